@@ -11,6 +11,7 @@ import (
 	"heckel.io/ntfy/v2/util"
 	"io"
 	"net/http"
+	"net/url"
 	"regexp"
 	"strings"
 	"sync"
@@ -162,6 +163,41 @@ func (c *Client) Poll(topic string, options ...SubscribeOption) ([]*Message, err
 	return messages, <-errChan
 }
 
+// Search performs a full-text search over the cached messages of a topic, and returns the matching messages,
+// newest first. All words in the query must match the message title, body or tags. Like Poll, the topic can be a
+// full URL, a short URL or a short name.
+//
+// By default, all cached messages will be searched, but you can change this behavior using a SubscribeOption,
+// e.g. WithSince or WithPriorityFilter.
+func (c *Client) Search(topic, query string, options ...SubscribeOption) ([]*Message, error) {
+	topicURL, err := c.expandTopicURL(topic)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(topicURL)
+	if err != nil {
+		return nil, err
+	}
+	topicName := strings.TrimPrefix(u.Path, "/")
+	u.Path = "/v1/search"
+	u.RawQuery = url.Values{"topic": {topicName}, "q": {query}}.Encode()
+	searchURL := u.String()
+	ctx := context.Background()
+	messages := make([]*Message, 0)
+	msgChan := make(chan *Message)
+	errChan := make(chan error)
+	log.Debug("%s Searching topic via %s", util.ShortTopicURL(topicURL), searchURL)
+	go func() {
+		err := performStreamRequest(ctx, msgChan, searchURL, topicURL, "", options...)
+		close(msgChan)
+		errChan <- err
+	}()
+	for m := range msgChan {
+		messages = append(messages, m)
+	}
+	return messages, <-errChan
+}
+
 // Subscribe subscribes to a topic to listen for newly incoming messages. The method starts a connection in the
 // background and returns new messages via the Messages channel.
 //
@@ -244,6 +280,10 @@ func handleSubscribeConnLoop(ctx context.Context, msgChan chan *Message, topicUR
 func performSubscribeRequest(ctx context.Context, msgChan chan *Message, topicURL string, subscriptionID string, options ...SubscribeOption) error {
 	streamURL := fmt.Sprintf("%s/json", topicURL)
 	log.Debug("%s Listening to %s", util.ShortTopicURL(topicURL), streamURL)
+	return performStreamRequest(ctx, msgChan, streamURL, topicURL, subscriptionID, options...)
+}
+
+func performStreamRequest(ctx context.Context, msgChan chan *Message, streamURL, topicURL, subscriptionID string, options ...SubscribeOption) error {
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, streamURL, nil)
 	if err != nil {
 		return err
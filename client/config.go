@@ -1,6 +1,8 @@
 package client
 
 import (
+	"errors"
+	"fmt"
 	"gopkg.in/yaml.v2"
 	"heckel.io/ntfy/v2/log"
 	"os"
@@ -13,12 +15,13 @@ const (
 
 // Config is the config struct for a Client
 type Config struct {
-	DefaultHost     string      `yaml:"default-host"`
-	DefaultUser     string      `yaml:"default-user"`
-	DefaultPassword *string     `yaml:"default-password"`
-	DefaultToken    string      `yaml:"default-token"`
-	DefaultCommand  string      `yaml:"default-command"`
-	Subscribe       []Subscribe `yaml:"subscribe"`
+	DefaultHost     string             `yaml:"default-host"`
+	DefaultUser     string             `yaml:"default-user"`
+	DefaultPassword *string            `yaml:"default-password"`
+	DefaultToken    string             `yaml:"default-token"`
+	DefaultCommand  string             `yaml:"default-command"`
+	Subscribe       []Subscribe        `yaml:"subscribe"`
+	Profiles        map[string]*Config `yaml:"profiles"`
 }
 
 // Subscribe is the struct for a Subscription within Config
@@ -28,6 +31,8 @@ type Subscribe struct {
 	Password *string           `yaml:"password"`
 	Token    *string           `yaml:"token"`
 	Command  string            `yaml:"command"`
+	Format   string            `yaml:"format"`
+	Env      map[string]string `yaml:"env"`
 	If       map[string]string `yaml:"if"`
 }
 
@@ -54,5 +59,24 @@ func LoadConfig(filename string) (*Config, error) {
 	if err := yaml.Unmarshal(b, c); err != nil {
 		return nil, err
 	}
+	for name, profile := range c.Profiles {
+		if profile == nil {
+			return nil, fmt.Errorf("profile %s is empty", name)
+		} else if len(profile.Profiles) > 0 {
+			return nil, fmt.Errorf("profile %s must not contain other profiles", name)
+		} else if profile.DefaultHost == "" {
+			profile.DefaultHost = DefaultBaseURL
+		}
+	}
 	return c, nil
 }
+
+// Profile returns the config of the named profile. A profile is a complete config of its own, i.e. options
+// that are not set in the profile (e.g. credentials) are not inherited from the top-level config.
+func (c *Config) Profile(name string) (*Config, error) {
+	profile, ok := c.Profiles[name]
+	if !ok {
+		return nil, errors.New("profile " + name + " not found in client config")
+	}
+	return profile, nil
+}
@@ -25,6 +25,9 @@ subscribe:
     command: notify-send -i /usr/share/ntfy/logo.png "Important" "$m"
     if:
             priority: high,urgent
+    format: '{{.Title}}: {{.Message}}'
+    env:
+            url: .attachment.url
   - topic: defaults
 `), 0600))
 
@@ -44,6 +47,8 @@ subscribe:
 	require.Equal(t, "alerts", conf.Subscribe[2].Topic)
 	require.Equal(t, `notify-send -i /usr/share/ntfy/logo.png "Important" "$m"`, conf.Subscribe[2].Command)
 	require.Equal(t, "high,urgent", conf.Subscribe[2].If["priority"])
+	require.Equal(t, "{{.Title}}: {{.Message}}", conf.Subscribe[2].Format)
+	require.Equal(t, ".attachment.url", conf.Subscribe[2].Env["url"])
 	require.Equal(t, "defaults", conf.Subscribe[3].Topic)
 }
 
@@ -138,3 +143,53 @@ subscribe:
 	require.Nil(t, conf.Subscribe[0].Password)
 	require.Nil(t, conf.Subscribe[0].Token)
 }
+
+func TestConfig_Profiles(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "client.yml")
+	require.Nil(t, os.WriteFile(filename, []byte(`
+default-host: https://ntfy.sh
+default-token: tk_AgQdq7mVBoFD37zQVN29RhuMzNIz2
+profiles:
+  work:
+    default-host: https://ntfy.example.com
+    default-user: phil
+    default-password: mypass
+    subscribe:
+      - topic: alerts
+  home:
+    default-command: 'echo "$message"'
+`), 0600))
+
+	conf, err := client.LoadConfig(filename)
+	require.Nil(t, err)
+	require.Equal(t, "https://ntfy.sh", conf.DefaultHost)
+
+	work, err := conf.Profile("work")
+	require.Nil(t, err)
+	require.Equal(t, "https://ntfy.example.com", work.DefaultHost)
+	require.Equal(t, "phil", work.DefaultUser)
+	require.Equal(t, "mypass", *work.DefaultPassword)
+	require.Equal(t, "", work.DefaultToken) // Not inherited
+	require.Equal(t, "alerts", work.Subscribe[0].Topic)
+
+	home, err := conf.Profile("home")
+	require.Nil(t, err)
+	require.Equal(t, client.DefaultBaseURL, home.DefaultHost)
+	require.Equal(t, `echo "$message"`, home.DefaultCommand)
+
+	_, err = conf.Profile("doesnotexist")
+	require.Error(t, err)
+}
+
+func TestConfig_Profiles_Nested(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "client.yml")
+	require.Nil(t, os.WriteFile(filename, []byte(`
+profiles:
+  work:
+    profiles:
+      home:
+        default-host: https://ntfy.example.com
+`), 0600))
+	_, err := client.LoadConfig(filename)
+	require.Error(t, err)
+}
@@ -133,6 +133,18 @@ func WithSinceUnixTime(since int64) SubscribeOption {
 	return WithSince(fmt.Sprintf("%d", since))
 }
 
+// WithUntil instructs the server to return only cached messages older or equal to the given Unix timestamp
+// or duration (e.g. 12h)
+func WithUntil(until string) SubscribeOption {
+	return WithQueryParam("until", until)
+}
+
+// WithLimit instructs the server to return at most the given number of cached messages (oldest first). To fetch
+// the next page, pass the ID of the last message via WithSince.
+func WithLimit(limit int) SubscribeOption {
+	return WithQueryParam("limit", fmt.Sprintf("%d", limit))
+}
+
 // WithPoll instructs the server to close the connection after messages have been returned. Don't use this option
 // directly. Use Client.Poll instead.
 func WithPoll() SubscribeOption {
@@ -3,11 +3,15 @@
 package cmd
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v2"
 	"heckel.io/ntfy/v2/user"
-	"heckel.io/ntfy/v2/util"
+	"io"
+	"os"
+	"time"
 )
 
 func init() {
@@ -21,6 +25,10 @@ const (
 var flagsAccess = append(
 	append([]cli.Flag{}, flagsUser...),
 	&cli.BoolFlag{Name: "reset", Aliases: []string{"r"}, Usage: "reset access for user (and topic)"},
+	&cli.BoolFlag{Name: "export", Usage: "export entire access control list and reservations to stdout"},
+	&cli.StringFlag{Name: "format", Value: "yaml", Usage: "output format of --export, either yaml or json"},
+	&cli.StringFlag{Name: "import", Usage: "import access control list and reservations from YAML/JSON file (- for stdin)"},
+	&cli.BoolFlag{Name: "dry-run", Usage: "only show the changes --import would make, without applying them"},
 )
 
 var cmdAccess = &cli.Command{
@@ -44,6 +52,8 @@ Usage:
   ntfy access                            # Shows access control list (alias: 'ntfy user list')
   ntfy access USERNAME                   # Shows access control entries for USERNAME
   ntfy access USERNAME TOPIC PERMISSION  # Allow/deny access for USERNAME to TOPIC
+  ntfy access --export [--format=json]   # Export access control list and reservations
+  ntfy access --import FILE [--dry-run]  # Replace access control list and reservations with FILE
 
 Arguments:
   USERNAME     an existing user, as created with 'ntfy user add', or "everyone"/"*"
@@ -54,6 +64,11 @@ Arguments:
                - read-only (aliases: read, ro)
                - write-only (aliases: write, wo)
                - deny (alias: none)
+               or a combination of the above (except deny) with one or more of the following,
+               separated by "+", e.g. "read-write+manage" or "read+write-no-cache":
+               - write-no-cache: publish messages, but only without caching them (Cache: no)
+               - attach: upload attachments (implied by write)
+               - manage: delete messages and mute senders
 
 Examples:
   ntfy access                        # Shows access control list (alias: 'ntfy user list')
@@ -61,20 +76,47 @@ Examples:
   ntfy access phil mytopic rw        # Allow read-write access to mytopic for user phil
   ntfy access everyone mytopic rw    # Allow anonymous read-write access to mytopic
   ntfy access everyone "up*" write   # Allow anonymous write-only access to topics "up..." 
+  ntfy access phil mytopic rw+manage # Allow read-write access to mytopic for user phil, and allow phil to manage it
   ntfy access --reset                # Reset entire access control list
   ntfy access --reset phil           # Reset all access for user phil
   ntfy access --reset phil mytopic   # Reset access for user phil and topic mytopic
+  ntfy access --export > acl.yml     # Export access control list and reservations to acl.yml
+  ntfy access --import acl.yml       # Apply acl.yml (only changes are applied, entries not in the file are removed)
+
+Import/export file format:
+  The file contains all user-specific access control entries and all reserved topics. It can be
+  written as YAML or JSON. Importing the same file twice has no effect, so it is safe to manage
+  the file in version control and import it after every change. Example:
+
+    access:
+      - user: phil
+        topic: "alerts*"
+        permission: read-write
+      - user: "*"                  # Anonymous access
+        topic: announcements
+        permission: read-only
+    reservations:
+      - user: phil
+        topic: phils-topic
+        everyone: deny-all
 `,
 }
 
 func execUserAccess(c *cli.Context) error {
 	if c.NArg() > 3 {
 		return errors.New("too many arguments, please check 'ntfy access --help' for usage details")
+	} else if (c.Bool("export") || c.String("import") != "") && (c.NArg() > 0 || c.Bool("reset")) {
+		return errors.New("--export and --import cannot be combined with other arguments, please check 'ntfy access --help' for usage details")
 	}
 	manager, err := createUserManager(c)
 	if err != nil {
 		return err
 	}
+	if c.Bool("export") {
+		return exportAccess(c, manager)
+	} else if filename := c.String("import"); filename != "" {
+		return importAccess(c, manager, filename, c.Bool("dry-run"))
+	}
 	username := c.Args().Get(0)
 	if username == userEveryone {
 		username = user.Everyone
@@ -97,12 +139,9 @@ func execUserAccess(c *cli.Context) error {
 }
 
 func changeAccess(c *cli.Context, manager *user.Manager, username string, topic string, perms string) error {
-	if !util.Contains([]string{"", "read-write", "rw", "read-only", "read", "ro", "write-only", "write", "wo", "none", "deny"}, perms) {
-		return errors.New("permission must be one of: read-write, read-only, write-only, or deny (or the aliases: read, ro, write, wo, none)")
-	}
 	permission, err := user.ParsePermission(perms)
 	if err != nil {
-		return err
+		return errors.New("permission must be one of: read-write, read-only, write-only, or deny (or the aliases: read, ro, write, wo, none), optionally combined with write-no-cache, attach or manage (e.g. rw+manage)")
 	}
 	u, err := manager.User(username)
 	if err == user.ErrUserNotFound {
@@ -113,7 +152,9 @@ func changeAccess(c *cli.Context, manager *user.Manager, username string, topic
 	if err := manager.AllowAccess(username, topic, permission); err != nil {
 		return err
 	}
-	if permission.IsReadWrite() {
+	if hasFineGrainedPermission(permission) {
+		fmt.Fprintf(c.App.ErrWriter, "granted %s access to topic %s\n\n", permission, topic)
+	} else if permission.IsReadWrite() {
 		fmt.Fprintf(c.App.ErrWriter, "granted read-write access to topic %s\n\n", topic)
 	} else if permission.IsRead() {
 		fmt.Fprintf(c.App.ErrWriter, "granted read-only access to topic %s\n\n", topic)
@@ -158,6 +199,73 @@ func resetUserTopicAccess(c *cli.Context, manager *user.Manager, username string
 	return showUserAccess(c, manager, username)
 }
 
+func exportAccess(c *cli.Context, manager *user.Manager) error {
+	list, err := manager.ExportAccess()
+	if err != nil {
+		return err
+	}
+	var b []byte
+	switch c.String("format") {
+	case "yaml":
+		b, err = yaml.Marshal(list)
+	case "json":
+		b, err = json.MarshalIndent(list, "", "  ")
+		b = append(b, '\n')
+	default:
+		return errors.New("format must be one of: yaml, json")
+	}
+	if err != nil {
+		return err
+	}
+	_, err = c.App.Writer.Write(b)
+	return err
+}
+
+func importAccess(c *cli.Context, manager *user.Manager, filename string, dryRun bool) error {
+	var b []byte
+	var err error
+	if filename == "-" {
+		b, err = io.ReadAll(c.App.Reader)
+	} else {
+		b, err = os.ReadFile(filename)
+	}
+	if err != nil {
+		return err
+	}
+	var list user.AccessList
+	if err := yaml.UnmarshalStrict(b, &list); err != nil { // JSON is valid YAML
+		return fmt.Errorf("cannot parse access control list: %w", err)
+	}
+	changes, err := manager.ImportAccess(&list, dryRun)
+	if err != nil {
+		return err
+	}
+	for _, entry := range changes.AccessAdded {
+		fmt.Fprintf(c.App.ErrWriter, "+ %s access to topic %s for user %s\n", entry.Permission, entry.Topic, entry.User)
+	}
+	for _, entry := range changes.AccessChanged {
+		fmt.Fprintf(c.App.ErrWriter, "~ %s access to topic %s for user %s\n", entry.Permission, entry.Topic, entry.User)
+	}
+	for _, entry := range changes.AccessRemoved {
+		fmt.Fprintf(c.App.ErrWriter, "- %s access to topic %s for user %s\n", entry.Permission, entry.Topic, entry.User)
+	}
+	for _, entry := range changes.ReservationsAdded {
+		fmt.Fprintf(c.App.ErrWriter, "+ reservation of topic %s for user %s (everyone: %s)\n", entry.Topic, entry.User, entry.Everyone)
+	}
+	for _, entry := range changes.ReservationsChanged {
+		fmt.Fprintf(c.App.ErrWriter, "~ reservation of topic %s for user %s (everyone: %s)\n", entry.Topic, entry.User, entry.Everyone)
+	}
+	for _, entry := range changes.ReservationsRemoved {
+		fmt.Fprintf(c.App.ErrWriter, "- reservation of topic %s for user %s (everyone: %s)\n", entry.Topic, entry.User, entry.Everyone)
+	}
+	if dryRun {
+		fmt.Fprintf(c.App.ErrWriter, "dry run: %d change(s) would be applied\n", changes.Count())
+	} else {
+		fmt.Fprintf(c.App.ErrWriter, "%d change(s) applied\n", changes.Count())
+	}
+	return nil
+}
+
 func showAccess(c *cli.Context, manager *user.Manager, username string) error {
 	if username == "" {
 		return showAllAccess(c, manager)
@@ -194,11 +302,20 @@ func showUsers(c *cli.Context, manager *user.Manager, users []*user.User) error
 			tier = u.Tier.Name
 		}
 		fmt.Fprintf(c.App.ErrWriter, "user %s (role: %s, tier: %s)\n", u.Name, u.Role, tier)
+		if u.IsSuspended() {
+			if u.Suspension.Until.Unix() == 0 {
+				fmt.Fprintf(c.App.ErrWriter, "- account suspended indefinitely\n")
+			} else {
+				fmt.Fprintf(c.App.ErrWriter, "- account suspended until %s\n", u.Suspension.Until.Format(time.UnixDate))
+			}
+		}
 		if u.Role == user.RoleAdmin {
 			fmt.Fprintf(c.App.ErrWriter, "- read-write access to all topics (admin role)\n")
 		} else if len(grants) > 0 {
 			for _, grant := range grants {
-				if grant.Allow.IsReadWrite() {
+				if hasFineGrainedPermission(grant.Allow) {
+					fmt.Fprintf(c.App.ErrWriter, "- %s access to topic %s\n", grant.Allow, grant.TopicPattern)
+				} else if grant.Allow.IsReadWrite() {
 					fmt.Fprintf(c.App.ErrWriter, "- read-write access to topic %s\n", grant.TopicPattern)
 				} else if grant.Allow.IsRead() {
 					fmt.Fprintf(c.App.ErrWriter, "- read-only access to topic %s\n", grant.TopicPattern)
@@ -213,7 +330,9 @@ func showUsers(c *cli.Context, manager *user.Manager, users []*user.User) error
 		}
 		if u.Name == user.Everyone {
 			access := manager.DefaultAccess()
-			if access.IsReadWrite() {
+			if hasFineGrainedPermission(access) {
+				fmt.Fprintf(c.App.ErrWriter, "- %s access to all (other) topics (server config)\n", access)
+			} else if access.IsReadWrite() {
 				fmt.Fprintln(c.App.ErrWriter, "- read-write access to all (other) topics (server config)")
 			} else if access.IsRead() {
 				fmt.Fprintln(c.App.ErrWriter, "- read-only access to all (other) topics (server config)")
@@ -226,3 +345,9 @@ func showUsers(c *cli.Context, manager *user.Manager, users []*user.User) error
 	}
 	return nil
 }
+
+// hasFineGrainedPermission returns true if the permission includes anything other than read/write
+// permissions, e.g. "manage". Such permissions are printed in their string representation.
+func hasFineGrainedPermission(p user.Permission) bool {
+	return p&^user.PermissionReadWrite != 0
+}
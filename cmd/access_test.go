@@ -6,6 +6,8 @@ import (
 	"github.com/urfave/cli/v2"
 	"heckel.io/ntfy/v2/server"
 	"heckel.io/ntfy/v2/test"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -76,6 +78,87 @@ user * (role: anonymous, tier: none)
 	}))
 }
 
+func TestCLI_Access_Grant_FineGrained(t *testing.T) {
+	s, conf, port := newTestServerWithAuth(t)
+	defer test.StopServer(t, s, port)
+
+	app, stdin, _, _ := newTestApp()
+	stdin.WriteString("benpass\nbenpass")
+	require.Nil(t, runUserCommand(app, conf, "add", "ben"))
+
+	app, _, _, stderr := newTestApp()
+	require.Nil(t, runAccessCommand(app, conf, "ben", "announcements", "rw+manage"))
+	require.Contains(t, stderr.String(), "granted read-write+manage access to topic announcements")
+
+	app, _, _, _ = newTestApp()
+	require.Nil(t, runAccessCommand(app, conf, "ben", "alerts", "write-no-cache"))
+	require.Error(t, runAccessCommand(app, conf, "ben", "alerts", "rw+superpowers"))
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runAccessCommand(app, conf, "ben"))
+	expected := `user ben (role: user, tier: none)
+- read-write+manage access to topic announcements
+- write-no-cache access to topic alerts
+`
+	require.Equal(t, expected, stderr.String())
+}
+
+func TestCLI_Access_Export_Import(t *testing.T) {
+	s, conf, port := newTestServerWithAuth(t)
+	defer test.StopServer(t, s, port)
+
+	app, stdin, _, _ := newTestApp()
+	stdin.WriteString("benpass\nbenpass")
+	require.Nil(t, runUserCommand(app, conf, "add", "ben"))
+	require.Nil(t, runAccessCommand(app, conf, "ben", "announcements", "rw"))
+
+	app, _, stdout, _ := newTestApp()
+	require.Nil(t, runAccessCommand(app, conf, "--export"))
+	require.Equal(t, `access:
+- user: ben
+  topic: announcements
+  permission: read-write
+reservations: []
+`, stdout.String())
+
+	filename := filepath.Join(t.TempDir(), "acl.yml")
+	require.Nil(t, os.WriteFile(filename, []byte(`
+access:
+  - user: ben
+    topic: "alerts*"
+    permission: ro
+  - user: "*"
+    topic: announcements
+    permission: read
+reservations:
+  - user: ben
+    topic: bens-topic
+    everyone: deny
+`), 0600))
+
+	app, _, _, stderr := newTestApp()
+	require.Nil(t, runAccessCommand(app, conf, "--import", filename, "--dry-run"))
+	require.Contains(t, stderr.String(), "+ read-only access to topic alerts* for user ben\n")
+	require.Contains(t, stderr.String(), "- read-write access to topic announcements for user ben\n")
+	require.Contains(t, stderr.String(), "+ reservation of topic bens-topic for user ben (everyone: deny-all)\n")
+	require.Contains(t, stderr.String(), "dry run: 4 change(s) would be applied")
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runAccessCommand(app, conf, "--import", filename))
+	require.Contains(t, stderr.String(), "4 change(s) applied")
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runAccessCommand(app, conf, "--import", filename))
+	require.Equal(t, "0 change(s) applied\n", stderr.String())
+
+	app, _, stdout, _ = newTestApp()
+	require.Nil(t, runAccessCommand(app, conf, "--export", "--format=json"))
+	require.Contains(t, stdout.String(), `"topic": "bens-topic"`)
+
+	app, _, _, _ = newTestApp()
+	require.Error(t, runAccessCommand(app, conf, "--export", "ben"))
+}
+
 func runAccessCommand(app *cli.App, conf *server.Config, args ...string) error {
 	userArgs := []string{
 		"ntfy",
@@ -43,7 +43,7 @@ func New() *cli.App {
 		Writer:                 os.Stdout,
 		ErrWriter:              os.Stderr,
 		Commands:               commands,
-		Flags:                  flagsDefault,
+		Flags:                  append(append([]cli.Flag{}, flagsDefault...), flagProfile),
 		Before:                 initLogFunc,
 	}
 }
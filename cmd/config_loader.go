@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"github.com/urfave/cli/v2"
 	"github.com/urfave/cli/v2/altsrc"
@@ -13,6 +14,7 @@ import (
 // if the config flag is exists and only loads it if it does. If the flag is set and the file exists, it fails.
 func initConfigFileInputSourceFunc(configFlag string, flags []cli.Flag, next cli.BeforeFunc) cli.BeforeFunc {
 	return func(context *cli.Context) error {
+		rememberCommandLineFlags(context, flags)
 		configFile := context.String(configFlag)
 		if context.IsSet(configFlag) && !util.FileExists(configFile) {
 			return fmt.Errorf("config file %s does not exist", configFile)
@@ -35,6 +37,27 @@ func initConfigFileInputSourceFunc(configFlag string, flags []cli.Flag, next cli
 	}
 }
 
+type commandLineFlagsKey struct{}
+
+// rememberCommandLineFlags stores the names of the flags that were set on the command line (or via environment
+// variables) in the context, before the config file values are applied. See commandLineFlags.
+func rememberCommandLineFlags(c *cli.Context, flags []cli.Flag) {
+	names := make(map[string]bool)
+	for _, f := range flags {
+		if c.IsSet(f.Names()[0]) {
+			names[f.Names()[0]] = true
+		}
+	}
+	c.Context = context.WithValue(c.Context, commandLineFlagsKey{}, names)
+}
+
+// commandLineFlags returns the names of the flags that were set on the command line (or via environment variables),
+// as opposed to the config file, see rememberCommandLineFlags
+func commandLineFlags(c *cli.Context) map[string]bool {
+	names, _ := c.Context.Value(commandLineFlagsKey{}).(map[string]bool)
+	return names
+}
+
 // newYamlSourceFromFile creates a new Yaml InputSourceContext from a filepath.
 //
 // This function also maps aliases, so a .yml file can contain short options, or options with underscores
@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
 	"github.com/urfave/cli/v2"
@@ -22,6 +23,7 @@ func init() {
 var flagsPublish = append(
 	append([]cli.Flag{}, flagsDefault...),
 	&cli.StringFlag{Name: "config", Aliases: []string{"c"}, EnvVars: []string{"NTFY_CONFIG"}, Usage: "client config file"},
+	flagProfile,
 	&cli.StringFlag{Name: "title", Aliases: []string{"t"}, EnvVars: []string{"NTFY_TITLE"}, Usage: "message title"},
 	&cli.StringFlag{Name: "message", Aliases: []string{"m"}, EnvVars: []string{"NTFY_MESSAGE"}, Usage: "message body"},
 	&cli.StringFlag{Name: "priority", Aliases: []string{"p"}, EnvVars: []string{"NTFY_PRIORITY"}, Usage: "priority of the message (1=min, 2=low, 3=default, 4=high, 5=max)"},
@@ -41,6 +43,9 @@ var flagsPublish = append(
 	&cli.BoolFlag{Name: "wait-cmd", Aliases: []string{"wait_cmd", "cmd", "done"}, EnvVars: []string{"NTFY_WAIT_CMD"}, Usage: "run command and wait until it finishes before publishing"},
 	&cli.BoolFlag{Name: "no-cache", Aliases: []string{"no_cache", "C"}, EnvVars: []string{"NTFY_NO_CACHE"}, Usage: "do not cache message server-side"},
 	&cli.BoolFlag{Name: "no-firebase", Aliases: []string{"no_firebase", "F"}, EnvVars: []string{"NTFY_NO_FIREBASE"}, Usage: "do not forward message to Firebase"},
+	&cli.BoolFlag{Name: "tail", EnvVars: []string{"NTFY_TAIL"}, Usage: "read stdin line by line and publish every line as a message, until stdin is closed"},
+	&cli.DurationFlag{Name: "tail-batch-timeout", Aliases: []string{"tail_batch_timeout"}, EnvVars: []string{"NTFY_TAIL_BATCH_TIMEOUT"}, Usage: "with --tail, combine lines read within `TIMEOUT` into one message"},
+	&cli.IntFlag{Name: "tail-batch-size", Aliases: []string{"tail_batch_size"}, EnvVars: []string{"NTFY_TAIL_BATCH_SIZE"}, Usage: "with --tail, publish at most `LINES` lines per message"},
 	&cli.BoolFlag{Name: "quiet", Aliases: []string{"q"}, EnvVars: []string{"NTFY_QUIET"}, Usage: "do not print message"},
 )
 
@@ -50,6 +55,7 @@ var cmdPublish = &cli.Command{
 	Usage:   "Send message via a ntfy server",
 	UsageText: `ntfy publish [OPTIONS..] TOPIC [MESSAGE...]
 ntfy publish [OPTIONS..] --wait-cmd COMMAND...
+ntfy publish [OPTIONS..] --tail TOPIC
 NTFY_TOPIC=.. ntfy publish [OPTIONS..] [MESSAGE...]`,
 	Action:   execPublish,
 	Category: categoryClient,
@@ -72,6 +78,8 @@ Examples:
   ntfy pub -u phil:mypass secret Psst                     # Publish with username/password
   ntfy pub --wait-pid 1234 mytopic                        # Wait for process 1234 to exit before publishing
   ntfy pub --wait-cmd mytopic rsync -av ./ /tmp/a         # Run command and publish after it completes
+  journalctl -f | ntfy pub --tail mylogs                  # Publish every line of the log as a message
+  journalctl -f | ntfy pub --tail --tail-batch-timeout=10s mylogs  # Combine lines of 10s into one message
   NTFY_USER=phil:mypass ntfy pub secret Psst              # Use env variables to set username/password
   NTFY_TOPIC=mytopic ntfy pub "some message"              # Use NTFY_TOPIC variable as topic 
   cat flower.jpg | ntfy pub --file=- flowers 'Nice!'      # Same as above, send image.jpg as attachment
@@ -106,10 +114,17 @@ func execPublish(c *cli.Context) error {
 	noFirebase := c.Bool("no-firebase")
 	quiet := c.Bool("quiet")
 	pid := c.Int("wait-pid")
+	tail := c.Bool("tail")
+	tailBatchTimeout := c.Duration("tail-batch-timeout")
+	tailBatchSize := c.Int("tail-batch-size")
 
 	// Checks
 	if user != "" && token != "" {
 		return errors.New("cannot set both --user and --token")
+	} else if tail && (file != "" || pid > 0 || c.Bool("wait-cmd")) {
+		return errors.New("cannot set --tail together with --file, --wait-pid or --wait-cmd")
+	} else if tailBatchSize < 0 || tailBatchTimeout < 0 {
+		return errors.New("--tail-batch-size and --tail-batch-timeout must not be negative")
 	}
 
 	// Do the things
@@ -180,6 +195,12 @@ func execPublish(c *cli.Context) error {
 	} else if conf.DefaultUser != "" && conf.DefaultPassword != nil {
 		options = append(options, client.WithBasicAuth(conf.DefaultUser, *conf.DefaultPassword))
 	}
+	if tail {
+		if message != "" {
+			return errors.New("cannot set a message with --tail, messages are read from stdin")
+		}
+		return publishTail(c, client.New(conf), topic, tailBatchTimeout, tailBatchSize, quiet, options...)
+	}
 	if pid > 0 {
 		newMessage, err := waitForProcess(pid)
 		if err != nil {
@@ -228,6 +249,58 @@ func execPublish(c *cli.Context) error {
 	return nil
 }
 
+// publishTail reads stdin line by line, and publishes the lines until stdin is closed. If a batch timeout is set,
+// all lines read within the timeout (starting with the first line of a batch) are combined into one message, up to
+// the batch size. Empty lines are skipped. Publishing errors are logged, but do not stop the tail.
+func publishTail(c *cli.Context, cl *client.Client, topic string, batchTimeout time.Duration, batchSize int, quiet bool, options ...client.PublishOption) error {
+	lines := make(chan string)
+	errChan := make(chan error, 1)
+	go func() {
+		scanner := bufio.NewScanner(c.App.Reader)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		errChan <- scanner.Err()
+		close(lines)
+	}()
+	batch := make([]string, 0)
+	publish := func() {
+		if len(batch) == 0 {
+			return
+		}
+		log.Debug("Publishing %d line(s) to %s", len(batch), topic)
+		m, err := cl.Publish(topic, strings.Join(batch, "\n"), options...)
+		batch = batch[:0]
+		if err != nil {
+			log.Warn("Unable to publish to %s: %s", topic, err.Error())
+		} else if !quiet {
+			fmt.Fprintln(c.App.Writer, strings.TrimSpace(m.Raw))
+		}
+	}
+	var timeout <-chan time.Time
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				publish()
+				return <-errChan
+			} else if strings.TrimSpace(line) == "" {
+				continue
+			}
+			batch = append(batch, line)
+			if batchTimeout == 0 || (batchSize > 0 && len(batch) >= batchSize) {
+				publish()
+				timeout = nil
+			} else if timeout == nil {
+				timeout = time.After(batchTimeout)
+			}
+		case <-timeout:
+			publish()
+			timeout = nil
+		}
+	}
+}
+
 // parseTopicMessageCommand reads the topic and the remaining arguments from the context.
 
 // There are a few cases to consider:
@@ -5,6 +5,7 @@ import (
 	"github.com/stretchr/testify/require"
 	"heckel.io/ntfy/v2/test"
 	"heckel.io/ntfy/v2/util"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -298,3 +299,95 @@ func TestCLI_Publish_Token_And_UserPass(t *testing.T) {
 	require.Error(t, err)
 	require.Equal(t, "cannot set both --user and --token", err.Error())
 }
+
+func TestCLI_Publish_Tail(t *testing.T) {
+	var messages []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/mytopic", r.URL.Path)
+		require.Equal(t, "Logs", r.Header.Get("X-Title"))
+		body, _ := io.ReadAll(r.Body)
+		messages = append(messages, string(body))
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(fmt.Sprintf(`{"id":"RXIQBFaieLVr","event":"message","topic":"mytopic","message":%q}`, string(body))))
+	}))
+	defer server.Close()
+
+	app, stdin, stdout, _ := newTestApp()
+	stdin.WriteString("line 1\nline 2\n\nline 3\n")
+	require.Nil(t, app.Run([]string{"ntfy", "publish", "--tail", "--title", "Logs", server.URL + "/mytopic"}))
+	require.Equal(t, []string{"line 1", "line 2", "line 3"}, messages)
+	require.Equal(t, 3, len(strings.Split(strings.TrimSpace(stdout.String()), "\n")))
+}
+
+func TestCLI_Publish_Tail_Batch(t *testing.T) {
+	var messages []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		messages = append(messages, string(body))
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"id":"RXIQBFaieLVr","event":"message","topic":"mytopic"}`))
+	}))
+	defer server.Close()
+
+	// Batches are published when the batch size is reached, and the rest when stdin is closed
+	app, stdin, _, _ := newTestApp()
+	stdin.WriteString("line 1\nline 2\nline 3\nline 4\nline 5\n")
+	require.Nil(t, app.Run([]string{"ntfy", "publish", "--tail", "--tail-batch-timeout", "1h", "--tail-batch-size", "2", "--quiet", server.URL + "/mytopic"}))
+	require.Equal(t, []string{"line 1\nline 2", "line 3\nline 4", "line 5"}, messages)
+
+	// Batches are published after the timeout
+	messages = nil
+	reader, writer := io.Pipe()
+	app, _, _, _ = newTestApp()
+	app.Reader = reader
+	done := make(chan error)
+	go func() {
+		done <- app.Run([]string{"ntfy", "publish", "--tail", "--tail-batch-timeout", "200ms", "--quiet", server.URL + "/mytopic"})
+	}()
+	writer.Write([]byte("line 1\nline 2\n"))
+	time.Sleep(500 * time.Millisecond)
+	writer.Write([]byte("line 3\n"))
+	writer.Close()
+	require.Nil(t, <-done)
+	require.Equal(t, []string{"line 1\nline 2", "line 3"}, messages)
+}
+
+func TestCLI_Publish_Tail_Invalid(t *testing.T) {
+	app, _, _, _ := newTestApp()
+	require.Error(t, app.Run([]string{"ntfy", "publish", "--tail", "--file", "somefile", "mytopic"}))
+	app, _, _, _ = newTestApp()
+	require.Error(t, app.Run([]string{"ntfy", "publish", "--tail", "mytopic", "some message"}))
+}
+
+func TestCLI_Publish_Profile(t *testing.T) {
+	message := `{"id":"RXIQBFaieLVr","time":124,"expires":1124,"event":"message","topic":"mytopic","message":"triggered"}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/mytopic", r.URL.Path)
+		require.Equal(t, "Bearer tk_work", r.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(message))
+	}))
+	defer server.Close()
+
+	filename := filepath.Join(t.TempDir(), "client.yml")
+	require.Nil(t, os.WriteFile(filename, []byte(fmt.Sprintf(`
+default-host: http://127.0.0.1:1
+default-token: tk_default
+profiles:
+  work:
+    default-host: %s
+    default-token: tk_work
+`, server.URL)), 0600))
+
+	// Profile before and after the command
+	app, _, stdout, _ := newTestApp()
+	require.Nil(t, app.Run([]string{"ntfy", "--profile", "work", "publish", "--config=" + filename, "mytopic", "triggered"}))
+	require.Equal(t, "triggered", toMessage(t, stdout.String()).Message)
+
+	app, _, stdout, _ = newTestApp()
+	require.Nil(t, app.Run([]string{"ntfy", "publish", "--config=" + filename, "--profile=work", "mytopic", "triggered"}))
+	require.Equal(t, "triggered", toMessage(t, stdout.String()).Message)
+
+	app, _, _, _ = newTestApp()
+	require.Error(t, app.Run([]string{"ntfy", "publish", "--config=" + filename, "--profile=home", "mytopic", "triggered"}))
+}
@@ -1,17 +1,21 @@
 package cmd
 
 import (
+	"flag"
 	"fmt"
 	"math/rand"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+	"github.com/urfave/cli/v2/altsrc"
 	"heckel.io/ntfy/v2/client"
 	"heckel.io/ntfy/v2/test"
 	"heckel.io/ntfy/v2/util"
@@ -84,8 +88,56 @@ func TestIP_Host_Parsing(t *testing.T) {
 	}
 }
 
+func TestCLI_Serve_ParseCachePriorityMultipliers(t *testing.T) {
+	multipliers, err := parseCachePriorityMultipliers("5:4, high:2,1:0.5")
+	require.Nil(t, err)
+	require.Equal(t, map[int]float64{5: 4, 4: 2, 1: 0.5}, multipliers)
+
+	multipliers, err = parseCachePriorityMultipliers("")
+	require.Nil(t, err)
+	require.Equal(t, 0, len(multipliers))
+
+	for _, invalid := range []string{"5", "6:2", "5:0", "5:-1", "low:abc"} {
+		_, err := parseCachePriorityMultipliers(invalid)
+		require.NotNil(t, err, invalid)
+	}
+}
+
 func newEmptyFile(t *testing.T) string {
 	filename := filepath.Join(t.TempDir(), "empty")
 	require.Nil(t, os.WriteFile(filename, []byte{}, 0600))
 	return filename
 }
+
+func TestCLI_Serve_ReloadServerConfig(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "server.yml")
+	contents := `
+visitor-request-limit-burst: 5
+visitor-email-limit-burst: 3
+disallowed-topics: [secret, admin]
+`
+	require.Nil(t, os.WriteFile(configFile, []byte(contents), 0600))
+	inputSource, err := newYamlSourceFromFile(configFile, flagsServe)
+	require.Nil(t, err)
+
+	app, _, _, _ := newTestApp()
+	set := flag.NewFlagSet("serve", flag.ContinueOnError)
+	for _, f := range flagsServe {
+		require.Nil(t, f.Apply(set))
+	}
+	require.Nil(t, set.Parse([]string{"--config=" + configFile, "--visitor-request-limit-burst=7"}))
+	c := cli.NewContext(app, set, nil)
+	rememberCommandLineFlags(c, flagsServe)
+	require.Nil(t, altsrc.ApplyInputSourceValues(c, inputSource, flagsServe)) // As done at startup
+	require.Equal(t, 3, c.Int("visitor-email-limit-burst"))
+
+	require.Nil(t, os.WriteFile(configFile, []byte(strings.ReplaceAll(contents, "burst: 3", "burst: 4")), 0600))
+	inputSource, err = newYamlSourceFromFile(configFile, flagsServe)
+	require.Nil(t, err)
+
+	conf, err := newReloadedServerConfig(c, inputSource)
+	require.Nil(t, err)
+	require.Equal(t, 7, conf.VisitorRequestLimitBurst) // Command line takes precedence
+	require.Equal(t, 4, conf.VisitorEmailLimitBurst)
+	require.Equal(t, []string{"secret", "admin"}, conf.DisallowedTopics[:2])
+}
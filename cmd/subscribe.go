@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/urfave/cli/v2"
@@ -11,8 +12,10 @@ import (
 	"os/exec"
 	"os/user"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strings"
+	"text/template"
 )
 
 func init() {
@@ -25,15 +28,28 @@ const (
 	clientUserConfigFileWindowsRelative = "ntfy\\client.yml"
 )
 
+var (
+	envVarNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// flagProfile is defined both globally (ntfy --profile work publish ..) and for the client commands
+var flagProfile = &cli.StringFlag{Name: "profile", EnvVars: []string{"NTFY_PROFILE"}, Usage: "use named `PROFILE` from the client config file"}
+
 var flagsSubscribe = append(
 	append([]cli.Flag{}, flagsDefault...),
 	&cli.StringFlag{Name: "config", Aliases: []string{"c"}, Usage: "client config file"},
+	flagProfile,
 	&cli.StringFlag{Name: "since", Aliases: []string{"s"}, Usage: "return events since `SINCE` (Unix timestamp, or all)"},
+	&cli.StringFlag{Name: "until", Usage: "return cached events until `UNTIL` (Unix timestamp, or duration)"},
+	&cli.IntFlag{Name: "limit", Usage: "return at most `LIMIT` cached events"},
 	&cli.StringFlag{Name: "user", Aliases: []string{"u"}, EnvVars: []string{"NTFY_USER"}, Usage: "username[:password] used to auth against the server"},
 	&cli.StringFlag{Name: "token", Aliases: []string{"k"}, EnvVars: []string{"NTFY_TOKEN"}, Usage: "access token used to auth against the server"},
 	&cli.BoolFlag{Name: "from-config", Aliases: []string{"from_config", "C"}, Usage: "read subscriptions from config file (service mode)"},
 	&cli.BoolFlag{Name: "poll", Aliases: []string{"p"}, Usage: "return events and exit, do not listen for new events"},
 	&cli.BoolFlag{Name: "scheduled", Aliases: []string{"sched", "S"}, Usage: "also return scheduled/delayed events"},
+	&cli.StringFlag{Name: "search", Aliases: []string{"q"}, Usage: "return cached events matching `QUERY` and exit (implies --poll)"},
+	&cli.StringFlag{Name: "format", Aliases: []string{"f"}, Usage: "print events using Go template `TEMPLATE` (e.g. '{{.Title}}: {{.Message}}'), or pass it to COMMAND as $NTFY_FORMATTED"},
+	&cli.StringSliceFlag{Name: "env", Aliases: []string{"e"}, Usage: "pass JSON field to COMMAND as environment variable, e.g. url=.attachment.url (can be repeated)"},
 )
 
 var cmdSubscribe = &cli.Command{
@@ -57,7 +73,9 @@ ntfy subscribe TOPIC
     ntfy subscribe mytopic            # Prints JSON for incoming messages for ntfy.sh/mytopic
     ntfy sub home.lan/backups         # Subscribe to topic on different server
     ntfy sub --poll home.lan/backups  # Just query for latest messages and exit
+    ntfy sub --search "disk full" home.lan/backups  # Search cached messages and exit
     ntfy sub -u phil:mypass secret    # Subscribe with username/password
+    ntfy sub --format '{{.Title}}: {{.Message}}' mytopic  # Print formatted messages instead of JSON
   
 ntfy subscribe TOPIC COMMAND
   This executes COMMAND for every incoming messages. The message fields are passed to the
@@ -73,10 +91,15 @@ ntfy subscribe TOPIC COMMAND
     $NTFY_PRIORITY  $priority, $prio, $p  Message priority (1=min, 5=max)
     $NTFY_TAGS      $tags, $tag, $ta      Message tags (comma separated list)
     $NTFY_RAW       $raw                  Raw JSON message
+    $NTFY_FORMATTED $formatted            Message rendered with --format (if set)
+
+  Additional variables can be extracted from the JSON message with --env NAME=FILTER,
+  using jq-like field filters such as .click, .attachment.url or .actions[0].url.
 
   Examples:
     ntfy sub mytopic 'notify-send "$m"'    # Execute command for incoming messages
     ntfy sub topic1 myscript.sh            # Execute script for incoming messages
+    ntfy sub --env url=.attachment.url topic1 'wget "$url"'  # Download attachments
 
 ntfy subscribe --from-config
   Service mode (used in ntfy-client.service). This reads the config file and sets up 
@@ -97,10 +120,13 @@ func execSubscribe(c *cli.Context) error {
 	}
 	cl := client.New(conf)
 	since := c.String("since")
+	until := c.String("until")
+	limit := c.Int("limit")
 	user := c.String("user")
 	token := c.String("token")
 	poll := c.Bool("poll")
 	scheduled := c.Bool("scheduled")
+	search := c.String("search")
 	fromConfig := c.Bool("from-config")
 	topic := c.Args().Get(0)
 	command := c.Args().Get(1)
@@ -109,14 +135,29 @@ func execSubscribe(c *cli.Context) error {
 	if user != "" && token != "" {
 		return errors.New("cannot set both --user and --token")
 	}
+	handler, err := newMessageHandler(command, c.String("format"), parseEnvFilters(c.StringSlice("env")))
+	if err != nil {
+		return err
+	}
 
 	if !fromConfig {
 		conf.Subscribe = nil // wipe if --from-config not passed
 	}
+	for _, sub := range conf.Subscribe {
+		if _, err := newSubscriptionHandler(sub, conf); err != nil {
+			return fmt.Errorf("invalid subscription for topic %s: %w", sub.Topic, err)
+		}
+	}
 	var options []client.SubscribeOption
 	if since != "" {
 		options = append(options, client.WithSince(since))
 	}
+	if until != "" {
+		options = append(options, client.WithUntil(until))
+	}
+	if limit > 0 {
+		options = append(options, client.WithLimit(limit))
+	}
 	if token != "" {
 		options = append(options, client.WithBearerAuth(token))
 	} else if user != "" {
@@ -147,44 +188,64 @@ func execSubscribe(c *cli.Context) error {
 		return errors.New("must specify topic, type 'ntfy subscribe --help' for help")
 	}
 
-	// Execute poll or subscribe
-	if poll {
-		return doPoll(c, cl, conf, topic, command, options...)
+	// Execute search, poll or subscribe
+	if search != "" {
+		if topic == "" {
+			return errors.New("must specify topic when searching, type 'ntfy subscribe --help' for help")
+		}
+		return doSearch(c, cl, topic, search, handler, options...)
+	} else if poll {
+		return doPoll(c, cl, conf, topic, handler, options...)
 	}
-	return doSubscribe(c, cl, conf, topic, command, options...)
+	return doSubscribe(c, cl, conf, topic, handler, options...)
 }
 
-func doPoll(c *cli.Context, cl *client.Client, conf *client.Config, topic, command string, options ...client.SubscribeOption) error {
+func doPoll(c *cli.Context, cl *client.Client, conf *client.Config, topic string, handler *messageHandler, options ...client.SubscribeOption) error {
 	for _, s := range conf.Subscribe { // may be nil
 		if auth := maybeAddAuthHeader(s, conf); auth != nil {
 			options = append(options, auth)
 		}
-		if err := doPollSingle(c, cl, s.Topic, s.Command, options...); err != nil {
+		subscriptionHandler, err := newSubscriptionHandler(s, nil)
+		if err != nil {
+			return err
+		}
+		if err := doPollSingle(c, cl, s.Topic, subscriptionHandler, options...); err != nil {
 			return err
 		}
 	}
 	if topic != "" {
-		if err := doPollSingle(c, cl, topic, command, options...); err != nil {
+		if err := doPollSingle(c, cl, topic, handler, options...); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func doPollSingle(c *cli.Context, cl *client.Client, topic, command string, options ...client.SubscribeOption) error {
+func doPollSingle(c *cli.Context, cl *client.Client, topic string, handler *messageHandler, options ...client.SubscribeOption) error {
 	messages, err := cl.Poll(topic, options...)
 	if err != nil {
 		return err
 	}
 	for _, m := range messages {
-		printMessageOrRunCommand(c, m, command)
+		printMessageOrRunCommand(c, m, handler)
+	}
+	return nil
+}
+
+func doSearch(c *cli.Context, cl *client.Client, topic, query string, handler *messageHandler, options ...client.SubscribeOption) error {
+	messages, err := cl.Search(topic, query, options...)
+	if err != nil {
+		return err
+	}
+	for _, m := range messages {
+		printMessageOrRunCommand(c, m, handler)
 	}
 	return nil
 }
 
-func doSubscribe(c *cli.Context, cl *client.Client, conf *client.Config, topic, command string, options ...client.SubscribeOption) error {
-	cmds := make(map[string]string)    // Subscription ID -> command
-	for _, s := range conf.Subscribe { // May be nil
+func doSubscribe(c *cli.Context, cl *client.Client, conf *client.Config, topic string, handler *messageHandler, options ...client.SubscribeOption) error {
+	handlers := make(map[string]*messageHandler) // Subscription ID -> handler
+	for _, s := range conf.Subscribe {           // May be nil
 		topicOptions := append(make([]client.SubscribeOption, 0), options...)
 		for filter, value := range s.If {
 			topicOptions = append(topicOptions, client.WithFilter(filter, value))
@@ -198,28 +259,26 @@ func doSubscribe(c *cli.Context, cl *client.Client, conf *client.Config, topic,
 		if err != nil {
 			return err
 		}
-		if s.Command != "" {
-			cmds[subscriptionID] = s.Command
-		} else if conf.DefaultCommand != "" {
-			cmds[subscriptionID] = conf.DefaultCommand
-		} else {
-			cmds[subscriptionID] = ""
+		subscriptionHandler, err := newSubscriptionHandler(s, conf)
+		if err != nil {
+			return err
 		}
+		handlers[subscriptionID] = subscriptionHandler
 	}
 	if topic != "" {
 		subscriptionID, err := cl.Subscribe(topic, options...)
 		if err != nil {
 			return err
 		}
-		cmds[subscriptionID] = command
+		handlers[subscriptionID] = handler
 	}
 	for m := range cl.Messages {
-		cmd, ok := cmds[m.SubscriptionID]
+		h, ok := handlers[m.SubscriptionID]
 		if !ok {
 			continue
 		}
 		log.Debug("%s Dispatching received message: %s", logMessagePrefix(m), m.Raw)
-		printMessageOrRunCommand(c, m, cmd)
+		printMessageOrRunCommand(c, m, h)
 	}
 	return nil
 }
@@ -248,22 +307,93 @@ func maybeAddAuthHeader(s client.Subscribe, conf *client.Config) client.Subscrib
 	return nil
 }
 
-func printMessageOrRunCommand(c *cli.Context, m *client.Message, command string) {
-	if command != "" {
-		runCommand(c, command, m)
+// messageHandler defines what happens to an incoming message: it is either printed (as raw JSON, or
+// rendered using the format template), or the command is executed
+type messageHandler struct {
+	command string
+	format  *template.Template // May be nil
+	env     map[string]string  // Environment variable name -> field filter, e.g. "url" -> ".attachment.url"
+}
+
+func newMessageHandler(command, format string, env map[string]string) (*messageHandler, error) {
+	handler := &messageHandler{
+		command: command,
+		env:     env,
+	}
+	if format != "" {
+		tmpl, err := template.New("format").Parse(format)
+		if err != nil {
+			return nil, fmt.Errorf("invalid format template: %w", err)
+		}
+		handler.format = tmpl
+	}
+	for name, filter := range env {
+		if !envVarNameRegex.MatchString(name) {
+			return nil, fmt.Errorf("invalid environment variable name %s", name)
+		} else if !util.ValidJSONFieldPath(filter) {
+			return nil, fmt.Errorf("invalid field filter %s for environment variable %s, must be e.g. .title or .actions[0].url", filter, name)
+		}
+	}
+	return handler, nil
+}
+
+// newSubscriptionHandler creates a handler for a subscription from the config file. If conf is passed, the
+// default command is used for subscriptions without command.
+func newSubscriptionHandler(s client.Subscribe, conf *client.Config) (*messageHandler, error) {
+	command := s.Command
+	if command == "" && conf != nil {
+		command = conf.DefaultCommand
+	}
+	return newMessageHandler(command, s.Format, s.Env)
+}
+
+// parseEnvFilters parses a list of NAME=FILTER pairs, as passed via --env
+func parseEnvFilters(pairs []string) map[string]string {
+	env := make(map[string]string)
+	for _, pair := range pairs {
+		name, filter, _ := strings.Cut(pair, "=")
+		env[strings.TrimSpace(name)] = strings.TrimSpace(filter)
+	}
+	return env
+}
+
+func printMessageOrRunCommand(c *cli.Context, m *client.Message, handler *messageHandler) {
+	if handler.command != "" {
+		runCommand(c, handler, m)
+	} else if handler.format != nil {
+		log.Debug("%s Printing formatted message", logMessagePrefix(m))
+		formatted, err := formatMessage(handler.format, m)
+		if err != nil {
+			log.Warn("%s Cannot format message: %s", logMessagePrefix(m), err.Error())
+			return
+		}
+		fmt.Fprintln(c.App.Writer, formatted)
 	} else {
 		log.Debug("%s Printing raw message", logMessagePrefix(m))
 		fmt.Fprintln(c.App.Writer, m.Raw)
 	}
 }
 
-func runCommand(c *cli.Context, command string, m *client.Message) {
-	if err := runCommandInternal(c, command, m); err != nil {
+func formatMessage(tmpl *template.Template, m *client.Message) (string, error) {
+	var buf strings.Builder
+	if err := tmpl.Execute(&buf, m); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func runCommand(c *cli.Context, handler *messageHandler, m *client.Message) {
+	if err := runCommandInternal(c, handler, m); err != nil {
 		log.Warn("%s Command failed: %s", logMessagePrefix(m), err.Error())
 	}
 }
 
-func runCommandInternal(c *cli.Context, script string, m *client.Message) error {
+func runCommandInternal(c *cli.Context, handler *messageHandler, m *client.Message) error {
+	env, err := envVars(handler, m)
+	if err != nil {
+		return err
+	}
+	script := handler.command
 	scriptFile := fmt.Sprintf("%s/ntfy-subscribe-%s.%s", os.TempDir(), util.RandomString(10), scriptExt)
 	log.Debug("%s Running command '%s' via temporary script %s", logMessagePrefix(m), script, scriptFile)
 	script = scriptHeader + script
@@ -276,11 +406,11 @@ func runCommandInternal(c *cli.Context, script string, m *client.Message) error
 	cmd.Stdin = c.App.Reader
 	cmd.Stdout = c.App.Writer
 	cmd.Stderr = c.App.ErrWriter
-	cmd.Env = envVars(m)
+	cmd.Env = env
 	return cmd.Run()
 }
 
-func envVars(m *client.Message) []string {
+func envVars(handler *messageHandler, m *client.Message) ([]string, error) {
 	env := make([]string, 0)
 	env = append(env, envVar(m.ID, "NTFY_ID", "id")...)
 	env = append(env, envVar(m.Topic, "NTFY_TOPIC", "topic")...)
@@ -290,11 +420,43 @@ func envVars(m *client.Message) []string {
 	env = append(env, envVar(fmt.Sprintf("%d", m.Priority), "NTFY_PRIORITY", "priority", "prio", "p")...)
 	env = append(env, envVar(strings.Join(m.Tags, ","), "NTFY_TAGS", "tags", "tag", "ta")...)
 	env = append(env, envVar(m.Raw, "NTFY_RAW", "raw")...)
+	if handler.format != nil {
+		formatted, err := formatMessage(handler.format, m)
+		if err != nil {
+			return nil, err
+		}
+		env = append(env, envVar(formatted, "NTFY_FORMATTED", "formatted")...)
+	}
+	if len(handler.env) > 0 {
+		var raw any
+		if err := json.Unmarshal([]byte(m.Raw), &raw); err != nil {
+			return nil, err
+		}
+		for name, filter := range handler.env {
+			env = append(env, envVar(filterField(raw, filter), name)...)
+		}
+	}
 	sort.Strings(env)
 	if log.IsTrace() {
 		log.Trace("%s With environment:\n%s", logMessagePrefix(m), strings.Join(env, "\n"))
 	}
-	return append(os.Environ(), env...)
+	return append(os.Environ(), env...), nil
+}
+
+// filterField extracts a value from a JSON document using a jq-like field filter, see util.JSONField. Strings are
+// returned as is, other values as JSON. Missing fields yield an empty string.
+func filterField(doc any, filter string) string {
+	value, ok := util.JSONField(doc, filter)
+	if !ok || value == nil {
+		return ""
+	} else if s, ok := value.(string); ok {
+		return s
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return ""
+	}
+	return string(b)
 }
 
 func envVar(value string, vars ...string) []string {
@@ -306,6 +468,18 @@ func envVar(value string, vars ...string) []string {
 }
 
 func loadConfig(c *cli.Context) (*client.Config, error) {
+	conf, err := loadConfigFile(c)
+	if err != nil {
+		return nil, err
+	}
+	if profile := profileFromContext(c); profile != "" {
+		log.Debug("Using profile %s", profile)
+		return conf.Profile(profile)
+	}
+	return conf, nil
+}
+
+func loadConfigFile(c *cli.Context) (*client.Config, error) {
 	filename := c.String("config")
 	if filename != "" {
 		return client.LoadConfig(filename)
@@ -323,6 +497,17 @@ func loadConfig(c *cli.Context) (*client.Config, error) {
 	return client.NewConfig(), nil
 }
 
+// profileFromContext returns the --profile flag of the command, or of the app if it was passed before the
+// command (ntfy --profile work publish ..). Since both define the flag, c.String only sees the command's value.
+func profileFromContext(c *cli.Context) string {
+	for _, ctx := range c.Lineage() {
+		if profile := ctx.String("profile"); profile != "" {
+			return profile
+		}
+	}
+	return ""
+}
+
 //lint:ignore U1000 Conditionally used in different builds
 func defaultClientConfigFileUnix() (string, error) {
 	u, err := user.Current()
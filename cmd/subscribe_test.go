@@ -3,6 +3,7 @@ package cmd
 import (
 	"fmt"
 	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/client"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -415,3 +416,72 @@ subscribe:
 
 	require.Equal(t, message, strings.TrimSpace(stdout.String()))
 }
+
+func TestCLI_Subscribe_Search(t *testing.T) {
+	message := `{"id":"RXIQBFaieLVr","time":124,"expires":1124,"event":"message","topic":"mytopic","message":"disk full"}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/v1/search", r.URL.Path)
+		require.Equal(t, "mytopic", r.URL.Query().Get("topic"))
+		require.Equal(t, "disk full", r.URL.Query().Get("q"))
+		require.Equal(t, "1h", r.URL.Query().Get("since"))
+		require.Equal(t, "Bearer tk_AgQdq7mVBoFD37zQVN29RhuMzNIz2", r.Header.Get("Authorization"))
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(message))
+	}))
+	defer server.Close()
+
+	app, _, stdout, _ := newTestApp()
+	require.Nil(t, app.Run([]string{"ntfy", "subscribe", "--search", "disk full", "--since", "1h", "--token", "tk_AgQdq7mVBoFD37zQVN29RhuMzNIz2", server.URL + "/mytopic"}))
+	require.Equal(t, message, strings.TrimSpace(stdout.String()))
+}
+
+func TestCLI_Subscribe_Poll_Format(t *testing.T) {
+	message := `{"id":"RXIQBFaieLVr","time":124,"expires":1124,"event":"message","topic":"mytopic","title":"Backup","message":"disk full","priority":4}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/mytopic/json", r.URL.Path)
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(message))
+	}))
+	defer server.Close()
+
+	app, _, stdout, _ := newTestApp()
+	require.Nil(t, app.Run([]string{"ntfy", "subscribe", "--poll", "--format", "{{.Title}} ({{.Priority}}): {{.Message}}", server.URL + "/mytopic"}))
+	require.Equal(t, "Backup (4): disk full", strings.TrimSpace(stdout.String()))
+}
+
+func TestCLI_Subscribe_Invalid_Format_And_Env(t *testing.T) {
+	app, _, _, _ := newTestApp()
+	require.ErrorContains(t, app.Run([]string{"ntfy", "subscribe", "--poll", "--format", "{{.Title", "mytopic"}), "invalid format template")
+	app, _, _, _ = newTestApp()
+	require.ErrorContains(t, app.Run([]string{"ntfy", "subscribe", "--poll", "--env", "url=attachment.url", "mytopic", "echo"}), "invalid field filter")
+	app, _, _, _ = newTestApp()
+	require.ErrorContains(t, app.Run([]string{"ntfy", "subscribe", "--poll", "--env", "my-url=.click", "mytopic", "echo"}), "invalid environment variable name")
+}
+
+func TestCLI_Subscribe_EnvVars_Filter(t *testing.T) {
+	m := &client.Message{
+		ID:    "RXIQBFaieLVr",
+		Title: "Backup",
+		Raw:   `{"id":"RXIQBFaieLVr","title":"Backup","priority":5,"attachment":{"name":"log.txt","url":"https://ntfy.sh/file/abc.txt"},"actions":[{"action":"view","label":"Open","url":"https://example.com"}],"tags":["warning","skull"]}`,
+	}
+	handler, err := newMessageHandler("echo", "{{.Title}}!", map[string]string{
+		"url":      ".attachment.url",
+		"label":    ".actions[0].label",
+		"tags":     ".tags",
+		"prio":     ".priority",
+		"missing":  ".actions[1].url",
+		"document": ".",
+	})
+	require.Nil(t, err)
+	env, err := envVars(handler, m)
+	require.Nil(t, err)
+	require.Contains(t, env, "url=https://ntfy.sh/file/abc.txt")
+	require.Contains(t, env, "label=Open")
+	require.Contains(t, env, `tags=["warning","skull"]`)
+	require.Contains(t, env, "prio=5")
+	require.Contains(t, env, "missing=")
+	require.Contains(t, env, "NTFY_FORMATTED=Backup!")
+	require.Contains(t, env, "formatted=Backup!")
+	require.Contains(t, env, `document={"actions":[{"action":"view","label":"Open","url":"https://example.com"}],"attachment":{"name":"log.txt","url":"https://ntfy.sh/file/abc.txt"},"id":"RXIQBFaieLVr","priority":5,"tags":["warning","skull"],"title":"Backup"}`)
+}
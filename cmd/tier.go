@@ -55,8 +55,12 @@ var cmdTier = &cli.Command{
 				&cli.StringFlag{Name: "attachment-total-size-limit", Value: defaultAttachmentTotalSizeLimit, Usage: "total size limit of attachments for the user"},
 				&cli.StringFlag{Name: "attachment-expiry-duration", Value: defaultAttachmentExpiryDuration, Usage: "duration after which attachments are deleted"},
 				&cli.StringFlag{Name: "attachment-bandwidth-limit", Value: defaultAttachmentBandwidthLimit, Usage: "daily bandwidth limit for attachment uploads/downloads"},
+				&cli.Int64Flag{Name: "subscription-limit", Usage: "number of simultaneous streaming connections (0 = server default)"},
+				&cli.StringFlag{Name: "subscription-duration-limit", Value: "0", Usage: "max. duration of a single streaming connection (0 = server default)"},
 				&cli.StringFlag{Name: "stripe-monthly-price-id", Usage: "Monthly Stripe price ID for paid tiers (e.g. price_12345)"},
 				&cli.StringFlag{Name: "stripe-yearly-price-id", Usage: "Yearly Stripe price ID for paid tiers (e.g. price_12345)"},
+				&cli.StringFlag{Name: "stripe-metered-messages-price-id", Usage: "Metered monthly Stripe price ID for published messages (e.g. price_12345)"},
+				&cli.StringFlag{Name: "stripe-metered-attachment-price-id", Usage: "Metered monthly Stripe price ID for uploaded attachment bytes (e.g. price_12345)"},
 				&cli.BoolFlag{Name: "ignore-exists", Usage: "if the tier already exists, perform no action and exit"},
 			},
 			Description: `Add a new tier to the ntfy user database.
@@ -79,6 +83,8 @@ Examples:
     --attachment-total-size-limit=1G \
     --attachment-expiry-duration=12h \
     --attachment-bandwidth-limit=5G \
+    --subscription-limit=100 \
+    --subscription-duration-limit=24h \
     pro
 `,
 		},
@@ -99,8 +105,12 @@ Examples:
 				&cli.StringFlag{Name: "attachment-total-size-limit", Usage: "total size limit of attachments for the user"},
 				&cli.StringFlag{Name: "attachment-expiry-duration", Usage: "duration after which attachments are deleted"},
 				&cli.StringFlag{Name: "attachment-bandwidth-limit", Usage: "daily bandwidth limit for attachment uploads/downloads"},
+				&cli.Int64Flag{Name: "subscription-limit", Usage: "number of simultaneous streaming connections (0 = server default)"},
+				&cli.StringFlag{Name: "subscription-duration-limit", Usage: "max. duration of a single streaming connection (0 = server default)"},
 				&cli.StringFlag{Name: "stripe-monthly-price-id", Usage: "Monthly Stripe price ID for paid tiers (e.g. price_12345)"},
 				&cli.StringFlag{Name: "stripe-yearly-price-id", Usage: "Yearly Stripe price ID for paid tiers (e.g. price_12345)"},
+				&cli.StringFlag{Name: "stripe-metered-messages-price-id", Usage: "Metered monthly Stripe price ID for published messages (e.g. price_12345)"},
+				&cli.StringFlag{Name: "stripe-metered-attachment-price-id", Usage: "Metered monthly Stripe price ID for uploaded attachment bytes (e.g. price_12345)"},
 			},
 			Description: `Updates a tier to change the limits.
 
@@ -115,7 +125,7 @@ Examples:
   ntfy tier change \                       # Update multiple limits and fields
     --message-expiry-duration=24h \
     --stripe-monthly-price-id=price_1234 \
-    --stripe-monthly-price-id=price_5678 \
+    --stripe-yearly-price-id=price_5678 \
     pro
 `,
 		},
@@ -175,6 +185,8 @@ func execTierAdd(c *cli.Context) error {
 		return errors.New("if stripe-monthly-price-id is set, stripe-yearly-price-id must also be set")
 	} else if c.String("stripe-monthly-price-id") == "" && c.String("stripe-yearly-price-id") != "" {
 		return errors.New("if stripe-yearly-price-id is set, stripe-monthly-price-id must also be set")
+	} else if c.String("stripe-monthly-price-id") == "" && (c.String("stripe-metered-messages-price-id") != "" || c.String("stripe-metered-attachment-price-id") != "") {
+		return errors.New("if stripe-metered-messages-price-id or stripe-metered-attachment-price-id is set, stripe-monthly-price-id must also be set")
 	}
 	manager, err := createUserManager(c)
 	if err != nil {
@@ -211,21 +223,29 @@ func execTierAdd(c *cli.Context) error {
 	if err != nil {
 		return err
 	}
+	subscriptionDurationLimit, err := util.ParseDuration(c.String("subscription-duration-limit"))
+	if err != nil {
+		return err
+	}
 	tier := &user.Tier{
-		ID:                       "", // Generated
-		Code:                     code,
-		Name:                     name,
-		MessageLimit:             c.Int64("message-limit"),
-		MessageExpiryDuration:    messageExpiryDuration,
-		EmailLimit:               c.Int64("email-limit"),
-		CallLimit:                c.Int64("call-limit"),
-		ReservationLimit:         c.Int64("reservation-limit"),
-		AttachmentFileSizeLimit:  attachmentFileSizeLimit,
-		AttachmentTotalSizeLimit: attachmentTotalSizeLimit,
-		AttachmentExpiryDuration: attachmentExpiryDuration,
-		AttachmentBandwidthLimit: attachmentBandwidthLimit,
-		StripeMonthlyPriceID:     c.String("stripe-monthly-price-id"),
-		StripeYearlyPriceID:      c.String("stripe-yearly-price-id"),
+		ID:                             "", // Generated
+		Code:                           code,
+		Name:                           name,
+		MessageLimit:                   c.Int64("message-limit"),
+		MessageExpiryDuration:          messageExpiryDuration,
+		EmailLimit:                     c.Int64("email-limit"),
+		CallLimit:                      c.Int64("call-limit"),
+		ReservationLimit:               c.Int64("reservation-limit"),
+		AttachmentFileSizeLimit:        attachmentFileSizeLimit,
+		AttachmentTotalSizeLimit:       attachmentTotalSizeLimit,
+		AttachmentExpiryDuration:       attachmentExpiryDuration,
+		AttachmentBandwidthLimit:       attachmentBandwidthLimit,
+		SubscriptionLimit:              c.Int64("subscription-limit"),
+		SubscriptionDurationLimit:      subscriptionDurationLimit,
+		StripeMonthlyPriceID:           c.String("stripe-monthly-price-id"),
+		StripeYearlyPriceID:            c.String("stripe-yearly-price-id"),
+		StripeMeteredMessagesPriceID:   c.String("stripe-metered-messages-price-id"),
+		StripeMeteredAttachmentPriceID: c.String("stripe-metered-attachment-price-id"),
 	}
 	if err := manager.AddTier(tier); err != nil {
 		return err
@@ -301,16 +321,33 @@ func execTierChange(c *cli.Context) error {
 			return err
 		}
 	}
+	if c.IsSet("subscription-limit") {
+		tier.SubscriptionLimit = c.Int64("subscription-limit")
+	}
+	if c.IsSet("subscription-duration-limit") {
+		tier.SubscriptionDurationLimit, err = util.ParseDuration(c.String("subscription-duration-limit"))
+		if err != nil {
+			return err
+		}
+	}
 	if c.IsSet("stripe-monthly-price-id") {
 		tier.StripeMonthlyPriceID = c.String("stripe-monthly-price-id")
 	}
 	if c.IsSet("stripe-yearly-price-id") {
 		tier.StripeYearlyPriceID = c.String("stripe-yearly-price-id")
 	}
+	if c.IsSet("stripe-metered-messages-price-id") {
+		tier.StripeMeteredMessagesPriceID = c.String("stripe-metered-messages-price-id")
+	}
+	if c.IsSet("stripe-metered-attachment-price-id") {
+		tier.StripeMeteredAttachmentPriceID = c.String("stripe-metered-attachment-price-id")
+	}
 	if tier.StripeMonthlyPriceID != "" && tier.StripeYearlyPriceID == "" {
 		return errors.New("if stripe-monthly-price-id is set, stripe-yearly-price-id must also be set")
 	} else if tier.StripeMonthlyPriceID == "" && tier.StripeYearlyPriceID != "" {
 		return errors.New("if stripe-yearly-price-id is set, stripe-monthly-price-id must also be set")
+	} else if tier.StripeMonthlyPriceID == "" && (tier.StripeMeteredMessagesPriceID != "" || tier.StripeMeteredAttachmentPriceID != "") {
+		return errors.New("if stripe-metered-messages-price-id or stripe-metered-attachment-price-id is set, stripe-monthly-price-id must also be set")
 	}
 	if err := manager.UpdateTier(tier); err != nil {
 		return err
@@ -355,10 +392,27 @@ func execTierList(c *cli.Context) error {
 }
 
 func printTier(c *cli.Context, tier *user.Tier) {
-	prices := "(none)"
+	prices, meteredPrices := "(none)", "(none)"
+	subscriptionLimit, subscriptionDurationLimit := "(server default)", "(server default)"
+	if tier.SubscriptionLimit > 0 {
+		subscriptionLimit = fmt.Sprintf("%d", tier.SubscriptionLimit)
+	}
+	if tier.SubscriptionDurationLimit > 0 {
+		subscriptionDurationLimit = fmt.Sprintf("%s (%d seconds)", tier.SubscriptionDurationLimit.String(), int64(tier.SubscriptionDurationLimit.Seconds()))
+	}
 	if tier.StripeMonthlyPriceID != "" && tier.StripeYearlyPriceID != "" {
 		prices = fmt.Sprintf("%s / %s", tier.StripeMonthlyPriceID, tier.StripeYearlyPriceID)
 	}
+	if tier.StripeMeteredMessagesPriceID != "" || tier.StripeMeteredAttachmentPriceID != "" {
+		meteredMessagesPrice, meteredAttachmentPrice := "-", "-"
+		if tier.StripeMeteredMessagesPriceID != "" {
+			meteredMessagesPrice = tier.StripeMeteredMessagesPriceID
+		}
+		if tier.StripeMeteredAttachmentPriceID != "" {
+			meteredAttachmentPrice = tier.StripeMeteredAttachmentPriceID
+		}
+		meteredPrices = fmt.Sprintf("%s / %s", meteredMessagesPrice, meteredAttachmentPrice)
+	}
 	fmt.Fprintf(c.App.ErrWriter, "tier %s (id: %s)\n", tier.Code, tier.ID)
 	fmt.Fprintf(c.App.ErrWriter, "- Name: %s\n", tier.Name)
 	fmt.Fprintf(c.App.ErrWriter, "- Message limit: %d\n", tier.MessageLimit)
@@ -370,5 +424,8 @@ func printTier(c *cli.Context, tier *user.Tier) {
 	fmt.Fprintf(c.App.ErrWriter, "- Attachment total size limit: %s\n", util.FormatSizeHuman(tier.AttachmentTotalSizeLimit))
 	fmt.Fprintf(c.App.ErrWriter, "- Attachment expiry duration: %s (%d seconds)\n", tier.AttachmentExpiryDuration.String(), int64(tier.AttachmentExpiryDuration.Seconds()))
 	fmt.Fprintf(c.App.ErrWriter, "- Attachment daily bandwidth limit: %s\n", util.FormatSizeHuman(tier.AttachmentBandwidthLimit))
+	fmt.Fprintf(c.App.ErrWriter, "- Subscription limit: %s\n", subscriptionLimit)
+	fmt.Fprintf(c.App.ErrWriter, "- Subscription duration limit: %s\n", subscriptionDurationLimit)
 	fmt.Fprintf(c.App.ErrWriter, "- Stripe prices (monthly/yearly): %s\n", prices)
+	fmt.Fprintf(c.App.ErrWriter, "- Stripe metered prices (messages/attachment bytes): %s\n", meteredPrices)
 }
@@ -25,6 +25,7 @@ func TestCLI_Tier_AddListChangeDelete(t *testing.T) {
 	require.Contains(t, stderr.String(), "tier pro (id: ti_")
 	require.Contains(t, stderr.String(), "- Name: Pro")
 	require.Contains(t, stderr.String(), "- Message limit: 1234")
+	require.Contains(t, stderr.String(), "- Subscription limit: (server default)")
 
 	app, _, _, stderr = newTestApp()
 	require.Nil(t, runTierCommand(app, conf, "change",
@@ -36,8 +37,11 @@ func TestCLI_Tier_AddListChangeDelete(t *testing.T) {
 		"--attachment-expiry-duration=1d",
 		"--attachment-total-size-limit=10G",
 		"--attachment-bandwidth-limit=100G",
+		"--subscription-limit=50",
+		"--subscription-duration-limit=12h",
 		"--stripe-monthly-price-id=price_991",
 		"--stripe-yearly-price-id=price_992",
+		"--stripe-metered-messages-price-id=price_993",
 		"pro",
 	))
 	require.Contains(t, stderr.String(), "- Message limit: 999")
@@ -47,7 +51,10 @@ func TestCLI_Tier_AddListChangeDelete(t *testing.T) {
 	require.Contains(t, stderr.String(), "- Attachment file size limit: 100.0 MB")
 	require.Contains(t, stderr.String(), "- Attachment expiry duration: 24h")
 	require.Contains(t, stderr.String(), "- Attachment total size limit: 10.0 GB")
+	require.Contains(t, stderr.String(), "- Subscription limit: 50")
+	require.Contains(t, stderr.String(), "- Subscription duration limit: 12h0m0s (43200 seconds)")
 	require.Contains(t, stderr.String(), "- Stripe prices (monthly/yearly): price_991 / price_992")
+	require.Contains(t, stderr.String(), "- Stripe metered prices (messages/attachment bytes): price_993 / -")
 
 	app, _, _, stderr = newTestApp()
 	require.Nil(t, runTierCommand(app, conf, "remove", "pro"))
@@ -117,7 +117,7 @@ func execTokenAdd(c *cli.Context) error {
 	} else if err != nil {
 		return err
 	}
-	token, err := manager.CreateToken(u.ID, label, expires, netip.IPv4Unspecified())
+	token, err := manager.CreateToken(u.ID, label, user.TokenTypeCLI, expires, netip.IPv4Unspecified())
 	if err != nil {
 		return err
 	}
@@ -200,7 +200,15 @@ func execTokenList(c *cli.Context) error {
 			} else {
 				expires = fmt.Sprintf("expires %s", t.Expires.Format(time.RFC822))
 			}
-			fmt.Fprintf(c.App.ErrWriter, "- %s%s, %s, accessed from %s at %s\n", t.Value, label, expires, t.LastOrigin.String(), t.LastAccess.Format(time.RFC822))
+			tokenType := string(t.Type)
+			if tokenType == "" {
+				tokenType = "unknown type" // Tokens created before token types were introduced
+			}
+			var created string
+			if t.Created.Unix() > 0 {
+				created = fmt.Sprintf(", created from %s at %s", t.CreatedOrigin.String(), t.Created.Format(time.RFC822))
+			}
+			fmt.Fprintf(c.App.ErrWriter, "- %s%s, %s, %s, accessed from %s at %s%s\n", t.Value, label, tokenType, expires, t.LastOrigin.String(), t.LastAccess.Format(time.RFC822), created)
 		}
 	}
 	if usersWithTokens == 0 {
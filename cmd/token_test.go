@@ -25,7 +25,7 @@ func TestCLI_Token_AddListRemove(t *testing.T) {
 
 	app, _, _, stderr = newTestApp()
 	require.Nil(t, runTokenCommand(app, conf, "list", "phil"))
-	require.Regexp(t, `user phil\n- tk_.+, never expires, accessed from 0.0.0.0 at .+`, stderr.String())
+	require.Regexp(t, `user phil\n- tk_.+, cli, never expires, accessed from 0.0.0.0 at .+, created from 0.0.0.0 at .+`, stderr.String())
 	re := regexp.MustCompile(`tk_\w+`)
 	token := re.FindString(stderr.String())
 
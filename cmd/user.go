@@ -9,6 +9,7 @@ import (
 	"heckel.io/ntfy/v2/user"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/urfave/cli/v2"
 	"github.com/urfave/cli/v2/altsrc"
@@ -33,7 +34,7 @@ var flagsUser = append(
 var cmdUser = &cli.Command{
 	Name:      "user",
 	Usage:     "Manage/show users",
-	UsageText: "ntfy user [list|add|remove|change-pass|change-role] ...",
+	UsageText: "ntfy user [list|add|remove|change-pass|change-role|change-tier|suspend|reinstate] ...",
 	Flags:     flagsUser,
 	Before:    initConfigFileInputSourceFunc("config", flagsUser, initLogFunc),
 	Category:  categoryServer,
@@ -131,6 +132,40 @@ as messages per day, attachment file sizes, etc.
 Example:
   ntfy user change-tier phil pro   # Change tier to "pro" for user "phil"  
   ntfy user change-tier phil -     # Remove tier from user "phil" entirely 
+`,
+		},
+		{
+			Name:      "suspend",
+			Usage:     "Suspends a user account",
+			UsageText: "ntfy user suspend [--until=<duration>] [--reason=..] USERNAME",
+			Action:    execUserSuspend,
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "until", Aliases: []string{"u"}, Value: "", Usage: "suspension is lifted automatically after"},
+				&cli.StringFlag{Name: "reason", Aliases: []string{"r"}, Value: "", Usage: "reason for the suspension, shown to the user"},
+			},
+			Description: `Suspend the account of the given user.
+
+A suspended user can still log in and manage their account, but cannot publish or subscribe to
+any topics. All data (messages, reservations, tokens, etc.) is preserved. This is meant to be used
+as an intermediate step before deleting an account, e.g. for terms of service violations.
+
+If --until is set, the suspension is lifted automatically at that time. Otherwise the user
+stays suspended until 'ntfy user reinstate' is called.
+
+Examples:
+  ntfy user suspend phil                                 # Suspend user phil indefinitely
+  ntfy user suspend --until=7d --reason="Spamming" phil  # Suspend user phil for 7 days
+`,
+		},
+		{
+			Name:      "reinstate",
+			Usage:     "Lifts the suspension of a user account",
+			UsageText: "ntfy user reinstate USERNAME",
+			Action:    execUserReinstate,
+			Description: `Lift the suspension of the given user.
+
+Example:
+  ntfy user reinstate phil
 `,
 		},
 		{
@@ -165,6 +200,8 @@ Examples:
   ntfy user change-pass phil                   # Change password for user phil
   NTFY_PASSWORD=.. ntfy user change-pass phil  # As above, using env variable to set password (for scripts)
   ntfy user change-role phil admin             # Make user phil an admin 
+  ntfy user suspend --until=7d phil            # Suspend user phil for 7 days
+  ntfy user reinstate phil                     # Lift the suspension of user phil
 
 For the 'ntfy user add' and 'ntfy user change-pass' commands, you may set the NTFY_PASSWORD environment
 variable to pass the new password. This is useful if you are creating/updating users via scripts.
@@ -309,6 +346,62 @@ func execUserChangeTier(c *cli.Context) error {
 	return nil
 }
 
+func execUserSuspend(c *cli.Context) error {
+	username := c.Args().Get(0)
+	untilStr := c.String("until")
+	reason := c.String("reason")
+	if username == "" {
+		return errors.New("username expected, type 'ntfy user suspend --help' for help")
+	} else if username == userEveryone || username == user.Everyone {
+		return errors.New("username not allowed")
+	}
+	until := time.Unix(0, 0)
+	if untilStr != "" {
+		var err error
+		until, err = util.ParseFutureTime(untilStr, time.Now())
+		if err != nil {
+			return err
+		}
+	}
+	manager, err := createUserManager(c)
+	if err != nil {
+		return err
+	}
+	if _, err := manager.User(username); err == user.ErrUserNotFound {
+		return fmt.Errorf("user %s does not exist", username)
+	}
+	if err := manager.SuspendUser(username, reason, until); err != nil {
+		return err
+	}
+	if until.Unix() == 0 {
+		fmt.Fprintf(c.App.ErrWriter, "user %s suspended indefinitely\n", username)
+	} else {
+		fmt.Fprintf(c.App.ErrWriter, "user %s suspended until %s\n", username, until.Format(time.UnixDate))
+	}
+	return nil
+}
+
+func execUserReinstate(c *cli.Context) error {
+	username := c.Args().Get(0)
+	if username == "" {
+		return errors.New("username expected, type 'ntfy user reinstate --help' for help")
+	} else if username == userEveryone || username == user.Everyone {
+		return errors.New("username not allowed")
+	}
+	manager, err := createUserManager(c)
+	if err != nil {
+		return err
+	}
+	if _, err := manager.User(username); err == user.ErrUserNotFound {
+		return fmt.Errorf("user %s does not exist", username)
+	}
+	if err := manager.ReinstateUser(username); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.App.ErrWriter, "user %s reinstated\n", username)
+	return nil
+}
+
 func execUserList(c *cli.Context) error {
 	manager, err := createUserManager(c)
 	if err != nil {
@@ -113,6 +113,37 @@ func TestCLI_User_Delete(t *testing.T) {
 	require.Contains(t, err.Error(), "user phil does not exist")
 }
 
+func TestCLI_User_Suspend_Reinstate(t *testing.T) {
+	s, conf, port := newTestServerWithAuth(t)
+	defer test.StopServer(t, s, port)
+
+	app, stdin, _, stderr := newTestApp()
+	stdin.WriteString("mypass\nmypass")
+	require.Nil(t, runUserCommand(app, conf, "add", "phil"))
+	require.Contains(t, stderr.String(), "user phil added with role user")
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runUserCommand(app, conf, "suspend", "--until=7d", "--reason=Spamming", "phil"))
+	require.Contains(t, stderr.String(), "user phil suspended until")
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runUserCommand(app, conf, "list"))
+	require.Contains(t, stderr.String(), "- account suspended until")
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runUserCommand(app, conf, "reinstate", "phil"))
+	require.Contains(t, stderr.String(), "user phil reinstated")
+
+	app, _, _, stderr = newTestApp()
+	require.Nil(t, runUserCommand(app, conf, "list"))
+	require.NotContains(t, stderr.String(), "suspended")
+
+	app, _, _, _ = newTestApp()
+	err := runUserCommand(app, conf, "suspend", "bob")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "user bob does not exist")
+}
+
 func newTestServerWithAuth(t *testing.T) (s *server.Server, conf *server.Config, port int) {
 	configFile := filepath.Join(t.TempDir(), "server-dummy.yml")
 	require.Nil(t, os.WriteFile(configFile, []byte(""), 0600)) // Dummy config file to avoid lookup of real server.yml
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	clamdTimeout   = 30 * time.Second
+	clamdChunkSize = 64 * 1024
+)
+
+var (
+	errFileInfected = errors.New("file infected")
+)
+
+// fileScanner scans files before they are accepted by the fileCache. It returns an error
+// wrapping errFileInfected if the file must be rejected.
+type fileScanner interface {
+	Scan(r io.Reader) error
+}
+
+// clamdScanner is a fileScanner that streams files to a ClamAV daemon (clamd) using the INSTREAM
+// command, see https://docs.clamav.net/manual/Usage/Scanning.html#clamd
+type clamdScanner struct {
+	network string
+	address string
+}
+
+var _ fileScanner = (*clamdScanner)(nil)
+
+// newClamdScanner creates a new clamdScanner. The address is either a unix socket path (starting with /),
+// or a TCP address in the form host:port.
+func newClamdScanner(address string) *clamdScanner {
+	network := "tcp"
+	if strings.HasPrefix(address, "/") {
+		network = "unix"
+	}
+	return &clamdScanner{
+		network: network,
+		address: address,
+	}
+}
+
+func (c *clamdScanner) Scan(r io.Reader) error {
+	conn, err := net.DialTimeout(c.network, c.address, clamdTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(clamdTimeout)); err != nil {
+		return err
+	}
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return err
+	}
+	buf := make([]byte, clamdChunkSize)
+	size := make([]byte, 4)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			if _, err := conn.Write(size); err != nil {
+				return err
+			} else if _, err := conn.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return err
+	}
+	response, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	response = strings.TrimSpace(strings.TrimRight(response, "\x00"))
+	if strings.HasSuffix(response, " OK") {
+		return nil
+	} else if strings.HasSuffix(response, " FOUND") {
+		signature := strings.TrimSuffix(strings.TrimPrefix(response, "stream: "), " FOUND")
+		return fmt.Errorf("%w: %s", errFileInfected, signature)
+	}
+	return fmt.Errorf("unexpected clamd response: %s", response)
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestClamdScanner_Scan(t *testing.T) {
+	address := newTestClamdServer(t)
+	scanner := newClamdScanner(address)
+	require.Nil(t, scanner.Scan(strings.NewReader("this is a harmless file")))
+	require.Nil(t, scanner.Scan(bytes.NewReader(make([]byte, 3*clamdChunkSize+17))))
+
+	err := scanner.Scan(strings.NewReader("this file contains " + testEicarMarker))
+	require.ErrorIs(t, err, errFileInfected)
+	require.Contains(t, err.Error(), "Eicar-Test-Signature")
+}
+
+func TestClamdScanner_Scan_Unavailable(t *testing.T) {
+	scanner := newClamdScanner("/does/not/exist.sock")
+	err := scanner.Scan(strings.NewReader("some file"))
+	require.NotNil(t, err)
+	require.NotErrorIs(t, err, errFileInfected)
+}
+
+const testEicarMarker = "EICAR-STANDARD-ANTIVIRUS-TEST-FILE"
+
+// newTestClamdServer starts a fake clamd that implements the INSTREAM command, and flags all
+// streams containing testEicarMarker as infected. It returns the TCP address of the server.
+func newTestClamdServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				if command, err := r.ReadString(0); err != nil || command != "zINSTREAM\x00" {
+					return
+				}
+				var data bytes.Buffer
+				for {
+					var size uint32
+					if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+						return
+					} else if size == 0 {
+						break
+					}
+					if _, err := io.CopyN(&data, r, int64(size)); err != nil {
+						return
+					}
+				}
+				if strings.Contains(data.String(), testEicarMarker) {
+					conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+				} else {
+					conn.Write([]byte("stream: OK\x00"))
+				}
+			}(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
@@ -18,10 +18,29 @@ const (
 	DefaultDelayedSenderInterval                = 10 * time.Second
 	DefaultMessageDelayMin                      = 10 * time.Second
 	DefaultMessageDelayMax                      = 3 * 24 * time.Hour
+	DefaultMessageDedupWindow                   = 10 * time.Minute
+	DefaultTokenRotationGracePeriod             = time.Hour
 	DefaultFirebaseKeepaliveInterval            = 3 * time.Hour    // ~control topic (Android), not too frequently to save battery
 	DefaultFirebasePollInterval                 = 20 * time.Minute // ~poll topic (iOS), max. 2-3 times per hour (see docs)
-	DefaultFirebaseQuotaExceededPenaltyDuration = 10 * time.Minute // Time that over-users are locked out of Firebase if it returns "quota exceeded"
+	DefaultFirebaseQuotaExceededPenaltyDuration = 10 * time.Minute // Max. time messages to a topic are held back if Firebase returns "quota exceeded"
+	DefaultFirebaseQueueSize                    = 10000            // Max. number of messages waiting to be sent to Firebase
+	DefaultFirebaseWorkers                      = 50               // Number of concurrent Firebase senders
 	DefaultStripePriceCacheDuration             = 3 * time.Hour    // Time to keep Stripe prices cached in memory before a refresh is needed
+	DefaultMonitorInterval                      = time.Minute      // Default interval of uptime monitor checks, if not set per check
+	DefaultMonitorTimeout                       = 10 * time.Second // Timeout of a single uptime monitor check
+	DefaultDiskSpaceCheckInterval               = time.Minute      // Interval of the disk space watchdog, if disk-space-min-free is set
+	DefaultTTSFormat                            = "wav"            // File extension of the audio produced by the text-to-speech command
+	DefaultTTSWorkers                           = 2                // Number of concurrent text-to-speech workers
+	DefaultFaultInjectionDelay                  = 5 * time.Second  // Max delivery delay if fault injection is enabled (development only!)
+	DefaultLanguage                             = "en"             // Language of server-generated text, if neither the account nor Accept-Language picks one
+	DefaultSMTPSenderRetryMaxAge                = 6 * time.Hour    // Max. time that failed outbound emails are retried
+	DefaultOutboundTimeout                      = 10 * time.Second // Timeout of outbound HTTP requests (upstream, Twilio, Web Push)
+	DefaultOutboundMaxIdleConnsPerHost          = 10               // Max. number of idle keep-alive connections per destination host
+	DefaultOutboundCircuitBreakerThreshold      = 5                // Consecutive failures before requests to a destination are paused
+	DefaultOutboundCircuitBreakerCooldown       = 30 * time.Second // Time that requests to a failing destination are paused
+	DefaultAuthFailureDelay                     = time.Duration(0) // Base delay of failed auth responses, disabled by default
+	DefaultAuthLockoutThreshold                 = 10               // Consecutive auth failures per username+IP before a lockout
+	DefaultAuthLockoutDuration                  = 15 * time.Minute // Duration of the first lockout, doubled for every further lockout
 )
 
 // Defines default Web Push settings
@@ -33,28 +52,35 @@ const (
 // Defines all global and per-visitor limits
 // - message size limit: the max number of bytes for a message
 // - total topic limit: max number of topics overall
+// - total subscription limit: max number of subscriptions (streaming connections) overall
 // - various attachment limits
 const (
 	DefaultMessageSizeLimit         = 4096 // Bytes; note that FCM/APNS have a limit of ~4 KB for the entire message
 	DefaultTotalTopicLimit          = 15000
+	DefaultTotalSubscriptionLimit   = 0                             // No limit
 	DefaultAttachmentTotalSizeLimit = int64(5 * 1024 * 1024 * 1024) // 5 GB
 	DefaultAttachmentFileSizeLimit  = int64(15 * 1024 * 1024)       // 15 MB
 	DefaultAttachmentExpiryDuration = 3 * time.Hour
+	DefaultAttachmentAuthURLExpiry  = 24 * time.Hour
 )
 
 // Defines all per-visitor limits
 // - per visitor subscription limit: max number of subscriptions (active HTTP connections) per per-visitor/IP
+// - per visitor subscription duration limit: max duration of a single subscription (0 = unlimited)
 // - per visitor request limit: max number of PUT/GET/.. requests (here: 60 requests bucket, replenished at a rate of one per 5 seconds)
 // - per visitor email limit: max number of emails (here: 16 email bucket, replenished at a rate of one per hour)
 // - per visitor attachment size limit: total per-visitor attachment size in bytes to be stored on the server
 // - per visitor attachment daily bandwidth limit: number of bytes that can be transferred to/from the server
 const (
 	DefaultVisitorSubscriptionLimit             = 30
+	DefaultVisitorSubscriptionDurationLimit     = time.Duration(0)
 	DefaultVisitorRequestLimitBurst             = 60
 	DefaultVisitorRequestLimitReplenish         = 5 * time.Second
 	DefaultVisitorMessageDailyLimit             = 0
 	DefaultVisitorEmailLimitBurst               = 16
 	DefaultVisitorEmailLimitReplenish           = time.Hour
+	DefaultUnifiedPushEndpointLimitBurst        = 0 // Disabled
+	DefaultUnifiedPushEndpointLimitReplenish    = 10 * time.Second
 	DefaultVisitorAccountCreationLimitBurst     = 3
 	DefaultVisitorAccountCreationLimitReplenish = 24 * time.Hour
 	DefaultVisitorAuthFailureLimitBurst         = 30
@@ -69,13 +95,19 @@ var (
 
 	// DefaultDisallowedTopics defines the topics that are forbidden, because they are used elsewhere. This array can be
 	// extended using the server.yml config. If updated, also update in Android and web app.
-	DefaultDisallowedTopics = []string{"docs", "static", "file", "app", "metrics", "account", "settings", "signup", "login", "v1"}
+	DefaultDisallowedTopics = []string{"docs", "static", "file", "app", "metrics", "account", "settings", "signup", "login", "subscribe", "v1", "healthz"}
+
+	// DefaultAttachmentURLSchemes and DefaultIconURLSchemes define the URL schemes allowed for external attachments
+	// and icons, since clients download them. Click URLs may have any scheme by default (e.g. mailto:, geo:).
+	DefaultAttachmentURLSchemes = []string{"http", "https"}
+	DefaultIconURLSchemes       = []string{"http", "https"}
 )
 
 // Config is the main config struct for the application. Use New to instantiate a default config struct.
 type Config struct {
 	File                                 string // Config file, only used for testing
 	BaseURL                              string
+	DefaultLanguage                      string // Language of server-generated text, see locale.go
 	ListenHTTP                           string
 	ListenHTTPS                          string
 	ListenUnix                           string
@@ -83,21 +115,45 @@ type Config struct {
 	KeyFile                              string
 	CertFile                             string
 	FirebaseKeyFile                      string
+	FirebaseProxy                        string // Overrides OutboundProxy for Firebase, see outbound_proxy.go
 	CacheFile                            string
 	CacheDuration                        time.Duration
+	CachePriorityMultipliers             map[int]float64 // Priority -> multiplier for the message expiry duration, see messageExpires
 	CacheStartupQueries                  string
 	CacheBatchSize                       int
 	CacheBatchTimeout                    time.Duration
+	CacheCompressSize                    int64 // Message bodies of at least this size are stored compressed; 0 to disable
 	AuthFile                             string
 	AuthStartupQueries                   string
 	AuthDefault                          user.Permission
 	AuthBcryptCost                       int
 	AuthStatsQueueWriterInterval         time.Duration
+	AuthHeader                           string         // Trusted header with the username (e.g. X-Remote-User), set by an auth proxy
+	AuthTrustedProxies                   []netip.Prefix // IPs/networks allowed to set the auth header
+	AuthFailureDelay                     time.Duration  // Base delay of failed auth responses, doubled with every consecutive failure
+	AuthLockoutThreshold                 int            // Consecutive failures per username+IP before a lockout, 0 disables lockouts
+	AuthLockoutDuration                  time.Duration
+	AuthMigrateTopics                    []string // Entries "<username>:<topic-pattern>[:<everyone>]", see server_auth_migrate.go
 	AttachmentCacheDir                   string
 	AttachmentTotalSizeLimit             int64
 	AttachmentFileSizeLimit              int64
 	AttachmentExpiryDuration             time.Duration
+	AttachmentDeniedTypes                []string       // MIME types that cannot be uploaded, may include wildcards (e.g. application/x-*)
+	AttachmentDeniedExtensions           []string       // File extensions that cannot be uploaded (e.g. .exe)
+	AttachmentAllowedTopics              []string       // Topic patterns in which attachments are allowed; empty means all topics
+	AttachmentDeniedTopics               []string       // Topic patterns in which attachments are not allowed; takes precedence
+	AttachmentClamdAddress               string         // Address of clamd (unix socket path or host:port) to scan uploads with
+	AttachmentLANBaseURL                 string         // Base URL of attachments for subscribers in AttachmentLANNetworks, see server_lan.go
+	AttachmentLANNetworks                []netip.Prefix // Networks of subscribers that receive AttachmentLANBaseURL attachment URLs
+	AttachmentAuth                       bool           // Require read access to the topic (or a signed URL) to download attachments, see server_attachment_auth.go
+	AttachmentAuthURLExpiry              time.Duration  // Duration for which signed attachment URLs are valid
+	AttachmentAuthTopics                 []string       // Topic patterns to which AttachmentAuth applies; empty means all topics
+	TTSCommand                           string         // Command that reads text from stdin and writes audio to stdout, see server_tts.go
+	TTSFormat                            string         // File extension of the audio produced by TTSCommand, e.g. "wav"
+	TTSCacheDir                          string         // Directory in which generated audio is cached by text hash
+	TTSWorkers                           int            // Number of concurrent text-to-speech workers
 	KeepaliveInterval                    time.Duration
+	StreamCompression                    bool // Compress JSON, SSE and raw streams with gzip, if the client accepts it
 	ManagerInterval                      time.Duration
 	DisallowedTopics                     []string
 	WebRoot                              string // empty to disable
@@ -105,15 +161,42 @@ type Config struct {
 	FirebaseKeepaliveInterval            time.Duration
 	FirebasePollInterval                 time.Duration
 	FirebaseQuotaExceededPenaltyDuration time.Duration
+	FirebaseQueueSize                    int   // Max. number of messages waiting to be sent to Firebase, see sendToFirebase
+	FirebaseWorkers                      int   // Number of goroutines sending messages to Firebase
+	FirebaseAttachmentDeferSize          int64 // Attachments of at least this size are sent without URL, see firebaseMessage; 0 to disable
 	UpstreamBaseURL                      string
+	UpstreamFallbackBaseURLs             []string // Tried in order if UpstreamBaseURL is unavailable, see upstream.go
 	UpstreamAccessToken                  string
+	UpstreamProxy                        string        // Overrides OutboundProxy for the upstream server
+	OutboundTimeout                      time.Duration // Timeout of outbound HTTP requests, see http_client.go
+	OutboundMaxIdleConnsPerHost          int
+	OutboundCAFile                       string // Additional trusted CAs (PEM) for outbound HTTPS requests
+	OutboundProxy                        string // HTTP(S) or SOCKS5 proxy for all outbound traffic, see outbound_proxy.go
+	OutboundCircuitBreakerThreshold      int    // Consecutive failures before requests to a host are paused, 0 to disable
+	OutboundCircuitBreakerCooldown       time.Duration
 	SMTPSenderAddr                       string
 	SMTPSenderUser                       string
 	SMTPSenderPass                       string
 	SMTPSenderFrom                       string
+	SMTPSenderProxy                      string        // Overrides OutboundProxy for sending emails
+	SMTPSenderRetryMaxAge                time.Duration // Max. time to retry emails after temporary errors, 0 to disable, see server_email_retry.go
+	SMTPSenderHTML                       bool          // Send HTML emails using the built-in template, see smtp_sender_html.go
+	SMTPSenderHTMLTemplate               string        // Custom HTML email template file, implies SMTPSenderHTML
+	EmailProvider                        string        // "smtp" (default), "ses", "sendgrid" or "mailgun", see mailer_api.go
+	EmailProviderKey                     string        // API key (SendGrid, Mailgun), or secret access key (SES)
+	EmailProviderKeyID                   string        // Access key ID (SES)
+	EmailProviderRegion                  string        // AWS region (SES), or "us"/"eu" (Mailgun)
+	EmailProviderDomain                  string        // Sending domain (Mailgun)
 	SMTPServerListen                     string
 	SMTPServerDomain                     string
 	SMTPServerAddrPrefix                 string
+	SMTPServerRules                      []string // Routing rules for incoming emails, see smtp_rules.go
+	TransformRules                       []string // Message transformation rules, see transform_rules.go
+	GeoIPFile                            string   // MaxMind DB file to look up the country of visitors, see network_rules.go
+	PublishAllowedNetworks               []string // IPs, networks or country codes that may publish; empty means all
+	PublishDeniedNetworks                []string // IPs, networks or country codes that may not publish; takes precedence
+	SubscribeAllowedNetworks             []string // IPs, networks or country codes that may subscribe; empty means all
+	SubscribeDeniedNetworks              []string // IPs, networks or country codes that may not subscribe; takes precedence
 	TwilioAccount                        string
 	TwilioAuthToken                      string
 	TwilioPhoneNumber                    string
@@ -123,12 +206,21 @@ type Config struct {
 	MetricsEnable                        bool
 	MetricsListenHTTP                    string
 	ProfileListenHTTP                    string
+	HealthListenGRPC                     string
+	HealthListenAgent                    string
 	MessageDelayMin                      time.Duration
 	MessageDelayMax                      time.Duration
+	MessageDedupWindow                   time.Duration
+	ClickURLSchemes                      []string // Allowed schemes of click URLs (e.g. https, mailto); empty means all
+	AttachmentURLSchemes                 []string // Allowed schemes of external attachment URLs
+	IconURLSchemes                       []string // Allowed schemes of icon URLs
+	TokenRotationGracePeriod             time.Duration
 	MessageSizeLimit                     int
 	TotalTopicLimit                      int
+	TotalSubscriptionLimit               int
 	TotalAttachmentSizeLimit             int64
 	VisitorSubscriptionLimit             int
+	VisitorSubscriptionDurationLimit     time.Duration
 	VisitorAttachmentTotalSizeLimit      int64
 	VisitorAttachmentDailyBandwidthLimit int64
 	VisitorRequestLimitBurst             int
@@ -141,14 +233,33 @@ type Config struct {
 	VisitorAccountCreationLimitReplenish time.Duration
 	VisitorAuthFailureLimitBurst         int
 	VisitorAuthFailureLimitReplenish     time.Duration
-	VisitorStatsResetTime                time.Time // Time of the day at which to reset visitor stats
-	VisitorSubscriberRateLimiting        bool      // Enable subscriber-based rate limiting for UnifiedPush topics
+	VisitorStatsResetTime                time.Time     // Time of the day at which to reset visitor stats
+	VisitorSubscriberRateLimiting        bool          // Enable subscriber-based rate limiting for UnifiedPush topics
+	UnifiedPushEndpointLimitBurst        int           // Max UnifiedPush messages per topic (endpoint) in a burst, 0 to disable
+	UnifiedPushEndpointLimitReplenish    time.Duration // Interval at which the per-endpoint limit is replenished (one per x)
+	MatrixPushMetadataOnly               bool          // Do not pass on message content, sender and room name of Matrix notifications
+	Banner                               string        // Message of the day, shown in the web app, see handleBannerChange
+	DeadLetterTopic                      string        // Topic to which undeliverable messages are re-published, see publishDeadLetter
+	ServerEventsTopic                    string        // Topic to which internal server events are published, see publishServerEvent
+	MonitorChecks                        []string      // Uptime monitor checks, format "<topic> <target> [<interval>]", see server_monitor.go
+	MonitorInterval                      time.Duration // Default interval of uptime monitor checks
+	MonitorTimeout                       time.Duration // Timeout of a single uptime monitor check
+	Bridges                              []string      // Bridged remote topics, format "<remote-topic-url> <local-topic> [<direction>]", see server_bridge.go
+	DiskSpaceMinFree                     int64         // Min. free disk space for the message and attachment cache, 0 to disable, see server_disk.go
+	DiskSpaceCheckInterval               time.Duration // Interval at which the free disk space is checked
+	FaultInjectionDelayProbability       float64       // Development only: Probability that message delivery is delayed
+	FaultInjectionDelay                  time.Duration // Development only: Max delivery delay
+	FaultInjectionFirebaseProbability    float64       // Development only: Probability that Firebase messages are dropped
+	FaultInjectionCacheErrorProbability  float64       // Development only: Probability that cache writes fail
 	BehindProxy                          bool
 	StripeSecretKey                      string
 	StripeWebhookKey                     string
+	StripeProxy                          string // Overrides OutboundProxy for Stripe
 	StripePriceCacheDuration             time.Duration
 	BillingContact                       string
-	EnableSignup                         bool // Enable creation of accounts via API and UI
+	EnableSignup                         bool   // Enable creation of accounts via API and UI
+	EnableSignupVerification             bool   // Require new accounts to verify their email address, see server_account_verify.go
+	SignupMode                           string // "open" (default) or "invite", see server_invites.go
 	EnableLogin                          bool
 	EnableReservations                   bool // Allow users with role "user" to own/reserve topics
 	EnableMetrics                        bool
@@ -168,6 +279,7 @@ func NewConfig() *Config {
 	return &Config{
 		File:                                 "", // Only used for testing
 		BaseURL:                              "",
+		DefaultLanguage:                      DefaultLanguage,
 		ListenHTTP:                           DefaultListenHTTP,
 		ListenHTTPS:                          "",
 		ListenUnix:                           "",
@@ -175,37 +287,94 @@ func NewConfig() *Config {
 		KeyFile:                              "",
 		CertFile:                             "",
 		FirebaseKeyFile:                      "",
+		FirebaseProxy:                        "",
 		CacheFile:                            "",
 		CacheDuration:                        DefaultCacheDuration,
+		CachePriorityMultipliers:             make(map[int]float64),
 		CacheStartupQueries:                  "",
 		CacheBatchSize:                       0,
 		CacheBatchTimeout:                    0,
+		CacheCompressSize:                    0,
 		AuthFile:                             "",
 		AuthStartupQueries:                   "",
 		AuthDefault:                          user.PermissionReadWrite,
 		AuthBcryptCost:                       user.DefaultUserPasswordBcryptCost,
 		AuthStatsQueueWriterInterval:         user.DefaultUserStatsQueueWriterInterval,
+		AuthHeader:                           "",
+		AuthTrustedProxies:                   make([]netip.Prefix, 0),
+		AuthFailureDelay:                     DefaultAuthFailureDelay,
+		AuthLockoutThreshold:                 DefaultAuthLockoutThreshold,
+		AuthLockoutDuration:                  DefaultAuthLockoutDuration,
+		AuthMigrateTopics:                    []string{},
 		AttachmentCacheDir:                   "",
 		AttachmentTotalSizeLimit:             DefaultAttachmentTotalSizeLimit,
 		AttachmentFileSizeLimit:              DefaultAttachmentFileSizeLimit,
 		AttachmentExpiryDuration:             DefaultAttachmentExpiryDuration,
+		AttachmentDeniedTypes:                make([]string, 0),
+		AttachmentDeniedExtensions:           make([]string, 0),
+		AttachmentAllowedTopics:              make([]string, 0),
+		AttachmentDeniedTopics:               make([]string, 0),
+		AttachmentClamdAddress:               "",
+		AttachmentLANBaseURL:                 "",
+		AttachmentLANNetworks:                make([]netip.Prefix, 0),
+		AttachmentAuth:                       false,
+		AttachmentAuthURLExpiry:              DefaultAttachmentAuthURLExpiry,
+		AttachmentAuthTopics:                 make([]string, 0),
+		TTSCommand:                           "",
+		TTSFormat:                            DefaultTTSFormat,
+		TTSCacheDir:                          "",
+		TTSWorkers:                           DefaultTTSWorkers,
 		KeepaliveInterval:                    DefaultKeepaliveInterval,
+		StreamCompression:                    false,
 		ManagerInterval:                      DefaultManagerInterval,
 		DisallowedTopics:                     DefaultDisallowedTopics,
 		WebRoot:                              "/",
 		DelayedSenderInterval:                DefaultDelayedSenderInterval,
+		MonitorInterval:                      DefaultMonitorInterval,
+		MonitorTimeout:                       DefaultMonitorTimeout,
+		Bridges:                              []string{},
+		DiskSpaceMinFree:                     0,
+		DiskSpaceCheckInterval:               DefaultDiskSpaceCheckInterval,
+		FaultInjectionDelay:                  DefaultFaultInjectionDelay,
 		FirebaseKeepaliveInterval:            DefaultFirebaseKeepaliveInterval,
 		FirebasePollInterval:                 DefaultFirebasePollInterval,
 		FirebaseQuotaExceededPenaltyDuration: DefaultFirebaseQuotaExceededPenaltyDuration,
+		FirebaseQueueSize:                    DefaultFirebaseQueueSize,
+		FirebaseWorkers:                      DefaultFirebaseWorkers,
+		FirebaseAttachmentDeferSize:          0,
 		UpstreamBaseURL:                      "",
+		UpstreamFallbackBaseURLs:             make([]string, 0),
 		UpstreamAccessToken:                  "",
+		UpstreamProxy:                        "",
+		OutboundTimeout:                      DefaultOutboundTimeout,
+		OutboundMaxIdleConnsPerHost:          DefaultOutboundMaxIdleConnsPerHost,
+		OutboundCAFile:                       "",
+		OutboundProxy:                        "",
+		OutboundCircuitBreakerThreshold:      DefaultOutboundCircuitBreakerThreshold,
+		OutboundCircuitBreakerCooldown:       DefaultOutboundCircuitBreakerCooldown,
 		SMTPSenderAddr:                       "",
 		SMTPSenderUser:                       "",
 		SMTPSenderPass:                       "",
 		SMTPSenderFrom:                       "",
+		SMTPSenderProxy:                      "",
+		SMTPSenderRetryMaxAge:                DefaultSMTPSenderRetryMaxAge,
+		SMTPSenderHTML:                       false,
+		SMTPSenderHTMLTemplate:               "",
+		EmailProvider:                        "smtp",
+		EmailProviderKey:                     "",
+		EmailProviderKeyID:                   "",
+		EmailProviderRegion:                  "",
+		EmailProviderDomain:                  "",
 		SMTPServerListen:                     "",
 		SMTPServerDomain:                     "",
 		SMTPServerAddrPrefix:                 "",
+		SMTPServerRules:                      []string{},
+		TransformRules:                       []string{},
+		GeoIPFile:                            "",
+		PublishAllowedNetworks:               []string{},
+		PublishDeniedNetworks:                []string{},
+		SubscribeAllowedNetworks:             []string{},
+		SubscribeDeniedNetworks:              []string{},
 		TwilioCallsBaseURL:                   "https://api.twilio.com", // Override for tests
 		TwilioAccount:                        "",
 		TwilioAuthToken:                      "",
@@ -215,9 +384,16 @@ func NewConfig() *Config {
 		MessageSizeLimit:                     DefaultMessageSizeLimit,
 		MessageDelayMin:                      DefaultMessageDelayMin,
 		MessageDelayMax:                      DefaultMessageDelayMax,
+		MessageDedupWindow:                   DefaultMessageDedupWindow,
+		ClickURLSchemes:                      []string{},
+		AttachmentURLSchemes:                 DefaultAttachmentURLSchemes,
+		IconURLSchemes:                       DefaultIconURLSchemes,
+		TokenRotationGracePeriod:             DefaultTokenRotationGracePeriod,
 		TotalTopicLimit:                      DefaultTotalTopicLimit,
+		TotalSubscriptionLimit:               DefaultTotalSubscriptionLimit,
 		TotalAttachmentSizeLimit:             0,
 		VisitorSubscriptionLimit:             DefaultVisitorSubscriptionLimit,
+		VisitorSubscriptionDurationLimit:     DefaultVisitorSubscriptionDurationLimit,
 		VisitorAttachmentTotalSizeLimit:      DefaultVisitorAttachmentTotalSizeLimit,
 		VisitorAttachmentDailyBandwidthLimit: DefaultVisitorAttachmentDailyBandwidthLimit,
 		VisitorRequestLimitBurst:             DefaultVisitorRequestLimitBurst,
@@ -226,6 +402,8 @@ func NewConfig() *Config {
 		VisitorMessageDailyLimit:             DefaultVisitorMessageDailyLimit,
 		VisitorEmailLimitBurst:               DefaultVisitorEmailLimitBurst,
 		VisitorEmailLimitReplenish:           DefaultVisitorEmailLimitReplenish,
+		UnifiedPushEndpointLimitBurst:        DefaultUnifiedPushEndpointLimitBurst,
+		UnifiedPushEndpointLimitReplenish:    DefaultUnifiedPushEndpointLimitReplenish,
 		VisitorAccountCreationLimitBurst:     DefaultVisitorAccountCreationLimitBurst,
 		VisitorAccountCreationLimitReplenish: DefaultVisitorAccountCreationLimitReplenish,
 		VisitorAuthFailureLimitBurst:         DefaultVisitorAuthFailureLimitBurst,
@@ -235,9 +413,12 @@ func NewConfig() *Config {
 		BehindProxy:                          false,
 		StripeSecretKey:                      "",
 		StripeWebhookKey:                     "",
+		StripeProxy:                          "",
 		StripePriceCacheDuration:             DefaultStripePriceCacheDuration,
 		BillingContact:                       "",
 		EnableSignup:                         false,
+		EnableSignupVerification:             false,
+		SignupMode:                           "open",
 		EnableLogin:                          false,
 		EnableReservations:                   false,
 		AccessControlAllowOrigin:             "*",
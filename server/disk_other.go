@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package server
+
+import "errors"
+
+// diskFree is not supported on this platform, so the disk space watchdog cannot be used
+func diskFree(_ string) (uint64, error) {
+	return 0, errors.New("checking free disk space is not supported on this platform")
+}
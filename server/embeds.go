@@ -0,0 +1,62 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	embedsMax           = 10
+	embedFieldsMax      = 25
+	embedTitleLimit     = 256
+	embedTextLimit      = 4096
+	embedFieldNameLimit = 256
+	embedFieldLimit     = 1024
+)
+
+var (
+	embedColorRegex = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+)
+
+// parseEmbeds parses and validates the JSON embeds array (X-Embeds header, or "embeds" when publishing as JSON),
+// as described in https://ntfy.sh/docs/publish/#embeds. Colors are normalized to lowercase.
+func parseEmbeds(s string) ([]*messageEmbed, error) {
+	embeds := make([]*messageEmbed, 0)
+	if err := json.Unmarshal([]byte(strings.TrimSpace(s)), &embeds); err != nil {
+		return nil, fmt.Errorf("JSON error: %w", err)
+	}
+	if len(embeds) > embedsMax {
+		return nil, fmt.Errorf("only %d embeds allowed", embedsMax)
+	}
+	for _, e := range embeds {
+		if e == nil {
+			return nil, fmt.Errorf("embed must not be null")
+		} else if e.Title == "" && e.Description == "" && len(e.Fields) == 0 {
+			return nil, fmt.Errorf("embed must have a title, description or fields")
+		} else if utf8.RuneCountInString(e.Title) > embedTitleLimit {
+			return nil, fmt.Errorf("embed title must not be longer than %d characters", embedTitleLimit)
+		} else if utf8.RuneCountInString(e.Description) > embedTextLimit {
+			return nil, fmt.Errorf("embed description must not be longer than %d characters", embedTextLimit)
+		} else if e.Color != "" && !embedColorRegex.MatchString(e.Color) {
+			return nil, fmt.Errorf("embed color '%s' invalid, must be a hex color like #ff0000", e.Color)
+		} else if e.URL != "" && !strings.HasPrefix(e.URL, "http://") && !strings.HasPrefix(e.URL, "https://") {
+			return nil, fmt.Errorf("embed url must start with http:// or https://")
+		} else if len(e.Fields) > embedFieldsMax {
+			return nil, fmt.Errorf("only %d fields per embed allowed", embedFieldsMax)
+		}
+		e.Color = strings.ToLower(e.Color)
+		for _, f := range e.Fields {
+			if f == nil || f.Name == "" || f.Value == "" {
+				return nil, fmt.Errorf("embed field must have a name and a value")
+			} else if utf8.RuneCountInString(f.Name) > embedFieldNameLimit {
+				return nil, fmt.Errorf("embed field name must not be longer than %d characters", embedFieldNameLimit)
+			} else if utf8.RuneCountInString(f.Value) > embedFieldLimit {
+				return nil, fmt.Errorf("embed field value must not be longer than %d characters", embedFieldLimit)
+			}
+		}
+	}
+	return embeds, nil
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+func TestParseEmbeds(t *testing.T) {
+	embeds, err := parseEmbeds("[]")
+	require.Nil(t, err)
+	require.Empty(t, embeds)
+
+	embeds, err = parseEmbeds(`[{"title":"HighCPU","url":"https://grafana.lan","color":"#E53935","fields":[{"name":"Host","value":"db1","inline":true},{"name":"CPU","value":"97%"}]},{"description":"Second"}]`)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(embeds))
+	require.Equal(t, "HighCPU", embeds[0].Title)
+	require.Equal(t, "https://grafana.lan", embeds[0].URL)
+	require.Equal(t, "#e53935", embeds[0].Color)
+	require.Equal(t, 2, len(embeds[0].Fields))
+	require.Equal(t, "Host", embeds[0].Fields[0].Name)
+	require.Equal(t, "db1", embeds[0].Fields[0].Value)
+	require.True(t, embeds[0].Fields[0].Inline)
+	require.False(t, embeds[0].Fields[1].Inline)
+	require.Equal(t, "Second", embeds[1].Description)
+}
+
+func TestParseEmbeds_Errors(t *testing.T) {
+	_, err := parseEmbeds(`not json`)
+	require.EqualError(t, err, "JSON error: invalid character 'o' in literal null (expecting 'u')")
+
+	_, err = parseEmbeds(`[{}]`)
+	require.EqualError(t, err, "embed must have a title, description or fields")
+
+	_, err = parseEmbeds(`[{"title":"a","color":"red"}]`)
+	require.EqualError(t, err, "embed color 'red' invalid, must be a hex color like #ff0000")
+
+	_, err = parseEmbeds(`[{"title":"a","url":"javascript:alert(1)"}]`)
+	require.EqualError(t, err, "embed url must start with http:// or https://")
+
+	_, err = parseEmbeds(`[{"fields":[{"name":"a"}]}]`)
+	require.EqualError(t, err, "embed field must have a name and a value")
+
+	_, err = parseEmbeds(`[{"title":"` + strings.Repeat("a", 257) + `"}]`)
+	require.EqualError(t, err, "embed title must not be longer than 256 characters")
+
+	_, err = parseEmbeds("[" + strings.Repeat(`{"title":"a"},`, 10) + `{"title":"a"}]`)
+	require.EqualError(t, err, "only 10 embeds allowed")
+}
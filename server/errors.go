@@ -123,17 +123,102 @@ var (
 	errHTTPBadRequestTemplateDisallowedFunctionCalls = &errHTTP{40044, http.StatusBadRequest, "invalid request: template contains disallowed function calls, e.g. template, call, or define", "https://ntfy.sh/docs/publish/#message-templating", nil}
 	errHTTPBadRequestTemplateExecuteFailed           = &errHTTP{40045, http.StatusBadRequest, "invalid request: template execution failed", "https://ntfy.sh/docs/publish/#message-templating", nil}
 	errHTTPBadRequestInvalidUsername                 = &errHTTP{40046, http.StatusBadRequest, "invalid request: invalid username", "", nil}
+	errHTTPBadRequestMutedUntilInvalid               = &errHTTP{40047, http.StatusBadRequest, "invalid request: muted_until must be a Unix timestamp, 0 or 1", "", nil}
+	errHTTPBadRequestCallChannelInvalid              = &errHTTP{40048, http.StatusBadRequest, "invalid request: call channel must be 'call' or 'sms'", "https://ntfy.sh/docs/publish/#phone-calls", nil}
+	errHTTPBadRequestWebhookInvalid                  = &errHTTP{40049, http.StatusBadRequest, "invalid request: webhook signature or event invalid", "", nil}
+	errHTTPBadRequestAttachmentTypeDenied            = &errHTTP{40050, http.StatusBadRequest, "invalid request: attachment type not allowed", "https://ntfy.sh/docs/config/#attachment-policies", nil}
+	errHTTPBadRequestAttachmentTopicDenied           = &errHTTP{40051, http.StatusBadRequest, "invalid request: attachments not allowed in this topic", "https://ntfy.sh/docs/config/#attachment-policies", nil}
+	errHTTPBadRequestAttachmentInfected              = &errHTTP{40052, http.StatusBadRequest, "invalid request: attachment rejected by virus scanner", "https://ntfy.sh/docs/config/#attachment-policies", nil}
+	errHTTPBadRequestThumbnailUnsupported            = &errHTTP{40053, http.StatusBadRequest, "invalid request: thumbnails are only supported for JPEG, PNG and GIF images", "https://ntfy.sh/docs/publish/#thumbnails", nil}
+	errHTTPBadRequestThumbnailWidthInvalid           = &errHTTP{40054, http.StatusBadRequest, "invalid request: thumbnail width invalid", "https://ntfy.sh/docs/publish/#thumbnails", nil}
+	errHTTPBadRequestUploadLengthInvalid             = &errHTTP{40055, http.StatusBadRequest, "invalid request: Upload-Length header missing or invalid", "https://ntfy.sh/docs/publish/#resumable-uploads", nil}
+	errHTTPBadRequestUploadOffsetInvalid             = &errHTTP{40056, http.StatusBadRequest, "invalid request: Upload-Offset header missing or invalid", "https://ntfy.sh/docs/publish/#resumable-uploads", nil}
+	errHTTPBadRequestUploadIncomplete                = &errHTTP{40057, http.StatusBadRequest, "invalid request: upload incomplete", "https://ntfy.sh/docs/publish/#resumable-uploads", nil}
+	errHTTPBadRequestUploadWithAttachURL             = &errHTTP{40058, http.StatusBadRequest, "invalid request: upload cannot be combined with an external attachment URL", "https://ntfy.sh/docs/publish/#resumable-uploads", nil}
+	errHTTPBadRequestTokenTypeInvalid                = &errHTTP{40059, http.StatusBadRequest, "invalid request: token type must be 'web', 'cli' or 'integration'", "", nil}
+	errHTTPBadRequestSearchInvalid                   = &errHTTP{40060, http.StatusBadRequest, "invalid request: search requires a query (q) and at least one topic", "https://ntfy.sh/docs/subscribe/api/#search-messages", nil}
+	errHTTPBadRequestSearchDisabled                  = &errHTTP{40061, http.StatusBadRequest, "invalid request: message search is not available on this server", "https://ntfy.sh/docs/subscribe/api/#search-messages", nil}
+	errHTTPBadRequestDedupIDInvalid                  = &errHTTP{40062, http.StatusBadRequest, "invalid request: dedup ID too long", "https://ntfy.sh/docs/publish/#message-deduplication", nil}
+	errHTTPBadRequestTokenGracePeriodInvalid         = &errHTTP{40063, http.StatusBadRequest, "invalid request: grace period must be between 0 and 7 days", "https://ntfy.sh/docs/config/#rotating-tokens", nil}
+	errHTTPBadRequestMuteInvalid                     = &errHTTP{40064, http.StatusBadRequest, "invalid request: mute requires a message ID, and a duration of up to 30 days", "https://ntfy.sh/docs/config/#managing-topics", nil}
+	errHTTPBadRequestQuietHoursInvalid               = &errHTTP{40065, http.StatusBadRequest, "invalid request: quiet hours must have a start and end time (HH:MM), a valid time zone, and a priority between 1 and 5", "https://ntfy.sh/docs/subscribe/phone/#quiet-hours", nil}
+	errHTTPBadRequestBannerInvalid                   = &errHTTP{40066, http.StatusBadRequest, "invalid request: banner message must not be empty and must not exceed 1024 characters", "https://ntfy.sh/docs/config/#message-of-the-day", nil}
+	errHTTPBadRequestReplayInvalid                   = &errHTTP{40067, http.StatusBadRequest, "invalid request: replay requires two different valid topics, a valid time window and a non-negative speed", "https://ntfy.sh/docs/config/#message-replay", nil}
+	errHTTPBadRequestSSEParamsInvalid                = &errHTTP{40068, http.StatusBadRequest, "invalid request: sse-retry must be a valid duration, and sse-heartbeat must be 'event' or 'comment'", "https://ntfy.sh/docs/subscribe/api/#subscribe-as-sse-stream", nil}
+	errHTTPBadRequestExportInvalid                   = &errHTTP{40069, http.StatusBadRequest, "invalid request: export requires a valid time window, a format of 'json', 'csv' or 'attachments', and a limit of up to 10000", "https://ntfy.sh/docs/subscribe/api/#export-topic-history", nil}
+	errHTTPBadRequestUntilInvalid                    = &errHTTP{40070, http.StatusBadRequest, "invalid until parameter", "https://ntfy.sh/docs/subscribe/api/#fetch-messages-in-pages", nil}
+	errHTTPBadRequestLimitInvalid                    = &errHTTP{40071, http.StatusBadRequest, "invalid limit parameter, must be a positive number", "https://ntfy.sh/docs/subscribe/api/#fetch-messages-in-pages", nil}
+	errHTTPBadRequestTTSDisabled                     = &errHTTP{40072, http.StatusBadRequest, "invalid request: text-to-speech is not enabled on this server", "https://ntfy.sh/docs/config/#text-to-speech", nil}
+	errHTTPBadRequestTTSWithAttachment               = &errHTTP{40073, http.StatusBadRequest, "invalid request: text-to-speech cannot be combined with an attachment", "https://ntfy.sh/docs/publish/#text-to-speech", nil}
+	errHTTPBadRequestTTLInvalid                      = &errHTTP{40074, http.StatusBadRequest, "invalid request: message and attachment TTL must be positive durations, e.g. 5m", "https://ntfy.sh/docs/publish/#self-destructing-messages", nil}
+	errHTTPBadRequestTransformMessageTooLarge        = &errHTTP{40075, http.StatusBadRequest, "invalid request: message or title is too large after applying transform rules", "https://ntfy.sh/docs/config/#message-transformations", nil}
+	errHTTPBadRequestNtfyURIInvalid                  = &errHTTP{40076, http.StatusBadRequest, "invalid request: uri must be an ntfy:// link, e.g. ntfy://ntfy.sh/mytopic", "https://ntfy.sh/docs/subscribe/web/#subscribe-links", nil}
+	errHTTPBadRequestBanInvalid                      = &errHTTP{40077, http.StatusBadRequest, "invalid request: ban must have either a valid IP address/network or a username", "https://ntfy.sh/docs/config/#banning-visitors", nil}
+	errHTTPBadRequestLockoutInvalid                  = &errHTTP{40078, http.StatusBadRequest, "invalid request: username and/or IP address required to clear lockouts", "https://ntfy.sh/docs/config/#auth-failure-lockouts", nil}
+	errHTTPBadRequestSignatureInvalid                = &errHTTP{40079, http.StatusBadRequest, "invalid request: malformed signed publish request", "https://ntfy.sh/docs/publish/#signed-publishing", nil}
+	errHTTPBadRequestTopicAliasInvalid               = &errHTTP{40080, http.StatusBadRequest, "invalid request: invalid topic alias", "https://ntfy.sh/docs/config/#topic-aliases", nil}
+	errHTTPBadRequestReadMarkerInvalid               = &errHTTP{40081, http.StatusBadRequest, "invalid request: last_read must contain a valid message ID and time", "", nil}
+	errHTTPBadRequestSCIMInvalid                     = &errHTTP{40083, http.StatusBadRequest, "invalid request: invalid or unsupported SCIM request", "https://ntfy.sh/docs/config/#user-provisioning-scim", nil}
+	errHTTPBadRequestEmailPublishingDisabled         = &errHTTP{40082, http.StatusBadRequest, "invalid request: e-mail publishing is not enabled", "https://ntfy.sh/docs/config/#e-mail-publishing", nil}
+	errHTTPBadRequestTopicSeriesInvalid              = &errHTTP{40084, http.StatusBadRequest, "invalid request: invalid topic series", "https://ntfy.sh/docs/config/#topic-series", nil}
+	errHTTPBadRequestTopicSamplingInvalid            = &errHTTP{40085, http.StatusBadRequest, "invalid request: invalid sampling rule", "https://ntfy.sh/docs/config/#message-sampling", nil}
+	errHTTPBadRequestArchiveEmailInvalid             = &errHTTP{40086, http.StatusBadRequest, "invalid request: invalid archive e-mail address", "https://ntfy.sh/docs/config/#archiving-deleted-messages", nil}
+	errHTTPBadRequestSigningKeyInvalid               = &errHTTP{40087, http.StatusBadRequest, "invalid request: invalid signing key", "https://ntfy.sh/docs/config/#rotating-signing-keys", nil}
+	errHTTPBadRequestIntegrationInvalid              = &errHTTP{40088, http.StatusBadRequest, "invalid request: unsupported or invalid webhook payload", "https://ntfy.sh/docs/publish/#webhook-integrations", nil}
+	errHTTPBadRequestProxyTimeoutInvalid             = &errHTTP{40089, http.StatusBadRequest, "invalid request: proxy-timeout must be a valid duration of at least 10s", "https://ntfy.sh/docs/subscribe/api/#keepalive-behind-proxies", nil}
+	errHTTPBadRequestEmbedsInvalid                   = &errHTTP{40090, http.StatusBadRequest, "invalid request: embeds invalid", "https://ntfy.sh/docs/publish/#embeds", nil}
+	errHTTPBadRequestDashboardInvalid                = &errHTTP{40091, http.StatusBadRequest, "invalid request: invalid dashboard parameters", "https://ntfy.sh/docs/subscribe/api/#dashboards", nil}
+	errHTTPBadRequestClickURLInvalid                 = &errHTTP{40092, http.StatusBadRequest, "invalid request: click URL is invalid", "https://ntfy.sh/docs/publish/#click-action", nil}
+	errHTTPBadRequestRoutingInvalid                  = &errHTTP{40093, http.StatusBadRequest, "invalid request: routing channels must be \"push\" or \"email\", and the priority between 1 and 5", "https://ntfy.sh/docs/subscribe/phone/#notification-routing", nil}
+	errHTTPBadRequestTOTPInvalid                     = &errHTTP{40094, http.StatusBadRequest, "invalid request: two-factor code invalid", "https://ntfy.sh/docs/config/#two-factor-authentication", nil}
+	errHTTPBadRequestSignupEmailInvalid              = &errHTTP{40095, http.StatusBadRequest, "invalid request: a valid e-mail address is required to sign up", "https://ntfy.sh/docs/config/#email-verification", nil}
+	errHTTPBadRequestVerificationInvalid             = &errHTTP{40096, http.StatusBadRequest, "invalid request: verification link invalid or expired", "https://ntfy.sh/docs/config/#email-verification", nil}
+	errHTTPBadRequestInviteInvalid                   = &errHTTP{40097, http.StatusBadRequest, "invalid request: invite code invalid, expired or used up", "https://ntfy.sh/docs/config/#invite-only-signup", nil}
+	errHTTPBadRequestAccountStatsInvalid             = &errHTTP{40098, http.StatusBadRequest, "invalid request: granularity must be hour or day, and days between 1 and 90 (7 for hourly stats)", "https://ntfy.sh/docs/config/#usage-stats", nil}
+	errHTTPBadRequestPromotionCodeInvalid            = &errHTTP{40099, http.StatusBadRequest, "invalid request: promotion code invalid or expired", "https://ntfy.sh/docs/config/#promotion-codes", nil}
 	errHTTPNotFound                                  = &errHTTP{40401, http.StatusNotFound, "page not found", "", nil}
+	errHTTPNotFoundUpload                            = &errHTTP{40402, http.StatusNotFound, "upload not found or expired", "https://ntfy.sh/docs/publish/#resumable-uploads", nil}
+	errHTTPNotFoundToken                             = &errHTTP{40403, http.StatusNotFound, "token not found", "https://ntfy.sh/docs/config/#rotating-tokens", nil}
+	errHTTPNotFoundMessage                           = &errHTTP{40404, http.StatusNotFound, "message not found", "https://ntfy.sh/docs/config/#managing-topics", nil}
+	errHTTPNotFoundBan                               = &errHTTP{40405, http.StatusNotFound, "ban not found", "https://ntfy.sh/docs/config/#banning-visitors", nil}
+	errHTTPNotFoundLockout                           = &errHTTP{40406, http.StatusNotFound, "no matching auth lockout found", "https://ntfy.sh/docs/config/#auth-failure-lockouts", nil}
+	errHTTPNotFoundSCIMResource                      = &errHTTP{40408, http.StatusNotFound, "SCIM resource not found", "https://ntfy.sh/docs/config/#user-provisioning-scim", nil}
+	errHTTPNotFoundTopicAlias                        = &errHTTP{40407, http.StatusNotFound, "topic alias not found", "https://ntfy.sh/docs/config/#topic-aliases", nil}
+	errHTTPNotFoundTopicSeries                       = &errHTTP{40409, http.StatusNotFound, "no series fields defined for topic", "https://ntfy.sh/docs/config/#topic-series", nil}
+	errHTTPNotFoundTopicSampling                     = &errHTTP{40410, http.StatusNotFound, "no sampling rule defined for topic", "https://ntfy.sh/docs/config/#message-sampling", nil}
+	errHTTPNotFoundSigningKey                        = &errHTTP{40411, http.StatusNotFound, "signing key not found", "https://ntfy.sh/docs/config/#rotating-signing-keys", nil}
+	errHTTPNotFoundInvite                            = &errHTTP{40412, http.StatusNotFound, "invite not found", "https://ntfy.sh/docs/config/#invite-only-signup", nil}
+	errHTTPNotFoundOrg                               = &errHTTP{40413, http.StatusNotFound, "organization not found", "https://ntfy.sh/docs/config/#organizations", nil}
+	errHTTPNotFoundOrgInvite                         = &errHTTP{40414, http.StatusNotFound, "organization invite not found", "https://ntfy.sh/docs/config/#organizations", nil}
 	errHTTPUnauthorized                              = &errHTTP{40101, http.StatusUnauthorized, "unauthorized", "https://ntfy.sh/docs/publish/#authentication", nil}
+	errHTTPUnauthorizedEmailNotVerified              = &errHTTP{40103, http.StatusUnauthorized, "unauthorized: e-mail address not verified", "https://ntfy.sh/docs/config/#email-verification", nil}
+	errHTTPUnauthorizedTOTPRequired                  = &errHTTP{40102, http.StatusUnauthorized, "unauthorized: two-factor code required", "https://ntfy.sh/docs/config/#two-factor-authentication", nil}
 	errHTTPForbidden                                 = &errHTTP{40301, http.StatusForbidden, "forbidden", "https://ntfy.sh/docs/publish/#authentication", nil}
+	errHTTPForbiddenScopedToken                      = &errHTTP{40302, http.StatusForbidden, "forbidden: scoped tokens cannot be used to manage the account", "https://ntfy.sh/docs/config/#access-tokens", nil}
+	errHTTPForbiddenAccountSuspended                 = &errHTTP{40303, http.StatusForbidden, "forbidden: account suspended", "", nil}
+	errHTTPForbiddenSenderMuted                      = &errHTTP{40304, http.StatusForbidden, "forbidden: sender muted in this topic", "https://ntfy.sh/docs/config/#managing-topics", nil}
+	errHTTPForbiddenAttachmentsNotPermitted          = &errHTTP{40305, http.StatusForbidden, "forbidden: not allowed to upload attachments to this topic", "https://ntfy.sh/docs/config/#fine-grained-permissions", nil}
+	errHTTPForbiddenNetworkDenied                    = &errHTTP{40306, http.StatusForbidden, "forbidden: not allowed from your network or country", "https://ntfy.sh/docs/config/#network-access-rules", nil}
+	errHTTPForbiddenBanned                           = &errHTTP{40307, http.StatusForbidden, "forbidden: IP address banned", "https://ntfy.sh/docs/config/#banning-visitors", nil}
+	errHTTPForbiddenSignatureInvalid                 = &errHTTP{40308, http.StatusForbidden, "forbidden: invalid publish signature", "https://ntfy.sh/docs/publish/#signed-publishing", nil}
+	errHTTPForbiddenTopicPattern                     = &errHTTP{40309, http.StatusForbidden, "forbidden: subscribing to topic patterns requires an admin or an access control entry for the pattern", "https://ntfy.sh/docs/subscribe/api/#wildcard-subscriptions", nil}
+	errHTTPForbiddenDashboardToken                   = &errHTTP{40310, http.StatusForbidden, "forbidden: dashboard token invalid or expired", "https://ntfy.sh/docs/subscribe/api/#dashboards", nil}
+	errHTTPForbiddenAttachmentSignature              = &errHTTP{40312, http.StatusForbidden, "forbidden: attachment URL signature invalid or expired", "https://ntfy.sh/docs/config/#attachment-access-control", nil}
+	errHTTPForbiddenNotOrgAdmin                      = &errHTTP{40311, http.StatusForbidden, "forbidden: only owners and admins of the organization can do this", "https://ntfy.sh/docs/config/#organizations", nil}
 	errHTTPConflictUserExists                        = &errHTTP{40901, http.StatusConflict, "conflict: user already exists", "", nil}
 	errHTTPConflictTopicReserved                     = &errHTTP{40902, http.StatusConflict, "conflict: access control entry for topic or topic pattern already exists", "", nil}
 	errHTTPConflictSubscriptionExists                = &errHTTP{40903, http.StatusConflict, "conflict: topic subscription already exists", "", nil}
 	errHTTPConflictPhoneNumberExists                 = &errHTTP{40904, http.StatusConflict, "conflict: phone number already exists", "", nil}
+	errHTTPConflictUploadOffset                      = &errHTTP{40905, http.StatusConflict, "conflict: Upload-Offset does not match current upload offset", "https://ntfy.sh/docs/publish/#resumable-uploads", nil}
+	errHTTPConflictTOTPEnabled                       = &errHTTP{40906, http.StatusConflict, "conflict: two-factor authentication already enabled", "https://ntfy.sh/docs/config/#two-factor-authentication", nil}
+	errHTTPConflictOrgMemberExists                   = &errHTTP{40907, http.StatusConflict, "conflict: user is already a member of an organization", "https://ntfy.sh/docs/config/#organizations", nil}
+	errHTTPConflictUserAccessExists                  = &errHTTP{40908, http.StatusConflict, "conflict: user already has access to the topic", "", nil}
 	errHTTPGonePhoneVerificationExpired              = &errHTTP{41001, http.StatusGone, "phone number verification expired or does not exist", "", nil}
 	errHTTPEntityTooLargeAttachment                  = &errHTTP{41301, http.StatusRequestEntityTooLarge, "attachment too large, or bandwidth limit reached", "https://ntfy.sh/docs/publish/#limitations", nil}
 	errHTTPEntityTooLargeMatrixRequest               = &errHTTP{41302, http.StatusRequestEntityTooLarge, "Matrix request is larger than the max allowed length", "", nil}
 	errHTTPEntityTooLargeJSONBody                    = &errHTTP{41303, http.StatusRequestEntityTooLarge, "JSON body too large", "", nil}
+	errHTTPEntityTooLargeArchive                     = &errHTTP{41305, http.StatusRequestEntityTooLarge, "message archive too large to be sent via e-mail", "https://ntfy.sh/docs/config/#archiving-deleted-messages", nil}
+	errHTTPEntityTooLargeSignedBody                  = &errHTTP{41304, http.StatusRequestEntityTooLarge, "signed message body too large, must not exceed the message size limit", "https://ntfy.sh/docs/publish/#signed-publishing", nil}
 	errHTTPTooManyRequestsLimitRequests              = &errHTTP{42901, http.StatusTooManyRequests, "limit reached: too many requests", "https://ntfy.sh/docs/publish/#limitations", nil}
 	errHTTPTooManyRequestsLimitEmails                = &errHTTP{42902, http.StatusTooManyRequests, "limit reached: too many emails", "https://ntfy.sh/docs/publish/#limitations", nil}
 	errHTTPTooManyRequestsLimitSubscriptions         = &errHTTP{42903, http.StatusTooManyRequests, "limit reached: too many active subscriptions", "https://ntfy.sh/docs/publish/#limitations", nil}
@@ -141,12 +226,21 @@ var (
 	errHTTPTooManyRequestsLimitAttachmentBandwidth   = &errHTTP{42905, http.StatusTooManyRequests, "limit reached: daily bandwidth reached", "https://ntfy.sh/docs/publish/#limitations", nil}
 	errHTTPTooManyRequestsLimitAccountCreation       = &errHTTP{42906, http.StatusTooManyRequests, "limit reached: too many accounts created", "https://ntfy.sh/docs/publish/#limitations", nil} // FIXME document limit
 	errHTTPTooManyRequestsLimitReservations          = &errHTTP{42907, http.StatusTooManyRequests, "limit reached: too many topic reservations for this user", "", nil}
+	errHTTPTooManyRequestsLimitOrgTopics             = &errHTTP{42916, http.StatusTooManyRequests, "limit reached: too many topic reservations for this organization", "https://ntfy.sh/docs/config/#organizations", nil}
 	errHTTPTooManyRequestsLimitMessages              = &errHTTP{42908, http.StatusTooManyRequests, "limit reached: daily message quota reached", "https://ntfy.sh/docs/publish/#limitations", nil}
 	errHTTPTooManyRequestsLimitAuthFailure           = &errHTTP{42909, http.StatusTooManyRequests, "limit reached: too many auth failures", "https://ntfy.sh/docs/publish/#limitations", nil} // FIXME document limit
 	errHTTPTooManyRequestsLimitCalls                 = &errHTTP{42910, http.StatusTooManyRequests, "limit reached: daily phone call quota reached", "https://ntfy.sh/docs/publish/#limitations", nil}
+	errHTTPTooManyRequestsLimitUnifiedPushEndpoint   = &errHTTP{42911, http.StatusTooManyRequests, "limit reached: too many messages for this UnifiedPush endpoint", "https://ntfy.sh/docs/config/#unifiedpush-endpoint-limits", nil}
+	errHTTPTooManyRequestsLimitSubscriptionDuration  = &errHTTP{42912, http.StatusTooManyRequests, "limit reached: max. subscription duration reached, please reconnect", "https://ntfy.sh/docs/config/#subscription-limits", nil}
+	errHTTPTooManyRequestsLimitTotalSubscriptions    = &errHTTP{42913, http.StatusTooManyRequests, "limit reached: the total number of subscriptions on the server has been reached, please try again later", "https://ntfy.sh/docs/config/#subscription-limits", nil}
+	errHTTPTooManyRequestsLimitInstantDevices        = &errHTTP{42914, http.StatusTooManyRequests, "limit reached: too many devices registered for instant delivery", "https://ntfy.sh/docs/config/#instant-delivery-without-firebase", nil}
+	errHTTPTooManyRequestsAuthLockout                = &errHTTP{42915, http.StatusTooManyRequests, "limit reached: too many failed login attempts, temporarily locked out", "https://ntfy.sh/docs/config/#auth-failure-lockouts", nil}
 	errHTTPInternalError                             = &errHTTP{50001, http.StatusInternalServerError, "internal server error", "", nil}
 	errHTTPInternalErrorInvalidPath                  = &errHTTP{50002, http.StatusInternalServerError, "internal server error: invalid path", "", nil}
 	errHTTPInternalErrorMissingBaseURL               = &errHTTP{50003, http.StatusInternalServerError, "internal server error: base-url must be be configured for this feature", "https://ntfy.sh/docs/config/", nil}
 	errHTTPInternalErrorWebPushUnableToPublish       = &errHTTP{50004, http.StatusInternalServerError, "internal server error: unable to publish web push message", "", nil}
+	errHTTPInternalErrorArchiveEmail                 = &errHTTP{50005, http.StatusInternalServerError, "internal server error: unable to send archive e-mail, messages were not deleted", "https://ntfy.sh/docs/config/#archiving-deleted-messages", nil}
+	errHTTPInternalErrorVerificationEmail            = &errHTTP{50006, http.StatusInternalServerError, "internal server error: unable to send verification e-mail", "https://ntfy.sh/docs/config/#email-verification", nil}
 	errHTTPInsufficientStorageUnifiedPush            = &errHTTP{50701, http.StatusInsufficientStorage, "cannot publish to UnifiedPush topic without previously active subscriber", "", nil}
+	errHTTPInsufficientStorageDiskSpace              = &errHTTP{50702, http.StatusInsufficientStorage, "insufficient storage: the server is low on disk space, attachments are temporarily disabled", "https://ntfy.sh/docs/config/#disk-space-watchdog", nil}
 )
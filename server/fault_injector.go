@@ -0,0 +1,69 @@
+package server
+
+import (
+	"errors"
+	"heckel.io/ntfy/v2/log"
+	"math/rand"
+	"time"
+)
+
+// faultInjector injects faults into the server with the configured probabilities. It is meant for development and
+// testing only, e.g. to validate reconnection logic of clients, or alerting of operators. It must never be enabled
+// in production.
+//
+// All methods are safe to call on a nil faultInjector, in which case no faults are injected.
+type faultInjector struct {
+	delayProbability        float64       // Probability that the delivery of a message is delayed
+	delay                   time.Duration // Max delivery delay; the actual delay is random between 0 and this
+	firebaseDropProbability float64       // Probability that a Firebase message is silently dropped
+	cacheErrorProbability   float64       // Probability that writing a message to the cache fails
+}
+
+var (
+	errFaultInjectedCacheWrite = errors.New("fault injection: cache write failed")
+)
+
+// newFaultInjector creates a new fault injector from the config, or returns nil if fault injection is disabled
+func newFaultInjector(conf *Config) *faultInjector {
+	if conf.FaultInjectionDelayProbability <= 0 && conf.FaultInjectionFirebaseProbability <= 0 && conf.FaultInjectionCacheErrorProbability <= 0 {
+		return nil
+	}
+	return &faultInjector{
+		delayProbability:        conf.FaultInjectionDelayProbability,
+		delay:                   conf.FaultInjectionDelay,
+		firebaseDropProbability: conf.FaultInjectionFirebaseProbability,
+		cacheErrorProbability:   conf.FaultInjectionCacheErrorProbability,
+	}
+}
+
+// Delay blocks for a random duration (up to the configured delay), if the fault is triggered
+func (f *faultInjector) Delay(m *message) {
+	if f == nil || f.delay <= 0 || !triggered(f.delayProbability) {
+		return
+	}
+	delay := time.Duration(rand.Int63n(int64(f.delay)))
+	log.Tag(tagFault).With(m).Debug("Fault injection: Delaying delivery by %s", delay.Round(time.Millisecond))
+	time.Sleep(delay)
+}
+
+// DropFirebase returns true if the Firebase message should be dropped
+func (f *faultInjector) DropFirebase(m *message) bool {
+	if f == nil || !triggered(f.firebaseDropProbability) {
+		return false
+	}
+	log.Tag(tagFault).With(m).Debug("Fault injection: Dropping Firebase message")
+	return true
+}
+
+// CacheWriteError returns an error if writing to the message cache should fail
+func (f *faultInjector) CacheWriteError(m *message) error {
+	if f == nil || !triggered(f.cacheErrorProbability) {
+		return nil
+	}
+	log.Tag(tagFault).With(m).Debug("Fault injection: Failing cache write")
+	return errFaultInjectedCacheWrite
+}
+
+func triggered(probability float64) bool {
+	return probability > 0 && rand.Float64() < probability
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestFaultInjector_Disabled(t *testing.T) {
+	require.Nil(t, newFaultInjector(newTestConfig(t)))
+
+	var f *faultInjector
+	m := newDefaultMessage("mytopic", "hi")
+	f.Delay(m)
+	require.False(t, f.DropFirebase(m))
+	require.Nil(t, f.CacheWriteError(m))
+}
+
+func TestFaultInjector_CacheWriteError(t *testing.T) {
+	c := newTestConfig(t)
+	c.FaultInjectionCacheErrorProbability = 1
+	s := newTestServer(t, c)
+
+	response := request(t, s, "PUT", "/mytopic", "my message", nil)
+	require.Equal(t, 500, response.Code)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	require.Equal(t, "", response.Body.String())
+}
+
+func TestFaultInjector_DropFirebase(t *testing.T) {
+	c := newTestConfig(t)
+	c.FaultInjectionFirebaseProbability = 1
+	sender := newTestFirebaseSender(10)
+	s := newTestServer(t, c)
+	s.firebaseClient = newFirebaseClient(sender, &testAuther{Allow: true})
+
+	response := request(t, s, "PUT", "/mytopic", "my message", nil)
+	require.Equal(t, 200, response.Code)
+	time.Sleep(100 * time.Millisecond) // Firebase publishing would happen
+	require.Equal(t, 0, len(sender.Messages()))
+
+	// Message is still delivered to other subscribers
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	require.Equal(t, "my message", toMessage(t, response.Body.String()).Message)
+}
+
+func TestFaultInjector_Delay(t *testing.T) {
+	f := &faultInjector{
+		delayProbability: 1,
+		delay:            50 * time.Millisecond,
+	}
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		f.Delay(newDefaultMessage("mytopic", "hi"))
+	}
+	require.True(t, time.Since(start) < 500*time.Millisecond)
+
+	f.delayProbability = 0
+	start = time.Now()
+	f.Delay(newDefaultMessage("mytopic", "hi"))
+	require.True(t, time.Since(start) < 10*time.Millisecond)
+}
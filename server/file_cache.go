@@ -9,19 +9,28 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
 	"sync"
+	"time"
 )
 
 var (
 	fileIDRegex      = regexp.MustCompile(fmt.Sprintf(`^[-_A-Za-z0-9]{%d}$`, messageIDLength))
 	errInvalidFileID = errors.New("invalid file ID")
 	errFileExists    = errors.New("file exists")
+	errUploadOffset  = errors.New("upload offset mismatch")
+)
+
+const (
+	uploadFileSuffix = ".upload" // Suffix for incomplete (chunked) uploads, see CreateUpload
 )
 
 type fileCache struct {
 	dir              string
 	totalSizeCurrent int64
 	totalSizeLimit   int64
+	scanner          fileScanner   // Optional, scans files before they are accepted, see Write
+	thumbnails       chan struct{} // Limits the number of thumbnails generated at the same time, see Thumbnail
 	mu               sync.Mutex
 }
 
@@ -37,6 +46,7 @@ func newFileCache(dir string, totalSizeLimit int64) (*fileCache, error) {
 		dir:              dir,
 		totalSizeCurrent: size,
 		totalSizeLimit:   totalSizeLimit,
+		thumbnails:       make(chan struct{}, thumbnailMaxParallel),
 	}, nil
 }
 
@@ -65,6 +75,12 @@ func (c *fileCache) Write(id string, in io.Reader, limiters ...util.Limiter) (in
 		os.Remove(file)
 		return 0, err
 	}
+	if c.scanner != nil {
+		if err := c.scan(file); err != nil {
+			os.Remove(file)
+			return 0, err
+		}
+	}
 	c.mu.Lock()
 	c.totalSizeCurrent += size
 	mset(metricAttachmentsTotalSize, c.totalSizeCurrent)
@@ -72,7 +88,208 @@ func (c *fileCache) Write(id string, in io.Reader, limiters ...util.Limiter) (in
 	return size, nil
 }
 
+func (c *fileCache) scan(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return c.scanner.Scan(f)
+}
+
+// Thumbnail returns the path of a downscaled variant of the image with the given ID. Variants are generated
+// on demand, and stored next to the original file (as <id>_<width>), so they count towards the total size limit,
+// and are removed along with the original file, see Remove. Since decoding an image takes a lot of memory, only
+// thumbnailMaxParallel thumbnails are generated at the same time; other requests wait for their turn.
+func (c *fileCache) Thumbnail(id string, width int) (string, error) {
+	if !fileIDRegex.MatchString(id) {
+		return "", errInvalidFileID
+	}
+	file := filepath.Join(c.dir, fmt.Sprintf("%s_%d", id, width))
+	if _, err := os.Stat(file); err == nil {
+		return file, nil
+	}
+	c.thumbnails <- struct{}{}
+	defer func() { <-c.thumbnails }()
+	if _, err := os.Stat(file); err == nil {
+		return file, nil // Generated by another request while waiting
+	}
+	log.Tag(tagFileCache).Fields(log.Context{"message_id": id, "thumbnail_width": width}).Debug("Generating thumbnail")
+	f, err := os.Open(filepath.Join(c.dir, id))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	thumbnail, err := resizeImage(f, width)
+	if err != nil {
+		return "", err
+	} else if int64(len(thumbnail)) > c.Remaining() {
+		return "", util.ErrLimitReached
+	}
+	// Write to a temporary file first, so that concurrent requests never see a partially written thumbnail
+	tmp, err := os.CreateTemp(c.dir, fmt.Sprintf("%s_%d.*.tmp", id, width))
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(thumbnail); err != nil {
+		tmp.Close()
+		return "", err
+	} else if err := tmp.Close(); err != nil {
+		return "", err
+	} else if err := os.Rename(tmp.Name(), file); err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	c.totalSizeCurrent += int64(len(thumbnail))
+	mset(metricAttachmentsTotalSize, c.totalSizeCurrent)
+	c.mu.Unlock()
+	return file, nil
+}
+
+// CreateUpload creates an empty file for a chunked upload. Chunks are appended using AppendUpload, and the
+// completed file is turned into a regular attachment using CommitUpload.
+func (c *fileCache) CreateUpload(id string) error {
+	if !fileIDRegex.MatchString(id) {
+		return errInvalidFileID
+	}
+	log.Tag(tagFileCache).Field("upload_id", id).Debug("Creating upload")
+	f, err := os.OpenFile(filepath.Join(c.dir, id+uploadFileSuffix), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// AppendUpload appends a chunk to an upload created with CreateUpload. The offset must match the current size of
+// the upload, so that chunks are never written twice or out of order. If the chunk cannot be written completely
+// (e.g. because a limiter is exhausted), the upload is truncated back to the offset. It returns the new offset.
+func (c *fileCache) AppendUpload(id string, offset int64, in io.Reader, limiters ...util.Limiter) (int64, error) {
+	if !fileIDRegex.MatchString(id) {
+		return 0, errInvalidFileID
+	}
+	file := filepath.Join(c.dir, id+uploadFileSuffix)
+	f, err := os.OpenFile(file, os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return 0, err
+	} else if stat.Size() != offset {
+		return stat.Size(), errUploadOffset
+	} else if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	limiters = append(limiters, util.NewFixedLimiter(c.Remaining()))
+	limitWriter := util.NewLimitWriter(f, limiters...)
+	size, err := io.Copy(limitWriter, in)
+	if err != nil {
+		if err := f.Truncate(offset); err != nil {
+			log.Tag(tagFileCache).Field("upload_id", id).Err(err).Warn("Cannot truncate upload after failed write")
+		}
+		return offset, err
+	}
+	if err := f.Close(); err != nil {
+		return offset, err
+	}
+	c.mu.Lock()
+	c.totalSizeCurrent += size
+	mset(metricAttachmentsTotalSize, c.totalSizeCurrent)
+	c.mu.Unlock()
+	return offset + size, nil
+}
+
+// PeekUpload returns up to n bytes from the beginning of an upload, e.g. to detect the content type
+func (c *fileCache) PeekUpload(id string, n int) ([]byte, error) {
+	if !fileIDRegex.MatchString(id) {
+		return nil, errInvalidFileID
+	}
+	f, err := os.Open(filepath.Join(c.dir, id+uploadFileSuffix))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	b := make([]byte, n)
+	read, err := io.ReadFull(f, b)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return b[:read], nil
+}
+
+// CommitUpload turns a completed upload into an attachment with the given file ID. If a scanner is defined, the
+// file is scanned first, and removed if the scan fails. It returns the size of the file.
+func (c *fileCache) CommitUpload(uploadID, id string) (int64, error) {
+	if !fileIDRegex.MatchString(uploadID) || !fileIDRegex.MatchString(id) {
+		return 0, errInvalidFileID
+	}
+	log.Tag(tagFileCache).Fields(log.Context{"upload_id": uploadID, "message_id": id}).Debug("Committing upload")
+	uploadFile, file := filepath.Join(c.dir, uploadID+uploadFileSuffix), filepath.Join(c.dir, id)
+	if _, err := os.Stat(file); err == nil {
+		return 0, errFileExists
+	}
+	stat, err := os.Stat(uploadFile)
+	if err != nil {
+		return 0, err
+	}
+	if c.scanner != nil {
+		if err := c.scan(uploadFile); err != nil {
+			if err := c.RemoveUploads(uploadID); err != nil {
+				log.Tag(tagFileCache).Field("upload_id", uploadID).Err(err).Warn("Cannot remove rejected upload")
+			}
+			return 0, err
+		}
+	}
+	if err := os.Rename(uploadFile, file); err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+// RemoveUploads deletes the given (incomplete) uploads
+func (c *fileCache) RemoveUploads(ids ...string) error {
+	for _, id := range ids {
+		if !fileIDRegex.MatchString(id) {
+			return errInvalidFileID
+		}
+		log.Tag(tagFileCache).Field("upload_id", id).Debug("Deleting upload")
+		if err := os.Remove(filepath.Join(c.dir, id+uploadFileSuffix)); err != nil {
+			log.Tag(tagFileCache).Field("upload_id", id).Err(err).Debug("Error deleting upload")
+		}
+	}
+	return c.updateSize()
+}
+
+// RemoveStaleUploads deletes all uploads that have not been written to for the given duration. This also
+// removes leftover uploads from before a server restart.
+func (c *fileCache) RemoveStaleUploads(olderThan time.Duration) error {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+	ids := make([]string, 0)
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), uploadFileSuffix) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return err
+		} else if time.Since(info.ModTime()) > olderThan {
+			ids = append(ids, strings.TrimSuffix(e.Name(), uploadFileSuffix))
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	return c.RemoveUploads(ids...)
+}
+
+// Remove deletes the attachments with the given IDs, along with their thumbnails (<id>_<width>, see Thumbnail)
 func (c *fileCache) Remove(ids ...string) error {
+	removed := make(map[string]bool)
 	for _, id := range ids {
 		if !fileIDRegex.MatchString(id) {
 			return errInvalidFileID
@@ -82,7 +299,26 @@ func (c *fileCache) Remove(ids ...string) error {
 		if err := os.Remove(file); err != nil {
 			log.Tag(tagFileCache).Field("message_id", id).Err(err).Debug("Error deleting attachment")
 		}
+		removed[id] = true
+	}
+	// Thumbnails are found with a single pass over the directory, rather than one glob per ID
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if len(name) <= messageIDLength || name[messageIDLength] != '_' || !removed[name[:messageIDLength]] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(c.dir, name)); err != nil {
+			log.Tag(tagFileCache).Field("message_id", name[:messageIDLength]).Err(err).Debug("Error deleting thumbnail")
+		}
 	}
+	return c.updateSize()
+}
+
+func (c *fileCache) updateSize() error {
 	size, err := dirSize(c.dir)
 	if err != nil {
 		return err
@@ -2,11 +2,17 @@ package server
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"github.com/stretchr/testify/require"
 	"heckel.io/ntfy/v2/util"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
 	"os"
 	"strings"
+	"sync"
 	"testing"
 )
 
@@ -43,6 +49,117 @@ func TestFileCache_Write_Remove_Success(t *testing.T) {
 	require.Equal(t, int64(2248), c.Remaining())
 }
 
+func TestFileCache_Thumbnail_Remove_Success(t *testing.T) {
+	dir, c := newTestFileCache(t)
+	_, err := c.Write("abcdefghijkl", bytes.NewReader(newTestPNG(t, 640, 480)))
+	require.Nil(t, err)
+
+	file, err := c.Thumbnail("abcdefghijkl", 320)
+	require.Nil(t, err)
+	require.Equal(t, dir+"/abcdefghijkl_320", file)
+	f, err := os.Open(file)
+	require.Nil(t, err)
+	config, err := png.DecodeConfig(f)
+	require.Nil(t, f.Close())
+	require.Nil(t, err)
+	require.Equal(t, 320, config.Width)
+	require.Equal(t, 240, config.Height)
+
+	stat, err := os.Stat(file)
+	require.Nil(t, err)
+	size := c.Size()
+	file2, err := c.Thumbnail("abcdefghijkl", 320) // Cached
+	require.Nil(t, err)
+	require.Equal(t, file, file2)
+	require.Equal(t, size, c.Size())
+	require.Greater(t, size, stat.Size())
+
+	require.Nil(t, c.Remove("abcdefghijkl"))
+	require.NoFileExists(t, dir+"/abcdefghijkl")
+	require.NoFileExists(t, dir+"/abcdefghijkl_320")
+	require.Equal(t, int64(0), c.Size())
+}
+
+func TestFileCache_Thumbnail_Unsupported(t *testing.T) {
+	_, c := newTestFileCache(t)
+	_, err := c.Write("abcdefghijkl", strings.NewReader("not an image"))
+	require.Nil(t, err)
+	_, err = c.Thumbnail("abcdefghijkl", 320)
+	require.Equal(t, errThumbnailUnsupported, err)
+}
+
+func TestFileCache_Thumbnail_TooManyPixels(t *testing.T) {
+	_, c := newTestFileCache(t)
+	var buf bytes.Buffer
+	require.Nil(t, gif.Encode(&buf, image.NewPaletted(image.Rect(0, 0, 1, 1), color.Palette{color.Black}), nil))
+	img := buf.Bytes()
+	binary.LittleEndian.PutUint16(img[6:], 5000) // Logical screen width and height, as claimed by the header
+	binary.LittleEndian.PutUint16(img[8:], 5000)
+	_, err := c.Write("abcdefghijkl", bytes.NewReader(img))
+	require.Nil(t, err)
+	_, err = c.Thumbnail("abcdefghijkl", 320)
+	require.Equal(t, errThumbnailUnsupported, err)
+}
+
+func TestFileCache_Thumbnail_Parallel(t *testing.T) {
+	dir, c := newTestFileCache(t)
+	_, err := c.Write("abcdefghijkl", bytes.NewReader(newTestPNG(t, 256, 192)))
+	require.Nil(t, err)
+	_, err = c.Write("abcdefghijk2", bytes.NewReader(newTestPNG(t, 128, 96)))
+	require.Nil(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(width int) {
+			defer wg.Done()
+			_, err := c.Thumbnail("abcdefghijkl", width)
+			require.Nil(t, err)
+		}(64 * (i%3 + 1))
+	}
+	wg.Wait()
+	require.Equal(t, 0, len(c.thumbnails))
+	_, err = c.Thumbnail("abcdefghijk2", 64)
+	require.Nil(t, err)
+
+	// Only the thumbnails of removed attachments are deleted
+	require.Nil(t, c.Remove("abcdefghijkl"))
+	require.NoFileExists(t, dir+"/abcdefghijkl_64")
+	require.NoFileExists(t, dir+"/abcdefghijkl_128")
+	require.NoFileExists(t, dir+"/abcdefghijkl_192")
+	require.FileExists(t, dir+"/abcdefghijk2")
+	require.FileExists(t, dir+"/abcdefghijk2_64")
+}
+
+func TestFileCache_Upload_Append_Commit(t *testing.T) {
+	dir, c := newTestFileCache(t)
+	require.Nil(t, c.CreateUpload("abcdefghijkl"))
+	offset, err := c.AppendUpload("abcdefghijkl", 0, strings.NewReader("hello "))
+	require.Nil(t, err)
+	require.Equal(t, int64(6), offset)
+	_, err = c.AppendUpload("abcdefghijkl", 0, strings.NewReader("hello "))
+	require.Equal(t, errUploadOffset, err)
+	offset, err = c.AppendUpload("abcdefghijkl", 6, strings.NewReader("world, too long"), util.NewFixedLimiter(5))
+	require.Equal(t, util.ErrLimitReached, err)
+	require.Equal(t, int64(6), offset)
+	require.Equal(t, "hello ", readFile(t, dir+"/abcdefghijkl.upload")) // Truncated
+	offset, err = c.AppendUpload("abcdefghijkl", 6, strings.NewReader("world"), util.NewFixedLimiter(5))
+	require.Nil(t, err)
+	require.Equal(t, int64(11), offset)
+	require.Equal(t, int64(11), c.Size())
+
+	peeked, err := c.PeekUpload("abcdefghijkl", 5)
+	require.Nil(t, err)
+	require.Equal(t, "hello", string(peeked))
+
+	size, err := c.CommitUpload("abcdefghijkl", "mnopqrstuvwx")
+	require.Nil(t, err)
+	require.Equal(t, int64(11), size)
+	require.Equal(t, "hello world", readFile(t, dir+"/mnopqrstuvwx"))
+	require.NoFileExists(t, dir+"/abcdefghijkl.upload")
+	require.Equal(t, int64(11), c.Size())
+}
+
 func TestFileCache_Write_FailedTotalSizeLimit(t *testing.T) {
 	dir, c := newTestFileCache(t)
 	for i := 0; i < 10; i++ {
@@ -74,3 +191,15 @@ func readFile(t *testing.T, f string) string {
 	require.Nil(t, err)
 	return string(b)
 }
+
+func newTestPNG(t *testing.T, width, height int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetRGBA(x, y, color.RGBA{R: uint8(x / 64 * 20), G: uint8(y / 64 * 20), B: 100, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	require.Nil(t, png.Encode(&buf, img))
+	return buf.Bytes()
+}
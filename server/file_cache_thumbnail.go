@@ -0,0 +1,98 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif" // Register GIF decoder
+	"image/jpeg"
+	"image/png"
+	"io"
+)
+
+const (
+	thumbnailDefaultWidth = 320              // Width used for ?thumb=1
+	thumbnailMaxWidth     = 1024             // Max width that can be requested via ?width=...
+	thumbnailWidthStep    = 64               // Requested widths are rounded up to a multiple of this, to limit the number of variants
+	thumbnailMaxPixels    = 16 * 1000 * 1000 // Max pixels of the original image, to protect against decompression bombs (~64 MB when decoded)
+	thumbnailMaxParallel  = 2                // Max number of thumbnails generated at the same time, to limit memory and CPU usage
+	thumbnailJPEGQuality  = 80
+)
+
+var (
+	errThumbnailUnsupported = errors.New("thumbnails are only supported for JPEG, PNG and GIF images")
+)
+
+// normalizeThumbnailWidth normalizes a requested thumbnail width, see thumbnailWidthStep and thumbnailMaxWidth
+func normalizeThumbnailWidth(width int) int {
+	if width <= 0 {
+		return 0
+	} else if width > thumbnailMaxWidth {
+		return thumbnailMaxWidth
+	}
+	return (width + thumbnailWidthStep - 1) / thumbnailWidthStep * thumbnailWidthStep
+}
+
+// resizeImage decodes the image from r, scales it down to the given width (keeping the aspect ratio),
+// and encodes it as JPEG (for JPEG images) or PNG (for everything else). Animated GIFs are reduced to their
+// first frame. If the image is already narrower than the given width, it is returned as is (re-encoded).
+func resizeImage(r io.ReadSeeker, width int) ([]byte, error) {
+	config, format, err := image.DecodeConfig(r)
+	if err != nil {
+		return nil, errThumbnailUnsupported
+	} else if config.Width <= 0 || config.Height <= 0 || int64(config.Width)*int64(config.Height) > thumbnailMaxPixels {
+		return nil, errThumbnailUnsupported
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	src, _, err := image.Decode(r)
+	if err != nil {
+		return nil, errThumbnailUnsupported
+	}
+	dst := src
+	if src.Bounds().Dx() > width {
+		height := max(1, src.Bounds().Dy()*width/src.Bounds().Dx())
+		dst = scaleImage(src, width, height)
+	}
+	var buf bytes.Buffer
+	if format == "jpeg" {
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: thumbnailJPEGQuality})
+	} else {
+		err = png.Encode(&buf, dst)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// scaleImage scales down src to the given dimensions using a box filter, i.e. each destination pixel
+// is the average of all source pixels it covers
+func scaleImage(src image.Image, width, height int) *image.RGBA {
+	bounds := src.Bounds()
+	rgba, ok := src.(*image.RGBA)
+	if !ok || bounds.Min != (image.Point{}) {
+		rgba = image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		draw.Draw(rgba, rgba.Bounds(), src, bounds.Min, draw.Src)
+	}
+	srcWidth, srcHeight := rgba.Bounds().Dx(), rgba.Bounds().Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := y*srcHeight/height, max((y+1)*srcHeight/height, y*srcHeight/height+1)
+		for x := 0; x < width; x++ {
+			x0, x1 := x*srcWidth/width, max((x+1)*srcWidth/width, x*srcWidth/width+1)
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					c := rgba.RGBAAt(sx, sy)
+					r, g, b, a, n = r+uint64(c.R), g+uint64(c.G), b+uint64(c.B), a+uint64(c.A), n+1
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{R: uint8(r / n), G: uint8(g / n), B: uint8(b / n), A: uint8(a / n)})
+		}
+	}
+	return dst
+}
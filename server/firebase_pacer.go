@@ -0,0 +1,181 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Firebase limits how many messages can be sent per topic, and per project (see docs/config.md#firebase-limits).
+// If FCM responds with "quota exceeded", sends to the topic (or to all topics, if the project quota is exceeded) are
+// paced: they are held back for the duration of the Retry-After hint of the response, or, if there is none, for a
+// delay that doubles with every quota error (up to Config.FirebaseQuotaExceededPenaltyDuration). Every successful
+// send halves the delay again, until the topic is no longer paced.
+//
+// Messages that are held back are put back into the Firebase queue once the delay has passed, so that a paced topic
+// does not hold up the Firebase workers. Messages that would have to wait longer than firebasePacingWaitMax are not
+// sent at all. The pacing state is exposed via the stats endpoint (see handleStats).
+
+const (
+	firebasePacingDelayMin = 5 * time.Second // First delay after a quota error without a Retry-After hint
+	firebasePacingWaitMax  = 5 * time.Second // Max. time a message to a paced topic is held back before it is dropped
+	firebasePacingProject  = ""              // Pacing key for project-wide quota errors; topics cannot be empty
+)
+
+const (
+	firebaseQuotaFailureType = "type.googleapis.com/google.rpc.QuotaFailure" // Error detail type of quota errors, see firebaseProjectQuotaExceeded
+	firebaseErrorBodyLimit   = 64 * 1024                                     // Max. size of error responses that are parsed
+)
+
+// firebasePacer holds the pacing state per topic (and for the whole project), see above
+type firebasePacer struct {
+	delayMax time.Duration
+	paces    map[string]*firebasePace // Topic -> pace, or firebasePacingProject -> pace
+	mu       sync.Mutex
+}
+
+type firebasePace struct {
+	delay time.Duration // Current delay, doubled after every quota error, halved after every successful send
+	until time.Time     // No messages are sent before this time
+}
+
+// firebasePacingStats is a snapshot of the pacing state
+type firebasePacingStats struct {
+	PacedTopics  int           // Number of topics that are currently held back
+	ProjectDelay time.Duration // Time until sends to all topics resume, zero if the project is not paced
+	MaxDelay     time.Duration // Longest time until sends resume, for any topic or the project
+}
+
+func newFirebasePacer(delayMax time.Duration) *firebasePacer {
+	return &firebasePacer{
+		delayMax: delayMax,
+		paces:    make(map[string]*firebasePace),
+	}
+}
+
+// Wait returns how long sends to the given topic are held back, or zero if messages can be sent right away
+func (p *firebasePacer) Wait(topic string) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	var wait time.Duration
+	for _, key := range []string{firebasePacingProject, topic} {
+		if pace, ok := p.paces[key]; ok && pace.until.After(now) {
+			wait = max(wait, pace.until.Sub(now))
+		}
+	}
+	return wait
+}
+
+// QuotaExceeded paces the topic (or the whole project), and returns the delay. The Retry-After hint
+// of the response is honored if it is longer than the current delay.
+func (p *firebasePacer) QuotaExceeded(topic string, project bool, retryAfter time.Duration) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := topic
+	if project {
+		key = firebasePacingProject
+	}
+	pace, ok := p.paces[key]
+	if !ok {
+		pace = &firebasePace{delay: firebasePacingDelayMin / 2}
+		p.paces[key] = pace
+	}
+	pace.delay = max(min(pace.delay*2, p.delayMax), retryAfter)
+	pace.until = time.Now().Add(pace.delay)
+	return pace.delay
+}
+
+// Sent halves the delay of the topic and the project after a successful send, and stops pacing them
+// once the delay drops below firebasePacingDelayMin
+func (p *firebasePacer) Sent(topic string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, key := range []string{firebasePacingProject, topic} {
+		if pace, ok := p.paces[key]; ok {
+			pace.delay /= 2
+			if pace.delay < firebasePacingDelayMin {
+				delete(p.paces, key)
+			}
+		}
+	}
+}
+
+// Stats returns a snapshot of the pacing state
+func (p *firebasePacer) Stats() *firebasePacingStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	stats := &firebasePacingStats{}
+	for key, pace := range p.paces {
+		if !pace.until.After(now) {
+			continue
+		}
+		wait := pace.until.Sub(now)
+		if key == firebasePacingProject {
+			stats.ProjectDelay = wait
+		} else {
+			stats.PacedTopics++
+		}
+		stats.MaxDelay = max(stats.MaxDelay, wait)
+	}
+	return stats
+}
+
+// parseRetryAfter parses the Retry-After header of a response, which is either a number of seconds,
+// or an HTTP date. It returns zero if there is no (valid) header.
+func parseRetryAfter(resp *http.Response) time.Duration {
+	if resp == nil {
+		return 0
+	}
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	} else if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	} else if t, err := http.ParseTime(value); err == nil && t.After(time.Now()) {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// firebaseProjectQuotaExceeded returns true if the "quota exceeded" response of FCM refers to the quota of the whole
+// project rather than a single topic, i.e. if the google.rpc.QuotaFailure detail of the error names the project as
+// the subject of a violation (e.g. "project_number:123").
+func firebaseProjectQuotaExceeded(resp *http.Response) bool {
+	if resp == nil || resp.Body == nil {
+		return false
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, firebaseErrorBodyLimit))
+	if err != nil {
+		return false
+	}
+	var response struct {
+		Error struct {
+			Details []struct {
+				Type       string `json:"@type"`
+				Violations []struct {
+					Subject string `json:"subject"`
+				} `json:"violations"`
+			} `json:"details"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return false
+	}
+	for _, detail := range response.Error.Details {
+		if detail.Type != firebaseQuotaFailureType {
+			continue
+		}
+		for _, violation := range detail.Violations {
+			if strings.HasPrefix(violation.Subject, "project_number:") || strings.HasPrefix(violation.Subject, "projects/") {
+				return true
+			}
+		}
+	}
+	return false
+}
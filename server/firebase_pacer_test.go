@@ -0,0 +1,55 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFirebasePacer_AdaptiveDelay(t *testing.T) {
+	p := newFirebasePacer(time.Minute)
+	require.Equal(t, time.Duration(0), p.Wait("mytopic"))
+
+	// Delay doubles with every quota error, up to the max.
+	require.Equal(t, 5*time.Second, p.QuotaExceeded("mytopic", false, 0))
+	require.Equal(t, 10*time.Second, p.QuotaExceeded("mytopic", false, 0))
+	require.Equal(t, 20*time.Second, p.QuotaExceeded("mytopic", false, 0))
+	require.Equal(t, 40*time.Second, p.QuotaExceeded("mytopic", false, 0))
+	require.Equal(t, time.Minute, p.QuotaExceeded("mytopic", false, 0))
+	require.Equal(t, 2*time.Minute, p.QuotaExceeded("mytopic", false, 2*time.Minute)) // Retry-After wins
+	require.InDelta(t, 120, p.Wait("mytopic").Seconds(), 1)
+	require.Equal(t, time.Duration(0), p.Wait("othertopic"))
+
+	// Successful sends halve the delay, until the topic is no longer paced
+	for i := 0; i < 4; i++ {
+		p.Sent("mytopic")
+	}
+	require.Equal(t, 1, p.Stats().PacedTopics)
+	p.Sent("mytopic")
+	require.Equal(t, 0, p.Stats().PacedTopics)
+	require.Equal(t, 5*time.Second, p.QuotaExceeded("mytopic", false, 0))
+}
+
+func TestFirebasePacer_Project(t *testing.T) {
+	p := newFirebasePacer(10 * time.Minute)
+	p.QuotaExceeded("mytopic", true, 30*time.Second)
+	require.InDelta(t, 30, p.Wait("othertopic").Seconds(), 1)
+	stats := p.Stats()
+	require.Equal(t, 0, stats.PacedTopics)
+	require.InDelta(t, 30, stats.ProjectDelay.Seconds(), 1)
+	require.InDelta(t, 30, stats.MaxDelay.Seconds(), 1)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	resp := &http.Response{Header: http.Header{}}
+	require.Equal(t, time.Duration(0), parseRetryAfter(nil))
+	require.Equal(t, time.Duration(0), parseRetryAfter(resp))
+	resp.Header.Set("Retry-After", "120")
+	require.Equal(t, 2*time.Minute, parseRetryAfter(resp))
+	resp.Header.Set("Retry-After", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	require.InDelta(t, time.Hour.Seconds(), parseRetryAfter(resp).Seconds(), 2)
+	resp.Header.Set("Retry-After", "invalid")
+	require.Equal(t, time.Duration(0), parseRetryAfter(resp))
+}
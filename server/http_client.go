@@ -0,0 +1,151 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"heckel.io/ntfy/v2/log"
+)
+
+// All outbound HTTP requests (upstream poll forwarding, Twilio, Web Push, uptime monitor checks) go through a shared
+// httpClient, so that connections are pooled and kept alive across requests, instead of opening a new connection
+// for every message. Requests are sent through "outbound-proxy" if set (see outbound_proxy.go), and the client trusts
+// the CAs in "outbound-ca-file" in addition to the system CAs.
+//
+// Each destination host has a circuit breaker: After "outbound-circuit-breaker-threshold" consecutive failures
+// (connection errors or HTTP 5xx), requests to the host fail right away with errHTTPClientCircuitOpen for
+// "outbound-circuit-breaker-cooldown". After that, a single request is let through; if it succeeds, the circuit
+// is closed again, otherwise it stays open for another cooldown period. This avoids piling up requests (and
+// goroutines) when a destination is down.
+
+var (
+	errHTTPClientCircuitOpen = errors.New("circuit breaker open, destination temporarily unavailable")
+)
+
+// httpClient is the shared HTTP client for outbound requests, see above
+type httpClient struct {
+	client    *http.Client
+	threshold int           // Consecutive failures before the circuit opens, 0 disables circuit breakers
+	cooldown  time.Duration // Time the circuit stays open
+	breakers  map[string]*circuitBreaker
+	mu        sync.Mutex
+}
+
+// circuitBreaker is the state of a single destination host
+type circuitBreaker struct {
+	failures  int
+	openUntil time.Time
+	probing   bool // A trial request is in flight after the cooldown
+}
+
+// newHTTPClient creates a client that sends requests through the given proxy, see outboundProxyURL
+func newHTTPClient(conf *Config, proxy string) (*httpClient, error) {
+	proxyFunc, err := outboundProxyFunc(conf, proxy)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{}
+	if conf.OutboundCAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := os.ReadFile(conf.OutboundCAFile)
+		if err != nil {
+			return nil, err
+		} else if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", conf.OutboundCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	transport := &http.Transport{
+		Proxy: proxyFunc,
+		DialContext: (&net.Dialer{
+			Timeout:   conf.OutboundTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:     tlsConfig,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: conf.OutboundMaxIdleConnsPerHost,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: conf.OutboundTimeout,
+	}
+	return &httpClient{
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   conf.OutboundTimeout,
+		},
+		threshold: conf.OutboundCircuitBreakerThreshold,
+		cooldown:  conf.OutboundCircuitBreakerCooldown,
+		breakers:  make(map[string]*circuitBreaker),
+	}, nil
+}
+
+// Do sends the request, unless the circuit breaker of the destination host is open. Failures (connection errors
+// and HTTP 5xx responses) are counted towards the circuit breaker. It implements webpush.HTTPClient.
+func (c *httpClient) Do(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	if !c.allow(host) {
+		return nil, fmt.Errorf("%s: %w", host, errHTTPClientCircuitOpen)
+	}
+	resp, err := c.client.Do(req)
+	c.record(host, err == nil && resp.StatusCode < 500)
+	return resp, err
+}
+
+// Client returns the underlying HTTP client, without circuit breakers, e.g. for uptime monitor checks, which are
+// supposed to see every failure
+func (c *httpClient) Client() *http.Client {
+	return c.client
+}
+
+func (c *httpClient) allow(host string) bool {
+	if c.threshold <= 0 {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, ok := c.breakers[host]
+	if !ok || b.failures < c.threshold {
+		return true
+	} else if b.probing || time.Now().Before(b.openUntil) {
+		return false
+	}
+	b.probing = true // Cooldown is over, let a single trial request through
+	return true
+}
+
+func (c *httpClient) record(host string, success bool) {
+	if c.threshold <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b, ok := c.breakers[host]
+	if success {
+		if ok && b.failures >= c.threshold {
+			log.Tag(tagHTTPClient).Field("http_client_host", host).Info("Circuit breaker for %s closed, destination available again", host)
+		}
+		delete(c.breakers, host)
+		return
+	} else if !ok {
+		b = &circuitBreaker{}
+		c.breakers[host] = b
+	}
+	b.failures++
+	b.probing = false
+	if b.failures >= c.threshold {
+		if b.failures == c.threshold {
+			log.Tag(tagHTTPClient).Field("http_client_host", host).Warn("Circuit breaker for %s opened after %d failures, pausing requests for %s", host, b.failures, c.cooldown.String())
+		}
+		b.openUntil = time.Now().Add(c.cooldown)
+	}
+}
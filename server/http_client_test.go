@@ -0,0 +1,123 @@
+package server
+
+import (
+	"encoding/pem"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHTTPClient_CircuitBreaker(t *testing.T) {
+	var requests, status atomic.Int32
+	status.Store(http.StatusInternalServerError)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer server.Close()
+
+	c := newTestConfig(t)
+	c.OutboundCircuitBreakerThreshold = 2
+	c.OutboundCircuitBreakerCooldown = 200 * time.Millisecond
+	client, err := newHTTPClient(c, "")
+	require.Nil(t, err)
+	get := func() (*http.Response, error) {
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		require.Nil(t, err)
+		resp, err := client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return resp, err
+	}
+
+	// Two failures open the circuit, the third request is not sent
+	for i := 0; i < 2; i++ {
+		resp, err := get()
+		require.Nil(t, err)
+		require.Equal(t, 500, resp.StatusCode)
+	}
+	_, err = get()
+	require.True(t, errors.Is(err, errHTTPClientCircuitOpen))
+	require.Equal(t, int32(2), requests.Load())
+
+	// After the cooldown, a trial request is let through; it fails, so the circuit stays open
+	time.Sleep(250 * time.Millisecond)
+	_, err = get()
+	require.Nil(t, err)
+	_, err = get()
+	require.True(t, errors.Is(err, errHTTPClientCircuitOpen))
+	require.Equal(t, int32(3), requests.Load())
+
+	// Destination recovers, trial request closes the circuit
+	status.Store(http.StatusOK)
+	time.Sleep(250 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		resp, err := get()
+		require.Nil(t, err)
+		require.Equal(t, 200, resp.StatusCode)
+	}
+	require.Equal(t, int32(6), requests.Load())
+}
+
+func TestHTTPClient_CircuitBreakerDisabled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	c := newTestConfig(t)
+	c.OutboundCircuitBreakerThreshold = 0
+	client, err := newHTTPClient(c, "")
+	require.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		require.Nil(t, err)
+		resp, err := client.Do(req)
+		require.Nil(t, err)
+		resp.Body.Close()
+		require.Equal(t, 502, resp.StatusCode)
+	}
+}
+
+func TestHTTPClient_CAFile(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	// Self-signed certificate is not trusted by default
+	client, err := newHTTPClient(newTestConfig(t), "")
+	require.Nil(t, err)
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	_, err = client.Do(req)
+	require.Error(t, err)
+
+	// Trusted via outbound-ca-file
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.Nil(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600))
+	c := newTestConfig(t)
+	c.OutboundCAFile = caFile
+	client, err = newHTTPClient(c, "")
+	require.Nil(t, err)
+	req, _ = http.NewRequest(http.MethodGet, server.URL, nil)
+	resp, err := client.Do(req)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, 200, resp.StatusCode)
+}
+
+func TestHTTPClient_CAFileInvalid(t *testing.T) {
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.Nil(t, os.WriteFile(caFile, []byte("not a certificate"), 0600))
+	c := newTestConfig(t)
+	c.OutboundCAFile = caFile
+	_, err := New(c)
+	require.Error(t, err)
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"golang.org/x/text/language"
+	"heckel.io/ntfy/v2/user"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Server-generated text (e.g. the default message of attachments, emails, quiet hours summaries, and Matrix
+// notifications) is translated using the catalogs in the locales folder. Each catalog maps a key to a format
+// string (see fmt.Sprintf), and is named after its language, e.g. de.json. Keys that are missing in a catalog
+// fall back to English.
+//
+// The language is picked from the user's account settings (the same language as in the web app), then from the
+// Accept-Language header, and falls back to the server's default language (default-language).
+
+var (
+	//go:embed locales
+	localesFs embed.FS
+	locales   = mustLoadLocales()
+)
+
+// localeCatalogs holds the translations of all languages, and a matcher to find the best language for a request
+type localeCatalogs struct {
+	languages []string                     // Language names, e.g. "en" or "pt_BR", default language first
+	catalogs  map[string]map[string]string // Language -> key -> format string
+	matcher   language.Matcher
+}
+
+func mustLoadLocales() *localeCatalogs {
+	entries, err := localesFs.ReadDir("locales")
+	if err != nil {
+		panic(err)
+	}
+	catalogs := make(map[string]map[string]string)
+	languages := []string{DefaultLanguage}
+	for _, e := range entries {
+		b, err := localesFs.ReadFile(path.Join("locales", e.Name()))
+		if err != nil {
+			panic(err)
+		}
+		var catalog map[string]string
+		if err := json.Unmarshal(b, &catalog); err != nil {
+			panic(fmt.Sprintf("invalid locale %s: %s", e.Name(), err.Error()))
+		}
+		lang := strings.TrimSuffix(e.Name(), ".json")
+		catalogs[lang] = catalog
+		if lang != DefaultLanguage {
+			languages = append(languages, lang)
+		}
+	}
+	sort.Strings(languages[1:])
+	tags := make([]language.Tag, len(languages))
+	for i, lang := range languages {
+		tags[i] = language.MustParse(strings.ReplaceAll(lang, "_", "-"))
+	}
+	return &localeCatalogs{
+		languages: languages,
+		catalogs:  catalogs,
+		matcher:   language.NewMatcher(tags),
+	}
+}
+
+// Supported returns true if there is a catalog for the given language
+func (l *localeCatalogs) Supported(lang string) bool {
+	_, ok := l.catalogs[lang]
+	return ok
+}
+
+// Match returns the supported language that best matches the given Accept-Language header or language
+// name (e.g. "de-CH" or "pt_BR"), or false if none of the languages match
+func (l *localeCatalogs) Match(acceptLanguage string) (string, bool) {
+	type weightedTag struct {
+		tag    language.Tag
+		weight float32
+	}
+	weighted := make([]weightedTag, 0)
+	for _, part := range strings.Split(strings.ReplaceAll(acceptLanguage, "_", "-"), ",") {
+		t, q, err := language.ParseAcceptLanguage(part) // Parse one by one to skip unknown languages
+		if err == nil && len(t) == 1 {
+			weighted = append(weighted, weightedTag{t[0], q[0]})
+		}
+	}
+	sort.SliceStable(weighted, func(i, j int) bool {
+		return weighted[i].weight > weighted[j].weight
+	})
+	tags := make([]language.Tag, len(weighted))
+	for i, w := range weighted {
+		tags[i] = w.tag
+	}
+	if len(tags) == 0 {
+		return "", false
+	}
+	_, index, confidence := l.matcher.Match(tags...)
+	if confidence == language.No {
+		return "", false
+	}
+	return l.languages[index], true
+}
+
+// Text returns the translation of key in the given language (falling back to English), formatted with args
+func (l *localeCatalogs) Text(lang, key string, args ...any) string {
+	format, ok := l.catalogs[lang][key]
+	if !ok {
+		format, ok = l.catalogs[DefaultLanguage][key]
+		if !ok {
+			format = key
+		}
+	}
+	if len(args) == 0 {
+		return format
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// Plural returns the translation of key in the given language, picking the "_one" or "_other" form depending on n
+func (l *localeCatalogs) Plural(lang, key string, n int) string {
+	if n == 1 {
+		return l.Text(lang, key+"_one", n)
+	}
+	return l.Text(lang, key+"_other", n)
+}
+
+// language returns the language for server-generated text in response to a request of the given visitor,
+// see above. The request may be nil.
+func (s *Server) language(v *visitor, r *http.Request) string {
+	if lang, ok := userLanguage(v.User()); ok {
+		return lang
+	} else if r != nil {
+		if lang, ok := locales.Match(r.Header.Get("Accept-Language")); ok {
+			return lang
+		}
+	}
+	return s.config().DefaultLanguage
+}
+
+// userLanguage returns the supported language that matches the language in the user's account settings, if any
+func userLanguage(u *user.User) (string, bool) {
+	if u == nil || u.Prefs == nil || u.Prefs.Language == nil {
+		return "", false
+	}
+	return locales.Match(*u.Prefs.Language)
+}
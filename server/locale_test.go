@@ -0,0 +1,93 @@
+package server
+
+import (
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+	"regexp"
+	"testing"
+)
+
+func TestLocales_CatalogsMatchEnglish(t *testing.T) {
+	verbRegex := regexp.MustCompile(`%(\[\d+])?[sd]`)
+	en := locales.catalogs[DefaultLanguage]
+	for lang, catalog := range locales.catalogs {
+		for key, format := range catalog {
+			english, ok := en[key]
+			require.True(t, ok, "key %s of language %s does not exist in English", key, lang)
+			require.Equal(t, len(verbRegex.FindAllString(english, -1)), len(verbRegex.FindAllString(format, -1)), "key %s of language %s", key, lang)
+		}
+	}
+}
+
+func TestLocales_Match(t *testing.T) {
+	for acceptLanguage, expected := range map[string]string{
+		"de":                         "de",
+		"de-CH":                      "de",
+		"de_DE":                      "de",
+		"fr-CA,fr;q=0.9,en;q=0.8":    "fr",
+		"xx;q=0.9,es;q=0.8,en;q=0.1": "es",
+		"en-US":                      "en",
+		"en;q=0.1,es;q=0.8":          "es",
+	} {
+		lang, ok := locales.Match(acceptLanguage)
+		require.True(t, ok, acceptLanguage)
+		require.Equal(t, expected, lang, acceptLanguage)
+	}
+	for _, acceptLanguage := range []string{"", "xx", "*", "not a language!"} {
+		_, ok := locales.Match(acceptLanguage)
+		require.False(t, ok, acceptLanguage)
+	}
+}
+
+func TestLocales_Text(t *testing.T) {
+	require.Equal(t, "Du hast eine Datei erhalten: a.txt", locales.Text("de", "attachment_default_message", "a.txt"))
+	require.Equal(t, "You received a file: a.txt", locales.Text("xx", "attachment_default_message", "a.txt"))
+	require.Equal(t, "You received a file: a.txt", locales.Text("", "attachment_default_message", "a.txt"))
+	require.Equal(t, "1 verpassten Anruf", locales.Plural("de", "matrix_missed_calls", 1))
+	require.Equal(t, "3 verpasste Anrufe", locales.Plural("de", "matrix_missed_calls", 3))
+}
+
+func TestServer_Locale_AttachmentMessage(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "PUT", "/mytopic?f=myfile.txt", "this is an attachment", map[string]string{
+		"Accept-Language": "fr-FR,fr;q=0.9",
+	})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "Vous avez reçu un fichier : myfile.txt", toMessage(t, response.Body.String()).Message)
+
+	response = request(t, s, "PUT", "/mytopic?f=myfile.txt", "this is an attachment", map[string]string{
+		"Accept-Language": "xx",
+	})
+	require.Equal(t, "You received a file: myfile.txt", toMessage(t, response.Body.String()).Message)
+}
+
+func TestServer_Locale_DefaultLanguage(t *testing.T) {
+	c := newTestConfig(t)
+	c.DefaultLanguage = "es"
+	s := newTestServer(t, c)
+	response := request(t, s, "PUT", "/mytopic?f=myfile.txt", "this is an attachment", nil)
+	require.Equal(t, "Has recibido un archivo: myfile.txt", toMessage(t, response.Body.String()).Message)
+
+	c = newTestConfig(t)
+	c.DefaultLanguage = "xx"
+	_, err := New(c)
+	require.Error(t, err)
+}
+
+func TestServer_Locale_AccountLanguage(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	response := request(t, s, "PATCH", "/v1/account/settings", `{"language": "de"}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+
+	// Account setting wins over Accept-Language
+	response = request(t, s, "PUT", "/mytopic?f=myfile.txt", "this is an attachment", map[string]string{
+		"Authorization":   util.BasicAuth("phil", "phil"),
+		"Accept-Language": "fr",
+	})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "Du hast eine Datei erhalten: myfile.txt", toMessage(t, response.Body.String()).Message)
+}
@@ -30,6 +30,13 @@ const (
 	tagWebsocket    = "websocket"
 	tagMatrix       = "matrix"
 	tagWebPush      = "webpush"
+	tagMonitor      = "monitor"
+	tagFault        = "fault"
+	tagTTS          = "tts"
+	tagNetworkRules = "network_rules"
+	tagHTTPClient   = "http_client"
+	tagUpstream     = "upstream"
+	tagBridge       = "bridge"
 )
 
 var (
@@ -0,0 +1,473 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"heckel.io/ntfy/v2/log"
+)
+
+// Many hosting providers block outbound SMTP (ports 25 and 587), so emails can also be sent via the HTTP APIs of
+// Amazon SES, SendGrid or Mailgun, selected via "email-provider". The X-Email publish flow is the same for all
+// providers: the mail is formatted exactly like SMTP mails (see formatMail, formatHTMLMail and formatArchiveMail)
+// by a mailSender, and then handed to a Mailer, which sends it as raw MIME message (SES, Mailgun), or as
+// structured JSON (SendGrid, which does not accept raw messages). Provider errors with status 429 or 5xx are
+// temporary, and are retried (see server_email_retry.go).
+//
+// Other services can be plugged in by passing a custom Mailer to New via WithMailer.
+
+const (
+	emailProviderSMTP     = "smtp"
+	emailProviderSES      = "ses"
+	emailProviderSendGrid = "sendgrid"
+	emailProviderMailgun  = "mailgun"
+)
+
+const (
+	emailAPIErrorBodyLimit = 512 // Max. number of bytes of the error response included in the error
+)
+
+// Mail is a formatted email, as raw MIME message, and as separate parts for services that need them
+type Mail struct {
+	From       string          // Sender address, see smtp-sender-from
+	FromName   string          // Display name of the sender, e.g. "ntfy.sh/mytopic", may be empty
+	To         string          // Recipient address
+	Subject    string          // Subject, not encoded
+	Raw        []byte          // Full MIME message, including headers, as it would be sent via SMTP
+	Text       string          // Plain text body
+	HTML       string          // HTML body, empty if HTML emails are disabled
+	Attachment *MailAttachment // Attachment, e.g. a ZIP archive of deleted messages, may be nil
+}
+
+// MailAttachment is a file attached to a Mail
+type MailAttachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// Mailer sends formatted emails. A custom implementation can be passed to New via WithMailer, to send
+// emails via a service that is not supported out of the box. Errors that wrap a net.Error, or a
+// *textproto.Error with a 4xx code, are considered temporary, and the email is retried.
+type Mailer interface {
+	SendMail(mail *Mail) error
+}
+
+// emailAPIError is a non-2xx response of an email provider API
+type emailAPIError struct {
+	Provider   string
+	StatusCode int
+	Body       string
+}
+
+func (e *emailAPIError) Error() string {
+	return fmt.Sprintf("%s: unexpected response %d %s: %s", e.Provider, e.StatusCode, http.StatusText(e.StatusCode), e.Body)
+}
+
+// Temporary returns true if the request may succeed if retried later, i.e. if the provider is rate limiting
+// or has a server error
+func (e *emailAPIError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// newMailer creates the mailer for outgoing emails, depending on the email provider, or returns nil if
+// sending emails is not configured
+func newMailer(conf *Config) (mailer, error) {
+	switch conf.EmailProvider {
+	case "", emailProviderSMTP:
+		if conf.SMTPSenderAddr == "" {
+			return nil, nil
+		}
+		if _, err := outboundProxyURL(conf, conf.SMTPSenderProxy); err != nil {
+			return nil, err
+		}
+		sender, err := newSMTPSender(conf)
+		if err != nil {
+			return nil, err
+		}
+		return sender, nil
+	case emailProviderSES, emailProviderSendGrid, emailProviderMailgun:
+		client, err := newHTTPClient(conf, conf.SMTPSenderProxy)
+		if err != nil {
+			return nil, err
+		}
+		sender, err := newMailSender(conf, newEmailProviderMailer(conf, client), conf.EmailProvider)
+		if err != nil {
+			return nil, err
+		}
+		return sender, nil
+	default:
+		return nil, fmt.Errorf("invalid email provider %s", conf.EmailProvider)
+	}
+}
+
+// emailSendingEnabled returns true if outgoing emails are configured, either via SMTP or an email provider API
+func emailSendingEnabled(conf *Config) bool {
+	if conf.EmailProvider == "" || conf.EmailProvider == emailProviderSMTP {
+		return conf.SMTPSenderAddr != ""
+	}
+	return true
+}
+
+// mailSender is a mailer that formats emails, and sends them with a Mailer, see above
+type mailSender struct {
+	config  *Config
+	mailer  Mailer
+	via     string             // Name of the mailer, for logging
+	html    *template.Template // HTML email template, nil if HTML emails are disabled, see smtp_sender_html.go
+	success int64
+	failure int64
+	mu      sync.Mutex
+}
+
+func newMailSender(conf *Config, m Mailer, via string) (*mailSender, error) {
+	html, err := loadMailTemplate(conf)
+	if err != nil {
+		return nil, err
+	}
+	return &mailSender{
+		config: conf,
+		mailer: m,
+		via:    via,
+		html:   html,
+	}, nil
+}
+
+func (s *mailSender) Send(v *visitor, m *message, to string) error {
+	return s.withCount(v, m, func() error {
+		content, err := newMailContent(s.config.BaseURL, v.ip.String(), m)
+		if err != nil {
+			return err
+		}
+		mail := &Mail{
+			From:     s.config.SMTPSenderFrom,
+			FromName: content.ShortTopicURL,
+			To:       to,
+			Subject:  content.Subject,
+			Text:     content.Text(),
+		}
+		var raw string
+		if s.html != nil {
+			if mail.HTML, err = renderHTMLMail(s.html, content, m); err != nil {
+				return err
+			} else if raw, err = formatHTMLMail(s.html, s.config.BaseURL, v.ip.String(), s.config.SMTPSenderFrom, to, m); err != nil {
+				return err
+			}
+		} else if raw, err = formatMail(s.config.BaseURL, v.ip.String(), s.config.SMTPSenderFrom, to, m); err != nil {
+			return err
+		}
+		mail.Raw = []byte(raw)
+		ev := logvm(v, m).
+			Tag(tagEmail).
+			Fields(log.Context{
+				"email_via": s.via,
+				"email_to":  to,
+			})
+		if ev.IsTrace() {
+			ev.Field("email_body", raw).Trace("Sending email")
+		} else if ev.IsDebug() {
+			ev.Debug("Sending email")
+		}
+		return s.mailer.SendMail(mail)
+	})
+}
+
+// SendArchive sends a mail with the given text, and the archive as a ZIP attachment, see server_archive.go
+func (s *mailSender) SendArchive(v *visitor, to, subject, text, filename string, archive []byte) error {
+	raw, err := formatArchiveMail(s.config.SMTPSenderFrom, to, subject, text, filename, archive)
+	if err != nil {
+		return err
+	}
+	logv(v).
+		Tag(tagEmail).
+		Fields(log.Context{
+			"email_via":          s.via,
+			"email_to":           to,
+			"email_archive_size": len(archive),
+		}).
+		Debug("Sending archive email")
+	err = s.mailer.SendMail(&Mail{
+		From:    s.config.SMTPSenderFrom,
+		To:      to,
+		Subject: subject,
+		Raw:     []byte(raw),
+		Text:    text,
+		Attachment: &MailAttachment{
+			Filename:    filename,
+			ContentType: "application/zip",
+			Data:        archive,
+		},
+	})
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		logv(v).Err(err).Debug("Sending archive mail failed")
+		s.failure++
+	} else {
+		s.success++
+	}
+	return err
+}
+
+// SendText sends a plain text mail, e.g. the email verification link, see server_account_verify.go
+func (s *mailSender) SendText(v *visitor, to, subject, text string) error {
+	logv(v).
+		Tag(tagEmail).
+		Fields(log.Context{
+			"email_via": s.via,
+			"email_to":  to,
+		}).
+		Debug("Sending text email")
+	err := s.mailer.SendMail(&Mail{
+		From:    s.config.SMTPSenderFrom,
+		To:      to,
+		Subject: subject,
+		Raw:     []byte(formatTextMail(s.config.SMTPSenderFrom, to, subject, text)),
+		Text:    text,
+	})
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		logv(v).Err(err).Debug("Sending text mail failed")
+		s.failure++
+	} else {
+		s.success++
+	}
+	return err
+}
+
+func (s *mailSender) Counts() (total int64, success int64, failure int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.success + s.failure, s.success, s.failure
+}
+
+func (s *mailSender) withCount(v *visitor, m *message, fn func() error) error {
+	err := fn()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		logvm(v, m).Err(err).Debug("Sending mail failed")
+		s.failure++
+	} else {
+		s.success++
+	}
+	return err
+}
+
+// emailProviderMailer is a Mailer that sends emails via the HTTP API of an email provider, see above
+type emailProviderMailer struct {
+	config  *Config
+	client  *httpClient
+	baseURL string // API base URL of the provider, can be overridden in tests
+}
+
+var _ Mailer = (*emailProviderMailer)(nil)
+
+func newEmailProviderMailer(conf *Config, client *httpClient) *emailProviderMailer {
+	var baseURL string
+	switch conf.EmailProvider {
+	case emailProviderSES:
+		baseURL = fmt.Sprintf("https://email.%s.amazonaws.com", conf.EmailProviderRegion)
+	case emailProviderSendGrid:
+		baseURL = "https://api.sendgrid.com"
+	case emailProviderMailgun:
+		baseURL = "https://api.mailgun.net"
+		if strings.EqualFold(conf.EmailProviderRegion, "eu") {
+			baseURL = "https://api.eu.mailgun.net"
+		}
+	}
+	return &emailProviderMailer{
+		config:  conf,
+		client:  client,
+		baseURL: baseURL,
+	}
+}
+
+// SendMail sends the mail via the API of the configured provider
+func (p *emailProviderMailer) SendMail(mail *Mail) error {
+	var req *http.Request
+	var err error
+	switch p.config.EmailProvider {
+	case emailProviderSES:
+		req, err = p.sesRequest(mail)
+	case emailProviderSendGrid:
+		req, err = p.sendGridRequest(mail)
+	case emailProviderMailgun:
+		req, err = p.mailgunRequest(mail)
+	default:
+		err = fmt.Errorf("invalid email provider %s", p.config.EmailProvider)
+	}
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, emailAPIErrorBodyLimit))
+		return &emailAPIError{
+			Provider:   p.config.EmailProvider,
+			StatusCode: resp.StatusCode,
+			Body:       strings.TrimSpace(string(body)),
+		}
+	}
+	return nil
+}
+
+// sesRequest creates a SendEmail request for the Amazon SES v2 API, with the raw MIME message, signed with
+// AWS Signature Version 4
+func (p *emailProviderMailer) sesRequest(mail *Mail) (*http.Request, error) {
+	body, err := json.Marshal(map[string]any{
+		"FromEmailAddress": mail.From,
+		"Destination": map[string]any{
+			"ToAddresses": []string{mail.To},
+		},
+		"Content": map[string]any{
+			"Raw": map[string]string{
+				"Data": base64.StdEncoding.EncodeToString(mail.Raw),
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, p.baseURL+"/v2/email/outbound-emails", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	signAWSRequest(req, body, p.config.EmailProviderKeyID, p.config.EmailProviderKey, p.config.EmailProviderRegion, "ses", time.Now())
+	return req, nil
+}
+
+// sendGridRequest creates a request for the SendGrid v3 mail send API. SendGrid does not accept raw MIME
+// messages, so the mail is sent as text and HTML parts, and attachments.
+func (p *emailProviderMailer) sendGridRequest(mail *Mail) (*http.Request, error) {
+	content := []map[string]string{{"type": "text/plain", "value": mail.Text}}
+	if mail.HTML != "" {
+		content = append(content, map[string]string{"type": "text/html", "value": mail.HTML})
+	}
+	from := map[string]string{"email": mail.From}
+	if mail.FromName != "" {
+		from["name"] = mail.FromName
+	}
+	payload := map[string]any{
+		"personalizations": []map[string]any{{"to": []map[string]string{{"email": mail.To}}}},
+		"from":             from,
+		"subject":          mail.Subject,
+		"content":          content,
+	}
+	if mail.Attachment != nil {
+		payload["attachments"] = []map[string]string{{
+			"content":     base64.StdEncoding.EncodeToString(mail.Attachment.Data),
+			"type":        mail.Attachment.ContentType,
+			"filename":    mail.Attachment.Filename,
+			"disposition": "attachment",
+		}}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, p.baseURL+"/v3/mail/send", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+p.config.EmailProviderKey)
+	return req, nil
+}
+
+// mailgunRequest creates a request for the Mailgun messages.mime API, with the raw MIME message
+func (p *emailProviderMailer) mailgunRequest(mail *Mail) (*http.Request, error) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	if err := writer.WriteField("to", mail.To); err != nil {
+		return nil, err
+	}
+	part, err := writer.CreateFormFile("message", "message.mime")
+	if err != nil {
+		return nil, err
+	} else if _, err := part.Write(mail.Raw); err != nil {
+		return nil, err
+	} else if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/v3/%s/messages.mime", p.baseURL, p.config.EmailProviderDomain), &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.SetBasicAuth("api", p.config.EmailProviderKey)
+	return req, nil
+}
+
+// signAWSRequest signs the request with AWS Signature Version 4, see
+// https://docs.aws.amazon.com/IAM/latest/UserGuide/create-signed-request.html. All headers of the request
+// are signed, so they must be set before calling this function.
+func signAWSRequest(req *http.Request, body []byte, keyID, secret, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		sha256Hex(body),
+	}, "\n")
+	scope := fmt.Sprintf("%s/%s/%s/aws4_request", date, region, service)
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+	key := []byte("AWS4" + secret)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", keyID, scope, signedHeaders, signature))
+}
+
+func sha256Hex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
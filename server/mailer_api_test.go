@@ -0,0 +1,146 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignAWSRequest(t *testing.T) {
+	// Test vector "get-vanilla" from the AWS Signature Version 4 test suite
+	req, err := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	require.Nil(t, err)
+	signAWSRequest(req, nil, "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "us-east-1", "service", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+	require.Equal(t, "20150830T123600Z", req.Header.Get("X-Amz-Date"))
+	require.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31", req.Header.Get("Authorization"))
+}
+
+func TestAPISender_SES(t *testing.T) {
+	var raw string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/v2/email/outbound-emails", r.URL.Path)
+		require.True(t, strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/"))
+		require.Contains(t, r.Header.Get("Authorization"), "/eu-west-1/ses/aws4_request, SignedHeaders=content-type;host;x-amz-date, Signature=")
+		var req struct {
+			FromEmailAddress string
+			Content          struct{ Raw struct{ Data string } }
+		}
+		require.Nil(t, json.NewDecoder(r.Body).Decode(&req))
+		require.Equal(t, "ntfy@ntfy.sh", req.FromEmailAddress)
+		b, err := base64.StdEncoding.DecodeString(req.Content.Raw.Data)
+		require.Nil(t, err)
+		raw = string(b)
+		w.Write([]byte(`{"MessageId":"abc"}`))
+	}))
+	defer server.Close()
+
+	sender := newTestAPISender(t, server.URL, func(c *Config) {
+		c.EmailProvider = emailProviderSES
+		c.EmailProviderKeyID = "AKID"
+		c.EmailProviderRegion = "eu-west-1"
+	})
+	require.Nil(t, sender.Send(newTestMailVisitor(t), newDefaultMessage("alerts", "Disk is full"), "phil@example.com"))
+	require.Contains(t, raw, "From: \"ntfy.sh/alerts\" <ntfy@ntfy.sh>\nTo: phil@example.com\nSubject: Disk is full\n")
+	total, success, _ := sender.Counts()
+	require.Equal(t, int64(1), total)
+	require.Equal(t, int64(1), success)
+}
+
+func TestAPISender_SendGrid(t *testing.T) {
+	var payload map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/v3/mail/send", r.URL.Path)
+		require.Equal(t, "Bearer secret key", r.Header.Get("Authorization"))
+		require.Nil(t, json.NewDecoder(r.Body).Decode(&payload))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	sender := newTestAPISender(t, server.URL, func(c *Config) {
+		c.EmailProvider = emailProviderSendGrid
+		c.SMTPSenderHTML = true
+	})
+	require.Nil(t, sender.Send(newTestMailVisitor(t), newDefaultMessage("alerts", "Disk is full"), "phil@example.com"))
+	require.Equal(t, "Disk is full", payload["subject"])
+	require.Equal(t, map[string]any{"email": "ntfy@ntfy.sh", "name": "ntfy.sh/alerts"}, payload["from"])
+	content := payload["content"].([]any)
+	require.Equal(t, 2, len(content))
+	require.True(t, strings.HasPrefix(content[0].(map[string]any)["value"].(string), "Disk is full\n\n--\n"))
+	require.Equal(t, "text/html", content[1].(map[string]any)["type"])
+
+	require.Nil(t, sender.SendArchive(newTestMailVisitor(t), "phil@example.com", "Archive", "Your archive", "archive.zip", []byte("zip")))
+	attachments := payload["attachments"].([]any)
+	require.Equal(t, "archive.zip", attachments[0].(map[string]any)["filename"])
+	require.Equal(t, base64.StdEncoding.EncodeToString([]byte("zip")), attachments[0].(map[string]any)["content"])
+}
+
+func TestAPISender_Mailgun(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/v3/mg.example.com/messages.mime", r.URL.Path)
+		user, pass, ok := r.BasicAuth()
+		require.True(t, ok)
+		require.Equal(t, "api", user)
+		require.Equal(t, "secret key", pass)
+		require.Equal(t, "phil@example.com", r.FormValue("to"))
+		file, _, err := r.FormFile("message")
+		require.Nil(t, err)
+		raw, _ := io.ReadAll(file)
+		require.Contains(t, string(raw), "To: phil@example.com\n")
+		w.Write([]byte(`{"id":"<abc@mg.example.com>","message":"Queued. Thank you."}`))
+	}))
+	defer server.Close()
+
+	sender := newTestAPISender(t, server.URL, func(c *Config) {
+		c.EmailProvider = emailProviderMailgun
+		c.EmailProviderDomain = "mg.example.com"
+	})
+	require.Nil(t, sender.Send(newTestMailVisitor(t), newDefaultMessage("alerts", "Disk is full"), "phil@example.com"))
+}
+
+func TestAPISender_Errors(t *testing.T) {
+	status := http.StatusTooManyRequests
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte(`{"errors":[{"message":"rate limited"}]}`))
+	}))
+	defer server.Close()
+
+	sender := newTestAPISender(t, server.URL, func(c *Config) {
+		c.EmailProvider = emailProviderSendGrid
+	})
+	err := sender.Send(newTestMailVisitor(t), newDefaultMessage("alerts", "Disk is full"), "phil@example.com")
+	require.Equal(t, `sendgrid: unexpected response 429 Too Many Requests: {"errors":[{"message":"rate limited"}]}`, err.Error())
+	require.True(t, isTemporaryEmailError(err))
+
+	status = http.StatusBadRequest
+	err = sender.Send(newTestMailVisitor(t), newDefaultMessage("alerts", "Disk is full"), "phil@example.com")
+	require.False(t, isTemporaryEmailError(err))
+	total, _, failure := sender.Counts()
+	require.Equal(t, int64(2), total)
+	require.Equal(t, int64(2), failure)
+}
+
+func newTestAPISender(t *testing.T, baseURL string, configure func(c *Config)) *mailSender {
+	c := newTestConfig(t)
+	c.BaseURL = "https://ntfy.sh"
+	c.SMTPSenderFrom = "ntfy@ntfy.sh"
+	c.EmailProviderKey = "secret key"
+	configure(c)
+	m, err := newMailer(c)
+	require.Nil(t, err)
+	sender := m.(*mailSender)
+	sender.mailer.(*emailProviderMailer).baseURL = baseURL
+	return sender
+}
+
+func newTestMailVisitor(t *testing.T) *visitor {
+	return newVisitor(newTestConfig(t), newMemTestCache(t), nil, netip.MustParseAddr("1.2.3.4"), nil)
+}
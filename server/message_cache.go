@@ -1,10 +1,12 @@
 package server
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"net/netip"
 	"strings"
 	"time"
@@ -47,7 +49,13 @@ const (
 			user TEXT NOT NULL,
 			content_type TEXT NOT NULL,
 			encoding TEXT NOT NULL,
-			published INT NOT NULL
+			published INT NOT NULL,
+			dedup_count INT NOT NULL,
+			summary TEXT NOT NULL,
+			attachment_alt TEXT NOT NULL,
+			embeds TEXT NOT NULL,
+			publisher TEXT NOT NULL,
+			compression TEXT NOT NULL
 		);
 		CREATE INDEX IF NOT EXISTS idx_mid ON messages (mid);
 		CREATE INDEX IF NOT EXISTS idx_time ON messages (time);
@@ -61,68 +69,152 @@ const (
 			value INT
 		);
 		INSERT INTO stats (key, value) VALUES ('messages', 0);
+		CREATE TABLE IF NOT EXISTS expirations (
+			mid TEXT NOT NULL,
+			topic TEXT NOT NULL,
+			time INT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_expirations_topic_time ON expirations (topic, time);
+		CREATE TABLE IF NOT EXISTS email_retries (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			mid TEXT NOT NULL,
+			topic TEXT NOT NULL,
+			email TEXT NOT NULL,
+			sender TEXT NOT NULL,
+			message TEXT NOT NULL,
+			attempts INT NOT NULL,
+			next_attempt INT NOT NULL,
+			created INT NOT NULL,
+			error TEXT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_email_retries_next_attempt ON email_retries (next_attempt);
+		CREATE TABLE IF NOT EXISTS bans (
+			network TEXT PRIMARY KEY,
+			reason TEXT NOT NULL,
+			created INT NOT NULL,
+			until INT NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS topic_aliases (
+			alias TEXT PRIMARY KEY,
+			topic TEXT NOT NULL,
+			created INT NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS topic_series_fields (
+			topic TEXT NOT NULL,
+			name TEXT NOT NULL,
+			path TEXT NOT NULL,
+			PRIMARY KEY (topic, name)
+		);
+		CREATE TABLE IF NOT EXISTS topic_sampling_rules (
+			topic TEXT PRIMARY KEY,
+			rate INT NOT NULL,
+			max_priority INT NOT NULL,
+			summary INT NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS topic_identity (
+			topic TEXT PRIMARY KEY
+		);
+		CREATE TABLE IF NOT EXISTS firebase_deliveries (
+			mid TEXT NOT NULL,
+			topic TEXT NOT NULL,
+			time INT NOT NULL,
+			outcome TEXT NOT NULL,
+			error TEXT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_firebase_deliveries_topic_time ON firebase_deliveries (topic, time);
 		COMMIT;
 	`
 	insertMessageQuery = `
-		INSERT INTO messages (mid, time, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_deleted, sender, user, content_type, encoding, published)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		INSERT INTO messages (mid, time, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, attachment_deleted, sender, user, content_type, encoding, published, dedup_count, summary, attachment_alt, embeds, publisher, compression)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 	deleteMessageQuery                = `DELETE FROM messages WHERE mid = ?`
 	updateMessagesForTopicExpiryQuery = `UPDATE messages SET expires = ? WHERE topic = ?`
-	selectRowIDFromMessageID          = `SELECT id FROM messages WHERE mid = ?` // Do not include topic, see #336 and TestServer_PollSinceID_MultipleTopics
+	selectRowIDFromMessageID          = `SELECT time, id FROM messages WHERE mid = ?` // Do not include topic, see #336 and TestServer_PollSinceID_MultipleTopics
 	selectMessagesByIDQuery           = `
-		SELECT mid, time, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender, user, content_type, encoding
+		SELECT mid, time, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender, user, content_type, encoding, dedup_count, summary, attachment_alt, embeds, publisher, compression, id
 		FROM messages 
 		WHERE mid = ?
 	`
 	selectMessagesSinceTimeQuery = `
-		SELECT mid, time, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender, user, content_type, encoding
+		SELECT mid, time, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender, user, content_type, encoding, dedup_count, summary, attachment_alt, embeds, publisher, compression, id
 		FROM messages 
-		WHERE topic = ? AND time >= ? AND published = 1
+		WHERE topic = ? AND time >= ? AND published = 1 AND (expires = 0 OR expires >= ?)
 		ORDER BY time, id
 	`
 	selectMessagesSinceTimeIncludeScheduledQuery = `
-		SELECT mid, time, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender, user, content_type, encoding
+		SELECT mid, time, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender, user, content_type, encoding, dedup_count, summary, attachment_alt, embeds, publisher, compression, id
 		FROM messages 
-		WHERE topic = ? AND time >= ?
+		WHERE topic = ? AND time >= ? AND (expires = 0 OR expires >= ?)
 		ORDER BY time, id
 	`
 	selectMessagesSinceIDQuery = `
-		SELECT mid, time, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender, user, content_type, encoding
+		SELECT mid, time, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender, user, content_type, encoding, dedup_count, summary, attachment_alt, embeds, publisher, compression, id
 		FROM messages 
-		WHERE topic = ? AND id > ? AND published = 1 
+		WHERE topic = ? AND (time > ? OR (time = ? AND id > ?)) AND published = 1 AND (expires = 0 OR expires >= ?)
 		ORDER BY time, id
 	`
 	selectMessagesSinceIDIncludeScheduledQuery = `
-		SELECT mid, time, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender, user, content_type, encoding
+		SELECT mid, time, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender, user, content_type, encoding, dedup_count, summary, attachment_alt, embeds, publisher, compression, id
+		FROM messages 
+		WHERE topic = ? AND ((time > ? OR (time = ? AND id > ?)) OR published = 0) AND (expires = 0 OR expires >= ?)
+		ORDER BY time, id
+	`
+	selectMessagesPageQuery = `
+		SELECT mid, time, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender, user, content_type, encoding, dedup_count, summary, attachment_alt, embeds, publisher, compression, id
 		FROM messages 
-		WHERE topic = ? AND (id > ? OR published = 0)
+		WHERE topic = ? AND (time > ? OR (time = ? AND id > ?)) AND time <= ? AND (published = 1 OR ?) AND (expires = 0 OR expires >= ?)
 		ORDER BY time, id
+		LIMIT ?
+	`
+	selectMessagesLatestQuery = `
+		SELECT mid, time, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender, user, content_type, encoding, dedup_count, summary, attachment_alt, embeds, publisher, compression, id
+		FROM messages 
+		WHERE topic = ? AND published = 1 AND (expires = 0 OR expires >= ?)
+		ORDER BY time DESC, id DESC
+		LIMIT ?
 	`
 	selectMessagesDueQuery = `
-		SELECT mid, time, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender, user, content_type, encoding
+		SELECT mid, time, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender, user, content_type, encoding, dedup_count, summary, attachment_alt, embeds, publisher, compression, id
 		FROM messages 
 		WHERE time <= ? AND published = 0
 		ORDER BY time, id
 	`
 	selectMessagesExpiredQuery      = `SELECT mid FROM messages WHERE expires <= ? AND published = 1`
+	selectMessageIDsByTopicQuery    = `SELECT mid FROM messages WHERE topic = ?`
+	selectMessageTimeQuery          = `SELECT time FROM messages WHERE mid = ?`
 	updateMessagePublishedQuery     = `UPDATE messages SET published = 1 WHERE mid = ?`
+	updateMessageDedupCountQuery    = `UPDATE messages SET dedup_count = ? WHERE mid = ?`
+	updateAttachmentSizeQuery       = `UPDATE messages SET attachment_size = ? WHERE mid = ?`
+	updateMessagesUserQuery         = `UPDATE messages SET user = ? WHERE topic = ? AND user = ''`
 	selectMessagesCountQuery        = `SELECT COUNT(*) FROM messages`
 	selectMessageCountPerTopicQuery = `SELECT topic, COUNT(*) FROM messages GROUP BY topic`
+	selectTopicMessageStatsQuery    = `SELECT COUNT(*), IFNULL(SUM(CASE WHEN attachment_deleted = 0 THEN attachment_size ELSE 0 END), 0) FROM messages WHERE topic = ?`
 	selectTopicsQuery               = `SELECT topic FROM messages GROUP BY topic`
 
 	updateAttachmentDeleted            = `UPDATE messages SET attachment_deleted = 1 WHERE mid = ?`
 	selectAttachmentsExpiredQuery      = `SELECT mid FROM messages WHERE attachment_expires > 0 AND attachment_expires <= ? AND attachment_deleted = 0`
+	selectAttachmentsOldestQuery       = `SELECT mid FROM messages WHERE attachment_expires > 0 AND attachment_deleted = 0 ORDER BY time, id LIMIT ?`
 	selectAttachmentsSizeBySenderQuery = `SELECT IFNULL(SUM(attachment_size), 0) FROM messages WHERE user = '' AND sender = ? AND attachment_expires >= ?`
 	selectAttachmentsSizeByUserIDQuery = `SELECT IFNULL(SUM(attachment_size), 0) FROM messages WHERE user = ? AND attachment_expires >= ?`
 
+	insertExpirationsQuery       = `INSERT INTO expirations (mid, topic, time) SELECT mid, topic, ? FROM messages WHERE mid IN (%s)`
+	selectMessageTopicsQuery     = `SELECT mid, topic FROM messages WHERE mid IN (%s)`
+	deleteMessagesQuery          = `DELETE FROM messages WHERE mid IN (%s)`
+	selectExpirationsSinceQuery  = `SELECT mid FROM expirations WHERE topic = ? AND time >= ? ORDER BY time, rowid`
+	deleteExpirationsBeforeQuery = `DELETE FROM expirations WHERE time < ?`
+
 	selectStatsQuery = `SELECT value FROM stats WHERE key = 'messages'`
 	updateStatsQuery = `UPDATE stats SET value = ? WHERE key = 'messages'`
 )
 
+const (
+	expiredMessagesBatchSize = 500 // Number of message IDs per query in DeleteExpiredMessages, well below SQLite's parameter limit
+)
+
 // Schema management queries
 const (
-	currentSchemaVersion          = 13
+	currentSchemaVersion          = 25
 	createSchemaVersionTableQuery = `
 		CREATE TABLE IF NOT EXISTS schemaVersion (
 			id INT PRIMARY KEY,
@@ -251,6 +343,114 @@ const (
 	migrate12To13AlterMessagesTableQuery = `
 		CREATE INDEX IF NOT EXISTS idx_topic ON messages (topic);
 	`
+
+	// 13 -> 14
+	migrate13To14AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN dedup_count INT NOT NULL DEFAULT('0');
+	`
+
+	// 14 -> 15
+	migrate14To15CreateExpirationsTableQuery = `
+		CREATE TABLE IF NOT EXISTS expirations (
+			mid TEXT NOT NULL,
+			topic TEXT NOT NULL,
+			time INT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_expirations_topic_time ON expirations (topic, time);
+	`
+
+	// 15 -> 16
+	migrate15To16AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN summary TEXT NOT NULL DEFAULT('');
+		ALTER TABLE messages ADD COLUMN attachment_alt TEXT NOT NULL DEFAULT('');
+	`
+
+	// 16 -> 17
+	migrate16To17CreateEmailRetriesTableQuery = `
+		CREATE TABLE IF NOT EXISTS email_retries (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			mid TEXT NOT NULL,
+			topic TEXT NOT NULL,
+			email TEXT NOT NULL,
+			sender TEXT NOT NULL,
+			message TEXT NOT NULL,
+			attempts INT NOT NULL,
+			next_attempt INT NOT NULL,
+			created INT NOT NULL,
+			error TEXT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_email_retries_next_attempt ON email_retries (next_attempt);
+	`
+
+	// 17 -> 18
+	migrate17To18CreateBansTableQuery = `
+		CREATE TABLE IF NOT EXISTS bans (
+			network TEXT PRIMARY KEY,
+			reason TEXT NOT NULL,
+			created INT NOT NULL,
+			until INT NOT NULL
+		);
+	`
+
+	// 18 -> 19
+	migrate18To19CreateTopicAliasesTableQuery = `
+		CREATE TABLE IF NOT EXISTS topic_aliases (
+			alias TEXT PRIMARY KEY,
+			topic TEXT NOT NULL,
+			created INT NOT NULL
+		);
+	`
+
+	// 19 -> 20
+	migrate19To20CreateTopicSeriesFieldsTableQuery = `
+		CREATE TABLE IF NOT EXISTS topic_series_fields (
+			topic TEXT NOT NULL,
+			name TEXT NOT NULL,
+			path TEXT NOT NULL,
+			PRIMARY KEY (topic, name)
+		);
+	`
+
+	// 20 -> 21
+	migrate20To21CreateTopicSamplingRulesTableQuery = `
+		CREATE TABLE IF NOT EXISTS topic_sampling_rules (
+			topic TEXT PRIMARY KEY,
+			rate INT NOT NULL,
+			max_priority INT NOT NULL,
+			summary INT NOT NULL
+		);
+	`
+
+	// 21 -> 22
+	migrate21To22AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN embeds TEXT NOT NULL DEFAULT('');
+	`
+
+	// 22 -> 23
+	migrate22To23AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN publisher TEXT NOT NULL DEFAULT('');
+		CREATE TABLE IF NOT EXISTS topic_identity (
+			topic TEXT PRIMARY KEY
+		);
+	`
+
+	// 23 -> 24
+	migrate23To24CreateFirebaseDeliveriesTableQuery = `
+		CREATE TABLE IF NOT EXISTS firebase_deliveries (
+			mid TEXT NOT NULL,
+			topic TEXT NOT NULL,
+			time INT NOT NULL,
+			outcome TEXT NOT NULL,
+			error TEXT NOT NULL
+		);
+		CREATE INDEX IF NOT EXISTS idx_firebase_deliveries_topic_time ON firebase_deliveries (topic, time);
+	`
+
+	// 24 -> 25
+	migrate24To25AlterMessagesTableQuery = `
+		ALTER TABLE messages ADD COLUMN compression TEXT NOT NULL DEFAULT('');
+		DROP TRIGGER IF EXISTS messages_fts_insert; -- Re-created in setupSearchIndex, to exclude compressed messages
+	`
 )
 
 var (
@@ -268,13 +468,28 @@ var (
 		10: migrateFrom10,
 		11: migrateFrom11,
 		12: migrateFrom12,
+		13: migrateFrom13,
+		14: migrateFrom14,
+		15: migrateFrom15,
+		16: migrateFrom16,
+		17: migrateFrom17,
+		18: migrateFrom18,
+		19: migrateFrom19,
+		20: migrateFrom20,
+		21: migrateFrom21,
+		22: migrateFrom22,
+		23: migrateFrom23,
+		24: migrateFrom24,
 	}
 )
 
 type messageCache struct {
-	db    *sql.DB
-	queue *util.BatchingQueue[*message]
-	nop   bool
+	db           *sql.DB
+	queue        *util.BatchingQueue[*message]
+	nop          bool
+	search       bool           // Full-text search index available, see setupSearchIndex
+	compressSize int64          // Message bodies of at least this size are compressed, see message_cache_compression.go
+	faults       *faultInjector // Development only, may be nil, see fault_injector.go
 }
 
 // newSqliteCache creates a SQLite file-backed cache
@@ -286,14 +501,19 @@ func newSqliteCache(filename, startupQueries string, cacheDuration time.Duration
 	if err := setupMessagesDB(db, startupQueries, cacheDuration); err != nil {
 		return nil, err
 	}
+	search, err := setupSearchIndex(db, searchIndexModules...)
+	if err != nil {
+		return nil, err
+	}
 	var queue *util.BatchingQueue[*message]
 	if batchSize > 0 || batchTimeout > 0 {
 		queue = util.NewBatchingQueue[*message](batchSize, batchTimeout)
 	}
 	cache := &messageCache{
-		db:    db,
-		queue: queue,
-		nop:   nop,
+		db:     db,
+		queue:  queue,
+		nop:    nop,
+		search: search,
 	}
 	go cache.processMessageBatches()
 	return cache, nil
@@ -323,6 +543,9 @@ func createMemoryFilename() string {
 // AddMessage stores a message to the message cache synchronously, or queues it to be stored at a later date asyncronously.
 // The message is queued only if "batchSize" or "batchTimeout" are passed to the constructor.
 func (c *messageCache) AddMessage(m *message) error {
+	if err := c.faults.CacheWriteError(m); err != nil {
+		return err
+	}
 	if c.queue != nil {
 		c.queue.Enqueue(m)
 		return nil
@@ -356,10 +579,11 @@ func (c *messageCache) addMessages(ms []*message) error {
 		}
 		published := m.Time <= time.Now().Unix()
 		tags := strings.Join(m.Tags, ",")
-		var attachmentName, attachmentType, attachmentURL string
+		var attachmentName, attachmentType, attachmentURL, attachmentAlt string
 		var attachmentSize, attachmentExpires, attachmentDeleted int64
 		if m.Attachment != nil {
 			attachmentName = m.Attachment.Name
+			attachmentAlt = m.Attachment.Alt
 			attachmentType = m.Attachment.Type
 			attachmentSize = m.Attachment.Size
 			attachmentExpires = m.Attachment.Expires
@@ -373,16 +597,33 @@ func (c *messageCache) addMessages(ms []*message) error {
 			}
 			actionsStr = string(actionsBytes)
 		}
+		var embedsStr string
+		if len(m.Embeds) > 0 {
+			embedsBytes, err := json.Marshal(m.Embeds)
+			if err != nil {
+				return err
+			}
+			embedsStr = string(embedsBytes)
+		}
+		var publisherStr string
+		if m.Publisher != nil {
+			publisherBytes, err := json.Marshal(m.Publisher)
+			if err != nil {
+				return err
+			}
+			publisherStr = string(publisherBytes)
+		}
 		var sender string
 		if m.Sender.IsValid() {
 			sender = m.Sender.String()
 		}
+		body, compression := c.maybeCompressMessage(m)
 		_, err := stmt.Exec(
 			m.ID,
 			m.Time,
 			m.Expires,
 			m.Topic,
-			m.Message,
+			body,
 			m.Title,
 			m.Priority,
 			tags,
@@ -400,6 +641,12 @@ func (c *messageCache) addMessages(ms []*message) error {
 			m.ContentType,
 			m.Encoding,
 			published,
+			m.DedupCount,
+			m.Summary,
+			attachmentAlt,
+			embedsStr,
+			publisherStr,
+			compression,
 		)
 		if err != nil {
 			return err
@@ -413,6 +660,9 @@ func (c *messageCache) addMessages(ms []*message) error {
 	return nil
 }
 
+// Messages returns the messages of the topic since the given marker, in (time, id) order. Like all queries that
+// return messages to subscribers, it skips messages that have expired but were not pruned yet (e.g. if their
+// X-Message-TTL is shorter than the manager interval).
 func (c *messageCache) Messages(topic string, since sinceMarker, scheduled bool) ([]*message, error) {
 	if since.IsNone() {
 		return make([]*message, 0), nil
@@ -426,9 +676,9 @@ func (c *messageCache) messagesSinceTime(topic string, since sinceMarker, schedu
 	var rows *sql.Rows
 	var err error
 	if scheduled {
-		rows, err = c.db.Query(selectMessagesSinceTimeIncludeScheduledQuery, topic, since.Time().Unix())
+		rows, err = c.db.Query(selectMessagesSinceTimeIncludeScheduledQuery, topic, since.Time().Unix(), time.Now().Unix())
 	} else {
-		rows, err = c.db.Query(selectMessagesSinceTimeQuery, topic, since.Time().Unix())
+		rows, err = c.db.Query(selectMessagesSinceTimeQuery, topic, since.Time().Unix(), time.Now().Unix())
 	}
 	if err != nil {
 		return nil, err
@@ -445,17 +695,62 @@ func (c *messageCache) messagesSinceID(topic string, since sinceMarker, schedule
 	if !idrows.Next() {
 		return c.messagesSinceTime(topic, sinceAllMessages, scheduled)
 	}
-	var rowID int64
-	if err := idrows.Scan(&rowID); err != nil {
+	var sinceTime, rowID int64
+	if err := idrows.Scan(&sinceTime, &rowID); err != nil {
 		return nil, err
 	}
 	idrows.Close()
-	var rows *sql.Rows
+	var rows *sql.Rows // Messages after the given one, in the same (time, id) order as they are sent, see sendOldMessages
 	if scheduled {
-		rows, err = c.db.Query(selectMessagesSinceIDIncludeScheduledQuery, topic, rowID)
+		rows, err = c.db.Query(selectMessagesSinceIDIncludeScheduledQuery, topic, sinceTime, sinceTime, rowID, time.Now().Unix())
 	} else {
-		rows, err = c.db.Query(selectMessagesSinceIDQuery, topic, rowID)
+		rows, err = c.db.Query(selectMessagesSinceIDQuery, topic, sinceTime, sinceTime, rowID, time.Now().Unix())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return readMessages(rows)
+}
+
+// MessageCursor returns the position of the given since marker in the (time, id) order of the message cache, i.e.
+// the position after which messages should be returned by MessagesPage. If the since marker is a message ID that
+// is not in the cache (anymore), the position before all messages is returned, same as in Messages.
+func (c *messageCache) MessageCursor(since sinceMarker) (*messageCursor, error) {
+	if !since.IsID() {
+		return &messageCursor{Time: since.Time().Unix()}, nil // Row IDs start at 1, so this includes all messages at since.Time()
+	}
+	rows, err := c.db.Query(selectRowIDFromMessageID, since.ID())
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
+	if !rows.Next() {
+		return &messageCursor{}, nil
+	}
+	var cursor messageCursor
+	if err := rows.Scan(&cursor.Time, &cursor.RowID); err != nil {
+		return nil, err
+	}
+	return &cursor, rows.Err()
+}
+
+// MessagesPage returns at most limit messages of the topic after the given cursor, and published at or before
+// until (0 means no limit), in (time, id) order. A limit < 0 means no limit. If scheduled is true, messages that are
+// not published yet are included as well. Since their time is the (future) delivery time, they come last.
+func (c *messageCache) MessagesPage(topic string, after *messageCursor, until int64, limit int, scheduled bool) ([]*message, error) {
+	if until <= 0 {
+		until = math.MaxInt64
+	}
+	rows, err := c.db.Query(selectMessagesPageQuery, topic, after.Time, after.Time, after.RowID, until, scheduled, time.Now().Unix(), limit)
+	if err != nil {
+		return nil, err
+	}
+	return readMessages(rows)
+}
+
+// MessagesLatest returns the latest limit published messages of the topic, newest first
+func (c *messageCache) MessagesLatest(topic string, limit int) ([]*message, error) {
+	rows, err := c.db.Query(selectMessagesLatestQuery, topic, time.Now().Unix(), limit)
 	if err != nil {
 		return nil, err
 	}
@@ -470,6 +765,15 @@ func (c *messageCache) MessagesDue() ([]*message, error) {
 	return readMessages(rows)
 }
 
+// TopicMessageIDs returns the IDs of all messages of the given topic, including scheduled messages
+func (c *messageCache) TopicMessageIDs(topic string) ([]string, error) {
+	rows, err := c.db.Query(selectMessageIDsByTopicQuery, topic)
+	if err != nil {
+		return nil, err
+	}
+	return readMessageIDs(rows)
+}
+
 // MessagesExpired returns a list of IDs for messages that have expires (should be deleted)
 func (c *messageCache) MessagesExpired() ([]string, error) {
 	rows, err := c.db.Query(selectMessagesExpiredQuery, time.Now().Unix())
@@ -508,6 +812,38 @@ func (c *messageCache) MarkPublished(m *message) error {
 	return err
 }
 
+// UpdateDedupCount sets the number of duplicates that were coalesced into the given message
+func (c *messageCache) UpdateDedupCount(id string, count int) error {
+	_, err := c.db.Exec(updateMessageDedupCountQuery, count, id)
+	return err
+}
+
+// UpdateAttachmentSize sets the size of the attachment of the given message, e.g. after the attachment was
+// generated asynchronously (see generateTTS). It returns errMessageNotFound if the message does not exist.
+func (c *messageCache) UpdateAttachmentSize(id string, size int64) error {
+	res, err := c.db.Exec(updateAttachmentSizeQuery, size, id)
+	if err != nil {
+		return err
+	}
+	rows, err := res.RowsAffected()
+	if err != nil {
+		return err
+	} else if rows == 0 {
+		return errMessageNotFound
+	}
+	return nil
+}
+
+// AttributeMessages sets the user of all anonymous messages in the given topic, e.g. when migrating a topic to
+// an owner (see migrateTopics). It returns the number of changed messages.
+func (c *messageCache) AttributeMessages(topic, userID string) (int64, error) {
+	res, err := c.db.Exec(updateMessagesUserQuery, userID, topic)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
 func (c *messageCache) MessageCounts() (map[string]int, error) {
 	rows, err := c.db.Query(selectMessageCountPerTopicQuery)
 	if err != nil {
@@ -528,6 +864,14 @@ func (c *messageCache) MessageCounts() (map[string]int, error) {
 	return counts, nil
 }
 
+// TopicStats returns the number of cached messages in a topic, and the total size of their attachments
+func (c *messageCache) TopicStats(topic string) (messages int, attachmentsSize int64, err error) {
+	if err := c.db.QueryRow(selectTopicMessageStatsQuery, topic).Scan(&messages, &attachmentsSize); err != nil {
+		return 0, 0, err
+	}
+	return messages, attachmentsSize, nil
+}
+
 func (c *messageCache) Topics() (map[string]*topic, error) {
 	rows, err := c.db.Query(selectTopicsQuery)
 	if err != nil {
@@ -562,6 +906,91 @@ func (c *messageCache) DeleteMessages(ids ...string) error {
 	return tx.Commit()
 }
 
+// DeleteExpiredMessages deletes the given expired messages, and remembers their IDs, so that subscribers that
+// reconnect can be told which messages expired while they were gone (see ExpirationsSince). It returns the
+// deleted message IDs by topic.
+func (c *messageCache) DeleteExpiredMessages(ids ...string) (map[string][]string, error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	expired := make(map[string][]string)
+	now := time.Now().Unix()
+	for start := 0; start < len(ids); start += expiredMessagesBatchSize {
+		batch := ids[start:min(start+expiredMessagesBatchSize, len(ids))]
+		args := make([]any, len(batch))
+		for i, id := range batch {
+			args[i] = id
+		}
+		placeholders := queryPlaceholders(len(batch))
+		rows, err := tx.Query(fmt.Sprintf(selectMessageTopicsQuery, placeholders), args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var id, topic string
+			if err := rows.Scan(&id, &topic); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			expired[topic] = append(expired[topic], id)
+		}
+		if err := rows.Err(); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		rows.Close()
+		if _, err := tx.Exec(fmt.Sprintf(insertExpirationsQuery, placeholders), append([]any{now}, args...)...); err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec(fmt.Sprintf(deleteMessagesQuery, placeholders), args...); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return expired, nil
+}
+
+// ExpirationsSince returns the IDs of the messages of the given topic that expired (i.e. were deleted by
+// DeleteExpiredMessages) after the given since marker. If the since marker is a message ID, the time of that
+// message is used. If that message does not exist anymore, all remembered expirations are returned.
+func (c *messageCache) ExpirationsSince(topic string, since sinceMarker) ([]string, error) {
+	sinceTime := since.Time().Unix()
+	if since.IsID() {
+		if err := c.db.QueryRow(selectMessageTimeQuery, since.ID()).Scan(&sinceTime); errors.Is(err, sql.ErrNoRows) {
+			sinceTime = 0
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	rows, err := c.db.Query(selectExpirationsSinceQuery, topic, sinceTime)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := make([]string, 0)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// PruneExpirations forgets the expirations (see DeleteExpiredMessages) that happened before the given time
+func (c *messageCache) PruneExpirations(before time.Time) error {
+	_, err := c.db.Exec(deleteExpirationsBeforeQuery, before.Unix())
+	return err
+}
+
 func (c *messageCache) ExpireMessages(topics ...string) error {
 	tx, err := c.db.Begin()
 	if err != nil {
@@ -581,6 +1010,19 @@ func (c *messageCache) AttachmentsExpired() ([]string, error) {
 	if err != nil {
 		return nil, err
 	}
+	return readMessageIDs(rows)
+}
+
+// AttachmentsOldest returns the message IDs of the oldest non-deleted attachments, regardless of their expiry
+func (c *messageCache) AttachmentsOldest(limit int) ([]string, error) {
+	rows, err := c.db.Query(selectAttachmentsOldestQuery, limit)
+	if err != nil {
+		return nil, err
+	}
+	return readMessageIDs(rows)
+}
+
+func readMessageIDs(rows *sql.Rows) ([]string, error) {
 	defer rows.Close()
 	ids := make([]string, 0)
 	for rows.Next() {
@@ -668,9 +1110,9 @@ func readMessages(rows *sql.Rows) ([]*message, error) {
 }
 
 func readMessage(rows *sql.Rows) (*message, error) {
-	var timestamp, expires, attachmentSize, attachmentExpires int64
-	var priority int
-	var id, topic, msg, title, tagsStr, click, icon, actionsStr, attachmentName, attachmentType, attachmentURL, sender, user, contentType, encoding string
+	var timestamp, expires, attachmentSize, attachmentExpires, rowID int64
+	var priority, dedupCount int
+	var id, topic, msg, title, tagsStr, click, icon, actionsStr, attachmentName, attachmentType, attachmentURL, sender, user, contentType, encoding, summary, attachmentAlt, embedsStr, publisherStr, compression string
 	err := rows.Scan(
 		&id,
 		&timestamp,
@@ -692,10 +1134,21 @@ func readMessage(rows *sql.Rows) (*message, error) {
 		&user,
 		&contentType,
 		&encoding,
+		&dedupCount,
+		&summary,
+		&attachmentAlt,
+		&embedsStr,
+		&publisherStr,
+		&compression,
+		&rowID,
 	)
 	if err != nil {
 		return nil, err
 	}
+	msg, err = decompressMessage(msg, compression)
+	if err != nil {
+		return nil, err
+	}
 	var tags []string
 	if tagsStr != "" {
 		tags = strings.Split(tagsStr, ",")
@@ -706,6 +1159,18 @@ func readMessage(rows *sql.Rows) (*message, error) {
 			return nil, err
 		}
 	}
+	var embeds []*messageEmbed
+	if embedsStr != "" {
+		if err := json.Unmarshal([]byte(embedsStr), &embeds); err != nil {
+			return nil, err
+		}
+	}
+	var publisher *messagePublisher
+	if publisherStr != "" {
+		if err := json.Unmarshal([]byte(publisherStr), &publisher); err != nil {
+			return nil, err
+		}
+	}
 	senderIP, err := netip.ParseAddr(sender)
 	if err != nil {
 		senderIP = netip.Addr{} // if no IP stored in database, return invalid address
@@ -714,6 +1179,7 @@ func readMessage(rows *sql.Rows) (*message, error) {
 	if attachmentName != "" && attachmentURL != "" {
 		att = &attachment{
 			Name:    attachmentName,
+			Alt:     attachmentAlt,
 			Type:    attachmentType,
 			Size:    attachmentSize,
 			Expires: attachmentExpires,
@@ -733,11 +1199,16 @@ func readMessage(rows *sql.Rows) (*message, error) {
 		Click:       click,
 		Icon:        icon,
 		Actions:     actions,
+		Embeds:      embeds,
+		Publisher:   publisher,
 		Attachment:  att,
 		Sender:      senderIP, // Must parse assuming database must be correct
 		User:        user,
 		ContentType: contentType,
 		Encoding:    encoding,
+		DedupCount:  dedupCount,
+		Summary:     summary,
+		RowID:       rowID,
 	}, nil
 }
 
@@ -761,6 +1232,12 @@ func (c *messageCache) Stats() (messages int64, err error) {
 	return messages, nil
 }
 
+// Ping checks if the database responds, by reading the schema version within the context's deadline
+func (c *messageCache) Ping(ctx context.Context) error {
+	var schemaVersion int
+	return c.db.QueryRowContext(ctx, selectSchemaVersionQuery).Scan(&schemaVersion)
+}
+
 func (c *messageCache) Close() error {
 	return c.db.Close()
 }
@@ -992,3 +1469,195 @@ func migrateFrom12(db *sql.DB, _ time.Duration) error {
 	}
 	return tx.Commit()
 }
+
+func migrateFrom13(db *sql.DB, _ time.Duration) error {
+	log.Tag(tagMessageCache).Info("Migrating cache database schema: from 13 to 14")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate13To14AlterMessagesTableQuery); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 14); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom14(db *sql.DB, _ time.Duration) error {
+	log.Tag(tagMessageCache).Info("Migrating cache database schema: from 14 to 15")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate14To15CreateExpirationsTableQuery); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 15); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom15(db *sql.DB, _ time.Duration) error {
+	log.Tag(tagMessageCache).Info("Migrating cache database schema: from 15 to 16")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate15To16AlterMessagesTableQuery); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 16); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom16(db *sql.DB, _ time.Duration) error {
+	log.Tag(tagMessageCache).Info("Migrating cache database schema: from 16 to 17")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate16To17CreateEmailRetriesTableQuery); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 17); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom17(db *sql.DB, _ time.Duration) error {
+	log.Tag(tagMessageCache).Info("Migrating cache database schema: from 17 to 18")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate17To18CreateBansTableQuery); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 18); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom18(db *sql.DB, _ time.Duration) error {
+	log.Tag(tagMessageCache).Info("Migrating cache database schema: from 18 to 19")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate18To19CreateTopicAliasesTableQuery); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 19); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom19(db *sql.DB, _ time.Duration) error {
+	log.Tag(tagMessageCache).Info("Migrating cache database schema: from 19 to 20")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate19To20CreateTopicSeriesFieldsTableQuery); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 20); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom20(db *sql.DB, _ time.Duration) error {
+	log.Tag(tagMessageCache).Info("Migrating cache database schema: from 20 to 21")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate20To21CreateTopicSamplingRulesTableQuery); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 21); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom21(db *sql.DB, _ time.Duration) error {
+	log.Tag(tagMessageCache).Info("Migrating cache database schema: from 21 to 22")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate21To22AlterMessagesTableQuery); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 22); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom22(db *sql.DB, _ time.Duration) error {
+	log.Tag(tagMessageCache).Info("Migrating cache database schema: from 22 to 23")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate22To23AlterMessagesTableQuery); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 23); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom23(db *sql.DB, _ time.Duration) error {
+	log.Tag(tagMessageCache).Info("Migrating cache database schema: from 23 to 24")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate23To24CreateFirebaseDeliveriesTableQuery); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 24); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom24(db *sql.DB, _ time.Duration) error {
+	log.Tag(tagMessageCache).Info("Migrating cache database schema: from 24 to 25")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate24To25AlterMessagesTableQuery); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 25); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
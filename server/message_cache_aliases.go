@@ -0,0 +1,51 @@
+package server
+
+import (
+	"time"
+)
+
+// Topic aliases are kept in the topic_aliases table of the message cache, so that they survive restarts, see
+// server_topic_alias.go. Aliases are loaded into memory on startup, so the table is only read once.
+
+const (
+	upsertTopicAliasQuery = `
+		INSERT INTO topic_aliases (alias, topic, created)
+		VALUES (?, ?, ?)
+		ON CONFLICT (alias) DO UPDATE SET topic = excluded.topic, created = excluded.created
+	`
+	selectTopicAliasesQuery = `SELECT alias, topic FROM topic_aliases`
+	deleteTopicAliasQuery   = `DELETE FROM topic_aliases WHERE alias = ?`
+)
+
+// AddTopicAlias adds an alias for a topic, or replaces the target of an existing alias
+func (c *messageCache) AddTopicAlias(alias, topic string) error {
+	_, err := c.db.Exec(upsertTopicAliasQuery, alias, topic, time.Now().Unix())
+	return err
+}
+
+// TopicAliases returns all topic aliases (alias -> topic)
+func (c *messageCache) TopicAliases() (map[string]string, error) {
+	rows, err := c.db.Query(selectTopicAliasesQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	aliases := make(map[string]string)
+	for rows.Next() {
+		var alias, topic string
+		if err := rows.Scan(&alias, &topic); err != nil {
+			return nil, err
+		}
+		aliases[alias] = topic
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return aliases, nil
+}
+
+// RemoveTopicAlias removes the given alias
+func (c *messageCache) RemoveTopicAlias(alias string) error {
+	_, err := c.db.Exec(deleteTopicAliasQuery, alias)
+	return err
+}
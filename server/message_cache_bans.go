@@ -0,0 +1,76 @@
+package server
+
+import (
+	"net/netip"
+	"time"
+)
+
+// IP bans are kept in the bans table of the message cache, so that they survive restarts, see server_bans.go.
+// Bans are loaded into memory on startup, so the table is only read once.
+
+const (
+	upsertBanQuery = `
+		INSERT INTO bans (network, reason, created, until)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT (network) DO UPDATE SET reason = excluded.reason, created = excluded.created, until = excluded.until
+	`
+	selectBansQuery        = `SELECT network, reason, created, until FROM bans ORDER BY created`
+	deleteBanQuery         = `DELETE FROM bans WHERE network = ?`
+	deleteExpiredBansQuery = `DELETE FROM bans WHERE until > 0 AND until <= ?`
+)
+
+// AddBan adds a ban, or replaces an existing ban of the same network
+func (c *messageCache) AddBan(b *ban) error {
+	var until int64
+	if !b.Until.IsZero() {
+		until = b.Until.Unix()
+	}
+	_, err := c.db.Exec(upsertBanQuery, b.Network.String(), b.Reason, b.Created.Unix(), until)
+	return err
+}
+
+// Bans returns all bans, including expired ones that have not been pruned yet
+func (c *messageCache) Bans() ([]*ban, error) {
+	rows, err := c.db.Query(selectBansQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	bans := make([]*ban, 0)
+	for rows.Next() {
+		var network, reason string
+		var created, until int64
+		if err := rows.Scan(&network, &reason, &created, &until); err != nil {
+			return nil, err
+		}
+		prefix, err := netip.ParsePrefix(network)
+		if err != nil {
+			return nil, err
+		}
+		b := &ban{
+			Network: prefix,
+			Reason:  reason,
+			Created: time.Unix(created, 0),
+		}
+		if until > 0 {
+			b.Until = time.Unix(until, 0)
+		}
+		bans = append(bans, b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return bans, nil
+}
+
+// RemoveBan removes the ban of the given network
+func (c *messageCache) RemoveBan(network netip.Prefix) error {
+	_, err := c.db.Exec(deleteBanQuery, network.String())
+	return err
+}
+
+// RemoveExpiredBans removes all temporary bans that have ended before the given time
+func (c *messageCache) RemoveExpiredBans(now time.Time) error {
+	_, err := c.db.Exec(deleteExpiredBansQuery, now.Unix())
+	return err
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"heckel.io/ntfy/v2/log"
+)
+
+// Message bodies of at least "cache-compress-size" bytes are stored gzip-compressed in the message cache, to keep
+// the cache file small if large messages (e.g. log excerpts or JSON payloads) are published. The "compression"
+// column holds the algorithm ("gzip"), or is empty if the body is stored as is. Bodies are only stored compressed
+// if that actually saves space.
+//
+// Compressed bodies are not part of the full-text search index, see message_cache_search.go.
+
+const (
+	messageCompressionGzip = "gzip"
+)
+
+// maybeCompressMessage returns the message body as it is stored in the database, along with the compression
+// algorithm that was used, if any
+func (c *messageCache) maybeCompressMessage(m *message) (any, string) {
+	if c.compressSize <= 0 || int64(len(m.Message)) < c.compressSize {
+		return m.Message, ""
+	}
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write([]byte(m.Message)); err != nil {
+		log.Tag(tagMessageCache).With(m).Err(err).Warn("Unable to compress message, storing uncompressed")
+		return m.Message, ""
+	} else if err := gz.Close(); err != nil {
+		log.Tag(tagMessageCache).With(m).Err(err).Warn("Unable to compress message, storing uncompressed")
+		return m.Message, ""
+	} else if buf.Len() >= len(m.Message) {
+		return m.Message, ""
+	}
+	return buf.Bytes(), messageCompressionGzip
+}
+
+// decompressMessage reverses maybeCompressMessage
+func decompressMessage(body, compression string) (string, error) {
+	switch compression {
+	case "":
+		return body, nil
+	case messageCompressionGzip:
+		gz, err := gzip.NewReader(bytes.NewReader([]byte(body)))
+		if err != nil {
+			return "", err
+		}
+		defer gz.Close()
+		b, err := io.ReadAll(gz)
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	default:
+		return "", fmt.Errorf("unknown message compression %s", compression)
+	}
+}
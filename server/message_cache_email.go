@@ -0,0 +1,153 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/netip"
+	"time"
+)
+
+// Failed outbound emails are kept in the email_retries table of the message cache, so that they survive restarts,
+// see server_email_retry.go. The message is stored as JSON (and not referenced by ID), since it may not be cached
+// at all (Cache: no), or may have expired from the cache before the email is delivered.
+
+const (
+	emailRetriesDueLimit = 100 // Max number of emails retried in one run, see runEmailRetrier
+)
+
+const (
+	insertEmailRetryQuery = `
+		INSERT INTO email_retries (mid, topic, email, sender, message, attempts, next_attempt, created, error)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	selectEmailRetriesQuery = `
+		SELECT id, email, sender, message, attempts, next_attempt, created, error
+		FROM email_retries
+		ORDER BY next_attempt, id
+	`
+	selectEmailRetriesDueQuery = `
+		SELECT id, email, sender, message, attempts, next_attempt, created, error
+		FROM email_retries
+		WHERE next_attempt <= ?
+		ORDER BY next_attempt, id
+		LIMIT ?
+	`
+	selectEmailRetriesCountQuery = `SELECT COUNT(*) FROM email_retries`
+	updateEmailRetryQuery        = `UPDATE email_retries SET attempts = ?, next_attempt = ?, error = ? WHERE id = ?`
+	deleteEmailRetryQuery        = `DELETE FROM email_retries WHERE id = ?`
+)
+
+// emailRetry is an outbound email that could not be delivered, and is waiting to be retried
+type emailRetry struct {
+	ID          int64
+	Email       string
+	Sender      netip.Addr
+	Message     *message
+	Attempts    int
+	NextAttempt time.Time
+	Created     time.Time
+	Error       string
+}
+
+// AddEmailRetry adds a failed email to the retry queue
+func (c *messageCache) AddEmailRetry(r *emailRetry) error {
+	m, err := json.Marshal(r.Message)
+	if err != nil {
+		return err
+	}
+	_, err = c.db.Exec(
+		insertEmailRetryQuery,
+		r.Message.ID,
+		r.Message.Topic,
+		r.Email,
+		r.Sender.String(),
+		string(m),
+		r.Attempts,
+		r.NextAttempt.Unix(),
+		r.Created.Unix(),
+		r.Error,
+	)
+	return err
+}
+
+// EmailRetries returns all emails in the retry queue, ordered by the time of the next attempt
+func (c *messageCache) EmailRetries() ([]*emailRetry, error) {
+	rows, err := c.db.Query(selectEmailRetriesQuery)
+	if err != nil {
+		return nil, err
+	}
+	return readEmailRetries(rows)
+}
+
+// EmailRetriesDue returns the emails whose next attempt is due
+func (c *messageCache) EmailRetriesDue(now time.Time) ([]*emailRetry, error) {
+	rows, err := c.db.Query(selectEmailRetriesDueQuery, now.Unix(), emailRetriesDueLimit)
+	if err != nil {
+		return nil, err
+	}
+	return readEmailRetries(rows)
+}
+
+// EmailRetriesCount returns the number of emails in the retry queue
+func (c *messageCache) EmailRetriesCount() (int, error) {
+	rows, err := c.db.Query(selectEmailRetriesCountQuery)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return 0, errNoRows
+	}
+	var count int
+	if err := rows.Scan(&count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// UpdateEmailRetry records a failed retry, and schedules the next attempt
+func (c *messageCache) UpdateEmailRetry(r *emailRetry) error {
+	_, err := c.db.Exec(updateEmailRetryQuery, r.Attempts, r.NextAttempt.Unix(), r.Error, r.ID)
+	return err
+}
+
+// DeleteEmailRetry removes an email from the retry queue, e.g. after it was delivered or has expired
+func (c *messageCache) DeleteEmailRetry(id int64) error {
+	_, err := c.db.Exec(deleteEmailRetryQuery, id)
+	return err
+}
+
+func readEmailRetries(rows *sql.Rows) ([]*emailRetry, error) {
+	defer rows.Close()
+	retries := make([]*emailRetry, 0)
+	for rows.Next() {
+		var id, nextAttempt, created int64
+		var attempts int
+		var email, sender, messageJSON, errStr string
+		if err := rows.Scan(&id, &email, &sender, &messageJSON, &attempts, &nextAttempt, &created, &errStr); err != nil {
+			return nil, err
+		}
+		var m message
+		if err := json.Unmarshal([]byte(messageJSON), &m); err != nil {
+			return nil, err
+		}
+		senderIP, err := netip.ParseAddr(sender)
+		if err != nil {
+			senderIP = netip.IPv4Unspecified()
+		}
+		retries = append(retries, &emailRetry{
+			ID:          id,
+			Email:       email,
+			Sender:      senderIP,
+			Message:     &m,
+			Attempts:    attempts,
+			NextAttempt: time.Unix(nextAttempt, 0),
+			Created:     time.Unix(created, 0),
+			Error:       errStr,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return retries, nil
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"time"
+)
+
+// Firebase delivery outcomes are kept in the firebase_deliveries table of the message cache, one row per message
+// sent (or not sent) to Firebase, see server_firebase.go. Rows are pruned after firebaseDeliveryRetention, see
+// pruneMessages.
+
+const (
+	insertFirebaseDeliveryQuery          = `INSERT INTO firebase_deliveries (mid, topic, time, outcome, error) VALUES (?, ?, ?, ?, ?)`
+	selectFirebaseDeliveryCountsQuery    = `SELECT outcome, COUNT(*) FROM firebase_deliveries WHERE topic = ? AND time >= ? GROUP BY outcome`
+	selectFirebaseDeliveryLastErrorQuery = `SELECT time, error FROM firebase_deliveries WHERE topic = ? AND time >= ? AND outcome != ? ORDER BY time DESC, rowid DESC LIMIT 1`
+	deleteFirebaseDeliveriesBeforeQuery  = `DELETE FROM firebase_deliveries WHERE time < ?`
+)
+
+// firebaseDeliveryStats are the aggregated Firebase delivery outcomes of a topic
+type firebaseDeliveryStats struct {
+	Counts        map[string]int // Outcome -> number of messages, see firebaseOutcomeDelivered, ...
+	LastError     string         // Most recent error, empty if there were no errors
+	LastErrorTime int64          // Unix time of the most recent error
+}
+
+// AddFirebaseDelivery records the outcome of sending a message to Firebase
+func (c *messageCache) AddFirebaseDelivery(m *message, outcome string, err error) error {
+	var errStr string
+	if err != nil {
+		errStr = err.Error()
+	}
+	_, err = c.db.Exec(insertFirebaseDeliveryQuery, m.ID, m.Topic, time.Now().Unix(), outcome, errStr)
+	return err
+}
+
+// FirebaseDeliveryStats returns the Firebase delivery outcomes of a topic since the given time
+func (c *messageCache) FirebaseDeliveryStats(topic string, since time.Time) (*firebaseDeliveryStats, error) {
+	rows, err := c.db.Query(selectFirebaseDeliveryCountsQuery, topic, since.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	stats := &firebaseDeliveryStats{
+		Counts: make(map[string]int),
+	}
+	for rows.Next() {
+		var outcome string
+		var count int
+		if err := rows.Scan(&outcome, &count); err != nil {
+			return nil, err
+		}
+		stats.Counts[outcome] = count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	if _, ok := stats.Counts[firebaseOutcomeDelivered]; len(stats.Counts) == 0 || (ok && len(stats.Counts) == 1) {
+		return stats, nil // No errors
+	}
+	rows, err = c.db.Query(selectFirebaseDeliveryLastErrorQuery, topic, since.Unix(), firebaseOutcomeDelivered)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if rows.Next() {
+		if err := rows.Scan(&stats.LastErrorTime, &stats.LastError); err != nil {
+			return nil, err
+		}
+	}
+	return stats, rows.Err()
+}
+
+// PruneFirebaseDeliveries removes the Firebase delivery outcomes recorded before the given time
+func (c *messageCache) PruneFirebaseDeliveries(before time.Time) error {
+	_, err := c.db.Exec(deleteFirebaseDeliveriesBeforeQuery, before.Unix())
+	return err
+}
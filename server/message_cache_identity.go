@@ -0,0 +1,43 @@
+package server
+
+// Topics that show the publisher identity are kept in the topic_identity table of the message cache, so that the
+// setting survives restarts, see server_identity.go. The table is loaded into memory on startup.
+
+const (
+	selectTopicIdentityQuery = `SELECT topic FROM topic_identity`
+	insertTopicIdentityQuery = `INSERT INTO topic_identity (topic) VALUES (?) ON CONFLICT (topic) DO NOTHING`
+	deleteTopicIdentityQuery = `DELETE FROM topic_identity WHERE topic = ?`
+)
+
+// AddTopicIdentity enables the publisher identity for a topic
+func (c *messageCache) AddTopicIdentity(topic string) error {
+	_, err := c.db.Exec(insertTopicIdentityQuery, topic)
+	return err
+}
+
+// TopicIdentities returns all topics that have the publisher identity enabled
+func (c *messageCache) TopicIdentities() ([]string, error) {
+	rows, err := c.db.Query(selectTopicIdentityQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	topics := make([]string, 0)
+	for rows.Next() {
+		var topic string
+		if err := rows.Scan(&topic); err != nil {
+			return nil, err
+		}
+		topics = append(topics, topic)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return topics, nil
+}
+
+// RemoveTopicIdentity disables the publisher identity for a topic
+func (c *messageCache) RemoveTopicIdentity(topic string) error {
+	_, err := c.db.Exec(deleteTopicIdentityQuery, topic)
+	return err
+}
@@ -0,0 +1,47 @@
+package server
+
+// Sampling rules are kept in the topic_sampling_rules table of the message cache, so that they survive
+// restarts, see server_sampling.go. Rules are loaded into memory on startup, so the table is only read once.
+
+const (
+	selectTopicSamplingRulesQuery = `SELECT topic, rate, max_priority, summary FROM topic_sampling_rules`
+	upsertTopicSamplingRuleQuery  = `
+		INSERT INTO topic_sampling_rules (topic, rate, max_priority, summary) VALUES (?, ?, ?, ?)
+		ON CONFLICT (topic) DO UPDATE SET rate = excluded.rate, max_priority = excluded.max_priority, summary = excluded.summary
+	`
+	deleteTopicSamplingRuleQuery = `DELETE FROM topic_sampling_rules WHERE topic = ?`
+)
+
+// SetTopicSamplingRule adds or replaces the sampling rule of a topic
+func (c *messageCache) SetTopicSamplingRule(topic string, rule *samplingRule) error {
+	_, err := c.db.Exec(upsertTopicSamplingRuleQuery, topic, rule.Rate, rule.MaxPriority, rule.Summary)
+	return err
+}
+
+// TopicSamplingRules returns the sampling rules of all topics (topic -> rule)
+func (c *messageCache) TopicSamplingRules() (map[string]*samplingRule, error) {
+	rows, err := c.db.Query(selectTopicSamplingRulesQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rules := make(map[string]*samplingRule)
+	for rows.Next() {
+		var topic string
+		var rule samplingRule
+		if err := rows.Scan(&topic, &rule.Rate, &rule.MaxPriority, &rule.Summary); err != nil {
+			return nil, err
+		}
+		rules[topic] = &rule
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// RemoveTopicSamplingRule removes the sampling rule of a topic
+func (c *messageCache) RemoveTopicSamplingRule(topic string) error {
+	_, err := c.db.Exec(deleteTopicSamplingRuleQuery, topic)
+	return err
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"heckel.io/ntfy/v2/log"
+)
+
+// Full-text search over the message cache is backed by a separate SQLite full-text index (messages_fts), which
+// holds the title, message and tags of each message, keyed by the message's row ID. The index is kept in sync via
+// triggers, so it does not need to be considered when adding or deleting messages. Compressed message bodies (see
+// message_cache_compression.go) are not indexed, so these messages can only be found by their title and tags.
+//
+// The index uses the FTS5 module if SQLite was compiled with it (build tag "sqlite_fts5", see Makefile), and
+// falls back to FTS4 otherwise. Release builds use FTS5, while a plain "go build" or "go test" uses FTS4, which
+// go-sqlite3 always includes. Both behave the same for the quoted match expressions built by searchMatchExpression,
+// and the search query itself is plain SQL, so the fallback is fully supported. The index is not part of the regular
+// schema versioning, since it depends on the build; it is created (and filled) on startup if it does not exist.
+
+const (
+	searchResultsLimitDefault = 100
+	searchResultsLimitMax     = 1000
+)
+
+const (
+	selectSearchIndexExistsQuery = `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'messages_fts'`
+	createSearchIndexQuery       = `CREATE VIRTUAL TABLE IF NOT EXISTS messages_fts USING %s (title, message, tags)`
+	createSearchTriggersQuery    = `
+		CREATE TRIGGER IF NOT EXISTS messages_fts_insert AFTER INSERT ON messages BEGIN
+			INSERT INTO messages_fts (rowid, title, message, tags) VALUES (new.id, new.title, CASE WHEN new.compression = '' THEN new.message ELSE '' END, new.tags);
+		END;
+		CREATE TRIGGER IF NOT EXISTS messages_fts_delete AFTER DELETE ON messages BEGIN
+			DELETE FROM messages_fts WHERE rowid = old.id;
+		END;
+	`
+	fillSearchIndexQuery = `INSERT INTO messages_fts (rowid, title, message, tags) SELECT id, title, CASE WHEN compression = '' THEN message ELSE '' END, tags FROM messages`
+	searchMessagesQuery  = `
+		SELECT mid, time, expires, topic, message, title, priority, tags, click, icon, actions, attachment_name, attachment_type, attachment_size, attachment_expires, attachment_url, sender, user, content_type, encoding, dedup_count, summary, attachment_alt, embeds, publisher, compression, id
+		FROM messages
+		WHERE id IN (SELECT rowid FROM messages_fts WHERE messages_fts MATCH ?) AND topic IN (%s) AND published = 1 AND (expires = 0 OR expires >= ?) %s
+		ORDER BY time DESC, id DESC
+		LIMIT ?
+	`
+)
+
+// searchQuery describes a full-text search, see messageCache.Search
+type searchQuery struct {
+	Topics   []string
+	Query    string      // Free text; all words must match
+	Since    sinceMarker // Only time and ID markers are supported
+	Priority []int       // Empty means any priority
+	Limit    int
+}
+
+// searchIndexModules are the SQLite full-text modules used for the search index, in order of preference
+var searchIndexModules = []string{"fts5", "fts4"}
+
+// setupSearchIndex creates the full-text search index and its triggers if they don't exist, using the first of the
+// given modules that is supported (see searchIndexModules), and returns false if none of them is supported
+func setupSearchIndex(db *sql.DB, modules ...string) (bool, error) {
+	var exists int
+	if err := db.QueryRow(selectSearchIndexExistsQuery).Scan(&exists); err != nil {
+		return false, err
+	}
+	if exists == 0 {
+		created := false
+		for _, module := range modules {
+			if _, err := db.Exec(fmt.Sprintf(createSearchIndexQuery, module)); err != nil {
+				log.Tag(tagMessageCache).Err(err).Debug("Cannot create full-text search index using %s", module)
+				continue
+			}
+			log.Tag(tagMessageCache).Debug("Created full-text search index using %s", module)
+			created = true
+			break
+		}
+		if !created {
+			log.Tag(tagMessageCache).Warn("Full-text search is not supported by this SQLite build, message search disabled")
+			return false, nil
+		}
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(createSearchTriggersQuery); err != nil {
+		return false, err
+	}
+	if exists == 0 {
+		if _, err := tx.Exec(fillSearchIndexQuery); err != nil {
+			return false, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// SearchEnabled returns true if full-text search is available, see Search
+func (c *messageCache) SearchEnabled() bool {
+	return c.search && !c.nop
+}
+
+// Search performs a full-text search over the cached messages of the given topics, and returns the
+// matching messages, newest first. Expired messages that have not been pruned yet are not returned.
+func (c *messageCache) Search(q *searchQuery) ([]*message, error) {
+	if len(q.Topics) == 0 || q.Since.IsNone() {
+		return make([]*message, 0), nil
+	}
+	match := searchMatchExpression(q.Query)
+	if match == "" {
+		return make([]*message, 0), nil
+	}
+	args := []any{match}
+	for _, t := range q.Topics {
+		args = append(args, t)
+	}
+	args = append(args, time.Now().Unix())
+	var filters []string
+	if q.Since.IsID() {
+		filters = append(filters, "AND id > (SELECT IFNULL(MAX(id), 0) FROM messages WHERE mid = ?)")
+		args = append(args, q.Since.ID())
+	} else {
+		filters = append(filters, "AND time >= ?")
+		args = append(args, q.Since.Time().Unix())
+	}
+	if len(q.Priority) > 0 {
+		priorities := make([]any, 0)
+		for _, p := range q.Priority {
+			priorities = append(priorities, p)
+			if p == 3 {
+				priorities = append(priorities, 0) // Default priority (3) is the same as "not set" (0), see queryFilter
+			}
+		}
+		filters = append(filters, fmt.Sprintf("AND priority IN (%s)", queryPlaceholders(len(priorities))))
+		args = append(args, priorities...)
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = searchResultsLimitDefault
+	} else if limit > searchResultsLimitMax {
+		limit = searchResultsLimitMax
+	}
+	args = append(args, limit)
+	query := fmt.Sprintf(searchMessagesQuery, queryPlaceholders(len(q.Topics)), strings.Join(filters, " "))
+	rows, err := c.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return readMessages(rows)
+}
+
+// searchMatchExpression turns free text into a full-text MATCH expression, in which every word is quoted. This
+// avoids syntax errors for user input, and works for both FTS4 and FTS5. All words must match (implicit AND).
+func searchMatchExpression(query string) string {
+	terms := make([]string, 0)
+	for _, word := range strings.Fields(query) {
+		terms = append(terms, fmt.Sprintf(`"%s"`, strings.ReplaceAll(word, `"`, `""`)))
+	}
+	return strings.Join(terms, " ")
+}
+
+func queryPlaceholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
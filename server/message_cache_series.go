@@ -0,0 +1,58 @@
+package server
+
+// Series field definitions are kept in the topic_series_fields table of the message cache, so that they survive
+// restarts, see server_series.go. Definitions are loaded into memory on startup, so the table is only read once.
+
+const (
+	selectTopicSeriesFieldsQuery = `SELECT topic, name, path FROM topic_series_fields`
+	insertTopicSeriesFieldQuery  = `INSERT INTO topic_series_fields (topic, name, path) VALUES (?, ?, ?)`
+	deleteTopicSeriesFieldsQuery = `DELETE FROM topic_series_fields WHERE topic = ?`
+)
+
+// SetTopicSeriesFields replaces the series fields of a topic (name -> JSON field path)
+func (c *messageCache) SetTopicSeriesFields(topic string, fields map[string]string) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(deleteTopicSeriesFieldsQuery, topic); err != nil {
+		return err
+	}
+	for name, path := range fields {
+		if _, err := tx.Exec(insertTopicSeriesFieldQuery, topic, name, path); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// TopicSeriesFields returns the series fields of all topics (topic -> name -> JSON field path)
+func (c *messageCache) TopicSeriesFields() (map[string]map[string]string, error) {
+	rows, err := c.db.Query(selectTopicSeriesFieldsQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	fields := make(map[string]map[string]string)
+	for rows.Next() {
+		var topic, name, path string
+		if err := rows.Scan(&topic, &name, &path); err != nil {
+			return nil, err
+		}
+		if _, ok := fields[topic]; !ok {
+			fields[topic] = make(map[string]string)
+		}
+		fields[topic][name] = path
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// RemoveTopicSeriesFields removes all series fields of a topic
+func (c *messageCache) RemoveTopicSeriesFields(topic string) error {
+	_, err := c.db.Exec(deleteTopicSeriesFieldsQuery, topic)
+	return err
+}
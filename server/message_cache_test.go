@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net/netip"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -233,6 +234,98 @@ func testCacheMessagesSinceID(t *testing.T, c *messageCache) {
 	require.Equal(t, "message 3", messages[1].Message)
 }
 
+func TestSqliteCache_MessagesPage(t *testing.T) {
+	testCacheMessagesPage(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_MessagesPage(t *testing.T) {
+	testCacheMessagesPage(t, newMemTestCache(t))
+}
+
+func testCacheMessagesPage(t *testing.T, c *messageCache) {
+	m1 := newMessageWithTimestamp("mytopic", "message 1", 100)
+	m2 := newMessageWithTimestamp("mytopic", "message 2", 200)
+	m3 := newMessageWithTimestamp("mytopic", "message 3", 200)
+	m4 := newMessageWithTimestamp("mytopic", "message 4", 300)
+	m5 := newMessageWithTimestamp("mytopic", "message 5", time.Now().Add(time.Hour).Unix()) // Scheduled
+	m6 := newMessageWithTimestamp("othertopic", "message 6", 150)
+	for _, m := range []*message{m1, m2, m3, m4, m5, m6} {
+		require.Nil(t, c.AddMessage(m))
+	}
+
+	// Cursor of a time marker includes messages at that time, cursor of an ID excludes the message itself
+	cursor, err := c.MessageCursor(newSinceTime(200))
+	require.Nil(t, err)
+	messages, err := c.MessagesPage("mytopic", cursor, 0, -1, false)
+	require.Nil(t, err)
+	require.Equal(t, []string{"message 2", "message 3", "message 4"}, messageTexts(messages))
+
+	cursor, err = c.MessageCursor(newSinceID(m2.ID))
+	require.Nil(t, err)
+	messages, err = c.MessagesPage("mytopic", cursor, 0, -1, true)
+	require.Nil(t, err)
+	require.Equal(t, []string{"message 3", "message 4", "message 5"}, messageTexts(messages))
+
+	// Unknown IDs start at the beginning
+	cursor, err = c.MessageCursor(newSinceID("doesntexist"))
+	require.Nil(t, err)
+	require.Equal(t, messageCursor{}, *cursor)
+
+	// Limit and until
+	messages, err = c.MessagesPage("mytopic", cursor, 0, 2, false)
+	require.Nil(t, err)
+	require.Equal(t, []string{"message 1", "message 2"}, messageTexts(messages))
+	messages, err = c.MessagesPage("mytopic", cursor, 200, -1, true)
+	require.Nil(t, err)
+	require.Equal(t, []string{"message 1", "message 2", "message 3"}, messageTexts(messages))
+
+	// Latest messages, newest first
+	messages, err = c.MessagesLatest("mytopic", 2)
+	require.Nil(t, err)
+	require.Equal(t, []string{"message 4", "message 3"}, messageTexts(messages))
+}
+
+func TestSqliteCache_MessagesExpired(t *testing.T) {
+	testCacheMessagesExpired(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_MessagesExpired(t *testing.T) {
+	testCacheMessagesExpired(t, newMemTestCache(t))
+}
+
+func testCacheMessagesExpired(t *testing.T, c *messageCache) {
+	now := time.Now()
+	m1 := newMessageWithTimestamp("mytopic", "message 1", now.Add(-time.Hour).Unix())
+	m2 := newMessageWithTimestamp("mytopic", "message 2", now.Add(-time.Minute).Unix())
+	m2.Expires = now.Add(-time.Second).Unix() // Expired, but not pruned yet
+	m3 := newMessageWithTimestamp("mytopic", "message 3", now.Unix())
+	m3.Expires = now.Add(time.Hour).Unix()
+	for _, m := range []*message{m1, m2, m3} {
+		require.Nil(t, c.AddMessage(m))
+	}
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, []string{"message 1", "message 3"}, messageTexts(messages))
+	messages, err = c.Messages("mytopic", newSinceID(m1.ID), true)
+	require.Nil(t, err)
+	require.Equal(t, []string{"message 3"}, messageTexts(messages))
+	messages, err = c.MessagesPage("mytopic", &messageCursor{}, 0, -1, false)
+	require.Nil(t, err)
+	require.Equal(t, []string{"message 1", "message 3"}, messageTexts(messages))
+	messages, err = c.MessagesLatest("mytopic", 10)
+	require.Nil(t, err)
+	require.Equal(t, []string{"message 3", "message 1"}, messageTexts(messages))
+}
+
+func messageTexts(messages []*message) []string {
+	texts := make([]string, 0)
+	for _, m := range messages {
+		texts = append(texts, m.Message)
+	}
+	return texts
+}
+
 func TestSqliteCache_Prune(t *testing.T) {
 	testCachePrune(t, newSqliteTestCache(t))
 }
@@ -280,6 +373,160 @@ func testCachePrune(t *testing.T, c *messageCache) {
 	require.Equal(t, "my other message", messages[0].Message)
 }
 
+func TestSqliteCache_Expirations(t *testing.T) {
+	testCacheExpirations(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_Expirations(t *testing.T) {
+	testCacheExpirations(t, newMemTestCache(t))
+}
+
+func TestSqliteCache_EmailRetries(t *testing.T) {
+	testCacheEmailRetries(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_EmailRetries(t *testing.T) {
+	testCacheEmailRetries(t, newMemTestCache(t))
+}
+
+func testCacheEmailRetries(t *testing.T, c *messageCache) {
+	now := time.Now()
+	m1 := newDefaultMessage("mytopic", "due now")
+	m1.Title = "a title"
+	m2 := newDefaultMessage("mytopic", "due later")
+	require.Nil(t, c.AddEmailRetry(&emailRetry{
+		Email:       "phil@example.com",
+		Sender:      netip.MustParseAddr("1.2.3.4"),
+		Message:     m1,
+		Attempts:    1,
+		NextAttempt: now.Add(-time.Second),
+		Created:     now.Add(-time.Minute),
+		Error:       "421 service not available",
+	}))
+	require.Nil(t, c.AddEmailRetry(&emailRetry{
+		Email:       "ben@example.com",
+		Sender:      netip.MustParseAddr("1.2.3.4"),
+		Message:     m2,
+		Attempts:    1,
+		NextAttempt: now.Add(time.Hour),
+		Created:     now,
+	}))
+	count, err := c.EmailRetriesCount()
+	require.Nil(t, err)
+	require.Equal(t, 2, count)
+
+	due, err := c.EmailRetriesDue(now)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(due))
+	require.Equal(t, "phil@example.com", due[0].Email)
+	require.Equal(t, "1.2.3.4", due[0].Sender.String())
+	require.Equal(t, m1.ID, due[0].Message.ID)
+	require.Equal(t, "a title", due[0].Message.Title)
+	require.Equal(t, "421 service not available", due[0].Error)
+
+	due[0].Attempts = 2
+	due[0].NextAttempt = now.Add(2 * time.Hour)
+	require.Nil(t, c.UpdateEmailRetry(due[0]))
+	due, err = c.EmailRetriesDue(now)
+	require.Nil(t, err)
+	require.Equal(t, 0, len(due))
+
+	retries, err := c.EmailRetries()
+	require.Nil(t, err)
+	require.Equal(t, 2, len(retries))
+	require.Equal(t, "ben@example.com", retries[0].Email)
+	require.Equal(t, 2, retries[1].Attempts)
+
+	require.Nil(t, c.DeleteEmailRetry(retries[0].ID))
+	count, err = c.EmailRetriesCount()
+	require.Nil(t, err)
+	require.Equal(t, 1, count)
+}
+
+func testCacheExpirations(t *testing.T, c *messageCache) {
+	now := time.Now().Unix()
+
+	m1 := newDefaultMessage("mytopic", "my message")
+	m1.Time = now - 10
+	m1.Expires = now - 5
+
+	m2 := newDefaultMessage("mytopic", "my other message")
+	m2.Time = now - 5
+	m2.Expires = now + 5 // In the future
+
+	m3 := newDefaultMessage("another_topic", "and another one")
+	m3.Time = now - 12
+	m3.Expires = now - 2
+
+	require.Nil(t, c.AddMessage(m1))
+	require.Nil(t, c.AddMessage(m2))
+	require.Nil(t, c.AddMessage(m3))
+
+	expiredMessageIDs, err := c.MessagesExpired()
+	require.Nil(t, err)
+	expired, err := c.DeleteExpiredMessages(append(expiredMessageIDs, "doesnotexist")...)
+	require.Nil(t, err)
+	require.Equal(t, map[string][]string{"mytopic": {m1.ID}, "another_topic": {m3.ID}}, expired)
+
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, m2.ID, messages[0].ID)
+
+	// Since time, and since ID (of a message that still exists, or not)
+	ids, err := c.ExpirationsSince("mytopic", newSinceTime(now-60))
+	require.Nil(t, err)
+	require.Equal(t, []string{m1.ID}, ids)
+	ids, err = c.ExpirationsSince("mytopic", newSinceTime(now+60))
+	require.Nil(t, err)
+	require.Equal(t, 0, len(ids))
+	ids, err = c.ExpirationsSince("mytopic", newSinceID(m2.ID))
+	require.Nil(t, err)
+	require.Equal(t, []string{m1.ID}, ids)
+	ids, err = c.ExpirationsSince("another_topic", newSinceID(m3.ID))
+	require.Nil(t, err)
+	require.Equal(t, []string{m3.ID}, ids)
+
+	// Prune
+	require.Nil(t, c.PruneExpirations(time.Now().Add(time.Minute)))
+	ids, err = c.ExpirationsSince("mytopic", newSinceTime(0))
+	require.Nil(t, err)
+	require.Equal(t, 0, len(ids))
+}
+
+func TestSqliteCache_Expirations_Batches(t *testing.T) {
+	testCacheExpirationsBatches(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_Expirations_Batches(t *testing.T) {
+	testCacheExpirationsBatches(t, newMemTestCache(t))
+}
+
+func testCacheExpirationsBatches(t *testing.T, c *messageCache) {
+	count := 2*expiredMessagesBatchSize + 1
+	messages := make([]*message, 0)
+	for i := 0; i < count; i++ {
+		m := newDefaultMessage(fmt.Sprintf("topic%d", i%3), "my message")
+		m.Expires = time.Now().Unix() - 1
+		messages = append(messages, m)
+	}
+	require.Nil(t, c.addMessages(messages))
+	ids, err := c.MessagesExpired()
+	require.Nil(t, err)
+	require.Equal(t, count, len(ids))
+
+	expired, err := c.DeleteExpiredMessages(ids...)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(expired))
+	require.Equal(t, count, len(expired["topic0"])+len(expired["topic1"])+len(expired["topic2"]))
+	ids, err = c.MessagesExpired()
+	require.Nil(t, err)
+	require.Equal(t, 0, len(ids))
+	expiredIDs, err := c.ExpirationsSince("topic0", newSinceTime(0))
+	require.Nil(t, err)
+	require.Equal(t, len(expired["topic0"]), len(expiredIDs))
+}
+
 func TestSqliteCache_Attachments(t *testing.T) {
 	testCacheAttachments(t, newSqliteTestCache(t))
 }
@@ -693,6 +940,133 @@ func TestMemCache_NopCache(t *testing.T) {
 	require.Empty(t, topics)
 }
 
+func TestSqliteCache_Search(t *testing.T) {
+	testCacheSearch(t, newSqliteTestCache(t))
+}
+
+func TestMemCache_Search(t *testing.T) {
+	testCacheSearch(t, newMemTestCache(t))
+}
+
+func testCacheSearch(t *testing.T, c *messageCache) {
+	require.True(t, c.SearchEnabled())
+
+	m1 := newDefaultMessage("mytopic", "Backup failed: disk full on /dev/sda1")
+	m1.Time = 1
+	m1.Priority = 5
+	m2 := newDefaultMessage("mytopic", "Backup succeeded")
+	m2.Time = 2
+	m2.Tags = []string{"disk"}
+	m3 := newDefaultMessage("othertopic", "Disk full on server 2")
+	m3.Time = 3
+	require.Nil(t, c.addMessages([]*message{m1, m2, m3}))
+
+	messages, err := c.Search(&searchQuery{Topics: []string{"mytopic"}, Query: "disk", Since: sinceAllMessages})
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, m2.ID, messages[0].ID) // Newest first, tags are searchable
+	require.Equal(t, m1.ID, messages[1].ID)
+
+	messages, err = c.Search(&searchQuery{Topics: []string{"mytopic", "othertopic"}, Query: "DISK full", Since: sinceAllMessages})
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, m3.ID, messages[0].ID)
+	require.Equal(t, m1.ID, messages[1].ID)
+
+	messages, err = c.Search(&searchQuery{Topics: []string{"mytopic", "othertopic"}, Query: "disk", Since: sinceAllMessages, Priority: []int{3}})
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+
+	messages, err = c.Search(&searchQuery{Topics: []string{"mytopic", "othertopic"}, Query: "disk", Since: newSinceTime(2), Limit: 1})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, m3.ID, messages[0].ID)
+
+	messages, err = c.Search(&searchQuery{Topics: []string{"mytopic"}, Query: `"unbalanced (quotes AND`, Since: sinceAllMessages})
+	require.Nil(t, err)
+	require.Empty(t, messages)
+
+	// Expired messages are not returned, even if they have not been pruned yet
+	m4 := newDefaultMessage("mytopic", "Disk full, but expired")
+	m4.Expires = time.Now().Add(-time.Minute).Unix()
+	require.Nil(t, c.AddMessage(m4))
+	messages, err = c.Search(&searchQuery{Topics: []string{"mytopic"}, Query: "expired", Since: sinceAllMessages})
+	require.Nil(t, err)
+	require.Empty(t, messages)
+
+	// Deleted messages are removed from the index
+	require.Nil(t, c.DeleteMessages(m1.ID))
+	messages, err = c.Search(&searchQuery{Topics: []string{"mytopic"}, Query: "full", Since: sinceAllMessages})
+	require.Nil(t, err)
+	require.Empty(t, messages)
+}
+
+func TestSqliteCache_Compression(t *testing.T) {
+	c := newSqliteTestCache(t)
+	c.compressSize = 100
+	small := newDefaultMessage("mytopic", "small backup log")
+	large := newDefaultMessage("mytopic", strings.Repeat("backup log line\n", 100))
+	large.Title = "Nightly backup"
+	require.Nil(t, c.addMessages([]*message{small, large}))
+
+	// Only large messages are compressed, and they are transparently decompressed
+	var compression string
+	require.Nil(t, c.db.QueryRow("SELECT compression FROM messages WHERE mid = ?", small.ID).Scan(&compression))
+	require.Equal(t, "", compression)
+	require.Nil(t, c.db.QueryRow("SELECT compression FROM messages WHERE mid = ?", large.ID).Scan(&compression))
+	require.Equal(t, "gzip", compression)
+	messages, err := c.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, small.Message, messages[0].Message)
+	require.Equal(t, large.Message, messages[1].Message)
+
+	// Compressed messages are found by title, but not by body
+	messages, err = c.Search(&searchQuery{Topics: []string{"mytopic"}, Query: "log", Since: sinceAllMessages})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, small.ID, messages[0].ID)
+	messages, err = c.Search(&searchQuery{Topics: []string{"mytopic"}, Query: "nightly", Since: sinceAllMessages})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, large.Message, messages[0].Message)
+}
+
+func TestSqliteCache_Search_ExistingMessagesIndexed(t *testing.T) {
+	filename := newSqliteTestCacheFile(t)
+	c := newSqliteTestCacheFromFile(t, filename, "")
+	require.Nil(t, c.AddMessage(newDefaultMessage("mytopic", "indexed later")))
+	_, err := c.db.Exec("DROP TRIGGER messages_fts_insert; DROP TRIGGER messages_fts_delete; DROP TABLE messages_fts")
+	require.Nil(t, err)
+	require.Nil(t, c.Close())
+
+	c = newSqliteTestCacheFromFile(t, filename, "")
+	messages, err := c.Search(&searchQuery{Topics: []string{"mytopic"}, Query: "later", Since: sinceAllMessages})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(messages))
+}
+
+func TestSqliteCache_Search_FTS4Fallback(t *testing.T) {
+	c := newSqliteTestCache(t)
+	_, err := c.db.Exec("DROP TRIGGER messages_fts_insert; DROP TRIGGER messages_fts_delete; DROP TABLE messages_fts")
+	require.Nil(t, err)
+
+	// Unsupported modules are skipped
+	search, err := setupSearchIndex(c.db, "doesnotexist")
+	require.Nil(t, err)
+	require.False(t, search)
+
+	// FTS4 is used if FTS5 is not available (e.g. builds without the "sqlite_fts5" tag)
+	search, err = setupSearchIndex(c.db, "doesnotexist", "fts4")
+	require.Nil(t, err)
+	require.True(t, search)
+	var schema string
+	require.Nil(t, c.db.QueryRow("SELECT sql FROM sqlite_master WHERE name = 'messages_fts'").Scan(&schema))
+	require.Contains(t, schema, "fts4")
+
+	testCacheSearch(t, c)
+}
+
 func newSqliteTestCache(t *testing.T) *messageCache {
 	c, err := newSqliteCache(newSqliteTestCacheFile(t), "", time.Hour, 0, 0, false)
 	if err != nil {
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"fmt"
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+	"net/netip"
+	"regexp"
+	"strings"
+)
+
+// Network access rules let operators of public instances allow or deny publishing and subscribing based on the
+// IP address of the visitor, e.g. to block networks that abuse the server, without having to firewall at the proxy.
+// Rules are defined separately for publishing and subscribing, via the "publish-allowed-networks",
+// "publish-denied-networks", "subscribe-allowed-networks" and "subscribe-denied-networks" config options.
+//
+// Each entry is an IP address (e.g. 1.2.3.4), a network in CIDR notation (e.g. 10.0.0.0/8), or a two-letter ISO
+// country code (e.g. DE). Country codes require a MaxMind DB file (e.g. GeoLite2-Country.mmdb, see "geoip-file").
+// Denied networks take precedence. If allowed networks are set, only visitors from these networks are allowed.
+
+var (
+	countryCodeRegex = regexp.MustCompile(`^[A-Z]{2}$`)
+)
+
+// networkRules holds the parsed publish and subscribe rules, and the GeoIP database to look up countries
+type networkRules struct {
+	publish   *networkPolicy
+	subscribe *networkPolicy
+	geoIP     *util.MaxMindDB // May be nil
+}
+
+// networkPolicy is the list of allowed and denied networks for publishing or subscribing
+type networkPolicy struct {
+	allowed *networkList
+	denied  *networkList
+}
+
+// networkList is a list of networks and country codes
+type networkList struct {
+	prefixes  []netip.Prefix
+	countries []string
+}
+
+// newNetworkRules parses the network rules from the config, and opens the GeoIP database (if configured).
+// It returns nil if no rules are defined.
+func newNetworkRules(conf *Config) (*networkRules, error) {
+	var err error
+	r := &networkRules{
+		publish:   &networkPolicy{},
+		subscribe: &networkPolicy{},
+	}
+	for _, l := range []struct {
+		list    **networkList
+		entries []string
+		option  string
+	}{
+		{&r.publish.allowed, conf.PublishAllowedNetworks, "publish-allowed-networks"},
+		{&r.publish.denied, conf.PublishDeniedNetworks, "publish-denied-networks"},
+		{&r.subscribe.allowed, conf.SubscribeAllowedNetworks, "subscribe-allowed-networks"},
+		{&r.subscribe.denied, conf.SubscribeDeniedNetworks, "subscribe-denied-networks"},
+	} {
+		if *l.list, err = parseNetworkList(l.entries); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", l.option, err)
+		}
+	}
+	if conf.GeoIPFile != "" {
+		if r.geoIP, err = util.OpenMaxMindDB(conf.GeoIPFile); err != nil {
+			return nil, fmt.Errorf("cannot open GeoIP database %s: %w", conf.GeoIPFile, err)
+		}
+	} else if r.publish.hasCountries() || r.subscribe.hasCountries() {
+		return nil, fmt.Errorf("country codes in network rules require geoip-file to be set")
+	}
+	if r.publish.empty() && r.subscribe.empty() {
+		return nil, nil
+	}
+	return r, nil
+}
+
+func parseNetworkList(entries []string) (*networkList, error) {
+	l := &networkList{
+		prefixes:  make([]netip.Prefix, 0),
+		countries: make([]string, 0),
+	}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if countryCodeRegex.MatchString(strings.ToUpper(entry)) {
+			l.countries = append(l.countries, strings.ToUpper(entry))
+		} else if strings.Contains(entry, "/") {
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, err
+			}
+			l.prefixes = append(l.prefixes, prefix.Masked())
+		} else {
+			ip, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("expected IP address, network or country code, got %q", entry)
+			}
+			l.prefixes = append(l.prefixes, netip.PrefixFrom(ip, ip.BitLen()))
+		}
+	}
+	return l, nil
+}
+
+// contains returns true if the IP address or country is in the list
+func (l *networkList) contains(ip netip.Addr, country string) bool {
+	return util.ContainsIP(l.prefixes, ip) || (country != "" && util.Contains(l.countries, country))
+}
+
+func (l *networkList) empty() bool {
+	return len(l.prefixes) == 0 && len(l.countries) == 0
+}
+
+func (p *networkPolicy) empty() bool {
+	return p.allowed.empty() && p.denied.empty()
+}
+
+func (p *networkPolicy) hasCountries() bool {
+	return len(p.allowed.countries) > 0 || len(p.denied.countries) > 0
+}
+
+// allowedFrom returns true if the policy allows the given IP address and country, see above
+func (p *networkPolicy) allowedFrom(ip netip.Addr, country string) bool {
+	if p.denied.contains(ip, country) {
+		return false
+	}
+	return p.allowed.empty() || p.allowed.contains(ip, country)
+}
+
+// policy returns the publish or subscribe policy for the given permission, or nil if there is none
+func (r *networkRules) policy(perm user.Permission) *networkPolicy {
+	switch perm {
+	case user.PermissionRead:
+		return r.subscribe
+	case user.PermissionWrite, user.PermissionWriteNoCache:
+		return r.publish
+	default:
+		return nil
+	}
+}
+
+// country returns the country code of the given IP address, or an empty string if it is unknown
+func (r *networkRules) country(ip netip.Addr) string {
+	if r.geoIP == nil {
+		return ""
+	}
+	country, err := r.geoIP.Country(ip)
+	if err != nil {
+		log.Tag(tagNetworkRules).Err(err).Debug("Cannot look up country of %s", ip.String())
+		return ""
+	}
+	return country
+}
+
+// checkNetworkRules returns an error if the visitor is not allowed to publish (user.PermissionWrite) or subscribe
+// (user.PermissionRead) from its IP address or country
+func (s *Server) checkNetworkRules(v *visitor, perm user.Permission) error {
+	if s.networkRules == nil {
+		return nil
+	}
+	policy := s.networkRules.policy(perm)
+	if policy == nil || policy.empty() {
+		return nil
+	}
+	var country string
+	if policy.hasCountries() {
+		country = s.networkRules.country(v.IP())
+	}
+	if !policy.allowedFrom(v.IP(), country) {
+		logv(v).
+			Tag(tagNetworkRules).
+			Fields(log.Context{
+				"country":    country,
+				"permission": perm.String(),
+			}).
+			Debug("Access denied by network rules")
+		return errHTTPForbiddenNetworkDenied.With(v)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/user"
+	"net/http"
+	"net/netip"
+	"testing"
+)
+
+func TestServer_NetworkRules_Publish(t *testing.T) {
+	c := newTestConfig(t)
+	c.PublishDeniedNetworks = []string{"9.9.9.0/24"}
+	s := newTestServer(t, c)
+
+	// Publishing is denied from 9.9.9.9 (see request()), subscribing is allowed
+	response := request(t, s, "PUT", "/mytopic", "from a denied network", nil)
+	require.Equal(t, 403, response.Code)
+	require.Equal(t, 40306, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	require.Equal(t, 200, response.Code)
+
+	// Other networks may publish
+	response = request(t, s, "PUT", "/mytopic", "from another network", nil, func(r *http.Request) {
+		r.RemoteAddr = "1.2.3.4"
+	})
+	require.Equal(t, 200, response.Code)
+}
+
+func TestServer_NetworkRules_Subscribe(t *testing.T) {
+	c := newTestConfig(t)
+	c.SubscribeAllowedNetworks = []string{"10.0.0.0/8", "1.2.3.4"}
+	c.SubscribeDeniedNetworks = []string{"10.1.0.0/16"}
+	s := newTestServer(t, c)
+
+	response := request(t, s, "PUT", "/mytopic", "publishing is allowed", nil)
+	require.Equal(t, 200, response.Code)
+
+	for ip, code := range map[string]int{
+		"9.9.9.9":  403, // Not in allowed networks
+		"10.0.0.1": 200,
+		"10.1.0.1": 403, // Denied networks take precedence
+		"1.2.3.4":  200,
+		"1.2.3.5":  403,
+	} {
+		response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil, func(r *http.Request) {
+			r.RemoteAddr = ip
+		})
+		require.Equal(t, code, response.Code, ip)
+	}
+	response = request(t, s, "GET", "/v1/search?topics=mytopic&q=allowed", "", nil)
+	require.Equal(t, 403, response.Code)
+}
+
+func TestServer_NetworkRules_Invalid(t *testing.T) {
+	c := newTestConfig(t)
+	c.PublishDeniedNetworks = []string{"not a network"}
+	_, err := New(c)
+	require.Error(t, err)
+
+	c = newTestConfig(t)
+	c.PublishDeniedNetworks = []string{"10.0.0.0/33"}
+	_, err = New(c)
+	require.Error(t, err)
+
+	c = newTestConfig(t)
+	c.SubscribeDeniedNetworks = []string{"cn"} // Country codes require a GeoIP database
+	_, err = New(c)
+	require.ErrorContains(t, err, "geoip-file")
+
+	c = newTestConfig(t)
+	c.GeoIPFile = "/does/not/exist.mmdb"
+	_, err = New(c)
+	require.Error(t, err)
+}
+
+func TestNetworkRules_Countries(t *testing.T) {
+	rules, err := newNetworkRules(&Config{
+		PublishAllowedNetworks:  []string{"de", "AT", "10.0.0.0/8"},
+		SubscribeDeniedNetworks: []string{"CN"},
+		GeoIPFile:               "",
+	})
+	require.Error(t, err) // No GeoIP file
+	require.Nil(t, rules)
+
+	publish, err := parseNetworkList([]string{"de", "AT", "10.0.0.0/8"})
+	require.Nil(t, err)
+	require.Equal(t, []string{"DE", "AT"}, publish.countries)
+	policy := &networkPolicy{allowed: publish, denied: &networkList{}}
+	require.True(t, policy.allowedFrom(netip.MustParseAddr("1.2.3.4"), "DE"))
+	require.True(t, policy.allowedFrom(netip.MustParseAddr("10.1.2.3"), ""))
+	require.False(t, policy.allowedFrom(netip.MustParseAddr("1.2.3.4"), "FR"))
+	require.False(t, policy.allowedFrom(netip.MustParseAddr("1.2.3.4"), "")) // Unknown country
+
+	r := &networkRules{publish: policy, subscribe: &networkPolicy{allowed: &networkList{}, denied: &networkList{}}}
+	require.Equal(t, policy, r.policy(user.PermissionWriteNoCache))
+	require.Nil(t, r.policy(user.PermissionManage))
+}
+
+func TestNetworkRules_NoRules(t *testing.T) {
+	rules, err := newNetworkRules(newTestConfig(t))
+	require.Nil(t, err)
+	require.Nil(t, rules)
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/proxy"
+)
+
+// Outbound traffic to integrations (Firebase, email, Stripe, upstream server, ...) can be routed through an
+// HTTP(S) or SOCKS5 proxy, e.g. a corporate egress proxy or Tor. "outbound-proxy" applies to all integrations;
+// each integration can override it with its own proxy (e.g. "firebase-proxy"), or with "direct" to bypass it.
+//
+// If no proxy is configured, HTTP-based integrations honor the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment
+// variables. Email (SMTP) is never sent through a proxy unless one is configured explicitly.
+
+const (
+	outboundProxyDirect = "direct" // Bypasses the proxy for an integration, even if outbound-proxy is set
+)
+
+// outboundProxyURL returns the proxy of an integration, i.e. the integration-specific override if it is set, and
+// outbound-proxy otherwise. It returns nil if no proxy is configured, or if the proxy is bypassed ("direct").
+func outboundProxyURL(conf *Config, override string) (*url.URL, error) {
+	rawURL := override
+	if rawURL == "" {
+		rawURL = conf.OutboundProxy
+	}
+	if rawURL == "" || rawURL == outboundProxyDirect {
+		return nil, nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy %s: %w", rawURL, err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid proxy %s: host missing", rawURL)
+		}
+		return u, nil
+	default:
+		return nil, fmt.Errorf("invalid proxy %s: scheme must be http, https, socks5 or socks5h", rawURL)
+	}
+}
+
+// outboundProxyConfigured returns true if a proxy (or "direct") is configured for an integration
+func outboundProxyConfigured(conf *Config, override string) bool {
+	return override != "" || conf.OutboundProxy != ""
+}
+
+// outboundProxyFunc returns the proxy function of an integration for an http.Transport. If nothing is
+// configured, the proxy is taken from the environment.
+func outboundProxyFunc(conf *Config, override string) (func(*http.Request) (*url.URL, error), error) {
+	if !outboundProxyConfigured(conf, override) {
+		return http.ProxyFromEnvironment, nil
+	}
+	u, err := outboundProxyURL(conf, override)
+	if err != nil {
+		return nil, err
+	} else if u == nil {
+		return nil, nil // Direct
+	}
+	return http.ProxyURL(u), nil
+}
+
+// outboundTransport returns an http.Transport for integrations that use their own HTTP client (Firebase, Stripe)
+func outboundTransport(conf *Config, override string) (*http.Transport, error) {
+	proxyFunc, err := outboundProxyFunc(conf, override)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxyFunc
+	return transport, nil
+}
+
+// outboundDialer returns a dial function for non-HTTP integrations (email), which connects through the configured
+// proxy. SOCKS5 proxies are used as is, HTTP(S) proxies are asked to open a tunnel via CONNECT.
+func outboundDialer(conf *Config, override string) (func(ctx context.Context, network, addr string) (net.Conn, error), error) {
+	dialer := &net.Dialer{Timeout: conf.OutboundTimeout}
+	u, err := outboundProxyURL(conf, override)
+	if err != nil {
+		return nil, err
+	} else if u == nil {
+		return dialer.DialContext, nil
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		d, err := proxy.FromURL(u, dialer)
+		if err != nil {
+			return nil, err
+		}
+		contextDialer, ok := d.(proxy.ContextDialer)
+		if !ok {
+			return nil, fmt.Errorf("invalid proxy %s: dialer does not support contexts", u.Redacted())
+		}
+		return contextDialer.DialContext, nil
+	default:
+		return func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialHTTPProxy(ctx, dialer, u, addr)
+		}, nil
+	}
+}
+
+// dialHTTPProxy opens a tunnel to addr through an HTTP(S) proxy, using the CONNECT method
+func dialHTTPProxy(ctx context.Context, dialer *net.Dialer, proxyURL *url.URL, addr string) (net.Conn, error) {
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		if proxyURL.Scheme == "https" {
+			proxyAddr = net.JoinHostPort(proxyURL.Hostname(), "443")
+		} else {
+			proxyAddr = net.JoinHostPort(proxyURL.Hostname(), "80")
+		}
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s refused to connect to %s: %s", proxyURL.Redacted(), addr, resp.Status)
+	}
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
+
+// bufferedConn is a net.Conn that reads from a bufio.Reader first, so that data the server sent right after
+// the proxy response (e.g. the SMTP greeting) is not lost
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
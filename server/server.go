@@ -3,7 +3,6 @@ package server
 import (
 	"bytes"
 	"context"
-	"crypto/sha256"
 	"embed"
 	"encoding/base64"
 	"encoding/json"
@@ -23,6 +22,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"text/template"
 	"time"
 	"unicode/utf8"
@@ -30,7 +30,10 @@ import (
 	"github.com/emersion/go-smtp"
 	"github.com/gorilla/websocket"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/stripe/stripe-go/v74"
 	"golang.org/x/sync/errgroup"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
 	"heckel.io/ntfy/v2/log"
 	"heckel.io/ntfy/v2/user"
 	"heckel.io/ntfy/v2/util"
@@ -38,29 +41,67 @@ import (
 
 // Server is the main server, providing the UI and API for ntfy
 type Server struct {
-	config            *Config
-	httpServer        *http.Server
-	httpsServer       *http.Server
-	httpMetricsServer *http.Server
-	httpProfileServer *http.Server
-	unixListener      net.Listener
-	smtpServer        *smtp.Server
-	smtpServerBackend *smtpBackend
-	smtpSender        mailer
-	topics            map[string]*topic
-	visitors          map[string]*visitor // ip:<ip> or user:<user>
-	firebaseClient    *firebaseClient
-	messages          int64                               // Total number of messages (persisted if messageCache enabled)
-	messagesHistory   []int64                             // Last n values of the messages counter, used to determine rate
-	userManager       *user.Manager                       // Might be nil!
-	messageCache      *messageCache                       // Database that stores the messages
-	webPush           *webPushStore                       // Database that stores web push subscriptions
-	fileCache         *fileCache                          // File system based cache that stores attachments
-	stripe            stripeAPI                           // Stripe API, can be replaced with a mock
-	priceCache        *util.LookupCache[map[string]int64] // Stripe price ID -> price as cents (USD implied!)
-	metricsHandler    http.Handler                        // Handles /metrics if enable-metrics set, and listen-metrics-http not set
-	closeChan         chan bool
-	mu                sync.RWMutex
+	state              atomic.Pointer[serverState] // Config and email sender, replaced on reload, see server_reload.go
+	httpServer         *http.Server
+	httpsServer        *http.Server
+	httpMetricsServer  *http.Server
+	httpProfileServer  *http.Server
+	unixListener       net.Listener
+	grpcServer         *grpc.Server   // Serves the gRPC health service, if health-listen-grpc is set
+	grpcHealth         *health.Server // gRPC health service, may be nil, see server_health.go
+	healthAgent        net.Listener   // HAProxy agent listener, if health-listen-agent is set
+	smtpServer         *smtp.Server
+	smtpServerBackend  *smtpBackend
+	smtpRules          []*smtpRule                // SMTP routing rules, see smtp_rules.go
+	transformRules     []*transformRule           // Message transformation rules, see transform_rules.go
+	networkRules       *networkRules              // Publish/subscribe rules based on IP address or country, may be nil, see network_rules.go
+	bans               *banList                   // IP bans, see server_bans.go
+	topicAliases       *topicAliases              // Alias -> target topic, see server_topic_alias.go
+	series             *topicSeries               // Series fields of topics, see server_series.go
+	sampling           *topicSampling             // Sampling rules of topics, see server_sampling.go
+	identity           *topicIdentity             // Topics that show the publisher identity, see server_identity.go
+	authLockouts       *authLockouts              // Auth failures and lockouts per username+IP, see server_auth_lockout.go
+	orgLimits          *orgLimits                 // Pooled limits of organizations, see server_org_limits.go
+	httpClient         *httpClient                // Shared client for outbound HTTP requests, see http_client.go
+	upstreamClient     *httpClient                // Client for upstream poll requests, same as httpClient unless upstream-proxy is set
+	upstreams          *upstreamServers           // Upstream servers and their health, may be nil, see upstream.go
+	topics             *util.ShardedMap[*topic]   // Topic ID -> topic, see topicsFromIDs
+	wildcards          *wildcardSubscriptions     // Subscriptions to topic patterns, see server_wildcard.go
+	visitors           *util.ShardedMap[*visitor] // ip:<ip> or user:<user> -> visitor, see visitor
+	subscriptions      atomic.Int64               // Number of active subscriptions (streaming connections), see subscriptionAllowed
+	diskSpaceLow       atomic.Bool                // True if free disk space is below disk-space-min-free, see checkDiskSpace
+	draining           atomic.Bool                // True if health checks report the server as unavailable, see setDraining
+	options            *options                   // Custom implementations passed to New, see server_options.go
+	firebaseClient     *firebaseClient
+	firebaseQueue      *util.PriorityQueue[*firebaseJob]           // Messages waiting to be sent to Firebase, see sendToFirebase
+	firebaseWorkers    sync.Once                                   // Starts the Firebase workers on first use, see sendToFirebase
+	firebasePacer      *firebasePacer                              // Holds back messages to topics after Firebase quota errors
+	firebaseRetryDelay time.Duration                               // Delay before the first Firebase retry, can be shortened in tests
+	emailRetryDelay    time.Duration                               // Delay before the first email retry, can be shortened in tests
+	tts                *ttsGenerator                               // Text-to-speech engine and queue, may be nil, see server_tts.go
+	messages           int64                                       // Total number of messages (persisted if messageCache enabled)
+	messagesHistory    []int64                                     // Last n values of the messages counter, used to determine rate
+	userManager        *user.Manager                               // Might be nil!
+	messageCache       *messageCache                               // Database that stores the messages
+	webPush            *webPushStore                               // Database that stores web push subscriptions
+	fileCache          *fileCache                                  // File system based cache that stores attachments
+	uploads            map[string]*attachmentUpload                // In-progress resumable uploads, see handleAttachmentUploadCreate
+	dedups             map[string]*messageDedup                    // Recently published messages by topic and dedup ID, see dedupMessage
+	publishSignatures  map[string]time.Time                        // Recently used publish signatures -> expiry, see usePublishSignature
+	quietHours         map[string]*quietHoursQueue                 // Messages held back during quiet hours by topic, see holdForQuietHours
+	banner             string                                      // Message of the day, see handleBannerChange
+	monitorChecks      []*monitorCheck                             // Uptime monitor checks, see runMonitor
+	bridges            []*bridge                                   // Bridged remote topics, see runBridges
+	faults             *faultInjector                              // Development only, may be nil, see fault_injector.go
+	events             *serverEvents                               // Throttling state of server events, see publishServerEvent
+	instant            *instantRegistry                            // Devices registered for instant delivery, see handleInstantDeviceRegister
+	diskFree           func(path string) (uint64, error)           // Free disk space of the file system of path, can be replaced in tests
+	stripe             StripeAPI                                   // Stripe API, can be replaced with a mock
+	priceCache         *util.LookupCache[map[string]*stripe.Price] // Stripe price ID -> price (amount as cents, USD implied!)
+	discountCache      *util.LookupCache[[]*stripe.PromotionCode]  // Public Stripe promotion codes, shown in the upgrade dialog
+	metricsHandler     http.Handler                                // Handles /metrics if enable-metrics set, and listen-metrics-http not set
+	closeChan          chan bool
+	mu                 sync.RWMutex
 }
 
 // handleFunc extends the normal http.HandlerFunc to be able to easily return errors
@@ -71,12 +112,22 @@ var (
 	topicRegex             = regexp.MustCompile(`^[-_A-Za-z0-9]{1,64}$`)               // No /!
 	topicPathRegex         = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}$`)              // Regex must match JS & Android app!
 	externalTopicPathRegex = regexp.MustCompile(`^/[^/]+\.[^/]+/[-_A-Za-z0-9]{1,64}$`) // Extended topic path, for web-app, e.g. /example.com/mytopic
-	jsonPathRegex          = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}(,[-_A-Za-z0-9]{1,64})*/json$`)
-	ssePathRegex           = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}(,[-_A-Za-z0-9]{1,64})*/sse$`)
-	rawPathRegex           = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}(,[-_A-Za-z0-9]{1,64})*/raw$`)
-	wsPathRegex            = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}(,[-_A-Za-z0-9]{1,64})*/ws$`)
+	jsonPathRegex          = regexp.MustCompile(`^/[-_A-Za-z0-9*]{1,64}(,[-_A-Za-z0-9*]{1,64})*/json$`)
+	ssePathRegex           = regexp.MustCompile(`^/[-_A-Za-z0-9*]{1,64}(,[-_A-Za-z0-9*]{1,64})*/sse$`)
+	rawPathRegex           = regexp.MustCompile(`^/[-_A-Za-z0-9*]{1,64}(,[-_A-Za-z0-9*]{1,64})*/raw$`)
+	wsPathRegex            = regexp.MustCompile(`^/[-_A-Za-z0-9*]{1,64}(,[-_A-Za-z0-9*]{1,64})*/ws$`)
 	authPathRegex          = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}(,[-_A-Za-z0-9]{1,64})*/auth$`)
 	publishPathRegex       = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}/(publish|send|trigger)$`)
+	topicMessagePathRegex  = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}/([-_A-Za-z0-9]{12})$`)
+	topicMutePathRegex     = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}/mute$`)
+	topicMessagesPathRegex = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}/messages$`)
+	topicStatsPathRegex    = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}/stats$`)
+	topicAliasPathRegex    = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}/alias$`)
+	topicExportPathRegex   = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}/export$`)
+	topicFeedPathRegex     = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}/feed\.xml$`)
+	topicSeriesPathRegex   = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}/series$`)
+	topicSamplingPathRegex = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}/sampling$`)
+	topicIdentityPathRegex = regexp.MustCompile(`^/[-_A-Za-z0-9]{1,64}/identity$`)
 
 	webConfigPath                                        = "/config.js"
 	webManifestPath                                      = "/manifest.webmanifest"
@@ -86,28 +137,80 @@ var (
 	matrixPushPath                                       = "/_matrix/push/v1/notify"
 	metricsPath                                          = "/metrics"
 	apiHealthPath                                        = "/v1/health"
+	healthzPath                                          = "/healthz"
+	apiConfigPath                                        = "/v1/config"
+	apiBannerPath                                        = "/v1/banner"
+	apiAdminReplayPath                                   = "/v1/admin/replay"
+	apiAdminEmailRetriesPath                             = "/v1/admin/email-retries"
+	apiAdminBansPath                                     = "/v1/admin/bans"
+	apiAdminLockoutsPath                                 = "/v1/admin/lockouts"
+	apiAdminDrainPath                                    = "/v1/admin/drain"
+	apiAdminKeysPath                                     = "/v1/admin/keys"
+	apiAdminInvitesPath                                  = "/v1/admin/invites"
 	apiStatsPath                                         = "/v1/stats"
+	apiInstantPath                                       = "/v1/instant"
+	apiInstantDevicesPath                                = "/v1/instant/devices"
+	apiQRCodePath                                        = "/v1/qr"
+	apiDashboardPath                                     = "/v1/dashboard"
+	subscribeURIPath                                     = "/subscribe"
+	apiSearchPath                                        = "/v1/search"
 	apiWebPushPath                                       = "/v1/webpush"
 	apiTiersPath                                         = "/v1/tiers"
 	apiUsersPath                                         = "/v1/users"
 	apiUsersAccessPath                                   = "/v1/users/access"
+	apiUsersAccessBulkPath                               = "/v1/users/access/bulk"
+	apiAttachmentsPath                                   = "/v1/attachments"
+	apiUsersSuspensionPath                               = "/v1/users/suspension"
+	apiUsersTierPath                                     = "/v1/users/tier"
+	apiAccessCheckPath                                   = "/v1/access/check"
+	scimServiceProviderConfigPath                        = "/scim/v2/ServiceProviderConfig"
+	scimUsersPath                                        = "/scim/v2/Users"
+	scimGroupsPath                                       = "/scim/v2/Groups"
 	apiAccountPath                                       = "/v1/account"
 	apiAccountTokenPath                                  = "/v1/account/token"
+	apiAccountTokenRotatePath                            = "/v1/account/token/rotate"
 	apiAccountPasswordPath                               = "/v1/account/password"
 	apiAccountSettingsPath                               = "/v1/account/settings"
 	apiAccountSubscriptionPath                           = "/v1/account/subscription"
 	apiAccountReservationPath                            = "/v1/account/reservation"
 	apiAccountPhonePath                                  = "/v1/account/phone"
+	apiAccountUnifiedPushEndpointsPath                   = "/v1/account/up-endpoints"
 	apiAccountPhoneVerifyPath                            = "/v1/account/phone/verify"
+	apiAccountTOTPPath                                   = "/v1/account/2fa"
+	apiAccountStatsPath                                  = "/v1/account/stats"
+	apiAccountVerifyPath                                 = "/v1/account/verify"
 	apiAccountBillingPortalPath                          = "/v1/account/billing/portal"
 	apiAccountBillingWebhookPath                         = "/v1/account/billing/webhook"
 	apiAccountBillingSubscriptionPath                    = "/v1/account/billing/subscription"
 	apiAccountBillingSubscriptionCheckoutSuccessTemplate = "/v1/account/billing/subscription/success/{CHECKOUT_SESSION_ID}"
 	apiAccountBillingSubscriptionCheckoutSuccessRegex    = regexp.MustCompile(`/v1/account/billing/subscription/success/(.+)$`)
+	apiAccountOrgPath                                    = "/v1/account/org"
+	apiAccountOrgMembersPath                             = "/v1/account/org/members"
+	apiAccountOrgInvitesPath                             = "/v1/account/org/invites"
+	apiAccountOrgInviteSingleRegex                       = regexp.MustCompile(`/v1/account/org/invites/([-_A-Za-z0-9]{1,64})$`)
+	apiAccountOrgTopicsPath                              = "/v1/account/org/topics"
+	apiAccountOrgTopicSingleRegex                        = regexp.MustCompile(`/v1/account/org/topics/([-_A-Za-z0-9]{1,64})$`)
+	apiAccountOrgBillingPortalPath                       = "/v1/account/org/billing/portal"
+	apiAccountOrgBillingSubscriptionPath                 = "/v1/account/org/billing/subscription"
+	apiAccountOrgBillingCheckoutSuccessTemplate          = "/v1/account/org/billing/subscription/success/{CHECKOUT_SESSION_ID}"
+	apiAccountOrgBillingCheckoutSuccessRegex             = regexp.MustCompile(`/v1/account/org/billing/subscription/success/(.+)$`)
 	apiAccountReservationSingleRegex                     = regexp.MustCompile(`/v1/account/reservation/([-_A-Za-z0-9]{1,64})$`)
+	apiAccountReservationManagersRegex                   = regexp.MustCompile(`/v1/account/reservation/([-_A-Za-z0-9]{1,64})/managers$`)
+	apiAccountReservationMembersRegex                    = regexp.MustCompile(`/v1/account/reservation/([-_A-Za-z0-9]{1,64})/members$`)
+	apiAccountReservationTransferRegex                   = regexp.MustCompile(`/v1/account/reservation/([-_A-Za-z0-9]{1,64})/transfer$`)
+	apiAccountReservationSecretRegex                     = regexp.MustCompile(`/v1/account/reservation/([-_A-Za-z0-9]{1,64})/secret$`)
+	apiAccountReservationEmailRegex                      = regexp.MustCompile(`/v1/account/reservation/([-_A-Za-z0-9]{1,64})/email$`)
+	apiAdminKeySingleRegex                               = regexp.MustCompile(`^/v1/admin/keys/([-_A-Za-z0-9]{1,64})$`)
+	apiAdminInviteSingleRegex                            = regexp.MustCompile(`^/v1/admin/invites/([-_A-Za-z0-9]{1,64})$`)
+	apiIntegrationRegex                                  = regexp.MustCompile(`^/v1/integrations/(github|grafana|alertmanager)/([-_A-Za-z0-9]{1,64})$`)
+	apiDashboardRegex                                    = regexp.MustCompile(`^/v1/dashboard/([-_.A-Za-z0-9]{1,256})$`)
+	apiAttachmentsUploadRegex                            = regexp.MustCompile(`^/v1/attachments/([-_A-Za-z0-9]{1,64})$`)
+	scimUserPathRegex                                    = regexp.MustCompile(`^/scim/v2/Users/([^/]+)$`)
+	scimGroupPathRegex                                   = regexp.MustCompile(`^/scim/v2/Groups/([^/]+)$`)
 	staticRegex                                          = regexp.MustCompile(`^/static/.+`)
 	docsRegex                                            = regexp.MustCompile(`^/docs(|/.*)$`)
 	fileRegex                                            = regexp.MustCompile(`^/file/([-_A-Za-z0-9]{1,64})(?:\.[A-Za-z0-9]{1,16})?$`)
+	fileURLRegex                                         = regexp.MustCompile(`^/file/([-_A-Za-z0-9]{1,64})/url$`)
 	urlRegex                                             = regexp.MustCompile(`^https?://`)
 	phoneNumberRegex                                     = regexp.MustCompile(`^\+\d{1,100}$`)
 
@@ -123,16 +226,18 @@ var (
 )
 
 const (
-	firebaseControlTopic     = "~control"                // See Android if changed
-	firebasePollTopic        = "~poll"                   // See iOS if changed (DISABLED for now)
-	emptyMessageBody         = "triggered"               // Used if message body is empty
-	newMessageBody           = "New message"             // Used in poll requests as generic message
-	defaultAttachmentMessage = "You received a file: %s" // Used if message body is empty, and there is an attachment
-	encodingBase64           = "base64"                  // Used mainly for binary UnifiedPush messages
-	jsonBodyBytesLimit       = 32768                     // Max number of bytes for a request bodys (unless MessageLimit is higher)
-	unifiedPushTopicPrefix   = "up"                      // Temporarily, we rate limit all "up*" topics based on the subscriber
-	unifiedPushTopicLength   = 14                        // Length of UnifiedPush topics, including the "up" part
-	messagesHistoryMax       = 10                        // Number of message count values to keep in memory
+	firebaseControlTopic     = "~control"    // See Android if changed
+	firebasePollTopic        = "~poll"       // See iOS if changed (DISABLED for now)
+	emptyMessageBody         = "triggered"   // Used if message body is empty
+	newMessageBody           = "New message" // Used in poll requests as generic message
+	encodingBase64           = "base64"      // Used mainly for binary UnifiedPush messages
+	jsonBodyBytesLimit       = 32768         // Max number of bytes for a request bodys (unless MessageLimit is higher)
+	accessListBodyBytesLimit = 1048576       // Max number of bytes for an access list import, see handleAccessImport
+	unifiedPushTopicPrefix   = "up"          // Temporarily, we rate limit all "up*" topics based on the subscriber
+	unifiedPushTopicLength   = 14            // Length of UnifiedPush topics, including the "up" part
+	messagesHistoryMax       = 10            // Number of message count values to keep in memory
+	mapShards                = 64            // Number of shards of the topics and visitors maps, see util.ShardedMap
+	attachmentSniffBytes     = 3072          // Number of bytes used to detect the content type of attachments
 	templateMaxExecutionTime = 100 * time.Millisecond
 )
 
@@ -142,6 +247,12 @@ var (
 	templateDisallowedRegex = regexp.MustCompile(`(?m)\{\{-?\s*(call|template|define)\b`)
 )
 
+// Keepalive constants, see keepaliveInterval
+const (
+	keepaliveProxyTimeoutMin        = 10 * time.Second
+	keepaliveProxyTimeoutCloudflare = 100 * time.Second // Cloudflare closes idle connections after 100s
+)
+
 // WebSocket constants
 const (
 	wsWriteWait  = 2 * time.Second
@@ -151,20 +262,101 @@ const (
 )
 
 // New instantiates a new Server. It creates the cache and adds a Firebase
-// subscriber (if configured).
-func New(conf *Config) (*Server, error) {
+// subscriber (if configured). Options may replace the mailer, the Firebase
+// sender and the Stripe API, see server_options.go.
+func New(conf *Config, opts ...Option) (*Server, error) {
+	options := newOptions(opts)
+	if conf.DeadLetterTopic != "" && !topicRegex.MatchString(conf.DeadLetterTopic) {
+		return nil, fmt.Errorf("invalid dead-letter topic %s", conf.DeadLetterTopic)
+	} else if conf.ServerEventsTopic != "" && !topicRegex.MatchString(conf.ServerEventsTopic) {
+		return nil, fmt.Errorf("invalid server events topic %s", conf.ServerEventsTopic)
+	} else if !locales.Supported(conf.DefaultLanguage) {
+		return nil, fmt.Errorf("unsupported default language %s", conf.DefaultLanguage)
+	}
+	monitorChecks, err := parseMonitorChecks(conf.MonitorChecks, conf.MonitorInterval)
+	if err != nil {
+		return nil, err
+	}
+	bridges, err := parseBridges(conf.Bridges)
+	if err != nil {
+		return nil, err
+	}
+	smtpRules, err := parseSMTPRules(conf.SMTPServerRules)
+	if err != nil {
+		return nil, err
+	}
+	transformRules, err := parseTransformRules(conf.TransformRules)
+	if err != nil {
+		return nil, err
+	}
+	networkRules, err := newNetworkRules(conf)
+	if err != nil {
+		return nil, err
+	}
+	topicMigrations, err := parseTopicMigrations(conf.AuthMigrateTopics)
+	if err != nil {
+		return nil, err
+	}
 	var mailer mailer
-	if conf.SMTPSenderAddr != "" {
-		mailer = &smtpSender{config: conf}
+	if options.mailer != nil {
+		mailer, err = newMailSender(conf, options.mailer, "custom")
+	} else {
+		mailer, err = newMailer(conf)
 	}
-	var stripe stripeAPI
-	if conf.StripeSecretKey != "" {
-		stripe = newStripeAPI()
+	if err != nil {
+		return nil, err
+	}
+	var stripe StripeAPI
+	if options.stripeAPI != nil {
+		stripe = options.stripeAPI
+	} else if conf.StripeSecretKey != "" {
+		stripe, err = newStripeAPI(conf)
+		if err != nil {
+			return nil, err
+		}
 	}
 	messageCache, err := createMessageCache(conf)
 	if err != nil {
 		return nil, err
 	}
+	faults := newFaultInjector(conf)
+	messageCache.faults = faults
+	messageCache.compressSize = conf.CacheCompressSize
+	bans, err := newBanList(messageCache)
+	if err != nil {
+		return nil, err
+	}
+	topicAliases, err := newTopicAliases(messageCache)
+	if err != nil {
+		return nil, err
+	}
+	series, err := newTopicSeries(messageCache)
+	if err != nil {
+		return nil, err
+	}
+	sampling, err := newTopicSampling(messageCache)
+	if err != nil {
+		return nil, err
+	}
+	identity, err := newTopicIdentity(messageCache)
+	if err != nil {
+		return nil, err
+	}
+	httpClient, err := newHTTPClient(conf, "")
+	if err != nil {
+		return nil, err
+	}
+	upstreamClient := httpClient
+	if conf.UpstreamProxy != "" {
+		upstreamClient, err = newHTTPClient(conf, conf.UpstreamProxy)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var upstreams *upstreamServers
+	if conf.UpstreamBaseURL != "" {
+		upstreams = newUpstreamServers(append([]string{conf.UpstreamBaseURL}, conf.UpstreamFallbackBaseURLs...)...)
+	}
 	var webPush *webPushStore
 	if conf.WebPushPublicKey != "" {
 		webPush, err = newWebPushStore(conf.WebPushFile, conf.WebPushStartupQueries)
@@ -172,10 +364,14 @@ func New(conf *Config) (*Server, error) {
 			return nil, err
 		}
 	}
-	topics, err := messageCache.Topics()
+	cachedTopics, err := messageCache.Topics()
 	if err != nil {
 		return nil, err
 	}
+	topics := util.NewShardedMap[*topic](mapShards)
+	for id, t := range cachedTopics {
+		topics.Set(id, t)
+	}
 	messages, err := messageCache.Stats()
 	if err != nil {
 		return nil, err
@@ -186,6 +382,16 @@ func New(conf *Config) (*Server, error) {
 		if err != nil {
 			return nil, err
 		}
+		if conf.AttachmentClamdAddress != "" {
+			fileCache.scanner = newClamdScanner(conf.AttachmentClamdAddress)
+		}
+	}
+	var tts *ttsGenerator
+	if conf.TTSCommand != "" {
+		tts, err = newTTSGenerator(newCommandTTSEngine(conf.TTSCommand), conf.TTSFormat, conf.TTSCacheDir)
+		if err != nil {
+			return nil, err
+		}
 	}
 	var userManager *user.Manager
 	if conf.AuthFile != "" {
@@ -194,11 +400,16 @@ func New(conf *Config) (*Server, error) {
 			return nil, err
 		}
 	}
+	if err := migrateTopics(messageCache, userManager, topicMigrations); err != nil {
+		return nil, err
+	}
 	var firebaseClient *firebaseClient
-	if conf.FirebaseKeyFile != "" {
-		sender, err := newFirebaseSender(conf.FirebaseKeyFile)
-		if err != nil {
-			return nil, err
+	if options.firebaseSender != nil || conf.FirebaseKeyFile != "" {
+		sender := options.firebaseSender
+		if sender == nil {
+			if sender, err = newFirebaseSender(conf); err != nil {
+				return nil, err
+			}
 		}
 		// This awkward logic is required because Go is weird about nil types and interfaces.
 		// See issue #641, and https://go.dev/play/p/uur1flrv1t3 for an example
@@ -209,20 +420,54 @@ func New(conf *Config) (*Server, error) {
 		firebaseClient = newFirebaseClient(sender, auther)
 	}
 	s := &Server{
-		config:          conf,
-		messageCache:    messageCache,
-		webPush:         webPush,
-		fileCache:       fileCache,
-		firebaseClient:  firebaseClient,
-		smtpSender:      mailer,
-		topics:          topics,
-		userManager:     userManager,
-		messages:        messages,
-		messagesHistory: []int64{messages},
-		visitors:        make(map[string]*visitor),
-		stripe:          stripe,
+		options:            options,
+		messageCache:       messageCache,
+		webPush:            webPush,
+		fileCache:          fileCache,
+		firebaseClient:     firebaseClient,
+		firebaseQueue:      util.NewPriorityQueue[*firebaseJob](firebaseQueuePriorities, conf.FirebaseQueueSize),
+		firebaseRetryDelay: firebaseRetryDelay,
+		firebasePacer:      newFirebasePacer(conf.FirebaseQuotaExceededPenaltyDuration),
+		emailRetryDelay:    emailRetryDelay,
+		tts:                tts,
+		topics:             topics,
+		wildcards:          newWildcardSubscriptions(),
+		userManager:        userManager,
+		messages:           messages,
+		messagesHistory:    []int64{messages},
+		visitors:           util.NewShardedMap[*visitor](mapShards),
+		uploads:            make(map[string]*attachmentUpload),
+		dedups:             make(map[string]*messageDedup),
+		publishSignatures:  make(map[string]time.Time),
+		quietHours:         make(map[string]*quietHoursQueue),
+		banner:             conf.Banner,
+		monitorChecks:      monitorChecks,
+		bridges:            bridges,
+		smtpRules:          smtpRules,
+		transformRules:     transformRules,
+		networkRules:       networkRules,
+		bans:               bans,
+		topicAliases:       topicAliases,
+		series:             series,
+		sampling:           sampling,
+		identity:           identity,
+		authLockouts:       newAuthLockouts(),
+		orgLimits:          newOrgLimits(userManager),
+		httpClient:         httpClient,
+		upstreamClient:     upstreamClient,
+		upstreams:          upstreams,
+		faults:             faults,
+		events:             newServerEvents(),
+		instant:            newInstantRegistry(),
+		diskFree:           diskFree,
+		stripe:             stripe,
+	}
+	s.state.Store(&serverState{config: conf, mailer: mailer})
+	if conf.HealthListenGRPC != "" {
+		s.grpcHealth = newGRPCHealthServer()
 	}
 	s.priceCache = util.NewLookupCache(s.fetchStripePrices, conf.StripePriceCacheDuration)
+	s.discountCache = util.NewLookupCache(s.fetchStripeDiscounts, conf.StripePriceCacheDuration)
 	return s, nil
 }
 
@@ -238,61 +483,71 @@ func createMessageCache(conf *Config) (*messageCache, error) {
 // Run executes the main server. It listens on HTTP (+ HTTPS, if configured), and starts
 // a manager go routine to print stats and prune messages.
 func (s *Server) Run() error {
+	conf := s.config()
 	var listenStr string
-	if s.config.ListenHTTP != "" {
-		listenStr += fmt.Sprintf(" %s[http]", s.config.ListenHTTP)
+	if conf.ListenHTTP != "" {
+		listenStr += fmt.Sprintf(" %s[http]", conf.ListenHTTP)
+	}
+	if conf.ListenHTTPS != "" {
+		listenStr += fmt.Sprintf(" %s[https]", conf.ListenHTTPS)
+	}
+	if conf.ListenUnix != "" {
+		listenStr += fmt.Sprintf(" %s[unix]", conf.ListenUnix)
 	}
-	if s.config.ListenHTTPS != "" {
-		listenStr += fmt.Sprintf(" %s[https]", s.config.ListenHTTPS)
+	if conf.SMTPServerListen != "" {
+		listenStr += fmt.Sprintf(" %s[smtp]", conf.SMTPServerListen)
 	}
-	if s.config.ListenUnix != "" {
-		listenStr += fmt.Sprintf(" %s[unix]", s.config.ListenUnix)
+	if conf.MetricsListenHTTP != "" {
+		listenStr += fmt.Sprintf(" %s[http/metrics]", conf.MetricsListenHTTP)
 	}
-	if s.config.SMTPServerListen != "" {
-		listenStr += fmt.Sprintf(" %s[smtp]", s.config.SMTPServerListen)
+	if conf.ProfileListenHTTP != "" {
+		listenStr += fmt.Sprintf(" %s[http/profile]", conf.ProfileListenHTTP)
 	}
-	if s.config.MetricsListenHTTP != "" {
-		listenStr += fmt.Sprintf(" %s[http/metrics]", s.config.MetricsListenHTTP)
+	if conf.HealthListenGRPC != "" {
+		listenStr += fmt.Sprintf(" %s[grpc/health]", conf.HealthListenGRPC)
 	}
-	if s.config.ProfileListenHTTP != "" {
-		listenStr += fmt.Sprintf(" %s[http/profile]", s.config.ProfileListenHTTP)
+	if conf.HealthListenAgent != "" {
+		listenStr += fmt.Sprintf(" %s[agent/health]", conf.HealthListenAgent)
 	}
-	log.Tag(tagStartup).Info("Listening on%s, ntfy %s, log level is %s", listenStr, s.config.Version, log.CurrentLevel().String())
+	log.Tag(tagStartup).Info("Listening on%s, ntfy %s, log level is %s", listenStr, conf.Version, log.CurrentLevel().String())
 	if log.IsFile() {
-		fmt.Fprintf(os.Stderr, "Listening on%s, ntfy %s\n", listenStr, s.config.Version)
+		fmt.Fprintf(os.Stderr, "Listening on%s, ntfy %s\n", listenStr, conf.Version)
 		fmt.Fprintf(os.Stderr, "Logs are written to %s\n", log.File())
 	}
+	if s.faults != nil {
+		log.Tag(tagStartup).Warn("Fault injection is enabled, this is meant for development and testing only")
+	}
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", s.handle)
 	errChan := make(chan error)
 	s.mu.Lock()
 	s.closeChan = make(chan bool)
-	if s.config.ListenHTTP != "" {
-		s.httpServer = &http.Server{Addr: s.config.ListenHTTP, Handler: mux}
+	if conf.ListenHTTP != "" {
+		s.httpServer = &http.Server{Addr: conf.ListenHTTP, Handler: mux}
 		go func() {
 			errChan <- s.httpServer.ListenAndServe()
 		}()
 	}
-	if s.config.ListenHTTPS != "" {
-		s.httpsServer = &http.Server{Addr: s.config.ListenHTTPS, Handler: mux}
+	if conf.ListenHTTPS != "" {
+		s.httpsServer = &http.Server{Addr: conf.ListenHTTPS, Handler: mux}
 		go func() {
-			errChan <- s.httpsServer.ListenAndServeTLS(s.config.CertFile, s.config.KeyFile)
+			errChan <- s.httpsServer.ListenAndServeTLS(conf.CertFile, conf.KeyFile)
 		}()
 	}
-	if s.config.ListenUnix != "" {
+	if conf.ListenUnix != "" {
 		go func() {
 			var err error
 			s.mu.Lock()
-			os.Remove(s.config.ListenUnix)
-			s.unixListener, err = net.Listen("unix", s.config.ListenUnix)
+			os.Remove(conf.ListenUnix)
+			s.unixListener, err = net.Listen("unix", conf.ListenUnix)
 			if err != nil {
 				s.mu.Unlock()
 				errChan <- err
 				return
 			}
 			defer s.unixListener.Close()
-			if s.config.ListenUnixMode > 0 {
-				if err := os.Chmod(s.config.ListenUnix, s.config.ListenUnixMode); err != nil {
+			if conf.ListenUnixMode > 0 {
+				if err := os.Chmod(conf.ListenUnix, conf.ListenUnixMode); err != nil {
 					s.mu.Unlock()
 					errChan <- err
 					return
@@ -303,29 +558,52 @@ func (s *Server) Run() error {
 			errChan <- httpServer.Serve(s.unixListener)
 		}()
 	}
-	if s.config.MetricsListenHTTP != "" {
+	if conf.MetricsListenHTTP != "" {
 		initMetrics()
-		s.httpMetricsServer = &http.Server{Addr: s.config.MetricsListenHTTP, Handler: promhttp.Handler()}
+		s.httpMetricsServer = &http.Server{Addr: conf.MetricsListenHTTP, Handler: promhttp.Handler()}
 		go func() {
 			errChan <- s.httpMetricsServer.ListenAndServe()
 		}()
-	} else if s.config.EnableMetrics {
+	} else if conf.EnableMetrics {
 		initMetrics()
 		s.metricsHandler = promhttp.Handler()
 	}
-	if s.config.ProfileListenHTTP != "" {
+	if conf.ProfileListenHTTP != "" {
 		profileMux := http.NewServeMux()
 		profileMux.HandleFunc("/debug/pprof/", pprof.Index)
 		profileMux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
 		profileMux.HandleFunc("/debug/pprof/profile", pprof.Profile)
 		profileMux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
 		profileMux.HandleFunc("/debug/pprof/trace", pprof.Trace)
-		s.httpProfileServer = &http.Server{Addr: s.config.ProfileListenHTTP, Handler: profileMux}
+		s.httpProfileServer = &http.Server{Addr: conf.ProfileListenHTTP, Handler: profileMux}
 		go func() {
 			errChan <- s.httpProfileServer.ListenAndServe()
 		}()
 	}
-	if s.config.SMTPServerListen != "" {
+	if conf.HealthListenGRPC != "" {
+		go func() {
+			listener, err := net.Listen("tcp", conf.HealthListenGRPC)
+			if err != nil {
+				errChan <- err
+				return
+			}
+			errChan <- s.runGRPCHealthServer(listener)
+		}()
+	}
+	if conf.HealthListenAgent != "" {
+		go func() {
+			var err error
+			s.mu.Lock()
+			s.healthAgent, err = net.Listen("tcp", conf.HealthListenAgent)
+			s.mu.Unlock()
+			if err != nil {
+				errChan <- err
+				return
+			}
+			errChan <- s.runHealthAgent(s.healthAgent)
+		}()
+	}
+	if conf.SMTPServerListen != "" {
 		go func() {
 			errChan <- s.runSMTPServer()
 		}()
@@ -335,12 +613,23 @@ func (s *Server) Run() error {
 	go s.runStatsResetter()
 	go s.runDelayedSender()
 	go s.runFirebaseKeepaliver()
-
+	go s.runMonitor()
+	go s.runBridges()
+	go s.runDiskWatchdog()
+	go s.runEmailRetrier()
+	go s.runStripeUsageReporter()
+	go s.publishStartupEvent()
+	if err := sdNotify(sdNotifyReady); err != nil {
+		log.Tag(tagStartup).Err(err).Warn("Unable to notify systemd of readiness")
+	}
 	return <-errChan
 }
 
 // Stop stops HTTP (+HTTPS) server and all managers
 func (s *Server) Stop() {
+	if err := sdNotify(sdNotifyStopping); err != nil {
+		log.Tag(tagManager).Err(err).Warn("Unable to notify systemd of shutdown")
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if s.httpServer != nil {
@@ -355,7 +644,17 @@ func (s *Server) Stop() {
 	if s.smtpServer != nil {
 		s.smtpServer.Close()
 	}
+	if s.grpcServer != nil {
+		s.grpcServer.Stop()
+	}
+	if s.healthAgent != nil {
+		s.healthAgent.Close()
+	}
 	s.closeDatabases()
+	s.firebaseQueue.Close()
+	if s.tts != nil {
+		s.tts.queue.Close()
+	}
 	close(s.closeChan)
 }
 
@@ -396,6 +695,7 @@ func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) handleError(w http.ResponseWriter, r *http.Request, v *visitor, err error) {
+	conf := s.config()
 	httpErr, ok := err.(*errHTTP)
 	if !ok {
 		httpErr = errHTTPInternalError
@@ -405,6 +705,9 @@ func (s *Server) handleError(w http.ResponseWriter, r *http.Request, v *visitor,
 	}
 	isRateLimiting := util.Contains(rateLimitingErrorCodes, httpErr.HTTPCode)
 	isNormalError := strings.Contains(err.Error(), "i/o timeout") || util.Contains(normalErrorCodes, httpErr.HTTPCode)
+	if isRateLimiting {
+		s.limitReached(v, httpErr)
+	}
 	ev := logvr(v, r).Err(err)
 	if websocket.IsWebSocketUpgrade(r) {
 		ev.Tag(tagWebsocket).Fields(websocketErrorContext(err))
@@ -420,27 +723,69 @@ func (s *Server) handleError(w http.ResponseWriter, r *http.Request, v *visitor,
 	} else {
 		ev.Info("Connection closed with HTTP %d (ntfy error %d)", httpErr.HTTPCode, httpErr.Code)
 	}
-	if isRateLimiting && s.config.StripeSecretKey != "" {
+	if isRateLimiting && conf.StripeSecretKey != "" {
 		u := v.User()
 		if u == nil || u.Tier == nil {
-			httpErr = httpErr.Wrap("increase your limits with a paid plan, see %s", s.config.BaseURL)
+			httpErr = httpErr.Wrap("increase your limits with a paid plan, see %s", conf.BaseURL)
 		}
 	}
+	setRetryAfterHeader(w, httpErr)
 	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", s.config.AccessControlAllowOrigin) // CORS, allow cross-origin requests
+	w.Header().Set("Access-Control-Allow-Origin", conf.AccessControlAllowOrigin) // CORS, allow cross-origin requests
 	w.WriteHeader(httpErr.HTTPCode)
 	io.WriteString(w, httpErr.JSON()+"\n")
 }
 
 func (s *Server) handleInternal(w http.ResponseWriter, r *http.Request, v *visitor) error {
-	if r.Method == http.MethodGet && r.URL.Path == "/" && s.config.WebRoot == "/" {
+	conf := s.config()
+	if r.Method == http.MethodGet && r.URL.Path == "/" && conf.WebRoot == "/" {
 		return s.ensureWebEnabled(s.handleRoot)(w, r, v)
 	} else if r.Method == http.MethodHead && r.URL.Path == "/" {
 		return s.ensureWebEnabled(s.handleEmpty)(w, r, v)
 	} else if r.Method == http.MethodGet && r.URL.Path == apiHealthPath {
 		return s.handleHealth(w, r, v)
+	} else if (r.Method == http.MethodGet || r.Method == http.MethodHead) && r.URL.Path == healthzPath {
+		return s.handleHealthz(w, r, v)
 	} else if r.Method == http.MethodGet && r.URL.Path == webConfigPath {
 		return s.ensureWebEnabled(s.handleWebConfig)(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == apiConfigPath {
+		return s.handleConfig(w, r, v)
+	} else if (r.Method == http.MethodPut || r.Method == http.MethodPost) && r.URL.Path == apiBannerPath {
+		return s.ensureAdmin(s.handleBannerChange)(w, r, v)
+	} else if r.Method == http.MethodDelete && r.URL.Path == apiBannerPath {
+		return s.ensureAdmin(s.handleBannerDelete)(w, r, v)
+	} else if r.Method == http.MethodPost && r.URL.Path == apiAdminReplayPath {
+		return s.ensureAdmin(s.handleReplay)(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == apiAdminEmailRetriesPath {
+		return s.ensureAdmin(s.handleEmailRetriesGet)(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == apiAdminBansPath {
+		return s.ensureAdmin(s.handleBansGet)(w, r, v)
+	} else if (r.Method == http.MethodPut || r.Method == http.MethodPost) && r.URL.Path == apiAdminBansPath {
+		return s.ensureAdmin(s.handleBanAdd)(w, r, v)
+	} else if r.Method == http.MethodDelete && r.URL.Path == apiAdminBansPath {
+		return s.ensureAdmin(s.handleBanRemove)(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == apiAdminDrainPath {
+		return s.ensureAdmin(s.handleDrainGet)(w, r, v)
+	} else if (r.Method == http.MethodPut || r.Method == http.MethodPost) && r.URL.Path == apiAdminDrainPath {
+		return s.ensureAdmin(s.handleDrainStart)(w, r, v)
+	} else if r.Method == http.MethodDelete && r.URL.Path == apiAdminDrainPath {
+		return s.ensureAdmin(s.handleDrainStop)(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == apiAdminLockoutsPath {
+		return s.ensureAdmin(s.handleAuthLockoutsGet)(w, r, v)
+	} else if r.Method == http.MethodDelete && r.URL.Path == apiAdminLockoutsPath {
+		return s.ensureAdmin(s.handleAuthLockoutsClear)(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == apiAdminKeysPath {
+		return s.ensureAdmin(s.handleSigningKeysGet)(w, r, v)
+	} else if r.Method == http.MethodPost && r.URL.Path == apiAdminKeysPath {
+		return s.ensureAdmin(s.handleSigningKeyAdd)(w, r, v)
+	} else if r.Method == http.MethodDelete && apiAdminKeySingleRegex.MatchString(r.URL.Path) {
+		return s.ensureAdmin(s.handleSigningKeyRetire)(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == apiAdminInvitesPath {
+		return s.ensureAdmin(s.handleInvitesGet)(w, r, v)
+	} else if r.Method == http.MethodPost && r.URL.Path == apiAdminInvitesPath {
+		return s.ensureAdmin(s.handleInviteAdd)(w, r, v)
+	} else if r.Method == http.MethodDelete && apiAdminInviteSingleRegex.MatchString(r.URL.Path) {
+		return s.ensureAdmin(s.handleInviteDelete)(w, r, v)
 	} else if r.Method == http.MethodGet && r.URL.Path == webManifestPath {
 		return s.ensureWebPushEnabled(s.handleWebManifest)(w, r, v)
 	} else if r.Method == http.MethodGet && r.URL.Path == apiUsersPath {
@@ -453,14 +798,58 @@ func (s *Server) handleInternal(w http.ResponseWriter, r *http.Request, v *visit
 		return s.ensureAdmin(s.handleAccessAllow)(w, r, v)
 	} else if r.Method == http.MethodDelete && r.URL.Path == apiUsersAccessPath {
 		return s.ensureAdmin(s.handleAccessReset)(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == apiUsersAccessBulkPath {
+		return s.ensureAdmin(s.handleAccessExport)(w, r, v)
+	} else if (r.Method == http.MethodPut || r.Method == http.MethodPost) && r.URL.Path == apiUsersAccessBulkPath {
+		return s.ensureAdmin(s.handleAccessImport)(w, r, v)
+	} else if (r.Method == http.MethodPut || r.Method == http.MethodPost) && r.URL.Path == apiUsersSuspensionPath {
+		return s.ensureAdmin(s.handleUsersSuspend)(w, r, v)
+	} else if r.Method == http.MethodDelete && r.URL.Path == apiUsersSuspensionPath {
+		return s.ensureAdmin(s.handleUsersReinstate)(w, r, v)
+	} else if (r.Method == http.MethodPut || r.Method == http.MethodPost) && r.URL.Path == apiUsersTierPath {
+		return s.ensureAdmin(s.handleUsersTierGrant)(w, r, v)
+	} else if r.Method == http.MethodDelete && r.URL.Path == apiUsersTierPath {
+		return s.ensureAdmin(s.handleUsersTierRevoke)(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == scimServiceProviderConfigPath {
+		return s.ensureAdmin(s.handleSCIMServiceProviderConfig)(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == scimUsersPath {
+		return s.ensureAdmin(s.handleSCIMUsersGet)(w, r, v)
+	} else if r.Method == http.MethodPost && r.URL.Path == scimUsersPath {
+		return s.ensureAdmin(s.handleSCIMUserCreate)(w, r, v)
+	} else if r.Method == http.MethodGet && scimUserPathRegex.MatchString(r.URL.Path) {
+		return s.ensureAdmin(s.handleSCIMUserGet)(w, r, v)
+	} else if r.Method == http.MethodPut && scimUserPathRegex.MatchString(r.URL.Path) {
+		return s.ensureAdmin(s.handleSCIMUserReplace)(w, r, v)
+	} else if r.Method == http.MethodPatch && scimUserPathRegex.MatchString(r.URL.Path) {
+		return s.ensureAdmin(s.handleSCIMUserPatch)(w, r, v)
+	} else if r.Method == http.MethodDelete && scimUserPathRegex.MatchString(r.URL.Path) {
+		return s.ensureAdmin(s.handleSCIMUserDelete)(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == scimGroupsPath {
+		return s.ensureAdmin(s.handleSCIMGroupsGet)(w, r, v)
+	} else if r.Method == http.MethodGet && scimGroupPathRegex.MatchString(r.URL.Path) {
+		return s.ensureAdmin(s.handleSCIMGroupGet)(w, r, v)
+	} else if r.Method == http.MethodPut && scimGroupPathRegex.MatchString(r.URL.Path) {
+		return s.ensureAdmin(s.handleSCIMGroupReplace)(w, r, v)
+	} else if r.Method == http.MethodPatch && scimGroupPathRegex.MatchString(r.URL.Path) {
+		return s.ensureAdmin(s.handleSCIMGroupPatch)(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == apiAccessCheckPath {
+		return s.ensureUser(s.handleAccessCheck)(w, r, v) // Admins, or users checking themselves
 	} else if r.Method == http.MethodPost && r.URL.Path == apiAccountPath {
 		return s.ensureUserManager(s.handleAccountCreate)(w, r, v)
 	} else if r.Method == http.MethodGet && r.URL.Path == apiAccountPath {
 		return s.handleAccountGet(w, r, v) // Allowed by anonymous
+	} else if r.Method == http.MethodGet && r.URL.Path == apiAccountVerifyPath {
+		return s.ensureUserManager(s.handleAccountVerify)(w, r, v) // Allowed by anonymous, see sendVerificationEmail
+	} else if r.Method == http.MethodPatch && r.URL.Path == apiAccountPath {
+		return s.ensureUser(s.withAccountSync(s.handleAccountChange))(w, r, v)
 	} else if r.Method == http.MethodDelete && r.URL.Path == apiAccountPath {
 		return s.ensureUser(s.withAccountSync(s.handleAccountDelete))(w, r, v)
 	} else if r.Method == http.MethodPost && r.URL.Path == apiAccountPasswordPath {
 		return s.ensureUser(s.handleAccountPasswordChange)(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == apiAccountTokenPath {
+		return s.ensureUser(s.handleAccountTokensGet)(w, r, v)
+	} else if r.Method == http.MethodPost && r.URL.Path == apiAccountTokenRotatePath {
+		return s.ensureUser(s.withAccountSync(s.handleAccountTokenRotate))(w, r, v)
 	} else if r.Method == http.MethodPost && r.URL.Path == apiAccountTokenPath {
 		return s.ensureUser(s.withAccountSync(s.handleAccountTokenCreate))(w, r, v)
 	} else if r.Method == http.MethodPatch && r.URL.Path == apiAccountTokenPath {
@@ -475,10 +864,34 @@ func (s *Server) handleInternal(w http.ResponseWriter, r *http.Request, v *visit
 		return s.ensureUser(s.withAccountSync(s.handleAccountSubscriptionChange))(w, r, v)
 	} else if r.Method == http.MethodDelete && r.URL.Path == apiAccountSubscriptionPath {
 		return s.ensureUser(s.withAccountSync(s.handleAccountSubscriptionDelete))(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == apiAccountUnifiedPushEndpointsPath {
+		return s.ensureUser(s.handleAccountUnifiedPushEndpoints)(w, r, v)
 	} else if r.Method == http.MethodPost && r.URL.Path == apiAccountReservationPath {
 		return s.ensureUser(s.withAccountSync(s.handleAccountReservationAdd))(w, r, v)
 	} else if r.Method == http.MethodDelete && apiAccountReservationSingleRegex.MatchString(r.URL.Path) {
 		return s.ensureUser(s.withAccountSync(s.handleAccountReservationDelete))(w, r, v)
+	} else if r.Method == http.MethodGet && apiAccountReservationManagersRegex.MatchString(r.URL.Path) {
+		return s.ensureUser(s.handleAccountReservationManagersGet)(w, r, v)
+	} else if r.Method == http.MethodPost && apiAccountReservationManagersRegex.MatchString(r.URL.Path) {
+		return s.ensureUser(s.withAccountSync(s.handleAccountReservationManagerAdd))(w, r, v)
+	} else if r.Method == http.MethodDelete && apiAccountReservationManagersRegex.MatchString(r.URL.Path) {
+		return s.ensureUser(s.withAccountSync(s.handleAccountReservationManagerDelete))(w, r, v)
+	} else if r.Method == http.MethodGet && apiAccountReservationMembersRegex.MatchString(r.URL.Path) {
+		return s.ensureUser(s.handleAccountReservationMembersGet)(w, r, v)
+	} else if (r.Method == http.MethodPut || r.Method == http.MethodPost) && apiAccountReservationMembersRegex.MatchString(r.URL.Path) {
+		return s.ensureUser(s.withAccountSync(s.handleAccountReservationMemberAdd))(w, r, v)
+	} else if r.Method == http.MethodDelete && apiAccountReservationMembersRegex.MatchString(r.URL.Path) {
+		return s.ensureUser(s.withAccountSync(s.handleAccountReservationMemberDelete))(w, r, v)
+	} else if r.Method == http.MethodPost && apiAccountReservationTransferRegex.MatchString(r.URL.Path) {
+		return s.ensureUser(s.withAccountSync(s.handleAccountReservationTransfer))(w, r, v)
+	} else if r.Method == http.MethodPost && apiAccountReservationSecretRegex.MatchString(r.URL.Path) {
+		return s.ensureUser(s.handleAccountReservationSecretCreate)(w, r, v)
+	} else if r.Method == http.MethodDelete && apiAccountReservationSecretRegex.MatchString(r.URL.Path) {
+		return s.ensureUser(s.handleAccountReservationSecretDelete)(w, r, v)
+	} else if r.Method == http.MethodPost && apiAccountReservationEmailRegex.MatchString(r.URL.Path) {
+		return s.ensureUser(s.handleAccountReservationEmailCreate)(w, r, v)
+	} else if r.Method == http.MethodDelete && apiAccountReservationEmailRegex.MatchString(r.URL.Path) {
+		return s.ensureUser(s.handleAccountReservationEmailDelete)(w, r, v)
 	} else if r.Method == http.MethodPost && r.URL.Path == apiAccountBillingSubscriptionPath {
 		return s.ensurePaymentsEnabled(s.ensureUser(s.handleAccountBillingSubscriptionCreate))(w, r, v) // Account sync via incoming Stripe webhook
 	} else if r.Method == http.MethodGet && apiAccountBillingSubscriptionCheckoutSuccessRegex.MatchString(r.URL.Path) {
@@ -491,18 +904,76 @@ func (s *Server) handleInternal(w http.ResponseWriter, r *http.Request, v *visit
 		return s.ensurePaymentsEnabled(s.ensureStripeCustomer(s.handleAccountBillingPortalSessionCreate))(w, r, v)
 	} else if r.Method == http.MethodPost && r.URL.Path == apiAccountBillingWebhookPath {
 		return s.ensurePaymentsEnabled(s.ensureUserManager(s.handleAccountBillingWebhook))(w, r, v) // This request comes from Stripe!
+	} else if r.Method == http.MethodGet && r.URL.Path == apiAccountOrgPath {
+		return s.ensureUser(s.handleAccountOrgGet)(w, r, v)
+	} else if r.Method == http.MethodPost && r.URL.Path == apiAccountOrgPath {
+		return s.ensureUser(s.withAccountSync(s.handleAccountOrgCreate))(w, r, v)
+	} else if r.Method == http.MethodDelete && r.URL.Path == apiAccountOrgPath {
+		return s.ensureUser(s.withAccountSync(s.handleAccountOrgDelete))(w, r, v)
+	} else if (r.Method == http.MethodPut || r.Method == http.MethodPost) && r.URL.Path == apiAccountOrgMembersPath {
+		return s.ensureUser(s.handleAccountOrgMemberAdd)(w, r, v)
+	} else if r.Method == http.MethodDelete && r.URL.Path == apiAccountOrgMembersPath {
+		return s.ensureUser(s.withAccountSync(s.handleAccountOrgMemberDelete))(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == apiAccountOrgInvitesPath {
+		return s.ensureUser(s.handleAccountOrgInvitesGet)(w, r, v)
+	} else if r.Method == http.MethodPost && apiAccountOrgInviteSingleRegex.MatchString(r.URL.Path) {
+		return s.ensureUser(s.withAccountSync(s.handleAccountOrgInviteAccept))(w, r, v)
+	} else if r.Method == http.MethodDelete && apiAccountOrgInviteSingleRegex.MatchString(r.URL.Path) {
+		return s.ensureUser(s.handleAccountOrgInviteDelete)(w, r, v)
+	} else if (r.Method == http.MethodPut || r.Method == http.MethodPost) && r.URL.Path == apiAccountOrgTopicsPath {
+		return s.ensureUser(s.handleAccountOrgTopicAdd)(w, r, v)
+	} else if r.Method == http.MethodDelete && apiAccountOrgTopicSingleRegex.MatchString(r.URL.Path) {
+		return s.ensureUser(s.handleAccountOrgTopicDelete)(w, r, v)
+	} else if r.Method == http.MethodPost && r.URL.Path == apiAccountOrgBillingSubscriptionPath {
+		return s.ensurePaymentsEnabled(s.ensureUser(s.handleAccountOrgBillingSubscriptionCreate))(w, r, v) // Account sync via incoming Stripe webhook
+	} else if r.Method == http.MethodGet && apiAccountOrgBillingCheckoutSuccessRegex.MatchString(r.URL.Path) {
+		return s.ensurePaymentsEnabled(s.ensureUserManager(s.handleAccountOrgBillingSubscriptionCreateSuccess))(w, r, v) // No user context!
+	} else if r.Method == http.MethodDelete && r.URL.Path == apiAccountOrgBillingSubscriptionPath {
+		return s.ensurePaymentsEnabled(s.ensureUser(s.handleAccountOrgBillingSubscriptionDelete))(w, r, v)
+	} else if r.Method == http.MethodPost && r.URL.Path == apiAccountOrgBillingPortalPath {
+		return s.ensurePaymentsEnabled(s.ensureUser(s.handleAccountOrgBillingPortalSessionCreate))(w, r, v)
 	} else if r.Method == http.MethodPut && r.URL.Path == apiAccountPhoneVerifyPath {
 		return s.ensureUser(s.ensureCallsEnabled(s.withAccountSync(s.handleAccountPhoneNumberVerify)))(w, r, v)
 	} else if r.Method == http.MethodPut && r.URL.Path == apiAccountPhonePath {
 		return s.ensureUser(s.ensureCallsEnabled(s.withAccountSync(s.handleAccountPhoneNumberAdd)))(w, r, v)
 	} else if r.Method == http.MethodDelete && r.URL.Path == apiAccountPhonePath {
 		return s.ensureUser(s.ensureCallsEnabled(s.withAccountSync(s.handleAccountPhoneNumberDelete)))(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == apiAccountStatsPath {
+		return s.ensureUser(s.handleAccountStatsGet)(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == apiAccountTOTPPath {
+		return s.ensureUser(s.handleAccountTOTPGet)(w, r, v)
+	} else if r.Method == http.MethodPost && r.URL.Path == apiAccountTOTPPath {
+		return s.ensureUser(s.handleAccountTOTPEnroll)(w, r, v)
+	} else if r.Method == http.MethodPut && r.URL.Path == apiAccountTOTPPath {
+		return s.ensureUser(s.withAccountSync(s.handleAccountTOTPEnable))(w, r, v)
+	} else if r.Method == http.MethodDelete && r.URL.Path == apiAccountTOTPPath {
+		return s.ensureUser(s.withAccountSync(s.handleAccountTOTPDisable))(w, r, v)
 	} else if r.Method == http.MethodPost && apiWebPushPath == r.URL.Path {
 		return s.ensureWebPushEnabled(s.limitRequests(s.handleWebPushUpdate))(w, r, v)
 	} else if r.Method == http.MethodDelete && apiWebPushPath == r.URL.Path {
 		return s.ensureWebPushEnabled(s.limitRequests(s.handleWebPushDelete))(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == apiInstantPath {
+		return s.handleInstant(w, r, v)
+	} else if r.Method == http.MethodPost && r.URL.Path == apiInstantDevicesPath {
+		return s.limitRequests(s.handleInstantDeviceRegister)(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == apiInstantDevicesPath {
+		return s.ensureAdmin(s.handleInstantDevicesGet)(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == apiQRCodePath {
+		return s.limitRequests(s.handleQRCode)(w, r, v)
+	} else if r.Method == http.MethodPost && r.URL.Path == apiQRCodePath {
+		return s.ensureUser(s.withAccountSync(s.handleQRCodeTokenCreate))(w, r, v)
+	} else if r.Method == http.MethodPost && r.URL.Path == apiDashboardPath {
+		return s.ensureUser(s.handleDashboardTokenCreate)(w, r, v)
+	} else if r.Method == http.MethodGet && apiDashboardRegex.MatchString(r.URL.Path) {
+		return s.ensureUserManager(s.limitRequests(s.handleDashboard))(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == subscribeURIPath {
+		return s.ensureWebEnabled(s.limitRequests(s.handleSubscribeURI))(w, r, v)
+	} else if r.Method == http.MethodPost && r.URL.Path == subscribeURIPath {
+		return s.ensureUser(s.withAccountSync(s.handleSubscribeURIAccount))(w, r, v)
 	} else if r.Method == http.MethodGet && r.URL.Path == apiStatsPath {
 		return s.handleStats(w, r, v)
+	} else if r.Method == http.MethodGet && r.URL.Path == apiSearchPath {
+		return s.limitRequests(s.handleSearch)(w, r, v)
 	} else if r.Method == http.MethodGet && r.URL.Path == apiTiersPath {
 		return s.ensurePaymentsEnabled(s.handleBillingTiersGet)(w, r, v)
 	} else if r.Method == http.MethodGet && r.URL.Path == matrixPushPath {
@@ -513,14 +984,26 @@ func (s *Server) handleInternal(w http.ResponseWriter, r *http.Request, v *visit
 		return s.ensureWebEnabled(s.handleStatic)(w, r, v)
 	} else if r.Method == http.MethodGet && docsRegex.MatchString(r.URL.Path) {
 		return s.ensureWebEnabled(s.handleDocs)(w, r, v)
-	} else if (r.Method == http.MethodGet || r.Method == http.MethodHead) && fileRegex.MatchString(r.URL.Path) && s.config.AttachmentCacheDir != "" {
+	} else if (r.Method == http.MethodGet || r.Method == http.MethodHead) && fileRegex.MatchString(r.URL.Path) && conf.AttachmentCacheDir != "" {
 		return s.limitRequests(s.handleFile)(w, r, v)
+	} else if r.Method == http.MethodGet && fileURLRegex.MatchString(r.URL.Path) && conf.AttachmentCacheDir != "" {
+		return s.ensureUserManager(s.limitRequests(s.handleFileURL))(w, r, v)
+	} else if r.Method == http.MethodPost && r.URL.Path == apiAttachmentsPath {
+		return s.limitRequests(s.handleAttachmentUploadCreate)(w, r, v)
+	} else if r.Method == http.MethodHead && apiAttachmentsUploadRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.handleAttachmentUploadHead)(w, r, v)
+	} else if r.Method == http.MethodPatch && apiAttachmentsUploadRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.handleAttachmentUploadPatch)(w, r, v)
+	} else if r.Method == http.MethodDelete && apiAttachmentsUploadRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.handleAttachmentUploadDelete)(w, r, v)
 	} else if r.Method == http.MethodOptions {
 		return s.limitRequests(s.handleOptions)(w, r, v) // Should work even if the web app is not enabled, see #598
 	} else if (r.Method == http.MethodPut || r.Method == http.MethodPost) && r.URL.Path == "/" {
 		return s.transformBodyJSON(s.limitRequestsWithTopic(s.authorizeTopicWrite(s.handlePublish)))(w, r, v)
 	} else if r.Method == http.MethodPost && r.URL.Path == matrixPushPath {
 		return s.transformMatrixJSON(s.limitRequestsWithTopic(s.authorizeTopicWrite(s.handlePublishMatrix)))(w, r, v)
+	} else if r.Method == http.MethodPost && apiIntegrationRegex.MatchString(r.URL.Path) {
+		return s.transformIntegration(s.limitRequestsWithTopic(s.authorizeTopicWrite(s.handlePublish)))(w, r, v)
 	} else if (r.Method == http.MethodPut || r.Method == http.MethodPost) && topicPathRegex.MatchString(r.URL.Path) {
 		return s.limitRequestsWithTopic(s.authorizeTopicWrite(s.handlePublish))(w, r, v)
 	} else if r.Method == http.MethodGet && publishPathRegex.MatchString(r.URL.Path) {
@@ -535,6 +1018,42 @@ func (s *Server) handleInternal(w http.ResponseWriter, r *http.Request, v *visit
 		return s.limitRequests(s.authorizeTopicRead(s.handleSubscribeWS))(w, r, v)
 	} else if r.Method == http.MethodGet && authPathRegex.MatchString(r.URL.Path) {
 		return s.limitRequests(s.authorizeTopicRead(s.handleTopicAuth))(w, r, v)
+	} else if r.Method == http.MethodDelete && topicMessagePathRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.authorizeTopicManage(s.handleTopicMessageDelete))(w, r, v)
+	} else if r.Method == http.MethodPost && topicMutePathRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.authorizeTopicManage(s.handleTopicMute))(w, r, v)
+	} else if r.Method == http.MethodDelete && topicMutePathRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.authorizeTopicManage(s.handleTopicUnmute))(w, r, v)
+	} else if r.Method == http.MethodDelete && topicMessagesPathRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.authorizeTopicManage(s.handleTopicMessagesDelete))(w, r, v)
+	} else if r.Method == http.MethodGet && topicStatsPathRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.authorizeTopicManage(s.handleTopicStats))(w, r, v)
+	} else if (r.Method == http.MethodPut || r.Method == http.MethodPost) && topicAliasPathRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.authorizeTopicManage(s.handleTopicAliasAdd))(w, r, v)
+	} else if r.Method == http.MethodDelete && topicAliasPathRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.authorizeTopicManage(s.handleTopicAliasDelete))(w, r, v)
+	} else if r.Method == http.MethodGet && topicExportPathRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.authorizeTopicRead(s.handleTopicExport))(w, r, v)
+	} else if r.Method == http.MethodGet && topicFeedPathRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.authorizeTopicRead(s.handleTopicFeed))(w, r, v)
+	} else if r.Method == http.MethodGet && topicSeriesPathRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.authorizeTopicRead(s.handleTopicSeriesGet))(w, r, v)
+	} else if (r.Method == http.MethodPut || r.Method == http.MethodPost) && topicSeriesPathRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.authorizeTopicManage(s.handleTopicSeriesSet))(w, r, v)
+	} else if r.Method == http.MethodDelete && topicSeriesPathRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.authorizeTopicManage(s.handleTopicSeriesDelete))(w, r, v)
+	} else if r.Method == http.MethodGet && topicSamplingPathRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.authorizeTopicRead(s.handleTopicSamplingGet))(w, r, v)
+	} else if (r.Method == http.MethodPut || r.Method == http.MethodPost) && topicSamplingPathRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.authorizeTopicManage(s.handleTopicSamplingSet))(w, r, v)
+	} else if r.Method == http.MethodDelete && topicSamplingPathRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.authorizeTopicManage(s.handleTopicSamplingDelete))(w, r, v)
+	} else if r.Method == http.MethodGet && topicIdentityPathRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.authorizeTopicRead(s.handleTopicIdentityGet))(w, r, v)
+	} else if (r.Method == http.MethodPut || r.Method == http.MethodPost) && topicIdentityPathRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.authorizeTopicManage(s.handleTopicIdentitySet))(w, r, v)
+	} else if r.Method == http.MethodDelete && topicIdentityPathRegex.MatchString(r.URL.Path) {
+		return s.limitRequests(s.authorizeTopicManage(s.handleTopicIdentityDelete))(w, r, v)
 	} else if r.Method == http.MethodGet && (topicPathRegex.MatchString(r.URL.Path) || externalTopicPathRegex.MatchString(r.URL.Path)) {
 		return s.ensureWebEnabled(s.handleTopic)(w, r, v)
 	}
@@ -550,7 +1069,7 @@ func (s *Server) handleTopic(w http.ResponseWriter, r *http.Request, v *visitor)
 	unifiedpush := readBoolParam(r, false, "x-unifiedpush", "unifiedpush", "up") // see PUT/POST too!
 	if unifiedpush {
 		w.Header().Set("Content-Type", "application/json")
-		w.Header().Set("Access-Control-Allow-Origin", s.config.AccessControlAllowOrigin) // CORS, allow cross-origin requests
+		w.Header().Set("Access-Control-Allow-Origin", s.config().AccessControlAllowOrigin) // CORS, allow cross-origin requests
 		_, err := io.WriteString(w, `{"unifiedpush":{"version":1}}`+"\n")
 		return err
 	}
@@ -566,29 +1085,35 @@ func (s *Server) handleTopicAuth(w http.ResponseWriter, _ *http.Request, _ *visi
 	return s.writeJSON(w, newSuccessResponse())
 }
 
-func (s *Server) handleHealth(w http.ResponseWriter, _ *http.Request, _ *visitor) error {
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	draining := s.draining.Load()
 	response := &apiHealthResponse{
-		Healthy: true,
+		Healthy:       !draining,
+		Draining:      draining,
+		Subscriptions: s.subscriptions.Load(),
+	}
+	if readBoolParam(r, false, "x-deep", "deep") {
+		response.Checks = make(map[string]string)
+		for name, err := range s.checkDatabases() {
+			if err != nil {
+				response.Checks[name] = err.Error()
+				response.Healthy = false
+			} else {
+				response.Checks[name] = healthCheckOK
+			}
+		}
+	}
+	if !response.Healthy {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Access-Control-Allow-Origin", s.config().AccessControlAllowOrigin) // CORS, allow cross-origin requests
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return json.NewEncoder(w).Encode(response)
 	}
 	return s.writeJSON(w, response)
 }
 
 func (s *Server) handleWebConfig(w http.ResponseWriter, _ *http.Request, _ *visitor) error {
-	response := &apiConfigResponse{
-		BaseURL:            "", // Will translate to window.location.origin
-		AppRoot:            s.config.WebRoot,
-		EnableLogin:        s.config.EnableLogin,
-		EnableSignup:       s.config.EnableSignup,
-		EnablePayments:     s.config.StripeSecretKey != "",
-		EnableCalls:        s.config.TwilioAccount != "",
-		EnableEmails:       s.config.SMTPSenderFrom != "",
-		EnableReservations: s.config.EnableReservations,
-		EnableWebPush:      s.config.WebPushPublicKey != "",
-		BillingContact:     s.config.BillingContact,
-		WebPushPublicKey:   s.config.WebPushPublicKey,
-		DisallowedTopics:   s.config.DisallowedTopics,
-	}
-	b, err := json.MarshalIndent(response, "", "  ")
+	b, err := json.MarshalIndent(s.configResponse(), "", "  ")
 	if err != nil {
 		return err
 	}
@@ -598,6 +1123,34 @@ func (s *Server) handleWebConfig(w http.ResponseWriter, _ *http.Request, _ *visi
 	return err
 }
 
+// handleConfig returns the same server configuration as handleWebConfig, but as JSON, for clients other than the web app
+func (s *Server) handleConfig(w http.ResponseWriter, _ *http.Request, _ *visitor) error {
+	return s.writeJSON(w, s.configResponse())
+}
+
+func (s *Server) configResponse() *apiConfigResponse {
+	conf := s.config()
+	s.mu.RLock()
+	banner := s.banner
+	s.mu.RUnlock()
+	return &apiConfigResponse{
+		BaseURL:            "", // Will translate to window.location.origin
+		AppRoot:            conf.WebRoot,
+		EnableLogin:        conf.EnableLogin,
+		EnableSignup:       conf.EnableSignup,
+		SignupMode:         conf.SignupMode,
+		EnablePayments:     conf.StripeSecretKey != "",
+		EnableCalls:        conf.TwilioAccount != "",
+		EnableEmails:       conf.SMTPSenderFrom != "",
+		EnableReservations: conf.EnableReservations,
+		EnableWebPush:      conf.WebPushPublicKey != "",
+		BillingContact:     conf.BillingContact,
+		WebPushPublicKey:   conf.WebPushPublicKey,
+		DisallowedTopics:   conf.DisallowedTopics,
+		Banner:             banner,
+	}
+}
+
 // handleWebManifest serves the web app manifest for the progressive web app (PWA)
 func (s *Server) handleWebManifest(w http.ResponseWriter, _ *http.Request, _ *visitor) error {
 	response := &webManifestResponse{
@@ -605,7 +1158,7 @@ func (s *Server) handleWebManifest(w http.ResponseWriter, _ *http.Request, _ *vi
 		Description:     "ntfy lets you send push notifications via scripts from any computer or phone",
 		ShortName:       "ntfy",
 		Scope:           "/",
-		StartURL:        s.config.WebRoot,
+		StartURL:        s.config().WebRoot,
 		Display:         "standalone",
 		BackgroundColor: "#ffffff",
 		ThemeColor:      "#317f6f",
@@ -613,6 +1166,9 @@ func (s *Server) handleWebManifest(w http.ResponseWriter, _ *http.Request, _ *vi
 			{SRC: "/static/images/pwa-192x192.png", Sizes: "192x192", Type: "image/png"},
 			{SRC: "/static/images/pwa-512x512.png", Sizes: "512x512", Type: "image/png"},
 		},
+		ProtocolHandlers: []*webManifestProtocolHandler{
+			{Protocol: ntfyURIWebScheme, URL: subscribeURIPath + "?uri=%s"}, // See server_uri.go
+		},
 	}
 	return s.writeJSONWithContentType(w, response, "application/manifest+json")
 }
@@ -642,13 +1198,21 @@ func (s *Server) handleStats(w http.ResponseWriter, _ *http.Request, _ *visitor)
 	s.mu.RLock()
 	messages, n, rate := s.messages, len(s.messagesHistory), float64(0)
 	if n > 1 {
-		rate = float64(s.messagesHistory[n-1]-s.messagesHistory[0]) / (float64(n-1) * s.config.ManagerInterval.Seconds())
+		rate = float64(s.messagesHistory[n-1]-s.messagesHistory[0]) / (float64(n-1) * s.config().ManagerInterval.Seconds())
 	}
 	s.mu.RUnlock()
 	response := &apiStatsResponse{
 		Messages:     messages,
 		MessagesRate: rate,
 	}
+	if s.firebaseClient != nil {
+		pacing := s.firebasePacer.Stats()
+		response.Firebase = &apiStatsFirebaseResponse{
+			PacedTopics:  pacing.PacedTopics,
+			ProjectDelay: int64(pacing.ProjectDelay.Seconds()),
+			MaxDelay:     int64(pacing.MaxDelay.Seconds()),
+		}
+	}
 	return s.writeJSON(w, response)
 }
 
@@ -656,7 +1220,8 @@ func (s *Server) handleStats(w http.ResponseWriter, _ *http.Request, _ *visitor)
 // Before streaming the file to a client, it locates uploader (m.Sender or m.User) in the message cache, so it
 // can associate the download bandwidth with the uploader.
 func (s *Server) handleFile(w http.ResponseWriter, r *http.Request, v *visitor) error {
-	if s.config.AttachmentCacheDir == "" {
+	conf := s.config()
+	if conf.AttachmentCacheDir == "" {
 		return errHTTPInternalError
 	}
 	matches := fileRegex.FindStringSubmatch(r.URL.Path)
@@ -664,7 +1229,16 @@ func (s *Server) handleFile(w http.ResponseWriter, r *http.Request, v *visitor)
 		return errHTTPInternalErrorInvalidPath
 	}
 	messageID := matches[1]
-	file := filepath.Join(s.config.AttachmentCacheDir, messageID)
+	// Signatures are always checked, see handleFileURL; topics are checked in authorizeAttachment. Without a user
+	// manager, there are no signing keys, so the signature is ignored.
+	signed := s.userManager != nil && readQueryParam(r, "sig") != ""
+	if conf.AttachmentAuth || signed {
+		if err := s.authorizeAttachment(r, v, messageID); err != nil {
+			return err
+		}
+	}
+	s.waitForTTS(r.Context(), messageID)
+	file := filepath.Join(conf.AttachmentCacheDir, messageID)
 	stat, err := os.Stat(file)
 	if err != nil {
 		return errHTTPNotFound.Fields(log.Context{
@@ -672,23 +1246,18 @@ func (s *Server) handleFile(w http.ResponseWriter, r *http.Request, v *visitor)
 			"error_context": "filesystem",
 		})
 	}
-	w.Header().Set("Access-Control-Allow-Origin", s.config.AccessControlAllowOrigin) // CORS, allow cross-origin requests
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", stat.Size()))
-	if r.Method == http.MethodHead {
-		return nil
-	}
 	// Find message in database, and associate bandwidth to the uploader user
 	// This is an easy way to
 	//   - avoid abuse (e.g. 1 uploader, 1k downloaders)
 	//   - and also uses the higher bandwidth limits of a paying user
 	m, err := s.messageCache.Message(messageID)
 	if errors.Is(err, errMessageNotFound) {
-		if s.config.CacheBatchTimeout > 0 {
+		if conf.CacheBatchTimeout > 0 {
 			// Strange edge case: If we immediately after upload request the file (the web app does this for images),
 			// and messages are persisted asynchronously, retry fetching from the database
 			m, err = util.Retry(func() (*message, error) {
 				return s.messageCache.Message(messageID)
-			}, s.config.CacheBatchTimeout, 100*time.Millisecond, 300*time.Millisecond, 600*time.Millisecond)
+			}, conf.CacheBatchTimeout, 100*time.Millisecond, 300*time.Millisecond, 600*time.Millisecond)
 		}
 		if err != nil {
 			return errHTTPNotFound.Fields(log.Context{
@@ -699,6 +1268,13 @@ func (s *Server) handleFile(w http.ResponseWriter, r *http.Request, v *visitor)
 	} else if err != nil {
 		return err
 	}
+	if m.Attachment != nil && m.Attachment.Expires > 0 && m.Attachment.Expires < time.Now().Unix() {
+		// Expired, but not pruned yet (e.g. X-Attachment-TTL shorter than the manager interval)
+		return errHTTPNotFound.Fields(log.Context{
+			"message_id":    messageID,
+			"error_context": "attachment_expired",
+		})
+	}
 	bandwidthVisitor := v
 	if s.userManager != nil && m.User != "" {
 		u, err := s.userManager.UserByID(m.User)
@@ -709,30 +1285,145 @@ func (s *Server) handleFile(w http.ResponseWriter, r *http.Request, v *visitor)
 	} else if m.Sender.IsValid() {
 		bandwidthVisitor = s.visitor(m.Sender, nil)
 	}
-	if !bandwidthVisitor.BandwidthAllowed(stat.Size()) {
+	thumbnailWidth, err := parseThumbnailWidth(r)
+	if err != nil {
+		return err
+	} else if thumbnailWidth > 0 {
+		// Thumbnails are paid for with the size of the original image, since it has to be read and resized,
+		// and the thumbnail itself is smaller. This also covers sending the thumbnail below.
+		if !bandwidthVisitor.BandwidthAllowed(stat.Size()) {
+			return errHTTPTooManyRequestsLimitAttachmentBandwidth.With(m)
+		}
+		file, err = s.fileCache.Thumbnail(messageID, thumbnailWidth)
+		if errors.Is(err, errThumbnailUnsupported) {
+			return errHTTPBadRequestThumbnailUnsupported
+		} else if errors.Is(err, util.ErrLimitReached) {
+			return errHTTPEntityTooLargeAttachment
+		} else if err != nil {
+			return err
+		}
+		if stat, err = os.Stat(file); err != nil {
+			return err
+		}
+	}
+	// Attachments never change, so the ETag only depends on the message ID and the requested file
+	etag := fmt.Sprintf(`"%s-%d-%d"`, messageID, thumbnailWidth, stat.Size())
+	w.Header().Set("Access-Control-Allow-Origin", conf.AccessControlAllowOrigin) // CORS, allow cross-origin requests
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("ETag", etag)
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	if r.Method == http.MethodHead {
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", stat.Size()))
+		return nil
+	}
+	if thumbnailWidth == 0 && !bandwidthVisitor.BandwidthAllowed(requestedRangeLength(r.Header.Get("Range"), stat.Size())) {
 		return errHTTPTooManyRequestsLimitAttachmentBandwidth.With(m)
 	}
-	// Actually send file
+	// Actually send file; http.ServeContent handles Range and If-Range requests, so clients can resume downloads
 	f, err := os.Open(file)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	if m.Attachment.Name != "" {
+	contentType, err := attachmentContentType(f, r.URL.Path)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", contentType)
+	if m.Attachment.Name != "" && thumbnailWidth == 0 {
 		w.Header().Set("Content-Disposition", "attachment; filename="+strconv.Quote(m.Attachment.Name))
 	}
-	_, err = io.Copy(util.NewContentTypeWriter(w, r.URL.Path), f)
-	return err
+	http.ServeContent(w, r, "", stat.ModTime(), f)
+	return nil
+}
+
+// attachmentContentType detects the content type of the file from its first bytes (see util.SafeContentType),
+// and rewinds the file afterwards. Unlike util.ContentTypeWriter, it always returns a content type, so that
+// http.ServeContent does not sniff the content itself.
+func attachmentContentType(f *os.File, filename string) (string, error) {
+	buf := make([]byte, attachmentSniffBytes)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return util.SafeContentType(buf[:n], filename), nil
+}
+
+// etagMatches returns true if the If-None-Match header value contains the given ETag, or is "*"
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// requestedRangeLength returns the number of bytes requested by a single-range Range header (e.g. "bytes=100-",
+// "bytes=100-199" or "bytes=-100"), to count only the bytes that are actually sent towards the bandwidth limit. For
+// all other requests (no range, multiple ranges, invalid ranges), it returns the file size.
+func requestedRangeLength(rangeHeader string, size int64) int64 {
+	spec, ok := strings.CutPrefix(rangeHeader, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return size
+	}
+	startStr, endStr, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return size
+	}
+	if startStr == "" {
+		suffix, err := strconv.ParseInt(endStr, 10, 64)
+		if err != nil || suffix <= 0 {
+			return size
+		}
+		return min(suffix, size)
+	}
+	start, err := strconv.ParseInt(startStr, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return size
+	}
+	end := size - 1
+	if endStr != "" {
+		if end, err = strconv.ParseInt(endStr, 10, 64); err != nil || end < start {
+			return size
+		}
+		end = min(end, size-1)
+	}
+	return end - start + 1
+}
+
+// parseThumbnailWidth returns the requested thumbnail width for handleFile, or 0 if the original file
+// is requested. Both "?thumb=1" (default width) and "?width=..." are supported.
+func parseThumbnailWidth(r *http.Request) (int, error) {
+	widthStr := readParam(r, "x-width", "width")
+	if widthStr != "" {
+		width, err := strconv.Atoi(widthStr)
+		if err != nil || width <= 0 {
+			return 0, errHTTPBadRequestThumbnailWidthInvalid
+		}
+		return normalizeThumbnailWidth(width), nil
+	} else if readBoolParam(r, false, "x-thumb", "thumb") {
+		return thumbnailDefaultWidth, nil
+	}
+	return 0, nil
 }
 
 func (s *Server) handleMatrixDiscovery(w http.ResponseWriter) error {
-	if s.config.BaseURL == "" {
+	if s.config().BaseURL == "" {
 		return errHTTPInternalErrorMissingBaseURL
 	}
 	return writeMatrixDiscoveryResponse(w)
 }
 
 func (s *Server) handlePublishInternal(r *http.Request, v *visitor) (*message, error) {
+	conf := s.config()
 	start := time.Now()
 	t, err := fromContext[*topic](r, contextTopic)
 	if err != nil {
@@ -742,22 +1433,41 @@ func (s *Server) handlePublishInternal(r *http.Request, v *visitor) (*message, e
 	if err != nil {
 		return nil, err
 	}
-	body, err := util.Peek(r.Body, s.config.MessageSizeLimit)
+	body, err := util.Peek(r.Body, conf.MessageSizeLimit)
 	if err != nil {
 		return nil, err
 	}
 	m := newDefaultMessage(t.ID, "")
-	cache, firebase, email, call, template, unifiedpush, e := s.parsePublishParams(r, m)
+	m.Language = s.language(v, r)
+	cache, firebase, email, call, callChannel, template, unifiedpush, e := s.parsePublishParams(r, m)
+	tts := readBoolParam(r, false, "x-tts", "tts")
 	if e != nil {
 		return nil, e.With(t)
+	} else if t.Muted(senderKey(v.MaybeUserID(), v.IP())) {
+		return nil, errHTTPForbiddenSenderMuted.With(t)
+	} else if tts && s.tts == nil {
+		return nil, errHTTPBadRequestTTSDisabled.With(t)
+	} else if tts && m.Attachment != nil {
+		return nil, errHTTPBadRequestTTSWithAttachment.With(t)
+	}
+	signed, _ := fromContext[bool](r, contextSignedPublish)
+	emailAlias, _ := fromContext[bool](r, contextEmailAlias)
+	if cache && !signed && !emailAlias && !s.topicPermitted(v, t.ID, user.PermissionWrite) {
+		// Publisher only has the publish-only-no-cache permission, see user.PermissionWriteNoCache
+		if m.Time > time.Now().Unix() {
+			return nil, errHTTPBadRequestDelayNoCache.With(t)
+		}
+		cache = false
 	}
-	if unifiedpush && s.config.VisitorSubscriberRateLimiting && t.RateVisitor() == nil {
+	if unifiedpush && conf.VisitorSubscriberRateLimiting && t.RateVisitor() == nil {
 		// UnifiedPush clients must subscribe before publishing to allow proper subscriber-based rate limiting.
 		// The 5xx response is because some app servers (in particular Mastodon) will remove
 		// the subscription as invalid if any 400-499 code (except 429/408) is returned.
 		// See https://github.com/mastodon/mastodon/blob/730bb3e211a84a2f30e3e2bbeae3f77149824a68/app/workers/web/push_notification_worker.rb#L35-L46
 		return nil, errHTTPInsufficientStorageUnifiedPush.With(t)
-	} else if !util.ContainsIP(s.config.VisitorRequestExemptIPAddrs, v.ip) && !vrate.MessageAllowed() {
+	} else if unifiedpush && conf.UnifiedPushEndpointLimitBurst > 0 && !t.UnifiedPushAllowed(conf.UnifiedPushEndpointLimitBurst, conf.UnifiedPushEndpointLimitReplenish) {
+		return nil, errHTTPTooManyRequestsLimitUnifiedPushEndpoint.With(t)
+	} else if !util.ContainsIP(conf.VisitorRequestExemptIPAddrs, v.ip) && !vrate.MessageAllowed() {
 		return nil, errHTTPTooManyRequestsLimitMessages.With(t)
 	} else if email != "" && !vrate.EmailAllowed() {
 		return nil, errHTTPTooManyRequestsLimitEmails.With(t)
@@ -775,48 +1485,100 @@ func (s *Server) handlePublishInternal(r *http.Request, v *visitor) (*message, e
 	}
 	m.Sender = v.IP()
 	m.User = v.MaybeUserID()
+	s.maybeAddPublisher(v, m)
 	if cache {
-		m.Expires = time.Unix(m.Time, 0).Add(v.Limits().MessageExpiryDuration).Unix()
+		m.Expires = s.messageExpires(v, m)
+	}
+	if unifiedpush {
+		cache = applyUnifiedPushHeaders(r, m, cache)
 	}
 	if err := s.handlePublishBody(r, v, m, body, template, unifiedpush); err != nil {
 		return nil, err
 	}
+	if !unifiedpush {
+		if err := s.transformMessage(v, m); err != nil {
+			return nil, err
+		}
+	}
 	if m.Message == "" {
 		m.Message = emptyMessageBody
 	}
 	delayed := m.Time > time.Now().Unix()
+	var dedupID string // Set if m is recorded as the original message for its dedup ID, see dedupMessage
+	if conf.MessageDedupWindow > 0 && !delayed && m.PollID == "" {
+		var e *errHTTP
+		dedupID, e = parseDedupID(r, m)
+		if e != nil {
+			return nil, e.With(t)
+		} else if dedupID != "" {
+			original, err := s.dedupMessage(t, dedupID, m)
+			if err != nil {
+				return nil, err
+			} else if original != nil {
+				if m.Attachment != nil && s.fileCache != nil {
+					if err := s.fileCache.Remove(m.ID); err != nil {
+						logvrm(v, r, m).Tag(tagPublish).Err(err).Warn("Error removing attachment of duplicate message")
+					}
+				}
+				logvrm(v, r, m).Tag(tagPublish).Debug("Coalescing duplicate message into message %s (%d duplicates)", original.ID, original.DedupCount)
+				return original, nil
+			}
+		}
+	}
+	if tts && m.Event == messageEvent {
+		if err := s.handleTTSAttachment(v, m); err != nil {
+			s.removeDedup(t, dedupID, m)
+			return nil, err
+		}
+	}
+	if alt := readParam(r, "x-alt", "alt"); alt != "" && m.Attachment != nil {
+		m.Attachment.Alt = alt
+	}
 	ev := logvrm(v, r, m).
 		Tag(tagPublish).
 		With(t).
 		Fields(log.Context{
-			"message_delayed":     delayed,
-			"message_firebase":    firebase,
-			"message_unifiedpush": unifiedpush,
-			"message_email":       email,
-			"message_call":        call,
+			"message_delayed":      delayed,
+			"message_firebase":     firebase,
+			"message_unifiedpush":  unifiedpush,
+			"message_email":        email,
+			"message_call":         call,
+			"message_call_channel": callChannel,
 		})
 	if ev.IsTrace() {
 		ev.Field("message_body", util.MaybeMarshalJSON(m)).Trace("Received message")
 	} else if ev.IsDebug() {
 		ev.Debug("Received message")
 	}
-	if !delayed {
+	if !delayed && s.sampleOut(v, m) {
+		s.updateSeriesMetrics(m) // Sampled out messages are cached, but not delivered, see server_sampling.go
+	} else if !delayed {
+		s.faults.Delay(m)
 		if err := t.Publish(v, m); err != nil {
+			s.removeDedup(t, dedupID, m)
 			return nil, err
 		}
-		if s.firebaseClient != nil && firebase {
-			go s.sendToFirebase(v, m)
-		}
-		if s.smtpSender != nil && email != "" {
-			go s.sendEmail(v, m, email)
+		s.updateSeriesMetrics(m)
+		firebase, email = s.routeMessage(v, m, firebase, email)
+		if !s.holdForQuietHours(v, m, firebase, email) {
+			if s.firebaseClient != nil && firebase {
+				s.sendToFirebase(v, m)
+			}
+			if sender := s.mailer(); sender != nil && email != "" {
+				go s.sendEmail(sender, v, m, email)
+			}
 		}
-		if s.config.TwilioAccount != "" && call != "" {
-			go s.callPhone(v, r, m, call)
+		if conf.TwilioAccount != "" && call != "" {
+			if callChannel == callChannelSMS {
+				go s.sendSMS(v, r, m, call)
+			} else {
+				go s.callPhone(v, r, m, call)
+			}
 		}
-		if s.config.UpstreamBaseURL != "" && !unifiedpush { // UP messages are not sent to upstream
+		if conf.UpstreamBaseURL != "" && !unifiedpush { // UP messages are not sent to upstream
 			go s.forwardPollRequest(v, m)
 		}
-		if s.config.WebPushPublicKey != "" {
+		if conf.WebPushPublicKey != "" {
 			go s.publishToWebPushEndpoints(v, m)
 		}
 	} else {
@@ -825,6 +1587,7 @@ func (s *Server) handlePublishInternal(r *http.Request, v *visitor) (*message, e
 	if cache {
 		logvrm(v, r, m).Tag(tagPublish).Debug("Adding message to cache")
 		if err := s.messageCache.AddMessage(m); err != nil {
+			s.removeDedup(t, dedupID, m)
 			return nil, err
 		}
 	}
@@ -832,10 +1595,12 @@ func (s *Server) handlePublishInternal(r *http.Request, v *visitor) (*message, e
 	if s.userManager != nil && u != nil && u.Tier != nil {
 		go s.userManager.EnqueueUserStats(u.ID, v.Stats())
 	}
+	s.recordUsage(m, 1, 0)
 	s.mu.Lock()
 	s.messages++
 	s.mu.Unlock()
 	if unifiedpush {
+		t.CountUnifiedPushMessage()
 		minc(metricUnifiedPushPublishedSuccess)
 	}
 	mset(metricMessagePublishDurationMillis, time.Since(start).Milliseconds())
@@ -877,67 +1642,16 @@ func (s *Server) handlePublishMatrix(w http.ResponseWriter, r *http.Request, v *
 	return writeMatrixSuccess(w)
 }
 
-func (s *Server) sendToFirebase(v *visitor, m *message) {
-	logvm(v, m).Tag(tagFirebase).Debug("Publishing to Firebase")
-	if err := s.firebaseClient.Send(v, m); err != nil {
-		minc(metricFirebasePublishedFailure)
-		if errors.Is(err, errFirebaseTemporarilyBanned) {
-			logvm(v, m).Tag(tagFirebase).Err(err).Debug("Unable to publish to Firebase: %v", err.Error())
-		} else {
-			logvm(v, m).Tag(tagFirebase).Err(err).Warn("Unable to publish to Firebase: %v", err.Error())
-		}
-		return
-	}
-	minc(metricFirebasePublishedSuccess)
-}
-
-func (s *Server) sendEmail(v *visitor, m *message, email string) {
-	logvm(v, m).Tag(tagEmail).Field("email", email).Debug("Sending email to %s", email)
-	if err := s.smtpSender.Send(v, m, email); err != nil {
-		logvm(v, m).Tag(tagEmail).Field("email", email).Err(err).Warn("Unable to send email to %s: %v", email, err.Error())
-		minc(metricEmailsPublishedFailure)
-		return
-	}
-	minc(metricEmailsPublishedSuccess)
-}
-
-func (s *Server) forwardPollRequest(v *visitor, m *message) {
-	topicURL := fmt.Sprintf("%s/%s", s.config.BaseURL, m.Topic)
-	topicHash := fmt.Sprintf("%x", sha256.Sum256([]byte(topicURL)))
-	forwardURL := fmt.Sprintf("%s/%s", s.config.UpstreamBaseURL, topicHash)
-	logvm(v, m).Debug("Publishing poll request to %s", forwardURL)
-	req, err := http.NewRequest("POST", forwardURL, strings.NewReader(""))
-	if err != nil {
-		logvm(v, m).Err(err).Warn("Unable to publish poll request")
-		return
-	}
-	req.Header.Set("User-Agent", "ntfy/"+s.config.Version)
-	req.Header.Set("X-Poll-ID", m.ID)
-	if s.config.UpstreamAccessToken != "" {
-		req.Header.Set("Authorization", util.BearerAuth(s.config.UpstreamAccessToken))
-	}
-	var httpClient = &http.Client{
-		Timeout: time.Second * 10,
-	}
-	response, err := httpClient.Do(req)
-	if err != nil {
-		logvm(v, m).Err(err).Warn("Unable to publish poll request")
-		return
-	} else if response.StatusCode != http.StatusOK {
-		if response.StatusCode == http.StatusTooManyRequests {
-			logvm(v, m).Err(err).Warn("Unable to publish poll request, the upstream server %s responded with HTTP %s; you may solve this by sending fewer daily messages, or by configuring upstream-access-token (assuming you have an account with higher rate limits) ", s.config.UpstreamBaseURL, response.Status)
-		} else {
-			logvm(v, m).Err(err).Warn("Unable to publish poll request, the upstream server %s responded with HTTP %s", s.config.UpstreamBaseURL, response.Status)
-		}
-		return
-	}
-}
-
-func (s *Server) parsePublishParams(r *http.Request, m *message) (cache bool, firebase bool, email, call string, template bool, unifiedpush bool, err *errHTTP) {
+func (s *Server) parsePublishParams(r *http.Request, m *message) (cache bool, firebase bool, email, call, callChannel string, template bool, unifiedpush bool, err *errHTTP) {
+	conf := s.config()
 	cache = readBoolParam(r, true, "x-cache", "cache")
 	firebase = readBoolParam(r, true, "x-firebase", "firebase")
 	m.Title = readParam(r, "x-title", "title", "t")
+	m.Summary = readParam(r, "x-summary", "summary")
 	m.Click = readParam(r, "x-click", "click")
+	if m.Click != "" && !urlSchemeAllowed(m.Click, conf.ClickURLSchemes) {
+		return false, false, "", "", "", false, false, errHTTPBadRequestClickURLInvalid
+	}
 	icon := readParam(r, "x-icon", "icon")
 	filename := readParam(r, "x-filename", "filename", "file", "f")
 	attach := readParam(r, "x-attach", "attach", "a")
@@ -948,8 +1662,10 @@ func (s *Server) parsePublishParams(r *http.Request, m *message) (cache bool, fi
 		m.Attachment.Name = filename
 	}
 	if attach != "" {
-		if !urlRegex.MatchString(attach) {
-			return false, false, "", "", false, false, errHTTPBadRequestAttachmentURLInvalid
+		if !urlSchemeAllowed(attach, conf.AttachmentURLSchemes) {
+			return false, false, "", "", "", false, false, errHTTPBadRequestAttachmentURLInvalid
+		} else if !s.attachmentTopicAllowed(m.Topic) {
+			return false, false, "", "", "", false, false, errHTTPBadRequestAttachmentTopicDenied
 		}
 		m.Attachment.URL = attach
 		if m.Attachment.Name == "" {
@@ -966,20 +1682,26 @@ func (s *Server) parsePublishParams(r *http.Request, m *message) (cache bool, fi
 		}
 	}
 	if icon != "" {
-		if !urlRegex.MatchString(icon) {
-			return false, false, "", "", false, false, errHTTPBadRequestIconURLInvalid
+		if !urlSchemeAllowed(icon, conf.IconURLSchemes) {
+			return false, false, "", "", "", false, false, errHTTPBadRequestIconURLInvalid
 		}
 		m.Icon = icon
 	}
 	email = readParam(r, "x-email", "x-e-mail", "email", "e-mail", "mail", "e")
-	if s.smtpSender == nil && email != "" {
-		return false, false, "", "", false, false, errHTTPBadRequestEmailDisabled
+	if s.mailer() == nil && email != "" {
+		return false, false, "", "", "", false, false, errHTTPBadRequestEmailDisabled
 	}
 	call = readParam(r, "x-call", "call")
-	if call != "" && (s.config.TwilioAccount == "" || s.userManager == nil) {
-		return false, false, "", "", false, false, errHTTPBadRequestPhoneCallsDisabled
+	if call != "" && (conf.TwilioAccount == "" || s.userManager == nil) {
+		return false, false, "", "", "", false, false, errHTTPBadRequestPhoneCallsDisabled
 	} else if call != "" && !isBoolValue(call) && !phoneNumberRegex.MatchString(call) {
-		return false, false, "", "", false, false, errHTTPBadRequestPhoneNumberInvalid
+		return false, false, "", "", "", false, false, errHTTPBadRequestPhoneNumberInvalid
+	}
+	callChannel = strings.ToLower(readParam(r, "x-call-channel", "call-channel"))
+	if callChannel == "" {
+		callChannel = callChannelCall
+	} else if callChannel != callChannelCall && callChannel != callChannelSMS {
+		return false, false, "", "", "", false, false, errHTTPBadRequestCallChannelInvalid
 	}
 	messageStr := strings.ReplaceAll(readParam(r, "x-message", "message", "m"), "\\n", "\n")
 	if messageStr != "" {
@@ -988,35 +1710,55 @@ func (s *Server) parsePublishParams(r *http.Request, m *message) (cache bool, fi
 	var e error
 	m.Priority, e = util.ParsePriority(readParam(r, "x-priority", "priority", "prio", "p"))
 	if e != nil {
-		return false, false, "", "", false, false, errHTTPBadRequestPriorityInvalid
+		return false, false, "", "", "", false, false, errHTTPBadRequestPriorityInvalid
 	}
 	m.Tags = readCommaSeparatedParam(r, "x-tags", "tags", "tag", "ta")
 	delayStr := readParam(r, "x-delay", "delay", "x-at", "at", "x-in", "in")
 	if delayStr != "" {
 		if !cache {
-			return false, false, "", "", false, false, errHTTPBadRequestDelayNoCache
+			return false, false, "", "", "", false, false, errHTTPBadRequestDelayNoCache
 		}
 		if email != "" {
-			return false, false, "", "", false, false, errHTTPBadRequestDelayNoEmail // we cannot store the email address (yet)
+			return false, false, "", "", "", false, false, errHTTPBadRequestDelayNoEmail // we cannot store the email address (yet)
 		}
 		if call != "" {
-			return false, false, "", "", false, false, errHTTPBadRequestDelayNoCall // we cannot store the phone number (yet)
+			return false, false, "", "", "", false, false, errHTTPBadRequestDelayNoCall // we cannot store the phone number (yet)
 		}
 		delay, err := util.ParseFutureTime(delayStr, time.Now())
 		if err != nil {
-			return false, false, "", "", false, false, errHTTPBadRequestDelayCannotParse
-		} else if delay.Unix() < time.Now().Add(s.config.MessageDelayMin).Unix() {
-			return false, false, "", "", false, false, errHTTPBadRequestDelayTooSmall
-		} else if delay.Unix() > time.Now().Add(s.config.MessageDelayMax).Unix() {
-			return false, false, "", "", false, false, errHTTPBadRequestDelayTooLarge
+			return false, false, "", "", "", false, false, errHTTPBadRequestDelayCannotParse
+		} else if delay.Unix() < time.Now().Add(conf.MessageDelayMin).Unix() {
+			return false, false, "", "", "", false, false, errHTTPBadRequestDelayTooSmall
+		} else if delay.Unix() > time.Now().Add(conf.MessageDelayMax).Unix() {
+			return false, false, "", "", "", false, false, errHTTPBadRequestDelayTooLarge
 		}
 		m.Time = delay.Unix()
 	}
+	messageTTLStr, attachmentTTLStr := readParam(r, "x-message-ttl", "message-ttl"), readParam(r, "x-attachment-ttl", "attachment-ttl")
+	if messageTTLStr != "" {
+		m.MessageTTL, e = util.ParseDuration(messageTTLStr)
+		if e != nil || m.MessageTTL <= 0 {
+			return false, false, "", "", "", false, false, errHTTPBadRequestTTLInvalid
+		}
+	}
+	if attachmentTTLStr != "" {
+		m.AttachmentTTL, e = util.ParseDuration(attachmentTTLStr)
+		if e != nil || m.AttachmentTTL <= 0 {
+			return false, false, "", "", "", false, false, errHTTPBadRequestTTLInvalid
+		}
+	}
 	actionsStr := readParam(r, "x-actions", "actions", "action")
 	if actionsStr != "" {
 		m.Actions, e = parseActions(actionsStr)
 		if e != nil {
-			return false, false, "", "", false, false, errHTTPBadRequestActionsInvalid.Wrap(e.Error())
+			return false, false, "", "", "", false, false, errHTTPBadRequestActionsInvalid.Wrap(e.Error())
+		}
+	}
+	embedsStr := readParam(r, "x-embeds", "embeds")
+	if embedsStr != "" {
+		m.Embeds, e = parseEmbeds(embedsStr)
+		if e != nil {
+			return false, false, "", "", "", false, false, errHTTPBadRequestEmbedsInvalid.Wrap(e.Error())
 		}
 	}
 	contentType, markdown := readParam(r, "content-type", "content_type"), readBoolParam(r, false, "x-markdown", "markdown", "md")
@@ -1035,7 +1777,7 @@ func (s *Server) parsePublishParams(r *http.Request, m *message) (cache bool, fi
 		cache = false
 		email = ""
 	}
-	return cache, firebase, email, call, template, unifiedpush, nil
+	return cache, firebase, email, call, callChannel, template, unifiedpush, nil
 }
 
 // handlePublishBody consumes the PUT/POST body and decides whether the body is an attachment or the message.
@@ -1044,31 +1786,35 @@ func (s *Server) parsePublishParams(r *http.Request, m *message) (cache bool, fi
 //     If a message is flagged as poll request, the body does not matter and is discarded
 //  2. curl -T somebinarydata.bin "ntfy.sh/mytopic?up=1"
 //     If UnifiedPush is enabled, encode as base64 if body is binary, and do not trim
-//  3. curl -H "Attach: http://example.com/file.jpg" ntfy.sh/mytopic
+//  3. curl -H "Upload: CAZWzqKm7OHs" -d "Here's the video" ntfy.sh/mytopic
+//     Body must be a message, because the attachment was uploaded before (see handleAttachmentUploadCreate)
+//  4. curl -H "Attach: http://example.com/file.jpg" ntfy.sh/mytopic
 //     Body must be a message, because we attached an external URL
-//  4. curl -T short.txt -H "Filename: short.txt" ntfy.sh/mytopic
+//  5. curl -T short.txt -H "Filename: short.txt" ntfy.sh/mytopic
 //     Body must be attachment, because we passed a filename
-//  5. curl -H "Template: yes" -T file.txt ntfy.sh/mytopic
+//  6. curl -H "Template: yes" -T file.txt ntfy.sh/mytopic
 //     If templating is enabled, read up to 32k and treat message body as JSON
-//  6. curl -T file.txt ntfy.sh/mytopic
-//     If file.txt is <= 4096 (message limit) and valid UTF-8, treat it as a message
 //  7. curl -T file.txt ntfy.sh/mytopic
+//     If file.txt is <= 4096 (message limit) and valid UTF-8, treat it as a message
+//  8. curl -T file.txt ntfy.sh/mytopic
 //     In all other cases, mostly if file.txt is > message limit, treat it as an attachment
 func (s *Server) handlePublishBody(r *http.Request, v *visitor, m *message, body *util.PeekedReadCloser, template, unifiedpush bool) error {
 	if m.Event == pollRequestEvent { // Case 1
 		return s.handleBodyDiscard(body)
 	} else if unifiedpush {
 		return s.handleBodyAsMessageAutoDetect(m, body) // Case 2
+	} else if uploadID := readParam(r, "x-upload", "upload"); uploadID != "" {
+		return s.handleBodyAsUploadedAttachment(r, v, m, uploadID, body) // Case 3
 	} else if m.Attachment != nil && m.Attachment.URL != "" {
-		return s.handleBodyAsTextMessage(m, body) // Case 3
+		return s.handleBodyAsTextMessage(m, body) // Case 4
 	} else if m.Attachment != nil && m.Attachment.Name != "" {
-		return s.handleBodyAsAttachment(r, v, m, body) // Case 4
+		return s.handleBodyAsAttachment(r, v, m, body) // Case 5
 	} else if template {
-		return s.handleBodyAsTemplatedTextMessage(m, body) // Case 5
+		return s.handleBodyAsTemplatedTextMessage(m, body) // Case 6
 	} else if !body.LimitReached && utf8.Valid(body.PeekedBytes) {
-		return s.handleBodyAsTextMessage(m, body) // Case 6
+		return s.handleBodyAsTextMessage(m, body) // Case 7
 	}
-	return s.handleBodyAsAttachment(r, v, m, body) // Case 7
+	return s.handleBodyAsAttachment(r, v, m, body) // Case 8
 }
 
 func (s *Server) handleBodyDiscard(body *util.PeekedReadCloser) error {
@@ -1095,13 +1841,14 @@ func (s *Server) handleBodyAsTextMessage(m *message, body *util.PeekedReadCloser
 		m.Message = strings.TrimSpace(string(body.PeekedBytes)) // Truncates the message to the peek limit if required
 	}
 	if m.Attachment != nil && m.Attachment.Name != "" && m.Message == "" {
-		m.Message = fmt.Sprintf(defaultAttachmentMessage, m.Attachment.Name)
+		m.Message = locales.Text(m.Language, "attachment_default_message", m.Attachment.Name)
 	}
 	return nil
 }
 
 func (s *Server) handleBodyAsTemplatedTextMessage(m *message, body *util.PeekedReadCloser) error {
-	body, err := util.Peek(body, max(s.config.MessageSizeLimit, jsonBodyBytesLimit))
+	conf := s.config()
+	body, err := util.Peek(body, max(conf.MessageSizeLimit, jsonBodyBytesLimit))
 	if err != nil {
 		return err
 	} else if body.LimitReached {
@@ -1114,7 +1861,7 @@ func (s *Server) handleBodyAsTemplatedTextMessage(m *message, body *util.PeekedR
 	if m.Title, err = replaceTemplate(m.Title, peekedBody); err != nil {
 		return err
 	}
-	if len(m.Message) > s.config.MessageSizeLimit {
+	if len(m.Message) > conf.MessageSizeLimit {
 		return errHTTPBadRequestTemplateMessageTooLarge
 	}
 	return nil
@@ -1140,14 +1887,21 @@ func replaceTemplate(tpl string, source string) (string, error) {
 }
 
 func (s *Server) handleBodyAsAttachment(r *http.Request, v *visitor, m *message, body *util.PeekedReadCloser) error {
-	if s.fileCache == nil || s.config.BaseURL == "" || s.config.AttachmentCacheDir == "" {
+	conf := s.config()
+	if s.fileCache == nil || conf.BaseURL == "" || conf.AttachmentCacheDir == "" {
 		return errHTTPBadRequestAttachmentsDisallowed.With(m)
+	} else if s.diskSpaceLow.Load() {
+		return errHTTPInsufficientStorageDiskSpace.With(m)
+	} else if !s.attachmentTopicAllowed(m.Topic) {
+		return errHTTPBadRequestAttachmentTopicDenied.With(m)
+	} else if !s.topicPermitted(v, m.Topic, user.PermissionAttach) {
+		return errHTTPForbiddenAttachmentsNotPermitted.With(m)
 	}
 	vinfo, err := v.Info()
 	if err != nil {
 		return err
 	}
-	attachmentExpiry := time.Now().Add(vinfo.Limits.AttachmentExpiryDuration).Unix()
+	attachmentExpiry := attachmentExpires(vinfo, m)
 	if m.Time > attachmentExpiry {
 		return errHTTPBadRequestAttachmentsExpiryBeforeDelivery.With(m)
 	}
@@ -1168,12 +1922,15 @@ func (s *Server) handleBodyAsAttachment(r *http.Request, v *visitor, m *message,
 	var ext string
 	m.Attachment.Expires = attachmentExpiry
 	m.Attachment.Type, ext = util.DetectContentType(body.PeekedBytes, m.Attachment.Name)
-	m.Attachment.URL = fmt.Sprintf("%s/file/%s%s", s.config.BaseURL, m.ID, ext)
+	m.Attachment.URL = fmt.Sprintf("%s/file/%s%s", conf.BaseURL, m.ID, ext)
 	if m.Attachment.Name == "" {
 		m.Attachment.Name = fmt.Sprintf("attachment%s", ext)
 	}
+	if !s.attachmentTypeAllowed(m.Attachment.Type, ext, m.Attachment.Name) {
+		return errHTTPBadRequestAttachmentTypeDenied.With(m).Fields(log.Context{"attachment_type": m.Attachment.Type})
+	}
 	if m.Message == "" {
-		m.Message = fmt.Sprintf(defaultAttachmentMessage, m.Attachment.Name)
+		m.Message = locales.Text(m.Language, "attachment_default_message", m.Attachment.Name)
 	}
 	limiters := []util.Limiter{
 		v.BandwidthLimiter(),
@@ -1183,12 +1940,55 @@ func (s *Server) handleBodyAsAttachment(r *http.Request, v *visitor, m *message,
 	m.Attachment.Size, err = s.fileCache.Write(m.ID, body, limiters...)
 	if errors.Is(err, util.ErrLimitReached) {
 		return errHTTPEntityTooLargeAttachment.With(m)
+	} else if errors.Is(err, errFileInfected) {
+		logvrm(v, r, m).Tag(tagFileCache).Err(err).Warn("Rejecting attachment, virus scanner found malware")
+		return errHTTPBadRequestAttachmentInfected.With(m)
 	} else if err != nil {
 		return err
 	}
 	return nil
 }
 
+// attachmentTopicAllowed returns true if attachments (uploaded or external) may be published to the given
+// topic, as per attachment-allowed-topics and attachment-denied-topics
+func (s *Server) attachmentTopicAllowed(topic string) bool {
+	conf := s.config()
+	for _, pattern := range conf.AttachmentDeniedTopics {
+		if matched, _ := path.Match(pattern, topic); matched {
+			return false
+		}
+	}
+	if len(conf.AttachmentAllowedTopics) == 0 {
+		return true
+	}
+	for _, pattern := range conf.AttachmentAllowedTopics {
+		if matched, _ := path.Match(pattern, topic); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// attachmentTypeAllowed returns true if an uploaded attachment with the given (detected) MIME type, extension
+// and filename may be stored, as per attachment-denied-types and attachment-denied-extensions
+func (s *Server) attachmentTypeAllowed(contentType, ext, filename string) bool {
+	conf := s.config()
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	for _, pattern := range conf.AttachmentDeniedTypes {
+		if matched, _ := path.Match(strings.ToLower(pattern), strings.ToLower(strings.TrimSpace(mediaType))); matched {
+			return false
+		}
+	}
+	exts := []string{strings.ToLower(ext), strings.ToLower(filepath.Ext(filename))}
+	for _, denied := range conf.AttachmentDeniedExtensions {
+		denied = "." + strings.TrimPrefix(strings.ToLower(denied), ".")
+		if util.Contains(exts, denied) {
+			return false
+		}
+	}
+	return true
+}
+
 func (s *Server) handleSubscribeJSON(w http.ResponseWriter, r *http.Request, v *visitor) error {
 	encoder := func(msg *message) (string, error) {
 		var buf bytes.Buffer
@@ -1201,13 +2001,24 @@ func (s *Server) handleSubscribeJSON(w http.ResponseWriter, r *http.Request, v *
 }
 
 func (s *Server) handleSubscribeSSE(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	retry, commentHeartbeat, err := parseSSEParams(r)
+	if err != nil {
+		return err
+	}
 	encoder := func(msg *message) (string, error) {
+		if msg.Event == keepaliveEvent && commentHeartbeat {
+			return ":keepalive\n\n", nil // Comment lines are ignored by EventSource, but keep the connection alive
+		}
 		var buf bytes.Buffer
 		if err := json.NewEncoder(&buf).Encode(&msg); err != nil {
 			return "", err
 		}
+		var prefix string
+		if msg.Event == openEvent && retry > 0 {
+			prefix = fmt.Sprintf("retry: %d\n", retry.Milliseconds()) // Reconnection time suggested to EventSource clients
+		}
 		if msg.Event != messageEvent {
-			return fmt.Sprintf("event: %s\ndata: %s\n", msg.Event, buf.String()), nil // Browser's .onmessage() does not fire on this!
+			return fmt.Sprintf("%sevent: %s\ndata: %s\n", prefix, msg.Event, buf.String()), nil // Browser's .onmessage() does not fire on this!
 		}
 		return fmt.Sprintf("data: %s\n", buf.String()), nil
 	}
@@ -1225,20 +2036,30 @@ func (s *Server) handleSubscribeRaw(w http.ResponseWriter, r *http.Request, v *v
 }
 
 func (s *Server) handleSubscribeHTTP(w http.ResponseWriter, r *http.Request, v *visitor, contentType string, encoder messageEncoder) error {
+	conf := s.config()
+	stats := newConnStats()
 	logvr(v, r).Tag(tagSubscribe).Debug("HTTP stream connection opened")
-	defer logvr(v, r).Tag(tagSubscribe).Debug("HTTP stream connection closed")
-	if !v.SubscriptionAllowed() {
-		return errHTTPTooManyRequestsLimitSubscriptions
+	defer func() {
+		logvr(v, r).Tag(tagSubscribe).Fields(stats.Context()).Debug("HTTP stream connection closed")
+	}()
+	maxDuration, err := s.subscriptionAllowed(v)
+	if err != nil {
+		return err
 	}
-	defer v.RemoveSubscription()
+	defer s.removeSubscription(v)
 	topics, topicsStr, err := s.topicsFromPath(r.URL.Path)
 	if err != nil {
 		return err
 	}
-	poll, since, scheduled, filters, err := parseSubscribeParams(r)
+	poll, since, scheduled, filters, page, err := parseSubscribeParams(r)
 	if err != nil {
 		return err
 	}
+	keepalive, err := s.keepaliveInterval(r)
+	if err != nil {
+		return err
+	}
+	sendStats := readBoolParam(r, false, "x-stats", "stats")
 	var wlock sync.Mutex
 	defer func() {
 		// Hack: This is the fix for a horrible data race that I have not been able to figure out in quite some time.
@@ -1247,10 +2068,28 @@ func (s *Server) handleSubscribeHTTP(w http.ResponseWriter, r *http.Request, v *
 		// data race detector. See https://github.com/binwiederhier/ntfy/issues/338#issuecomment-1163425889.
 		wlock.TryLock()
 	}()
+	if conf.StreamCompression && strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		gw := util.NewGzipStreamWriter(w)
+		defer func() {
+			wlock.Lock()
+			defer wlock.Unlock()
+			gw.Close()
+		}()
+		w = gw
+	}
+	lan := s.lanSubscriber(v)
+	attachmentKey, err := s.attachmentSigningKey()
+	if err != nil {
+		return err
+	}
 	sub := func(v *visitor, msg *message) error {
 		if !filters.Pass(msg) {
 			return nil
 		}
+		msg = s.withSignedAttachmentURL(attachmentKey, msg)
+		if lan {
+			msg = s.withLANAttachmentURL(msg)
+		}
 		m, err := encoder(msg)
 		if err != nil {
 			return err
@@ -1263,18 +2102,34 @@ func (s *Server) handleSubscribeHTTP(w http.ResponseWriter, r *http.Request, v *
 		if fl, ok := w.(http.Flusher); ok {
 			fl.Flush()
 		}
+		stats.Sent(msg, len(m))
 		return nil
 	}
+	sendClose := func() error {
+		if !sendStats {
+			return nil
+		}
+		return sub(v, newCloseMessage(topicsStr, stats.Snapshot()))
+	}
 	if err := s.maybeSetRateVisitors(r, v, topics); err != nil {
 		return err
 	}
-	w.Header().Set("Access-Control-Allow-Origin", s.config.AccessControlAllowOrigin) // CORS, allow cross-origin requests
-	w.Header().Set("Content-Type", contentType+"; charset=utf-8")                    // Android/Volley client needs charset!
+	patterns := topicPatternsFromPath(r.URL.Path)
+	oldTopics, err := s.withWildcardTopics(v, topics, patterns, since)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Access-Control-Allow-Origin", conf.AccessControlAllowOrigin) // CORS, allow cross-origin requests
+	w.Header().Set("Content-Type", contentType+"; charset=utf-8")                // Android/Volley client needs charset!
+	w.Header().Set("X-Keepalive-Interval", strconv.Itoa(int(keepalive.Seconds())))
 	if poll {
 		for _, t := range topics {
 			t.Keepalive()
 		}
-		return s.sendOldMessages(topics, since, scheduled, v, sub)
+		if err := s.sendOldMessages(oldTopics, since, scheduled, filters, page, v, sub); err != nil {
+			return err
+		}
+		return sendClose()
 	}
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -1287,19 +2142,29 @@ func (s *Server) handleSubscribeHTTP(w http.ResponseWriter, r *http.Request, v *
 			topics[i].Unsubscribe(subscriberID) // Order!
 		}
 	}()
-	if err := sub(v, newOpenMessage(topicsStr)); err != nil { // Send out open message
+	wildcards, err := s.subscribeWildcards(v, patterns, topics, sub, cancel)
+	if err != nil {
+		return err
+	}
+	defer s.unsubscribeWildcards(wildcards)
+	if err := sub(v, s.newOpenMessage(topicsStr)); err != nil { // Send out open message
 		return err
 	}
-	if err := s.sendOldMessages(topics, since, scheduled, v, sub); err != nil {
+	if err := s.sendOldMessages(oldTopics, since, scheduled, filters, page, v, sub); err != nil {
 		return err
 	}
+	deadline, stop := subscriptionDeadline(maxDuration)
+	defer stop()
 	for {
 		select {
 		case <-ctx.Done():
-			return nil
+			return sendClose()
 		case <-r.Context().Done():
 			return nil
-		case <-time.After(s.config.KeepaliveInterval):
+		case <-deadline:
+			logvr(v, r).Tag(tagSubscribe).Err(errHTTPTooManyRequestsLimitSubscriptionDuration).Debug("Closing HTTP stream, max. subscription duration of %s reached", maxDuration)
+			return sendClose()
+		case <-time.After(keepalive):
 			ev := logvr(v, r).Tag(tagSubscribe)
 			if len(topics) == 1 {
 				ev.With(topics[0]).Trace("Sending keepalive message to %s", topics[0].ID)
@@ -1321,20 +2186,32 @@ func (s *Server) handleSubscribeWS(w http.ResponseWriter, r *http.Request, v *vi
 	if strings.ToLower(r.Header.Get("Upgrade")) != "websocket" {
 		return errHTTPBadRequestWebSocketsUpgradeHeaderMissing
 	}
-	if !v.SubscriptionAllowed() {
-		return errHTTPTooManyRequestsLimitSubscriptions
+	maxDuration, err := s.subscriptionAllowed(v)
+	if err != nil {
+		return err
 	}
-	defer v.RemoveSubscription()
+	defer s.removeSubscription(v)
+	stats := newConnStats()
 	logvr(v, r).Tag(tagWebsocket).Debug("WebSocket connection opened")
-	defer logvr(v, r).Tag(tagWebsocket).Debug("WebSocket connection closed")
+	defer func() {
+		logvr(v, r).Tag(tagWebsocket).Fields(stats.Context()).Debug("WebSocket connection closed")
+	}()
 	topics, topicsStr, err := s.topicsFromPath(r.URL.Path)
 	if err != nil {
 		return err
 	}
-	poll, since, scheduled, filters, err := parseSubscribeParams(r)
+	poll, since, scheduled, filters, page, err := parseSubscribeParams(r)
 	if err != nil {
 		return err
 	}
+	keepalive, err := s.keepaliveInterval(r)
+	if err != nil {
+		return err
+	}
+	device, since := s.instantDeviceConnected(r, v, topicsStr, since)
+	if device != nil {
+		defer s.instantDeviceDisconnected(device)
+	}
 	upgrader := &websocket.Upgrader{
 		ReadBufferSize:  wsBufferSize,
 		WriteBufferSize: wsBufferSize,
@@ -1342,7 +2219,9 @@ func (s *Server) handleSubscribeWS(w http.ResponseWriter, r *http.Request, v *vi
 			return true // We're open for business!
 		},
 	}
-	conn, err := upgrader.Upgrade(w, r, nil)
+	conn, err := upgrader.Upgrade(w, r, http.Header{
+		"X-Keepalive-Interval": []string{strconv.Itoa(int(keepalive.Seconds()))},
+	})
 	if err != nil {
 		return err
 	}
@@ -1352,11 +2231,43 @@ func (s *Server) handleSubscribeWS(w http.ResponseWriter, r *http.Request, v *vi
 	cancelCtx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	// Use errgroup to run WebSocket reader and writer in Go routines
+	// Close connection after the max. subscription duration (if any), see visitor.SubscriptionAllowed
+	deadline, stop := subscriptionDeadline(maxDuration)
+	defer stop()
+
+	// Write messages as JSON, and record connection statistics
 	var wlock sync.Mutex
+	sendStats := readBoolParam(r, false, "x-stats", "stats")
+	write := func(msg *message) error {
+		wlock.Lock()
+		defer wlock.Unlock()
+		if err := conn.SetWriteDeadline(time.Now().Add(wsWriteWait)); err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		if err := json.NewEncoder(&buf).Encode(msg); err != nil {
+			return err
+		}
+		if err := conn.WriteMessage(websocket.TextMessage, buf.Bytes()); err != nil {
+			return err
+		}
+		stats.Sent(msg, buf.Len())
+		if device != nil {
+			s.instantMessageDelivered(device, msg)
+		}
+		return nil
+	}
+	sendClose := func() error {
+		if !sendStats {
+			return nil
+		}
+		return write(newCloseMessage(topicsStr, stats.Snapshot()))
+	}
+
+	// Use errgroup to run WebSocket reader and writer in Go routines
 	g, gctx := errgroup.WithContext(cancelCtx)
 	g.Go(func() error {
-		pongWait := s.config.KeepaliveInterval + wsPongWait
+		pongWait := keepalive + wsPongWait
 		conn.SetReadLimit(wsReadLimit)
 		if err := conn.SetReadDeadline(time.Now().Add(pongWait)); err != nil {
 			return err
@@ -1393,9 +2304,23 @@ func (s *Server) handleSubscribeWS(w http.ResponseWriter, r *http.Request, v *vi
 				return nil
 			case <-cancelCtx.Done():
 				logvr(v, r).Tag(tagWebsocket).Trace("Cancel received, closing subscriber connection")
+				if err := sendClose(); err != nil {
+					return err
+				}
 				conn.Close()
 				return &websocket.CloseError{Code: websocket.CloseNormalClosure, Text: "subscription was canceled"}
-			case <-time.After(s.config.KeepaliveInterval):
+			case <-deadline:
+				logvr(v, r).Tag(tagWebsocket).Err(errHTTPTooManyRequestsLimitSubscriptionDuration).Debug("Closing WebSocket connection, max. subscription duration of %s reached", maxDuration)
+				if err := sendClose(); err != nil {
+					return err
+				}
+				closeMessage := websocket.FormatCloseMessage(websocket.CloseTryAgainLater, errHTTPTooManyRequestsLimitSubscriptionDuration.Message)
+				if err := conn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(wsWriteWait)); err != nil {
+					return err
+				}
+				conn.Close()
+				return &websocket.CloseError{Code: websocket.CloseNormalClosure, Text: "max. subscription duration reached"}
+			case <-time.After(keepalive):
 				v.Keepalive()
 				for _, t := range topics {
 					t.Keepalive()
@@ -1406,26 +2331,38 @@ func (s *Server) handleSubscribeWS(w http.ResponseWriter, r *http.Request, v *vi
 			}
 		}
 	})
+	lan := s.lanSubscriber(v)
+	attachmentKey, err := s.attachmentSigningKey()
+	if err != nil {
+		return err
+	}
 	sub := func(v *visitor, msg *message) error {
 		if !filters.Pass(msg) {
 			return nil
 		}
-		wlock.Lock()
-		defer wlock.Unlock()
-		if err := conn.SetWriteDeadline(time.Now().Add(wsWriteWait)); err != nil {
-			return err
+		msg = s.withSignedAttachmentURL(attachmentKey, msg)
+		if lan {
+			msg = s.withLANAttachmentURL(msg)
 		}
-		return conn.WriteJSON(msg)
+		return write(msg)
 	}
 	if err := s.maybeSetRateVisitors(r, v, topics); err != nil {
 		return err
 	}
-	w.Header().Set("Access-Control-Allow-Origin", s.config.AccessControlAllowOrigin) // CORS, allow cross-origin requests
+	patterns := topicPatternsFromPath(r.URL.Path)
+	oldTopics, err := s.withWildcardTopics(v, topics, patterns, since)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Access-Control-Allow-Origin", s.config().AccessControlAllowOrigin) // CORS, allow cross-origin requests
 	if poll {
 		for _, t := range topics {
 			t.Keepalive()
 		}
-		return s.sendOldMessages(topics, since, scheduled, v, sub)
+		if err := s.sendOldMessages(oldTopics, since, scheduled, filters, page, v, sub); err != nil {
+			return err
+		}
+		return sendClose()
 	}
 	subscriberIDs := make([]int, 0)
 	for _, t := range topics {
@@ -1436,10 +2373,15 @@ func (s *Server) handleSubscribeWS(w http.ResponseWriter, r *http.Request, v *vi
 			topics[i].Unsubscribe(subscriberID) // Order!
 		}
 	}()
-	if err := sub(v, newOpenMessage(topicsStr)); err != nil { // Send out open message
+	wildcards, err := s.subscribeWildcards(v, patterns, topics, sub, cancel)
+	if err != nil {
+		return err
+	}
+	defer s.unsubscribeWildcards(wildcards)
+	if err := sub(v, s.newOpenMessage(topicsStr)); err != nil { // Send out open message
 		return err
 	}
-	if err := s.sendOldMessages(topics, since, scheduled, v, sub); err != nil {
+	if err := s.sendOldMessages(oldTopics, since, scheduled, filters, page, v, sub); err != nil {
 		return err
 	}
 	err = g.Wait()
@@ -1450,7 +2392,61 @@ func (s *Server) handleSubscribeWS(w http.ResponseWriter, r *http.Request, v *vi
 	return err
 }
 
-func parseSubscribeParams(r *http.Request) (poll bool, since sinceMarker, scheduled bool, filters *queryFilter, err error) {
+// subscriptionDeadline returns a channel that fires once the max. duration of a subscription is reached,
+// or a nil channel (which never fires) if the duration is unlimited. The returned function stops the timer.
+func subscriptionDeadline(maxDuration time.Duration) (<-chan time.Time, func()) {
+	if maxDuration <= 0 {
+		return nil, func() {}
+	}
+	timer := time.NewTimer(maxDuration)
+	return timer.C, func() { timer.Stop() }
+}
+
+// keepaliveInterval returns the keepalive interval of a subscriber connection. Reverse proxies close connections
+// that are idle for longer than their idle timeout (e.g. 60s for nginx's proxy_read_timeout, 100s for Cloudflare),
+// which leads to seemingly random connection drops if the configured keepalive interval is too long. Clients can
+// pass the timeout of their proxy (proxy-timeout=60s), in which case keepalives are sent after 2/3 of the timeout,
+// unless the configured interval is shorter. Cloudflare is detected automatically (CF-Ray header). The interval is
+// returned to the client in the X-Keepalive-Interval header (in seconds).
+func (s *Server) keepaliveInterval(r *http.Request) (time.Duration, error) {
+	conf := s.config()
+	var timeout time.Duration
+	if timeoutStr := readParam(r, "x-proxy-timeout", "proxy-timeout", "proxy_timeout"); timeoutStr != "" {
+		t, err := util.ParseDuration(timeoutStr)
+		if err != nil || t < keepaliveProxyTimeoutMin {
+			return 0, errHTTPBadRequestProxyTimeoutInvalid
+		}
+		timeout = t
+	} else if r.Header.Get("CF-Ray") != "" {
+		timeout = keepaliveProxyTimeoutCloudflare
+	}
+	if timeout == 0 {
+		return conf.KeepaliveInterval, nil
+	}
+	return min(conf.KeepaliveInterval, timeout*2/3), nil
+}
+
+// parseSSEParams parses the SSE-specific subscribe parameters: the "retry" hint sent to EventSource clients, and
+// whether keepalive events should be sent as comment lines (":keepalive") instead of full "keepalive" events
+func parseSSEParams(r *http.Request) (retry time.Duration, commentHeartbeat bool, err error) {
+	if retryStr := readParam(r, "x-sse-retry", "sse-retry"); retryStr != "" {
+		retry, err = util.ParseDuration(retryStr)
+		if err != nil || retry < 0 {
+			return 0, false, errHTTPBadRequestSSEParamsInvalid
+		}
+	}
+	switch heartbeat := strings.ToLower(readParam(r, "x-sse-heartbeat", "sse-heartbeat")); heartbeat {
+	case "", "event":
+		commentHeartbeat = false
+	case "comment":
+		commentHeartbeat = true
+	default:
+		return 0, false, errHTTPBadRequestSSEParamsInvalid
+	}
+	return retry, commentHeartbeat, nil
+}
+
+func parseSubscribeParams(r *http.Request) (poll bool, since sinceMarker, scheduled bool, filters *queryFilter, page *messagePage, err error) {
 	poll = readBoolParam(r, false, "x-poll", "poll", "po")
 	scheduled = readBoolParam(r, false, "x-scheduled", "scheduled", "sched")
 	since, err = parseSince(r, poll)
@@ -1461,6 +2457,10 @@ func parseSubscribeParams(r *http.Request) (poll bool, since sinceMarker, schedu
 	if err != nil {
 		return
 	}
+	page, err = parseMessagePage(r)
+	if err != nil {
+		return
+	}
 	return
 }
 
@@ -1475,14 +2475,14 @@ func parseSubscribeParams(r *http.Request) (poll bool, since sinceMarker, schedu
 // This only applies to UnifiedPush topics ("up...").
 func (s *Server) maybeSetRateVisitors(r *http.Request, v *visitor, topics []*topic) error {
 	// Bail out if not enabled
-	if !s.config.VisitorSubscriberRateLimiting {
+	if !s.config().VisitorSubscriberRateLimiting {
 		return nil
 	}
 
 	// Make a list of topics that we'll actually set the RateVisitor on
 	eligibleRateTopics := make([]*topic, 0)
 	for _, t := range topics {
-		if strings.HasPrefix(t.ID, unifiedPushTopicPrefix) && len(t.ID) == unifiedPushTopicLength {
+		if isUnifiedPushTopic(t.ID) {
 			eligibleRateTopics = append(eligibleRateTopics, t)
 		}
 	}
@@ -1530,25 +2530,73 @@ func (s *Server) setRateVisitors(r *http.Request, v *visitor, rateTopics []*topi
 }
 
 // sendOldMessages selects old messages from the messageCache and calls sub for each of them. It uses since as the
-// marker, returning only messages that are newer than the marker.
-func (s *Server) sendOldMessages(topics []*topic, since sinceMarker, scheduled bool, v *visitor, sub subscriber) error {
+// marker, returning only messages that are newer than the marker. The page limits the messages to the ones
+// published before the "until" time, and to the first n messages that pass the filters (oldest first).
+func (s *Server) sendOldMessages(topics []*topic, since sinceMarker, scheduled bool, filters *queryFilter, page *messagePage, v *visitor, sub subscriber) error {
 	if since.IsNone() {
 		return nil
 	}
-	messages := make([]*message, 0)
-	for _, t := range topics {
-		topicMessages, err := s.messageCache.Messages(t.ID, since, scheduled)
-		if err != nil {
-			return err
+	cursor, err := s.messageCache.MessageCursor(since)
+	if err != nil {
+		return err
+	}
+	batchSize := -1 // No limit
+	if page.Limit > 0 {
+		batchSize = page.Limit
+	}
+	var sent int
+	for {
+		// Read the next batch of each topic, and merge them. Since each topic returns its first messages after the
+		// cursor, the first batchSize messages of the merged list are the next ones across all topics.
+		messages := make([]*message, 0)
+		more := false
+		for _, t := range topics {
+			topicMessages, err := s.messageCache.MessagesPage(t.ID, cursor, page.Until, batchSize, scheduled)
+			if err != nil {
+				return err
+			}
+			messages = append(messages, topicMessages...)
+			more = more || (batchSize > 0 && len(topicMessages) == batchSize)
+		}
+		sort.SliceStable(messages, func(i, j int) bool {
+			if messages[i].Time != messages[j].Time {
+				return messages[i].Time < messages[j].Time
+			}
+			return messages[i].RowID < messages[j].RowID // Same order as the since=<id> cursor, see messageCache.MessagesPage
+		})
+		if batchSize > 0 && len(messages) > batchSize {
+			messages = messages[:batchSize]
+			more = true
+		}
+		for _, m := range messages {
+			cursor = &messageCursor{Time: m.Time, RowID: m.RowID}
+			if !filters.Pass(m) {
+				continue
+			}
+			if err := sub(v, m); err != nil {
+				return err
+			}
+			sent++
+			if page.Limit > 0 && sent >= page.Limit {
+				more = false
+				break
+			}
+		}
+		if !more || len(messages) == 0 {
+			break
 		}
-		messages = append(messages, topicMessages...)
 	}
-	sort.Slice(messages, func(i, j int) bool {
-		return messages[i].Time < messages[j].Time
-	})
-	for _, m := range messages {
-		if err := sub(v, m); err != nil {
+	if since.IsAll() {
+		return nil // Clients that receive all messages do not need to be told which ones expired
+	}
+	for _, t := range topics {
+		ids, err := s.messageCache.ExpirationsSince(t.ID, since)
+		if err != nil {
 			return err
+		} else if len(ids) > 0 {
+			if err := sub(v, newExpiredMessage(t.ID, ids)); err != nil {
+				return err
+			}
 		}
 	}
 	return nil
@@ -1584,29 +2632,63 @@ func parseSince(r *http.Request, poll bool) (sinceMarker, error) {
 	return sinceNoMessages, errHTTPBadRequestSinceInvalid
 }
 
+// parseMessagePage returns the "until" and "limit" parameters, which limit the cached messages that are sent
+// to a subscriber. Together with since=<message ID>, they allow clients to fetch the history incrementally:
+// Pass the ID of the last received message as "since" to get the next page.
+//
+// Values in the "until=..." parameter can be either a unix timestamp or a duration (e.g. 12h), just like "since".
+func parseMessagePage(r *http.Request) (*messagePage, error) {
+	page := &messagePage{}
+	if until := readParam(r, "x-until", "until", "u"); until != "" {
+		if t, err := strconv.ParseInt(until, 10, 64); err == nil && t > 0 {
+			page.Until = t
+		} else if d, err := time.ParseDuration(until); err == nil {
+			page.Until = time.Now().Add(-1 * d).Unix()
+		} else {
+			return nil, errHTTPBadRequestUntilInvalid
+		}
+	}
+	if limit := readParam(r, "x-limit", "limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			return nil, errHTTPBadRequestLimitInvalid
+		}
+		page.Limit = n
+	}
+	return page, nil
+}
+
 func (s *Server) handleOptions(w http.ResponseWriter, _ *http.Request, _ *visitor) error {
 	w.Header().Set("Access-Control-Allow-Methods", "GET, PUT, POST, PATCH, DELETE")
-	w.Header().Set("Access-Control-Allow-Origin", s.config.AccessControlAllowOrigin) // CORS, allow cross-origin requests
-	w.Header().Set("Access-Control-Allow-Headers", "*")                              // CORS, allow auth via JS // FIXME is this terrible?
+	w.Header().Set("Access-Control-Allow-Origin", s.config().AccessControlAllowOrigin) // CORS, allow cross-origin requests
+	w.Header().Set("Access-Control-Allow-Headers", "*")                                // CORS, allow auth via JS // FIXME is this terrible?
 	return nil
 }
 
-// topicFromPath returns the topic from a root path (e.g. /mytopic), creating it if it doesn't exist.
+// topicFromPath returns the topic from a root path (e.g. /mytopic), creating it if it doesn't exist. Topic aliases
+// are resolved, see topicAliases.
 func (s *Server) topicFromPath(path string) (*topic, error) {
 	parts := strings.Split(path, "/")
 	if len(parts) < 2 {
 		return nil, errHTTPBadRequestTopicInvalid
 	}
-	return s.topicFromID(parts[1])
+	return s.topicFromID(s.topicAliases.Resolve(parts[1])[0])
 }
 
 // topicsFromPath returns the topic from a root path (e.g. /mytopic,mytopic2), creating it if it doesn't exist.
+// Topic aliases are resolved, see topicAliases. Topic patterns (e.g. host-*) are skipped, see topicPatternsFromPath.
 func (s *Server) topicsFromPath(path string) ([]*topic, string, error) {
 	parts := strings.Split(path, "/")
 	if len(parts) < 2 {
 		return nil, "", errHTTPBadRequestTopicInvalid
 	}
-	topicIDs := util.SplitNoEmpty(parts[1], ",")
+	ids := make([]string, 0)
+	for _, id := range util.SplitNoEmpty(parts[1], ",") {
+		if !isTopicPattern(id) {
+			ids = append(ids, id)
+		}
+	}
+	topicIDs := s.topicAliases.Resolve(ids...)
 	topics, err := s.topicsFromIDs(topicIDs...)
 	if err != nil {
 		return nil, "", errHTTPBadRequestTopicInvalid
@@ -1615,21 +2697,30 @@ func (s *Server) topicsFromPath(path string) ([]*topic, string, error) {
 }
 
 // topicsFromIDs returns the topics with the given IDs, creating them if they don't exist.
+//
+// The total topic limit is checked without a global lock, so under heavy concurrency, the number of topics
+// may exceed the limit by a few topics.
 func (s *Server) topicsFromIDs(ids ...string) ([]*topic, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	conf := s.config()
 	topics := make([]*topic, 0)
 	for _, id := range ids {
-		if util.Contains(s.config.DisallowedTopics, id) {
+		if util.Contains(conf.DisallowedTopics, id) {
 			return nil, errHTTPBadRequestTopicDisallowed
 		}
-		if _, ok := s.topics[id]; !ok {
-			if len(s.topics) >= s.config.TotalTopicLimit {
+		var created bool
+		t, err := s.topics.GetOrCreate(id, func() (*topic, error) {
+			if s.topics.Len() >= conf.TotalTopicLimit {
 				return nil, errHTTPTooManyRequestsLimitTotalTopics
 			}
-			s.topics[id] = newTopic(id)
+			created = true
+			return newTopic(id), nil
+		})
+		if err != nil {
+			return nil, err
+		} else if created {
+			s.wildcards.TopicCreated(t)
 		}
-		topics = append(topics, s.topics[id])
+		topics = append(topics, t)
 	}
 	return topics, nil
 }
@@ -1645,14 +2736,12 @@ func (s *Server) topicFromID(id string) (*topic, error) {
 
 // topicsFromPattern returns a list of topics matching the given pattern, but it does not create them.
 func (s *Server) topicsFromPattern(pattern string) ([]*topic, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	patternRegexp, err := regexp.Compile("^" + strings.ReplaceAll(pattern, "*", ".*") + "$")
+	patternRegexp, err := topicPatternRegexp(pattern)
 	if err != nil {
 		return nil, err
 	}
 	topics := make([]*topic, 0)
-	for _, t := range s.topics {
+	for _, t := range s.topics.Values() {
 		if patternRegexp.MatchString(t.ID) {
 			topics = append(topics, t)
 		}
@@ -1661,10 +2750,11 @@ func (s *Server) topicsFromPattern(pattern string) ([]*topic, error) {
 }
 
 func (s *Server) runSMTPServer() error {
-	s.smtpServerBackend = newMailBackend(s.config, s.handle)
+	conf := s.config()
+	s.smtpServerBackend = newMailBackend(conf, s.userManager, s.smtpRules, s.handle)
 	s.smtpServer = smtp.NewServer(s.smtpServerBackend)
-	s.smtpServer.Addr = s.config.SMTPServerListen
-	s.smtpServer.Domain = s.config.SMTPServerDomain
+	s.smtpServer.Addr = conf.SMTPServerListen
+	s.smtpServer.Domain = conf.SMTPServerDomain
 	s.smtpServer.ReadTimeout = 10 * time.Second
 	s.smtpServer.WriteTimeout = 10 * time.Second
 	s.smtpServer.MaxMessageBytes = 1024 * 1024 // Must be much larger than message size (headers, multipart, etc.)
@@ -1674,13 +2764,25 @@ func (s *Server) runSMTPServer() error {
 }
 
 func (s *Server) runManager() {
+	var watchdog <-chan time.Time // Nil channel (blocks forever), unless the systemd watchdog is enabled
+	if interval := sdWatchdogInterval(); interval > 0 {
+		log.Tag(tagManager).Info("Systemd watchdog enabled, pinging every %s", interval.String())
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		watchdog = ticker.C
+	}
+	timer := time.NewTimer(s.config().ManagerInterval)
+	defer timer.Stop()
 	for {
 		select {
-		case <-time.After(s.config.ManagerInterval):
+		case <-timer.C:
 			log.
 				Tag(tagManager).
 				Timing(s.execManager).
 				Debug("Manager finished")
+			timer.Reset(s.config().ManagerInterval)
+		case <-watchdog:
+			s.pingWatchdog()
 		case <-s.closeChan:
 			return
 		}
@@ -1691,7 +2793,7 @@ func (s *Server) runManager() {
 // email counters. The stats are used to display the counters in the web app, as well as for rate limiting.
 func (s *Server) runStatsResetter() {
 	for {
-		runAt := util.NextOccurrenceUTC(s.config.VisitorStatsResetTime, time.Now())
+		runAt := util.NextOccurrenceUTC(s.config().VisitorStatsResetTime, time.Now())
 		timer := time.NewTimer(time.Until(runAt))
 		log.Tag(tagResetter).Debug("Waiting until %v to reset visitor stats", runAt)
 		select {
@@ -1710,9 +2812,10 @@ func (s *Server) resetStats() {
 	log.Info("Resetting all visitor stats (daily task)")
 	s.mu.Lock()
 	defer s.mu.Unlock() // Includes the database query to avoid races with other processes
-	for _, v := range s.visitors {
+	for _, v := range s.visitors.Values() {
 		v.ResetStats()
 	}
+	s.orgLimits.Reset()
 	if s.userManager != nil {
 		if err := s.userManager.ResetStats(); err != nil {
 			log.Tag(tagResetter).Warn("Failed to write to database: %s", err.Error())
@@ -1724,17 +2827,17 @@ func (s *Server) runFirebaseKeepaliver() {
 	if s.firebaseClient == nil {
 		return
 	}
-	v := newVisitor(s.config, s.messageCache, s.userManager, netip.IPv4Unspecified(), nil) // Background process, not a real visitor, uses IP 0.0.0.0
+	v := newVisitor(s.config(), s.messageCache, s.userManager, netip.IPv4Unspecified(), nil) // Background process, not a real visitor, uses IP 0.0.0.0
 	for {
 		select {
-		case <-time.After(s.config.FirebaseKeepaliveInterval):
+		case <-time.After(s.config().FirebaseKeepaliveInterval):
 			s.sendToFirebase(v, newKeepaliveMessage(firebaseControlTopic))
 		/*
 			FIXME: Disable iOS polling entirely for now due to thundering herd problem (see #677)
 			       To solve this, we'd have to shard the iOS poll topics to spread out the polling evenly.
 			       Given that it's not really necessary to poll, turning it off for now should not have any impact.
 
-			case <-time.After(s.config.FirebasePollInterval):
+			case <-time.After(s.config().FirebasePollInterval):
 				s.sendToFirebase(v, newKeepaliveMessage(firebasePollTopic))
 		*/
 		case <-s.closeChan:
@@ -1746,7 +2849,7 @@ func (s *Server) runFirebaseKeepaliver() {
 func (s *Server) runDelayedSender() {
 	for {
 		select {
-		case <-time.After(s.config.DelayedSenderInterval):
+		case <-time.After(s.config().DelayedSenderInterval):
 			if err := s.sendDelayedMessages(); err != nil {
 				log.Tag(tagPublish).Err(err).Warn("Error sending delayed messages")
 			}
@@ -1779,10 +2882,12 @@ func (s *Server) sendDelayedMessages() error {
 }
 
 func (s *Server) sendDelayedMessage(v *visitor, m *message) error {
+	conf := s.config()
 	logvm(v, m).Debug("Sending delayed message")
-	s.mu.RLock()
-	t, ok := s.topics[m.Topic] // If no subscribers, just mark message as published
-	s.mu.RUnlock()
+	if s.sampleOut(v, m) {
+		return s.messageCache.MarkPublished(m)
+	}
+	t, ok := s.topics.Get(m.Topic) // If no subscribers, just mark message as published
 	if ok {
 		go func() {
 			// We do not rate-limit messages here, since we've rate limited them in the PUT/POST handler
@@ -1791,13 +2896,13 @@ func (s *Server) sendDelayedMessage(v *visitor, m *message) error {
 			}
 		}()
 	}
-	if s.firebaseClient != nil { // Firebase subscribers may not show up in topics map
-		go s.sendToFirebase(v, m)
+	if firebase, _ := s.routeMessage(v, m, s.firebaseClient != nil, ""); firebase && !s.holdForQuietHours(v, m, true, "") { // Firebase subscribers may not show up in topics map
+		s.sendToFirebase(v, m)
 	}
-	if s.config.UpstreamBaseURL != "" {
+	if conf.UpstreamBaseURL != "" {
 		go s.forwardPollRequest(v, m)
 	}
-	if s.config.WebPushPublicKey != "" {
+	if conf.WebPushPublicKey != "" {
 		go s.publishToWebPushEndpoints(v, m)
 	}
 	if err := s.messageCache.MarkPublished(m); err != nil {
@@ -1806,11 +2911,67 @@ func (s *Server) sendDelayedMessage(v *visitor, m *message) error {
 	return nil
 }
 
+// messageExpires returns the time (Unix timestamp) after which the message is pruned from the cache. This is the
+// visitor's message expiry duration (cache-duration, or the tier's limit), multiplied by the priority multiplier
+// of the message (cache-priority-multipliers), if any. This keeps e.g. urgent messages around longer than chatty
+// low-priority messages.
+func (s *Server) messageExpires(v *visitor, m *message) int64 {
+	duration := v.Limits().MessageExpiryDuration
+	priority := m.Priority
+	if priority == 0 {
+		priority = 3 // Default priority
+	}
+	if multiplier, ok := s.config().CachePriorityMultipliers[priority]; ok {
+		duration = time.Duration(float64(duration) * multiplier)
+	}
+	if m.MessageTTL > 0 && m.MessageTTL < duration {
+		duration = m.MessageTTL // Publishers may only shorten the retention (X-Message-TTL)
+	}
+	return time.Unix(m.Time, 0).Add(duration).Unix()
+}
+
+// attachmentExpires returns the time at which the attachment of the given message expires. Publishers may request
+// a shorter retention than the visitor's limit (X-Attachment-TTL), but not a longer one.
+func attachmentExpires(vinfo *visitorInfo, m *message) int64 {
+	duration := vinfo.Limits.AttachmentExpiryDuration
+	if m.AttachmentTTL > 0 && m.AttachmentTTL < duration {
+		duration = m.AttachmentTTL
+	}
+	return time.Now().Add(duration).Unix()
+}
+
+// publishMessage publishes a message that was created by the server itself (e.g. by the uptime monitor) rather than
+// received via the API. The message is treated like any other message, i.e. it is delivered to subscribers, forwarded
+// to Firebase, Web Push and the upstream server, and cached. Rate limits are not applied.
+func (s *Server) publishMessage(v *visitor, m *message) error {
+	conf := s.config()
+	t, err := s.topicFromID(m.Topic)
+	if err != nil {
+		return err
+	}
+	m.Sender = v.IP()
+	m.User = v.MaybeUserID()
+	m.Expires = s.messageExpires(v, m)
+	if err := t.Publish(v, m); err != nil {
+		return err
+	}
+	if firebase, _ := s.routeMessage(v, m, s.firebaseClient != nil, ""); firebase && !s.holdForQuietHours(v, m, true, "") {
+		s.sendToFirebase(v, m)
+	}
+	if conf.UpstreamBaseURL != "" {
+		go s.forwardPollRequest(v, m)
+	}
+	if conf.WebPushPublicKey != "" {
+		go s.publishToWebPushEndpoints(v, m)
+	}
+	return s.messageCache.AddMessage(m)
+}
+
 // transformBodyJSON peeks the request body, reads the JSON, and converts it to headers
 // before passing it on to the next handler. This is meant to be used in combination with handlePublish.
 func (s *Server) transformBodyJSON(next handleFunc) handleFunc {
 	return func(w http.ResponseWriter, r *http.Request, v *visitor) error {
-		m, err := readJSONWithLimit[publishMessage](r.Body, s.config.MessageSizeLimit*2, false) // 2x to account for JSON format overhead
+		m, err := readJSONWithLimit[publishMessage](r.Body, s.config().MessageSizeLimit*2, false) // 2x to account for JSON format overhead
 		if err != nil {
 			return err
 		}
@@ -1853,6 +3014,13 @@ func (s *Server) transformBodyJSON(next handleFunc) handleFunc {
 			}
 			r.Header.Set("X-Actions", string(actionsStr))
 		}
+		if len(m.Embeds) > 0 {
+			embedsStr, err := json.Marshal(m.Embeds)
+			if err != nil {
+				return errHTTPBadRequestMessageJSONInvalid
+			}
+			r.Header.Set("X-Embeds", string(embedsStr))
+		}
 		if m.Email != "" {
 			r.Header.Set("X-Email", m.Email)
 		}
@@ -1862,13 +3030,29 @@ func (s *Server) transformBodyJSON(next handleFunc) handleFunc {
 		if m.Call != "" {
 			r.Header.Set("X-Call", m.Call)
 		}
+		if m.CallChannel != "" {
+			r.Header.Set("X-Call-Channel", m.CallChannel)
+		}
+		if m.MessageTTL != "" {
+			r.Header.Set("X-Message-TTL", m.MessageTTL)
+		}
+		if m.AttachmentTTL != "" {
+			r.Header.Set("X-Attachment-TTL", m.AttachmentTTL)
+		}
+		if m.Summary != "" {
+			r.Header.Set("X-Summary", m.Summary)
+		}
+		if m.Alt != "" {
+			r.Header.Set("X-Alt", m.Alt)
+		}
 		return next(w, r, v)
 	}
 }
 
 func (s *Server) transformMatrixJSON(next handleFunc) handleFunc {
 	return func(w http.ResponseWriter, r *http.Request, v *visitor) error {
-		newRequest, err := newRequestFromMatrixJSON(r, s.config.BaseURL, s.config.MessageSizeLimit)
+		conf := s.config()
+		newRequest, err := newRequestFromMatrixJSON(r, conf.BaseURL, conf.MessageSizeLimit, conf.MatrixPushMetadataOnly, s.language(v, r))
 		if err != nil {
 			logvr(v, r).Tag(tagMatrix).Err(err).Debug("Invalid Matrix request")
 			if e, ok := err.(*errMatrixPushkeyRejected); ok {
@@ -1884,17 +3068,32 @@ func (s *Server) transformMatrixJSON(next handleFunc) handleFunc {
 	}
 }
 
+// authorizeTopicWrite checks for the weakest permission that allows publishing, i.e. user.PermissionWriteNoCache.
+// Whether the message may be cached is checked in handlePublishInternal.
 func (s *Server) authorizeTopicWrite(next handleFunc) handleFunc {
-	return s.autorizeTopic(next, user.PermissionWrite)
+	return s.autorizeTopic(next, user.PermissionWriteNoCache)
 }
 
 func (s *Server) authorizeTopicRead(next handleFunc) handleFunc {
 	return s.autorizeTopic(next, user.PermissionRead)
 }
 
+// authorizeTopicManage requires access control to be enabled, since otherwise anyone could manage any topic
+func (s *Server) authorizeTopicManage(next handleFunc) handleFunc {
+	return s.ensureUserManager(s.autorizeTopic(next, user.PermissionManage))
+}
+
 func (s *Server) autorizeTopic(next handleFunc, perm user.Permission) handleFunc {
 	return func(w http.ResponseWriter, r *http.Request, v *visitor) error {
-		if s.userManager == nil {
+		if err := s.checkBanned(v); err != nil {
+			return err
+		} else if err := s.checkNetworkRules(v, perm); err != nil {
+			return err
+		}
+		patterns := topicPatternsFromPath(r.URL.Path)
+		if s.userManager == nil && len(patterns) > 0 {
+			return errHTTPForbiddenTopicPattern.Wrap("access control is not enabled")
+		} else if s.userManager == nil {
 			return next(w, r, v)
 		}
 		topics, _, err := s.topicsFromPath(r.URL.Path)
@@ -1902,12 +3101,31 @@ func (s *Server) autorizeTopic(next handleFunc, perm user.Permission) handleFunc
 			return err
 		}
 		u := v.User()
+		if u.IsSuspended() {
+			return errHTTPForbiddenAccountSuspended.Wrap("%s", suspensionDetails(u.Suspension)).With(v)
+		} else if perm == user.PermissionWriteNoCache && isSignedPublish(r) {
+			r, err := s.authorizeSignedPublish(r, v, topics)
+			if err != nil {
+				return err
+			}
+			return next(w, r, v)
+		} else if emailAlias, _ := fromContext[bool](r, contextEmailAlias); emailAlias && perm == user.PermissionWriteNoCache {
+			return next(w, r, v) // Emails to a secret alias are authorized by the SMTP server, see smtpSession.Rcpt
+		} else if signed, _ := fromContext[bool](r, contextSignedPublish); signed && perm == user.PermissionWriteNoCache {
+			return next(w, r, v) // Webhook signature was verified against the topic's publish secret, see transformIntegration
+		}
 		for _, t := range topics {
 			if err := s.userManager.Authorize(u, t.ID, perm); err != nil {
 				logvr(v, r).With(t).Err(err).Debug("Access to topic %s not authorized", t.ID)
 				return errHTTPForbidden.With(t)
 			}
 		}
+		for _, pattern := range patterns {
+			if err := s.userManager.AuthorizeTopicPattern(u, pattern, perm); err != nil {
+				logvr(v, r).Err(err).Debug("Access to topic pattern %s not authorized", pattern)
+				return errHTTPForbiddenTopicPattern
+			}
+		}
 		return next(w, r, v)
 	}
 }
@@ -1925,11 +3143,19 @@ func (s *Server) autorizeTopic(next handleFunc, perm user.Permission) handleFunc
 // that subsequent logging calls still have a visitor context.
 func (s *Server) maybeAuthenticate(r *http.Request) (*visitor, error) {
 	// Read "Authorization" header value, and exit out early if it's not set
-	ip := extractIPAddress(r, s.config.BehindProxy)
+	ip := extractIPAddress(r, s.config().BehindProxy)
 	vip := s.visitor(ip, nil)
 	if s.userManager == nil {
 		return vip, nil
 	}
+	if username := s.readTrustedProxyUsername(r); username != "" {
+		u, err := s.authenticateProxyUser(username)
+		if err != nil {
+			logr(r).Err(err).Debug("Authentication via auth header failed")
+			return vip, errHTTPUnauthorized
+		}
+		return s.visitor(ip, u), nil
+	}
 	header, err := readAuthHeader(r)
 	if err != nil {
 		return vip, err
@@ -1939,14 +3165,22 @@ func (s *Server) maybeAuthenticate(r *http.Request) (*visitor, error) {
 	// If we're trying to auth, check the rate limiter first
 	if !vip.AuthAllowed() {
 		return vip, errHTTPTooManyRequestsLimitAuthFailure // Always return visitor, even when error occurs!
+	} else if err := s.checkAuthLockout(r, vip, header); err != nil {
+		return vip, err
 	}
 	u, err := s.authenticate(r, header)
-	if err != nil {
+	if errors.Is(err, errHTTPUnauthorizedTOTPRequired) {
+		return vip, err // Password was correct, client must ask for the two-factor code
+	} else if errors.Is(err, errHTTPUnauthorizedEmailNotVerified) {
+		return vip, err // Password was correct, but the email address was not verified yet
+	} else if err != nil {
 		vip.AuthFailed()
 		logr(r).Err(err).Debug("Authentication failed")
+		s.authFailed(r, vip, header)
 		return vip, errHTTPUnauthorized // Always return visitor, even when error occurs!
 	}
 	// Authentication with user was successful
+	s.authLockouts.Succeeded(authLockoutUsername(header), ip)
 	return s.visitor(ip, u), nil
 }
 
@@ -1992,7 +3226,15 @@ func (s *Server) authenticateBasicAuth(r *http.Request, value string) (user *use
 	} else if username == "" {
 		return s.authenticateBearerAuth(r, password) // Treat password as token
 	}
-	return s.userManager.Authenticate(username, password)
+	u, err := s.userManager.Authenticate(username, password)
+	if err != nil {
+		return nil, err
+	} else if err := s.checkEmailVerified(u); err != nil {
+		return nil, err
+	} else if err := s.authenticateTOTP(r, u); err != nil {
+		return nil, err
+	}
+	return u, nil
 }
 
 func (s *Server) authenticateBearerAuth(r *http.Request, token string) (*user.User, error) {
@@ -2000,7 +3242,7 @@ func (s *Server) authenticateBearerAuth(r *http.Request, token string) (*user.Us
 	if err != nil {
 		return nil, err
 	}
-	ip := extractIPAddress(r, s.config.BehindProxy)
+	ip := extractIPAddress(r, s.config().BehindProxy)
 	go s.userManager.EnqueueTokenUpdate(token, &user.TokenUpdate{
 		LastAccess: time.Now(),
 		LastOrigin: ip,
@@ -2008,17 +3250,55 @@ func (s *Server) authenticateBearerAuth(r *http.Request, token string) (*user.Us
 	return u, nil
 }
 
+// readTrustedProxyUsername returns the username passed in the configured auth header (e.g. X-Remote-User),
+// but only if the request comes directly from one of the trusted proxies. The header is ignored otherwise.
+func (s *Server) readTrustedProxyUsername(r *http.Request) string {
+	conf := s.config()
+	if conf.AuthHeader == "" {
+		return ""
+	}
+	username := strings.TrimSpace(r.Header.Get(conf.AuthHeader))
+	if username == "" {
+		return ""
+	}
+	peerIP := extractIPAddress(r, false) // Proxy's own address, not the forwarded one
+	if !util.ContainsIP(conf.AuthTrustedProxies, peerIP) {
+		logr(r).Debug("Ignoring %s header from untrusted address %s", conf.AuthHeader, peerIP.String()) // Not a warning, since any client can send the header
+		return ""
+	}
+	return username
+}
+
+// authenticateProxyUser looks up the user passed by a trusted proxy, and creates it with a
+// random password if it does not exist yet. Provisioned users can log in via the proxy only.
+func (s *Server) authenticateProxyUser(username string) (*user.User, error) {
+	if !user.AllowedUsername(username) {
+		return nil, user.ErrInvalidArgument
+	}
+	u, err := s.userManager.User(username)
+	if errors.Is(err, user.ErrUserNotFound) {
+		log.Tag(tagAccount).Field("user_name", username).Info("Provisioning user from auth header")
+		if err := s.userManager.AddUser(username, util.RandomString(32), user.RoleUser); err != nil && !errors.Is(err, user.ErrUserExists) {
+			return nil, err
+		}
+		return s.userManager.User(username)
+	} else if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
 func (s *Server) visitor(ip netip.Addr, user *user.User) *visitor {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	id := visitorID(ip, user)
-	v, exists := s.visitors[id]
-	if !exists {
-		s.visitors[id] = newVisitor(s.config, s.messageCache, s.userManager, ip, user)
-		return s.visitors[id]
-	}
-	v.Keepalive()
-	v.SetUser(user) // Always update with the latest user, may be nil!
+	var created bool
+	v, _ := s.visitors.GetOrCreate(visitorID(ip, user), func() (*visitor, error) {
+		created = true
+		return newVisitor(s.config(), s.messageCache, s.userManager, ip, user), nil
+	})
+	if !created {
+		v.Keepalive()
+		v.SetUser(user) // Always update with the latest user, may be nil!
+	}
+	v.SetOrgLimiters(s.orgLimits.Get(user))
 	return v
 }
 
@@ -2028,7 +3308,7 @@ func (s *Server) writeJSON(w http.ResponseWriter, v any) error {
 
 func (s *Server) writeJSONWithContentType(w http.ResponseWriter, v any, contentType string) error {
 	w.Header().Set("Content-Type", contentType)
-	w.Header().Set("Access-Control-Allow-Origin", s.config.AccessControlAllowOrigin) // CORS, allow cross-origin requests
+	w.Header().Set("Access-Control-Allow-Origin", s.config().AccessControlAllowOrigin) // CORS, allow cross-origin requests
 	if err := json.NewEncoder(w).Encode(v); err != nil {
 		return err
 	}
@@ -8,19 +8,24 @@ import (
 	"heckel.io/ntfy/v2/util"
 	"net/http"
 	"net/netip"
+	"regexp"
 	"strings"
 	"time"
 )
 
 const (
-	syncTopicAccountSyncEvent = "sync"
-	tokenExpiryDuration       = 72 * time.Hour // Extend tokens by this much
+	syncTopicAccountSyncEvent   = "sync"
+	tokenExpiryDuration         = 72 * time.Hour     // Extend tokens by this much
+	tokenRotationGracePeriodMax = 7 * 24 * time.Hour // Max time the old token stays valid after rotating it
 )
 
 func (s *Server) handleAccountCreate(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	conf := s.config()
 	u := v.User()
-	if !u.IsAdmin() { // u may be nil, but that's fine
-		if !s.config.EnableSignup {
+	if u != nil && u.TokenScope != nil {
+		return errHTTPForbiddenScopedToken
+	} else if !u.IsAdmin() { // u may be nil, but that's fine
+		if !conf.EnableSignup {
 			return errHTTPBadRequestSignupNotEnabled
 		} else if u != nil {
 			return errHTTPUnauthorized // Cannot create account from user context
@@ -33,21 +38,47 @@ func (s *Server) handleAccountCreate(w http.ResponseWriter, r *http.Request, v *
 	if err != nil {
 		return err
 	}
+	invite := conf.SignupMode == signupModeInvite && !u.IsAdmin()
+	verify := conf.EnableSignupVerification && !u.IsAdmin()
+	if invite && newAccount.Invite == "" {
+		return errHTTPBadRequestInviteInvalid
+	} else if verify && s.mailer() == nil {
+		return errHTTPBadRequestEmailDisabled
+	} else if verify && conf.BaseURL == "" {
+		return errHTTPInternalErrorMissingBaseURL
+	} else if verify && !validSignupEmail(newAccount.Email) {
+		return errHTTPBadRequestSignupEmailInvalid
+	}
 	if existingUser, _ := s.userManager.User(newAccount.Username); existingUser != nil {
 		return errHTTPConflictUserExists
 	}
 	logvr(v, r).Tag(tagAccount).Field("user_name", newAccount.Username).Info("Creating user %s", newAccount.Username)
-	if err := s.userManager.AddUser(newAccount.Username, newAccount.Password, user.RoleUser); err != nil {
-		if errors.Is(err, user.ErrInvalidArgument) {
-			return errHTTPBadRequestInvalidUsername
-		}
+	if err := s.addUser(v, r, newAccount, invite); err != nil {
 		return err
 	}
 	v.AccountCreated()
+	if verify {
+		newUser, err := s.userManager.User(newAccount.Username)
+		if err != nil {
+			return err
+		}
+		if err := s.sendVerificationEmail(v, r, newUser, newAccount.Email); err != nil {
+			logvr(v, r).Tag(tagAccount).Err(err).Warn("Unable to send verification email, removing user %s", newAccount.Username)
+			if err := s.userManager.RemoveUser(newAccount.Username); err != nil {
+				return err
+			} else if invite {
+				if err := s.userManager.ReturnInvite(newAccount.Invite); err != nil {
+					return err
+				}
+			}
+			return errHTTPInternalErrorVerificationEmail
+		}
+	}
 	return s.writeJSON(w, newSuccessResponse())
 }
 
 func (s *Server) handleAccountGet(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	conf := s.config()
 	info, err := v.Info()
 	if err != nil {
 		return err
@@ -66,6 +97,8 @@ func (s *Server) handleAccountGet(w http.ResponseWriter, r *http.Request, v *vis
 			AttachmentFileSize:       limits.AttachmentFileSizeLimit,
 			AttachmentExpiryDuration: int64(limits.AttachmentExpiryDuration.Seconds()),
 			AttachmentBandwidth:      limits.AttachmentBandwidthLimit,
+			Subscriptions:            limits.SubscriptionLimit,
+			SubscriptionDuration:     int64(limits.SubscriptionDuration.Seconds()),
 		},
 		Stats: &apiAccountStats{
 			Messages:                     stats.Messages,
@@ -101,6 +134,19 @@ func (s *Server) handleAccountGet(w http.ResponseWriter, r *http.Request, v *vis
 				Code: u.Tier.Code,
 				Name: u.Tier.Name,
 			}
+			if u.TierExpires.Unix() > 0 {
+				response.Tier.Expires = u.TierExpires.Unix()
+			}
+		}
+		if u.IsSuspended() {
+			response.Suspension = newAccountSuspensionResponse(u.Suspension)
+		}
+		if u.Org != nil {
+			response.Org = &apiAccountOrgMembership{
+				ID:   u.Org.ID,
+				Name: u.Org.Name,
+				Role: string(u.Org.Role),
+			}
 		}
 		if u.Billing.StripeCustomerID != "" {
 			response.Billing = &apiAccountBilling{
@@ -112,7 +158,7 @@ func (s *Server) handleAccountGet(w http.ResponseWriter, r *http.Request, v *vis
 				CancelAt:     u.Billing.StripeSubscriptionCancelAt.Unix(),
 			}
 		}
-		if s.config.EnableReservations {
+		if conf.EnableReservations {
 			reservations, err := s.userManager.Reservations(u.Name)
 			if err != nil {
 				return err
@@ -123,31 +169,29 @@ func (s *Server) handleAccountGet(w http.ResponseWriter, r *http.Request, v *vis
 					response.Reservations = append(response.Reservations, &apiAccountReservation{
 						Topic:    r.Topic,
 						Everyone: r.Everyone.String(),
+						Email:    s.emailAliasAddress(r.EmailAlias),
 					})
 				}
 			}
 		}
-		tokens, err := s.userManager.Tokens(u.ID)
-		if err != nil {
-			return err
-		}
-		if len(tokens) > 0 {
-			response.Tokens = make([]*apiAccountTokenResponse, 0)
-			for _, t := range tokens {
-				var lastOrigin string
-				if t.LastOrigin != netip.IPv4Unspecified() {
-					lastOrigin = t.LastOrigin.String()
+		if u.TokenScope == nil { // Scoped tokens must not reveal other tokens
+			tokens, err := s.userManager.Tokens(u.ID)
+			if err != nil {
+				return err
+			}
+			if len(tokens) > 0 {
+				response.Tokens = make([]*apiAccountTokenResponse, 0)
+				for _, t := range tokens {
+					response.Tokens = append(response.Tokens, newAccountTokenResponse(t))
 				}
-				response.Tokens = append(response.Tokens, &apiAccountTokenResponse{
-					Token:      t.Value,
-					Label:      t.Label,
-					LastAccess: t.LastAccess.Unix(),
-					LastOrigin: lastOrigin,
-					Expires:    t.Expires.Unix(),
-				})
 			}
 		}
-		if s.config.TwilioAccount != "" {
+		twoFactor, err := s.userManager.TOTPEnabled(u.ID)
+		if err != nil {
+			return err
+		}
+		response.TwoFactor = twoFactor
+		if conf.TwilioAccount != "" {
 			phoneNumbers, err := s.userManager.PhoneNumbers(u.ID)
 			if err != nil {
 				return err
@@ -163,6 +207,34 @@ func (s *Server) handleAccountGet(w http.ResponseWriter, r *http.Request, v *vis
 	return s.writeJSON(w, response)
 }
 
+// handleAccountChange changes the username of the current user. Since all other data (access control entries,
+// reservations, tokens, messages, etc.) references the user ID, nothing is lost. Clients using basic auth will
+// have to update their credentials; tokens stay valid.
+func (s *Server) handleAccountChange(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	req, err := readJSONWithLimit[apiAccountChangeRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	} else if req.Password == "" || req.Username == "" {
+		return errHTTPBadRequest
+	} else if !user.AllowedUsername(req.Username) {
+		return errHTTPBadRequestInvalidUsername
+	}
+	u := v.User()
+	if _, err := s.userManager.Authenticate(u.Name, req.Password); err != nil {
+		return errHTTPBadRequestIncorrectPasswordConfirmation
+	}
+	if req.Username == u.Name {
+		return s.writeJSON(w, newSuccessResponse())
+	}
+	logvr(v, r).Tag(tagAccount).Field("new_username", req.Username).Info("Renaming user %s to %s", u.Name, req.Username)
+	if err := s.userManager.ChangeUsername(u.Name, req.Username); errors.Is(err, user.ErrUserExists) {
+		return errHTTPConflictUserExists
+	} else if err != nil {
+		return err
+	}
+	return s.writeJSON(w, newSuccessResponse())
+}
+
 func (s *Server) handleAccountDelete(w http.ResponseWriter, r *http.Request, v *visitor) error {
 	req, err := readJSONWithLimit[apiAccountDeleteRequest](r.Body, jsonBodyBytesLimit, false)
 	if err != nil {
@@ -174,6 +246,16 @@ func (s *Server) handleAccountDelete(w http.ResponseWriter, r *http.Request, v *
 	if _, err := s.userManager.Authenticate(u.Name, req.Password); err != nil {
 		return errHTTPBadRequestIncorrectPasswordConfirmation
 	}
+	if u.Org != nil && u.Org.Role == user.OrgRoleOwner {
+		if err := s.ensureOtherOrgOwner(u); err != nil {
+			return err
+		}
+	}
+	if req.ArchiveEmail != "" {
+		if err := s.sendAccountArchiveEmail(r, v, u, req.ArchiveEmail); err != nil {
+			return err
+		}
+	}
 	if s.webPush != nil && u.ID != "" {
 		if err := s.webPush.RemoveSubscriptionsByUserID(u.ID); err != nil {
 			logvr(v, r).Err(err).Warn("Error removing web push subscriptions for %s", u.Name)
@@ -213,6 +295,18 @@ func (s *Server) handleAccountPasswordChange(w http.ResponseWriter, r *http.Requ
 	return s.writeJSON(w, newSuccessResponse())
 }
 
+func (s *Server) handleAccountTokensGet(w http.ResponseWriter, _ *http.Request, v *visitor) error {
+	tokens, err := s.userManager.Tokens(v.User().ID)
+	if err != nil {
+		return err
+	}
+	response := make([]*apiAccountTokenResponse, 0)
+	for _, t := range tokens {
+		response = append(response, newAccountTokenResponse(t))
+	}
+	return s.writeJSON(w, response)
+}
+
 func (s *Server) handleAccountTokenCreate(w http.ResponseWriter, r *http.Request, v *visitor) error {
 	req, err := readJSONWithLimit[apiAccountTokenIssueRequest](r.Body, jsonBodyBytesLimit, true) // Allow empty body!
 	if err != nil {
@@ -222,30 +316,60 @@ func (s *Server) handleAccountTokenCreate(w http.ResponseWriter, r *http.Request
 	if req.Label != nil {
 		label = *req.Label
 	}
+	tokenType := user.TokenTypeWeb // Logging in via the web app does not pass a label or type
+	if req.Type != nil {
+		tokenType = user.TokenType(*req.Type)
+		if !user.AllowedTokenType(tokenType) {
+			return errHTTPBadRequestTokenTypeInvalid
+		}
+	} else if req.Label != nil {
+		tokenType = user.TokenTypeIntegration
+	}
 	expires := time.Now().Add(tokenExpiryDuration)
 	if req.Expires != nil {
 		expires = time.Unix(*req.Expires, 0)
 	}
+	hardExpires := time.Unix(0, 0)
+	if req.HardExpires != nil {
+		hardExpires = time.Unix(*req.HardExpires, 0)
+	}
+	var scope *user.TokenScope
+	if req.Scope != nil {
+		permission, err := user.ParsePermission(req.Scope.Permission)
+		if err != nil || permission == user.PermissionDenyAll {
+			return errHTTPBadRequestPermissionInvalid
+		}
+		for _, topic := range req.Scope.Topics {
+			if !user.AllowedTopicPattern(topic) {
+				return errHTTPBadRequestTopicInvalid
+			}
+		}
+		scope = &user.TokenScope{
+			Permission: permission,
+			Topics:     req.Scope.Topics,
+		}
+	}
 	u := v.User()
+	if tokenAuthenticated(r) {
+		if err := s.verifyTOTP(r, u); err != nil { // Password logins are verified in authenticateBasicAuth
+			return err
+		}
+	}
 	logvr(v, r).
 		Tag(tagAccount).
 		Fields(log.Context{
-			"token_label":   label,
-			"token_expires": expires,
+			"token_label":        label,
+			"token_type":         tokenType,
+			"token_expires":      expires,
+			"token_hard_expires": hardExpires,
+			"token_scoped":       scope != nil,
 		}).
 		Debug("Creating token for user %s", u.Name)
-	token, err := s.userManager.CreateToken(u.ID, label, expires, v.IP())
+	token, err := s.userManager.CreateScopedToken(u.ID, label, tokenType, expires, hardExpires, v.IP(), r.UserAgent(), scope)
 	if err != nil {
 		return err
 	}
-	response := &apiAccountTokenResponse{
-		Token:      token.Value,
-		Label:      token.Label,
-		LastAccess: token.LastAccess.Unix(),
-		LastOrigin: token.LastOrigin.String(),
-		Expires:    token.Expires.Unix(),
-	}
-	return s.writeJSON(w, response)
+	return s.writeJSON(w, newAccountTokenResponse(token))
 }
 
 func (s *Server) handleAccountTokenUpdate(w http.ResponseWriter, r *http.Request, v *visitor) error {
@@ -265,6 +389,11 @@ func (s *Server) handleAccountTokenUpdate(w http.ResponseWriter, r *http.Request
 	} else if req.Label == nil {
 		expires = util.Time(time.Now().Add(tokenExpiryDuration)) // If label/expires not set, extend token by 72 hours
 	}
+	if tokenAuthenticated(r) {
+		if err := s.verifyTOTP(r, u); err != nil { // Password logins are verified in authenticateBasicAuth
+			return err
+		}
+	}
 	logvr(v, r).
 		Tag(tagAccount).
 		Fields(log.Context{
@@ -276,14 +405,101 @@ func (s *Server) handleAccountTokenUpdate(w http.ResponseWriter, r *http.Request
 	if err != nil {
 		return err
 	}
+	return s.writeJSON(w, newAccountTokenResponse(token))
+}
+
+func (s *Server) handleAccountTokenRotate(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	u := v.User()
+	req, err := readJSONWithLimit[apiAccountTokenRotateRequest](r.Body, jsonBodyBytesLimit, true) // Allow empty body!
+	if err != nil {
+		return err
+	} else if req.Token == "" {
+		req.Token = u.Token
+		if req.Token == "" {
+			return errHTTPBadRequestNoTokenProvided
+		}
+	}
+	gracePeriod := s.config().TokenRotationGracePeriod
+	if req.GracePeriod != nil {
+		gracePeriod = time.Duration(*req.GracePeriod) * time.Second
+		if gracePeriod < 0 || gracePeriod > tokenRotationGracePeriodMax {
+			return errHTTPBadRequestTokenGracePeriodInvalid
+		}
+	}
+	if tokenAuthenticated(r) {
+		if err := s.verifyTOTP(r, u); err != nil { // Password logins are verified in authenticateBasicAuth
+			return err
+		}
+	}
+	logvr(v, r).
+		Tag(tagAccount).
+		Field("token_grace_period", gracePeriod.String()).
+		Debug("Rotating token for user %s", u.Name)
+	newToken, oldToken, err := s.userManager.RotateToken(u.ID, req.Token, gracePeriod, v.IP(), r.UserAgent())
+	if errors.Is(err, user.ErrTokenNotFound) {
+		return errHTTPNotFoundToken
+	} else if err != nil {
+		return err
+	}
+	return s.writeJSON(w, &apiAccountTokenRotateResponse{
+		Token:    newAccountTokenResponse(newToken),
+		Previous: newAccountTokenResponse(oldToken),
+	})
+}
+
+func newAccountSuspensionResponse(suspension *user.Suspension) *apiAccountSuspension {
+	response := &apiAccountSuspension{
+		Since:  suspension.Since.Unix(),
+		Reason: suspension.Reason,
+	}
+	if suspension.Until.Unix() > 0 {
+		response.Until = suspension.Until.Unix()
+	}
+	return response
+}
+
+// suspensionDetails returns a human-readable description of the suspension, as returned to the suspended user
+func suspensionDetails(suspension *user.Suspension) string {
+	details := "indefinitely"
+	if suspension.Until.Unix() > 0 {
+		details = "until " + suspension.Until.UTC().Format(time.RFC3339)
+	}
+	if suspension.Reason != "" {
+		details += ", reason: " + suspension.Reason
+	}
+	return details
+}
+
+func newAccountTokenResponse(t *user.Token) *apiAccountTokenResponse {
+	var lastOrigin string
+	if t.LastOrigin != netip.IPv4Unspecified() {
+		lastOrigin = t.LastOrigin.String()
+	}
 	response := &apiAccountTokenResponse{
-		Token:      token.Value,
-		Label:      token.Label,
-		LastAccess: token.LastAccess.Unix(),
-		LastOrigin: token.LastOrigin.String(),
-		Expires:    token.Expires.Unix(),
+		Token:      t.Value,
+		Label:      t.Label,
+		Type:       string(t.Type),
+		LastAccess: t.LastAccess.Unix(),
+		LastOrigin: lastOrigin,
+		Expires:    t.Expires.Unix(),
+	}
+	if t.HardExpires.Unix() > 0 {
+		response.HardExpires = t.HardExpires.Unix()
+	}
+	if t.Created.Unix() > 0 {
+		response.Created = t.Created.Unix()
+		response.CreatedUserAgent = t.CreatedUserAgent
+		if t.CreatedOrigin != netip.IPv4Unspecified() {
+			response.CreatedOrigin = t.CreatedOrigin.String()
+		}
 	}
-	return s.writeJSON(w, response)
+	if t.Scope != nil {
+		response.Scope = &apiAccountTokenScope{
+			Permission: t.Scope.Permission.String(),
+			Topics:     t.Scope.Topics,
+		}
+	}
+	return response
 }
 
 func (s *Server) handleAccountTokenDelete(w http.ResponseWriter, r *http.Request, v *visitor) error {
@@ -319,18 +535,7 @@ func (s *Server) handleAccountSettingsChange(w http.ResponseWriter, r *http.Requ
 		prefs.Language = newPrefs.Language
 	}
 	if newPrefs.Notification != nil {
-		if prefs.Notification == nil {
-			prefs.Notification = &user.NotificationPrefs{}
-		}
-		if newPrefs.Notification.DeleteAfter != nil {
-			prefs.Notification.DeleteAfter = newPrefs.Notification.DeleteAfter
-		}
-		if newPrefs.Notification.Sound != nil {
-			prefs.Notification.Sound = newPrefs.Notification.Sound
-		}
-		if newPrefs.Notification.MinPriority != nil {
-			prefs.Notification.MinPriority = newPrefs.Notification.MinPriority
-		}
+		prefs.Notification = mergeNotificationPrefs(prefs.Notification, newPrefs.Notification)
 	}
 	logvr(v, r).Tag(tagAccount).Debug("Changing account settings for user %s", u.Name)
 	if err := s.userManager.ChangeSettings(u.ID, prefs); err != nil {
@@ -349,6 +554,14 @@ func (s *Server) handleAccountSubscriptionAdd(w http.ResponseWriter, r *http.Req
 	if prefs == nil {
 		prefs = &user.Prefs{}
 	}
+	if err := validateSubscription(newSubscription); err != nil {
+		return err
+	} else if newSubscription.QuietHours != nil && newSubscription.QuietHours.Start == "" && newSubscription.QuietHours.End == "" {
+		newSubscription.QuietHours = nil
+	}
+	if newSubscription.Routing != nil && newSubscription.Routing.Channels == nil && newSubscription.Routing.Priority == 0 {
+		newSubscription.Routing = nil
+	}
 	for _, subscription := range prefs.Subscriptions {
 		if newSubscription.BaseURL == subscription.BaseURL && newSubscription.Topic == subscription.Topic {
 			return errHTTPConflictSubscriptionExists
@@ -367,6 +580,9 @@ func (s *Server) handleAccountSubscriptionChange(w http.ResponseWriter, r *http.
 	if err != nil {
 		return err
 	}
+	if err := validateSubscription(updatedSubscription); err != nil {
+		return err
+	}
 	u := v.User()
 	prefs := u.Prefs
 	if prefs == nil || prefs.Subscriptions == nil {
@@ -376,6 +592,40 @@ func (s *Server) handleAccountSubscriptionChange(w http.ResponseWriter, r *http.
 	for _, sub := range prefs.Subscriptions {
 		if sub.BaseURL == updatedSubscription.BaseURL && sub.Topic == updatedSubscription.Topic {
 			sub.DisplayName = updatedSubscription.DisplayName
+			if updatedSubscription.Icon != nil { // Only update if set, so that older clients don't reset them
+				sub.Icon = updatedSubscription.Icon
+				if *sub.Icon == "" {
+					sub.Icon = nil
+				}
+			}
+			if updatedSubscription.MutedUntil != nil {
+				sub.MutedUntil = updatedSubscription.MutedUntil
+			}
+			if updatedSubscription.SortOrder != nil {
+				sub.SortOrder = updatedSubscription.SortOrder
+			}
+			if updatedSubscription.QuietHours != nil { // Only update if set; empty start and end remove quiet hours
+				sub.QuietHours = updatedSubscription.QuietHours
+				if sub.QuietHours.Start == "" && sub.QuietHours.End == "" {
+					sub.QuietHours = nil
+				}
+			}
+			if updatedSubscription.Routing != nil { // Only update if set; {} removes the routing
+				sub.Routing = updatedSubscription.Routing
+				if sub.Routing.Channels == nil && sub.Routing.Priority == 0 {
+					sub.Routing = nil
+				}
+			}
+			if updatedSubscription.Notification != nil { // Only update the fields that are set; {} removes the overrides
+				if *updatedSubscription.Notification == (user.NotificationPrefs{}) {
+					sub.Notification = nil
+				} else {
+					sub.Notification = mergeNotificationPrefs(sub.Notification, updatedSubscription.Notification)
+				}
+			}
+			if updatedSubscription.LastRead != nil && updatedSubscription.LastRead.After(sub.LastRead) { // Only move forward
+				sub.LastRead = updatedSubscription.LastRead
+			}
 			subscription = sub
 			break
 		}
@@ -416,6 +666,43 @@ func (s *Server) handleAccountSubscriptionDelete(w http.ResponseWriter, r *http.
 	return s.writeJSON(w, newSuccessResponse())
 }
 
+// validateSubscription checks the client-provided subscription metadata, so that we don't store
+// arbitrary strings that other clients will render
+func validateSubscription(sub *user.Subscription) error {
+	if sub.Icon != nil && *sub.Icon != "" && !urlRegex.MatchString(*sub.Icon) {
+		return errHTTPBadRequestIconURLInvalid
+	} else if sub.MutedUntil != nil && *sub.MutedUntil < 0 {
+		return errHTTPBadRequestMutedUntilInvalid
+	} else if sub.QuietHours != nil && (sub.QuietHours.Start != "" || sub.QuietHours.End != "") && !sub.QuietHours.Valid() {
+		return errHTTPBadRequestQuietHoursInvalid
+	} else if sub.Routing != nil && !sub.Routing.Valid() {
+		return errHTTPBadRequestRoutingInvalid
+	} else if sub.Notification != nil && sub.Notification.MinPriority != nil && (*sub.Notification.MinPriority < 1 || *sub.Notification.MinPriority > 5) {
+		return errHTTPBadRequestPriorityInvalid
+	} else if sub.LastRead != nil && (!validMessageID(sub.LastRead.ID) || sub.LastRead.Time <= 0) {
+		return errHTTPBadRequestReadMarkerInvalid
+	}
+	return nil
+}
+
+// mergeNotificationPrefs returns the given notification settings, updated with the fields that are set in update,
+// so that clients can change individual settings. The prefs param may be nil.
+func mergeNotificationPrefs(prefs, update *user.NotificationPrefs) *user.NotificationPrefs {
+	if prefs == nil {
+		prefs = &user.NotificationPrefs{}
+	}
+	if update.DeleteAfter != nil {
+		prefs.DeleteAfter = update.DeleteAfter
+	}
+	if update.Sound != nil {
+		prefs.Sound = update.Sound
+	}
+	if update.MinPriority != nil {
+		prefs.MinPriority = update.MinPriority
+	}
+	return prefs
+}
+
 // handleAccountReservationAdd adds a topic reservation for the logged-in user, but only if the user has a tier
 // with enough remaining reservations left, or if the user is an admin. Admins can always reserve a topic, unless
 // it is already reserved by someone else.
@@ -489,6 +776,16 @@ func (s *Server) handleAccountReservationDelete(w http.ResponseWriter, r *http.R
 		return errHTTPUnauthorized
 	}
 	deleteMessages := readBoolParam(r, false, "X-Delete-Messages", "Delete-Messages")
+	if deleteMessages {
+		archiveEmail, err := s.archiveEmailFromRequest(r, v)
+		if err != nil {
+			return err
+		} else if archiveEmail != "" {
+			if err := s.sendArchiveEmail(r, v, archiveEmail, topic); err != nil {
+				return err
+			}
+		}
+	}
 	logvr(v, r).
 		Tag(tagAccount).
 		Fields(log.Context{
@@ -508,30 +805,274 @@ func (s *Server) handleAccountReservationDelete(w http.ResponseWriter, r *http.R
 	return s.writeJSON(w, newSuccessResponse())
 }
 
+// handleAccountReservationManagersGet lists the users that may manage a topic reserved by the current user
+func (s *Server) handleAccountReservationManagersGet(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	topic, err := s.ownedReservationFromPath(r, v, apiAccountReservationManagersRegex)
+	if err != nil {
+		return err
+	}
+	managers, err := s.userManager.ReservationManagers(v.User().Name, topic)
+	if err != nil {
+		return err
+	}
+	return s.writeJSON(w, &apiAccountReservationManagersResponse{
+		Managers: managers,
+	})
+}
+
+// handleAccountReservationManagerAdd grants another user the right to manage a topic reserved by the current
+// user (prune messages, delete messages, mute senders and view stats), without handing over ownership
+func (s *Server) handleAccountReservationManagerAdd(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	topic, err := s.ownedReservationFromPath(r, v, apiAccountReservationManagersRegex)
+	if err != nil {
+		return err
+	}
+	req, err := readJSONWithLimit[apiAccountReservationManagerRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	}
+	u := v.User()
+	if req.Username == "" || req.Username == u.Name {
+		return errHTTPBadRequestUserNotFound
+	}
+	logvr(v, r).
+		Tag(tagAccount).
+		Fields(log.Context{
+			"topic":   topic,
+			"manager": req.Username,
+		}).
+		Debug("Adding topic manager")
+	if err := s.userManager.AddReservationManager(u.Name, topic, req.Username); errors.Is(err, user.ErrUserNotFound) || errors.Is(err, user.ErrInvalidArgument) {
+		return errHTTPBadRequestUserNotFound
+	} else if errors.Is(err, user.ErrUserAccessExists) {
+		return errHTTPConflictUserAccessExists
+	} else if err != nil {
+		return err
+	}
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+// handleAccountReservationManagerDelete revokes the right to manage a topic reserved by the current user
+func (s *Server) handleAccountReservationManagerDelete(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	topic, err := s.ownedReservationFromPath(r, v, apiAccountReservationManagersRegex)
+	if err != nil {
+		return err
+	}
+	req, err := readJSONWithLimit[apiAccountReservationManagerRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	}
+	logvr(v, r).
+		Tag(tagAccount).
+		Fields(log.Context{
+			"topic":   topic,
+			"manager": req.Username,
+		}).
+		Debug("Removing topic manager")
+	if err := s.userManager.RemoveReservationManager(v.User().Name, topic, req.Username); errors.Is(err, user.ErrInvalidArgument) {
+		return errHTTPBadRequestUserNotFound
+	} else if err != nil {
+		return err
+	}
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+// handleAccountReservationMembersGet lists the users that were granted access to a topic reserved by the current user
+func (s *Server) handleAccountReservationMembersGet(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	topic, err := s.ownedReservationFromPath(r, v, apiAccountReservationMembersRegex)
+	if err != nil {
+		return err
+	}
+	members, err := s.userManager.ReservationMembers(v.User().Name, topic)
+	if err != nil {
+		return err
+	}
+	response := &apiAccountReservationMembersResponse{
+		Members: make([]*apiAccountReservationMember, 0),
+	}
+	for _, member := range members {
+		response.Members = append(response.Members, &apiAccountReservationMember{
+			Username:   member.Username,
+			Permission: member.Permission.String(),
+		})
+	}
+	return s.writeJSON(w, response)
+}
+
+// handleAccountReservationMemberAdd grants another user read and/or write access to a topic reserved by the current
+// user, so that a team can share a protected topic without sharing account credentials
+func (s *Server) handleAccountReservationMemberAdd(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	topic, err := s.ownedReservationFromPath(r, v, apiAccountReservationMembersRegex)
+	if err != nil {
+		return err
+	}
+	req, err := readJSONWithLimit[apiAccountReservationMemberRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	}
+	u := v.User()
+	if req.Username == "" || req.Username == u.Name {
+		return errHTTPBadRequestUserNotFound
+	}
+	permission := user.PermissionReadWrite
+	if req.Permission != "" {
+		permission, err = user.ParsePermission(req.Permission)
+		if err != nil || permission == user.PermissionDenyAll || permission.IsManage() {
+			return errHTTPBadRequestPermissionInvalid
+		}
+	}
+	logvr(v, r).
+		Tag(tagAccount).
+		Fields(log.Context{
+			"topic":      topic,
+			"member":     req.Username,
+			"permission": permission.String(),
+		}).
+		Debug("Adding topic member")
+	if err := s.userManager.AddReservationMember(u.Name, topic, req.Username, permission); errors.Is(err, user.ErrUserNotFound) || errors.Is(err, user.ErrInvalidArgument) {
+		return errHTTPBadRequestUserNotFound
+	} else if errors.Is(err, user.ErrUserAccessExists) {
+		return errHTTPConflictUserAccessExists
+	} else if err != nil {
+		return err
+	}
+	if !permission.IsRead() {
+		if err := s.killUserSubscriberByName(req.Username, topic); err != nil {
+			return err
+		}
+	}
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+// handleAccountReservationMemberDelete revokes the access of a user to a topic reserved by the current user
+func (s *Server) handleAccountReservationMemberDelete(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	topic, err := s.ownedReservationFromPath(r, v, apiAccountReservationMembersRegex)
+	if err != nil {
+		return err
+	}
+	req, err := readJSONWithLimit[apiAccountReservationMemberRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	}
+	logvr(v, r).
+		Tag(tagAccount).
+		Fields(log.Context{
+			"topic":  topic,
+			"member": req.Username,
+		}).
+		Debug("Removing topic member")
+	if err := s.userManager.RemoveReservationMember(v.User().Name, topic, req.Username); errors.Is(err, user.ErrInvalidArgument) {
+		return errHTTPBadRequestUserNotFound
+	} else if err != nil {
+		return err
+	}
+	if err := s.killUserSubscriberByName(req.Username, topic); err != nil {
+		return err
+	}
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+// handleAccountReservationTransfer hands over the ownership of a topic reserved by the current user to another user,
+// if that user may own another reservation. The current user stays a read-write member of the topic.
+func (s *Server) handleAccountReservationTransfer(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	topic, err := s.ownedReservationFromPath(r, v, apiAccountReservationTransferRegex)
+	if err != nil {
+		return err
+	}
+	req, err := readJSONWithLimit[apiAccountReservationTransferRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	}
+	u := v.User()
+	if req.Username == "" || req.Username == u.Name {
+		return errHTTPBadRequestUserNotFound
+	}
+	newOwner, err := s.userManager.User(req.Username)
+	if errors.Is(err, user.ErrUserNotFound) {
+		return errHTTPBadRequestUserNotFound
+	} else if err != nil {
+		return err
+	} else if newOwner.IsUser() {
+		if newOwner.Tier == nil {
+			return errHTTPTooManyRequestsLimitReservations.Wrap("user %s cannot reserve topics", newOwner.Name)
+		}
+		reservations, err := s.userManager.ReservationsCount(newOwner.Name)
+		if err != nil {
+			return err
+		} else if reservations >= newOwner.Tier.ReservationLimit {
+			return errHTTPTooManyRequestsLimitReservations.Wrap("user %s cannot reserve more topics", newOwner.Name)
+		}
+	}
+	logvr(v, r).
+		Tag(tagAccount).
+		Fields(log.Context{
+			"topic":     topic,
+			"new_owner": newOwner.Name,
+		}).
+		Info("Transferring topic reservation %s to user %s", topic, newOwner.Name)
+	if err := s.userManager.TransferReservation(u.Name, topic, newOwner.Name); err != nil {
+		return err
+	}
+	s.publishSyncEventAsync(s.visitor(netip.IPv4Unspecified(), newOwner))
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+// ownedReservationFromPath returns the topic from a path like /v1/account/reservation/mytopic/managers,
+// if it is reserved by the current user
+func (s *Server) ownedReservationFromPath(r *http.Request, v *visitor, pathRegex *regexp.Regexp) (string, error) {
+	matches := pathRegex.FindStringSubmatch(r.URL.Path)
+	if len(matches) != 2 {
+		return "", errHTTPInternalErrorInvalidPath
+	}
+	topic := matches[1]
+	if !topicRegex.MatchString(topic) {
+		return "", errHTTPBadRequestTopicInvalid
+	}
+	authorized, err := s.userManager.HasReservation(v.User().Name, topic)
+	if err != nil {
+		return "", err
+	} else if !authorized {
+		return "", errHTTPUnauthorized
+	}
+	return topic, nil
+}
+
 // maybeRemoveMessagesAndExcessReservations deletes topic reservations for the given user (if too many for tier),
 // and marks associated messages for the topics as deleted. This also eventually deletes attachments.
 // The process relies on the manager to perform the actual deletions (see runManager).
 func (s *Server) maybeRemoveMessagesAndExcessReservations(r *http.Request, v *visitor, u *user.User, reservationsLimit int64) error {
-	reservations, err := s.userManager.Reservations(u.Name)
+	topics, err := s.removeMessagesAndExcessReservations(u, reservationsLimit)
 	if err != nil {
 		return err
-	} else if int64(len(reservations)) <= reservationsLimit {
+	} else if len(topics) == 0 {
 		logvr(v, r).Tag(tagAccount).Debug("No excess reservations to remove")
 		return nil
 	}
+	logvr(v, r).Tag(tagAccount).Info("Removed excess reservations for topics %s", strings.Join(topics, ", "))
+	return nil
+}
+
+// removeMessagesAndExcessReservations is the request-independent part of maybeRemoveMessagesAndExcessReservations.
+// It returns the topics of the removed reservations.
+func (s *Server) removeMessagesAndExcessReservations(u *user.User, reservationsLimit int64) ([]string, error) {
+	reservations, err := s.userManager.Reservations(u.Name)
+	if err != nil {
+		return nil, err
+	} else if int64(len(reservations)) <= reservationsLimit {
+		return nil, nil
+	}
 	topics := make([]string, 0)
 	for i := int64(len(reservations)) - 1; i >= reservationsLimit; i-- {
 		topics = append(topics, reservations[i].Topic)
 	}
-	logvr(v, r).Tag(tagAccount).Info("Removing excess reservations for topics %s", strings.Join(topics, ", "))
 	if err := s.userManager.RemoveReservations(u.Name, topics...); err != nil {
-		return err
+		return nil, err
 	}
 	if err := s.messageCache.ExpireMessages(topics...); err != nil {
-		return err
+		return nil, err
 	}
 	go s.pruneMessages()
-	return nil
+	return topics, nil
 }
 
 func (s *Server) handleAccountPhoneNumberVerify(w http.ResponseWriter, r *http.Request, v *visitor) error {
@@ -541,7 +1082,7 @@ func (s *Server) handleAccountPhoneNumberVerify(w http.ResponseWriter, r *http.R
 		return err
 	} else if !phoneNumberRegex.MatchString(req.Number) {
 		return errHTTPBadRequestPhoneNumberInvalid
-	} else if req.Channel != "sms" && req.Channel != "call" {
+	} else if req.Channel != callChannelSMS && req.Channel != callChannelCall {
 		return errHTTPBadRequestPhoneNumberVerifyChannelInvalid
 	}
 	// Check user is allowed to add phone numbers
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"heckel.io/ntfy/v2/user"
+)
+
+// Usage stats show users how their account was used over time, as opposed to the instantaneous counters in
+// GET /v1/account. For each message published by a user, the server records the message, uploaded attachment
+// bytes, and sent emails per topic in hourly buckets (see user.Manager.EnqueueUsage). The stats are kept for
+// 90 days, and returned via GET /v1/account/stats?granularity=day&days=30.
+
+const (
+	accountStatsGranularityHour = "hour"
+	accountStatsGranularityDay  = "day"
+	accountStatsDaysDefault     = 30
+	accountStatsDaysMax         = 90
+	accountStatsHourlyDaysMax   = 7
+)
+
+// handleAccountStatsGet returns the usage stats of the account as a time series, per topic
+func (s *Server) handleAccountStatsGet(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	granularity := readQueryParam(r, "granularity")
+	if granularity == "" {
+		granularity = accountStatsGranularityDay
+	}
+	days := accountStatsDaysDefault
+	if daysStr := readQueryParam(r, "days"); daysStr != "" {
+		var err error
+		if days, err = strconv.Atoi(daysStr); err != nil {
+			return errHTTPBadRequestAccountStatsInvalid
+		}
+	}
+	var period time.Duration
+	switch granularity {
+	case accountStatsGranularityHour:
+		if days < 1 || days > accountStatsHourlyDaysMax {
+			return errHTTPBadRequestAccountStatsInvalid
+		}
+		period = time.Hour
+	case accountStatsGranularityDay:
+		if days < 1 || days > accountStatsDaysMax {
+			return errHTTPBadRequestAccountStatsInvalid
+		}
+		period = 24 * time.Hour
+	default:
+		return errHTTPBadRequestAccountStatsInvalid
+	}
+	since := time.Now().Truncate(period).Add(-time.Duration(days) * 24 * time.Hour).Add(period) // Includes the current period
+	usage, err := s.userManager.Usage(v.User().ID, since, period)
+	if err != nil {
+		return err
+	}
+	response := &apiAccountStatsResponse{
+		Granularity: granularity,
+		Since:       since.Unix(),
+		Stats:       make([]*apiAccountStatsPeriod, 0),
+	}
+	var current *apiAccountStatsPeriod
+	for _, u := range usage {
+		if current == nil || current.Time != u.Time.Unix() {
+			current = &apiAccountStatsPeriod{
+				Time:   u.Time.Unix(),
+				Topics: make([]*apiAccountStatsTopic, 0),
+			}
+			response.Stats = append(response.Stats, current)
+		}
+		current.Messages += u.Messages
+		current.Emails += u.Emails
+		current.AttachmentBytes += u.AttachmentBytes
+		current.Topics = append(current.Topics, &apiAccountStatsTopic{
+			Topic:           u.Topic,
+			Messages:        u.Messages,
+			Emails:          u.Emails,
+			AttachmentBytes: u.AttachmentBytes,
+		})
+	}
+	return s.writeJSON(w, response)
+}
+
+// recordUsage adds published messages (including their uploaded attachment) and sent emails to the usage
+// stats of the user who published the message, if any
+func (s *Server) recordUsage(m *message, messages, emails int64) {
+	if s.userManager == nil || m.User == "" {
+		return
+	}
+	usage := &user.Usage{
+		Topic:    m.Topic,
+		Messages: messages,
+		Emails:   emails,
+	}
+	if messages > 0 && m.Attachment != nil && m.Attachment.Expires > 0 {
+		usage.AttachmentBytes = m.Attachment.Size // Only uploaded attachments have an expiry
+	}
+	s.userManager.EnqueueUsage(m.User, usage)
+}
@@ -1,12 +1,19 @@
 package server
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
 	"fmt"
 	"github.com/stretchr/testify/require"
 	"heckel.io/ntfy/v2/log"
 	"heckel.io/ntfy/v2/user"
 	"heckel.io/ntfy/v2/util"
 	"io"
+	"net/http"
+	"net/http/httptest"
 	"net/netip"
 	"path/filepath"
 	"strings"
@@ -51,6 +58,77 @@ func TestAccount_Signup_Success(t *testing.T) {
 	require.Equal(t, "phil", account.Username)
 }
 
+func TestAccount_Signup_Verification(t *testing.T) {
+	conf := newTestConfigWithAuthFile(t)
+	conf.BaseURL = "https://ntfy.example.com"
+	conf.EnableSignup = true
+	conf.EnableSignupVerification = true
+	s := newTestServer(t, conf)
+	defer s.closeDatabases()
+	mailer := &testMailer{}
+	setTestMailer(s, mailer)
+
+	// Email address is required
+	rr := request(t, s, "POST", "/v1/account", `{"username":"phil", "password":"mypass"}`, nil)
+	require.Equal(t, 400, rr.Code)
+	require.Equal(t, 40095, toHTTPError(t, rr.Body.String()).Code)
+	rr = request(t, s, "POST", "/v1/account", `{"username":"phil", "password":"mypass", "email":"Phil <phil@example.com>"}`, nil)
+	require.Equal(t, 400, rr.Code)
+
+	rr = request(t, s, "POST", "/v1/account", `{"username":"phil", "password":"mypass", "email":"phil@example.com"}`, nil)
+	require.Equal(t, 200, rr.Code)
+	text := mailer.Text("phil@example.com")
+	require.Contains(t, text, "phil")
+	require.Contains(t, text, "https://ntfy.example.com/v1/account/verify?token=vt_")
+
+	// Login fails until verified
+	rr = request(t, s, "POST", "/v1/account/token", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "mypass"),
+	})
+	require.Equal(t, 401, rr.Code)
+	require.Equal(t, 40103, toHTTPError(t, rr.Body.String()).Code)
+	rr = request(t, s, "POST", "/v1/account/token", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "wrong"),
+	})
+	require.Equal(t, 401, rr.Code)
+	require.Equal(t, 40101, toHTTPError(t, rr.Body.String()).Code)
+
+	rr = request(t, s, "GET", "/v1/account/verify?token=vt_invalid", "", nil)
+	require.Equal(t, 400, rr.Code)
+	require.Equal(t, 40096, toHTTPError(t, rr.Body.String()).Code)
+
+	link := text[strings.Index(text, "https://ntfy.example.com"):]
+	link = strings.TrimPrefix(strings.Fields(link)[0], "https://ntfy.example.com")
+	rr = request(t, s, "GET", link, "", nil)
+	require.Equal(t, 302, rr.Code)
+	require.Equal(t, "/login", rr.Header().Get("Location"))
+
+	rr = request(t, s, "POST", "/v1/account/token", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "mypass"),
+	})
+	require.Equal(t, 200, rr.Code)
+
+	// Link can only be used once
+	rr = request(t, s, "GET", link, "", nil)
+	require.Equal(t, 400, rr.Code)
+}
+
+func TestAccount_Signup_Verification_MailFailure(t *testing.T) {
+	conf := newTestConfigWithAuthFile(t)
+	conf.BaseURL = "https://ntfy.example.com"
+	conf.EnableSignup = true
+	conf.EnableSignupVerification = true
+	s := newTestServer(t, conf)
+	defer s.closeDatabases()
+	setTestMailer(s, &testFailingMailer{})
+
+	rr := request(t, s, "POST", "/v1/account", `{"username":"phil", "password":"mypass", "email":"phil@example.com"}`, nil)
+	require.Equal(t, 500, rr.Code)
+	require.Equal(t, 50006, toHTTPError(t, rr.Body.String()).Code)
+	_, err := s.userManager.User("phil")
+	require.Equal(t, user.ErrUserNotFound, err)
+}
+
 func TestAccount_Signup_UserExists(t *testing.T) {
 	conf := newTestConfigWithAuthFile(t)
 	conf.EnableSignup = true
@@ -134,7 +212,7 @@ func TestAccount_Get_Anonymous(t *testing.T) {
 	conf.VisitorAttachmentTotalSizeLimit = 5123
 	conf.AttachmentFileSizeLimit = 512
 	s := newTestServer(t, conf)
-	s.smtpSender = &testMailer{}
+	setTestMailer(s, &testMailer{})
 	defer s.closeDatabases()
 
 	rr := request(t, s, "GET", "/v1/account", "", nil)
@@ -176,7 +254,7 @@ func TestAccount_ChangeSettings(t *testing.T) {
 
 	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
 	u, _ := s.userManager.User("phil")
-	token, _ := s.userManager.CreateToken(u.ID, "", time.Unix(0, 0), netip.IPv4Unspecified())
+	token, _ := s.userManager.CreateToken(u.ID, "", user.TokenTypeWeb, time.Unix(0, 0), netip.IPv4Unspecified())
 
 	rr := request(t, s, "PATCH", "/v1/account/settings", `{"notification": {"sound": "juntos"},"ignored": true}`, map[string]string{
 		"Authorization": util.BasicAuth("phil", "phil"),
@@ -250,6 +328,271 @@ func TestAccount_Subscription_AddUpdateDelete(t *testing.T) {
 	require.Equal(t, 0, len(account.Subscriptions))
 }
 
+func TestAccount_Subscription_Metadata(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+
+	rr := request(t, s, "POST", "/v1/account/subscription", `{"base_url": "http://abc.com", "topic": "def", "icon": "https://abc.com/icon.png", "sort_order": 2}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+
+	// Only fields that are set are changed (except display name, for backwards compatibility)
+	rr = request(t, s, "PATCH", "/v1/account/subscription", `{"base_url": "http://abc.com", "topic": "def", "display_name": "ding dong", "muted_until": 1}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+
+	rr = request(t, s, "GET", "/v1/account", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	account, _ := util.UnmarshalJSON[apiAccountResponse](io.NopCloser(rr.Body))
+	require.Equal(t, 1, len(account.Subscriptions))
+	require.Equal(t, util.String("ding dong"), account.Subscriptions[0].DisplayName)
+	require.Equal(t, util.String("https://abc.com/icon.png"), account.Subscriptions[0].Icon)
+	require.Equal(t, int64(1), *account.Subscriptions[0].MutedUntil)
+	require.Equal(t, util.Int(2), account.Subscriptions[0].SortOrder)
+
+	// Unmute and remove icon
+	rr = request(t, s, "PATCH", "/v1/account/subscription", `{"base_url": "http://abc.com", "topic": "def", "display_name": "ding dong", "muted_until": 0, "icon": ""}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	sub, _ := util.UnmarshalJSON[user.Subscription](io.NopCloser(rr.Body))
+	require.Equal(t, int64(0), *sub.MutedUntil) // Explicitly unmuted, so other clients pick it up
+	require.Nil(t, sub.Icon)
+	require.Equal(t, util.Int(2), sub.SortOrder)
+
+	// Invalid values
+	rr = request(t, s, "PATCH", "/v1/account/subscription", `{"base_url": "http://abc.com", "topic": "def", "icon": "not a URL"}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 400, rr.Code)
+	require.Equal(t, 40021, toHTTPError(t, rr.Body.String()).Code)
+
+	rr = request(t, s, "PATCH", "/v1/account/subscription", `{"base_url": "http://abc.com", "topic": "def", "muted_until": -5}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 400, rr.Code)
+	require.Equal(t, 40047, toHTTPError(t, rr.Body.String()).Code)
+}
+
+func TestAccount_Subscription_QuietHours(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+	mailer := &testMailer{}
+	setTestMailer(s, mailer)
+
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.AddReservation("phil", "mytopic", user.PermissionDenyAll))
+
+	// Invalid quiet hours
+	rr := request(t, s, "POST", "/v1/account/subscription", `{"base_url": "`+s.config().BaseURL+`", "topic": "mytopic", "quiet_hours": {"start": "22:00", "end": "25:00"}}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 400, rr.Code)
+	require.Equal(t, 40065, toHTTPError(t, rr.Body.String()).Code)
+
+	// Quiet hours right now
+	start, end := time.Now().UTC().Add(-time.Hour).Format("15:04"), time.Now().UTC().Add(time.Hour).Format("15:04")
+	rr = request(t, s, "POST", "/v1/account/subscription", `{"base_url": "`+s.config().BaseURL+`", "topic": "mytopic", "quiet_hours": {"start": "`+start+`", "end": "`+end+`"}}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	sub, _ := util.UnmarshalJSON[user.Subscription](io.NopCloser(rr.Body))
+	require.Equal(t, start, sub.QuietHours.Start)
+
+	// Low-priority messages are held back, high-priority messages are not
+	rr = request(t, s, "PUT", "/mytopic", "backup done", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+		"Title":         "Backup",
+		"Email":         "phil@example.com",
+	})
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "PUT", "/mytopic", "disk full", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+		"Priority":      "5",
+		"Email":         "phil@example.com",
+	})
+	require.Equal(t, 200, rr.Code)
+	waitFor(t, func() bool {
+		mailer.mu.Lock()
+		defer mailer.mu.Unlock()
+		return mailer.count == 1
+	})
+
+	// Held back messages are still cached
+	rr = request(t, s, "GET", "/mytopic/json?poll=1", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 2, len(toMessages(t, rr.Body.String())))
+
+	// Summary is sent once the quiet hours end
+	s.mu.Lock()
+	queue := s.quietHours["mytopic"]
+	require.NotNil(t, queue)
+	require.Equal(t, 1, queue.count)
+	queue.until = time.Now().Add(-time.Second)
+	s.mu.Unlock()
+	s.sendQuietHoursSummaries()
+	waitFor(t, func() bool {
+		mailer.mu.Lock()
+		defer mailer.mu.Unlock()
+		return mailer.count == 2
+	})
+	s.mu.Lock()
+	require.Equal(t, 0, len(s.quietHours))
+	s.mu.Unlock()
+
+	// Remove quiet hours
+	rr = request(t, s, "PATCH", "/v1/account/subscription", `{"base_url": "`+s.config().BaseURL+`", "topic": "mytopic", "quiet_hours": {"start": "", "end": ""}}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	sub, _ = util.UnmarshalJSON[user.Subscription](io.NopCloser(rr.Body))
+	require.Nil(t, sub.QuietHours)
+}
+
+func TestAccount_Subscription_Routing(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+	mailer := &testMailer{}
+	setTestMailer(s, mailer)
+	sender := newTestFirebaseSender(10)
+	s.firebaseClient = newFirebaseClient(sender, &testAuther{Allow: true})
+
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.AddReservation("phil", "mytopic", user.PermissionDenyAll))
+	headers := map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	}
+
+	// Invalid routing
+	rr := request(t, s, "POST", "/v1/account/subscription", `{"base_url": "`+s.config().BaseURL+`", "topic": "mytopic", "routing": {"channels": ["webhook"]}}`, headers)
+	require.Equal(t, 400, rr.Code)
+	require.Equal(t, 40093, toHTTPError(t, rr.Body.String()).Code)
+	rr = request(t, s, "POST", "/v1/account/subscription", `{"base_url": "`+s.config().BaseURL+`", "topic": "mytopic", "routing": {"channels": ["push"], "priority": 6}}`, headers)
+	require.Equal(t, 400, rr.Code)
+
+	// Only push notifications, and only for high-priority messages
+	rr = request(t, s, "POST", "/v1/account/subscription", `{"base_url": "`+s.config().BaseURL+`", "topic": "mytopic", "routing": {"channels": ["push"], "priority": 4}}`, headers)
+	require.Equal(t, 200, rr.Code)
+	sub, _ := util.UnmarshalJSON[user.Subscription](io.NopCloser(rr.Body))
+	require.Equal(t, &user.Routing{Channels: []string{"push"}, Priority: 4}, sub.Routing)
+
+	rr = request(t, s, "PUT", "/mytopic", "backup done", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+		"Email":         "phil@example.com",
+	})
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "PUT", "/mytopic", "disk full", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+		"Priority":      "5",
+		"Email":         "phil@example.com",
+	})
+	require.Equal(t, 200, rr.Code)
+	waitFor(t, func() bool {
+		return len(sender.Messages()) == 1
+	})
+	require.Equal(t, "disk full", sender.Messages()[0].Data["message"])
+	mailer.mu.Lock()
+	require.Equal(t, 0, mailer.count)
+	mailer.mu.Unlock()
+
+	// Both messages are still cached
+	rr = request(t, s, "GET", "/mytopic/json?poll=1", "", headers)
+	require.Equal(t, 2, len(toMessages(t, rr.Body.String())))
+
+	// Web push subscriptions of the user are routed the same way
+	u, err := s.userManager.User("phil")
+	require.Nil(t, err)
+	require.False(t, s.webPushRoutingAllows(&webPushSubscription{UserID: u.ID}, &message{Topic: "mytopic", Priority: 3}))
+	require.True(t, s.webPushRoutingAllows(&webPushSubscription{UserID: u.ID}, &message{Topic: "mytopic", Priority: 4}))
+	require.True(t, s.webPushRoutingAllows(&webPushSubscription{UserID: u.ID}, &message{Topic: "othertopic", Priority: 1}))
+	require.True(t, s.webPushRoutingAllows(&webPushSubscription{}, &message{Topic: "mytopic", Priority: 1}))
+
+	// No channels at all
+	rr = request(t, s, "PATCH", "/v1/account/subscription", `{"base_url": "`+s.config().BaseURL+`", "topic": "mytopic", "routing": {"channels": []}}`, headers)
+	require.Equal(t, 200, rr.Code)
+	require.False(t, s.webPushRoutingAllows(&webPushSubscription{UserID: u.ID}, &message{Topic: "mytopic", Priority: 5}))
+
+	// Remove routing
+	rr = request(t, s, "PATCH", "/v1/account/subscription", `{"base_url": "`+s.config().BaseURL+`", "topic": "mytopic", "routing": {}}`, headers)
+	require.Equal(t, 200, rr.Code)
+	sub, _ = util.UnmarshalJSON[user.Subscription](io.NopCloser(rr.Body))
+	require.Nil(t, sub.Routing)
+	require.True(t, s.webPushRoutingAllows(&webPushSubscription{UserID: u.ID}, &message{Topic: "mytopic", Priority: 1}))
+}
+
+func TestAccount_Subscription_QuietHours_Summary(t *testing.T) {
+	queue := &quietHoursQueue{
+		topic: "mytopic",
+		messages: []*message{
+			{Title: "Backup", Message: "backup done"},
+			{Message: strings.Repeat("x", 150)},
+		},
+		count: 12,
+	}
+	m := newQuietHoursSummaryMessage(queue)
+	require.Equal(t, "mytopic", m.Topic)
+	require.Equal(t, "Quiet hours summary", m.Title)
+	require.Equal(t, "12 notifications were held back during quiet hours:\n- Backup: backup done\n- "+strings.Repeat("x", 100)+"…\n… and 10 more", m.Message)
+}
+
+func TestAccount_Subscription_ReadStateAndNotificationPrefs(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	headers := map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	}
+	rr := request(t, s, "POST", "/v1/account/subscription", `{"base_url": "http://abc.com", "topic": "def"}`, headers)
+	require.Equal(t, 200, rr.Code)
+
+	// Read on the web app
+	rr = request(t, s, "PATCH", "/v1/account/subscription", `{"base_url": "http://abc.com", "topic": "def", "last_read": {"id": "aaaaaaaaaaaa", "time": 1700000100}, "notification": {"min_priority": 3, "sound": "ding"}}`, headers)
+	require.Equal(t, 200, rr.Code)
+
+	// An outdated device cannot move the read marker backwards, and only changes the notification settings it sets
+	rr = request(t, s, "PATCH", "/v1/account/subscription", `{"base_url": "http://abc.com", "topic": "def", "last_read": {"id": "bbbbbbbbbbbb", "time": 1700000050}, "notification": {"min_priority": 4}}`, headers)
+	require.Equal(t, 200, rr.Code)
+	sub, _ := util.UnmarshalJSON[user.Subscription](io.NopCloser(rr.Body))
+	require.Equal(t, &user.ReadMarker{ID: "aaaaaaaaaaaa", Time: 1700000100}, sub.LastRead) // Response contains the winning marker
+	require.Equal(t, util.Int(4), sub.Notification.MinPriority)
+	require.Equal(t, util.String("ding"), sub.Notification.Sound)
+
+	// Newer markers win
+	rr = request(t, s, "PATCH", "/v1/account/subscription", `{"base_url": "http://abc.com", "topic": "def", "last_read": {"id": "cccccccccccc", "time": 1700000200}}`, headers)
+	require.Equal(t, 200, rr.Code)
+
+	rr = request(t, s, "GET", "/v1/account", "", headers)
+	require.Equal(t, 200, rr.Code)
+	account, _ := util.UnmarshalJSON[apiAccountResponse](io.NopCloser(rr.Body))
+	require.Equal(t, 1, len(account.Subscriptions))
+	require.Equal(t, &user.ReadMarker{ID: "cccccccccccc", Time: 1700000200}, account.Subscriptions[0].LastRead)
+	require.Equal(t, util.Int(4), account.Subscriptions[0].Notification.MinPriority)
+
+	// Remove notification overrides
+	rr = request(t, s, "PATCH", "/v1/account/subscription", `{"base_url": "http://abc.com", "topic": "def", "notification": {}}`, headers)
+	require.Equal(t, 200, rr.Code)
+	sub, _ = util.UnmarshalJSON[user.Subscription](io.NopCloser(rr.Body))
+	require.Nil(t, sub.Notification)
+	require.Equal(t, "cccccccccccc", sub.LastRead.ID)
+
+	// Invalid values
+	rr = request(t, s, "PATCH", "/v1/account/subscription", `{"base_url": "http://abc.com", "topic": "def", "last_read": {"id": "not an ID", "time": 1700000300}}`, headers)
+	require.Equal(t, 400, rr.Code)
+	require.Equal(t, 40081, toHTTPError(t, rr.Body.String()).Code)
+
+	rr = request(t, s, "PATCH", "/v1/account/subscription", `{"base_url": "http://abc.com", "topic": "def", "notification": {"min_priority": 6}}`, headers)
+	require.Equal(t, 400, rr.Code)
+	require.Equal(t, 40007, toHTTPError(t, rr.Body.String()).Code)
+}
+
 func TestAccount_ChangePassword(t *testing.T) {
 	s := newTestServer(t, newTestConfigWithAuthFile(t))
 	defer s.closeDatabases()
@@ -283,6 +626,57 @@ func TestAccount_ChangePassword(t *testing.T) {
 	require.Equal(t, 200, rr.Code)
 }
 
+func TestAccount_ChangeUsername(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	require.Nil(t, s.userManager.AllowAccess("phil", "mytopic", user.PermissionReadWrite))
+	u, err := s.userManager.User("phil")
+	require.Nil(t, err)
+	token, err := s.userManager.CreateToken(u.ID, "", user.TokenTypeWeb, time.Unix(0, 0), netip.IPv4Unspecified())
+	require.Nil(t, err)
+
+	// Wrong password, invalid or existing username
+	rr := request(t, s, "PATCH", "/v1/account", `{"username": "philipp", "password": "WRONG"}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 40026, toHTTPError(t, rr.Body.String()).Code)
+	rr = request(t, s, "PATCH", "/v1/account", `{"username": "not valid", "password": "phil"}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 40046, toHTTPError(t, rr.Body.String()).Code)
+	rr = request(t, s, "PATCH", "/v1/account", `{"username": "ben", "password": "phil"}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 409, rr.Code)
+
+	// Rename
+	rr = request(t, s, "PATCH", "/v1/account", `{"username": "philipp", "password": "phil"}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+
+	// Old name does not work anymore, new name and existing token do
+	rr = request(t, s, "GET", "/v1/account", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 401, rr.Code)
+	rr = request(t, s, "GET", "/v1/account", "", map[string]string{
+		"Authorization": util.BearerAuth(token.Value),
+	})
+	require.Equal(t, 200, rr.Code)
+	account, _ := util.UnmarshalJSON[apiAccountResponse](io.NopCloser(rr.Body))
+	require.Equal(t, "philipp", account.Username)
+
+	// ACL entries are preserved
+	rr = request(t, s, "PUT", "/mytopic", "hi", map[string]string{
+		"Authorization": util.BasicAuth("philipp", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+}
+
 func TestAccount_ChangePassword_NoAccount(t *testing.T) {
 	s := newTestServer(t, newTestConfigWithAuthFile(t))
 	defer s.closeDatabases()
@@ -332,13 +726,250 @@ func TestAccount_ExtendToken_NoTokenProvided(t *testing.T) {
 	s := newTestServer(t, newTestConfigWithAuthFile(t))
 	defer s.closeDatabases()
 
-	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+
+	rr := request(t, s, "PATCH", "/v1/account/token", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"), // Not Bearer!
+	})
+	require.Equal(t, 400, rr.Code)
+	require.Equal(t, 40023, toHTTPError(t, rr.Body.String()).Code)
+}
+
+func TestAccount_CreateScopedToken(t *testing.T) {
+	conf := newTestConfigWithAuthFile(t)
+	conf.AuthDefault = user.PermissionDenyAll
+	s := newTestServer(t, conf)
+	defer s.closeDatabases()
+
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.AllowAccess("phil", "ci_*", user.PermissionReadWrite))
+	require.Nil(t, s.userManager.AllowAccess("phil", "private", user.PermissionReadWrite))
+
+	rr := request(t, s, "POST", "/v1/account/token", `{"label":"ci","scope":{"permission":"write-only","topics":["ci_*"]}}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	token, err := util.UnmarshalJSON[apiAccountTokenResponse](io.NopCloser(rr.Body))
+	require.Nil(t, err)
+	require.Equal(t, "write-only", token.Scope.Permission)
+	require.Equal(t, []string{"ci_*"}, token.Scope.Topics)
+
+	// Publish to topic in scope works, but not subscribe or other topics
+	rr = request(t, s, "PUT", "/ci_builds", "build passed", map[string]string{
+		"Authorization": util.BearerAuth(token.Token),
+	})
+	require.Equal(t, 200, rr.Code)
+
+	rr = request(t, s, "GET", "/ci_builds/json?poll=1", "", map[string]string{
+		"Authorization": util.BearerAuth(token.Token),
+	})
+	require.Equal(t, 403, rr.Code)
+
+	rr = request(t, s, "PUT", "/private", "not allowed", map[string]string{
+		"Authorization": util.BearerAuth(token.Token),
+	})
+	require.Equal(t, 403, rr.Code)
+
+	// Scoped tokens cannot manage the account, or see other tokens
+	rr = request(t, s, "POST", "/v1/account/token", "", map[string]string{
+		"Authorization": util.BearerAuth(token.Token),
+	})
+	require.Equal(t, 403, rr.Code)
+	require.Equal(t, 40302, toHTTPError(t, rr.Body.String()).Code)
+
+	rr = request(t, s, "GET", "/v1/account", "", map[string]string{
+		"Authorization": util.BearerAuth(token.Token),
+	})
+	require.Equal(t, 200, rr.Code)
+	account, err := util.UnmarshalJSON[apiAccountResponse](io.NopCloser(rr.Body))
+	require.Nil(t, err)
+	require.Equal(t, "phil", account.Username)
+	require.Nil(t, account.Tokens)
+
+	// Invalid scope
+	rr = request(t, s, "POST", "/v1/account/token", `{"scope":{"permission":"deny-all"}}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 400, rr.Code)
+	require.Equal(t, 40025, toHTTPError(t, rr.Body.String()).Code)
+}
+
+func TestAccount_ScopedToken_Admin(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	u, err := s.userManager.User("phil")
+	require.Nil(t, err)
+	token, err := s.userManager.CreateScopedToken(u.ID, "device", user.TokenTypeIntegration, time.Now().Add(time.Hour), time.Unix(0, 0), netip.IPv4Unspecified(), "", &user.TokenScope{
+		Permission: user.PermissionWrite,
+	})
+	require.Nil(t, err)
+
+	// Scoped tokens of admins cannot be used for admin endpoints, or to create accounts
+	rr := request(t, s, "GET", "/v1/users", "", map[string]string{
+		"Authorization": util.BearerAuth(token.Value),
+	})
+	require.Equal(t, 403, rr.Code)
+	require.Equal(t, 40302, toHTTPError(t, rr.Body.String()).Code)
+
+	rr = request(t, s, "POST", "/v1/account", `{"username":"ben", "password":"ben"}`, map[string]string{
+		"Authorization": util.BearerAuth(token.Value),
+	})
+	require.Equal(t, 403, rr.Code)
+
+	// Unscoped admin access still works
+	rr = request(t, s, "GET", "/v1/users", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+}
+
+func TestAccount_CreateToken_HardExpires(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+
+	hardExpires := time.Now().Add(time.Hour).Unix()
+	rr := request(t, s, "POST", "/v1/account/token", fmt.Sprintf(`{"hard_expires":%d}`, hardExpires), map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	token, err := util.UnmarshalJSON[apiAccountTokenResponse](io.NopCloser(rr.Body))
+	require.Nil(t, err)
+	require.Equal(t, hardExpires, token.HardExpires)
+	require.Equal(t, hardExpires, token.Expires) // Default expiry (72h) is capped
+
+	rr = request(t, s, "PATCH", "/v1/account/token", "", map[string]string{
+		"Authorization": util.BearerAuth(token.Token),
+	})
+	require.Equal(t, 200, rr.Code)
+	token, err = util.UnmarshalJSON[apiAccountTokenResponse](io.NopCloser(rr.Body))
+	require.Nil(t, err)
+	require.Equal(t, hardExpires, token.Expires)
+}
+
+func TestAccount_CreateToken_TypesAndList(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+
+	// Login without label: web session
+	rr := request(t, s, "POST", "/v1/account/token", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+		"User-Agent":    "Mozilla/5.0",
+	})
+	require.Equal(t, 200, rr.Code)
+	token, err := util.UnmarshalJSON[apiAccountTokenResponse](io.NopCloser(rr.Body))
+	require.Nil(t, err)
+	require.Equal(t, "web", token.Type)
+	require.Equal(t, "9.9.9.9", token.CreatedOrigin)
+	require.Equal(t, "Mozilla/5.0", token.CreatedUserAgent)
+	require.True(t, token.Created > 0)
+	webToken := token.Token
+
+	// Label without type: integration
+	rr = request(t, s, "POST", "/v1/account/token", `{"label":"backup script"}`, map[string]string{
+		"Authorization": util.BearerAuth(webToken),
+	})
+	require.Equal(t, 200, rr.Code)
+	token, err = util.UnmarshalJSON[apiAccountTokenResponse](io.NopCloser(rr.Body))
+	require.Nil(t, err)
+	require.Equal(t, "integration", token.Type)
+
+	// Explicit type
+	rr = request(t, s, "POST", "/v1/account/token", `{"label":"laptop","type":"cli"}`, map[string]string{
+		"Authorization": util.BearerAuth(webToken),
+	})
+	require.Equal(t, 200, rr.Code)
+
+	// Invalid type
+	rr = request(t, s, "POST", "/v1/account/token", `{"type":"robot"}`, map[string]string{
+		"Authorization": util.BearerAuth(webToken),
+	})
+	require.Equal(t, 400, rr.Code)
+	require.Equal(t, 40059, toHTTPError(t, rr.Body.String()).Code)
+
+	// List tokens
+	rr = request(t, s, "GET", "/v1/account/token", "", map[string]string{
+		"Authorization": util.BearerAuth(webToken),
+	})
+	require.Equal(t, 200, rr.Code)
+	tokens, err := util.UnmarshalJSON[[]*apiAccountTokenResponse](io.NopCloser(rr.Body))
+	require.Nil(t, err)
+	require.Equal(t, 3, len(*tokens))
+	types := make(map[string]string)
+	for _, t := range *tokens {
+		types[t.Label] = t.Type
+	}
+	require.Equal(t, map[string]string{"": "web", "backup script": "integration", "laptop": "cli"}, types)
+
+	// Anonymous users cannot list tokens
+	rr = request(t, s, "GET", "/v1/account/token", "", nil)
+	require.Equal(t, 401, rr.Code)
+}
+
+func TestAccount_RotateToken(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	u, err := s.userManager.User("phil")
+	require.Nil(t, err)
+	token, err := s.userManager.CreateToken(u.ID, "backups", user.TokenTypeIntegration, time.Unix(0, 0), netip.IPv4Unspecified())
+	require.Nil(t, err)
+
+	rr := request(t, s, "POST", "/v1/account/token/rotate", fmt.Sprintf(`{"token":"%s"}`, token.Value), map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	rotated, err := util.UnmarshalJSON[apiAccountTokenRotateResponse](io.NopCloser(rr.Body))
+	require.Nil(t, err)
+	require.NotEqual(t, token.Value, rotated.Token.Token)
+	require.Equal(t, "backups", rotated.Token.Label)
+	require.Equal(t, "integration", rotated.Token.Type)
+	require.Equal(t, int64(0), rotated.Token.Expires)
+	require.Equal(t, token.Value, rotated.Previous.Token)
+	require.True(t, rotated.Previous.Expires > time.Now().Add(59*time.Minute).Unix())
+	require.True(t, rotated.Previous.Expires <= time.Now().Add(time.Hour).Unix())
+
+	// Both tokens work during the grace period
+	for _, tk := range []string{token.Value, rotated.Token.Token} {
+		rr = request(t, s, "GET", "/v1/account", "", map[string]string{
+			"Authorization": util.BearerAuth(tk),
+		})
+		require.Equal(t, 200, rr.Code)
+	}
+
+	// Rotate token used for auth, without grace period
+	rr = request(t, s, "POST", "/v1/account/token/rotate", `{"grace_period":0}`, map[string]string{
+		"Authorization": util.BearerAuth(rotated.Token.Token),
+	})
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "GET", "/v1/account", "", map[string]string{
+		"Authorization": util.BearerAuth(rotated.Token.Token),
+	})
+	require.Equal(t, 401, rr.Code)
+
+	// Errors
+	rr = request(t, s, "POST", "/v1/account/token/rotate", `{"token":"tk_doesnotexist"}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 404, rr.Code)
+	require.Equal(t, 40403, toHTTPError(t, rr.Body.String()).Code)
 
-	rr := request(t, s, "PATCH", "/v1/account/token", "", map[string]string{
-		"Authorization": util.BasicAuth("phil", "phil"), // Not Bearer!
+	rr = request(t, s, "POST", "/v1/account/token/rotate", fmt.Sprintf(`{"token":"%s","grace_period":99999999}`, token.Value), map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 400, rr.Code)
+	require.Equal(t, 40063, toHTTPError(t, rr.Body.String()).Code)
+
+	rr = request(t, s, "POST", "/v1/account/token/rotate", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
 	})
 	require.Equal(t, 400, rr.Code)
-	require.Equal(t, 40023, toHTTPError(t, rr.Body.String()).Code)
 }
 
 func TestAccount_DeleteToken(t *testing.T) {
@@ -654,25 +1285,25 @@ func TestAccount_Reservation_Delete_Messages_And_Attachments(t *testing.T) {
 	})
 	require.Equal(t, 200, rr.Code)
 	m1 := toMessage(t, rr.Body.String())
-	require.FileExists(t, filepath.Join(s.config.AttachmentCacheDir, m1.ID))
+	require.FileExists(t, filepath.Join(s.config().AttachmentCacheDir, m1.ID))
 
 	rr = request(t, s, "POST", "/mytopic2?f=attach.txt", `Howdy`, map[string]string{
 		"Authorization": util.BasicAuth("phil", "mypass"),
 	})
 	require.Equal(t, 200, rr.Code)
 	m2 := toMessage(t, rr.Body.String())
-	require.FileExists(t, filepath.Join(s.config.AttachmentCacheDir, m2.ID))
+	require.FileExists(t, filepath.Join(s.config().AttachmentCacheDir, m2.ID))
 
 	// Pre-verify message count and file
 	ms, err := s.messageCache.Messages("mytopic1", sinceAllMessages, false)
 	require.Nil(t, err)
 	require.Equal(t, 1, len(ms))
-	require.FileExists(t, filepath.Join(s.config.AttachmentCacheDir, m1.ID))
+	require.FileExists(t, filepath.Join(s.config().AttachmentCacheDir, m1.ID))
 
 	ms, err = s.messageCache.Messages("mytopic2", sinceAllMessages, false)
 	require.Nil(t, err)
 	require.Equal(t, 1, len(ms))
-	require.FileExists(t, filepath.Join(s.config.AttachmentCacheDir, m2.ID))
+	require.FileExists(t, filepath.Join(s.config().AttachmentCacheDir, m2.ID))
 
 	// Delete reservation
 	rr = request(t, s, "DELETE", "/v1/account/reservation/mytopic1", ``, map[string]string{
@@ -692,19 +1323,19 @@ func TestAccount_Reservation_Delete_Messages_And_Attachments(t *testing.T) {
 	waitFor(t, func() bool {
 		ms, err := s.messageCache.Messages("mytopic1", sinceAllMessages, false)
 		require.Nil(t, err)
-		return len(ms) == 0 && !util.FileExists(filepath.Join(s.config.AttachmentCacheDir, m1.ID))
+		return len(ms) == 0 && !util.FileExists(filepath.Join(s.config().AttachmentCacheDir, m1.ID))
 	})
 
 	ms, err = s.messageCache.Messages("mytopic1", sinceAllMessages, false)
 	require.Nil(t, err)
 	require.Equal(t, 0, len(ms))
-	require.NoFileExists(t, filepath.Join(s.config.AttachmentCacheDir, m1.ID))
+	require.NoFileExists(t, filepath.Join(s.config().AttachmentCacheDir, m1.ID))
 
 	ms, err = s.messageCache.Messages("mytopic2", sinceAllMessages, false)
 	require.Nil(t, err)
 	require.Equal(t, 1, len(ms))
 	require.Equal(t, m2.ID, ms[0].ID)
-	require.FileExists(t, filepath.Join(s.config.AttachmentCacheDir, m2.ID))
+	require.FileExists(t, filepath.Join(s.config().AttachmentCacheDir, m2.ID))
 }
 
 /*func TestAccount_Persist_UserStats_After_Tier_Change(t *testing.T) {
@@ -769,3 +1400,465 @@ func TestAccount_Reservation_Delete_Messages_And_Attachments(t *testing.T) {
 	account, _ = util.UnmarshalJSON[apiAccountResponse](io.NopCloser(rr.Body))
 	require.Equal(t, int64(2), account.Stats.Messages) // Is not reset!
 }*/
+
+func TestAccount_Reservation_Managers(t *testing.T) {
+	t.Parallel()
+	conf := newTestConfigWithAuthFile(t)
+	conf.AuthDefault = user.PermissionDenyAll
+	s := newTestServer(t, conf)
+
+	// Create users, phil has a tier with reservations
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	require.Nil(t, s.userManager.AddUser("emma", "emma", user.RoleUser))
+	require.Nil(t, s.userManager.AddTier(&user.Tier{
+		Code:                     "pro",
+		MessageLimit:             20,
+		MessageExpiryDuration:    time.Hour,
+		ReservationLimit:         2,
+		AttachmentTotalSizeLimit: 10000,
+		AttachmentFileSizeLimit:  10000,
+		AttachmentExpiryDuration: time.Hour,
+		AttachmentBandwidthLimit: 10000,
+	}))
+	require.Nil(t, s.userManager.ChangeTier("phil", "pro"))
+	philAuth := map[string]string{"Authorization": util.BasicAuth("phil", "phil")}
+	benAuth := map[string]string{"Authorization": util.BasicAuth("ben", "ben")}
+	emmaAuth := map[string]string{"Authorization": util.BasicAuth("emma", "emma")}
+
+	rr := request(t, s, "POST", "/v1/account/reservation", `{"topic": "mytopic", "everyone":"read-only"}`, philAuth)
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "POST", "/mytopic?f=attach.txt", `Howdy`, philAuth)
+	require.Equal(t, 200, rr.Code)
+
+	// Only the owner can delegate, and only to existing users
+	rr = request(t, s, "POST", "/v1/account/reservation/mytopic/managers", `{"username":"ben"}`, emmaAuth)
+	require.Equal(t, 401, rr.Code)
+	rr = request(t, s, "POST", "/v1/account/reservation/mytopic/managers", `{"username":"nobody"}`, philAuth)
+	require.Equal(t, 400, rr.Code)
+	require.Equal(t, 40031, toHTTPError(t, rr.Body.String()).Code)
+	rr = request(t, s, "POST", "/v1/account/reservation/mytopic/managers", `{"username":"ben"}`, philAuth)
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "GET", "/v1/account/reservation/mytopic/managers", "", philAuth)
+	require.Equal(t, 200, rr.Code)
+	managers, err := util.UnmarshalJSON[apiAccountReservationManagersResponse](io.NopCloser(rr.Body))
+	require.Nil(t, err)
+	require.Equal(t, []string{"ben"}, managers.Managers)
+
+	// Managers can view stats and prune messages, others cannot
+	rr = request(t, s, "GET", "/mytopic/stats", "", emmaAuth)
+	require.Equal(t, 403, rr.Code)
+	rr = request(t, s, "GET", "/mytopic/stats", "", benAuth)
+	require.Equal(t, 200, rr.Code)
+	stats, err := util.UnmarshalJSON[apiTopicStatsResponse](io.NopCloser(rr.Body))
+	require.Nil(t, err)
+	require.Equal(t, "mytopic", stats.Topic)
+	require.Equal(t, 1, stats.Messages)
+	require.Equal(t, int64(5), stats.AttachmentsSize)
+
+	rr = request(t, s, "DELETE", "/mytopic/messages", "", emmaAuth)
+	require.Equal(t, 403, rr.Code)
+	rr = request(t, s, "DELETE", "/mytopic/messages", "", benAuth)
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "GET", "/mytopic/json?poll=1", "", philAuth)
+	require.Equal(t, 0, len(toMessages(t, rr.Body.String())))
+
+	// Managers cannot delegate further; revoking removes access to the scoped endpoints
+	rr = request(t, s, "POST", "/v1/account/reservation/mytopic/managers", `{"username":"emma"}`, benAuth)
+	require.Equal(t, 401, rr.Code)
+	rr = request(t, s, "DELETE", "/v1/account/reservation/mytopic/managers", `{"username":"ben"}`, philAuth)
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "GET", "/mytopic/stats", "", benAuth)
+	require.Equal(t, 403, rr.Code)
+	rr = request(t, s, "GET", "/mytopic/stats", "", philAuth)
+	require.Equal(t, 200, rr.Code)
+
+	// Access granted by an admin cannot be taken over by the owner
+	require.Nil(t, s.userManager.AllowAccess("emma", "mytopic", user.PermissionRead))
+	rr = request(t, s, "POST", "/v1/account/reservation/mytopic/managers", `{"username":"emma"}`, philAuth)
+	require.Equal(t, 409, rr.Code)
+	require.Equal(t, 40908, toHTTPError(t, rr.Body.String()).Code)
+}
+
+func TestAccount_Reservation_Members_Transfer(t *testing.T) {
+	t.Parallel()
+	conf := newTestConfigWithAuthFile(t)
+	conf.AuthDefault = user.PermissionDenyAll
+	conf.EnableReservations = true
+	s := newTestServer(t, conf)
+
+	// Create users, phil and ben have a tier with reservations
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	require.Nil(t, s.userManager.AddUser("emma", "emma", user.RoleUser))
+	require.Nil(t, s.userManager.AddTier(&user.Tier{
+		Code:             "pro",
+		MessageLimit:     20,
+		ReservationLimit: 1,
+	}))
+	require.Nil(t, s.userManager.ChangeTier("phil", "pro"))
+	require.Nil(t, s.userManager.ChangeTier("ben", "pro"))
+	philAuth := map[string]string{"Authorization": util.BasicAuth("phil", "phil")}
+	benAuth := map[string]string{"Authorization": util.BasicAuth("ben", "ben")}
+	emmaAuth := map[string]string{"Authorization": util.BasicAuth("emma", "emma")}
+
+	rr := request(t, s, "POST", "/v1/account/reservation", `{"topic": "mytopic", "everyone":"deny-all"}`, philAuth)
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "POST", "/v1/account/reservation", `{"topic": "bentopic", "everyone":"deny-all"}`, benAuth)
+	require.Equal(t, 200, rr.Code)
+
+	// Only the owner can add members, with a valid permission
+	rr = request(t, s, "POST", "/v1/account/reservation/mytopic/members", `{"username":"emma"}`, benAuth)
+	require.Equal(t, 401, rr.Code)
+	rr = request(t, s, "POST", "/v1/account/reservation/mytopic/members", `{"username":"emma", "permission":"deny-all"}`, philAuth)
+	require.Equal(t, 40025, toHTTPError(t, rr.Body.String()).Code)
+	rr = request(t, s, "POST", "/v1/account/reservation/mytopic/members", `{"username":"emma", "permission":"read-only"}`, philAuth)
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "GET", "/v1/account/reservation/mytopic/members", "", philAuth)
+	require.Equal(t, 200, rr.Code)
+	members, err := util.UnmarshalJSON[apiAccountReservationMembersResponse](io.NopCloser(rr.Body))
+	require.Nil(t, err)
+	require.Equal(t, 1, len(members.Members))
+	require.Equal(t, "emma", members.Members[0].Username)
+	require.Equal(t, "read-only", members.Members[0].Permission)
+
+	// Members can read, but not write
+	rr = request(t, s, "POST", "/mytopic", "hi from phil", philAuth)
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "GET", "/mytopic/json?poll=1", "", emmaAuth)
+	require.Equal(t, 200, rr.Code)
+	require.Equal(t, 1, len(toMessages(t, rr.Body.String())))
+	rr = request(t, s, "POST", "/mytopic", "hi from emma", emmaAuth)
+	require.Equal(t, 403, rr.Code)
+
+	// Transfer fails if the new owner has no reservations left, or no tier
+	rr = request(t, s, "POST", "/v1/account/reservation/mytopic/transfer", `{"username":"ben"}`, philAuth)
+	require.Equal(t, 42907, toHTTPError(t, rr.Body.String()).Code)
+	rr = request(t, s, "POST", "/v1/account/reservation/mytopic/transfer", `{"username":"emma"}`, philAuth)
+	require.Equal(t, 42907, toHTTPError(t, rr.Body.String()).Code)
+	rr = request(t, s, "POST", "/v1/account/reservation/mytopic/transfer", `{"username":"nobody"}`, philAuth)
+	require.Equal(t, 40031, toHTTPError(t, rr.Body.String()).Code)
+
+	// Transfer to ben, phil stays a member
+	rr = request(t, s, "DELETE", "/v1/account/reservation/bentopic", "", benAuth)
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "POST", "/v1/account/reservation/mytopic/transfer", `{"username":"ben"}`, philAuth)
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "GET", "/v1/account", "", benAuth)
+	account, err := util.UnmarshalJSON[apiAccountResponse](io.NopCloser(rr.Body))
+	require.Nil(t, err)
+	require.Equal(t, 1, len(account.Reservations))
+	require.Equal(t, "mytopic", account.Reservations[0].Topic)
+	rr = request(t, s, "GET", "/v1/account/reservation/mytopic/members", "", philAuth)
+	require.Equal(t, 401, rr.Code)
+	rr = request(t, s, "GET", "/v1/account/reservation/mytopic/members", "", benAuth)
+	require.Equal(t, 200, rr.Code)
+	members, err = util.UnmarshalJSON[apiAccountReservationMembersResponse](io.NopCloser(rr.Body))
+	require.Nil(t, err)
+	require.Equal(t, 2, len(members.Members))
+	require.Equal(t, "emma", members.Members[0].Username)
+	require.Equal(t, "phil", members.Members[1].Username)
+	require.Equal(t, "read-write", members.Members[1].Permission)
+	rr = request(t, s, "POST", "/mytopic", "hi from phil", philAuth)
+	require.Equal(t, 200, rr.Code)
+
+	// New owner removes the previous owner
+	rr = request(t, s, "DELETE", "/v1/account/reservation/mytopic/members", `{"username":"phil"}`, benAuth)
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "POST", "/mytopic", "hi from phil", philAuth)
+	require.Equal(t, 403, rr.Code)
+}
+
+func TestAccount_UnifiedPushEndpoints(t *testing.T) {
+	t.Parallel()
+	conf := newTestConfigWithAuthFile(t)
+	conf.AuthDefault = user.PermissionReadWrite
+	s := newTestServer(t, conf)
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+
+	subscribeRR := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/upAAAAAAAAAAAA,mytopic/json", nil)
+	req.Header.Set("Authorization", util.BasicAuth("phil", "phil"))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan bool)
+	go func() {
+		s.handle(subscribeRR, req.WithContext(ctx))
+		done <- true
+	}()
+	waitFor(t, func() bool {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		topic, ok := s.topics.Get("upAAAAAAAAAAAA")
+		if !ok {
+			return false
+		}
+		subscribers, _ := topic.Stats()
+		return subscribers == 1
+	})
+	for i := 0; i < 3; i++ {
+		rr := request(t, s, "PUT", "/upAAAAAAAAAAAA?up=1", "hi", nil)
+		require.Equal(t, 200, rr.Code)
+	}
+	rr := request(t, s, "PUT", "/upBBBBBBBBBBBB?up=1", "not subscribed", nil)
+	require.Equal(t, 200, rr.Code)
+
+	rr = request(t, s, "GET", "/v1/account/up-endpoints", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	endpoints, err := util.UnmarshalJSON[apiAccountUnifiedPushEndpointsResponse](io.NopCloser(rr.Body))
+	require.Nil(t, err)
+	require.Equal(t, 1, len(endpoints.Endpoints))
+	require.Equal(t, "upAAAAAAAAAAAA", endpoints.Endpoints[0].Topic)
+	require.Equal(t, 1, endpoints.Endpoints[0].Subscribers)
+	require.Equal(t, 3, endpoints.Endpoints[0].MessagesToday)
+	require.Equal(t, 1, len(endpoints.Endpoints[0].Days))
+	require.Equal(t, time.Now().Format(time.DateOnly), endpoints.Endpoints[0].Days[0].Date)
+
+	cancel()
+	<-done
+
+	rr = request(t, s, "GET", "/v1/account/up-endpoints", "", nil)
+	require.Equal(t, 401, rr.Code)
+}
+
+func TestAccount_TOTP(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+
+	rr := request(t, s, "GET", "/v1/account/2fa", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	status, _ := util.UnmarshalJSON[apiAccountTOTPResponse](io.NopCloser(rr.Body))
+	require.False(t, status.Enabled)
+
+	// Enroll and enable, both require the password
+	rr = request(t, s, "POST", "/v1/account/2fa", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 400, rr.Code)
+	rr = request(t, s, "POST", "/v1/account/2fa", `{"password":"wrong"}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 400, rr.Code)
+	require.Equal(t, errHTTPBadRequestIncorrectPasswordConfirmation.Code, toHTTPError(t, rr.Body.String()).Code)
+	rr = request(t, s, "POST", "/v1/account/2fa", `{"password":"phil"}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	enroll, _ := util.UnmarshalJSON[apiAccountTOTPEnrollResponse](io.NopCloser(rr.Body))
+	require.NotEmpty(t, enroll.Secret)
+	require.True(t, strings.HasPrefix(enroll.URI, "otpauth://totp/"))
+
+	rr = request(t, s, "PUT", "/v1/account/2fa", `{"password":"phil","code":"123"}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 400, rr.Code)
+	require.Equal(t, 40094, toHTTPError(t, rr.Body.String()).Code)
+
+	step := time.Now().Unix() / 30
+	rr = request(t, s, "PUT", "/v1/account/2fa", fmt.Sprintf(`{"code":"%s"}`, testTOTPCode(t, enroll.Secret, step)), map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 400, rr.Code)
+	rr = request(t, s, "PUT", "/v1/account/2fa", fmt.Sprintf(`{"password":"phil","code":"%s"}`, testTOTPCode(t, enroll.Secret, step)), map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	enable, _ := util.UnmarshalJSON[apiAccountTOTPEnableResponse](io.NopCloser(rr.Body))
+	require.Len(t, enable.RecoveryCodes, 10)
+
+	// Password alone is not enough anymore; a code can be sent with several requests while it is valid
+	rr = request(t, s, "GET", "/v1/account", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 401, rr.Code)
+	require.Equal(t, 40102, toHTTPError(t, rr.Body.String()).Code)
+
+	rr = request(t, s, "GET", "/v1/account", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+		"X-TOTP":        "not-a-code",
+	})
+	require.Equal(t, 401, rr.Code)
+	require.Equal(t, 40101, toHTTPError(t, rr.Body.String()).Code)
+
+	rr = request(t, s, "GET", "/v1/account", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+		"X-TOTP":        testTOTPCode(t, enroll.Secret, step+1),
+	})
+	require.Equal(t, 200, rr.Code)
+	account, _ := util.UnmarshalJSON[apiAccountResponse](io.NopCloser(rr.Body))
+	require.True(t, account.TwoFactor)
+
+	rr = request(t, s, "GET", "/v1/account", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+		"X-TOTP":        testTOTPCode(t, enroll.Secret, step+1),
+	})
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "PUT", "/mytopic", "published with the same code", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+		"X-TOTP":        testTOTPCode(t, enroll.Secret, step+1),
+	})
+	require.Equal(t, 200, rr.Code)
+
+	// Recovery codes work exactly once
+	rr = request(t, s, "GET", "/v1/account", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+		"X-TOTP":        enable.RecoveryCodes[0],
+	})
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "GET", "/v1/account", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+		"X-TOTP":        enable.RecoveryCodes[0],
+	})
+	require.Equal(t, 401, rr.Code)
+
+	// Logging in creates a token, which does not need a code; creating another token with it does
+	rr = request(t, s, "POST", "/v1/account/token", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+		"X-TOTP":        enable.RecoveryCodes[1],
+	})
+	require.Equal(t, 200, rr.Code)
+	token, _ := util.UnmarshalJSON[apiAccountTokenResponse](io.NopCloser(rr.Body))
+
+	rr = request(t, s, "GET", "/v1/account/2fa", "", map[string]string{
+		"Authorization": util.BearerAuth(token.Token),
+	})
+	require.Equal(t, 200, rr.Code)
+	status, _ = util.UnmarshalJSON[apiAccountTOTPResponse](io.NopCloser(rr.Body))
+	require.True(t, status.Enabled)
+	require.Equal(t, 8, status.RecoveryCodesLeft)
+
+	rr = request(t, s, "POST", "/v1/account/token", "", map[string]string{
+		"Authorization": util.BearerAuth(token.Token),
+	})
+	require.Equal(t, 401, rr.Code)
+	require.Equal(t, 40102, toHTTPError(t, rr.Body.String()).Code)
+
+	rr = request(t, s, "POST", "/v1/account/token", "", map[string]string{
+		"Authorization": util.BearerAuth(token.Token),
+		"X-TOTP":        testTOTPCode(t, enroll.Secret, step+1), // Already used for Basic auth
+	})
+	require.Equal(t, 401, rr.Code)
+
+	rr = request(t, s, "POST", "/v1/account/token", "", map[string]string{
+		"Authorization": util.BasicAuth("", token.Token),
+		"X-TOTP":        enable.RecoveryCodes[2],
+	})
+	require.Equal(t, 200, rr.Code)
+
+	// Extending and rotating a token with a token also requires a code
+	rr = request(t, s, "PATCH", "/v1/account/token", "", map[string]string{
+		"Authorization": util.BearerAuth(token.Token),
+	})
+	require.Equal(t, 401, rr.Code)
+	require.Equal(t, 40102, toHTTPError(t, rr.Body.String()).Code)
+	rr = request(t, s, "PATCH", "/v1/account/token", "", map[string]string{
+		"Authorization": util.BearerAuth(token.Token),
+		"X-TOTP":        enable.RecoveryCodes[4],
+	})
+	require.Equal(t, 200, rr.Code)
+
+	rr = request(t, s, "POST", "/v1/account/token/rotate", "", map[string]string{
+		"Authorization": util.BearerAuth(token.Token),
+	})
+	require.Equal(t, 401, rr.Code)
+	require.Equal(t, 40102, toHTTPError(t, rr.Body.String()).Code)
+	rr = request(t, s, "POST", "/v1/account/token/rotate", "", map[string]string{
+		"Authorization": util.BearerAuth(token.Token),
+		"X-TOTP":        enable.RecoveryCodes[5],
+	})
+	require.Equal(t, 200, rr.Code)
+	rotated, _ := util.UnmarshalJSON[apiAccountTokenRotateResponse](io.NopCloser(rr.Body))
+	token = rotated.Token
+
+	// Enrolling again fails, disabling requires password and code
+	rr = request(t, s, "POST", "/v1/account/2fa", `{"password":"phil"}`, map[string]string{
+		"Authorization": util.BearerAuth(token.Token),
+	})
+	require.Equal(t, 409, rr.Code)
+	require.Equal(t, 40906, toHTTPError(t, rr.Body.String()).Code)
+
+	rr = request(t, s, "DELETE", "/v1/account/2fa", fmt.Sprintf(`{"password":"wrong","code":"%s"}`, enable.RecoveryCodes[3]), map[string]string{
+		"Authorization": util.BearerAuth(token.Token),
+	})
+	require.Equal(t, 400, rr.Code)
+	rr = request(t, s, "DELETE", "/v1/account/2fa", `{"password":"phil","code":"123"}`, map[string]string{
+		"Authorization": util.BearerAuth(token.Token),
+	})
+	require.Equal(t, 400, rr.Code)
+	require.Equal(t, 40094, toHTTPError(t, rr.Body.String()).Code)
+	rr = request(t, s, "DELETE", "/v1/account/2fa", fmt.Sprintf(`{"password":"phil","code":"%s"}`, enable.RecoveryCodes[3]), map[string]string{
+		"Authorization": util.BearerAuth(token.Token),
+	})
+	require.Equal(t, 200, rr.Code)
+
+	rr = request(t, s, "GET", "/v1/account", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+}
+
+func testTOTPCode(t *testing.T, secret string, step int64) string {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	require.Nil(t, err)
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000)
+}
+
+func TestAccount_Stats(t *testing.T) {
+	conf := newTestConfigWithAuthFile(t)
+	conf.AuthDefault = user.PermissionReadWrite
+	conf.AuthStatsQueueWriterInterval = 100 * time.Millisecond
+	s := newTestServer(t, conf)
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	phil := map[string]string{"Authorization": util.BasicAuth("phil", "phil")}
+
+	require.Equal(t, 401, request(t, s, "GET", "/v1/account/stats", "", nil).Code)
+
+	require.Equal(t, 200, request(t, s, "PUT", "/mytopic", "message 1", phil).Code)
+	require.Equal(t, 200, request(t, s, "PUT", "/mytopic", "message 2", phil).Code)
+	require.Equal(t, 200, request(t, s, "PUT", "/mytopic?f=file.txt", "some attachment", phil).Code)
+	require.Equal(t, 200, request(t, s, "PUT", "/another", "message 3", phil).Code)
+	require.Equal(t, 200, request(t, s, "PUT", "/anonymous", "not counted", nil).Code)
+
+	var stats *apiAccountStatsResponse
+	waitFor(t, func() bool {
+		rr := request(t, s, "GET", "/v1/account/stats", "", phil)
+		require.Equal(t, 200, rr.Code)
+		stats, _ = util.UnmarshalJSON[apiAccountStatsResponse](io.NopCloser(rr.Body))
+		return len(stats.Stats) == 1 && stats.Stats[0].Messages == 4
+	})
+	require.Equal(t, "day", stats.Granularity)
+	require.Equal(t, time.Now().Truncate(24*time.Hour).Add(-29*24*time.Hour).Unix(), stats.Since)
+	period := stats.Stats[0]
+	require.Equal(t, time.Now().Truncate(24*time.Hour).Unix(), period.Time)
+	require.Equal(t, int64(len("some attachment")), period.AttachmentBytes)
+	require.Len(t, period.Topics, 2)
+	require.Equal(t, "another", period.Topics[0].Topic)
+	require.Equal(t, int64(1), period.Topics[0].Messages)
+	require.Equal(t, "mytopic", period.Topics[1].Topic)
+	require.Equal(t, int64(3), period.Topics[1].Messages)
+
+	rr := request(t, s, "GET", "/v1/account/stats?granularity=hour&days=1", "", phil)
+	require.Equal(t, 200, rr.Code)
+	stats, _ = util.UnmarshalJSON[apiAccountStatsResponse](io.NopCloser(rr.Body))
+	require.Equal(t, "hour", stats.Granularity)
+	require.Len(t, stats.Stats, 1)
+	require.Equal(t, time.Now().Truncate(time.Hour).Unix(), stats.Stats[0].Time)
+
+	for _, query := range []string{"granularity=week", "days=0", "days=91", "days=abc", "granularity=hour&days=8"} {
+		rr = request(t, s, "GET", "/v1/account/stats?"+query, "", phil)
+		require.Equal(t, 400, rr.Code, query)
+		require.Equal(t, 40098, toHTTPError(t, rr.Body.String()).Code)
+	}
+}
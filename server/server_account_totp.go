@@ -0,0 +1,182 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"heckel.io/ntfy/v2/user"
+)
+
+// Two-factor authentication (2FA) protects accounts with time-based one-time passwords (TOTP) from an authenticator
+// app, in addition to the password (see user/totp.go):
+//
+//   - GET /v1/account/2fa returns whether 2FA is enabled, and the number of unused recovery codes
+//   - POST /v1/account/2fa {"password":"..."} creates a new (pending) TOTP secret, and returns it along with an
+//     otpauth:// URI
+//   - PUT /v1/account/2fa {"password":"...","code":"123456"} confirms the secret with a code, enables 2FA, and
+//     returns recovery codes
+//   - DELETE /v1/account/2fa {"password":"...","code":"123456"} disables 2FA
+//
+// Once enabled, logging in with username and password (Basic auth) requires a TOTP code (or a recovery code) in the
+// X-TOTP header, see authenticateBasicAuth. If it is missing, the server responds with errHTTPUnauthorizedTOTPRequired,
+// so that clients can ask for it. A code can be sent with any number of Basic auth requests while it is valid (e.g.
+// by the CLI or curl), but it can not be used again to create, rotate, or update a token with an existing token. Creating a new access token with an existing token also requires a code. Existing
+// tokens stay valid, so that apps and scripts can keep using them without a code.
+
+// handleAccountTOTPGet returns the 2FA status of the account
+func (s *Server) handleAccountTOTPGet(w http.ResponseWriter, _ *http.Request, v *visitor) error {
+	u := v.User()
+	enabled, err := s.userManager.TOTPEnabled(u.ID)
+	if err != nil {
+		return err
+	}
+	response := &apiAccountTOTPResponse{
+		Enabled: enabled,
+	}
+	if enabled {
+		response.RecoveryCodesLeft, err = s.userManager.TOTPRecoveryCodesLeft(u.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return s.writeJSON(w, response)
+}
+
+// handleAccountTOTPEnroll creates a new TOTP secret for the account, which must be confirmed via handleAccountTOTPEnable.
+// Like enabling and disabling 2FA, it requires the password, so that a stolen session cannot set up its own secret.
+func (s *Server) handleAccountTOTPEnroll(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	req, err := readJSONWithLimit[apiAccountTOTPEnrollRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	}
+	u := v.User()
+	if err := s.confirmPassword(u, req.Password); err != nil {
+		return err
+	}
+	secret, err := s.userManager.BeginTOTPEnrollment(u.ID)
+	if errors.Is(err, user.ErrTOTPAlreadyEnabled) {
+		return errHTTPConflictTOTPEnabled
+	} else if err != nil {
+		return err
+	}
+	logvr(v, r).Tag(tagAccount).Debug("Starting two-factor authentication enrollment for user %s", u.Name)
+	return s.writeJSON(w, &apiAccountTOTPEnrollResponse{
+		Secret: secret,
+		URI:    user.TOTPURI(s.totpIssuer(), u.Name, secret),
+	})
+}
+
+// handleAccountTOTPEnable confirms the pending TOTP secret with a code, and enables 2FA for the account
+func (s *Server) handleAccountTOTPEnable(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	req, err := readJSONWithLimit[apiAccountTOTPEnableRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	}
+	u := v.User()
+	if err := s.confirmPassword(u, req.Password); err != nil {
+		return err
+	}
+	recoveryCodes, err := s.userManager.EnableTOTP(u.ID, req.Code)
+	if errors.Is(err, user.ErrTOTPAlreadyEnabled) {
+		return errHTTPConflictTOTPEnabled
+	} else if errors.Is(err, user.ErrTOTPInvalidCode) || errors.Is(err, user.ErrTOTPNotEnabled) {
+		return errHTTPBadRequestTOTPInvalid
+	} else if err != nil {
+		return err
+	}
+	logvr(v, r).Tag(tagAccount).Info("Enabled two-factor authentication for user %s", u.Name)
+	return s.writeJSON(w, &apiAccountTOTPEnableResponse{
+		RecoveryCodes: recoveryCodes,
+	})
+}
+
+// handleAccountTOTPDisable disables 2FA for the account. It requires the password and a TOTP code (or recovery code).
+func (s *Server) handleAccountTOTPDisable(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	req, err := readJSONWithLimit[apiAccountTOTPDisableRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	}
+	u := v.User()
+	if err := s.confirmPassword(u, req.Password); err != nil {
+		return err
+	}
+	if err := s.userManager.VerifyTOTP(u.ID, req.Code); errors.Is(err, user.ErrTOTPNotEnabled) {
+		return s.writeJSON(w, newSuccessResponse())
+	} else if errors.Is(err, user.ErrTOTPInvalidCode) {
+		v.AuthFailed()
+		return errHTTPBadRequestTOTPInvalid
+	} else if err != nil {
+		return err
+	}
+	if err := s.userManager.DisableTOTP(u.ID); err != nil {
+		return err
+	}
+	logvr(v, r).Tag(tagAccount).Info("Disabled two-factor authentication for user %s", u.Name)
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+// confirmPassword checks the current password of the user, as passed in the request body of 2FA changes
+func (s *Server) confirmPassword(u *user.User, password string) error {
+	if password == "" {
+		return errHTTPBadRequest
+	} else if _, err := s.userManager.Authenticate(u.Name, password); err != nil {
+		return errHTTPBadRequestIncorrectPasswordConfirmation
+	}
+	return nil
+}
+
+// verifyTOTP checks the TOTP code (or recovery code) in the X-TOTP header, if the user has 2FA enabled. Each code
+// can only be used once.
+func (s *Server) verifyTOTP(r *http.Request, u *user.User) error {
+	return s.checkTOTP(r, u, s.userManager.VerifyTOTP)
+}
+
+// authenticateTOTP is like verifyTOTP, but allows a TOTP code to be used again while it is valid. It is used for
+// Basic auth, since clients send the same code with every request, see authenticateBasicAuth.
+func (s *Server) authenticateTOTP(r *http.Request, u *user.User) error {
+	return s.checkTOTP(r, u, s.userManager.AuthenticateTOTP)
+}
+
+func (s *Server) checkTOTP(r *http.Request, u *user.User, verify func(userID, code string) error) error {
+	enabled, err := s.userManager.TOTPEnabled(u.ID)
+	if err != nil {
+		return err
+	} else if !enabled {
+		return nil
+	}
+	code := readParam(r, "x-totp", "totp")
+	if code == "" {
+		return errHTTPUnauthorizedTOTPRequired
+	}
+	if err := verify(u.ID, code); errors.Is(err, user.ErrTOTPInvalidCode) {
+		return errHTTPUnauthorized
+	} else if err != nil {
+		return err
+	}
+	logr(r).Tag(tagAccount).Debug("Verified two-factor code of user %s", u.Name)
+	return nil
+}
+
+// totpIssuer returns the issuer shown in authenticator apps, i.e. the host name of the server
+func (s *Server) totpIssuer() string {
+	if u, err := url.Parse(s.config().BaseURL); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return "ntfy"
+}
+
+// tokenAuthenticated returns true if the request was authenticated with an access token rather than a password,
+// either via Bearer auth, or via Basic auth with an empty username
+func tokenAuthenticated(r *http.Request) bool {
+	header, err := readAuthHeader(r)
+	if err != nil {
+		return false
+	} else if strings.HasPrefix(strings.ToLower(header), "bearer ") {
+		return true
+	}
+	req := &http.Request{Header: http.Header{"Authorization": []string{header}}}
+	username, _, ok := req.BasicAuth()
+	return ok && username == ""
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"heckel.io/ntfy/v2/user"
+)
+
+// Email verification makes sure that accounts created via signup (enable-signup) belong to a real email address,
+// which makes it harder to create throwaway accounts on public instances. If enable-signup-verification is set:
+//
+//   - POST /v1/account requires an "email" field; the account is created, but marked as unverified, and a
+//     verification link (GET /v1/account/verify?token=vt_...) is sent to the email address
+//   - Logging in with an unverified account fails with errHTTPUnauthorizedEmailNotVerified
+//   - Opening the link verifies the account, and redirects to the login page of the web app
+//   - Accounts that are not verified within signupVerificationExpiry are deleted, see pruneTokens
+//
+// Accounts created by admins do not need to be verified.
+
+const (
+	signupVerificationExpiry = 24 * time.Hour
+)
+
+// handleAccountVerify verifies the email address of a new account, using the token from the verification link
+func (s *Server) handleAccountVerify(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	conf := s.config()
+	token := readQueryParam(r, "token")
+	if token == "" {
+		return errHTTPBadRequestVerificationInvalid
+	}
+	userID, err := s.userManager.VerifyEmail(token)
+	if errors.Is(err, user.ErrVerificationNotFound) {
+		return errHTTPBadRequestVerificationInvalid
+	} else if err != nil {
+		return err
+	}
+	logvr(v, r).Tag(tagAccount).Field("user_id", userID).Info("Verified email address of user %s", userID)
+	if conf.WebRoot != "" {
+		http.Redirect(w, r, strings.TrimSuffix(conf.WebRoot, "/")+"/login", http.StatusFound)
+		return nil
+	}
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+// sendVerificationEmail marks the new user as unverified, and sends the verification link to the given address
+func (s *Server) sendVerificationEmail(v *visitor, r *http.Request, u *user.User, email string) error {
+	sender := s.mailer()
+	if sender == nil {
+		return errHTTPBadRequestEmailDisabled // Disabled via config reload since the request was validated
+	}
+	token, err := s.userManager.AddEmailVerification(u.ID, email, time.Now().Add(signupVerificationExpiry))
+	if err != nil {
+		return err
+	}
+	link := fmt.Sprintf("%s%s?token=%s", s.config().BaseURL, apiAccountVerifyPath, url.QueryEscape(token))
+	lang := s.language(v, r)
+	subject := locales.Text(lang, "signup_verification_email_subject")
+	text := locales.Text(lang, "signup_verification_email_message", u.Name, link)
+	logvr(v, r).Tag(tagAccount).Field("user_name", u.Name).Debug("Sending verification email to %s", email)
+	return sender.SendText(v, email, subject, text)
+}
+
+// validSignupEmail returns true if the given string is a plain email address, e.g. phil@example.com
+func validSignupEmail(email string) bool {
+	addr, err := mail.ParseAddress(email)
+	return err == nil && addr.Address == email
+}
+
+// checkEmailVerified returns errHTTPUnauthorizedEmailNotVerified if the user has not verified their email address yet
+func (s *Server) checkEmailVerified(u *user.User) error {
+	pending, err := s.userManager.EmailVerificationPending(u.ID)
+	if err != nil {
+		return err
+	} else if pending {
+		return errHTTPUnauthorizedEmailNotVerified
+	}
+	return nil
+}
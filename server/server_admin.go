@@ -2,8 +2,11 @@ package server
 
 import (
 	"errors"
+	"fmt"
+	"heckel.io/ntfy/v2/log"
 	"heckel.io/ntfy/v2/user"
 	"net/http"
+	"time"
 )
 
 func (s *Server) handleUsersGet(w http.ResponseWriter, r *http.Request, v *visitor) error {
@@ -34,6 +37,12 @@ func (s *Server) handleUsersGet(w http.ResponseWriter, r *http.Request, v *visit
 			Tier:     tier,
 			Grants:   userGrants,
 		}
+		if u.Tier != nil && u.TierExpires.Unix() > 0 {
+			usersResponse[i].TierExpires = u.TierExpires.Unix()
+		}
+		if u.IsSuspended() {
+			usersResponse[i].Suspension = newAccountSuspensionResponse(u.Suspension)
+		}
 	}
 	return s.writeJSON(w, usersResponse)
 }
@@ -93,6 +102,131 @@ func (s *Server) handleUsersDelete(w http.ResponseWriter, r *http.Request, v *vi
 	return s.writeJSON(w, newSuccessResponse())
 }
 
+func (s *Server) handleUsersSuspend(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	req, err := readJSONWithLimit[apiUserSuspendRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	} else if req.Until < 0 || (req.Until > 0 && req.Until < time.Now().Unix()) {
+		return errHTTPBadRequest.Wrap("until must be in the future, or 0 to suspend indefinitely")
+	}
+	u, err := s.userManager.User(req.Username)
+	if errors.Is(err, user.ErrUserNotFound) {
+		return errHTTPBadRequestUserNotFound
+	} else if err != nil {
+		return err
+	} else if !u.IsUser() {
+		return errHTTPUnauthorized.Wrap("can only suspend regular users from API")
+	}
+	if err := s.suspendUser(r, v, u, req.Reason, req.Until); err != nil {
+		return err
+	}
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+// suspendUser suspends the given user until the given Unix timestamp (0 means indefinitely), and closes their
+// active subscriptions. It is used for suspensions and user bans, see server_bans.go.
+func (s *Server) suspendUser(r *http.Request, v *visitor, u *user.User, reason string, until int64) error {
+	logvr(v, r).
+		Tag(tagAccount).
+		Fields(log.Context{
+			"suspended_user":   u.Name,
+			"suspended_until":  until,
+			"suspended_reason": reason,
+		}).
+		Info("Suspending user %s", u.Name)
+	if err := s.userManager.SuspendUser(u.Name, reason, time.Unix(until, 0)); err != nil {
+		return err
+	}
+	return s.killUserSubscriber(u, "*") // FIXME super inefficient
+}
+
+func (s *Server) handleUsersReinstate(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	req, err := readJSONWithLimit[apiUserReinstateRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	}
+	if _, err := s.userManager.User(req.Username); errors.Is(err, user.ErrUserNotFound) {
+		return errHTTPBadRequestUserNotFound
+	} else if err != nil {
+		return err
+	}
+	return s.reinstateUser(w, r, v, req.Username)
+}
+
+func (s *Server) reinstateUser(w http.ResponseWriter, r *http.Request, v *visitor, username string) error {
+	logvr(v, r).Tag(tagAccount).Field("reinstated_user", username).Info("Reinstating user %s", username)
+	if err := s.userManager.ReinstateUser(username); err != nil {
+		return err
+	}
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+// handleUsersTierGrant assigns a tier to a user, optionally until a given time, independent of Stripe. This is
+// useful for trials, sponsorships or other payment arrangements. Expired grants are removed in expireTierGrants.
+func (s *Server) handleUsersTierGrant(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	req, err := readJSONWithLimit[apiUserTierGrantRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	} else if req.Until < 0 || (req.Until > 0 && req.Until < time.Now().Unix()) {
+		return errHTTPBadRequest.Wrap("until must be in the future, or 0 to grant the tier permanently")
+	}
+	u, err := s.userManager.User(req.Username)
+	if errors.Is(err, user.ErrUserNotFound) {
+		return errHTTPBadRequestUserNotFound
+	} else if err != nil {
+		return err
+	} else if !u.IsUser() {
+		return errHTTPUnauthorized.Wrap("can only grant tiers to regular users from API")
+	} else if u.Billing.StripeSubscriptionID != "" {
+		return errHTTPBadRequest.Wrap("user has a paid subscription, tier cannot be granted")
+	}
+	tier, err := s.userManager.Tier(req.Tier)
+	if errors.Is(err, user.ErrTierNotFound) {
+		return errHTTPBadRequestTierInvalid
+	} else if err != nil {
+		return err
+	}
+	if err := s.maybeRemoveMessagesAndExcessReservations(r, v, u, tier.ReservationLimit); err != nil {
+		return err
+	}
+	logvr(v, r).
+		Tag(tagAccount).
+		Fields(log.Context{
+			"granted_user":  u.Name,
+			"granted_tier":  tier.Code,
+			"granted_until": req.Until,
+		}).
+		Info("Granting tier %s to user %s", tier.Code, u.Name)
+	if err := s.userManager.GrantTier(u.Name, tier.Code, time.Unix(req.Until, 0)); err != nil {
+		return err
+	}
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+// handleUsersTierRevoke removes the tier from a user, and removes reservations that exceed the default limit
+func (s *Server) handleUsersTierRevoke(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	req, err := readJSONWithLimit[apiUserTierRevokeRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	}
+	u, err := s.userManager.User(req.Username)
+	if errors.Is(err, user.ErrUserNotFound) {
+		return errHTTPBadRequestUserNotFound
+	} else if err != nil {
+		return err
+	} else if u.Billing.StripeSubscriptionID != "" {
+		return errHTTPBadRequest.Wrap("user has a paid subscription, tier cannot be revoked")
+	}
+	logvr(v, r).Tag(tagAccount).Field("revoked_user", u.Name).Info("Revoking tier of user %s", u.Name)
+	if err := s.maybeRemoveMessagesAndExcessReservations(r, v, u, visitorDefaultReservationsLimit); err != nil {
+		return err
+	}
+	if err := s.userManager.ResetTier(u.Name); err != nil {
+		return err
+	}
+	return s.writeJSON(w, newSuccessResponse())
+}
+
 func (s *Server) handleAccessAllow(w http.ResponseWriter, r *http.Request, v *visitor) error {
 	req, err := readJSONWithLimit[apiAccessAllowRequest](r.Body, jsonBodyBytesLimit, false)
 	if err != nil {
@@ -132,6 +266,156 @@ func (s *Server) handleAccessReset(w http.ResponseWriter, r *http.Request, v *vi
 	return s.writeJSON(w, newSuccessResponse())
 }
 
+func (s *Server) handleAccessCheck(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	u := v.User()
+	username, topic := r.URL.Query().Get("user"), r.URL.Query().Get("topic")
+	if username == "" {
+		username = u.Name
+	} else if username != u.Name && !u.IsAdmin() {
+		return errHTTPForbidden // Only admins may check the access of other users
+	}
+	if !topicRegex.MatchString(topic) {
+		return errHTTPBadRequestTopicInvalid
+	}
+	perm, err := user.ParsePermission(r.URL.Query().Get("perm"))
+	if err != nil || perm == user.PermissionDenyAll {
+		return errHTTPBadRequestPermissionInvalid
+	}
+	var target *user.User // nil means anonymous
+	if username != user.Everyone {
+		target, err = s.userManager.User(username)
+		if errors.Is(err, user.ErrUserNotFound) {
+			return errHTTPBadRequestUserNotFound
+		} else if err != nil {
+			return err
+		}
+	}
+	response := &apiAccessCheckResponse{
+		User:       username,
+		Topic:      topic,
+		Permission: perm.String(),
+	}
+	if target != nil && target.Tier != nil {
+		response.Tier = target.Tier.Code
+	}
+	if target != nil && target.IsSuspended() {
+		response.Reason = "suspended"
+		response.Explanation = "Access denied, because the user is suspended"
+		return s.writeJSON(w, response)
+	}
+	decision, err := s.userManager.Explain(target, topic, perm)
+	if err != nil {
+		return err
+	}
+	response.Allowed = decision.Allowed
+	response.Reason = string(decision.Reason)
+	showOwner := u.IsAdmin() || (decision.Entry != nil && decision.Entry.Owner == u.Name) // Don't reveal who reserved a topic
+	response.Explanation = explainAccessDecision(decision, s.config().AuthDefault, showOwner)
+	if decision.Entry != nil {
+		response.Entry = &apiAccessCheckEntryResponse{
+			User:       decision.Entry.Username,
+			Topic:      decision.Entry.TopicPattern,
+			Permission: decision.Entry.Permission.String(),
+		}
+		if showOwner {
+			response.Entry.Owner = decision.Entry.Owner
+		}
+	}
+	return s.writeJSON(w, response)
+}
+
+// explainAccessDecision returns a human-readable explanation of the given access decision. If showOwner is false,
+// the owner of a reserved topic is left out.
+func explainAccessDecision(decision *user.Decision, defaultAccess user.Permission, showOwner bool) string {
+	verdict := "denied"
+	if decision.Allowed {
+		verdict = "granted"
+	}
+	switch decision.Reason {
+	case user.DecisionTokenScope:
+		return "Access denied by the scope of the access token"
+	case user.DecisionAdmin:
+		return "Access granted, because admins can access all topics"
+	case user.DecisionReservation:
+		if decision.Entry.Username == decision.Entry.Owner {
+			return fmt.Sprintf("Access %s, because the topic is reserved by the user (%s)", verdict, decision.Entry.Permission)
+		}
+		if !showOwner {
+			return fmt.Sprintf("Access %s by the everyone access of the topic reserved by another user (%s)", verdict, decision.Entry.Permission)
+		}
+		return fmt.Sprintf("Access %s by the everyone access of the topic reserved by user %s (%s)", verdict, decision.Entry.Owner, decision.Entry.Permission)
+	case user.DecisionOrg:
+		return fmt.Sprintf("Access %s by the organization that reserved the topic", verdict)
+	case user.DecisionAccessEntry:
+		return fmt.Sprintf("Access %s by the access control entry %s for user %s (%s)", verdict, decision.Entry.TopicPattern, decision.Entry.Username, decision.Entry.Permission)
+	default:
+		return fmt.Sprintf("Access %s by the default access (%s), because no access control entry matches the topic", verdict, defaultAccess)
+	}
+}
+
+func (s *Server) handleAccessExport(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	list, err := s.userManager.ExportAccess()
+	if err != nil {
+		return err
+	}
+	return s.writeJSON(w, list)
+}
+
+func (s *Server) handleAccessImport(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	list, err := readJSONWithLimit[user.AccessList](r.Body, accessListBodyBytesLimit, false)
+	if err != nil {
+		return err
+	}
+	dryRun := readBoolParam(r, false, "x-dry-run", "dry-run")
+	changes, err := s.userManager.ImportAccess(list, dryRun)
+	if errors.Is(err, user.ErrUserNotFound) {
+		return errHTTPBadRequestUserNotFound.Wrap("%s", err.Error())
+	} else if errors.Is(err, user.ErrInvalidArgument) {
+		return errHTTPBadRequest.Wrap("%s", err.Error())
+	} else if err != nil {
+		return err
+	}
+	logvr(v, r).
+		Tag(tagAccount).
+		Fields(log.Context{
+			"access_changes": changes.Count(),
+			"dry_run":        dryRun,
+		}).
+		Info("Imported access control list with %d change(s)", changes.Count())
+	if !dryRun {
+		// Disconnect subscribers that may have lost access
+		for _, entry := range append(changes.AccessChanged, changes.AccessRemoved...) {
+			if err := s.killUserSubscriberByName(entry.User, entry.Topic); err != nil {
+				return err
+			}
+		}
+		for _, entry := range changes.ReservationsRemoved {
+			if err := s.killUserSubscriberByName(entry.User, entry.Topic); err != nil {
+				return err
+			}
+		}
+		for _, entry := range append(changes.ReservationsChanged, changes.ReservationsRemoved...) {
+			if err := s.killUserSubscriberByName(user.Everyone, entry.Topic); err != nil {
+				return err
+			}
+		}
+	}
+	return s.writeJSON(w, &apiAccessImportResponse{
+		DryRun:  dryRun,
+		Changes: changes,
+	})
+}
+
+func (s *Server) killUserSubscriberByName(username, topicPattern string) error {
+	u, err := s.userManager.User(username)
+	if errors.Is(err, user.ErrUserNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return s.killUserSubscriber(u, topicPattern)
+}
+
 func (s *Server) killUserSubscriber(u *user.User, topicPattern string) error {
 	topics, err := s.topicsFromPattern(topicPattern)
 	if err != nil {
@@ -1,9 +1,12 @@
 package server
 
 import (
+	"fmt"
 	"github.com/stretchr/testify/require"
 	"heckel.io/ntfy/v2/user"
 	"heckel.io/ntfy/v2/util"
+	"io"
+	"net/http/httptest"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -90,6 +93,157 @@ func TestUser_AddRemove_Failures(t *testing.T) {
 	require.Equal(t, 200, rr.Code)
 }
 
+func TestUser_SuspendReinstate(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	require.Nil(t, s.userManager.AllowAccess("ben", "mytopic", user.PermissionReadWrite))
+
+	// Non-admins and admins cannot be suspended via the API
+	rr := request(t, s, "PUT", "/v1/users/suspension", `{"username": "ben"}`, map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 401, rr.Code)
+	rr = request(t, s, "PUT", "/v1/users/suspension", `{"username": "phil"}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 401, rr.Code)
+
+	// Suspend ben for a day
+	until := time.Now().Add(24 * time.Hour).Unix()
+	rr = request(t, s, "PUT", "/v1/users/suspension", fmt.Sprintf(`{"username": "ben", "reason": "Spamming", "until": %d}`, until), map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+
+	// Publishing and subscribing is blocked with a structured error
+	rr = request(t, s, "PUT", "/mytopic", "hi", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 403, rr.Code)
+	err := toHTTPError(t, rr.Body.String())
+	require.Equal(t, 40303, err.Code)
+	require.Contains(t, err.Message, "reason: Spamming")
+	rr = request(t, s, "GET", "/mytopic/json?poll=1", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 40303, toHTTPError(t, rr.Body.String()).Code)
+
+	// User can still log in and see the suspension
+	rr = request(t, s, "GET", "/v1/account", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 200, rr.Code)
+	account, _ := util.UnmarshalJSON[apiAccountResponse](io.NopCloser(rr.Body))
+	require.Equal(t, until, account.Suspension.Until)
+	require.Equal(t, "Spamming", account.Suspension.Reason)
+
+	// Admin sees the suspension, too
+	rr = request(t, s, "GET", "/v1/users", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	users, _ := util.UnmarshalJSON[[]apiUserResponse](io.NopCloser(rr.Body))
+	require.Nil(t, (*users)[0].Suspension)
+	require.Equal(t, "Spamming", (*users)[1].Suspension.Reason)
+
+	// Reinstate, publishing works again
+	rr = request(t, s, "DELETE", "/v1/users/suspension", `{"username": "ben"}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "PUT", "/mytopic", "hi", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 200, rr.Code)
+}
+
+func TestUser_TierGrant_Revoke_Expire(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	require.Nil(t, s.userManager.AddTier(&user.Tier{
+		Code:             "pro",
+		Name:             "Pro",
+		ReservationLimit: 2,
+	}))
+
+	// Invalid requests
+	rr := request(t, s, "PUT", "/v1/users/tier", `{"username": "ben", "tier": "pro"}`, map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 401, rr.Code)
+	rr = request(t, s, "PUT", "/v1/users/tier", `{"username": "ben", "tier": "does-not-exist"}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 40030, toHTTPError(t, rr.Body.String()).Code)
+	rr = request(t, s, "PUT", "/v1/users/tier", fmt.Sprintf(`{"username": "ben", "tier": "pro", "until": %d}`, time.Now().Add(-time.Hour).Unix()), map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 400, rr.Code)
+
+	// Grant tier to ben for a week
+	until := time.Now().Add(7 * 24 * time.Hour).Unix()
+	rr = request(t, s, "PUT", "/v1/users/tier", fmt.Sprintf(`{"username": "ben", "tier": "pro", "until": %d}`, until), map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+
+	rr = request(t, s, "GET", "/v1/users", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	users, _ := util.UnmarshalJSON[[]apiUserResponse](io.NopCloser(rr.Body))
+	require.Equal(t, "pro", (*users)[1].Tier)
+	require.Equal(t, until, (*users)[1].TierExpires)
+
+	rr = request(t, s, "GET", "/v1/account", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 200, rr.Code)
+	account, _ := util.UnmarshalJSON[apiAccountResponse](io.NopCloser(rr.Body))
+	require.Equal(t, "pro", account.Tier.Code)
+	require.Equal(t, until, account.Tier.Expires)
+
+	// Not expired yet
+	require.Nil(t, s.userManager.AddReservation("ben", "mytopic", user.PermissionRead))
+	s.expireTierGrants()
+	ben, err := s.userManager.User("ben")
+	require.Nil(t, err)
+	require.Equal(t, "pro", ben.Tier.Code)
+
+	// Expired: tier and reservations are removed
+	require.Nil(t, s.userManager.GrantTier("ben", "pro", time.Now().Add(-time.Minute)))
+	s.expireTierGrants()
+	ben, err = s.userManager.User("ben")
+	require.Nil(t, err)
+	require.Nil(t, ben.Tier)
+	reservations, err := s.userManager.Reservations("ben")
+	require.Nil(t, err)
+	require.Empty(t, reservations)
+
+	// Permanent grant, then revoke
+	rr = request(t, s, "PUT", "/v1/users/tier", `{"username": "ben", "tier": "pro"}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	ben, err = s.userManager.User("ben")
+	require.Nil(t, err)
+	require.Equal(t, "pro", ben.Tier.Code)
+	require.Equal(t, int64(0), ben.TierExpires.Unix())
+	rr = request(t, s, "DELETE", "/v1/users/tier", `{"username": "ben"}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	ben, err = s.userManager.User("ben")
+	require.Nil(t, err)
+	require.Nil(t, ben.Tier)
+}
+
 func TestAccess_AllowReset(t *testing.T) {
 	c := newTestConfigWithAuthFile(t)
 	c.AuthDefault = user.PermissionDenyAll
@@ -147,6 +301,92 @@ func TestAccess_AllowReset_NonAdminAttempt(t *testing.T) {
 	require.Equal(t, 401, rr.Code)
 }
 
+func TestAccess_Check(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionDenyAll
+	s := newTestServer(t, c)
+	defer s.closeDatabases()
+
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	require.Nil(t, s.userManager.AddUser("john", "john", user.RoleUser))
+	require.Nil(t, s.userManager.AllowAccess("ben", "prod-*", user.PermissionRead))
+	require.Nil(t, s.userManager.AddReservation("john", "johns-topic", user.PermissionRead))
+
+	// Admin checks another user
+	rr := request(t, s, "GET", "/v1/access/check?user=ben&topic=prod-alerts&perm=write", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	check, _ := util.UnmarshalJSON[apiAccessCheckResponse](io.NopCloser(rr.Body))
+	require.False(t, check.Allowed)
+	require.Equal(t, "ben", check.User)
+	require.Equal(t, "write-only", check.Permission)
+	require.Equal(t, "access-entry", check.Reason)
+	require.Equal(t, "prod-*", check.Entry.Topic)
+	require.Equal(t, "read-only", check.Entry.Permission)
+	require.Equal(t, "Access denied by the access control entry prod-* for user ben (read-only)", check.Explanation)
+
+	// Admin checks anonymous access to a reserved topic
+	rr = request(t, s, "GET", "/v1/access/check?user=*&topic=johns-topic&perm=read", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	check, _ = util.UnmarshalJSON[apiAccessCheckResponse](io.NopCloser(rr.Body))
+	require.True(t, check.Allowed)
+	require.Equal(t, "reservation", check.Reason)
+	require.Equal(t, "john", check.Entry.Owner)
+
+	// User checks themselves
+	rr = request(t, s, "GET", "/v1/access/check?topic=other&perm=read", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 200, rr.Code)
+	check, _ = util.UnmarshalJSON[apiAccessCheckResponse](io.NopCloser(rr.Body))
+	require.False(t, check.Allowed)
+	require.Equal(t, "ben", check.User)
+	require.Equal(t, "default-access", check.Reason)
+	require.Nil(t, check.Entry)
+
+	// User checks a topic reserved by another user; the owner is not revealed
+	rr = request(t, s, "GET", "/v1/access/check?topic=johns-topic&perm=read", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 200, rr.Code)
+	check, _ = util.UnmarshalJSON[apiAccessCheckResponse](io.NopCloser(rr.Body))
+	require.True(t, check.Allowed)
+	require.Equal(t, "reservation", check.Reason)
+	require.Equal(t, "", check.Entry.Owner)
+	require.NotContains(t, check.Explanation, "john")
+	require.NotContains(t, rr.Body.String(), "john")
+
+	// Suspended users are denied
+	require.Nil(t, s.userManager.SuspendUser("ben", "spam", time.Unix(0, 0)))
+	rr = request(t, s, "GET", "/v1/access/check?user=ben&topic=prod-alerts&perm=read", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	check, _ = util.UnmarshalJSON[apiAccessCheckResponse](io.NopCloser(rr.Body))
+	require.False(t, check.Allowed)
+	require.Equal(t, "suspended", check.Reason)
+
+	// Users cannot check other users, anonymous users cannot check anything
+	rr = request(t, s, "GET", "/v1/access/check?user=phil&topic=prod-alerts&perm=read", "", map[string]string{
+		"Authorization": util.BasicAuth("john", "john"),
+	})
+	require.Equal(t, 403, rr.Code)
+	rr = request(t, s, "GET", "/v1/access/check?topic=prod-alerts&perm=read", "", nil)
+	require.Equal(t, 401, rr.Code)
+
+	// Invalid parameters
+	for _, query := range []string{"user=nobody&topic=a&perm=read", "topic=a/b&perm=read", "topic=a&perm=everything", "topic=a&perm=deny"} {
+		rr = request(t, s, "GET", "/v1/access/check?"+query, "", map[string]string{
+			"Authorization": util.BasicAuth("phil", "phil"),
+		})
+		require.Equal(t, 400, rr.Code, query)
+	}
+}
+
 func TestAccess_AllowReset_KillConnection(t *testing.T) {
 	c := newTestConfigWithAuthFile(t)
 	c.AuthDefault = user.PermissionDenyAll
@@ -179,3 +419,222 @@ func TestAccess_AllowReset_KillConnection(t *testing.T) {
 		return timeTaken.Load() >= 500
 	})
 }
+
+func TestAccess_ExportImport(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionDenyAll
+	s := newTestServer(t, c)
+	defer s.closeDatabases()
+
+	// User and admin
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	require.Nil(t, s.userManager.AllowAccess("ben", "gold", user.PermissionRead))
+
+	// Export
+	rr := request(t, s, "GET", "/v1/users/access/bulk", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	list, err := util.UnmarshalJSON[user.AccessList](io.NopCloser(rr.Body))
+	require.Nil(t, err)
+	require.Equal(t, []user.AccessEntry{{User: "ben", Topic: "gold", Permission: "read-only"}}, list.Access)
+	require.Equal(t, 0, len(list.Reservations))
+
+	// Import (dry run)
+	body := `{"access":[{"user":"ben","topic":"silver","permission":"rw"}],"reservations":[{"user":"ben","topic":"bens-topic","everyone":"ro"}]}`
+	rr = request(t, s, "PUT", "/v1/users/access/bulk?dry-run=1", body, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	response, err := util.UnmarshalJSON[apiAccessImportResponse](io.NopCloser(rr.Body))
+	require.Nil(t, err)
+	require.True(t, response.DryRun)
+	require.Equal(t, []user.AccessEntry{{User: "ben", Topic: "silver", Permission: "read-write"}}, response.Changes.AccessAdded)
+	require.Equal(t, []user.AccessEntry{{User: "ben", Topic: "gold", Permission: "read-only"}}, response.Changes.AccessRemoved)
+	require.Equal(t, []user.ReservationEntry{{User: "ben", Topic: "bens-topic", Everyone: "read-only"}}, response.Changes.ReservationsAdded)
+	rr = request(t, s, "GET", "/gold/json?poll=1", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 200, rr.Code)
+
+	// Import
+	rr = request(t, s, "PUT", "/v1/users/access/bulk", body, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	response, err = util.UnmarshalJSON[apiAccessImportResponse](io.NopCloser(rr.Body))
+	require.Nil(t, err)
+	require.False(t, response.DryRun)
+	require.Equal(t, 3, response.Changes.Count())
+	rr = request(t, s, "GET", "/gold/json?poll=1", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 403, rr.Code)
+	rr = request(t, s, "GET", "/bens-topic/json?poll=1", "", nil)
+	require.Equal(t, 200, rr.Code)
+
+	// Import again is a no-op
+	rr = request(t, s, "PUT", "/v1/users/access/bulk", body, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	response, err = util.UnmarshalJSON[apiAccessImportResponse](io.NopCloser(rr.Body))
+	require.Nil(t, err)
+	require.Equal(t, 0, response.Changes.Count())
+
+	// Unknown user
+	rr = request(t, s, "PUT", "/v1/users/access/bulk", `{"access":[{"user":"nobody","topic":"silver","permission":"rw"}]}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 400, rr.Code)
+	require.Equal(t, 40031, toHTTPError(t, rr.Body.String()).Code)
+
+	// Non-admin
+	rr = request(t, s, "GET", "/v1/users/access/bulk", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 401, rr.Code)
+}
+
+func TestBanner_ChangeAndDelete(t *testing.T) {
+	conf := newTestConfigWithAuthFile(t)
+	conf.AuthDefault = user.PermissionReadWrite
+	conf.Banner = "Scheduled maintenance on Sunday"
+	s := newTestServer(t, conf)
+	defer s.closeDatabases()
+
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	ben, err := s.userManager.User("ben")
+	require.Nil(t, err)
+
+	// Banner from config is returned via /v1/config and /config.js
+	rr := request(t, s, "GET", "/v1/config", "", nil)
+	require.Equal(t, 200, rr.Code)
+	config, err := util.UnmarshalJSON[apiConfigResponse](io.NopCloser(rr.Body))
+	require.Nil(t, err)
+	require.Equal(t, "Scheduled maintenance on Sunday", config.Banner)
+	rr = request(t, s, "GET", "/config.js", "", nil)
+	require.Contains(t, rr.Body.String(), `"banner": "Scheduled maintenance on Sunday"`)
+
+	// Only admins can change the banner
+	rr = request(t, s, "PUT", "/v1/banner", `{"message":"Nope"}`, map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 401, rr.Code)
+	rr = request(t, s, "PUT", "/v1/banner", `{"message":"   "}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 400, rr.Code)
+	require.Equal(t, 40066, toHTTPError(t, rr.Body.String()).Code)
+
+	// Changing the banner publishes a sync event to connected users
+	subscribeRR := httptest.NewRecorder()
+	cancel := subscribe(t, s, "/"+ben.SyncTopic+"/json", subscribeRR)
+	rr = request(t, s, "PUT", "/v1/banner", `{"message":"Now with more cowbell"}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	cancel()
+	messages := toMessages(t, subscribeRR.Body.String())
+	require.Equal(t, 2, len(messages)) // open + banner
+	require.Equal(t, `{"event":"banner","banner":"Now with more cowbell"}`, messages[1].Message)
+
+	rr = request(t, s, "GET", "/v1/config", "", nil)
+	config, err = util.UnmarshalJSON[apiConfigResponse](io.NopCloser(rr.Body))
+	require.Nil(t, err)
+	require.Equal(t, "Now with more cowbell", config.Banner)
+
+	// Delete
+	rr = request(t, s, "DELETE", "/v1/banner", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "GET", "/v1/config", "", nil)
+	config, err = util.UnmarshalJSON[apiConfigResponse](io.NopCloser(rr.Body))
+	require.Nil(t, err)
+	require.Equal(t, "", config.Banner)
+}
+
+func TestReplay_TimeWindow(t *testing.T) {
+	conf := newTestConfigWithAuthFile(t)
+	conf.AuthDefault = user.PermissionReadWrite
+	s := newTestServer(t, conf)
+	defer s.closeDatabases()
+
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+
+	// Add messages from 3h, 2h and 1h ago
+	now := time.Now()
+	for i, body := range []string{"three hours ago", "two hours ago", "one hour ago"} {
+		m := newDefaultMessage("source", body)
+		m.Time = now.Add(time.Duration(i-3) * time.Hour).Unix()
+		m.Title = "Original " + body
+		m.Priority = 4
+		m.Tags = []string{"tag1"}
+		require.Nil(t, s.messageCache.AddMessage(m))
+	}
+
+	// Only admins can replay, topics must be valid and different
+	rr := request(t, s, "POST", "/v1/admin/replay", `{"topic":"source","target":"replayed"}`, map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 401, rr.Code)
+	rr = request(t, s, "POST", "/v1/admin/replay", `{"topic":"source","target":"source"}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 400, rr.Code)
+	require.Equal(t, 40067, toHTTPError(t, rr.Body.String()).Code)
+	rr = request(t, s, "POST", "/v1/admin/replay", `{"topic":"source","target":"replayed","since":"yesterday"}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 40067, toHTTPError(t, rr.Body.String()).Code)
+
+	// Replay the window between 150 and 30 minutes ago
+	rr = request(t, s, "POST", "/v1/admin/replay", `{"topic":"source","target":"replayed","since":"150m","until":"30m"}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	res, err := util.UnmarshalJSON[apiReplayResponse](io.NopCloser(rr.Body))
+	require.Nil(t, err)
+	require.Equal(t, 2, res.Messages)
+
+	rr = request(t, s, "GET", "/replayed/json?poll=1", "", nil)
+	messages := toMessages(t, rr.Body.String())
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "two hours ago", messages[0].Message)
+	require.Equal(t, "Original two hours ago", messages[0].Title)
+	require.Equal(t, 4, messages[0].Priority)
+	require.Equal(t, []string{"tag1"}, messages[0].Tags)
+	require.Equal(t, "one hour ago", messages[1].Message)
+	require.True(t, messages[1].Time >= now.Unix())
+}
+
+func TestReplay_TimeScaled(t *testing.T) {
+	conf := newTestConfigWithAuthFile(t)
+	s := newTestServer(t, conf)
+	defer s.closeDatabases()
+
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		m := newDefaultMessage("source", fmt.Sprintf("message %d", i))
+		m.Time = now.Add(time.Duration(i-2) * time.Second).Unix()
+		require.Nil(t, s.messageCache.AddMessage(m))
+	}
+
+	// With speed 4, the 1 second gap between the messages is replayed in 250ms
+	start := time.Now()
+	rr := request(t, s, "POST", "/v1/admin/replay", `{"topic":"source","target":"replayed","speed":4}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	waitFor(t, func() bool {
+		messages, err := s.messageCache.Messages("replayed", sinceAllMessages, false)
+		require.Nil(t, err)
+		return len(messages) == 2
+	})
+	require.True(t, time.Since(start) >= 250*time.Millisecond)
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"time"
+
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/user"
+)
+
+// Archive emails are a safety net against accidental data loss: When the messages of a topic are deleted (via
+// DELETE /<topic>/messages, or by deleting a topic reservation with X-Delete-Messages), or when an account is deleted,
+// users can pass an e-mail address (X-Archive-Email header, or "archive_email" when deleting the account). Before the
+// messages are purged, the remaining cached messages are exported (in the same format as GET /<topic>/export, see
+// server_export.go), compressed into a ZIP file with one file per topic, and sent to that address.
+//
+// If the archive cannot be created or sent, the deletion is aborted, so that no messages are lost.
+
+const (
+	archiveEmailSizeLimit = 10 * 1024 * 1024 // Max. size of the ZIP file, larger mails are rejected by most mail servers
+)
+
+// archiveEmailFromRequest returns the e-mail address from the X-Archive-Email header (or query parameter), or an
+// empty string if no archive was requested
+func (s *Server) archiveEmailFromRequest(r *http.Request, v *visitor) (string, error) {
+	to := readParam(r, "x-archive-email", "archive-email", "archive_email")
+	if err := s.validateArchiveEmail(v, to); err != nil {
+		return "", err
+	}
+	return to, nil
+}
+
+// validateArchiveEmail checks if an archive can be sent to the given address. An empty address is always valid.
+func (s *Server) validateArchiveEmail(v *visitor, to string) error {
+	if to == "" {
+		return nil
+	} else if s.mailer() == nil {
+		return errHTTPBadRequestEmailDisabled
+	} else if _, err := mail.ParseAddress(to); err != nil {
+		return errHTTPBadRequestArchiveEmailInvalid
+	} else if !v.EmailAllowed() {
+		return errHTTPTooManyRequestsLimitEmails
+	}
+	return nil
+}
+
+// sendArchiveEmail exports the cached messages of the given topics, and emails them to the given address as a ZIP
+// file. If there are no messages, no email is sent. The caller must purge the messages only if this succeeds.
+func (s *Server) sendArchiveEmail(r *http.Request, v *visitor, to string, topics ...string) error {
+	sender := s.mailer()
+	if sender == nil {
+		return errHTTPBadRequestEmailDisabled // Disabled via config reload since the request was validated
+	}
+	archive, count, err := s.createArchive(topics...)
+	if err != nil {
+		return err
+	} else if count == 0 {
+		logvr(v, r).Tag(tagEmail).Debug("No messages to archive, not sending archive email")
+		return nil
+	} else if len(archive) > archiveEmailSizeLimit {
+		return errHTTPEntityTooLargeArchive
+	}
+	lang := s.language(v, r)
+	subject := locales.Text(lang, "archive_email_subject")
+	text := locales.Plural(lang, "archive_email_message", count)
+	filename := fmt.Sprintf("ntfy-archive-%s.zip", time.Now().UTC().Format("2006-01-02"))
+	logvr(v, r).
+		Tag(tagEmail).
+		Fields(log.Context{
+			"archive_topics":   topics,
+			"archive_messages": count,
+			"archive_size":     len(archive),
+		}).
+		Info("Sending archive of %d message(s) before deleting them", count)
+	if err := sender.SendArchive(v, to, subject, text, filename, archive); err != nil {
+		logvr(v, r).Tag(tagEmail).Err(err).Warn("Unable to send archive email, not deleting messages")
+		return errHTTPInternalErrorArchiveEmail
+	}
+	return nil
+}
+
+// sendAccountArchiveEmail emails the messages of all topics reserved by the user, before the account is deleted
+func (s *Server) sendAccountArchiveEmail(r *http.Request, v *visitor, u *user.User, to string) error {
+	if err := s.validateArchiveEmail(v, to); err != nil {
+		return err
+	}
+	reservations, err := s.userManager.Reservations(u.Name)
+	if err != nil {
+		return err
+	}
+	topics := make([]string, 0, len(reservations))
+	for _, reservation := range reservations {
+		topics = append(topics, reservation.Topic)
+	}
+	return s.sendArchiveEmail(r, v, to, topics...)
+}
+
+// createArchive creates a ZIP file with one newline-delimited JSON file per topic (<topic>.jsonl) from the cached
+// messages of the given topics, and returns it along with the total number of messages. Topics without messages
+// are skipped.
+func (s *Server) createArchive(topics ...string) ([]byte, int, error) {
+	var buf bytes.Buffer
+	writer := zip.NewWriter(&buf)
+	var count int
+	for _, topic := range topics {
+		messages, err := s.messageCache.Messages(topic, sinceAllMessages, true)
+		if err != nil {
+			return nil, 0, err
+		}
+		var file *json.Encoder
+		for _, m := range messages {
+			if m.Event != messageEvent {
+				continue
+			}
+			if file == nil {
+				w, err := writer.Create(topic + ".jsonl")
+				if err != nil {
+					return nil, 0, err
+				}
+				file = json.NewEncoder(w)
+			}
+			if err := file.Encode(m); err != nil {
+				return nil, 0, err
+			}
+			count++
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, 0, err
+	}
+	return buf.Bytes(), count, nil
+}
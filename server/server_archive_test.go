@@ -0,0 +1,120 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+func TestServer_ArchiveEmail_TopicMessagesDelete(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+	mailer := &testMailer{}
+	setTestMailer(s, mailer)
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	admin := map[string]string{"Authorization": util.BasicAuth("phil", "phil")}
+	for _, body := range []string{"first", "second"} {
+		require.Equal(t, 200, request(t, s, "PUT", "/mytopic", body, admin).Code)
+	}
+
+	// Invalid address, nothing is deleted
+	rr := request(t, s, "DELETE", "/mytopic/messages", "", map[string]string{
+		"Authorization":   util.BasicAuth("phil", "phil"),
+		"X-Archive-Email": "not an email",
+	})
+	require.Equal(t, 40086, toHTTPError(t, rr.Body.String()).Code)
+	require.Equal(t, 2, len(toMessages(t, request(t, s, "GET", "/mytopic/json?poll=1", "", admin).Body.String())))
+
+	// Archive is sent, then messages are deleted
+	require.Equal(t, 200, request(t, s, "DELETE", "/mytopic/messages", "", map[string]string{
+		"Authorization":   util.BasicAuth("phil", "phil"),
+		"X-Archive-Email": "phil@example.com",
+	}).Code)
+	require.Equal(t, 0, len(toMessages(t, request(t, s, "GET", "/mytopic/json?poll=1", "", admin).Body.String())))
+	require.Equal(t, 1, len(mailer.archives))
+	for _, archive := range mailer.archives {
+		files := readTestArchive(t, archive)
+		require.Equal(t, 1, len(files))
+		messages := toMessages(t, files["mytopic.jsonl"])
+		require.Equal(t, 2, len(messages))
+		require.Equal(t, "first", messages[0].Message)
+		require.Equal(t, "second", messages[1].Message)
+	}
+}
+
+func TestServer_ArchiveEmail_Failure(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+	setTestMailer(s, &testFailingMailer{})
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	admin := map[string]string{"Authorization": util.BasicAuth("phil", "phil")}
+	require.Equal(t, 200, request(t, s, "PUT", "/mytopic", "important", admin).Code)
+
+	// Deletion is aborted if the archive cannot be sent
+	rr := request(t, s, "DELETE", "/mytopic/messages", "", map[string]string{
+		"Authorization":   util.BasicAuth("phil", "phil"),
+		"X-Archive-Email": "phil@example.com",
+	})
+	require.Equal(t, 500, rr.Code)
+	require.Equal(t, 50005, toHTTPError(t, rr.Body.String()).Code)
+	require.Equal(t, 1, len(toMessages(t, request(t, s, "GET", "/mytopic/json?poll=1", "", admin).Body.String())))
+}
+
+func TestServer_ArchiveEmail_Disabled(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	rr := request(t, s, "DELETE", "/mytopic/messages", "", map[string]string{
+		"Authorization":   util.BasicAuth("phil", "phil"),
+		"X-Archive-Email": "phil@example.com",
+	})
+	require.Equal(t, 40001, toHTTPError(t, rr.Body.String()).Code)
+}
+
+func TestServer_ArchiveEmail_AccountDelete(t *testing.T) {
+	conf := newTestConfigWithAuthFile(t)
+	conf.EnableSignup = true
+	s := newTestServer(t, conf)
+	defer s.closeDatabases()
+	mailer := &testMailer{}
+	setTestMailer(s, mailer)
+	require.Nil(t, s.userManager.AddTier(&user.Tier{Code: "pro", ReservationLimit: 2, MessageLimit: 100, EmailLimit: 10}))
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.ChangeTier("phil", "pro"))
+	require.Nil(t, s.userManager.AddReservation("phil", "alerts", user.PermissionDenyAll))
+	require.Nil(t, s.userManager.AddReservation("phil", "backups", user.PermissionDenyAll))
+	phil := map[string]string{"Authorization": util.BasicAuth("phil", "phil")}
+	require.Equal(t, 200, request(t, s, "PUT", "/alerts", "disk full", phil).Code)
+	require.Equal(t, 200, request(t, s, "PUT", "/backups", "backup done", phil).Code)
+	require.Equal(t, 200, request(t, s, "PUT", "/backups", "backup failed", phil).Code)
+
+	rr := request(t, s, "DELETE", "/v1/account", `{"password":"phil","archive_email":"phil@example.com"}`, phil)
+	require.Equal(t, 200, rr.Code)
+	require.Equal(t, 1, len(mailer.archives))
+	for _, archive := range mailer.archives {
+		files := readTestArchive(t, archive)
+		require.Equal(t, 2, len(files))
+		require.Equal(t, 1, len(toMessages(t, files["alerts.jsonl"])))
+		require.Equal(t, 2, len(toMessages(t, files["backups.jsonl"])))
+	}
+}
+
+func readTestArchive(t *testing.T, archive []byte) map[string]string {
+	reader, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	require.Nil(t, err)
+	files := make(map[string]string)
+	for _, f := range reader.File {
+		rc, err := f.Open()
+		require.Nil(t, err)
+		b, err := io.ReadAll(rc)
+		require.Nil(t, err)
+		rc.Close()
+		files[f.Name] = string(b)
+	}
+	return files
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/user"
+)
+
+// By default, uploaded attachments (/file/<message ID>) can be downloaded by anyone who knows the URL. If
+// "attachment-auth" is set, downloading an attachment requires read access to the topic of its message, or a
+// signed URL:
+//
+//   - Signed URLs have the format /file/<message ID>.<ext>?expires=<unix time>&key=<key ID>&sig=<signature>, where
+//     the signature is the HMAC-SHA256 of "<message ID>.<expires>.<key ID>" with a signing key of purpose
+//     "attachment" (see server_signing_keys.go). They are valid for "attachment-auth-url-expiry".
+//   - Attachment URLs are signed in e-mails, Firebase and Web Push notifications, since the clients that open them
+//     (mail clients, the Android app, browsers) do not send credentials. They are also signed in messages delivered
+//     to subscribers, who already passed the read check of the subscription.
+//
+// If "attachment-auth-topics" is set, this only applies to topics matching one of the patterns; attachments in other
+// topics can be downloaded by anyone who knows the URL, and their URLs are not signed.
+//
+// The stored message always contains the unsigned URL, so that signatures are generated with the current key.
+//
+// If "firebase-attachment-defer-size" is set, Firebase messages for large attachments do not contain the attachment
+// URL (see firebaseMessage). The app fetches a short-lived signed URL via GET /file/<message ID>/url when the
+// notification is opened, see handleFileURL. These URLs are signed even if "attachment-auth" is not set, and
+// signatures are always verified if present, so that they expire.
+
+const (
+	attachmentDeferredURLExpiry = 15 * time.Minute // Validity of signed URLs returned by handleFileURL
+)
+
+// authorizeAttachment checks if the visitor may download the attachment of the given message, either via a valid
+// signature in the URL, or via read access to the topic of the message (if attachment-auth applies to the topic)
+func (s *Server) authorizeAttachment(r *http.Request, v *visitor, messageID string) error {
+	if signature := readQueryParam(r, "sig"); signature != "" {
+		if err := s.verifyAttachmentSignature(messageID, readQueryParam(r, "expires"), readQueryParam(r, "key"), signature); err != nil {
+			logvr(v, r).Tag(tagFileCache).Err(err).Debug("Invalid attachment URL signature")
+			return errHTTPForbiddenAttachmentSignature
+		}
+		return nil
+	}
+	m, err := s.messageCache.Message(messageID)
+	if errors.Is(err, errMessageNotFound) {
+		return errHTTPNotFound
+	} else if err != nil {
+		return err
+	}
+	if s.attachmentAuthRequired(m.Topic) && !s.topicPermitted(v, m.Topic, user.PermissionRead) {
+		return errHTTPForbidden.With(m)
+	}
+	return nil
+}
+
+// attachmentAuthRequired returns true if downloading attachments of the given topic requires read access or
+// a signed URL, as per attachment-auth and attachment-auth-topics
+func (s *Server) attachmentAuthRequired(topic string) bool {
+	conf := s.config()
+	if !conf.AttachmentAuth {
+		return false
+	} else if len(conf.AttachmentAuthTopics) == 0 {
+		return true
+	}
+	for _, pattern := range conf.AttachmentAuthTopics {
+		if matched, _ := path.Match(pattern, topic); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// attachmentSigningKey returns the key to sign attachment URLs with, or nil if attachment URLs are not signed
+func (s *Server) attachmentSigningKey() (*user.SigningKey, error) {
+	if !s.config().AttachmentAuth || s.userManager == nil {
+		return nil, nil
+	}
+	return s.signingKey(signingKeyPurposeAttachment)
+}
+
+// withSignedAttachmentURL returns a copy of the message with a signed attachment URL, or the message itself if it
+// has no attachment stored on this server, if attachment-auth does not apply to its topic, or if key is nil
+func (s *Server) withSignedAttachmentURL(key *user.SigningKey, m *message) *message {
+	if key == nil || !s.attachmentStored(m) || !s.attachmentAuthRequired(m.Topic) {
+		return m
+	}
+	attachment := *m.Attachment
+	attachment.URL = signedAttachmentURL(key, m, time.Now().Add(s.config().AttachmentAuthURLExpiry).Unix())
+	signedMessage := *m
+	signedMessage.Attachment = &attachment
+	return &signedMessage
+}
+
+// signAttachmentURL is like withSignedAttachmentURL, but looks up the signing key. If that fails, the message is
+// returned unchanged.
+func (s *Server) signAttachmentURL(m *message) *message {
+	if m.Attachment == nil || !s.attachmentAuthRequired(m.Topic) {
+		return m
+	}
+	key, err := s.attachmentSigningKey()
+	if err != nil {
+		log.Tag(tagFileCache).With(m).Err(err).Warn("Unable to sign attachment URL")
+		return m
+	}
+	return s.withSignedAttachmentURL(key, m)
+}
+
+// handleFileURL returns a signed download URL for the attachment of the given message, which is only valid for
+// attachmentDeferredURLExpiry. It is used by clients that received a Firebase message without attachment URL (see
+// firebaseMessage) to download the attachment when it is needed.
+func (s *Server) handleFileURL(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	matches := fileURLRegex.FindStringSubmatch(r.URL.Path)
+	if len(matches) != 2 {
+		return errHTTPInternalErrorInvalidPath
+	}
+	m, err := s.messageCache.Message(matches[1])
+	if errors.Is(err, errMessageNotFound) {
+		return errHTTPNotFound
+	} else if err != nil {
+		return err
+	} else if !s.attachmentStored(m) {
+		return errHTTPNotFound.With(m)
+	} else if !s.topicPermitted(v, m.Topic, user.PermissionRead) {
+		return errHTTPForbidden.With(m)
+	}
+	key, err := s.signingKey(signingKeyPurposeAttachment) // Regardless of attachment-auth, see above
+	if err != nil {
+		return err
+	}
+	expires := min(time.Now().Add(attachmentDeferredURLExpiry).Unix(), m.Attachment.Expires)
+	return s.writeJSON(w, &apiFileURLResponse{
+		URL:     signedAttachmentURL(key, m, expires),
+		Expires: expires,
+	})
+}
+
+// attachmentStored returns true if the message has an attachment that was uploaded to this server
+func (s *Server) attachmentStored(m *message) bool {
+	return m.Attachment != nil && strings.HasPrefix(m.Attachment.URL, s.config().BaseURL+"/file/")
+}
+
+// verifyAttachmentSignature checks the signature and expiry of a signed attachment URL for the given message
+func (s *Server) verifyAttachmentSignature(messageID, expiresStr, keyID, signatureStr string) error {
+	signature, err := base64.RawURLEncoding.DecodeString(signatureStr)
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding")
+	}
+	expires, err := strconv.ParseInt(expiresStr, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid expiry")
+	} else if time.Now().Unix() > expires {
+		return fmt.Errorf("signature expired")
+	} else if s.userManager == nil {
+		return fmt.Errorf("signed URLs require a user database")
+	}
+	keys, err := s.userManager.SigningKeys(signingKeyPurposeAttachment)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if key.ID == keyID {
+			if !hmac.Equal(signature, attachmentSignature(key.Secret, messageID, expiresStr, keyID)) {
+				return fmt.Errorf("invalid signature")
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("signing key %s not found or retired", keyID)
+}
+
+// signedAttachmentURL returns the attachment URL of the message, signed with the given key and valid until expires
+func signedAttachmentURL(key *user.SigningKey, m *message, expires int64) string {
+	expiresStr := strconv.FormatInt(expires, 10)
+	signature := attachmentSignature(key.Secret, m.ID, expiresStr, key.ID)
+	return fmt.Sprintf("%s?expires=%s&key=%s&sig=%s", m.Attachment.URL, expiresStr, key.ID, base64.RawURLEncoding.EncodeToString(signature))
+}
+
+func attachmentSignature(secret, messageID, expires, keyID string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(fmt.Sprintf("%s.%s.%s", messageID, expires, keyID)))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+func TestServer_AttachmentAuth(t *testing.T) {
+	conf := newTestConfigWithAuthFile(t)
+	conf.AuthDefault = user.PermissionDenyAll
+	conf.AttachmentAuth = true
+	s := newTestServer(t, conf)
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	require.Nil(t, s.userManager.AllowAccess("phil", "mytopic", user.PermissionReadWrite))
+	require.Nil(t, s.userManager.AllowAccess("ben", "mytopic", user.PermissionWrite))
+	philAuth := map[string]string{"Authorization": util.BasicAuth("phil", "phil")}
+	benAuth := map[string]string{"Authorization": util.BasicAuth("ben", "ben")}
+
+	// Publisher response contains the unsigned URL
+	content := "text file!" + util.RandomString(4990)
+	rr := request(t, s, "PUT", "/mytopic", content, benAuth)
+	require.Equal(t, 200, rr.Code)
+	m := toMessage(t, rr.Body.String())
+	require.NotContains(t, m.Attachment.URL, "sig=")
+	path := strings.TrimPrefix(m.Attachment.URL, "http://127.0.0.1:12345")
+
+	// Only users with read access can download
+	rr = request(t, s, "GET", path, "", nil)
+	require.Equal(t, 403, rr.Code)
+	rr = request(t, s, "HEAD", path, "", benAuth)
+	require.Equal(t, 403, rr.Code)
+	rr = request(t, s, "GET", path, "", philAuth)
+	require.Equal(t, 200, rr.Code)
+	require.Equal(t, content, rr.Body.String())
+
+	// Subscribers receive a signed URL, which works without credentials
+	rr = request(t, s, "GET", "/mytopic/json?poll=1", "", philAuth)
+	require.Equal(t, 200, rr.Code)
+	polled := toMessage(t, strings.TrimSpace(rr.Body.String()))
+	require.Contains(t, polled.Attachment.URL, "sig=")
+	signedPath := strings.TrimPrefix(polled.Attachment.URL, "http://127.0.0.1:12345")
+	rr = request(t, s, "GET", signedPath, "", nil)
+	require.Equal(t, 200, rr.Code)
+	require.Equal(t, content, rr.Body.String())
+
+	// Tampered and expired signatures are rejected
+	rr = request(t, s, "GET", strings.Replace(signedPath, "sig=", "sig=x", 1), "", nil)
+	require.Equal(t, 40312, toHTTPError(t, rr.Body.String()).Code)
+	key, err := s.attachmentSigningKey()
+	require.Nil(t, err)
+	expired := s.withSignedAttachmentURL(key, m)
+	expired.Attachment.URL = strings.Replace(expired.Attachment.URL, "expires=", "expires=1", 1) // Changes expiry and signature
+	rr = request(t, s, "GET", strings.TrimPrefix(expired.Attachment.URL, "http://127.0.0.1:12345"), "", nil)
+	require.Equal(t, 40312, toHTTPError(t, rr.Body.String()).Code)
+	conf.AttachmentAuthURLExpiry = -time.Minute
+	rr = request(t, s, "GET", strings.TrimPrefix(s.signAttachmentURL(m).Attachment.URL, "http://127.0.0.1:12345"), "", nil)
+	require.Equal(t, 40312, toHTTPError(t, rr.Body.String()).Code)
+
+	// Retiring the signing key revokes all signed URLs
+	require.Nil(t, s.userManager.RetireSigningKey(key.ID, 0))
+	rr = request(t, s, "GET", signedPath, "", nil)
+	require.Equal(t, 40312, toHTTPError(t, rr.Body.String()).Code)
+}
+
+func TestServer_AttachmentAuth_Topics(t *testing.T) {
+	conf := newTestConfigWithAuthFile(t)
+	conf.AuthDefault = user.PermissionDenyAll
+	conf.AttachmentAuth = true
+	conf.AttachmentAuthTopics = []string{"private-*"}
+	s := newTestServer(t, conf)
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.AllowAccess("phil", "private-files", user.PermissionReadWrite))
+	require.Nil(t, s.userManager.AllowAccess("phil", "public-files", user.PermissionReadWrite))
+	philAuth := map[string]string{"Authorization": util.BasicAuth("phil", "phil")}
+
+	// Attachments in matching topics require read access, and subscribers receive signed URLs
+	rr := request(t, s, "PUT", "/private-files", "private file!"+util.RandomString(4990), philAuth)
+	require.Equal(t, 200, rr.Code)
+	path := strings.TrimPrefix(toMessage(t, rr.Body.String()).Attachment.URL, "http://127.0.0.1:12345")
+	require.Equal(t, 403, request(t, s, "GET", path, "", nil).Code)
+	require.Equal(t, 200, request(t, s, "GET", path, "", philAuth).Code)
+	rr = request(t, s, "GET", "/private-files/json?poll=1", "", philAuth)
+	require.Contains(t, toMessage(t, strings.TrimSpace(rr.Body.String())).Attachment.URL, "sig=")
+
+	// Attachments in other topics can be downloaded by anyone, and URLs are not signed
+	rr = request(t, s, "PUT", "/public-files", "public file!"+util.RandomString(4990), philAuth)
+	require.Equal(t, 200, rr.Code)
+	m := toMessage(t, rr.Body.String())
+	path = strings.TrimPrefix(m.Attachment.URL, "http://127.0.0.1:12345")
+	require.Equal(t, 200, request(t, s, "GET", path, "", nil).Code)
+	rr = request(t, s, "GET", "/public-files/json?poll=1", "", philAuth)
+	require.NotContains(t, toMessage(t, strings.TrimSpace(rr.Body.String())).Attachment.URL, "sig=")
+	require.NotContains(t, s.signAttachmentURL(m).Attachment.URL, "sig=")
+}
+
+func TestServer_AttachmentAuth_SignatureWithoutUserManager(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	require.Nil(t, s.userManager)
+
+	content := "text file!" + util.RandomString(4990)
+	rr := request(t, s, "PUT", "/mytopic", content, nil)
+	require.Equal(t, 200, rr.Code)
+	path := strings.TrimPrefix(toMessage(t, rr.Body.String()).Attachment.URL, "http://127.0.0.1:12345")
+
+	// Signature parameters are ignored, since there are no signing keys
+	rr = request(t, s, "GET", path+"?sig=AAAA&expires=99999999999&key=x", "", nil)
+	require.Equal(t, 200, rr.Code)
+	require.Equal(t, content, rr.Body.String())
+	rr = request(t, s, "GET", "/file/doesnotexist.txt?sig=AAAA&expires=99999999999&key=x", "", nil)
+	require.Equal(t, 404, rr.Code)
+}
@@ -0,0 +1,256 @@
+package server
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/util"
+)
+
+// Auth failures are tracked per username+IP combination, in addition to the per-visitor auth failure rate limiter
+// (see visitor.AuthAllowed), to resist credential stuffing on public instances:
+//
+//   - Every failed attempt is answered with a delay ("auth-failure-delay"), which doubles with every consecutive
+//     failure (up to authFailureDelayMax). This ties up the attacker's connections (tarpit).
+//   - After "auth-lockout-threshold" consecutive failures, the username+IP combination is locked out for
+//     "auth-lockout-duration". The duration doubles with every further lockout (up to authLockoutDurationMax).
+//     Since the IP address is part of the key, an attacker cannot lock out a legitimate user from other places.
+//
+// Failures are forgotten after a successful login. Lockouts are held in memory only, and can be inspected and
+// cleared by admins via /v1/admin/lockouts. Token auth failures are tracked with an empty username.
+
+const (
+	authFailureDelayMax      = 10 * time.Second
+	authLockoutDurationMax   = 24 * time.Hour
+	authFailureRetentionTime = 24 * time.Hour // Entries without failures for this long are pruned
+)
+
+type authLockoutKey struct {
+	username string
+	ip       netip.Addr
+}
+
+// authLockout is the auth failure state of a single username+IP combination
+type authLockout struct {
+	Username    string
+	IP          netip.Addr
+	Failures    int // Consecutive failures since the last lockout
+	Lockouts    int // Number of lockouts so far, used to increase the lockout duration
+	LastFailure time.Time
+	LockedUntil time.Time
+}
+
+// authLockouts is the in-memory list of auth failures and lockouts
+type authLockouts struct {
+	entries map[authLockoutKey]*authLockout
+	mu      sync.Mutex
+}
+
+func newAuthLockouts() *authLockouts {
+	return &authLockouts{
+		entries: make(map[authLockoutKey]*authLockout),
+	}
+}
+
+// LockedUntil returns the end of the lockout of the given username and IP address, or the zero time if
+// it is not locked out
+func (l *authLockouts) LockedUntil(username string, ip netip.Addr) time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.entries[authLockoutKey{username, ip}]
+	if !ok || !e.LockedUntil.After(time.Now()) {
+		return time.Time{}
+	}
+	return e.LockedUntil
+}
+
+// Failed records a failed attempt, and returns the delay before the response should be sent, and whether
+// the username+IP combination was locked out by this failure
+func (l *authLockouts) Failed(username string, ip netip.Addr, conf *Config) (delay time.Duration, locked bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	key := authLockoutKey{username, ip}
+	e, ok := l.entries[key]
+	if !ok {
+		e = &authLockout{Username: username, IP: ip}
+		l.entries[key] = e
+	} else if now.Sub(e.LastFailure) > conf.AuthLockoutDuration {
+		e.Failures = 0 // Not consecutive anymore
+	}
+	e.Failures++
+	e.LastFailure = now
+	if conf.AuthFailureDelay > 0 {
+		delay = authFailureDelayMax
+		if e.Failures < 16 {
+			delay = min(conf.AuthFailureDelay<<(e.Failures-1), authFailureDelayMax)
+		}
+	}
+	if conf.AuthLockoutThreshold > 0 && e.Failures >= conf.AuthLockoutThreshold {
+		duration := authLockoutDurationMax
+		if e.Lockouts < 16 {
+			duration = min(conf.AuthLockoutDuration<<e.Lockouts, authLockoutDurationMax)
+		}
+		e.Failures = 0
+		e.Lockouts++
+		e.LockedUntil = now.Add(duration)
+		locked = true
+	}
+	return delay, locked
+}
+
+// Succeeded forgets all failures of the given username and IP address
+func (l *authLockouts) Succeeded(username string, ip netip.Addr) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.entries, authLockoutKey{username, ip})
+}
+
+// Entries returns copies of all entries, most recent failure first
+func (l *authLockouts) Entries() []authLockout {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entries := make([]authLockout, 0, len(l.entries))
+	for _, e := range l.entries {
+		entries = append(entries, *e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].LastFailure.After(entries[j].LastFailure)
+	})
+	return entries
+}
+
+// Clear removes all entries matching the given username and/or IP address (an empty username and an invalid
+// IP address match everything), and returns the number of removed entries
+func (l *authLockouts) Clear(username string, ip netip.Addr) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var cleared int
+	for key := range l.entries {
+		if (username == "" || key.username == username) && (!ip.IsValid() || key.ip == ip) {
+			delete(l.entries, key)
+			cleared++
+		}
+	}
+	return cleared
+}
+
+// Prune removes all entries that are not locked out and have not failed recently, and returns the number
+// of removed entries
+func (l *authLockouts) Prune(now time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var pruned int
+	for key, e := range l.entries {
+		if !e.LockedUntil.After(now) && now.Sub(e.LastFailure) > authFailureRetentionTime {
+			delete(l.entries, key)
+			pruned++
+		}
+	}
+	return pruned
+}
+
+// checkAuthLockout returns an error if the username+IP combination of an auth attempt is locked out
+func (s *Server) checkAuthLockout(r *http.Request, v *visitor, header string) error {
+	username := authLockoutUsername(header)
+	until := s.authLockouts.LockedUntil(username, v.IP())
+	if until.IsZero() {
+		return nil
+	}
+	logvr(v, r).Tag(tagAccount).Field("user_name", username).Debug("Auth attempt rejected, locked out until %s", util.FormatTime(until))
+	return errHTTPTooManyRequestsAuthLockout.Wrap("try again after %s", until.UTC().Format(time.RFC3339))
+}
+
+// authFailed records a failed auth attempt, and holds the response back for the progressive delay (tarpit),
+// unless the client goes away before that
+func (s *Server) authFailed(r *http.Request, v *visitor, header string) {
+	username := authLockoutUsername(header)
+	delay, locked := s.authLockouts.Failed(username, v.IP(), s.config())
+	if locked {
+		minc(metricAuthLockouts)
+		logvr(v, r).Tag(tagAccount).Field("user_name", username).Warn("Too many failed auth attempts, locking out user %s from %s", username, v.IP().String())
+	}
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+		}
+	}
+}
+
+func (s *Server) pruneAuthLockouts() {
+	if pruned := s.authLockouts.Prune(time.Now()); pruned > 0 {
+		log.Tag(tagManager).Debug("Removed %d stale auth failure record(s)", pruned)
+	}
+}
+
+// handleAuthLockoutsGet lists all recent auth failures and lockouts
+func (s *Server) handleAuthLockoutsGet(w http.ResponseWriter, _ *http.Request, _ *visitor) error {
+	now := time.Now()
+	lockouts := make([]*apiAuthLockoutResponse, 0)
+	for _, e := range s.authLockouts.Entries() {
+		lockout := &apiAuthLockoutResponse{
+			Username:    e.Username,
+			IP:          e.IP.String(),
+			Failures:    e.Failures,
+			Lockouts:    e.Lockouts,
+			LastFailure: e.LastFailure.Unix(),
+		}
+		if e.LockedUntil.After(now) {
+			lockout.LockedUntil = e.LockedUntil.Unix()
+		}
+		lockouts = append(lockouts, lockout)
+	}
+	return s.writeJSON(w, &apiAuthLockoutsResponse{
+		Lockouts: lockouts,
+	})
+}
+
+// handleAuthLockoutsClear clears the auth failures and lockouts of a username, an IP address, or both
+func (s *Server) handleAuthLockoutsClear(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	req, err := readJSONWithLimit[apiAuthLockoutsClearRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	} else if req.Username == "" && req.IP == "" {
+		return errHTTPBadRequestLockoutInvalid
+	}
+	var ip netip.Addr
+	if req.IP != "" {
+		ip, err = netip.ParseAddr(strings.TrimSpace(req.IP))
+		if err != nil {
+			return errHTTPBadRequestLockoutInvalid.Wrap("invalid IP address")
+		}
+	}
+	cleared := s.authLockouts.Clear(req.Username, ip)
+	if cleared == 0 {
+		return errHTTPNotFoundLockout
+	}
+	logvr(v, r).
+		Tag(tagAccount).
+		Fields(log.Context{
+			"user_name":        req.Username,
+			"lockout_ip":       req.IP,
+			"lockouts_cleared": cleared,
+		}).
+		Info("Cleared %d auth lockout(s)", cleared)
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+// authLockoutUsername returns the username of a Basic auth header, or an empty string for tokens
+func authLockoutUsername(header string) string {
+	if !strings.HasPrefix(strings.ToLower(header), "basic ") {
+		return ""
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(header[len("basic "):]))
+	if err != nil {
+		return ""
+	}
+	username, _, _ := strings.Cut(string(b), ":")
+	return username
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+	"net/http"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestServer_AuthLockout(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthLockoutThreshold = 3
+	c.AuthLockoutDuration = time.Hour
+	s := newTestServer(t, c)
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	fromAttacker := func(r *http.Request) {
+		r.RemoteAddr = "1.2.3.4"
+	}
+
+	for i := 0; i < 3; i++ {
+		response := request(t, s, "GET", "/v1/account", "", map[string]string{
+			"Authorization": util.BasicAuth("ben", "wrong"),
+		}, fromAttacker)
+		require.Equal(t, 401, response.Code)
+	}
+
+	// Locked out, even with the correct password
+	response := request(t, s, "GET", "/v1/account", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	}, fromAttacker)
+	require.Equal(t, 429, response.Code)
+	err := toHTTPError(t, response.Body.String())
+	require.Equal(t, 42915, err.Code)
+	require.Contains(t, err.Message, "try again after")
+
+	// Other users from the same IP, and the same user from other IPs are not affected
+	response = request(t, s, "GET", "/v1/account", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	}, fromAttacker)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "GET", "/v1/account", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 200, response.Code)
+
+	// Admin can inspect lockouts
+	admin := map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	}
+	response = request(t, s, "GET", "/v1/admin/lockouts", "", admin)
+	require.Equal(t, 200, response.Code)
+	var lockouts apiAuthLockoutsResponse
+	require.Nil(t, json.NewDecoder(response.Body).Decode(&lockouts))
+	require.Equal(t, 1, len(lockouts.Lockouts))
+	require.Equal(t, "ben", lockouts.Lockouts[0].Username)
+	require.Equal(t, "1.2.3.4", lockouts.Lockouts[0].IP)
+	require.Equal(t, 1, lockouts.Lockouts[0].Lockouts)
+	require.True(t, lockouts.Lockouts[0].LockedUntil > time.Now().Add(59*time.Minute).Unix())
+
+	// ... and clear them
+	response = request(t, s, "DELETE", "/v1/admin/lockouts", `{"username": "ben", "ip": "1.2.3.4"}`, admin)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "GET", "/v1/account", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	}, fromAttacker)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "DELETE", "/v1/admin/lockouts", `{"ip": "1.2.3.4"}`, admin)
+	require.Equal(t, 404, response.Code)
+	require.Equal(t, 40406, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "DELETE", "/v1/admin/lockouts", `{}`, admin)
+	require.Equal(t, 40078, toHTTPError(t, response.Body.String()).Code)
+
+	// Only admins can see lockouts
+	response = request(t, s, "GET", "/v1/admin/lockouts", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 401, response.Code)
+}
+
+func TestServer_AuthLockout_SuccessResetsFailures(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthLockoutThreshold = 3
+	s := newTestServer(t, c)
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+
+	for i := 0; i < 5; i++ {
+		response := request(t, s, "GET", "/v1/account", "", map[string]string{
+			"Authorization": util.BasicAuth("ben", "wrong"),
+		})
+		require.Equal(t, 401, response.Code)
+		response = request(t, s, "GET", "/v1/account", "", map[string]string{
+			"Authorization": util.BasicAuth("ben", "ben"),
+		})
+		require.Equal(t, 200, response.Code)
+	}
+	require.Equal(t, 0, len(s.authLockouts.Entries()))
+}
+
+func TestServer_AuthLockout_Delay(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthFailureDelay = 50 * time.Millisecond
+	c.AuthLockoutThreshold = 0
+	s := newTestServer(t, c)
+
+	// Delays double: 50ms, 100ms, 200ms
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		response := request(t, s, "GET", "/v1/account", "", map[string]string{
+			"Authorization": util.BasicAuth("ben", "wrong"),
+		})
+		require.Equal(t, 401, response.Code)
+	}
+	require.GreaterOrEqual(t, time.Since(start), 350*time.Millisecond)
+	require.Equal(t, 0, s.authLockouts.Entries()[0].Lockouts)
+}
+
+func TestAuthLockouts_ProgressiveDuration(t *testing.T) {
+	c := NewConfig()
+	c.AuthLockoutThreshold = 2
+	c.AuthLockoutDuration = time.Minute
+	l := newAuthLockouts()
+	ip := netip.MustParseAddr("1.2.3.4")
+
+	_, locked := l.Failed("ben", ip, c)
+	require.False(t, locked)
+	_, locked = l.Failed("ben", ip, c)
+	require.True(t, locked)
+	require.WithinDuration(t, time.Now().Add(time.Minute), l.LockedUntil("ben", ip), time.Second)
+
+	l.Failed("ben", ip, c)
+	l.Failed("ben", ip, c)
+	require.WithinDuration(t, time.Now().Add(2*time.Minute), l.LockedUntil("ben", ip), time.Second)
+	require.True(t, l.LockedUntil("ben", netip.MustParseAddr("1.2.3.5")).IsZero())
+	require.True(t, l.LockedUntil("phil", ip).IsZero())
+
+	// Stale entries are pruned once the lockout is over
+	require.Equal(t, 0, l.Prune(time.Now()))
+	require.Equal(t, 1, l.Prune(time.Now().Add(authFailureRetentionTime+time.Minute)))
+}
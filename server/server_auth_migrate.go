@@ -0,0 +1,131 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/user"
+)
+
+// Enabling access control on an existing instance (auth-file, typically with auth-default-access: deny-all) instantly
+// breaks all anonymous publishers, and leaves the existing topics without an owner. The "auth-migrate-topics" option
+// guides this migration: Each entry assigns the cached topics matching a topic pattern to a user, e.g. "phil:backup-*".
+//
+// On startup, every matching topic that has messages in the message cache and that is not reserved yet is reserved
+// for the user. Everyone keeps read-write access by default (or the access given in the entry, e.g.
+// "phil:backup-*:read-only"), so that anonymous publishers continue to work until the owner changes the access.
+// Anonymous messages in the topics are attributed to the owner, so that they count towards the owner's limits.
+//
+// The migration runs on every startup, and is idempotent: Topics reserved by other users are skipped, and messages
+// that are already attributed to a user are not changed.
+
+// topicMigration assigns all cached topics matching a topic pattern to a user, see migrateTopics
+type topicMigration struct {
+	username string
+	pattern  *regexp.Regexp
+	everyone user.Permission
+}
+
+// parseTopicMigrations parses the "auth-migrate-topics" entries, in the format <username>:<topic-pattern>[:<everyone>]
+func parseTopicMigrations(entries []string) ([]*topicMigration, error) {
+	migrations := make([]*topicMigration, 0)
+	for _, entry := range entries {
+		migration, err := parseTopicMigration(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid topic migration %q: %w", entry, err)
+		}
+		migrations = append(migrations, migration)
+	}
+	return migrations, nil
+}
+
+func parseTopicMigration(entry string) (*topicMigration, error) {
+	parts := strings.Split(strings.TrimSpace(entry), ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return nil, errors.New("expected '<username>:<topic-pattern>[:<everyone-access>]'")
+	}
+	username, topicPattern := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+	if !user.AllowedUsername(username) || username == user.Everyone {
+		return nil, fmt.Errorf("invalid username %q", username)
+	} else if !user.AllowedTopicPattern(topicPattern) {
+		return nil, fmt.Errorf("invalid topic pattern %q", topicPattern)
+	}
+	pattern, err := topicPatternRegexp(topicPattern)
+	if err != nil {
+		return nil, err
+	}
+	everyone := user.PermissionReadWrite
+	if len(parts) == 3 {
+		everyone, err = user.ParsePermission(strings.TrimSpace(parts[2]))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &topicMigration{
+		username: username,
+		pattern:  pattern,
+		everyone: everyone,
+	}, nil
+}
+
+// migrateTopics reserves the cached topics matching the given migrations for their users, and attributes the
+// anonymous messages in these topics to the owner. Topics that are reserved by another user are skipped.
+func migrateTopics(cache *messageCache, userManager *user.Manager, migrations []*topicMigration) error {
+	if len(migrations) == 0 {
+		return nil
+	} else if userManager == nil {
+		return errors.New("cannot migrate topics, access control is not enabled")
+	}
+	cachedTopics, err := cache.Topics()
+	if err != nil {
+		return err
+	}
+	topicIDs := make([]string, 0, len(cachedTopics))
+	for id := range cachedTopics {
+		topicIDs = append(topicIDs, id)
+	}
+	sort.Strings(topicIDs)
+	for _, migration := range migrations {
+		u, err := userManager.User(migration.username)
+		if errors.Is(err, user.ErrUserNotFound) {
+			return fmt.Errorf("cannot migrate topics, user %s does not exist", migration.username)
+		} else if err != nil {
+			return err
+		}
+		for _, topic := range topicIDs {
+			if !migration.pattern.MatchString(topic) || !user.AllowedTopic(topic) {
+				continue
+			}
+			if err := migrateTopic(cache, userManager, u, topic, migration.everyone); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func migrateTopic(cache *messageCache, userManager *user.Manager, u *user.User, topic string, everyone user.Permission) error {
+	owner, err := userManager.ReservationOwner(topic)
+	if err != nil {
+		return err
+	} else if owner != "" && owner != u.ID {
+		log.Tag(tagStartup).Field("topic", topic).Warn("Not migrating topic %s to user %s, it is reserved by another user", topic, u.Name)
+		return nil
+	} else if owner == "" {
+		if err := userManager.AddReservation(u.Name, topic, everyone); err != nil {
+			return err
+		}
+		log.Tag(tagStartup).Field("topic", topic).Info("Migrated topic %s: reserved for user %s, everyone has %s access", topic, u.Name, everyone.String())
+	}
+	messages, err := cache.AttributeMessages(topic, u.ID)
+	if err != nil {
+		return err
+	} else if messages > 0 {
+		log.Tag(tagStartup).Field("topic", topic).Info("Migrated topic %s: attributed %d anonymous message(s) to user %s", topic, messages, u.Name)
+	}
+	return nil
+}
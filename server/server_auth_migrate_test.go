@@ -0,0 +1,108 @@
+package server
+
+import (
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+	"testing"
+)
+
+func TestServer_AuthMigrateTopics(t *testing.T) {
+	// Existing instance without access control
+	c := newTestConfig(t)
+	s := newTestServer(t, c)
+	require.Equal(t, 200, request(t, s, "PUT", "/backup-db", "backup done", nil).Code)
+	require.Equal(t, 200, request(t, s, "PUT", "/backup-web", "backup failed", nil).Code)
+	require.Equal(t, 200, request(t, s, "PUT", "/backup-other", "not mine", nil).Code)
+	require.Equal(t, 200, request(t, s, "PUT", "/alerts", "unrelated", nil).Code)
+	s.closeDatabases()
+
+	// Enable access control
+	c = configureAuth(t, c)
+	c.AuthDefault = user.PermissionDenyAll
+	s = newTestServer(t, c)
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	require.Nil(t, s.userManager.AddReservation("ben", "backup-other", user.PermissionDenyAll))
+	s.closeDatabases()
+
+	// Migrate on startup
+	c.AuthMigrateTopics = []string{"phil:backup-*"}
+	s = newTestServer(t, c)
+	defer s.closeDatabases()
+
+	phil, err := s.userManager.User("phil")
+	require.Nil(t, err)
+	reservations, err := s.userManager.Reservations("phil")
+	require.Nil(t, err)
+	require.Equal(t, 2, len(reservations))
+	require.Equal(t, "backup-db", reservations[0].Topic)
+	require.Equal(t, user.PermissionReadWrite, reservations[0].Everyone)
+	require.Equal(t, "backup-web", reservations[1].Topic)
+
+	// Anonymous publishers still work, other topics follow the default access
+	require.Equal(t, 200, request(t, s, "PUT", "/backup-db", "backup done again", nil).Code)
+	require.Equal(t, 403, request(t, s, "PUT", "/backup-other", "denied", nil).Code)
+	require.Equal(t, 403, request(t, s, "PUT", "/alerts", "denied", nil).Code)
+
+	// Anonymous messages are attributed to the owner, unless the topic belongs to someone else
+	attributed, err := s.messageCache.AttributeMessages("backup-web", phil.ID)
+	require.Nil(t, err)
+	require.Equal(t, int64(0), attributed) // Already done during startup
+	attributed, err = s.messageCache.AttributeMessages("backup-other", "u_other")
+	require.Nil(t, err)
+	require.Equal(t, int64(1), attributed)
+
+	// Migration is idempotent
+	s.closeDatabases()
+	s = newTestServer(t, c)
+	defer s.closeDatabases()
+	reservations, err = s.userManager.Reservations("phil")
+	require.Nil(t, err)
+	require.Equal(t, 2, len(reservations))
+	owner, err := s.userManager.ReservationOwner("backup-other")
+	require.Nil(t, err)
+	ben, err := s.userManager.User("ben")
+	require.Nil(t, err)
+	require.Equal(t, ben.ID, owner)
+}
+
+func TestServer_AuthMigrateTopics_EveryoneAccess(t *testing.T) {
+	c := newTestConfig(t)
+	s := newTestServer(t, c)
+	require.Equal(t, 200, request(t, s, "PUT", "/backup-db", "backup done", nil).Code)
+	s.closeDatabases()
+
+	c = configureAuth(t, c)
+	s = newTestServer(t, c)
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	s.closeDatabases()
+
+	c.AuthMigrateTopics = []string{"phil:backup-*:read-only"}
+	s = newTestServer(t, c)
+	defer s.closeDatabases()
+	require.Equal(t, 403, request(t, s, "PUT", "/backup-db", "denied", nil).Code)
+	require.Equal(t, 200, request(t, s, "GET", "/backup-db/json?poll=1", "", nil).Code)
+	require.Equal(t, 200, request(t, s, "PUT", "/backup-db", "allowed", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	}).Code)
+}
+
+func TestServer_AuthMigrateTopics_Invalid(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthMigrateTopics = []string{"nobody:backup-*"}
+	_, err := New(c)
+	require.Error(t, err)
+
+	for _, entry := range []string{"phil", "phil:", "phil:backup-*:write-everything", "*:backup-*", "phil:backup/db"} {
+		_, err := parseTopicMigrations([]string{entry})
+		require.Error(t, err, entry)
+	}
+	migrations, err := parseTopicMigrations([]string{"phil:backup-*", " ben : alerts : read-only "})
+	require.Nil(t, err)
+	require.Equal(t, 2, len(migrations))
+	require.True(t, migrations[0].pattern.MatchString("backup-db"))
+	require.Equal(t, user.PermissionReadWrite, migrations[0].everyone)
+	require.Equal(t, "ben", migrations[1].username)
+	require.Equal(t, user.PermissionRead, migrations[1].everyone)
+}
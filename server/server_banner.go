@@ -0,0 +1,84 @@
+package server
+
+import (
+	"encoding/json"
+	"heckel.io/ntfy/v2/log"
+	"net/http"
+	"net/netip"
+	"strings"
+	"unicode/utf8"
+)
+
+// The banner (message of the day) is a short announcement by the server operator, e.g. a maintenance notice or a
+// policy update, which is shown in the web app. It is initially set via the "banner" config option, and can be
+// changed at runtime by admins (PUT/DELETE /v1/banner). Runtime changes are kept in memory only.
+//
+// Clients read the banner via /v1/config (or /config.js for the web app). When the banner changes, a "banner"
+// event is published to the sync topics of all connected users, so that they don't have to reload.
+
+const (
+	syncTopicBannerEvent = "banner"
+	bannerMessageLimit   = 1024 // Characters
+)
+
+func (s *Server) handleBannerChange(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	req, err := readJSONWithLimit[apiBannerRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	}
+	message := strings.TrimSpace(req.Message)
+	if message == "" || utf8.RuneCountInString(message) > bannerMessageLimit {
+		return errHTTPBadRequestBannerInvalid
+	}
+	logvr(v, r).Tag(tagManager).Field("banner", message).Info("Changing banner")
+	s.changeBanner(message)
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+func (s *Server) handleBannerDelete(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	logvr(v, r).Tag(tagManager).Info("Removing banner")
+	s.changeBanner("")
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+// changeBanner sets the banner, and notifies all connected users about the change
+func (s *Server) changeBanner(message string) {
+	s.mu.Lock()
+	s.banner = message
+	s.mu.Unlock()
+	go func() {
+		if err := s.publishBannerEvent(message); err != nil {
+			log.Tag(tagManager).Err(err).Warn("Error publishing banner to sync topics")
+		}
+	}()
+}
+
+// publishBannerEvent publishes a "banner" event to the sync topics of all users. Sync topics are only
+// published to if they exist, i.e. if a client is (or was recently) subscribed to them.
+func (s *Server) publishBannerEvent(message string) error {
+	if s.userManager == nil {
+		return nil
+	}
+	users, err := s.userManager.Users()
+	if err != nil {
+		return err
+	}
+	messageBytes, err := json.Marshal(&apiAccountSyncTopicResponse{Event: syncTopicBannerEvent, Banner: message})
+	if err != nil {
+		return err
+	}
+	for _, u := range users {
+		if u.SyncTopic == "" {
+			continue
+		}
+		syncTopic, ok := s.topics.Get(u.SyncTopic)
+		if !ok {
+			continue
+		}
+		v := s.visitor(netip.IPv4Unspecified(), u)
+		if err := syncTopic.Publish(v, newDefaultMessage(syncTopic.ID, string(messageBytes))); err != nil {
+			logv(v).Err(err).Trace("Error publishing banner to user's sync topic")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,324 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/user"
+)
+
+// Bans let admins block abusive visitors from publishing and subscribing via the API (/v1/admin/bans), instead of
+// having to firewall them. A ban applies to either an IP address or network (e.g. 1.2.3.4 or 1.2.3.0/24), or to a
+// user. Bans can be temporary (until a given time) or permanent.
+//
+// IP bans are stored in the message cache (see message_cache_bans.go) and held in memory. User bans are account
+// suspensions (see handleUsersSuspend), i.e. they are stored in the user database and also shown in the account.
+// Banning a user closes their active subscriptions; banned IP addresses keep their existing connections, but cannot
+// re-subscribe or publish.
+
+// ban is a ban of an IP address or network
+type ban struct {
+	Network netip.Prefix
+	Reason  string
+	Created time.Time
+	Until   time.Time // Zero means permanently
+}
+
+func (b *ban) active(now time.Time) bool {
+	return b.Until.IsZero() || b.Until.After(now)
+}
+
+// banList is the in-memory list of IP bans
+type banList struct {
+	bans map[netip.Prefix]*ban
+	mu   sync.RWMutex
+}
+
+// newBanList loads the IP bans from the message cache
+func newBanList(cache *messageCache) (*banList, error) {
+	bans, err := cache.Bans()
+	if err != nil {
+		return nil, err
+	}
+	l := &banList{
+		bans: make(map[netip.Prefix]*ban),
+	}
+	for _, b := range bans {
+		l.bans[b.Network] = b
+	}
+	return l, nil
+}
+
+// Lookup returns the active ban of the given IP address, or nil if it is not banned
+func (l *banList) Lookup(ip netip.Addr) *ban {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	now := time.Now()
+	for network, b := range l.bans {
+		if network.Contains(ip) && b.active(now) {
+			return b
+		}
+	}
+	return nil
+}
+
+// Bans returns all active bans, oldest first
+func (l *banList) Bans() []*ban {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	now := time.Now()
+	bans := make([]*ban, 0)
+	for _, b := range l.bans {
+		if b.active(now) {
+			bans = append(bans, b)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Created.Before(bans[j].Created)
+	})
+	return bans
+}
+
+func (l *banList) Add(b *ban) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.bans[b.Network] = b
+}
+
+// Remove removes the ban of the given network, and returns false if there was none
+func (l *banList) Remove(network netip.Prefix) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.bans[network]; !ok {
+		return false
+	}
+	delete(l.bans, network)
+	return true
+}
+
+// Prune removes all bans that have ended, and returns the number of removed bans
+func (l *banList) Prune(now time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var pruned int
+	for network, b := range l.bans {
+		if !b.active(now) {
+			delete(l.bans, network)
+			pruned++
+		}
+	}
+	return pruned
+}
+
+// checkBanned returns an error if the IP address of the visitor is banned. User bans are checked in autorizeTopic,
+// since they are account suspensions.
+func (s *Server) checkBanned(v *visitor) error {
+	b := s.bans.Lookup(v.IP())
+	if b == nil {
+		return nil
+	}
+	logv(v).Tag(tagManager).Field("ban_network", b.Network.String()).Debug("Access denied, IP address is banned")
+	return errHTTPForbiddenBanned.Wrap("%s", banDetails(b.Until, b.Reason)).With(v)
+}
+
+func (s *Server) pruneBans() {
+	if pruned := s.bans.Prune(time.Now()); pruned > 0 {
+		log.Tag(tagManager).Debug("Removed %d expired ban(s)", pruned)
+	}
+	if err := s.messageCache.RemoveExpiredBans(time.Now()); err != nil {
+		log.Tag(tagManager).Err(err).Warn("Error removing expired bans")
+	}
+}
+
+// handleBansGet lists all active bans, as well as all current visitors and their stats, so that admins can spot
+// abusive visitors
+func (s *Server) handleBansGet(w http.ResponseWriter, _ *http.Request, _ *visitor) error {
+	bans := make([]*apiBanResponse, 0)
+	for _, b := range s.bans.Bans() {
+		bans = append(bans, &apiBanResponse{
+			IP:     b.Network.String(),
+			Reason: b.Reason,
+			Since:  b.Created.Unix(),
+			Until:  unixOrZero(b.Until),
+		})
+	}
+	if s.userManager != nil {
+		users, err := s.userManager.Users()
+		if err != nil {
+			return err
+		}
+		for _, u := range users {
+			if u.IsSuspended() {
+				bans = append(bans, &apiBanResponse{
+					Username: u.Name,
+					Reason:   u.Suspension.Reason,
+					Since:    u.Suspension.Since.Unix(),
+					Until:    max(u.Suspension.Until.Unix(), 0),
+				})
+			}
+		}
+	}
+	visitors := make([]*apiBanVisitorResponse, 0)
+	for _, v := range s.visitors.Values() {
+		u := v.User()
+		stats := v.Stats()
+		visitor := &apiBanVisitorResponse{
+			IP:            v.IP().String(),
+			Messages:      stats.Messages,
+			Emails:        stats.Emails,
+			Calls:         stats.Calls,
+			Subscriptions: v.Subscriptions(),
+			LastSeen:      v.Seen().Unix(),
+			Banned:        s.bans.Lookup(v.IP()) != nil || u.IsSuspended(),
+		}
+		if u != nil {
+			visitor.Username = u.Name
+		}
+		visitors = append(visitors, visitor)
+	}
+	sort.Slice(visitors, func(i, j int) bool {
+		return visitors[i].Messages > visitors[j].Messages
+	})
+	return s.writeJSON(w, &apiBansResponse{
+		Bans:     bans,
+		Visitors: visitors,
+	})
+}
+
+// handleBanAdd bans an IP address/network or a user
+func (s *Server) handleBanAdd(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	req, err := readJSONWithLimit[apiBanRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	} else if (req.IP == "") == (req.Username == "") {
+		return errHTTPBadRequestBanInvalid
+	} else if req.Until < 0 || (req.Until > 0 && req.Until < time.Now().Unix()) {
+		return errHTTPBadRequest.Wrap("until must be in the future, or 0 to ban permanently")
+	}
+	if req.Username != "" {
+		return s.handleBanAddUser(w, r, v, req)
+	}
+	network, err := parseBanNetwork(req.IP)
+	if err != nil {
+		return errHTTPBadRequestBanInvalid
+	} else if network.Contains(v.IP()) {
+		return errHTTPBadRequestBanInvalid.Wrap("cannot ban your own IP address")
+	}
+	b := &ban{
+		Network: network,
+		Reason:  req.Reason,
+		Created: time.Now(),
+	}
+	if req.Until > 0 {
+		b.Until = time.Unix(req.Until, 0)
+	}
+	logvr(v, r).
+		Tag(tagManager).
+		Fields(log.Context{
+			"ban_network": network.String(),
+			"ban_until":   req.Until,
+			"ban_reason":  req.Reason,
+		}).
+		Info("Banning %s", network.String())
+	if err := s.messageCache.AddBan(b); err != nil {
+		return err
+	}
+	s.bans.Add(b)
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+func (s *Server) handleBanAddUser(w http.ResponseWriter, r *http.Request, v *visitor, req *apiBanRequest) error {
+	if s.userManager == nil {
+		return errHTTPBadRequestBanInvalid.Wrap("user bans require auth-file to be set")
+	}
+	u, err := s.userManager.User(req.Username)
+	if errors.Is(err, user.ErrUserNotFound) {
+		return errHTTPBadRequestUserNotFound
+	} else if err != nil {
+		return err
+	} else if !u.IsUser() {
+		return errHTTPUnauthorized.Wrap("can only ban regular users from API")
+	}
+	if err := s.suspendUser(r, v, u, req.Reason, req.Until); err != nil {
+		return err
+	}
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+// handleBanRemove lifts the ban of an IP address/network or a user
+func (s *Server) handleBanRemove(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	req, err := readJSONWithLimit[apiBanRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	} else if (req.IP == "") == (req.Username == "") {
+		return errHTTPBadRequestBanInvalid
+	}
+	if req.Username != "" {
+		if s.userManager == nil {
+			return errHTTPNotFoundBan
+		}
+		u, err := s.userManager.User(req.Username)
+		if errors.Is(err, user.ErrUserNotFound) {
+			return errHTTPBadRequestUserNotFound
+		} else if err != nil {
+			return err
+		} else if !u.IsSuspended() {
+			return errHTTPNotFoundBan
+		}
+		return s.reinstateUser(w, r, v, req.Username)
+	}
+	network, err := parseBanNetwork(req.IP)
+	if err != nil {
+		return errHTTPBadRequestBanInvalid
+	}
+	if !s.bans.Remove(network) {
+		return errHTTPNotFoundBan
+	}
+	logvr(v, r).Tag(tagManager).Field("ban_network", network.String()).Info("Lifting ban of %s", network.String())
+	if err := s.messageCache.RemoveBan(network); err != nil {
+		return err
+	}
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+// parseBanNetwork parses an IP address (e.g. 1.2.3.4) or network (e.g. 1.2.3.0/24)
+func parseBanNetwork(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return prefix.Masked(), nil
+	}
+	ip, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(ip, ip.BitLen()), nil
+}
+
+// banDetails describes a ban (or suspension) for error messages
+func banDetails(until time.Time, reason string) string {
+	details := "permanently"
+	if !until.IsZero() {
+		details = "until " + until.UTC().Format(time.RFC3339)
+	}
+	if reason != "" {
+		details += ", reason: " + reason
+	}
+	return details
+}
+
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+	"net/http"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestServer_Bans_IP(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionReadWrite
+	s := newTestServer(t, c)
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	admin := map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	}
+	fromBannedIP := func(r *http.Request) {
+		r.RemoteAddr = "1.2.3.4"
+	}
+
+	response := request(t, s, "PUT", "/v1/admin/bans", `{"ip": "1.2.3.0/24", "reason": "spam"}`, admin)
+	require.Equal(t, 200, response.Code)
+
+	// Publishing and subscribing is blocked
+	response = request(t, s, "PUT", "/mytopic", "banned", nil, fromBannedIP)
+	require.Equal(t, 403, response.Code)
+	err := toHTTPError(t, response.Body.String())
+	require.Equal(t, 40307, err.Code)
+	require.Contains(t, err.Message, "permanently, reason: spam")
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil, fromBannedIP)
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "GET", "/v1/search?topics=mytopic&q=banned", "", nil, fromBannedIP)
+	require.Equal(t, 403, response.Code)
+
+	// Other IPs are not affected
+	response = request(t, s, "PUT", "/mytopic", "not banned", nil, func(r *http.Request) {
+		r.RemoteAddr = "1.2.4.1"
+	})
+	require.Equal(t, 200, response.Code)
+
+	// Bans survive restarts
+	s2 := newTestServer(t, c)
+	response = request(t, s2, "PUT", "/mytopic", "still banned", nil, fromBannedIP)
+	require.Equal(t, 403, response.Code)
+	response = request(t, s2, "GET", "/v1/admin/bans", "", admin)
+	require.Equal(t, 200, response.Code)
+	var bans apiBansResponse
+	require.Nil(t, json.NewDecoder(response.Body).Decode(&bans))
+	require.Equal(t, 1, len(bans.Bans))
+	require.Equal(t, "1.2.3.0/24", bans.Bans[0].IP)
+	require.Equal(t, "spam", bans.Bans[0].Reason)
+	require.Equal(t, int64(0), bans.Bans[0].Until)
+
+	// Lift ban
+	response = request(t, s, "DELETE", "/v1/admin/bans", `{"ip": "1.2.3.0/24"}`, admin)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/mytopic", "no longer banned", nil, fromBannedIP)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "DELETE", "/v1/admin/bans", `{"ip": "1.2.3.0/24"}`, admin)
+	require.Equal(t, 404, response.Code)
+	require.Equal(t, 40405, toHTTPError(t, response.Body.String()).Code)
+
+	s3 := newTestServer(t, c)
+	require.Nil(t, s3.bans.Lookup(netip.MustParseAddr("1.2.3.4")))
+}
+
+func TestServer_Bans_Temporary(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	s := newTestServer(t, c)
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+
+	until := time.Now().Add(time.Hour).Unix()
+	response := request(t, s, "PUT", "/v1/admin/bans", fmt.Sprintf(`{"ip": "1.2.3.4", "until": %d}`, until), map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/mytopic", "banned", nil, func(r *http.Request) {
+		r.RemoteAddr = "1.2.3.4"
+	})
+	require.Equal(t, 403, response.Code)
+	require.Contains(t, toHTTPError(t, response.Body.String()).Message, "until "+time.Unix(until, 0).UTC().Format(time.RFC3339))
+
+	// Expired bans are ignored, and removed by the manager
+	expired := &ban{
+		Network: netip.MustParsePrefix("5.6.7.8/32"),
+		Created: time.Now().Add(-time.Hour),
+		Until:   time.Now().Add(-time.Minute),
+	}
+	require.Nil(t, s.messageCache.AddBan(expired))
+	s.bans.Add(expired)
+	require.Nil(t, s.bans.Lookup(netip.MustParseAddr("5.6.7.8")))
+	s.execManager()
+	bans, err := s.messageCache.Bans()
+	require.Nil(t, err)
+	require.Equal(t, 1, len(bans))
+	require.Equal(t, "1.2.3.4/32", bans[0].Network.String())
+}
+
+func TestServer_Bans_User(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionReadWrite
+	s := newTestServer(t, c)
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	admin := map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	}
+	ben := map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	}
+
+	response := request(t, s, "PUT", "/mytopic", "before ban", ben)
+	require.Equal(t, 200, response.Code)
+
+	// User bans are account suspensions
+	response = request(t, s, "POST", "/v1/admin/bans", `{"username": "ben", "reason": "abuse"}`, admin)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/mytopic", "banned", ben)
+	require.Equal(t, 403, response.Code)
+	require.Equal(t, 40303, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "GET", "/v1/admin/bans", "", admin)
+	require.Equal(t, 200, response.Code)
+	var bans apiBansResponse
+	require.Nil(t, json.NewDecoder(response.Body).Decode(&bans))
+	require.Equal(t, 1, len(bans.Bans))
+	require.Equal(t, "ben", bans.Bans[0].Username)
+	require.Equal(t, "abuse", bans.Bans[0].Reason)
+
+	response = request(t, s, "DELETE", "/v1/admin/bans", `{"username": "ben"}`, admin)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/mytopic", "ban lifted", ben)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "DELETE", "/v1/admin/bans", `{"username": "ben"}`, admin)
+	require.Equal(t, 404, response.Code)
+}
+
+func TestServer_Bans_Visitors(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	for i := 0; i < 3; i++ {
+		response := request(t, s, "PUT", "/mytopic", "message", nil, func(r *http.Request) {
+			r.RemoteAddr = "1.2.3.4"
+		})
+		require.Equal(t, 200, response.Code)
+	}
+	response := request(t, s, "GET", "/v1/admin/bans", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+	var bans apiBansResponse
+	require.Nil(t, json.NewDecoder(response.Body).Decode(&bans))
+	require.Equal(t, 0, len(bans.Bans))
+	require.True(t, len(bans.Visitors) >= 2)
+	require.Equal(t, "1.2.3.4", bans.Visitors[0].IP)
+	require.Equal(t, int64(3), bans.Visitors[0].Messages)
+	require.False(t, bans.Visitors[0].Banned)
+}
+
+func TestServer_Bans_Invalid(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	admin := map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	}
+	for body, code := range map[string]int{
+		`{}`:                                   40077,
+		`{"ip": "1.2.3.4", "username": "ben"}`: 40077,
+		`{"ip": "not an ip"}`:                  40077,
+		`{"ip": "9.9.9.0/24"}`:                 40077, // Own IP address
+		`{"ip": "1.2.3.4", "until": 1000}`:     40000, // In the past
+		`{"username": "phil"}`:                 40101, // Admins cannot be banned
+		`{"username": "does-not-exist"}`:       40031,
+	} {
+		response := request(t, s, "PUT", "/v1/admin/bans", body, admin)
+		require.Equal(t, code, toHTTPError(t, response.Body.String()).Code, body)
+	}
+
+	// Only admins can ban
+	response := request(t, s, "PUT", "/v1/admin/bans", `{"ip": "1.2.3.4"}`, map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 401, response.Code)
+}
@@ -0,0 +1,222 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+// Dashboards are read-only views of the latest messages of a topic, meant to be embedded into wallboards or status
+// pages (e.g. as an iframe), without handing out credentials for the topic:
+//
+//   - POST /v1/dashboard {"topic":"alerts","expires":"30d"} creates a dashboard token for a topic the user can read
+//   - GET /v1/dashboard/<token> renders the latest messages as an HTML page that refreshes itself
+//   - GET /v1/dashboard/<token>?format=json returns the latest messages as JSON, e.g. for custom widgets
+//
+// Dashboard tokens are not stored. They have the format <topic>.<user ID>.<expires>.<key ID>.<signature>, where the
+// signature is the HMAC-SHA256 of "<topic>.<user ID>.<expires>.<key ID>" with a signing key of purpose "dashboard"
+// (see server_signing_keys.go). The key is generated when the first token is created. Retiring it revokes all tokens
+// that were signed with it. Since the read access of the user that created the token is checked every time the
+// dashboard is viewed, a token also stops working if that user loses access to the topic, or is deleted.
+
+const (
+	dashboardTokenExpiryDefault = 30 * 24 * time.Hour
+	dashboardTokenExpiryMax     = 365 * 24 * time.Hour
+	dashboardLimitDefault       = 10
+	dashboardLimitMax           = 100
+	dashboardRefreshInterval    = 60 * time.Second
+)
+
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"time": func(t int64) string {
+		return time.Unix(t, 0).Format("Jan 2, 15:04")
+	},
+	"join": func(s []string) string {
+		return strings.Join(s, ", ")
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta http-equiv="refresh" content="{{.Refresh}}">
+<title>{{.Topic}}</title>
+<style>
+body { font-family: Roboto, Helvetica, Arial, sans-serif; margin: 0; padding: 8px; background: #fff; color: #222; }
+.message { border-left: 4px solid #338574; padding: 6px 10px; margin-bottom: 8px; background: #f5f5f5; border-radius: 4px; }
+.message.high { border-left-color: #e53935; }
+.meta { font-size: 12px; color: #666; }
+.title { font-weight: 500; }
+.body { white-space: pre-line; }
+.empty { color: #666; }
+</style>
+</head>
+<body>
+{{range .Messages}}<div class="message{{if ge .Priority 4}} high{{end}}">
+<div class="meta">{{time .Time}}{{if .Tags}} &middot; {{join .Tags}}{{end}}</div>
+{{if .Title}}<div class="title">{{.Title}}</div>{{end}}
+<div class="body">{{.Message}}</div>
+</div>
+{{else}}<div class="empty">No messages</div>
+{{end}}</body>
+</html>
+`))
+
+type dashboardTemplateData struct {
+	Topic    string
+	Refresh  int
+	Messages []*message
+}
+
+// handleDashboardTokenCreate creates a signed dashboard token for a topic the user has read access to, see above
+func (s *Server) handleDashboardTokenCreate(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	conf := s.config()
+	req, err := readJSONWithLimit[apiDashboardTokenRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	} else if !topicRegex.MatchString(req.Topic) {
+		return errHTTPBadRequestTopicInvalid
+	} else if !s.topicPermitted(v, req.Topic, user.PermissionRead) {
+		return errHTTPForbidden
+	}
+	expiry := dashboardTokenExpiryDefault
+	if req.Expires != "" {
+		expiry, err = util.ParseDuration(req.Expires)
+		if err != nil || expiry <= 0 || expiry > dashboardTokenExpiryMax {
+			return errHTTPBadRequestDashboardInvalid.Wrap("expires must be a duration of at most %s", util.FormatDuration(dashboardTokenExpiryMax))
+		}
+	}
+	key, err := s.dashboardSigningKey()
+	if err != nil {
+		return err
+	}
+	expires := time.Now().Add(expiry).Unix()
+	token := dashboardToken(key, req.Topic, v.User().ID, expires)
+	logvr(v, r).
+		Tag(tagAccount).
+		Fields(log.Context{
+			"topic":              req.Topic,
+			"dashboard_expires":  expires,
+			"dashboard_key_id":   key.ID,
+			"dashboard_lifetime": expiry.String(),
+		}).
+		Info("Created dashboard token for topic %s", req.Topic)
+	response := &apiDashboardTokenResponse{
+		Token:   token,
+		Expires: expires,
+	}
+	if conf.BaseURL != "" {
+		response.URL = fmt.Sprintf("%s%s/%s", conf.BaseURL, apiDashboardPath, token)
+	}
+	return s.writeJSON(w, response)
+}
+
+// handleDashboard renders the latest messages of the topic in the dashboard token, as HTML page or as JSON
+func (s *Server) handleDashboard(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	matches := apiDashboardRegex.FindStringSubmatch(r.URL.Path)
+	if len(matches) != 2 {
+		return errHTTPInternalErrorInvalidPath
+	}
+	topic, userID, err := s.verifyDashboardToken(matches[1])
+	if err != nil {
+		logvr(v, r).Tag(tagAccount).Err(err).Debug("Invalid dashboard token")
+		return errHTTPForbiddenDashboardToken
+	}
+	u, err := s.userManager.UserByID(userID)
+	if errors.Is(err, user.ErrUserNotFound) {
+		logvr(v, r).Tag(tagAccount).Field("user_id", userID).Debug("Dashboard token of deleted user")
+		return errHTTPForbiddenDashboardToken
+	} else if err != nil {
+		return err
+	} else if err := s.userManager.Authorize(u, topic, user.PermissionRead); err != nil {
+		logvr(v, r).Tag(tagAccount).Field("user_id", userID).Debug("Dashboard token of user without read access to topic %s", topic)
+		return errHTTPForbiddenDashboardToken
+	}
+	limit := dashboardLimitDefault
+	if limitStr := readParam(r, "x-limit", "limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 || limit > dashboardLimitMax {
+			return errHTTPBadRequestDashboardInvalid.Wrap("limit must be a number between 1 and %d", dashboardLimitMax)
+		}
+	}
+	messages, err := s.messageCache.MessagesLatest(topic, limit)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	if strings.ToLower(readParam(r, "x-format", "format")) == "json" {
+		w.Header().Set("Access-Control-Allow-Origin", s.config().AccessControlAllowOrigin) // CORS, allow cross-origin requests
+		return s.writeJSON(w, &apiDashboardResponse{
+			Topic:    topic,
+			Messages: messages,
+		})
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	return dashboardTemplate.Execute(w, &dashboardTemplateData{
+		Topic:    topic,
+		Refresh:  int(dashboardRefreshInterval.Seconds()),
+		Messages: messages,
+	})
+}
+
+// dashboardSigningKey returns the signing key for new dashboard tokens, see signingKey
+func (s *Server) dashboardSigningKey() (*user.SigningKey, error) {
+	return s.signingKey(signingKeyPurposeDashboard)
+}
+
+// verifyDashboardToken checks the signature and expiry of a dashboard token, and returns its topic and the ID of
+// the user that created it
+func (s *Server) verifyDashboardToken(token string) (topic string, userID string, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 5 {
+		return "", "", fmt.Errorf("invalid token format")
+	}
+	topic, userID, expiresStr, keyID := parts[0], parts[1], parts[2], parts[3]
+	signature, err := base64.RawURLEncoding.DecodeString(parts[4])
+	if err != nil {
+		return "", "", fmt.Errorf("invalid signature encoding")
+	}
+	expires, err := strconv.ParseInt(expiresStr, 10, 64)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid expiry")
+	} else if time.Now().Unix() > expires {
+		return "", "", fmt.Errorf("token expired")
+	}
+	keys, err := s.userManager.SigningKeys(signingKeyPurposeDashboard)
+	if err != nil {
+		return "", "", err
+	}
+	for _, key := range keys {
+		if key.ID == keyID {
+			if !hmac.Equal(signature, dashboardSignature(key.Secret, topic, userID, expiresStr, keyID)) {
+				return "", "", fmt.Errorf("invalid signature")
+			}
+			return topic, userID, nil
+		}
+	}
+	return "", "", fmt.Errorf("signing key %s not found or retired", keyID)
+}
+
+// dashboardToken returns a signed token for the given topic, user and expiry, see above
+func dashboardToken(key *user.SigningKey, topic, userID string, expires int64) string {
+	expiresStr := strconv.FormatInt(expires, 10)
+	signature := dashboardSignature(key.Secret, topic, userID, expiresStr, key.ID)
+	return fmt.Sprintf("%s.%s.%s.%s.%s", topic, userID, expiresStr, key.ID, base64.RawURLEncoding.EncodeToString(signature))
+}
+
+func dashboardSignature(secret, topic, userID, expires, keyID string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(fmt.Sprintf("%s.%s.%s.%s", topic, userID, expires, keyID)))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+func TestServer_Dashboard(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionDenyAll
+	c.BaseURL = "https://ntfy.example.com"
+	s := newTestServer(t, c)
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	require.Nil(t, s.userManager.AllowAccess("ben", "alerts", user.PermissionReadWrite))
+	ben := map[string]string{"Authorization": util.BasicAuth("ben", "ben")}
+
+	for i, msg := range []string{"first", "second", "<b>third</b>"} {
+		headers := map[string]string{"Authorization": util.BasicAuth("ben", "ben")}
+		if i == 2 {
+			headers["Priority"] = "5"
+		}
+		require.Equal(t, 200, request(t, s, "PUT", "/alerts", msg, headers).Code)
+	}
+
+	// Create token, only for readable topics
+	require.Equal(t, 401, request(t, s, "POST", "/v1/dashboard", `{"topic":"alerts"}`, nil).Code)
+	require.Equal(t, 403, request(t, s, "POST", "/v1/dashboard", `{"topic":"other"}`, ben).Code)
+	rr := request(t, s, "POST", "/v1/dashboard", `{"topic":"alerts","expires":"500d"}`, ben)
+	require.Equal(t, 400, rr.Code)
+	require.Equal(t, 40091, toHTTPError(t, rr.Body.String()).Code)
+	rr = request(t, s, "POST", "/v1/dashboard", `{"topic":"alerts","expires":"1d"}`, ben)
+	require.Equal(t, 200, rr.Code)
+	token, _ := util.UnmarshalJSON[apiDashboardTokenResponse](io.NopCloser(rr.Body))
+	require.True(t, strings.HasPrefix(token.Token, "alerts."))
+	require.Equal(t, "https://ntfy.example.com/v1/dashboard/"+token.Token, token.URL)
+
+	// JSON, no credentials needed
+	rr = request(t, s, "GET", "/v1/dashboard/"+token.Token+"?format=json&limit=2", "", nil)
+	require.Equal(t, 200, rr.Code)
+	dashboard, _ := util.UnmarshalJSON[apiDashboardResponse](io.NopCloser(rr.Body))
+	require.Equal(t, "alerts", dashboard.Topic)
+	require.Equal(t, 2, len(dashboard.Messages))
+	require.Equal(t, "<b>third</b>", dashboard.Messages[0].Message)
+	require.Equal(t, "second", dashboard.Messages[1].Message)
+
+	// HTML, with escaped message
+	rr = request(t, s, "GET", "/v1/dashboard/"+token.Token, "", nil)
+	require.Equal(t, 200, rr.Code)
+	require.Equal(t, "text/html; charset=utf-8", rr.Header().Get("Content-Type"))
+	require.Contains(t, rr.Body.String(), `<div class="message high">`)
+	require.Contains(t, rr.Body.String(), "&lt;b&gt;third&lt;/b&gt;")
+	require.Contains(t, rr.Body.String(), "first")
+
+	// Tampered tokens are rejected
+	tampered := strings.Replace(token.Token, "alerts.", "other.", 1)
+	rr = request(t, s, "GET", "/v1/dashboard/"+tampered, "", nil)
+	require.Equal(t, 403, rr.Code)
+	require.Equal(t, 40310, toHTTPError(t, rr.Body.String()).Code)
+	require.Equal(t, 403, request(t, s, "GET", "/v1/dashboard/invalid", "", nil).Code)
+	require.Equal(t, 400, request(t, s, "GET", "/v1/dashboard/"+token.Token+"?limit=1000", "", nil).Code)
+
+	// Retiring the signing key revokes the token
+	keys, err := s.userManager.SigningKeys(signingKeyPurposeDashboard)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(keys))
+	require.Equal(t, 200, request(t, s, "DELETE", "/v1/admin/keys/"+keys[0].ID, "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	}).Code)
+	require.Equal(t, 403, request(t, s, "GET", "/v1/dashboard/"+token.Token, "", nil).Code)
+}
+
+func TestServer_Dashboard_CreatorLosesAccess(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionDenyAll
+	s := newTestServer(t, c)
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	require.Nil(t, s.userManager.AllowAccess("ben", "alerts", user.PermissionRead))
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.AllowAccess("phil", "alerts", user.PermissionRead))
+
+	rr := request(t, s, "POST", "/v1/dashboard", `{"topic":"alerts"}`, map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 200, rr.Code)
+	benToken, _ := util.UnmarshalJSON[apiDashboardTokenResponse](io.NopCloser(rr.Body))
+	rr = request(t, s, "POST", "/v1/dashboard", `{"topic":"alerts"}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	philToken, _ := util.UnmarshalJSON[apiDashboardTokenResponse](io.NopCloser(rr.Body))
+	require.Equal(t, 200, request(t, s, "GET", "/v1/dashboard/"+benToken.Token, "", nil).Code)
+	require.Equal(t, 200, request(t, s, "GET", "/v1/dashboard/"+philToken.Token, "", nil).Code)
+
+	// Revoking the creator's read access revokes the token, other tokens keep working
+	require.Nil(t, s.userManager.ResetAccess("ben", "alerts"))
+	rr = request(t, s, "GET", "/v1/dashboard/"+benToken.Token, "", nil)
+	require.Equal(t, 403, rr.Code)
+	require.Equal(t, 40310, toHTTPError(t, rr.Body.String()).Code)
+	require.Equal(t, 200, request(t, s, "GET", "/v1/dashboard/"+philToken.Token, "", nil).Code)
+
+	// Deleting the creator revokes the token
+	require.Nil(t, s.userManager.RemoveUser("phil"))
+	require.Equal(t, 403, request(t, s, "GET", "/v1/dashboard/"+philToken.Token, "", nil).Code)
+}
+
+func TestServer_Dashboard_Expired(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleAdmin))
+	u, err := s.userManager.User("ben")
+	require.Nil(t, err)
+	key, err := s.dashboardSigningKey()
+	require.Nil(t, err)
+	token := dashboardToken(key, "alerts", u.ID, 1000)
+	rr := request(t, s, "GET", "/v1/dashboard/"+token, "", nil)
+	require.Equal(t, 403, rr.Code)
+
+	// The same key is reused for new tokens
+	key2, err := s.dashboardSigningKey()
+	require.Nil(t, err)
+	require.Equal(t, key.ID, key2.ID)
+}
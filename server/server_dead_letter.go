@@ -0,0 +1,52 @@
+package server
+
+import (
+	"fmt"
+	"heckel.io/ntfy/v2/log"
+	"net/netip"
+)
+
+// If the "dead-letter-topic" option is set, messages that could not be delivered via Firebase, email or Web Push
+// are re-published to the dead-letter topic, along with the reason for the failure. This lets operators subscribe
+// to (and alert on) delivery failures, instead of losing them in the logs.
+//
+// Messages published to the dead-letter topic itself are never dead-lettered again, so there are no loops.
+
+const (
+	deadLetterChannelFirebase = "firebase"
+	deadLetterChannelEmail    = "email"
+	deadLetterChannelWebPush  = "webpush"
+	deadLetterTag             = "dead_letter"
+)
+
+// publishDeadLetter publishes a message to the dead-letter topic, describing the failed delivery of the original
+// message m via the given channel. It does nothing if no dead-letter topic is configured.
+func (s *Server) publishDeadLetter(m *message, channel string, err error) {
+	conf := s.config()
+	if conf.DeadLetterTopic == "" || m.Event != messageEvent || m.Topic == conf.DeadLetterTopic {
+		return
+	}
+	v := newVisitor(conf, s.messageCache, s.userManager, netip.IPv4Unspecified(), nil) // Background process, not a real visitor, uses IP 0.0.0.0
+	body := fmt.Sprintf("Message %s in topic %s could not be delivered via %s: %s", m.ID, m.Topic, channel, err.Error())
+	if m.Title != "" {
+		body += "\n\n" + m.Title
+	}
+	if m.Message != "" {
+		body += "\n\n" + m.Message
+	}
+	deadLetter := newDefaultMessage(conf.DeadLetterTopic, body)
+	deadLetter.Title = fmt.Sprintf("Delivery via %s failed", channel)
+	deadLetter.Priority = m.Priority
+	deadLetter.Tags = []string{deadLetterTag, channel}
+	log.
+		Tag(tagPublish).
+		With(m).
+		Fields(log.Context{
+			"dead_letter_topic":   conf.DeadLetterTopic,
+			"dead_letter_channel": channel,
+		}).
+		Debug("Publishing undeliverable message to dead-letter topic")
+	if err := s.publishMessage(v, deadLetter); err != nil {
+		logvm(v, deadLetter).Tag(tagPublish).Err(err).Warn("Unable to publish to dead-letter topic")
+	}
+}
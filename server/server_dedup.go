@@ -0,0 +1,103 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Message deduplication coalesces repeated publishes into one delivery, e.g. for alert storms from flapping monitors.
+// Publishers opt in per message, either with an explicit dedup ID (X-Dedup-ID: <id>), or by asking the server to
+// derive the ID from the message content (X-Dedup: yes). If another message with the same dedup ID was published to
+// the same topic within the dedup window (message-dedup-window), the new message is dropped, and the dedup_count of
+// the original message is increased instead.
+//
+// The window starts with the first delivered message and is not extended by duplicates, so that a long-lasting
+// storm still results in one delivery per window. Recent dedup IDs are kept in memory (see Server.dedups), i.e.
+// a restart resets all windows.
+
+const (
+	dedupIDMaxLength = 256
+)
+
+// messageDedup is the most recent delivered message for a dedup ID in a topic
+type messageDedup struct {
+	message *message // Copy of the delivered message, returned to publishers of duplicates
+	expires time.Time
+}
+
+// parseDedupID returns the dedup ID for the message (as passed via X-Dedup-ID, or derived from the content
+// if X-Dedup is set), or an empty string if the message should not be deduplicated
+func parseDedupID(r *http.Request, m *message) (string, *errHTTP) {
+	dedupID := readParam(r, "x-dedup-id", "dedup-id")
+	if dedupID != "" {
+		if len(dedupID) > dedupIDMaxLength {
+			return "", errHTTPBadRequestDedupIDInvalid
+		}
+		return "id:" + dedupID, nil
+	} else if readBoolParam(r, false, "x-dedup", "dedup") {
+		return "hash:" + messageContentHash(m), nil
+	}
+	return "", nil
+}
+
+// messageContentHash returns a hash over the user-visible fields of a message, used for hash-based deduplication
+func messageContentHash(m *message) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%d\x00%s\x00%s\x00%s", m.Title, m.Message, m.Priority, strings.Join(m.Tags, ","), m.Click, m.Icon)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// dedupMessage checks if a message with the same dedup ID has been published to the topic within the dedup window.
+// If so, it increases the dedup count of the original message, and returns it. Otherwise, it records m as the original
+// message for the dedup ID, and returns nil. If publishing m fails afterwards, the caller must call removeDedup.
+func (s *Server) dedupMessage(t *topic, dedupID string, m *message) (*message, error) {
+	key := fmt.Sprintf("%s/%s", t.ID, dedupID)
+	s.mu.Lock()
+	entry, ok := s.dedups[key]
+	if !ok || time.Now().After(entry.expires) {
+		original := *m
+		s.dedups[key] = &messageDedup{
+			message: &original,
+			expires: time.Now().Add(s.config().MessageDedupWindow),
+		}
+		s.mu.Unlock()
+		return nil, nil
+	}
+	entry.message.DedupCount++
+	original := *entry.message
+	s.mu.Unlock()
+	if err := s.messageCache.UpdateDedupCount(original.ID, original.DedupCount); err != nil {
+		return nil, err
+	}
+	return &original, nil
+}
+
+// removeDedup removes the dedup ID again if m was recorded as its original message, e.g. if publishing m failed, so
+// that the next message with the same dedup ID is delivered instead of being coalesced into a message that was never
+// delivered. If dedupID is empty, this is a no-op.
+func (s *Server) removeDedup(t *topic, dedupID string, m *message) {
+	if dedupID == "" {
+		return
+	}
+	key := fmt.Sprintf("%s/%s", t.ID, dedupID)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if entry, ok := s.dedups[key]; ok && entry.message.ID == m.ID {
+		delete(s.dedups, key)
+	}
+}
+
+// pruneDedups removes dedup IDs whose dedup window has passed
+func (s *Server) pruneDedups() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, entry := range s.dedups {
+		if time.Now().After(entry.expires) {
+			delete(s.dedups, key)
+		}
+	}
+}
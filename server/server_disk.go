@@ -0,0 +1,149 @@
+package server
+
+import (
+	"fmt"
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/util"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The disk space watchdog protects the server from running out of disk space, which may corrupt the SQLite
+// message cache. If "disk-space-min-free" is set, the free disk space of the file systems of the message cache
+// (cache-file) and the attachment cache (attachment-cache-dir) is checked every "disk-space-check-interval".
+//
+// If the free disk space drops below the minimum, the watchdog:
+//   - deletes expired messages and attachments right away (instead of waiting for the next manager run)
+//   - deletes the oldest attachments, even if they have not expired yet, until enough space is available again
+//   - rejects new attachments and uploads with a 507 Insufficient Storage, until enough space is available again
+//   - publishes a "disk_space" server event to the server events topic, if configured (also if pruning was enough)
+//
+// Once the free disk space is above the minimum again, attachments are accepted again, and another server event
+// is published. Note that deleting messages does not shrink the SQLite database file; its pages are only reused.
+
+const (
+	serverEventDiskSpace       = "disk_space"
+	diskSpacePruneBatchSize    = 100 // Number of attachments deleted at once during emergency pruning
+	diskSpacePruneBatchesMax   = 10  // Max. number of batches per check, so that a single check does not delete everything
+	diskSpaceLowPriority       = 5
+	diskSpaceRecoveredPriority = 3
+)
+
+func (s *Server) runDiskWatchdog() {
+	if s.config().DiskSpaceMinFree <= 0 {
+		return
+	}
+	for {
+		s.checkDiskSpace()
+		select {
+		case <-time.After(s.config().DiskSpaceCheckInterval):
+		case <-s.closeChan:
+			return
+		}
+	}
+}
+
+// checkDiskSpace checks the free disk space, prunes messages and attachments if it is below the minimum, and
+// publishes a server event if the state changed, see above for details
+func (s *Server) checkDiskSpace() {
+	minFree := uint64(s.config().DiskSpaceMinFree)
+	free, err := s.diskSpaceFree()
+	if err != nil {
+		log.Tag(tagManager).Err(err).Warn("Unable to check free disk space")
+		return
+	}
+	var prunedAttachments int
+	if free < minFree {
+		log.Tag(tagManager).Warn("Free disk space %s is below %s, pruning messages and attachments", util.FormatSize(int64(free)), util.FormatSize(int64(minFree)))
+		free, prunedAttachments, err = s.pruneForDiskSpace(minFree)
+		if err != nil {
+			log.Tag(tagManager).Err(err).Warn("Error pruning messages and attachments to free up disk space")
+		}
+	}
+	low := free < minFree
+	wasLow := s.diskSpaceLow.Swap(low)
+	if low && !wasLow {
+		log.Tag(tagManager).Warn("Free disk space %s is still below %s after pruning, rejecting new attachments", util.FormatSize(int64(free)), util.FormatSize(int64(minFree)))
+		message := fmt.Sprintf("Only %s of disk space is left (min. %s). Expired messages and %d attachment(s) were deleted, and new attachments are rejected until more space is available. %s", util.FormatSize(int64(free)), util.FormatSize(int64(minFree)), prunedAttachments, s.diskSpaceUsage())
+		s.publishServerEvent(serverEventDiskSpace, diskSpaceLowPriority, "Disk space low", message)
+	} else if !low && wasLow {
+		log.Tag(tagManager).Info("Free disk space %s is above %s again, accepting attachments", util.FormatSize(int64(free)), util.FormatSize(int64(minFree)))
+		message := fmt.Sprintf("%s of disk space is available again, attachments are accepted again. %s", util.FormatSize(int64(free)), s.diskSpaceUsage())
+		s.publishServerEvent(serverEventDiskSpace, diskSpaceRecoveredPriority, "Disk space recovered", message)
+	} else if !low && prunedAttachments > 0 {
+		message := fmt.Sprintf("Free disk space was below %s. %d attachment(s) were deleted before they expired to free up disk space, %s is available now. %s", util.FormatSize(int64(minFree)), prunedAttachments, util.FormatSize(int64(free)), s.diskSpaceUsage())
+		s.publishThrottledServerEvent(serverEventDiskSpace, "pruned", diskSpaceLowPriority, "Disk space low, attachments deleted", message)
+	}
+}
+
+// pruneForDiskSpace deletes expired messages and attachments, and then the oldest attachments (even if they have
+// not expired), until the free disk space is at least minFree. It returns the free disk space after pruning, and
+// the number of deleted non-expired attachments.
+func (s *Server) pruneForDiskSpace(minFree uint64) (uint64, int, error) {
+	s.pruneMessages()
+	s.pruneAttachments()
+	var pruned int
+	for i := 0; i < diskSpacePruneBatchesMax && s.fileCache != nil; i++ {
+		free, err := s.diskSpaceFree()
+		if err != nil {
+			return 0, pruned, err
+		} else if free >= minFree {
+			return free, pruned, nil
+		}
+		ids, err := s.messageCache.AttachmentsOldest(diskSpacePruneBatchSize)
+		if err != nil {
+			return free, pruned, err
+		} else if len(ids) == 0 {
+			break
+		}
+		log.Tag(tagManager).Debug("Deleting %d oldest attachment(s) to free up disk space", len(ids))
+		if err := s.fileCache.Remove(ids...); err != nil {
+			return free, pruned, err
+		}
+		if err := s.messageCache.MarkAttachmentsDeleted(ids...); err != nil {
+			return free, pruned, err
+		}
+		pruned += len(ids)
+		s.messagesPruned(0, len(ids))
+	}
+	free, err := s.diskSpaceFree()
+	return free, pruned, err
+}
+
+// diskSpaceFree returns the lowest free disk space of the file systems of the message cache and attachment cache
+func (s *Server) diskSpaceFree() (uint64, error) {
+	conf := s.config()
+	paths := make([]string, 0)
+	if conf.CacheFile != "" {
+		paths = append(paths, filepath.Dir(conf.CacheFile))
+	}
+	if conf.AttachmentCacheDir != "" {
+		paths = append(paths, conf.AttachmentCacheDir)
+	}
+	free := uint64(math.MaxUint64)
+	for _, path := range paths {
+		pathFree, err := s.diskFree(path)
+		if err != nil {
+			return 0, err
+		}
+		free = min(free, pathFree)
+	}
+	return free, nil
+}
+
+// diskSpaceUsage returns a human-readable summary of the size of the message cache and the attachment cache
+func (s *Server) diskSpaceUsage() string {
+	conf := s.config()
+	var cacheSize, attachmentsSize int64
+	if conf.CacheFile != "" {
+		if stat, err := os.Stat(conf.CacheFile); err == nil {
+			cacheSize = stat.Size()
+		}
+	}
+	if s.fileCache != nil {
+		attachmentsSize = s.fileCache.Size()
+	}
+	return fmt.Sprintf("Message cache: %s, attachment cache: %s.", util.FormatSize(cacheSize), util.FormatSize(attachmentsSize))
+}
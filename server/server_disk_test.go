@@ -0,0 +1,115 @@
+package server
+
+import (
+	"errors"
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/util"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestServer_DiskSpace_LowRejectsAttachmentsAndRecovers(t *testing.T) {
+	c := newTestConfig(t)
+	c.ServerEventsTopic = "ntfy-events"
+	c.DiskSpaceMinFree = 1024 * 1024
+	s := newTestServer(t, c)
+	free := uint64(10 * 1024 * 1024)
+	s.diskFree = func(_ string) (uint64, error) {
+		return free, nil
+	}
+
+	// Enough space, attachments are accepted
+	s.checkDiskSpace()
+	response := request(t, s, "PUT", "/mytopic", "text file!"+util.RandomString(4990), nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, 0, len(serverEventMessages(t, s)))
+
+	// Low on disk space; pruning does not help, so attachments are rejected
+	free = 1000
+	s.checkDiskSpace()
+	require.True(t, s.diskSpaceLow.Load())
+	response = request(t, s, "PUT", "/mytopic", "text file!"+util.RandomString(4990), nil)
+	require.Equal(t, 507, response.Code)
+	require.Equal(t, 50702, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "POST", "/v1/attachments", "", map[string]string{
+		"Upload-Length": "5000",
+	})
+	require.Equal(t, 507, response.Code)
+
+	// Normal messages are still accepted
+	response = request(t, s, "PUT", "/mytopic", "just a message", nil)
+	require.Equal(t, 200, response.Code)
+
+	// Recovered, attachments are accepted again
+	free = 2 * 1024 * 1024
+	s.checkDiskSpace()
+	require.False(t, s.diskSpaceLow.Load())
+	response = request(t, s, "PUT", "/mytopic", "text file!"+util.RandomString(4990), nil)
+	require.Equal(t, 200, response.Code)
+
+	messages := serverEventMessages(t, s)
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "Disk space low", messages[0].Title)
+	require.Equal(t, []string{"server_event", "disk_space"}, messages[0].Tags)
+	require.Equal(t, 5, messages[0].Priority)
+	require.Contains(t, messages[0].Message, "Only 1000 of disk space is left (min. 1M)")
+	require.Contains(t, messages[0].Message, "1 attachment(s) were deleted")
+	require.Equal(t, "Disk space recovered", messages[1].Title)
+}
+
+func TestServer_DiskSpace_PruneOldestAttachments(t *testing.T) {
+	c := newTestConfig(t)
+	c.ServerEventsTopic = "ntfy-events"
+	c.DiskSpaceMinFree = 1024*1024 - 6000
+	s := newTestServer(t, c)
+	s.diskFree = func(_ string) (uint64, error) {
+		return uint64(1024*1024 - s.fileCache.Size()), nil // Attachments are the only thing on this disk
+	}
+
+	response := request(t, s, "PUT", "/mytopic", "text file!"+util.RandomString(4990), nil)
+	m1 := toMessage(t, response.Body.String())
+	response = request(t, s, "PUT", "/mytopic", "text file!"+util.RandomString(4990), nil)
+	m2 := toMessage(t, response.Body.String())
+	require.FileExists(t, filepath.Join(c.AttachmentCacheDir, m1.ID))
+	require.FileExists(t, filepath.Join(c.AttachmentCacheDir, m2.ID))
+
+	// Pruning deletes the (not yet expired) attachments, and frees up enough space
+	s.checkDiskSpace()
+	require.False(t, s.diskSpaceLow.Load())
+	require.NoFileExists(t, filepath.Join(c.AttachmentCacheDir, m1.ID))
+	require.NoFileExists(t, filepath.Join(c.AttachmentCacheDir, m2.ID))
+	require.Equal(t, int64(0), s.fileCache.Size())
+
+	// Messages are kept, only their attachments are gone
+	messages, err := s.messageCache.Messages("mytopic", sinceAllMessages, false)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(messages))
+	ids, err := s.messageCache.AttachmentsOldest(10)
+	require.Nil(t, err)
+	require.Empty(t, ids)
+
+	events := serverEventMessages(t, s)
+	require.Equal(t, 1, len(events))
+	require.Equal(t, "Disk space low, attachments deleted", events[0].Title)
+	require.Contains(t, events[0].Message, "2 attachment(s) were deleted before they expired")
+}
+
+func TestServer_DiskSpace_CheckFailed(t *testing.T) {
+	c := newTestConfig(t)
+	c.DiskSpaceMinFree = 1024 * 1024
+	s := newTestServer(t, c)
+	s.diskFree = func(_ string) (uint64, error) {
+		return 0, errors.New("not supported")
+	}
+	s.checkDiskSpace()
+	require.False(t, s.diskSpaceLow.Load())
+}
+
+func TestDiskFree(t *testing.T) {
+	free, err := diskFree(os.TempDir())
+	if err != nil {
+		t.Skip("not supported on this platform")
+	}
+	require.Greater(t, free, uint64(0))
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+// Secret email aliases let the owner of a reserved topic publish to it via email without exposing the topic name.
+// Instead of the predictable address ntfy-<topic>@<domain>, the owner generates an unguessable address (e.g.
+// ntfy-alerts-8f3a2bk1x9qz@ntfy.example.com, see handleAccountReservationEmailCreate). Emails to the alias may
+// publish to the topic regardless of the access control list, and once a topic has an alias, emails to its
+// regular address are rejected (see smtpSession.Rcpt).
+
+const (
+	emailAliasSecretLength  = 12
+	emailLocalPartMaxLength = 64 // See RFC 5321, section 4.5.3.1.1
+)
+
+// handleAccountReservationEmailCreate generates a new secret email alias for a topic reserved by the current user.
+// Any previous alias is replaced, i.e. emails to the old address are rejected.
+func (s *Server) handleAccountReservationEmailCreate(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	conf := s.config()
+	if conf.SMTPServerListen == "" {
+		return errHTTPBadRequestEmailPublishingDisabled
+	}
+	topic, err := s.ownedReservationFromPath(r, v, apiAccountReservationEmailRegex)
+	if err != nil {
+		return err
+	}
+	alias := newEmailAlias(conf.SMTPServerAddrPrefix, topic)
+	logvr(v, r).Tag(tagAccount).Field("topic", topic).Debug("Generating email alias for topic reservation")
+	if err := s.userManager.SetReservationEmailAlias(v.User().Name, topic, alias); errors.Is(err, user.ErrReservationNotFound) {
+		return errHTTPUnauthorized
+	} else if err != nil {
+		return err
+	}
+	return s.writeJSON(w, &apiAccountReservationEmailResponse{
+		Address: s.emailAliasAddress(alias),
+	})
+}
+
+// handleAccountReservationEmailDelete removes the secret email alias of a topic reserved by the current user,
+// so that emails are accepted at the regular address of the topic again
+func (s *Server) handleAccountReservationEmailDelete(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	topic, err := s.ownedReservationFromPath(r, v, apiAccountReservationEmailRegex)
+	if err != nil {
+		return err
+	}
+	logvr(v, r).Tag(tagAccount).Field("topic", topic).Debug("Removing email alias of topic reservation")
+	if err := s.userManager.SetReservationEmailAlias(v.User().Name, topic, ""); errors.Is(err, user.ErrReservationNotFound) {
+		return errHTTPUnauthorized
+	} else if err != nil {
+		return err
+	}
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+// emailAliasAddress returns the full email address for the given alias, or an empty string if email
+// publishing is not enabled
+func (s *Server) emailAliasAddress(alias string) string {
+	conf := s.config()
+	if alias == "" || conf.SMTPServerListen == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s%s@%s", conf.SMTPServerAddrPrefix, alias, conf.SMTPServerDomain)
+}
+
+// newEmailAlias generates a random alias of the form <topic>-<secret>. The topic is shortened if the address
+// would otherwise exceed the maximum length of the local part of an email address.
+func newEmailAlias(prefix, topic string) string {
+	name := strings.ToLower(topic)
+	if maxLength := emailLocalPartMaxLength - len(prefix) - emailAliasSecretLength - 1; len(name) > maxLength {
+		name = name[:max(maxLength, 0)]
+	}
+	return util.RandomLowerStringPrefix(name+"-", len(name)+1+emailAliasSecretLength)
+}
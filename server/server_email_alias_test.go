@@ -0,0 +1,108 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+func TestAccount_ReservationEmailAlias(t *testing.T) {
+	conf := newTestConfigWithAuthFile(t)
+	conf.AuthDefault = user.PermissionDenyAll
+	conf.EnableReservations = true
+	conf.SMTPServerListen = ":25"
+	conf.SMTPServerDomain = "ntfy.sh"
+	conf.SMTPServerAddrPrefix = "ntfy-"
+	s := newTestServer(t, conf)
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	require.Nil(t, s.userManager.AddReservation("phil", "alerts", user.PermissionDenyAll))
+
+	// Only the owner can create an alias
+	rr := request(t, s, "POST", "/v1/account/reservation/alerts/email", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 401, rr.Code)
+	rr = request(t, s, "POST", "/v1/account/reservation/alerts/email", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	alias, _ := util.UnmarshalJSON[apiAccountReservationEmailResponse](io.NopCloser(rr.Body))
+	require.Regexp(t, `^ntfy-alerts-[a-z0-9]{12}@ntfy\.sh$`, alias.Address)
+
+	// Alias is listed in the account
+	rr = request(t, s, "GET", "/v1/account", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	account, _ := util.UnmarshalJSON[apiAccountResponse](io.NopCloser(rr.Body))
+	require.Equal(t, alias.Address, account.Reservations[0].Email)
+
+	// Emails to the alias are published, despite the reservation
+	sendTestEmail(t, s, alias.Address, "250 2.0.0 OK: queued")
+	messages := toMessages(t, request(t, s, "GET", "/alerts/json?poll=1", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	}).Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "Backup failed", messages[0].Title)
+	require.Equal(t, "Disk full", messages[0].Message)
+
+	// Emails to the regular address of the topic are rejected
+	sendTestEmail(t, s, "ntfy-alerts@ntfy.sh", "451 4.0.0 invalid address")
+
+	// Emails to the alias are rejected once it is removed
+	rr = request(t, s, "DELETE", "/v1/account/reservation/alerts/email", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	sendTestEmail(t, s, alias.Address, `554 5.0.0 Error: transaction failed, blame it on the weather: error: {"code":40301,"http":403,"error":"forbidden","link":"https://ntfy.sh/docs/publish/#authentication"}`)
+}
+
+func TestAccount_ReservationEmailAlias_Disabled(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.AddReservation("phil", "alerts", user.PermissionDenyAll))
+	rr := request(t, s, "POST", "/v1/account/reservation/alerts/email", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 400, rr.Code)
+	require.Equal(t, 40082, toHTTPError(t, rr.Body.String()).Code)
+}
+
+func TestEmailAlias_New(t *testing.T) {
+	require.Regexp(t, `^mytopic-[a-z0-9]{12}$`, newEmailAlias("ntfy-", "MyTopic"))
+	alias := newEmailAlias("ntfy-", strings.Repeat("a", 64))
+	require.Equal(t, 64, len("ntfy-"+alias))
+}
+
+func sendTestEmail(t *testing.T, s *Server, to, expectedLine string) {
+	backend := newMailBackend(s.config(), s.userManager, nil, s.handle)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	smtpServer := smtp.NewServer(backend)
+	smtpServer.Domain = s.config().SMTPServerDomain
+	go smtpServer.Serve(l)
+	defer smtpServer.Close()
+	c, err := net.Dial("tcp", l.Addr().String())
+	require.Nil(t, err)
+	defer c.Close()
+	email := fmt.Sprintf(`EHLO example.com
+MAIL FROM: backup@example.com
+RCPT TO: %s
+DATA
+Subject: Backup failed
+
+Disk full
+.
+`, to)
+	writeAndReadUntilLine(t, email, c, bufio.NewScanner(c), expectedLine)
+}
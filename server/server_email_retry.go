@@ -0,0 +1,211 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/textproto"
+	"time"
+
+	"heckel.io/ntfy/v2/log"
+)
+
+// If an email cannot be sent because of a temporary error (e.g. the SMTP relay is briefly down, or it responds with
+// a 4xx code), it is added to a retry queue instead of being dropped. The queue is kept in the message cache, so it
+// survives restarts. Emails are retried with exponential backoff (1m, 2m, 4m, ..., max. 1h) until they are sent, or
+// until they are older than "smtp-sender-retry-max-age", in which case they fail like any other email (i.e. they
+// are dead-lettered, see publishDeadLetter).
+//
+// Permanent errors (5xx codes, e.g. an unknown recipient) are never retried. Admins can list the queue via
+// GET /v1/admin/email-retries.
+
+const (
+	emailRetryInterval = 10 * time.Second // Interval in which the retry queue is checked for due emails
+	emailRetryDelay    = time.Minute      // Delay before the first retry, doubled after every retry
+	emailRetryDelayMax = time.Hour        // Max. delay between retries
+)
+
+// sendEmail sends an email for the given message, and queues it for retry if it fails temporarily. The sender is
+// passed in by the caller (see Server.mailer), since email sending may be disabled by a config reload at any time.
+func (s *Server) sendEmail(sender mailer, v *visitor, m *message, email string) {
+	logvm(v, m).Tag(tagEmail).Field("email", email).Debug("Sending email to %s", email)
+	if err := sender.Send(v, s.signAttachmentURL(m), email); err != nil {
+		if s.queueEmailRetry(v, m, email, err) {
+			return
+		}
+		s.emailFailed(v, m, email, err)
+		return
+	}
+	minc(metricEmailsPublishedSuccess)
+	s.recordUsage(m, 0, 1)
+}
+
+func (s *Server) emailFailed(v *visitor, m *message, email string, err error) {
+	logvm(v, m).Tag(tagEmail).Field("email", email).Err(err).Warn("Unable to send email to %s: %v", email, err.Error())
+	minc(metricEmailsPublishedFailure)
+	s.publishDeadLetter(m, deadLetterChannelEmail, err)
+	s.integrationFailed(deadLetterChannelEmail, m, err)
+}
+
+// queueEmailRetry adds a failed email to the retry queue, and returns true if it was queued. Emails are only
+// queued if retrying is enabled and the error is temporary.
+func (s *Server) queueEmailRetry(v *visitor, m *message, email string, err error) bool {
+	if s.config().SMTPSenderRetryMaxAge <= 0 || !isTemporaryEmailError(err) {
+		return false
+	}
+	now := time.Now()
+	retry := &emailRetry{
+		Email:       email,
+		Sender:      v.IP(),
+		Message:     m,
+		Attempts:    1,
+		NextAttempt: now.Add(s.emailRetryBackoff(1)),
+		Created:     now,
+		Error:       err.Error(),
+	}
+	if err := s.messageCache.AddEmailRetry(retry); err != nil {
+		logvm(v, m).Tag(tagEmail).Err(err).Warn("Unable to queue email to %s for retry", email)
+		return false
+	}
+	logvm(v, m).
+		Tag(tagEmail).
+		Fields(log.Context{
+			"email":              email,
+			"email_next_attempt": retry.NextAttempt.Unix(),
+		}).
+		Err(err).
+		Info("Temporary error sending email to %s, retrying in %s", email, retry.NextAttempt.Sub(now).String())
+	minc(metricEmailsRetriesQueued)
+	s.updateEmailRetriesQueueDepth()
+	return true
+}
+
+func (s *Server) runEmailRetrier() {
+	for {
+		select {
+		case <-time.After(emailRetryInterval):
+			if err := s.retryEmails(); err != nil {
+				log.Tag(tagEmail).Err(err).Warn("Error retrying emails")
+			}
+		case <-s.closeChan:
+			return
+		}
+	}
+}
+
+// retryEmails retries all emails in the retry queue that are due
+func (s *Server) retryEmails() error {
+	sender := s.mailer()
+	if sender == nil {
+		return nil // Email sending disabled (e.g. via config reload), keep the queue until it is enabled again
+	}
+	retries, err := s.messageCache.EmailRetriesDue(time.Now())
+	if err != nil {
+		return err
+	}
+	for _, retry := range retries {
+		s.retryEmail(sender, retry)
+	}
+	s.updateEmailRetriesQueueDepth()
+	return nil
+}
+
+func (s *Server) retryEmail(sender mailer, retry *emailRetry) {
+	conf := s.config()
+	v := newVisitor(conf, s.messageCache, s.userManager, retry.Sender, nil) // Not a real visitor, only used for the sender IP
+	m := retry.Message
+	logvm(v, m).Tag(tagEmail).Field("email", retry.Email).Debug("Retrying email to %s, attempt %d", retry.Email, retry.Attempts+1)
+	minc(metricEmailsRetries)
+	err := sender.Send(v, s.signAttachmentURL(m), retry.Email)
+	if err == nil {
+		if err := s.messageCache.DeleteEmailRetry(retry.ID); err != nil {
+			logvm(v, m).Tag(tagEmail).Err(err).Warn("Unable to remove email from retry queue")
+		}
+		logvm(v, m).Tag(tagEmail).Field("email", retry.Email).Info("Sent email to %s after %d attempt(s)", retry.Email, retry.Attempts+1)
+		minc(metricEmailsPublishedSuccess)
+		s.recordUsage(m, 0, 1)
+		return
+	}
+	now := time.Now()
+	retry.Attempts++
+	retry.Error = err.Error()
+	retry.NextAttempt = now.Add(s.emailRetryBackoff(retry.Attempts))
+	expired := retry.NextAttempt.Sub(retry.Created) > conf.SMTPSenderRetryMaxAge
+	if expired || !isTemporaryEmailError(err) {
+		if err := s.messageCache.DeleteEmailRetry(retry.ID); err != nil {
+			logvm(v, m).Tag(tagEmail).Err(err).Warn("Unable to remove email from retry queue")
+		}
+		if expired {
+			minc(metricEmailsRetriesExpired)
+		}
+		s.emailFailed(v, m, retry.Email, err)
+		return
+	}
+	if err := s.messageCache.UpdateEmailRetry(retry); err != nil {
+		logvm(v, m).Tag(tagEmail).Err(err).Warn("Unable to update email in retry queue")
+	}
+	logvm(v, m).
+		Tag(tagEmail).
+		Field("email", retry.Email).
+		Err(err).
+		Debug("Temporary error sending email to %s, retrying in %s", retry.Email, retry.NextAttempt.Sub(now).String())
+}
+
+// emailRetryBackoff returns the delay before the given attempt, doubled after every attempt, see emailRetryDelayMax
+func (s *Server) emailRetryBackoff(attempts int) time.Duration {
+	delay := s.emailRetryDelay
+	for i := 1; i < attempts && delay < emailRetryDelayMax; i++ {
+		delay *= 2
+	}
+	if delay > emailRetryDelayMax {
+		return emailRetryDelayMax
+	}
+	return delay
+}
+
+func (s *Server) updateEmailRetriesQueueDepth() {
+	count, err := s.messageCache.EmailRetriesCount()
+	if err != nil {
+		log.Tag(tagEmail).Err(err).Warn("Unable to count emails in retry queue")
+		return
+	}
+	mset(metricEmailsRetriesQueueDepth, count)
+}
+
+// handleEmailRetriesGet lists the emails in the retry queue (admin only)
+func (s *Server) handleEmailRetriesGet(w http.ResponseWriter, _ *http.Request, _ *visitor) error {
+	retries, err := s.messageCache.EmailRetries()
+	if err != nil {
+		return err
+	}
+	response := make([]*apiEmailRetryResponse, len(retries))
+	for i, retry := range retries {
+		response[i] = &apiEmailRetryResponse{
+			ID:          retry.ID,
+			MessageID:   retry.Message.ID,
+			Topic:       retry.Message.Topic,
+			Email:       retry.Email,
+			Attempts:    retry.Attempts,
+			NextAttempt: retry.NextAttempt.Unix(),
+			Created:     retry.Created.Unix(),
+			Error:       retry.Error,
+		}
+	}
+	return s.writeJSON(w, response)
+}
+
+// isTemporaryEmailError returns true if sending an email may succeed later, i.e. if the SMTP server could not be
+// reached, or if it responded with a 4xx code. For email provider APIs, 429 and 5xx responses are temporary.
+func isTemporaryEmailError(err error) bool {
+	var protoErr *textproto.Error
+	var apiErr *emailAPIError
+	if errors.As(err, &protoErr) {
+		return protoErr.Code >= 400 && protoErr.Code < 500
+	} else if errors.As(err, &apiErr) {
+		return apiErr.Temporary()
+	} else if errors.Is(err, errHTTPClientCircuitOpen) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
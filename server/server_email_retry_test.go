@@ -0,0 +1,208 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServer_EmailRetry_TemporaryError(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	s := newTestServer(t, c)
+	s.emailRetryDelay = 0 // Retries are due right away
+	mailer := &testRetryMailer{errs: []error{
+		&textproto.Error{Code: 421, Msg: "Service not available"},
+		&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")},
+	}}
+	setTestMailer(s, mailer)
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+
+	response := request(t, s, "PUT", "/mytopic", "relay is down", map[string]string{
+		"E-Mail": "test@example.com",
+	})
+	require.Equal(t, 200, response.Code)
+	waitFor(t, func() bool {
+		count, err := s.messageCache.EmailRetriesCount()
+		return err == nil && count == 1
+	})
+
+	// Admins can list the queue
+	response = request(t, s, "GET", "/v1/admin/email-retries", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+	var retries []*apiEmailRetryResponse
+	require.Nil(t, json.NewDecoder(response.Body).Decode(&retries))
+	require.Equal(t, 1, len(retries))
+	require.Equal(t, "mytopic", retries[0].Topic)
+	require.Equal(t, "test@example.com", retries[0].Email)
+	require.Equal(t, 1, retries[0].Attempts)
+	require.Contains(t, retries[0].Error, "Service not available")
+
+	// Second attempt fails as well, third attempt succeeds
+	require.Nil(t, s.retryEmails())
+	retried, err := s.messageCache.EmailRetries()
+	require.Nil(t, err)
+	require.Equal(t, 1, len(retried))
+	require.Equal(t, 2, retried[0].Attempts)
+	require.Contains(t, retried[0].Error, "connection refused")
+
+	require.Nil(t, s.retryEmails())
+	count, err := s.messageCache.EmailRetriesCount()
+	require.Nil(t, err)
+	require.Equal(t, 0, count)
+	require.Equal(t, 3, mailer.Attempts())
+	require.Equal(t, "relay is down", mailer.Sent()[0].Message)
+}
+
+func TestServer_EmailRetry_PermanentError(t *testing.T) {
+	c := newTestConfig(t)
+	c.DeadLetterTopic = "undeliverable"
+	s := newTestServer(t, c)
+	setTestMailer(s, &testRetryMailer{errs: []error{
+		&textproto.Error{Code: 550, Msg: "No such user"},
+	}})
+
+	response := request(t, s, "PUT", "/mytopic", "unknown recipient", map[string]string{
+		"E-Mail": "test@example.com",
+	})
+	require.Equal(t, 200, response.Code)
+	waitFor(t, func() bool {
+		response = request(t, s, "GET", "/undeliverable/json?poll=1", "", nil)
+		messages := toMessages(t, response.Body.String())
+		return len(messages) == 1 && strings.Contains(messages[0].Message, "No such user")
+	})
+	count, err := s.messageCache.EmailRetriesCount()
+	require.Nil(t, err)
+	require.Equal(t, 0, count)
+}
+
+func TestServer_EmailRetry_Expired(t *testing.T) {
+	c := newTestConfig(t)
+	c.DeadLetterTopic = "undeliverable"
+	c.SMTPSenderRetryMaxAge = 50 * time.Millisecond
+	s := newTestServer(t, c)
+	s.emailRetryDelay = 0
+	setTestMailer(s, &testRetryMailer{errs: []error{
+		&textproto.Error{Code: 451, Msg: "Try again later"},
+		&textproto.Error{Code: 451, Msg: "Try again later"},
+	}})
+
+	response := request(t, s, "PUT", "/mytopic", "relay is down for too long", map[string]string{
+		"E-Mail": "test@example.com",
+	})
+	require.Equal(t, 200, response.Code)
+	waitFor(t, func() bool {
+		count, err := s.messageCache.EmailRetriesCount()
+		return err == nil && count == 1
+	})
+	time.Sleep(100 * time.Millisecond)
+	require.Nil(t, s.retryEmails())
+	count, err := s.messageCache.EmailRetriesCount()
+	require.Nil(t, err)
+	require.Equal(t, 0, count)
+	waitFor(t, func() bool {
+		response = request(t, s, "GET", "/undeliverable/json?poll=1", "", nil)
+		return len(toMessages(t, response.Body.String())) == 1
+	})
+}
+
+func TestServer_EmailRetry_Disabled(t *testing.T) {
+	c := newTestConfig(t)
+	c.SMTPSenderRetryMaxAge = 0
+	s := newTestServer(t, c)
+	mailer := &testRetryMailer{errs: []error{
+		&textproto.Error{Code: 421, Msg: "Service not available"},
+	}}
+	setTestMailer(s, mailer)
+
+	response := request(t, s, "PUT", "/mytopic", "not retried", map[string]string{
+		"E-Mail": "test@example.com",
+	})
+	require.Equal(t, 200, response.Code)
+	waitFor(t, func() bool {
+		return mailer.Attempts() == 1
+	})
+	time.Sleep(100 * time.Millisecond)
+	count, err := s.messageCache.EmailRetriesCount()
+	require.Nil(t, err)
+	require.Equal(t, 0, count)
+}
+
+func TestServer_EmailRetry_AdminOnly(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	response := request(t, s, "GET", "/v1/admin/email-retries", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 401, response.Code)
+}
+
+func TestServer_EmailRetryBackoff(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	require.Equal(t, time.Minute, s.emailRetryBackoff(1))
+	require.Equal(t, 2*time.Minute, s.emailRetryBackoff(2))
+	require.Equal(t, 32*time.Minute, s.emailRetryBackoff(6))
+	require.Equal(t, time.Hour, s.emailRetryBackoff(7))
+	require.Equal(t, time.Hour, s.emailRetryBackoff(100))
+}
+
+func TestIsTemporaryEmailError(t *testing.T) {
+	require.True(t, isTemporaryEmailError(&textproto.Error{Code: 421, Msg: "Service not available"}))
+	require.True(t, isTemporaryEmailError(&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}))
+	require.False(t, isTemporaryEmailError(&textproto.Error{Code: 550, Msg: "No such user"}))
+	require.False(t, isTemporaryEmailError(errors.New("missing port in address")))
+}
+
+// testRetryMailer fails with the given errors (one per attempt), and succeeds afterwards
+type testRetryMailer struct {
+	errs     []error
+	attempts int
+	sent     []*message
+	mu       sync.Mutex
+}
+
+func (t *testRetryMailer) Send(v *visitor, m *message, to string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.attempts++
+	if len(t.errs) > 0 {
+		err := t.errs[0]
+		t.errs = t.errs[1:]
+		return err
+	}
+	t.sent = append(t.sent, m)
+	return nil
+}
+
+func (t *testRetryMailer) SendArchive(v *visitor, to, subject, text, filename string, archive []byte) error {
+	return nil
+}
+
+func (t *testRetryMailer) SendText(v *visitor, to, subject, text string) error {
+	return nil
+}
+
+func (t *testRetryMailer) Counts() (total int64, success int64, failure int64) {
+	return 0, 0, 0
+}
+
+func (t *testRetryMailer) Attempts() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.attempts
+}
+
+func (t *testRetryMailer) Sent() []*message {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.sent
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"fmt"
+	"heckel.io/ntfy/v2/log"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server events are internal events of the server (startup, config reload, limit breaches, integration failures,
+// pruning summaries), which are published as messages to the "server-events-topic", so that operators get notified
+// about the health of their ntfy server via ntfy itself.
+//
+// Every server event message has the tags "server_event" and the event type (e.g. "startup"), so that clients can
+// easily filter them. To not flood the topic, events that can happen repeatedly are throttled per event type and key
+// (e.g. per visitor for limit breaches), and pruning summaries are sent at most once a day.
+
+const (
+	serverEventTag                = "server_event"
+	serverEventStartup            = "startup"
+	serverEventConfigReload       = "config_reload"
+	serverEventLimitReached       = "limit_reached"
+	serverEventIntegrationFailure = "integration_failure"
+	serverEventPruned             = "pruned"
+	serverEventThrottle           = 10 * time.Minute // Min. time between two events of the same type and key
+	serverEventPrunedInterval     = 24 * time.Hour   // Min. time between two pruning summaries
+)
+
+// serverEvents keeps track of throttled server events, as well as the pruning counters since the last summary
+type serverEvents struct {
+	last              map[string]time.Time // Event type and key -> last time published
+	prunedMessages    int
+	prunedAttachments int
+	prunedSince       time.Time
+	mu                sync.Mutex
+}
+
+func newServerEvents() *serverEvents {
+	return &serverEvents{
+		last:        make(map[string]time.Time),
+		prunedSince: time.Now(),
+	}
+}
+
+// allow returns true if the event with the given type and key was not published within the throttle duration,
+// and remembers the current time if it was not
+func (e *serverEvents) allow(event, key string, throttle time.Duration) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for id, last := range e.last {
+		if time.Since(last) >= throttle {
+			delete(e.last, id) // Prune, so the map does not grow forever
+		}
+	}
+	id := event + "|" + key
+	if last, ok := e.last[id]; ok && time.Since(last) < throttle {
+		return false
+	}
+	e.last[id] = time.Now()
+	return true
+}
+
+// publishServerEvent publishes a server event to the server events topic, if it is configured
+func (s *Server) publishServerEvent(event string, priority int, title, message string) {
+	conf := s.config()
+	if conf.ServerEventsTopic == "" {
+		return
+	}
+	v := newVisitor(conf, s.messageCache, s.userManager, netip.IPv4Unspecified(), nil) // Background process, not a real visitor, uses IP 0.0.0.0
+	m := newDefaultMessage(conf.ServerEventsTopic, message)
+	m.Title = title
+	m.Priority = priority
+	m.Tags = []string{serverEventTag, event}
+	log.Tag(tagManager).Field("server_event", event).Debug("Publishing server event: %s", title)
+	if err := s.publishMessage(v, m); err != nil {
+		logvm(v, m).Tag(tagManager).Err(err).Warn("Unable to publish server event")
+	}
+}
+
+// publishThrottledServerEvent publishes a server event, unless an event of the same type and key was
+// published within the throttle duration
+func (s *Server) publishThrottledServerEvent(event, key string, priority int, title, message string) {
+	if s.config().ServerEventsTopic == "" || !s.events.allow(event, key, serverEventThrottle) {
+		return
+	}
+	s.publishServerEvent(event, priority, title, message)
+}
+
+func (s *Server) publishStartupEvent() {
+	conf := s.config()
+	message := fmt.Sprintf("ntfy %s started", conf.Version)
+	if conf.BaseURL != "" {
+		message += fmt.Sprintf(", base URL is %s", conf.BaseURL)
+	}
+	s.publishServerEvent(serverEventStartup, 3, "ntfy server started", message)
+}
+
+// ReloadFailed publishes a server event if reloading the config failed, e.g. because the config file is invalid
+func (s *Server) ReloadFailed(err error) {
+	s.publishServerEvent(serverEventConfigReload, 4, "Config reload failed", fmt.Sprintf("Reloading the server config failed: %s", err.Error()))
+}
+
+// configReloaded publishes a server event after the config was reloaded, see Reload
+func (s *Server) configReloaded(changed []string) {
+	message := "The server config was reloaded, no settings changed"
+	if len(changed) > 0 {
+		message = fmt.Sprintf("The server config was reloaded, changed settings: %s", strings.Join(changed, ", "))
+	}
+	s.publishServerEvent(serverEventConfigReload, 2, "Config reloaded", message)
+}
+
+// limitReached publishes a (throttled) server event when a visitor hits a rate or size limit
+func (s *Server) limitReached(v *visitor, err *errHTTP) {
+	if s.config().ServerEventsTopic == "" {
+		return
+	}
+	who := fmt.Sprintf("IP %s", v.IP().String())
+	if u := v.User(); u != nil {
+		who = fmt.Sprintf("user %s", u.Name)
+	}
+	message := fmt.Sprintf("Visitor with %s reached a limit: %s (ntfy error %d). Further limit breaches by this visitor are not reported for %s.", who, err.Message, err.Code, serverEventThrottle)
+	go s.publishThrottledServerEvent(serverEventLimitReached, fmt.Sprintf("%s|%d", who, err.Code), 3, "Limit reached", message)
+}
+
+// integrationFailed publishes a (throttled) server event when a message could not be delivered via
+// an integration, e.g. Firebase or email
+func (s *Server) integrationFailed(integration string, m *message, err error) {
+	conf := s.config()
+	if conf.ServerEventsTopic == "" || m.Topic == conf.ServerEventsTopic {
+		return // Disabled, or event about the server events topic itself (avoid loops)
+	}
+	message := fmt.Sprintf("Delivering message %s in topic %s via %s failed: %s. Further %s failures are not reported for %s.", m.ID, m.Topic, integration, err.Error(), integration, serverEventThrottle)
+	s.publishThrottledServerEvent(serverEventIntegrationFailure, integration, 4, fmt.Sprintf("Integration failure: %s", integration), message)
+}
+
+// messagesPruned adds the number of pruned messages and attachments to the counters, and publishes a summary
+// if the last summary was published more than a day ago
+func (s *Server) messagesPruned(messages, attachments int) {
+	if s.config().ServerEventsTopic == "" {
+		return
+	}
+	s.events.mu.Lock()
+	s.events.prunedMessages += messages
+	s.events.prunedAttachments += attachments
+	if time.Since(s.events.prunedSince) < serverEventPrunedInterval || (s.events.prunedMessages == 0 && s.events.prunedAttachments == 0) {
+		s.events.mu.Unlock()
+		return
+	}
+	message := fmt.Sprintf("Pruned %d expired message(s) and %d expired attachment(s) since %s.", s.events.prunedMessages, s.events.prunedAttachments, s.events.prunedSince.UTC().Format(time.RFC1123))
+	s.events.prunedMessages, s.events.prunedAttachments, s.events.prunedSince = 0, 0, time.Now()
+	s.events.mu.Unlock()
+	s.publishServerEvent(serverEventPruned, 2, "Pruning summary", message)
+}
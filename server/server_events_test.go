@@ -0,0 +1,94 @@
+package server
+
+import (
+	"errors"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestServerEvents_LimitReached_Throttled(t *testing.T) {
+	c := newTestConfig(t)
+	c.ServerEventsTopic = "ntfy-events"
+	c.VisitorRequestLimitBurst = 3
+	s := newTestServer(t, c)
+
+	for i := 0; i < 3; i++ {
+		response := request(t, s, "PUT", "/mytopic", "message", nil)
+		require.Equal(t, 200, response.Code)
+	}
+	for i := 0; i < 3; i++ {
+		response := request(t, s, "PUT", "/mytopic", "message", nil)
+		require.Equal(t, 429, response.Code)
+	}
+
+	var messages []*message
+	waitFor(t, func() bool {
+		messages = serverEventMessages(t, s)
+		return len(messages) == 1
+	})
+	require.Equal(t, "Limit reached", messages[0].Title)
+	require.Equal(t, []string{"server_event", "limit_reached"}, messages[0].Tags)
+	require.Contains(t, messages[0].Message, "Visitor with IP 9.9.9.9 reached a limit: limit reached: too many requests (ntfy error 42901)")
+
+	// Further limit breaches are throttled
+	time.Sleep(200 * time.Millisecond)
+	require.Equal(t, 1, len(serverEventMessages(t, s)))
+}
+
+func TestServerEvents_IntegrationFailure(t *testing.T) {
+	c := newTestConfig(t)
+	c.ServerEventsTopic = "ntfy-events"
+	s := newTestServer(t, c)
+	s.firebaseClient = newFirebaseClient(newTestFirebaseSender(0), &testAuther{Allow: true})
+
+	response := request(t, s, "PUT", "/mytopic", "message", nil)
+	msg := toMessage(t, response.Body.String())
+
+	var messages []*message
+	waitFor(t, func() bool {
+		messages = serverEventMessages(t, s)
+		return len(messages) == 1
+	})
+	require.Equal(t, "Integration failure: firebase", messages[0].Title)
+	require.Equal(t, 4, messages[0].Priority)
+	require.Contains(t, messages[0].Message, "Delivering message "+msg.ID+" in topic mytopic via firebase failed")
+}
+
+func TestServerEvents_ConfigReloadedAndPruned(t *testing.T) {
+	c := newTestConfig(t)
+	c.ServerEventsTopic = "ntfy-events"
+	s := newTestServer(t, c)
+
+	s.configReloaded([]string{"disallowed-topics"})
+	s.ReloadFailed(errors.New("file not found"))
+
+	// Pruning summary is only published once a day
+	s.messagesPruned(5, 1)
+	require.Equal(t, 2, len(serverEventMessages(t, s)))
+	s.events.prunedSince = time.Now().Add(-25 * time.Hour)
+	s.messagesPruned(2, 0)
+
+	messages := serverEventMessages(t, s)
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, "Config reloaded", messages[0].Title)
+	require.Equal(t, "The server config was reloaded, changed settings: disallowed-topics", messages[0].Message)
+	require.Equal(t, "Config reload failed", messages[1].Title)
+	require.Equal(t, "Reloading the server config failed: file not found", messages[1].Message)
+	require.Equal(t, "Pruning summary", messages[2].Title)
+	require.Contains(t, messages[2].Message, "Pruned 7 expired message(s) and 1 expired attachment(s) since")
+	require.Equal(t, []string{"server_event", "pruned"}, messages[2].Tags)
+}
+
+func TestServerEvents_Disabled(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	s.configReloaded(nil)
+	s.messagesPruned(5, 1)
+	require.Equal(t, 0, s.events.prunedMessages)
+}
+
+func serverEventMessages(t *testing.T, s *Server) []*message {
+	messages, err := s.messageCache.Messages("ntfy-events", sinceAllMessages, false)
+	require.Nil(t, err)
+	return messages
+}
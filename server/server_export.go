@@ -0,0 +1,171 @@
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"heckel.io/ntfy/v2/log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Topic export lets users download the cached history of a topic, e.g. GET /mytopic/export?since=24h&format=csv,
+// so they can archive it without having to script the subscribe API. Messages are returned oldest first, in one
+// of these formats:
+//   - json (default): newline-delimited JSON, one message per line (just like polling via /<topic>/json?poll=1)
+//   - csv: a CSV file with a header row, one message per row, including the attachment details
+//   - attachments: a manifest of the attachments of the exported messages, as newline-delimited JSON
+//
+// Exports are paginated: If there are more messages than the limit, the "X-Next-Since" header contains the
+// ID of the last exported message, which can be passed as "since" to download the next page.
+
+const (
+	exportFormatJSON        = "json"
+	exportFormatCSV         = "csv"
+	exportFormatAttachments = "attachments"
+	exportLimitDefault      = 1000
+	exportLimitMax          = 10000
+)
+
+var exportCSVHeader = []string{"id", "time", "expires", "priority", "tags", "title", "message", "click", "attachment_name", "attachment_type", "attachment_size", "attachment_expires", "attachment_url"}
+
+// exportAttachment is one line of the attachments manifest, see handleTopicExport
+type exportAttachment struct {
+	ID      string `json:"id"`   // Message ID
+	Time    int64  `json:"time"` // Message time
+	Name    string `json:"name"`
+	Type    string `json:"type,omitempty"`
+	Size    int64  `json:"size,omitempty"`
+	Expires int64  `json:"expires,omitempty"`
+	URL     string `json:"url"`
+}
+
+func (s *Server) handleTopicExport(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	topicID := strings.Split(r.URL.Path, "/")[1]
+	since, err := parseSince(r, true)
+	if err != nil {
+		return err
+	}
+	until, err := parseReplayTime(readParam(r, "x-until", "until"), time.Now())
+	if err != nil {
+		return errHTTPBadRequestExportInvalid
+	}
+	format := strings.ToLower(readParam(r, "x-format", "format"))
+	if format == "" {
+		format = exportFormatJSON
+	} else if format != exportFormatJSON && format != exportFormatCSV && format != exportFormatAttachments {
+		return errHTTPBadRequestExportInvalid
+	}
+	limit := exportLimitDefault
+	if limitStr := readParam(r, "x-limit", "limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 || limit > exportLimitMax {
+			return errHTTPBadRequestExportInvalid
+		}
+	}
+	cached, err := s.messageCache.Messages(topicID, since, false)
+	if err != nil {
+		return err
+	}
+	messages := make([]*message, 0)
+	var more bool
+	for _, m := range cached {
+		if m.Event != messageEvent {
+			continue
+		} else if m.Time > until.Unix() {
+			break
+		} else if len(messages) >= limit {
+			more = true
+			break
+		}
+		messages = append(messages, m)
+	}
+	logvr(v, r).
+		Tag(tagSubscribe).
+		Fields(log.Context{
+			"export_topic":    topicID,
+			"export_format":   format,
+			"export_messages": len(messages),
+		}).
+		Debug("Exporting %d message(s) from topic %s", len(messages), topicID)
+	w.Header().Set("Access-Control-Allow-Origin", s.config().AccessControlAllowOrigin) // CORS, allow cross-origin requests
+	w.Header().Set("Access-Control-Expose-Headers", "X-Next-Since")
+	if more {
+		w.Header().Set("X-Next-Since", messages[len(messages)-1].ID)
+	}
+	switch format {
+	case exportFormatCSV:
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.csv"`, topicID))
+		return writeExportCSV(w, messages)
+	case exportFormatAttachments:
+		w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
+		return writeExportAttachments(w, messages)
+	default:
+		w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.jsonl"`, topicID))
+		encoder := json.NewEncoder(w)
+		for _, m := range messages {
+			if err := encoder.Encode(m); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func writeExportCSV(w http.ResponseWriter, messages []*message) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(exportCSVHeader); err != nil {
+		return err
+	}
+	for _, m := range messages {
+		record := []string{
+			m.ID,
+			strconv.FormatInt(m.Time, 10),
+			strconv.FormatInt(m.Expires, 10),
+			strconv.Itoa(m.Priority),
+			strings.Join(m.Tags, ","),
+			m.Title,
+			m.Message,
+			m.Click,
+			"", "", "", "", "",
+		}
+		if m.Attachment != nil {
+			record[8] = m.Attachment.Name
+			record[9] = m.Attachment.Type
+			record[10] = strconv.FormatInt(m.Attachment.Size, 10)
+			record[11] = strconv.FormatInt(m.Attachment.Expires, 10)
+			record[12] = m.Attachment.URL
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func writeExportAttachments(w http.ResponseWriter, messages []*message) error {
+	encoder := json.NewEncoder(w)
+	for _, m := range messages {
+		if m.Attachment == nil {
+			continue
+		}
+		manifest := &exportAttachment{
+			ID:      m.ID,
+			Time:    m.Time,
+			Name:    m.Attachment.Name,
+			Type:    m.Attachment.Type,
+			Size:    m.Attachment.Size,
+			Expires: m.Attachment.Expires,
+			URL:     m.Attachment.URL,
+		}
+		if err := encoder.Encode(manifest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
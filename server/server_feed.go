@@ -0,0 +1,162 @@
+package server
+
+import (
+	"encoding/xml"
+	"fmt"
+	"heckel.io/ntfy/v2/util"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Topic feeds render the cached messages of a topic as an Atom feed (RFC 4287), e.g. GET /mytopic/feed.xml,
+// so that notifications can be read in any feed reader. Entries are returned newest first. Priorities and
+// tags are mapped to categories, click actions to alternate links, and attachments to enclosures.
+
+const (
+	feedLimit               = 100 // Number of entries in a feed, newest first
+	feedEntryTitleMaxLength = 80
+	feedCategoryPriority    = "https://ntfy.sh/docs/publish/#message-priority"
+	feedCategoryTag         = "https://ntfy.sh/docs/publish/#tags-emojis"
+)
+
+type atomFeed struct {
+	XMLName xml.Name     `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string       `xml:"id"`
+	Title   string       `xml:"title"`
+	Updated string       `xml:"updated"`
+	Links   []*atomLink  `xml:"link"`
+	Author  *atomAuthor  `xml:"author"`
+	Entries []*atomEntry `xml:"entry"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomLink struct {
+	Rel    string `xml:"rel,attr,omitempty"`
+	Href   string `xml:"href,attr"`
+	Type   string `xml:"type,attr,omitempty"`
+	Length int64  `xml:"length,attr,omitempty"`
+	Title  string `xml:"title,attr,omitempty"`
+}
+
+type atomEntry struct {
+	ID         string          `xml:"id"`
+	Title      string          `xml:"title"`
+	Updated    string          `xml:"updated"`
+	Published  string          `xml:"published"`
+	Content    *atomContent    `xml:"content"`
+	Links      []*atomLink     `xml:"link"`
+	Categories []*atomCategory `xml:"category"`
+}
+
+type atomContent struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type atomCategory struct {
+	Term   string `xml:"term,attr"`
+	Scheme string `xml:"scheme,attr,omitempty"`
+}
+
+func (s *Server) handleTopicFeed(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	topicID := strings.Split(r.URL.Path, "/")[1]
+	cached, err := s.messageCache.Messages(topicID, sinceAllMessages, false)
+	if err != nil {
+		return err
+	}
+	messages := make([]*message, 0)
+	for i := len(cached) - 1; i >= 0 && len(messages) < feedLimit; i-- {
+		if cached[i].Event == messageEvent {
+			messages = append(messages, cached[i])
+		}
+	}
+	baseURL := s.feedBaseURL(r)
+	topicURL := fmt.Sprintf("%s/%s", baseURL, topicID)
+	feed := &atomFeed{
+		ID:      topicURL,
+		Title:   topicID,
+		Updated: time.Now().UTC().Format(time.RFC3339),
+		Links: []*atomLink{
+			{Rel: "self", Href: topicURL + "/feed.xml", Type: "application/atom+xml"},
+			{Rel: "alternate", Href: topicURL},
+		},
+		Author:  &atomAuthor{Name: "ntfy"},
+		Entries: make([]*atomEntry, 0, len(messages)),
+	}
+	if len(messages) > 0 {
+		feed.Updated = time.Unix(messages[0].Time, 0).UTC().Format(time.RFC3339)
+	}
+	for _, m := range messages {
+		feed.Entries = append(feed.Entries, newAtomEntry(topicURL, m))
+	}
+	logvr(v, r).Tag(tagSubscribe).Debug("Rendering feed with %d message(s) for topic %s", len(messages), topicID)
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.Header().Set("Access-Control-Allow-Origin", s.config().AccessControlAllowOrigin) // CORS, allow cross-origin requests
+	if _, err := w.Write([]byte(xml.Header)); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	return encoder.Encode(feed)
+}
+
+func newAtomEntry(topicURL string, m *message) *atomEntry {
+	published := time.Unix(m.Time, 0).UTC().Format(time.RFC3339)
+	entry := &atomEntry{
+		ID:        fmt.Sprintf("%s#%s", topicURL, m.ID),
+		Title:     feedEntryTitle(m),
+		Updated:   published,
+		Published: published,
+		Content:   &atomContent{Type: "text", Value: m.Message},
+	}
+	if m.Click != "" {
+		entry.Links = append(entry.Links, &atomLink{Rel: "alternate", Href: m.Click})
+	}
+	if m.Attachment != nil && m.Attachment.URL != "" {
+		entry.Links = append(entry.Links, &atomLink{
+			Rel:    "enclosure",
+			Href:   m.Attachment.URL,
+			Type:   m.Attachment.Type,
+			Length: m.Attachment.Size,
+			Title:  m.Attachment.Name,
+		})
+	}
+	if priority, err := util.PriorityString(m.Priority); err == nil {
+		entry.Categories = append(entry.Categories, &atomCategory{Term: priority, Scheme: feedCategoryPriority})
+	}
+	for _, tag := range m.Tags {
+		entry.Categories = append(entry.Categories, &atomCategory{Term: tag, Scheme: feedCategoryTag})
+	}
+	return entry
+}
+
+// feedEntryTitle returns the title of the message, or the (shortened) first line of the message
+// if it has no title, since feed entries must have a title
+func feedEntryTitle(m *message) string {
+	if m.Title != "" {
+		return m.Title
+	}
+	title, _, _ := strings.Cut(strings.TrimSpace(m.Message), "\n")
+	if len([]rune(title)) > feedEntryTitleMaxLength {
+		title = string([]rune(title)[:feedEntryTitleMaxLength-3]) + "..."
+	}
+	return title
+}
+
+// feedBaseURL returns the configured base URL, or the URL the request was made to, since feeds must
+// contain absolute links
+func (s *Server) feedBaseURL(r *http.Request) string {
+	conf := s.config()
+	if conf.BaseURL != "" {
+		return strings.TrimSuffix(conf.BaseURL, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s", scheme, r.Host)
+}
@@ -5,32 +5,278 @@ import (
 	"encoding/json"
 	"errors"
 	firebase "firebase.google.com/go/v4"
+	"firebase.google.com/go/v4/errorutils"
 	"firebase.google.com/go/v4/messaging"
 	"fmt"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
 	"google.golang.org/api/option"
+	"heckel.io/ntfy/v2/log"
 	"heckel.io/ntfy/v2/user"
 	"heckel.io/ntfy/v2/util"
+	"net/http"
+	"os"
 	"strings"
+	"time"
 )
 
 const (
 	fcmMessageLimit         = 4000
 	fcmApnsBodyMessageLimit = 100
+	firebaseQueuePriorities = 6           // Message priorities 0-5, see firebaseJob
+	firebaseRetryMax        = 3           // Max. number of retries after temporary Firebase errors
+	firebaseRetryDelay      = time.Second // Delay before the first retry, doubled after every retry
+)
+
+// Outcomes of sending a message to Firebase, recorded per message in the message cache (see
+// message_cache_firebase.go), and aggregated per topic in the topic stats (see handleTopicStats)
+const (
+	firebaseOutcomeDelivered = "delivered" // Accepted by Firebase
+	firebaseOutcomeThrottled = "throttled" // Quota exceeded, or held back because the topic is paced
+	firebaseOutcomeInvalid   = "invalid"   // Rejected by Firebase, e.g. invalid argument, unregistered or sender ID mismatch
+	firebaseOutcomeFailed    = "failed"    // Any other error, e.g. Firebase unavailable after retries, or queue full
+)
+
+const (
+	firebaseDeliveryRetention = 24 * time.Hour // Delivery outcomes are kept this long, see firebaseDelivered
 )
 
 var (
-	errFirebaseQuotaExceeded     = errors.New("quota exceeded for Firebase messages to topic")
-	errFirebaseTemporarilyBanned = errors.New("visitor temporarily banned from using Firebase")
+	firebaseScopes = []string{
+		"https://www.googleapis.com/auth/cloud-platform",
+		"https://www.googleapis.com/auth/firebase.messaging",
+	}
 )
 
+// Errors that a FirebaseSender can return (wrapped or not) to control how the message is handled
+var (
+	// ErrFirebaseQuotaExceeded means that Firebase rejected the message because of a rate limit. Messages to
+	// the topic are paced, see firebasePacer.
+	ErrFirebaseQuotaExceeded = errors.New("quota exceeded for Firebase messages to topic")
+
+	// ErrFirebaseUnavailable means that Firebase is temporarily unavailable. The message is retried with
+	// exponential backoff.
+	ErrFirebaseUnavailable = errors.New("Firebase temporarily unavailable")
+
+	// ErrFirebaseInvalid means that Firebase rejected the message, e.g. because it is invalid, or because the
+	// target is not registered (anymore). The message is not retried.
+	ErrFirebaseInvalid = errors.New("Firebase rejected message")
+)
+
+var (
+	errFirebasePaced     = errors.New("Firebase messages to topic temporarily paced after quota exceeded")
+	errFirebaseQueueFull = errors.New("Firebase queue is full, message dropped")
+)
+
+// firebaseSendError is a quota exceeded, temporary or permanent error returned by Firebase, see firebaseSenderImpl.Send
+type firebaseSendError struct {
+	err        error         // ErrFirebaseQuotaExceeded, ErrFirebaseUnavailable or ErrFirebaseInvalid
+	detail     string        // Error returned by Firebase
+	retryAfter time.Duration // Retry-After hint of the response, zero if there is none
+	project    bool          // Quota exceeded for the whole project, not just the topic
+}
+
+func (e *firebaseSendError) Error() string {
+	return fmt.Sprintf("%s: %s", e.err.Error(), e.detail)
+}
+
+func (e *firebaseSendError) Unwrap() error {
+	return e.err
+}
+
+// firebaseJob is a message waiting in the Firebase queue, see sendToFirebase
+type firebaseJob struct {
+	v *visitor
+	m *message
+}
+
+// sendToFirebase queues a message to be sent to Firebase. Messages are sent by a pool of workers (see
+// Config.FirebaseWorkers), urgent messages first. If the queue is full (e.g. during a publish burst or a Firebase
+// outage), the newest message with the lowest priority is dropped, so that urgent messages still get through.
+func (s *Server) sendToFirebase(v *visitor, m *message) {
+	s.firebaseWorkers.Do(func() {
+		for i := 0; i < s.config().FirebaseWorkers; i++ {
+			go s.runFirebaseWorker()
+		}
+	})
+	s.enqueueFirebase(v, m)
+}
+
+func (s *Server) enqueueFirebase(v *visitor, m *message) {
+	priority := m.Priority
+	if priority == 0 {
+		priority = 3 // Default priority; keepalive messages have no priority
+	}
+	dropped, ok := s.firebaseQueue.Enqueue(&firebaseJob{v: v, m: m}, priority)
+	mset(metricFirebaseQueueDepth, s.firebaseQueue.Len())
+	if ok {
+		minc(metricFirebaseQueueDropped)
+		s.firebaseFailed(dropped.v, dropped.m, errFirebaseQueueFull)
+	}
+}
+
+func (s *Server) runFirebaseWorker() {
+	for {
+		job, ok := s.firebaseQueue.Dequeue()
+		if !ok {
+			return // Queue closed
+		}
+		mset(metricFirebaseQueueDepth, s.firebaseQueue.Len())
+		s.deliverToFirebase(job.v, job.m)
+	}
+}
+
+// deliverToFirebase sends a message to Firebase, and retries with exponential backoff on temporary errors. If
+// Firebase responds with "quota exceeded", sends to the topic are paced, see firebasePacer.
+func (s *Server) deliverToFirebase(v *visitor, m *message) {
+	if s.faults.DropFirebase(m) {
+		return
+	}
+	if wait := s.firebasePacer.Wait(m.Topic); wait > firebasePacingWaitMax {
+		s.firebaseFailed(v, m, fmt.Errorf("%w, next message allowed in %s", errFirebasePaced, wait.Round(time.Second)))
+		return
+	} else if wait > 0 {
+		logvm(v, m).Tag(tagFirebase).Debug("Firebase messages to topic are paced, sending in %s", wait.Round(time.Millisecond))
+		s.requeueFirebase(v, m, wait)
+		return
+	}
+	logvm(v, m).Tag(tagFirebase).Debug("Publishing to Firebase")
+	fcm := s.firebaseMessage(m)
+	err := s.firebaseClient.Send(v, fcm)
+	for retry := 0; errors.Is(err, ErrFirebaseUnavailable) && retry < firebaseRetryMax; retry++ {
+		delay := s.firebaseRetryDelay << retry
+		var sendErr *firebaseSendError
+		if errors.As(err, &sendErr) {
+			delay = max(delay, min(sendErr.retryAfter, firebasePacingWaitMax))
+		}
+		logvm(v, m).Tag(tagFirebase).Err(err).Debug("Temporary Firebase error, retrying in %s", delay)
+		minc(metricFirebaseRetries)
+		if !s.waitFirebase(delay) {
+			logvm(v, m).Tag(tagFirebase).Debug("Firebase queue closed, not retrying")
+			return
+		}
+		err = s.firebaseClient.Send(v, fcm)
+	}
+	if errors.Is(err, ErrFirebaseQuotaExceeded) {
+		s.firebaseQuotaExceeded(v, m, err)
+	}
+	if err != nil {
+		s.firebaseFailed(v, m, err)
+		return
+	}
+	s.firebasePacer.Sent(m.Topic)
+	s.firebaseDelivered(v, m, nil)
+	minc(metricFirebasePublishedSuccess)
+}
+
+// waitFirebase waits for the given delay, and returns false if the Firebase queue was closed in the meantime
+func (s *Server) waitFirebase(delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-s.firebaseQueue.Done():
+		return false
+	}
+}
+
+// requeueFirebase puts a message back into the Firebase queue after the given delay, so that paced topics do not
+// hold up the Firebase workers. If the queue is closed in the meantime, the message is discarded.
+func (s *Server) requeueFirebase(v *visitor, m *message, delay time.Duration) {
+	go func() {
+		if s.waitFirebase(delay) {
+			s.enqueueFirebase(v, m)
+		}
+	}()
+}
+
+// firebaseMessage returns the message as it is sent to Firebase. If the attachment was uploaded to this server and
+// is at least firebase-attachment-defer-size large, the attachment URL is removed, so that the app does not download
+// it right away (which causes bandwidth spikes right after publishing). The app fetches the URL via
+// GET /file/<message ID>/url when the notification is opened. Otherwise, the attachment URL is signed, if
+// attachment-auth is set.
+func (s *Server) firebaseMessage(m *message) *message {
+	conf := s.config()
+	if conf.FirebaseAttachmentDeferSize > 0 && s.attachmentStored(m) && m.Attachment.Size >= conf.FirebaseAttachmentDeferSize {
+		attachment := *m.Attachment
+		attachment.URL = ""
+		deferred := *m
+		deferred.Attachment = &attachment
+		return &deferred
+	}
+	return s.signAttachmentURL(m)
+}
+
+// firebaseQuotaExceeded paces messages to the topic (or to all topics, if the project quota was exceeded),
+// honoring the Retry-After hint of the Firebase response, if any
+func (s *Server) firebaseQuotaExceeded(v *visitor, m *message, err error) {
+	var retryAfter time.Duration
+	var project bool
+	var sendErr *firebaseSendError
+	if errors.As(err, &sendErr) {
+		retryAfter, project = sendErr.retryAfter, sendErr.project
+	}
+	delay := s.firebasePacer.QuotaExceeded(m.Topic, project, retryAfter)
+	ev := logvm(v, m).
+		Tag(tagFirebase).
+		Err(err).
+		Fields(log.Context{
+			"firebase_pacing_delay":       delay.String(),
+			"firebase_pacing_project":     project,
+			"firebase_pacing_retry_after": retryAfter.String(),
+		})
+	if project {
+		ev.Warn("Firebase quota exceeded for project, pacing messages to all topics for %s", delay)
+	} else {
+		ev.Warn("Firebase quota exceeded for topic, pacing messages to topic for %s", delay)
+	}
+}
+
+func (s *Server) firebaseFailed(v *visitor, m *message, err error) {
+	minc(metricFirebasePublishedFailure)
+	s.firebaseDelivered(v, m, err)
+	if errors.Is(err, errFirebasePaced) {
+		logvm(v, m).Tag(tagFirebase).Err(err).Debug("Unable to publish to Firebase: %v", err.Error())
+		return
+	}
+	logvm(v, m).Tag(tagFirebase).Err(err).Warn("Unable to publish to Firebase: %v", err.Error())
+	s.publishDeadLetter(m, deadLetterChannelFirebase, err)
+	s.integrationFailed(deadLetterChannelFirebase, m, err)
+}
+
+// firebaseDelivered records the outcome of sending a message to Firebase, so that it shows up in the topic stats.
+// Keepalive and poll messages to the control topics are not recorded.
+func (s *Server) firebaseDelivered(v *visitor, m *message, err error) {
+	if m.Event == keepaliveEvent || !topicRegex.MatchString(m.Topic) {
+		return
+	}
+	outcome := firebaseOutcome(err)
+	if err := s.messageCache.AddFirebaseDelivery(m, outcome, err); err != nil {
+		logvm(v, m).Tag(tagFirebase).Err(err).Warn("Unable to record Firebase delivery outcome")
+	}
+}
+
+// firebaseOutcome returns the delivery outcome for the error returned when sending a message to Firebase
+func firebaseOutcome(err error) string {
+	if err == nil {
+		return firebaseOutcomeDelivered
+	} else if errors.Is(err, ErrFirebaseQuotaExceeded) || errors.Is(err, errFirebasePaced) {
+		return firebaseOutcomeThrottled
+	} else if errors.Is(err, ErrFirebaseInvalid) {
+		return firebaseOutcomeInvalid
+	}
+	return firebaseOutcomeFailed
+}
+
 // firebaseClient is a generic client that formats and sends messages to Firebase.
 // The actual Firebase implementation is implemented in firebaseSenderImpl, to make it testable.
 type firebaseClient struct {
-	sender firebaseSender
+	sender FirebaseSender
 	auther user.Auther
 }
 
-func newFirebaseClient(sender firebaseSender, auther user.Auther) *firebaseClient {
+func newFirebaseClient(sender FirebaseSender, auther user.Auther) *firebaseClient {
 	return &firebaseClient{
 		sender: sender,
 		auther: auther,
@@ -38,9 +284,6 @@ func newFirebaseClient(sender firebaseSender, auther user.Auther) *firebaseClien
 }
 
 func (c *firebaseClient) Send(v *visitor, m *message) error {
-	if !v.FirebaseAllowed() {
-		return errFirebaseTemporarilyBanned
-	}
 	fbm, err := toFirebaseMessage(m, c.auther)
 	if err != nil {
 		return err
@@ -49,32 +292,33 @@ func (c *firebaseClient) Send(v *visitor, m *message) error {
 	if ev.IsTrace() {
 		ev.Field("firebase_message", util.MaybeMarshalJSON(fbm)).Trace("Firebase message")
 	}
-	err = c.sender.Send(fbm)
-	if err == errFirebaseQuotaExceeded {
-		logvm(v, m).
-			Tag(tagFirebase).
-			Err(err).
-			Warn("Firebase quota exceeded (likely for topic), temporarily denying Firebase access to visitor")
-		v.FirebaseTemporarilyDeny()
-	}
-	return err
+	return c.sender.Send(fbm)
 }
 
-// firebaseSender is an interface that represents a client that can send to Firebase Cloud Messaging.
-// In tests, this can be implemented with a mock.
-type firebaseSender interface {
-	// Send sends a message to Firebase, or returns an error. It returns errFirebaseQuotaExceeded
-	// if a rate limit has reached.
+// FirebaseSender is an interface that represents a client that can send to Firebase Cloud Messaging.
+// In tests, this can be implemented with a mock. A custom implementation can be passed to New via
+// WithFirebaseSender, in which case firebase-key-file is not needed.
+type FirebaseSender interface {
+	// Send sends a message to Firebase, or returns an error. It returns an error wrapping ErrFirebaseQuotaExceeded
+	// if a rate limit has been reached, or ErrFirebaseUnavailable for temporary errors.
 	Send(m *messaging.Message) error
 }
 
-// firebaseSenderImpl is a firebaseSender that actually talks to Firebase
+// firebaseSenderImpl is a FirebaseSender that actually talks to Firebase
 type firebaseSenderImpl struct {
 	client *messaging.Client
 }
 
-func newFirebaseSender(credentialsFile string) (*firebaseSenderImpl, error) {
-	fb, err := firebase.NewApp(context.Background(), nil, option.WithCredentialsFile(credentialsFile))
+func newFirebaseSender(conf *Config) (*firebaseSenderImpl, error) {
+	opts := []option.ClientOption{option.WithCredentialsFile(conf.FirebaseKeyFile)}
+	if outboundProxyConfigured(conf, conf.FirebaseProxy) {
+		client, err := newFirebaseHTTPClient(conf)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, option.WithHTTPClient(client))
+	}
+	fb, err := firebase.NewApp(context.Background(), nil, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -87,10 +331,45 @@ func newFirebaseSender(credentialsFile string) (*firebaseSenderImpl, error) {
 	}, nil
 }
 
+// newFirebaseHTTPClient creates an authenticated HTTP client for Firebase that sends all requests (including
+// the OAuth token requests) through firebase-proxy or outbound-proxy
+func newFirebaseHTTPClient(conf *Config) (*http.Client, error) {
+	transport, err := outboundTransport(conf, conf.FirebaseProxy)
+	if err != nil {
+		return nil, err
+	}
+	credentials, err := os.ReadFile(conf.FirebaseKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Transport: transport})
+	creds, err := google.CredentialsFromJSON(ctx, credentials, firebaseScopes...)
+	if err != nil {
+		return nil, err
+	}
+	return oauth2.NewClient(ctx, creds.TokenSource), nil
+}
+
 func (c *firebaseSenderImpl) Send(m *messaging.Message) error {
 	_, err := c.client.Send(context.Background(), m)
 	if err != nil && messaging.IsQuotaExceeded(err) {
-		return errFirebaseQuotaExceeded
+		return &firebaseSendError{
+			err:        ErrFirebaseQuotaExceeded,
+			detail:     err.Error(),
+			retryAfter: parseRetryAfter(errorutils.HTTPResponse(err)),
+			project:    firebaseProjectQuotaExceeded(errorutils.HTTPResponse(err)),
+		}
+	} else if err != nil && (messaging.IsUnavailable(err) || messaging.IsInternal(err)) {
+		return &firebaseSendError{
+			err:        ErrFirebaseUnavailable,
+			detail:     err.Error(),
+			retryAfter: parseRetryAfter(errorutils.HTTPResponse(err)),
+		}
+	} else if err != nil && (messaging.IsInvalidArgument(err) || messaging.IsUnregistered(err) || messaging.IsSenderIDMismatch(err)) {
+		return &firebaseSendError{
+			err:    ErrFirebaseInvalid,
+			detail: err.Error(),
+		}
 	}
 	return err
 }
@@ -157,6 +436,9 @@ func toFirebaseMessage(m *message, auther user.Auther) (*messaging.Message, erro
 				"content_type": m.ContentType,
 				"encoding":     m.Encoding,
 			}
+			if m.Summary != "" {
+				data["summary"] = m.Summary
+			}
 			if len(m.Actions) > 0 {
 				actions, err := json.Marshal(m.Actions)
 				if err != nil {
@@ -164,12 +446,33 @@ func toFirebaseMessage(m *message, auther user.Auther) (*messaging.Message, erro
 				}
 				data["actions"] = string(actions)
 			}
+			if len(m.Embeds) > 0 {
+				embeds, err := json.Marshal(m.Embeds)
+				if err != nil {
+					return nil, err
+				}
+				data["embeds"] = string(embeds)
+			}
+			if m.Publisher != nil {
+				publisher, err := json.Marshal(m.Publisher)
+				if err != nil {
+					return nil, err
+				}
+				data["publisher"] = string(publisher)
+			}
 			if m.Attachment != nil {
 				data["attachment_name"] = m.Attachment.Name
 				data["attachment_type"] = m.Attachment.Type
 				data["attachment_size"] = fmt.Sprintf("%d", m.Attachment.Size)
 				data["attachment_expires"] = fmt.Sprintf("%d", m.Attachment.Expires)
-				data["attachment_url"] = m.Attachment.URL
+				if m.Attachment.URL != "" {
+					data["attachment_url"] = m.Attachment.URL
+				} else {
+					data["attachment_deferred"] = "1" // URL must be fetched via GET /file/<id>/url, see firebaseMessage
+				}
+				if m.Attachment.Alt != "" {
+					data["attachment_alt"] = m.Attachment.Alt
+				}
 			}
 			apnsConfig = createAPNSAlertConfig(m, data)
 		} else {
@@ -5,10 +5,14 @@ import (
 	"errors"
 	"fmt"
 	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+	"io"
+	"net/http"
 	"net/netip"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"firebase.google.com/go/v4/messaging"
 	"github.com/stretchr/testify/require"
@@ -48,7 +52,7 @@ func (s *testFirebaseSender) Send(m *messaging.Message) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if len(s.messages)+1 > s.allowed {
-		return errFirebaseQuotaExceeded
+		return ErrFirebaseQuotaExceeded
 	}
 	s.messages = append(s.messages, m)
 	return nil
@@ -60,6 +64,51 @@ func (s *testFirebaseSender) Messages() []*messaging.Message {
 	return append(make([]*messaging.Message, 0), s.messages...)
 }
 
+// testFlakyFirebaseSender fails with a temporary error the given number of times (or with quotaErr, if set),
+// and can be blocked to fill up the Firebase queue
+type testFlakyFirebaseSender struct {
+	failures int
+	quotaErr error
+	attempts []string // Message of each attempt
+	block    chan struct{}
+	messages []*messaging.Message
+	mu       sync.Mutex
+}
+
+func (s *testFlakyFirebaseSender) Send(m *messaging.Message) error {
+	if s.block != nil {
+		<-s.block
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attempts = append(s.attempts, m.Data["message"])
+	if s.quotaErr != nil {
+		return s.quotaErr
+	} else if len(s.attempts) <= s.failures {
+		return fmt.Errorf("%w: 503 service unavailable", ErrFirebaseUnavailable)
+	}
+	s.messages = append(s.messages, m)
+	return nil
+}
+
+func (s *testFlakyFirebaseSender) Attempts(message string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var attempts int
+	for _, m := range s.attempts {
+		if m == message {
+			attempts++
+		}
+	}
+	return attempts
+}
+
+func (s *testFlakyFirebaseSender) Messages() []*messaging.Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append(make([]*messaging.Message, 0), s.messages...)
+}
+
 func TestToFirebaseMessage_Keepalive(t *testing.T) {
 	m := newKeepaliveMessage("mytopic")
 	fbm, err := toFirebaseMessage(m, nil)
@@ -214,6 +263,27 @@ func TestToFirebaseMessage_Message_Normal_Allowed(t *testing.T) {
 	}, fbm.Data)
 }
 
+func TestToFirebaseMessage_Message_SummaryAndAlt(t *testing.T) {
+	m := newDefaultMessage("mytopic", "this is a message")
+	m.Summary = "The front door camera saw a person"
+	m.Attachment = &attachment{
+		Name: "camera.jpg",
+		Type: "image/jpeg",
+		URL:  "https://example.com/camera.jpg",
+		Alt:  "A person in a red jacket standing at the front door",
+	}
+	fbm, err := toFirebaseMessage(m, &testAuther{Allow: true})
+	require.Nil(t, err)
+	require.Equal(t, "The front door camera saw a person", fbm.Data["summary"])
+	require.Equal(t, "A person in a red jacket standing at the front door", fbm.Data["attachment_alt"])
+
+	m = newDefaultMessage("mytopic", "this is a message")
+	fbm, err = toFirebaseMessage(m, &testAuther{Allow: true})
+	require.Nil(t, err)
+	require.NotContains(t, fbm.Data, "summary")
+	require.NotContains(t, fbm.Data, "attachment_alt")
+}
+
 func TestToFirebaseMessage_Message_Normal_Not_Allowed(t *testing.T) {
 	m := newDefaultMessage("mytopic", "this is a message")
 	m.Priority = 5
@@ -325,21 +395,275 @@ func TestMaybeTruncateFCMMessage_NotTooLong(t *testing.T) {
 	require.Equal(t, "", notTruncatedFCMMessage.Data["truncated"])
 }
 
-func TestToFirebaseSender_Abuse(t *testing.T) {
-	sender := &testFirebaseSender{allowed: 2}
-	client := newFirebaseClient(sender, &testAuther{})
-	visitor := newVisitor(newTestConfig(t), newMemTestCache(t), nil, netip.MustParseAddr("1.2.3.4"), nil)
+func TestServer_Firebase_QuotaExceededPacing(t *testing.T) {
+	sender := &testFlakyFirebaseSender{quotaErr: &firebaseSendError{
+		err:        ErrFirebaseQuotaExceeded,
+		detail:     "topic quota exceeded",
+		retryAfter: time.Minute,
+	}}
+	s := newTestServer(t, newTestConfig(t))
+	s.firebaseClient = newFirebaseClient(sender, &testAuther{Allow: true})
+
+	// Quota error paces the topic, honoring the Retry-After hint
+	v := newVisitor(s.config(), s.messageCache, nil, netip.MustParseAddr("1.2.3.4"), nil)
+	s.deliverToFirebase(v, newDefaultMessage("mytopic", "first"))
+	require.InDelta(t, time.Minute.Seconds(), s.firebasePacer.Wait("mytopic").Seconds(), 1)
+	require.Equal(t, time.Duration(0), s.firebasePacer.Wait("othertopic"))
 
-	require.Nil(t, client.Send(visitor, &message{Topic: "mytopic"}))
+	response := request(t, s, "GET", "/v1/stats", "", nil)
+	require.Equal(t, 200, response.Code)
+	var stats apiStatsResponse
+	require.Nil(t, json.Unmarshal(response.Body.Bytes(), &stats))
+	require.Equal(t, 1, stats.Firebase.PacedTopics)
+	require.Equal(t, int64(0), stats.Firebase.ProjectDelay)
+	require.InDelta(t, 60, stats.Firebase.MaxDelay, 1)
+
+	// Messages to the paced topic are not sent, other topics are not affected
+	sender.quotaErr = nil
+	s.deliverToFirebase(v, newDefaultMessage("mytopic", "second"))
+	s.deliverToFirebase(v, newDefaultMessage("othertopic", "third"))
+	require.Equal(t, 1, sender.Attempts("first"))
+	require.Equal(t, 0, sender.Attempts("second"))
+	require.Equal(t, 1, sender.Attempts("third"))
 	require.Equal(t, 1, len(sender.Messages()))
+}
 
-	require.Nil(t, client.Send(visitor, &message{Topic: "mytopic"}))
-	require.Equal(t, 2, len(sender.Messages()))
+func TestServer_Firebase_PacedTopicDoesNotBlockWorkers(t *testing.T) {
+	c := newTestConfig(t)
+	c.FirebaseWorkers = 1
+	sender := &testFlakyFirebaseSender{}
+	s := newTestServer(t, c)
+	s.firebaseClient = newFirebaseClient(sender, &testAuther{Allow: true})
+	s.firebasePacer.paces["mytopic"] = &firebasePace{delay: firebasePacingDelayMin, until: time.Now().Add(time.Second)}
+
+	// The message to the paced topic is held back, but the only worker keeps sending other messages
+	request(t, s, "PUT", "/mytopic", "paced", nil)
+	request(t, s, "PUT", "/othertopic", "not paced", nil)
+	waitFor(t, func() bool {
+		return sender.Attempts("not paced") == 1
+	})
+	require.Equal(t, 0, sender.Attempts("paced"))
 
-	require.Equal(t, errFirebaseQuotaExceeded, client.Send(visitor, &message{Topic: "mytopic"}))
+	// Once the delay has passed, the message is sent
+	waitFor(t, func() bool {
+		return sender.Attempts("paced") == 1
+	})
 	require.Equal(t, 2, len(sender.Messages()))
+}
+
+func TestFirebaseProjectQuotaExceeded(t *testing.T) {
+	newResponse := func(body string) *http.Response {
+		return &http.Response{Body: io.NopCloser(strings.NewReader(body))}
+	}
+	project := `{"error":{"code":429,"status":"RESOURCE_EXHAUSTED","details":[
+		{"@type":"type.googleapis.com/google.firebase.fcm.v1.FcmError","errorCode":"QUOTA_EXCEEDED"},
+		{"@type":"type.googleapis.com/google.rpc.QuotaFailure","violations":[{"subject":"project_number:123456","description":"Quota exceeded"}]}]}}`
+	topic := `{"error":{"code":429,"message":"Topic quota exceeded for project messages","status":"RESOURCE_EXHAUSTED","details":[
+		{"@type":"type.googleapis.com/google.firebase.fcm.v1.FcmError","errorCode":"QUOTA_EXCEEDED"}]}}`
+	require.True(t, firebaseProjectQuotaExceeded(newResponse(project)))
+	require.False(t, firebaseProjectQuotaExceeded(newResponse(topic))) // Mentions "project", but not as the subject
+	require.False(t, firebaseProjectQuotaExceeded(newResponse("not json")))
+	require.False(t, firebaseProjectQuotaExceeded(nil))
+}
+
+func TestServer_Firebase_DeliveryStats(t *testing.T) {
+	sender := &testFlakyFirebaseSender{}
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+	s.firebaseClient = newFirebaseClient(sender, &testAuther{Allow: true})
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	philAuth := map[string]string{"Authorization": util.BasicAuth("phil", "phil")}
+
+	v := newVisitor(s.config(), s.messageCache, nil, netip.MustParseAddr("1.2.3.4"), nil)
+	s.deliverToFirebase(v, newDefaultMessage("mytopic", "first"))
+	s.deliverToFirebase(v, newDefaultMessage("mytopic", "second"))
+	sender.quotaErr = &firebaseSendError{err: ErrFirebaseInvalid, detail: "invalid argument"}
+	s.deliverToFirebase(v, newDefaultMessage("mytopic", "third"))
+	sender.quotaErr = &firebaseSendError{err: ErrFirebaseQuotaExceeded, detail: "topic quota exceeded"}
+	s.deliverToFirebase(v, newDefaultMessage("mytopic", "fourth"))
+	s.deliverToFirebase(v, newDefaultMessage("othertopic", "fifth"))
+	s.deliverToFirebase(v, newKeepaliveMessage(firebaseControlTopic))
+
+	rr := request(t, s, "GET", "/mytopic/stats", "", philAuth)
+	require.Equal(t, 200, rr.Code)
+	stats, err := util.UnmarshalJSON[apiTopicStatsResponse](io.NopCloser(rr.Body))
+	require.Nil(t, err)
+	require.NotNil(t, stats.Firebase)
+	require.Equal(t, 2, stats.Firebase.Delivered)
+	require.Equal(t, 1, stats.Firebase.Throttled)
+	require.Equal(t, 1, stats.Firebase.Invalid)
+	require.Equal(t, 0, stats.Firebase.Failed)
+	require.Contains(t, stats.Firebase.LastError, "topic quota exceeded")
+	require.NotZero(t, stats.Firebase.LastErrorTime)
+
+	// Outcomes are pruned after the retention period
+	require.Nil(t, s.messageCache.PruneFirebaseDeliveries(time.Now().Add(time.Minute)))
+	rr = request(t, s, "GET", "/mytopic/stats", "", philAuth)
+	stats, err = util.UnmarshalJSON[apiTopicStatsResponse](io.NopCloser(rr.Body))
+	require.Nil(t, err)
+	require.Equal(t, 0, stats.Firebase.Delivered+stats.Firebase.Throttled+stats.Firebase.Invalid)
+	require.Empty(t, stats.Firebase.LastError)
+}
+
+func TestServer_Firebase_RetryTemporaryErrors(t *testing.T) {
+	sender := &testFlakyFirebaseSender{failures: 2}
+	s := newTestServer(t, newTestConfig(t))
+	s.firebaseClient = newFirebaseClient(sender, &testAuther{Allow: true})
+	s.firebaseRetryDelay = 10 * time.Millisecond
+
+	request(t, s, "PUT", "/mytopic", "my message", nil)
+	waitFor(t, func() bool {
+		return len(sender.Messages()) == 1
+	})
+	require.Equal(t, 3, sender.Attempts("my message"))
+	require.Equal(t, "my message", sender.Messages()[0].Data["message"])
+}
 
-	sender.messages = make([]*messaging.Message, 0) // Reset to test that time limit is working
-	require.Equal(t, errFirebaseTemporarilyBanned, client.Send(visitor, &message{Topic: "mytopic"}))
+func TestServer_Firebase_RetryGivesUp(t *testing.T) {
+	c := newTestConfig(t)
+	c.DeadLetterTopic = "undeliverable"
+	sender := &testFlakyFirebaseSender{failures: 100}
+	s := newTestServer(t, c)
+	s.firebaseClient = newFirebaseClient(sender, &testAuther{Allow: true})
+	s.firebaseRetryDelay = 10 * time.Millisecond
+
+	request(t, s, "PUT", "/mytopic", "my message", nil)
+	waitFor(t, func() bool {
+		response := request(t, s, "GET", "/undeliverable/json?poll=1", "", nil)
+		return len(toMessages(t, response.Body.String())) == 1
+	})
+	require.Equal(t, 1+firebaseRetryMax, sender.Attempts("my message"))
 	require.Equal(t, 0, len(sender.Messages()))
 }
+
+func TestServer_Firebase_RetryStopsWhenQueueClosed(t *testing.T) {
+	sender := &testFlakyFirebaseSender{failures: 100}
+	s := newTestServer(t, newTestConfig(t))
+	s.firebaseClient = newFirebaseClient(sender, &testAuther{Allow: true})
+	s.firebaseRetryDelay = time.Hour
+
+	v := newVisitor(s.config(), s.messageCache, nil, netip.MustParseAddr("1.2.3.4"), nil)
+	done := make(chan struct{})
+	go func() {
+		s.deliverToFirebase(v, newDefaultMessage("mytopic", "my message"))
+		close(done)
+	}()
+	waitFor(t, func() bool {
+		return sender.Attempts("my message") == 1
+	})
+	s.firebaseQueue.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("retry did not stop after queue was closed")
+	}
+	require.Equal(t, 1, sender.Attempts("my message"))
+}
+
+func TestServer_Firebase_QueuePriorityAndBackpressure(t *testing.T) {
+	c := newTestConfig(t)
+	c.FirebaseWorkers = 1
+	c.FirebaseQueueSize = 2
+	sender := &testFlakyFirebaseSender{block: make(chan struct{})}
+	s := newTestServer(t, c)
+	s.firebaseClient = newFirebaseClient(sender, &testAuther{Allow: true})
+
+	// The first message blocks the only worker, the next two fill up the queue
+	request(t, s, "PUT", "/mytopic", "blocking", nil)
+	waitFor(t, func() bool {
+		return s.firebaseQueue.Len() == 0
+	})
+	request(t, s, "PUT", "/mytopic", "low 1", map[string]string{"Priority": "low"})
+	request(t, s, "PUT", "/mytopic", "low 2", map[string]string{"Priority": "low"})
+	require.Equal(t, 2, s.firebaseQueue.Len())
+
+	// Queue is full: the urgent message evicts the newest low priority message
+	request(t, s, "PUT", "/mytopic", "urgent", map[string]string{"Priority": "urgent"})
+	require.Equal(t, 2, s.firebaseQueue.Len())
+
+	close(sender.block)
+	waitFor(t, func() bool {
+		return len(sender.Messages()) == 3
+	})
+	messages := sender.Messages()
+	require.Equal(t, "blocking", messages[0].Data["message"])
+	require.Equal(t, "urgent", messages[1].Data["message"])
+	require.Equal(t, "low 1", messages[2].Data["message"])
+
+	// Messages are still delivered to subscribers, regardless of Firebase
+	response := request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	require.Equal(t, 4, len(toMessages(t, response.Body.String())))
+}
+
+func TestServer_Firebase_DeferredAttachment(t *testing.T) {
+	sender := newTestFirebaseSender(10)
+	conf := newTestConfigWithAuthFile(t)
+	conf.AuthDefault = user.PermissionDenyAll
+	conf.AttachmentAuth = true
+	conf.FirebaseAttachmentDeferSize = 1000
+	s := newTestServer(t, conf)
+	defer s.closeDatabases()
+	s.firebaseClient = newFirebaseClient(sender, &testAuther{Allow: true})
+	require.Nil(t, s.userManager.AllowAccess(user.Everyone, "mytopic", user.PermissionReadWrite))
+
+	// Small attachments are sent with (signed) URL, large attachments without
+	rr := request(t, s, "PUT", "/mytopic", "small", map[string]string{"Filename": "small.txt", "Firebase": "no"})
+	small := toMessage(t, rr.Body.String())
+	content := util.RandomString(5000)
+	rr = request(t, s, "PUT", "/mytopic", content, map[string]string{"Firebase": "no"})
+	large := toMessage(t, rr.Body.String())
+	v := newVisitor(s.config(), s.messageCache, nil, netip.MustParseAddr("1.2.3.4"), nil)
+	s.deliverToFirebase(v, small)
+	s.deliverToFirebase(v, large)
+	messages := sender.Messages()
+	require.Equal(t, 2, len(messages))
+	require.Contains(t, messages[0].Data["attachment_url"], "sig=")
+	require.Empty(t, messages[0].Data["attachment_deferred"])
+	require.Empty(t, messages[1].Data["attachment_url"])
+	require.Equal(t, "1", messages[1].Data["attachment_deferred"])
+	require.Equal(t, "5000", messages[1].Data["attachment_size"])
+
+	// The app fetches a short-lived signed URL when the notification is opened
+	rr = request(t, s, "GET", "/file/"+large.ID+"/url", "", nil)
+	require.Equal(t, 200, rr.Code)
+	fileURL, _ := util.UnmarshalJSON[apiFileURLResponse](io.NopCloser(rr.Body))
+	require.Contains(t, fileURL.URL, "sig=")
+	require.InDelta(t, time.Now().Add(attachmentDeferredURLExpiry).Unix(), fileURL.Expires, 5)
+	rr = request(t, s, "GET", strings.TrimPrefix(fileURL.URL, "http://127.0.0.1:12345"), "", nil)
+	require.Equal(t, 200, rr.Code)
+	require.Equal(t, content, rr.Body.String())
+
+	// Only users with read access get a URL
+	require.Nil(t, s.userManager.AllowAccess(user.Everyone, "mytopic", user.PermissionWrite))
+	rr = request(t, s, "GET", "/file/"+large.ID+"/url", "", nil)
+	require.Equal(t, 403, rr.Code)
+	rr = request(t, s, "GET", "/file/doesnotexist/url", "", nil)
+	require.Equal(t, 404, rr.Code)
+}
+
+func TestServer_Firebase_DeferredAttachment_WithoutAttachmentAuth(t *testing.T) {
+	conf := newTestConfigWithAuthFile(t)
+	conf.FirebaseAttachmentDeferSize = 1000
+	s := newTestServer(t, conf)
+	defer s.closeDatabases()
+	content := util.RandomString(5000)
+	rr := request(t, s, "PUT", "/mytopic", content, map[string]string{"Firebase": "no"})
+	large := toMessage(t, rr.Body.String())
+
+	// The URL is signed and short-lived, even if attachment-auth is not set
+	rr = request(t, s, "GET", "/file/"+large.ID+"/url", "", nil)
+	require.Equal(t, 200, rr.Code)
+	fileURL, _ := util.UnmarshalJSON[apiFileURLResponse](io.NopCloser(rr.Body))
+	require.Contains(t, fileURL.URL, "sig=")
+	require.InDelta(t, time.Now().Add(attachmentDeferredURLExpiry).Unix(), fileURL.Expires, 5)
+	rr = request(t, s, "GET", strings.TrimPrefix(fileURL.URL, "http://127.0.0.1:12345"), "", nil)
+	require.Equal(t, 200, rr.Code)
+	require.Equal(t, content, rr.Body.String())
+
+	// Expired signatures are rejected
+	key, err := s.signingKey(signingKeyPurposeAttachment)
+	require.Nil(t, err)
+	expiredURL := signedAttachmentURL(key, large, time.Now().Add(-time.Minute).Unix())
+	rr = request(t, s, "GET", strings.TrimPrefix(expiredURL, "http://127.0.0.1:12345"), "", nil)
+	require.Equal(t, 403, rr.Code)
+}
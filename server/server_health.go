@@ -0,0 +1,147 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"heckel.io/ntfy/v2/log"
+)
+
+// Health checks tell load balancers and orchestrators whether they should send traffic to this server. Besides the
+// JSON health endpoint (/v1/health), the server supports the following protocols:
+//
+//   - GET /healthz returns "ok" (200), or "draining" (503) while the server is draining, e.g. for AWS ALB target groups
+//   - The standard gRPC health checking protocol (grpc.health.v1.Health), if "health-listen-grpc" is set, e.g. for
+//     Kubernetes gRPC probes or Envoy. The status of the services "" and "ntfy" is NOT_SERVING while draining.
+//   - The HAProxy agent protocol, if "health-listen-agent" is set: The agent answers every TCP connection with
+//     "up ready" or "drain", and closes it, see HAProxy's "agent-check" server option.
+//
+// GET /v1/health?deep=1 additionally checks if the message cache and the user database respond (see checkDatabases),
+// so that operators can distinguish "process up" from "database wedged". The same check is used before pinging the
+// systemd watchdog, see server_systemd.go.
+//
+// Admins can put the server into the drain state (PUT/DELETE /v1/admin/drain) before maintenance or a deployment:
+// While draining, the server keeps serving all requests (including existing subscriptions), but it reports itself as
+// unavailable, so that load balancers stop sending new traffic. The drain state is kept in memory only.
+
+const (
+	healthServiceName        = "ntfy" // gRPC health service name, in addition to the overall server status ("")
+	healthAgentWriteTimeout  = 5 * time.Second
+	healthzResponseOK        = "ok"
+	healthzResponseDraining  = "draining"
+	healthAgentResponseUp    = "up ready\n"
+	healthAgentResponseDrain = "drain\n"
+	healthCheckOK            = "ok"
+	healthCheckTimeout       = 5 * time.Second
+)
+
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Cache-Control", "no-cache")
+	if s.draining.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		if r.Method == http.MethodGet {
+			_, err := fmt.Fprintln(w, healthzResponseDraining)
+			return err
+		}
+		return nil
+	}
+	if r.Method == http.MethodGet {
+		_, err := fmt.Fprintln(w, healthzResponseOK)
+		return err
+	}
+	return nil
+}
+
+func (s *Server) handleDrainGet(w http.ResponseWriter, _ *http.Request, _ *visitor) error {
+	return s.writeJSON(w, &apiAdminDrainResponse{
+		Draining: s.draining.Load(),
+	})
+}
+
+func (s *Server) handleDrainStart(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	logvr(v, r).Tag(tagManager).Info("Draining server, health checks report the server as unavailable")
+	s.setDraining(true)
+	return s.writeJSON(w, &apiAdminDrainResponse{Draining: true})
+}
+
+func (s *Server) handleDrainStop(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	logvr(v, r).Tag(tagManager).Info("Stopped draining server, health checks report the server as available")
+	s.setDraining(false)
+	return s.writeJSON(w, &apiAdminDrainResponse{Draining: false})
+}
+
+// setDraining changes the drain state, and updates the status of the gRPC health service accordingly
+func (s *Server) setDraining(draining bool) {
+	s.draining.Store(draining)
+	if s.grpcHealth != nil {
+		if draining {
+			s.grpcHealth.Shutdown()
+		} else {
+			s.grpcHealth.Resume()
+		}
+	}
+}
+
+// checkDatabases checks if the message cache and the user database (if enabled) respond, and returns the result
+// per database (name -> error, or nil if the database responded)
+func (s *Server) checkDatabases() map[string]error {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+	results := map[string]error{
+		"message_cache": s.messageCache.Ping(ctx),
+	}
+	if s.userManager != nil {
+		results["user_db"] = s.userManager.Ping(ctx)
+	}
+	return results
+}
+
+// newGRPCHealthServer creates the gRPC health service. It is created in the constructor (and not in Run),
+// so that the drain state can be changed before the server is started.
+func newGRPCHealthServer() *health.Server {
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus(healthServiceName, healthpb.HealthCheckResponse_SERVING)
+	return healthServer
+}
+
+// runGRPCHealthServer serves the standard gRPC health checking protocol on the given listener
+func (s *Server) runGRPCHealthServer(listener net.Listener) error {
+	s.mu.Lock()
+	s.grpcServer = grpc.NewServer()
+	healthpb.RegisterHealthServer(s.grpcServer, s.grpcHealth)
+	s.mu.Unlock()
+	return s.grpcServer.Serve(listener)
+}
+
+// runHealthAgent serves the HAProxy agent protocol on the given listener: Every connection is answered with
+// the current state of the server, and then closed
+func (s *Server) runHealthAgent(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handleHealthAgentConn(conn)
+	}
+}
+
+func (s *Server) handleHealthAgentConn(conn net.Conn) {
+	defer conn.Close()
+	response := healthAgentResponseUp
+	if s.draining.Load() {
+		response = healthAgentResponseDrain
+	}
+	if err := conn.SetWriteDeadline(time.Now().Add(healthAgentWriteTimeout)); err != nil {
+		return
+	}
+	if _, err := conn.Write([]byte(response)); err != nil {
+		log.Tag(tagManager).Err(err).Debug("Unable to write health agent response to %s", conn.RemoteAddr().String())
+	}
+}
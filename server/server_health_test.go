@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+func TestServer_Healthz_Drain(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+
+	rr := request(t, s, "GET", "/healthz", "", nil)
+	require.Equal(t, 200, rr.Code)
+	require.Equal(t, "ok\n", rr.Body.String())
+	rr = request(t, s, "GET", "/v1/health", "", nil)
+	require.Equal(t, 200, rr.Code)
+	require.Equal(t, `{"healthy":true,"subscriptions":0}`+"\n", rr.Body.String())
+
+	// Only admins can drain the server
+	require.Equal(t, 401, request(t, s, "PUT", "/v1/admin/drain", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	}).Code)
+	rr = request(t, s, "PUT", "/v1/admin/drain", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, rr.Code)
+	require.Equal(t, `{"draining":true}`+"\n", rr.Body.String())
+
+	// Health checks fail while draining, but other requests are still served
+	rr = request(t, s, "GET", "/healthz", "", nil)
+	require.Equal(t, 503, rr.Code)
+	require.Equal(t, "draining\n", rr.Body.String())
+	require.Equal(t, 503, request(t, s, "HEAD", "/healthz", "", nil).Code)
+	rr = request(t, s, "GET", "/v1/health", "", nil)
+	require.Equal(t, 503, rr.Code)
+	health, _ := util.UnmarshalJSON[apiHealthResponse](io.NopCloser(rr.Body))
+	require.False(t, health.Healthy)
+	require.True(t, health.Draining)
+	require.Equal(t, 200, request(t, s, "PUT", "/mytopic", "still works", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	}).Code)
+	rr = request(t, s, "GET", "/v1/admin/drain", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, `{"draining":true}`+"\n", rr.Body.String())
+
+	// Stop draining
+	require.Equal(t, 200, request(t, s, "DELETE", "/v1/admin/drain", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	}).Code)
+	require.Equal(t, 200, request(t, s, "GET", "/healthz", "", nil).Code)
+}
+
+func TestServer_Health_GRPC(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.HealthListenGRPC = "127.0.0.1:0"
+	s := newTestServer(t, conf)
+	defer s.closeDatabases()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	go s.runGRPCHealthServer(listener)
+	defer func() {
+		s.mu.Lock()
+		s.grpcServer.Stop()
+		s.mu.Unlock()
+	}()
+
+	conn, err := grpc.NewClient(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.Nil(t, err)
+	defer conn.Close()
+	client := healthpb.NewHealthClient(conn)
+	for _, service := range []string{"", "ntfy"} {
+		resp, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+		require.Nil(t, err)
+		require.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.Status)
+	}
+	s.setDraining(true)
+	resp, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: "ntfy"})
+	require.Nil(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, resp.Status)
+	s.setDraining(false)
+	resp, err = client.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	require.Nil(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.Status)
+}
+
+func TestServer_Health_Agent(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	defer s.closeDatabases()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer listener.Close()
+	go s.runHealthAgent(listener)
+
+	readAgent := func() string {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		require.Nil(t, err)
+		defer conn.Close()
+		b, err := io.ReadAll(conn)
+		require.Nil(t, err)
+		return string(b)
+	}
+	require.Equal(t, "up ready\n", readAgent())
+	s.setDraining(true)
+	require.Equal(t, "drain\n", readAgent())
+}
+
+func TestServer_Health_Deep(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	rr := request(t, s, "GET", "/v1/health?deep=1", "", nil)
+	require.Equal(t, 200, rr.Code)
+	health, _ := util.UnmarshalJSON[apiHealthResponse](io.NopCloser(rr.Body))
+	require.True(t, health.Healthy)
+	require.Equal(t, map[string]string{"message_cache": "ok", "user_db": "ok"}, health.Checks)
+
+	// Without deep=1, the databases are not checked
+	s.userManager.Close()
+	require.Equal(t, 200, request(t, s, "GET", "/v1/health", "", nil).Code)
+	rr = request(t, s, "GET", "/v1/health?deep=1", "", nil)
+	require.Equal(t, 503, rr.Code)
+	health, _ = util.UnmarshalJSON[apiHealthResponse](io.NopCloser(rr.Body))
+	require.False(t, health.Healthy)
+	require.Equal(t, "ok", health.Checks["message_cache"])
+	require.NotEqual(t, "ok", health.Checks["user_db"])
+	s.messageCache.Close()
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Publisher identity lets subscribers of shared topics see who sent a message: Topic owners enable it via
+// PUT /<topic>/identity (requires the manage permission), and disable it via DELETE /<topic>/identity. If enabled,
+// messages published by a logged-in user carry a "publisher" field with the username, and the label of the access
+// token, if one was used (e.g. {"user":"phil","token":"Grafana"}). Anonymous messages are not marked.
+//
+// The identity is determined by the server from the credentials of the publish request, so it cannot be spoofed
+// by the publisher. It is opt-in, because it reveals usernames to everyone who can read the topic.
+
+// topicIdentity is the in-memory set of topics that have the publisher identity enabled
+type topicIdentity struct {
+	topics map[string]bool
+	mu     sync.RWMutex
+}
+
+// newTopicIdentity loads the topics that have the publisher identity enabled from the message cache
+func newTopicIdentity(cache *messageCache) (*topicIdentity, error) {
+	topics, err := cache.TopicIdentities()
+	if err != nil {
+		return nil, err
+	}
+	t := &topicIdentity{
+		topics: make(map[string]bool),
+	}
+	for _, topic := range topics {
+		t.topics[topic] = true
+	}
+	return t, nil
+}
+
+// Enabled returns true if the publisher identity is enabled for the topic
+func (t *topicIdentity) Enabled(topic string) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.topics[topic]
+}
+
+// Set enables or disables the publisher identity for the topic
+func (t *topicIdentity) Set(topic string, enabled bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if enabled {
+		t.topics[topic] = true
+	} else {
+		delete(t.topics, topic)
+	}
+}
+
+// maybeAddPublisher sets the publisher of the message, if the publisher identity is enabled for its topic, and
+// the visitor is logged in
+func (s *Server) maybeAddPublisher(v *visitor, m *message) {
+	u := v.User()
+	if u == nil || m.Event != messageEvent || !s.identity.Enabled(m.Topic) {
+		return
+	}
+	m.Publisher = &messagePublisher{
+		User: u.Name,
+	}
+	if u.Token != "" && s.userManager != nil {
+		if token, err := s.userManager.Token(u.ID, u.Token); err == nil {
+			m.Publisher.Token = token.Label
+		}
+	}
+}
+
+// handleTopicIdentityGet returns whether the publisher identity is enabled for the topic in the path
+func (s *Server) handleTopicIdentityGet(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	topic, err := identityTopicFromPath(r)
+	if err != nil {
+		return err
+	}
+	return s.writeJSON(w, &apiTopicIdentityResponse{
+		Topic:   topic,
+		Enabled: s.identity.Enabled(topic),
+	})
+}
+
+// handleTopicIdentitySet enables the publisher identity for the topic in the path
+func (s *Server) handleTopicIdentitySet(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	topic, err := identityTopicFromPath(r)
+	if err != nil {
+		return err
+	}
+	if err := s.messageCache.AddTopicIdentity(topic); err != nil {
+		return err
+	}
+	s.identity.Set(topic, true)
+	logvr(v, r).Tag(tagManager).Field("topic", topic).Info("Enabled publisher identity for topic %s", topic)
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+// handleTopicIdentityDelete disables the publisher identity for the topic in the path. Messages that were
+// already published keep their publisher.
+func (s *Server) handleTopicIdentityDelete(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	topic, err := identityTopicFromPath(r)
+	if err != nil {
+		return err
+	}
+	if err := s.messageCache.RemoveTopicIdentity(topic); err != nil {
+		return err
+	}
+	s.identity.Set(topic, false)
+	logvr(v, r).Tag(tagManager).Field("topic", topic).Info("Disabled publisher identity for topic %s", topic)
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+// identityTopicFromPath returns the topic from a path like /alerts/identity
+func identityTopicFromPath(r *http.Request) (string, error) {
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) != 3 {
+		return "", errHTTPInternalErrorInvalidPath
+	}
+	return parts[1], nil
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"io"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+func TestServer_TopicIdentity(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	s := newTestServer(t, c)
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	require.Nil(t, s.userManager.AddReservation("phil", "alerts", user.PermissionReadWrite))
+	ben, err := s.userManager.User("ben")
+	require.Nil(t, err)
+	token, err := s.userManager.CreateToken(ben.ID, "Grafana", user.TokenTypeIntegration, time.Unix(0, 0), netip.IPv4Unspecified())
+	require.Nil(t, err)
+	phil := map[string]string{"Authorization": util.BasicAuth("phil", "phil")}
+
+	// Disabled by default
+	rr := request(t, s, "PUT", "/alerts", "before", phil)
+	require.Equal(t, 200, rr.Code)
+	require.Nil(t, toMessage(t, rr.Body.String()).Publisher)
+
+	// Only the owner can enable it
+	require.Equal(t, 403, request(t, s, "PUT", "/alerts/identity", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	}).Code)
+	require.Equal(t, 200, request(t, s, "PUT", "/alerts/identity", "", phil).Code)
+	rr = request(t, s, "GET", "/alerts/identity", "", phil)
+	require.Equal(t, 200, rr.Code)
+	identity, _ := util.UnmarshalJSON[apiTopicIdentityResponse](io.NopCloser(rr.Body))
+	require.True(t, identity.Enabled)
+
+	// Username, and token label if published with a token
+	rr = request(t, s, "PUT", "/alerts", "with password", phil)
+	require.Equal(t, 200, rr.Code)
+	m := toMessage(t, rr.Body.String())
+	require.Equal(t, "phil", m.Publisher.User)
+	require.Equal(t, "", m.Publisher.Token)
+	rr = request(t, s, "PUT", "/alerts", "with token", map[string]string{
+		"Authorization": util.BearerAuth(token.Value),
+	})
+	require.Equal(t, 200, rr.Code)
+	m = toMessage(t, rr.Body.String())
+	require.Equal(t, "ben", m.Publisher.User)
+	require.Equal(t, "Grafana", m.Publisher.Token)
+
+	// Publisher is cached
+	rr = request(t, s, "GET", "/alerts/json?poll=1", "", phil)
+	messages := toMessages(t, rr.Body.String())
+	require.Equal(t, 3, len(messages))
+	require.Nil(t, messages[0].Publisher)
+	require.Equal(t, "phil", messages[1].Publisher.User)
+	require.Equal(t, "Grafana", messages[2].Publisher.Token)
+
+	// Disable again
+	require.Equal(t, 200, request(t, s, "DELETE", "/alerts/identity", "", phil).Code)
+	rr = request(t, s, "PUT", "/alerts", "after", phil)
+	require.Nil(t, toMessage(t, rr.Body.String()).Publisher)
+}
@@ -0,0 +1,250 @@
+package server
+
+import (
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/util"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Instant delivery lets Android devices receive messages without Firebase (FCM) by keeping a WebSocket connection
+// to the server open at all times. This is the only option on self-hosted servers without FCM. To make this more
+// reliable, the server offers a small coordination API:
+//
+//   - GET /v1/instant returns connection hints: the WebSocket URL, the recommended keepalive interval and pong
+//     timeout, the recommended reconnect backoff, and whether FCM is available at all
+//   - POST /v1/instant/devices registers a device (or refreshes an existing registration), and returns a reconnect
+//     token. If a WebSocket subscription is opened with this token (?reconnect=<token>, or X-Reconnect-Token), and
+//     without "since", the server resumes after the last message that was delivered to the device, so that no
+//     messages are lost while the device was disconnected (e.g. when switching networks).
+//   - GET /v1/instant/devices (admins only) lists the device registry, i.e. which devices are connected, since
+//     when, to which topics, and how often they reconnected
+//
+// The device registry is kept in memory only. If a token is not known anymore (e.g. after a restart), registering
+// with it creates a new device. Devices that were not seen for a while are pruned by the manager.
+
+const (
+	instantReconnectDelayMin  = 5 * time.Second  // Recommended min. delay before reconnecting
+	instantReconnectDelayMax  = 5 * time.Minute  // Recommended max. delay before reconnecting (with exponential backoff)
+	instantDeviceExpiry       = 72 * time.Hour   // Devices that were not seen for this long are pruned
+	instantDevicesPerOwnerMax = 20               // Max. number of registered devices per user or IP address
+	instantTokenPrefix        = "rt_"            // Prefix of reconnect tokens
+	instantTokenLength        = 32               // Length of reconnect tokens, excluding the prefix
+	instantDeviceIDLength     = messageIDLength  // Length of the public device ID
+	instantRecentlySeen       = 10 * time.Minute // Used to decide which devices to evict if the limit is reached
+)
+
+// instantDevice is a device that is registered for instant delivery, see above
+type instantDevice struct {
+	id             string
+	token          string
+	owner          string // Owner of the device, see uploadOwner
+	topics         string // Comma-separated topics of the last connection
+	connections    int    // Number of open WebSocket connections with this device's token
+	reconnects     int    // Number of connections after the first one
+	lastMessageID  string // ID of the last message delivered to the device
+	created        time.Time
+	connectedSince time.Time
+	lastSeen       time.Time
+}
+
+// instantRegistry is the in-memory device registry, keyed by reconnect token
+type instantRegistry struct {
+	devices map[string]*instantDevice
+	mu      sync.Mutex
+}
+
+func newInstantRegistry() *instantRegistry {
+	return &instantRegistry{
+		devices: make(map[string]*instantDevice),
+	}
+}
+
+// handleInstant returns connection hints for instant delivery, see above
+func (s *Server) handleInstant(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	conf := s.config()
+	response := &apiInstantResponse{
+		KeepaliveInterval: int64(conf.KeepaliveInterval.Seconds()),
+		PongTimeout:       int64((conf.KeepaliveInterval + wsPongWait).Seconds()),
+		ReconnectDelayMin: int64(instantReconnectDelayMin.Seconds()),
+		ReconnectDelayMax: int64(instantReconnectDelayMax.Seconds()),
+		Firebase:          s.firebaseClient != nil,
+	}
+	if conf.BaseURL != "" {
+		response.WebSocketURL = strings.Replace(strings.Replace(conf.BaseURL, "https://", "wss://", 1), "http://", "ws://", 1)
+	}
+	return s.writeJSON(w, response)
+}
+
+// handleInstantDeviceRegister registers a device for instant delivery, or refreshes an existing registration if the
+// request contains a known reconnect token of the same owner
+func (s *Server) handleInstantDeviceRegister(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	req, err := readJSONWithLimit[apiInstantDeviceRequest](r.Body, jsonBodyBytesLimit, true)
+	if err != nil {
+		return err
+	}
+	owner := uploadOwner(v)
+	s.instant.mu.Lock()
+	defer s.instant.mu.Unlock()
+	if req != nil && req.Token != "" {
+		if device, ok := s.instant.devices[req.Token]; ok && device.owner == owner {
+			device.lastSeen = time.Now()
+			return s.writeJSON(w, newInstantDeviceResponse(device))
+		}
+	}
+	if !s.instant.evictIfFull(owner) {
+		return errHTTPTooManyRequestsLimitInstantDevices
+	}
+	device := &instantDevice{
+		id:       util.RandomString(instantDeviceIDLength),
+		token:    util.RandomStringPrefix(instantTokenPrefix, instantTokenLength),
+		owner:    owner,
+		created:  time.Now(),
+		lastSeen: time.Now(),
+	}
+	s.instant.devices[device.token] = device
+	logvr(v, r).Tag(tagWebsocket).Field("instant_device", device.id).Debug("Registered device %s for instant delivery", device.id)
+	return s.writeJSON(w, newInstantDeviceResponse(device))
+}
+
+// handleInstantDevicesGet lists all registered devices, see above; admins only
+func (s *Server) handleInstantDevicesGet(w http.ResponseWriter, _ *http.Request, _ *visitor) error {
+	s.instant.mu.Lock()
+	response := &apiInstantDevicesResponse{
+		Devices: make([]*apiInstantDevice, 0, len(s.instant.devices)),
+	}
+	for _, device := range s.instant.devices {
+		d := &apiInstantDevice{
+			ID:            device.id,
+			Owner:         device.owner,
+			Topics:        device.topics,
+			Connected:     device.connections > 0,
+			Reconnects:    device.reconnects,
+			LastMessageID: device.lastMessageID,
+			Created:       device.created.Unix(),
+			LastSeen:      device.lastSeen.Unix(),
+		}
+		if d.Connected {
+			d.ConnectedSince = device.connectedSince.Unix()
+			response.Connected++
+		}
+		response.Devices = append(response.Devices, d)
+	}
+	s.instant.mu.Unlock()
+	sort.Slice(response.Devices, func(i, j int) bool {
+		return response.Devices[i].Created < response.Devices[j].Created
+	})
+	response.Total = len(response.Devices)
+	return s.writeJSON(w, response)
+}
+
+// instantDeviceConnected marks the device with the reconnect token of the request (if any) as connected, and
+// returns it. If the device was delivered messages before and the request does not have a "since" parameter, the
+// returned since marker resumes after the last delivered message. If there is no (valid) token, nil is returned.
+func (s *Server) instantDeviceConnected(r *http.Request, v *visitor, topicsStr string, since sinceMarker) (*instantDevice, sinceMarker) {
+	token := readParam(r, "x-reconnect-token", "reconnect")
+	if token == "" {
+		return nil, since
+	}
+	s.instant.mu.Lock()
+	defer s.instant.mu.Unlock()
+	device, ok := s.instant.devices[token]
+	if !ok || device.owner != uploadOwner(v) {
+		logvr(v, r).Tag(tagWebsocket).Debug("Unknown reconnect token, ignoring")
+		return nil, since
+	}
+	if !device.connectedSince.IsZero() {
+		device.reconnects++
+	}
+	if device.connections == 0 {
+		device.connectedSince = time.Now()
+	}
+	device.connections++
+	device.topics = topicsStr
+	device.lastSeen = time.Now()
+	if device.lastMessageID != "" && readParam(r, "x-since", "since", "si") == "" {
+		logvr(v, r).Tag(tagWebsocket).Field("instant_device", device.id).Debug("Resuming instant delivery after message %s", device.lastMessageID)
+		since = newSinceID(device.lastMessageID)
+	}
+	mset(metricInstantDevicesConnected, s.instant.connected())
+	return device, since
+}
+
+// instantDeviceDisconnected marks the device as disconnected, if it has no other open connections
+func (s *Server) instantDeviceDisconnected(device *instantDevice) {
+	s.instant.mu.Lock()
+	defer s.instant.mu.Unlock()
+	device.connections--
+	device.lastSeen = time.Now()
+	mset(metricInstantDevicesConnected, s.instant.connected())
+}
+
+// instantMessageDelivered remembers the message as the last message delivered to the device
+func (s *Server) instantMessageDelivered(device *instantDevice, m *message) {
+	if m.Event != messageEvent {
+		return
+	}
+	s.instant.mu.Lock()
+	defer s.instant.mu.Unlock()
+	device.lastMessageID = m.ID
+	device.lastSeen = time.Now()
+}
+
+// pruneInstantDevices removes devices that are not connected and were not seen for a while
+func (s *Server) pruneInstantDevices() {
+	s.instant.mu.Lock()
+	defer s.instant.mu.Unlock()
+	for token, device := range s.instant.devices {
+		if device.connections == 0 && time.Since(device.lastSeen) > instantDeviceExpiry {
+			delete(s.instant.devices, token)
+		}
+	}
+	mset(metricInstantDevicesConnected, s.instant.connected())
+}
+
+// evictIfFull makes room for a new device of the given owner, by removing the least recently seen device that
+// is not connected and was not seen recently. It returns false if the owner has too many active devices.
+// Must be called with the lock held.
+func (r *instantRegistry) evictIfFull(owner string) bool {
+	var count int
+	var oldest *instantDevice
+	for _, device := range r.devices {
+		if device.owner != owner {
+			continue
+		}
+		count++
+		if device.connections == 0 && time.Since(device.lastSeen) > instantRecentlySeen && (oldest == nil || device.lastSeen.Before(oldest.lastSeen)) {
+			oldest = device
+		}
+	}
+	if count < instantDevicesPerOwnerMax {
+		return true
+	} else if oldest == nil {
+		return false
+	}
+	log.Tag(tagWebsocket).Field("instant_device", oldest.id).Debug("Evicting instant delivery device %s of %s", oldest.id, owner)
+	delete(r.devices, oldest.token)
+	return true
+}
+
+// connected returns the number of connected devices; must be called with the lock held
+func (r *instantRegistry) connected() int {
+	var connected int
+	for _, device := range r.devices {
+		if device.connections > 0 {
+			connected++
+		}
+	}
+	return connected
+}
+
+func newInstantDeviceResponse(device *instantDevice) *apiInstantDeviceResponse {
+	return &apiInstantDeviceResponse{
+		ID:      device.id,
+		Token:   device.token,
+		Expires: device.lastSeen.Add(instantDeviceExpiry).Unix(),
+	}
+}
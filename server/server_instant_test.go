@@ -0,0 +1,180 @@
+package server
+
+import (
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer_Instant_Hints(t *testing.T) {
+	c := newTestConfig(t)
+	c.BaseURL = "https://ntfy.example.com"
+	c.KeepaliveInterval = 45 * time.Second
+	s := newTestServer(t, c)
+
+	response := request(t, s, "GET", "/v1/instant", "", nil)
+	require.Equal(t, 200, response.Code)
+	hints, err := util.UnmarshalJSON[apiInstantResponse](io.NopCloser(response.Body))
+	require.Nil(t, err)
+	require.Equal(t, "wss://ntfy.example.com", hints.WebSocketURL)
+	require.Equal(t, int64(45), hints.KeepaliveInterval)
+	require.Equal(t, int64(60), hints.PongTimeout)
+	require.Equal(t, int64(5), hints.ReconnectDelayMin)
+	require.Equal(t, int64(300), hints.ReconnectDelayMax)
+	require.False(t, hints.Firebase)
+}
+
+func TestServer_Instant_RegisterDevice(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	response := request(t, s, "POST", "/v1/instant/devices", "", nil)
+	require.Equal(t, 200, response.Code)
+	device, err := util.UnmarshalJSON[apiInstantDeviceResponse](io.NopCloser(response.Body))
+	require.Nil(t, err)
+	require.Equal(t, 12, len(device.ID))
+	require.True(t, strings.HasPrefix(device.Token, "rt_"))
+	require.Greater(t, device.Expires, time.Now().Add(71*time.Hour).Unix())
+
+	// Refreshing with the same token returns the same device
+	response = request(t, s, "POST", "/v1/instant/devices", `{"token":"`+device.Token+`"}`, nil)
+	require.Equal(t, 200, response.Code)
+	refreshed, err := util.UnmarshalJSON[apiInstantDeviceResponse](io.NopCloser(response.Body))
+	require.Nil(t, err)
+	require.Equal(t, device.ID, refreshed.ID)
+	require.Equal(t, device.Token, refreshed.Token)
+
+	// Unknown tokens, or tokens of other owners, create a new device
+	response = request(t, s, "POST", "/v1/instant/devices", `{"token":"rt_doesnotexist"}`, nil)
+	other, err := util.UnmarshalJSON[apiInstantDeviceResponse](io.NopCloser(response.Body))
+	require.Nil(t, err)
+	require.NotEqual(t, device.ID, other.ID)
+	response = request(t, s, "POST", "/v1/instant/devices", `{"token":"`+device.Token+`"}`, nil, func(r *http.Request) {
+		r.RemoteAddr = "1.2.3.4:1234"
+	})
+	other, err = util.UnmarshalJSON[apiInstantDeviceResponse](io.NopCloser(response.Body))
+	require.Nil(t, err)
+	require.NotEqual(t, device.ID, other.ID)
+}
+
+func TestServer_Instant_RegisterDevice_Limit(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	for i := 0; i < instantDevicesPerOwnerMax; i++ {
+		response := request(t, s, "POST", "/v1/instant/devices", "", nil)
+		require.Equal(t, 200, response.Code)
+	}
+	response := request(t, s, "POST", "/v1/instant/devices", "", nil)
+	require.Equal(t, 429, response.Code)
+	require.Equal(t, 42914, toHTTPError(t, response.Body.String()).Code)
+
+	// Devices that were not seen in a while are evicted to make room
+	s.instant.mu.Lock()
+	for _, device := range s.instant.devices {
+		device.lastSeen = time.Now().Add(-time.Hour)
+		break
+	}
+	s.instant.mu.Unlock()
+	response = request(t, s, "POST", "/v1/instant/devices", "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, instantDevicesPerOwnerMax, len(s.instant.devices))
+}
+
+func TestServer_Instant_ResumeAfterReconnect(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	server := httptest.NewServer(http.HandlerFunc(s.handle))
+	defer server.Close()
+
+	// Register via the test server, so that the device owner (IP) matches the WebSocket connection
+	resp, err := http.Post(server.URL+"/v1/instant/devices", "application/json", nil)
+	require.Nil(t, err)
+	device, err := util.UnmarshalJSON[apiInstantDeviceResponse](resp.Body)
+	require.Nil(t, err)
+	wsURL := strings.Replace(server.URL, "http://", "ws://", 1) + "/mytopic/ws?reconnect=" + device.Token
+
+	// First connection receives messages as usual
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	require.Nil(t, err)
+	_, data, err := conn.ReadMessage()
+	require.Nil(t, err)
+	require.Equal(t, openEvent, toMessage(t, string(data)).Event)
+	request(t, s, "PUT", "/mytopic", "message 1", nil)
+	_, data, err = conn.ReadMessage()
+	require.Nil(t, err)
+	require.Equal(t, "message 1", toMessage(t, string(data)).Message)
+	require.Nil(t, conn.Close())
+	waitFor(t, func() bool {
+		s.instant.mu.Lock()
+		defer s.instant.mu.Unlock()
+		return s.instant.devices[device.Token].connections == 0
+	})
+
+	// Messages published while disconnected are delivered after reconnecting, but not the ones before
+	request(t, s, "PUT", "/mytopic", "message 2", nil)
+	request(t, s, "PUT", "/mytopic", "message 3", nil)
+	conn, _, err = websocket.DefaultDialer.Dial(wsURL, nil)
+	require.Nil(t, err)
+	defer conn.Close()
+	_, data, err = conn.ReadMessage()
+	require.Nil(t, err)
+	require.Equal(t, openEvent, toMessage(t, string(data)).Event)
+	_, data, err = conn.ReadMessage()
+	require.Nil(t, err)
+	require.Equal(t, "message 2", toMessage(t, string(data)).Message)
+	_, data, err = conn.ReadMessage()
+	require.Nil(t, err)
+	require.Equal(t, "message 3", toMessage(t, string(data)).Message)
+
+	s.instant.mu.Lock()
+	d := s.instant.devices[device.Token]
+	require.Equal(t, 1, d.connections)
+	require.Equal(t, 1, d.reconnects)
+	require.Equal(t, "mytopic", d.topics)
+	s.instant.mu.Unlock()
+}
+
+func TestServer_Instant_DevicesAdminOnly(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+
+	response := request(t, s, "POST", "/v1/instant/devices", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "GET", "/v1/instant/devices", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 401, response.Code)
+
+	response = request(t, s, "GET", "/v1/instant/devices", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+	devices, err := util.UnmarshalJSON[apiInstantDevicesResponse](io.NopCloser(response.Body))
+	require.Nil(t, err)
+	require.Equal(t, 1, devices.Total)
+	require.Equal(t, 0, devices.Connected)
+	require.True(t, strings.HasPrefix(devices.Devices[0].Owner, "user:u_"))
+	require.False(t, devices.Devices[0].Connected)
+}
+
+func TestServer_Instant_PruneDevices(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	request(t, s, "POST", "/v1/instant/devices", "", nil)
+	request(t, s, "POST", "/v1/instant/devices", "", nil)
+	s.instant.mu.Lock()
+	for _, device := range s.instant.devices {
+		device.lastSeen = time.Now().Add(-73 * time.Hour)
+		break
+	}
+	s.instant.mu.Unlock()
+	s.pruneInstantDevices()
+	require.Equal(t, 1, len(s.instant.devices))
+}
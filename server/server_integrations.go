@@ -0,0 +1,420 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/util"
+)
+
+// Webhook integrations turn the native webhook payloads of common services into well-formatted ntfy messages,
+// so that users do not have to write their own templates (see Message templating) or bridges:
+//
+//	POST /v1/integrations/github/<topic>        GitHub webhooks (push, pull_request, issues, release, workflow_run, ...)
+//	POST /v1/integrations/grafana/<topic>       Grafana alerting webhook contact point
+//	POST /v1/integrations/alertmanager/<topic>  Prometheus Alertmanager webhook receiver
+//
+// The request is converted (title, message, priority, tags, click URL) and then published like any other message,
+// i.e. rate limits and access control apply as usual. Services that sign their payloads (GitHub and Grafana) can use
+// the publish secret of a reserved topic (see server_signed_publish.go) as their webhook secret. A request with a
+// valid signature is accepted even if the topic denies anonymous access; an invalid signature is rejected.
+// Alertmanager does not sign its payloads, so it has to use regular credentials (e.g. an access token).
+//
+// Since signed requests bypass the access control list, they are protected against replays and tampering:
+//   - Every signature is only accepted once (see usePublishSignature). Grafana signatures must carry a timestamp
+//     (X-Grafana-Alerting-Timestamp) within signedPublishMaxSkew. GitHub only signs the body, so GitHub signatures
+//     and delivery IDs (X-GitHub-Delivery) are remembered for integrationGitHubReplayWindow instead.
+//   - Only the body is signed, so all other headers and query parameters (e.g. X-Email, X-Delay or X-Attach) are
+//     dropped from signed requests. The message is entirely derived from the payload.
+
+const (
+	integrationGitHub       = "github"
+	integrationGrafana      = "grafana"
+	integrationAlertmanager = "alertmanager"
+	integrationBodyLimit    = 1024 * 1024 // Webhook payloads (e.g. GitHub push events) can be much larger than a message
+	integrationListMax      = 5           // Max. number of commits or alerts listed in a message
+
+	integrationGitHubReplayWindow = 24 * time.Hour // GitHub signatures have no timestamp, see above
+)
+
+var (
+	integrationSeverityPriorities = map[string]int{
+		"critical":  5,
+		"emergency": 5,
+		"fatal":     5,
+		"page":      5,
+		"error":     4,
+		"high":      4,
+		"major":     4,
+		"warning":   3,
+		"warn":      3,
+		"medium":    3,
+		"info":      2,
+		"low":       2,
+		"none":      1,
+	}
+)
+
+// integrationMessage is the result of converting a webhook payload, see transformIntegration
+type integrationMessage struct {
+	Title    string
+	Message  string
+	Priority int
+	Tags     []string
+	Click    string
+}
+
+// gitHubPayload contains the fields of all supported GitHub webhook events,
+// see https://docs.github.com/en/webhooks/webhook-events-and-payloads
+type gitHubPayload struct {
+	Action     string `json:"action"`
+	Ref        string `json:"ref"`
+	Deleted    bool   `json:"deleted"`
+	Compare    string `json:"compare"`
+	Repository *struct {
+		FullName string `json:"full_name"`
+		HTMLURL  string `json:"html_url"`
+	} `json:"repository"`
+	Sender *struct {
+		Login string `json:"login"`
+	} `json:"sender"`
+	Pusher *struct {
+		Name string `json:"name"`
+	} `json:"pusher"`
+	Commits []*struct {
+		ID      string `json:"id"`
+		Message string `json:"message"`
+	} `json:"commits"`
+	PullRequest *gitHubIssue `json:"pull_request"`
+	Issue       *gitHubIssue `json:"issue"`
+	Release     *struct {
+		TagName string `json:"tag_name"`
+		Name    string `json:"name"`
+		HTMLURL string `json:"html_url"`
+	} `json:"release"`
+	WorkflowRun *struct {
+		Name       string `json:"name"`
+		HeadBranch string `json:"head_branch"`
+		Conclusion string `json:"conclusion"`
+		HTMLURL    string `json:"html_url"`
+	} `json:"workflow_run"`
+}
+
+// gitHubIssue is an issue or a pull request in a gitHubPayload
+type gitHubIssue struct {
+	Number  int    `json:"number"`
+	Title   string `json:"title"`
+	HTMLURL string `json:"html_url"`
+	Merged  bool   `json:"merged"`
+}
+
+// alertsPayload is the webhook payload of Alertmanager (https://prometheus.io/docs/alerting/latest/configuration/#webhook_config),
+// which Grafana extends with a few fields (https://grafana.com/docs/grafana/latest/alerting/configure-notifications/manage-contact-points/integrations/webhook-notifier/)
+type alertsPayload struct {
+	Status            string            `json:"status"`
+	Receiver          string            `json:"receiver"`
+	GroupLabels       map[string]string `json:"groupLabels"`
+	CommonLabels      map[string]string `json:"commonLabels"`
+	CommonAnnotations map[string]string `json:"commonAnnotations"`
+	ExternalURL       string            `json:"externalURL"`
+	Title             string            `json:"title"` // Grafana only
+	Alerts            []*struct {
+		Status       string            `json:"status"`
+		Labels       map[string]string `json:"labels"`
+		Annotations  map[string]string `json:"annotations"`
+		GeneratorURL string            `json:"generatorURL"`
+	} `json:"alerts"`
+}
+
+// transformIntegration reads the webhook payload of the service in the path (see apiIntegrationRegex), verifies
+// its signature (if any), and rewrites the request to a regular publish request to the topic in the path. Events
+// that are not worth a notification (e.g. workflow runs that have not completed yet) are acknowledged, but not
+// published.
+func (s *Server) transformIntegration(next handleFunc) handleFunc {
+	return func(w http.ResponseWriter, r *http.Request, v *visitor) error {
+		matches := apiIntegrationRegex.FindStringSubmatch(r.URL.Path)
+		if len(matches) != 3 {
+			return errHTTPInternalErrorInvalidPath
+		}
+		service, topic := matches[1], matches[2]
+		body, err := util.Peek(r.Body, integrationBodyLimit)
+		if err != nil {
+			return err
+		} else if body.LimitReached {
+			return errHTTPEntityTooLargeJSONBody
+		}
+		signed, err := s.verifyIntegrationSignature(r, service, topic, body.PeekedBytes)
+		if err != nil {
+			return err
+		}
+		lang := s.language(v, r)
+		var m *integrationMessage
+		switch service {
+		case integrationGitHub:
+			m, err = newGitHubMessage(r.Header.Get("X-GitHub-Event"), body.PeekedBytes, lang)
+		default:
+			m, err = newAlertsMessage(service, body.PeekedBytes, lang)
+		}
+		if err != nil {
+			logvr(v, r).Tag(tagPublish).Err(err).Debug("Invalid %s webhook payload", service)
+			return errHTTPBadRequestIntegrationInvalid
+		} else if m == nil {
+			logvr(v, r).Tag(tagPublish).Debug("Ignoring %s webhook event", service)
+			return s.writeJSON(w, newSuccessResponse())
+		}
+		logvr(v, r).Tag(tagPublish).Fields(log.Context{
+			"integration":        service,
+			"integration_signed": signed,
+		}).Debug("Publishing %s webhook event to topic %s", service, topic)
+		if signed {
+			r.Header = make(http.Header) // Only the body is signed, see above
+			r.URL.RawQuery = ""
+		}
+		r.URL.Path = "/" + topic
+		r.Body = io.NopCloser(strings.NewReader(m.Message))
+		r.Header.Set("X-Title", m.Title)
+		r.Header.Set("X-Tags", strings.Join(m.Tags, ","))
+		if m.Priority != 0 {
+			r.Header.Set("X-Priority", strconv.Itoa(m.Priority))
+		}
+		if m.Click != "" {
+			r.Header.Set("X-Click", m.Click)
+		}
+		if signed {
+			r = withContext(r, map[contextKey]any{
+				contextSignedPublish: true,
+			})
+		}
+		return next(w, r, v)
+	}
+}
+
+// verifyIntegrationSignature checks the signature of the webhook payload against the publish secret of the topic,
+// using the signature scheme of the service, and rejects replayed signatures. It returns false if the request is
+// not signed, or if the topic has no secret, in which case the request has to be authorized as usual.
+func (s *Server) verifyIntegrationSignature(r *http.Request, service, topic string, body []byte) (bool, error) {
+	var header string
+	switch service {
+	case integrationGitHub:
+		header = r.Header.Get("X-Hub-Signature-256") // sha256=<hex(HMAC-SHA256(secret, body))>
+	case integrationGrafana:
+		header = r.Header.Get("X-Grafana-Alerting-Signature") // <hex(HMAC-SHA256(secret, [timestamp:]body))>
+	}
+	if header == "" || s.userManager == nil {
+		return false, nil
+	}
+	secret, err := s.userManager.ReservationSecret(s.topicAliases.Resolve(topic)[0])
+	if err != nil {
+		return false, err
+	} else if secret == "" {
+		return false, nil
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	retention := integrationGitHubReplayWindow
+	if service == integrationGrafana {
+		timestampStr := r.Header.Get("X-Grafana-Alerting-Timestamp")
+		timestamp, err := strconv.ParseInt(timestampStr, 10, 64)
+		if err != nil {
+			return false, errHTTPForbiddenSignatureInvalid.Wrap("X-Grafana-Alerting-Timestamp must be a Unix timestamp")
+		} else if skew := time.Since(time.Unix(timestamp, 0)); skew > signedPublishMaxSkew || skew < -signedPublishMaxSkew {
+			return false, errHTTPForbiddenSignatureInvalid.Wrap("timestamp too far from server time")
+		}
+		mac.Write([]byte(timestampStr + ":"))
+		retention = 2 * signedPublishMaxSkew // Covers the entire timestamp window
+	}
+	mac.Write(body)
+	signature, err := hex.DecodeString(strings.TrimPrefix(header, "sha256="))
+	if err != nil || !hmac.Equal(mac.Sum(nil), signature) {
+		return false, errHTTPForbiddenSignatureInvalid
+	} else if !s.usePublishSignature(signature, retention) {
+		return false, errHTTPForbiddenSignatureInvalid.Wrap("signature was already used")
+	}
+	if delivery := r.Header.Get("X-GitHub-Delivery"); service == integrationGitHub && delivery != "" {
+		if !s.usePublishSignature([]byte(integrationGitHub+":"+delivery), retention) {
+			return false, errHTTPForbiddenSignatureInvalid.Wrap("delivery was already received")
+		}
+	}
+	return true, nil
+}
+
+// newGitHubMessage converts a GitHub webhook event of the given type (X-GitHub-Event header) into a message,
+// or returns nil if the event should not be published
+func newGitHubMessage(event string, body []byte, lang string) (*integrationMessage, error) {
+	var p gitHubPayload
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, err
+	} else if event == "" || p.Repository == nil {
+		return nil, fmt.Errorf("event type or repository missing")
+	}
+	var sender string
+	if p.Sender != nil {
+		sender = p.Sender.Login
+	}
+	m := &integrationMessage{
+		Title: p.Repository.FullName,
+		Tags:  []string{integrationGitHub},
+		Click: p.Repository.HTMLURL,
+	}
+	switch {
+	case event == "ping":
+		m.Message = locales.Text(lang, "integration_github_ping")
+		m.Tags = append(m.Tags, "white_check_mark")
+	case event == "push":
+		branch := strings.TrimPrefix(strings.TrimPrefix(p.Ref, "refs/heads/"), "refs/tags/")
+		if p.Pusher != nil {
+			sender = p.Pusher.Name
+		}
+		if p.Deleted {
+			m.Message = locales.Text(lang, "integration_github_push_deleted", sender, branch)
+			break
+		} else if len(p.Commits) == 0 {
+			return nil, nil // Tags and empty pushes are not interesting
+		}
+		lines := []string{locales.Text(lang, "integration_github_push", sender, locales.Plural(lang, "integration_github_commits", len(p.Commits)), branch)}
+		for i, commit := range p.Commits {
+			if i == integrationListMax {
+				lines = append(lines, locales.Text(lang, "integration_more", len(p.Commits)-i))
+				break
+			}
+			subject, _, _ := strings.Cut(commit.Message, "\n")
+			lines = append(lines, fmt.Sprintf("- %s: %s", shortCommitID(commit.ID), subject))
+		}
+		m.Message = strings.Join(lines, "\n")
+		m.Click = p.Compare
+	case event == "pull_request" && p.PullRequest != nil:
+		action := p.Action
+		if action == "closed" && p.PullRequest.Merged {
+			action = "merged"
+			m.Tags = append(m.Tags, "tada")
+		} else if action == "synchronize" || action == "labeled" || action == "unlabeled" || action == "assigned" || action == "unassigned" {
+			return nil, nil // Too noisy
+		}
+		m.Message = locales.Text(lang, "integration_github_pull_request", p.PullRequest.Number, action, sender) + "\n" + p.PullRequest.Title
+		m.Click = p.PullRequest.HTMLURL
+	case event == "issues" && p.Issue != nil:
+		m.Message = locales.Text(lang, "integration_github_issue", p.Issue.Number, p.Action, sender) + "\n" + p.Issue.Title
+		m.Click = p.Issue.HTMLURL
+	case event == "release" && p.Release != nil:
+		if p.Action != "published" && p.Action != "released" && p.Action != "prereleased" {
+			return nil, nil
+		}
+		name := p.Release.Name
+		if name == "" {
+			name = p.Release.TagName
+		}
+		m.Message = locales.Text(lang, "integration_github_release", name, p.Action, sender)
+		m.Tags = append(m.Tags, "tada")
+		m.Click = p.Release.HTMLURL
+	case event == "workflow_run" && p.WorkflowRun != nil:
+		if p.Action != "completed" {
+			return nil, nil // Requested and in progress runs are not interesting
+		}
+		run := p.WorkflowRun
+		m.Message = locales.Text(lang, "integration_github_workflow_run", run.Name, run.Conclusion, run.HeadBranch)
+		m.Click = run.HTMLURL
+		switch run.Conclusion {
+		case "success":
+			m.Tags = append(m.Tags, "white_check_mark")
+		case "failure", "timed_out", "startup_failure":
+			m.Tags = append(m.Tags, "x")
+			m.Priority = 4
+		}
+	default:
+		if p.Action != "" {
+			event = fmt.Sprintf("%s (%s)", event, p.Action)
+		}
+		m.Message = locales.Text(lang, "integration_github_event", event, sender)
+	}
+	return m, nil
+}
+
+// newAlertsMessage converts an Alertmanager or Grafana alert group into a message. The priority is derived from
+// the "severity" label of the firing alerts.
+func newAlertsMessage(service string, body []byte, lang string) (*integrationMessage, error) {
+	var p alertsPayload
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, err
+	} else if p.Status == "" || len(p.Alerts) == 0 {
+		return nil, fmt.Errorf("status or alerts missing")
+	}
+	m := &integrationMessage{
+		Title: p.Title,
+		Tags:  []string{service},
+		Click: p.ExternalURL,
+	}
+	if m.Title == "" {
+		name := p.CommonLabels["alertname"]
+		if name == "" {
+			name = p.GroupLabels["alertname"]
+		}
+		if name == "" {
+			name = p.Receiver
+		}
+		m.Title = strings.TrimSpace(fmt.Sprintf("[%s:%d] %s", strings.ToUpper(p.Status), len(p.Alerts), name))
+	}
+	if p.Status == "resolved" {
+		m.Tags = append(m.Tags, "white_check_mark")
+	} else {
+		m.Tags = append(m.Tags, "rotating_light")
+	}
+	lines := make([]string, 0)
+	for i, alert := range p.Alerts {
+		if i == 0 && alert.GeneratorURL != "" {
+			m.Click = alert.GeneratorURL
+		}
+		if alert.Status != "resolved" {
+			if priority, ok := integrationSeverityPriorities[strings.ToLower(alert.Labels["severity"])]; ok {
+				m.Priority = max(m.Priority, priority)
+			}
+		}
+		if i == integrationListMax {
+			lines = append(lines, locales.Text(lang, "integration_more", len(p.Alerts)-i))
+			continue
+		} else if i > integrationListMax {
+			continue
+		}
+		text := alertText(alert.Annotations, alert.Labels, p.CommonAnnotations)
+		if len(p.Alerts) == 1 {
+			lines = append(lines, text)
+		} else if alert.Status != p.Status {
+			lines = append(lines, fmt.Sprintf("- [%s] %s", strings.ToUpper(alert.Status), text))
+		} else {
+			lines = append(lines, "- "+text)
+		}
+	}
+	m.Message = strings.Join(lines, "\n")
+	return m, nil
+}
+
+// alertText returns the summary of an alert, falling back to the description and the alert name
+func alertText(annotations, labels, commonAnnotations map[string]string) string {
+	for _, text := range []string{annotations["summary"], annotations["description"], commonAnnotations["summary"], labels["alertname"]} {
+		if text != "" {
+			return text
+		}
+	}
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
+
+// shortCommitID returns the abbreviated commit ID, as displayed by GitHub
+func shortCommitID(id string) string {
+	if len(id) > 7 {
+		return id[:7]
+	}
+	return id
+}
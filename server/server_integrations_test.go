@@ -0,0 +1,237 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+const gitHubPushPayload = `{
+	"ref": "refs/heads/main",
+	"compare": "https://github.com/binwiederhier/ntfy/compare/abc...def",
+	"repository": {"full_name": "binwiederhier/ntfy", "html_url": "https://github.com/binwiederhier/ntfy"},
+	"pusher": {"name": "phil"},
+	"sender": {"login": "binwiederhier"},
+	"commits": [
+		{"id": "0123456789abcdef", "message": "Fix bug\n\nLong description"},
+		{"id": "fedcba9876543210", "message": "Add feature"}
+	]
+}`
+
+const alertmanagerPayload = `{
+	"version": "4",
+	"status": "firing",
+	"receiver": "ntfy",
+	"groupLabels": {"alertname": "HighCPU"},
+	"commonLabels": {"alertname": "HighCPU"},
+	"externalURL": "http://alertmanager:9093",
+	"alerts": [
+		{"status": "firing", "labels": {"alertname": "HighCPU", "severity": "warning"}, "annotations": {"summary": "CPU is at 91% on host1"}, "generatorURL": "http://prometheus:9090/graph?g0.expr=cpu"},
+		{"status": "firing", "labels": {"alertname": "HighCPU", "severity": "critical"}, "annotations": {"summary": "CPU is at 99% on host2"}},
+		{"status": "resolved", "labels": {"alertname": "HighCPU", "severity": "critical"}, "annotations": {"description": "CPU on host3"}}
+	]
+}`
+
+func TestServer_Integration_GitHub_Signed(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionDenyAll
+	s := newTestServer(t, c)
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.AddReservation("phil", "builds", user.PermissionDenyAll))
+	require.Nil(t, s.userManager.SetReservationSecret("phil", "builds", "webhook secret"))
+
+	// Unsigned anonymous requests and invalid signatures are rejected
+	headers := map[string]string{"X-GitHub-Event": "push"}
+	require.Equal(t, 403, request(t, s, "POST", "/v1/integrations/github/builds", gitHubPushPayload, headers).Code)
+	headers["X-Hub-Signature-256"] = "sha256=" + hmacHex("wrong secret", gitHubPushPayload)
+	rr := request(t, s, "POST", "/v1/integrations/github/builds", gitHubPushPayload, headers)
+	require.Equal(t, 403, rr.Code)
+	require.Equal(t, 40308, toHTTPError(t, rr.Body.String()).Code)
+
+	// Valid signature
+	headers["X-Hub-Signature-256"] = "sha256=" + hmacHex("webhook secret", gitHubPushPayload)
+	rr = request(t, s, "POST", "/v1/integrations/github/builds", gitHubPushPayload, headers)
+	require.Equal(t, 200, rr.Code)
+	m := toMessage(t, rr.Body.String())
+	require.Equal(t, "builds", m.Topic)
+	require.Equal(t, "binwiederhier/ntfy", m.Title)
+	require.Equal(t, "phil pushed 2 commits to main\n- 0123456: Fix bug\n- fedcba9: Add feature", m.Message)
+	require.Equal(t, "https://github.com/binwiederhier/ntfy/compare/abc...def", m.Click)
+	require.Equal(t, []string{"github"}, m.Tags)
+
+	// Message was cached
+	rr = request(t, s, "GET", "/builds/json?poll=1", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 1, len(toMessages(t, rr.Body.String())))
+}
+
+func TestServer_Integration_GitHub_Signed_Replay(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionDenyAll
+	s := newTestServer(t, c)
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.AddReservation("phil", "builds", user.PermissionDenyAll))
+	require.Nil(t, s.userManager.SetReservationSecret("phil", "builds", "webhook secret"))
+
+	// Unsigned headers and query parameters are ignored on signed requests
+	headers := map[string]string{
+		"X-GitHub-Event":      "push",
+		"X-GitHub-Delivery":   "72d3162e-cc78-11e3-81ab-4c9367dc0958",
+		"X-Hub-Signature-256": "sha256=" + hmacHex("webhook secret", gitHubPushPayload),
+		"X-Delay":             "1h",
+		"X-Tags":              "evil",
+	}
+	rr := request(t, s, "POST", "/v1/integrations/github/builds?email=phil@example.com", gitHubPushPayload, headers)
+	require.Equal(t, 200, rr.Code)
+	m := toMessage(t, rr.Body.String())
+	require.Equal(t, []string{"github"}, m.Tags)
+	require.LessOrEqual(t, m.Time, time.Now().Unix())
+
+	// Replaying the same request is rejected, even with a different delivery ID
+	rr = request(t, s, "POST", "/v1/integrations/github/builds", gitHubPushPayload, headers)
+	require.Equal(t, 403, rr.Code)
+	require.Equal(t, 40308, toHTTPError(t, rr.Body.String()).Code)
+	headers["X-GitHub-Delivery"] = "another-delivery"
+	rr = request(t, s, "POST", "/v1/integrations/github/builds", gitHubPushPayload, headers)
+	require.Equal(t, 403, rr.Code)
+
+	// A new payload with a reused delivery ID is rejected as well
+	payload := strings.Replace(gitHubPushPayload, "Fix bug", "Fix another bug", 1)
+	headers["X-GitHub-Delivery"] = "72d3162e-cc78-11e3-81ab-4c9367dc0958"
+	headers["X-Hub-Signature-256"] = "sha256=" + hmacHex("webhook secret", payload)
+	rr = request(t, s, "POST", "/v1/integrations/github/builds", payload, headers)
+	require.Equal(t, 403, rr.Code)
+
+	// Only one message was published
+	rr = request(t, s, "GET", "/builds/json?poll=1", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 1, len(toMessages(t, rr.Body.String())))
+}
+
+func TestServer_Integration_GitHub_Events(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	rr := request(t, s, "POST", "/v1/integrations/github/builds", `{"zen":"Keep it simple","repository":{"full_name":"a/b","html_url":"https://github.com/a/b"}}`, map[string]string{
+		"X-GitHub-Event": "ping",
+	})
+	require.Equal(t, 200, rr.Code)
+	m := toMessage(t, rr.Body.String())
+	require.Equal(t, "The webhook was set up successfully", m.Message)
+	require.Equal(t, "https://github.com/a/b", m.Click)
+
+	// Failed workflow runs are high priority, runs that are in progress are not published
+	workflowRun := `{"action":"%s","repository":{"full_name":"a/b"},"workflow_run":{"name":"CI","head_branch":"main","conclusion":"failure","html_url":"https://github.com/a/b/actions/runs/1"}}`
+	rr = request(t, s, "POST", "/v1/integrations/github/builds", fmt.Sprintf(workflowRun, "completed"), map[string]string{
+		"X-GitHub-Event": "workflow_run",
+	})
+	require.Equal(t, 200, rr.Code)
+	m = toMessage(t, rr.Body.String())
+	require.Equal(t, "Workflow CI: failure on main", m.Message)
+	require.Equal(t, 4, m.Priority)
+	require.Equal(t, []string{"github", "x"}, m.Tags)
+	rr = request(t, s, "POST", "/v1/integrations/github/builds", fmt.Sprintf(workflowRun, "in_progress"), map[string]string{
+		"X-GitHub-Event": "workflow_run",
+	})
+	require.Equal(t, 200, rr.Code)
+	require.Equal(t, `{"success":true}`+"\n", rr.Body.String())
+
+	// Merged pull requests
+	rr = request(t, s, "POST", "/v1/integrations/github/builds", `{"action":"closed","repository":{"full_name":"a/b"},"sender":{"login":"phil"},"pull_request":{"number":12,"title":"Fix bug","merged":true,"html_url":"https://github.com/a/b/pull/12"}}`, map[string]string{
+		"X-GitHub-Event": "pull_request",
+	})
+	require.Equal(t, 200, rr.Code)
+	m = toMessage(t, rr.Body.String())
+	require.Equal(t, "Pull request #12 merged by phil\nFix bug", m.Message)
+	require.Equal(t, "https://github.com/a/b/pull/12", m.Click)
+
+	// Invalid payloads
+	rr = request(t, s, "POST", "/v1/integrations/github/builds", `not json`, map[string]string{"X-GitHub-Event": "push"})
+	require.Equal(t, 400, rr.Code)
+	require.Equal(t, 40088, toHTTPError(t, rr.Body.String()).Code)
+	require.Equal(t, 400, request(t, s, "POST", "/v1/integrations/github/builds", `{"repository":{"full_name":"a/b"}}`, nil).Code)
+	require.Equal(t, 404, request(t, s, "POST", "/v1/integrations/gitlab/builds", gitHubPushPayload, nil).Code)
+}
+
+func TestServer_Integration_Alertmanager(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	rr := request(t, s, "POST", "/v1/integrations/alertmanager/alerts", alertmanagerPayload, nil)
+	require.Equal(t, 200, rr.Code)
+	m := toMessage(t, rr.Body.String())
+	require.Equal(t, "[FIRING:3] HighCPU", m.Title)
+	require.Equal(t, "- CPU is at 91% on host1\n- CPU is at 99% on host2\n- [RESOLVED] CPU on host3", m.Message)
+	require.Equal(t, 5, m.Priority)
+	require.Equal(t, []string{"alertmanager", "rotating_light"}, m.Tags)
+	require.Equal(t, "http://prometheus:9090/graph?g0.expr=cpu", m.Click)
+
+	rr = request(t, s, "POST", "/v1/integrations/alertmanager/alerts", `{"status":"resolved","receiver":"ntfy","alerts":[{"status":"resolved","labels":{"severity":"critical","instance":"host1"}}]}`, nil)
+	require.Equal(t, 200, rr.Code)
+	m = toMessage(t, rr.Body.String())
+	require.Equal(t, "[RESOLVED:1] ntfy", m.Title)
+	require.Equal(t, "instance=host1, severity=critical", m.Message)
+	require.Equal(t, 0, m.Priority) // Resolved alerts have the default priority
+	require.Equal(t, []string{"alertmanager", "white_check_mark"}, m.Tags)
+
+	require.Equal(t, 400, request(t, s, "POST", "/v1/integrations/alertmanager/alerts", `{"status":"firing","alerts":[]}`, nil).Code)
+}
+
+func TestServer_Integration_Grafana_Signed(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionDenyAll
+	s := newTestServer(t, c)
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.AddReservation("phil", "alerts", user.PermissionDenyAll))
+	require.Nil(t, s.userManager.SetReservationSecret("phil", "alerts", "webhook secret"))
+
+	payload := `{"status":"firing","title":"[FIRING:1] Disk full","alerts":[{"status":"firing","labels":{"alertname":"Disk full","severity":"error"},"annotations":{"summary":"Disk is 98% full"}}]}`
+	timestamp := fmt.Sprintf("%d", time.Now().Unix())
+	rr := request(t, s, "POST", "/v1/integrations/grafana/alerts", payload, map[string]string{
+		"X-Grafana-Alerting-Timestamp": timestamp,
+		"X-Grafana-Alerting-Signature": hmacHex("webhook secret", timestamp+":"+payload),
+	})
+	require.Equal(t, 200, rr.Code)
+	m := toMessage(t, rr.Body.String())
+	require.Equal(t, "[FIRING:1] Disk full", m.Title)
+	require.Equal(t, "Disk is 98% full", m.Message)
+	require.Equal(t, 4, m.Priority)
+	require.Equal(t, []string{"grafana", "rotating_light"}, m.Tags)
+
+	// Replayed request
+	rr = request(t, s, "POST", "/v1/integrations/grafana/alerts", payload, map[string]string{
+		"X-Grafana-Alerting-Timestamp": timestamp,
+		"X-Grafana-Alerting-Signature": hmacHex("webhook secret", timestamp+":"+payload),
+	})
+	require.Equal(t, 403, rr.Code)
+
+	// Missing timestamp
+	rr = request(t, s, "POST", "/v1/integrations/grafana/alerts", payload, map[string]string{
+		"X-Grafana-Alerting-Signature": hmacHex("webhook secret", payload),
+	})
+	require.Equal(t, 403, rr.Code)
+
+	// Old timestamp
+	timestamp = fmt.Sprintf("%d", time.Now().Add(-time.Hour).Unix())
+	rr = request(t, s, "POST", "/v1/integrations/grafana/alerts", payload, map[string]string{
+		"X-Grafana-Alerting-Timestamp": timestamp,
+		"X-Grafana-Alerting-Signature": hmacHex("webhook secret", timestamp+":"+payload),
+	})
+	require.Equal(t, 403, rr.Code)
+}
+
+func hmacHex(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
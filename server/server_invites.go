@@ -0,0 +1,132 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+// Invite-only signup lets semi-public instances grow without open registration. If signup-mode is "invite",
+// signing up (POST /v1/account) requires a valid invite code in the "invite" field:
+//
+//   - Admins create invites via POST /v1/admin/invites, optionally bound to a tier, limited to a number of uses,
+//     and/or expiring after a duration. The response contains the code, and a link to the signup page of the web app.
+//   - Admins list invites via GET /v1/admin/invites, and revoke them via DELETE /v1/admin/invites/<code>
+//   - Each signup counts as a use; users are assigned to the invite's tier
+//
+// Invites are stored in the user database (see user.Invite), and pruned after they expire, see pruneTokens.
+// Accounts created by admins do not need an invite.
+
+const (
+	signupModeOpen   = "open"
+	signupModeInvite = "invite"
+)
+
+// handleInvitesGet lists all invites that have not expired yet
+func (s *Server) handleInvitesGet(w http.ResponseWriter, _ *http.Request, _ *visitor) error {
+	invites, err := s.userManager.Invites()
+	if err != nil {
+		return err
+	}
+	response := &apiInvitesResponse{
+		Invites: make([]*apiInviteResponse, 0),
+	}
+	for _, invite := range invites {
+		response.Invites = append(response.Invites, s.newInviteResponse(invite))
+	}
+	return s.writeJSON(w, response)
+}
+
+// handleInviteAdd creates a new invite code
+func (s *Server) handleInviteAdd(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	req, err := readJSONWithLimit[apiInviteAddRequest](r.Body, jsonBodyBytesLimit, true)
+	if err != nil {
+		return err
+	} else if req.MaxUses < 0 {
+		return errHTTPBadRequest.Wrap("max_uses must not be negative")
+	}
+	expires := time.Unix(0, 0)
+	if req.Expires != "" {
+		duration, err := util.ParseDuration(req.Expires)
+		if err != nil || duration <= 0 {
+			return errHTTPBadRequest.Wrap("invalid expires duration %s", req.Expires)
+		}
+		expires = time.Now().Add(duration)
+	}
+	invite, err := s.userManager.AddInvite(req.Tier, req.MaxUses, expires)
+	if errors.Is(err, user.ErrTierNotFound) {
+		return errHTTPBadRequestTierInvalid
+	} else if err != nil {
+		return err
+	}
+	logvr(v, r).
+		Tag(tagManager).
+		Fields(log.Context{
+			"invite_tier":     invite.Tier,
+			"invite_max_uses": invite.MaxUses,
+		}).
+		Info("Added invite %s", invite.Code)
+	return s.writeJSON(w, s.newInviteResponse(invite))
+}
+
+// handleInviteDelete revokes the invite code in the path
+func (s *Server) handleInviteDelete(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	matches := apiAdminInviteSingleRegex.FindStringSubmatch(r.URL.Path)
+	if len(matches) != 2 {
+		return errHTTPInternalErrorInvalidPath
+	}
+	code := matches[1]
+	if err := s.userManager.RemoveInvite(code); errors.Is(err, user.ErrInviteNotFound) {
+		return errHTTPNotFoundInvite
+	} else if err != nil {
+		return err
+	}
+	logvr(v, r).Tag(tagManager).Info("Removed invite %s", code)
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+// addUser creates the user of a signup request. If invite is set, the signup is counted against the invite code of
+// the request, and the user is assigned to the invite's tier. The user is only created if the invite is valid.
+func (s *Server) addUser(v *visitor, r *http.Request, newAccount *apiAccountCreateRequest, invite bool) error {
+	var err error
+	if invite {
+		var usedInvite *user.Invite
+		usedInvite, err = s.userManager.AddUserWithInvite(newAccount.Username, newAccount.Password, user.RoleUser, newAccount.Invite)
+		if err == nil {
+			logvr(v, r).Tag(tagAccount).Field("user_name", newAccount.Username).Info("User %s signed up with invite %s", newAccount.Username, usedInvite.Code)
+		}
+	} else {
+		err = s.userManager.AddUser(newAccount.Username, newAccount.Password, user.RoleUser)
+	}
+	if errors.Is(err, user.ErrInviteNotFound) {
+		return errHTTPBadRequestInviteInvalid
+	} else if errors.Is(err, user.ErrInvalidArgument) {
+		return errHTTPBadRequestInvalidUsername
+	}
+	return err
+}
+
+func (s *Server) newInviteResponse(invite *user.Invite) *apiInviteResponse {
+	conf := s.config()
+	response := &apiInviteResponse{
+		Code:    invite.Code,
+		Tier:    invite.Tier,
+		MaxUses: invite.MaxUses,
+		Uses:    invite.Uses,
+		Created: invite.Created.Unix(),
+	}
+	if invite.Expires.Unix() > 0 {
+		response.Expires = invite.Expires.Unix()
+	}
+	if conf.BaseURL != "" && conf.WebRoot != "" {
+		response.Link = fmt.Sprintf("%s%s/signup?invite=%s", conf.BaseURL, strings.TrimSuffix(conf.WebRoot, "/"), url.QueryEscape(invite.Code))
+	}
+	return response
+}
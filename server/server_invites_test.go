@@ -0,0 +1,125 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+func TestServer_Invites(t *testing.T) {
+	conf := newTestConfigWithAuthFile(t)
+	conf.BaseURL = "https://ntfy.example.com"
+	conf.EnableSignup = true
+	conf.SignupMode = signupModeInvite
+	s := newTestServer(t, conf)
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	require.Nil(t, s.userManager.AddTier(&user.Tier{ID: "ti_123", Code: "pro", MessageLimit: 1234}))
+	admin := map[string]string{"Authorization": util.BasicAuth("phil", "phil")}
+
+	// Only admins can manage invites
+	require.Equal(t, 401, request(t, s, "POST", "/v1/admin/invites", "", nil).Code)
+
+	rr := request(t, s, "POST", "/v1/admin/invites", `{"tier":"does-not-exist"}`, admin)
+	require.Equal(t, 400, rr.Code)
+	require.Equal(t, 40030, toHTTPError(t, rr.Body.String()).Code)
+	rr = request(t, s, "POST", "/v1/admin/invites", `{"expires":"invalid"}`, admin)
+	require.Equal(t, 400, rr.Code)
+
+	rr = request(t, s, "POST", "/v1/admin/invites", `{"tier":"pro","max_uses":1,"expires":"7d"}`, admin)
+	require.Equal(t, 200, rr.Code)
+	invite, _ := util.UnmarshalJSON[apiInviteResponse](io.NopCloser(rr.Body))
+	require.Regexp(t, `^iv_`, invite.Code)
+	require.Equal(t, "https://ntfy.example.com/signup?invite="+invite.Code, invite.Link)
+	require.Equal(t, "pro", invite.Tier)
+	require.Equal(t, 1, invite.MaxUses)
+	require.True(t, invite.Expires > invite.Created)
+
+	// Signup requires a valid invite
+	rr = request(t, s, "POST", "/v1/account", `{"username":"ben", "password":"ben"}`, nil)
+	require.Equal(t, 400, rr.Code)
+	require.Equal(t, 40097, toHTTPError(t, rr.Body.String()).Code)
+	rr = request(t, s, "POST", "/v1/account", `{"username":"ben", "password":"ben", "invite":"iv_invalid"}`, nil)
+	require.Equal(t, 400, rr.Code)
+	require.Equal(t, 40097, toHTTPError(t, rr.Body.String()).Code)
+	_, err := s.userManager.User("ben")
+	require.Equal(t, user.ErrUserNotFound, err)
+
+	rr = request(t, s, "POST", "/v1/account", fmt.Sprintf(`{"username":"ben", "password":"ben", "invite":"%s"}`, invite.Code), nil)
+	require.Equal(t, 200, rr.Code)
+	ben, err := s.userManager.User("ben")
+	require.Nil(t, err)
+	require.Equal(t, "pro", ben.Tier.Code)
+
+	// Invite is used up
+	rr = request(t, s, "POST", "/v1/account", fmt.Sprintf(`{"username":"lisa", "password":"lisa", "invite":"%s"}`, invite.Code), nil)
+	require.Equal(t, 400, rr.Code)
+	require.Equal(t, 40097, toHTTPError(t, rr.Body.String()).Code)
+
+	// Admins can still create accounts without invite
+	rr = request(t, s, "POST", "/v1/account", `{"username":"lisa", "password":"lisa"}`, admin)
+	require.Equal(t, 200, rr.Code)
+
+	// List and delete
+	rr = request(t, s, "GET", "/v1/admin/invites", "", admin)
+	require.Equal(t, 200, rr.Code)
+	invites, _ := util.UnmarshalJSON[apiInvitesResponse](io.NopCloser(rr.Body))
+	require.Len(t, invites.Invites, 1)
+	require.Equal(t, 1, invites.Invites[0].Uses)
+
+	require.Equal(t, 200, request(t, s, "DELETE", "/v1/admin/invites/"+invite.Code, "", admin).Code)
+	rr = request(t, s, "DELETE", "/v1/admin/invites/"+invite.Code, "", admin)
+	require.Equal(t, 404, rr.Code)
+	require.Equal(t, 40412, toHTTPError(t, rr.Body.String()).Code)
+}
+
+func TestServer_Invites_InvalidDoesNotCountTowardsRateLimit(t *testing.T) {
+	conf := newTestConfigWithAuthFile(t)
+	conf.EnableSignup = true
+	conf.SignupMode = signupModeInvite
+	s := newTestServer(t, conf)
+	defer s.closeDatabases()
+	invite, err := s.userManager.AddInvite("", 0, time.Unix(0, 0))
+	require.Nil(t, err)
+
+	for i := 0; i < 5; i++ {
+		rr := request(t, s, "POST", "/v1/account", fmt.Sprintf(`{"username":"phil%d", "password":"phil", "invite":"iv_invalid"}`, i), nil)
+		require.Equal(t, 400, rr.Code)
+		require.Equal(t, 40097, toHTTPError(t, rr.Body.String()).Code)
+	}
+	rr := request(t, s, "POST", "/v1/account", fmt.Sprintf(`{"username":"phil", "password":"phil", "invite":"%s"}`, invite.Code), nil)
+	require.Equal(t, 200, rr.Code)
+}
+
+func TestServer_Invites_VerificationMailFailure(t *testing.T) {
+	conf := newTestConfigWithAuthFile(t)
+	conf.BaseURL = "https://ntfy.example.com"
+	conf.EnableSignup = true
+	conf.EnableSignupVerification = true
+	conf.SignupMode = signupModeInvite
+	s := newTestServer(t, conf)
+	defer s.closeDatabases()
+	setTestMailer(s, &testFailingMailer{})
+	invite, err := s.userManager.AddInvite("", 1, time.Unix(0, 0))
+	require.Nil(t, err)
+
+	// User is removed, and the invite can be used again
+	body := fmt.Sprintf(`{"username":"phil", "password":"phil", "email":"phil@example.com", "invite":"%s"}`, invite.Code)
+	rr := request(t, s, "POST", "/v1/account", body, nil)
+	require.Equal(t, 500, rr.Code)
+	require.Equal(t, 50006, toHTTPError(t, rr.Body.String()).Code)
+	_, err = s.userManager.User("phil")
+	require.Equal(t, user.ErrUserNotFound, err)
+	invites, err := s.userManager.Invites()
+	require.Nil(t, err)
+	require.Equal(t, 0, invites[0].Uses)
+
+	setTestMailer(s, &testMailer{})
+	rr = request(t, s, "POST", "/v1/account", body, nil)
+	require.Equal(t, 200, rr.Code)
+}
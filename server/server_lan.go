@@ -0,0 +1,36 @@
+package server
+
+import (
+	"strings"
+
+	"heckel.io/ntfy/v2/util"
+)
+
+// In mixed deployments, where some subscribers are on the same local network as the ntfy server (e.g. a home server
+// behind a router) and others connect via the public base-url, attachment downloads of local subscribers needlessly
+// go through the WAN (or a tunnel/reverse proxy). If "attachment-lan-base-url" is set, subscribers whose IP address is
+// in one of the "attachment-lan-networks" receive attachment URLs pointing to the local URL instead, e.g.
+// http://10.0.1.5:8080/file/abc.jpg instead of https://ntfy.example.com/file/abc.jpg.
+//
+// Only the URLs of attachments stored on this server are rewritten, and only in messages delivered to subscribers
+// (JSON, SSE, raw, WebSocket and polling). Messages sent to Firebase, Web Push or via email always use base-url.
+
+// lanSubscriber returns true if attachment URLs for the subscribing visitor should point to the LAN base URL
+func (s *Server) lanSubscriber(v *visitor) bool {
+	conf := s.config()
+	return conf.AttachmentLANBaseURL != "" && util.ContainsIP(conf.AttachmentLANNetworks, v.IP())
+}
+
+// withLANAttachmentURL returns a copy of the message in which the attachment URL points to the LAN base URL, or
+// the message itself if it has no attachment stored on this server
+func (s *Server) withLANAttachmentURL(m *message) *message {
+	conf := s.config()
+	if m.Attachment == nil || !strings.HasPrefix(m.Attachment.URL, conf.BaseURL+"/file/") {
+		return m
+	}
+	attachment := *m.Attachment
+	attachment.URL = conf.AttachmentLANBaseURL + strings.TrimPrefix(attachment.URL, conf.BaseURL)
+	lanMessage := *m
+	lanMessage.Attachment = &attachment
+	return &lanMessage
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestServer_AttachmentLANBaseURL(t *testing.T) {
+	c := newTestConfig(t)
+	c.AttachmentLANBaseURL = "http://10.0.1.5:8080"
+	c.AttachmentLANNetworks = []netip.Prefix{netip.MustParsePrefix("10.0.1.0/24")}
+	s := newTestServer(t, c)
+	fromLAN := func(r *http.Request) {
+		r.RemoteAddr = "10.0.1.17"
+	}
+
+	// Publish response and public subscribers use the public URL
+	response := request(t, s, "PUT", "/mytopic?f=file.txt", "some file", nil)
+	m := toMessage(t, response.Body.String())
+	require.Equal(t, "http://127.0.0.1:12345/file/"+m.ID+".txt", m.Attachment.URL)
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	require.Equal(t, "http://127.0.0.1:12345/file/"+m.ID+".txt", toMessage(t, response.Body.String()).Attachment.URL)
+
+	// LAN subscribers get the local URL, external attachments are not touched
+	response = request(t, s, "PUT", "/mytopic", "external", map[string]string{
+		"Attach": "https://example.com/file.jpg",
+	})
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil, fromLAN)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "http://10.0.1.5:8080/file/"+m.ID+".txt", messages[0].Attachment.URL)
+	require.Equal(t, "https://example.com/file.jpg", messages[1].Attachment.URL)
+
+	// Streaming LAN subscribers as well
+	rr := httptest.NewRecorder()
+	cancel := subscribe(t, s, "/mytopic/json", rr, fromLAN)
+	response = request(t, s, "PUT", "/mytopic?f=other.txt", "other file", nil)
+	m2 := toMessage(t, response.Body.String())
+	cancel()
+	messages = toMessages(t, rr.Body.String())
+	require.Equal(t, openEvent, messages[0].Event)
+	require.Equal(t, m2.ID, messages[len(messages)-1].ID)
+	require.Equal(t, "http://10.0.1.5:8080/file/"+m2.ID+".txt", messages[len(messages)-1].Attachment.URL)
+
+	// The cached message is unchanged
+	cached, err := s.messageCache.Message(m2.ID)
+	require.Nil(t, err)
+	require.Equal(t, "http://127.0.0.1:12345/file/"+m2.ID+".txt", cached.Attachment.URL)
+
+	// And the file can be downloaded from the LAN
+	response = request(t, s, "GET", "/file/"+m2.ID+".txt", "", nil, fromLAN)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "other file", response.Body.String())
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+	"net/http"
+	"net/netip"
+	"time"
+)
+
+// Topic management allows users with the "manage" permission (see user.PermissionManage) to moderate a topic:
+//
+//   - DELETE /mytopic/<message-id> deletes a message (and its attachment) from the message cache
+//   - POST /mytopic/mute with {"message":"<message-id>","duration":"1h"} mutes the sender of a message
+//   - DELETE /mytopic/mute lifts all mutes in the topic
+//   - DELETE /mytopic/messages prunes all messages (and attachments) in the topic
+//   - GET /mytopic/stats returns the number of messages, attachment size and subscribers of the topic, and the
+//     Firebase delivery outcomes of the last 24 hours (if Firebase is enabled, see firebaseDelivered)
+//
+// Senders are identified by their user ID, or by their IP address for anonymous publishers. Mutes are
+// kept in memory (see topic.mutes), i.e. a restart lifts all mutes.
+//
+// Owners of a reserved topic can manage it implicitly, and can delegate management to other users without
+// handing over ownership, see handleAccountReservationManagerAdd.
+
+const (
+	topicMuteDurationDefault = 24 * time.Hour
+	topicMuteDurationMax     = 30 * 24 * time.Hour
+)
+
+func (s *Server) handleTopicMessageDelete(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	t, messageID, err := s.topicAndMessageIDFromPath(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	m, err := s.messageCache.Message(messageID)
+	if errors.Is(err, errMessageNotFound) || (err == nil && m.Topic != t.ID) {
+		return errHTTPNotFoundMessage.With(t)
+	} else if err != nil {
+		return err
+	}
+	if err := s.messageCache.DeleteMessages(m.ID); err != nil {
+		return err
+	}
+	if m.Attachment != nil && s.fileCache != nil {
+		if err := s.fileCache.Remove(m.ID); err != nil {
+			logvrm(v, r, m).Tag(tagManager).Err(err).Warn("Error removing attachment of deleted message")
+		}
+	}
+	logvrm(v, r, m).Tag(tagManager).Info("Deleted message %s from topic %s", m.ID, t.ID)
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+func (s *Server) handleTopicMute(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	t, err := s.topicFromManagePath(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	req, err := readJSONWithLimit[apiTopicMuteRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	} else if req.Message == "" {
+		return errHTTPBadRequestMuteInvalid.With(t)
+	}
+	duration := topicMuteDurationDefault
+	if req.Duration != "" {
+		duration, err = util.ParseDuration(req.Duration)
+		if err != nil || duration <= 0 || duration > topicMuteDurationMax {
+			return errHTTPBadRequestMuteInvalid.With(t)
+		}
+	}
+	m, err := s.messageCache.Message(req.Message)
+	if errors.Is(err, errMessageNotFound) || (err == nil && m.Topic != t.ID) {
+		return errHTTPNotFoundMessage.With(t)
+	} else if err != nil {
+		return err
+	}
+	until := time.Now().Add(duration)
+	t.Mute(senderKey(m.User, m.Sender), until)
+	logvrm(v, r, m).
+		Tag(tagManager).
+		Fields(log.Context{
+			"mute_duration": duration.String(),
+			"mute_until":    until.Unix(),
+		}).
+		Info("Muted sender of message %s in topic %s", m.ID, t.ID)
+	return s.writeJSON(w, &apiTopicMuteResponse{
+		MutedUntil: until.Unix(),
+	})
+}
+
+func (s *Server) handleTopicUnmute(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	t, err := s.topicFromManagePath(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	t.Unmute()
+	logvr(v, r).Tag(tagManager).With(t).Info("Lifted all mutes in topic %s", t.ID)
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+func (s *Server) handleTopicMessagesDelete(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	t, err := s.topicFromManagePath(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	archiveEmail, err := s.archiveEmailFromRequest(r, v)
+	if err != nil {
+		return err
+	} else if archiveEmail != "" {
+		if err := s.sendArchiveEmail(r, v, archiveEmail, t.ID); err != nil {
+			return err
+		}
+	}
+	ids, err := s.messageCache.TopicMessageIDs(t.ID)
+	if err != nil {
+		return err
+	} else if len(ids) > 0 {
+		if err := s.deleteExpiredMessages(ids); err != nil {
+			return err
+		}
+	}
+	logvr(v, r).Tag(tagManager).With(t).Info("Pruned all messages in topic %s", t.ID)
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+func (s *Server) handleTopicStats(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	t, err := s.topicFromManagePath(r.URL.Path)
+	if err != nil {
+		return err
+	}
+	messages, attachmentsSize, err := s.messageCache.TopicStats(t.ID)
+	if err != nil {
+		return err
+	}
+	subscribers, lastAccess := t.Stats()
+	response := &apiTopicStatsResponse{
+		Topic:           t.ID,
+		Messages:        messages,
+		AttachmentsSize: attachmentsSize,
+		Subscribers:     subscribers,
+		LastAccess:      lastAccess.Unix(),
+	}
+	if s.firebaseClient != nil {
+		stats, err := s.messageCache.FirebaseDeliveryStats(t.ID, time.Now().Add(-firebaseDeliveryRetention))
+		if err != nil {
+			return err
+		}
+		response.Firebase = &apiTopicStatsFirebaseResponse{
+			Delivered:     stats.Counts[firebaseOutcomeDelivered],
+			Throttled:     stats.Counts[firebaseOutcomeThrottled],
+			Invalid:       stats.Counts[firebaseOutcomeInvalid],
+			Failed:        stats.Counts[firebaseOutcomeFailed],
+			LastError:     stats.LastError,
+			LastErrorTime: stats.LastErrorTime,
+		}
+	}
+	return s.writeJSON(w, response)
+}
+
+// topicFromManagePath returns the single topic from a path like /mytopic/stats
+func (s *Server) topicFromManagePath(path string) (*topic, error) {
+	topics, _, err := s.topicsFromPath(path)
+	if err != nil {
+		return nil, err
+	} else if len(topics) != 1 {
+		return nil, errHTTPBadRequestTopicInvalid
+	}
+	return topics[0], nil
+}
+
+// topicAndMessageIDFromPath returns the topic and the message ID from a path like /mytopic/<message-id>
+func (s *Server) topicAndMessageIDFromPath(path string) (*topic, string, error) {
+	matches := topicMessagePathRegex.FindStringSubmatch(path)
+	if len(matches) != 2 {
+		return nil, "", errHTTPInternalErrorInvalidPath
+	}
+	t, err := s.topicFromManagePath(path)
+	if err != nil {
+		return nil, "", err
+	}
+	return t, matches[1], nil
+}
+
+// topicPermitted returns true if the visitor has the given permission on the topic, or if
+// access control is disabled. Unlike autorizeTopic, it does not check for suspended accounts.
+func (s *Server) topicPermitted(v *visitor, topic string, perm user.Permission) bool {
+	return s.userManager == nil || s.userManager.Authorize(v.User(), topic, perm) == nil
+}
+
+// senderKey identifies a publisher for the purpose of muting, either by user ID or by IP address
+func senderKey(userID string, ip netip.Addr) string {
+	if userID != "" {
+		return fmt.Sprintf("user:%s", userID)
+	}
+	return fmt.Sprintf("ip:%s", ip.String())
+}
@@ -3,7 +3,9 @@ package server
 import (
 	"heckel.io/ntfy/v2/log"
 	"heckel.io/ntfy/v2/util"
+	"net/netip"
 	"strings"
+	"time"
 )
 
 func (s *Server) execManager() {
@@ -12,11 +14,28 @@ func (s *Server) execManager() {
 
 	// Prune all the things
 	s.pruneVisitors()
+	s.pruneBans()
+	s.pruneAuthLockouts()
 	s.pruneTokens()
+	s.expireTierGrants()
 	s.pruneAttachments()
+	s.pruneUploads()
+	s.pruneDedups()
+	s.prunePublishSignatures()
+	s.pruneInstantDevices()
+	s.pruneTTSCache()
 	s.pruneMessages()
 	s.pruneAndNotifyWebPushSubscriptions()
 
+	// Send summaries for messages held back during quiet hours
+	s.sendQuietHoursSummaries()
+
+	// Publish hourly summaries of messages suppressed by sampling rules
+	s.sendSamplingSummaries()
+
+	// Check upstream servers, so that failed servers are used again once they recover
+	s.checkUpstreamHealth()
+
 	// Message count per topic
 	var messagesCached int
 	messageCounts, err := s.messageCache.MessageCounts()
@@ -33,24 +52,21 @@ func (s *Server) execManager() {
 	log.
 		Tag(tagManager).
 		Timing(func() {
-			s.mu.Lock()
-			defer s.mu.Unlock()
-			for _, t := range s.topics {
+			emptyTopics = s.topics.DeleteFunc(func(_ string, t *topic) bool {
 				subs, lastAccess := t.Stats()
 				ev := log.Tag(tagManager).With(t)
 				if t.Stale() {
 					if ev.IsTrace() {
 						ev.Trace("- topic %s: Deleting stale topic (%d subscribers, accessed %s)", t.ID, subs, util.FormatTime(lastAccess))
 					}
-					emptyTopics++
-					delete(s.topics, t.ID)
-				} else {
-					if ev.IsTrace() {
-						ev.Trace("- topic %s: %d subscribers, accessed %s", t.ID, subs, util.FormatTime(lastAccess))
-					}
-					subscribers += subs
+					return true
 				}
-			}
+				if ev.IsTrace() {
+					ev.Trace("- topic %s: %d subscribers, accessed %s", t.ID, subs, util.FormatTime(lastAccess))
+				}
+				subscribers += subs
+				return false
+			})
 		}).
 		Debug("Removed %d empty topic(s)", emptyTopics)
 
@@ -60,8 +76,8 @@ func (s *Server) execManager() {
 		receivedMailTotal, receivedMailSuccess, receivedMailFailure = s.smtpServerBackend.Counts()
 	}
 	var sentMailTotal, sentMailSuccess, sentMailFailure int64
-	if s.smtpSender != nil {
-		sentMailTotal, sentMailSuccess, sentMailFailure = s.smtpSender.Counts()
+	if sender := s.mailer(); sender != nil {
+		sentMailTotal, sentMailSuccess, sentMailFailure = sender.Counts()
 	}
 
 	// Users
@@ -75,8 +91,9 @@ func (s *Server) execManager() {
 
 	// Print stats
 	s.mu.RLock()
-	messagesCount, topicsCount, visitorsCount := s.messages, len(s.topics), len(s.visitors)
+	messagesCount := s.messages
 	s.mu.RUnlock()
+	topicsCount, visitorsCount := s.topics.Len(), s.visitors.Len()
 
 	// Update stats
 	s.updateAndWriteStats(messagesCount)
@@ -111,15 +128,13 @@ func (s *Server) pruneVisitors() {
 	log.
 		Tag(tagManager).
 		Timing(func() {
-			s.mu.Lock()
-			defer s.mu.Unlock()
-			for ip, v := range s.visitors {
+			staleVisitors = s.visitors.DeleteFunc(func(_ string, v *visitor) bool {
 				if v.Stale() {
 					log.Tag(tagManager).With(v).Trace("Deleting stale visitor")
-					delete(s.visitors, ip)
-					staleVisitors++
+					return true
 				}
-			}
+				return false
+			})
 		}).
 		Field("stale_visitors", staleVisitors).
 		Debug("Deleted %d stale visitor(s)", staleVisitors)
@@ -136,11 +151,71 @@ func (s *Server) pruneTokens() {
 				if err := s.userManager.RemoveDeletedUsers(); err != nil {
 					log.Tag(tagManager).Err(err).Warn("Error deleting soft-deleted users")
 				}
+				if err := s.userManager.RemoveUnverifiedUsers(); err != nil {
+					log.Tag(tagManager).Err(err).Warn("Error deleting users with expired email verification")
+				}
+				if err := s.userManager.RemoveExpiredWebhookEvents(); err != nil {
+					log.Tag(tagManager).Err(err).Warn("Error deleting expired webhook events")
+				}
+				if err := s.userManager.RemoveExpiredSigningKeys(); err != nil {
+					log.Tag(tagManager).Err(err).Warn("Error deleting expired signing keys")
+				}
+				if err := s.userManager.RemoveExpiredInvites(); err != nil {
+					log.Tag(tagManager).Err(err).Warn("Error deleting expired invites")
+				}
+				if err := s.userManager.RemoveExpiredUsage(); err != nil {
+					log.Tag(tagManager).Err(err).Warn("Error deleting expired usage stats")
+				}
+				if err := s.userManager.ReinstateExpiredSuspensions(); err != nil {
+					log.Tag(tagManager).Err(err).Warn("Error reinstating users with expired suspensions")
+				}
 			}).
-			Debug("Removed expired tokens and users")
+			Debug("Removed expired tokens, users and webhook events, and reinstated users with expired suspensions")
+	}
+}
+
+// expireTierGrants removes the tier from users whose granted tier has expired (see handleUsersTierGrant), and
+// removes reservations that exceed the default limit
+func (s *Server) expireTierGrants() {
+	if s.userManager == nil {
+		return
+	}
+	usernames, err := s.userManager.UsersWithExpiredTier()
+	if err != nil {
+		log.Tag(tagManager).Err(err).Warn("Error retrieving users with expired tier")
+		return
+	}
+	for _, username := range usernames {
+		if err := s.expireTierGrant(username); err != nil {
+			log.Tag(tagManager).Field("user_name", username).Err(err).Warn("Error removing expired tier of user %s", username)
+		}
 	}
 }
 
+func (s *Server) expireTierGrant(username string) error {
+	u, err := s.userManager.User(username)
+	if err != nil {
+		return err
+	}
+	topics, err := s.removeMessagesAndExcessReservations(u, visitorDefaultReservationsLimit)
+	if err != nil {
+		return err
+	}
+	log.
+		Tag(tagManager).
+		Fields(log.Context{
+			"user_name":            u.Name,
+			"tier_code":            u.Tier.Code,
+			"removed_reservations": len(topics),
+		}).
+		Info("Granted tier %s of user %s expired, removing tier", u.Tier.Code, u.Name)
+	if err := s.userManager.ResetTier(u.Name); err != nil {
+		return err
+	}
+	s.publishSyncEventAsync(s.visitor(netip.IPv4Unspecified(), u))
+	return nil
+}
+
 func (s *Server) pruneAttachments() {
 	if s.fileCache == nil {
 		return
@@ -159,8 +234,9 @@ func (s *Server) pruneAttachments() {
 					log.Tag(tagManager).Err(err).Warn("Error deleting attachments")
 				}
 				if err := s.messageCache.MarkAttachmentsDeleted(ids...); err != nil {
-					log.Tag(tagManager).Err(err).Warn("Error marking attachments deleted")
+					log.Tag(tagManager).Err(err).Warn("Error deleting expired messages")
 				}
+				s.messagesPruned(0, len(ids))
 			} else {
 				log.Tag(tagManager).Debug("No expired attachments to delete")
 			}
@@ -176,17 +252,51 @@ func (s *Server) pruneMessages() {
 			if err != nil {
 				log.Tag(tagManager).Err(err).Warn("Error retrieving expired messages")
 			} else if len(expiredMessageIDs) > 0 {
-				if s.fileCache != nil {
-					if err := s.fileCache.Remove(expiredMessageIDs...); err != nil {
-						log.Tag(tagManager).Err(err).Warn("Error deleting attachments for expired messages")
-					}
-				}
-				if err := s.messageCache.DeleteMessages(expiredMessageIDs...); err != nil {
-					log.Tag(tagManager).Err(err).Warn("Error marking attachments deleted")
+				if err := s.deleteExpiredMessages(expiredMessageIDs); err != nil {
+					log.Tag(tagManager).Err(err).Warn("Error deleting expired messages")
 				}
 			} else {
 				log.Tag(tagManager).Debug("No expired messages to delete")
 			}
+			if err := s.messageCache.PruneExpirations(time.Now().Add(-s.config().CacheDuration)); err != nil {
+				log.Tag(tagManager).Err(err).Warn("Error pruning expirations")
+			}
+			if err := s.messageCache.PruneFirebaseDeliveries(time.Now().Add(-firebaseDeliveryRetention)); err != nil {
+				log.Tag(tagManager).Err(err).Warn("Error pruning Firebase delivery outcomes")
+			}
 		}).
 		Debug("Pruned messages")
 }
+
+// deleteExpiredMessages deletes the given messages and their attachments, and tells subscribers that they expired
+func (s *Server) deleteExpiredMessages(ids []string) error {
+	if s.fileCache != nil {
+		if err := s.fileCache.Remove(ids...); err != nil {
+			log.Tag(tagManager).Err(err).Warn("Error deleting attachments for expired messages")
+		}
+	}
+	expired, err := s.messageCache.DeleteExpiredMessages(ids...)
+	if err != nil {
+		return err
+	}
+	s.messagesPruned(len(ids), 0)
+	s.publishExpired(expired)
+	return nil
+}
+
+// publishExpired sends an "expired" event with the IDs of the expired messages to the active subscribers of each
+// topic, so that long-lived clients (e.g. dashboards) can remove them. Clients that are not connected right now
+// receive the event when they reconnect with a since marker, see sendOldMessages.
+func (s *Server) publishExpired(expired map[string][]string) {
+	v := newVisitor(s.config(), s.messageCache, s.userManager, netip.IPv4Unspecified(), nil) // Background process, not a real visitor, uses IP 0.0.0.0
+	for topic, ids := range expired {
+		t, ok := s.topics.Get(topic)
+		if !ok {
+			continue // No subscribers
+		}
+		m := newExpiredMessage(topic, ids)
+		if err := t.Publish(v, m); err != nil {
+			logvm(v, m).Tag(tagManager).Err(err).Warn("Unable to publish expired event")
+		}
+	}
+}
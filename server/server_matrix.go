@@ -7,6 +7,7 @@ import (
 	"heckel.io/ntfy/v2/util"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -45,11 +46,19 @@ import (
 // matrixRequest represents a Matrix message, as it is sent to a Push Gateway (as per
 // this spec: https://spec.matrix.org/v1.2/push-gateway-api/).
 //
-// From the message, we only require the "pushkey", as it represents our target topic URL.
+// From the message, we only require the "pushkey", as it represents our target topic URL. All other
+// fields are optional, and are used to derive the title, message and priority of the ntfy message.
 // A message may look like this (excerpt):
 //
 //	{
 //	  "notification": {
+//	    "event_id": "$3957tyerfgewrf384",
+//	    "room_name": "Mission Control",
+//	    "sender_display_name": "Major Tom",
+//	    "type": "m.room.message",
+//	    "content": { "msgtype": "m.text", "body": "I'm floating in a most peculiar way." },
+//	    "counts": { "unread": 2, "missed_calls": 1 },
+//	    "prio": "high",
 //	    "devices": [
 //	       {
 //	          "pushkey": "https://ntfy.sh/upDAHJKFFDFD?up=1",
@@ -59,11 +68,30 @@ import (
 //	  }
 //	}
 type matrixRequest struct {
-	Notification *struct {
-		Devices []*struct {
-			PushKey string `json:"pushkey"`
-		} `json:"devices"`
-	} `json:"notification"`
+	Notification *matrixNotification `json:"notification"`
+}
+
+// matrixNotification is the "notification" object of a matrixRequest
+type matrixNotification struct {
+	EventID           string `json:"event_id"`
+	RoomID            string `json:"room_id"`
+	Type              string `json:"type"`
+	Sender            string `json:"sender"`
+	SenderDisplayName string `json:"sender_display_name"`
+	RoomName          string `json:"room_name"`
+	Prio              string `json:"prio"`
+	Content           *struct {
+		MsgType    string `json:"msgtype"`
+		Body       string `json:"body"`
+		Membership string `json:"membership"`
+	} `json:"content"`
+	Counts *struct {
+		Unread      int `json:"unread"`
+		MissedCalls int `json:"missed_calls"`
+	} `json:"counts"`
+	Devices []*struct {
+		PushKey string `json:"pushkey"`
+	} `json:"devices"`
 }
 
 // matrixResponse represents the response to a Matrix push gateway message, as defined
@@ -80,6 +108,12 @@ const (
 	matrixRejectPushKeyForUnifiedPushTopicWithoutRateVisitorAfter = 12 * time.Hour
 )
 
+var (
+	// matrixMetadataFields are the fields of a Matrix notification that are passed on in metadata-only mode,
+	// see Config.MatrixPushMetadataOnly. This is the same as Matrix's own "event_id_only" push format.
+	matrixMetadataFields = []string{"event_id", "room_id", "counts", "prio", "devices"}
+)
+
 // errMatrixPushkeyRejected represents an error when handing Matrix gateway messages
 //
 // If the push key is set, the app server will remove it and will never send messages using the same
@@ -99,13 +133,19 @@ func (e errMatrixPushkeyRejected) Error() string {
 // It basically converts a Matrix push gatewqy request:
 //
 //	POST /_matrix/push/v1/notify HTTP/1.1
-//	{ "notification": { "devices": [ { "pushkey": "https://ntfy.sh/upDAHJKFFDFD?up=1", ... } ] } }
+//	{ "notification": { "room_name": "Mission Control", "prio": "high", "devices": [ { "pushkey": "https://ntfy.sh/upDAHJKFFDFD?up=1", ... } ] } }
 //
 // to a ntfy request, looking like this:
 //
 //	POST /upDAHJKFFDFD?up=1 HTTP/1.1
-//	{ "notification": { "devices": [ { "pushkey": "https://ntfy.sh/upDAHJKFFDFD?up=1", ... } ] } }
-func newRequestFromMatrixJSON(r *http.Request, baseURL string, messageLimit int) (*http.Request, error) {
+//	Title: Mission Control
+//	Priority: 4
+//	{ "notification": { "room_name": "Mission Control", "prio": "high", "devices": [ { "pushkey": "https://ntfy.sh/upDAHJKFFDFD?up=1", ... } ] } }
+//
+// For UnifiedPush topics (?up=1), the body is passed on as is, since the Matrix client on the device needs it. For
+// all other topics, the body is replaced by a human-readable message. If metadataOnly is set, the message content,
+// sender and room name are not passed on (neither in the title, nor in the body), see matrixMetadataFields.
+func newRequestFromMatrixJSON(r *http.Request, baseURL string, messageLimit int, metadataOnly bool, lang string) (*http.Request, error) {
 	if baseURL == "" {
 		return nil, errHTTPInternalErrorMissingBaseURL
 	}
@@ -127,10 +167,26 @@ func newRequestFromMatrixJSON(r *http.Request, baseURL string, messageLimit int)
 	if !strings.HasPrefix(pushKey, baseURL+"/") {
 		return nil, &errMatrixPushkeyRejected{rejectedPushKey: pushKey, configuredBaseURL: baseURL}
 	}
-	newRequest, err := http.NewRequest(http.MethodPost, pushKey, io.NopCloser(bytes.NewReader(body.PeekedBytes)))
+	newRequest, err := http.NewRequest(http.MethodPost, pushKey, nil)
 	if err != nil {
 		return nil, err
 	}
+	newBody := body.PeekedBytes
+	if !readBoolParam(newRequest, false, "x-unifiedpush", "unifiedpush", "up") {
+		newBody = []byte(m.Notification.message(lang, metadataOnly))
+	} else if metadataOnly {
+		newBody, err = matrixMetadataOnlyJSON(body.PeekedBytes)
+		if err != nil {
+			return nil, errHTTPBadRequestMatrixMessageInvalid
+		}
+	}
+	newRequest.Body = io.NopCloser(bytes.NewReader(newBody))
+	if title := m.Notification.title(metadataOnly); title != "" {
+		newRequest.Header.Set("X-Title", title)
+	}
+	if priority := m.Notification.priority(); priority != 0 {
+		newRequest.Header.Set("X-Priority", strconv.Itoa(priority))
+	}
 	newRequest.RemoteAddr = r.RemoteAddr // Not strictly necessary, since visitor was already extracted
 	if r.Header.Get("X-Forwarded-For") != "" {
 		newRequest.Header.Set("X-Forwarded-For", r.Header.Get("X-Forwarded-For"))
@@ -141,6 +197,94 @@ func newRequestFromMatrixJSON(r *http.Request, baseURL string, messageLimit int)
 	return newRequest, nil
 }
 
+// title returns the title of the ntfy message, i.e. the room name or the sender, or an empty string if
+// the notification does not refer to an event (e.g. badge updates), or if metadataOnly is set
+func (n *matrixNotification) title(metadataOnly bool) string {
+	if metadataOnly {
+		return ""
+	} else if n.RoomName != "" {
+		return n.RoomName
+	} else if n.SenderDisplayName != "" {
+		return n.SenderDisplayName
+	}
+	return n.Sender
+}
+
+// message returns a human-readable message for the notification in the given language, used for topics that
+// are not UnifiedPush topics
+func (n *matrixNotification) message(lang string, metadataOnly bool) string {
+	if !metadataOnly && n.EventID != "" {
+		sender := n.SenderDisplayName
+		if sender == "" {
+			sender = n.Sender
+		}
+		switch n.Type {
+		case "m.room.message":
+			if n.Content != nil && n.Content.Body != "" {
+				if n.RoomName != "" && sender != "" {
+					return fmt.Sprintf("%s: %s", sender, n.Content.Body)
+				}
+				return n.Content.Body
+			}
+		case "m.room.encrypted":
+			return locales.Text(lang, "matrix_message_encrypted")
+		case "m.room.member":
+			if n.Content != nil && n.Content.Membership == "invite" {
+				return locales.Text(lang, "matrix_message_invite")
+			}
+		case "m.call.invite":
+			return locales.Text(lang, "matrix_message_call")
+		}
+	}
+	if n.Counts != nil && (n.Counts.Unread > 0 || n.Counts.MissedCalls > 0) {
+		counts := make([]string, 0)
+		if n.Counts.Unread > 0 {
+			counts = append(counts, locales.Plural(lang, "matrix_unread_messages", n.Counts.Unread))
+		}
+		if n.Counts.MissedCalls > 0 {
+			counts = append(counts, locales.Plural(lang, "matrix_missed_calls", n.Counts.MissedCalls))
+		}
+		if len(counts) == 2 {
+			return locales.Text(lang, "matrix_counts_both", counts[0], counts[1])
+		}
+		return locales.Text(lang, "matrix_counts", counts[0])
+	}
+	return locales.Text(lang, "matrix_notification")
+}
+
+// priority returns the ntfy priority for the notification, or 0 for the default priority. Incoming calls
+// with high priority are treated as urgent.
+func (n *matrixNotification) priority() int {
+	switch n.Prio {
+	case "high":
+		if n.Type == "m.call.invite" {
+			return 5
+		}
+		return 4
+	case "low":
+		return 2
+	}
+	return 0
+}
+
+// matrixMetadataOnlyJSON removes all fields but matrixMetadataFields from the "notification" object of the
+// given Matrix JSON message
+func matrixMetadataOnlyJSON(body []byte) ([]byte, error) {
+	var request struct {
+		Notification map[string]json.RawMessage `json:"notification"`
+	}
+	if err := json.Unmarshal(body, &request); err != nil {
+		return nil, err
+	}
+	notification := make(map[string]json.RawMessage)
+	for _, field := range matrixMetadataFields {
+		if value, ok := request.Notification[field]; ok {
+			notification[field] = value
+		}
+	}
+	return json.Marshal(map[string]any{"notification": notification})
+}
+
 // writeMatrixDiscoveryResponse writes the UnifiedPush Matrix Gateway Discovery response to the given http.ResponseWriter,
 // as per the spec (https://unifiedpush.org/developers/gateway/).
 func writeMatrixDiscoveryResponse(w http.ResponseWriter) error {
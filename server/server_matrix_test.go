@@ -14,19 +14,66 @@ func TestMatrix_NewRequestFromMatrixJSON_Success(t *testing.T) {
 	maxLength := 4096
 	body := `{"notification":{"content":{"body":"I'm floating in a most peculiar way.","msgtype":"m.text"},"counts":{"missed_calls":1,"unread":2},"devices":[{"app_id":"org.matrix.matrixConsole.ios","data":{},"pushkey":"https://ntfy.sh/upABCDEFGHI?up=1","pushkey_ts":12345678,"tweaks":{"sound":"bing"}}],"event_id":"$3957tyerfgewrf384","prio":"high","room_alias":"#exampleroom:matrix.org","room_id":"!slw48wfj34rtnrf:example.com","room_name":"Mission Control","sender":"@exampleuser:matrix.org","sender_display_name":"Major Tom","type":"m.room.message"}}`
 	r, _ := http.NewRequest("POST", "http://ntfy.example.com/_matrix/push/v1/notify", strings.NewReader(body))
-	newRequest, err := newRequestFromMatrixJSON(r, baseURL, maxLength)
+	newRequest, err := newRequestFromMatrixJSON(r, baseURL, maxLength, false, DefaultLanguage)
 	require.Nil(t, err)
 	require.Equal(t, "POST", newRequest.Method)
 	require.Equal(t, "https://ntfy.sh/upABCDEFGHI?up=1", newRequest.URL.String())
 	require.Equal(t, body, readAll(t, newRequest.Body))
 }
 
+func TestMatrix_NewRequestFromMatrixJSON_TitleAndPriority(t *testing.T) {
+	baseURL := "https://ntfy.sh"
+	maxLength := 4096
+	body := `{"notification":{"content":{"body":"I'm floating in a most peculiar way.","msgtype":"m.text"},"counts":{"missed_calls":1,"unread":2},"devices":[{"app_id":"org.matrix.matrixConsole.ios","data":{},"pushkey":"https://ntfy.sh/upABCDEFGHI?up=1","pushkey_ts":12345678,"tweaks":{"sound":"bing"}}],"event_id":"$3957tyerfgewrf384","prio":"high","room_alias":"#exampleroom:matrix.org","room_id":"!slw48wfj34rtnrf:example.com","room_name":"Mission Control","sender":"@exampleuser:matrix.org","sender_display_name":"Major Tom","type":"m.room.message"}}`
+	r, _ := http.NewRequest("POST", "http://ntfy.example.com/_matrix/push/v1/notify", strings.NewReader(body))
+	newRequest, err := newRequestFromMatrixJSON(r, baseURL, maxLength, false, DefaultLanguage)
+	require.Nil(t, err)
+	require.Equal(t, "Mission Control", newRequest.Header.Get("X-Title"))
+	require.Equal(t, "4", newRequest.Header.Get("X-Priority"))
+	require.Equal(t, body, readAll(t, newRequest.Body))
+}
+
+func TestMatrix_NewRequestFromMatrixJSON_MetadataOnly(t *testing.T) {
+	baseURL := "https://ntfy.sh"
+	maxLength := 4096
+	body := `{"notification":{"content":{"body":"I'm floating in a most peculiar way.","msgtype":"m.text"},"counts":{"missed_calls":1,"unread":2},"devices":[{"app_id":"org.matrix.matrixConsole.ios","data":{},"pushkey":"https://ntfy.sh/upABCDEFGHI?up=1","pushkey_ts":12345678,"tweaks":{"sound":"bing"}}],"event_id":"$3957tyerfgewrf384","prio":"high","room_alias":"#exampleroom:matrix.org","room_id":"!slw48wfj34rtnrf:example.com","room_name":"Mission Control","sender":"@exampleuser:matrix.org","sender_display_name":"Major Tom","type":"m.room.message"}}`
+	r, _ := http.NewRequest("POST", "http://ntfy.example.com/_matrix/push/v1/notify", strings.NewReader(body))
+	newRequest, err := newRequestFromMatrixJSON(r, baseURL, maxLength, true, DefaultLanguage)
+	require.Nil(t, err)
+	require.Equal(t, "", newRequest.Header.Get("X-Title"))
+	require.Equal(t, "4", newRequest.Header.Get("X-Priority"))
+	require.Equal(t, `{"notification":{"counts":{"missed_calls":1,"unread":2},"devices":[{"app_id":"org.matrix.matrixConsole.ios","data":{},"pushkey":"https://ntfy.sh/upABCDEFGHI?up=1","pushkey_ts":12345678,"tweaks":{"sound":"bing"}}],"event_id":"$3957tyerfgewrf384","prio":"high","room_id":"!slw48wfj34rtnrf:example.com"}}`, readAll(t, newRequest.Body))
+}
+
+func TestMatrix_NewRequestFromMatrixJSON_NotUnifiedPush(t *testing.T) {
+	baseURL := "https://ntfy.sh"
+	maxLength := 4096
+	body := `{"notification":{"content":{"body":"I'm floating in a most peculiar way.","msgtype":"m.text"},"counts":{"missed_calls":1,"unread":2},"devices":[{"pushkey":"https://ntfy.sh/mytopic"}],"event_id":"$3957tyerfgewrf384","room_name":"Mission Control","sender":"@exampleuser:matrix.org","sender_display_name":"Major Tom","type":"m.room.message"}}`
+	r, _ := http.NewRequest("POST", "http://ntfy.example.com/_matrix/push/v1/notify", strings.NewReader(body))
+	newRequest, err := newRequestFromMatrixJSON(r, baseURL, maxLength, false, DefaultLanguage)
+	require.Nil(t, err)
+	require.Equal(t, "Mission Control", newRequest.Header.Get("X-Title"))
+	require.Equal(t, "", newRequest.Header.Get("X-Priority"))
+	require.Equal(t, "Major Tom: I'm floating in a most peculiar way.", readAll(t, newRequest.Body))
+
+	r, _ = http.NewRequest("POST", "http://ntfy.example.com/_matrix/push/v1/notify", strings.NewReader(body))
+	newRequest, err = newRequestFromMatrixJSON(r, baseURL, maxLength, true, DefaultLanguage)
+	require.Nil(t, err)
+	require.Equal(t, "", newRequest.Header.Get("X-Title"))
+	require.Equal(t, "You have 2 unread messages and 1 missed call", readAll(t, newRequest.Body))
+
+	r, _ = http.NewRequest("POST", "http://ntfy.example.com/_matrix/push/v1/notify", strings.NewReader(body))
+	newRequest, err = newRequestFromMatrixJSON(r, baseURL, maxLength, true, "fr")
+	require.Nil(t, err)
+	require.Equal(t, "Vous avez 2 messages non lus et 1 appel manqué", readAll(t, newRequest.Body))
+}
+
 func TestMatrix_NewRequestFromMatrixJSON_TooLarge(t *testing.T) {
 	baseURL := "https://ntfy.sh"
 	maxLength := 10 // Small
 	body := `{"notification":{"content":{"body":"I'm floating in a most peculiar way.","msgtype":"m.text"},"counts":{"missed_calls":1,"unread":2},"devices":[{"app_id":"org.matrix.matrixConsole.ios","data":{},"pushkey":"https://ntfy.sh/upABCDEFGHI?up=1","pushkey_ts":12345678,"tweaks":{"sound":"bing"}}],"event_id":"$3957tyerfgewrf384","prio":"high","room_alias":"#exampleroom:matrix.org","room_id":"!slw48wfj34rtnrf:example.com","room_name":"Mission Control","sender":"@exampleuser:matrix.org","sender_display_name":"Major Tom","type":"m.room.message"}}`
 	r, _ := http.NewRequest("POST", "http://ntfy.example.com/_matrix/push/v1/notify", strings.NewReader(body))
-	_, err := newRequestFromMatrixJSON(r, baseURL, maxLength)
+	_, err := newRequestFromMatrixJSON(r, baseURL, maxLength, false, DefaultLanguage)
 	require.Equal(t, errHTTPEntityTooLargeMatrixRequest, err)
 }
 
@@ -35,7 +82,7 @@ func TestMatrix_NewRequestFromMatrixJSON_InvalidJSON(t *testing.T) {
 	maxLength := 4096
 	body := `this is not json`
 	r, _ := http.NewRequest("POST", "http://ntfy.example.com/_matrix/push/v1/notify", strings.NewReader(body))
-	_, err := newRequestFromMatrixJSON(r, baseURL, maxLength)
+	_, err := newRequestFromMatrixJSON(r, baseURL, maxLength, false, DefaultLanguage)
 	require.Equal(t, errHTTPBadRequestMatrixMessageInvalid, err)
 }
 
@@ -44,7 +91,7 @@ func TestMatrix_NewRequestFromMatrixJSON_NotAMatrixMessage(t *testing.T) {
 	maxLength := 4096
 	body := `{"message":"this is not a matrix message, but valid json"}`
 	r, _ := http.NewRequest("POST", "http://ntfy.example.com/_matrix/push/v1/notify", strings.NewReader(body))
-	_, err := newRequestFromMatrixJSON(r, baseURL, maxLength)
+	_, err := newRequestFromMatrixJSON(r, baseURL, maxLength, false, DefaultLanguage)
 	require.Equal(t, errHTTPBadRequestMatrixMessageInvalid, err)
 }
 
@@ -53,7 +100,7 @@ func TestMatrix_NewRequestFromMatrixJSON_MismatchingPushKey(t *testing.T) {
 	maxLength := 4096
 	body := `{"notification":{"content":{"body":"I'm floating in a most peculiar way.","msgtype":"m.text"},"counts":{"missed_calls":1,"unread":2},"devices":[{"app_id":"org.matrix.matrixConsole.ios","data":{},"pushkey":"https://ntfy.example.com/upABCDEFGHI?up=1","pushkey_ts":12345678,"tweaks":{"sound":"bing"}}],"event_id":"$3957tyerfgewrf384","prio":"high","room_alias":"#exampleroom:matrix.org","room_id":"!slw48wfj34rtnrf:example.com","room_name":"Mission Control","sender":"@exampleuser:matrix.org","sender_display_name":"Major Tom","type":"m.room.message"}}`
 	r, _ := http.NewRequest("POST", "http://ntfy.example.com/_matrix/push/v1/notify", strings.NewReader(body))
-	_, err := newRequestFromMatrixJSON(r, baseURL, maxLength)
+	_, err := newRequestFromMatrixJSON(r, baseURL, maxLength, false, DefaultLanguage)
 	matrixErr, ok := err.(*errMatrixPushkeyRejected)
 	require.True(t, ok)
 	require.Equal(t, "push key must be prefixed with base URL, received push key: https://ntfy.example.com/upABCDEFGHI?up=1, configured base URL: https://ntfy.sh", matrixErr.Error())
@@ -11,21 +11,40 @@ var (
 	metricMessagePublishDurationMillis prometheus.Gauge
 	metricFirebasePublishedSuccess     prometheus.Counter
 	metricFirebasePublishedFailure     prometheus.Counter
+	metricFirebaseQueueDepth           prometheus.Gauge
+	metricFirebaseQueueDropped         prometheus.Counter
+	metricFirebaseRetries              prometheus.Counter
+	metricTTSGeneratedSuccess          prometheus.Counter
+	metricTTSGeneratedFailure          prometheus.Counter
+	metricTTSCacheHits                 prometheus.Counter
+	metricTTSQueueDepth                prometheus.Gauge
 	metricEmailsPublishedSuccess       prometheus.Counter
 	metricEmailsPublishedFailure       prometheus.Counter
+	metricEmailsRetriesQueued          prometheus.Counter
+	metricEmailsRetries                prometheus.Counter
+	metricEmailsRetriesExpired         prometheus.Counter
+	metricEmailsRetriesQueueDepth      prometheus.Gauge
+	metricAuthLockouts                 prometheus.Counter
 	metricEmailsReceivedSuccess        prometheus.Counter
 	metricEmailsReceivedFailure        prometheus.Counter
 	metricCallsMadeSuccess             prometheus.Counter
 	metricCallsMadeFailure             prometheus.Counter
+	metricSMSSentSuccess               prometheus.Counter
+	metricSMSSentFailure               prometheus.Counter
 	metricUnifiedPushPublishedSuccess  prometheus.Counter
 	metricMatrixPublishedSuccess       prometheus.Counter
 	metricMatrixPublishedFailure       prometheus.Counter
 	metricAttachmentsTotalSize         prometheus.Gauge
 	metricVisitors                     prometheus.Gauge
 	metricSubscribers                  prometheus.Gauge
+	metricSubscriptionsActive          prometheus.Gauge
+	metricSubscriptionsRejected        *prometheus.CounterVec
+	metricInstantDevicesConnected      prometheus.Gauge
 	metricTopics                       prometheus.Gauge
 	metricUsers                        prometheus.Gauge
 	metricHTTPRequests                 *prometheus.CounterVec
+	metricTopicSeriesValue             *prometheus.GaugeVec
+	metricMessagesSampledOut           prometheus.Counter
 )
 
 func initMetrics() {
@@ -47,12 +66,48 @@ func initMetrics() {
 	metricFirebasePublishedFailure = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "ntfy_firebase_published_failure",
 	})
+	metricFirebaseQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ntfy_firebase_queue_depth",
+	})
+	metricFirebaseQueueDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ntfy_firebase_queue_dropped_total",
+	})
+	metricFirebaseRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ntfy_firebase_retries_total",
+	})
+	metricTTSGeneratedSuccess = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ntfy_tts_generated_success",
+	})
+	metricTTSGeneratedFailure = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ntfy_tts_generated_failure",
+	})
+	metricTTSCacheHits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ntfy_tts_cache_hits_total",
+	})
+	metricTTSQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ntfy_tts_queue_depth",
+	})
 	metricEmailsPublishedSuccess = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "ntfy_emails_sent_success",
 	})
 	metricEmailsPublishedFailure = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "ntfy_emails_sent_failure",
 	})
+	metricEmailsRetriesQueued = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ntfy_emails_retries_queued_total",
+	})
+	metricEmailsRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ntfy_emails_retries_total",
+	})
+	metricEmailsRetriesExpired = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ntfy_emails_retries_expired_total",
+	})
+	metricEmailsRetriesQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ntfy_emails_retry_queue_depth",
+	})
+	metricAuthLockouts = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ntfy_auth_lockouts_total",
+	})
 	metricEmailsReceivedSuccess = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "ntfy_emails_received_success",
 	})
@@ -65,6 +120,12 @@ func initMetrics() {
 	metricCallsMadeFailure = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "ntfy_calls_made_failure",
 	})
+	metricSMSSentSuccess = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ntfy_sms_sent_success",
+	})
+	metricSMSSentFailure = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ntfy_sms_sent_failure",
+	})
 	metricUnifiedPushPublishedSuccess = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "ntfy_unifiedpush_published_success",
 	})
@@ -86,12 +147,27 @@ func initMetrics() {
 	metricSubscribers = prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "ntfy_subscribers_total",
 	})
+	metricSubscriptionsActive = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ntfy_subscriptions_active",
+	})
+	metricSubscriptionsRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ntfy_subscriptions_rejected_total",
+	}, []string{"limit"})
+	metricInstantDevicesConnected = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ntfy_instant_devices_connected",
+	})
 	metricTopics = prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "ntfy_topics_total",
 	})
 	metricHTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "ntfy_http_requests_total",
 	}, []string{"http_code", "ntfy_code", "http_method"})
+	metricTopicSeriesValue = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ntfy_topic_series_value",
+	}, []string{"topic", "field"})
+	metricMessagesSampledOut = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "ntfy_messages_sampled_out_total",
+	})
 	prometheus.MustRegister(
 		metricMessagesPublishedSuccess,
 		metricMessagesPublishedFailure,
@@ -99,12 +175,26 @@ func initMetrics() {
 		metricMessagePublishDurationMillis,
 		metricFirebasePublishedSuccess,
 		metricFirebasePublishedFailure,
+		metricFirebaseQueueDepth,
+		metricFirebaseQueueDropped,
+		metricFirebaseRetries,
+		metricTTSGeneratedSuccess,
+		metricTTSGeneratedFailure,
+		metricTTSCacheHits,
+		metricTTSQueueDepth,
 		metricEmailsPublishedSuccess,
 		metricEmailsPublishedFailure,
+		metricEmailsRetriesQueued,
+		metricEmailsRetries,
+		metricEmailsRetriesExpired,
+		metricEmailsRetriesQueueDepth,
+		metricAuthLockouts,
 		metricEmailsReceivedSuccess,
 		metricEmailsReceivedFailure,
 		metricCallsMadeSuccess,
 		metricCallsMadeFailure,
+		metricSMSSentSuccess,
+		metricSMSSentFailure,
 		metricUnifiedPushPublishedSuccess,
 		metricMatrixPublishedSuccess,
 		metricMatrixPublishedFailure,
@@ -112,8 +202,13 @@ func initMetrics() {
 		metricVisitors,
 		metricUsers,
 		metricSubscribers,
+		metricSubscriptionsActive,
+		metricSubscriptionsRejected,
+		metricInstantDevicesConnected,
 		metricTopics,
 		metricHTTPRequests,
+		metricTopicSeriesValue,
+		metricMessagesSampledOut,
 	)
 }
 
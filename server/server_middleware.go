@@ -12,11 +12,13 @@ const (
 	contextRateVisitor contextKey = iota + 2586
 	contextTopic
 	contextMatrixPushKey
+	contextSignedPublish
+	contextEmailAlias
 )
 
 func (s *Server) limitRequests(next handleFunc) handleFunc {
 	return func(w http.ResponseWriter, r *http.Request, v *visitor) error {
-		if util.ContainsIP(s.config.VisitorRequestExemptIPAddrs, v.ip) {
+		if util.ContainsIP(s.config().VisitorRequestExemptIPAddrs, v.ip) {
 			return next(w, r, v)
 		} else if !v.RequestAllowed() {
 			return errHTTPTooManyRequestsLimitRequests
@@ -40,7 +42,7 @@ func (s *Server) limitRequestsWithTopic(next handleFunc) handleFunc {
 			contextRateVisitor: vrate,
 			contextTopic:       t,
 		})
-		if util.ContainsIP(s.config.VisitorRequestExemptIPAddrs, v.ip) {
+		if util.ContainsIP(s.config().VisitorRequestExemptIPAddrs, v.ip) {
 			return next(w, r, v)
 		} else if !vrate.RequestAllowed() {
 			return errHTTPTooManyRequestsLimitRequests
@@ -51,7 +53,7 @@ func (s *Server) limitRequestsWithTopic(next handleFunc) handleFunc {
 
 func (s *Server) ensureWebEnabled(next handleFunc) handleFunc {
 	return func(w http.ResponseWriter, r *http.Request, v *visitor) error {
-		if s.config.WebRoot == "" {
+		if s.config().WebRoot == "" {
 			return errHTTPNotFound
 		}
 		return next(w, r, v)
@@ -60,7 +62,7 @@ func (s *Server) ensureWebEnabled(next handleFunc) handleFunc {
 
 func (s *Server) ensureWebPushEnabled(next handleFunc) handleFunc {
 	return func(w http.ResponseWriter, r *http.Request, v *visitor) error {
-		if s.config.WebRoot == "" || s.config.WebPushPublicKey == "" {
+		if conf := s.config(); conf.WebRoot == "" || conf.WebPushPublicKey == "" {
 			return errHTTPNotFound
 		}
 		return next(w, r, v)
@@ -78,8 +80,11 @@ func (s *Server) ensureUserManager(next handleFunc) handleFunc {
 
 func (s *Server) ensureUser(next handleFunc) handleFunc {
 	return s.ensureUserManager(func(w http.ResponseWriter, r *http.Request, v *visitor) error {
-		if v.User() == nil {
+		u := v.User()
+		if u == nil {
 			return errHTTPUnauthorized
+		} else if u.TokenScope != nil {
+			return errHTTPForbiddenScopedToken
 		}
 		return next(w, r, v)
 	})
@@ -87,8 +92,11 @@ func (s *Server) ensureUser(next handleFunc) handleFunc {
 
 func (s *Server) ensureAdmin(next handleFunc) handleFunc {
 	return s.ensureUserManager(func(w http.ResponseWriter, r *http.Request, v *visitor) error {
-		if !v.User().IsAdmin() {
+		u := v.User()
+		if !u.IsAdmin() {
 			return errHTTPUnauthorized
+		} else if u.TokenScope != nil {
+			return errHTTPForbiddenScopedToken
 		}
 		return next(w, r, v)
 	})
@@ -96,7 +104,7 @@ func (s *Server) ensureAdmin(next handleFunc) handleFunc {
 
 func (s *Server) ensureCallsEnabled(next handleFunc) handleFunc {
 	return func(w http.ResponseWriter, r *http.Request, v *visitor) error {
-		if s.config.TwilioAccount == "" || s.userManager == nil {
+		if s.config().TwilioAccount == "" || s.userManager == nil {
 			return errHTTPNotFound
 		}
 		return next(w, r, v)
@@ -105,7 +113,7 @@ func (s *Server) ensureCallsEnabled(next handleFunc) handleFunc {
 
 func (s *Server) ensurePaymentsEnabled(next handleFunc) handleFunc {
 	return func(w http.ResponseWriter, r *http.Request, v *visitor) error {
-		if s.config.StripeSecretKey == "" || s.stripe == nil {
+		if s.config().StripeSecretKey == "" || s.stripe == nil {
 			return errHTTPNotFound
 		}
 		return next(w, r, v)
@@ -0,0 +1,260 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/util"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The uptime monitor is a minimal built-in checker for simple cases, so that people don't have to run a separate
+// monitoring tool just to feed ntfy. Checks are defined via the "monitor-checks" config option, each in the
+// format "<topic> <target> [<interval>]", e.g. "backups https://example.com/health 5m". Supported targets are:
+//
+//   - http:// and https:// URLs: A GET request is made; any 2xx or 3xx status code counts as up
+//   - tcp://host:port: A TCP connection is opened and closed again
+//   - icmp://host: An ICMP echo request (ping) is sent; this may require CAP_NET_RAW or net.ipv4.ping_group_range
+//
+// A message is only published to the topic when the state of a check changes, i.e. when it fails or when it
+// recovers. The initial state is "up", so nothing is published at startup if the target is reachable.
+
+const (
+	monitorSchemeHTTP  = "http"
+	monitorSchemeHTTPS = "https"
+	monitorSchemeTCP   = "tcp"
+	monitorSchemeICMP  = "icmp"
+	monitorIntervalMin = 10 * time.Second
+)
+
+var (
+	errMonitorICMPNoReply = errors.New("no echo reply received")
+)
+
+// monitorCheck is a single uptime check, as defined in the config
+type monitorCheck struct {
+	topic    string
+	target   *url.URL
+	interval time.Duration
+	down     bool      // Current state of the check
+	since    time.Time // Time of the last state change
+	mu       sync.Mutex
+}
+
+// parseMonitorChecks parses the "monitor-checks" config option, see above for the format
+func parseMonitorChecks(checks []string, defaultInterval time.Duration) ([]*monitorCheck, error) {
+	monitorChecks := make([]*monitorCheck, 0)
+	for _, check := range checks {
+		fields := strings.Fields(check)
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("invalid monitor check %q, expected format '<topic> <target> [<interval>]'", check)
+		} else if !topicRegex.MatchString(fields[0]) {
+			return nil, fmt.Errorf("invalid monitor check %q, topic %s is invalid", check, fields[0])
+		}
+		target, err := url.Parse(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid monitor check %q, %s", check, err.Error())
+		}
+		switch target.Scheme {
+		case monitorSchemeHTTP, monitorSchemeHTTPS:
+		case monitorSchemeTCP:
+			if target.Port() == "" {
+				return nil, fmt.Errorf("invalid monitor check %q, tcp:// targets require a port", check)
+			}
+		case monitorSchemeICMP:
+		default:
+			return nil, fmt.Errorf("invalid monitor check %q, target must be an http://, https://, tcp:// or icmp:// URL", check)
+		}
+		if target.Hostname() == "" {
+			return nil, fmt.Errorf("invalid monitor check %q, target host is missing", check)
+		}
+		interval := defaultInterval
+		if len(fields) == 3 {
+			interval, err = util.ParseDuration(fields[2])
+			if err != nil {
+				return nil, fmt.Errorf("invalid monitor check %q, %s", check, err.Error())
+			}
+		}
+		if interval < monitorIntervalMin {
+			return nil, fmt.Errorf("invalid monitor check %q, interval must be at least %s", check, monitorIntervalMin)
+		}
+		monitorChecks = append(monitorChecks, &monitorCheck{
+			topic:    fields[0],
+			target:   target,
+			interval: interval,
+			since:    time.Now(),
+		})
+	}
+	return monitorChecks, nil
+}
+
+func (s *Server) runMonitor() {
+	for _, c := range s.monitorChecks {
+		go s.runMonitorCheck(c)
+	}
+}
+
+func (s *Server) runMonitorCheck(c *monitorCheck) {
+	log.Tag(tagMonitor).Debug("Monitoring %s every %s, publishing to topic %s", c.target.String(), c.interval, c.topic)
+	for {
+		select {
+		case <-time.After(c.interval):
+			s.execMonitorCheck(c)
+		case <-s.closeChan:
+			return
+		}
+	}
+}
+
+// execMonitorCheck runs the check once, and publishes a message to the check's topic if the state changed
+func (s *Server) execMonitorCheck(c *monitorCheck) {
+	err := s.probeMonitorTarget(c.target)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ev := log.Tag(tagMonitor).Fields(log.Context{
+		"monitor_target": c.target.String(),
+		"monitor_topic":  c.topic,
+	})
+	if err != nil && !c.down {
+		ev.Err(err).Info("Monitor check failed")
+		c.down, c.since = true, time.Now()
+		s.publishMonitorMessage(c.topic, "Monitor check failed", fmt.Sprintf("%s is down: %s", c.target.String(), err.Error()), 4, "rotating_light")
+	} else if err == nil && c.down {
+		ev.Info("Monitor check recovered")
+		downtime := time.Since(c.since).Round(time.Second)
+		c.down, c.since = false, time.Now()
+		s.publishMonitorMessage(c.topic, "Monitor check recovered", fmt.Sprintf("%s is up again, it was down for %s", c.target.String(), downtime), 3, "white_check_mark")
+	} else if err != nil {
+		ev.Err(err).Debug("Monitor check still failing")
+	} else {
+		ev.Trace("Monitor check succeeded")
+	}
+}
+
+func (s *Server) probeMonitorTarget(target *url.URL) error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.config().MonitorTimeout)
+	defer cancel()
+	switch target.Scheme {
+	case monitorSchemeHTTP, monitorSchemeHTTPS:
+		return probeHTTP(ctx, s.httpClient.Client(), target)
+	case monitorSchemeTCP:
+		return probeTCP(ctx, target)
+	case monitorSchemeICMP:
+		return probeICMP(ctx, target)
+	}
+	return fmt.Errorf("unsupported scheme %s", target.Scheme)
+}
+
+func probeHTTP(ctx context.Context, client *http.Client, target *url.URL) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "ntfy-monitor")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 399 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func probeTCP(ctx context.Context, target *url.URL) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", target.Host)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// probeICMP sends an ICMP echo request to the target host. It first tries an unprivileged "ping socket" (allowed
+// via net.ipv4.ping_group_range on Linux), and falls back to a raw socket, which requires CAP_NET_RAW.
+func probeICMP(ctx context.Context, target *url.URL) error {
+	addr, err := net.DefaultResolver.LookupNetIP(ctx, "ip4", target.Hostname())
+	if err != nil {
+		return err
+	} else if len(addr) == 0 {
+		return fmt.Errorf("cannot resolve %s", target.Hostname())
+	}
+	ip := addr[0].AsSlice()
+	var dst net.Addr = &net.UDPAddr{IP: ip}
+	conn, err := icmp.ListenPacket("udp4", "0.0.0.0")
+	if err != nil {
+		dst = &net.IPAddr{IP: ip}
+		conn, err = icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+		if err != nil {
+			return err
+		}
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return err
+		}
+	}
+	request := &icmp.Message{
+		Type: ipv4.ICMPTypeEcho,
+		Body: &icmp.Echo{ID: os.Getpid() & 0xffff, Seq: 1, Data: []byte("ntfy")},
+	}
+	b, err := request.Marshal(nil)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.WriteTo(b, dst); err != nil {
+		return err
+	}
+	reply := make([]byte, 1500)
+	for {
+		n, peer, err := conn.ReadFrom(reply)
+		if err != nil {
+			return errMonitorICMPNoReply
+		}
+		if !monitorPeerMatches(peer, addr[0]) {
+			continue
+		}
+		m, err := icmp.ParseMessage(ipv4.ICMPTypeEcho.Protocol(), reply[:n])
+		if err == nil && m.Type == ipv4.ICMPTypeEchoReply {
+			return nil
+		}
+	}
+}
+
+func monitorPeerMatches(peer net.Addr, addr netip.Addr) bool {
+	var ip net.IP
+	switch p := peer.(type) {
+	case *net.UDPAddr:
+		ip = p.IP
+	case *net.IPAddr:
+		ip = p.IP
+	default:
+		return false
+	}
+	peerAddr, ok := netip.AddrFromSlice(ip)
+	return ok && peerAddr.Unmap() == addr.Unmap()
+}
+
+// publishMonitorMessage publishes a message to the given topic on behalf of the server
+func (s *Server) publishMonitorMessage(topic, title, message string, priority int, tag string) {
+	v := newVisitor(s.config(), s.messageCache, s.userManager, netip.IPv4Unspecified(), nil) // Background process, not a real visitor, uses IP 0.0.0.0
+	m := newDefaultMessage(topic, message)
+	m.Title = title
+	m.Priority = priority
+	m.Tags = []string{tag}
+	if err := s.publishMessage(v, m); err != nil {
+		logvm(v, m).Tag(tagMonitor).Err(err).Warn("Unable to publish monitor message")
+	}
+}
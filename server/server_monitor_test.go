@@ -0,0 +1,127 @@
+package server
+
+import (
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMonitor_ParseChecks(t *testing.T) {
+	checks, err := parseMonitorChecks([]string{
+		"alerts https://example.com/health",
+		"alerts   tcp://db.lan:5432   30s",
+		"homelab icmp://192.168.1.1 5m",
+	}, time.Minute)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(checks))
+	require.Equal(t, "alerts", checks[0].topic)
+	require.Equal(t, "https://example.com/health", checks[0].target.String())
+	require.Equal(t, time.Minute, checks[0].interval)
+	require.Equal(t, "db.lan:5432", checks[1].target.Host)
+	require.Equal(t, 30*time.Second, checks[1].interval)
+	require.Equal(t, "homelab", checks[2].topic)
+	require.Equal(t, "icmp", checks[2].target.Scheme)
+	require.Equal(t, 5*time.Minute, checks[2].interval)
+}
+
+func TestMonitor_ParseChecks_Invalid(t *testing.T) {
+	for _, check := range []string{
+		"alerts",
+		"alerts https://example.com 1m extra",
+		"not/a/topic https://example.com",
+		"alerts ftp://example.com",
+		"alerts tcp://db.lan",
+		"alerts https://",
+		"alerts https://example.com 5s",
+		"alerts https://example.com nope",
+	} {
+		_, err := parseMonitorChecks([]string{check}, time.Minute)
+		require.Error(t, err, check)
+	}
+	_, err := parseMonitorChecks([]string{"alerts https://example.com"}, time.Second)
+	require.Error(t, err)
+}
+
+func TestMonitor_InvalidConfig(t *testing.T) {
+	c := newTestConfig(t)
+	c.MonitorChecks = []string{"alerts gopher://example.com"}
+	_, err := New(c)
+	require.Error(t, err)
+}
+
+func TestMonitor_HTTPCheck_FailAndRecover(t *testing.T) {
+	var healthy atomic.Bool
+	healthy.Store(true)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer target.Close()
+
+	c := newTestConfig(t)
+	c.MonitorChecks = []string{"alerts " + target.URL}
+	s := newTestServer(t, c)
+	require.Equal(t, 1, len(s.monitorChecks))
+	check := s.monitorChecks[0]
+
+	// Initial success does not publish anything
+	s.execMonitorCheck(check)
+	response := request(t, s, "GET", "/alerts/json?poll=1", "", nil)
+	require.Equal(t, "", response.Body.String())
+
+	// Failure publishes once
+	healthy.Store(false)
+	s.execMonitorCheck(check)
+	s.execMonitorCheck(check)
+	response = request(t, s, "GET", "/alerts/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "Monitor check failed", messages[0].Title)
+	require.Equal(t, 4, messages[0].Priority)
+	require.Equal(t, []string{"rotating_light"}, messages[0].Tags)
+	require.Contains(t, messages[0].Message, target.URL+" is down: unexpected status code 503")
+
+	// Recovery publishes once
+	healthy.Store(true)
+	s.execMonitorCheck(check)
+	s.execMonitorCheck(check)
+	response = request(t, s, "GET", "/alerts/json?poll=1", "", nil)
+	messages = toMessages(t, response.Body.String())
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "Monitor check recovered", messages[1].Title)
+	require.Equal(t, []string{"white_check_mark"}, messages[1].Tags)
+	require.True(t, strings.HasPrefix(messages[1].Message, target.URL+" is up again"))
+}
+
+func TestMonitor_TCPCheck(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	addr := listener.Addr().String()
+
+	c := newTestConfig(t)
+	c.MonitorChecks = []string{"alerts tcp://" + addr}
+	s := newTestServer(t, c)
+	require.Nil(t, s.probeMonitorTarget(s.monitorChecks[0].target))
+
+	listener.Close()
+	s.execMonitorCheck(s.monitorChecks[0])
+	response := request(t, s, "GET", "/alerts/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Contains(t, messages[0].Message, "tcp://"+addr+" is down")
+}
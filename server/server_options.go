@@ -0,0 +1,50 @@
+package server
+
+// Servers embedding ntfy can replace the outgoing integrations of the server with their own implementations, by
+// passing options to New:
+//
+//   - WithMailer sends emails (X-Email, archives, ...) with a custom Mailer, e.g. an internal mail service. Sending
+//     emails is enabled regardless of smtp-sender-addr or email-provider; smtp-sender-from is still used as sender.
+//   - WithFirebaseSender sends Firebase messages with a custom FirebaseSender, e.g. a mock FCM. Firebase is enabled
+//     regardless of firebase-key-file.
+//   - WithStripeAPI replaces the Stripe API client. Payments are still only enabled if stripe-secret-key is set.
+//
+// Custom implementations are not replaced when the config is reloaded.
+
+// Option is an option for New, see above
+type Option func(o *options)
+
+type options struct {
+	mailer         Mailer
+	firebaseSender FirebaseSender
+	stripeAPI      StripeAPI
+}
+
+// WithMailer sends emails with the given Mailer, instead of via SMTP or the configured email provider
+func WithMailer(mailer Mailer) Option {
+	return func(o *options) {
+		o.mailer = mailer
+	}
+}
+
+// WithFirebaseSender sends Firebase messages with the given FirebaseSender, instead of the Firebase Admin SDK
+func WithFirebaseSender(sender FirebaseSender) Option {
+	return func(o *options) {
+		o.firebaseSender = sender
+	}
+}
+
+// WithStripeAPI uses the given StripeAPI for payments, instead of the Stripe API
+func WithStripeAPI(api StripeAPI) Option {
+	return func(o *options) {
+		o.stripeAPI = api
+	}
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testCustomMailer struct {
+	err   error
+	mails []*Mail
+	mu    sync.Mutex
+}
+
+func (m *testCustomMailer) SendMail(mail *Mail) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return m.err
+	}
+	m.mails = append(m.mails, mail)
+	return nil
+}
+
+func (m *testCustomMailer) Mails() []*Mail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append(make([]*Mail, 0), m.mails...)
+}
+
+func TestServer_WithMailer(t *testing.T) {
+	c := newTestConfig(t)
+	c.BaseURL = "https://ntfy.sh"
+	c.SMTPSenderFrom = "ntfy@ntfy.sh"
+	mailer := &testCustomMailer{}
+	s, err := New(c, WithMailer(mailer))
+	require.Nil(t, err)
+	defer s.closeDatabases()
+
+	response := request(t, s, "PUT", "/mytopic", "fail", map[string]string{
+		"Title": "This is a test",
+		"Email": "phil@example.com",
+	})
+	require.Equal(t, 200, response.Code)
+	waitFor(t, func() bool {
+		return len(mailer.Mails()) == 1
+	})
+	mail := mailer.Mails()[0]
+	require.Equal(t, "ntfy@ntfy.sh", mail.From)
+	require.Equal(t, "ntfy.sh/mytopic", mail.FromName)
+	require.Equal(t, "phil@example.com", mail.To)
+	require.Equal(t, "This is a test", mail.Subject)
+	require.Contains(t, mail.Text, "fail")
+	require.Contains(t, string(mail.Raw), "To: phil@example.com")
+	require.Nil(t, mail.Attachment)
+
+	// Custom mailer is kept on reload, even though smtp-sender-addr is not set
+	s.Reload(c)
+	require.NotNil(t, s.mailer())
+	total, success, failure := s.mailer().Counts()
+	require.Equal(t, int64(1), total)
+	require.Equal(t, int64(1), success)
+	require.Equal(t, int64(0), failure)
+}
+
+func TestServer_WithMailer_Error(t *testing.T) {
+	c := newTestConfig(t)
+	c.SMTPSenderFrom = "ntfy@ntfy.sh"
+	mailer := &testCustomMailer{err: errors.New("permanent failure")}
+	s, err := New(c, WithMailer(mailer))
+	require.Nil(t, err)
+	defer s.closeDatabases()
+
+	request(t, s, "PUT", "/mytopic", "fail", map[string]string{
+		"Email": "phil@example.com",
+	})
+	waitFor(t, func() bool {
+		_, _, failure := s.mailer().Counts()
+		return failure == 1
+	})
+}
+
+func TestServer_WithFirebaseSender(t *testing.T) {
+	c := newTestConfig(t)
+	require.Empty(t, c.FirebaseKeyFile)
+	sender := newTestFirebaseSender(10)
+	s, err := New(c, WithFirebaseSender(sender))
+	require.Nil(t, err)
+	defer s.closeDatabases()
+	require.NotNil(t, s.firebaseClient)
+
+	request(t, s, "PUT", "/mytopic", "my first message", nil)
+	waitFor(t, func() bool {
+		return len(sender.Messages()) == 1
+	})
+	require.Equal(t, "my first message", sender.Messages()[0].Data["message"])
+}
+
+func TestServer_WithStripeAPI(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.StripeSecretKey = "secret key"
+	stripeMock := &testStripeAPI{}
+	s, err := New(c, WithStripeAPI(stripeMock))
+	require.Nil(t, err)
+	defer s.closeDatabases()
+	require.Same(t, stripeMock, s.stripe)
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"sync"
+
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+// Members of an organization that do not have a tier of their own use the organization's tier (see user.Org). Their
+// daily message, e-mail and call limits are pooled: the limits of the tier apply to all of these members combined,
+// not to each member individually. Every member is still limited by their own visitor limiters, and in addition by
+// the limiters of the organization, which are shared by the visitors of all members (see visitor.SetOrgLimiters).
+//
+// The limiters are held in memory, and created on first use from the combined daily stats of the members in the
+// user database (see user.Manager.OrgStats). They are reset along with the visitor stats once a day.
+
+// orgLimiters are the limiters shared by the members of an organization
+type orgLimiters struct {
+	tierID   string // Tier the limiters were created for; if the organization's tier changes, they are re-created
+	messages *util.FixedLimiter
+	emails   *util.FixedLimiter
+	calls    *util.FixedLimiter
+}
+
+// orgLimits is the in-memory list of organization limiters
+type orgLimits struct {
+	userManager *user.Manager
+	limiters    map[string]*orgLimiters // Organization ID -> limiters
+	mu          sync.Mutex
+}
+
+func newOrgLimits(userManager *user.Manager) *orgLimits {
+	return &orgLimits{
+		userManager: userManager,
+		limiters:    make(map[string]*orgLimiters),
+	}
+}
+
+// Get returns the limiters of the user's organization, or nil if the user does not use the organization's tier
+func (o *orgLimits) Get(u *user.User) *orgLimiters {
+	if o.userManager == nil || u == nil || u.Org == nil || !u.Org.UsesTier || u.Tier == nil {
+		return nil
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if l, ok := o.limiters[u.Org.ID]; ok && l.tierID == u.Tier.ID {
+		return l
+	}
+	stats, err := o.userManager.OrgStats(u.Org.ID)
+	if err != nil {
+		log.Tag(tagAccount).Field("org_id", u.Org.ID).Err(err).Warn("Cannot read organization stats, starting with zero")
+		stats = &user.Stats{}
+	}
+	l := &orgLimiters{
+		tierID:   u.Tier.ID,
+		messages: util.NewFixedLimiterWithValue(u.Tier.MessageLimit, stats.Messages),
+		emails:   util.NewFixedLimiterWithValue(u.Tier.EmailLimit, stats.Emails),
+		calls:    util.NewFixedLimiterWithValue(u.Tier.CallLimit, stats.Calls),
+	}
+	o.limiters[u.Org.ID] = l
+	return l
+}
+
+// Reset resets the daily stats of all organizations
+func (o *orgLimits) Reset() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, l := range o.limiters {
+		l.messages.Reset()
+		l.emails.Reset()
+		l.calls.Reset()
+	}
+}
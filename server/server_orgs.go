@@ -0,0 +1,650 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/stripe/stripe-go/v74"
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/user"
+)
+
+// Organizations let a team share one tier, one Stripe subscription and a set of reserved topics, instead of each
+// member paying for and reserving topics on their own (see user.Org). A user can be a member of one organization:
+//
+//   - Any user can create an organization via POST /v1/account/org, and becomes its owner. Owners and admins
+//     invite and remove members via POST/DELETE /v1/account/org/members. Invited users join by accepting the
+//     invite via POST /v1/account/org/invites/<org-id>, and may leave on their own.
+//   - Owners and admins reserve topics for the organization via POST /v1/account/org/topics. All members have
+//     read-write access to these topics, owners and admins can also manage them. Everyone else gets the
+//     "everyone" permission of the topic. Organization topics count against the reservation limit of the
+//     organization's tier, not against the limits of the members.
+//   - The owner subscribes the organization to a paid tier via POST /v1/account/org/billing/subscription. The
+//     Stripe customer is mapped to the organization (not the user) in the checkout success handler, and kept in
+//     sync by the same webhooks as user subscriptions. Members without a tier of their own use the organization's
+//     tier. Their daily message, e-mail and call limits are pooled, see orgLimits; attachment limits still apply
+//     to each member individually.
+
+// handleAccountOrgGet returns the organization of the current user, including members and topics
+func (s *Server) handleAccountOrgGet(w http.ResponseWriter, _ *http.Request, v *visitor) error {
+	u := v.User()
+	org, err := s.currentOrg(u)
+	if err != nil {
+		return err
+	}
+	members, err := s.userManager.OrgMembers(org.ID)
+	if err != nil {
+		return err
+	}
+	topics, err := s.userManager.OrgTopics(org.ID)
+	if err != nil {
+		return err
+	}
+	response := &apiAccountOrgResponse{
+		ID:      org.ID,
+		Name:    org.Name,
+		Role:    string(u.Org.Role),
+		Limits:  &apiAccountOrgLimits{},
+		Members: make([]*apiAccountOrgMember, 0),
+		Topics:  make([]*apiAccountOrgTopic, 0),
+		Created: org.Created.Unix(),
+	}
+	if org.Tier != nil {
+		response.Tier = &apiAccountTier{
+			Code: org.Tier.Code,
+			Name: org.Tier.Name,
+		}
+		response.Limits.Reservations = org.Tier.ReservationLimit
+	}
+	for _, member := range members {
+		response.Members = append(response.Members, &apiAccountOrgMember{
+			Username: member.Username,
+			Role:     string(member.Role),
+		})
+	}
+	for _, topic := range topics {
+		response.Topics = append(response.Topics, &apiAccountOrgTopic{
+			Topic:    topic.Topic,
+			Everyone: topic.Everyone.String(),
+		})
+	}
+	if u.Org.Role.IsOrgAdmin() && org.Billing.StripeCustomerID != "" {
+		response.Billing = &apiAccountBilling{
+			Customer:     true,
+			Subscription: org.Billing.StripeSubscriptionID != "",
+			Status:       string(org.Billing.StripeSubscriptionStatus),
+			Interval:     string(org.Billing.StripeSubscriptionInterval),
+			PaidUntil:    org.Billing.StripeSubscriptionPaidUntil.Unix(),
+			CancelAt:     org.Billing.StripeSubscriptionCancelAt.Unix(),
+		}
+	}
+	return s.writeJSON(w, response)
+}
+
+// handleAccountOrgCreate creates a new organization, with the current user as its owner
+func (s *Server) handleAccountOrgCreate(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	req, err := readJSONWithLimit[apiAccountOrgCreateRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" || len(name) > 64 {
+		return errHTTPBadRequest.Wrap("invalid organization name")
+	}
+	u := v.User()
+	org, err := s.userManager.AddOrg(name, u.Name)
+	if errors.Is(err, user.ErrOrgMemberExists) {
+		return errHTTPConflictOrgMemberExists
+	} else if err != nil {
+		return err
+	}
+	logvr(v, r).
+		Tag(tagAccount).
+		Fields(log.Context{
+			"org_id":   org.ID,
+			"org_name": org.Name,
+		}).
+		Info("Created organization %s", org.Name)
+	return s.writeJSON(w, &apiAccountOrgMembership{
+		ID:   org.ID,
+		Name: org.Name,
+		Role: string(user.OrgRoleOwner),
+	})
+}
+
+// handleAccountOrgDelete deletes the organization of the current user, including its topic reservations. Only the
+// owner can do this, and only if the organization has no active subscription.
+func (s *Server) handleAccountOrgDelete(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	org, err := s.currentOrgWithRole(v.User(), user.OrgRoleOwner)
+	if err != nil {
+		return err
+	} else if org.Billing.StripeSubscriptionID != "" {
+		return errHTTPBadRequestBillingSubscriptionExists
+	}
+	topics, err := s.userManager.OrgTopics(org.ID)
+	if err != nil {
+		return err
+	}
+	logvr(v, r).
+		Tag(tagAccount).
+		Field("org_id", org.ID).
+		Info("Deleting organization %s", org.Name)
+	if err := s.userManager.RemoveOrg(org.ID); err != nil {
+		return err
+	}
+	if len(topics) > 0 {
+		orgTopics := make([]string, 0)
+		for _, topic := range topics {
+			orgTopics = append(orgTopics, topic.Topic)
+		}
+		if err := s.messageCache.ExpireMessages(orgTopics...); err != nil {
+			return err
+		}
+		go s.pruneMessages()
+	}
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+// handleAccountOrgMemberAdd invites a user to the organization of the current user, or changes the role of a member.
+// Users only become members once they accept the invite (see handleAccountOrgInviteAccept), so that nobody can be
+// added to an organization against their will. To not reveal which users exist, inviting a non-existent user
+// succeeds as well. Only the owner can make other users owners.
+func (s *Server) handleAccountOrgMemberAdd(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	u := v.User()
+	org, err := s.currentOrgWithRole(u, user.OrgRoleAdmin)
+	if err != nil {
+		return err
+	}
+	req, err := readJSONWithLimit[apiAccountOrgMemberRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	} else if req.Username == "" || req.Username == u.Name {
+		return errHTTPBadRequestUserNotFound
+	}
+	role := user.OrgRoleMember
+	if req.Role != "" {
+		role = user.OrgRole(req.Role)
+		if !user.AllowedOrgRole(role) {
+			return errHTTPBadRequest.Wrap("invalid role %s", req.Role)
+		} else if role == user.OrgRoleOwner && u.Org.Role != user.OrgRoleOwner {
+			return errHTTPForbiddenNotOrgAdmin
+		}
+	}
+	members, err := s.userManager.OrgMembers(org.ID)
+	if err != nil {
+		return err
+	}
+	var member *user.OrgMember
+	for i := range members {
+		if members[i].Username == req.Username {
+			member = &members[i]
+			break
+		}
+	}
+	if member == nil {
+		logvr(v, r).
+			Tag(tagAccount).
+			Fields(log.Context{
+				"org_id": org.ID,
+				"member": req.Username,
+				"role":   string(role),
+			}).
+			Info("Inviting user %s to organization %s", req.Username, org.Name)
+		if err := s.userManager.AddOrgInvite(org.ID, req.Username, role); errors.Is(err, user.ErrInvalidArgument) {
+			return errHTTPBadRequestUserNotFound
+		} else if err != nil && !errors.Is(err, user.ErrUserNotFound) {
+			return err
+		}
+		return s.writeJSON(w, newSuccessResponse())
+	} else if member.Role == user.OrgRoleOwner && u.Org.Role != user.OrgRoleOwner {
+		return errHTTPForbiddenNotOrgAdmin // Admins cannot demote the owner
+	}
+	logvr(v, r).
+		Tag(tagAccount).
+		Fields(log.Context{
+			"org_id": org.ID,
+			"member": req.Username,
+			"role":   string(role),
+		}).
+		Info("Changing role of member %s in organization %s", req.Username, org.Name)
+	if err := s.userManager.AddOrgMember(org.ID, req.Username, role); errors.Is(err, user.ErrUserNotFound) || errors.Is(err, user.ErrInvalidArgument) {
+		return errHTTPBadRequestUserNotFound
+	} else if err != nil {
+		return err
+	}
+	if member, err := s.userManager.User(req.Username); err == nil {
+		s.publishSyncEventAsync(s.visitor(netip.IPv4Unspecified(), member))
+	}
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+// handleAccountOrgMemberDelete removes a user from the organization of the current user. Owners and admins can
+// remove any member except the owner, and every member can leave the organization.
+func (s *Server) handleAccountOrgMemberDelete(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	u := v.User()
+	org, err := s.currentOrg(u)
+	if err != nil {
+		return err
+	}
+	req, err := readJSONWithLimit[apiAccountOrgMemberRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	} else if req.Username == "" {
+		return errHTTPBadRequestUserNotFound
+	} else if req.Username != u.Name && !u.Org.Role.IsOrgAdmin() {
+		return errHTTPForbiddenNotOrgAdmin
+	}
+	members, err := s.userManager.OrgMembers(org.ID)
+	if err != nil {
+		return err
+	}
+	for _, member := range members {
+		if member.Username == req.Username && member.Role == user.OrgRoleOwner {
+			return errHTTPBadRequest.Wrap("the owner cannot be removed from the organization")
+		}
+	}
+	logvr(v, r).
+		Tag(tagAccount).
+		Fields(log.Context{
+			"org_id": org.ID,
+			"member": req.Username,
+		}).
+		Info("Removing member %s from organization %s", req.Username, org.Name)
+	if err := s.userManager.RemoveOrgMember(org.ID, req.Username); errors.Is(err, user.ErrInvalidArgument) {
+		return errHTTPBadRequestUserNotFound
+	} else if err != nil {
+		return err
+	}
+	topics, err := s.userManager.OrgTopics(org.ID)
+	if err != nil {
+		return err
+	}
+	for _, topic := range topics {
+		if !topic.Everyone.IsRead() {
+			if err := s.killUserSubscriberByName(req.Username, topic.Topic); err != nil {
+				return err
+			}
+		}
+	}
+	if member, err := s.userManager.User(req.Username); err == nil {
+		s.publishSyncEventAsync(s.visitor(netip.IPv4Unspecified(), member))
+	}
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+// handleAccountOrgInvitesGet returns the pending organization invites of the current user
+func (s *Server) handleAccountOrgInvitesGet(w http.ResponseWriter, _ *http.Request, v *visitor) error {
+	invites, err := s.userManager.OrgInvites(v.User().Name)
+	if err != nil {
+		return err
+	}
+	response := &apiAccountOrgInvitesResponse{
+		Invites: make([]*apiAccountOrgMembership, 0),
+	}
+	for _, invite := range invites {
+		response.Invites = append(response.Invites, &apiAccountOrgMembership{
+			ID:   invite.ID,
+			Name: invite.Name,
+			Role: string(invite.Role),
+		})
+	}
+	return s.writeJSON(w, response)
+}
+
+// handleAccountOrgInviteAccept accepts a pending invite, and makes the current user a member of the organization
+func (s *Server) handleAccountOrgInviteAccept(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	matches := apiAccountOrgInviteSingleRegex.FindStringSubmatch(r.URL.Path)
+	if len(matches) != 2 {
+		return errHTTPInternalErrorInvalidPath
+	}
+	u := v.User()
+	if err := s.userManager.AcceptOrgInvite(matches[1], u.Name); errors.Is(err, user.ErrOrgInviteNotFound) {
+		return errHTTPNotFoundOrgInvite
+	} else if errors.Is(err, user.ErrOrgMemberExists) {
+		return errHTTPConflictOrgMemberExists
+	} else if err != nil {
+		return err
+	}
+	org, err := s.userManager.Org(matches[1])
+	if err != nil {
+		return err
+	}
+	u, err = s.userManager.User(u.Name)
+	if err != nil {
+		return err
+	}
+	logvr(v, r).
+		Tag(tagAccount).
+		Fields(log.Context{
+			"org_id": org.ID,
+			"role":   string(u.Org.Role),
+		}).
+		Info("Joined organization %s", org.Name)
+	return s.writeJSON(w, &apiAccountOrgMembership{
+		ID:   org.ID,
+		Name: org.Name,
+		Role: string(u.Org.Role),
+	})
+}
+
+// handleAccountOrgInviteDelete declines a pending invite of the current user
+func (s *Server) handleAccountOrgInviteDelete(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	matches := apiAccountOrgInviteSingleRegex.FindStringSubmatch(r.URL.Path)
+	if len(matches) != 2 {
+		return errHTTPInternalErrorInvalidPath
+	}
+	if err := s.userManager.RemoveOrgInvite(matches[1], v.User().Name); errors.Is(err, user.ErrOrgInviteNotFound) {
+		return errHTTPNotFoundOrgInvite
+	} else if err != nil {
+		return err
+	}
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+// handleAccountOrgTopicAdd reserves a topic for the organization of the current user, or changes the everyone
+// permission of an existing organization topic
+func (s *Server) handleAccountOrgTopicAdd(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	org, err := s.currentOrgWithRole(v.User(), user.OrgRoleAdmin)
+	if err != nil {
+		return err
+	}
+	req, err := readJSONWithLimit[apiAccountOrgTopicRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	} else if !topicRegex.MatchString(req.Topic) {
+		return errHTTPBadRequestTopicInvalid
+	}
+	everyone := user.PermissionDenyAll
+	if req.Everyone != "" {
+		everyone, err = user.ParsePermission(req.Everyone)
+		if err != nil || everyone.IsManage() {
+			return errHTTPBadRequestPermissionInvalid
+		}
+	}
+	if org.Tier == nil {
+		return errHTTPTooManyRequestsLimitOrgTopics.Wrap("organization has no tier")
+	}
+	topics, err := s.userManager.OrgTopics(org.ID)
+	if err != nil {
+		return err
+	}
+	exists := false
+	for _, topic := range topics {
+		if topic.Topic == req.Topic {
+			exists = true
+			break
+		}
+	}
+	if !exists && int64(len(topics)) >= org.Tier.ReservationLimit {
+		return errHTTPTooManyRequestsLimitOrgTopics
+	}
+	logvr(v, r).
+		Tag(tagAccount).
+		Fields(log.Context{
+			"org_id":   org.ID,
+			"topic":    req.Topic,
+			"everyone": everyone.String(),
+		}).
+		Info("Reserving topic %s for organization %s", req.Topic, org.Name)
+	if err := s.userManager.AddOrgTopic(org.ID, req.Topic, everyone); errors.Is(err, user.ErrInvalidArgument) {
+		return errHTTPBadRequestTopicInvalid
+	} else if err != nil {
+		return errHTTPConflictTopicReserved
+	}
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+// handleAccountOrgTopicDelete removes a topic reservation of the organization of the current user, and deletes
+// the messages of the topic
+func (s *Server) handleAccountOrgTopicDelete(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	matches := apiAccountOrgTopicSingleRegex.FindStringSubmatch(r.URL.Path)
+	if len(matches) != 2 {
+		return errHTTPInternalErrorInvalidPath
+	}
+	topic := matches[1]
+	org, err := s.currentOrgWithRole(v.User(), user.OrgRoleAdmin)
+	if err != nil {
+		return err
+	}
+	logvr(v, r).
+		Tag(tagAccount).
+		Fields(log.Context{
+			"org_id": org.ID,
+			"topic":  topic,
+		}).
+		Info("Removing reservation of topic %s for organization %s", topic, org.Name)
+	if err := s.userManager.RemoveOrgTopic(org.ID, topic); errors.Is(err, user.ErrOrgTopicNotFound) {
+		return errHTTPUnauthorized
+	} else if err != nil {
+		return err
+	}
+	if err := s.messageCache.ExpireMessages(topic); err != nil {
+		return err
+	}
+	go s.pruneMessages()
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+// handleAccountOrgBillingSubscriptionCreate creates a Stripe checkout flow for a subscription of the organization.
+// Like for users, the tier is updated by the checkout success handler and subsequent webhooks from Stripe.
+func (s *Server) handleAccountOrgBillingSubscriptionCreate(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	org, err := s.currentOrgWithRole(v.User(), user.OrgRoleOwner)
+	if err != nil {
+		return err
+	} else if org.Billing.StripeSubscriptionID != "" {
+		return errHTTPBadRequestBillingSubscriptionExists
+	}
+	req, err := readJSONWithLimit[apiAccountBillingSubscriptionChangeRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	}
+	sess, err := s.newStripeCheckoutSession(r, v, req, org.Billing.StripeCustomerID, org.ID, s.config().BaseURL+apiAccountOrgBillingCheckoutSuccessTemplate)
+	if err != nil {
+		return err
+	}
+	response := &apiAccountBillingSubscriptionCreateResponse{
+		RedirectURL: sess.URL,
+	}
+	return s.writeJSON(w, response)
+}
+
+// handleAccountOrgBillingSubscriptionCreateSuccess is called after the Stripe checkout session for an organization
+// has succeeded, see handleAccountBillingSubscriptionCreateSuccess. This maps the organization to the Stripe customer.
+func (s *Server) handleAccountOrgBillingSubscriptionCreateSuccess(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	matches := apiAccountOrgBillingCheckoutSuccessRegex.FindStringSubmatch(r.URL.Path)
+	if len(matches) != 2 {
+		return errHTTPInternalErrorInvalidPath
+	}
+	sess, err := s.stripe.GetSession(matches[1])
+	if err != nil {
+		return err
+	} else if sess.Customer == nil || sess.Subscription == nil || sess.ClientReferenceID == "" {
+		return errHTTPBadRequestBillingRequestInvalid.Wrap("customer or subscription not found")
+	}
+	sub, err := s.stripe.GetSubscription(sess.Subscription.ID)
+	if err != nil {
+		return err
+	}
+	item := stripeFlatSubscriptionItem(sub.Items)
+	if item == nil || item.Price == nil || item.Price.Recurring == nil {
+		return errHTTPBadRequestBillingRequestInvalid.Wrap("more than one line item in existing subscription")
+	}
+	priceID, interval := item.Price.ID, item.Price.Recurring.Interval
+	tier, err := s.userManager.TierByStripePrice(priceID)
+	if err != nil {
+		return err
+	}
+	org, err := s.userManager.Org(sess.ClientReferenceID)
+	if err != nil {
+		return err
+	}
+	logvr(v, r).
+		With(tier).
+		Tag(tagStripe).
+		Fields(log.Context{
+			"org_id":                         org.ID,
+			"stripe_customer_id":             sess.Customer.ID,
+			"stripe_price_id":                priceID,
+			"stripe_subscription_id":         sub.ID,
+			"stripe_subscription_status":     string(sub.Status),
+			"stripe_subscription_interval":   string(interval),
+			"stripe_subscription_paid_until": sub.CurrentPeriodEnd,
+		}).
+		Info("Stripe checkout flow succeeded, updating organization tier and subscription")
+	customerParams := &stripe.CustomerParams{
+		Params: stripe.Params{
+			Metadata: map[string]string{
+				"org_id":   org.ID,
+				"org_name": org.Name,
+			},
+		},
+	}
+	if _, err := s.stripe.UpdateCustomer(sess.Customer.ID, customerParams); err != nil {
+		return err
+	}
+	if err := s.updateOrgSubscriptionAndTier(r, v, org, tier, sess.Customer.ID, sub.ID, string(sub.Status), string(interval), sub.CurrentPeriodEnd, sub.CancelAt); err != nil {
+		return err
+	}
+	http.Redirect(w, r, s.config().BaseURL+accountPath, http.StatusSeeOther)
+	return nil
+}
+
+// handleAccountOrgBillingSubscriptionDelete cancels the subscription of the organization at the end of the billing
+// period. The tier is reset by the webhook at the period end.
+func (s *Server) handleAccountOrgBillingSubscriptionDelete(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	org, err := s.currentOrgWithRole(v.User(), user.OrgRoleOwner)
+	if err != nil {
+		return err
+	}
+	logvr(v, r).Tag(tagStripe).Field("org_id", org.ID).Info("Deleting Stripe subscription of organization")
+	if org.Billing.StripeSubscriptionID != "" {
+		params := &stripe.SubscriptionParams{
+			CancelAtPeriodEnd: stripe.Bool(true),
+		}
+		if _, err := s.stripe.UpdateSubscription(org.Billing.StripeSubscriptionID, params); err != nil {
+			return err
+		}
+	}
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+// handleAccountOrgBillingPortalSessionCreate creates a session to the Stripe billing portal for the organization
+func (s *Server) handleAccountOrgBillingPortalSessionCreate(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	org, err := s.currentOrgWithRole(v.User(), user.OrgRoleOwner)
+	if err != nil {
+		return err
+	} else if org.Billing.StripeCustomerID == "" {
+		return errHTTPBadRequestNotAPaidUser
+	}
+	logvr(v, r).Tag(tagStripe).Field("org_id", org.ID).Info("Creating Stripe billing portal session for organization")
+	params := &stripe.BillingPortalSessionParams{
+		Customer:  stripe.String(org.Billing.StripeCustomerID),
+		ReturnURL: stripe.String(s.config().BaseURL),
+	}
+	ps, err := s.stripe.NewPortalSession(params)
+	if err != nil {
+		return err
+	}
+	response := &apiAccountBillingPortalRedirectResponse{
+		RedirectURL: ps.URL,
+	}
+	return s.writeJSON(w, response)
+}
+
+// updateOrgSubscriptionAndTier updates the tier and billing fields of the organization, see updateSubscriptionAndTier.
+// If the new tier allows fewer reservations, excess organization topics are removed, and their messages deleted.
+func (s *Server) updateOrgSubscriptionAndTier(r *http.Request, v *visitor, org *user.Org, tier *user.Tier, customerID, subscriptionID, status, interval string, paidUntil, cancelAt int64) error {
+	ev := logvr(v, r).Tag(tagStripe).Field("org_id", org.ID)
+	var reservationsLimit int64
+	if tier != nil {
+		reservationsLimit = tier.ReservationLimit
+	}
+	topics, err := s.userManager.OrgTopics(org.ID)
+	if err != nil {
+		return err
+	}
+	if int64(len(topics)) > reservationsLimit {
+		excessTopics := make([]string, 0)
+		for i := int64(len(topics)) - 1; i >= reservationsLimit; i-- {
+			if err := s.userManager.RemoveOrgTopic(org.ID, topics[i].Topic); err != nil {
+				return err
+			}
+			excessTopics = append(excessTopics, topics[i].Topic)
+		}
+		if err := s.messageCache.ExpireMessages(excessTopics...); err != nil {
+			return err
+		}
+		go s.pruneMessages()
+		ev.Info("Removed excess organization reservations for topics %s", strings.Join(excessTopics, ", "))
+	}
+	if tier == nil && org.Tier != nil {
+		ev.Info("Resetting tier for organization %s", org.Name)
+		if err := s.userManager.ResetOrgTier(org.ID); err != nil {
+			return err
+		}
+	} else if tier != nil && (org.Tier == nil || org.Tier.ID != tier.ID) {
+		ev.
+			Fields(log.Context{
+				"new_tier_id":   tier.ID,
+				"new_tier_code": tier.Code,
+			}).
+			Info("Changing tier to tier %s (%s) for organization %s", tier.ID, tier.Name, org.Name)
+		if err := s.userManager.ChangeOrgTier(org.ID, tier.Code); err != nil {
+			return err
+		}
+	}
+	billing := &user.Billing{
+		StripeCustomerID:            customerID,
+		StripeSubscriptionID:        subscriptionID,
+		StripeSubscriptionStatus:    stripe.SubscriptionStatus(status),
+		StripeSubscriptionInterval:  stripe.PriceRecurringInterval(interval),
+		StripeSubscriptionPaidUntil: time.Unix(paidUntil, 0),
+		StripeSubscriptionCancelAt:  time.Unix(cancelAt, 0),
+	}
+	return s.userManager.ChangeOrgBilling(org.ID, billing)
+}
+
+// currentOrg returns the organization of the user, or errHTTPNotFoundOrg if the user is not a member of one
+func (s *Server) currentOrg(u *user.User) (*user.Org, error) {
+	if u.Org == nil {
+		return nil, errHTTPNotFoundOrg
+	}
+	org, err := s.userManager.Org(u.Org.ID)
+	if errors.Is(err, user.ErrOrgNotFound) {
+		return nil, errHTTPNotFoundOrg
+	} else if err != nil {
+		return nil, err
+	}
+	return org, nil
+}
+
+// currentOrgWithRole returns the organization of the user, if the user has at least the given role in it
+func (s *Server) currentOrgWithRole(u *user.User, role user.OrgRole) (*user.Org, error) {
+	org, err := s.currentOrg(u)
+	if err != nil {
+		return nil, err
+	} else if role == user.OrgRoleOwner && u.Org.Role != user.OrgRoleOwner {
+		return nil, errHTTPForbiddenNotOrgAdmin
+	} else if role == user.OrgRoleAdmin && !u.Org.Role.IsOrgAdmin() {
+		return nil, errHTTPForbiddenNotOrgAdmin
+	}
+	return org, nil
+}
+
+// ensureOtherOrgOwner returns an error if the user is the only owner of their organization, so that deleting the
+// account does not leave the organization without an owner
+func (s *Server) ensureOtherOrgOwner(u *user.User) error {
+	members, err := s.userManager.OrgMembers(u.Org.ID)
+	if err != nil {
+		return err
+	}
+	for _, member := range members {
+		if member.Username != u.Name && member.Role == user.OrgRoleOwner {
+			return nil
+		}
+	}
+	return errHTTPBadRequest.Wrap("delete the organization %s, or make another member its owner first", u.Org.Name)
+}
@@ -0,0 +1,309 @@
+package server
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/stripe-go/v74"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+func TestServer_Orgs_Invites(t *testing.T) {
+	conf := newTestConfigWithAuthFile(t)
+	s := newTestServer(t, conf)
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	require.Nil(t, s.userManager.AddUser("emma", "emma", user.RoleUser))
+	philAuth := map[string]string{"Authorization": util.BasicAuth("phil", "phil")}
+	benAuth := map[string]string{"Authorization": util.BasicAuth("ben", "ben")}
+	emmaAuth := map[string]string{"Authorization": util.BasicAuth("emma", "emma")}
+
+	// Phil and ben each create an organization
+	rr := request(t, s, "POST", "/v1/account/org", `{"name":"Acme"}`, philAuth)
+	require.Equal(t, 200, rr.Code)
+	acme, _ := util.UnmarshalJSON[apiAccountOrgMembership](io.NopCloser(rr.Body))
+	rr = request(t, s, "POST", "/v1/account/org", `{"name":"Ben Inc"}`, benAuth)
+	require.Equal(t, 200, rr.Code)
+
+	// Inviting does not reveal whether a user exists, or whether they are a member of another organization
+	rr = request(t, s, "POST", "/v1/account/org/members", `{"username":"nobody"}`, philAuth)
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "POST", "/v1/account/org/members", `{"username":"ben"}`, philAuth)
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "GET", "/v1/account/org", "", benAuth)
+	require.Equal(t, 200, rr.Code)
+	account, _ := util.UnmarshalJSON[apiAccountOrgResponse](io.NopCloser(rr.Body))
+	require.Equal(t, "Ben Inc", account.Name) // Still in his own organization
+	rr = request(t, s, "POST", "/v1/account/org/invites/"+acme.ID, "", benAuth)
+	require.Equal(t, 409, rr.Code)
+	require.Equal(t, 40907, toHTTPError(t, rr.Body.String()).Code)
+
+	// Invites can be declined, and revoked by the organization
+	rr = request(t, s, "DELETE", "/v1/account/org/invites/"+acme.ID, "", benAuth)
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "DELETE", "/v1/account/org/invites/"+acme.ID, "", benAuth)
+	require.Equal(t, 404, rr.Code)
+	rr = request(t, s, "POST", "/v1/account/org/members", `{"username":"emma","role":"admin"}`, philAuth)
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "DELETE", "/v1/account/org/members", `{"username":"emma"}`, philAuth)
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "GET", "/v1/account/org/invites", "", emmaAuth)
+	require.Equal(t, 200, rr.Code)
+	invites, _ := util.UnmarshalJSON[apiAccountOrgInvitesResponse](io.NopCloser(rr.Body))
+	require.Equal(t, 0, len(invites.Invites))
+
+	// Accepting an invite makes the user a member with the invited role
+	rr = request(t, s, "POST", "/v1/account/org/members", `{"username":"emma","role":"admin"}`, philAuth)
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "POST", "/v1/account/org/invites/"+acme.ID, "", emmaAuth)
+	require.Equal(t, 200, rr.Code)
+	membership, _ := util.UnmarshalJSON[apiAccountOrgMembership](io.NopCloser(rr.Body))
+	require.Equal(t, acme.ID, membership.ID)
+	require.Equal(t, "admin", membership.Role)
+	rr = request(t, s, "POST", "/v1/account/org/members", `{"username":"emma","role":"member"}`, philAuth)
+	require.Equal(t, 200, rr.Code) // Changing the role of a member does not require an invite
+	rr = request(t, s, "GET", "/v1/account/org", "", emmaAuth)
+	require.Equal(t, 200, rr.Code)
+	account, _ = util.UnmarshalJSON[apiAccountOrgResponse](io.NopCloser(rr.Body))
+	require.Equal(t, "member", account.Role)
+}
+
+func TestServer_Orgs_Members_Topics(t *testing.T) {
+	conf := newTestConfigWithAuthFile(t)
+	conf.AuthDefault = user.PermissionDenyAll
+	s := newTestServer(t, conf)
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddTier(&user.Tier{
+		Code:             "team",
+		MessageLimit:     100,
+		ReservationLimit: 1,
+	}))
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	philAuth := map[string]string{"Authorization": util.BasicAuth("phil", "phil")}
+	benAuth := map[string]string{"Authorization": util.BasicAuth("ben", "ben")}
+
+	// Create organization, and invite ben as a member
+	rr := request(t, s, "GET", "/v1/account/org", "", philAuth)
+	require.Equal(t, 404, rr.Code)
+	rr = request(t, s, "POST", "/v1/account/org", `{"name":"Acme"}`, philAuth)
+	require.Equal(t, 200, rr.Code)
+	org, _ := util.UnmarshalJSON[apiAccountOrgMembership](io.NopCloser(rr.Body))
+	require.Equal(t, "Acme", org.Name)
+	require.Equal(t, "owner", org.Role)
+	rr = request(t, s, "POST", "/v1/account/org", `{"name":"Acme 2"}`, philAuth)
+	require.Equal(t, 40907, toHTTPError(t, rr.Body.String()).Code)
+	rr = request(t, s, "POST", "/v1/account/org/members", `{"username":"ben"}`, philAuth)
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "GET", "/v1/account/org", "", benAuth)
+	require.Equal(t, 404, rr.Code) // Not a member until the invite is accepted
+	rr = request(t, s, "GET", "/v1/account/org/invites", "", benAuth)
+	require.Equal(t, 200, rr.Code)
+	invites, _ := util.UnmarshalJSON[apiAccountOrgInvitesResponse](io.NopCloser(rr.Body))
+	require.Equal(t, 1, len(invites.Invites))
+	require.Equal(t, org.ID, invites.Invites[0].ID)
+	require.Equal(t, "Acme", invites.Invites[0].Name)
+	require.Equal(t, "member", invites.Invites[0].Role)
+	rr = request(t, s, "POST", "/v1/account/org/invites/"+org.ID, "", benAuth)
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "POST", "/v1/account/org/invites/"+org.ID, "", benAuth)
+	require.Equal(t, 40414, toHTTPError(t, rr.Body.String()).Code)
+
+	// Topics require an organization tier
+	rr = request(t, s, "POST", "/v1/account/org/topics", `{"topic":"acme","everyone":"read-only"}`, philAuth)
+	require.Equal(t, 42916, toHTTPError(t, rr.Body.String()).Code)
+	require.Nil(t, s.userManager.ChangeOrgTier(org.ID, "team"))
+	rr = request(t, s, "POST", "/v1/account/org/topics", `{"topic":"acme","everyone":"read-only"}`, benAuth)
+	require.Equal(t, 40311, toHTTPError(t, rr.Body.String()).Code)
+	rr = request(t, s, "POST", "/v1/account/org/topics", `{"topic":"acme","everyone":"read-only"}`, philAuth)
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "POST", "/v1/account/org/topics", `{"topic":"acme2"}`, philAuth)
+	require.Equal(t, 42916, toHTTPError(t, rr.Body.String()).Code)
+
+	// Members share the tier and the topic, everyone else can only read
+	rr = request(t, s, "GET", "/v1/account", "", benAuth)
+	require.Equal(t, 200, rr.Code)
+	account, _ := util.UnmarshalJSON[apiAccountResponse](io.NopCloser(rr.Body))
+	require.Equal(t, "team", account.Tier.Code)
+	require.Equal(t, org.ID, account.Org.ID)
+	require.Equal(t, "member", account.Org.Role)
+	rr = request(t, s, "PUT", "/acme", "from ben", benAuth)
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "PUT", "/acme", "from anonymous", nil)
+	require.Equal(t, 403, rr.Code)
+	rr = request(t, s, "GET", "/acme/json?poll=1", "", nil)
+	require.Equal(t, 200, rr.Code)
+
+	rr = request(t, s, "GET", "/v1/account/org", "", benAuth)
+	require.Equal(t, 200, rr.Code)
+	orgResponse, _ := util.UnmarshalJSON[apiAccountOrgResponse](io.NopCloser(rr.Body))
+	require.Equal(t, "team", orgResponse.Tier.Code)
+	require.Equal(t, int64(1), orgResponse.Limits.Reservations)
+	require.Equal(t, 2, len(orgResponse.Members))
+	require.Equal(t, "phil", orgResponse.Members[0].Username)
+	require.Equal(t, "owner", orgResponse.Members[0].Role)
+	require.Equal(t, 1, len(orgResponse.Topics))
+	require.Equal(t, "acme", orgResponse.Topics[0].Topic)
+	require.Equal(t, "read-only", orgResponse.Topics[0].Everyone)
+	require.Nil(t, orgResponse.Billing)
+
+	// Members cannot remove others, the owner cannot delete the account or leave
+	rr = request(t, s, "DELETE", "/v1/account/org/members", `{"username":"phil"}`, benAuth)
+	require.Equal(t, 40311, toHTTPError(t, rr.Body.String()).Code)
+	rr = request(t, s, "DELETE", "/v1/account", `{"password":"phil"}`, philAuth)
+	require.Equal(t, 400, rr.Code)
+
+	// Ben leaves, and loses access
+	rr = request(t, s, "DELETE", "/v1/account/org/members", `{"username":"ben"}`, benAuth)
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "PUT", "/acme", "from ben", benAuth)
+	require.Equal(t, 403, rr.Code)
+
+	// Delete the organization, which removes the topic reservation
+	rr = request(t, s, "DELETE", "/v1/account/org/topics/acme", "", benAuth)
+	require.Equal(t, 404, rr.Code)
+	rr = request(t, s, "DELETE", "/v1/account/org", "", philAuth)
+	require.Equal(t, 200, rr.Code)
+	require.Nil(t, s.userManager.AllowReservation("ben", "acme"))
+}
+
+func TestPayments_Webhook_Org_Subscription_Updated_And_Deleted(t *testing.T) {
+	stripeMock := &testStripeAPI{}
+	defer stripeMock.AssertExpectations(t)
+
+	c := newTestConfigWithAuthFile(t)
+	c.StripeSecretKey = "secret key"
+	c.StripeWebhookKey = "webhook key"
+	s := newTestServer(t, c)
+	s.stripe = stripeMock
+
+	stripeMock.
+		On("ConstructWebhookEvent", mock.Anything, "stripe signature", "webhook key").
+		Return(jsonToStripeEvent(t, subscriptionUpdatedEventJSON), nil).
+		Once()
+	stripeMock.
+		On("ConstructWebhookEvent", mock.Anything, "stripe signature", "webhook key").
+		Return(jsonToStripeEvent(t, subscriptionDeletedEventJSON), nil).
+		Once()
+
+	// Create an organization with a Stripe customer and two topics
+	require.Nil(t, s.userManager.AddTier(&user.Tier{
+		ID:                   "ti_1",
+		Code:                 "starter",
+		StripeMonthlyPriceID: "price_1234",
+		ReservationLimit:     1,
+	}))
+	require.Nil(t, s.userManager.AddTier(&user.Tier{
+		ID:               "ti_2",
+		Code:             "pro",
+		ReservationLimit: 2,
+	}))
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	org, err := s.userManager.AddOrg("Acme", "phil")
+	require.Nil(t, err)
+	require.Nil(t, s.userManager.ChangeOrgTier(org.ID, "pro"))
+	require.Nil(t, s.userManager.AddOrgTopic(org.ID, "atopic", user.PermissionDenyAll))
+	require.Nil(t, s.userManager.AddOrgTopic(org.ID, "ztopic", user.PermissionDenyAll))
+	require.Nil(t, s.userManager.ChangeOrgBilling(org.ID, &user.Billing{
+		StripeCustomerID:     "acct_5555",
+		StripeSubscriptionID: "sub_1234",
+	}))
+
+	// Subscription updated: the organization's tier changes, the excess topic is removed
+	rr := request(t, s, "POST", "/v1/account/billing/webhook", "dummy", map[string]string{
+		"Stripe-Signature": "stripe signature",
+	})
+	require.Equal(t, 200, rr.Code)
+	org, err = s.userManager.Org(org.ID)
+	require.Nil(t, err)
+	require.Equal(t, "starter", org.Tier.Code)
+	require.Equal(t, stripe.SubscriptionStatusActive, org.Billing.StripeSubscriptionStatus)
+	require.Equal(t, stripe.PriceRecurringIntervalYear, org.Billing.StripeSubscriptionInterval)
+	require.Equal(t, int64(1674268231), org.Billing.StripeSubscriptionPaidUntil.Unix())
+	topics, err := s.userManager.OrgTopics(org.ID)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(topics))
+	require.Equal(t, "atopic", topics[0].Topic)
+
+	// The owner's own account is not affected
+	u, err := s.userManager.User("phil")
+	require.Nil(t, err)
+	require.Equal(t, "", u.Billing.StripeCustomerID)
+	require.Equal(t, "starter", u.Tier.Code) // Inherited from the organization
+
+	// Subscription deleted: the organization's tier is reset
+	rr = request(t, s, "POST", "/v1/account/billing/webhook", "dummy", map[string]string{
+		"Stripe-Signature": "stripe signature",
+	})
+	require.Equal(t, 200, rr.Code)
+	org, err = s.userManager.Org(org.ID)
+	require.Nil(t, err)
+	require.Nil(t, org.Tier)
+	require.Equal(t, "acct_5555", org.Billing.StripeCustomerID)
+	require.Equal(t, "", org.Billing.StripeSubscriptionID)
+	require.Equal(t, int64(0), org.Billing.StripeSubscriptionPaidUntil.Unix())
+	topics, err = s.userManager.OrgTopics(org.ID)
+	require.Nil(t, err)
+	require.Equal(t, 0, len(topics))
+}
+
+func TestServer_Orgs_PooledLimits(t *testing.T) {
+	conf := newTestConfigWithAuthFile(t)
+	s := newTestServer(t, conf)
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddTier(&user.Tier{
+		Code:                  "team",
+		MessageLimit:          3,
+		MessageExpiryDuration: time.Hour,
+	}))
+	require.Nil(t, s.userManager.AddTier(&user.Tier{
+		Code:                  "pro",
+		MessageLimit:          10,
+		MessageExpiryDuration: time.Hour,
+	}))
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	require.Nil(t, s.userManager.AddUser("emma", "emma", user.RoleUser))
+	require.Nil(t, s.userManager.ChangeTier("emma", "pro")) // Has her own tier, so her limits are not pooled
+	org, err := s.userManager.AddOrg("Acme", "phil")
+	require.Nil(t, err)
+	require.Nil(t, s.userManager.ChangeOrgTier(org.ID, "team"))
+	for _, username := range []string{"ben", "emma"} {
+		require.Nil(t, s.userManager.AddOrgInvite(org.ID, username, user.OrgRoleMember))
+		require.Nil(t, s.userManager.AcceptOrgInvite(org.ID, username))
+	}
+	philAuth := map[string]string{"Authorization": util.BasicAuth("phil", "phil")}
+	benAuth := map[string]string{"Authorization": util.BasicAuth("ben", "ben")}
+	emmaAuth := map[string]string{"Authorization": util.BasicAuth("emma", "emma")}
+
+	// Phil and ben share the message limit of the organization's tier
+	for i := 0; i < 2; i++ {
+		rr := request(t, s, "PUT", "/mytopic", "from phil", philAuth)
+		require.Equal(t, 200, rr.Code)
+	}
+	rr := request(t, s, "GET", "/v1/account", "", benAuth)
+	require.Equal(t, 200, rr.Code)
+	account, _ := util.UnmarshalJSON[apiAccountResponse](io.NopCloser(rr.Body))
+	require.Equal(t, int64(0), account.Stats.Messages)
+	require.Equal(t, int64(1), account.Stats.MessagesRemaining)
+	rr = request(t, s, "PUT", "/mytopic", "from ben", benAuth)
+	require.Equal(t, 200, rr.Code)
+	rr = request(t, s, "PUT", "/mytopic", "from ben", benAuth)
+	require.Equal(t, 429, rr.Code)
+	rr = request(t, s, "PUT", "/mytopic", "from phil", philAuth)
+	require.Equal(t, 429, rr.Code)
+
+	// Members with their own tier are not affected
+	rr = request(t, s, "PUT", "/mytopic", "from emma", emmaAuth)
+	require.Equal(t, 200, rr.Code)
+
+	// Limits are reset daily
+	s.resetStats()
+	rr = request(t, s, "PUT", "/mytopic", "from ben", benAuth)
+	require.Equal(t, 200, rr.Code)
+}
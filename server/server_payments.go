@@ -9,7 +9,9 @@ import (
 	"github.com/stripe/stripe-go/v74/checkout/session"
 	"github.com/stripe/stripe-go/v74/customer"
 	"github.com/stripe/stripe-go/v74/price"
+	"github.com/stripe/stripe-go/v74/promotioncode"
 	"github.com/stripe/stripe-go/v74/subscription"
+	"github.com/stripe/stripe-go/v74/usagerecord"
 	"github.com/stripe/stripe-go/v74/webhook"
 	"heckel.io/ntfy/v2/log"
 	"heckel.io/ntfy/v2/user"
@@ -41,11 +43,18 @@ import (
 //      Whenever a subscription changes (updated, deleted), Stripe sends us a request via a webhook.
 //      This is used to keep the local user database fields up to date. Stripe is the source of truth.
 //      What Stripe says is mirrored and not questioned.
+// - Promotion codes:
+//      Users can enter a promotion code on the Stripe checkout page, or pass it when creating or updating the
+//      subscription. Promotion codes with the metadata "public" set to "true" are listed with the tiers they
+//      apply to in handleBillingTiersGet, so the web app can show them.
+// - Metered billing:
+//      Reporting usage for pay-as-you-go tiers is implemented in server_payments_metered.go.
 
 var (
 	errNotAPaidTier                 = errors.New("tier does not have billing price identifier")
 	errMultipleBillingSubscriptions = errors.New("cannot have multiple billing subscriptions")
 	errNoBillingSubscription        = errors.New("user does not have an active billing subscription")
+	errStripeEventDataMissing       = errors.New("stripe event data missing")
 )
 
 var (
@@ -59,7 +68,7 @@ func (s *Server) handleBillingTiersGet(w http.ResponseWriter, _ *http.Request, _
 	if err != nil {
 		return err
 	}
-	freeTier := configBasedVisitorLimits(s.config)
+	freeTier := configBasedVisitorLimits(s.config())
 	response := []*apiAccountBillingTier{
 		{
 			// This is a bit of a hack: This is the "Free" tier. It has no tier code, name or price.
@@ -80,18 +89,23 @@ func (s *Server) handleBillingTiersGet(w http.ResponseWriter, _ *http.Request, _
 	if err != nil {
 		return err
 	}
+	promotionCodes, err := s.discountCache.Value()
+	if err != nil {
+		return err
+	}
 	for _, tier := range tiers {
 		priceMonth, priceYear := prices[tier.StripeMonthlyPriceID], prices[tier.StripeYearlyPriceID]
-		if priceMonth == 0 || priceYear == 0 { // Only allow tiers that have both prices!
+		if priceMonth == nil || priceYear == nil || priceMonth.UnitAmount == 0 || priceYear.UnitAmount == 0 { // Only allow tiers that have both prices!
 			continue
 		}
 		response = append(response, &apiAccountBillingTier{
 			Code: tier.Code,
 			Name: tier.Name,
 			Prices: &apiAccountBillingPrices{
-				Month: priceMonth,
-				Year:  priceYear,
+				Month: priceMonth.UnitAmount,
+				Year:  priceYear.UnitAmount,
 			},
+			Discounts: newAccountBillingDiscounts(promotionCodes, priceMonth),
 			Limits: &apiAccountLimits{
 				Basis:                    string(visitorLimitBasisTier),
 				Messages:                 tier.MessageLimit,
@@ -119,17 +133,30 @@ func (s *Server) handleAccountBillingSubscriptionCreate(w http.ResponseWriter, r
 	if err != nil {
 		return err
 	}
-	tier, err := s.userManager.Tier(req.Tier)
+	sess, err := s.newStripeCheckoutSession(r, v, req, u.Billing.StripeCustomerID, u.ID, s.config().BaseURL+apiAccountBillingSubscriptionCheckoutSuccessTemplate)
 	if err != nil {
 		return err
 	}
+	response := &apiAccountBillingSubscriptionCreateResponse{
+		RedirectURL: sess.URL,
+	}
+	return s.writeJSON(w, response)
+}
+
+// newStripeCheckoutSession creates a Stripe checkout session for a subscription to the requested tier and interval.
+// The client reference ID is passed back to the checkout success handler, see handleAccountBillingSubscriptionCreateSuccess.
+func (s *Server) newStripeCheckoutSession(r *http.Request, v *visitor, req *apiAccountBillingSubscriptionChangeRequest, customerID, clientReferenceID, successURL string) (*stripe.CheckoutSession, error) {
+	tier, err := s.userManager.Tier(req.Tier)
+	if err != nil {
+		return nil, err
+	}
 	var priceID string
 	if req.Interval == string(stripe.PriceRecurringIntervalMonth) && tier.StripeMonthlyPriceID != "" {
 		priceID = tier.StripeMonthlyPriceID
 	} else if req.Interval == string(stripe.PriceRecurringIntervalYear) && tier.StripeYearlyPriceID != "" {
 		priceID = tier.StripeYearlyPriceID
 	} else {
-		return errNotAPaidTier
+		return nil, errNotAPaidTier
 	}
 	logvr(v, r).
 		With(tier).
@@ -140,40 +167,50 @@ func (s *Server) handleAccountBillingSubscriptionCreate(w http.ResponseWriter, r
 		Tag(tagStripe).
 		Info("Creating Stripe checkout flow")
 	var stripeCustomerID *string
-	if u.Billing.StripeCustomerID != "" {
-		stripeCustomerID = &u.Billing.StripeCustomerID
-		stripeCustomer, err := s.stripe.GetCustomer(u.Billing.StripeCustomerID)
+	if customerID != "" {
+		stripeCustomerID = &customerID
+		stripeCustomer, err := s.stripe.GetCustomer(customerID)
 		if err != nil {
-			return err
+			return nil, err
 		} else if stripeCustomer.Subscriptions != nil && len(stripeCustomer.Subscriptions.Data) > 0 {
-			return errMultipleBillingSubscriptions
+			return nil, errMultipleBillingSubscriptions
 		}
 	}
-	successURL := s.config.BaseURL + apiAccountBillingSubscriptionCheckoutSuccessTemplate
+	lineItems := []*stripe.CheckoutSessionLineItemParams{
+		{
+			Price:    stripe.String(priceID),
+			Quantity: stripe.Int64(1),
+		},
+	}
+	for _, meteredPriceID := range stripeMeteredPriceIDs(tier, req.Interval) {
+		lineItems = append(lineItems, &stripe.CheckoutSessionLineItemParams{
+			Price: stripe.String(meteredPriceID), // Metered prices must not have a quantity
+		})
+	}
 	params := &stripe.CheckoutSessionParams{
 		Customer:            stripeCustomerID, // A user may have previously deleted their subscription
-		ClientReferenceID:   &u.ID,
+		ClientReferenceID:   &clientReferenceID,
 		SuccessURL:          &successURL,
 		Mode:                stripe.String(string(stripe.CheckoutSessionModeSubscription)),
 		AllowPromotionCodes: stripe.Bool(true),
-		LineItems: []*stripe.CheckoutSessionLineItemParams{
-			{
-				Price:    stripe.String(priceID),
-				Quantity: stripe.Int64(1),
-			},
-		},
+		LineItems:           lineItems,
 		AutomaticTax: &stripe.CheckoutSessionAutomaticTaxParams{
 			Enabled: stripe.Bool(true),
 		},
 	}
-	sess, err := s.stripe.NewCheckoutSession(params)
-	if err != nil {
-		return err
-	}
-	response := &apiAccountBillingSubscriptionCreateResponse{
-		RedirectURL: sess.URL,
+	if req.PromotionCode != "" {
+		promotionCode, err := s.stripePromotionCode(req.PromotionCode)
+		if err != nil {
+			return nil, err
+		}
+		params.AllowPromotionCodes = nil // Stripe does not allow both
+		params.Discounts = []*stripe.CheckoutSessionDiscountParams{
+			{
+				PromotionCode: stripe.String(promotionCode.ID),
+			},
+		}
 	}
-	return s.writeJSON(w, response)
+	return s.stripe.NewCheckoutSession(params)
 }
 
 // handleAccountBillingSubscriptionCreateSuccess is called after the Stripe checkout session has succeeded. We use
@@ -195,10 +232,12 @@ func (s *Server) handleAccountBillingSubscriptionCreateSuccess(w http.ResponseWr
 	sub, err := s.stripe.GetSubscription(sess.Subscription.ID)
 	if err != nil {
 		return err
-	} else if sub.Items == nil || len(sub.Items.Data) != 1 || sub.Items.Data[0].Price == nil || sub.Items.Data[0].Price.Recurring == nil {
+	}
+	item := stripeFlatSubscriptionItem(sub.Items)
+	if item == nil || item.Price == nil || item.Price.Recurring == nil {
 		return errHTTPBadRequestBillingRequestInvalid.Wrap("more than one line item in existing subscription")
 	}
-	priceID, interval := sub.Items.Data[0].Price.ID, sub.Items.Data[0].Price.Recurring.Interval
+	priceID, interval := item.Price.ID, item.Price.Recurring.Interval
 	tier, err := s.userManager.TierByStripePrice(priceID)
 	if err != nil {
 		return err
@@ -234,7 +273,7 @@ func (s *Server) handleAccountBillingSubscriptionCreateSuccess(w http.ResponseWr
 	if err := s.updateSubscriptionAndTier(r, v, u, tier, sess.Customer.ID, sub.ID, string(sub.Status), string(interval), sub.CurrentPeriodEnd, sub.CancelAt); err != nil {
 		return err
 	}
-	http.Redirect(w, r, s.config.BaseURL+accountPath, http.StatusSeeOther)
+	http.Redirect(w, r, s.config().BaseURL+accountPath, http.StatusSeeOther)
 	return nil
 }
 
@@ -274,18 +313,55 @@ func (s *Server) handleAccountBillingSubscriptionUpdate(w http.ResponseWriter, r
 	sub, err := s.stripe.GetSubscription(u.Billing.StripeSubscriptionID)
 	if err != nil {
 		return err
-	} else if sub.Items == nil || len(sub.Items.Data) != 1 {
+	}
+	item := stripeFlatSubscriptionItem(sub.Items)
+	if item == nil {
 		return errHTTPBadRequestBillingRequestInvalid.Wrap("no items, or more than one item")
 	}
+	items := []*stripe.SubscriptionItemsParams{
+		{
+			ID:    stripe.String(item.ID),
+			Price: stripe.String(priceID),
+		},
+	}
+	if meteredTier(u.Tier) {
+		// Report usage so far, so that it is included in the invoice for the change (see ProrationBehavior below)
+		if err := s.reportStripeSubscriptionUsage(u, sub, time.Unix(sub.CurrentPeriodStart, 0), time.Now(), time.Now()); err != nil {
+			return err
+		}
+	}
+	meteredPriceIDs := stripeMeteredPriceIDs(tier, req.Interval)
+	existingPriceIDs := make([]string, 0)
+	for _, existing := range sub.Items.Data {
+		if existing.ID == item.ID {
+			continue
+		} else if existing.Price != nil && util.Contains(meteredPriceIDs, existing.Price.ID) {
+			existingPriceIDs = append(existingPriceIDs, existing.Price.ID) // Keep metered items of the new tier
+			continue
+		}
+		items = append(items, &stripe.SubscriptionItemsParams{
+			ID:      stripe.String(existing.ID),
+			Deleted: stripe.Bool(true),
+		})
+	}
+	for _, meteredPriceID := range meteredPriceIDs {
+		if !util.Contains(existingPriceIDs, meteredPriceID) {
+			items = append(items, &stripe.SubscriptionItemsParams{
+				Price: stripe.String(meteredPriceID),
+			})
+		}
+	}
 	params := &stripe.SubscriptionParams{
 		CancelAtPeriodEnd: stripe.Bool(false),
 		ProrationBehavior: stripe.String(string(stripe.SubscriptionSchedulePhaseProrationBehaviorAlwaysInvoice)),
-		Items: []*stripe.SubscriptionItemsParams{
-			{
-				ID:    stripe.String(sub.Items.Data[0].ID),
-				Price: stripe.String(priceID),
-			},
-		},
+		Items:             items,
+	}
+	if req.PromotionCode != "" {
+		promotionCode, err := s.stripePromotionCode(req.PromotionCode)
+		if err != nil {
+			return err
+		}
+		params.PromotionCode = stripe.String(promotionCode.ID)
 	}
 	_, err = s.stripe.UpdateSubscription(sub.ID, params)
 	if err != nil {
@@ -322,7 +398,7 @@ func (s *Server) handleAccountBillingPortalSessionCreate(w http.ResponseWriter,
 	}
 	params := &stripe.BillingPortalSessionParams{
 		Customer:  stripe.String(u.Billing.StripeCustomerID),
-		ReturnURL: stripe.String(s.config.BaseURL),
+		ReturnURL: stripe.String(s.config().BaseURL),
 	}
 	ps, err := s.stripe.NewPortalSession(params)
 	if err != nil {
@@ -335,51 +411,39 @@ func (s *Server) handleAccountBillingPortalSessionCreate(w http.ResponseWriter,
 }
 
 // handleAccountBillingWebhook handles incoming Stripe webhooks. It mainly keeps the local user database in sync
-// with the Stripe view of the world. This endpoint is authorized via the Stripe webhook secret. Note that the
-// visitor (v) in this endpoint is the Stripe API, so we don't have u available.
-func (s *Server) handleAccountBillingWebhook(_ http.ResponseWriter, r *http.Request, v *visitor) error {
-	stripeSignature := r.Header.Get("Stripe-Signature")
-	if stripeSignature == "" {
-		return errHTTPBadRequestBillingRequestInvalid
-	}
-	body, err := util.Peek(r.Body, jsonBodyBytesLimit)
-	if err != nil {
-		return err
-	} else if body.LimitReached {
-		return errHTTPEntityTooLargeJSONBody
-	}
-	event, err := s.stripe.ConstructWebhookEvent(body.PeekedBytes, stripeSignature, s.config.StripeWebhookKey)
+// with the Stripe view of the world. This endpoint is authorized via the Stripe webhook secret. Verification,
+// deduplication and dispatching of the events is done in handleWebhook.
+func (s *Server) handleAccountBillingWebhook(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	secrets, err := s.signingSecrets(signingKeyPurposeStripeWebhook, s.config().StripeWebhookKey)
 	if err != nil {
 		return err
-	} else if event.Data == nil || event.Data.Raw == nil {
-		return errHTTPBadRequestBillingRequestInvalid
 	}
-	switch event.Type {
-	case "customer.subscription.updated":
-		return s.handleAccountBillingWebhookSubscriptionUpdated(r, v, event)
-	case "customer.subscription.deleted":
-		return s.handleAccountBillingWebhookSubscriptionDeleted(r, v, event)
-	default:
-		logvr(v, r).
-			Tag(tagStripe).
-			Field("stripe_webhook_type", event.Type).
-			Warn("Unhandled Stripe webhook event %s received", event.Type)
-		return nil
+	verifier := &stripeWebhookVerifier{
+		api:     s.stripe,
+		secrets: secrets,
 	}
+	return s.handleWebhook(verifier, map[string]webhookHandler{
+		"customer.subscription.updated": s.handleAccountBillingWebhookSubscriptionUpdated,
+		"customer.subscription.deleted": s.handleAccountBillingWebhookSubscriptionDeleted,
+		"invoice.created":               s.handleAccountBillingWebhookInvoiceCreated,
+	})(w, r, v)
 }
 
-func (s *Server) handleAccountBillingWebhookSubscriptionUpdated(r *http.Request, v *visitor, event stripe.Event) error {
-	ev, err := util.UnmarshalJSON[apiStripeSubscriptionUpdatedEvent](io.NopCloser(bytes.NewReader(event.Data.Raw)))
+func (s *Server) handleAccountBillingWebhookSubscriptionUpdated(r *http.Request, v *visitor, event *webhookEvent) error {
+	ev, err := util.UnmarshalJSON[apiStripeSubscriptionUpdatedEvent](io.NopCloser(bytes.NewReader(event.Data)))
 	if err != nil {
 		return err
-	} else if ev.ID == "" || ev.Customer == "" || ev.Status == "" || ev.CurrentPeriodEnd == 0 || ev.Items == nil || len(ev.Items.Data) != 1 || ev.Items.Data[0].Price == nil || ev.Items.Data[0].Price.ID == "" || ev.Items.Data[0].Price.Recurring == nil {
+	}
+	item := ev.flatItem()
+	if ev.ID == "" || ev.Customer == "" || ev.Status == "" || ev.CurrentPeriodEnd == 0 || item == nil || item.Price == nil || item.Price.ID == "" || item.Price.Recurring == nil {
 		logvr(v, r).Tag(tagStripe).Field("stripe_request", fmt.Sprintf("%#v", ev)).Warn("Unexpected request from Stripe")
 		return errHTTPBadRequestBillingRequestInvalid
 	}
-	subscriptionID, priceID, interval := ev.ID, ev.Items.Data[0].Price.ID, ev.Items.Data[0].Price.Recurring.Interval
+	subscriptionID, priceID, interval := ev.ID, item.Price.ID, item.Price.Recurring.Interval
 	logvr(v, r).
 		Tag(tagStripe).
 		Fields(log.Context{
+			"stripe_webhook_id":              event.ID,
 			"stripe_webhook_type":            event.Type,
 			"stripe_customer_id":             ev.Customer,
 			"stripe_price_id":                priceID,
@@ -390,6 +454,15 @@ func (s *Server) handleAccountBillingWebhookSubscriptionUpdated(r *http.Request,
 			"stripe_subscription_cancel_at":  ev.CancelAt,
 		}).
 		Info("Updating subscription to status %s, with price %s", ev.Status, priceID)
+	if org, err := s.userManager.OrgByStripeCustomer(ev.Customer); err == nil {
+		tier, err := s.userManager.TierByStripePrice(priceID)
+		if err != nil {
+			return err
+		}
+		return s.updateOrgSubscriptionAndTier(r, v, org, tier, ev.Customer, subscriptionID, ev.Status, string(interval), ev.CurrentPeriodEnd, ev.CancelAt)
+	} else if !errors.Is(err, user.ErrOrgNotFound) {
+		return err
+	}
 	userFn := func() (*user.User, error) {
 		return s.userManager.UserByStripeCustomer(ev.Customer)
 	}
@@ -412,13 +485,18 @@ func (s *Server) handleAccountBillingWebhookSubscriptionUpdated(r *http.Request,
 	return nil
 }
 
-func (s *Server) handleAccountBillingWebhookSubscriptionDeleted(r *http.Request, v *visitor, event stripe.Event) error {
-	ev, err := util.UnmarshalJSON[apiStripeSubscriptionDeletedEvent](io.NopCloser(bytes.NewReader(event.Data.Raw)))
+func (s *Server) handleAccountBillingWebhookSubscriptionDeleted(r *http.Request, v *visitor, event *webhookEvent) error {
+	ev, err := util.UnmarshalJSON[apiStripeSubscriptionDeletedEvent](io.NopCloser(bytes.NewReader(event.Data)))
 	if err != nil {
 		return err
 	} else if ev.Customer == "" {
 		return errHTTPBadRequestBillingRequestInvalid
 	}
+	if org, err := s.userManager.OrgByStripeCustomer(ev.Customer); err == nil {
+		return s.updateOrgSubscriptionAndTier(r, v, org, nil, ev.Customer, "", "", "", 0, 0)
+	} else if !errors.Is(err, user.ErrOrgNotFound) {
+		return err
+	}
 	u, err := s.userManager.UserByStripeCustomer(ev.Customer)
 	if err != nil {
 		return err
@@ -448,7 +526,7 @@ func (s *Server) updateSubscriptionAndTier(r *http.Request, v *visitor, u *user.
 		if err := s.userManager.ResetTier(u.Name); err != nil {
 			return err
 		}
-	} else if tier != nil && u.TierID() != tier.ID {
+	} else if tier != nil && (u.TierID() != tier.ID || u.TierExpires.Unix() > 0) { // Paid tier replaces a granted tier
 		logvr(v, r).
 			Tag(tagStripe).
 			Fields(log.Context{
@@ -477,26 +555,88 @@ func (s *Server) updateSubscriptionAndTier(r *http.Request, v *visitor, u *user.
 
 // fetchStripePrices contacts the Stripe API to retrieve all prices. This is used by the server to cache the prices
 // in memory, and ultimately for the web app to display the price table.
-func (s *Server) fetchStripePrices() (map[string]int64, error) {
+func (s *Server) fetchStripePrices() (map[string]*stripe.Price, error) {
 	log.Debug("Caching prices from Stripe API")
-	priceMap := make(map[string]int64)
+	priceMap := make(map[string]*stripe.Price)
 	prices, err := s.stripe.ListPrices(&stripe.PriceListParams{Active: stripe.Bool(true)})
 	if err != nil {
 		log.Warn("Fetching Stripe prices failed: %s", err.Error())
 		return nil, err
 	}
 	for _, p := range prices {
-		priceMap[p.ID] = p.UnitAmount
-		log.Trace("- Caching price %s = %v", p.ID, priceMap[p.ID])
+		priceMap[p.ID] = p
+		log.Trace("- Caching price %s = %v", p.ID, p.UnitAmount)
 	}
 	return priceMap, nil
 }
 
-// stripeAPI is a small interface to facilitate mocking of the Stripe API
-type stripeAPI interface {
+// fetchStripeDiscounts contacts the Stripe API to retrieve all active promotion codes that are marked as public
+// (metadata "public" set to "true"). Like the prices, these are cached, and displayed in the web app.
+func (s *Server) fetchStripeDiscounts() ([]*stripe.PromotionCode, error) {
+	log.Debug("Caching public promotion codes from Stripe API")
+	params := &stripe.PromotionCodeListParams{Active: stripe.Bool(true)}
+	params.AddExpand("data.coupon.applies_to")
+	promotionCodes, err := s.stripe.ListPromotionCodes(params)
+	if err != nil {
+		log.Warn("Fetching Stripe promotion codes failed: %s", err.Error())
+		return nil, err
+	}
+	public := make([]*stripe.PromotionCode, 0)
+	for _, p := range promotionCodes {
+		if p.Metadata["public"] == "true" && p.Coupon != nil && p.Coupon.Valid {
+			public = append(public, p)
+			log.Trace("- Caching promotion code %s", p.Code)
+		}
+	}
+	return public, nil
+}
+
+// stripePromotionCode looks up an active promotion code by its customer-facing code (e.g. SUMMER20), or returns
+// errHTTPBadRequestPromotionCodeInvalid if it does not exist, is inactive, or its coupon is no longer valid
+func (s *Server) stripePromotionCode(code string) (*stripe.PromotionCode, error) {
+	promotionCodes, err := s.stripe.ListPromotionCodes(&stripe.PromotionCodeListParams{
+		Code:   stripe.String(code),
+		Active: stripe.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range promotionCodes {
+		if p.Coupon != nil && p.Coupon.Valid {
+			return p, nil
+		}
+	}
+	return nil, errHTTPBadRequestPromotionCodeInvalid
+}
+
+// newAccountBillingDiscounts returns the promotion codes that apply to the product of the given price. Coupons
+// without product restrictions apply to all products.
+func newAccountBillingDiscounts(promotionCodes []*stripe.PromotionCode, p *stripe.Price) []*apiAccountBillingDiscount {
+	discounts := make([]*apiAccountBillingDiscount, 0)
+	for _, promotionCode := range promotionCodes {
+		coupon := promotionCode.Coupon
+		if coupon.AppliesTo != nil && len(coupon.AppliesTo.Products) > 0 && (p.Product == nil || !util.Contains(coupon.AppliesTo.Products, p.Product.ID)) {
+			continue
+		}
+		discounts = append(discounts, &apiAccountBillingDiscount{
+			Code:             promotionCode.Code,
+			PercentOff:       coupon.PercentOff,
+			AmountOff:        coupon.AmountOff,
+			Duration:         string(coupon.Duration),
+			DurationInMonths: coupon.DurationInMonths,
+			ExpiresAt:        promotionCode.ExpiresAt,
+		})
+	}
+	return discounts
+}
+
+// StripeAPI is a small interface to facilitate mocking of the Stripe API. A custom implementation can be
+// passed to New via WithStripeAPI.
+type StripeAPI interface {
 	NewCheckoutSession(params *stripe.CheckoutSessionParams) (*stripe.CheckoutSession, error)
 	NewPortalSession(params *stripe.BillingPortalSessionParams) (*stripe.BillingPortalSession, error)
 	ListPrices(params *stripe.PriceListParams) ([]*stripe.Price, error)
+	ListPromotionCodes(params *stripe.PromotionCodeListParams) ([]*stripe.PromotionCode, error)
 	GetCustomer(id string) (*stripe.Customer, error)
 	GetSession(id string) (*stripe.CheckoutSession, error)
 	GetSubscription(id string) (*stripe.Subscription, error)
@@ -504,15 +644,27 @@ type stripeAPI interface {
 	UpdateSubscription(id string, params *stripe.SubscriptionParams) (*stripe.Subscription, error)
 	CancelSubscription(id string) (*stripe.Subscription, error)
 	ConstructWebhookEvent(payload []byte, header string, secret string) (stripe.Event, error)
+	NewUsageRecord(params *stripe.UsageRecordParams) (*stripe.UsageRecord, error)
 }
 
 // realStripeAPI is a thin shim around the Stripe functions to facilitate mocking
 type realStripeAPI struct{}
 
-var _ stripeAPI = (*realStripeAPI)(nil)
+var _ StripeAPI = (*realStripeAPI)(nil)
 
-func newStripeAPI() stripeAPI {
-	return &realStripeAPI{}
+// newStripeAPI creates the Stripe API shim, and routes Stripe requests through stripe-proxy or outbound-proxy,
+// if configured. Note that the Stripe backend is global, just like the secret key (stripe.Key).
+func newStripeAPI(conf *Config) (StripeAPI, error) {
+	if outboundProxyConfigured(conf, conf.StripeProxy) {
+		transport, err := outboundTransport(conf, conf.StripeProxy)
+		if err != nil {
+			return nil, err
+		}
+		stripe.SetBackend(stripe.APIBackend, stripe.GetBackendWithConfig(stripe.APIBackend, &stripe.BackendConfig{
+			HTTPClient: &http.Client{Transport: transport, Timeout: 80 * time.Second}, // Same as Stripe's default
+		}))
+	}
+	return &realStripeAPI{}, nil
 }
 
 func (s *realStripeAPI) NewCheckoutSession(params *stripe.CheckoutSessionParams) (*stripe.CheckoutSession, error) {
@@ -535,6 +687,18 @@ func (s *realStripeAPI) ListPrices(params *stripe.PriceListParams) ([]*stripe.Pr
 	return prices, nil
 }
 
+func (s *realStripeAPI) ListPromotionCodes(params *stripe.PromotionCodeListParams) ([]*stripe.PromotionCode, error) {
+	promotionCodes := make([]*stripe.PromotionCode, 0)
+	iter := promotioncode.List(params)
+	for iter.Next() {
+		promotionCodes = append(promotionCodes, iter.PromotionCode())
+	}
+	if iter.Err() != nil {
+		return nil, iter.Err()
+	}
+	return promotionCodes, nil
+}
+
 func (s *realStripeAPI) GetCustomer(id string) (*stripe.Customer, error) {
 	return customer.Get(id, nil)
 }
@@ -562,3 +726,40 @@ func (s *realStripeAPI) CancelSubscription(id string) (*stripe.Subscription, err
 func (s *realStripeAPI) ConstructWebhookEvent(payload []byte, header string, secret string) (stripe.Event, error) {
 	return webhook.ConstructEvent(payload, header, secret)
 }
+
+func (s *realStripeAPI) NewUsageRecord(params *stripe.UsageRecordParams) (*stripe.UsageRecord, error) {
+	return usagerecord.New(params)
+}
+
+// stripeWebhookVerifier is a webhookVerifier for Stripe events. The signature check (including the timestamp
+// tolerance) is done by the Stripe library, see https://stripe.com/docs/webhooks/signatures. Stripe does not
+// send a key ID, so all valid secrets are tried (see server_signing_keys.go).
+type stripeWebhookVerifier struct {
+	api     StripeAPI
+	secrets []string
+}
+
+func (s *stripeWebhookVerifier) Verify(r *http.Request, body []byte) (*webhookEvent, error) {
+	signature := r.Header.Get("Stripe-Signature")
+	if signature == "" {
+		return nil, errWebhookSignatureMissing
+	}
+	var event stripe.Event
+	err := errWebhookSignatureInvalid
+	for _, secret := range s.secrets {
+		if event, err = s.api.ConstructWebhookEvent(body, signature, secret); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	} else if event.Data == nil || event.Data.Raw == nil {
+		return nil, errStripeEventDataMissing
+	}
+	return &webhookEvent{
+		Provider: "stripe",
+		ID:       event.ID,
+		Type:     event.Type,
+		Data:     event.Data.Raw,
+	}, nil
+}
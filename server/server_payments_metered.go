@@ -0,0 +1,216 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/stripe/stripe-go/v74"
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+// Metered billing lets operators offer pay-as-you-go tiers, in addition to flat subscriptions. A tier can define
+// metered (monthly) Stripe prices for published messages and/or uploaded attachment bytes, see
+// user.Tier.StripeMeteredMessagesPriceID and user.Tier.StripeMeteredAttachmentPriceID:
+//
+// - Checkout/update subscription:
+//      Monthly subscriptions get one additional subscription item per metered price. Yearly subscriptions only
+//      contain the flat price, since Stripe does not allow mixing intervals within a subscription.
+// - Reporting:
+//      Every stripeUsageReportInterval, the usage of the current billing period is summed up from the usage
+//      stats (see user.Manager.UsageTotal), and reported to Stripe via a usage record. Usage records are
+//      sent with action "set", so the metered prices must use the "last_during_period" aggregation.
+// - Reconciliation:
+//      When Stripe creates the invoice at the end of a billing period (invoice.created webhook), the final
+//      usage of the ended period is reported, before Stripe finalizes the invoice.
+
+const (
+	stripeUsageReportInterval = time.Hour
+)
+
+// runStripeUsageReporter periodically reports the usage of users on metered tiers to Stripe
+func (s *Server) runStripeUsageReporter() {
+	if s.stripe == nil || s.userManager == nil {
+		return
+	}
+	for {
+		select {
+		case <-time.After(stripeUsageReportInterval):
+			if err := s.reportStripeUsage(); err != nil {
+				log.Tag(tagStripe).Err(err).Warn("Error reporting usage to Stripe")
+			}
+		case <-s.closeChan:
+			return
+		}
+	}
+}
+
+// reportStripeUsage reports the usage of the current billing period for all users with a subscription on a
+// metered tier. Errors for individual users are logged, and do not stop the reporting for other users.
+func (s *Server) reportStripeUsage() error {
+	users, err := s.userManager.Users()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, u := range users {
+		if !meteredTier(u.Tier) || u.Billing.StripeSubscriptionID == "" {
+			continue
+		}
+		sub, err := s.stripe.GetSubscription(u.Billing.StripeSubscriptionID)
+		if err != nil {
+			log.Tag(tagStripe).Field("user_name", u.Name).Err(err).Warn("Unable to retrieve Stripe subscription to report usage")
+			continue
+		}
+		if err := s.reportStripeSubscriptionUsage(u, sub, time.Unix(sub.CurrentPeriodStart, 0), now, now); err != nil {
+			log.Tag(tagStripe).Field("user_name", u.Name).Err(err).Warn("Unable to report usage to Stripe")
+		}
+	}
+	return nil
+}
+
+// reportStripeSubscriptionUsage reports the total usage of the user between since and until to the metered items
+// of the given subscription, as a usage record with the given timestamp
+func (s *Server) reportStripeSubscriptionUsage(u *user.User, sub *stripe.Subscription, since, until, timestamp time.Time) error {
+	if sub.Items == nil {
+		return nil
+	}
+	var usage *user.Usage
+	for _, item := range sub.Items.Data {
+		if item.Price == nil || item.Price.Recurring == nil || item.Price.Recurring.UsageType != stripe.PriceRecurringUsageTypeMetered {
+			continue
+		}
+		if usage == nil {
+			var err error
+			if usage, err = s.userManager.UsageTotal(u.ID, since, until); err != nil {
+				return err
+			}
+		}
+		var quantity int64
+		switch item.Price.ID {
+		case u.Tier.StripeMeteredMessagesPriceID:
+			quantity = usage.Messages
+		case u.Tier.StripeMeteredAttachmentPriceID:
+			quantity = usage.AttachmentBytes
+		default:
+			continue // Metered price of a different tier, e.g. after a tier change
+		}
+		log.
+			Tag(tagStripe).
+			Fields(log.Context{
+				"user_id":                     u.ID,
+				"user_name":                   u.Name,
+				"stripe_subscription_id":      sub.ID,
+				"stripe_subscription_item_id": item.ID,
+				"stripe_price_id":             item.Price.ID,
+				"stripe_usage_quantity":       quantity,
+			}).
+			Debug("Reporting usage of %d for price %s to Stripe", quantity, item.Price.ID)
+		params := &stripe.UsageRecordParams{
+			SubscriptionItem: stripe.String(item.ID),
+			Action:           stripe.String(stripe.UsageRecordActionSet),
+			Quantity:         stripe.Int64(quantity),
+			Timestamp:        stripe.Int64(timestamp.Unix()),
+		}
+		if _, err := s.stripe.NewUsageRecord(params); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleAccountBillingWebhookInvoiceCreated reconciles the usage of metered subscriptions at the end of a billing
+// period. Stripe creates the invoice for the ended period as a draft, and includes usage records that are reported
+// until the invoice is finalized.
+func (s *Server) handleAccountBillingWebhookInvoiceCreated(r *http.Request, v *visitor, event *webhookEvent) error {
+	ev, err := util.UnmarshalJSON[apiStripeInvoiceCreatedEvent](io.NopCloser(bytes.NewReader(event.Data)))
+	if err != nil {
+		return err
+	} else if ev.Customer == "" {
+		return errHTTPBadRequestBillingRequestInvalid
+	} else if ev.BillingReason != string(stripe.InvoiceBillingReasonSubscriptionCycle) || ev.Subscription == "" || ev.PeriodEnd <= ev.PeriodStart {
+		return nil // Only the end-of-period invoice needs reconciliation
+	}
+	if _, err := s.userManager.OrgByStripeCustomer(ev.Customer); err == nil {
+		return nil // Usage of organizations is not metered
+	}
+	u, err := s.userManager.UserByStripeCustomer(ev.Customer)
+	if err != nil {
+		return err
+	} else if !meteredTier(u.Tier) {
+		return nil
+	}
+	v.SetUser(u)
+	logvr(v, r).
+		Tag(tagStripe).
+		Fields(log.Context{
+			"stripe_webhook_id":      event.ID,
+			"stripe_webhook_type":    event.Type,
+			"stripe_invoice_id":      ev.ID,
+			"stripe_subscription_id": ev.Subscription,
+		}).
+		Info("Invoice created, reconciling usage of billing period")
+	sub, err := s.stripe.GetSubscription(ev.Subscription)
+	if err != nil {
+		return err
+	}
+	periodStart, periodEnd := time.Unix(ev.PeriodStart, 0), time.Unix(ev.PeriodEnd, 0)
+	return s.reportStripeSubscriptionUsage(u, sub, periodStart, periodEnd, periodEnd.Add(-time.Second))
+}
+
+// stripeMeteredPriceIDs returns the metered price IDs of the tier, which are only used for monthly subscriptions
+func stripeMeteredPriceIDs(tier *user.Tier, interval string) []string {
+	if interval != string(stripe.PriceRecurringIntervalMonth) {
+		return nil
+	}
+	priceIDs := make([]string, 0)
+	for _, priceID := range []string{tier.StripeMeteredMessagesPriceID, tier.StripeMeteredAttachmentPriceID} {
+		if priceID != "" {
+			priceIDs = append(priceIDs, priceID)
+		}
+	}
+	return priceIDs
+}
+
+// stripeFlatSubscriptionItem returns the (only) non-metered item of the subscription, or nil if there is none,
+// or more than one
+func stripeFlatSubscriptionItem(items *stripe.SubscriptionItemList) *stripe.SubscriptionItem {
+	if items == nil {
+		return nil
+	}
+	var flat *stripe.SubscriptionItem
+	for _, item := range items.Data {
+		if item.Price != nil && item.Price.Recurring != nil && item.Price.Recurring.UsageType == stripe.PriceRecurringUsageTypeMetered {
+			continue
+		} else if flat != nil {
+			return nil
+		}
+		flat = item
+	}
+	return flat
+}
+
+// flatItem returns the (only) non-metered item of the subscription in the event, see stripeFlatSubscriptionItem
+func (e *apiStripeSubscriptionUpdatedEvent) flatItem() *apiStripeSubscriptionItem {
+	if e.Items == nil {
+		return nil
+	}
+	var flat *apiStripeSubscriptionItem
+	for _, item := range e.Items.Data {
+		if item.Price != nil && item.Price.Recurring != nil && item.Price.Recurring.UsageType == string(stripe.PriceRecurringUsageTypeMetered) {
+			continue
+		} else if flat != nil {
+			return nil
+		}
+		flat = item
+	}
+	return flat
+}
+
+// meteredTier returns true if the tier has at least one metered price
+func meteredTier(tier *user.Tier) bool {
+	return tier != nil && (tier.StripeMeteredMessagesPriceID != "" || tier.StripeMeteredAttachmentPriceID != "")
+}
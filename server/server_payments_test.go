@@ -2,6 +2,8 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 	"github.com/stripe/stripe-go/v74"
@@ -36,12 +38,31 @@ func TestPayments_Tiers(t *testing.T) {
 	stripeMock.
 		On("ListPrices", mock.Anything).
 		Return([]*stripe.Price{
-			{ID: "price_123", UnitAmount: 500},
-			{ID: "price_124", UnitAmount: 5000},
-			{ID: "price_456", UnitAmount: 1000},
-			{ID: "price_457", UnitAmount: 10000},
+			{ID: "price_123", UnitAmount: 500, Product: &stripe.Product{ID: "prod_pro"}},
+			{ID: "price_124", UnitAmount: 5000, Product: &stripe.Product{ID: "prod_pro"}},
+			{ID: "price_456", UnitAmount: 1000, Product: &stripe.Product{ID: "prod_business"}},
+			{ID: "price_457", UnitAmount: 10000, Product: &stripe.Product{ID: "prod_business"}},
 			{ID: "price_999", UnitAmount: 9999},
 		}, nil)
+	stripeMock.
+		On("ListPromotionCodes", mock.Anything).
+		Return([]*stripe.PromotionCode{
+			{
+				Code:     "EVERYONE10",
+				Metadata: map[string]string{"public": "true"},
+				Coupon:   &stripe.Coupon{Valid: true, PercentOff: 10, Duration: stripe.CouponDurationForever},
+			},
+			{
+				Code:      "PRO5",
+				Metadata:  map[string]string{"public": "true"},
+				ExpiresAt: 1900000000,
+				Coupon:    &stripe.Coupon{Valid: true, AmountOff: 500, Duration: stripe.CouponDurationRepeating, DurationInMonths: 3, AppliesTo: &stripe.CouponAppliesTo{Products: []string{"prod_pro"}}},
+			},
+			{
+				Code:   "SECRET50",
+				Coupon: &stripe.Coupon{Valid: true, PercentOff: 50, Duration: stripe.CouponDurationOnce}, // Not public
+			},
+		}, nil)
 
 	// Create tiers
 	require.Nil(t, s.userManager.AddTier(&user.Tier{
@@ -104,6 +125,15 @@ func TestPayments_Tiers(t *testing.T) {
 	require.Equal(t, "tier", tier.Limits.Basis)
 	require.Equal(t, int64(500), tier.Prices.Month)
 	require.Equal(t, int64(5000), tier.Prices.Year)
+	require.Equal(t, 2, len(tier.Discounts))
+	require.Equal(t, "EVERYONE10", tier.Discounts[0].Code)
+	require.Equal(t, float64(10), tier.Discounts[0].PercentOff)
+	require.Equal(t, "forever", tier.Discounts[0].Duration)
+	require.Equal(t, "PRO5", tier.Discounts[1].Code)
+	require.Equal(t, int64(500), tier.Discounts[1].AmountOff)
+	require.Equal(t, "repeating", tier.Discounts[1].Duration)
+	require.Equal(t, int64(3), tier.Discounts[1].DurationInMonths)
+	require.Equal(t, int64(1900000000), tier.Discounts[1].ExpiresAt)
 	require.Equal(t, int64(777), tier.Limits.Reservations)
 	require.Equal(t, int64(1000), tier.Limits.Messages)
 	require.Equal(t, int64(3600), tier.Limits.MessagesExpiryDuration)
@@ -117,6 +147,8 @@ func TestPayments_Tiers(t *testing.T) {
 	require.Equal(t, "Business", tier.Name)
 	require.Equal(t, int64(1000), tier.Prices.Month)
 	require.Equal(t, int64(10000), tier.Prices.Year)
+	require.Equal(t, 1, len(tier.Discounts))
+	require.Equal(t, "EVERYONE10", tier.Discounts[0].Code)
 	require.Equal(t, "tier", tier.Limits.Basis)
 	require.Equal(t, int64(777333), tier.Limits.Reservations)
 	require.Equal(t, int64(2000), tier.Limits.Messages)
@@ -204,6 +236,53 @@ func TestPayments_SubscriptionCreate_StripeCustomer_Success(t *testing.T) {
 	require.Equal(t, "https://billing.stripe.com/abc/def", redirectResponse.RedirectURL)
 }
 
+func TestPayments_SubscriptionCreate_PromotionCode(t *testing.T) {
+	stripeMock := &testStripeAPI{}
+	defer stripeMock.AssertExpectations(t)
+
+	c := newTestConfigWithAuthFile(t)
+	c.StripeSecretKey = "secret key"
+	c.StripeWebhookKey = "webhook key"
+	s := newTestServer(t, c)
+	s.stripe = stripeMock
+
+	// Define how the mock should react
+	stripeMock.
+		On("ListPromotionCodes", &stripe.PromotionCodeListParams{Code: stripe.String("SUMMER20"), Active: stripe.Bool(true)}).
+		Return([]*stripe.PromotionCode{{ID: "promo_123", Code: "SUMMER20", Coupon: &stripe.Coupon{Valid: true}}}, nil)
+	stripeMock.
+		On("ListPromotionCodes", &stripe.PromotionCodeListParams{Code: stripe.String("EXPIRED"), Active: stripe.Bool(true)}).
+		Return([]*stripe.PromotionCode{{ID: "promo_456", Code: "EXPIRED", Coupon: &stripe.Coupon{Valid: false}}}, nil)
+	stripeMock.
+		On("NewCheckoutSession", mock.MatchedBy(func(params *stripe.CheckoutSessionParams) bool {
+			return params.AllowPromotionCodes == nil && len(params.Discounts) == 1 && *params.Discounts[0].PromotionCode == "promo_123"
+		})).
+		Return(&stripe.CheckoutSession{URL: "https://billing.stripe.com/abc/def"}, nil)
+
+	// Create tier and user
+	require.Nil(t, s.userManager.AddTier(&user.Tier{
+		ID:                   "ti_123",
+		Code:                 "pro",
+		StripeMonthlyPriceID: "price_123",
+	}))
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+
+	// Create subscription with invalid, and valid promotion code
+	response := request(t, s, "POST", "/v1/account/billing/subscription", `{"tier": "pro", "interval": "month", "promotion_code": "EXPIRED"}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40099, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "POST", "/v1/account/billing/subscription", `{"tier": "pro", "interval": "month", "promotion_code": "SUMMER20"}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+	redirectResponse, err := util.UnmarshalJSON[apiAccountBillingSubscriptionCreateResponse](io.NopCloser(response.Body))
+	require.Nil(t, err)
+	require.Equal(t, "https://billing.stripe.com/abc/def", redirectResponse.RedirectURL)
+}
+
 func TestPayments_AccountDelete_Cancels_Subscription(t *testing.T) {
 	stripeMock := &testStripeAPI{}
 	defer stripeMock.AssertExpectations(t)
@@ -491,7 +570,7 @@ func TestPayments_Webhook_Subscription_Updated_Downgrade_From_PastDue_To_Active(
 	})
 	require.Equal(t, 200, rr.Code)
 	a2 := toMessage(t, rr.Body.String())
-	require.FileExists(t, filepath.Join(s.config.AttachmentCacheDir, a2.ID))
+	require.FileExists(t, filepath.Join(s.config().AttachmentCacheDir, a2.ID))
 
 	rr = request(t, s, "PUT", "/ztopic", "some zzz message", map[string]string{
 		"Authorization": util.BasicAuth("phil", "phil"),
@@ -503,7 +582,7 @@ func TestPayments_Webhook_Subscription_Updated_Downgrade_From_PastDue_To_Active(
 	})
 	require.Equal(t, 200, rr.Code)
 	z2 := toMessage(t, rr.Body.String())
-	require.FileExists(t, filepath.Join(s.config.AttachmentCacheDir, z2.ID))
+	require.FileExists(t, filepath.Join(s.config().AttachmentCacheDir, z2.ID))
 
 	// Call the webhook: This does all the magic
 	rr = request(t, s, "POST", "/v1/account/billing/webhook", "dummy", map[string]string{
@@ -535,12 +614,12 @@ func TestPayments_Webhook_Subscription_Updated_Downgrade_From_PastDue_To_Active(
 	ms, err := s.messageCache.Messages("atopic", sinceAllMessages, false)
 	require.Nil(t, err)
 	require.Equal(t, 2, len(ms))
-	require.FileExists(t, filepath.Join(s.config.AttachmentCacheDir, a2.ID))
+	require.FileExists(t, filepath.Join(s.config().AttachmentCacheDir, a2.ID))
 
 	ms, err = s.messageCache.Messages("ztopic", sinceAllMessages, false)
 	require.Nil(t, err)
 	require.Equal(t, 0, len(ms))
-	require.NoFileExists(t, filepath.Join(s.config.AttachmentCacheDir, z2.ID))
+	require.NoFileExists(t, filepath.Join(s.config().AttachmentCacheDir, z2.ID))
 }
 
 func TestPayments_Webhook_Subscription_Deleted(t *testing.T) {
@@ -606,6 +685,39 @@ func TestPayments_Webhook_Subscription_Deleted(t *testing.T) {
 	r, err := s.userManager.Reservations("phil")
 	require.Nil(t, err)
 	require.Equal(t, 0, len(r))
+
+	// Deliver the same event again (e.g. Stripe retry or replay): it is acknowledged, but not processed again
+	require.Nil(t, s.userManager.ChangeTier("phil", "pro"))
+	rr = request(t, s, "POST", "/v1/account/billing/webhook", "dummy", map[string]string{
+		"Stripe-Signature": "stripe signature",
+	})
+	require.Equal(t, 200, rr.Code)
+	u, err = s.userManager.User("phil")
+	require.Nil(t, err)
+	require.Equal(t, "pro", u.Tier.Code)
+}
+
+func TestPayments_Webhook_Invalid_Signature(t *testing.T) {
+	stripeMock := &testStripeAPI{}
+	defer stripeMock.AssertExpectations(t)
+
+	c := newTestConfigWithAuthFile(t)
+	c.StripeSecretKey = "secret key"
+	c.StripeWebhookKey = "webhook key"
+	s := newTestServer(t, c)
+	s.stripe = stripeMock
+
+	stripeMock.
+		On("ConstructWebhookEvent", mock.Anything, "bad signature", "webhook key").
+		Return(stripe.Event{}, errors.New("signature mismatch"))
+
+	rr := request(t, s, "POST", "/v1/account/billing/webhook", "dummy", nil)
+	require.Equal(t, 40049, toHTTPError(t, rr.Body.String()).Code)
+
+	rr = request(t, s, "POST", "/v1/account/billing/webhook", "dummy", map[string]string{
+		"Stripe-Signature": "bad signature",
+	})
+	require.Equal(t, 40049, toHTTPError(t, rr.Body.String()).Code)
 }
 
 func TestPayments_Subscription_Update_Different_Tier(t *testing.T) {
@@ -717,7 +829,7 @@ func TestPayments_CreatePortalSession(t *testing.T) {
 	stripeMock.
 		On("NewPortalSession", &stripe.BillingPortalSessionParams{
 			Customer:  stripe.String("acct_123"),
-			ReturnURL: stripe.String(s.config.BaseURL),
+			ReturnURL: stripe.String(s.config().BaseURL),
 		}).
 		Return(&stripe.BillingPortalSession{
 			URL: "https://billing.stripe.com/blablabla",
@@ -739,11 +851,232 @@ func TestPayments_CreatePortalSession(t *testing.T) {
 	require.Equal(t, "https://billing.stripe.com/blablabla", ps.RedirectURL)
 }
 
+func TestPayments_Metered_SubscriptionCreate(t *testing.T) {
+	stripeMock := &testStripeAPI{}
+	defer stripeMock.AssertExpectations(t)
+
+	c := newTestConfigWithAuthFile(t)
+	c.StripeSecretKey = "secret key"
+	c.StripeWebhookKey = "webhook key"
+	s := newTestServer(t, c)
+	s.stripe = stripeMock
+
+	// Monthly subscriptions include the metered prices (without quantity), yearly subscriptions don't
+	stripeMock.
+		On("NewCheckoutSession", mock.MatchedBy(func(params *stripe.CheckoutSessionParams) bool {
+			return len(params.LineItems) == 3 &&
+				*params.LineItems[0].Price == "price_123" && *params.LineItems[0].Quantity == 1 &&
+				*params.LineItems[1].Price == "price_messages" && params.LineItems[1].Quantity == nil &&
+				*params.LineItems[2].Price == "price_attachment" && params.LineItems[2].Quantity == nil
+		})).
+		Return(&stripe.CheckoutSession{URL: "https://billing.stripe.com/monthly"}, nil)
+	stripeMock.
+		On("NewCheckoutSession", mock.MatchedBy(func(params *stripe.CheckoutSessionParams) bool {
+			return len(params.LineItems) == 1 && *params.LineItems[0].Price == "price_124"
+		})).
+		Return(&stripe.CheckoutSession{URL: "https://billing.stripe.com/yearly"}, nil)
+
+	require.Nil(t, s.userManager.AddTier(&user.Tier{
+		ID:                             "ti_123",
+		Code:                           "payg",
+		StripeMonthlyPriceID:           "price_123",
+		StripeYearlyPriceID:            "price_124",
+		StripeMeteredMessagesPriceID:   "price_messages",
+		StripeMeteredAttachmentPriceID: "price_attachment",
+	}))
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+
+	for interval, redirectURL := range map[string]string{"month": "https://billing.stripe.com/monthly", "year": "https://billing.stripe.com/yearly"} {
+		response := request(t, s, "POST", "/v1/account/billing/subscription", `{"tier": "payg", "interval": "`+interval+`"}`, map[string]string{
+			"Authorization": util.BasicAuth("phil", "phil"),
+		})
+		require.Equal(t, 200, response.Code)
+		redirectResponse, err := util.UnmarshalJSON[apiAccountBillingSubscriptionCreateResponse](io.NopCloser(response.Body))
+		require.Nil(t, err)
+		require.Equal(t, redirectURL, redirectResponse.RedirectURL)
+	}
+}
+
+func TestPayments_Metered_ReportUsage_And_Update_Subscription(t *testing.T) {
+	stripeMock := &testStripeAPI{}
+	defer stripeMock.AssertExpectations(t)
+
+	c := newTestConfigWithAuthFile(t)
+	c.StripeSecretKey = "secret key"
+	c.StripeWebhookKey = "webhook key"
+	c.AuthStatsQueueWriterInterval = 100 * time.Millisecond
+	s := newTestServer(t, c)
+	s.stripe = stripeMock
+
+	// Create metered tier, a flat tier, and a user with a subscription
+	require.Nil(t, s.userManager.AddTier(&user.Tier{
+		ID:                             "ti_123",
+		Code:                           "payg",
+		MessageLimit:                   100,
+		AttachmentFileSizeLimit:        1000,
+		AttachmentTotalSizeLimit:       1000,
+		AttachmentExpiryDuration:       time.Hour,
+		AttachmentBandwidthLimit:       1000,
+		StripeMonthlyPriceID:           "price_123",
+		StripeYearlyPriceID:            "price_124",
+		StripeMeteredMessagesPriceID:   "price_messages",
+		StripeMeteredAttachmentPriceID: "price_attachment",
+	}))
+	require.Nil(t, s.userManager.AddTier(&user.Tier{
+		ID:                   "ti_456",
+		Code:                 "pro",
+		StripeMonthlyPriceID: "price_456",
+		StripeYearlyPriceID:  "price_457",
+	}))
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.ChangeTier("phil", "payg"))
+	require.Nil(t, s.userManager.ChangeBilling("phil", &user.Billing{
+		StripeCustomerID:     "acct_123",
+		StripeSubscriptionID: "sub_123",
+	}))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser)) // Not on a metered tier, not reported
+
+	// Publish messages and an attachment
+	phil := map[string]string{"Authorization": util.BasicAuth("phil", "phil")}
+	require.Equal(t, 200, request(t, s, "PUT", "/mytopic", "message 1", phil).Code)
+	require.Equal(t, 200, request(t, s, "PUT", "/mytopic?f=file.txt", "attachment", phil).Code)
+	u, err := s.userManager.User("phil")
+	require.Nil(t, err)
+	waitFor(t, func() bool {
+		usage, err := s.userManager.UsageTotal(u.ID, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+		require.Nil(t, err)
+		return usage.Messages == 2
+	})
+
+	// Define how the mock should react
+	periodStart := time.Now().Add(-24 * time.Hour)
+	stripeMock.
+		On("GetSubscription", "sub_123").
+		Return(&stripe.Subscription{
+			ID:                 "sub_123",
+			CurrentPeriodStart: periodStart.Unix(),
+			Items: &stripe.SubscriptionItemList{
+				Data: []*stripe.SubscriptionItem{
+					{
+						ID:    "si_flat",
+						Price: &stripe.Price{ID: "price_123", Recurring: &stripe.PriceRecurring{UsageType: stripe.PriceRecurringUsageTypeLicensed}},
+					},
+					{
+						ID:    "si_messages",
+						Price: &stripe.Price{ID: "price_messages", Recurring: &stripe.PriceRecurring{UsageType: stripe.PriceRecurringUsageTypeMetered}},
+					},
+					{
+						ID:    "si_attachment",
+						Price: &stripe.Price{ID: "price_attachment", Recurring: &stripe.PriceRecurring{UsageType: stripe.PriceRecurringUsageTypeMetered}},
+					},
+				},
+			},
+		}, nil)
+	stripeMock.
+		On("NewUsageRecord", mock.MatchedBy(func(params *stripe.UsageRecordParams) bool {
+			return *params.SubscriptionItem == "si_messages" && *params.Quantity == 2 && *params.Action == "set"
+		})).
+		Return(&stripe.UsageRecord{}, nil).
+		Twice()
+	stripeMock.
+		On("NewUsageRecord", mock.MatchedBy(func(params *stripe.UsageRecordParams) bool {
+			return *params.SubscriptionItem == "si_attachment" && *params.Quantity == int64(len("attachment")) && *params.Action == "set"
+		})).
+		Return(&stripe.UsageRecord{}, nil).
+		Twice()
+
+	// Report usage (normally done periodically)
+	require.Nil(t, s.reportStripeUsage())
+
+	// Changing to a flat tier reports the usage so far, and removes the metered items
+	stripeMock.
+		On("UpdateSubscription", "sub_123", &stripe.SubscriptionParams{
+			CancelAtPeriodEnd: stripe.Bool(false),
+			ProrationBehavior: stripe.String(string(stripe.SubscriptionSchedulePhaseProrationBehaviorAlwaysInvoice)),
+			Items: []*stripe.SubscriptionItemsParams{
+				{
+					ID:    stripe.String("si_flat"),
+					Price: stripe.String("price_456"),
+				},
+				{
+					ID:      stripe.String("si_messages"),
+					Deleted: stripe.Bool(true),
+				},
+				{
+					ID:      stripe.String("si_attachment"),
+					Deleted: stripe.Bool(true),
+				},
+			},
+		}).
+		Return(&stripe.Subscription{}, nil)
+	rr := request(t, s, "PUT", "/v1/account/billing/subscription", `{"tier":"pro","interval":"month"}`, phil)
+	require.Equal(t, 200, rr.Code)
+}
+
+func TestPayments_Webhook_Invoice_Created_Reconciles_Usage(t *testing.T) {
+	stripeMock := &testStripeAPI{}
+	defer stripeMock.AssertExpectations(t)
+
+	c := newTestConfigWithAuthFile(t)
+	c.StripeSecretKey = "secret key"
+	c.StripeWebhookKey = "webhook key"
+	s := newTestServer(t, c)
+	s.stripe = stripeMock
+
+	require.Nil(t, s.userManager.AddTier(&user.Tier{
+		ID:                           "ti_123",
+		Code:                         "payg",
+		StripeMonthlyPriceID:         "price_123",
+		StripeYearlyPriceID:          "price_124",
+		StripeMeteredMessagesPriceID: "price_messages",
+	}))
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.ChangeTier("phil", "payg"))
+	require.Nil(t, s.userManager.ChangeBilling("phil", &user.Billing{
+		StripeCustomerID:     "acct_5555",
+		StripeSubscriptionID: "sub_1234",
+	}))
+
+	// Define how the mock should react
+	periodEnd := time.Now().Truncate(time.Hour).Add(time.Hour)
+	event := fmt.Sprintf(invoiceCreatedEventJSON, periodEnd.Add(-30*24*time.Hour).Unix(), periodEnd.Unix())
+	stripeMock.
+		On("ConstructWebhookEvent", mock.Anything, "stripe signature", "webhook key").
+		Return(jsonToStripeEvent(t, event), nil)
+	stripeMock.
+		On("GetSubscription", "sub_1234").
+		Return(&stripe.Subscription{
+			ID: "sub_1234",
+			Items: &stripe.SubscriptionItemList{
+				Data: []*stripe.SubscriptionItem{
+					{
+						ID:    "si_messages",
+						Price: &stripe.Price{ID: "price_messages", Recurring: &stripe.PriceRecurring{UsageType: stripe.PriceRecurringUsageTypeMetered}},
+					},
+				},
+			},
+		}, nil)
+	stripeMock.
+		On("NewUsageRecord", &stripe.UsageRecordParams{
+			SubscriptionItem: stripe.String("si_messages"),
+			Action:           stripe.String("set"),
+			Quantity:         stripe.Int64(0),
+			Timestamp:        stripe.Int64(periodEnd.Unix() - 1),
+		}).
+		Return(&stripe.UsageRecord{}, nil)
+
+	// Call the webhook
+	rr := request(t, s, "POST", "/v1/account/billing/webhook", "dummy", map[string]string{
+		"Stripe-Signature": "stripe signature",
+	})
+	require.Equal(t, 200, rr.Code)
+}
+
 type testStripeAPI struct {
 	mock.Mock
 }
 
-var _ stripeAPI = (*testStripeAPI)(nil)
+var _ StripeAPI = (*testStripeAPI)(nil)
 
 func (s *testStripeAPI) NewCheckoutSession(params *stripe.CheckoutSessionParams) (*stripe.CheckoutSession, error) {
 	args := s.Called(params)
@@ -760,6 +1093,11 @@ func (s *testStripeAPI) ListPrices(params *stripe.PriceListParams) ([]*stripe.Pr
 	return args.Get(0).([]*stripe.Price), args.Error(1)
 }
 
+func (s *testStripeAPI) ListPromotionCodes(params *stripe.PromotionCodeListParams) ([]*stripe.PromotionCode, error) {
+	args := s.Called(params)
+	return args.Get(0).([]*stripe.PromotionCode), args.Error(1)
+}
+
 func (s *testStripeAPI) GetCustomer(id string) (*stripe.Customer, error) {
 	args := s.Called(id)
 	return args.Get(0).(*stripe.Customer), args.Error(1)
@@ -795,6 +1133,11 @@ func (s *testStripeAPI) ConstructWebhookEvent(payload []byte, header string, sec
 	return args.Get(0).(stripe.Event), args.Error(1)
 }
 
+func (s *testStripeAPI) NewUsageRecord(params *stripe.UsageRecordParams) (*stripe.UsageRecord, error) {
+	args := s.Called(params)
+	return args.Get(0).(*stripe.UsageRecord), args.Error(1)
+}
+
 func jsonToStripeEvent(t *testing.T, v string) stripe.Event {
 	var e stripe.Event
 	if err := json.Unmarshal([]byte(v), &e); err != nil {
@@ -805,6 +1148,7 @@ func jsonToStripeEvent(t *testing.T, v string) stripe.Event {
 
 const subscriptionUpdatedEventJSON = `
 {
+	"id": "evt_1234",
 	"type": "customer.subscription.updated",
 	"data": {
 		"object": {
@@ -831,6 +1175,7 @@ const subscriptionUpdatedEventJSON = `
 
 const subscriptionDeletedEventJSON = `
 {
+	"id": "evt_5678",
 	"type": "customer.subscription.deleted",
 	"data": {
 		"object": {
@@ -854,3 +1199,19 @@ const subscriptionDeletedEventJSON = `
 		}
 	}
 }`
+
+const invoiceCreatedEventJSON = `
+{
+	"id": "evt_9999",
+	"type": "invoice.created",
+	"data": {
+		"object": {
+			"id": "in_1234",
+			"customer": "acct_5555",
+			"subscription": "sub_1234",
+			"billing_reason": "subscription_cycle",
+			"period_start": %d,
+			"period_end": %d
+		}
+	}
+}`
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"fmt"
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// QR codes simplify onboarding devices to self-hosted servers: Instead of typing the server URL, topic and access
+// token into the app, users scan a QR code that encodes an ntfy:// link (see docs/subscribe/phone.md#ntfy-links):
+//
+//   - GET /v1/qr?topic=<topic> returns a QR code for the topic, e.g. ntfy://ntfy.example.com/mytopic
+//   - GET /v1/qr?topic=<topic>&token=<token> includes an existing access token of the logged-in user
+//   - POST /v1/qr?topic=<topic> creates a new access token that can only read the topic, and includes it
+//
+// If "format=text" is passed, the link is returned as text instead of as PNG image.
+
+const (
+	qrCodeScale      = 8 // Pixels per QR code module
+	qrCodeTokenLabel = "QR code onboarding (%s)"
+)
+
+// handleQRCode returns a QR code for the given topic, optionally including an existing access token, see above
+func (s *Server) handleQRCode(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	topic, err := s.qrCodeTopic(r, v)
+	if err != nil {
+		return err
+	}
+	token := readParam(r, "x-token", "token")
+	if token != "" {
+		u := v.User()
+		if s.userManager == nil || u == nil {
+			return errHTTPUnauthorized
+		} else if _, err := s.userManager.Token(u.ID, token); err != nil {
+			return errHTTPNotFoundToken
+		}
+	}
+	return s.writeQRCode(w, r, topic, token)
+}
+
+// handleQRCodeTokenCreate creates a new access token that is scoped to reading the given topic, and returns
+// a QR code including the token, see above
+func (s *Server) handleQRCodeTokenCreate(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	topic, err := s.qrCodeTopic(r, v)
+	if err != nil {
+		return err
+	}
+	u := v.User()
+	scope := &user.TokenScope{
+		Permission: user.PermissionRead,
+		Topics:     []string{topic},
+	}
+	label := fmt.Sprintf(qrCodeTokenLabel, topic)
+	logvr(v, r).
+		Tag(tagAccount).
+		Fields(log.Context{
+			"token_label": label,
+			"topic":       topic,
+		}).
+		Debug("Creating QR code token for user %s", u.Name)
+	token, err := s.userManager.CreateScopedToken(u.ID, label, user.TokenTypeIntegration, time.Unix(0, 0), time.Unix(0, 0), v.IP(), r.UserAgent(), scope)
+	if err != nil {
+		return err
+	}
+	return s.writeQRCode(w, r, topic, token.Value)
+}
+
+// qrCodeTopic reads the topic from the request, and checks that the visitor may read it
+func (s *Server) qrCodeTopic(r *http.Request, v *visitor) (string, error) {
+	conf := s.config()
+	if conf.BaseURL == "" {
+		return "", errHTTPInternalErrorMissingBaseURL
+	}
+	topic := readParam(r, "x-topic", "topic")
+	if !topicRegex.MatchString(topic) {
+		return "", errHTTPBadRequestTopicInvalid
+	} else if util.Contains(conf.DisallowedTopics, topic) {
+		return "", errHTTPBadRequestTopicDisallowed
+	} else if !s.topicPermitted(v, topic, user.PermissionRead) {
+		return "", errHTTPForbidden
+	}
+	return topic, nil
+}
+
+func (s *Server) writeQRCode(w http.ResponseWriter, r *http.Request, topic, token string) error {
+	conf := s.config()
+	link, err := qrCodeLink(conf.BaseURL, topic, token)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Access-Control-Allow-Origin", conf.AccessControlAllowOrigin) // CORS, allow cross-origin requests
+	if token != "" {
+		w.Header().Set("Cache-Control", "no-store") // Do not cache QR codes with access tokens
+	}
+	if strings.ToLower(readParam(r, "x-format", "format")) == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, err := w.Write([]byte(link))
+		return err
+	}
+	qr, err := util.NewQRCode(link)
+	if err != nil {
+		return err
+	}
+	image, err := qr.PNG(qrCodeScale)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "image/png")
+	_, err = w.Write(image)
+	return err
+}
+
+// qrCodeLink returns the ntfy:// link for the given server, topic and (optional) token, e.g.
+// ntfy://ntfy.example.com/mytopic, or ntfy://10.0.0.1:8080/mytopic?secure=false&token=tk_...
+func qrCodeLink(baseURL, topic, token string) (string, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return "", err
+	}
+	params := url.Values{}
+	if u.Scheme == "http" {
+		params.Set("secure", "false")
+	}
+	if token != "" {
+		params.Set("token", token)
+	}
+	link := fmt.Sprintf("ntfy://%s/%s", u.Host, topic)
+	if len(params) > 0 {
+		link += "?" + params.Encode()
+	}
+	return link, nil
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+	"image/png"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer_QRCode_Text(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "GET", "/v1/qr?topic=mytopic&format=text", "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "ntfy://127.0.0.1:12345/mytopic?secure=false", response.Body.String())
+
+	c := newTestConfig(t)
+	c.BaseURL = "https://ntfy.example.com"
+	s = newTestServer(t, c)
+	response = request(t, s, "GET", "/v1/qr?topic=mytopic&format=text", "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "ntfy://ntfy.example.com/mytopic", response.Body.String())
+	require.Equal(t, "", response.Header().Get("Cache-Control"))
+}
+
+func TestServer_QRCode_PNG(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "GET", "/v1/qr?topic=mytopic", "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "image/png", response.Header().Get("Content-Type"))
+	img, err := png.Decode(bytes.NewReader(response.Body.Bytes()))
+	require.Nil(t, err)
+	require.Equal(t, img.Bounds().Dx(), img.Bounds().Dy())
+}
+
+func TestServer_QRCode_InvalidTopic(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "GET", "/v1/qr?topic=not+valid", "", nil)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40009, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "GET", "/v1/qr", "", nil)
+	require.Equal(t, 400, response.Code)
+}
+
+func TestServer_QRCode_MissingBaseURL(t *testing.T) {
+	c := newTestConfig(t)
+	c.BaseURL = ""
+	s := newTestServer(t, c)
+	response := request(t, s, "GET", "/v1/qr?topic=mytopic", "", nil)
+	require.Equal(t, 500, response.Code)
+}
+
+func TestServer_QRCode_WithToken(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionDenyAll
+	s := newTestServer(t, c)
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	require.Nil(t, s.userManager.AllowAccess("phil", "mytopic", user.PermissionReadWrite))
+	phil, err := s.userManager.User("phil")
+	require.Nil(t, err)
+	ben, err := s.userManager.User("ben")
+	require.Nil(t, err)
+	philToken, err := s.userManager.CreateToken(phil.ID, "", user.TokenTypeWeb, time.Unix(0, 0), netip.IPv4Unspecified())
+	require.Nil(t, err)
+	benToken, err := s.userManager.CreateToken(ben.ID, "", user.TokenTypeWeb, time.Unix(0, 0), netip.IPv4Unspecified())
+	require.Nil(t, err)
+
+	// Anonymous users cannot read the topic, and cannot include tokens
+	response := request(t, s, "GET", "/v1/qr?topic=mytopic&format=text", "", nil)
+	require.Equal(t, 403, response.Code)
+
+	// Own token is included
+	response = request(t, s, "GET", "/v1/qr?topic=mytopic&format=text&token="+philToken.Value, "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "ntfy://127.0.0.1:12345/mytopic?secure=false&token="+philToken.Value, response.Body.String())
+	require.Equal(t, "no-store", response.Header().Get("Cache-Control"))
+
+	// Tokens of other users are not
+	response = request(t, s, "GET", "/v1/qr?topic=mytopic&format=text&token="+benToken.Value, "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 404, response.Code)
+	require.Equal(t, 40403, toHTTPError(t, response.Body.String()).Code)
+
+	// Users without read access get no QR code
+	response = request(t, s, "GET", "/v1/qr?topic=mytopic&format=text&token="+benToken.Value, "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 403, response.Code)
+}
+
+func TestServer_QRCode_WithToken_Anonymous(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	response := request(t, s, "GET", "/v1/qr?topic=mytopic&token=tk_aaaaaaaaaaaaaaaaaaaaaaaaaaaaa", "", nil)
+	require.Equal(t, 401, response.Code)
+}
+
+func TestServer_QRCode_CreateToken(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionDenyAll
+	s := newTestServer(t, c)
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.AllowAccess("phil", "mytopic", user.PermissionReadWrite))
+	require.Nil(t, s.userManager.AllowAccess("phil", "othertopic", user.PermissionReadWrite))
+
+	// Anonymous users cannot create tokens
+	response := request(t, s, "POST", "/v1/qr?topic=mytopic", "", nil)
+	require.Equal(t, 401, response.Code)
+
+	response = request(t, s, "POST", "/v1/qr?topic=mytopic&format=text", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+	link, err := url.Parse(response.Body.String())
+	require.Nil(t, err)
+	require.Equal(t, "ntfy", link.Scheme)
+	require.Equal(t, "/mytopic", link.Path)
+	token := link.Query().Get("token")
+	require.True(t, strings.HasPrefix(token, "tk_"))
+
+	// Token can only read the topic
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", map[string]string{
+		"Authorization": util.BearerAuth(token),
+	})
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/mytopic", "test", map[string]string{
+		"Authorization": util.BearerAuth(token),
+	})
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "GET", "/othertopic/json?poll=1", "", map[string]string{
+		"Authorization": util.BearerAuth(token),
+	})
+	require.Equal(t, 403, response.Code)
+
+	// Token is listed in the account
+	phil, err := s.userManager.User("phil")
+	require.Nil(t, err)
+	tokens, err := s.userManager.Tokens(phil.ID)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(tokens))
+	require.Equal(t, "QR code onboarding (mytopic)", tokens[0].Label)
+}
+
+func TestQRCodeLink(t *testing.T) {
+	link, err := qrCodeLink("https://ntfy.sh", "mytopic", "")
+	require.Nil(t, err)
+	require.Equal(t, "ntfy://ntfy.sh/mytopic", link)
+	link, err = qrCodeLink("http://10.0.0.1:8080", "mytopic", "tk_abc")
+	require.Nil(t, err)
+	require.Equal(t, "ntfy://10.0.0.1:8080/mytopic?secure=false&token=tk_abc", link)
+}
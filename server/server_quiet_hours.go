@@ -0,0 +1,190 @@
+package server
+
+import (
+	"fmt"
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+	"strings"
+	"time"
+)
+
+// Quiet hours let users hold back low-priority notifications of a subscription during a daily time window,
+// e.g. 22:00-07:00 (see user.QuietHours, stored in the account's subscription settings). Since Firebase and
+// email deliveries are sent per topic, and not per subscriber, the server can only apply quiet hours to topics
+// that the user has reserved, i.e. topics that only the user controls.
+//
+// During quiet hours, Firebase and email deliveries of messages up to the configured priority are held back.
+// The messages are still cached and delivered to connected subscribers. Once the quiet hours end, a single
+// summary notification is sent instead. Held back messages are kept in memory (see Server.quietHours), i.e.
+// a restart drops pending summaries.
+
+const (
+	quietHoursSummaryMaxMessages = 10  // Max. number of messages listed in a summary
+	quietHoursSummaryLineLength  = 100 // Messages are truncated to this many characters in the summary
+)
+
+// quietHoursQueue holds the messages of a topic whose Firebase/email deliveries were held back
+type quietHoursQueue struct {
+	topic    string
+	visitor  *visitor // Visitor of the most recent held back message, used to send the summary
+	messages []*message
+	count    int // Total number of held back messages, may be more than len(messages)
+	firebase bool
+	emails   []string
+	until    time.Time // End of the quiet hours, when the summary is sent
+	language string    // Language of the summary, i.e. the language of the topic owner, see locale.go
+}
+
+// holdForQuietHours checks if the owner of the message's topic has quiet hours configured for the topic, and if the
+// message's priority is low enough to be held back. If so, the message is queued for the summary, and true is returned.
+// The caller must then not send the message to Firebase or via email.
+func (s *Server) holdForQuietHours(v *visitor, m *message, firebase bool, email string) bool {
+	firebase = firebase && s.firebaseClient != nil
+	if s.mailer() == nil {
+		email = ""
+	}
+	if !firebase && email == "" {
+		return false
+	}
+	now := time.Now()
+	quietHours, owner := s.quietHoursForTopic(m.Topic)
+	if quietHours == nil || !quietHours.Active(now) || effectivePriority(m) > quietHours.MaxPriority() {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	queue, ok := s.quietHours[m.Topic]
+	if !ok {
+		queue = &quietHoursQueue{
+			topic:    m.Topic,
+			messages: make([]*message, 0),
+			emails:   make([]string, 0),
+			until:    quietHours.NextEnd(now),
+			language: s.config().DefaultLanguage,
+		}
+		if lang, ok := userLanguage(owner); ok {
+			queue.language = lang
+		}
+		s.quietHours[m.Topic] = queue
+	}
+	queue.visitor = v
+	queue.count++
+	if len(queue.messages) < quietHoursSummaryMaxMessages {
+		queue.messages = append(queue.messages, m)
+	}
+	queue.firebase = queue.firebase || firebase
+	if email != "" && !util.Contains(queue.emails, email) {
+		queue.emails = append(queue.emails, email)
+	}
+	logvm(v, m).
+		Tag(tagPublish).
+		Fields(log.Context{
+			"quiet_hours_until":    queue.until.Unix(),
+			"quiet_hours_messages": queue.count,
+		}).
+		Debug("Holding back Firebase/email delivery during quiet hours")
+	return true
+}
+
+// quietHoursForTopic returns the quiet hours the owner of a reserved topic has configured for their
+// subscription to the topic (and the owner), or nil if there are none
+func (s *Server) quietHoursForTopic(topic string) (*user.QuietHours, *user.User) {
+	sub, owner := s.ownerSubscription(topic)
+	if sub == nil || sub.QuietHours == nil {
+		return nil, nil
+	}
+	return sub.QuietHours, owner
+}
+
+// ownerSubscription returns the subscription of the owner of a reserved topic to the topic (and the owner),
+// or nil if the topic is not reserved, or the owner has not subscribed to it in their account
+func (s *Server) ownerSubscription(topic string) (*user.Subscription, *user.User) {
+	conf := s.config()
+	if s.userManager == nil || conf.BaseURL == "" {
+		return nil, nil
+	}
+	ownerID, err := s.userManager.ReservationOwner(topic)
+	if err != nil || ownerID == "" {
+		return nil, nil
+	}
+	owner, err := s.userManager.UserByID(ownerID)
+	if err != nil {
+		return nil, nil
+	}
+	if sub := userSubscription(owner, conf.BaseURL, topic); sub != nil {
+		return sub, owner
+	}
+	return nil, nil
+}
+
+// userSubscription returns the user's subscription to the given topic, or nil if there is none
+func userSubscription(u *user.User, baseURL, topic string) *user.Subscription {
+	if u.Prefs == nil {
+		return nil
+	}
+	for _, sub := range u.Prefs.Subscriptions {
+		if sub.BaseURL == baseURL && sub.Topic == topic {
+			return sub
+		}
+	}
+	return nil
+}
+
+// sendQuietHoursSummaries sends a summary of the held back messages for all topics whose quiet hours have ended
+func (s *Server) sendQuietHoursSummaries() {
+	s.mu.Lock()
+	due := make([]*quietHoursQueue, 0)
+	for topic, queue := range s.quietHours {
+		if time.Now().After(queue.until) {
+			due = append(due, queue)
+			delete(s.quietHours, topic)
+		}
+	}
+	s.mu.Unlock()
+	for _, queue := range due {
+		m := newQuietHoursSummaryMessage(queue)
+		logvm(queue.visitor, m).Tag(tagPublish).Debug("Sending quiet hours summary for %d message(s)", queue.count)
+		if queue.firebase && s.firebaseClient != nil {
+			s.sendToFirebase(queue.visitor, m)
+		}
+		if sender := s.mailer(); sender != nil {
+			for _, email := range queue.emails {
+				go s.sendEmail(sender, queue.visitor, m, email)
+			}
+		}
+	}
+}
+
+// newQuietHoursSummaryMessage creates the summary message for the held back messages, listing the first few of them
+func newQuietHoursSummaryMessage(queue *quietHoursQueue) *message {
+	var b strings.Builder
+	b.WriteString(locales.Plural(queue.language, "quiet_hours_summary_message", queue.count))
+	for _, m := range queue.messages {
+		text := []rune(strings.ReplaceAll(m.Message, "\n", " "))
+		if len(text) > quietHoursSummaryLineLength {
+			text = append(text[:quietHoursSummaryLineLength], '…')
+		}
+		if m.Title != "" {
+			fmt.Fprintf(&b, "\n- %s: %s", m.Title, string(text))
+		} else {
+			fmt.Fprintf(&b, "\n- %s", string(text))
+		}
+	}
+	if queue.count > len(queue.messages) {
+		b.WriteString("\n" + locales.Text(queue.language, "quiet_hours_summary_more", queue.count-len(queue.messages)))
+	}
+	m := newDefaultMessage(queue.topic, b.String())
+	m.Title = locales.Text(queue.language, "quiet_hours_summary_title")
+	m.Language = queue.language
+	m.Tags = []string{"zzz"}
+	return m
+}
+
+// effectivePriority returns the priority of the message, treating "not set" (0) as the default priority (3)
+func effectivePriority(m *message) int {
+	if m.Priority == 0 {
+		return 3
+	}
+	return m.Priority
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"heckel.io/ntfy/v2/log"
+	"reflect"
+)
+
+// serverState holds the settings that can be changed via Reload. It is never modified after it was stored in
+// Server.state, so it can be read without holding any locks.
+type serverState struct {
+	config *Config
+	mailer mailer // May be nil if email sending is disabled
+}
+
+// Reload applies the settings of the given config that are safe to change at runtime to the running server, and
+// returns the names of the settings that changed. Reloading does not drop any subscriber connections. All other
+// settings (listen addresses, databases, ...) are ignored; changing them requires a restart.
+//
+// Reloadable settings are:
+//   - Rate limits: All visitor-* limits, the global subscription limit, and the UnifiedPush endpoint limits. The rate limiters of all current
+//     visitors are re-created (keeping their daily message/email/call stats and active subscriptions)
+//   - Disallowed topics
+//   - SMTP sender and email provider settings: If smtp-sender-addr (or email-provider) is set/unset, email sending
+//     is enabled/disabled
+//
+// The log level is not part of the server config, and is reloaded by the caller.
+//
+// The config and email sender are never modified in place. Instead, Reload copies the current config, applies the
+// changes to the copy, and atomically swaps in a new serverState. Request handlers read the state once via
+// Server.config and Server.mailer, and may keep using the old one for the rest of the request.
+func (s *Server) Reload(conf *Config) []string {
+	s.mu.Lock() // Serializes concurrent reloads
+	defer s.mu.Unlock()
+	current := s.state.Load()
+	updated := *current.config
+	changed := make([]string, 0)
+	var limitsChanged bool
+	limitsChanged = reloadSetting("visitor-subscription-limit", &updated.VisitorSubscriptionLimit, conf.VisitorSubscriptionLimit, &changed) || limitsChanged
+	limitsChanged = reloadSetting("visitor-subscription-duration-limit", &updated.VisitorSubscriptionDurationLimit, conf.VisitorSubscriptionDurationLimit, &changed) || limitsChanged
+	limitsChanged = reloadSetting("visitor-request-limit-burst", &updated.VisitorRequestLimitBurst, conf.VisitorRequestLimitBurst, &changed) || limitsChanged
+	limitsChanged = reloadSetting("visitor-request-limit-replenish", &updated.VisitorRequestLimitReplenish, conf.VisitorRequestLimitReplenish, &changed) || limitsChanged
+	limitsChanged = reloadSetting("visitor-request-limit-exempt-hosts", &updated.VisitorRequestExemptIPAddrs, conf.VisitorRequestExemptIPAddrs, &changed) || limitsChanged
+	limitsChanged = reloadSetting("visitor-message-daily-limit", &updated.VisitorMessageDailyLimit, conf.VisitorMessageDailyLimit, &changed) || limitsChanged
+	limitsChanged = reloadSetting("visitor-email-limit-burst", &updated.VisitorEmailLimitBurst, conf.VisitorEmailLimitBurst, &changed) || limitsChanged
+	limitsChanged = reloadSetting("visitor-email-limit-replenish", &updated.VisitorEmailLimitReplenish, conf.VisitorEmailLimitReplenish, &changed) || limitsChanged
+	limitsChanged = reloadSetting("visitor-attachment-total-size-limit", &updated.VisitorAttachmentTotalSizeLimit, conf.VisitorAttachmentTotalSizeLimit, &changed) || limitsChanged
+	limitsChanged = reloadSetting("visitor-attachment-daily-bandwidth-limit", &updated.VisitorAttachmentDailyBandwidthLimit, conf.VisitorAttachmentDailyBandwidthLimit, &changed) || limitsChanged
+	limitsChanged = reloadSetting("visitor-subscriber-rate-limiting", &updated.VisitorSubscriberRateLimiting, conf.VisitorSubscriberRateLimiting, &changed) || limitsChanged
+	reloadSetting("global-subscription-limit", &updated.TotalSubscriptionLimit, conf.TotalSubscriptionLimit, &changed)
+	reloadSetting("unifiedpush-endpoint-limit-burst", &updated.UnifiedPushEndpointLimitBurst, conf.UnifiedPushEndpointLimitBurst, &changed)
+	reloadSetting("unifiedpush-endpoint-limit-replenish", &updated.UnifiedPushEndpointLimitReplenish, conf.UnifiedPushEndpointLimitReplenish, &changed)
+	reloadSetting("disallowed-topics", &updated.DisallowedTopics, conf.DisallowedTopics, &changed)
+	var emailChanged bool
+	emailChanged = reloadSetting("smtp-sender-addr", &updated.SMTPSenderAddr, conf.SMTPSenderAddr, &changed) || emailChanged
+	emailChanged = reloadSetting("smtp-sender-user", &updated.SMTPSenderUser, conf.SMTPSenderUser, &changed) || emailChanged
+	emailChanged = reloadSetting("smtp-sender-pass", &updated.SMTPSenderPass, conf.SMTPSenderPass, &changed) || emailChanged
+	emailChanged = reloadSetting("smtp-sender-from", &updated.SMTPSenderFrom, conf.SMTPSenderFrom, &changed) || emailChanged
+	emailChanged = reloadSetting("smtp-sender-proxy", &updated.SMTPSenderProxy, conf.SMTPSenderProxy, &changed) || emailChanged
+	reloadSetting("smtp-sender-retry-max-age", &updated.SMTPSenderRetryMaxAge, conf.SMTPSenderRetryMaxAge, &changed)
+	emailChanged = reloadSetting("email-provider", &updated.EmailProvider, conf.EmailProvider, &changed) || emailChanged
+	emailChanged = reloadSetting("email-provider-key", &updated.EmailProviderKey, conf.EmailProviderKey, &changed) || emailChanged
+	emailChanged = reloadSetting("email-provider-key-id", &updated.EmailProviderKeyID, conf.EmailProviderKeyID, &changed) || emailChanged
+	emailChanged = reloadSetting("email-provider-region", &updated.EmailProviderRegion, conf.EmailProviderRegion, &changed) || emailChanged
+	emailChanged = reloadSetting("email-provider-domain", &updated.EmailProviderDomain, conf.EmailProviderDomain, &changed) || emailChanged
+	sender := current.mailer
+	if s.options.mailer != nil {
+		// Custom mailer passed to New, see server_options.go
+	} else if emailSendingEnabled(&updated) && (sender == nil || emailChanged) {
+		// Senders keep the config they were created with, so they are re-created if any email setting changed
+		newSender, err := newMailer(&updated)
+		if err != nil {
+			log.Tag(tagManager).Err(err).Warn("Unable to create email sender, keeping previous email settings")
+		} else {
+			sender = newSender
+		}
+	} else if !emailSendingEnabled(&updated) {
+		sender = nil
+	}
+	s.state.Store(&serverState{config: &updated, mailer: sender})
+	visitors := s.visitors.Values()
+	for _, v := range visitors {
+		v.Reload(&updated, limitsChanged)
+	}
+	if limitsChanged {
+		log.Tag(tagManager).Debug("Reset rate limiters of %d visitor(s)", len(visitors))
+	}
+	go s.configReloaded(changed)
+	return changed
+}
+
+// reloadSetting sets current to updated if they differ, and adds the setting name to the list of changed settings.
+// It returns true if the setting changed.
+func reloadSetting[T any](name string, current *T, updated T, changed *[]string) bool {
+	if reflect.DeepEqual(*current, updated) {
+		return false
+	}
+	*current = updated
+	*changed = append(*changed, name)
+	return true
+}
+
+// config returns the current config. Callers that read multiple settings that belong together should call this once.
+func (s *Server) config() *Config {
+	return s.state.Load().config
+}
+
+// mailer returns the current email sender, or nil if email sending is disabled. Since email sending may be disabled
+// by a reload at any time, callers must check the returned value, and not call this again to use it.
+func (s *Server) mailer() mailer {
+	return s.state.Load().mailer
+}
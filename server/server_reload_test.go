@@ -0,0 +1,79 @@
+package server
+
+import (
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+)
+
+func TestServer_Reload(t *testing.T) {
+	c := newTestConfig(t)
+	c.VisitorRequestLimitBurst = 2
+	s := newTestServer(t, c)
+
+	for i := 0; i < 2; i++ {
+		require.Equal(t, 200, request(t, s, "PUT", "/mytopic", "message", nil).Code)
+	}
+	require.Equal(t, 429, request(t, s, "PUT", "/mytopic", "message", nil).Code)
+
+	// Reload config with higher burst, a disallowed topic and an SMTP server
+	conf := newTestConfig(t)
+	conf.VisitorRequestLimitBurst = 5
+	conf.DisallowedTopics = append(conf.DisallowedTopics, "forbidden")
+	conf.SMTPSenderAddr = "mail.example.com:587"
+	conf.SMTPSenderFrom = "ntfy@example.com"
+	changed := s.Reload(conf)
+	require.Equal(t, []string{"visitor-request-limit-burst", "disallowed-topics", "smtp-sender-addr", "smtp-sender-from"}, changed)
+	require.NotNil(t, s.mailer())
+
+	// Limiters of existing visitors were reset
+	for i := 0; i < 5; i++ {
+		require.Equal(t, 200, request(t, s, "PUT", "/mytopic", "message", nil).Code)
+	}
+	require.Equal(t, 429, request(t, s, "PUT", "/mytopic", "message", nil).Code)
+
+	response := request(t, s, "PUT", "/forbidden", "message", nil)
+	require.Equal(t, 40010, toHTTPError(t, response.Body.String()).Code)
+
+	// Reloading the same config changes nothing, unsetting the SMTP server disables email
+	require.Empty(t, s.Reload(conf))
+	conf.SMTPSenderAddr = ""
+	require.Equal(t, []string{"smtp-sender-addr"}, s.Reload(conf))
+	require.Nil(t, s.mailer())
+}
+
+func TestServer_Reload_WhilePublishingEmails(t *testing.T) {
+	// This test is meant to be run with -race. Email sending is repeatedly enabled and disabled while messages
+	// with an email address are published, which must neither race nor use a nil email sender.
+	c := newTestConfig(t)
+	c.SMTPSenderAddr = "127.0.0.1:1" // Nothing listening, emails fail
+	c.SMTPSenderFrom = "ntfy@example.com"
+	c.VisitorRequestLimitBurst = 1000
+	c.VisitorEmailLimitBurst = 1000
+	s := newTestServer(t, c)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				response := request(t, s, "PUT", "/mytopic", "message", map[string]string{
+					"E-Mail": "test@example.com",
+				})
+				require.Contains(t, []int{200, 400}, response.Code) // 400 if email is disabled
+			}
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		conf := newTestConfig(t)
+		conf.SMTPSenderFrom = "ntfy@example.com"
+		conf.VisitorRequestLimitBurst = 1000 + i
+		conf.VisitorEmailLimitBurst = 1000
+		if i%2 == 1 {
+			conf.SMTPSenderAddr = "127.0.0.1:1"
+		}
+		s.Reload(conf)
+	}
+	wg.Wait()
+}
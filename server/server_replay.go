@@ -0,0 +1,128 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Message replay re-publishes a window of a topic's cached messages into another topic, e.g. to test new
+// subscribers against realistic traffic. Replayed messages are new messages (with a new ID and time), but keep the
+// title, body, priority, tags, actions, etc. of the original messages. Attachments are not copied, i.e. they still
+// point to the original attachment URL.
+//
+// If a speed is given, the original timing between messages is kept (divided by the speed factor, e.g. 2 replays
+// twice as fast), and the replay runs in the background. Otherwise, all messages are published right away.
+
+const (
+	replayMessagesLimit = 1000 // Max number of messages that are replayed in one request
+)
+
+func (s *Server) handleReplay(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	req, err := readJSONWithLimit[apiReplayRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	}
+	if !topicRegex.MatchString(req.Topic) || !topicRegex.MatchString(req.Target) || req.Topic == req.Target {
+		return errHTTPBadRequestReplayInvalid
+	} else if req.Speed < 0 {
+		return errHTTPBadRequestReplayInvalid
+	}
+	since, err := parseReplaySince(req.Since)
+	if err != nil {
+		return errHTTPBadRequestReplayInvalid
+	}
+	until, err := parseReplayTime(req.Until, time.Now())
+	if err != nil {
+		return errHTTPBadRequestReplayInvalid
+	}
+	cached, err := s.messageCache.Messages(req.Topic, since, false)
+	if err != nil {
+		return err
+	}
+	messages := make([]*message, 0)
+	for _, m := range cached {
+		if m.Event != messageEvent || m.Time > until.Unix() {
+			continue
+		} else if len(messages) >= replayMessagesLimit {
+			break
+		}
+		messages = append(messages, m)
+	}
+	logvr(v, r).
+		Tag(tagManager).
+		Fields(map[string]any{
+			"replay_topic":    req.Topic,
+			"replay_target":   req.Target,
+			"replay_messages": len(messages),
+			"replay_speed":    req.Speed,
+		}).
+		Info("Replaying %d message(s) from topic %s to topic %s", len(messages), req.Topic, req.Target)
+	if req.Speed > 0 {
+		go s.replayMessages(v, req.Target, messages, req.Speed)
+	} else {
+		s.replayMessages(v, req.Target, messages, 0)
+	}
+	return s.writeJSON(w, &apiReplayResponse{
+		Success:  true,
+		Messages: len(messages),
+	})
+}
+
+// replayMessages publishes copies of the given messages to the target topic. If speed is larger than zero,
+// the time between messages is scaled accordingly, otherwise messages are published without delay.
+func (s *Server) replayMessages(v *visitor, target string, messages []*message, speed float64) {
+	for i, original := range messages {
+		if speed > 0 && i > 0 {
+			delay := time.Duration(float64(time.Duration(original.Time-messages[i-1].Time)*time.Second) / speed)
+			select {
+			case <-time.After(delay):
+			case <-s.closeChan:
+				return
+			}
+		}
+		m := newDefaultMessage(target, original.Message)
+		m.Title = original.Title
+		m.Priority = original.Priority
+		m.Tags = original.Tags
+		m.Click = original.Click
+		m.Icon = original.Icon
+		m.Actions = original.Actions
+		m.Attachment = original.Attachment
+		m.ContentType = original.ContentType
+		m.Encoding = original.Encoding
+		if err := s.publishMessage(v, m); err != nil {
+			logvm(v, m).Tag(tagManager).Err(err).Warn("Unable to replay message %s", original.ID)
+		}
+	}
+}
+
+// parseReplaySince parses the "since" field of a replay request, which can be a message ID, a Unix timestamp,
+// or a duration (e.g. "1h", meaning one hour ago). If empty, all cached messages are replayed.
+func parseReplaySince(since string) (sinceMarker, error) {
+	if since == "" || since == "all" {
+		return sinceAllMessages, nil
+	} else if validMessageID(since) {
+		return newSinceID(since), nil
+	}
+	t, err := parseReplayTime(since, time.Time{})
+	if err != nil {
+		return sinceNoMessages, err
+	}
+	return newSinceTime(t.Unix()), nil
+}
+
+// parseReplayTime parses a Unix timestamp or a duration (e.g. "1h", meaning one hour ago), and returns
+// the given default value if the string is empty.
+func parseReplayTime(s string, defaultValue time.Time) (time.Time, error) {
+	if s == "" {
+		return defaultValue, nil
+	} else if t, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(t, 0), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Now().Add(-d), nil
+}
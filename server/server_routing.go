@@ -0,0 +1,59 @@
+package server
+
+import (
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/user"
+)
+
+// Notification routing lets users choose which delivery channels fire for a subscription (see user.Routing, stored
+// in the account's subscription settings), e.g. only push notifications, and only for high-priority messages. It is
+// enforced when a message is fanned out:
+//
+//   - Web push notifications are sent per subscriber, so the routing of each web push subscriber's account is applied.
+//   - Firebase and email deliveries are sent per topic, and not per subscriber. Like quiet hours (see
+//     server_quiet_hours.go), the routing can only be applied to topics that the user has reserved.
+//
+// Messages are always cached, and delivered to connected subscribers, regardless of the routing.
+
+// routeMessage applies the routing of the topic owner to the Firebase and email deliveries of a message, and returns
+// whether the message should still be sent to Firebase, and to which email address (if any)
+func (s *Server) routeMessage(v *visitor, m *message, firebase bool, email string) (bool, string) {
+	if !firebase && email == "" {
+		return firebase, email
+	}
+	sub, _ := s.ownerSubscription(m.Topic)
+	if sub == nil || sub.Routing == nil {
+		return firebase, email
+	}
+	priority := effectivePriority(m)
+	routedFirebase := firebase && sub.Routing.Allows(user.RoutingChannelPush, priority)
+	routedEmail := email
+	if !sub.Routing.Allows(user.RoutingChannelEmail, priority) {
+		routedEmail = ""
+	}
+	if routedFirebase != firebase || routedEmail != email {
+		logvm(v, m).
+			Tag(tagPublish).
+			Fields(log.Context{
+				"routing_firebase": routedFirebase,
+				"routing_email":    routedEmail != "",
+			}).
+			Debug("Routing preferences of topic owner suppressed Firebase/email delivery")
+	}
+	return routedFirebase, routedEmail
+}
+
+// webPushRoutingAllows returns true if the account of the web push subscriber (if any) allows push notifications
+// for the message
+func (s *Server) webPushRoutingAllows(subscription *webPushSubscription, m *message) bool {
+	conf := s.config()
+	if subscription.UserID == "" || s.userManager == nil || conf.BaseURL == "" {
+		return true
+	}
+	u, err := s.userManager.UserByID(subscription.UserID)
+	if err != nil {
+		return true
+	}
+	sub := userSubscription(u, conf.BaseURL, m.Topic)
+	return sub == nil || sub.Routing == nil || sub.Routing.Allows(user.RoutingChannelPush, effectivePriority(m))
+}
@@ -0,0 +1,255 @@
+package server
+
+import (
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"heckel.io/ntfy/v2/log"
+)
+
+// Sampling keeps high-volume topics (e.g. debug-level firehoses) from draining the batteries of their subscribers:
+// Topic owners define a sampling rule via PUT /<topic>/sampling (requires the manage permission), e.g.
+// {"rate":10,"max_priority":3}, which means that only 1 in 10 messages up to priority 3 is delivered. Messages
+// with a higher priority are always delivered. Rules are removed via DELETE /<topic>/sampling.
+//
+// Sampling is enforced at fanout: Suppressed messages are still cached (and can be polled), but they are not
+// delivered to subscribers, Firebase, web push, e-mail, phone calls or the upstream server. To keep the topic
+// observable, a summary message with the number of suppressed messages is published to the topic every hour
+// (unless "summary" is false), and suppressed messages are counted in the ntfy_messages_sampled_out_total metric.
+//
+// Rules are stored in the message cache (see message_cache_sampling.go) and held in memory. Counters are
+// kept in memory only, i.e. a restart drops the pending summaries.
+
+const (
+	samplingRateMax            = 10000
+	samplingMaxPriorityDefault = 3 // Messages up to the default priority are sampled, unless defined otherwise
+	samplingSummaryInterval    = time.Hour
+	samplingSummaryPriority    = 2
+	samplingSummaryTag         = "scissors"
+)
+
+// samplingRule defines which messages of a topic are sampled
+type samplingRule struct {
+	Rate        int  // Deliver 1 in Rate messages
+	MaxPriority int  // Only messages up to this priority are sampled, higher priorities are always delivered
+	Summary     bool // Publish an hourly summary of suppressed messages
+}
+
+// samplingCounter counts the sampled messages of a topic
+type samplingCounter struct {
+	matched    int64     // Number of messages the rule applied to, used to pick every Nth message
+	suppressed int       // Number of suppressed messages since the last summary
+	since      time.Time // Start of the current summary interval
+}
+
+// topicSampling is the in-memory list of sampling rules, and their counters
+type topicSampling struct {
+	rules    map[string]*samplingRule
+	counters map[string]*samplingCounter
+	mu       sync.Mutex
+}
+
+// newTopicSampling loads the sampling rules from the message cache
+func newTopicSampling(cache *messageCache) (*topicSampling, error) {
+	rules, err := cache.TopicSamplingRules()
+	if err != nil {
+		return nil, err
+	}
+	return &topicSampling{
+		rules:    rules,
+		counters: make(map[string]*samplingCounter),
+	}, nil
+}
+
+// Rule returns the sampling rule of a topic, and the number of suppressed messages since the last summary
+func (t *topicSampling) Rule(topic string) (*samplingRule, int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	rule, ok := t.rules[topic]
+	if !ok {
+		return nil, 0
+	}
+	if counter, ok := t.counters[topic]; ok {
+		return rule, counter.suppressed
+	}
+	return rule, 0
+}
+
+// Set adds or replaces the sampling rule of a topic. Counters are kept, so that pending summaries are not lost.
+func (t *topicSampling) Set(topic string, rule *samplingRule) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rules[topic] = rule
+}
+
+// Remove removes the sampling rule of a topic, and returns false if there was none
+func (t *topicSampling) Remove(topic string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.rules[topic]; !ok {
+		return false
+	}
+	delete(t.rules, topic)
+	delete(t.counters, topic)
+	return true
+}
+
+// Suppress returns true if the message should not be delivered, because the sampling rule of its topic
+// applies to the message, and it is not the 1 in N message that is delivered
+func (t *topicSampling) Suppress(m *message) bool {
+	if m.Event != messageEvent {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	rule, ok := t.rules[m.Topic]
+	if !ok || effectivePriority(m) > rule.MaxPriority {
+		return false
+	}
+	counter, ok := t.counters[m.Topic]
+	if !ok {
+		counter = &samplingCounter{since: time.Now()}
+		t.counters[m.Topic] = counter
+	}
+	counter.matched++
+	if (counter.matched-1)%int64(rule.Rate) == 0 {
+		return false
+	}
+	counter.suppressed++
+	return true
+}
+
+// DueSummaries returns the number of suppressed messages (topic -> count) of all topics whose summary interval has
+// ended, and that have summaries enabled. The counters of these topics are reset.
+func (t *topicSampling) DueSummaries(now time.Time) map[string]int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	due := make(map[string]int)
+	for topic, counter := range t.counters {
+		if now.Sub(counter.since) < samplingSummaryInterval {
+			continue
+		}
+		if rule, ok := t.rules[topic]; ok && rule.Summary && counter.suppressed > 0 {
+			due[topic] = counter.suppressed
+		}
+		counter.suppressed = 0
+		counter.since = now
+	}
+	return due
+}
+
+// sampleOut checks if the message is suppressed by the sampling rule of its topic, see topicSampling.Suppress.
+// If it returns true, the caller must not deliver the message.
+func (s *Server) sampleOut(v *visitor, m *message) bool {
+	if !s.sampling.Suppress(m) {
+		return false
+	}
+	minc(metricMessagesSampledOut)
+	logvm(v, m).Tag(tagPublish).Debug("Message suppressed by sampling rule, not delivering to subscribers")
+	return true
+}
+
+// sendSamplingSummaries publishes a summary message to all topics whose summary interval has ended
+func (s *Server) sendSamplingSummaries() {
+	conf := s.config()
+	due := s.sampling.DueSummaries(time.Now())
+	if len(due) == 0 {
+		return
+	}
+	v := newVisitor(conf, s.messageCache, s.userManager, netip.IPv4Unspecified(), nil) // Background process, not a real visitor, uses IP 0.0.0.0
+	for topic, suppressed := range due {
+		m := newDefaultMessage(topic, locales.Plural(conf.DefaultLanguage, "sampling_summary_message", suppressed))
+		m.Title = locales.Text(conf.DefaultLanguage, "sampling_summary_title")
+		m.Priority = samplingSummaryPriority
+		m.Tags = []string{samplingSummaryTag}
+		logvm(v, m).Tag(tagPublish).Debug("Publishing sampling summary for %d suppressed message(s)", suppressed)
+		if err := s.publishMessage(v, m); err != nil {
+			logvm(v, m).Tag(tagPublish).Err(err).Warn("Unable to publish sampling summary")
+		}
+	}
+}
+
+// handleTopicSamplingGet returns the sampling rule of the topic in the path
+func (s *Server) handleTopicSamplingGet(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	topic, err := samplingTopicFromPath(r)
+	if err != nil {
+		return err
+	}
+	rule, suppressed := s.sampling.Rule(topic)
+	if rule == nil {
+		return errHTTPNotFoundTopicSampling
+	}
+	return s.writeJSON(w, &apiTopicSamplingResponse{
+		Topic:       topic,
+		Rate:        rule.Rate,
+		MaxPriority: rule.MaxPriority,
+		Summary:     rule.Summary,
+		Suppressed:  suppressed,
+	})
+}
+
+// handleTopicSamplingSet defines the sampling rule of the topic in the path, replacing any existing rule
+func (s *Server) handleTopicSamplingSet(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	topic, err := samplingTopicFromPath(r)
+	if err != nil {
+		return err
+	}
+	req, err := readJSONWithLimit[apiTopicSamplingRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	}
+	rule := &samplingRule{
+		Rate:        req.Rate,
+		MaxPriority: req.MaxPriority,
+		Summary:     req.Summary == nil || *req.Summary,
+	}
+	if rule.MaxPriority == 0 {
+		rule.MaxPriority = samplingMaxPriorityDefault
+	}
+	if rule.Rate < 2 || rule.Rate > samplingRateMax {
+		return errHTTPBadRequestTopicSamplingInvalid.Wrap("rate must be between 2 and %d", samplingRateMax)
+	} else if rule.MaxPriority < 1 || rule.MaxPriority > 4 {
+		return errHTTPBadRequestTopicSamplingInvalid.Wrap("max_priority must be between 1 and 4")
+	}
+	if err := s.messageCache.SetTopicSamplingRule(topic, rule); err != nil {
+		return err
+	}
+	s.sampling.Set(topic, rule)
+	logvr(v, r).
+		Tag(tagManager).
+		Fields(log.Context{
+			"sampling_rate":         rule.Rate,
+			"sampling_max_priority": rule.MaxPriority,
+			"sampling_summary":      rule.Summary,
+		}).
+		Info("Defined sampling rule for topic %s", topic)
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+// handleTopicSamplingDelete removes the sampling rule of the topic in the path
+func (s *Server) handleTopicSamplingDelete(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	topic, err := samplingTopicFromPath(r)
+	if err != nil {
+		return err
+	}
+	if !s.sampling.Remove(topic) {
+		return errHTTPNotFoundTopicSampling
+	}
+	if err := s.messageCache.RemoveTopicSamplingRule(topic); err != nil {
+		return err
+	}
+	logvr(v, r).Tag(tagManager).Info("Removed sampling rule of topic %s", topic)
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+// samplingTopicFromPath returns the topic from a path like /debug/sampling
+func samplingTopicFromPath(r *http.Request) (string, error) {
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) != 3 {
+		return "", errHTTPInternalErrorInvalidPath
+	}
+	return parts[1], nil
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+func TestServer_TopicSampling(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionReadWrite
+	s := newTestServer(t, c)
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.AddReservation("phil", "debug", user.PermissionReadWrite))
+	phil := map[string]string{"Authorization": util.BasicAuth("phil", "phil")}
+
+	// Only owners can define rules
+	require.Equal(t, 403, request(t, s, "PUT", "/debug/sampling", `{"rate":3}`, nil).Code)
+	require.Equal(t, 200, request(t, s, "PUT", "/debug/sampling", `{"rate":3}`, phil).Code)
+
+	// Collect delivered messages
+	tp, err := s.topicFromID("debug")
+	require.Nil(t, err)
+	var mu sync.Mutex
+	delivered := make([]string, 0)
+	tp.Subscribe(func(_ *visitor, m *message) error {
+		mu.Lock()
+		defer mu.Unlock()
+		delivered = append(delivered, m.Message)
+		return nil
+	}, "", func() {})
+
+	// 1 in 3 low-priority messages is delivered, high priority messages are always delivered
+	for _, body := range []string{"1", "2", "3", "4", "5"} {
+		require.Equal(t, 200, request(t, s, "PUT", "/debug", body, nil).Code)
+	}
+	require.Equal(t, 200, request(t, s, "PUT", "/debug", "urgent", map[string]string{"Priority": "5"}).Code)
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(delivered) == 3
+	})
+	mu.Lock()
+	require.ElementsMatch(t, []string{"1", "4", "urgent"}, delivered)
+	mu.Unlock()
+
+	// Suppressed messages are still cached
+	rr := request(t, s, "GET", "/debug/json?poll=1", "", nil)
+	require.Equal(t, 6, len(toMessages(t, rr.Body.String())))
+
+	// Rule and counter
+	rr = request(t, s, "GET", "/debug/sampling", "", nil)
+	require.Equal(t, 200, rr.Code)
+	rule, _ := util.UnmarshalJSON[apiTopicSamplingResponse](io.NopCloser(rr.Body))
+	require.Equal(t, 3, rule.Rate)
+	require.Equal(t, 3, rule.MaxPriority)
+	require.True(t, rule.Summary)
+	require.Equal(t, 3, rule.Suppressed)
+
+	// Summary is published once the interval has ended
+	s.sampling.mu.Lock()
+	s.sampling.counters["debug"].since = time.Now().Add(-2 * samplingSummaryInterval)
+	s.sampling.mu.Unlock()
+	s.sendSamplingSummaries()
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(delivered) == 4
+	})
+	mu.Lock()
+	require.Equal(t, "3 messages were not delivered in the last hour due to sampling", delivered[3])
+	mu.Unlock()
+	_, suppressed := s.sampling.Rule("debug")
+	require.Equal(t, 0, suppressed)
+
+	// Remove rule
+	require.Equal(t, 200, request(t, s, "DELETE", "/debug/sampling", "", phil).Code)
+	require.Equal(t, 404, request(t, s, "GET", "/debug/sampling", "", nil).Code)
+	require.Equal(t, 404, request(t, s, "DELETE", "/debug/sampling", "", phil).Code)
+}
+
+func TestServer_TopicSampling_Invalid(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	admin := map[string]string{"Authorization": util.BasicAuth("phil", "phil")}
+	for _, body := range []string{
+		`{}`,
+		`{"rate":1}`,
+		`{"rate":100000}`,
+		`{"rate":10,"max_priority":5}`,
+	} {
+		rr := request(t, s, "PUT", "/debug/sampling", body, admin)
+		require.Equal(t, 400, rr.Code, body)
+		require.Equal(t, 40085, toHTTPError(t, rr.Body.String()).Code)
+	}
+}
+
+func TestServer_TopicSampling_Persisted(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	s := newTestServer(t, c)
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	require.Equal(t, 200, request(t, s, "PUT", "/debug/sampling", `{"rate":10,"max_priority":2,"summary":false}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	}).Code)
+	s.closeDatabases()
+
+	s = newTestServer(t, c)
+	defer s.closeDatabases()
+	rule, _ := s.sampling.Rule("debug")
+	require.Equal(t, &samplingRule{Rate: 10, MaxPriority: 2, Summary: false}, rule)
+}
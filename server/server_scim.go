@@ -0,0 +1,602 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+// SCIM 2.0 (RFC 7643 and RFC 7644) lets identity providers (e.g. Okta, Entra ID, authentik) automatically provision
+// and deprovision ntfy accounts. The identity provider authenticates with the access token of an admin user. Only
+// regular users are managed via SCIM; admins are neither listed, nor can they be modified.
+//
+//   - Users map to ntfy users: "userName" is the username, and "active" maps to the suspension of the account, i.e.
+//     deactivating a user suspends it indefinitely (see suspendUser). Deleting a user removes it entirely.
+//   - Groups map to tiers: The "displayName" of a group is the tier code, and its members are the users on the tier.
+//     Groups cannot be created or deleted via SCIM, since tiers define limits and must be created by an admin.
+//
+// Filtering is only supported for the "eq" operator (e.g. filter=userName eq "phil"), which is what identity
+// providers use to look up existing resources. Sorting, ETags and bulk operations are not supported.
+
+const (
+	scimSchemaUser                  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimSchemaGroup                 = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimSchemaListResponse          = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimSchemaServiceProviderConfig = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	scimContentType                 = "application/scim+json"
+	scimListMaxResults              = 200
+	scimPasswordLength              = 32 // Length of the random password if the identity provider does not set one
+	scimSuspendReason               = "deactivated by identity provider"
+)
+
+var (
+	scimFilterRegex = regexp.MustCompile(`(?i)^(userName|displayName)\s+eq\s+"([^"]*)"$`)
+	scimMemberRegex = regexp.MustCompile(`(?i)^members\[value\s+eq\s+"([^"]+)"\]$`)
+)
+
+type scimUser struct {
+	Schemas  []string      `json:"schemas"`
+	ID       string        `json:"id,omitempty"`
+	UserName string        `json:"userName"`
+	Password string        `json:"password,omitempty"` // Write-only
+	Active   *bool         `json:"active,omitempty"`
+	Groups   []*scimMember `json:"groups,omitempty"` // Read-only, see Group
+	Meta     *scimMeta     `json:"meta,omitempty"`
+}
+
+type scimGroup struct {
+	Schemas     []string      `json:"schemas"`
+	ID          string        `json:"id,omitempty"`
+	DisplayName string        `json:"displayName"`
+	Members     []*scimMember `json:"members"`
+	Meta        *scimMeta     `json:"meta,omitempty"`
+}
+
+type scimMember struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+}
+
+type scimMeta struct {
+	ResourceType string `json:"resourceType"`
+	Location     string `json:"location,omitempty"`
+}
+
+type scimListResponse struct {
+	Schemas      []string `json:"schemas"`
+	TotalResults int      `json:"totalResults"`
+	StartIndex   int      `json:"startIndex"`
+	ItemsPerPage int      `json:"itemsPerPage"`
+	Resources    []any    `json:"Resources"`
+}
+
+type scimPatchRequest struct {
+	Operations []*scimPatchOperation `json:"Operations"`
+}
+
+type scimPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+// scimUserChange is a change to a user, parsed from a PUT or PATCH request. Nil fields are not changed.
+type scimUserChange struct {
+	username *string
+	password *string
+	active   *bool
+}
+
+func (s *Server) handleSCIMServiceProviderConfig(w http.ResponseWriter, _ *http.Request, _ *visitor) error {
+	supported := func(b bool) map[string]any { return map[string]any{"supported": b} }
+	return s.writeSCIM(w, http.StatusOK, map[string]any{
+		"schemas":        []string{scimSchemaServiceProviderConfig},
+		"patch":          supported(true),
+		"bulk":           map[string]any{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":         map[string]any{"supported": true, "maxResults": scimListMaxResults},
+		"changePassword": supported(true),
+		"sort":           supported(false),
+		"etag":           supported(false),
+		"authenticationSchemes": []map[string]any{
+			{
+				"type":        "oauthbearertoken",
+				"name":        "Access token",
+				"description": "Access token of an ntfy admin user",
+			},
+		},
+	})
+}
+
+func (s *Server) handleSCIMUsersGet(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	users, err := s.scimUsers()
+	if err != nil {
+		return err
+	}
+	filter := r.URL.Query().Get("filter")
+	matches := scimFilterRegex.FindStringSubmatch(filter)
+	if filter != "" && (matches == nil || !strings.EqualFold(matches[1], "userName")) {
+		return errHTTPBadRequestSCIMInvalid.Wrap("unsupported filter, only userName eq \"...\" is supported")
+	}
+	resources := make([]any, 0)
+	for _, u := range users {
+		if filter == "" || strings.EqualFold(u.Name, matches[2]) {
+			resources = append(resources, s.newSCIMUser(u))
+		}
+	}
+	return s.writeSCIMList(w, r, resources)
+}
+
+func (s *Server) handleSCIMUserGet(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	u, err := s.scimUserFromPath(r)
+	if err != nil {
+		return err
+	}
+	return s.writeSCIM(w, http.StatusOK, s.newSCIMUser(u))
+}
+
+func (s *Server) handleSCIMUserCreate(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	req, err := readJSONWithLimit[scimUser](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	} else if !user.AllowedUsername(req.UserName) {
+		return errHTTPBadRequestSCIMInvalid.Wrap("userName invalid")
+	}
+	if _, err := s.userManager.User(req.UserName); err == nil {
+		return errHTTPConflictUserExists
+	} else if !errors.Is(err, user.ErrUserNotFound) {
+		return err
+	}
+	password := req.Password
+	if password == "" {
+		password = util.RandomString(scimPasswordLength) // Users cannot log in until a password is set
+	}
+	logvr(v, r).Tag(tagAccount).Field("scim_user", req.UserName).Info("Provisioning user %s via SCIM", req.UserName)
+	if err := s.userManager.AddUser(req.UserName, password, user.RoleUser); err != nil {
+		return err
+	}
+	u, err := s.userManager.User(req.UserName)
+	if err != nil {
+		return err
+	}
+	if req.Active != nil && !*req.Active {
+		if err := s.suspendUser(r, v, u, scimSuspendReason, 0); err != nil {
+			return err
+		}
+		if u, err = s.userManager.User(req.UserName); err != nil {
+			return err
+		}
+	}
+	return s.writeSCIM(w, http.StatusCreated, s.newSCIMUser(u))
+}
+
+func (s *Server) handleSCIMUserReplace(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	u, err := s.scimUserFromPath(r)
+	if err != nil {
+		return err
+	}
+	req, err := readJSONWithLimit[scimUser](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	}
+	change := &scimUserChange{active: req.Active}
+	if req.UserName != "" {
+		change.username = &req.UserName
+	}
+	if req.Password != "" {
+		change.password = &req.Password
+	}
+	return s.changeSCIMUser(w, r, v, u, change)
+}
+
+func (s *Server) handleSCIMUserPatch(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	u, err := s.scimUserFromPath(r)
+	if err != nil {
+		return err
+	}
+	req, err := readJSONWithLimit[scimPatchRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	}
+	change := &scimUserChange{}
+	for _, op := range req.Operations {
+		if o := strings.ToLower(op.Op); o != "add" && o != "replace" {
+			return errHTTPBadRequestSCIMInvalid.Wrap("unsupported operation %s", op.Op)
+		} else if err := change.apply(op.Path, op.Value); err != nil {
+			return err
+		}
+	}
+	return s.changeSCIMUser(w, r, v, u, change)
+}
+
+func (s *Server) handleSCIMUserDelete(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	u, err := s.scimUserFromPath(r)
+	if err != nil {
+		return err
+	}
+	logvr(v, r).Tag(tagAccount).Field("scim_user", u.Name).Info("Deprovisioning user %s via SCIM", u.Name)
+	if err := s.userManager.RemoveUser(u.Name); err != nil {
+		return err
+	}
+	if err := s.killUserSubscriber(u, "*"); err != nil { // FIXME super inefficient
+		return err
+	}
+	w.Header().Set("Access-Control-Allow-Origin", s.config().AccessControlAllowOrigin) // CORS, allow cross-origin requests
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (s *Server) changeSCIMUser(w http.ResponseWriter, r *http.Request, v *visitor, u *user.User, change *scimUserChange) error {
+	username := u.Name
+	if change.username != nil && *change.username != u.Name {
+		if !user.AllowedUsername(*change.username) {
+			return errHTTPBadRequestSCIMInvalid.Wrap("userName invalid")
+		} else if _, err := s.userManager.User(*change.username); err == nil {
+			return errHTTPConflictUserExists
+		}
+		logvr(v, r).Tag(tagAccount).Field("scim_user", u.Name).Info("Renaming user %s to %s via SCIM", u.Name, *change.username)
+		if err := s.userManager.ChangeUsername(u.Name, *change.username); err != nil {
+			return err
+		}
+		username = *change.username
+	}
+	if change.password != nil {
+		if err := s.userManager.ChangePassword(username, *change.password); err != nil {
+			return err
+		}
+	}
+	if change.active != nil && *change.active && u.IsSuspended() {
+		logvr(v, r).Tag(tagAccount).Field("reinstated_user", username).Info("Reinstating user %s via SCIM", username)
+		if err := s.userManager.ReinstateUser(username); err != nil {
+			return err
+		}
+	} else if change.active != nil && !*change.active && !u.IsSuspended() {
+		if err := s.suspendUser(r, v, u, scimSuspendReason, 0); err != nil {
+			return err
+		}
+	}
+	u, err := s.userManager.User(username)
+	if err != nil {
+		return err
+	}
+	return s.writeSCIM(w, http.StatusOK, s.newSCIMUser(u))
+}
+
+// apply parses a single add/replace operation of a PATCH request. Identity providers either pass the
+// attribute as path, or pass an object with the attributes as value.
+func (c *scimUserChange) apply(path string, value json.RawMessage) error {
+	switch strings.ToLower(path) {
+	case "":
+		var attrs map[string]json.RawMessage
+		if err := json.Unmarshal(value, &attrs); err != nil {
+			return errHTTPBadRequestSCIMInvalid.Wrap("value must be an object if path is empty")
+		}
+		for name, attr := range attrs {
+			if err := c.apply(name, attr); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "username":
+		return unmarshalSCIMString(value, &c.username)
+	case "password":
+		return unmarshalSCIMString(value, &c.password)
+	case "active":
+		var active bool
+		if err := json.Unmarshal(value, &active); err != nil {
+			// Some identity providers (e.g. Entra ID) send booleans as strings
+			var activeStr string
+			if err := json.Unmarshal(value, &activeStr); err != nil {
+				return errHTTPBadRequestSCIMInvalid.Wrap("active must be a boolean")
+			} else if active, err = strconv.ParseBool(activeStr); err != nil {
+				return errHTTPBadRequestSCIMInvalid.Wrap("active must be a boolean")
+			}
+		}
+		c.active = &active
+		return nil
+	default:
+		return nil // Attributes that ntfy does not store (e.g. name, emails) are ignored
+	}
+}
+
+func unmarshalSCIMString(value json.RawMessage, target **string) error {
+	var s string
+	if err := json.Unmarshal(value, &s); err != nil {
+		return errHTTPBadRequestSCIMInvalid.Wrap("value must be a string")
+	}
+	*target = &s
+	return nil
+}
+
+func (s *Server) handleSCIMGroupsGet(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	tiers, err := s.userManager.Tiers()
+	if err != nil {
+		return err
+	}
+	filter := r.URL.Query().Get("filter")
+	matches := scimFilterRegex.FindStringSubmatch(filter)
+	if filter != "" && (matches == nil || !strings.EqualFold(matches[1], "displayName")) {
+		return errHTTPBadRequestSCIMInvalid.Wrap("unsupported filter, only displayName eq \"...\" is supported")
+	}
+	users, err := s.scimUsers()
+	if err != nil {
+		return err
+	}
+	resources := make([]any, 0)
+	for _, t := range tiers {
+		if filter == "" || t.Code == matches[2] {
+			resources = append(resources, s.newSCIMGroup(t, users))
+		}
+	}
+	return s.writeSCIMList(w, r, resources)
+}
+
+func (s *Server) handleSCIMGroupGet(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	tier, err := s.scimTierFromPath(r)
+	if err != nil {
+		return err
+	}
+	return s.writeSCIMGroup(w, tier)
+}
+
+func (s *Server) handleSCIMGroupReplace(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	tier, err := s.scimTierFromPath(r)
+	if err != nil {
+		return err
+	}
+	req, err := readJSONWithLimit[scimGroup](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	}
+	if err := s.replaceSCIMGroupMembers(r, v, tier, req.Members); err != nil {
+		return err
+	}
+	return s.writeSCIMGroup(w, tier)
+}
+
+func (s *Server) handleSCIMGroupPatch(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	tier, err := s.scimTierFromPath(r)
+	if err != nil {
+		return err
+	}
+	req, err := readJSONWithLimit[scimPatchRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	}
+	for _, op := range req.Operations {
+		var members []*scimMember
+		if matches := scimMemberRegex.FindStringSubmatch(op.Path); matches != nil {
+			members = []*scimMember{{Value: matches[1]}} // e.g. members[value eq "u_..."]
+		} else if strings.EqualFold(op.Path, "members") && len(op.Value) > 0 {
+			if err := json.Unmarshal(op.Value, &members); err != nil {
+				return errHTTPBadRequestSCIMInvalid.Wrap("members must be a list")
+			}
+		} else if op.Path == "" {
+			var attrs struct {
+				Members []*scimMember `json:"members"`
+			}
+			if err := json.Unmarshal(op.Value, &attrs); err != nil {
+				return errHTTPBadRequestSCIMInvalid.Wrap("value must be an object if path is empty")
+			} else if attrs.Members == nil {
+				continue // Other attributes (e.g. displayName) cannot be changed
+			}
+			members = attrs.Members
+		} else if !strings.EqualFold(op.Path, "members") {
+			return errHTTPBadRequestSCIMInvalid.Wrap("unsupported path %s", op.Path)
+		}
+		switch strings.ToLower(op.Op) {
+		case "add":
+			err = s.addSCIMGroupMembers(r, v, tier, members)
+		case "remove":
+			if len(members) == 0 { // Remove all members
+				err = s.replaceSCIMGroupMembers(r, v, tier, members)
+			} else {
+				err = s.removeSCIMGroupMembers(r, v, tier, members)
+			}
+		case "replace":
+			err = s.replaceSCIMGroupMembers(r, v, tier, members)
+		default:
+			return errHTTPBadRequestSCIMInvalid.Wrap("unsupported operation %s", op.Op)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return s.writeSCIMGroup(w, tier)
+}
+
+func (s *Server) addSCIMGroupMembers(r *http.Request, v *visitor, tier *user.Tier, members []*scimMember) error {
+	for _, member := range members {
+		u, err := s.scimMember(member)
+		if err != nil {
+			return err
+		}
+		logvr(v, r).Tag(tagAccount).Fields(log.Context{"scim_user": u.Name, "scim_tier": tier.Code}).Info("Changing tier of user %s to %s via SCIM", u.Name, tier.Code)
+		if err := s.userManager.ChangeTier(u.Name, tier.Code); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) removeSCIMGroupMembers(r *http.Request, v *visitor, tier *user.Tier, members []*scimMember) error {
+	for _, member := range members {
+		u, err := s.scimMember(member)
+		if err != nil {
+			return err
+		} else if u.Tier == nil || u.Tier.ID != tier.ID {
+			continue // User is not on this tier (anymore), do not reset another tier
+		}
+		logvr(v, r).Tag(tagAccount).Fields(log.Context{"scim_user": u.Name, "scim_tier": tier.Code}).Info("Removing tier %s from user %s via SCIM", tier.Code, u.Name)
+		if err := s.userManager.ResetTier(u.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) replaceSCIMGroupMembers(r *http.Request, v *visitor, tier *user.Tier, members []*scimMember) error {
+	users, err := s.scimUsers()
+	if err != nil {
+		return err
+	}
+	remove := make([]*scimMember, 0)
+	for _, u := range users {
+		if u.Tier == nil || u.Tier.ID != tier.ID {
+			continue
+		} else if !containsSCIMMember(members, u.ID) {
+			remove = append(remove, &scimMember{Value: u.ID})
+		}
+	}
+	if err := s.removeSCIMGroupMembers(r, v, tier, remove); err != nil {
+		return err
+	}
+	return s.addSCIMGroupMembers(r, v, tier, members)
+}
+
+// scimUsers returns all users that can be managed via SCIM, i.e. all regular users
+func (s *Server) scimUsers() ([]*user.User, error) {
+	users, err := s.userManager.Users()
+	if err != nil {
+		return nil, err
+	}
+	regularUsers := make([]*user.User, 0)
+	for _, u := range users {
+		if u.IsUser() {
+			regularUsers = append(regularUsers, u)
+		}
+	}
+	return regularUsers, nil
+}
+
+func containsSCIMMember(members []*scimMember, id string) bool {
+	for _, m := range members {
+		if m.Value == id {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) scimUserFromPath(r *http.Request) (*user.User, error) {
+	matches := scimUserPathRegex.FindStringSubmatch(r.URL.Path)
+	if len(matches) != 2 {
+		return nil, errHTTPInternalErrorInvalidPath
+	}
+	u, err := s.userManager.UserByID(matches[1])
+	if errors.Is(err, user.ErrUserNotFound) || (err == nil && !u.IsUser()) {
+		return nil, errHTTPNotFoundSCIMResource
+	} else if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (s *Server) scimMember(member *scimMember) (*user.User, error) {
+	u, err := s.userManager.UserByID(member.Value)
+	if errors.Is(err, user.ErrUserNotFound) || (err == nil && !u.IsUser()) {
+		return nil, errHTTPBadRequestSCIMInvalid.Wrap("member %s not found", member.Value)
+	} else if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (s *Server) scimTierFromPath(r *http.Request) (*user.Tier, error) {
+	matches := scimGroupPathRegex.FindStringSubmatch(r.URL.Path)
+	if len(matches) != 2 {
+		return nil, errHTTPInternalErrorInvalidPath
+	}
+	tiers, err := s.userManager.Tiers()
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range tiers {
+		if t.ID == matches[1] {
+			return t, nil
+		}
+	}
+	return nil, errHTTPNotFoundSCIMResource
+}
+
+func (s *Server) newSCIMUser(u *user.User) *scimUser {
+	active := !u.IsSuspended()
+	su := &scimUser{
+		Schemas:  []string{scimSchemaUser},
+		ID:       u.ID,
+		UserName: u.Name,
+		Active:   &active,
+		Meta:     s.newSCIMMeta("User", scimUsersPath, u.ID),
+	}
+	if u.Tier != nil {
+		su.Groups = []*scimMember{{Value: u.Tier.ID, Display: u.Tier.Code}}
+	}
+	return su
+}
+
+func (s *Server) newSCIMGroup(tier *user.Tier, users []*user.User) *scimGroup {
+	members := make([]*scimMember, 0)
+	for _, u := range users {
+		if u.Tier != nil && u.Tier.ID == tier.ID {
+			members = append(members, &scimMember{Value: u.ID, Display: u.Name})
+		}
+	}
+	return &scimGroup{
+		Schemas:     []string{scimSchemaGroup},
+		ID:          tier.ID,
+		DisplayName: tier.Code,
+		Members:     members,
+		Meta:        s.newSCIMMeta("Group", scimGroupsPath, tier.ID),
+	}
+}
+
+func (s *Server) newSCIMMeta(resourceType, path, id string) *scimMeta {
+	conf := s.config()
+	meta := &scimMeta{ResourceType: resourceType}
+	if conf.BaseURL != "" {
+		meta.Location = fmt.Sprintf("%s%s/%s", conf.BaseURL, path, id)
+	}
+	return meta
+}
+
+func (s *Server) writeSCIMGroup(w http.ResponseWriter, tier *user.Tier) error {
+	users, err := s.scimUsers()
+	if err != nil {
+		return err
+	}
+	return s.writeSCIM(w, http.StatusOK, s.newSCIMGroup(tier, users))
+}
+
+// writeSCIMList writes a paginated list response, see RFC 7644, section 3.4.2.4. The startIndex is 1-based.
+func (s *Server) writeSCIMList(w http.ResponseWriter, r *http.Request, resources []any) error {
+	startIndex, err := strconv.Atoi(r.URL.Query().Get("startIndex"))
+	if err != nil || startIndex < 1 {
+		startIndex = 1
+	}
+	count, err := strconv.Atoi(r.URL.Query().Get("count"))
+	if err != nil || count < 0 || count > scimListMaxResults {
+		count = scimListMaxResults
+	}
+	page := resources[min(startIndex-1, len(resources)):min(startIndex-1+count, len(resources))]
+	return s.writeSCIM(w, http.StatusOK, &scimListResponse{
+		Schemas:      []string{scimSchemaListResponse},
+		TotalResults: len(resources),
+		StartIndex:   startIndex,
+		ItemsPerPage: len(page),
+		Resources:    page,
+	})
+}
+
+func (s *Server) writeSCIM(w http.ResponseWriter, status int, v any) error {
+	w.Header().Set("Content-Type", scimContentType)
+	w.Header().Set("Access-Control-Allow-Origin", s.config().AccessControlAllowOrigin) // CORS, allow cross-origin requests
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+func TestSCIM_Users(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	admin := map[string]string{"Authorization": util.BasicAuth("phil", "phil")}
+
+	// Create user
+	rr := request(t, s, "POST", "/scim/v2/Users", `{"schemas":["urn:ietf:params:scim:schemas:core:2.0:User"],"userName":"ben@example.com","password":"ben","active":true}`, admin)
+	require.Equal(t, 201, rr.Code)
+	require.Equal(t, "application/scim+json", rr.Header().Get("Content-Type"))
+	created, _ := util.UnmarshalJSON[scimUser](io.NopCloser(rr.Body))
+	require.Equal(t, "ben@example.com", created.UserName)
+	require.True(t, *created.Active)
+	require.Equal(t, 409, request(t, s, "POST", "/scim/v2/Users", `{"userName":"ben@example.com"}`, admin).Code)
+	require.Equal(t, 200, request(t, s, "GET", "/v1/account", "", map[string]string{
+		"Authorization": util.BasicAuth("ben@example.com", "ben"),
+	}).Code)
+
+	// List and filter users, admins are not listed
+	require.Nil(t, s.userManager.AddUser("john", "john", user.RoleUser))
+	rr = request(t, s, "GET", "/scim/v2/Users", "", admin)
+	require.Equal(t, 200, rr.Code)
+	list, _ := util.UnmarshalJSON[scimListResponse](io.NopCloser(rr.Body))
+	require.Equal(t, 2, list.TotalResults)
+	rr = request(t, s, "GET", `/scim/v2/Users?filter=userName+eq+"BEN@example.com"`, "", admin)
+	list, _ = util.UnmarshalJSON[scimListResponse](io.NopCloser(rr.Body))
+	require.Equal(t, 1, list.TotalResults)
+	require.Equal(t, created.ID, list.Resources[0].(map[string]any)["id"])
+	rr = request(t, s, "GET", "/scim/v2/Users?startIndex=2&count=5", "", admin)
+	list, _ = util.UnmarshalJSON[scimListResponse](io.NopCloser(rr.Body))
+	require.Equal(t, 2, list.TotalResults)
+	require.Equal(t, 1, list.ItemsPerPage)
+	require.Equal(t, 400, request(t, s, "GET", `/scim/v2/Users?filter=userName+co+"ben"`, "", admin).Code)
+
+	// Deactivate (with a boolean as string, like Entra ID), and reactivate
+	rr = request(t, s, "PATCH", "/scim/v2/Users/"+created.ID, `{"Operations":[{"op":"Replace","path":"active","value":"False"}]}`, admin)
+	require.Equal(t, 200, rr.Code)
+	patched, _ := util.UnmarshalJSON[scimUser](io.NopCloser(rr.Body))
+	require.False(t, *patched.Active)
+	ben, err := s.userManager.User("ben@example.com")
+	require.Nil(t, err)
+	require.True(t, ben.IsSuspended())
+	rr = request(t, s, "PATCH", "/scim/v2/Users/"+created.ID, `{"Operations":[{"op":"replace","value":{"active":true,"userName":"ben"}}]}`, admin)
+	require.Equal(t, 200, rr.Code)
+	patched, _ = util.UnmarshalJSON[scimUser](io.NopCloser(rr.Body))
+	require.True(t, *patched.Active)
+	require.Equal(t, "ben", patched.UserName)
+
+	// Replace user
+	rr = request(t, s, "PUT", "/scim/v2/Users/"+created.ID, `{"userName":"ben","password":"newpass","active":false}`, admin)
+	require.Equal(t, 200, rr.Code)
+	ben, err = s.userManager.User("ben")
+	require.Nil(t, err)
+	require.True(t, ben.IsSuspended())
+	_, err = s.userManager.Authenticate("ben", "newpass")
+	require.Nil(t, err)
+
+	// Delete user
+	require.Equal(t, 204, request(t, s, "DELETE", "/scim/v2/Users/"+created.ID, "", admin).Code)
+	require.Equal(t, 404, request(t, s, "GET", "/scim/v2/Users/"+created.ID, "", admin).Code)
+	_, err = s.userManager.User("ben")
+	require.Equal(t, user.ErrUserNotFound, err)
+
+	// Admins cannot be managed
+	phil, err := s.userManager.User("phil")
+	require.Nil(t, err)
+	require.Equal(t, 404, request(t, s, "DELETE", "/scim/v2/Users/"+phil.ID, "", admin).Code)
+}
+
+func TestSCIM_Groups(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	require.Nil(t, s.userManager.AddUser("john", "john", user.RoleUser))
+	require.Nil(t, s.userManager.AddTier(&user.Tier{Code: "pro", Name: "Pro"}))
+	require.Nil(t, s.userManager.AddTier(&user.Tier{Code: "business", Name: "Business"}))
+	admin := map[string]string{"Authorization": util.BasicAuth("phil", "phil")}
+	ben, _ := s.userManager.User("ben")
+	john, _ := s.userManager.User("john")
+
+	// Groups are tiers
+	rr := request(t, s, "GET", `/scim/v2/Groups?filter=displayName+eq+"pro"`, "", admin)
+	require.Equal(t, 200, rr.Code)
+	list, _ := util.UnmarshalJSON[scimListResponse](io.NopCloser(rr.Body))
+	require.Equal(t, 1, list.TotalResults)
+	groupID := list.Resources[0].(map[string]any)["id"].(string)
+
+	// Add members
+	rr = request(t, s, "PATCH", "/scim/v2/Groups/"+groupID, fmt.Sprintf(`{"Operations":[{"op":"add","path":"members","value":[{"value":"%s"},{"value":"%s"}]}]}`, ben.ID, john.ID), admin)
+	require.Equal(t, 200, rr.Code)
+	group, _ := util.UnmarshalJSON[scimGroup](io.NopCloser(rr.Body))
+	require.Equal(t, "pro", group.DisplayName)
+	require.Equal(t, 2, len(group.Members))
+	ben, _ = s.userManager.User("ben")
+	require.Equal(t, "pro", ben.Tier.Code)
+	rr = request(t, s, "GET", "/scim/v2/Users/"+ben.ID, "", admin)
+	u, _ := util.UnmarshalJSON[scimUser](io.NopCloser(rr.Body))
+	require.Equal(t, "pro", u.Groups[0].Display)
+
+	// Remove member
+	rr = request(t, s, "PATCH", "/scim/v2/Groups/"+groupID, fmt.Sprintf(`{"Operations":[{"op":"remove","path":"members[value eq \"%s\"]"}]}`, ben.ID), admin)
+	require.Equal(t, 200, rr.Code)
+	ben, _ = s.userManager.User("ben")
+	require.Nil(t, ben.Tier)
+
+	// Replace members
+	rr = request(t, s, "PUT", "/scim/v2/Groups/"+groupID, fmt.Sprintf(`{"displayName":"pro","members":[{"value":"%s"}]}`, ben.ID), admin)
+	require.Equal(t, 200, rr.Code)
+	group, _ = util.UnmarshalJSON[scimGroup](io.NopCloser(rr.Body))
+	require.Equal(t, 1, len(group.Members))
+	require.Equal(t, "ben", group.Members[0].Display)
+	john, _ = s.userManager.User("john")
+	require.Nil(t, john.Tier)
+
+	// Unknown members and groups
+	require.Equal(t, 400, request(t, s, "PATCH", "/scim/v2/Groups/"+groupID, `{"Operations":[{"op":"add","path":"members","value":[{"value":"u_doesnotexist"}]}]}`, admin).Code)
+	require.Equal(t, 404, request(t, s, "GET", "/scim/v2/Groups/ti_doesnotexist", "", admin).Code)
+}
+
+func TestSCIM_NonAdmin(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	require.Equal(t, 401, request(t, s, "GET", "/scim/v2/Users", "", nil).Code)
+	require.Equal(t, 401, request(t, s, "POST", "/scim/v2/Users", `{"userName":"john"}`, map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	}).Code)
+}
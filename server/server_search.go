@@ -0,0 +1,101 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+	"net/http"
+	"strconv"
+)
+
+// handleSearch performs a full-text search over the cached messages of one or more topics, e.g.
+// GET /v1/search?topic=mytopic,othertopic&q=disk+full&priority=4,5&since=24h. Matching messages are
+// returned newest first, as newline-delimited JSON (just like polling via /<topic>/json?poll=1).
+func (s *Server) handleSearch(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	conf := s.config()
+	if !s.messageCache.SearchEnabled() {
+		return errHTTPBadRequestSearchDisabled
+	}
+	query := readParam(r, "x-query", "query", "q")
+	topicIDs := util.SplitNoEmpty(readParam(r, "x-topic", "topic", "topics"), ",")
+	if query == "" || len(topicIDs) == 0 {
+		return errHTTPBadRequestSearchInvalid
+	}
+	for _, id := range topicIDs {
+		if !topicRegex.MatchString(id) {
+			return errHTTPBadRequestTopicInvalid
+		} else if util.Contains(conf.DisallowedTopics, id) {
+			return errHTTPBadRequestTopicDisallowed
+		}
+	}
+	if err := s.authorizeTopicsRead(r, v, topicIDs); err != nil {
+		return err
+	}
+	since, err := parseSince(r, true)
+	if err != nil {
+		return err
+	}
+	filters, err := parseQueryFilters(r)
+	if err != nil {
+		return err
+	}
+	limit := searchResultsLimitDefault
+	if limitStr := readParam(r, "x-limit", "limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 || limit > searchResultsLimitMax {
+			return errHTTPBadRequestSearchInvalid.Wrap("limit must be a number between 1 and %d", searchResultsLimitMax)
+		}
+	}
+	messages, err := s.messageCache.Search(&searchQuery{
+		Topics:   topicIDs,
+		Query:    query,
+		Since:    since,
+		Priority: filters.Priority,
+		Limit:    limit,
+	})
+	if err != nil {
+		return err
+	}
+	logvr(v, r).Tag(tagSubscribe).Fields(log.Context{
+		"search_topics":  topicIDs,
+		"search_results": len(messages),
+	}).Debug("Searched %d topic(s), found %d message(s)", len(topicIDs), len(messages))
+	var buf bytes.Buffer
+	for _, m := range messages {
+		if !filters.Pass(m) {
+			continue
+		}
+		if err := json.NewEncoder(&buf).Encode(m); err != nil {
+			return err
+		}
+	}
+	w.Header().Set("Access-Control-Allow-Origin", conf.AccessControlAllowOrigin) // CORS, allow cross-origin requests
+	w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// authorizeTopicsRead checks if the visitor is allowed to read all of the given topics. Unlike authorizeTopicRead,
+// it does not read the topics from the path, and does not create the topics.
+func (s *Server) authorizeTopicsRead(r *http.Request, v *visitor, topicIDs []string) error {
+	if err := s.checkBanned(v); err != nil {
+		return err
+	} else if err := s.checkNetworkRules(v, user.PermissionRead); err != nil {
+		return err
+	} else if s.userManager == nil {
+		return nil
+	}
+	u := v.User()
+	if u.IsSuspended() {
+		return errHTTPForbiddenAccountSuspended.Wrap("%s", suspensionDetails(u.Suspension)).With(v)
+	}
+	for _, id := range topicIDs {
+		if err := s.userManager.Authorize(u, id, user.PermissionRead); err != nil {
+			logvr(v, r).Err(err).Debug("Access to topic %s not authorized", id)
+			return errHTTPForbidden
+		}
+	}
+	return nil
+}
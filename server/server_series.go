@@ -0,0 +1,268 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/util"
+)
+
+// Topic series turn topics with JSON messages (e.g. from sensors) into lightweight time series: Topic owners define
+// numeric fields to extract from the messages of a topic, e.g. {"temperature":"$.temperature"}, via PUT /<topic>/series
+// (requires the manage permission, see user.PermissionManage). Definitions are removed via DELETE /<topic>/series.
+//
+// Values are extracted from the cached messages of the topic when GET /<topic>/series is called (requires the read
+// permission), optionally aggregated into buckets (?interval=1h). This means that series cover the cache duration,
+// and that fields can be defined after the messages were published. If metrics are enabled, the latest value of
+// each field is also exposed as the ntfy_topic_series_value gauge.
+//
+// Definitions are stored in the message cache (see message_cache_series.go) and held in memory.
+
+const (
+	seriesFieldsLimit = 10 // Max. number of fields per topic
+)
+
+var (
+	seriesFieldNameRegex = regexp.MustCompile(`^[a-z][a-z0-9_]{0,31}$`)
+)
+
+// topicSeries is the in-memory list of series field definitions
+type topicSeries struct {
+	fields map[string]map[string]string // Topic -> field name -> JSON field path
+	mu     sync.RWMutex
+}
+
+// newTopicSeries loads the series field definitions from the message cache
+func newTopicSeries(cache *messageCache) (*topicSeries, error) {
+	fields, err := cache.TopicSeriesFields()
+	if err != nil {
+		return nil, err
+	}
+	return &topicSeries{
+		fields: fields,
+	}, nil
+}
+
+// Fields returns the series fields of a topic (name -> JSON field path), or nil if there are none
+func (t *topicSeries) Fields(topic string) map[string]string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.fields[topic]
+}
+
+func (t *topicSeries) Set(topic string, fields map[string]string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.fields[topic] = fields
+}
+
+// Remove removes the series fields of a topic, and returns false if there were none
+func (t *topicSeries) Remove(topic string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.fields[topic]; !ok {
+		return false
+	}
+	delete(t.fields, topic)
+	return true
+}
+
+// handleTopicSeriesSet defines the series fields of the topic in the path, replacing any existing definitions
+func (s *Server) handleTopicSeriesSet(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	topic, err := seriesTopicFromPath(r)
+	if err != nil {
+		return err
+	}
+	req, err := readJSONWithLimit[apiTopicSeriesRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	}
+	if len(req.Fields) == 0 || len(req.Fields) > seriesFieldsLimit {
+		return errHTTPBadRequestTopicSeriesInvalid.Wrap("between 1 and %d fields must be defined", seriesFieldsLimit)
+	}
+	for name, path := range req.Fields {
+		if !seriesFieldNameRegex.MatchString(name) {
+			return errHTTPBadRequestTopicSeriesInvalid.Wrap("invalid field name %s", name)
+		} else if !util.ValidJSONFieldPath(path) {
+			return errHTTPBadRequestTopicSeriesInvalid.Wrap("invalid path %s for field %s", path, name)
+		}
+	}
+	if err := s.messageCache.SetTopicSeriesFields(topic, req.Fields); err != nil {
+		return err
+	}
+	s.series.Set(topic, req.Fields)
+	deleteSeriesMetrics(topic)
+	logvr(v, r).Tag(tagManager).Field("topic_series_fields", req.Fields).Info("Defined %d series field(s) for topic %s", len(req.Fields), topic)
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+// handleTopicSeriesDelete removes the series fields of the topic in the path
+func (s *Server) handleTopicSeriesDelete(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	topic, err := seriesTopicFromPath(r)
+	if err != nil {
+		return err
+	}
+	if !s.series.Remove(topic) {
+		return errHTTPNotFoundTopicSeries
+	}
+	if err := s.messageCache.RemoveTopicSeriesFields(topic); err != nil {
+		return err
+	}
+	deleteSeriesMetrics(topic)
+	logvr(v, r).Tag(tagManager).Info("Removed series fields of topic %s", topic)
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+// handleTopicSeriesGet extracts the series fields from the cached messages of the topic in the path. The
+// query parameters since (see parseSince), field (comma-separated field names) and interval (bucket size,
+// e.g. 1h) can be used to narrow down and aggregate the results.
+func (s *Server) handleTopicSeriesGet(w http.ResponseWriter, r *http.Request, _ *visitor) error {
+	topic, err := seriesTopicFromPath(r)
+	if err != nil {
+		return err
+	}
+	fields := s.series.Fields(topic)
+	if fields == nil {
+		return errHTTPNotFoundTopicSeries
+	}
+	if names := util.SplitNoEmpty(readParam(r, "x-field", "field"), ","); len(names) > 0 {
+		selected := make(map[string]string)
+		for _, name := range names {
+			path, ok := fields[name]
+			if !ok {
+				return errHTTPBadRequestTopicSeriesInvalid.Wrap("unknown field %s", name)
+			}
+			selected[name] = path
+		}
+		fields = selected
+	}
+	var interval int64
+	if intervalStr := readParam(r, "x-interval", "interval"); intervalStr != "" {
+		d, err := util.ParseDuration(intervalStr)
+		if err != nil || d.Seconds() < 1 {
+			return errHTTPBadRequestTopicSeriesInvalid.Wrap("invalid interval %s", intervalStr)
+		}
+		interval = int64(d.Seconds())
+	}
+	since, err := parseSince(r, true)
+	if err != nil {
+		return err
+	}
+	messages, err := s.messageCache.Messages(topic, since, false)
+	if err != nil {
+		return err
+	}
+	series := make(map[string][]*apiTopicSeriesPoint)
+	for name := range fields {
+		series[name] = make([]*apiTopicSeriesPoint, 0)
+	}
+	for _, m := range messages {
+		for name, value := range seriesValues(fields, m) {
+			series[name] = append(series[name], &apiTopicSeriesPoint{Time: m.Time, Value: value})
+		}
+	}
+	if interval > 0 {
+		for name, points := range series {
+			series[name] = aggregateSeriesPoints(points, interval)
+		}
+	}
+	return s.writeJSON(w, &apiTopicSeriesResponse{
+		Topic:  topic,
+		Fields: fields,
+		Series: series,
+	})
+}
+
+// updateSeriesMetrics sets the ntfy_topic_series_value gauge for all series fields of a newly published message
+func (s *Server) updateSeriesMetrics(m *message) {
+	if metricTopicSeriesValue == nil {
+		return
+	}
+	fields := s.series.Fields(m.Topic)
+	if fields == nil {
+		return
+	}
+	for name, value := range seriesValues(fields, m) {
+		metricTopicSeriesValue.WithLabelValues(m.Topic, name).Set(value)
+	}
+}
+
+// deleteSeriesMetrics removes the gauges of all series fields of a topic, e.g. after the fields changed
+func deleteSeriesMetrics(topic string) {
+	if metricTopicSeriesValue != nil {
+		metricTopicSeriesValue.DeletePartialMatch(map[string]string{"topic": topic})
+	}
+}
+
+// seriesValues extracts the numeric values of the given fields (name -> JSON field path) from a message. Fields
+// that do not exist or are not numeric are skipped, as are messages that are not JSON.
+func seriesValues(fields map[string]string, m *message) map[string]float64 {
+	if m.Event != messageEvent || m.Encoding != "" || !strings.HasPrefix(strings.TrimSpace(m.Message), "{") {
+		return nil
+	}
+	var doc any
+	if err := json.Unmarshal([]byte(m.Message), &doc); err != nil {
+		log.Tag(tagPublish).Field("topic", m.Topic).Trace("Skipping series values of message %s, message is not JSON: %s", m.ID, err.Error())
+		return nil
+	}
+	values := make(map[string]float64)
+	for name, path := range fields {
+		raw, ok := util.JSONField(doc, path)
+		if !ok {
+			continue
+		}
+		switch value := raw.(type) {
+		case float64:
+			values[name] = value
+		case string:
+			if f, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+				values[name] = f
+			}
+		}
+	}
+	return values
+}
+
+// aggregateSeriesPoints groups the points into buckets of the given interval (in seconds), with the average
+// as the value of each bucket. Points must be sorted by time.
+func aggregateSeriesPoints(points []*apiTopicSeriesPoint, interval int64) []*apiTopicSeriesPoint {
+	buckets := make(map[int64]*apiTopicSeriesPoint)
+	sums := make(map[int64]float64)
+	for _, p := range points {
+		start := p.Time - p.Time%interval
+		bucket, ok := buckets[start]
+		if !ok {
+			minValue, maxValue := p.Value, p.Value
+			bucket = &apiTopicSeriesPoint{Time: start, Min: &minValue, Max: &maxValue}
+			buckets[start] = bucket
+		}
+		bucket.Count++
+		*bucket.Min = min(*bucket.Min, p.Value)
+		*bucket.Max = max(*bucket.Max, p.Value)
+		sums[start] += p.Value
+	}
+	aggregated := make([]*apiTopicSeriesPoint, 0, len(buckets))
+	for start, bucket := range buckets {
+		bucket.Value = sums[start] / float64(bucket.Count)
+		aggregated = append(aggregated, bucket)
+	}
+	sort.Slice(aggregated, func(i, j int) bool {
+		return aggregated[i].Time < aggregated[j].Time
+	})
+	return aggregated
+}
+
+// seriesTopicFromPath returns the topic from a path like /sensors/series
+func seriesTopicFromPath(r *http.Request) (string, error) {
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) != 3 {
+		return "", errHTTPInternalErrorInvalidPath
+	}
+	return parts[1], nil
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+func TestServer_TopicSeries(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionDenyAll
+	s := newTestServer(t, c)
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	require.Nil(t, s.userManager.AddReservation("phil", "sensors", user.PermissionDenyAll))
+	require.Nil(t, s.userManager.AllowAccess("ben", "sensors", user.PermissionRead))
+	phil := map[string]string{"Authorization": util.BasicAuth("phil", "phil")}
+	ben := map[string]string{"Authorization": util.BasicAuth("ben", "ben")}
+
+	// Messages can be published before the fields are defined
+	for _, body := range []string{`{"temperature":21.5,"room":{"humidity":"40"}}`, `not json`, `{"temperature":22.5}`, `{"temperature":"n/a"}`} {
+		require.Equal(t, 200, request(t, s, "PUT", "/sensors", body, phil).Code)
+	}
+	require.Equal(t, 404, request(t, s, "GET", "/sensors/series", "", phil).Code)
+
+	// Only owners can define fields
+	body := `{"fields":{"temperature":"$.temperature","humidity":"$.room.humidity"}}`
+	require.Equal(t, 403, request(t, s, "PUT", "/sensors/series", body, ben).Code)
+	require.Equal(t, 200, request(t, s, "PUT", "/sensors/series", body, phil).Code)
+
+	// Readers can read the series, non-numeric values are skipped
+	rr := request(t, s, "GET", "/sensors/series", "", ben)
+	require.Equal(t, 200, rr.Code)
+	series, _ := util.UnmarshalJSON[apiTopicSeriesResponse](io.NopCloser(rr.Body))
+	require.Equal(t, "sensors", series.Topic)
+	require.Equal(t, "$.temperature", series.Fields["temperature"])
+	require.Equal(t, 2, len(series.Series["temperature"]))
+	require.Equal(t, 21.5, series.Series["temperature"][0].Value)
+	require.Equal(t, 22.5, series.Series["temperature"][1].Value)
+	require.Equal(t, 1, len(series.Series["humidity"]))
+	require.Equal(t, float64(40), series.Series["humidity"][0].Value)
+
+	// Select fields and aggregate
+	rr = request(t, s, "GET", "/sensors/series?field=temperature&interval=1d", "", ben)
+	require.Equal(t, 200, rr.Code)
+	series, _ = util.UnmarshalJSON[apiTopicSeriesResponse](io.NopCloser(rr.Body))
+	require.Equal(t, 1, len(series.Series))
+	points := series.Series["temperature"]
+	require.GreaterOrEqual(t, len(points), 1) // Two buckets if the test runs at midnight UTC
+	if len(points) == 1 {
+		require.Equal(t, 22.0, points[0].Value)
+		require.Equal(t, 21.5, *points[0].Min)
+		require.Equal(t, 22.5, *points[0].Max)
+		require.Equal(t, 2, points[0].Count)
+	}
+	require.Equal(t, 400, request(t, s, "GET", "/sensors/series?field=pressure", "", ben).Code)
+	require.Equal(t, 400, request(t, s, "GET", "/sensors/series?interval=abc", "", ben).Code)
+	require.Equal(t, 403, request(t, s, "GET", "/sensors/series", "", nil).Code)
+
+	// Remove fields
+	require.Equal(t, 403, request(t, s, "DELETE", "/sensors/series", "", ben).Code)
+	require.Equal(t, 200, request(t, s, "DELETE", "/sensors/series", "", phil).Code)
+	require.Equal(t, 404, request(t, s, "GET", "/sensors/series", "", phil).Code)
+	require.Equal(t, 404, request(t, s, "DELETE", "/sensors/series", "", phil).Code)
+}
+
+func TestServer_TopicSeries_Invalid(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	admin := map[string]string{"Authorization": util.BasicAuth("phil", "phil")}
+	for _, body := range []string{
+		`{"fields":{}}`,
+		`{"fields":{"Temperature":"$.temperature"}}`,
+		`{"fields":{"temperature":"temperature"}}`,
+		`{"fields":{"a":".a","b":".b","c":".c","d":".d","e":".e","f":".f","g":".g","h":".h","i":".i","j":".j","k":".k"}}`,
+	} {
+		rr := request(t, s, "PUT", "/sensors/series", body, admin)
+		require.Equal(t, 400, rr.Code, body)
+		require.Equal(t, 40084, toHTTPError(t, rr.Body.String()).Code)
+	}
+}
+
+func TestServer_TopicSeries_Persisted(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	s := newTestServer(t, c)
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	require.Equal(t, 200, request(t, s, "PUT", "/sensors/series", `{"fields":{"temperature":".temperature"}}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	}).Code)
+	s.closeDatabases()
+
+	s = newTestServer(t, c)
+	defer s.closeDatabases()
+	require.Equal(t, map[string]string{"temperature": ".temperature"}, s.series.Fields("sensors"))
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+// Signed publishing lets devices that cannot safely store a reusable access token (e.g. microcontrollers) publish
+// to a reserved topic without logging in. The topic owner generates a shared secret for the reservation (see
+// handleAccountReservationSecretCreate), and the device signs every request with it:
+//
+//	X-Timestamp: <unix timestamp>
+//	X-Signature: hex(HMAC-SHA256(secret, "<topic>.<timestamp>.<body>"))
+//
+// A request with a valid signature may publish to the topic, regardless of the access control list. To prevent
+// replay attacks, the timestamp must not differ more than signedPublishMaxSkew from the server time, and every
+// signature is only accepted once (see Server.publishSignatures). Only the topic, the timestamp and the body are
+// signed, so the message must be passed as body, and all other headers and query parameters are dropped. Otherwise,
+// anyone who intercepts a signed request could add emails, phone calls or attachments to it.
+
+const (
+	signedPublishMaxSkew      = 5 * time.Minute
+	signedPublishSecretLength = 32
+)
+
+// isSignedPublish returns true if the request carries a publish signature, see authorizeSignedPublish
+func isSignedPublish(r *http.Request) bool {
+	return readHeaderParam(r, "x-signature", "signature") != ""
+}
+
+// authorizeSignedPublish verifies the signature of a publish request, and marks the request as signed, so that
+// the message may be cached (see handlePublishInternal). The body is read into memory to verify the signature,
+// so it must not be larger than the message size limit.
+func (s *Server) authorizeSignedPublish(r *http.Request, v *visitor, topics []*topic) (*http.Request, error) {
+	signature, err := hex.DecodeString(readHeaderParam(r, "x-signature", "signature"))
+	if err != nil {
+		return nil, errHTTPBadRequestSignatureInvalid.Wrap("signature must be hex-encoded")
+	} else if len(topics) != 1 {
+		return nil, errHTTPBadRequestSignatureInvalid.Wrap("signed requests can only publish to a single topic")
+	} else if r.Method != http.MethodPut && r.Method != http.MethodPost {
+		return nil, errHTTPBadRequestSignatureInvalid.Wrap("signed requests must use PUT or POST")
+	} else if readParam(r, "x-message", "message", "m") != "" {
+		return nil, errHTTPBadRequestSignatureInvalid.Wrap("message must be passed as body in signed requests")
+	}
+	timestampStr := readHeaderParam(r, "x-timestamp", "timestamp")
+	timestamp, err := strconv.ParseInt(timestampStr, 10, 64)
+	if err != nil {
+		return nil, errHTTPBadRequestSignatureInvalid.Wrap("timestamp must be a Unix timestamp")
+	}
+	t := topics[0]
+	secret, err := s.userManager.ReservationSecret(t.ID)
+	if err != nil {
+		return nil, err
+	} else if secret == "" {
+		return nil, errHTTPForbiddenSignatureInvalid.Wrap("topic does not accept signed requests").With(t)
+	} else if skew := time.Since(time.Unix(timestamp, 0)); skew > signedPublishMaxSkew || skew < -signedPublishMaxSkew {
+		return nil, errHTTPForbiddenSignatureInvalid.Wrap("timestamp too far from server time").With(t)
+	}
+	body, err := util.Peek(r.Body, s.config().MessageSizeLimit)
+	if err != nil {
+		return nil, err
+	} else if body.LimitReached {
+		return nil, errHTTPEntityTooLargeSignedBody.With(t)
+	}
+	r.Body = body
+	if !hmac.Equal(signature, publishSignature(secret, t.ID, timestampStr, body.PeekedBytes)) {
+		logvr(v, r).Tag(tagPublish).With(t).Debug("Invalid publish signature")
+		return nil, errHTTPForbiddenSignatureInvalid.With(t)
+	} else if !s.usePublishSignature(signature, 2*signedPublishMaxSkew) { // Covers the entire timestamp window
+		logvr(v, r).Tag(tagPublish).With(t).Debug("Publish signature was already used")
+		return nil, errHTTPForbiddenSignatureInvalid.Wrap("signature was already used").With(t)
+	}
+	r.Header = make(http.Header) // Only the topic, the timestamp and the body are signed, see above
+	r.URL.RawQuery = ""
+	return withContext(r, map[contextKey]any{
+		contextSignedPublish: true,
+	}), nil
+}
+
+// usePublishSignature remembers the signature for the given duration, and returns false if it was already used
+func (s *Server) usePublishSignature(signature []byte, retention time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := hex.EncodeToString(signature)
+	if expires, ok := s.publishSignatures[key]; ok && time.Now().Before(expires) {
+		return false
+	}
+	s.publishSignatures[key] = time.Now().Add(retention)
+	return true
+}
+
+func (s *Server) prunePublishSignatures() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, expires := range s.publishSignatures {
+		if time.Now().After(expires) {
+			delete(s.publishSignatures, key)
+		}
+	}
+}
+
+// handleAccountReservationSecretCreate generates a new shared secret for signed publishing to a topic reserved
+// by the current user. The secret is only returned once; any previous secret is replaced.
+func (s *Server) handleAccountReservationSecretCreate(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	topic, err := s.ownedReservationFromPath(r, v, apiAccountReservationSecretRegex)
+	if err != nil {
+		return err
+	}
+	secret := util.RandomString(signedPublishSecretLength)
+	logvr(v, r).Tag(tagAccount).Field("topic", topic).Debug("Generating publish secret for topic reservation")
+	if err := s.userManager.SetReservationSecret(v.User().Name, topic, secret); errors.Is(err, user.ErrReservationNotFound) {
+		return errHTTPUnauthorized
+	} else if err != nil {
+		return err
+	}
+	return s.writeJSON(w, &apiAccountReservationSecretResponse{
+		Secret: secret,
+	})
+}
+
+// handleAccountReservationSecretDelete removes the shared secret of a topic reserved by the current user, so
+// that signed requests are rejected
+func (s *Server) handleAccountReservationSecretDelete(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	topic, err := s.ownedReservationFromPath(r, v, apiAccountReservationSecretRegex)
+	if err != nil {
+		return err
+	}
+	logvr(v, r).Tag(tagAccount).Field("topic", topic).Debug("Removing publish secret of topic reservation")
+	if err := s.userManager.SetReservationSecret(v.User().Name, topic, ""); errors.Is(err, user.ErrReservationNotFound) {
+		return errHTTPUnauthorized
+	} else if err != nil {
+		return err
+	}
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+// publishSignature computes the signature of a publish request, see above
+func publishSignature(secret, topic, timestamp string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.Join([]string{topic, timestamp, ""}, ".")))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
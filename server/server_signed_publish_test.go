@@ -0,0 +1,181 @@
+package server
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestServer_SignedPublish(t *testing.T) {
+	s, secret := newTestServerWithSignedTopic(t)
+
+	// Valid signature: published and cached, even though anonymous users are denied
+	response := request(t, s, "POST", "/mytopic", "temperature: 21.5", signedPublishHeaders(secret, "mytopic", time.Now(), "temperature: 21.5"))
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "temperature: 21.5", toMessage(t, response.Body.String()).Message)
+
+	// Replay
+	headers := signedPublishHeaders(secret, "mytopic", time.Now().Add(time.Second), "hi")
+	response = request(t, s, "PUT", "/mytopic", "hi", headers)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/mytopic", "hi", headers)
+	require.Equal(t, 403, response.Code)
+	require.Equal(t, 40308, toHTTPError(t, response.Body.String()).Code)
+
+	// Wrong secret, body or topic
+	for _, h := range []map[string]string{
+		signedPublishHeaders("wrong", "mytopic", time.Now(), "bye"),
+		signedPublishHeaders(secret, "mytopic", time.Now(), "other body"),
+		signedPublishHeaders(secret, "othertopic", time.Now(), "bye"),
+	} {
+		response = request(t, s, "PUT", "/mytopic", "bye", h)
+		require.Equal(t, 403, response.Code)
+		require.Equal(t, 40308, toHTTPError(t, response.Body.String()).Code)
+	}
+
+	// Stale timestamp
+	response = request(t, s, "PUT", "/mytopic", "bye", signedPublishHeaders(secret, "mytopic", time.Now().Add(-10*time.Minute), "bye"))
+	require.Equal(t, 403, response.Code)
+	require.Contains(t, toHTTPError(t, response.Body.String()).Message, "timestamp")
+
+	// Topic without secret
+	response = request(t, s, "PUT", "/othertopic", "bye", signedPublishHeaders(secret, "othertopic", time.Now(), "bye"))
+	require.Equal(t, 403, response.Code)
+	require.Equal(t, 40308, toHTTPError(t, response.Body.String()).Code)
+
+	// Malformed requests
+	response = request(t, s, "PUT", "/mytopic", "bye", map[string]string{"X-Signature": "not-hex", "X-Timestamp": "123"})
+	require.Equal(t, 40079, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "GET", "/mytopic/publish?m=bye", "", signedPublishHeaders(secret, "mytopic", time.Now(), ""))
+	require.Equal(t, 40079, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_SignedPublish_BodyTooLarge(t *testing.T) {
+	s, secret := newTestServerWithSignedTopic(t)
+	body := util.RandomString(5000)
+	response := request(t, s, "PUT", "/mytopic", body, signedPublishHeaders(secret, "mytopic", time.Now(), body))
+	require.Equal(t, 413, response.Code)
+	require.Equal(t, 41304, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestAccount_Reservation_Secret(t *testing.T) {
+	s, secret := newTestServerWithSignedTopic(t)
+
+	// Regenerating the secret invalidates the old one
+	response := request(t, s, "POST", "/v1/account/reservation/mytopic/secret", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+	newSecret, err := util.UnmarshalJSON[apiAccountReservationSecretResponse](io.NopCloser(response.Body))
+	require.Nil(t, err)
+	require.NotEqual(t, secret, newSecret.Secret)
+	response = request(t, s, "PUT", "/mytopic", "hi", signedPublishHeaders(secret, "mytopic", time.Now(), "hi"))
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "PUT", "/mytopic", "hi", signedPublishHeaders(newSecret.Secret, "mytopic", time.Now(), "hi"))
+	require.Equal(t, 200, response.Code)
+
+	// Only the owner can manage the secret
+	response = request(t, s, "POST", "/v1/account/reservation/mytopic/secret", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 401, response.Code)
+
+	// Deleting the secret disables signed publishing
+	response = request(t, s, "DELETE", "/v1/account/reservation/mytopic/secret", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/mytopic", "bye", signedPublishHeaders(newSecret.Secret, "mytopic", time.Now(), "bye"))
+	require.Equal(t, 403, response.Code)
+}
+
+// newTestServerWithSignedTopic creates a server where "mytopic" is reserved by phil (deny-all for everyone else),
+// and has a publish secret, which is returned
+func newTestServerWithSignedTopic(t *testing.T) (*Server, string) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionDenyAll
+	c.MessageSizeLimit = 4096
+	s := newTestServer(t, c)
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	require.Nil(t, s.userManager.AddTier(&user.Tier{
+		Code:             "pro",
+		MessageLimit:     100,
+		ReservationLimit: 2,
+	}))
+	require.Nil(t, s.userManager.ChangeTier("phil", "pro"))
+	response := request(t, s, "POST", "/v1/account/reservation", `{"topic": "mytopic", "everyone":"deny-all"}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "POST", "/v1/account/reservation/mytopic/secret", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+	secret, err := util.UnmarshalJSON[apiAccountReservationSecretResponse](io.NopCloser(response.Body))
+	require.Nil(t, err)
+	require.Equal(t, signedPublishSecretLength, len(secret.Secret))
+	return s, secret.Secret
+}
+
+func signedPublishHeaders(secret, topic string, timestamp time.Time, body string) map[string]string {
+	ts := fmt.Sprintf("%d", timestamp.Unix())
+	return map[string]string{
+		"X-Timestamp": ts,
+		"X-Signature": hex.EncodeToString(publishSignature(secret, topic, ts, []byte(body))),
+	}
+}
+
+func TestServer_SignedPublish_UnsignedHeadersIgnored(t *testing.T) {
+	var called atomic.Bool
+	twilioServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called.Store(true)
+	}))
+	defer twilioServer.Close()
+
+	s, secret := newTestServerWithSignedTopic(t)
+	c := s.config()
+	c.TwilioCallsBaseURL = twilioServer.URL
+	c.TwilioAccount = "AC1234567890"
+	c.TwilioAuthToken = "AAEAA1234567890"
+	c.TwilioPhoneNumber = "+1234567890"
+	require.Nil(t, s.userManager.AddTier(&user.Tier{
+		Code:         "calls",
+		MessageLimit: 10,
+		CallLimit:    10,
+	}))
+	require.Nil(t, s.userManager.ChangeTier("ben", "calls"))
+	u, err := s.userManager.User("ben")
+	require.Nil(t, err)
+	require.Nil(t, s.userManager.AddPhoneNumber(u.ID, "+11122233344"))
+
+	// Ben intercepted a signed request, and adds a phone call and a title to it
+	headers := signedPublishHeaders(secret, "mytopic", time.Now(), "intercepted")
+	headers["Authorization"] = util.BasicAuth("ben", "ben")
+	headers["X-Call"] = "+11122233344"
+	headers["X-Title"] = "injected"
+	response := request(t, s, "PUT", "/mytopic?title=injected", "intercepted", headers)
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+	require.Equal(t, "intercepted", m.Message)
+	require.Equal(t, "", m.Title)
+
+	// Replaying it is rejected
+	response = request(t, s, "PUT", "/mytopic", "intercepted", headers)
+	require.Equal(t, 403, response.Code)
+
+	time.Sleep(200 * time.Millisecond) // Calls are made asynchronously
+	require.False(t, called.Load())
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+// Signing keys are server secrets used to verify HMAC signatures of incoming requests. To rotate a secret without
+// rejecting requests during the switch-over, multiple keys of the same purpose can be valid at the same time:
+//
+//  1. Add the new key via POST /v1/admin/keys (the secret can be passed, or is generated and returned once)
+//  2. Configure the new secret at the sender (e.g. in the Stripe dashboard)
+//  3. Retire the old key via DELETE /v1/admin/keys/<id>, optionally with a grace period ({"grace":"24h"}), during
+//     which the old key is still accepted
+//
+// Keys are stored in the user database (see user.SigningKey), and identified by their key ID (sk_...). Signatures
+// that do not carry a key ID (e.g. from Stripe) are checked against all valid keys. The key configured in the server
+// config (e.g. stripe-webhook-key) is always valid in addition to the keys in the database.
+
+const (
+	signingKeyPurposeStripeWebhook = "stripe-webhook"
+	signingKeyPurposeDashboard     = "dashboard"
+	signingKeyPurposeAttachment    = "attachment"
+	signingKeySecretLength         = 32
+)
+
+var (
+	signingKeyPurposes = []string{signingKeyPurposeStripeWebhook, signingKeyPurposeDashboard, signingKeyPurposeAttachment}
+)
+
+// signingSecrets returns all valid secrets for the given purpose: the configured secret (if any) first, followed
+// by the keys from the database, newest first
+func (s *Server) signingSecrets(purpose, configured string) ([]string, error) {
+	secrets := make([]string, 0)
+	if configured != "" {
+		secrets = append(secrets, configured)
+	}
+	if s.userManager == nil {
+		return secrets, nil
+	}
+	keys, err := s.userManager.SigningKeys(purpose)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		secrets = append(secrets, key.Secret)
+	}
+	return secrets, nil
+}
+
+// signingKey returns the newest signing key of the given purpose that is not retired, and generates one if there
+// is none. It is used to sign tokens and URLs that are issued by the server itself.
+func (s *Server) signingKey(purpose string) (*user.SigningKey, error) {
+	keys, err := s.userManager.SigningKeys(purpose)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if key.Expires.Unix() <= 0 {
+			return key, nil
+		}
+	}
+	return s.userManager.AddSigningKey(purpose, util.RandomString(signingKeySecretLength))
+}
+
+// handleSigningKeysGet lists all valid signing keys, without their secrets
+func (s *Server) handleSigningKeysGet(w http.ResponseWriter, _ *http.Request, _ *visitor) error {
+	keys, err := s.userManager.SigningKeys("")
+	if err != nil {
+		return err
+	}
+	response := &apiSigningKeysResponse{
+		Keys: make([]*apiSigningKeyResponse, 0),
+	}
+	for _, key := range keys {
+		response.Keys = append(response.Keys, newSigningKeyResponse(key))
+	}
+	return s.writeJSON(w, response)
+}
+
+// handleSigningKeyAdd adds a signing key. If no secret is passed, a random secret is generated. The secret is
+// only returned in this response.
+func (s *Server) handleSigningKeyAdd(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	req, err := readJSONWithLimit[apiSigningKeyAddRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	} else if !util.Contains(signingKeyPurposes, req.Purpose) {
+		return errHTTPBadRequestSigningKeyInvalid.Wrap("purpose must be one of: %v", signingKeyPurposes)
+	}
+	secret := req.Secret
+	if secret == "" {
+		secret = util.RandomString(signingKeySecretLength)
+	}
+	key, err := s.userManager.AddSigningKey(req.Purpose, secret)
+	if err != nil {
+		return err
+	}
+	logvr(v, r).
+		Tag(tagManager).
+		Fields(log.Context{
+			"signing_key_id":      key.ID,
+			"signing_key_purpose": key.Purpose,
+		}).
+		Info("Added signing key %s", key.ID)
+	response := newSigningKeyResponse(key)
+	response.Secret = key.Secret
+	return s.writeJSON(w, response)
+}
+
+// handleSigningKeyRetire retires the signing key in the path, optionally with a grace period, see
+// user.Manager.RetireSigningKey
+func (s *Server) handleSigningKeyRetire(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	matches := apiAdminKeySingleRegex.FindStringSubmatch(r.URL.Path)
+	if len(matches) != 2 {
+		return errHTTPInternalErrorInvalidPath
+	}
+	id := matches[1]
+	req, err := readJSONWithLimit[apiSigningKeyRetireRequest](r.Body, jsonBodyBytesLimit, true)
+	if err != nil {
+		return err
+	}
+	var grace time.Duration
+	if req.Grace != "" {
+		grace, err = util.ParseDuration(req.Grace)
+		if err != nil || grace < 0 {
+			return errHTTPBadRequestSigningKeyInvalid.Wrap("invalid grace period %s", req.Grace)
+		}
+	}
+	if err := s.userManager.RetireSigningKey(id, grace); errors.Is(err, user.ErrSigningKeyNotFound) {
+		return errHTTPNotFoundSigningKey
+	} else if err != nil {
+		return err
+	}
+	logvr(v, r).
+		Tag(tagManager).
+		Fields(log.Context{
+			"signing_key_id":    id,
+			"signing_key_grace": grace.String(),
+		}).
+		Info("Retired signing key %s", id)
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+func newSigningKeyResponse(key *user.SigningKey) *apiSigningKeyResponse {
+	response := &apiSigningKeyResponse{
+		ID:      key.ID,
+		Purpose: key.Purpose,
+		Created: key.Created.Unix(),
+	}
+	if key.Expires.Unix() > 0 {
+		response.Expires = key.Expires.Unix()
+	}
+	return response
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/stripe/stripe-go/v74"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+func TestServer_SigningKeys(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	admin := map[string]string{"Authorization": util.BasicAuth("phil", "phil")}
+
+	// Only admins can manage keys
+	require.Equal(t, 401, request(t, s, "GET", "/v1/admin/keys", "", nil).Code)
+	require.Equal(t, 401, request(t, s, "GET", "/v1/admin/keys", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	}).Code)
+
+	// Add a key with a generated secret, and one with a given secret
+	rr := request(t, s, "POST", "/v1/admin/keys", `{"purpose":"stripe-webhook"}`, admin)
+	require.Equal(t, 200, rr.Code)
+	key1, _ := util.UnmarshalJSON[apiSigningKeyResponse](io.NopCloser(rr.Body))
+	require.Regexp(t, `^sk_`, key1.ID)
+	require.Equal(t, signingKeySecretLength, len(key1.Secret))
+	rr = request(t, s, "POST", "/v1/admin/keys", `{"purpose":"stripe-webhook","secret":"whsec_new"}`, admin)
+	require.Equal(t, 200, rr.Code)
+	key2, _ := util.UnmarshalJSON[apiSigningKeyResponse](io.NopCloser(rr.Body))
+	require.Equal(t, "whsec_new", key2.Secret)
+	rr = request(t, s, "POST", "/v1/admin/keys", `{"purpose":"unknown"}`, admin)
+	require.Equal(t, 400, rr.Code)
+	require.Equal(t, 40087, toHTTPError(t, rr.Body.String()).Code)
+
+	// Secrets are not listed
+	rr = request(t, s, "GET", "/v1/admin/keys", "", admin)
+	require.Equal(t, 200, rr.Code)
+	keys, _ := util.UnmarshalJSON[apiSigningKeysResponse](io.NopCloser(rr.Body))
+	require.Equal(t, 2, len(keys.Keys))
+	for _, key := range keys.Keys {
+		require.Equal(t, "", key.Secret)
+		require.Equal(t, int64(0), key.Expires)
+	}
+
+	// Retire with grace period, the key is still valid
+	require.Equal(t, 400, request(t, s, "DELETE", "/v1/admin/keys/"+key1.ID, `{"grace":"abc"}`, admin).Code)
+	require.Equal(t, 200, request(t, s, "DELETE", "/v1/admin/keys/"+key1.ID, `{"grace":"1h"}`, admin).Code)
+	secrets, err := s.signingSecrets(signingKeyPurposeStripeWebhook, "whsec_config")
+	require.Nil(t, err)
+	require.ElementsMatch(t, []string{"whsec_config", key1.Secret, "whsec_new"}, secrets)
+	require.Equal(t, "whsec_config", secrets[0])
+
+	// Retire without grace period, the key is removed
+	require.Equal(t, 200, request(t, s, "DELETE", "/v1/admin/keys/"+key2.ID, "", admin).Code)
+	rr = request(t, s, "DELETE", "/v1/admin/keys/"+key2.ID, "", admin)
+	require.Equal(t, 404, rr.Code)
+	require.Equal(t, 40411, toHTTPError(t, rr.Body.String()).Code)
+	secrets, err = s.signingSecrets(signingKeyPurposeStripeWebhook, "")
+	require.Nil(t, err)
+	require.Equal(t, []string{key1.Secret}, secrets)
+}
+
+func TestPayments_Webhook_Rotated_Key(t *testing.T) {
+	stripeMock := &testStripeAPI{}
+	defer stripeMock.AssertExpectations(t)
+
+	c := newTestConfigWithAuthFile(t)
+	c.StripeSecretKey = "secret key"
+	c.StripeWebhookKey = "old webhook key"
+	s := newTestServer(t, c)
+	defer s.closeDatabases()
+	s.stripe = stripeMock
+	_, err := s.userManager.AddSigningKey(signingKeyPurposeStripeWebhook, "new webhook key")
+	require.Nil(t, err)
+
+	// Signature made with the new key is accepted, even though the configured key does not match
+	stripeMock.
+		On("ConstructWebhookEvent", mock.Anything, "stripe signature", "old webhook key").
+		Return(stripe.Event{}, errors.New("signature mismatch"))
+	stripeMock.
+		On("ConstructWebhookEvent", mock.Anything, "stripe signature", "new webhook key").
+		Return(jsonToStripeEvent(t, `{"id":"evt_1234","type":"customer.created","data":{"object":{}}}`), nil)
+
+	rr := request(t, s, "POST", "/v1/account/billing/webhook", "dummy", map[string]string{
+		"Stripe-Signature": "stripe signature",
+	})
+	require.Equal(t, 200, rr.Code)
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"fmt"
+	"heckel.io/ntfy/v2/util"
+	"net/http"
+	"time"
+)
+
+// Subscriptions (JSON/SSE/raw streams and WebSocket connections) hold server resources for as long as they are open,
+// so the number of concurrent subscriptions is limited in two ways:
+//   - per visitor (visitor-subscription-limit, or the tier's subscription limit), i.e. per IP address for anonymous
+//     visitors, and per user for authenticated visitors (regardless of whether they use a password or an access token)
+//   - in total (global-subscription-limit), across all visitors
+//
+// If either limit is reached, the subscription is rejected with a 429 and a Retry-After header, so that clients
+// back off instead of reconnecting right away. The number of active subscriptions is exposed via the health
+// endpoint and the metrics.
+
+const (
+	subscriptionRetryAfter = 30 * time.Second // Value of the Retry-After header if a subscription limit is reached
+)
+
+// subscriptionLimitErrors are the errors for which handleError sets a Retry-After header
+var subscriptionLimitErrors = []int{
+	errHTTPTooManyRequestsLimitSubscriptions.Code,
+	errHTTPTooManyRequestsLimitTotalSubscriptions.Code,
+}
+
+// subscriptionAllowed checks the global and the per-visitor subscription limits, and adds one to both counters
+// if the subscription is allowed. It returns the visitor's max. subscription duration (see visitor.SubscriptionAllowed).
+// Every successful call must be followed by a call to removeSubscription.
+func (s *Server) subscriptionAllowed(v *visitor) (time.Duration, error) {
+	s.mu.RLock()
+	limit := int64(s.config().TotalSubscriptionLimit)
+	s.mu.RUnlock()
+	if active := s.subscriptions.Add(1); limit > 0 && active > limit {
+		s.subscriptions.Add(-1)
+		subscriptionRejected("global")
+		return 0, errHTTPTooManyRequestsLimitTotalSubscriptions
+	}
+	maxDuration, err := v.SubscriptionAllowed()
+	if err != nil {
+		s.subscriptions.Add(-1)
+		subscriptionRejected("visitor")
+		return 0, err
+	}
+	mset(metricSubscriptionsActive, s.subscriptions.Load())
+	return maxDuration, nil
+}
+
+// removeSubscription releases a subscription that was allowed by subscriptionAllowed
+func (s *Server) removeSubscription(v *visitor) {
+	v.RemoveSubscription()
+	mset(metricSubscriptionsActive, s.subscriptions.Add(-1))
+}
+
+// setRetryAfterHeader sets the Retry-After header if the error is a subscription limit error
+func setRetryAfterHeader(w http.ResponseWriter, err *errHTTP) {
+	if util.Contains(subscriptionLimitErrors, err.Code) {
+		w.Header().Set("Retry-After", fmt.Sprintf("%d", int(subscriptionRetryAfter.Seconds())))
+	}
+}
+
+func subscriptionRejected(limit string) {
+	if metricSubscriptionsRejected != nil {
+		metricSubscriptionsRejected.WithLabelValues(limit).Inc()
+	}
+}
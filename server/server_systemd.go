@@ -0,0 +1,67 @@
+package server
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"heckel.io/ntfy/v2/log"
+)
+
+// If ntfy runs as a systemd service with Type=notify, the server notifies systemd once it has started (READY=1), and
+// when it is stopped (STOPPING=1). If WatchdogSec is set in the unit, the manager pings the watchdog (WATCHDOG=1) at half
+// the watchdog interval, but only if the databases respond (see checkDatabases), so that systemd restarts the server
+// if a database is wedged. Outside of systemd (NOTIFY_SOCKET not set), all of this is a no-op.
+//
+// The protocol is described in sd_notify(3): Every notification is a single datagram sent to the Unix socket
+// in NOTIFY_SOCKET, which may be an abstract socket (prefixed with "@").
+
+const (
+	sdNotifyReady    = "READY=1"
+	sdNotifyStopping = "STOPPING=1"
+	sdNotifyWatchdog = "WATCHDOG=1"
+)
+
+// sdNotify sends the given state to systemd, if NOTIFY_SOCKET is set
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	} else if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:] // Abstract socket
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// sdWatchdogInterval returns the interval in which the systemd watchdog must be pinged (half of WatchdogSec),
+// or 0 if the watchdog is not enabled for this process
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	} else if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// pingWatchdog pings the systemd watchdog, unless one of the databases does not respond
+func (s *Server) pingWatchdog() {
+	for name, err := range s.checkDatabases() {
+		if err != nil {
+			log.Tag(tagManager).Err(err).Warn("Not pinging systemd watchdog, %s does not respond", name)
+			return
+		}
+	}
+	if err := sdNotify(sdNotifyWatchdog); err != nil {
+		log.Tag(tagManager).Err(err).Warn("Unable to ping systemd watchdog")
+	}
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSdNotify(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	require.Nil(t, err)
+	defer conn.Close()
+
+	t.Setenv("NOTIFY_SOCKET", socket)
+	require.Nil(t, sdNotify(sdNotifyReady))
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	require.Nil(t, err)
+	require.Equal(t, "READY=1", string(buf[:n]))
+
+	// Watchdog pings only if the databases respond
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	s.pingWatchdog()
+	n, err = conn.Read(buf)
+	require.Nil(t, err)
+	require.Equal(t, "WATCHDOG=1", string(buf[:n]))
+	s.closeDatabases()
+	s.pingWatchdog()
+	require.Nil(t, conn.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+	_, err = conn.Read(buf)
+	require.Error(t, err)
+}
+
+func TestSdNotify_NoSocket(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	require.Nil(t, sdNotify(sdNotifyReady))
+}
+
+func TestSdWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "")
+	require.Equal(t, time.Duration(0), sdWatchdogInterval())
+
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	t.Setenv("WATCHDOG_PID", "")
+	require.Equal(t, 15*time.Second, sdWatchdogInterval())
+
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	require.Equal(t, 15*time.Second, sdWatchdogInterval())
+
+	t.Setenv("WATCHDOG_PID", "1")
+	require.Equal(t, time.Duration(0), sdWatchdogInterval())
+}
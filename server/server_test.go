@@ -2,13 +2,18 @@ package server
 
 import (
 	"bufio"
+	"compress/gzip"
 	"context"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/csv"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"golang.org/x/crypto/bcrypt"
 	"heckel.io/ntfy/v2/user"
+	"image/png"
 	"io"
 	"net/http"
 	"net/http/httptest"
@@ -23,6 +28,7 @@ import (
 	"time"
 
 	"github.com/SherClockHolmes/webpush-go"
+	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/require"
 	"heckel.io/ntfy/v2/log"
 	"heckel.io/ntfy/v2/util"
@@ -84,6 +90,60 @@ func TestServer_PublishWithFirebase(t *testing.T) {
 	require.Equal(t, "my first message", sender.Messages()[0].APNS.Payload.CustomData["message"])
 }
 
+func TestServer_PublishWithFirebase_DeadLetter(t *testing.T) {
+	c := newTestConfig(t)
+	c.DeadLetterTopic = "undeliverable"
+	sender := newTestFirebaseSender(0) // Every send fails
+	s := newTestServer(t, c)
+	s.firebaseClient = newFirebaseClient(sender, &testAuther{Allow: true})
+
+	response := request(t, s, "PUT", "/mytopic", "my first message", map[string]string{
+		"Title":    "Backup",
+		"Priority": "high",
+	})
+	msg := toMessage(t, response.Body.String())
+
+	var messages []*message
+	waitFor(t, func() bool {
+		response = request(t, s, "GET", "/undeliverable/json?poll=1", "", nil)
+		messages = toMessages(t, response.Body.String())
+		return len(messages) == 1
+	})
+	require.Equal(t, "Delivery via firebase failed", messages[0].Title)
+	require.Equal(t, fmt.Sprintf("Message %s in topic mytopic could not be delivered via firebase: %s\n\nBackup\n\nmy first message", msg.ID, ErrFirebaseQuotaExceeded.Error()), messages[0].Message)
+	require.Equal(t, 4, messages[0].Priority)
+	require.Equal(t, []string{"dead_letter", "firebase"}, messages[0].Tags)
+
+	// Messages in the dead-letter topic are not dead-lettered again, even though Firebase fails for them as well
+	time.Sleep(200 * time.Millisecond)
+	response = request(t, s, "GET", "/undeliverable/json?poll=1", "", nil)
+	require.Equal(t, 1, len(toMessages(t, response.Body.String())))
+}
+
+func TestServer_PublishWithEmail_DeadLetter(t *testing.T) {
+	c := newTestConfig(t)
+	c.DeadLetterTopic = "undeliverable"
+	s := newTestServer(t, c)
+	setTestMailer(s, &testFailingMailer{})
+
+	response := request(t, s, "PUT", "/mytopic", "fail", map[string]string{
+		"E-Mail": "test@example.com",
+	})
+	require.Equal(t, 200, response.Code)
+	waitFor(t, func() bool {
+		response = request(t, s, "GET", "/undeliverable/json?poll=1", "", nil)
+		messages := toMessages(t, response.Body.String())
+		return len(messages) == 1 && strings.Contains(messages[0].Message, "could not be delivered via email: connection refused")
+	})
+}
+
+func TestServer_DeadLetterTopic_Invalid(t *testing.T) {
+	c := newTestConfig(t)
+	c.DeadLetterTopic = "not/a/topic"
+	_, err := New(c)
+	require.Error(t, err)
+}
+
 func TestServer_PublishWithFirebase_WithoutUsers_AndWithoutPanic(t *testing.T) {
 	// This tests issue #641, which used to panic before the fix
 
@@ -358,6 +418,87 @@ func TestServer_PublishGETOnlyOneTopic(t *testing.T) {
 	require.Equal(t, 404, response.Code)
 }
 
+func TestServer_PublishDedup(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	response := request(t, s, "PUT", "/mytopic", "disk full", map[string]string{"X-Dedup-ID": "disk-sda1"})
+	msg1 := toMessage(t, response.Body.String())
+	require.Equal(t, 0, msg1.DedupCount)
+
+	response = request(t, s, "PUT", "/mytopic", "disk still full", map[string]string{"X-Dedup-ID": "disk-sda1"})
+	msg2 := toMessage(t, response.Body.String())
+	require.Equal(t, msg1.ID, msg2.ID)
+	require.Equal(t, "disk full", msg2.Message)
+	require.Equal(t, 1, msg2.DedupCount)
+
+	response = request(t, s, "PUT", "/mytopic?dedup-id=disk-sda1", "disk full again", nil)
+	require.Equal(t, 2, toMessage(t, response.Body.String()).DedupCount)
+
+	// Same dedup ID in another topic, or another dedup ID is not coalesced
+	response = request(t, s, "PUT", "/othertopic", "disk full", map[string]string{"X-Dedup-ID": "disk-sda1"})
+	require.NotEqual(t, msg1.ID, toMessage(t, response.Body.String()).ID)
+	response = request(t, s, "PUT", "/mytopic", "disk full", map[string]string{"X-Dedup-ID": "disk-sdb1"})
+	require.NotEqual(t, msg1.ID, toMessage(t, response.Body.String()).ID)
+
+	// Hash-based
+	response = request(t, s, "PUT", "/mytopic", "flapping", map[string]string{"X-Dedup": "yes", "Title": "Monitor"})
+	msg3 := toMessage(t, response.Body.String())
+	response = request(t, s, "PUT", "/mytopic", "flapping", map[string]string{"X-Dedup": "yes", "Title": "Monitor"})
+	require.Equal(t, msg3.ID, toMessage(t, response.Body.String()).ID)
+	response = request(t, s, "PUT", "/mytopic", "flapping", map[string]string{"X-Dedup": "yes", "Title": "Other monitor"})
+	require.NotEqual(t, msg3.ID, toMessage(t, response.Body.String()).ID)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 4, len(messages))
+	require.Equal(t, msg1.ID, messages[0].ID)
+	require.Equal(t, 2, messages[0].DedupCount)
+	require.Equal(t, msg3.ID, messages[2].ID)
+	require.Equal(t, 1, messages[2].DedupCount)
+
+	// Window expired
+	s.mu.Lock()
+	for _, entry := range s.dedups {
+		entry.expires = time.Now().Add(-time.Second)
+	}
+	s.mu.Unlock()
+	response = request(t, s, "PUT", "/mytopic", "disk full", map[string]string{"X-Dedup-ID": "disk-sda1"})
+	require.NotEqual(t, msg1.ID, toMessage(t, response.Body.String()).ID)
+	s.pruneDedups()
+	require.Equal(t, 1, len(s.dedups))
+}
+
+func TestServer_PublishDedup_PublishFailed(t *testing.T) {
+	c := newTestConfig(t)
+	c.FaultInjectionCacheErrorProbability = 1
+	s := newTestServer(t, c)
+
+	response := request(t, s, "PUT", "/mytopic", "disk full", map[string]string{"X-Dedup-ID": "disk-sda1"})
+	require.Equal(t, 500, response.Code)
+	require.Equal(t, 0, len(s.dedups))
+
+	// The failed message is not the original message of the dedup ID
+	s.messageCache.faults = nil
+	response = request(t, s, "PUT", "/mytopic", "disk still full", map[string]string{"X-Dedup-ID": "disk-sda1"})
+	require.Equal(t, 200, response.Code)
+	msg := toMessage(t, response.Body.String())
+	require.Equal(t, "disk still full", msg.Message)
+	require.Equal(t, 0, msg.DedupCount)
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	require.Equal(t, msg.ID, toMessage(t, response.Body.String()).ID)
+}
+
+func TestServer_PublishDedup_Disabled(t *testing.T) {
+	c := newTestConfig(t)
+	c.MessageDedupWindow = 0
+	s := newTestServer(t, c)
+
+	response := request(t, s, "PUT", "/mytopic", "disk full", map[string]string{"X-Dedup-ID": "disk-sda1"})
+	msg1 := toMessage(t, response.Body.String())
+	response = request(t, s, "PUT", "/mytopic", "disk full", map[string]string{"X-Dedup-ID": "disk-sda1"})
+	require.NotEqual(t, msg1.ID, toMessage(t, response.Body.String()).ID)
+}
+
 func TestServer_PublishNoCache(t *testing.T) {
 	s := newTestServer(t, newTestConfig(t))
 
@@ -455,6 +596,143 @@ func TestServer_PublishAt_Expires(t *testing.T) {
 	require.True(t, m.Expires < time.Now().Add(12*time.Hour+48*time.Hour+time.Minute).Unix())
 }
 
+func TestServer_Publish_CachePriorityMultipliers(t *testing.T) {
+	c := newTestConfig(t)
+	c.CachePriorityMultipliers = map[int]float64{5: 4, 1: 0.5}
+	s := newTestServer(t, c)
+
+	expires := func(priority string) int64 {
+		response := request(t, s, "PUT", "/mytopic", "a message", map[string]string{
+			"Priority": priority,
+		})
+		require.Equal(t, 200, response.Code)
+		return toMessage(t, response.Body.String()).Expires
+	}
+	require.InDelta(t, time.Now().Add(48*time.Hour).Unix(), expires("urgent"), 2)
+	require.InDelta(t, time.Now().Add(12*time.Hour).Unix(), expires("high"), 2)
+	require.InDelta(t, time.Now().Add(12*time.Hour).Unix(), expires(""), 2)
+	require.InDelta(t, time.Now().Add(6*time.Hour).Unix(), expires("min"), 2)
+}
+
+func TestServer_Publish_MessageTTL(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	// Shorter than the default is honored, longer is capped
+	response := request(t, s, "PUT", "/mytopic", "OTP: 123456", map[string]string{
+		"Message-TTL": "5m",
+	})
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+	require.InDelta(t, time.Now().Add(5*time.Minute).Unix(), m.Expires, 2)
+
+	response = request(t, s, "PUT", "/mytopic?message-ttl=30d", "a message", nil)
+	require.Equal(t, 200, response.Code)
+	require.InDelta(t, time.Now().Add(12*time.Hour).Unix(), toMessage(t, response.Body.String()).Expires, 2)
+
+	for _, ttl := range []string{"0", "-5m", "forever"} {
+		response = request(t, s, "PUT", "/mytopic", "a message", map[string]string{
+			"Message-TTL": ttl,
+		})
+		require.Equal(t, 400, response.Code)
+		require.Equal(t, 40074, toHTTPError(t, response.Body.String()).Code)
+	}
+
+	// Expired messages are not returned, even if they were not pruned yet
+	require.Nil(t, s.messageCache.AddMessage(&message{ID: "expiredmsg12", Time: time.Now().Add(-10 * time.Minute).Unix(), Expires: time.Now().Add(-5 * time.Minute).Unix(), Event: messageEvent, Topic: "mytopic", Message: "OTP: 654321"}))
+	response = request(t, s, "GET", "/mytopic/json?poll=1&since=all", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "OTP: 123456", messages[0].Message)
+
+	// Pruned by the manager
+	_, err := s.messageCache.db.Exec("UPDATE messages SET expires = ? WHERE mid = ?", time.Now().Add(-time.Second).Unix(), m.ID)
+	require.Nil(t, err)
+	s.execManager()
+	_, err = s.messageCache.Message(m.ID)
+	require.Equal(t, errMessageNotFound, err)
+}
+
+func TestServer_ExpiredEvent(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	since := time.Now().Add(-time.Minute).Unix()
+
+	response := request(t, s, "PUT", "/mytopic", "OTP: 123456", nil)
+	m1 := toMessage(t, response.Body.String())
+	response = request(t, s, "PUT", "/mytopic", "another message", nil)
+	m2 := toMessage(t, response.Body.String())
+
+	// Active subscribers are told right away when the manager deletes the message
+	rr := httptest.NewRecorder()
+	cancel := subscribe(t, s, "/mytopic/json?since=none", rr)
+	_, err := s.messageCache.db.Exec("UPDATE messages SET expires = ? WHERE mid = ?", time.Now().Add(-time.Second).Unix(), m1.ID)
+	require.Nil(t, err)
+	s.execManager()
+	cancel()
+	messages := toMessages(t, rr.Body.String())
+	last := messages[len(messages)-1]
+	require.Equal(t, expiredEvent, last.Event)
+	require.Equal(t, "mytopic", last.Topic)
+	require.Equal(t, []string{m1.ID}, last.Expired)
+
+	// Clients that reconnect with a since marker are told as well
+	for _, query := range []string{fmt.Sprintf("since=%d", since), "since=" + m1.ID, "since=1h"} {
+		response = request(t, s, "GET", "/mytopic/json?poll=1&"+query, "", nil)
+		messages = toMessages(t, response.Body.String())
+		require.Equal(t, 2, len(messages), query)
+		require.Equal(t, m2.ID, messages[0].ID)
+		require.Equal(t, expiredEvent, messages[1].Event)
+		require.Equal(t, []string{m1.ID}, messages[1].Expired)
+	}
+
+	// ... but not when they receive all messages, or messages after the expiry
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	messages = toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, m2.ID, messages[0].ID)
+	response = request(t, s, "GET", fmt.Sprintf("/mytopic/json?poll=1&since=%d", time.Now().Add(time.Minute).Unix()), "", nil)
+	require.Equal(t, "", response.Body.String())
+}
+
+func TestServer_Publish_AttachmentTTL(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "PUT", "/mytopic", "secret file", map[string]string{
+		"Filename":       "secret.txt",
+		"Attachment-TTL": "10m",
+	})
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+	require.InDelta(t, time.Now().Add(10*time.Minute).Unix(), m.Attachment.Expires, 2)
+	require.InDelta(t, time.Now().Add(12*time.Hour).Unix(), m.Expires, 2) // Message itself is kept
+	path := strings.TrimPrefix(m.Attachment.URL, "http://127.0.0.1:12345")
+	require.Equal(t, 200, request(t, s, "GET", path, "", nil).Code)
+	response = request(t, s, "HEAD", path, "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "11", response.Header().Get("Content-Length"))
+
+	// Longer than the limit is capped
+	response = request(t, s, "PUT", "/mytopic?f=other.txt&attachment-ttl=1d", "other file", nil)
+	require.Equal(t, 200, response.Code)
+	require.InDelta(t, time.Now().Add(3*time.Hour).Unix(), toMessage(t, response.Body.String()).Attachment.Expires, 2)
+
+	// Expired attachments cannot be downloaded, even if they were not pruned yet
+	_, err := s.messageCache.db.Exec("UPDATE messages SET attachment_expires = ? WHERE mid = ?", time.Now().Add(-time.Second).Unix(), m.ID)
+	require.Nil(t, err)
+	require.Equal(t, 404, request(t, s, "GET", path, "", nil).Code)
+	response = request(t, s, "HEAD", path, "", nil)
+	require.Equal(t, 404, response.Code)
+	require.Equal(t, "", response.Header().Get("Content-Length"))
+	s.execManager()
+	require.NoFileExists(t, filepath.Join(s.config().AttachmentCacheDir, m.ID))
+}
+
+func TestServer_PublishJSON_TTL(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	body := `{"topic":"mytopic","message":"OTP: 123456","message_ttl":"5m"}`
+	response := request(t, s, "PUT", "/", body, nil)
+	require.Equal(t, 200, response.Code)
+	require.InDelta(t, time.Now().Add(5*time.Minute).Unix(), toMessage(t, response.Body.String()).Expires, 2)
+}
+
 func TestServer_PublishAtWithCacheError(t *testing.T) {
 	s := newTestServer(t, newTestConfig(t))
 
@@ -598,6 +876,39 @@ func TestServer_PublishAndPollSince(t *testing.T) {
 	require.Equal(t, 40008, toHTTPError(t, response.Body.String()).Code)
 }
 
+func TestServer_PublishAndPoll_StreamCompression(t *testing.T) {
+	conf := newTestConfig(t)
+	conf.StreamCompression = true
+	s := newTestServer(t, conf)
+
+	request(t, s, "PUT", "/mytopic", "test 1", nil)
+	request(t, s, "PUT", "/mytopic", "test 2", nil)
+
+	// Compressed if the client accepts gzip
+	response := request(t, s, "GET", "/mytopic/json?poll=1", "", map[string]string{
+		"Accept-Encoding": "gzip, deflate",
+	})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "gzip", response.Header().Get("Content-Encoding"))
+	gz, err := gzip.NewReader(response.Body)
+	require.Nil(t, err)
+	body, err := io.ReadAll(gz)
+	require.Nil(t, err)
+	messages := toMessages(t, string(body))
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "test 1", messages[0].Message)
+
+	// Uncompressed otherwise, and errors are never compressed
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	require.Equal(t, "", response.Header().Get("Content-Encoding"))
+	require.Equal(t, 2, len(toMessages(t, response.Body.String())))
+	response = request(t, s, "GET", "/mytopic/json?poll=1&since=INVALID", "", map[string]string{
+		"Accept-Encoding": "gzip",
+	})
+	require.Equal(t, "", response.Header().Get("Content-Encoding"))
+	require.Equal(t, 40008, toHTTPError(t, response.Body.String()).Code)
+}
+
 func newMessageWithTimestamp(topic, message string, timestamp int64) *message {
 	m := newDefaultMessage(topic, message)
 	m.Time = timestamp
@@ -628,6 +939,84 @@ func TestServer_PollSinceID_MultipleTopics(t *testing.T) {
 	require.Equal(t, "mytopic2", messages[3].Topic)
 }
 
+func TestServer_PollWithUntilAndLimit_Pagination(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	require.Nil(t, s.messageCache.AddMessage(newMessageWithTimestamp("mytopic1", "test 1", 1655740277)))
+	require.Nil(t, s.messageCache.AddMessage(newMessageWithTimestamp("mytopic2", "test 2", 1655740283)))
+	require.Nil(t, s.messageCache.AddMessage(newMessageWithTimestamp("mytopic1", "test 3", 1655740289)))
+	require.Nil(t, s.messageCache.AddMessage(newMessageWithTimestamp("mytopic2", "test 4", 1655740293)))
+	require.Nil(t, s.messageCache.AddMessage(newMessageWithTimestamp("mytopic1", "test 5", 1655740297)))
+
+	// Fetch history in pages of two, passing the last ID as cursor
+	var pages [][]string
+	cursor := "all"
+	for {
+		response := request(t, s, "GET", fmt.Sprintf("/mytopic1,mytopic2/json?poll=1&since=%s&limit=2", cursor), "", nil)
+		messages := toMessages(t, response.Body.String())
+		if len(messages) == 0 {
+			break
+		}
+		page := make([]string, 0)
+		for _, m := range messages {
+			page = append(page, m.Message)
+		}
+		pages = append(pages, page)
+		cursor = messages[len(messages)-1].ID
+	}
+	require.Equal(t, [][]string{{"test 1", "test 2"}, {"test 3", "test 4"}, {"test 5"}}, pages)
+
+	// Until is inclusive
+	response := request(t, s, "GET", "/mytopic1,mytopic2/json?poll=1&since=1655740280&until=1655740293", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, "test 2", messages[0].Message)
+	require.Equal(t, "test 4", messages[2].Message)
+
+	// Limit counts only messages that pass the filters
+	response = request(t, s, "GET", "/mytopic1,mytopic2/json?poll=1&message=test+5&limit=1", "", nil)
+	messages = toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "test 5", messages[0].Message)
+}
+
+func TestServer_PollWithLimit_Pagination_SameSecond(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	// Messages of three topics, all published in the same second
+	for i, topic := range []string{"mytopic1", "mytopic2", "mytopic1", "mytopic3", "mytopic2", "mytopic1"} {
+		require.Nil(t, s.messageCache.AddMessage(newMessageWithTimestamp(topic, fmt.Sprintf("test %d", i+1), 1655740277)))
+	}
+
+	// Every message is returned exactly once, in publishing order
+	received := make([]string, 0)
+	cursor := "all"
+	for {
+		response := request(t, s, "GET", fmt.Sprintf("/mytopic1,mytopic2,mytopic3/json?poll=1&since=%s&limit=2", cursor), "", nil)
+		messages := toMessages(t, response.Body.String())
+		if len(messages) == 0 {
+			break
+		}
+		for _, m := range messages {
+			received = append(received, m.Message)
+		}
+		cursor = messages[len(messages)-1].ID
+	}
+	require.Equal(t, []string{"test 1", "test 2", "test 3", "test 4", "test 5", "test 6"}, received)
+}
+
+func TestServer_PollWithUntilAndLimit_Invalid(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	response := request(t, s, "GET", "/mytopic/json?poll=1&until=yesterday", "", nil)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40070, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1&limit=-1", "", nil)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40071, toHTTPError(t, response.Body.String()).Code)
+}
+
 func TestServer_PollSinceID_MultipleTopics_IDDoesNotMatch(t *testing.T) {
 	s := newTestServer(t, newTestConfig(t))
 
@@ -645,6 +1034,242 @@ func TestServer_PollSinceID_MultipleTopics_IDDoesNotMatch(t *testing.T) {
 	require.Equal(t, "test 6", messages[3].Message)
 }
 
+func TestServer_TopicMessagesDelete_OnlyTopic(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithAuthFile(t))
+	defer s.closeDatabases()
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	admin := map[string]string{"Authorization": util.BasicAuth("phil", "phil")}
+	require.Equal(t, 200, request(t, s, "PUT", "/mytopic", "first", admin).Code)
+	require.Equal(t, 200, request(t, s, "PUT", "/mytopic?f=file.txt", "attachment", admin).Code)
+	expiredInOtherTopic := newDefaultMessage("othertopic", "expired, but not pruned yet")
+	expiredInOtherTopic.Expires = time.Now().Unix() - 1
+	require.Nil(t, s.messageCache.AddMessage(expiredInOtherTopic))
+	require.Equal(t, int64(10), s.fileCache.Size())
+
+	// Messages and attachments of the topic are deleted, other topics are left to the manager
+	require.Equal(t, 200, request(t, s, "DELETE", "/mytopic/messages", "", admin).Code)
+	ids, err := s.messageCache.TopicMessageIDs("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 0, len(ids))
+	require.Equal(t, int64(0), s.fileCache.Size())
+	ids, err = s.messageCache.MessagesExpired()
+	require.Nil(t, err)
+	require.Equal(t, []string{expiredInOtherTopic.ID}, ids)
+}
+
+func TestServer_Search(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	request(t, s, "PUT", "/mytopic", "Backup failed: disk full", map[string]string{"Priority": "high"})
+	request(t, s, "PUT", "/mytopic", "Backup succeeded", nil)
+	request(t, s, "PUT", "/othertopic", "Disk almost full", nil)
+
+	response := request(t, s, "GET", "/v1/search?topic=mytopic,othertopic&q=disk+full", "", nil)
+	require.Equal(t, 200, response.Code)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "Disk almost full", messages[0].Message)
+	require.Equal(t, "Backup failed: disk full", messages[1].Message)
+
+	response = request(t, s, "GET", "/v1/search?topic=mytopic,othertopic&q=disk&priority=high", "", nil)
+	messages = toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "Backup failed: disk full", messages[0].Message)
+
+	response = request(t, s, "GET", "/v1/search?topic=mytopic&q=backup&limit=1", "", nil)
+	messages = toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "Backup succeeded", messages[0].Message)
+
+	response = request(t, s, "GET", "/v1/search?topic=mytopic&q=backup&limit=1001", "", nil)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40060, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "GET", "/v1/search?topic=mytopic&q=backup&limit=0", "", nil)
+	require.Equal(t, 400, response.Code)
+
+	response = request(t, s, "GET", "/v1/search?topic=mytopic", "", nil)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40060, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "GET", "/v1/search?q=disk", "", nil)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40060, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_Search_Auth(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionDenyAll
+	s := newTestServer(t, c)
+	defer s.closeDatabases()
+
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.AllowAccess("phil", "mytopic", user.PermissionReadWrite))
+	require.Nil(t, s.messageCache.AddMessage(newDefaultMessage("mytopic", "secret disk report")))
+	require.Nil(t, s.messageCache.AddMessage(newDefaultMessage("othertopic", "other disk report")))
+
+	response := request(t, s, "GET", "/v1/search?topic=mytopic&q=disk", "", nil)
+	require.Equal(t, 403, response.Code)
+
+	response = request(t, s, "GET", "/v1/search?topic=mytopic,othertopic&q=disk", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 403, response.Code)
+
+	response = request(t, s, "GET", "/v1/search?topic=mytopic&q=disk", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "secret disk report", messages[0].Message)
+}
+
+func TestServer_Search_CacheDisabled(t *testing.T) {
+	c := newTestConfig(t)
+	c.CacheDuration = 0
+	s := newTestServer(t, c)
+
+	response := request(t, s, "GET", "/v1/search?topic=mytopic&q=disk", "", nil)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40061, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_TopicExport(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	request(t, s, "PUT", "/mytopic", "first", map[string]string{"Title": "Backup", "Tags": "a,b"})
+	request(t, s, "PUT", "/mytopic?attach=https://example.com/file.jpg", "second", nil)
+	request(t, s, "PUT", "/mytopic", "third", nil)
+	request(t, s, "PUT", "/othertopic", "other", nil)
+
+	response := request(t, s, "GET", "/mytopic/export", "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "application/x-ndjson; charset=utf-8", response.Header().Get("Content-Type"))
+	require.Equal(t, "", response.Header().Get("X-Next-Since"))
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, "first", messages[0].Message)
+	require.Equal(t, "second", messages[1].Message)
+	require.Equal(t, "https://example.com/file.jpg", messages[1].Attachment.URL)
+	require.Equal(t, "third", messages[2].Message)
+
+	// Pagination
+	response = request(t, s, "GET", "/mytopic/export?limit=2", "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, 2, len(toMessages(t, response.Body.String())))
+	require.Equal(t, messages[1].ID, response.Header().Get("X-Next-Since"))
+
+	response = request(t, s, "GET", "/mytopic/export?limit=2&since="+messages[1].ID, "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "", response.Header().Get("X-Next-Since"))
+	page := toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(page))
+	require.Equal(t, "third", page[0].Message)
+
+	// Time window
+	response = request(t, s, "GET", "/mytopic/export?until=1", "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "", response.Body.String())
+
+	// CSV
+	response = request(t, s, "GET", "/mytopic/export?format=csv", "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "text/csv; charset=utf-8", response.Header().Get("Content-Type"))
+	records, err := csv.NewReader(strings.NewReader(response.Body.String())).ReadAll()
+	require.Nil(t, err)
+	require.Equal(t, 4, len(records))
+	require.Equal(t, "id", records[0][0])
+	require.Equal(t, []string{"a,b", "Backup", "first"}, records[1][4:7])
+	require.Equal(t, "file.jpg", records[2][8])
+	require.Equal(t, "https://example.com/file.jpg", records[2][12])
+
+	// Attachments manifest
+	response = request(t, s, "GET", "/mytopic/export?format=attachments", "", nil)
+	require.Equal(t, 200, response.Code)
+	lines := strings.Split(strings.TrimSpace(response.Body.String()), "\n")
+	require.Equal(t, 1, len(lines))
+	manifest, err := util.UnmarshalJSON[exportAttachment](io.NopCloser(strings.NewReader(lines[0])))
+	require.Nil(t, err)
+	require.Equal(t, messages[1].ID, manifest.ID)
+	require.Equal(t, "file.jpg", manifest.Name)
+
+	// Invalid params
+	for _, query := range []string{"format=xml", "limit=0", "limit=10001", "until=yesterday"} {
+		response = request(t, s, "GET", "/mytopic/export?"+query, "", nil)
+		require.Equal(t, 400, response.Code)
+		require.Equal(t, 40069, toHTTPError(t, response.Body.String()).Code)
+	}
+}
+
+func TestServer_TopicFeed(t *testing.T) {
+	c := newTestConfig(t)
+	c.BaseURL = "https://ntfy.example.com"
+	s := newTestServer(t, c)
+
+	request(t, s, "PUT", "/mytopic", "first", map[string]string{"Title": "Backup", "Tags": "a,b", "Priority": "high", "Click": "https://example.com"})
+	request(t, s, "PUT", "/mytopic?attach=https://example.com/file.jpg", "second line one\nline two", nil)
+	request(t, s, "PUT", "/othertopic", "other", nil)
+
+	response := request(t, s, "GET", "/mytopic/feed.xml", "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "application/atom+xml; charset=utf-8", response.Header().Get("Content-Type"))
+	var feed atomFeed
+	require.Nil(t, xml.Unmarshal(response.Body.Bytes(), &feed))
+	require.Equal(t, "https://ntfy.example.com/mytopic", feed.ID)
+	require.Equal(t, "mytopic", feed.Title)
+	require.Equal(t, 2, len(feed.Entries))
+
+	// Newest first, title falls back to the first line of the message
+	require.Equal(t, "second line one", feed.Entries[0].Title)
+	require.Equal(t, "second line one\nline two", feed.Entries[0].Content.Value)
+	require.Equal(t, "enclosure", feed.Entries[0].Links[0].Rel)
+	require.Equal(t, "https://example.com/file.jpg", feed.Entries[0].Links[0].Href)
+	require.Equal(t, "file.jpg", feed.Entries[0].Links[0].Title)
+	require.Equal(t, "default", feed.Entries[0].Categories[0].Term)
+
+	require.Equal(t, "Backup", feed.Entries[1].Title)
+	require.Equal(t, "first", feed.Entries[1].Content.Value)
+	require.Equal(t, "https://example.com", feed.Entries[1].Links[0].Href)
+	require.Equal(t, 3, len(feed.Entries[1].Categories))
+	require.Equal(t, "high", feed.Entries[1].Categories[0].Term)
+	require.Equal(t, "b", feed.Entries[1].Categories[2].Term)
+}
+
+func TestServer_TopicFeed_Unauthorized(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionDenyAll
+	s := newTestServer(t, c)
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+
+	require.Equal(t, 403, request(t, s, "GET", "/mytopic/feed.xml", "", nil).Code)
+	require.Equal(t, 200, request(t, s, "GET", "/mytopic/feed.xml", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	}).Code)
+}
+
+func TestServer_TopicExport_Auth(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionDenyAll
+	s := newTestServer(t, c)
+	defer s.closeDatabases()
+
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.AllowAccess("phil", "mytopic", user.PermissionRead))
+	require.Nil(t, s.messageCache.AddMessage(newDefaultMessage("mytopic", "secret report")))
+
+	response := request(t, s, "GET", "/mytopic/export", "", nil)
+	require.Equal(t, 403, response.Code)
+
+	response = request(t, s, "GET", "/mytopic/export", "", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "secret report", messages[0].Message)
+}
+
 func TestServer_PublishViaGET(t *testing.T) {
 	s := newTestServer(t, newTestConfig(t))
 
@@ -676,7 +1301,7 @@ func TestServer_PublishMessageInHeaderWithNewlines(t *testing.T) {
 
 func TestServer_PublishInvalidTopic(t *testing.T) {
 	s := newTestServer(t, newTestConfig(t))
-	s.smtpSender = &testMailer{}
+	setTestMailer(s, &testMailer{})
 	response := request(t, s, "PUT", "/docs", "fail", nil)
 	require.Equal(t, 40010, toHTTPError(t, response.Body.String()).Code)
 }
@@ -838,48 +1463,162 @@ func TestServer_Auth_Fail_InvalidPass(t *testing.T) {
 	require.Equal(t, 401, response.Code)
 }
 
-func TestServer_Auth_Fail_Unauthorized(t *testing.T) {
+func TestServer_Auth_Fail_Unauthorized(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionDenyAll
+	s := newTestServer(t, c)
+
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	require.Nil(t, s.userManager.AllowAccess("ben", "sometopic", user.PermissionReadWrite)) // Not mytopic!
+
+	response := request(t, s, "GET", "/mytopic/auth", "", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 403, response.Code)
+}
+
+func TestServer_Auth_Fail_CannotPublish(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionReadWrite // Open by default
+	s := newTestServer(t, c)
+
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	require.Nil(t, s.userManager.AllowAccess(user.Everyone, "private", user.PermissionDenyAll))
+	require.Nil(t, s.userManager.AllowAccess(user.Everyone, "announcements", user.PermissionRead))
+
+	response := request(t, s, "PUT", "/mytopic", "test", nil)
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "PUT", "/announcements", "test", nil)
+	require.Equal(t, 403, response.Code) // Cannot write as anonymous
+
+	response = request(t, s, "PUT", "/announcements", "test", map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "GET", "/announcements/json?poll=1", "", nil)
+	require.Equal(t, 200, response.Code) // Anonymous read allowed
+
+	response = request(t, s, "GET", "/private/json?poll=1", "", nil)
+	require.Equal(t, 403, response.Code) // Anonymous read not allowed
+}
+
+func TestServer_Auth_FineGrained_WriteNoCacheAndAttach(t *testing.T) {
 	c := newTestConfigWithAuthFile(t)
 	c.AuthDefault = user.PermissionDenyAll
 	s := newTestServer(t, c)
+	defer s.closeDatabases()
 
 	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
-	require.Nil(t, s.userManager.AllowAccess("ben", "sometopic", user.PermissionReadWrite)) // Not mytopic!
+	require.Nil(t, s.userManager.AllowAccess("ben", "alerts", user.PermissionRead|user.PermissionWriteNoCache))
+	require.Nil(t, s.userManager.AllowAccess("ben", "files", user.PermissionRead|user.PermissionWriteNoCache|user.PermissionAttach))
+	auth := map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	}
 
-	response := request(t, s, "GET", "/mytopic/auth", "", map[string]string{
+	// Publish-only-no-cache: messages are published, but not cached
+	response := request(t, s, "PUT", "/alerts", "not cached", auth)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, int64(0), toMessage(t, response.Body.String()).Expires)
+	response = request(t, s, "GET", "/alerts/json?poll=1", "", auth)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, 0, len(toMessages(t, response.Body.String())))
+
+	response = request(t, s, "PUT", "/alerts", "delayed", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+		"Delay":         "1h",
+	})
+	require.Equal(t, 400, response.Code)
+
+	// Attachments require the attach permission
+	response = request(t, s, "PUT", "/alerts", "some file", map[string]string{
 		"Authorization": util.BasicAuth("ben", "ben"),
+		"Filename":      "file.txt",
 	})
 	require.Equal(t, 403, response.Code)
+	require.Equal(t, 40305, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "PUT", "/files", "some file", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+		"Filename":      "file.txt",
+	})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "file.txt", toMessage(t, response.Body.String()).Attachment.Name)
 }
 
-func TestServer_Auth_Fail_CannotPublish(t *testing.T) {
+func TestServer_Auth_FineGrained_Manage(t *testing.T) {
 	c := newTestConfigWithAuthFile(t)
-	c.AuthDefault = user.PermissionReadWrite // Open by default
+	c.AuthDefault = user.PermissionDenyAll
 	s := newTestServer(t, c)
+	defer s.closeDatabases()
 
-	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
-	require.Nil(t, s.userManager.AllowAccess(user.Everyone, "private", user.PermissionDenyAll))
-	require.Nil(t, s.userManager.AllowAccess(user.Everyone, "announcements", user.PermissionRead))
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	require.Nil(t, s.userManager.AllowAccess("phil", "mytopic", user.PermissionReadWrite|user.PermissionManage))
+	require.Nil(t, s.userManager.AllowAccess("ben", "mytopic", user.PermissionReadWrite))
+	philAuth := map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	}
+	benAuth := map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	}
 
-	response := request(t, s, "PUT", "/mytopic", "test", nil)
+	response := request(t, s, "PUT", "/mytopic", "spam 1", benAuth)
 	require.Equal(t, 200, response.Code)
+	spam1 := toMessage(t, response.Body.String())
+	response = request(t, s, "PUT", "/mytopic", "spam 2", benAuth)
+	require.Equal(t, 200, response.Code)
+	spam2 := toMessage(t, response.Body.String())
 
-	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	// Delete message: ben cannot, phil can
+	response = request(t, s, "DELETE", "/mytopic/"+spam1.ID, "", benAuth)
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "DELETE", "/mytopic/"+spam1.ID, "", philAuth)
 	require.Equal(t, 200, response.Code)
+	response = request(t, s, "DELETE", "/mytopic/"+spam1.ID, "", philAuth)
+	require.Equal(t, 404, response.Code)
+	require.Equal(t, 40404, toHTTPError(t, response.Body.String()).Code)
 
-	response = request(t, s, "PUT", "/announcements", "test", nil)
-	require.Equal(t, 403, response.Code) // Cannot write as anonymous
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", philAuth)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, spam2.ID, messages[0].ID)
 
-	response = request(t, s, "PUT", "/announcements", "test", map[string]string{
-		"Authorization": util.BasicAuth("phil", "phil"),
-	})
+	// Mute sender: ben cannot publish anymore, phil still can
+	response = request(t, s, "POST", "/mytopic/mute", `{"message":"`+spam2.ID+`","duration":"1h"}`, benAuth)
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "POST", "/mytopic/mute", `{"message":"`+spam2.ID+`","duration":"100d"}`, philAuth)
+	require.Equal(t, 400, response.Code)
+	response = request(t, s, "POST", "/mytopic/mute", `{"message":"`+spam2.ID+`","duration":"1h"}`, philAuth)
+	require.Equal(t, 200, response.Code)
+	mute, err := util.UnmarshalJSON[apiTopicMuteResponse](io.NopCloser(response.Body))
+	require.Nil(t, err)
+	require.Greater(t, mute.MutedUntil, time.Now().Add(59*time.Minute).Unix())
+
+	response = request(t, s, "PUT", "/mytopic", "spam 3", benAuth)
+	require.Equal(t, 403, response.Code)
+	require.Equal(t, 40304, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "PUT", "/mytopic", "hi", philAuth)
 	require.Equal(t, 200, response.Code)
 
-	response = request(t, s, "GET", "/announcements/json?poll=1", "", nil)
-	require.Equal(t, 200, response.Code) // Anonymous read allowed
+	// Lift mutes
+	response = request(t, s, "DELETE", "/mytopic/mute", "", philAuth)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/mytopic", "sorry", benAuth)
+	require.Equal(t, 200, response.Code)
+}
 
-	response = request(t, s, "GET", "/private/json?poll=1", "", nil)
-	require.Equal(t, 403, response.Code) // Anonymous read not allowed
+func TestServer_Auth_FineGrained_Manage_NoAuth(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "PUT", "/mytopic", "hi", nil)
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+	response = request(t, s, "DELETE", "/mytopic/"+m.ID, "", nil)
+	require.Equal(t, 404, response.Code)
 }
 
 func TestServer_Auth_Fail_Rate_Limiting(t *testing.T) {
@@ -917,6 +1656,58 @@ func TestServer_Auth_ViaQuery(t *testing.T) {
 	require.Equal(t, 401, response.Code)
 }
 
+func TestServer_Auth_ProxyHeader_TrustedProxy(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionDenyAll
+	c.AuthHeader = "X-Remote-User"
+	c.AuthTrustedProxies = []netip.Prefix{netip.MustParsePrefix("9.9.9.0/24")}
+	s := newTestServer(t, c)
+
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+
+	response := request(t, s, "PUT", "/mytopic", "test", map[string]string{
+		"X-Remote-User": "phil",
+	})
+	require.Equal(t, 200, response.Code)
+
+	// New users are provisioned automatically
+	response = request(t, s, "GET", "/v1/account", "", map[string]string{
+		"X-Remote-User": "ben",
+	})
+	require.Equal(t, 200, response.Code)
+	account, _ := util.UnmarshalJSON[apiAccountResponse](io.NopCloser(response.Body))
+	require.Equal(t, "ben", account.Username)
+	require.Equal(t, "user", account.Role)
+
+	u, err := s.userManager.User("ben")
+	require.Nil(t, err)
+	require.Equal(t, user.RoleUser, u.Role)
+
+	// Invalid usernames are rejected
+	response = request(t, s, "GET", "/v1/account", "", map[string]string{
+		"X-Remote-User": "*",
+	})
+	require.Equal(t, 401, response.Code)
+}
+
+func TestServer_Auth_ProxyHeader_UntrustedProxy(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionDenyAll
+	c.AuthHeader = "X-Remote-User"
+	c.AuthTrustedProxies = []netip.Prefix{netip.MustParsePrefix("10.0.0.1/32")}
+	s := newTestServer(t, c)
+
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+
+	response := request(t, s, "PUT", "/mytopic", "test", map[string]string{
+		"X-Remote-User": "phil",
+	})
+	require.Equal(t, 403, response.Code) // Header ignored, treated as anonymous
+
+	_, err := s.userManager.User("ben")
+	require.Equal(t, user.ErrUserNotFound, err)
+}
+
 func TestServer_Auth_NonBasicHeader(t *testing.T) {
 	s := newTestServer(t, newTestConfigWithAuthFile(t))
 
@@ -1046,7 +1837,7 @@ func TestServer_StatsResetter_MessageLimiter_EmailsLimiter(t *testing.T) {
 
 	c := newTestConfigWithAuthFile(t)
 	s := newTestServer(t, c)
-	s.smtpSender = &testMailer{}
+	setTestMailer(s, &testMailer{})
 
 	// Publish some messages, and check stats
 	for i := 0; i < 3; i++ {
@@ -1127,8 +1918,10 @@ func TestServer_DailyMessageQuotaFromDatabase(t *testing.T) {
 }
 
 type testMailer struct {
-	count int
-	mu    sync.Mutex
+	count    int
+	archives map[string][]byte // Filename -> archive, see SendArchive
+	texts    map[string]string // Recipient -> text, see SendText
+	mu       sync.Mutex
 }
 
 func (t *testMailer) Send(v *visitor, m *message, to string) error {
@@ -1138,10 +1931,56 @@ func (t *testMailer) Send(v *visitor, m *message, to string) error {
 	return nil
 }
 
+func (t *testMailer) SendArchive(v *visitor, to, subject, text, filename string, archive []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.count++
+	if t.archives == nil {
+		t.archives = make(map[string][]byte)
+	}
+	t.archives[filename] = archive
+	return nil
+}
+
+func (t *testMailer) SendText(v *visitor, to, subject, text string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.count++
+	if t.texts == nil {
+		t.texts = make(map[string]string)
+	}
+	t.texts[to] = text
+	return nil
+}
+
+func (t *testMailer) Text(to string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.texts[to]
+}
+
 func (t *testMailer) Counts() (total int64, success int64, failure int64) {
 	return 0, 0, 0
 }
 
+type testFailingMailer struct{}
+
+func (t *testFailingMailer) Send(v *visitor, m *message, to string) error {
+	return errors.New("connection refused")
+}
+
+func (t *testFailingMailer) SendArchive(v *visitor, to, subject, text, filename string, archive []byte) error {
+	return errors.New("connection refused")
+}
+
+func (t *testFailingMailer) SendText(v *visitor, to, subject, text string) error {
+	return errors.New("connection refused")
+}
+
+func (t *testFailingMailer) Counts() (total int64, success int64, failure int64) {
+	return 0, 0, 0
+}
+
 func (t *testMailer) Count() int {
 	t.mu.Lock()
 	defer t.mu.Unlock()
@@ -1201,7 +2040,7 @@ func TestServer_PublishTooRequests_ShortReplenish(t *testing.T) {
 
 func TestServer_PublishTooManyEmails_Defaults(t *testing.T) {
 	s := newTestServer(t, newTestConfig(t))
-	s.smtpSender = &testMailer{}
+	setTestMailer(s, &testMailer{})
 	for i := 0; i < 16; i++ {
 		response := request(t, s, "PUT", "/mytopic", fmt.Sprintf("message %d", i), map[string]string{
 			"E-Mail": "test@example.com",
@@ -1219,7 +2058,7 @@ func TestServer_PublishTooManyEmails_Replenish(t *testing.T) {
 	c := newTestConfig(t)
 	c.VisitorEmailLimitReplenish = 500 * time.Millisecond
 	s := newTestServer(t, c)
-	s.smtpSender = &testMailer{}
+	setTestMailer(s, &testMailer{})
 	for i := 0; i < 16; i++ {
 		response := request(t, s, "PUT", "/mytopic", fmt.Sprintf("message %d", i), map[string]string{
 			"E-Mail": "test@example.com",
@@ -1245,7 +2084,7 @@ func TestServer_PublishTooManyEmails_Replenish(t *testing.T) {
 
 func TestServer_PublishDelayedEmail_Fail(t *testing.T) {
 	s := newTestServer(t, newTestConfig(t))
-	s.smtpSender = &testMailer{}
+	setTestMailer(s, &testMailer{})
 	response := request(t, s, "PUT", "/mytopic", "fail", map[string]string{
 		"E-Mail": "test@example.com",
 		"Delay":  "20 min",
@@ -1289,28 +2128,28 @@ func TestServer_PublishAndExpungeTopicAfter16Hours(t *testing.T) {
 	require.Equal(t, 200, response.Code)
 	waitFor(t, func() bool {
 		// .lastAccess set in t.Publish() -> t.Keepalive() in Goroutine
-		s.topics["mytopic"].mu.RLock()
-		defer s.topics["mytopic"].mu.RUnlock()
-		return s.topics["mytopic"].lastAccess.Unix() >= time.Now().Unix()-2 &&
-			s.topics["mytopic"].lastAccess.Unix() <= time.Now().Unix()+2
+		topicByID(s, "mytopic").mu.RLock()
+		defer topicByID(s, "mytopic").mu.RUnlock()
+		return topicByID(s, "mytopic").lastAccess.Unix() >= time.Now().Unix()-2 &&
+			topicByID(s, "mytopic").lastAccess.Unix() <= time.Now().Unix()+2
 	})
 
 	// Topic won't get pruned
 	s.execManager()
-	require.NotNil(t, s.topics["mytopic"])
+	require.NotNil(t, topicByID(s, "mytopic"))
 
 	// Fudge with last access, but subscribe, and see that it won't get pruned (because of subscriber)
-	subID := s.topics["mytopic"].Subscribe(subFn, "", func() {})
-	s.topics["mytopic"].mu.Lock()
-	s.topics["mytopic"].lastAccess = time.Now().Add(-17 * time.Hour)
-	s.topics["mytopic"].mu.Unlock()
+	subID := topicByID(s, "mytopic").Subscribe(subFn, "", func() {})
+	topicByID(s, "mytopic").mu.Lock()
+	topicByID(s, "mytopic").lastAccess = time.Now().Add(-17 * time.Hour)
+	topicByID(s, "mytopic").mu.Unlock()
 	s.execManager()
-	require.NotNil(t, s.topics["mytopic"])
+	require.NotNil(t, topicByID(s, "mytopic"))
 
 	// It'll finally get pruned now that there are no subscribers and last access is 17 hours ago
-	s.topics["mytopic"].Unsubscribe(subID)
+	topicByID(s, "mytopic").Unsubscribe(subID)
 	s.execManager()
-	require.Nil(t, s.topics["mytopic"])
+	require.Nil(t, topicByID(s, "mytopic"))
 }
 
 func TestServer_TopicKeepaliveOnPoll(t *testing.T) {
@@ -1322,13 +2161,13 @@ func TestServer_TopicKeepaliveOnPoll(t *testing.T) {
 	require.Equal(t, 200, response.Code)
 
 	// Mess with last access time
-	s.topics["mytopic"].lastAccess = time.Now().Add(-17 * time.Hour)
+	topicByID(s, "mytopic").lastAccess = time.Now().Add(-17 * time.Hour)
 
 	// Poll again and check keepalive time
 	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
 	require.Equal(t, 200, response.Code)
-	require.True(t, s.topics["mytopic"].lastAccess.Unix() >= time.Now().Unix()-2)
-	require.True(t, s.topics["mytopic"].lastAccess.Unix() <= time.Now().Unix()+2)
+	require.True(t, topicByID(s, "mytopic").lastAccess.Unix() >= time.Now().Unix()-2)
+	require.True(t, topicByID(s, "mytopic").lastAccess.Unix() <= time.Now().Unix()+2)
 }
 
 func TestServer_UnifiedPushDiscovery(t *testing.T) {
@@ -1408,6 +2247,60 @@ func TestServer_PublishUnifiedPushText(t *testing.T) {
 	require.Equal(t, "this is a unifiedpush text message", m.Message)
 }
 
+func TestServer_PublishUnifiedPush_TTLAndUrgency(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	response := request(t, s, "PUT", "/upAAAAAAAAAAAA?up=1", "cached", map[string]string{
+		"TTL":     "60",
+		"Urgency": "high",
+	})
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+	require.Equal(t, 4, m.Priority)
+	require.InDelta(t, time.Now().Add(time.Minute).Unix(), m.Expires, 2)
+
+	response = request(t, s, "PUT", "/upAAAAAAAAAAAA?up=1", "not cached", map[string]string{
+		"TTL":     "0",
+		"Urgency": "very-low",
+	})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, 1, toMessage(t, response.Body.String()).Priority)
+
+	response = request(t, s, "PUT", "/upAAAAAAAAAAAA?up=1", "invalid headers are ignored", map[string]string{
+		"TTL":     "soon",
+		"Urgency": "asap",
+	})
+	require.Equal(t, 200, response.Code)
+
+	response = request(t, s, "GET", "/upAAAAAAAAAAAA/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 2, len(messages))
+	require.Equal(t, "cached", messages[0].Message)
+	require.Equal(t, "invalid headers are ignored", messages[1].Message)
+	require.Equal(t, 0, messages[1].Priority)
+}
+
+func TestServer_PublishUnifiedPush_EndpointLimit(t *testing.T) {
+	c := newTestConfig(t)
+	c.UnifiedPushEndpointLimitBurst = 2
+	c.UnifiedPushEndpointLimitReplenish = time.Hour
+	s := newTestServer(t, c)
+
+	for i := 0; i < 2; i++ {
+		response := request(t, s, "PUT", "/upAAAAAAAAAAAA?up=1", "hi", nil)
+		require.Equal(t, 200, response.Code)
+	}
+	response := request(t, s, "PUT", "/upAAAAAAAAAAAA?up=1", "hi", nil)
+	require.Equal(t, 429, response.Code)
+	require.Equal(t, 42911, toHTTPError(t, response.Body.String()).Code)
+
+	// Other endpoints and regular publishes are not affected
+	response = request(t, s, "PUT", "/upBBBBBBBBBBBB?up=1", "hi", nil)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/upAAAAAAAAAAAA", "hi", nil)
+	require.Equal(t, 200, response.Code)
+}
+
 func TestServer_MatrixGateway_Discovery_Success(t *testing.T) {
 	s := newTestServer(t, newTestConfig(t))
 	response := request(t, s, "GET", "/_matrix/push/v1/notify", "", nil)
@@ -1442,6 +2335,22 @@ func TestServer_MatrixGateway_Push_Success(t *testing.T) {
 	require.Equal(t, notification, m.Message)
 }
 
+func TestServer_MatrixGateway_Push_Content(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	notification := `{"notification":{"event_id":"$3957tyerfgewrf384","type":"m.call.invite","prio":"high","room_name":"Mission Control","devices":[{"pushkey":"http://127.0.0.1:12345/mytopic"}]}}`
+	response := request(t, s, "POST", "/_matrix/push/v1/notify", notification, nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, `{"rejected":[]}`+"\n", response.Body.String())
+
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+	require.Equal(t, "Mission Control", m.Title)
+	require.Equal(t, "Incoming call", m.Message)
+	require.Equal(t, 5, m.Priority)
+}
+
 func TestServer_MatrixGateway_Push_Failure_NoSubscriber(t *testing.T) {
 	c := newTestConfig(t)
 	c.VisitorSubscriberRateLimiting = true
@@ -1462,10 +2371,10 @@ func TestServer_MatrixGateway_Push_Failure_NoSubscriber_After13Hours(t *testing.
 	response := request(t, s, "POST", "/_matrix/push/v1/notify", notification, nil)
 	require.Equal(t, 507, response.Code)
 	require.Equal(t, 50701, toHTTPError(t, response.Body.String()).Code)
-	require.Nil(t, s.topics["mytopic"].rateVisitor)
+	require.Nil(t, topicByID(s, "mytopic").rateVisitor)
 
 	// Fake: This topic has been around for 13 hours without a rate visitor
-	s.topics["mytopic"].lastAccess = time.Now().Add(-13 * time.Hour)
+	topicByID(s, "mytopic").lastAccess = time.Now().Add(-13 * time.Hour)
 
 	// Same request should now return HTTP 200 with a rejected pushkey
 	response = request(t, s, "POST", "/_matrix/push/v1/notify", notification, nil)
@@ -1473,9 +2382,9 @@ func TestServer_MatrixGateway_Push_Failure_NoSubscriber_After13Hours(t *testing.
 	require.Equal(t, `{"rejected":["http://127.0.0.1:12345/mytopic?up=1"]}`, strings.TrimSpace(response.Body.String()))
 
 	// Slightly unrelated: Test that topic is pruned after 16 hours
-	s.topics["mytopic"].lastAccess = time.Now().Add(-17 * time.Hour)
+	topicByID(s, "mytopic").lastAccess = time.Now().Add(-17 * time.Hour)
 	s.execManager()
-	require.Nil(t, s.topics["mytopic"])
+	require.Nil(t, topicByID(s, "mytopic"))
 }
 
 func TestServer_MatrixGateway_Push_Failure_InvalidPushkey(t *testing.T) {
@@ -1622,7 +2531,7 @@ func TestServer_PublishAsJSON_WithEmail(t *testing.T) {
 	t.Parallel()
 	mailer := &testMailer{}
 	s := newTestServer(t, newTestConfig(t))
-	s.smtpSender = mailer
+	setTestMailer(s, mailer)
 	body := `{"topic":"mytopic","message":"A message","email":"phil@example.com"}`
 	response := request(t, s, "PUT", "/", body, nil)
 	require.Equal(t, 200, response.Code)
@@ -1669,6 +2578,46 @@ func TestServer_PublishAsJSON_WithActions(t *testing.T) {
 	require.Equal(t, "target_temp_f=65", m.Actions[1].Body)
 }
 
+func TestServer_PublishAsJSON_WithEmbeds(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	body := `{
+		"topic":"alerts",
+		"message":"CPU usage is critical",
+		"embeds": [
+			{
+				"title": "HighCPU",
+				"color": "#e53935",
+				"fields": [
+					{"name": "Host", "value": "db1", "inline": true},
+					{"name": "CPU", "value": "97%", "inline": true}
+				]
+			}
+		]
+	}`
+	response := request(t, s, "POST", "/", body, nil)
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+	require.Equal(t, 1, len(m.Embeds))
+	require.Equal(t, "HighCPU", m.Embeds[0].Title)
+	require.Equal(t, "#e53935", m.Embeds[0].Color)
+	require.Equal(t, 2, len(m.Embeds[0].Fields))
+
+	// Embeds are cached
+	response = request(t, s, "GET", "/alerts/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "HighCPU", messages[0].Embeds[0].Title)
+	require.Equal(t, "97%", messages[0].Embeds[0].Fields[1].Value)
+	require.True(t, messages[0].Embeds[0].Fields[1].Inline)
+
+	// Invalid embeds via header
+	response = request(t, s, "POST", "/alerts", "test", map[string]string{
+		"Embeds": `[{"title":"HighCPU","color":"red"}]`,
+	})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40090, toHTTPError(t, response.Body.String()).Code)
+}
+
 func TestServer_PublishAsJSON_Invalid(t *testing.T) {
 	s := newTestServer(t, newTestConfig(t))
 	body := `{"topic":"mytopic",INVALID`
@@ -1709,39 +2658,283 @@ func TestServer_PublishWithTierBasedMessageLimitAndExpiry(t *testing.T) {
 		"Authorization": util.BasicAuth("phil", "phil"),
 	})
 	require.Equal(t, 200, response.Code)
-	require.Empty(t, response.Body)
+	require.Empty(t, response.Body)
+}
+
+func TestServer_PublishAttachment(t *testing.T) {
+	content := "text file!" + util.RandomString(4990) // > 4096
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "PUT", "/mytopic", content, nil)
+	msg := toMessage(t, response.Body.String())
+	require.Equal(t, "attachment.txt", msg.Attachment.Name)
+	require.Equal(t, "text/plain; charset=utf-8", msg.Attachment.Type)
+	require.Equal(t, int64(5000), msg.Attachment.Size)
+	require.GreaterOrEqual(t, msg.Attachment.Expires, time.Now().Add(179*time.Minute).Unix()) // Almost 3 hours
+	require.Contains(t, msg.Attachment.URL, "http://127.0.0.1:12345/file/")
+	require.Equal(t, netip.Addr{}, msg.Sender) // Should never be returned
+	require.FileExists(t, filepath.Join(s.config().AttachmentCacheDir, msg.ID))
+
+	// GET
+	path := strings.TrimPrefix(msg.Attachment.URL, "http://127.0.0.1:12345")
+	response = request(t, s, "GET", path, "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "5000", response.Header().Get("Content-Length"))
+	require.Equal(t, content, response.Body.String())
+
+	// HEAD
+	response = request(t, s, "HEAD", path, "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "5000", response.Header().Get("Content-Length"))
+	require.Equal(t, "", response.Body.String())
+
+	// Slightly unrelated cross-test: make sure we add an owner for internal attachments
+	size, err := s.messageCache.AttachmentBytesUsedBySender("9.9.9.9") // See request()
+	require.Nil(t, err)
+	require.Equal(t, int64(5000), size)
+}
+
+func TestServer_PublishAttachment_Range_ETag(t *testing.T) {
+	content := "text file!" + util.RandomString(4990) // > 4096
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "PUT", "/mytopic", content, nil)
+	msg := toMessage(t, response.Body.String())
+	path := strings.TrimPrefix(msg.Attachment.URL, "http://127.0.0.1:12345")
+
+	// Full download returns ETag, and supports ranges
+	response = request(t, s, "GET", path, "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "bytes", response.Header().Get("Accept-Ranges"))
+	require.Equal(t, "text/plain; charset=utf-8", response.Header().Get("Content-Type"))
+	etag := response.Header().Get("ETag")
+	require.NotEmpty(t, etag)
+
+	// Resume download
+	response = request(t, s, "GET", path, "", map[string]string{
+		"Range": "bytes=4000-",
+	})
+	require.Equal(t, 206, response.Code)
+	require.Equal(t, "bytes 4000-4999/5000", response.Header().Get("Content-Range"))
+	require.Equal(t, "1000", response.Header().Get("Content-Length"))
+	require.Equal(t, content[4000:], response.Body.String())
+
+	// Range only if the file has not changed
+	response = request(t, s, "GET", path, "", map[string]string{
+		"Range":    "bytes=0-9",
+		"If-Range": `"something-else"`,
+	})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, content, response.Body.String())
+
+	response = request(t, s, "GET", path, "", map[string]string{
+		"Range": "bytes=6000-",
+	})
+	require.Equal(t, 416, response.Code)
+
+	// Cached copy is still valid
+	response = request(t, s, "GET", path, "", map[string]string{
+		"If-None-Match": etag,
+	})
+	require.Equal(t, 304, response.Code)
+	require.Equal(t, "", response.Body.String())
+}
+
+func TestServer_RequestedRangeLength(t *testing.T) {
+	require.Equal(t, int64(5000), requestedRangeLength("", 5000))
+	require.Equal(t, int64(1000), requestedRangeLength("bytes=4000-", 5000))
+	require.Equal(t, int64(100), requestedRangeLength("bytes=100-199", 5000))
+	require.Equal(t, int64(4900), requestedRangeLength("bytes=100-9999", 5000))
+	require.Equal(t, int64(300), requestedRangeLength("bytes=-300", 5000))
+	require.Equal(t, int64(5000), requestedRangeLength("bytes=0-9,20-29", 5000))
+	require.Equal(t, int64(5000), requestedRangeLength("bytes=6000-", 5000))
+	require.Equal(t, int64(5000), requestedRangeLength("items=0-9", 5000))
+}
+
+func TestServer_PublishAttachmentThumbnail(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "PUT", "/mytopic?f=photo.png", string(newTestPNG(t, 800, 600)), nil)
+	msg := toMessage(t, response.Body.String())
+	require.Equal(t, "image/png", msg.Attachment.Type)
+	path := strings.TrimPrefix(msg.Attachment.URL, "http://127.0.0.1:12345")
+
+	// Default thumbnail width
+	response = request(t, s, "GET", path+"?thumb=1", "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "image/png", response.Header().Get("Content-Type"))
+	require.Equal(t, "", response.Header().Get("Content-Disposition"))
+	require.Equal(t, fmt.Sprintf("%d", response.Body.Len()), response.Header().Get("Content-Length"))
+	config, err := png.DecodeConfig(response.Body)
+	require.Nil(t, err)
+	require.Equal(t, 320, config.Width)
+	require.Equal(t, 240, config.Height)
+	require.FileExists(t, filepath.Join(s.config().AttachmentCacheDir, msg.ID+"_320"))
+
+	// Custom width, rounded up
+	response = request(t, s, "GET", path+"?width=100", "", nil)
+	require.Equal(t, 200, response.Code)
+	config, err = png.DecodeConfig(response.Body)
+	require.Nil(t, err)
+	require.Equal(t, 128, config.Width)
+	require.Equal(t, 96, config.Height)
+
+	// HEAD
+	response = request(t, s, "HEAD", path, "", map[string]string{"X-Width": "100"})
+	require.Equal(t, 200, response.Code)
+	stat, err := os.Stat(filepath.Join(s.config().AttachmentCacheDir, msg.ID+"_128"))
+	require.Nil(t, err)
+	require.Equal(t, fmt.Sprintf("%d", stat.Size()), response.Header().Get("Content-Length"))
+
+	// Invalid width
+	response = request(t, s, "GET", path+"?width=abc", "", nil)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40054, toHTTPError(t, response.Body.String()).Code)
+
+	// Not an image
+	response = request(t, s, "PUT", "/mytopic?f=file.txt", "this is not an image", nil)
+	msg = toMessage(t, response.Body.String())
+	response = request(t, s, "GET", strings.TrimPrefix(msg.Attachment.URL, "http://127.0.0.1:12345")+"?thumb=1", "", nil)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40053, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_PublishAttachmentThumbnail_BandwidthLimit(t *testing.T) {
+	image := newTestPNG(t, 800, 600)
+	c := newTestConfig(t)
+	c.VisitorAttachmentDailyBandwidthLimit = int64(2*len(image) + 100) // Upload and one thumbnail
+	s := newTestServer(t, c)
+	response := request(t, s, "PUT", "/mytopic?f=photo.png", string(image), nil)
+	msg := toMessage(t, response.Body.String())
+	path := strings.TrimPrefix(msg.Attachment.URL, "http://127.0.0.1:12345")
+
+	// Generating a thumbnail counts with the size of the original image
+	response = request(t, s, "GET", path+"?width=100", "", nil)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "GET", path+"?width=200", "", nil)
+	require.Equal(t, 429, response.Code)
+	require.Equal(t, 42905, toHTTPError(t, response.Body.String()).Code)
+	require.NoFileExists(t, filepath.Join(s.config().AttachmentCacheDir, msg.ID+"_256"))
 }
 
-func TestServer_PublishAttachment(t *testing.T) {
-	content := "text file!" + util.RandomString(4990) // > 4096
+func TestServer_PublishAttachment_MessageNotFound(t *testing.T) {
 	s := newTestServer(t, newTestConfig(t))
-	response := request(t, s, "PUT", "/mytopic", content, nil)
+	response := request(t, s, "PUT", "/mytopic?f=photo.png", string(newTestPNG(t, 800, 600)), nil)
 	msg := toMessage(t, response.Body.String())
-	require.Equal(t, "attachment.txt", msg.Attachment.Name)
-	require.Equal(t, "text/plain; charset=utf-8", msg.Attachment.Type)
-	require.Equal(t, int64(5000), msg.Attachment.Size)
-	require.GreaterOrEqual(t, msg.Attachment.Expires, time.Now().Add(179*time.Minute).Unix()) // Almost 3 hours
-	require.Contains(t, msg.Attachment.URL, "http://127.0.0.1:12345/file/")
-	require.Equal(t, netip.Addr{}, msg.Sender) // Should never be returned
-	require.FileExists(t, filepath.Join(s.config.AttachmentCacheDir, msg.ID))
-
-	// GET
 	path := strings.TrimPrefix(msg.Attachment.URL, "http://127.0.0.1:12345")
 	response = request(t, s, "GET", path, "", nil)
 	require.Equal(t, 200, response.Code)
-	require.Equal(t, "5000", response.Header().Get("Content-Length"))
+	etag := response.Header().Get("ETag")
+
+	// Files without a message are not served, not even thumbnails or cache validations
+	require.Nil(t, s.messageCache.DeleteMessages(msg.ID))
+	require.Equal(t, 404, request(t, s, "GET", path+"?thumb=1", "", nil).Code)
+	require.Equal(t, 404, request(t, s, "GET", path, "", map[string]string{"If-None-Match": etag}).Code)
+	require.Equal(t, 404, request(t, s, "HEAD", path, "", nil).Code)
+	require.NoFileExists(t, filepath.Join(s.config().AttachmentCacheDir, msg.ID+"_320"))
+}
+
+func TestServer_PublishAttachmentResumableUpload(t *testing.T) {
+	c := newTestConfig(t)
+	c.BehindProxy = true
+	s := newTestServer(t, c)
+	content := util.RandomString(10000)
+
+	// Start upload
+	response := request(t, s, "POST", "/v1/attachments", "", map[string]string{
+		"Upload-Length": "10000",
+		"Filename":      "video.mp4",
+	})
+	require.Equal(t, 200, response.Code)
+	upload, _ := util.UnmarshalJSON[apiAttachmentUploadResponse](io.NopCloser(response.Body))
+	require.Equal(t, int64(10000), upload.Length)
+	require.Equal(t, int64(0), upload.Offset)
+	require.Equal(t, "/v1/attachments/"+upload.ID, response.Header().Get("Location"))
+	path := "/v1/attachments/" + upload.ID
+
+	// Upload first chunk, then retry the same chunk
+	response = request(t, s, "PATCH", path, content[:4000], map[string]string{"Upload-Offset": "0"})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "4000", response.Header().Get("Upload-Offset"))
+	response = request(t, s, "PATCH", path, content[:4000], map[string]string{"Upload-Offset": "0"})
+	require.Equal(t, 409, response.Code)
+	require.Equal(t, 40905, toHTTPError(t, response.Body.String()).Code)
+
+	// Publishing an incomplete upload fails
+	response = request(t, s, "PUT", "/mytopic", "", map[string]string{"Upload": upload.ID})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40057, toHTTPError(t, response.Body.String()).Code)
+
+	// Chunk larger than the announced length is rejected, and the upload can be resumed
+	response = request(t, s, "PATCH", path, content[4000:]+"x", map[string]string{"Upload-Offset": "4000"})
+	require.Equal(t, 413, response.Code)
+	response = request(t, s, "HEAD", path, "", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "4000", response.Header().Get("Upload-Offset"))
+	require.Equal(t, "10000", response.Header().Get("Upload-Length"))
+	response = request(t, s, "PATCH", path, content[4000:], map[string]string{"Upload-Offset": "4000"})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "10000", response.Header().Get("Upload-Offset"))
+
+	// Other visitors cannot see or use the upload
+	response = request(t, s, "HEAD", path, "", map[string]string{"X-Forwarded-For": "1.2.3.4"})
+	require.Equal(t, 404, response.Code)
+	response = request(t, s, "PUT", "/mytopic", "", map[string]string{"Upload": upload.ID, "X-Forwarded-For": "1.2.3.4"})
+	require.Equal(t, 404, response.Code)
+	require.Equal(t, 40402, toHTTPError(t, response.Body.String()).Code)
+
+	// Publish
+	response = request(t, s, "PUT", "/mytopic", "Here's the video", map[string]string{"Upload": upload.ID})
+	require.Equal(t, 200, response.Code)
+	msg := toMessage(t, response.Body.String())
+	require.Equal(t, "Here's the video", msg.Message)
+	require.Equal(t, "video.mp4", msg.Attachment.Name)
+	require.Equal(t, int64(10000), msg.Attachment.Size)
+	require.FileExists(t, filepath.Join(s.config().AttachmentCacheDir, msg.ID))
+	require.NoFileExists(t, filepath.Join(s.config().AttachmentCacheDir, upload.ID+uploadFileSuffix))
+
+	response = request(t, s, "GET", strings.TrimPrefix(msg.Attachment.URL, "http://127.0.0.1:12345"), "", nil)
+	require.Equal(t, 200, response.Code)
 	require.Equal(t, content, response.Body.String())
 
-	// HEAD
+	// Upload is gone
 	response = request(t, s, "HEAD", path, "", nil)
+	require.Equal(t, 404, response.Code)
+}
+
+func TestServer_PublishAttachmentResumableUploadLimits(t *testing.T) {
+	c := newTestConfig(t)
+	c.AttachmentFileSizeLimit = 5000
+	c.VisitorAttachmentTotalSizeLimit = 8000
+	s := newTestServer(t, c)
+
+	// Invalid or too large length
+	response := request(t, s, "POST", "/v1/attachments", "", nil)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40055, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "POST", "/v1/attachments", "", map[string]string{"Upload-Length": "5001"})
+	require.Equal(t, 413, response.Code)
+
+	// In-progress uploads count towards the visitor's total attachment size
+	response = request(t, s, "POST", "/v1/attachments", "", map[string]string{"Upload-Length": "5000"})
 	require.Equal(t, 200, response.Code)
-	require.Equal(t, "5000", response.Header().Get("Content-Length"))
-	require.Equal(t, "", response.Body.String())
+	upload, _ := util.UnmarshalJSON[apiAttachmentUploadResponse](io.NopCloser(response.Body))
+	response = request(t, s, "POST", "/v1/attachments", "", map[string]string{"Upload-Length": "5000"})
+	require.Equal(t, 413, response.Code)
 
-	// Slightly unrelated cross-test: make sure we add an owner for internal attachments
-	size, err := s.messageCache.AttachmentBytesUsedBySender("9.9.9.9") // See request()
-	require.Nil(t, err)
-	require.Equal(t, int64(5000), size)
+	// Cancel upload
+	response = request(t, s, "DELETE", "/v1/attachments/"+upload.ID, "", nil)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "POST", "/v1/attachments", "", map[string]string{"Upload-Length": "5000"})
+	require.Equal(t, 200, response.Code)
+	upload, _ = util.UnmarshalJSON[apiAttachmentUploadResponse](io.NopCloser(response.Body))
+
+	// Expired uploads are pruned
+	require.FileExists(t, filepath.Join(s.config().AttachmentCacheDir, upload.ID+uploadFileSuffix))
+	s.mu.Lock()
+	s.uploads[upload.ID].Expires = time.Now().Add(-time.Minute)
+	s.mu.Unlock()
+	s.execManager()
+	require.NoFileExists(t, filepath.Join(s.config().AttachmentCacheDir, upload.ID+uploadFileSuffix))
+	response = request(t, s, "HEAD", "/v1/attachments/"+upload.ID, "", nil)
+	require.Equal(t, 404, response.Code)
 }
 
 func TestServer_PublishAttachmentShortWithFilename(t *testing.T) {
@@ -1759,7 +2952,7 @@ func TestServer_PublishAttachmentShortWithFilename(t *testing.T) {
 	require.GreaterOrEqual(t, msg.Attachment.Expires, time.Now().Add(3*time.Hour).Unix())
 	require.Contains(t, msg.Attachment.URL, "http://127.0.0.1:12345/file/")
 	require.Equal(t, netip.Addr{}, msg.Sender) // Should never be returned
-	require.FileExists(t, filepath.Join(s.config.AttachmentCacheDir, msg.ID))
+	require.FileExists(t, filepath.Join(s.config().AttachmentCacheDir, msg.ID))
 
 	path := strings.TrimPrefix(msg.Attachment.URL, "http://127.0.0.1:12345")
 	response = request(t, s, "GET", path, "", nil)
@@ -1773,6 +2966,41 @@ func TestServer_PublishAttachmentShortWithFilename(t *testing.T) {
 	require.Equal(t, int64(21), size)
 }
 
+func TestServer_PublishAttachmentWithAltAndSummary(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "PUT", "/mytopic", "fake image", map[string]string{
+		"Filename":  "camera.jpg",
+		"X-Alt":     "A person in a red jacket standing at the front door",
+		"X-Summary": "The front door camera saw a person",
+	})
+	require.Equal(t, 200, response.Code)
+	msg := toMessage(t, response.Body.String())
+	require.Equal(t, "The front door camera saw a person", msg.Summary)
+	require.Equal(t, "A person in a red jacket standing at the front door", msg.Attachment.Alt)
+
+	response = request(t, s, "PUT", "/", `{"topic":"mytopic","message":"Motion detected","summary":"Motion in the garden",`+
+		`"attach":"https://example.com/garden.jpg","alt":"An empty garden at night"}`, nil)
+	require.Equal(t, 200, response.Code)
+	msg = toMessage(t, response.Body.String())
+	require.Equal(t, "Motion in the garden", msg.Summary)
+	require.Equal(t, "An empty garden at night", msg.Attachment.Alt)
+
+	// Alt text without an attachment is ignored
+	response = request(t, s, "PUT", "/mytopic?alt=something", "no attachment", nil)
+	msg = toMessage(t, response.Body.String())
+	require.Nil(t, msg.Attachment)
+
+	// Both fields are stored in the cache
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 3, len(messages))
+	require.Equal(t, "The front door camera saw a person", messages[0].Summary)
+	require.Equal(t, "A person in a red jacket standing at the front door", messages[0].Attachment.Alt)
+	require.Equal(t, "Motion in the garden", messages[1].Summary)
+	require.Equal(t, "An empty garden at night", messages[1].Attachment.Alt)
+	require.Equal(t, "", messages[2].Summary)
+}
+
 func TestServer_PublishAttachmentExternalWithoutFilename(t *testing.T) {
 	s := newTestServer(t, newTestConfig(t))
 	response := request(t, s, "PUT", "/mytopic", "", map[string]string{
@@ -1818,6 +3046,94 @@ func TestServer_PublishAttachmentBadURL(t *testing.T) {
 	require.Equal(t, 40013, err.Code)
 }
 
+func TestServer_PublishURLSchemes(t *testing.T) {
+	c := newTestConfig(t)
+	c.ClickURLSchemes = []string{"https", "mailto", "geo"}
+	c.AttachmentURLSchemes = []string{"https"}
+	s := newTestServer(t, c)
+
+	// Allowed schemes
+	response := request(t, s, "PUT", "/mytopic", "hi", map[string]string{
+		"Click":  "mailto:phil@example.com",
+		"Attach": "https://example.com/file.jpg",
+		"Icon":   "http://example.com/icon.png", // Default: http and https
+	})
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "mailto:phil@example.com", toMessage(t, response.Body.String()).Click)
+	require.Equal(t, 200, request(t, s, "PUT", "/mytopic", "hi", map[string]string{"Click": "geo:37.786971,-122.399677"}).Code)
+
+	// Denied schemes
+	response = request(t, s, "PUT", "/mytopic", "hi", map[string]string{"Click": "intent://scan/#Intent;scheme=zxing;end"})
+	require.Equal(t, 40092, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "PUT", "/mytopic", "hi", map[string]string{"Attach": "http://example.com/file.jpg"})
+	require.Equal(t, 40013, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "PUT", "/mytopic", "hi", map[string]string{"Icon": "ftp://example.com/icon.png"})
+	require.Equal(t, 40021, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_PublishAttachmentDeniedType(t *testing.T) {
+	c := newTestConfig(t)
+	c.AttachmentDeniedTypes = []string{"application/x-*"}
+	c.AttachmentDeniedExtensions = []string{"exe", ".BAT"}
+	s := newTestServer(t, c)
+
+	// Denied by filename extension
+	response := request(t, s, "PUT", "/mytopic?f=setup.exe", "this is an ATTACHMENT", nil)
+	require.Equal(t, 40050, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "PUT", "/mytopic?f=run.bat", "this is an ATTACHMENT", nil)
+	require.Equal(t, 40050, toHTTPError(t, response.Body.String()).Code)
+
+	// Denied by detected MIME type
+	response = request(t, s, "PUT", "/mytopic", "\x7fELF\x02\x01\x01\x00"+strings.Repeat("x", 5000), nil)
+	require.Equal(t, 40050, toHTTPError(t, response.Body.String()).Code)
+
+	// Allowed
+	response = request(t, s, "PUT", "/mytopic?f=notes.txt", "this is an ATTACHMENT", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "notes.txt", toMessage(t, response.Body.String()).Attachment.Name)
+}
+
+func TestServer_PublishAttachmentDeniedTopic(t *testing.T) {
+	c := newTestConfig(t)
+	c.AttachmentAllowedTopics = []string{"files-*"}
+	c.AttachmentDeniedTopics = []string{"files-secret"}
+	s := newTestServer(t, c)
+
+	response := request(t, s, "PUT", "/mytopic?f=notes.txt", "this is an ATTACHMENT", nil)
+	require.Equal(t, 40051, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "PUT", "/mytopic?attach=https://example.com/file.jpg", "", nil)
+	require.Equal(t, 40051, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "PUT", "/files-secret?f=notes.txt", "this is an ATTACHMENT", nil)
+	require.Equal(t, 40051, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "PUT", "/files-public?f=notes.txt", "this is an ATTACHMENT", nil)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "PUT", "/files-public?attach=https://example.com/file.jpg", "", nil)
+	require.Equal(t, 200, response.Code)
+
+	// Messages without attachments are not affected
+	response = request(t, s, "PUT", "/mytopic", "just a message", nil)
+	require.Equal(t, 200, response.Code)
+}
+
+func TestServer_PublishAttachmentVirusScan(t *testing.T) {
+	c := newTestConfig(t)
+	c.AttachmentClamdAddress = newTestClamdServer(t)
+	s := newTestServer(t, c)
+
+	response := request(t, s, "PUT", "/mytopic?f=virus.txt", strings.Repeat("x", 5000)+testEicarMarker, nil)
+	require.Equal(t, 40052, toHTTPError(t, response.Body.String()).Code)
+	files, err := os.ReadDir(c.AttachmentCacheDir)
+	require.Nil(t, err)
+	require.Empty(t, files)
+	require.Equal(t, int64(0), s.fileCache.Size())
+
+	response = request(t, s, "PUT", "/mytopic?f=clean.txt", strings.Repeat("x", 5000), nil)
+	require.Equal(t, 200, response.Code)
+	msg := toMessage(t, response.Body.String())
+	require.FileExists(t, filepath.Join(c.AttachmentCacheDir, msg.ID))
+}
+
 func TestServer_PublishAttachmentTooLargeContentLength(t *testing.T) {
 	content := util.RandomString(5000) // > 4096
 	s := newTestServer(t, newTestConfig(t))
@@ -1886,7 +3202,7 @@ func TestServer_PublishAttachmentAndExpire(t *testing.T) {
 	response := request(t, s, "PUT", "/mytopic", content, nil)
 	msg := toMessage(t, response.Body.String())
 	require.Contains(t, msg.Attachment.URL, "http://127.0.0.1:12345/file/")
-	file := filepath.Join(s.config.AttachmentCacheDir, msg.ID)
+	file := filepath.Join(s.config().AttachmentCacheDir, msg.ID)
 	require.FileExists(t, file)
 
 	path := strings.TrimPrefix(msg.Attachment.URL, "http://127.0.0.1:12345")
@@ -1934,7 +3250,7 @@ func TestServer_PublishAttachmentWithTierBasedExpiry(t *testing.T) {
 	require.Contains(t, msg.Attachment.URL, "http://127.0.0.1:12345/file/")
 	require.True(t, msg.Attachment.Expires > time.Now().Add(sevenDays-30*time.Second).Unix())
 	require.True(t, msg.Expires > time.Now().Add(sevenDays-30*time.Second).Unix())
-	file := filepath.Join(s.config.AttachmentCacheDir, msg.ID)
+	file := filepath.Join(s.config().AttachmentCacheDir, msg.ID)
 	require.FileExists(t, file)
 
 	path := strings.TrimPrefix(msg.Attachment.URL, "http://127.0.0.1:12345")
@@ -2012,7 +3328,7 @@ func TestServer_PublishAttachmentWithTierBasedLimits(t *testing.T) {
 	response := request(t, s, "PUT", "/mytopic", smallFile, nil)
 	msg := toMessage(t, response.Body.String())
 	require.Contains(t, msg.Attachment.URL, "http://127.0.0.1:12345/file/")
-	require.FileExists(t, filepath.Join(s.config.AttachmentCacheDir, msg.ID))
+	require.FileExists(t, filepath.Join(s.config().AttachmentCacheDir, msg.ID))
 
 	// Publish large file as anonymous
 	response = request(t, s, "PUT", "/mytopic", largeFile, nil)
@@ -2034,7 +3350,7 @@ func TestServer_PublishAttachmentWithTierBasedLimits(t *testing.T) {
 		require.Equal(t, 200, response.Code)
 		msg = toMessage(t, response.Body.String())
 		require.Contains(t, msg.Attachment.URL, "http://127.0.0.1:12345/file/")
-		require.FileExists(t, filepath.Join(s.config.AttachmentCacheDir, msg.ID))
+		require.FileExists(t, filepath.Join(s.config().AttachmentCacheDir, msg.ID))
 	}
 	response = request(t, s, "PUT", "/mytopic", largeFile, map[string]string{
 		"Authorization": util.BasicAuth("phil", "phil"),
@@ -2252,6 +3568,287 @@ func TestServer_AnonymousUser_And_NonTierUser_Are_Same_Visitor(t *testing.T) {
 	require.Equal(t, int64(2), account.Stats.Messages)
 }
 
+func TestServer_Subscribe_TierSubscriptionLimit(t *testing.T) {
+	conf := newTestConfigWithAuthFile(t)
+	conf.AuthDefault = user.PermissionReadWrite
+	conf.VisitorSubscriptionLimit = 1
+	s := newTestServer(t, conf)
+
+	require.Nil(t, s.userManager.AddTier(&user.Tier{
+		Code:              "pro",
+		MessageLimit:      100,
+		SubscriptionLimit: 2,
+	}))
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.ChangeTier("phil", "pro"))
+
+	// Anonymous visitor uses server default
+	cancel := subscribe(t, s, "/mytopic/json", httptest.NewRecorder(), func(r *http.Request) {
+		r.RemoteAddr = "9.9.9.9" // Same as request()
+	})
+	defer cancel()
+	response := request(t, s, "GET", "/mytopic/json", "", nil)
+	require.Equal(t, 429, response.Code)
+	require.Equal(t, 42903, toHTTPError(t, response.Body.String()).Code)
+
+	// Tier user can open two connections
+	headers := map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	}
+	for i := 0; i < 2; i++ {
+		cancel := subscribe(t, s, "/mytopic/json", httptest.NewRecorder(), func(r *http.Request) {
+			r.Header.Set("Authorization", headers["Authorization"])
+		})
+		defer cancel()
+	}
+	response = request(t, s, "GET", "/mytopic/sse", "", headers)
+	require.Equal(t, 429, response.Code)
+	require.Equal(t, 42903, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "GET", "/v1/account", "", headers)
+	account, _ := util.UnmarshalJSON[apiAccountResponse](io.NopCloser(response.Body))
+	require.Equal(t, int64(2), account.Limits.Subscriptions)
+}
+
+func TestServer_Subscribe_GlobalSubscriptionLimit(t *testing.T) {
+	c := newTestConfig(t)
+	c.TotalSubscriptionLimit = 2
+	s := newTestServer(t, c)
+
+	// Two subscriptions from different visitors use up the global limit
+	for _, ip := range []string{"1.2.3.4", "5.6.7.8"} {
+		ip := ip
+		cancel := subscribe(t, s, "/mytopic/json", httptest.NewRecorder(), func(r *http.Request) {
+			r.RemoteAddr = ip
+		})
+		defer cancel()
+	}
+	response := request(t, s, "GET", "/v1/health", "", nil)
+	health, _ := util.UnmarshalJSON[apiHealthResponse](io.NopCloser(response.Body))
+	require.Equal(t, int64(2), health.Subscriptions)
+
+	// Third visitor is rejected with Retry-After
+	response = request(t, s, "GET", "/mytopic/sse", "", nil)
+	require.Equal(t, 429, response.Code)
+	require.Equal(t, 42913, toHTTPError(t, response.Body.String()).Code)
+	require.Equal(t, "30", response.Header().Get("Retry-After"))
+
+	// Rejected subscriptions are not counted
+	require.Equal(t, int64(2), s.subscriptions.Load())
+	require.Equal(t, int64(0), s.visitor(netip.MustParseAddr("9.9.9.9"), nil).subscriptionLimiter.Value())
+
+	// Raising the limit via a reload lets new subscriptions through
+	c2 := newTestConfig(t)
+	c2.TotalSubscriptionLimit = 0
+	require.Contains(t, s.Reload(c2), "global-subscription-limit")
+	cancel := subscribe(t, s, "/mytopic/json", httptest.NewRecorder(), func(r *http.Request) {
+		r.RemoteAddr = "9.9.9.9"
+	})
+	require.Equal(t, int64(3), s.subscriptions.Load())
+	cancel()
+	require.Equal(t, int64(2), s.subscriptions.Load())
+}
+
+func TestServer_Subscribe_VisitorSubscriptionLimit_RetryAfter(t *testing.T) {
+	c := newTestConfig(t)
+	c.VisitorSubscriptionLimit = 1
+	s := newTestServer(t, c)
+
+	cancel := subscribe(t, s, "/mytopic/json", httptest.NewRecorder(), func(r *http.Request) {
+		r.RemoteAddr = "9.9.9.9" // Same as request()
+	})
+	defer cancel()
+	response := request(t, s, "GET", "/mytopic/json", "", nil)
+	require.Equal(t, 429, response.Code)
+	require.Equal(t, 42903, toHTTPError(t, response.Body.String()).Code)
+	require.Equal(t, "30", response.Header().Get("Retry-After"))
+	require.Equal(t, int64(1), s.subscriptions.Load())
+}
+
+func TestServer_Subscribe_SubscriptionDurationLimit_HTTP(t *testing.T) {
+	c := newTestConfig(t)
+	c.VisitorSubscriptionDurationLimit = 300 * time.Millisecond
+	c.VisitorSubscriptionLimit = 1
+	s := newTestServer(t, c)
+
+	start := time.Now()
+	response := request(t, s, "GET", "/mytopic/json", "", nil) // Returns after max. duration
+	require.True(t, time.Since(start) >= 300*time.Millisecond)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, openEvent, toMessage(t, response.Body.String()).Event)
+
+	// Subscription was released
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	require.Equal(t, 200, response.Code)
+}
+
+func TestServer_Subscribe_SubscriptionDurationLimit_WebSocket(t *testing.T) {
+	c := newTestConfig(t)
+	c.VisitorSubscriptionDurationLimit = 300 * time.Millisecond
+	s := newTestServer(t, c)
+	server := httptest.NewServer(http.HandlerFunc(s.handle))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial(strings.Replace(server.URL, "http://", "ws://", 1)+"/mytopic/ws", nil)
+	require.Nil(t, err)
+	defer conn.Close()
+
+	_, data, err := conn.ReadMessage()
+	require.Nil(t, err)
+	require.Equal(t, openEvent, toMessage(t, string(data)).Event)
+
+	_, _, err = conn.ReadMessage()
+	require.True(t, websocket.IsCloseError(err, websocket.CloseTryAgainLater))
+	require.Contains(t, err.Error(), "max. subscription duration reached")
+}
+
+func TestServer_Subscribe_CloseStats_Poll(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	request(t, s, "PUT", "/mytopic", "my first message", nil)
+	request(t, s, "PUT", "/mytopic", "my second message", nil)
+
+	response := request(t, s, "GET", "/mytopic/json?poll=1&stats=1", "", nil)
+	lines := strings.SplitAfter(strings.TrimSpace(response.Body.String()), "\n")
+	require.Equal(t, 3, len(lines))
+
+	m := toMessage(t, lines[2])
+	require.Equal(t, closeEvent, m.Event)
+	require.Equal(t, "mytopic", m.Topic)
+	require.Equal(t, int64(2), m.Stats.Messages)
+	require.Equal(t, int64(len(lines[0])+len(lines[1])), m.Stats.Bytes)
+
+	// Not sent if not requested
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	require.Equal(t, 2, len(toMessages(t, response.Body.String())))
+}
+
+func TestServer_Subscribe_CloseStats_SSE_SubscriptionDurationLimit(t *testing.T) {
+	c := newTestConfig(t)
+	c.VisitorSubscriptionDurationLimit = 500 * time.Millisecond
+	s := newTestServer(t, c)
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		request(t, s, "PUT", "/mytopic", "my message", nil)
+	}()
+	response := request(t, s, "GET", "/mytopic/sse", "", map[string]string{
+		"X-Stats": "1",
+	})
+	body := response.Body.String()
+	require.Contains(t, body, "event: open\n")
+	require.Contains(t, body, `"message":"my message"`)
+	require.Contains(t, body, "event: close\n")
+
+	_, closeData, _ := strings.Cut(body, "event: close\ndata: ")
+	m := toMessage(t, closeData)
+	require.Equal(t, int64(1), m.Stats.Messages)
+	require.Equal(t, int64(len(body)-len("event: close\ndata: ")-len(closeData)), m.Stats.Bytes)
+	require.True(t, m.Stats.Duration >= 500)
+}
+
+func TestServer_Subscribe_CloseStats_WebSocket(t *testing.T) {
+	c := newTestConfig(t)
+	c.VisitorSubscriptionDurationLimit = 300 * time.Millisecond
+	s := newTestServer(t, c)
+	server := httptest.NewServer(http.HandlerFunc(s.handle))
+	defer server.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial(strings.Replace(server.URL, "http://", "ws://", 1)+"/mytopic/ws?stats=1", nil)
+	require.Nil(t, err)
+	defer conn.Close()
+
+	_, data, err := conn.ReadMessage()
+	require.Nil(t, err)
+	require.Equal(t, openEvent, toMessage(t, string(data)).Event)
+
+	_, closeData, err := conn.ReadMessage()
+	require.Nil(t, err)
+	m := toMessage(t, string(closeData))
+	require.Equal(t, closeEvent, m.Event)
+	require.Equal(t, int64(0), m.Stats.Messages)
+	require.Equal(t, int64(len(data)), m.Stats.Bytes)
+
+	_, _, err = conn.ReadMessage()
+	require.True(t, websocket.IsCloseError(err, websocket.CloseTryAgainLater))
+}
+
+func TestServer_SubscribeSSE_RetryAndCommentHeartbeat(t *testing.T) {
+	c := newTestConfig(t)
+	c.KeepaliveInterval = 100 * time.Millisecond
+	s := newTestServer(t, c)
+
+	rr := httptest.NewRecorder()
+	cancel := subscribe(t, s, "/mytopic/sse?sse-retry=5s&sse-heartbeat=comment", rr)
+	time.Sleep(200 * time.Millisecond)
+	cancel()
+
+	body := rr.Body.String()
+	require.True(t, strings.HasPrefix(body, "retry: 5000\nevent: open\ndata: "))
+	require.Contains(t, body, "\n\n:keepalive\n\n")
+	require.NotContains(t, body, "event: keepalive")
+}
+
+func TestServer_SubscribeSSE_DefaultHeartbeat(t *testing.T) {
+	c := newTestConfig(t)
+	c.KeepaliveInterval = 100 * time.Millisecond
+	s := newTestServer(t, c)
+
+	rr := httptest.NewRecorder()
+	cancel := subscribe(t, s, "/mytopic/sse", rr)
+	time.Sleep(200 * time.Millisecond)
+	cancel()
+
+	body := rr.Body.String()
+	require.True(t, strings.HasPrefix(body, "event: open\ndata: "))
+	require.Contains(t, body, "event: keepalive\ndata: ")
+	require.NotContains(t, body, "retry:")
+}
+
+func TestServer_SubscribeSSE_InvalidParams(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+
+	response := request(t, s, "GET", "/mytopic/sse?sse-retry=soon", "", nil)
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40068, toHTTPError(t, response.Body.String()).Code)
+
+	response = request(t, s, "GET", "/mytopic/sse", "", map[string]string{
+		"X-SSE-Heartbeat": "sometimes",
+	})
+	require.Equal(t, 40068, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_Subscribe_ProxyTimeout(t *testing.T) {
+	c := newTestConfig(t)
+	c.KeepaliveInterval = 45 * time.Second
+	s := newTestServer(t, c)
+
+	response := request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	require.Equal(t, "45", response.Header().Get("X-Keepalive-Interval"))
+	response = request(t, s, "GET", "/mytopic/json?poll=1&proxy_timeout=30s", "", nil)
+	require.Equal(t, "20", response.Header().Get("X-Keepalive-Interval"))
+	response = request(t, s, "GET", "/mytopic/json?poll=1&proxy-timeout=5m", "", nil)
+	require.Equal(t, "45", response.Header().Get("X-Keepalive-Interval")) // Never longer than the configured interval
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", map[string]string{
+		"CF-Ray": "8c6bd8d7bb3e2f0d-FRA",
+	})
+	require.Equal(t, "45", response.Header().Get("X-Keepalive-Interval"))
+
+	c.KeepaliveInterval = 3 * time.Minute
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", map[string]string{
+		"CF-Ray": "8c6bd8d7bb3e2f0d-FRA",
+	})
+	require.Equal(t, "66", response.Header().Get("X-Keepalive-Interval")) // Cloudflare's 100s idle timeout
+
+	response = request(t, s, "GET", "/mytopic/ws?proxy_timeout=5s", "", map[string]string{
+		"Upgrade": "websocket",
+	})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40089, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "GET", "/mytopic/sse?proxy_timeout=soon", "", nil)
+	require.Equal(t, 40089, toHTTPError(t, response.Body.String()).Code)
+}
+
 func TestServer_SubscriberRateLimiting_Success(t *testing.T) {
 	c := newTestConfigWithAuthFile(t)
 	c.VisitorRequestLimitBurst = 3
@@ -2265,7 +3862,7 @@ func TestServer_SubscriberRateLimiting_Success(t *testing.T) {
 	rr := request(t, s, "GET", "/upAAAAAAAAAAAA/json?poll=1", "", nil, subscriber1Fn)
 	require.Equal(t, 200, rr.Code)
 	require.Equal(t, "", rr.Body.String())
-	require.Equal(t, "1.2.3.4", s.topics["upAAAAAAAAAAAA"].rateVisitor.ip.String())
+	require.Equal(t, "1.2.3.4", topicByID(s, "upAAAAAAAAAAAA").rateVisitor.ip.String())
 
 	// "Register" visitor 8.7.7.1 to topic "up012345678912" as a rate limit visitor (implicitly via topic name)
 	subscriber2Fn := func(r *http.Request) {
@@ -2274,7 +3871,7 @@ func TestServer_SubscriberRateLimiting_Success(t *testing.T) {
 	rr = request(t, s, "GET", "/up012345678912/json?poll=1", "", nil, subscriber2Fn)
 	require.Equal(t, 200, rr.Code)
 	require.Equal(t, "", rr.Body.String())
-	require.Equal(t, "8.7.7.1", s.topics["up012345678912"].rateVisitor.ip.String())
+	require.Equal(t, "8.7.7.1", topicByID(s, "up012345678912").rateVisitor.ip.String())
 
 	// Publish 2 messages to "subscriber1topic" as visitor 9.9.9.9. It'd be 3 normally, but the
 	// GET request before is also counted towards the request limiter.
@@ -2317,9 +3914,9 @@ func TestServer_SubscriberRateLimiting_NotWrongTopic(t *testing.T) {
 	rr := request(t, s, "GET", "/alerts,upAAAAAAAAAAAA,upBBBBBBBBBBBB/json?poll=1", "", nil, subscriberFn)
 	require.Equal(t, 200, rr.Code)
 	require.Equal(t, "", rr.Body.String())
-	require.Nil(t, s.topics["alerts"].rateVisitor)
-	require.Equal(t, "1.2.3.4", s.topics["upAAAAAAAAAAAA"].rateVisitor.ip.String())
-	require.Equal(t, "1.2.3.4", s.topics["upBBBBBBBBBBBB"].rateVisitor.ip.String())
+	require.Nil(t, topicByID(s, "alerts").rateVisitor)
+	require.Equal(t, "1.2.3.4", topicByID(s, "upAAAAAAAAAAAA").rateVisitor.ip.String())
+	require.Equal(t, "1.2.3.4", topicByID(s, "upBBBBBBBBBBBB").rateVisitor.ip.String())
 }
 
 func TestServer_SubscriberRateLimiting_NotEnabled_Failed(t *testing.T) {
@@ -2336,7 +3933,7 @@ func TestServer_SubscriberRateLimiting_NotEnabled_Failed(t *testing.T) {
 	})
 	require.Equal(t, 200, rr.Code)
 	require.Equal(t, "", rr.Body.String())
-	require.Nil(t, s.topics["upAAAAAAAAAAAA"].rateVisitor)
+	require.Nil(t, topicByID(s, "upAAAAAAAAAAAA").rateVisitor)
 
 	// Registering visitor 8.7.7.1 to topic has no effect
 	rr = request(t, s, "GET", "/up012345678912/json?poll=1", "", nil, func(r *http.Request) {
@@ -2344,7 +3941,7 @@ func TestServer_SubscriberRateLimiting_NotEnabled_Failed(t *testing.T) {
 	})
 	require.Equal(t, 200, rr.Code)
 	require.Equal(t, "", rr.Body.String())
-	require.Nil(t, s.topics["up012345678912"].rateVisitor)
+	require.Nil(t, topicByID(s, "up012345678912").rateVisitor)
 
 	// Publish 3 messages to "upAAAAAAAAAAAA" as visitor 9.9.9.9
 	for i := 0; i < 3; i++ {
@@ -2421,26 +4018,26 @@ func TestServer_SubscriberRateLimiting_VisitorExpiration(t *testing.T) {
 	}
 	rr := request(t, s, "GET", "/upAAAAAAAAAAAA/json?poll=1", "", nil, subscriberFn)
 	require.Equal(t, 200, rr.Code)
-	require.Equal(t, "1.2.3.4", s.topics["upAAAAAAAAAAAA"].rateVisitor.ip.String())
-	require.Equal(t, s.visitors["ip:1.2.3.4"], s.topics["upAAAAAAAAAAAA"].rateVisitor)
+	require.Equal(t, "1.2.3.4", topicByID(s, "upAAAAAAAAAAAA").rateVisitor.ip.String())
+	require.Equal(t, visitorByID(s, "ip:1.2.3.4"), topicByID(s, "upAAAAAAAAAAAA").rateVisitor)
 
 	// Publish message, observe rate visitor tokens being decreased
 	response := request(t, s, "POST", "/upAAAAAAAAAAAA", "some message", nil)
 	require.Equal(t, 200, response.Code)
-	require.Equal(t, int64(0), s.visitors["ip:9.9.9.9"].messagesLimiter.Value())
-	require.Equal(t, int64(1), s.topics["upAAAAAAAAAAAA"].rateVisitor.messagesLimiter.Value())
-	require.Equal(t, s.visitors["ip:1.2.3.4"], s.topics["upAAAAAAAAAAAA"].rateVisitor)
+	require.Equal(t, int64(0), visitorByID(s, "ip:9.9.9.9").messagesLimiter.Value())
+	require.Equal(t, int64(1), topicByID(s, "upAAAAAAAAAAAA").rateVisitor.messagesLimiter.Value())
+	require.Equal(t, visitorByID(s, "ip:1.2.3.4"), topicByID(s, "upAAAAAAAAAAAA").rateVisitor)
 
 	// Expire visitor
-	s.visitors["ip:1.2.3.4"].seen = time.Now().Add(-1 * 25 * time.Hour)
+	visitorByID(s, "ip:1.2.3.4").seen = time.Now().Add(-1 * 25 * time.Hour)
 	s.pruneVisitors()
 
 	// Publish message again, observe that rateVisitor is not used anymore and is reset
 	response = request(t, s, "POST", "/upAAAAAAAAAAAA", "some message", nil)
 	require.Equal(t, 200, response.Code)
-	require.Equal(t, int64(1), s.visitors["ip:9.9.9.9"].messagesLimiter.Value())
-	require.Nil(t, s.topics["upAAAAAAAAAAAA"].rateVisitor)
-	require.Nil(t, s.visitors["ip:1.2.3.4"])
+	require.Equal(t, int64(1), visitorByID(s, "ip:9.9.9.9").messagesLimiter.Value())
+	require.Nil(t, topicByID(s, "upAAAAAAAAAAAA").rateVisitor)
+	require.Nil(t, visitorByID(s, "ip:1.2.3.4"))
 }
 
 func TestServer_SubscriberRateLimiting_ProtectedTopics_WithDefaultReadWrite(t *testing.T) {
@@ -2459,8 +4056,8 @@ func TestServer_SubscriberRateLimiting_ProtectedTopics_WithDefaultReadWrite(t *t
 		r.RemoteAddr = "1.2.3.4"
 	})
 	require.Equal(t, 200, rr.Code)
-	require.Equal(t, "1.2.3.4", s.topics["up123456789012"].rateVisitor.ip.String())
-	require.Nil(t, s.topics["announcements"].rateVisitor)
+	require.Equal(t, "1.2.3.4", topicByID(s, "up123456789012").rateVisitor.ip.String())
+	require.Nil(t, topicByID(s, "announcements").rateVisitor)
 }
 
 func TestServer_MessageHistoryAndStatsEndpoint(t *testing.T) {
@@ -2892,6 +4489,11 @@ func newTestServer(t *testing.T, config *Config) *Server {
 	return server
 }
 
+// setTestMailer replaces the server's email sender, keeping the current config
+func setTestMailer(s *Server, m mailer) {
+	s.state.Store(&serverState{config: s.config(), mailer: m})
+}
+
 func request(t *testing.T, s *Server, method, url, body string, headers map[string]string, fn ...func(r *http.Request)) *httptest.ResponseRecorder {
 	rr := httptest.NewRecorder()
 	r, err := http.NewRequest(method, url, strings.NewReader(body))
@@ -2909,12 +4511,15 @@ func request(t *testing.T, s *Server, method, url, body string, headers map[stri
 	return rr
 }
 
-func subscribe(t *testing.T, s *Server, url string, rr *httptest.ResponseRecorder) context.CancelFunc {
+func subscribe(t *testing.T, s *Server, url string, rr *httptest.ResponseRecorder, fn ...func(r *http.Request)) context.CancelFunc {
 	ctx, cancel := context.WithCancel(context.Background())
 	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
+	for _, f := range fn {
+		f(req)
+	}
 	done := make(chan bool)
 	go func() {
 		s.handle(rr, req)
@@ -2929,6 +4534,41 @@ func subscribe(t *testing.T, s *Server, url string, rr *httptest.ResponseRecorde
 	return cancelAndWaitForDone
 }
 
+func BenchmarkServer_TopicAndVisitor_Parallel(b *testing.B) {
+	conf := NewConfig()
+	conf.CacheDuration = 0 // No cache, only measure the topics/visitors maps
+	conf.TotalTopicLimit = 100000
+	s, err := New(conf)
+	require.Nil(b, err)
+	topicIDs := make([]string, 20000)
+	for i := range topicIDs {
+		topicIDs[i] = fmt.Sprintf("topic%d", i)
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var i int
+		for pb.Next() {
+			if _, err := s.topicFromID(topicIDs[i%len(topicIDs)]); err != nil {
+				b.Fatal(err)
+			}
+			s.visitor(netip.AddrFrom4([4]byte{10, 0, byte(i >> 8), byte(i)}), nil)
+			i++
+		}
+	})
+}
+
+// topicByID returns the topic with the given ID from the server's topics map, or nil if it does not exist
+func topicByID(s *Server, id string) *topic {
+	t, _ := s.topics.Get(id)
+	return t
+}
+
+// visitorByID returns the visitor with the given ID (e.g. "ip:1.2.3.4") from the server's visitors map, or nil
+func visitorByID(s *Server, id string) *visitor {
+	v, _ := s.visitors.Get(id)
+	return v
+}
+
 func toMessages(t *testing.T, s string) []*message {
 	messages := make([]*message, 0)
 	scanner := bufio.NewScanner(strings.NewReader(s))
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+// Topic aliases let users rename long-lived topics without breaking existing publishers and subscribers: Publishing
+// to or subscribing to an alias (e.g. "alerts") transparently maps to the target topic (e.g. "alerts-prod-2024").
+// Subscribers are told about the mapping via the "aliases" field of the "open" event, so that clients can update
+// their subscriptions.
+//
+// Aliases are defined via POST /<alias>/alias with {"topic":"<target>"}, and removed via DELETE /<alias>/alias.
+// Both require the manage permission (see user.PermissionManage) on the alias and the target topic, i.e. owners can
+// alias their reserved topics, and admins can alias any topic. Access control is always applied to the target topic.
+//
+// Aliases are resolved only once, i.e. an alias cannot point to another alias, and a topic that is the target of
+// an alias cannot itself become an alias. Aliases are stored in the message cache (see message_cache_aliases.go)
+// and held in memory.
+
+// topicAliases is the in-memory list of topic aliases
+type topicAliases struct {
+	aliases map[string]string // Alias -> target topic
+	mu      sync.RWMutex
+}
+
+// newTopicAliases loads the topic aliases from the message cache
+func newTopicAliases(cache *messageCache) (*topicAliases, error) {
+	aliases, err := cache.TopicAliases()
+	if err != nil {
+		return nil, err
+	}
+	return &topicAliases{
+		aliases: aliases,
+	}, nil
+}
+
+// Resolve maps the given topic IDs to their targets, and removes duplicates (e.g. if both the alias and the
+// target are given)
+func (a *topicAliases) Resolve(ids ...string) []string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	resolved := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if target, ok := a.aliases[id]; ok {
+			id = target
+		}
+		if !util.Contains(resolved, id) {
+			resolved = append(resolved, id)
+		}
+	}
+	return resolved
+}
+
+// Lookup returns the aliases among the given topic IDs (alias -> target topic), or nil if there are none
+func (a *topicAliases) Lookup(ids ...string) map[string]string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	var aliases map[string]string
+	for _, id := range ids {
+		if target, ok := a.aliases[id]; ok {
+			if aliases == nil {
+				aliases = make(map[string]string)
+			}
+			aliases[id] = target
+		}
+	}
+	return aliases
+}
+
+// Check returns an error if the alias cannot be added, because it would create a chain of aliases
+func (a *topicAliases) Check(alias, topic string) *errHTTP {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if _, ok := a.aliases[topic]; ok {
+		return errHTTPBadRequestTopicAliasInvalid.Wrap("target topic %s is an alias itself", topic)
+	}
+	for existing, target := range a.aliases {
+		if target == alias {
+			return errHTTPBadRequestTopicAliasInvalid.Wrap("topic %s is the target of alias %s", alias, existing)
+		}
+	}
+	return nil
+}
+
+func (a *topicAliases) Add(alias, topic string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.aliases[alias] = topic
+}
+
+// Remove removes the given alias, and returns false if there was none
+func (a *topicAliases) Remove(alias string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.aliases[alias]; !ok {
+		return false
+	}
+	delete(a.aliases, alias)
+	return true
+}
+
+// newOpenMessage creates an open message, which lists the aliases among the subscribed topics, if any
+func (s *Server) newOpenMessage(topicsStr string) *message {
+	m := newOpenMessage(topicsStr)
+	m.Aliases = s.topicAliases.Lookup(util.SplitNoEmpty(topicsStr, ",")...)
+	return m
+}
+
+// handleTopicAliasAdd makes the topic in the path an alias of the topic in the request body, or changes the target
+// of an existing alias
+func (s *Server) handleTopicAliasAdd(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	alias, err := s.topicAliasFromPath(r, v)
+	if err != nil {
+		return err
+	}
+	req, err := readJSONWithLimit[apiTopicAliasRequest](r.Body, jsonBodyBytesLimit, false)
+	if err != nil {
+		return err
+	}
+	topic := req.Topic
+	if !topicRegex.MatchString(topic) {
+		return errHTTPBadRequestTopicInvalid
+	} else if topic == alias {
+		return errHTTPBadRequestTopicAliasInvalid.Wrap("alias and target topic must be different")
+	} else if s.topicDisallowed(topic) {
+		return errHTTPBadRequestTopicDisallowed
+	} else if !s.topicPermitted(v, topic, user.PermissionManage) {
+		return errHTTPForbidden
+	} else if err := s.topicAliases.Check(alias, topic); err != nil {
+		return err
+	}
+	if err := s.messageCache.AddTopicAlias(alias, topic); err != nil {
+		return err
+	}
+	s.topicAliases.Add(alias, topic)
+	logvr(v, r).
+		Tag(tagManager).
+		Fields(log.Context{
+			"topic_alias":  alias,
+			"topic_target": topic,
+		}).
+		Info("Added alias %s for topic %s", alias, topic)
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+// handleTopicAliasDelete removes the alias in the path
+func (s *Server) handleTopicAliasDelete(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	alias, err := s.topicAliasFromPath(r, v)
+	if err != nil {
+		return err
+	}
+	if !s.topicAliases.Remove(alias) {
+		return errHTTPNotFoundTopicAlias
+	}
+	if err := s.messageCache.RemoveTopicAlias(alias); err != nil {
+		return err
+	}
+	logvr(v, r).Tag(tagManager).Field("topic_alias", alias).Info("Removed topic alias %s", alias)
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+// topicAliasFromPath returns the alias from a path like /alerts/alias, and checks that the visitor may manage it.
+// Note that authorizeTopicManage only checks the target topic if the alias already exists.
+func (s *Server) topicAliasFromPath(r *http.Request, v *visitor) (string, error) {
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) != 3 {
+		return "", errHTTPInternalErrorInvalidPath
+	}
+	alias := parts[1]
+	if s.topicDisallowed(alias) {
+		return "", errHTTPBadRequestTopicDisallowed
+	} else if !s.topicPermitted(v, alias, user.PermissionManage) {
+		return "", errHTTPForbidden
+	}
+	return alias, nil
+}
+
+// topicDisallowed returns true if the topic ID cannot be used, see Config.DisallowedTopics
+func (s *Server) topicDisallowed(id string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return util.Contains(s.config().DisallowedTopics, id)
+}
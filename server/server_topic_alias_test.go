@@ -0,0 +1,102 @@
+package server
+
+import (
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServer_TopicAlias(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionReadWrite
+	c.VisitorSubscriptionDurationLimit = 300 * time.Millisecond
+	s := newTestServer(t, c)
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	admin := map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	}
+
+	// Only admins (or owners) can define aliases
+	response := request(t, s, "POST", "/alerts/alias", `{"topic":"alerts-prod-2024"}`, nil)
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "POST", "/alerts/alias", `{"topic":"alerts-prod-2024"}`, admin)
+	require.Equal(t, 200, response.Code)
+
+	// Publishing to the alias publishes to the target
+	response = request(t, s, "PUT", "/alerts", "disk full", nil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "alerts-prod-2024", toMessage(t, response.Body.String()).Topic)
+	response = request(t, s, "GET", "/alerts-prod-2024/json?poll=1", "", nil)
+	require.Equal(t, "disk full", toMessage(t, response.Body.String()).Message)
+
+	// Subscribing to the alias subscribes to the target, and the open event contains the alias
+	response = request(t, s, "GET", "/alerts,alerts-prod-2024,other/json", "", nil) // Returns after max. duration
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, openEvent, messages[0].Event)
+	require.Equal(t, map[string]string{"alerts": "alerts-prod-2024"}, messages[0].Aliases)
+	response = request(t, s, "GET", "/alerts/json?poll=1", "", nil)
+	messages = toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages)) // No duplicates
+	require.Equal(t, "disk full", messages[0].Message)
+
+	// No chains
+	response = request(t, s, "POST", "/alerts-prod-2024/alias", `{"topic":"alerts-prod-2025"}`, admin)
+	require.Equal(t, 40080, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "POST", "/old-alerts/alias", `{"topic":"alerts"}`, admin)
+	require.Equal(t, 40080, toHTTPError(t, response.Body.String()).Code)
+
+	// Removing the alias
+	response = request(t, s, "DELETE", "/alerts/alias", "", admin)
+	require.Equal(t, 200, response.Code)
+	response = request(t, s, "DELETE", "/alerts/alias", "", admin)
+	require.Equal(t, 40407, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "PUT", "/alerts", "not aliased", nil)
+	require.Equal(t, "alerts", toMessage(t, response.Body.String()).Topic)
+}
+
+func TestServer_TopicAlias_ReservedTopics(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionDenyAll
+	s := newTestServer(t, c)
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	require.Nil(t, s.userManager.AddReservation("phil", "alerts", user.PermissionDenyAll))
+	require.Nil(t, s.userManager.AddReservation("phil", "alerts-new", user.PermissionDenyAll))
+	require.Nil(t, s.userManager.AddReservation("ben", "bens-topic", user.PermissionDenyAll))
+	phil := map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	}
+
+	// Owners can only alias their own topics
+	response := request(t, s, "POST", "/alerts/alias", `{"topic":"bens-topic"}`, phil)
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "POST", "/alerts/alias", `{"topic":"alerts-new"}`, phil)
+	require.Equal(t, 200, response.Code)
+
+	// Aliases grant no access, access control is applied to the target topic
+	response = request(t, s, "PUT", "/alerts", "hi", map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	})
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "PUT", "/alerts", "hi", phil)
+	require.Equal(t, 200, response.Code)
+	require.Equal(t, "alerts-new", toMessage(t, response.Body.String()).Topic)
+}
+
+func TestServer_TopicAlias_Persisted(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.CacheFile = filepath.Join(t.TempDir(), "cache.db")
+	s := newTestServer(t, c)
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	response := request(t, s, "POST", "/alerts/alias", `{"topic":"alerts-prod"}`, map[string]string{
+		"Authorization": util.BasicAuth("phil", "phil"),
+	})
+	require.Equal(t, 200, response.Code)
+	s.closeDatabases()
+
+	s = newTestServer(t, c)
+	require.Equal(t, []string{"alerts-prod", "other"}, s.topicAliases.Resolve("alerts", "other"))
+}
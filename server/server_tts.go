@@ -0,0 +1,317 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+	"mime"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Text-to-speech (TTS) lets publishers request an audio version of a message (X-TTS: yes), so that smart speakers
+// and car clients can play alerts. The audio is generated by a pluggable engine (see ttsEngine, by default an external
+// command such as espeak-ng or piper), and attached to the message like a regular attachment.
+//
+// To keep TTS off the hot path, the message is published right away, with the attachment URL already set, and the
+// audio is generated by a pool of workers in the background. Downloads of the attachment wait until the audio is ready.
+// Generated audio is cached by the hash of the text, so repeated alerts (e.g. "Garage door open") are only synthesized
+// once. Cached files that were not used for a while are removed by the manager.
+
+const (
+	ttsQueuePriorities = 6                  // Message priorities 0-5, see ttsJob
+	ttsQueueSize       = 1000               // Max. number of messages waiting for audio generation
+	ttsTimeout         = 30 * time.Second   // Max. time the engine may take to synthesize one message
+	ttsWaitTimeout     = 30 * time.Second   // Max. time a download waits for the audio to be generated
+	ttsCacheExpiry     = 7 * 24 * time.Hour // Cached audio files that were not used for this long are pruned
+	ttsFilename        = "message"          // Attachment name without extension, e.g. message.wav
+)
+
+var (
+	errTTSQueueFull = errors.New("text-to-speech queue is full, message dropped")
+)
+
+// ttsEngine converts text to audio. In tests, this can be implemented with a mock.
+type ttsEngine interface {
+	Synthesize(ctx context.Context, text string) ([]byte, error)
+}
+
+// commandTTSEngine is a ttsEngine that runs a shell command, which reads the text from stdin and writes
+// the audio to stdout, e.g. "espeak-ng --stdout" or "piper --model en_US-lessac-medium --output_file -"
+type commandTTSEngine struct {
+	command string
+}
+
+func newCommandTTSEngine(command string) *commandTTSEngine {
+	return &commandTTSEngine{command: command}
+}
+
+func (e *commandTTSEngine) Synthesize(ctx context.Context, text string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "sh", "-c", e.command)
+	cmd.Stdin = strings.NewReader(text)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	} else if stdout.Len() == 0 {
+		return nil, errors.New("command did not produce any audio")
+	}
+	return stdout.Bytes(), nil
+}
+
+// ttsJob is a message waiting in the text-to-speech queue
+type ttsJob struct {
+	v *visitor
+	m *message
+}
+
+// ttsGenerator holds the engine, the queue, and the messages whose audio is not ready yet
+type ttsGenerator struct {
+	engine   ttsEngine
+	format   string // File extension of the generated audio, e.g. "wav"
+	cacheDir string
+	queue    *util.PriorityQueue[*ttsJob]
+	workers  sync.Once
+	pending  map[string]chan struct{} // Message ID -> closed when the audio is ready (or failed), see waitForTTS
+	mu       sync.Mutex
+}
+
+func newTTSGenerator(engine ttsEngine, format, cacheDir string) (*ttsGenerator, error) {
+	if err := os.MkdirAll(cacheDir, 0700); err != nil {
+		return nil, err
+	}
+	return &ttsGenerator{
+		engine:   engine,
+		format:   format,
+		cacheDir: cacheDir,
+		queue:    util.NewPriorityQueue[*ttsJob](ttsQueuePriorities, ttsQueueSize),
+		pending:  make(map[string]chan struct{}),
+	}, nil
+}
+
+// handleTTSAttachment attaches the (not yet generated) audio file to the message, and queues the message for
+// audio generation. The checks are the same as for regular attachments, see handleBodyAsAttachment.
+func (s *Server) handleTTSAttachment(v *visitor, m *message) error {
+	conf := s.config()
+	if s.tts == nil {
+		return errHTTPBadRequestTTSDisabled.With(m)
+	} else if m.Attachment != nil {
+		if s.fileCache != nil {
+			if err := s.fileCache.Remove(m.ID); err != nil {
+				logvm(v, m).Tag(tagTTS).Err(err).Warn("Error removing attachment of text-to-speech message")
+			}
+		}
+		return errHTTPBadRequestTTSWithAttachment.With(m)
+	} else if s.fileCache == nil || conf.BaseURL == "" || conf.AttachmentCacheDir == "" {
+		return errHTTPBadRequestAttachmentsDisallowed.With(m)
+	} else if s.diskSpaceLow.Load() {
+		return errHTTPInsufficientStorageDiskSpace.With(m)
+	} else if !s.attachmentTopicAllowed(m.Topic) {
+		return errHTTPBadRequestAttachmentTopicDenied.With(m)
+	} else if !s.topicPermitted(v, m.Topic, user.PermissionAttach) {
+		return errHTTPForbiddenAttachmentsNotPermitted.With(m)
+	}
+	vinfo, err := v.Info()
+	if err != nil {
+		return err
+	}
+	attachmentExpiry := attachmentExpires(vinfo, m)
+	if m.Time > attachmentExpiry {
+		return errHTTPBadRequestAttachmentsExpiryBeforeDelivery.With(m)
+	}
+	ext := "." + s.tts.format
+	contentType := mime.TypeByExtension(ext)
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	m.Attachment = &attachment{
+		Name:    ttsFilename + ext,
+		Type:    contentType,
+		Expires: attachmentExpiry,
+		URL:     fmt.Sprintf("%s/file/%s%s", conf.BaseURL, m.ID, ext),
+	}
+	if !s.attachmentTypeAllowed(m.Attachment.Type, ext, m.Attachment.Name) {
+		return errHTTPBadRequestAttachmentTypeDenied.With(m).Fields(log.Context{"attachment_type": m.Attachment.Type})
+	}
+	s.tts.mu.Lock()
+	s.tts.pending[m.ID] = make(chan struct{})
+	s.tts.mu.Unlock()
+	s.queueTTS(v, m)
+	return nil
+}
+
+// queueTTS queues a message for audio generation. Like the Firebase queue (see sendToFirebase), urgent messages
+// are processed first, and if the queue is full, the newest message with the lowest priority is dropped.
+func (s *Server) queueTTS(v *visitor, m *message) {
+	s.tts.workers.Do(func() {
+		for i := 0; i < s.config().TTSWorkers; i++ {
+			go s.runTTSWorker()
+		}
+	})
+	priority := m.Priority
+	if priority == 0 {
+		priority = 3
+	}
+	dropped, ok := s.tts.queue.Enqueue(&ttsJob{v: v, m: m}, priority)
+	mset(metricTTSQueueDepth, s.tts.queue.Len())
+	if ok {
+		s.ttsFailed(dropped.v, dropped.m, errTTSQueueFull)
+	}
+}
+
+func (s *Server) runTTSWorker() {
+	for {
+		job, ok := s.tts.queue.Dequeue()
+		if !ok {
+			return // Queue closed
+		}
+		mset(metricTTSQueueDepth, s.tts.queue.Len())
+		if err := s.generateTTS(job.v, job.m); err != nil {
+			s.ttsFailed(job.v, job.m, err)
+			continue
+		}
+		minc(metricTTSGeneratedSuccess)
+		s.ttsDone(job.m.ID)
+	}
+}
+
+// generateTTS synthesizes the audio for a message (or takes it from the cache), and writes it to the attachment
+// cache. The attachment size is then updated in the message cache, so that it counts towards the visitor's limits.
+func (s *Server) generateTTS(v *visitor, m *message) error {
+	conf := s.config()
+	text := ttsText(m)
+	file, err := s.ttsCachedFile(text)
+	if err != nil {
+		return err
+	}
+	vinfo, err := v.Info()
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	size, err := s.fileCache.Write(m.ID, f, util.NewFixedLimiter(vinfo.Limits.AttachmentFileSizeLimit), util.NewFixedLimiter(vinfo.Stats.AttachmentTotalSizeRemaining))
+	if err != nil {
+		return err
+	}
+	err = s.messageCache.UpdateAttachmentSize(m.ID, size)
+	if errors.Is(err, errMessageNotFound) && conf.CacheBatchTimeout > 0 {
+		// Messages may be persisted asynchronously, see handleFile
+		_, err = util.Retry(func() (*message, error) {
+			return nil, s.messageCache.UpdateAttachmentSize(m.ID, size)
+		}, conf.CacheBatchTimeout, 100*time.Millisecond, 300*time.Millisecond, 600*time.Millisecond)
+	}
+	if errors.Is(err, errMessageNotFound) {
+		return nil // Message is not cached (Cache: no), nothing to update
+	}
+	return err
+}
+
+// ttsCachedFile returns the path of the audio file for the given text, synthesizing it if it is not cached yet
+func (s *Server) ttsCachedFile(text string) (string, error) {
+	hash := sha256.Sum256([]byte(text))
+	file := filepath.Join(s.tts.cacheDir, hex.EncodeToString(hash[:])+"."+s.tts.format)
+	if _, err := os.Stat(file); err == nil {
+		minc(metricTTSCacheHits)
+		now := time.Now()
+		_ = os.Chtimes(file, now, now) // Mark as used, see pruneTTSCache
+		return file, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ttsTimeout)
+	defer cancel()
+	audio, err := s.tts.engine.Synthesize(ctx, text)
+	if err != nil {
+		return "", err
+	}
+	tmpFile := file + ".tmp"
+	if err := os.WriteFile(tmpFile, audio, 0600); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmpFile, file); err != nil {
+		os.Remove(tmpFile)
+		return "", err
+	}
+	return file, nil
+}
+
+func (s *Server) ttsFailed(v *visitor, m *message, err error) {
+	minc(metricTTSGeneratedFailure)
+	logvm(v, m).Tag(tagTTS).Err(err).Warn("Unable to generate text-to-speech audio: %s", err.Error())
+	s.ttsDone(m.ID)
+}
+
+func (s *Server) ttsDone(messageID string) {
+	s.tts.mu.Lock()
+	defer s.tts.mu.Unlock()
+	if done, ok := s.tts.pending[messageID]; ok {
+		close(done)
+		delete(s.tts.pending, messageID)
+	}
+}
+
+// waitForTTS blocks until the audio of the given message is ready, if it is still being generated
+func (s *Server) waitForTTS(ctx context.Context, messageID string) {
+	if s.tts == nil {
+		return
+	}
+	s.tts.mu.Lock()
+	done, ok := s.tts.pending[messageID]
+	s.tts.mu.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+	case <-time.After(ttsWaitTimeout):
+	}
+}
+
+// pruneTTSCache removes cached audio files that were not used for a while
+func (s *Server) pruneTTSCache() {
+	if s.tts == nil {
+		return
+	}
+	entries, err := os.ReadDir(s.tts.cacheDir)
+	if err != nil {
+		log.Tag(tagTTS).Err(err).Warn("Error reading text-to-speech cache")
+		return
+	}
+	var removed int
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || e.IsDir() || time.Since(info.ModTime()) < ttsCacheExpiry {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.tts.cacheDir, e.Name())); err != nil {
+			log.Tag(tagTTS).Err(err).Warn("Error removing cached text-to-speech audio %s", e.Name())
+			continue
+		}
+		removed++
+	}
+	if removed > 0 {
+		log.Tag(tagTTS).Debug("Removed %d cached text-to-speech audio file(s)", removed)
+	}
+}
+
+// ttsText returns the text that is read out for a message, i.e. the title (if any) and the message
+func ttsText(m *message) string {
+	if m.Title != "" {
+		return m.Title + ". " + m.Message
+	}
+	return m.Message
+}
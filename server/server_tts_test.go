@@ -0,0 +1,162 @@
+package server
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServer_TTS_Disabled(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "PUT", "/mytopic", "Garage door open", map[string]string{
+		"TTS": "yes",
+	})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40072, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_TTS_PublishAndDownload(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithTTS(t))
+	engine := &testTTSEngine{release: make(chan struct{})}
+	s.tts.engine = engine
+
+	response := request(t, s, "PUT", "/mytopic", "Garage door open", map[string]string{
+		"Title": "Alert",
+		"TTS":   "yes",
+	})
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+	require.Equal(t, "Garage door open", m.Message)
+	require.Equal(t, "message.wav", m.Attachment.Name)
+	require.True(t, strings.HasPrefix(m.Attachment.Type, "audio/"))
+	require.Equal(t, "http://127.0.0.1:12345/file/"+m.ID+".wav", m.Attachment.URL)
+	require.Equal(t, int64(0), m.Attachment.Size) // Not generated yet
+
+	// Download waits until the audio is generated
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		response := request(t, s, "GET", "/file/"+m.ID+".wav", "", nil)
+		require.Equal(t, 200, response.Code)
+		require.Equal(t, "audio:Alert. Garage door open", response.Body.String())
+	}()
+	time.Sleep(100 * time.Millisecond)
+	close(engine.release)
+	wg.Wait()
+
+	// Attachment size is updated in the cache
+	response = request(t, s, "GET", "/mytopic/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, int64(len("audio:Alert. Garage door open")), messages[0].Attachment.Size)
+}
+
+func TestServer_TTS_CachedByText(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithTTS(t))
+	engine := &testTTSEngine{}
+	s.tts.engine = engine
+
+	var ids []string
+	for _, text := range []string{"Garage door open", "Garage door open", "Garage door closed"} {
+		response := request(t, s, "PUT", "/mytopic?tts=1", text, nil)
+		require.Equal(t, 200, response.Code)
+		ids = append(ids, toMessage(t, response.Body.String()).ID)
+	}
+	waitFor(t, func() bool {
+		s.tts.mu.Lock()
+		defer s.tts.mu.Unlock()
+		return len(s.tts.pending) == 0
+	})
+	for _, id := range ids {
+		require.FileExists(t, filepath.Join(s.config().AttachmentCacheDir, id))
+	}
+	require.Equal(t, 2, engine.Calls())
+	entries, err := os.ReadDir(s.config().TTSCacheDir)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(entries))
+}
+
+func TestServer_TTS_WithAttachment(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithTTS(t))
+	response := request(t, s, "PUT", "/mytopic", "some file", map[string]string{
+		"Filename": "file.txt",
+		"TTS":      "yes",
+	})
+	require.Equal(t, 400, response.Code)
+	require.Equal(t, 40073, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_TTS_EngineFails(t *testing.T) {
+	c := newTestConfigWithTTS(t)
+	c.TTSCommand = "echo 'no voices installed' >&2; exit 1"
+	s := newTestServer(t, c)
+
+	response := request(t, s, "PUT", "/mytopic?tts=1", "Garage door open", nil)
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+
+	// Download does not wait forever, and the message is still delivered
+	response = request(t, s, "GET", "/file/"+m.ID+".wav", "", nil)
+	require.Equal(t, 404, response.Code)
+}
+
+func TestServer_TTS_PruneCache(t *testing.T) {
+	s := newTestServer(t, newTestConfigWithTTS(t))
+	oldFile := filepath.Join(s.config().TTSCacheDir, "old.wav")
+	newFile := filepath.Join(s.config().TTSCacheDir, "new.wav")
+	require.Nil(t, os.WriteFile(oldFile, []byte("old"), 0600))
+	require.Nil(t, os.WriteFile(newFile, []byte("new"), 0600))
+	old := time.Now().Add(-ttsCacheExpiry - time.Hour)
+	require.Nil(t, os.Chtimes(oldFile, old, old))
+
+	s.pruneTTSCache()
+	require.NoFileExists(t, oldFile)
+	require.FileExists(t, newFile)
+}
+
+func TestCommandTTSEngine(t *testing.T) {
+	audio, err := newCommandTTSEngine("tr a-z A-Z").Synthesize(context.Background(), "hello")
+	require.Nil(t, err)
+	require.Equal(t, "HELLO", string(audio))
+
+	_, err = newCommandTTSEngine("cat > /dev/null").Synthesize(context.Background(), "hello")
+	require.Error(t, err)
+
+	_, err = newCommandTTSEngine("echo 'no voices' >&2; exit 1").Synthesize(context.Background(), "hello")
+	require.ErrorContains(t, err, "no voices")
+}
+
+func newTestConfigWithTTS(t *testing.T) *Config {
+	c := newTestConfig(t)
+	c.TTSCommand = "cat"
+	c.TTSCacheDir = t.TempDir()
+	return c
+}
+
+type testTTSEngine struct {
+	release chan struct{} // If set, Synthesize blocks until closed
+	calls   int
+	mu      sync.Mutex
+}
+
+func (e *testTTSEngine) Synthesize(_ context.Context, text string) ([]byte, error) {
+	if e.release != nil {
+		<-e.release
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.calls++
+	return []byte("audio:" + text), nil
+}
+
+func (e *testTTSEngine) Calls() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.calls
+}
@@ -30,6 +30,14 @@ const (
 	</Say>
 	<Say>Goodbye.</Say>
 </Response>`
+	twilioSMSFormat    = "ntfy message on topic %s from %s: %s"
+	twilioSMSBodyLimit = 1600 // Max. number of characters in a Twilio text message body; longer bodies are rejected
+)
+
+// Channels used to deliver a message to a phone number (X-Call-Channel); also used for phone verification
+const (
+	callChannelCall = "call"
+	callChannelSMS  = "sms"
 )
 
 // convertPhoneNumber checks if the given phone number is verified for the given user, and if so, returns the verified
@@ -67,13 +75,14 @@ func (s *Server) callPhone(v *visitor, r *http.Request, m *message, to string) {
 	}
 	body := fmt.Sprintf(twilioCallFormat, xmlEscapeText(m.Topic), xmlEscapeText(m.Message), xmlEscapeText(sender))
 	data := url.Values{}
-	data.Set("From", s.config.TwilioPhoneNumber)
+	data.Set("From", s.config().TwilioPhoneNumber)
 	data.Set("To", to)
 	data.Set("Twiml", body)
 	ev := logvrm(v, r, m).Tag(tagTwilio).Field("twilio_to", to).FieldIf("twilio_body", body, log.TraceLevel).Debug("Sending Twilio request")
-	response, err := s.callPhoneInternal(data)
+	response, err := s.callPhoneInternal("Calls.json", data)
 	if err != nil {
 		ev.Field("twilio_response", response).Err(err).Warn("Error sending Twilio request")
+		s.integrationFailed("twilio", m, err)
 		minc(metricCallsMadeFailure)
 		return
 	}
@@ -81,43 +90,87 @@ func (s *Server) callPhone(v *visitor, r *http.Request, m *message, to string) {
 	minc(metricCallsMadeSuccess)
 }
 
-func (s *Server) callPhoneInternal(data url.Values) (string, error) {
-	requestURL := fmt.Sprintf("%s/2010-04-01/Accounts/%s/Calls.json", s.config.TwilioCallsBaseURL, s.config.TwilioAccount)
+// sendSMS calls the Twilio API to send a text message to the given phone number, using the given message.
+// Like callPhone, failures will be logged, but not returned to the caller. Long messages are truncated.
+func (s *Server) sendSMS(v *visitor, r *http.Request, m *message, to string) {
+	u, sender := v.User(), m.Sender.String()
+	if u != nil {
+		sender = u.Name
+	}
+	text := m.Message
+	if m.Title != "" {
+		text = m.Title + ": " + m.Message
+	}
+	body := maybeTruncateSMSBody(fmt.Sprintf(twilioSMSFormat, m.Topic, sender, text))
+	data := url.Values{}
+	data.Set("From", s.config().TwilioPhoneNumber)
+	data.Set("To", to)
+	data.Set("Body", body)
+	ev := logvrm(v, r, m).Tag(tagTwilio).Field("twilio_to", to).FieldIf("twilio_body", body, log.TraceLevel).Debug("Sending Twilio SMS request")
+	response, err := s.callPhoneInternal("Messages.json", data)
+	if err != nil {
+		ev.Field("twilio_response", response).Err(err).Warn("Error sending Twilio SMS request")
+		s.integrationFailed("twilio", m, err)
+		minc(metricSMSSentFailure)
+		return
+	}
+	ev.FieldIf("twilio_response", response, log.TraceLevel).Debug("Received successful Twilio SMS response")
+	minc(metricSMSSentSuccess)
+}
+
+// maybeTruncateSMSBody truncates the text message body to twilioSMSBodyLimit characters (with ellipsis), since
+// Twilio rejects longer messages entirely
+func maybeTruncateSMSBody(s string) string {
+	runes := []rune(s)
+	if len(runes) > twilioSMSBodyLimit {
+		return string(runes[:twilioSMSBodyLimit-3]) + "..."
+	}
+	return s
+}
+
+func (s *Server) callPhoneInternal(resource string, data url.Values) (string, error) {
+	conf := s.config()
+	requestURL := fmt.Sprintf("%s/2010-04-01/Accounts/%s/%s", conf.TwilioCallsBaseURL, conf.TwilioAccount, resource)
 	req, err := http.NewRequest(http.MethodPost, requestURL, strings.NewReader(data.Encode()))
 	if err != nil {
 		return "", err
 	}
-	req.Header.Set("User-Agent", "ntfy/"+s.config.Version)
+	req.Header.Set("User-Agent", "ntfy/"+conf.Version)
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Set("Authorization", util.BasicAuth(s.config.TwilioAccount, s.config.TwilioAuthToken))
-	resp, err := http.DefaultClient.Do(req)
+	req.Header.Set("Authorization", util.BasicAuth(conf.TwilioAccount, conf.TwilioAuthToken))
+	resp, err := s.httpClient.Do(req)
 	if err != nil {
 		return "", err
 	}
+	defer resp.Body.Close()
 	response, err := io.ReadAll(resp.Body)
 	if err != nil {
 		return "", err
+	} else if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return string(response), fmt.Errorf("twilio request failed with status code %d", resp.StatusCode)
 	}
 	return string(response), nil
 }
 
 func (s *Server) verifyPhoneNumber(v *visitor, r *http.Request, phoneNumber, channel string) error {
+	conf := s.config()
 	ev := logvr(v, r).Tag(tagTwilio).Field("twilio_to", phoneNumber).Field("twilio_channel", channel).Debug("Sending phone verification")
 	data := url.Values{}
 	data.Set("To", phoneNumber)
 	data.Set("Channel", channel)
-	requestURL := fmt.Sprintf("%s/v2/Services/%s/Verifications", s.config.TwilioVerifyBaseURL, s.config.TwilioVerifyService)
+	requestURL := fmt.Sprintf("%s/v2/Services/%s/Verifications", conf.TwilioVerifyBaseURL, conf.TwilioVerifyService)
 	req, err := http.NewRequest(http.MethodPost, requestURL, strings.NewReader(data.Encode()))
 	if err != nil {
 		return err
 	}
-	req.Header.Set("User-Agent", "ntfy/"+s.config.Version)
+	req.Header.Set("User-Agent", "ntfy/"+conf.Version)
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Set("Authorization", util.BasicAuth(s.config.TwilioAccount, s.config.TwilioAuthToken))
-	resp, err := http.DefaultClient.Do(req)
+	req.Header.Set("Authorization", util.BasicAuth(conf.TwilioAccount, conf.TwilioAuthToken))
+	resp, err := s.httpClient.Do(req)
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 	response, err := io.ReadAll(resp.Body)
 	if err != nil {
 		ev.Err(err).Warn("Error sending Twilio phone verification request")
@@ -128,22 +181,25 @@ func (s *Server) verifyPhoneNumber(v *visitor, r *http.Request, phoneNumber, cha
 }
 
 func (s *Server) verifyPhoneNumberCheck(v *visitor, r *http.Request, phoneNumber, code string) error {
+	conf := s.config()
 	ev := logvr(v, r).Tag(tagTwilio).Field("twilio_to", phoneNumber).Debug("Checking phone verification")
 	data := url.Values{}
 	data.Set("To", phoneNumber)
 	data.Set("Code", code)
-	requestURL := fmt.Sprintf("%s/v2/Services/%s/VerificationCheck", s.config.TwilioVerifyBaseURL, s.config.TwilioVerifyService)
+	requestURL := fmt.Sprintf("%s/v2/Services/%s/VerificationCheck", conf.TwilioVerifyBaseURL, conf.TwilioVerifyService)
 	req, err := http.NewRequest(http.MethodPost, requestURL, strings.NewReader(data.Encode()))
 	if err != nil {
 		return err
 	}
-	req.Header.Set("User-Agent", "ntfy/"+s.config.Version)
+	req.Header.Set("User-Agent", "ntfy/"+conf.Version)
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Set("Authorization", util.BasicAuth(s.config.TwilioAccount, s.config.TwilioAuthToken))
-	resp, err := http.DefaultClient.Do(req)
+	req.Header.Set("Authorization", util.BasicAuth(conf.TwilioAccount, conf.TwilioAuthToken))
+	resp, err := s.httpClient.Do(req)
 	if err != nil {
 		return err
-	} else if resp.StatusCode != http.StatusOK {
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
 		if ev.IsTrace() {
 			response, err := io.ReadAll(resp.Body)
 			if err != nil {
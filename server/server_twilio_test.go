@@ -7,8 +7,10 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"sync/atomic"
 	"testing"
+	"unicode/utf8"
 )
 
 func TestServer_Twilio_Call_Add_Verify_Call_Delete_Success(t *testing.T) {
@@ -157,6 +159,113 @@ func TestServer_Twilio_Call_Success(t *testing.T) {
 	})
 }
 
+func TestServer_Twilio_Call_SMS_Success(t *testing.T) {
+	var called atomic.Bool
+	twilioServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if called.Load() {
+			t.Fatal("Should be only called once")
+		}
+		body, err := io.ReadAll(r.Body)
+		require.Nil(t, err)
+		require.Equal(t, "/2010-04-01/Accounts/AC1234567890/Messages.json", r.URL.Path)
+		require.Equal(t, "Basic QUMxMjM0NTY3ODkwOkFBRUFBMTIzNDU2Nzg5MA==", r.Header.Get("Authorization"))
+		require.Equal(t, "Body=ntfy+message+on+topic+mytopic+from+phil%3A+alert%3A+hi+there&From=%2B1234567890&To=%2B11122233344", string(body))
+		called.Store(true)
+	}))
+	defer twilioServer.Close()
+
+	c := newTestConfigWithAuthFile(t)
+	c.TwilioCallsBaseURL = twilioServer.URL
+	c.TwilioAccount = "AC1234567890"
+	c.TwilioAuthToken = "AAEAA1234567890"
+	c.TwilioPhoneNumber = "+1234567890"
+	s := newTestServer(t, c)
+
+	// Add tier and user
+	require.Nil(t, s.userManager.AddTier(&user.Tier{
+		Code:         "pro",
+		MessageLimit: 10,
+		CallLimit:    1,
+	}))
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.ChangeTier("phil", "pro"))
+	u, err := s.userManager.User("phil")
+	require.Nil(t, err)
+	require.Nil(t, s.userManager.AddPhoneNumber(u.ID, "+11122233344"))
+
+	// Invalid channel
+	response := request(t, s, "POST", "/mytopic", "hi there", map[string]string{
+		"authorization":  util.BasicAuth("phil", "phil"),
+		"x-call":         "+11122233344",
+		"x-call-channel": "fax",
+	})
+	require.Equal(t, 40048, toHTTPError(t, response.Body.String()).Code)
+
+	// Do the thing
+	response = request(t, s, "POST", "/mytopic", "hi there", map[string]string{
+		"authorization":  util.BasicAuth("phil", "phil"),
+		"x-title":        "alert",
+		"x-call":         "+11122233344",
+		"x-call-channel": "sms",
+	})
+	require.Equal(t, "hi there", toMessage(t, response.Body.String()).Message)
+	waitFor(t, func() bool {
+		return called.Load()
+	})
+}
+
+func TestServer_Twilio_Call_SMS_TruncatedAndFailed(t *testing.T) {
+	var body atomic.Value
+	twilioServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Nil(t, r.ParseForm())
+		body.Store(r.PostForm.Get("Body"))
+		w.WriteHeader(http.StatusBadRequest) // Twilio rejects the message, e.g. because the number cannot receive SMS
+		_, _ = w.Write([]byte(`{"code":21614,"message":"not a valid mobile number"}`))
+	}))
+	defer twilioServer.Close()
+
+	c := newTestConfigWithAuthFile(t)
+	c.TwilioCallsBaseURL = twilioServer.URL
+	c.TwilioAccount = "AC1234567890"
+	c.TwilioAuthToken = "AAEAA1234567890"
+	c.TwilioPhoneNumber = "+1234567890"
+	c.ServerEventsTopic = "ntfy-events"
+	s := newTestServer(t, c)
+
+	// Add tier and user
+	require.Nil(t, s.userManager.AddTier(&user.Tier{
+		Code:         "pro",
+		MessageLimit: 10,
+		CallLimit:    1,
+	}))
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleUser))
+	require.Nil(t, s.userManager.ChangeTier("phil", "pro"))
+	u, err := s.userManager.User("phil")
+	require.Nil(t, err)
+	require.Nil(t, s.userManager.AddPhoneNumber(u.ID, "+11122233344"))
+
+	// Long messages are truncated to the Twilio limit
+	response := request(t, s, "POST", "/mytopic", strings.Repeat("ü", 1700), map[string]string{
+		"authorization":  util.BasicAuth("phil", "phil"),
+		"x-call":         "+11122233344",
+		"x-call-channel": "sms",
+	})
+	require.Equal(t, 200, response.Code)
+	waitFor(t, func() bool {
+		return body.Load() != nil
+	})
+	sms := body.Load().(string)
+	require.Equal(t, twilioSMSBodyLimit, utf8.RuneCountInString(sms))
+	require.True(t, strings.HasPrefix(sms, "ntfy message on topic mytopic from phil: üü"))
+	require.True(t, strings.HasSuffix(sms, "ü..."))
+
+	// Error responses from Twilio are reported as integration failures
+	waitFor(t, func() bool {
+		response := request(t, s, "GET", "/ntfy-events/json?poll=1", "", nil)
+		return strings.Contains(response.Body.String(), "status code 400")
+	})
+}
+
 func TestServer_Twilio_Call_Success_With_Yes(t *testing.T) {
 	var called atomic.Bool
 	twilioServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UnifiedPush endpoints are "up*" topics, one per app and device, to which app servers publish messages with
+// ?up=1 (see https://unifiedpush.org/developers/spec/server/). In addition to the regular publishing params, ntfy
+// supports the following Web Push headers (RFC 8030) for UnifiedPush messages, as required by UnifiedPush v2:
+//
+//   - TTL: <seconds> limits how long the message is cached; with "TTL: 0", it is only delivered to active subscribers
+//   - Urgency: very-low|low|normal|high is mapped to the message priority, unless a priority is set explicitly
+//
+// Each endpoint can be rate limited independently of the publishing visitor (unifiedpush-endpoint-limit-burst and
+// unifiedpush-endpoint-limit-replenish), so that a single misbehaving app server cannot exhaust the rate limits of
+// the subscriber (see visitor-subscriber-rate-limiting). Per-endpoint message counts are kept in memory for the
+// last few days (see topic.upMessages), and can be listed via /v1/account/up-endpoints.
+
+var (
+	// unifiedPushUrgencyPriorities maps the Urgency header (RFC 8030, section 5.3) to a message priority
+	unifiedPushUrgencyPriorities = map[string]int{
+		"very-low": 1,
+		"low":      2,
+		"normal":   3,
+		"high":     4,
+	}
+)
+
+// applyUnifiedPushHeaders applies the TTL and Urgency headers to a UnifiedPush message, and returns whether the
+// message should be cached. Invalid values are ignored rather than rejected, since some app servers remove the
+// subscription if a 4xx status code is returned (see handlePublishInternal).
+func applyUnifiedPushHeaders(r *http.Request, m *message, cache bool) bool {
+	if priority, ok := unifiedPushUrgencyPriorities[strings.ToLower(strings.TrimSpace(r.Header.Get("Urgency")))]; ok && m.Priority == 0 {
+		m.Priority = priority
+	}
+	ttl, err := strconv.ParseInt(strings.TrimSpace(r.Header.Get("TTL")), 10, 64)
+	if err != nil || ttl < 0 {
+		return cache
+	} else if ttl == 0 {
+		m.Expires = 0
+		return false
+	}
+	if cache {
+		if expires := time.Unix(m.Time, 0).Add(time.Duration(ttl) * time.Second).Unix(); expires < m.Expires {
+			m.Expires = expires
+		}
+	}
+	return cache
+}
+
+// handleAccountUnifiedPushEndpoints lists the UnifiedPush endpoints (topics) the current user is subscribed to,
+// along with the number of messages per day
+func (s *Server) handleAccountUnifiedPushEndpoints(w http.ResponseWriter, _ *http.Request, v *visitor) error {
+	u := v.User()
+	topics := make([]*topic, 0)
+	for _, t := range s.topics.Values() {
+		if isUnifiedPushTopic(t.ID) && t.SubscribedBy(u.ID) {
+			topics = append(topics, t)
+		}
+	}
+	sort.Slice(topics, func(i, j int) bool {
+		return topics[i].ID < topics[j].ID
+	})
+	today := time.Now().Format(time.DateOnly)
+	endpoints := make([]*apiAccountUnifiedPushEndpoint, 0, len(topics))
+	for _, t := range topics {
+		counts := t.UnifiedPushMessages()
+		days := make([]*apiAccountUnifiedPushEndpointDay, 0, len(counts))
+		for day, count := range counts {
+			days = append(days, &apiAccountUnifiedPushEndpointDay{
+				Date:     day,
+				Messages: count,
+			})
+		}
+		sort.Slice(days, func(i, j int) bool {
+			return days[i].Date > days[j].Date
+		})
+		subscribers, lastAccess := t.Stats()
+		endpoints = append(endpoints, &apiAccountUnifiedPushEndpoint{
+			Topic:         t.ID,
+			Subscribers:   subscribers,
+			MessagesToday: counts[today],
+			Days:          days,
+			LastAccess:    lastAccess.Unix(),
+		})
+	}
+	return s.writeJSON(w, &apiAccountUnifiedPushEndpointsResponse{
+		Endpoints: endpoints,
+	})
+}
+
+// isUnifiedPushTopic returns true if the topic looks like a topic generated by a UnifiedPush distributor
+func isUnifiedPushTopic(id string) bool {
+	return strings.HasPrefix(id, unifiedPushTopicPrefix) && len(id) == unifiedPushTopicLength
+}
@@ -0,0 +1,306 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Resumable (chunked) uploads allow clients on flaky connections to upload large attachments in multiple
+// requests, loosely following the tus protocol (https://tus.io):
+//
+//  1. POST /v1/attachments with an Upload-Length header reserves space and returns an upload ID
+//  2. PATCH /v1/attachments/<id> with an Upload-Offset header appends a chunk; HEAD returns the current offset
+//  3. PUT /mytopic with an X-Upload: <id> header publishes a message with the completed upload as attachment
+//
+// Upload state is kept in memory (see Server.uploads), and incomplete uploads are deleted after
+// attachmentUploadExpiry without any activity.
+
+const (
+	attachmentUploadExpiry    = time.Hour // Incomplete uploads without activity are removed after this time
+	attachmentUploadPeekBytes = 4096      // Number of bytes used to detect the content type of a completed upload
+)
+
+// attachmentUpload is an in-progress upload, see handleAttachmentUploadCreate
+type attachmentUpload struct {
+	ID      string
+	Owner   string // Visitor that created the upload, see uploadOwner
+	Name    string // Filename, may be overridden when publishing
+	Length  int64  // Total size, as announced via Upload-Length
+	Offset  int64  // Bytes received so far
+	Expires time.Time
+	mu      sync.Mutex // Serializes chunks
+}
+
+// Context returns fields for the log
+func (u *attachmentUpload) Context() log.Context {
+	return log.Context{
+		"upload_id":     u.ID,
+		"upload_length": u.Length,
+		"upload_offset": u.Offset,
+	}
+}
+
+func (s *Server) handleAttachmentUploadCreate(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	if s.fileCache == nil || s.config().BaseURL == "" {
+		return errHTTPBadRequestAttachmentsDisallowed
+	} else if s.diskSpaceLow.Load() {
+		return errHTTPInsufficientStorageDiskSpace
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		return errHTTPBadRequestUploadLengthInvalid
+	}
+	vinfo, err := v.Info()
+	if err != nil {
+		return err
+	}
+	upload := &attachmentUpload{
+		ID:      util.RandomString(messageIDLength),
+		Owner:   uploadOwner(v),
+		Name:    readParam(r, "x-filename", "filename", "file", "f"),
+		Length:  length,
+		Expires: time.Now().Add(attachmentUploadExpiry),
+	}
+	// Other in-progress uploads of this visitor count towards the total attachment size limit, so that
+	// the limit cannot be bypassed by starting many uploads at once
+	s.mu.Lock()
+	reserved := s.uploadBytesReservedNoLock(upload.Owner)
+	if length > vinfo.Limits.AttachmentFileSizeLimit || length > vinfo.Stats.AttachmentTotalSizeRemaining-reserved || length > s.fileCache.Remaining() {
+		s.mu.Unlock()
+		return errHTTPEntityTooLargeAttachment.Fields(log.Context{
+			"upload_length":                   length,
+			"upload_bytes_reserved":           reserved,
+			"attachment_total_size_remaining": vinfo.Stats.AttachmentTotalSizeRemaining,
+			"attachment_file_size_limit":      vinfo.Limits.AttachmentFileSizeLimit,
+		})
+	}
+	s.uploads[upload.ID] = upload
+	s.mu.Unlock()
+	if err := s.fileCache.CreateUpload(upload.ID); err != nil {
+		s.mu.Lock()
+		delete(s.uploads, upload.ID)
+		s.mu.Unlock()
+		return err
+	}
+	logvr(v, r).Tag(tagFileCache).With(upload).Debug("Created upload %s", upload.ID)
+	w.Header().Set("Location", fmt.Sprintf("%s/%s", apiAttachmentsPath, upload.ID))
+	return s.writeUploadResponse(w, upload)
+}
+
+func (s *Server) handleAttachmentUploadHead(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	upload, err := s.uploadFromPath(r, v)
+	if err != nil {
+		return err
+	}
+	upload.mu.Lock()
+	defer upload.mu.Unlock()
+	w.Header().Set("Access-Control-Allow-Origin", s.config().AccessControlAllowOrigin) // CORS, allow cross-origin requests
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	return nil
+}
+
+func (s *Server) handleAttachmentUploadPatch(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	upload, err := s.uploadFromPath(r, v)
+	if err != nil {
+		return err
+	} else if s.diskSpaceLow.Load() {
+		return errHTTPInsufficientStorageDiskSpace.With(upload)
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		return errHTTPBadRequestUploadOffsetInvalid
+	}
+	upload.mu.Lock()
+	defer upload.mu.Unlock()
+	if offset != upload.Offset {
+		return errHTTPConflictUploadOffset.With(upload)
+	}
+	limiters := []util.Limiter{
+		v.BandwidthLimiter(),
+		util.NewFixedLimiter(upload.Length - upload.Offset),
+	}
+	upload.Offset, err = s.fileCache.AppendUpload(upload.ID, offset, r.Body, limiters...)
+	upload.Expires = time.Now().Add(attachmentUploadExpiry)
+	if errors.Is(err, util.ErrLimitReached) {
+		return errHTTPEntityTooLargeAttachment.With(upload)
+	} else if errors.Is(err, errUploadOffset) {
+		return errHTTPConflictUploadOffset.With(upload)
+	} else if err != nil {
+		return err
+	}
+	logvr(v, r).Tag(tagFileCache).With(upload).Debug("Received chunk for upload %s", upload.ID)
+	return s.writeUploadResponse(w, upload)
+}
+
+func (s *Server) handleAttachmentUploadDelete(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	upload, err := s.uploadFromPath(r, v)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	delete(s.uploads, upload.ID)
+	s.mu.Unlock()
+	if err := s.fileCache.RemoveUploads(upload.ID); err != nil {
+		return err
+	}
+	return s.writeJSON(w, newSuccessResponse())
+}
+
+// handleBodyAsUploadedAttachment attaches a completed upload to the message, and treats the body as the message
+func (s *Server) handleBodyAsUploadedAttachment(r *http.Request, v *visitor, m *message, uploadID string, body *util.PeekedReadCloser) error {
+	conf := s.config()
+	if s.fileCache == nil || conf.BaseURL == "" {
+		return errHTTPBadRequestAttachmentsDisallowed.With(m)
+	} else if m.Attachment != nil && m.Attachment.URL != "" {
+		return errHTTPBadRequestUploadWithAttachURL.With(m)
+	} else if !s.attachmentTopicAllowed(m.Topic) {
+		return errHTTPBadRequestAttachmentTopicDenied.With(m)
+	} else if !s.topicPermitted(v, m.Topic, user.PermissionAttach) {
+		return errHTTPForbiddenAttachmentsNotPermitted.With(m)
+	}
+	upload, err := s.upload(uploadID, v)
+	if err != nil {
+		return err
+	}
+	upload.mu.Lock()
+	defer upload.mu.Unlock()
+	if upload.Offset != upload.Length {
+		return errHTTPBadRequestUploadIncomplete.With(m, upload)
+	}
+	vinfo, err := v.Info()
+	if err != nil {
+		return err
+	}
+	attachmentExpiry := attachmentExpires(vinfo, m)
+	if m.Time > attachmentExpiry {
+		return errHTTPBadRequestAttachmentsExpiryBeforeDelivery.With(m)
+	}
+	peeked, err := s.fileCache.PeekUpload(upload.ID, attachmentUploadPeekBytes)
+	if err != nil {
+		return err
+	}
+	if m.Attachment == nil {
+		m.Attachment = &attachment{}
+	}
+	if m.Attachment.Name == "" {
+		m.Attachment.Name = upload.Name
+	}
+	var ext string
+	m.Attachment.Expires = attachmentExpiry
+	m.Attachment.Type, ext = util.DetectContentType(peeked, m.Attachment.Name)
+	m.Attachment.URL = fmt.Sprintf("%s/file/%s%s", conf.BaseURL, m.ID, ext)
+	if m.Attachment.Name == "" {
+		m.Attachment.Name = fmt.Sprintf("attachment%s", ext)
+	}
+	if !s.attachmentTypeAllowed(m.Attachment.Type, ext, m.Attachment.Name) {
+		return errHTTPBadRequestAttachmentTypeDenied.With(m).Fields(log.Context{"attachment_type": m.Attachment.Type})
+	}
+	if err := s.handleBodyAsTextMessage(m, body); err != nil {
+		return err
+	}
+	m.Attachment.Size, err = s.fileCache.CommitUpload(upload.ID, m.ID)
+	s.mu.Lock()
+	delete(s.uploads, upload.ID) // Upload is gone, either committed or rejected by the scanner
+	s.mu.Unlock()
+	if errors.Is(err, errFileInfected) {
+		logvrm(v, r, m).Tag(tagFileCache).Err(err).Warn("Rejecting upload, virus scanner found malware")
+		return errHTTPBadRequestAttachmentInfected.With(m)
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// pruneUploads removes incomplete uploads that have not been written to in attachmentUploadExpiry,
+// as well as leftover upload files from before a restart
+func (s *Server) pruneUploads() {
+	if s.fileCache == nil {
+		return
+	}
+	s.mu.RLock()
+	uploads := make([]*attachmentUpload, 0, len(s.uploads))
+	for _, upload := range s.uploads {
+		uploads = append(uploads, upload)
+	}
+	s.mu.RUnlock()
+	expired := make([]string, 0)
+	for _, upload := range uploads {
+		upload.mu.Lock()
+		if time.Now().After(upload.Expires) {
+			expired = append(expired, upload.ID)
+		}
+		upload.mu.Unlock()
+	}
+	if len(expired) > 0 {
+		s.mu.Lock()
+		for _, id := range expired {
+			delete(s.uploads, id)
+		}
+		s.mu.Unlock()
+		if err := s.fileCache.RemoveUploads(expired...); err != nil {
+			log.Tag(tagManager).Err(err).Warn("Error deleting expired uploads")
+		}
+	}
+	if err := s.fileCache.RemoveStaleUploads(attachmentUploadExpiry); err != nil {
+		log.Tag(tagManager).Err(err).Warn("Error deleting stale uploads")
+	}
+}
+
+// uploadFromPath returns the upload referenced in the request path, if it belongs to the visitor
+func (s *Server) uploadFromPath(r *http.Request, v *visitor) (*attachmentUpload, error) {
+	matches := apiAttachmentsUploadRegex.FindStringSubmatch(r.URL.Path)
+	if len(matches) != 2 {
+		return nil, errHTTPInternalErrorInvalidPath
+	}
+	return s.upload(matches[1], v)
+}
+
+// upload returns the upload with the given ID, if it belongs to the visitor. Uploads of other visitors
+// are treated as if they did not exist.
+func (s *Server) upload(id string, v *visitor) (*attachmentUpload, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	upload, ok := s.uploads[id]
+	if !ok || upload.Owner != uploadOwner(v) {
+		return nil, errHTTPNotFoundUpload
+	}
+	return upload, nil
+}
+
+func (s *Server) uploadBytesReservedNoLock(owner string) int64 {
+	var reserved int64
+	for _, upload := range s.uploads {
+		if upload.Owner == owner {
+			reserved += upload.Length
+		}
+	}
+	return reserved
+}
+
+func (s *Server) writeUploadResponse(w http.ResponseWriter, upload *attachmentUpload) error {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	return s.writeJSON(w, &apiAttachmentUploadResponse{
+		ID:      upload.ID,
+		Length:  upload.Length,
+		Offset:  upload.Offset,
+		Expires: upload.Expires.Unix(),
+	})
+}
+
+// uploadOwner returns the owner of an upload. Unlike visitorID, users without a tier are identified by
+// their user ID as well, since attachments are always associated with the user, see handlePublishInternal.
+func uploadOwner(v *visitor) string {
+	if u := v.User(); u != nil {
+		return fmt.Sprintf("user:%s", u.ID)
+	}
+	return fmt.Sprintf("ip:%s", v.IP().String())
+}
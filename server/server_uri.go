@@ -0,0 +1,142 @@
+package server
+
+import (
+	"fmt"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// One-click subscribe links let users subscribe to a topic from emails, wikis, etc. They point to the /subscribe
+// endpoint, and pass an ntfy:// URI (see docs/subscribe/phone.md#ntfy-links), e.g.
+//
+//	https://ntfy.example.com/subscribe?uri=ntfy://ntfy.example.com/mytopic
+//
+//   - GET /subscribe?uri=<uri> redirects to the topic in the web app, which subscribes to it (and adds it to the
+//     account of the logged-in user)
+//   - POST /subscribe?uri=<uri> adds the topic to the subscriptions of the logged-in user, and returns the subscription
+//
+// The web app manifest registers the web+ntfy:// scheme to the GET endpoint, so that installed web apps can open
+// web+ntfy:// links directly. Access tokens in the URI (token=...) are meant for the Android app, and are ignored here,
+// since the web app and the account use the user's login.
+
+const (
+	ntfyURIScheme    = "ntfy"
+	ntfyURIWebScheme = "web+ntfy" // Custom schemes in browsers must be prefixed with "web+"
+)
+
+// ntfyURI is a parsed ntfy:// URI, e.g. ntfy://ntfy.example.com/mytopic?secure=false&display=Alerts
+type ntfyURI struct {
+	BaseURL     string // Derived from host and "secure" parameter, e.g. https://ntfy.example.com
+	Topic       string
+	DisplayName string
+}
+
+// parseNtfyURI parses an ntfy:// (or web+ntfy://) URI, see ntfyURI
+func parseNtfyURI(uri string) (*ntfyURI, error) {
+	u, err := url.Parse(strings.TrimSpace(uri))
+	if err != nil {
+		return nil, errHTTPBadRequestNtfyURIInvalid
+	} else if u.Scheme != ntfyURIScheme && u.Scheme != ntfyURIWebScheme {
+		return nil, errHTTPBadRequestNtfyURIInvalid
+	} else if u.Host == "" || u.User != nil {
+		return nil, errHTTPBadRequestNtfyURIInvalid
+	}
+	topic := strings.TrimPrefix(u.Path, "/")
+	if !topicRegex.MatchString(topic) {
+		return nil, errHTTPBadRequestTopicInvalid
+	}
+	scheme := "https"
+	if secure := u.Query().Get("secure"); secure != "" && !util.Contains([]string{"true", "yes", "1"}, strings.ToLower(secure)) {
+		scheme = "http"
+	}
+	return &ntfyURI{
+		BaseURL:     fmt.Sprintf("%s://%s", scheme, u.Host),
+		Topic:       topic,
+		DisplayName: strings.TrimSpace(u.Query().Get("display")),
+	}, nil
+}
+
+// handleSubscribeURI redirects to the topic of the ntfy:// URI in the web app, see above
+func (s *Server) handleSubscribeURI(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	uri, err := s.readNtfyURI(r, v)
+	if err != nil {
+		return err
+	}
+	location := "/" + uri.Topic
+	if !s.isLocalBaseURL(r, uri.BaseURL) {
+		// The web app only supports HTTPS for other servers, see subscriptionExternal route
+		location = fmt.Sprintf("/%s/%s", strings.TrimPrefix(strings.TrimPrefix(uri.BaseURL, "https://"), "http://"), uri.Topic)
+	}
+	http.Redirect(w, r, location, http.StatusFound)
+	return nil
+}
+
+// handleSubscribeURIAccount adds the topic of the ntfy:// URI to the subscriptions of the logged-in user, see above.
+// Unlike handleAccountSubscriptionAdd, an existing subscription is not an error, so that links can be clicked twice.
+func (s *Server) handleSubscribeURIAccount(w http.ResponseWriter, r *http.Request, v *visitor) error {
+	uri, err := s.readNtfyURI(r, v)
+	if err != nil {
+		return err
+	}
+	u := v.User()
+	prefs := u.Prefs
+	if prefs == nil {
+		prefs = &user.Prefs{}
+	}
+	for _, subscription := range prefs.Subscriptions {
+		if subscription.BaseURL == uri.BaseURL && subscription.Topic == uri.Topic {
+			return s.writeJSON(w, subscription)
+		}
+	}
+	newSubscription := &user.Subscription{
+		BaseURL: uri.BaseURL,
+		Topic:   uri.Topic,
+	}
+	if uri.DisplayName != "" {
+		newSubscription.DisplayName = &uri.DisplayName
+	}
+	prefs.Subscriptions = append(prefs.Subscriptions, newSubscription)
+	logvr(v, r).Tag(tagAccount).With(newSubscription).Debug("Adding subscription via ntfy:// URI for user %s", u.Name)
+	if err := s.userManager.ChangeSettings(u.ID, prefs); err != nil {
+		return err
+	}
+	return s.writeJSON(w, newSubscription)
+}
+
+// readNtfyURI reads and parses the "uri" parameter. Topics on this server are checked against the disallowed
+// topics and the visitor's permissions, so that links to topics the visitor cannot read fail early.
+func (s *Server) readNtfyURI(r *http.Request, v *visitor) (*ntfyURI, error) {
+	conf := s.config()
+	uri, err := parseNtfyURI(readParam(r, "x-uri", "uri"))
+	if err != nil {
+		return nil, err
+	}
+	if s.isLocalBaseURL(r, uri.BaseURL) {
+		if util.Contains(conf.DisallowedTopics, uri.Topic) {
+			return nil, errHTTPBadRequestTopicDisallowed
+		} else if !s.topicPermitted(v, uri.Topic, user.PermissionRead) {
+			return nil, errHTTPForbidden
+		}
+		if conf.BaseURL != "" {
+			uri.BaseURL = conf.BaseURL // Same base URL as the web app, e.g. http:// if secure=false was omitted
+		}
+	}
+	return uri, nil
+}
+
+// isLocalBaseURL returns true if the given base URL refers to this server, i.e. if it matches base-url (or the
+// host of the request, if base-url is not set). The scheme is ignored, since ntfy:// URIs default to HTTPS.
+func (s *Server) isLocalBaseURL(r *http.Request, baseURL string) bool {
+	conf := s.config()
+	host := r.Host
+	if conf.BaseURL != "" {
+		if u, err := url.Parse(conf.BaseURL); err == nil {
+			host = u.Host
+		}
+	}
+	u, err := url.Parse(baseURL)
+	return err == nil && strings.EqualFold(u.Host, host)
+}
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestVerifyWebhookSignature(t *testing.T) {
+	body := []byte(`{"id":"evt_1234"}`)
+	now := time.Now().Unix()
+
+	// Valid signature
+	header := webhookSignatureHeader(now, body, "secret")
+	require.Nil(t, verifyWebhookSignature(header, body, []string{"secret"}, webhookSignatureTolerance))
+
+	// Multiple signatures (e.g. during secret rotation), one of them valid
+	header += ",v1=abcdef"
+	require.Nil(t, verifyWebhookSignature(header, body, []string{"secret"}, webhookSignatureTolerance))
+
+	// Multiple valid secrets (e.g. during key rotation), one of them matches
+	require.Nil(t, verifyWebhookSignature(header, body, []string{"new secret", "secret"}, webhookSignatureTolerance))
+
+	// Wrong secret, modified body, or missing/malformed header
+	header = webhookSignatureHeader(now, body, "secret")
+	require.Equal(t, errWebhookSignatureInvalid, verifyWebhookSignature(header, body, []string{"other secret"}, webhookSignatureTolerance))
+	require.Equal(t, errWebhookSignatureInvalid, verifyWebhookSignature(header, []byte(`{"id":"evt_5678"}`), []string{"secret"}, webhookSignatureTolerance))
+	require.Equal(t, errWebhookSignatureMissing, verifyWebhookSignature("", body, []string{"secret"}, webhookSignatureTolerance))
+	require.Equal(t, errWebhookSignatureInvalid, verifyWebhookSignature("v1=abcdef", body, []string{"secret"}, webhookSignatureTolerance))
+
+	// Replayed (old) signature
+	header = webhookSignatureHeader(now-int64((10*time.Minute).Seconds()), body, "secret")
+	require.Equal(t, errWebhookSignatureExpired, verifyWebhookSignature(header, body, []string{"secret"}, webhookSignatureTolerance))
+}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"regexp"
@@ -49,6 +50,10 @@ func (s *Server) handleWebPushUpdate(w http.ResponseWriter, r *http.Request, v *
 	topics, err := s.topicsFromIDs(req.Topics...)
 	if err != nil {
 		return err
+	} else if err := s.checkBanned(v); err != nil {
+		return err
+	} else if err := s.checkNetworkRules(v, user.PermissionRead); err != nil {
+		return err
 	}
 	if s.userManager != nil {
 		u := v.User()
@@ -83,20 +88,32 @@ func (s *Server) publishToWebPushEndpoints(v *visitor, m *message) {
 		return
 	}
 	log.Tag(tagWebPush).With(v, m).Debug("Publishing web push message to %d subscribers", len(subscriptions))
-	payload, err := json.Marshal(newWebPushPayload(fmt.Sprintf("%s/%s", s.config.BaseURL, m.Topic), m))
+	payload, err := json.Marshal(newWebPushPayload(fmt.Sprintf("%s/%s", s.config().BaseURL, m.Topic), s.signAttachmentURL(m)))
 	if err != nil {
 		log.Tag(tagWebPush).Err(err).With(v, m).Warn("Unable to marshal expiring payload")
 		return
 	}
+	var failed int
+	var lastErr error
 	for _, subscription := range subscriptions {
+		if !s.webPushRoutingAllows(subscription, m) {
+			logvm(v, m).Tag(tagWebPush).With(subscription).Debug("Routing preferences of subscriber suppressed web push message")
+			continue
+		}
 		if err := s.sendWebPushNotification(subscription, payload, v, m); err != nil {
 			log.Tag(tagWebPush).Err(err).With(v, m, subscription).Warn("Unable to publish web push message")
+			failed, lastErr = failed+1, err
 		}
 	}
+	if failed > 0 {
+		err := fmt.Errorf("%d of %d subscription(s) failed, last error: %w", failed, len(subscriptions), lastErr)
+		s.publishDeadLetter(m, deadLetterChannelWebPush, err)
+		s.integrationFailed(deadLetterChannelWebPush, m, err)
+	}
 }
 
 func (s *Server) pruneAndNotifyWebPushSubscriptions() {
-	if s.config.WebPushPublicKey == "" {
+	if s.config().WebPushPublicKey == "" {
 		return
 	}
 	go func() {
@@ -107,12 +124,13 @@ func (s *Server) pruneAndNotifyWebPushSubscriptions() {
 }
 
 func (s *Server) pruneAndNotifyWebPushSubscriptionsInternal() error {
+	conf := s.config()
 	// Expire old subscriptions
-	if err := s.webPush.RemoveExpiredSubscriptions(s.config.WebPushExpiryDuration); err != nil {
+	if err := s.webPush.RemoveExpiredSubscriptions(conf.WebPushExpiryDuration); err != nil {
 		return err
 	}
 	// Notify subscriptions that will expire soon
-	subscriptions, err := s.webPush.SubscriptionsExpiring(s.config.WebPushExpiryWarningDuration)
+	subscriptions, err := s.webPush.SubscriptionsExpiring(conf.WebPushExpiryWarningDuration)
 	if err != nil {
 		return err
 	} else if len(subscriptions) == 0 {
@@ -138,6 +156,7 @@ func (s *Server) pruneAndNotifyWebPushSubscriptionsInternal() error {
 }
 
 func (s *Server) sendWebPushNotification(sub *webPushSubscription, message []byte, contexters ...log.Contexter) error {
+	conf := s.config()
 	log.Tag(tagWebPush).With(sub).With(contexters...).Debug("Sending web push message")
 	payload := &webpush.Subscription{
 		Endpoint: sub.Endpoint,
@@ -147,19 +166,24 @@ func (s *Server) sendWebPushNotification(sub *webPushSubscription, message []byt
 		},
 	}
 	resp, err := webpush.SendNotification(message, payload, &webpush.Options{
-		Subscriber:      s.config.WebPushEmailAddress,
-		VAPIDPublicKey:  s.config.WebPushPublicKey,
-		VAPIDPrivateKey: s.config.WebPushPrivateKey,
+		Subscriber:      conf.WebPushEmailAddress,
+		VAPIDPublicKey:  conf.WebPushPublicKey,
+		VAPIDPrivateKey: conf.WebPushPrivateKey,
 		Urgency:         webpush.UrgencyHigh, // iOS requires this to ensure delivery
-		TTL:             int(s.config.CacheDuration.Seconds()),
+		TTL:             int(conf.CacheDuration.Seconds()),
+		HTTPClient:      s.httpClient,
 	})
-	if err != nil {
+	if errors.Is(err, errHTTPClientCircuitOpen) {
+		log.Tag(tagWebPush).With(sub).With(contexters...).Err(err).Debug("Unable to publish web push message, push service temporarily unavailable")
+		return err
+	} else if err != nil {
 		log.Tag(tagWebPush).With(sub).With(contexters...).Err(err).Debug("Unable to publish web push message, removing endpoint")
 		if err := s.webPush.RemoveSubscriptionsByEndpoint(sub.Endpoint); err != nil {
 			return err
 		}
 		return err
 	}
+	defer resp.Body.Close()
 	if (resp.StatusCode < 200 || resp.StatusCode > 299) && resp.StatusCode != 429 {
 		log.Tag(tagWebPush).With(sub).With(contexters...).Field("response_code", resp.StatusCode).Debug("Unable to publish web push message, unexpected response")
 		if err := s.webPush.RemoveSubscriptionsByEndpoint(sub.Endpoint); err != nil {
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+)
+
+// Wildcard subscriptions let admins and users with a matching access control entry subscribe to all topics matching
+// a topic pattern, e.g. GET /host-*/json, instead of listing every topic. Patterns can be mixed with regular topics
+// (e.g. /alerts,host-*/json). Messages carry their originating topic in the "topic" field, as always.
+//
+// Patterns are authorized in autorizeTopic (see user.Manager.AuthorizeTopicPattern): Users need an entry that covers
+// the entire pattern (e.g. "host-*" or "*"); the default access does not apply. Each matching topic is checked again
+// when it is added to the subscription, so that more specific entries (e.g. "host-secret" deny) are respected.
+// Wildcard subscriptions require access control, since otherwise anyone could read all topics.
+//
+// A wildcard subscription subscribes to all matching topics that exist in memory, and to every matching topic
+// that is created later (see topicsFromIDs). Old messages (since=...) are read from all matching cached topics.
+
+// wildcardSubscription is a subscription to all topics matching one or more topic patterns
+type wildcardSubscription struct {
+	patterns   []*regexp.Regexp
+	exclude    []string // Topics that are subscribed to explicitly
+	permitted  func(id string) bool
+	subscriber subscriber
+	userID     string
+	cancel     func()
+	topics     map[*topic]int // Topic -> subscriber ID
+	closed     bool
+	mu         sync.Mutex
+}
+
+// Matches returns true if the topic ID matches any of the patterns, and is not excluded
+func (w *wildcardSubscription) Matches(id string) bool {
+	if util.Contains(w.exclude, id) {
+		return false
+	}
+	for _, pattern := range w.patterns {
+		if pattern.MatchString(id) {
+			return true
+		}
+	}
+	return false
+}
+
+// Subscribe subscribes to the given topic if it matches and may be read, and if it is not subscribed already
+func (w *wildcardSubscription) Subscribe(t *topic) {
+	if !w.Matches(t.ID) || !w.permitted(t.ID) {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.topics[t]; ok || w.closed {
+		return
+	}
+	w.topics[t] = t.Subscribe(w.subscriber, w.userID, w.cancel)
+}
+
+// Unsubscribe unsubscribes from all topics; the subscription cannot be used afterwards
+func (w *wildcardSubscription) Unsubscribe() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for t, subscriberID := range w.topics {
+		t.Unsubscribe(subscriberID)
+	}
+	w.topics = make(map[*topic]int)
+	w.closed = true
+}
+
+// wildcardSubscriptions is the list of active wildcard subscriptions
+type wildcardSubscriptions struct {
+	subscriptions map[*wildcardSubscription]struct{}
+	mu            sync.RWMutex
+}
+
+func newWildcardSubscriptions() *wildcardSubscriptions {
+	return &wildcardSubscriptions{
+		subscriptions: make(map[*wildcardSubscription]struct{}),
+	}
+}
+
+func (w *wildcardSubscriptions) Add(subscription *wildcardSubscription) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.subscriptions[subscription] = struct{}{}
+}
+
+func (w *wildcardSubscriptions) Remove(subscription *wildcardSubscription) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.subscriptions, subscription)
+}
+
+// TopicCreated adds a newly created topic to all matching wildcard subscriptions
+func (w *wildcardSubscriptions) TopicCreated(t *topic) {
+	w.mu.RLock()
+	subscriptions := make([]*wildcardSubscription, 0, len(w.subscriptions))
+	for subscription := range w.subscriptions {
+		subscriptions = append(subscriptions, subscription)
+	}
+	w.mu.RUnlock()
+	for _, subscription := range subscriptions {
+		subscription.Subscribe(t)
+	}
+}
+
+// subscribeWildcards creates a wildcard subscription for the given patterns, and subscribes to all matching topics.
+// Topics that are created later are added in topicsFromIDs. It returns nil if there are no patterns.
+func (s *Server) subscribeWildcards(v *visitor, patterns []string, topics []*topic, sub subscriber, cancel func()) (*wildcardSubscription, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	patternRegexps, err := topicPatternRegexps(patterns)
+	if err != nil {
+		return nil, err
+	}
+	subscription := &wildcardSubscription{
+		patterns:   patternRegexps,
+		exclude:    topicIDsOf(topics),
+		permitted:  s.wildcardTopicPermitted(v),
+		subscriber: sub,
+		userID:     v.MaybeUserID(),
+		cancel:     cancel,
+		topics:     make(map[*topic]int),
+	}
+	s.wildcards.Add(subscription) // Before iterating the topics, so that no new topic is missed
+	for _, t := range s.topics.Values() {
+		subscription.Subscribe(t)
+	}
+	logv(v).Tag(tagSubscribe).Debug("Subscribed to topics matching %s", strings.Join(patterns, ","))
+	return subscription, nil
+}
+
+// unsubscribeWildcards removes the wildcard subscription, and unsubscribes from all topics. The subscription
+// may be nil.
+func (s *Server) unsubscribeWildcards(subscription *wildcardSubscription) {
+	if subscription == nil {
+		return
+	}
+	s.wildcards.Remove(subscription)
+	subscription.Unsubscribe()
+}
+
+// withWildcardTopics returns the given topics, plus all cached topics that match the given patterns and may be
+// read by the visitor. It is used to send old messages, see sendOldMessages.
+func (s *Server) withWildcardTopics(v *visitor, topics []*topic, patterns []string, since sinceMarker) ([]*topic, error) {
+	if len(patterns) == 0 || since.IsNone() {
+		return topics, nil
+	}
+	patternRegexps, err := topicPatternRegexps(patterns)
+	if err != nil {
+		return nil, err
+	}
+	cachedTopics, err := s.messageCache.Topics()
+	if err != nil {
+		return nil, err
+	}
+	subscription := &wildcardSubscription{
+		patterns:  patternRegexps,
+		exclude:   topicIDsOf(topics),
+		permitted: s.wildcardTopicPermitted(v),
+	}
+	result := append(make([]*topic, 0, len(topics)), topics...)
+	for id, t := range cachedTopics {
+		if subscription.Matches(id) && subscription.permitted(id) {
+			result = append(result, t)
+		}
+	}
+	return result, nil
+}
+
+// wildcardTopicPermitted returns a function that checks if the visitor may read a topic that matches a pattern
+func (s *Server) wildcardTopicPermitted(v *visitor) func(id string) bool {
+	return func(id string) bool {
+		return !s.topicDisallowed(id) && s.topicPermitted(v, id, user.PermissionRead)
+	}
+}
+
+// topicPatternsFromPath returns the topic patterns from a root path (e.g. /mytopic,host-*/json), see topicsFromPath
+func topicPatternsFromPath(path string) []string {
+	parts := strings.Split(path, "/")
+	if len(parts) < 2 {
+		return nil
+	}
+	patterns := make([]string, 0)
+	for _, id := range util.SplitNoEmpty(parts[1], ",") {
+		if isTopicPattern(id) && !util.Contains(patterns, id) {
+			patterns = append(patterns, id)
+		}
+	}
+	return patterns
+}
+
+// isTopicPattern returns true if the topic ID contains a wildcard (*)
+func isTopicPattern(id string) bool {
+	return strings.Contains(id, "*")
+}
+
+// topicPatternRegexp converts a topic pattern (e.g. "host-*") to a regular expression
+func topicPatternRegexp(pattern string) (*regexp.Regexp, error) {
+	return regexp.Compile("^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), `\*`, ".*") + "$")
+}
+
+func topicPatternRegexps(patterns []string) ([]*regexp.Regexp, error) {
+	patternRegexps := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		patternRegexp, err := topicPatternRegexp(pattern)
+		if err != nil {
+			return nil, err
+		}
+		patternRegexps = append(patternRegexps, patternRegexp)
+	}
+	return patternRegexps, nil
+}
+
+func topicIDsOf(topics []*topic) []string {
+	ids := make([]string, len(topics))
+	for i, t := range topics {
+		ids[i] = t.ID
+	}
+	return ids
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"github.com/stretchr/testify/require"
+	"heckel.io/ntfy/v2/user"
+	"heckel.io/ntfy/v2/util"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestServer_WildcardSubscription_Admin(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionReadWrite
+	s := newTestServer(t, c)
+	require.Nil(t, s.userManager.AddUser("phil", "phil", user.RoleAdmin))
+	withAuth := func(r *http.Request) {
+		r.Header.Set("Authorization", util.BasicAuth("phil", "phil"))
+	}
+
+	// Topic exists before subscribing, and has cached messages
+	require.Equal(t, 200, request(t, s, "PUT", "/host-a", "old message", nil).Code)
+	time.Sleep(100 * time.Millisecond) // Publishing is done asynchronously, this avoids races
+
+	rr := httptest.NewRecorder()
+	cancel := subscribe(t, s, "/alerts,host-*/json?since=all", rr, withAuth)
+	require.Equal(t, 200, request(t, s, "PUT", "/host-a", "disk full", nil).Code)
+	require.Equal(t, 200, request(t, s, "PUT", "/host-b", "cpu high", nil).Code) // Created after subscribing
+	require.Equal(t, 200, request(t, s, "PUT", "/alerts", "explicit", nil).Code)
+	require.Equal(t, 200, request(t, s, "PUT", "/other", "not matching", nil).Code)
+	cancel()
+
+	messages := toMessages(t, rr.Body.String())
+	require.Equal(t, 5, len(messages))
+	require.Equal(t, openEvent, messages[0].Event)
+	require.Equal(t, "alerts,host-*", messages[0].Topic)
+	received := make(map[string]string)
+	for _, m := range messages[1:] {
+		require.Equal(t, messageEvent, m.Event)
+		received[m.Message] = m.Topic
+	}
+	require.Equal(t, map[string]string{
+		"old message": "host-a",
+		"disk full":   "host-a",
+		"cpu high":    "host-b",
+		"explicit":    "alerts", // Only once
+	}, received)
+
+	// Unsubscribed from all topics
+	for _, id := range []string{"host-a", "host-b", "alerts"} {
+		topic, ok := s.topics.Get(id)
+		require.True(t, ok)
+		subscribers, _ := topic.Stats()
+		require.Equal(t, 0, subscribers)
+	}
+	require.Empty(t, s.wildcards.subscriptions)
+}
+
+func TestServer_WildcardSubscription_Grant(t *testing.T) {
+	c := newTestConfigWithAuthFile(t)
+	c.AuthDefault = user.PermissionReadWrite
+	s := newTestServer(t, c)
+	require.Nil(t, s.userManager.AddUser("ben", "ben", user.RoleUser))
+	require.Nil(t, s.userManager.AllowAccess("ben", "host-*", user.PermissionRead))
+	require.Nil(t, s.userManager.AllowAccess("ben", "host-secret", user.PermissionDenyAll))
+	headers := map[string]string{
+		"Authorization": util.BasicAuth("ben", "ben"),
+	}
+
+	require.Equal(t, 200, request(t, s, "PUT", "/host-a", "visible", nil).Code)
+	require.Equal(t, 200, request(t, s, "PUT", "/host-secret", "secret", nil).Code)
+	response := request(t, s, "GET", "/host-*/json?poll=1", "", headers)
+	require.Equal(t, 200, response.Code)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "host-a", messages[0].Topic)
+	require.Equal(t, "visible", messages[0].Message)
+
+	// Patterns must be covered by a grant, the default access does not apply
+	response = request(t, s, "GET", "/h*/json?poll=1", "", headers)
+	require.Equal(t, 403, response.Code)
+	require.Equal(t, 40309, toHTTPError(t, response.Body.String()).Code)
+	response = request(t, s, "GET", "/host-*/json?poll=1", "", nil)
+	require.Equal(t, 403, response.Code)
+	response = request(t, s, "GET", "/*/sse?poll=1", "", headers)
+	require.Equal(t, 403, response.Code)
+}
+
+func TestServer_WildcardSubscription_NoAccessControl(t *testing.T) {
+	s := newTestServer(t, newTestConfig(t))
+	response := request(t, s, "GET", "/host-*/json?poll=1", "", nil)
+	require.Equal(t, 403, response.Code)
+	require.Equal(t, 40309, toHTTPError(t, response.Body.String()).Code)
+	_, ok := s.topics.Get("host-*")
+	require.False(t, ok)
+}
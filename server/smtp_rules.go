@@ -0,0 +1,188 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"heckel.io/ntfy/v2/util"
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// SMTP routing rules let the SMTP server route incoming emails based on the recipient, the sender and the subject,
+// instead of only mapping the recipient address to a topic. This makes it possible to forward a whole mailbox to
+// ntfy, and still get clean notifications. Rules are defined via the "smtp-server-rules" config option, one rule per
+// entry, each a list of "key=value" pairs separated by semicolons, e.g.
+//
+//	to=^ntfy-backups@; subject=(?i)^\[(?P<host>[^\]]+)\] backup (?P<status>\w+); topic=backups; tags=floppy_disk; title={{.Match.host}}: {{.Match.status}}
+//
+// Conditions (all given conditions must match, a rule without conditions matches all emails):
+//   - to: regex matched against the recipient address, e.g. ntfy-backups@ntfy.sh
+//   - from: regex matched against the "From" header (or the sender address, if there is none)
+//   - subject: regex matched against the decoded subject
+//
+// Actions:
+//   - topic: topic to publish to, instead of the one derived from the recipient address
+//   - priority: message priority, e.g. "high" or "5"
+//   - tags: comma-separated list of tags
+//   - title, message: Go templates for the title and message. Available fields are .To, .From, .Subject, .Body,
+//     .Topic, and .Match, which contains the named groups of all condition regexes (e.g. {{.Match.host}})
+//
+// Rules are evaluated in order, and only the first matching rule is applied. If the recipient address is not a valid
+// topic, the email is only accepted if a rule with a topic matches.
+
+var (
+	smtpRuleKeys = []string{"to", "from", "subject", "topic", "priority", "tags", "title", "message"}
+)
+
+// smtpRule is a parsed SMTP routing rule, see above
+type smtpRule struct {
+	to       *regexp.Regexp
+	from     *regexp.Regexp
+	subject  *regexp.Regexp
+	topic    string
+	priority int
+	tags     []string
+	title    *template.Template
+	message  *template.Template
+}
+
+// smtpRuleData is the data that is passed to the title and message templates of an SMTP rule
+type smtpRuleData struct {
+	To      string
+	From    string
+	Subject string
+	Body    string
+	Topic   string
+	Match   map[string]string
+}
+
+// parseSMTPRules parses the "smtp-server-rules" config option, see above for the format
+func parseSMTPRules(rules []string) ([]*smtpRule, error) {
+	smtpRules := make([]*smtpRule, 0)
+	for _, rule := range rules {
+		r, err := parseSMTPRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SMTP rule %q: %w", rule, err)
+		}
+		smtpRules = append(smtpRules, r)
+	}
+	return smtpRules, nil
+}
+
+func parseSMTPRule(rule string) (*smtpRule, error) {
+	r := &smtpRule{}
+	var hasAction bool
+	for _, field := range strings.Split(rule, ";") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(field, "=")
+		key, value = strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(value)
+		if !ok || value == "" {
+			return nil, fmt.Errorf("expected 'key=value', got %q", field)
+		} else if !util.Contains(smtpRuleKeys, key) {
+			return nil, fmt.Errorf("unknown key %q, expected one of %s", key, strings.Join(smtpRuleKeys, ", "))
+		}
+		var err error
+		switch key {
+		case "to":
+			r.to, err = regexp.Compile(value)
+		case "from":
+			r.from, err = regexp.Compile(value)
+		case "subject":
+			r.subject, err = regexp.Compile(value)
+		case "topic":
+			if !topicRegex.MatchString(value) {
+				return nil, fmt.Errorf("invalid topic %q", value)
+			}
+			r.topic = value
+		case "priority":
+			r.priority, err = util.ParsePriority(value)
+		case "tags":
+			for _, tag := range util.SplitNoEmpty(value, ",") {
+				r.tags = append(r.tags, strings.TrimSpace(tag))
+			}
+		case "title":
+			r.title, err = parseSMTPRuleTemplate(value)
+		case "message":
+			r.message, err = parseSMTPRuleTemplate(value)
+		}
+		if err != nil {
+			return nil, err
+		}
+		hasAction = hasAction || (key != "to" && key != "from" && key != "subject")
+	}
+	if !hasAction {
+		return nil, fmt.Errorf("rule must have at least one of topic, priority, tags, title or message")
+	}
+	return r, nil
+}
+
+func parseSMTPRuleTemplate(tpl string) (*template.Template, error) {
+	if templateDisallowedRegex.MatchString(tpl) {
+		return nil, fmt.Errorf("template %q contains disallowed function calls", tpl)
+	}
+	return template.New("").Option("missingkey=zero").Parse(tpl)
+}
+
+// match returns true and the named groups of all condition regexes, if all conditions of the rule match
+func (r *smtpRule) match(to, from, subject string) (map[string]string, bool) {
+	groups := make(map[string]string)
+	for _, condition := range []struct {
+		regex *regexp.Regexp
+		value string
+	}{{r.to, to}, {r.from, from}, {r.subject, subject}} {
+		if condition.regex == nil {
+			continue
+		}
+		matches := condition.regex.FindStringSubmatch(condition.value)
+		if matches == nil {
+			return nil, false
+		}
+		for i, name := range condition.regex.SubexpNames() {
+			if name != "" {
+				groups[name] = matches[i]
+			}
+		}
+	}
+	return groups, true
+}
+
+// apply applies the actions of the rule to the message
+func (r *smtpRule) apply(m *message, data *smtpRuleData) error {
+	if r.topic != "" {
+		m.Topic = r.topic
+		data.Topic = r.topic
+	}
+	if r.priority != 0 {
+		m.Priority = r.priority
+	}
+	if len(r.tags) > 0 {
+		m.Tags = r.tags
+	}
+	if r.title != nil {
+		title, err := executeSMTPRuleTemplate(r.title, data)
+		if err != nil {
+			return err
+		}
+		m.Title = strings.TrimSpace(title)
+	}
+	if r.message != nil {
+		message, err := executeSMTPRuleTemplate(r.message, data)
+		if err != nil {
+			return err
+		}
+		m.Message = strings.TrimSpace(message)
+	}
+	return nil
+}
+
+func executeSMTPRuleTemplate(t *template.Template, data *smtpRuleData) (string, error) {
+	var buf bytes.Buffer
+	if err := t.Execute(util.NewTimeoutWriter(&buf, templateMaxExecutionTime), data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
@@ -1,12 +1,19 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
 	_ "embed" // required by go:embed
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
 	"mime"
+	"mime/multipart"
 	"net"
 	"net/smtp"
+	"net/textproto"
 	"strings"
 	"sync"
 	"time"
@@ -17,23 +24,42 @@ import (
 
 type mailer interface {
 	Send(v *visitor, m *message, to string) error
+	SendArchive(v *visitor, to, subject, text, filename string, archive []byte) error
+	SendText(v *visitor, to, subject, text string) error
 	Counts() (total int64, success int64, failure int64)
 }
 
 type smtpSender struct {
 	config  *Config
+	html    *template.Template // HTML email template, nil if HTML emails are disabled, see smtp_sender_html.go
 	success int64
 	failure int64
 	mu      sync.Mutex
 }
 
+func newSMTPSender(conf *Config) (*smtpSender, error) {
+	html, err := loadMailTemplate(conf)
+	if err != nil {
+		return nil, err
+	}
+	return &smtpSender{
+		config: conf,
+		html:   html,
+	}, nil
+}
+
 func (s *smtpSender) Send(v *visitor, m *message, to string) error {
 	return s.withCount(v, m, func() error {
 		host, _, err := net.SplitHostPort(s.config.SMTPSenderAddr)
 		if err != nil {
 			return err
 		}
-		message, err := formatMail(s.config.BaseURL, v.ip.String(), s.config.SMTPSenderFrom, to, m)
+		var message string
+		if s.html != nil {
+			message, err = formatHTMLMail(s.html, s.config.BaseURL, v.ip.String(), s.config.SMTPSenderFrom, to, m)
+		} else {
+			message, err = formatMail(s.config.BaseURL, v.ip.String(), s.config.SMTPSenderFrom, to, m)
+		}
 		if err != nil {
 			return err
 		}
@@ -53,10 +79,125 @@ func (s *smtpSender) Send(v *visitor, m *message, to string) error {
 		} else if ev.IsDebug() {
 			ev.Debug("Sending email")
 		}
-		return smtp.SendMail(s.config.SMTPSenderAddr, auth, s.config.SMTPSenderFrom, []string{to}, []byte(message))
+		return s.sendMail(host, auth, to, []byte(message))
 	})
 }
 
+// SendArchive sends a mail with the given text, and the archive as a ZIP attachment, see server_archive.go
+func (s *smtpSender) SendArchive(v *visitor, to, subject, text, filename string, archive []byte) error {
+	host, _, err := net.SplitHostPort(s.config.SMTPSenderAddr)
+	if err != nil {
+		return err
+	}
+	message, err := formatArchiveMail(s.config.SMTPSenderFrom, to, subject, text, filename, archive)
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if s.config.SMTPSenderUser != "" {
+		auth = smtp.PlainAuth("", s.config.SMTPSenderUser, s.config.SMTPSenderPass, host)
+	}
+	logv(v).
+		Tag(tagEmail).
+		Fields(log.Context{
+			"email_via":          s.config.SMTPSenderAddr,
+			"email_user":         s.config.SMTPSenderUser,
+			"email_to":           to,
+			"email_archive_size": len(archive),
+		}).
+		Debug("Sending archive email")
+	err = s.sendMail(host, auth, to, []byte(message))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		logv(v).Err(err).Debug("Sending archive mail failed")
+		s.failure++
+	} else {
+		s.success++
+	}
+	return err
+}
+
+// SendText sends a plain text mail, e.g. the email verification link, see server_account_verify.go
+func (s *smtpSender) SendText(v *visitor, to, subject, text string) error {
+	host, _, err := net.SplitHostPort(s.config.SMTPSenderAddr)
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if s.config.SMTPSenderUser != "" {
+		auth = smtp.PlainAuth("", s.config.SMTPSenderUser, s.config.SMTPSenderPass, host)
+	}
+	logv(v).
+		Tag(tagEmail).
+		Fields(log.Context{
+			"email_via":  s.config.SMTPSenderAddr,
+			"email_user": s.config.SMTPSenderUser,
+			"email_to":   to,
+		}).
+		Debug("Sending text email")
+	err = s.sendMail(host, auth, to, []byte(formatTextMail(s.config.SMTPSenderFrom, to, subject, text)))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		logv(v).Err(err).Debug("Sending text mail failed")
+		s.failure++
+	} else {
+		s.success++
+	}
+	return err
+}
+
+// sendMail sends the message like smtp.SendMail, except that the connection is opened through smtp-sender-proxy
+// or outbound-proxy, if configured (see outbound_proxy.go)
+func (s *smtpSender) sendMail(host string, auth smtp.Auth, to string, message []byte) error {
+	if !outboundProxyConfigured(s.config, s.config.SMTPSenderProxy) {
+		return smtp.SendMail(s.config.SMTPSenderAddr, auth, s.config.SMTPSenderFrom, []string{to}, message)
+	} else if strings.ContainsAny(s.config.SMTPSenderFrom+to, "\r\n") {
+		return errors.New("smtp: A line must not contain CR or LF")
+	}
+	dial, err := outboundDialer(s.config, s.config.SMTPSenderProxy)
+	if err != nil {
+		return err
+	}
+	conn, err := dial(context.Background(), "tcp", s.config.SMTPSenderAddr)
+	if err != nil {
+		return err
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("smtp: server doesn't support AUTH")
+		} else if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(s.config.SMTPSenderFrom); err != nil {
+		return err
+	} else if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	} else if _, err := w.Write(message); err != nil {
+		return err
+	} else if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
 func (s *smtpSender) Counts() (total int64, success int64, failure int64) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -77,58 +218,134 @@ func (s *smtpSender) withCount(v *visitor, m *message, fn func() error) error {
 }
 
 func formatMail(baseURL, senderIP, from, to string, m *message) (string, error) {
+	content, err := newMailContent(baseURL, senderIP, m)
+	if err != nil {
+		return "", err
+	}
+	message := content.Message
+	if content.Trailer != "" {
+		message += "\n\n" + content.Trailer
+	}
+	body := `From: "{shortTopicURL}" <{from}>
+To: {to}
+Subject: {subject}
+Content-Type: text/plain; charset="utf-8"
+
+{message}
+
+--
+{footer}`
+	body = strings.ReplaceAll(body, "{from}", from)
+	body = strings.ReplaceAll(body, "{to}", to)
+	body = strings.ReplaceAll(body, "{subject}", mime.BEncoding.Encode("utf-8", content.Subject))
+	body = strings.ReplaceAll(body, "{footer}", content.Footer)
+	body = strings.ReplaceAll(body, "{message}", message)
+	body = strings.ReplaceAll(body, "{shortTopicURL}", content.ShortTopicURL)
+	return body, nil
+}
+
+// mailContent is the text of a notification email, shared by the plain text and the HTML email
+type mailContent struct {
+	Subject       string   // Title (or message) with emojis, not encoded
+	Message       string   // Message body
+	Trailer       string   // Tags and priority, as text
+	Emojis        []string // Tags that map to emojis
+	Tags          []string // Tags that do not map to emojis
+	Footer        string
+	TopicURL      string
+	ShortTopicURL string
+}
+
+// Text returns the plain text body of the mail, i.e. the message, the trailer and the footer
+func (c *mailContent) Text() string {
+	text := c.Message
+	if c.Trailer != "" {
+		text += "\n\n" + c.Trailer
+	}
+	return text + "\n\n--\n" + c.Footer
+}
+
+func newMailContent(baseURL, senderIP string, m *message) (*mailContent, error) {
 	topicURL := baseURL + "/" + m.Topic
 	subject := m.Title
 	if subject == "" {
 		subject = m.Message
 	}
 	subject = strings.ReplaceAll(strings.ReplaceAll(subject, "\r", ""), "\n", " ")
-	message := m.Message
-	trailer := ""
+	content := &mailContent{
+		Message:       m.Message,
+		Footer:        locales.Text(m.Language, "email_footer", senderIP, time.Unix(m.Time, 0).UTC().Format(time.RFC1123), topicURL),
+		TopicURL:      topicURL,
+		ShortTopicURL: util.ShortTopicURL(topicURL),
+	}
 	if len(m.Tags) > 0 {
 		emojis, tags, err := toEmojis(m.Tags)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 		if len(emojis) > 0 {
 			subject = strings.Join(emojis, " ") + " " + subject
 		}
 		if len(tags) > 0 {
-			trailer = "Tags: " + strings.Join(tags, ", ")
+			content.Trailer = locales.Text(m.Language, "email_tags", strings.Join(tags, ", "))
 		}
+		content.Emojis, content.Tags = emojis, tags
 	}
 	if m.Priority != 0 && m.Priority != 3 {
 		priority, err := util.PriorityString(m.Priority)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
-		if trailer != "" {
-			trailer += "\n"
+		if content.Trailer != "" {
+			content.Trailer += "\n"
 		}
-		trailer += fmt.Sprintf("Priority: %s", priority)
+		content.Trailer += locales.Text(m.Language, "email_priority", priority)
 	}
-	if trailer != "" {
-		message += "\n\n" + trailer
-	}
-	subject = mime.BEncoding.Encode("utf-8", subject)
-	body := `From: "{shortTopicURL}" <{from}>
-To: {to}
-Subject: {subject}
-Content-Type: text/plain; charset="utf-8"
+	content.Subject = subject
+	return content, nil
+}
 
-{message}
+// formatTextMail creates a plain text mail
+func formatTextMail(from, to, subject, text string) string {
+	subject = mime.BEncoding.Encode("utf-8", strings.ReplaceAll(strings.ReplaceAll(subject, "\r", ""), "\n", " "))
+	return fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nMIME-Version: 1.0\r\nContent-Type: text/plain; charset=\"utf-8\"\r\n\r\n%s", from, to, subject, text)
+}
 
---
-This message was sent by {ip} at {time} via {topicURL}`
-	body = strings.ReplaceAll(body, "{from}", from)
-	body = strings.ReplaceAll(body, "{to}", to)
-	body = strings.ReplaceAll(body, "{subject}", subject)
-	body = strings.ReplaceAll(body, "{message}", message)
-	body = strings.ReplaceAll(body, "{topicURL}", topicURL)
-	body = strings.ReplaceAll(body, "{shortTopicURL}", util.ShortTopicURL(topicURL))
-	body = strings.ReplaceAll(body, "{time}", time.Unix(m.Time, 0).UTC().Format(time.RFC1123))
-	body = strings.ReplaceAll(body, "{ip}", senderIP)
-	return body, nil
+// formatArchiveMail creates a multipart mail with the text as the first part, and the archive as a base64-encoded
+// attachment as the second part
+func formatArchiveMail(from, to, subject, text, filename string, archive []byte) (string, error) {
+	var b strings.Builder
+	writer := multipart.NewWriter(&b)
+	subject = mime.BEncoding.Encode("utf-8", strings.ReplaceAll(strings.ReplaceAll(subject, "\r", ""), "\n", " "))
+	fmt.Fprintf(&b, "From: %s\r\nTo: %s\r\nSubject: %s\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=\"%s\"\r\n\r\n", from, to, subject, writer.Boundary())
+	textPart, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {`text/plain; charset="utf-8"`},
+	})
+	if err != nil {
+		return "", err
+	} else if _, err := textPart.Write([]byte(text)); err != nil {
+		return "", err
+	}
+	archivePart, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"application/zip"},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": filename})},
+	})
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.StdEncoding.EncodeToString(archive)
+	for len(encoded) > 0 {
+		line := encoded[:min(len(encoded), 76)]
+		encoded = encoded[len(line):]
+		if _, err := archivePart.Write([]byte(line + "\r\n")); err != nil {
+			return "", err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+	return b.String(), nil
 }
 
 var (
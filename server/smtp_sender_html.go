@@ -0,0 +1,166 @@
+package server
+
+import (
+	"bytes"
+	_ "embed" // required by go:embed
+	"fmt"
+	"html/template"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"os"
+	"strings"
+
+	"heckel.io/ntfy/v2/util"
+)
+
+// HTML emails are sent as multipart/alternative mails, with the plain text email (see formatMail) as the first part,
+// and the HTML email as the second part, so that mail clients without HTML support still show the text. They are
+// enabled with smtp-sender-html, or by passing a custom template via smtp-sender-html-template. Templates are Go
+// html/template templates, and are rendered with a mailTemplateData struct. The built-in template is
+// mailer_template.html, and may be used as a starting point for custom templates.
+
+var (
+	//go:embed "mailer_template.html"
+	mailTemplateSource string
+)
+
+var mailPriorityColors = map[int]string{
+	1: "#9e9e9e",
+	2: "#78909c",
+	3: "#338574",
+	4: "#fb8c00",
+	5: "#e53935",
+}
+
+// mailTemplateData is passed to the HTML email template
+type mailTemplateData struct {
+	Subject         string
+	Title           string
+	Message         string
+	Emojis          []string
+	Tags            []string
+	Priority        int    // 1-5
+	PriorityText    string // Localized priority, e.g. "Priority: high"; empty for the default priority
+	PriorityColor   string // Hex color of the priority, e.g. #e53935
+	Click           string
+	ClickLabel      string
+	Attachment      *mailTemplateAttachment
+	AttachmentLabel string
+	Topic           string
+	TopicURL        string
+	ShortTopicURL   string
+	Footer          string
+}
+
+type mailTemplateAttachment struct {
+	Name string
+	URL  string
+	Size string // Human-readable size, empty if unknown
+}
+
+// loadMailTemplate returns the HTML email template, or nil if HTML emails are disabled
+func loadMailTemplate(conf *Config) (*template.Template, error) {
+	source := mailTemplateSource
+	if conf.SMTPSenderHTMLTemplate != "" {
+		b, err := os.ReadFile(conf.SMTPSenderHTMLTemplate)
+		if err != nil {
+			return nil, err
+		}
+		source = string(b)
+	} else if !conf.SMTPSenderHTML {
+		return nil, nil
+	}
+	tmpl, err := template.New("email").Parse(source)
+	if err != nil {
+		return nil, fmt.Errorf("invalid email template %s: %w", conf.SMTPSenderHTMLTemplate, err)
+	}
+	return tmpl, nil
+}
+
+// formatHTMLMail creates a multipart/alternative mail with the plain text, and the HTML rendered with the template
+func formatHTMLMail(tmpl *template.Template, baseURL, senderIP, from, to string, m *message) (string, error) {
+	content, err := newMailContent(baseURL, senderIP, m)
+	if err != nil {
+		return "", err
+	}
+	html, err := renderHTMLMail(tmpl, content, m)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	writer := multipart.NewWriter(&b)
+	fmt.Fprintf(&b, "From: \"%s\" <%s>\r\nTo: %s\r\nSubject: %s\r\nMIME-Version: 1.0\r\nContent-Type: multipart/alternative; boundary=\"%s\"\r\n\r\n", content.ShortTopicURL, from, to, mime.BEncoding.Encode("utf-8", content.Subject), writer.Boundary())
+	for _, part := range []struct {
+		contentType string
+		body        string
+	}{
+		{`text/plain; charset="utf-8"`, content.Text()},
+		{`text/html; charset="utf-8"`, html},
+	} {
+		w, err := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return "", err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write([]byte(part.body)); err != nil {
+			return "", err
+		} else if err := qp.Close(); err != nil {
+			return "", err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// renderHTMLMail renders the HTML body of the mail with the template
+func renderHTMLMail(tmpl *template.Template, content *mailContent, m *message) (string, error) {
+	var html bytes.Buffer
+	if err := tmpl.Execute(&html, newMailTemplateData(content, m)); err != nil {
+		return "", err
+	}
+	return html.String(), nil
+}
+
+func newMailTemplateData(content *mailContent, m *message) *mailTemplateData {
+	priority := m.Priority
+	if priority == 0 {
+		priority = 3
+	}
+	data := &mailTemplateData{
+		Subject:         content.Subject,
+		Title:           m.Title,
+		Message:         content.Message,
+		Emojis:          content.Emojis,
+		Tags:            content.Tags,
+		Priority:        priority,
+		PriorityColor:   mailPriorityColors[priority],
+		Click:           m.Click,
+		ClickLabel:      locales.Text(m.Language, "email_click"),
+		AttachmentLabel: locales.Text(m.Language, "email_attachment"),
+		Topic:           m.Topic,
+		TopicURL:        content.TopicURL,
+		ShortTopicURL:   content.ShortTopicURL,
+		Footer:          content.Footer,
+	}
+	if priority != 3 {
+		name, _ := util.PriorityString(priority)
+		data.PriorityText = locales.Text(m.Language, "email_priority", name)
+	}
+	if m.Attachment != nil {
+		data.Attachment = &mailTemplateAttachment{
+			Name: m.Attachment.Name,
+			URL:  m.Attachment.URL,
+		}
+		if m.Attachment.Size > 0 {
+			data.Attachment.Size = util.FormatSizeHuman(m.Attachment.Size)
+		}
+	}
+	return data
+}
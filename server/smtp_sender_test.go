@@ -2,6 +2,13 @@ package server
 
 import (
 	"github.com/stretchr/testify/require"
+	"io"
+	"mime"
+	"mime/multipart"
+	netmail "net/mail"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -139,3 +146,107 @@ Priority: max
 This message was sent by 1.2.3.4 at Fri, 24 Dec 2021 21:43:24 UTC via https://ntfy.sh/alerts`
 	require.Equal(t, expected, actual)
 }
+
+func TestFormatMail_Language(t *testing.T) {
+	actual, _ := formatMail("https://ntfy.sh", "1.2.3.4", "ntfy@ntfy.sh", "phil@example.com", &message{
+		ID:       "abc",
+		Time:     1640382204,
+		Event:    "message",
+		Topic:    "alerts",
+		Message:  "Eine einfache Nachricht",
+		Tags:     []string{"backup"},
+		Priority: 4,
+		Language: "de",
+	})
+	expected := `From: "ntfy.sh/alerts" <ntfy@ntfy.sh>
+To: phil@example.com
+Subject: Eine einfache Nachricht
+Content-Type: text/plain; charset="utf-8"
+
+Eine einfache Nachricht
+
+Tags: backup
+Priorität: high
+
+--
+Diese Nachricht wurde von 1.2.3.4 am Fri, 24 Dec 2021 21:43:24 UTC über https://ntfy.sh/alerts gesendet`
+	require.Equal(t, expected, actual)
+}
+
+func TestFormatArchiveMail(t *testing.T) {
+	actual, err := formatArchiveMail("ntfy@ntfy.sh", "phil@example.com", "Your archive", "Attached is an archive", "archive.zip", []byte("zip content"))
+	require.Nil(t, err)
+	require.Contains(t, actual, "From: ntfy@ntfy.sh\r\nTo: phil@example.com\r\nSubject: Your archive\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=")
+	require.Contains(t, actual, "Attached is an archive")
+	require.Contains(t, actual, `Content-Disposition: attachment; filename=archive.zip`)
+	require.Contains(t, actual, "emlwIGNvbnRlbnQ=\r\n") // base64("zip content")
+}
+
+func TestFormatHTMLMail(t *testing.T) {
+	tmpl, err := loadMailTemplate(&Config{SMTPSenderHTML: true})
+	require.Nil(t, err)
+	actual, err := formatHTMLMail(tmpl, "https://ntfy.sh", "1.2.3.4", "ntfy@ntfy.sh", "phil@example.com", &message{
+		ID:       "abc",
+		Time:     1640382204,
+		Event:    "message",
+		Topic:    "alerts",
+		Priority: 5,
+		Tags:     []string{"warning", "tag123"},
+		Title:    "Disk <full>",
+		Message:  "Disk is full",
+		Click:    "https://grafana.lan/d/disk",
+		Attachment: &attachment{
+			Name: "disk.png",
+			Size: 2048,
+			URL:  "https://ntfy.sh/file/abc.png",
+		},
+	})
+	require.Nil(t, err)
+	require.Contains(t, actual, "From: \"ntfy.sh/alerts\" <ntfy@ntfy.sh>\r\nTo: phil@example.com\r\nSubject: =?utf-8?")
+	text, html := readAlternativeMail(t, actual)
+	require.Equal(t, "Disk is full\r\n\r\nTags: tag123\r\nPriority: max\r\n\r\n--\r\nThis message was sent by 1.2.3.4 at Fri, 24 Dec 2021 21:43:24 UTC via https://ntfy.sh/alerts", text)
+	require.Contains(t, html, "Disk &lt;full&gt;") // Escaped
+	require.Contains(t, html, "border-top: 6px solid #e53935;")
+	require.Contains(t, html, `<a href="https://grafana.lan/d/disk"`)
+	require.Contains(t, html, "disk.png</a> (2.0 KB)")
+}
+
+func TestLoadMailTemplate(t *testing.T) {
+	tmpl, err := loadMailTemplate(&Config{})
+	require.Nil(t, err)
+	require.Nil(t, tmpl) // Disabled
+
+	filename := filepath.Join(t.TempDir(), "email.html")
+	require.Nil(t, os.WriteFile(filename, []byte(`<p>{{.Message}} via {{.ShortTopicURL}}</p>`), 0600))
+	tmpl, err = loadMailTemplate(&Config{SMTPSenderHTMLTemplate: filename})
+	require.Nil(t, err)
+	actual, err := formatHTMLMail(tmpl, "https://ntfy.sh", "1.2.3.4", "ntfy@ntfy.sh", "phil@example.com", &message{
+		Time:    1640382204,
+		Topic:   "alerts",
+		Message: "A simple message",
+	})
+	require.Nil(t, err)
+	_, html := readAlternativeMail(t, actual)
+	require.Equal(t, "<p>A simple message via ntfy.sh/alerts</p>", html)
+
+	require.Nil(t, os.WriteFile(filename, []byte(`<p>{{.Message</p>`), 0600))
+	_, err = loadMailTemplate(&Config{SMTPSenderHTMLTemplate: filename})
+	require.NotNil(t, err)
+}
+
+// readAlternativeMail returns the decoded text and HTML parts of a multipart/alternative mail
+func readAlternativeMail(t *testing.T, mail string) (text string, html string) {
+	msg, err := netmail.ReadMessage(strings.NewReader(mail))
+	require.Nil(t, err)
+	_, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	require.Nil(t, err)
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	for _, body := range []*string{&text, &html} {
+		part, err := reader.NextPart()
+		require.Nil(t, err)
+		b, err := io.ReadAll(part)
+		require.Nil(t, err)
+		*body = string(b)
+	}
+	return text, html
+}
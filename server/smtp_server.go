@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"github.com/emersion/go-smtp"
 	"github.com/microcosm-cc/bluemonday"
+	"heckel.io/ntfy/v2/user"
 	"io"
 	"mime"
 	"mime/multipart"
@@ -40,20 +41,24 @@ const (
 
 // smtpBackend implements SMTP server methods.
 type smtpBackend struct {
-	config  *Config
-	handler func(http.ResponseWriter, *http.Request)
-	success int64
-	failure int64
-	mu      sync.Mutex
+	config      *Config
+	userManager *user.Manager // May be nil, used to resolve secret email aliases, see server_email_alias.go
+	rules       []*smtpRule   // Routing rules, see smtp_rules.go
+	handler     func(http.ResponseWriter, *http.Request)
+	success     int64
+	failure     int64
+	mu          sync.Mutex
 }
 
 var _ smtp.Backend = (*smtpBackend)(nil)
 var _ smtp.Session = (*smtpSession)(nil)
 
-func newMailBackend(conf *Config, handler func(http.ResponseWriter, *http.Request)) *smtpBackend {
+func newMailBackend(conf *Config, userManager *user.Manager, rules []*smtpRule, handler func(http.ResponseWriter, *http.Request)) *smtpBackend {
 	return &smtpBackend{
-		config:  conf,
-		handler: handler,
+		config:      conf,
+		userManager: userManager,
+		rules:       rules,
+		handler:     handler,
 	}
 }
 
@@ -72,8 +77,11 @@ func (b *smtpBackend) Counts() (total int64, success int64, failure int64) {
 type smtpSession struct {
 	backend *smtpBackend
 	conn    *smtp.Conn
-	topic   string
+	from    string // Sender address (MAIL FROM)
+	to      string // Recipient address (RCPT TO)
+	topic   string // Topic derived from the recipient address, may be empty if SMTP rules are used
 	token   string
+	alias   bool // True if the recipient address is the secret email alias of the topic
 	mu      sync.Mutex
 }
 
@@ -84,6 +92,9 @@ func (s *smtpSession) AuthPlain(username, _ string) error {
 
 func (s *smtpSession) Mail(from string, opts *smtp.MailOptions) error {
 	logem(s.conn).Field("smtp_mail_from", from).Debug("MAIL FROM: %s", from)
+	s.mu.Lock()
+	s.from = from
+	s.mu.Unlock()
 	return nil
 }
 
@@ -98,15 +109,18 @@ func (s *smtpSession) Rcpt(to string) error {
 		} else if len(addressList) != 1 {
 			return errTooManyRecipients
 		}
-		to = addressList[0].Address
-		if !strings.HasSuffix(to, "@"+conf.SMTPServerDomain) {
+		address := addressList[0].Address
+		if !strings.HasSuffix(address, "@"+conf.SMTPServerDomain) {
 			return errInvalidDomain
 		}
 		// Remove @ntfy.sh from end of email
-		to = strings.TrimSuffix(to, "@"+conf.SMTPServerDomain)
+		to = strings.TrimSuffix(address, "@"+conf.SMTPServerDomain)
 		if conf.SMTPServerAddrPrefix != "" {
 			if !strings.HasPrefix(to, conf.SMTPServerAddrPrefix) {
-				return errInvalidAddress
+				if len(s.backend.rules) == 0 {
+					return errInvalidAddress
+				}
+				to = "" // Topic must be set by a rule, see Data
 			}
 			// remove ntfy- from beginning of email
 			to = strings.TrimPrefix(to, conf.SMTPServerAddrPrefix)
@@ -117,17 +131,51 @@ func (s *smtpSession) Rcpt(to string) error {
 			to = parts[0]
 			token = parts[1]
 		}
-		if !topicRegex.MatchString(to) {
+		to, alias, err := s.resolveAlias(to)
+		if err != nil {
+			return err
+		}
+		if to != "" && !topicRegex.MatchString(to) {
+			if len(s.backend.rules) == 0 {
+				return errInvalidTopic
+			}
+			to = "" // Topic must be set by a rule, see Data
+		} else if to == "" && len(s.backend.rules) == 0 {
 			return errInvalidTopic
 		}
 		s.mu.Lock()
+		s.to = address
 		s.topic = to
 		s.token = token
+		s.alias = alias
 		s.mu.Unlock()
 		return nil
 	})
 }
 
+// resolveAlias returns the topic for the given secret email alias (and true), or the given topic name (and false)
+// if it is not an alias. Topics with an alias do not accept emails to their regular address.
+func (s *smtpSession) resolveAlias(to string) (string, bool, error) {
+	if to == "" || s.backend.userManager == nil {
+		return to, false, nil
+	}
+	topic, err := s.backend.userManager.EmailAliasTopic(to)
+	if err != nil {
+		return "", false, err
+	} else if topic != "" {
+		return topic, true, nil
+	} else if !topicRegex.MatchString(to) {
+		return to, false, nil
+	}
+	alias, err := s.backend.userManager.ReservationEmailAlias(to)
+	if err != nil {
+		return "", false, err
+	} else if alias != "" {
+		return "", false, errInvalidAddress
+	}
+	return to, false, nil
+}
+
 func (s *smtpSession) Data(r io.Reader) error {
 	return s.withFailCount(func() error {
 		conf := s.backend.config
@@ -163,6 +211,14 @@ func (s *smtpSession) Data(r io.Reader) error {
 			}
 			m.Title = subject
 		}
+		if err := s.applyRules(m, msg.Header, body); err != nil {
+			return err
+		} else if m.Topic == "" {
+			return errInvalidTopic
+		}
+		if len(m.Message) > conf.MessageSizeLimit {
+			m.Message = m.Message[:conf.MessageSizeLimit]
+		}
 		if m.Title != "" && m.Message == "" {
 			m.Message = m.Title // Flip them, this makes more sense
 			m.Title = ""
@@ -196,9 +252,20 @@ func (s *smtpSession) publishMessage(m *message) error {
 	if m.Title != "" {
 		req.Header.Set("Title", m.Title)
 	}
+	if m.Priority != 0 {
+		req.Header.Set("Priority", fmt.Sprintf("%d", m.Priority))
+	}
+	if len(m.Tags) > 0 {
+		req.Header.Set("Tags", strings.Join(m.Tags, ","))
+	}
 	if s.token != "" {
 		req.Header.Add("Authorization", "Bearer "+s.token)
 	}
+	if s.alias && s.topic == m.Topic {
+		req = withContext(req, map[contextKey]any{
+			contextEmailAlias: true,
+		})
+	}
 	rr := httptest.NewRecorder()
 	s.backend.handler(rr, req)
 	if rr.Code != http.StatusOK {
@@ -207,9 +274,38 @@ func (s *smtpSession) publishMessage(m *message) error {
 	return nil
 }
 
+// applyRules applies the first matching SMTP routing rule (if any) to the message, see smtp_rules.go
+func (s *smtpSession) applyRules(m *message, header mail.Header, body string) error {
+	s.mu.Lock()
+	to, from := s.to, s.from
+	s.mu.Unlock()
+	if headerFrom := strings.TrimSpace(header.Get("From")); headerFrom != "" {
+		from = headerFrom
+	}
+	for _, rule := range s.backend.rules {
+		groups, ok := rule.match(to, from, m.Title)
+		if !ok {
+			continue
+		}
+		logem(s.conn).Field("smtp_rcpt_to", to).Debug("Applying SMTP rule to email")
+		return rule.apply(m, &smtpRuleData{
+			To:      to,
+			From:    from,
+			Subject: m.Title,
+			Body:    body,
+			Topic:   m.Topic,
+			Match:   groups,
+		})
+	}
+	return nil
+}
+
 func (s *smtpSession) Reset() {
 	s.mu.Lock()
+	s.from = ""
+	s.to = ""
 	s.topic = ""
+	s.alias = false
 	s.mu.Unlock()
 }
 
@@ -1389,11 +1389,17 @@ what's up
 type smtpHandlerFunc func(http.ResponseWriter, *http.Request)
 
 func newTestSMTPServer(t *testing.T, handler smtpHandlerFunc) (s *smtp.Server, c net.Conn, conf *Config, scanner *bufio.Scanner) {
+	return newTestSMTPServerWithRules(t, nil, handler)
+}
+
+func newTestSMTPServerWithRules(t *testing.T, rules []string, handler smtpHandlerFunc) (s *smtp.Server, c net.Conn, conf *Config, scanner *bufio.Scanner) {
 	conf = newTestConfig(t)
 	conf.SMTPServerListen = ":25"
 	conf.SMTPServerDomain = "ntfy.sh"
 	conf.SMTPServerAddrPrefix = "ntfy-"
-	backend := newMailBackend(conf, handler)
+	smtpRules, err := parseSMTPRules(rules)
+	require.Nil(t, err)
+	backend := newMailBackend(conf, nil, smtpRules, handler)
 	l, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
 		t.Fatal(err)
@@ -1439,3 +1445,113 @@ func readUntilLine(t *testing.T, conn net.Conn, scanner *bufio.Scanner, expected
 	}
 	t.Fatalf("Expected line '%s' not found in output:\n%s", expectedLine, output)
 }
+
+func TestSmtpBackend_Rules(t *testing.T) {
+	email := `EHLO example.com
+MAIL FROM: backup@example.com
+RCPT TO: ntfy-mailbox@ntfy.sh
+DATA
+Subject: [nas01] Backup FAILED
+From: Backup Daemon <backup@example.com>
+
+Backup of /data failed: disk full
+.
+`
+	rules := []string{
+		`from=@github\.com; topic=github`,
+		`from=backup@; subject=(?i)^\[(?P<host>[^\]]+)\] backup (?P<status>\w+); topic=backups; priority=high; tags=floppy_disk, warning; title={{.Match.host}}: {{.Match.status}}; message={{.Body}} (via {{.To}})`,
+	}
+	s, c, _, scanner := newTestSMTPServerWithRules(t, rules, func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/backups", r.URL.Path)
+		require.Equal(t, "nas01: FAILED", r.Header.Get("Title"))
+		require.Equal(t, "4", r.Header.Get("Priority"))
+		require.Equal(t, "floppy_disk,warning", r.Header.Get("Tags"))
+		require.Equal(t, "Backup of /data failed: disk full (via ntfy-mailbox@ntfy.sh)", readAll(t, r.Body))
+	})
+	defer s.Close()
+	defer c.Close()
+	writeAndReadUntilLine(t, email, c, scanner, "250 2.0.0 OK: queued")
+}
+
+func TestSmtpBackend_Rules_NoMatch(t *testing.T) {
+	email := `EHLO example.com
+MAIL FROM: phil@example.com
+RCPT TO: ntfy-mytopic@ntfy.sh
+DATA
+Subject: hi there
+
+what's up
+.
+`
+	s, c, _, scanner := newTestSMTPServerWithRules(t, []string{`from=@github\.com; topic=github`}, func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/mytopic", r.URL.Path) // Recipient address is used as usual
+		require.Equal(t, "hi there", r.Header.Get("Title"))
+		require.Equal(t, "", r.Header.Get("Priority"))
+		require.Equal(t, "what's up", readAll(t, r.Body))
+	})
+	defer s.Close()
+	defer c.Close()
+	writeAndReadUntilLine(t, email, c, scanner, "250 2.0.0 OK: queued")
+}
+
+func TestSmtpBackend_Rules_RecipientNotATopic(t *testing.T) {
+	email := `EHLO example.com
+MAIL FROM: phil@example.com
+RCPT TO: alerts.prod@ntfy.sh
+DATA
+Subject: hi there
+
+what's up
+.
+`
+	s, c, _, scanner := newTestSMTPServerWithRules(t, []string{`to=^alerts\.prod@; topic=alerts`}, func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/alerts", r.URL.Path)
+	})
+	defer s.Close()
+	defer c.Close()
+	writeAndReadUntilLine(t, email, c, scanner, "250 2.0.0 OK: queued")
+
+	// No rule with a topic matches, so the email is rejected
+	email = `MAIL FROM: phil@example.com
+RCPT TO: other.prod@ntfy.sh
+DATA
+Subject: hi there
+
+what's up
+.
+`
+	writeAndReadUntilLine(t, email, c, scanner, "554 5.0.0 Error: transaction failed, blame it on the weather: invalid topic")
+}
+
+func TestParseSMTPRules(t *testing.T) {
+	rules, err := parseSMTPRules([]string{
+		`to=^ntfy-alerts@; priority=urgent`,
+		`subject=(?P<x>.+); title={{.Match.x}}; tags=a,b`,
+		`topic=catchall`,
+	})
+	require.Nil(t, err)
+	require.Equal(t, 3, len(rules))
+	require.Equal(t, 5, rules[0].priority)
+	require.Equal(t, []string{"a", "b"}, rules[1].tags)
+	require.Equal(t, "catchall", rules[2].topic)
+
+	groups, ok := rules[1].match("ntfy-x@ntfy.sh", "phil@example.com", "hello")
+	require.True(t, ok)
+	require.Equal(t, "hello", groups["x"])
+	_, ok = rules[0].match("ntfy-x@ntfy.sh", "phil@example.com", "hello")
+	require.False(t, ok)
+
+	for _, invalid := range []string{
+		`to=^ntfy-alerts@`,               // No action
+		`to=[invalid; topic=mytopic`,     // Invalid regex
+		`topic=my topic`,                 // Invalid topic
+		`priority=super-urgent`,          // Invalid priority
+		`title={{call .X}}`,              // Disallowed template function
+		`recipient=abc; topic=mytopic`,   // Unknown key
+		`to; topic=mytopic`,              // Missing value
+		`message={{.Body; topic=mytopic`, // Invalid template
+	} {
+		_, err := parseSMTPRules([]string{invalid})
+		require.Error(t, err, invalid)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"sync"
 	"time"
 
+	"golang.org/x/time/rate"
 	"heckel.io/ntfy/v2/log"
 	"heckel.io/ntfy/v2/util"
 )
@@ -14,6 +15,9 @@ const (
 	// This must be larger than matrixRejectPushKeyForUnifiedPushTopicWithoutRateVisitorAfter to give
 	// time for more requests to come in, so that we can send a {"rejected":["<pushkey>"]} response back.
 	topicExpungeAfter = 16 * time.Hour
+
+	// topicUnifiedPushStatsDays is the number of days for which UnifiedPush message counts are kept
+	topicUnifiedPushStatsDays = 7
 )
 
 // topic represents a channel to which subscribers can subscribe, and publishers
@@ -22,6 +26,9 @@ type topic struct {
 	ID          string
 	subscribers map[int]*topicSubscriber
 	rateVisitor *visitor
+	mutes       map[string]time.Time // Muted senders (see senderKey) -> muted until
+	upLimiter   *rate.Limiter        // Per-endpoint limiter for UnifiedPush messages, see UnifiedPushAllowed
+	upMessages  map[string]int       // UnifiedPush messages per day (YYYY-MM-DD), see CountUnifiedPushMessage
 	lastAccess  time.Time
 	mu          sync.RWMutex
 }
@@ -40,6 +47,8 @@ func newTopic(id string) *topic {
 	return &topic{
 		ID:          id,
 		subscribers: make(map[int]*topicSubscriber),
+		mutes:       make(map[string]time.Time),
+		upMessages:  make(map[string]int),
 		lastAccess:  time.Now(),
 	}
 }
@@ -70,9 +79,93 @@ func (t *topic) Stale() bool {
 	if t.rateVisitor != nil && !t.rateVisitor.Stale() {
 		return false
 	}
+	for _, until := range t.mutes {
+		if time.Now().Before(until) {
+			return false // Keep mutes until they expire
+		}
+	}
 	return len(t.subscribers) == 0 && time.Since(t.lastAccess) > topicExpungeAfter
 }
 
+// Mute prevents the given sender (see senderKey) from publishing to this topic until the given time
+func (t *topic) Mute(sender string, until time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.mutes[sender] = until
+}
+
+// Unmute lifts all mutes in this topic
+func (t *topic) Unmute() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.mutes = make(map[string]time.Time)
+}
+
+// Muted returns true if the given sender (see senderKey) is currently muted in this topic
+func (t *topic) Muted(sender string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	until, ok := t.mutes[sender]
+	if ok && time.Now().After(until) {
+		delete(t.mutes, sender)
+		return false
+	}
+	return ok
+}
+
+// UnifiedPushAllowed returns true if another UnifiedPush message may be published to this topic, as per
+// the per-endpoint limit (burst and replenish). The limiter is created on first use.
+func (t *topic) UnifiedPushAllowed(burst int, replenish time.Duration) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.upLimiter == nil {
+		t.upLimiter = rate.NewLimiter(rate.Every(replenish), burst)
+	}
+	return t.upLimiter.Allow()
+}
+
+// CountUnifiedPushMessage increases today's UnifiedPush message count, and forgets counts older
+// than topicUnifiedPushStatsDays
+func (t *topic) CountUnifiedPushMessage() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	t.upMessages[now.Format(time.DateOnly)]++
+	oldest := now.AddDate(0, 0, -topicUnifiedPushStatsDays+1).Format(time.DateOnly)
+	for day := range t.upMessages {
+		if day < oldest {
+			delete(t.upMessages, day)
+		}
+	}
+}
+
+// UnifiedPushMessages returns the UnifiedPush message counts of the last topicUnifiedPushStatsDays days,
+// keyed by day (YYYY-MM-DD)
+func (t *topic) UnifiedPushMessages() map[string]int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	counts := make(map[string]int, len(t.upMessages))
+	for day, count := range t.upMessages {
+		counts[day] = count
+	}
+	return counts
+}
+
+// SubscribedBy returns true if the given user is subscribed to this topic, or is its rate visitor
+func (t *topic) SubscribedBy(userID string) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.rateVisitor != nil && t.rateVisitor.MaybeUserID() == userID {
+		return true
+	}
+	for _, s := range t.subscribers {
+		if s.userID == userID {
+			return true
+		}
+	}
+	return false
+}
+
 func (t *topic) LastAccess() time.Time {
 	t.mu.RLock()
 	defer t.mu.RUnlock()
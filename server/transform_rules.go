@@ -0,0 +1,225 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"heckel.io/ntfy/v2/util"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Transformation rules let operators normalize messages from third-party systems centrally, instead of in every
+// publisher. They are applied to published messages before they are cached and delivered. Rules are defined via
+// the "transform-rules" config option, one rule per entry, each a list of "key=value" pairs separated by semicolons, e.g.
+//
+//	topic=alerts*; message-field=alert.description; title-field=alert.name; priority-field=alert.severity; priority-map=critical:5,warning:4
+//
+// Condition:
+//   - topic: topic pattern the rule applies to, e.g. "alerts" or "alerts-*" (see path.Match); default is all topics
+//
+// Actions (applied in this order):
+//   - title-field, message-field: JSON field to extract from the message body (if it is JSON) as title or message,
+//     e.g. "alert.name" or "alerts.0.name" for the first element of an array
+//   - priority-field: JSON field to extract from the message body as priority, e.g. "severity"
+//   - priority-map: comma-separated list of "value:priority" pairs to map the value of the priority field to a
+//     priority, e.g. "critical:5,warning:high,info:low"; values that are not mapped are parsed as priority
+//   - replace, with: regex to replace in the message, and its replacement (may contain $1, ${name}, ...)
+//
+// All rules matching the topic are applied in order, so that the output of one rule is the input of the next.
+
+var (
+	transformRuleKeys = []string{"topic", "title-field", "message-field", "priority-field", "priority-map", "replace", "with"}
+)
+
+// transformRule is a parsed message transformation rule, see above
+type transformRule struct {
+	topic         string
+	titleField    string
+	messageField  string
+	priorityField string
+	priorityMap   map[string]int
+	replace       *regexp.Regexp
+	with          string
+}
+
+// parseTransformRules parses the "transform-rules" config option, see above for the format
+func parseTransformRules(rules []string) ([]*transformRule, error) {
+	transformRules := make([]*transformRule, 0)
+	for _, rule := range rules {
+		r, err := parseTransformRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("invalid transform rule %q: %w", rule, err)
+		}
+		transformRules = append(transformRules, r)
+	}
+	return transformRules, nil
+}
+
+func parseTransformRule(rule string) (*transformRule, error) {
+	r := &transformRule{}
+	var hasWith bool
+	for _, field := range strings.Split(rule, ";") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(field, "=")
+		key, value = strings.ToLower(strings.TrimSpace(key)), strings.TrimSpace(value)
+		if !ok || (value == "" && key != "with") {
+			return nil, fmt.Errorf("expected 'key=value', got %q", field)
+		} else if !util.Contains(transformRuleKeys, key) {
+			return nil, fmt.Errorf("unknown key %q, expected one of %s", key, strings.Join(transformRuleKeys, ", "))
+		}
+		var err error
+		switch key {
+		case "topic":
+			if _, err := path.Match(value, ""); err != nil {
+				return nil, fmt.Errorf("invalid topic pattern %q", value)
+			}
+			r.topic = value
+		case "title-field":
+			r.titleField = value
+		case "message-field":
+			r.messageField = value
+		case "priority-field":
+			r.priorityField = value
+		case "priority-map":
+			r.priorityMap, err = parseTransformPriorityMap(value)
+		case "replace":
+			r.replace, err = regexp.Compile(value)
+		case "with":
+			r.with = value
+			hasWith = true
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if r.titleField == "" && r.messageField == "" && r.priorityField == "" && r.replace == nil {
+		return nil, fmt.Errorf("rule must have at least one of title-field, message-field, priority-field or replace")
+	} else if r.priorityMap != nil && r.priorityField == "" {
+		return nil, fmt.Errorf("priority-map requires priority-field")
+	} else if r.replace == nil && hasWith {
+		return nil, fmt.Errorf("with requires replace")
+	}
+	return r, nil
+}
+
+func parseTransformPriorityMap(value string) (map[string]int, error) {
+	priorityMap := make(map[string]int)
+	for _, pair := range util.SplitNoEmpty(value, ",") {
+		from, to, ok := strings.Cut(pair, ":")
+		if !ok {
+			return nil, fmt.Errorf("expected 'value:priority', got %q", pair)
+		}
+		priority, err := util.ParsePriority(strings.TrimSpace(to))
+		if err != nil {
+			return nil, err
+		} else if priority == 0 {
+			return nil, fmt.Errorf("expected 'value:priority', got %q", pair)
+		}
+		priorityMap[strings.ToLower(strings.TrimSpace(from))] = priority
+	}
+	return priorityMap, nil
+}
+
+// match returns true if the rule applies to the given topic
+func (r *transformRule) match(topic string) bool {
+	if r.topic == "" {
+		return true
+	}
+	matched, _ := path.Match(r.topic, topic)
+	return matched
+}
+
+// apply applies the actions of the rule to the message. Fields that cannot be extracted (because the message is not
+// JSON, or because the field does not exist) are skipped.
+func (r *transformRule) apply(m *message) {
+	if r.titleField != "" || r.messageField != "" || r.priorityField != "" {
+		var data any
+		if err := json.Unmarshal([]byte(m.Message), &data); err == nil {
+			title, titleOk := transformField(data, r.titleField)
+			message, messageOk := transformField(data, r.messageField)
+			priority, priorityOk := transformField(data, r.priorityField)
+			if titleOk {
+				m.Title = title
+			}
+			if messageOk {
+				m.Message = message
+			}
+			if priorityOk {
+				if p, ok := r.priorityMap[strings.ToLower(priority)]; ok {
+					m.Priority = p
+				} else if p, err := util.ParsePriority(priority); err == nil {
+					m.Priority = p
+				}
+			}
+		}
+	}
+	if r.replace != nil {
+		m.Message = r.replace.ReplaceAllString(m.Message, r.with)
+	}
+}
+
+// transformField returns the value of the given dotted field path (e.g. "alert.name" or "alerts.0.name") in the
+// JSON data as string, or false if the field does not exist or is empty
+func transformField(data any, field string) (string, bool) {
+	if field == "" {
+		return "", false
+	}
+	for _, name := range strings.Split(field, ".") {
+		switch d := data.(type) {
+		case map[string]any:
+			data = d[name]
+		case []any:
+			index, err := strconv.Atoi(name)
+			if err != nil || index < 0 || index >= len(d) {
+				return "", false
+			}
+			data = d[index]
+		default:
+			return "", false
+		}
+	}
+	var value string
+	switch d := data.(type) {
+	case nil:
+		return "", false
+	case string:
+		value = d
+	case float64, bool:
+		value = fmt.Sprintf("%v", d)
+	default:
+		b, err := json.Marshal(d)
+		if err != nil {
+			return "", false
+		}
+		value = string(b)
+	}
+	value = strings.TrimSpace(value)
+	return value, value != ""
+}
+
+// transformMessage applies all transformation rules matching the message's topic, see above
+func (s *Server) transformMessage(v *visitor, m *message) error {
+	conf := s.config()
+	if len(s.transformRules) == 0 || m.Event != messageEvent || m.Encoding != "" {
+		return nil
+	}
+	var applied int
+	for _, r := range s.transformRules {
+		if r.match(m.Topic) {
+			r.apply(m)
+			applied++
+		}
+	}
+	if applied == 0 {
+		return nil
+	} else if len(m.Message) > conf.MessageSizeLimit || len(m.Title) > conf.MessageSizeLimit {
+		return errHTTPBadRequestTransformMessageTooLarge.With(m)
+	}
+	logvm(v, m).Tag(tagPublish).Debug("Applied %d transform rule(s) to message", applied)
+	return nil
+}
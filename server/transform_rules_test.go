@@ -0,0 +1,120 @@
+package server
+
+import (
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+func TestParseTransformRules(t *testing.T) {
+	rules, err := parseTransformRules([]string{
+		`topic=alerts-*; priority-field=severity; priority-map=Critical:5, warning:high`,
+		`replace=(\d+)%; with=$1 percent`,
+		`replace=secret; with=`,
+	})
+	require.Nil(t, err)
+	require.Equal(t, 3, len(rules))
+	require.Equal(t, map[string]int{"critical": 5, "warning": 4}, rules[0].priorityMap)
+	require.True(t, rules[0].match("alerts-prod"))
+	require.False(t, rules[0].match("alerts"))
+	require.True(t, rules[1].match("anything"))
+	require.Equal(t, "", rules[2].with)
+
+	for _, invalid := range []string{
+		`topic=alerts`,                              // No action
+		`topic=[alerts; message-field=x`,            // Invalid pattern
+		`replace=[invalid`,                          // Invalid regex
+		`with=abc`,                                  // With without replace
+		`priority-map=critical:5`,                   // Priority map without field
+		`priority-field=x; priority-map=critical:9`, // Invalid priority
+		`priority-field=x; priority-map=critical`,   // Missing priority
+		`field=x`,       // Unknown key
+		`message-field`, // Missing value
+	} {
+		_, err := parseTransformRules([]string{invalid})
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestTransformField(t *testing.T) {
+	data := map[string]any{
+		"alert": map[string]any{"name": " Disk full ", "level": float64(4), "firing": true, "labels": map[string]any{"host": "nas01"}},
+		"items": []any{map[string]any{"name": "first"}},
+	}
+	for field, expected := range map[string]string{
+		"alert.name":   "Disk full",
+		"alert.level":  "4",
+		"alert.firing": "true",
+		"alert.labels": `{"host":"nas01"}`,
+		"items.0.name": "first",
+	} {
+		value, ok := transformField(data, field)
+		require.True(t, ok, field)
+		require.Equal(t, expected, value, field)
+	}
+	for _, field := range []string{"", "nope", "alert.name.x", "items.1.name", "items.x"} {
+		_, ok := transformField(data, field)
+		require.False(t, ok, field)
+	}
+}
+
+func TestServer_PublishWithTransformRules(t *testing.T) {
+	c := newTestConfig(t)
+	c.TransformRules = []string{
+		`topic=alerts; message-field=alert.description; title-field=alert.name; priority-field=alert.severity; priority-map=critical:5,warning:4`,
+		`topic=alerts; replace=(\d+)%; with=$1 percent`,
+		`topic=backups-*; replace=(?i)password=\S+; with=password=***`,
+	}
+	s := newTestServer(t, c)
+
+	// JSON fields are extracted, then the next rule is applied to the result
+	response := request(t, s, "PUT", "/alerts", `{"alert":{"name":"Disk full","description":"/var is at 98%","severity":"critical"}}`, nil)
+	require.Equal(t, 200, response.Code)
+	m := toMessage(t, response.Body.String())
+	require.Equal(t, "Disk full", m.Title)
+	require.Equal(t, "/var is at 98 percent", m.Message)
+	require.Equal(t, 5, m.Priority)
+
+	// Missing fields and unmapped values leave the message unchanged
+	response = request(t, s, "PUT", "/alerts", `{"alert":{"severity":"high"}}`, map[string]string{
+		"Title": "Some title",
+	})
+	m = toMessage(t, response.Body.String())
+	require.Equal(t, "Some title", m.Title)
+	require.Equal(t, `{"alert":{"severity":"high"}}`, m.Message)
+	require.Equal(t, 4, m.Priority)
+
+	// Messages that are not JSON are passed through
+	response = request(t, s, "PUT", "/alerts", "not json", nil)
+	m = toMessage(t, response.Body.String())
+	require.Equal(t, "not json", m.Message)
+	require.Equal(t, 0, m.Priority)
+
+	// Regex replacement, topic patterns
+	response = request(t, s, "PUT", "/backups-nas", "Backup failed, login with PASSWORD=hunter2 failed", nil)
+	m = toMessage(t, response.Body.String())
+	require.Equal(t, "Backup failed, login with password=*** failed", m.Message)
+	response = request(t, s, "PUT", "/backups", "password=hunter2", nil)
+	m = toMessage(t, response.Body.String())
+	require.Equal(t, "password=hunter2", m.Message)
+
+	// Transformed messages are cached
+	response = request(t, s, "GET", "/alerts/json?poll=1", "", nil)
+	messages := toMessages(t, response.Body.String())
+	require.Equal(t, "Disk full", messages[0].Title)
+}
+
+func TestServer_PublishWithTransformRules_TooLarge(t *testing.T) {
+	c := newTestConfig(t)
+	c.TransformRules = []string{`replace=x; with=` + strings.Repeat("y", 100)}
+	s := newTestServer(t, c)
+	response := request(t, s, "PUT", "/mytopic", strings.Repeat("x", 1000), nil)
+	require.Equal(t, 40075, toHTTPError(t, response.Body.String()).Code)
+}
+
+func TestServer_TransformRulesInvalid(t *testing.T) {
+	c := newTestConfig(t)
+	c.TransformRules = []string{`replace=[invalid`}
+	_, err := New(c)
+	require.Error(t, err)
+}
@@ -3,6 +3,7 @@ package server
 import (
 	"net/http"
 	"net/netip"
+	"sync/atomic"
 	"time"
 
 	"heckel.io/ntfy/v2/log"
@@ -17,6 +18,8 @@ const (
 	keepaliveEvent   = "keepalive"
 	messageEvent     = "message"
 	pollRequestEvent = "poll_request"
+	closeEvent       = "close"
+	expiredEvent     = "expired"
 )
 
 const (
@@ -25,24 +28,35 @@ const (
 
 // message represents a message published to a topic
 type message struct {
-	ID          string      `json:"id"`                // Random message ID
-	Time        int64       `json:"time"`              // Unix time in seconds
-	Expires     int64       `json:"expires,omitempty"` // Unix time in seconds (not required for open/keepalive)
-	Event       string      `json:"event"`             // One of the above
-	Topic       string      `json:"topic"`
-	Title       string      `json:"title,omitempty"`
-	Message     string      `json:"message,omitempty"`
-	Priority    int         `json:"priority,omitempty"`
-	Tags        []string    `json:"tags,omitempty"`
-	Click       string      `json:"click,omitempty"`
-	Icon        string      `json:"icon,omitempty"`
-	Actions     []*action   `json:"actions,omitempty"`
-	Attachment  *attachment `json:"attachment,omitempty"`
-	PollID      string      `json:"poll_id,omitempty"`
-	ContentType string      `json:"content_type,omitempty"` // text/plain by default (if empty), or text/markdown
-	Encoding    string      `json:"encoding,omitempty"`     // empty for raw UTF-8, or "base64" for encoded bytes
-	Sender      netip.Addr  `json:"-"`                      // IP address of uploader, used for rate limiting
-	User        string      `json:"-"`                      // UserID of the uploader, used to associated attachments
+	ID            string            `json:"id"`                // Random message ID
+	Time          int64             `json:"time"`              // Unix time in seconds
+	Expires       int64             `json:"expires,omitempty"` // Unix time in seconds (not required for open/keepalive)
+	Event         string            `json:"event"`             // One of the above
+	Topic         string            `json:"topic"`
+	Title         string            `json:"title,omitempty"`
+	Message       string            `json:"message,omitempty"`
+	Summary       string            `json:"summary,omitempty"` // Plain-language summary for screen readers (X-Summary)
+	Priority      int               `json:"priority,omitempty"`
+	Tags          []string          `json:"tags,omitempty"`
+	Click         string            `json:"click,omitempty"`
+	Icon          string            `json:"icon,omitempty"`
+	Actions       []*action         `json:"actions,omitempty"`
+	Embeds        []*messageEmbed   `json:"embeds,omitempty"`    // Structured content blocks (X-Embeds), see embeds.go
+	Publisher     *messagePublisher `json:"publisher,omitempty"` // Verified publisher, only set if enabled for the topic, see server_identity.go
+	Attachment    *attachment       `json:"attachment,omitempty"`
+	PollID        string            `json:"poll_id,omitempty"`
+	ContentType   string            `json:"content_type,omitempty"` // text/plain by default (if empty), or text/markdown
+	Encoding      string            `json:"encoding,omitempty"`     // empty for raw UTF-8, or "base64" for encoded bytes
+	DedupCount    int               `json:"dedup_count,omitempty"`  // Number of duplicates coalesced into this message, see X-Dedup-ID
+	Stats         *connStats        `json:"stats,omitempty"`        // Connection statistics, only set in "close" events
+	Expired       []string          `json:"expired,omitempty"`      // IDs of expired messages, only set in "expired" events
+	Aliases       map[string]string `json:"aliases,omitempty"`      // Topic aliases (alias -> topic), only set in "open" events
+	Sender        netip.Addr        `json:"-"`                      // IP address of uploader, used for rate limiting
+	User          string            `json:"-"`                      // UserID of the uploader, used to associated attachments
+	MessageTTL    time.Duration     `json:"-"`                      // Requested message retention (X-Message-TTL), see messageExpires
+	AttachmentTTL time.Duration     `json:"-"`                      // Requested attachment retention (X-Attachment-TTL), see attachmentExpires
+	Language      string            `json:"-"`                      // Language of server-generated text (e.g. emails), see locale.go
+	RowID         int64             `json:"-"`                      // Row ID in the message cache, used to order messages of multiple topics, see sendOldMessages
 }
 
 func (m *message) Context() log.Context {
@@ -64,6 +78,7 @@ func (m *message) Context() log.Context {
 
 type attachment struct {
 	Name    string `json:"name"`
+	Alt     string `json:"alt,omitempty"` // Alt-text for screen readers (X-Alt)
 	Type    string `json:"type,omitempty"`
 	Size    int64  `json:"size,omitempty"`
 	Expires int64  `json:"expires,omitempty"`
@@ -83,6 +98,27 @@ type action struct {
 	Extras  map[string]string `json:"extras,omitempty"`  // used in "broadcast" action
 }
 
+// messageEmbed is a structured content block with key-value fields, e.g. to display the details of a monitoring alert
+type messageEmbed struct {
+	Title       string               `json:"title,omitempty"`
+	Description string               `json:"description,omitempty"`
+	URL         string               `json:"url,omitempty"`   // opened when the embed title is clicked
+	Color       string               `json:"color,omitempty"` // hex color, e.g. #ff0000
+	Fields      []*messageEmbedField `json:"fields,omitempty"`
+}
+
+type messageEmbedField struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Inline bool   `json:"inline,omitempty"` // displayed next to other inline fields, if there is room
+}
+
+// messagePublisher is the verified identity of the user who published a message
+type messagePublisher struct {
+	User  string `json:"user"`
+	Token string `json:"token,omitempty"` // Label of the access token, if a token was used to publish
+}
+
 func newAction() *action {
 	return &action{
 		Headers: make(map[string]string),
@@ -92,20 +128,26 @@ func newAction() *action {
 
 // publishMessage is used as input when publishing as JSON
 type publishMessage struct {
-	Topic    string   `json:"topic"`
-	Title    string   `json:"title"`
-	Message  string   `json:"message"`
-	Priority int      `json:"priority"`
-	Tags     []string `json:"tags"`
-	Click    string   `json:"click"`
-	Icon     string   `json:"icon"`
-	Actions  []action `json:"actions"`
-	Attach   string   `json:"attach"`
-	Markdown bool     `json:"markdown"`
-	Filename string   `json:"filename"`
-	Email    string   `json:"email"`
-	Call     string   `json:"call"`
-	Delay    string   `json:"delay"`
+	Topic         string         `json:"topic"`
+	Title         string         `json:"title"`
+	Message       string         `json:"message"`
+	Priority      int            `json:"priority"`
+	Tags          []string       `json:"tags"`
+	Click         string         `json:"click"`
+	Icon          string         `json:"icon"`
+	Actions       []action       `json:"actions"`
+	Embeds        []messageEmbed `json:"embeds"`
+	Attach        string         `json:"attach"`
+	Markdown      bool           `json:"markdown"`
+	Filename      string         `json:"filename"`
+	Email         string         `json:"email"`
+	Call          string         `json:"call"`
+	CallChannel   string         `json:"call_channel"`
+	Delay         string         `json:"delay"`
+	MessageTTL    string         `json:"message_ttl"`
+	AttachmentTTL string         `json:"attachment_ttl"`
+	Summary       string         `json:"summary"`
+	Alt           string         `json:"alt"`
 }
 
 // messageEncoder is a function that knows how to encode a message
@@ -132,6 +174,21 @@ func newKeepaliveMessage(topic string) *message {
 	return newMessage(keepaliveEvent, topic, "")
 }
 
+// newCloseMessage is a convenience method to create a close message, reporting the connection statistics
+func newCloseMessage(topic string, stats *connStats) *message {
+	m := newMessage(closeEvent, topic, "")
+	m.Stats = stats
+	return m
+}
+
+// newExpiredMessage is a convenience method to create an expired message, listing the IDs of messages that were
+// deleted from the cache, so that clients can remove them as well
+func newExpiredMessage(topic string, ids []string) *message {
+	m := newMessage(expiredEvent, topic, "")
+	m.Expired = ids
+	return m
+}
+
 // newDefaultMessage is a convenience method to create a notification message
 func newDefaultMessage(topic, msg string) *message {
 	return newMessage(messageEvent, topic, msg)
@@ -144,6 +201,49 @@ func newPollRequestMessage(topic, pollID string) *message {
 	return m
 }
 
+// connStats are the connection-level statistics of a subscription (HTTP stream or WebSocket), which are logged
+// and optionally sent to the client in a "close" event when the subscription ends. Counters are updated atomically,
+// since messages for multiple topics may be sent concurrently.
+type connStats struct {
+	Messages int64     `json:"messages"` // Number of messages (message events) delivered
+	Bytes    int64     `json:"bytes"`    // Number of bytes sent, including open/keepalive events
+	Duration int64     `json:"duration"` // Connection duration in milliseconds
+	started  time.Time // Time the subscription was opened
+}
+
+func newConnStats() *connStats {
+	return &connStats{
+		started: time.Now(),
+	}
+}
+
+// Sent records that the given message was sent to the subscriber, using the given number of bytes
+func (c *connStats) Sent(m *message, bytes int) {
+	if m.Event == messageEvent {
+		atomic.AddInt64(&c.Messages, 1)
+	}
+	atomic.AddInt64(&c.Bytes, int64(bytes))
+}
+
+// Snapshot returns a copy of the current stats, with the duration set to the time since the subscription was opened
+func (c *connStats) Snapshot() *connStats {
+	return &connStats{
+		Messages: atomic.LoadInt64(&c.Messages),
+		Bytes:    atomic.LoadInt64(&c.Bytes),
+		Duration: time.Since(c.started).Milliseconds(),
+		started:  c.started,
+	}
+}
+
+func (c *connStats) Context() log.Context {
+	stats := c.Snapshot()
+	return log.Context{
+		"subscription_messages":    stats.Messages,
+		"subscription_bytes":       stats.Bytes,
+		"subscription_duration_ms": stats.Duration,
+	}
+}
+
 func validMessageID(s string) bool {
 	return util.ValidRandomString(s, messageIDLength)
 }
@@ -194,6 +294,18 @@ type queryFilter struct {
 	Priority []int
 }
 
+// messagePage limits the cached messages that are sent to a subscriber, see parseMessagePage
+type messagePage struct {
+	Until int64 // Unix timestamp; only send messages published at or before this time, 0 means no limit
+	Limit int   // Max. number of cached messages to send, 0 means no limit
+}
+
+// messageCursor is a position in the (time, id) order of the message cache, see messageCache.MessagesPage
+type messageCursor struct {
+	Time  int64
+	RowID int64
+}
+
 func parseQueryFilters(r *http.Request) (*queryFilter, error) {
 	idFilter := readParam(r, "x-id", "id")
 	messageFilter := readParam(r, "x-message", "message", "m")
@@ -240,12 +352,101 @@ func (q *queryFilter) Pass(msg *message) bool {
 }
 
 type apiHealthResponse struct {
-	Healthy bool `json:"healthy"`
+	Healthy       bool              `json:"healthy"`
+	Draining      bool              `json:"draining,omitempty"` // True if the server is draining, see setDraining
+	Subscriptions int64             `json:"subscriptions"`      // Number of active subscriptions (streaming connections)
+	Checks        map[string]string `json:"checks,omitempty"`   // Database checks (name -> "ok" or error), only if ?deep=1
+}
+
+type apiTopicSeriesRequest struct {
+	Fields map[string]string `json:"fields"` // Field name -> JSON field path, e.g. "temperature" -> "$.temperature"
+}
+
+type apiTopicSeriesResponse struct {
+	Topic  string                            `json:"topic"`
+	Fields map[string]string                 `json:"fields"`
+	Series map[string][]*apiTopicSeriesPoint `json:"series"`
+}
+
+type apiTopicSeriesPoint struct {
+	Time  int64    `json:"time"`
+	Value float64  `json:"value"`           // Value, or average value of the bucket if aggregated
+	Min   *float64 `json:"min,omitempty"`   // Only set if aggregated
+	Max   *float64 `json:"max,omitempty"`   // Only set if aggregated
+	Count int      `json:"count,omitempty"` // Only set if aggregated
+}
+
+type apiTopicSamplingRequest struct {
+	Rate        int   `json:"rate"`                   // Deliver 1 in Rate messages
+	MaxPriority int   `json:"max_priority,omitempty"` // Messages up to this priority are sampled (default: 3)
+	Summary     *bool `json:"summary,omitempty"`      // Publish an hourly summary of suppressed messages (default: true)
+}
+
+type apiTopicSamplingResponse struct {
+	Topic       string `json:"topic"`
+	Rate        int    `json:"rate"`
+	MaxPriority int    `json:"max_priority"`
+	Summary     bool   `json:"summary"`
+	Suppressed  int    `json:"suppressed"` // Suppressed messages since the last summary
+}
+
+type apiTopicIdentityResponse struct {
+	Topic   string `json:"topic"`
+	Enabled bool   `json:"enabled"`
+}
+
+type apiAdminDrainResponse struct {
+	Draining bool `json:"draining"`
+}
+
+type apiInstantResponse struct {
+	WebSocketURL      string `json:"websocket_url,omitempty"` // Base URL for WebSocket subscriptions, e.g. wss://ntfy.example.com
+	KeepaliveInterval int64  `json:"keepalive_interval"`      // Seconds between server pings
+	PongTimeout       int64  `json:"pong_timeout"`            // Seconds after which a connection without pongs is closed
+	ReconnectDelayMin int64  `json:"reconnect_delay_min"`     // Recommended min. seconds before reconnecting
+	ReconnectDelayMax int64  `json:"reconnect_delay_max"`     // Recommended max. seconds before reconnecting (with backoff)
+	Firebase          bool   `json:"firebase"`                // True if the server can deliver via Firebase (FCM)
+}
+
+type apiInstantDeviceRequest struct {
+	Token string `json:"token,omitempty"` // Existing reconnect token, if any
+}
+
+type apiInstantDeviceResponse struct {
+	ID      string `json:"id"`
+	Token   string `json:"token"`
+	Expires int64  `json:"expires"` // Unix time after which the device is pruned, unless it is seen again
+}
+
+type apiInstantDevice struct {
+	ID             string `json:"id"`
+	Owner          string `json:"owner"`
+	Topics         string `json:"topics,omitempty"`
+	Connected      bool   `json:"connected"`
+	ConnectedSince int64  `json:"connected_since,omitempty"`
+	Reconnects     int    `json:"reconnects"`
+	LastMessageID  string `json:"last_message_id,omitempty"`
+	Created        int64  `json:"created"`
+	LastSeen       int64  `json:"last_seen"`
+}
+
+type apiInstantDevicesResponse struct {
+	Total     int                 `json:"total"`
+	Connected int                 `json:"connected"`
+	Devices   []*apiInstantDevice `json:"devices"`
 }
 
 type apiStatsResponse struct {
-	Messages     int64   `json:"messages"`
-	MessagesRate float64 `json:"messages_rate"` // Average number of messages per second
+	Messages     int64                     `json:"messages"`
+	MessagesRate float64                   `json:"messages_rate"` // Average number of messages per second
+	Firebase     *apiStatsFirebaseResponse `json:"firebase,omitempty"`
+}
+
+// apiStatsFirebaseResponse is the Firebase pacing state, see firebasePacer
+type apiStatsFirebaseResponse struct {
+	PacedTopics  int   `json:"paced_topics"`  // Number of topics whose messages are currently held back
+	ProjectDelay int64 `json:"project_delay"` // Seconds until messages to all topics resume, 0 if not paced
+	MaxDelay     int64 `json:"max_delay"`     // Longest time in seconds until messages to any topic resume
 }
 
 type apiUserAddRequest struct {
@@ -256,10 +457,12 @@ type apiUserAddRequest struct {
 }
 
 type apiUserResponse struct {
-	Username string                  `json:"username"`
-	Role     string                  `json:"role"`
-	Tier     string                  `json:"tier,omitempty"`
-	Grants   []*apiUserGrantResponse `json:"grants,omitempty"`
+	Username    string                  `json:"username"`
+	Role        string                  `json:"role"`
+	Tier        string                  `json:"tier,omitempty"`
+	TierExpires int64                   `json:"tier_expires,omitempty"` // Only set if the tier was granted until a certain time
+	Grants      []*apiUserGrantResponse `json:"grants,omitempty"`
+	Suspension  *apiAccountSuspension   `json:"suspension,omitempty"`
 }
 
 type apiUserGrantResponse struct {
@@ -271,6 +474,26 @@ type apiUserDeleteRequest struct {
 	Username string `json:"username"`
 }
 
+type apiUserSuspendRequest struct {
+	Username string `json:"username"`
+	Reason   string `json:"reason"`
+	Until    int64  `json:"until"` // Unix timestamp; 0 means indefinitely
+}
+
+type apiUserReinstateRequest struct {
+	Username string `json:"username"`
+}
+
+type apiUserTierGrantRequest struct {
+	Username string `json:"username"`
+	Tier     string `json:"tier"`
+	Until    int64  `json:"until"` // Unix timestamp; 0 means permanently
+}
+
+type apiUserTierRevokeRequest struct {
+	Username string `json:"username"`
+}
+
 type apiAccessAllowRequest struct {
 	Username   string `json:"username"`
 	Topic      string `json:"topic"` // This may be a pattern
@@ -282,9 +505,46 @@ type apiAccessResetRequest struct {
 	Topic    string `json:"topic"`
 }
 
+type apiAccessCheckResponse struct {
+	User        string                       `json:"user"` // Username, or Everyone (*) for anonymous users
+	Topic       string                       `json:"topic"`
+	Permission  string                       `json:"permission"`
+	Allowed     bool                         `json:"allowed"`
+	Reason      string                       `json:"reason"`
+	Explanation string                       `json:"explanation"`
+	Entry       *apiAccessCheckEntryResponse `json:"entry,omitempty"`
+	Tier        string                       `json:"tier,omitempty"`
+}
+
+type apiAccessCheckEntryResponse struct {
+	User       string `json:"user"`
+	Topic      string `json:"topic"` // This may be a pattern
+	Permission string `json:"permission"`
+	Owner      string `json:"owner,omitempty"`
+}
+
+type apiAttachmentUploadResponse struct {
+	ID      string `json:"id"`
+	Length  int64  `json:"length"`
+	Offset  int64  `json:"offset"`
+	Expires int64  `json:"expires"`
+}
+
+type apiFileURLResponse struct {
+	URL     string `json:"url"`
+	Expires int64  `json:"expires"`
+}
+
+type apiAccessImportResponse struct {
+	DryRun  bool                    `json:"dry_run"`
+	Changes *user.AccessListChanges `json:"changes"`
+}
+
 type apiAccountCreateRequest struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
+	Email    string `json:"email,omitempty"`  // Required if enable-signup-verification is set
+	Invite   string `json:"invite,omitempty"` // Required if signup-mode is "invite"
 }
 
 type apiAccountPasswordChangeRequest struct {
@@ -292,13 +552,27 @@ type apiAccountPasswordChangeRequest struct {
 	NewPassword string `json:"new_password"`
 }
 
-type apiAccountDeleteRequest struct {
+type apiAccountChangeRequest struct {
+	Username string `json:"username"`
 	Password string `json:"password"`
 }
 
+type apiAccountDeleteRequest struct {
+	Password     string `json:"password"`
+	ArchiveEmail string `json:"archive_email,omitempty"` // Send the messages of reserved topics to this address first, see server_archive.go
+}
+
 type apiAccountTokenIssueRequest struct {
-	Label   *string `json:"label"`
-	Expires *int64  `json:"expires"` // Unix timestamp
+	Label       *string               `json:"label"`
+	Type        *string               `json:"type"`         // "web", "cli" or "integration"; defaults to "web" without label, "integration" with label
+	Expires     *int64                `json:"expires"`      // Unix timestamp
+	HardExpires *int64                `json:"hard_expires"` // Unix timestamp, cannot be extended
+	Scope       *apiAccountTokenScope `json:"scope"`
+}
+
+type apiAccountTokenScope struct {
+	Permission string   `json:"permission"` // "read-write", "read-only" (subscribe-only), or "write-only" (publish-only)
+	Topics     []string `json:"topics,omitempty"`
 }
 
 type apiAccountTokenUpdateRequest struct {
@@ -307,12 +581,55 @@ type apiAccountTokenUpdateRequest struct {
 	Expires *int64  `json:"expires"` // Unix timestamp
 }
 
+type apiAccountTokenRotateRequest struct {
+	Token       string `json:"token"`        // Defaults to the token used for authentication
+	GracePeriod *int64 `json:"grace_period"` // Seconds the old token stays valid; defaults to token-rotation-grace-period
+}
+
+type apiAccountTokenRotateResponse struct {
+	Token    *apiAccountTokenResponse `json:"token"`
+	Previous *apiAccountTokenResponse `json:"previous"`
+}
+
+type apiTopicMuteRequest struct {
+	Message  string `json:"message"`            // Message ID; the sender of this message is muted
+	Duration string `json:"duration,omitempty"` // e.g. "1h" or "2d"; defaults to 24h
+}
+
+type apiTopicMuteResponse struct {
+	MutedUntil int64 `json:"muted_until"`
+}
+
+type apiTopicStatsResponse struct {
+	Topic           string                         `json:"topic"`
+	Messages        int                            `json:"messages"`
+	AttachmentsSize int64                          `json:"attachments_size"`
+	Subscribers     int                            `json:"subscribers"`
+	LastAccess      int64                          `json:"last_access,omitempty"`
+	Firebase        *apiTopicStatsFirebaseResponse `json:"firebase,omitempty"`
+}
+
+type apiTopicStatsFirebaseResponse struct {
+	Delivered     int    `json:"delivered"`
+	Throttled     int    `json:"throttled"`
+	Invalid       int    `json:"invalid"`
+	Failed        int    `json:"failed"`
+	LastError     string `json:"last_error,omitempty"`
+	LastErrorTime int64  `json:"last_error_time,omitempty"`
+}
+
 type apiAccountTokenResponse struct {
-	Token      string `json:"token"`
-	Label      string `json:"label,omitempty"`
-	LastAccess int64  `json:"last_access,omitempty"`
-	LastOrigin string `json:"last_origin,omitempty"`
-	Expires    int64  `json:"expires,omitempty"` // Unix timestamp
+	Token            string                `json:"token"`
+	Label            string                `json:"label,omitempty"`
+	Type             string                `json:"type,omitempty"`
+	LastAccess       int64                 `json:"last_access,omitempty"`
+	LastOrigin       string                `json:"last_origin,omitempty"`
+	Expires          int64                 `json:"expires,omitempty"`      // Unix timestamp
+	HardExpires      int64                 `json:"hard_expires,omitempty"` // Unix timestamp
+	Scope            *apiAccountTokenScope `json:"scope,omitempty"`
+	Created          int64                 `json:"created,omitempty"` // Unix timestamp
+	CreatedOrigin    string                `json:"created_origin,omitempty"`
+	CreatedUserAgent string                `json:"created_user_agent,omitempty"`
 }
 
 type apiAccountPhoneNumberVerifyRequest struct {
@@ -326,8 +643,9 @@ type apiAccountPhoneNumberAddRequest struct {
 }
 
 type apiAccountTier struct {
-	Code string `json:"code"`
-	Name string `json:"name"`
+	Code    string `json:"code"`
+	Name    string `json:"name"`
+	Expires int64  `json:"expires,omitempty"` // Only set if the tier was granted by an admin until a certain time
 }
 
 type apiAccountLimits struct {
@@ -341,6 +659,8 @@ type apiAccountLimits struct {
 	AttachmentFileSize       int64  `json:"attachment_file_size"`
 	AttachmentExpiryDuration int64  `json:"attachment_expiry_duration"`
 	AttachmentBandwidth      int64  `json:"attachment_bandwidth"`
+	Subscriptions            int64  `json:"subscriptions"`
+	SubscriptionDuration     int64  `json:"subscription_duration,omitempty"` // Seconds, 0 means unlimited
 }
 
 type apiAccountStats struct {
@@ -359,6 +679,7 @@ type apiAccountStats struct {
 type apiAccountReservation struct {
 	Topic    string `json:"topic"`
 	Everyone string `json:"everyone"`
+	Email    string `json:"email,omitempty"` // Secret email alias address, see handleAccountReservationEmailCreate
 }
 
 type apiAccountBilling struct {
@@ -370,6 +691,12 @@ type apiAccountBilling struct {
 	CancelAt     int64  `json:"cancel_at,omitempty"`
 }
 
+type apiAccountSuspension struct {
+	Since  int64  `json:"since"`
+	Until  int64  `json:"until,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
 type apiAccountResponse struct {
 	Username      string                     `json:"username"`
 	Role          string                     `json:"role,omitempty"`
@@ -380,10 +707,62 @@ type apiAccountResponse struct {
 	Reservations  []*apiAccountReservation   `json:"reservations,omitempty"`
 	Tokens        []*apiAccountTokenResponse `json:"tokens,omitempty"`
 	PhoneNumbers  []string                   `json:"phone_numbers,omitempty"`
+	TwoFactor     bool                       `json:"two_factor,omitempty"`
 	Tier          *apiAccountTier            `json:"tier,omitempty"`
 	Limits        *apiAccountLimits          `json:"limits,omitempty"`
 	Stats         *apiAccountStats           `json:"stats,omitempty"`
 	Billing       *apiAccountBilling         `json:"billing,omitempty"`
+	Suspension    *apiAccountSuspension      `json:"suspension,omitempty"`
+	Org           *apiAccountOrgMembership   `json:"org,omitempty"`
+}
+
+type apiAccountStatsResponse struct {
+	Granularity string                   `json:"granularity"` // "hour" or "day"
+	Since       int64                    `json:"since"`
+	Stats       []*apiAccountStatsPeriod `json:"stats"` // Only periods with usage, oldest first
+}
+
+type apiAccountStatsPeriod struct {
+	Time            int64                   `json:"time"` // Start of the period
+	Messages        int64                   `json:"messages"`
+	Emails          int64                   `json:"emails"`
+	AttachmentBytes int64                   `json:"attachment_bytes"`
+	Topics          []*apiAccountStatsTopic `json:"topics"`
+}
+
+type apiAccountStatsTopic struct {
+	Topic           string `json:"topic"`
+	Messages        int64  `json:"messages"`
+	Emails          int64  `json:"emails"`
+	AttachmentBytes int64  `json:"attachment_bytes"`
+}
+
+type apiAccountTOTPResponse struct {
+	Enabled           bool `json:"enabled"`
+	RecoveryCodesLeft int  `json:"recovery_codes_left,omitempty"`
+}
+
+type apiAccountTOTPEnrollResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+type apiAccountTOTPEnrollRequest struct {
+	Password string `json:"password"`
+}
+
+type apiAccountTOTPEnableRequest struct {
+	Password string `json:"password"`
+	Code     string `json:"code"`
+}
+
+type apiAccountTOTPEnableResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type apiAccountTOTPDisableRequest struct {
+	Password string `json:"password"`
+	Code     string `json:"code"`
 }
 
 type apiAccountReservationRequest struct {
@@ -391,11 +770,117 @@ type apiAccountReservationRequest struct {
 	Everyone string `json:"everyone"`
 }
 
+type apiAccountUnifiedPushEndpointDay struct {
+	Date     string `json:"date"` // YYYY-MM-DD
+	Messages int    `json:"messages"`
+}
+
+type apiAccountUnifiedPushEndpoint struct {
+	Topic         string                              `json:"topic"`
+	Subscribers   int                                 `json:"subscribers"`
+	MessagesToday int                                 `json:"messages_today"`
+	Days          []*apiAccountUnifiedPushEndpointDay `json:"days"`
+	LastAccess    int64                               `json:"last_access"`
+}
+
+type apiAccountUnifiedPushEndpointsResponse struct {
+	Endpoints []*apiAccountUnifiedPushEndpoint `json:"endpoints"`
+}
+
+type apiAccountReservationManagerRequest struct {
+	Username string `json:"username"`
+}
+
+type apiAccountReservationManagersResponse struct {
+	Managers []string `json:"managers"`
+}
+
+type apiAccountReservationMemberRequest struct {
+	Username   string `json:"username"`
+	Permission string `json:"permission,omitempty"` // Defaults to read-write
+}
+
+type apiAccountReservationMembersResponse struct {
+	Members []*apiAccountReservationMember `json:"members"`
+}
+
+type apiAccountReservationMember struct {
+	Username   string `json:"username"`
+	Permission string `json:"permission"`
+}
+
+type apiAccountReservationTransferRequest struct {
+	Username string `json:"username"`
+}
+
+type apiAccountOrgMembership struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+type apiAccountOrgCreateRequest struct {
+	Name string `json:"name"`
+}
+
+type apiAccountOrgResponse struct {
+	ID      string                 `json:"id"`
+	Name    string                 `json:"name"`
+	Role    string                 `json:"role"`
+	Tier    *apiAccountTier        `json:"tier,omitempty"`
+	Limits  *apiAccountOrgLimits   `json:"limits"`
+	Members []*apiAccountOrgMember `json:"members"`
+	Topics  []*apiAccountOrgTopic  `json:"topics"`
+	Billing *apiAccountBilling     `json:"billing,omitempty"`
+	Created int64                  `json:"created"`
+}
+
+type apiAccountOrgLimits struct {
+	Reservations int64 `json:"reservations"`
+}
+
+type apiAccountOrgMember struct {
+	Username string `json:"username"`
+	Role     string `json:"role"`
+}
+
+type apiAccountOrgTopic struct {
+	Topic    string `json:"topic"`
+	Everyone string `json:"everyone"`
+}
+
+type apiAccountOrgMemberRequest struct {
+	Username string `json:"username"`
+	Role     string `json:"role,omitempty"`
+}
+
+type apiAccountOrgInvitesResponse struct {
+	Invites []*apiAccountOrgMembership `json:"invites"`
+}
+
+type apiAccountOrgTopicRequest struct {
+	Topic    string `json:"topic"`
+	Everyone string `json:"everyone,omitempty"`
+}
+
+type apiTopicAliasRequest struct {
+	Topic string `json:"topic"`
+}
+
+type apiAccountReservationSecretResponse struct {
+	Secret string `json:"secret"`
+}
+
+type apiAccountReservationEmailResponse struct {
+	Address string `json:"address"`
+}
+
 type apiConfigResponse struct {
 	BaseURL            string   `json:"base_url"`
 	AppRoot            string   `json:"app_root"`
 	EnableLogin        bool     `json:"enable_login"`
 	EnableSignup       bool     `json:"enable_signup"`
+	SignupMode         string   `json:"signup_mode"`
 	EnablePayments     bool     `json:"enable_payments"`
 	EnableCalls        bool     `json:"enable_calls"`
 	EnableEmails       bool     `json:"enable_emails"`
@@ -404,6 +889,141 @@ type apiConfigResponse struct {
 	BillingContact     string   `json:"billing_contact"`
 	WebPushPublicKey   string   `json:"web_push_public_key"`
 	DisallowedTopics   []string `json:"disallowed_topics"`
+	Banner             string   `json:"banner"`
+}
+
+type apiBannerRequest struct {
+	Message string `json:"message"`
+}
+
+type apiReplayRequest struct {
+	Topic  string  `json:"topic"`
+	Target string  `json:"target"`
+	Since  string  `json:"since,omitempty"`
+	Until  string  `json:"until,omitempty"`
+	Speed  float64 `json:"speed,omitempty"`
+}
+
+type apiReplayResponse struct {
+	Success  bool `json:"success"`
+	Messages int  `json:"messages"`
+}
+
+type apiBanRequest struct {
+	IP       string `json:"ip,omitempty"` // IP address or network, e.g. 1.2.3.4 or 1.2.3.0/24
+	Username string `json:"username,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+	Until    int64  `json:"until,omitempty"` // Unix timestamp; 0 means permanently
+}
+
+type apiBanResponse struct {
+	IP       string `json:"ip,omitempty"`
+	Username string `json:"username,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+	Since    int64  `json:"since"`
+	Until    int64  `json:"until,omitempty"`
+}
+
+type apiBanVisitorResponse struct {
+	IP            string `json:"ip"`
+	Username      string `json:"username,omitempty"`
+	Messages      int64  `json:"messages"`
+	Emails        int64  `json:"emails"`
+	Calls         int64  `json:"calls"`
+	Subscriptions int64  `json:"subscriptions"`
+	LastSeen      int64  `json:"last_seen"`
+	Banned        bool   `json:"banned,omitempty"`
+}
+
+type apiBansResponse struct {
+	Bans     []*apiBanResponse        `json:"bans"`
+	Visitors []*apiBanVisitorResponse `json:"visitors"`
+}
+
+type apiAuthLockoutResponse struct {
+	Username    string `json:"username,omitempty"` // Empty for token auth failures
+	IP          string `json:"ip"`
+	Failures    int    `json:"failures"`
+	Lockouts    int    `json:"lockouts"`
+	LastFailure int64  `json:"last_failure"`
+	LockedUntil int64  `json:"locked_until,omitempty"`
+}
+
+type apiAuthLockoutsResponse struct {
+	Lockouts []*apiAuthLockoutResponse `json:"lockouts"`
+}
+
+type apiAuthLockoutsClearRequest struct {
+	Username string `json:"username,omitempty"`
+	IP       string `json:"ip,omitempty"`
+}
+
+type apiSigningKeyAddRequest struct {
+	Purpose string `json:"purpose"`
+	Secret  string `json:"secret,omitempty"` // Generated if empty
+}
+
+type apiSigningKeyRetireRequest struct {
+	Grace string `json:"grace,omitempty"` // Duration during which the key is still valid, e.g. 24h
+}
+
+type apiSigningKeyResponse struct {
+	ID      string `json:"id"`
+	Purpose string `json:"purpose"`
+	Secret  string `json:"secret,omitempty"` // Only returned when the key is added
+	Created int64  `json:"created"`
+	Expires int64  `json:"expires,omitempty"` // Only set for retired keys
+}
+
+type apiSigningKeysResponse struct {
+	Keys []*apiSigningKeyResponse `json:"keys"`
+}
+
+type apiInviteAddRequest struct {
+	Tier    string `json:"tier,omitempty"`     // Tier code new users are assigned to
+	MaxUses int    `json:"max_uses,omitempty"` // Zero means unlimited
+	Expires string `json:"expires,omitempty"`  // Duration, e.g. 7d; never expires if empty
+}
+
+type apiInviteResponse struct {
+	Code    string `json:"code"`
+	Link    string `json:"link,omitempty"` // Signup page of the web app, if base-url is set
+	Tier    string `json:"tier,omitempty"`
+	MaxUses int    `json:"max_uses,omitempty"`
+	Uses    int    `json:"uses"`
+	Created int64  `json:"created"`
+	Expires int64  `json:"expires,omitempty"`
+}
+
+type apiInvitesResponse struct {
+	Invites []*apiInviteResponse `json:"invites"`
+}
+
+type apiDashboardTokenRequest struct {
+	Topic   string `json:"topic"`
+	Expires string `json:"expires,omitempty"` // Duration, e.g. 30d
+}
+
+type apiDashboardTokenResponse struct {
+	Token   string `json:"token"`
+	URL     string `json:"url,omitempty"` // Only set if base-url is configured
+	Expires int64  `json:"expires"`
+}
+
+type apiDashboardResponse struct {
+	Topic    string     `json:"topic"`
+	Messages []*message `json:"messages"`
+}
+
+type apiEmailRetryResponse struct {
+	ID          int64  `json:"id"`
+	MessageID   string `json:"message_id"`
+	Topic       string `json:"topic"`
+	Email       string `json:"email"`
+	Attempts    int    `json:"attempts"`
+	NextAttempt int64  `json:"next_attempt"`
+	Created     int64  `json:"created"`
+	Error       string `json:"error"`
 }
 
 type apiAccountBillingPrices struct {
@@ -412,10 +1032,20 @@ type apiAccountBillingPrices struct {
 }
 
 type apiAccountBillingTier struct {
-	Code   string                   `json:"code,omitempty"`
-	Name   string                   `json:"name,omitempty"`
-	Prices *apiAccountBillingPrices `json:"prices,omitempty"`
-	Limits *apiAccountLimits        `json:"limits"`
+	Code      string                       `json:"code,omitempty"`
+	Name      string                       `json:"name,omitempty"`
+	Prices    *apiAccountBillingPrices     `json:"prices,omitempty"`
+	Discounts []*apiAccountBillingDiscount `json:"discounts,omitempty"`
+	Limits    *apiAccountLimits            `json:"limits"`
+}
+
+type apiAccountBillingDiscount struct {
+	Code             string  `json:"code"`
+	PercentOff       float64 `json:"percent_off,omitempty"`
+	AmountOff        int64   `json:"amount_off,omitempty"` // Cents (USD implied!)
+	Duration         string  `json:"duration"`             // "once", "repeating" or "forever"
+	DurationInMonths int64   `json:"duration_in_months,omitempty"`
+	ExpiresAt        int64   `json:"expires_at,omitempty"`
 }
 
 type apiAccountBillingSubscriptionCreateResponse struct {
@@ -423,8 +1053,9 @@ type apiAccountBillingSubscriptionCreateResponse struct {
 }
 
 type apiAccountBillingSubscriptionChangeRequest struct {
-	Tier     string `json:"tier"`
-	Interval string `json:"interval"`
+	Tier          string `json:"tier"`
+	Interval      string `json:"interval"`
+	PromotionCode string `json:"promotion_code,omitempty"`
 }
 
 type apiAccountBillingPortalRedirectResponse struct {
@@ -432,7 +1063,8 @@ type apiAccountBillingPortalRedirectResponse struct {
 }
 
 type apiAccountSyncTopicResponse struct {
-	Event string `json:"event"`
+	Event  string `json:"event"`
+	Banner string `json:"banner,omitempty"` // Only set for "banner" events
 }
 
 type apiSuccessResponse struct {
@@ -452,22 +1084,34 @@ type apiStripeSubscriptionUpdatedEvent struct {
 	CurrentPeriodEnd int64  `json:"current_period_end"`
 	CancelAt         int64  `json:"cancel_at"`
 	Items            *struct {
-		Data []*struct {
-			Price *struct {
-				ID        string `json:"id"`
-				Recurring *struct {
-					Interval string `json:"interval"`
-				} `json:"recurring"`
-			} `json:"price"`
-		} `json:"data"`
+		Data []*apiStripeSubscriptionItem `json:"data"`
 	} `json:"items"`
 }
 
+type apiStripeSubscriptionItem struct {
+	Price *struct {
+		ID        string `json:"id"`
+		Recurring *struct {
+			Interval  string `json:"interval"`
+			UsageType string `json:"usage_type"`
+		} `json:"recurring"`
+	} `json:"price"`
+}
+
 type apiStripeSubscriptionDeletedEvent struct {
 	ID       string `json:"id"`
 	Customer string `json:"customer"`
 }
 
+type apiStripeInvoiceCreatedEvent struct {
+	ID            string `json:"id"`
+	Customer      string `json:"customer"`
+	Subscription  string `json:"subscription"`
+	BillingReason string `json:"billing_reason"`
+	PeriodStart   int64  `json:"period_start"`
+	PeriodEnd     int64  `json:"period_end"`
+}
+
 type apiWebPushUpdateSubscriptionRequest struct {
 	Endpoint string   `json:"endpoint"`
 	Auth     string   `json:"auth"`
@@ -523,15 +1167,16 @@ func (w *webPushSubscription) Context() log.Context {
 
 // https://developer.mozilla.org/en-US/docs/Web/Manifest
 type webManifestResponse struct {
-	Name            string             `json:"name"`
-	Description     string             `json:"description"`
-	ShortName       string             `json:"short_name"`
-	Scope           string             `json:"scope"`
-	StartURL        string             `json:"start_url"`
-	Display         string             `json:"display"`
-	BackgroundColor string             `json:"background_color"`
-	ThemeColor      string             `json:"theme_color"`
-	Icons           []*webManifestIcon `json:"icons"`
+	Name             string                        `json:"name"`
+	Description      string                        `json:"description"`
+	ShortName        string                        `json:"short_name"`
+	Scope            string                        `json:"scope"`
+	StartURL         string                        `json:"start_url"`
+	Display          string                        `json:"display"`
+	BackgroundColor  string                        `json:"background_color"`
+	ThemeColor       string                        `json:"theme_color"`
+	Icons            []*webManifestIcon            `json:"icons"`
+	ProtocolHandlers []*webManifestProtocolHandler `json:"protocol_handlers"`
 }
 
 type webManifestIcon struct {
@@ -539,3 +1184,8 @@ type webManifestIcon struct {
 	Sizes string `json:"sizes"`
 	Type  string `json:"type"`
 }
+
+type webManifestProtocolHandler struct {
+	Protocol string `json:"protocol"`
+	URL      string `json:"url"`
+}
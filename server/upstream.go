@@ -0,0 +1,195 @@
+package server
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"heckel.io/ntfy/v2/log"
+	"heckel.io/ntfy/v2/util"
+)
+
+// Poll requests are forwarded to "upstream-base-url" (see forwardPollRequest). To keep iOS notifications working
+// when the upstream server is unreachable, "upstream-fallback-base-urls" can list additional upstream servers,
+// which are tried in order if the previous one fails.
+//
+// An upstream server is marked unhealthy if a poll request fails with a connection error or an HTTP 5xx response,
+// and is then skipped (unless all servers are unhealthy) until a health check succeeds again. Health checks
+// (GET /v1/health) are performed for all upstream servers by the manager, see checkUpstreamHealth. Other errors
+// (e.g. HTTP 429 if rate limits are exceeded) do not trigger a failover, since the next server will likely
+// respond the same way.
+
+// upstreamServer is a single upstream server and its health
+type upstreamServer struct {
+	BaseURL string
+	Healthy bool
+}
+
+// upstreamServers is the list of upstream servers, in order of preference
+type upstreamServers struct {
+	servers []*upstreamServer
+	mu      sync.Mutex
+}
+
+func newUpstreamServers(baseURLs ...string) *upstreamServers {
+	servers := make([]*upstreamServer, 0)
+	for _, baseURL := range baseURLs {
+		if baseURL != "" {
+			servers = append(servers, &upstreamServer{BaseURL: baseURL, Healthy: true})
+		}
+	}
+	return &upstreamServers{
+		servers: servers,
+	}
+}
+
+// Candidates returns the base URLs of all upstream servers in the order in which they should be tried, i.e. the
+// healthy servers in order of preference first, followed by the unhealthy servers as a last resort
+func (u *upstreamServers) Candidates() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	healthy, unhealthy := make([]string, 0), make([]string, 0)
+	for _, server := range u.servers {
+		if server.Healthy {
+			healthy = append(healthy, server.BaseURL)
+		} else {
+			unhealthy = append(unhealthy, server.BaseURL)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+// BaseURLs returns the base URLs of all upstream servers in order of preference
+func (u *upstreamServers) BaseURLs() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	baseURLs := make([]string, len(u.servers))
+	for i, server := range u.servers {
+		baseURLs[i] = server.BaseURL
+	}
+	return baseURLs
+}
+
+// MarkHealthy marks the upstream server with the given base URL as healthy or unhealthy, and logs the change
+func (u *upstreamServers) MarkHealthy(baseURL string, healthy bool, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, server := range u.servers {
+		if server.BaseURL != baseURL || server.Healthy == healthy {
+			continue
+		}
+		server.Healthy = healthy
+		if healthy {
+			log.Tag(tagUpstream).Field("upstream_base_url", baseURL).Info("Upstream server %s is available again", baseURL)
+		} else if len(u.servers) > 1 {
+			log.Tag(tagUpstream).Field("upstream_base_url", baseURL).Err(err).Warn("Upstream server %s is unavailable, failing over to other upstream servers", baseURL)
+		} else {
+			log.Tag(tagUpstream).Field("upstream_base_url", baseURL).Err(err).Warn("Upstream server %s is unavailable", baseURL)
+		}
+	}
+}
+
+// forwardPollRequest publishes a poll request for the given message to the upstream server(s), see above. Poll
+// requests only contain the message ID and the SHA256 of the topic URL, so the upstream server cannot read the message.
+func (s *Server) forwardPollRequest(v *visitor, m *message) {
+	topicURL := fmt.Sprintf("%s/%s", s.config().BaseURL, m.Topic)
+	topicHash := fmt.Sprintf("%x", sha256.Sum256([]byte(topicURL)))
+	var err error
+	for _, baseURL := range s.upstreams.Candidates() {
+		var failover bool
+		failover, err = s.forwardPollRequestTo(v, m, baseURL, topicHash)
+		if err == nil || !failover {
+			break
+		}
+	}
+	if err != nil {
+		s.integrationFailed("upstream", m, err)
+	}
+}
+
+// forwardPollRequestTo publishes a poll request to a single upstream server. It returns an error if the request
+// failed, and whether the next upstream server should be tried.
+func (s *Server) forwardPollRequestTo(v *visitor, m *message, baseURL, topicHash string) (failover bool, err error) {
+	conf := s.config()
+	forwardURL := fmt.Sprintf("%s/%s", baseURL, topicHash)
+	logvm(v, m).Debug("Publishing poll request to %s", forwardURL)
+	req, err := http.NewRequest("POST", forwardURL, strings.NewReader(""))
+	if err != nil {
+		logvm(v, m).Err(err).Warn("Unable to publish poll request")
+		return false, err
+	}
+	req.Header.Set("User-Agent", "ntfy/"+conf.Version)
+	req.Header.Set("X-Poll-ID", m.ID)
+	if conf.UpstreamAccessToken != "" {
+		req.Header.Set("Authorization", util.BearerAuth(conf.UpstreamAccessToken))
+	}
+	response, err := s.upstreamClient.Do(req)
+	if err != nil {
+		logvm(v, m).Err(err).Warn("Unable to publish poll request to upstream server %s", baseURL)
+		s.upstreams.MarkHealthy(baseURL, false, err)
+		return true, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusOK {
+		s.upstreams.MarkHealthy(baseURL, true, nil)
+		return false, nil
+	}
+	err = fmt.Errorf("upstream server %s responded with HTTP %s", baseURL, response.Status)
+	if response.StatusCode >= 500 {
+		logvm(v, m).Err(err).Warn("Unable to publish poll request, the upstream server %s responded with HTTP %s", baseURL, response.Status)
+		s.upstreams.MarkHealthy(baseURL, false, err)
+		return true, err
+	} else if response.StatusCode == http.StatusTooManyRequests {
+		logvm(v, m).Err(err).Warn("Unable to publish poll request, the upstream server %s responded with HTTP %s; you may solve this by sending fewer daily messages, or by configuring upstream-access-token (assuming you have an account with higher rate limits) ", baseURL, response.Status)
+	} else {
+		logvm(v, m).Err(err).Warn("Unable to publish poll request, the upstream server %s responded with HTTP %s", baseURL, response.Status)
+	}
+	return false, err
+}
+
+// checkUpstreamHealth checks the health endpoint of all upstream servers concurrently, and marks them as
+// healthy or unhealthy. Health checks bypass the circuit breaker of the HTTP client, so that a recovered server
+// is detected right away.
+func (s *Server) checkUpstreamHealth() {
+	if s.upstreams == nil {
+		return
+	}
+	var wg sync.WaitGroup
+	for _, baseURL := range s.upstreams.BaseURLs() {
+		wg.Add(1)
+		go func(baseURL string) {
+			defer wg.Done()
+			err := s.checkUpstreamHealthOf(baseURL)
+			if err != nil {
+				log.Tag(tagUpstream).Field("upstream_base_url", baseURL).Err(err).Debug("Health check of upstream server %s failed", baseURL)
+			}
+			s.upstreams.MarkHealthy(baseURL, err == nil, err)
+		}(baseURL)
+	}
+	wg.Wait()
+}
+
+func (s *Server) checkUpstreamHealthOf(baseURL string) error {
+	req, err := http.NewRequest("GET", baseURL+apiHealthPath, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "ntfy/"+s.config().Version)
+	response, err := s.upstreamClient.Client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected HTTP status %s", response.Status)
+	}
+	health, err := util.UnmarshalJSON[apiHealthResponse](response.Body)
+	if err != nil {
+		return err
+	} else if !health.Healthy {
+		return fmt.Errorf("upstream server reports unhealthy state")
+	}
+	return nil
+}
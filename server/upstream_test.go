@@ -0,0 +1,111 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestServer_Upstream_Failover(t *testing.T) {
+	var primaryDown atomic.Bool
+	var primaryRequests, fallbackRequests atomic.Int32
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if primaryDown.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		} else if r.URL.Path == apiHealthPath {
+			json.NewEncoder(w).Encode(&apiHealthResponse{Healthy: true})
+		}
+		if r.URL.Path != apiHealthPath {
+			primaryRequests.Add(1)
+		}
+	}))
+	defer primary.Close()
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != apiHealthPath {
+			fallbackRequests.Add(1)
+		}
+	}))
+	defer fallback.Close()
+
+	c := newTestConfig(t)
+	c.BaseURL = "http://myserver.internal"
+	c.UpstreamBaseURL = primary.URL
+	c.UpstreamFallbackBaseURLs = []string{fallback.URL}
+	s := newTestServer(t, c)
+
+	// Primary fails, poll request goes to the fallback server
+	primaryDown.Store(true)
+	response := request(t, s, "PUT", "/mytopic", "hi", nil)
+	require.Equal(t, 200, response.Code)
+	waitFor(t, func() bool {
+		return fallbackRequests.Load() == 1
+	})
+	require.Equal(t, int32(1), primaryRequests.Load())
+	require.Equal(t, []string{fallback.URL, primary.URL}, s.upstreams.Candidates())
+
+	// Primary is now skipped
+	response = request(t, s, "PUT", "/mytopic", "hi again", nil)
+	require.Equal(t, 200, response.Code)
+	waitFor(t, func() bool {
+		return fallbackRequests.Load() == 2
+	})
+	require.Equal(t, int32(1), primaryRequests.Load())
+
+	// Primary recovers, and is used again after the health check
+	primaryDown.Store(false)
+	s.checkUpstreamHealth()
+	require.Equal(t, []string{primary.URL, fallback.URL}, s.upstreams.Candidates())
+	response = request(t, s, "PUT", "/mytopic", "back to normal", nil)
+	require.Equal(t, 200, response.Code)
+	waitFor(t, func() bool {
+		return primaryRequests.Load() == 2
+	})
+	require.Equal(t, int32(2), fallbackRequests.Load())
+}
+
+func TestServer_Upstream_NoFailoverOnRateLimit(t *testing.T) {
+	var primaryRequests, fallbackRequests atomic.Int32
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		primaryRequests.Add(1)
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer primary.Close()
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fallbackRequests.Add(1)
+	}))
+	defer fallback.Close()
+
+	c := newTestConfig(t)
+	c.BaseURL = "http://myserver.internal"
+	c.UpstreamBaseURL = primary.URL
+	c.UpstreamFallbackBaseURLs = []string{fallback.URL}
+	s := newTestServer(t, c)
+
+	response := request(t, s, "PUT", "/mytopic", "hi", nil)
+	require.Equal(t, 200, response.Code)
+	waitFor(t, func() bool {
+		return primaryRequests.Load() == 1
+	})
+	require.Equal(t, int32(0), fallbackRequests.Load())
+	require.Equal(t, []string{primary.URL, fallback.URL}, s.upstreams.Candidates())
+}
+
+func TestUpstreamServers_HealthCheckFails(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&apiHealthResponse{Healthy: false})
+	}))
+	defer upstream.Close()
+
+	c := newTestConfig(t)
+	c.BaseURL = "http://myserver.internal"
+	c.UpstreamBaseURL = upstream.URL
+	c.UpstreamFallbackBaseURLs = []string{"http://127.0.0.1:1"} // Nothing listening
+	s := newTestServer(t, c)
+	s.checkUpstreamHealth()
+	require.Equal(t, []string{upstream.URL, "http://127.0.0.1:1"}, s.upstreams.Candidates()) // All unhealthy, order kept
+	require.False(t, s.upstreams.servers[0].Healthy)
+	require.False(t, s.upstreams.servers[1].Healthy)
+}
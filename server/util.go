@@ -9,6 +9,7 @@ import (
 	"mime"
 	"net/http"
 	"net/netip"
+	"net/url"
 	"regexp"
 	"strings"
 )
@@ -154,3 +155,20 @@ func maybeIgnoreSpecialHeader(name, value string) string {
 	}
 	return value
 }
+
+// urlSchemeAllowed returns true if the scheme of the URL is in the list of allowed schemes (e.g. "https",
+// "mailto"). An empty list, or a list containing "*", allows all schemes. HTTP(S) URLs must have a host.
+func urlSchemeAllowed(rawURL string, schemes []string) bool {
+	if len(schemes) == 0 || util.Contains(schemes, "*") {
+		return true
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme == "" {
+		return false
+	}
+	scheme := strings.ToLower(u.Scheme)
+	if (scheme == "http" || scheme == "https") && u.Host == "" {
+		return false
+	}
+	return util.Contains(schemes, scheme)
+}
@@ -32,6 +32,16 @@ func TestReadBoolParam(t *testing.T) {
 	require.Equal(t, true, firebase)
 }
 
+func TestURLSchemeAllowed(t *testing.T) {
+	require.True(t, urlSchemeAllowed("anything", nil))
+	require.True(t, urlSchemeAllowed("ftp://example.com", []string{"*"}))
+	require.True(t, urlSchemeAllowed("HTTPS://example.com", []string{"https"}))
+	require.True(t, urlSchemeAllowed("mailto:phil@example.com", []string{"https", "mailto"}))
+	require.False(t, urlSchemeAllowed("https://", []string{"https"}))
+	require.False(t, urlSchemeAllowed("example.com", []string{"https"}))
+	require.False(t, urlSchemeAllowed("http://example.com", []string{"https"}))
+}
+
 func TestRenderHTTPRequest_ValidShort(t *testing.T) {
 	r, _ := http.NewRequest("POST", "http://ntfy.sh/mytopic?p=2", strings.NewReader("some message"))
 	r.Header.Set("Title", "A title")
@@ -63,9 +63,9 @@ type visitor struct {
 	callsLimiter        *util.FixedLimiter // Rate limiter for calls
 	subscriptionLimiter *util.FixedLimiter // Fixed limiter for active subscriptions (ongoing connections)
 	bandwidthLimiter    *util.RateLimiter  // Limiter for attachment bandwidth downloads
+	orgLimiters         *orgLimiters       // Limiters shared with other members of the organization, may be nil, see orgLimits
 	accountLimiter      *rate.Limiter      // Rate limiter for account creation, may be nil
 	authLimiter         *rate.Limiter      // Limiter for incorrect login attempts, may be nil
-	firebase            time.Time          // Next allowed Firebase message
 	seen                time.Time          // Last seen time of this visitor (needed for removal of stale visitors)
 	mu                  sync.RWMutex
 }
@@ -90,6 +90,8 @@ type visitorLimits struct {
 	AttachmentFileSizeLimit  int64
 	AttachmentExpiryDuration time.Duration
 	AttachmentBandwidthLimit int64
+	SubscriptionLimit        int64
+	SubscriptionDuration     time.Duration // Max. duration of a single subscription, 0 means unlimited
 }
 
 type visitorStats struct {
@@ -127,13 +129,12 @@ func newVisitor(conf *Config, messageCache *messageCache, userManager *user.Mana
 		userManager:         userManager, // May be nil
 		ip:                  ip,
 		user:                user,
-		firebase:            time.Unix(0, 0),
 		seen:                time.Now(),
-		subscriptionLimiter: util.NewFixedLimiter(int64(conf.VisitorSubscriptionLimit)),
 		requestLimiter:      nil, // Set in resetLimiters
 		messagesLimiter:     nil, // Set in resetLimiters, may be nil
 		emailsLimiter:       nil, // Set in resetLimiters
 		callsLimiter:        nil, // Set in resetLimiters, may be nil
+		subscriptionLimiter: nil, // Set in resetLimiters
 		bandwidthLimiter:    nil, // Set in resetLimiters
 		accountLimiter:      nil, // Set in resetLimiters, may be nil
 		authLimiter:         nil, // Set in resetLimiters, may be nil
@@ -209,40 +210,52 @@ func (v *visitor) RequestAllowed() bool {
 	return v.requestLimiter.Allow()
 }
 
-func (v *visitor) FirebaseAllowed() bool {
-	v.mu.RLock()
-	defer v.mu.RUnlock()
-	return !time.Now().Before(v.firebase)
-}
-
-func (v *visitor) FirebaseTemporarilyDeny() {
-	v.mu.Lock()
-	defer v.mu.Unlock()
-	v.firebase = time.Now().Add(v.config.FirebaseQuotaExceededPenaltyDuration)
-}
-
 func (v *visitor) MessageAllowed() bool {
 	v.mu.RLock() // limiters could be replaced!
 	defer v.mu.RUnlock()
-	return v.messagesLimiter.Allow()
+	if !v.messagesLimiter.Allow() {
+		return false
+	} else if v.orgLimiters != nil && !v.orgLimiters.messages.Allow() {
+		v.messagesLimiter.AllowN(-1)
+		return false
+	}
+	return true
 }
 
 func (v *visitor) EmailAllowed() bool {
 	v.mu.RLock() // limiters could be replaced!
 	defer v.mu.RUnlock()
-	return v.emailsLimiter.Allow()
+	if !v.emailsLimiter.Allow() {
+		return false
+	} else if v.orgLimiters != nil && !v.orgLimiters.emails.Allow() {
+		v.emailsLimiter.AllowN(-1)
+		return false
+	}
+	return true
 }
 
 func (v *visitor) CallAllowed() bool {
 	v.mu.RLock() // limiters could be replaced!
 	defer v.mu.RUnlock()
-	return v.callsLimiter.Allow()
+	if !v.callsLimiter.Allow() {
+		return false
+	} else if v.orgLimiters != nil && !v.orgLimiters.calls.Allow() {
+		v.callsLimiter.AllowN(-1)
+		return false
+	}
+	return true
 }
 
-func (v *visitor) SubscriptionAllowed() bool {
+// SubscriptionAllowed checks if the visitor may open another subscription (streaming connection), and
+// returns the max. duration of the subscription (0 if unlimited). If the visitor has too many active
+// subscriptions, errHTTPTooManyRequestsLimitSubscriptions is returned.
+func (v *visitor) SubscriptionAllowed() (time.Duration, error) {
 	v.mu.RLock() // limiters could be replaced!
 	defer v.mu.RUnlock()
-	return v.subscriptionLimiter.Allow()
+	if !v.subscriptionLimiter.Allow() {
+		return 0, errHTTPTooManyRequestsLimitSubscriptions
+	}
+	return v.limitsNoLock().SubscriptionDuration, nil
 }
 
 // AuthAllowed returns true if an auth request can be attempted (> 1 token available)
@@ -331,6 +344,20 @@ func (v *visitor) ResetStats() {
 	v.callsLimiter.Reset()
 }
 
+// Seen returns the time of the last request of this visitor
+func (v *visitor) Seen() time.Time {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.seen
+}
+
+// Subscriptions returns the number of active subscriptions (ongoing connections) of this visitor
+func (v *visitor) Subscriptions() int64 {
+	v.mu.RLock() // limiters could be replaced!
+	defer v.mu.RUnlock()
+	return v.subscriptionLimiter.Value()
+}
+
 // User returns the visitor user, or nil if there is none
 func (v *visitor) User() *user.User {
 	v.mu.RLock()
@@ -367,6 +394,14 @@ func (v *visitor) SetUser(u *user.User) {
 	}
 }
 
+// SetOrgLimiters sets the limiters shared with the other members of the user's organization, see orgLimits.
+// l may be nil, if the user does not use the organization's tier.
+func (v *visitor) SetOrgLimiters(l *orgLimiters) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.orgLimiters = l
+}
+
 // MaybeUserID returns the user ID of the visitor (if any). If this is an anonymous visitor,
 // an empty string is returned.
 func (v *visitor) MaybeUserID() string {
@@ -378,6 +413,18 @@ func (v *visitor) MaybeUserID() string {
 	return ""
 }
 
+// Reload replaces the visitor's config after the server config was reloaded. If resetLimiters is true, the rate
+// limiters are re-created from the new config and tier, keeping the visitor's daily message, email and call stats,
+// as well as the number of active subscriptions.
+func (v *visitor) Reload(conf *Config, resetLimiters bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.config = conf
+	if resetLimiters {
+		v.resetLimitersNoLock(v.messagesLimiter.Value(), v.emailsLimiter.Value(), v.callsLimiter.Value(), false)
+	}
+}
+
 func (v *visitor) resetLimitersNoLock(messages, emails, calls int64, enqueueUpdate bool) {
 	limits := v.limitsNoLock()
 	v.requestLimiter = rate.NewLimiter(limits.RequestLimitReplenish, limits.RequestLimitBurst)
@@ -385,6 +432,11 @@ func (v *visitor) resetLimitersNoLock(messages, emails, calls int64, enqueueUpda
 	v.emailsLimiter = util.NewRateLimiterWithValue(limits.EmailLimitReplenish, limits.EmailLimitBurst, emails)
 	v.callsLimiter = util.NewFixedLimiterWithValue(limits.CallLimit, calls)
 	v.bandwidthLimiter = util.NewBytesLimiter(int(limits.AttachmentBandwidthLimit), oneDay)
+	if v.subscriptionLimiter != nil {
+		v.subscriptionLimiter = util.NewFixedLimiterWithValue(limits.SubscriptionLimit, v.subscriptionLimiter.Value()) // Keep active subscriptions
+	} else {
+		v.subscriptionLimiter = util.NewFixedLimiter(limits.SubscriptionLimit)
+	}
 	if v.user == nil {
 		v.accountLimiter = rate.NewLimiter(rate.Every(v.config.VisitorAccountCreationLimitReplenish), v.config.VisitorAccountCreationLimitBurst)
 		v.authLimiter = rate.NewLimiter(rate.Every(v.config.VisitorAuthFailureLimitReplenish), v.config.VisitorAuthFailureLimitBurst)
@@ -416,6 +468,13 @@ func (v *visitor) limitsNoLock() *visitorLimits {
 }
 
 func tierBasedVisitorLimits(conf *Config, tier *user.Tier) *visitorLimits {
+	subscriptionLimit, subscriptionDuration := int64(conf.VisitorSubscriptionLimit), conf.VisitorSubscriptionDurationLimit
+	if tier.SubscriptionLimit > 0 {
+		subscriptionLimit = tier.SubscriptionLimit // Zero means "server default"
+	}
+	if tier.SubscriptionDurationLimit > 0 {
+		subscriptionDuration = tier.SubscriptionDurationLimit
+	}
 	return &visitorLimits{
 		Basis:                    visitorLimitBasisTier,
 		RequestLimitBurst:        util.MinMax(int(float64(tier.MessageLimit)*visitorMessageToRequestLimitBurstRate), conf.VisitorRequestLimitBurst, visitorMessageToRequestLimitBurstMax),
@@ -431,6 +490,8 @@ func tierBasedVisitorLimits(conf *Config, tier *user.Tier) *visitorLimits {
 		AttachmentFileSizeLimit:  tier.AttachmentFileSizeLimit,
 		AttachmentExpiryDuration: tier.AttachmentExpiryDuration,
 		AttachmentBandwidthLimit: tier.AttachmentBandwidthLimit,
+		SubscriptionLimit:        subscriptionLimit,
+		SubscriptionDuration:     subscriptionDuration,
 	}
 }
 
@@ -454,6 +515,8 @@ func configBasedVisitorLimits(conf *Config) *visitorLimits {
 		AttachmentFileSizeLimit:  conf.AttachmentFileSizeLimit,
 		AttachmentExpiryDuration: conf.AttachmentExpiryDuration,
 		AttachmentBandwidthLimit: conf.VisitorAttachmentDailyBandwidthLimit,
+		SubscriptionLimit:        int64(conf.VisitorSubscriptionLimit),
+		SubscriptionDuration:     conf.VisitorSubscriptionDurationLimit,
 	}
 }
 
@@ -504,6 +567,12 @@ func (v *visitor) infoLightNoLock() *visitorInfo {
 		Calls:             calls,
 		CallsRemaining:    zeroIfNegative(limits.CallLimit - calls),
 	}
+	if v.orgLimiters != nil {
+		// Pooled limits, the remaining values are shared with the other members of the organization
+		stats.MessagesRemaining = min(stats.MessagesRemaining, zeroIfNegative(limits.MessageLimit-v.orgLimiters.messages.Value()))
+		stats.EmailsRemaining = min(stats.EmailsRemaining, zeroIfNegative(limits.EmailLimit-v.orgLimiters.emails.Value()))
+		stats.CallsRemaining = min(stats.CallsRemaining, zeroIfNegative(limits.CallLimit-v.orgLimiters.calls.Value()))
+	}
 	return &visitorInfo{
 		Limits: limits,
 		Stats:  stats,
@@ -2,7 +2,10 @@
 package user
 
 import (
+	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -15,6 +18,7 @@ import (
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 )
 
 const (
@@ -29,6 +33,19 @@ const (
 	tokenPrefix                     = "tk_"
 	tokenLength                     = 32
 	tokenMaxCount                   = 20 // Only keep this many tokens in the table per user
+	tokenUserAgentMaxLength         = 256
+	tokenRotationDefaultLifetime    = 72 * time.Hour // Lifetime of a rotated token, if the lifetime of the old token is unknown
+	webhookEventKeepDuration        = 30 * 24 * time.Hour
+	usageBucketDuration             = time.Hour           // Resolution of the usage stats, see EnqueueUsage
+	usageKeepDuration               = 90 * 24 * time.Hour // Usage stats are kept this long, see RemoveExpiredUsage
+	signingKeyIDPrefix              = "sk_"
+	signingKeyIDLength              = 12
+	verificationTokenPrefix         = "vt_"
+	verificationTokenLength         = 32
+	inviteCodePrefix                = "iv_"
+	inviteCodeLength                = 16
+	orgIDPrefix                     = "org_"
+	orgIDLength                     = 12
 	tag                             = "user_manager"
 )
 
@@ -61,8 +78,12 @@ const (
 			attachment_total_size_limit INT NOT NULL,
 			attachment_expiry_duration INT NOT NULL,
 			attachment_bandwidth_limit INT NOT NULL,
+			subscriptions_limit INT NOT NULL DEFAULT (0),
+			subscription_duration_limit INT NOT NULL DEFAULT (0),
 			stripe_monthly_price_id TEXT,
-			stripe_yearly_price_id TEXT
+			stripe_yearly_price_id TEXT,
+			stripe_metered_messages_price_id TEXT,
+			stripe_metered_attachment_price_id TEXT
 		);
 		CREATE UNIQUE INDEX idx_tier_code ON tier (code);
 		CREATE UNIQUE INDEX idx_tier_stripe_monthly_price_id ON tier (stripe_monthly_price_id);
@@ -86,6 +107,10 @@ const (
 			stripe_subscription_cancel_at INT,
 			created INT NOT NULL,
 			deleted INT,
+			suspended INT,
+			suspended_until INT NOT NULL DEFAULT (0),
+			suspended_reason TEXT NOT NULL DEFAULT (''),
+			tier_expires INT NOT NULL DEFAULT (0),
 		    FOREIGN KEY (tier_id) REFERENCES tier (id)
 		);
 		CREATE UNIQUE INDEX idx_user ON user (user);
@@ -96,11 +121,17 @@ const (
 			topic TEXT NOT NULL,
 			read INT NOT NULL,
 			write INT NOT NULL,
+			write_no_cache INT NOT NULL DEFAULT (0),
+			attach INT NOT NULL DEFAULT (0),
+			manage INT NOT NULL DEFAULT (0),
 			owner_user_id INT,
+			publish_secret TEXT,
+			email_alias TEXT,
 			PRIMARY KEY (user_id, topic),
 			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE,
 		    FOREIGN KEY (owner_user_id) REFERENCES user (id) ON DELETE CASCADE
 		);
+		CREATE UNIQUE INDEX idx_user_access_email_alias ON user_access (email_alias);
 		CREATE TABLE IF NOT EXISTS user_token (
 			user_id TEXT NOT NULL,
 			token TEXT NOT NULL,
@@ -108,6 +139,13 @@ const (
 			last_access INT NOT NULL,
 			last_origin TEXT NOT NULL,
 			expires INT NOT NULL,
+			hard_expires INT NOT NULL DEFAULT (0),
+			scope_permission INT,
+			scope_topics TEXT NOT NULL DEFAULT (''),
+			type TEXT NOT NULL DEFAULT (''),
+			created INT NOT NULL DEFAULT (0),
+			created_origin TEXT NOT NULL DEFAULT (''),
+			created_user_agent TEXT NOT NULL DEFAULT (''),
 			PRIMARY KEY (user_id, token),
 			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
 		);
@@ -117,6 +155,108 @@ const (
 			PRIMARY KEY (user_id, phone_number),
 			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
 		);
+		CREATE TABLE IF NOT EXISTS webhook_event (
+			provider TEXT NOT NULL,
+			id TEXT NOT NULL,
+			type TEXT NOT NULL,
+			received INT NOT NULL,
+			PRIMARY KEY (provider, id)
+		);
+		CREATE TABLE IF NOT EXISTS signing_key (
+			id TEXT NOT NULL,
+			purpose TEXT NOT NULL,
+			secret TEXT NOT NULL,
+			created INT NOT NULL,
+			expires INT NOT NULL,
+			PRIMARY KEY (id)
+		);
+		CREATE INDEX IF NOT EXISTS idx_signing_key_purpose ON signing_key (purpose);
+		CREATE TABLE IF NOT EXISTS user_totp (
+			user_id TEXT NOT NULL,
+			secret TEXT NOT NULL,
+			enabled INT NOT NULL,
+			last_step INT NOT NULL,
+			created INT NOT NULL,
+			PRIMARY KEY (user_id),
+			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
+		);
+		CREATE TABLE IF NOT EXISTS user_totp_recovery (
+			user_id TEXT NOT NULL,
+			code_hash TEXT NOT NULL,
+			PRIMARY KEY (user_id, code_hash),
+			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
+		);
+		CREATE TABLE IF NOT EXISTS user_verification (
+			user_id TEXT NOT NULL,
+			email TEXT NOT NULL,
+			token_hash TEXT NOT NULL,
+			expires INT NOT NULL,
+			PRIMARY KEY (user_id),
+			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
+		);
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_user_verification_token_hash ON user_verification (token_hash);
+		CREATE TABLE IF NOT EXISTS invite (
+			code TEXT NOT NULL,
+			tier_code TEXT NOT NULL,
+			max_uses INT NOT NULL,
+			uses INT NOT NULL,
+			created INT NOT NULL,
+			expires INT NOT NULL,
+			PRIMARY KEY (code)
+		);
+		CREATE TABLE IF NOT EXISTS user_usage (
+			user_id TEXT NOT NULL,
+			topic TEXT NOT NULL,
+			bucket INT NOT NULL,
+			messages INT NOT NULL,
+			emails INT NOT NULL,
+			attachment_bytes INT NOT NULL,
+			PRIMARY KEY (user_id, topic, bucket),
+			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
+		);
+		CREATE INDEX IF NOT EXISTS idx_user_usage_bucket ON user_usage (bucket);
+		CREATE TABLE IF NOT EXISTS org (
+			id TEXT PRIMARY KEY,
+			name TEXT NOT NULL,
+			tier_id TEXT,
+			stripe_customer_id TEXT,
+			stripe_subscription_id TEXT,
+			stripe_subscription_status TEXT,
+			stripe_subscription_interval TEXT,
+			stripe_subscription_paid_until INT,
+			stripe_subscription_cancel_at INT,
+			created INT NOT NULL,
+			FOREIGN KEY (tier_id) REFERENCES tier (id)
+		);
+		CREATE UNIQUE INDEX idx_org_stripe_customer_id ON org (stripe_customer_id);
+		CREATE TABLE IF NOT EXISTS org_member (
+			org_id TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			role TEXT NOT NULL,
+			PRIMARY KEY (org_id, user_id),
+			FOREIGN KEY (org_id) REFERENCES org (id) ON DELETE CASCADE,
+			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
+		);
+		CREATE UNIQUE INDEX idx_org_member_user_id ON org_member (user_id);
+		CREATE TABLE IF NOT EXISTS org_invite (
+			org_id TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			role TEXT NOT NULL,
+			created INT NOT NULL,
+			PRIMARY KEY (org_id, user_id),
+			FOREIGN KEY (org_id) REFERENCES org (id) ON DELETE CASCADE,
+			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
+		);
+		CREATE INDEX idx_org_invite_user_id ON org_invite (user_id);
+		CREATE TABLE IF NOT EXISTS org_topic (
+			topic TEXT NOT NULL,
+			org_id TEXT NOT NULL,
+			everyone_read INT NOT NULL,
+			everyone_write INT NOT NULL,
+			PRIMARY KEY (topic),
+			FOREIGN KEY (org_id) REFERENCES org (id) ON DELETE CASCADE
+		);
+		CREATE INDEX idx_org_topic_org_id ON org_topic (org_id);
 		CREATE TABLE IF NOT EXISTS schemaVersion (
 			id INT PRIMARY KEY,
 			version INT NOT NULL
@@ -132,34 +272,43 @@ const (
 	`
 
 	selectUserByIDQuery = `
-		SELECT u.id, u.user, u.pass, u.role, u.prefs, u.sync_topic, u.stats_messages, u.stats_emails, u.stats_calls, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, deleted, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id
+		SELECT u.id, u.user, u.pass, u.role, u.prefs, u.sync_topic, u.stats_messages, u.stats_emails, u.stats_calls, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, deleted, u.suspended, u.suspended_until, u.suspended_reason, u.tier_expires, IFNULL(m.org_id, ''), IFNULL(m.role, ''), IFNULL(g.name, ''), u.tier_id IS NULL AND g.tier_id IS NOT NULL, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.subscriptions_limit, t.subscription_duration_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id, t.stripe_metered_messages_price_id, t.stripe_metered_attachment_price_id
 		FROM user u
-		LEFT JOIN tier t on t.id = u.tier_id
+		LEFT JOIN org_member m on m.user_id = u.id
+		LEFT JOIN org g on g.id = m.org_id
+		LEFT JOIN tier t on t.id = IFNULL(u.tier_id, g.tier_id)
 		WHERE u.id = ?
 	`
 	selectUserByNameQuery = `
-		SELECT u.id, u.user, u.pass, u.role, u.prefs, u.sync_topic, u.stats_messages, u.stats_emails, u.stats_calls, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, deleted, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id
+		SELECT u.id, u.user, u.pass, u.role, u.prefs, u.sync_topic, u.stats_messages, u.stats_emails, u.stats_calls, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, deleted, u.suspended, u.suspended_until, u.suspended_reason, u.tier_expires, IFNULL(m.org_id, ''), IFNULL(m.role, ''), IFNULL(g.name, ''), u.tier_id IS NULL AND g.tier_id IS NOT NULL, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.subscriptions_limit, t.subscription_duration_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id, t.stripe_metered_messages_price_id, t.stripe_metered_attachment_price_id
 		FROM user u
-		LEFT JOIN tier t on t.id = u.tier_id
+		LEFT JOIN org_member m on m.user_id = u.id
+		LEFT JOIN org g on g.id = m.org_id
+		LEFT JOIN tier t on t.id = IFNULL(u.tier_id, g.tier_id)
 		WHERE user = ?
 	`
 	selectUserByTokenQuery = `
-		SELECT u.id, u.user, u.pass, u.role, u.prefs, u.sync_topic, u.stats_messages, u.stats_emails, u.stats_calls, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, deleted, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id
+		SELECT u.id, u.user, u.pass, u.role, u.prefs, u.sync_topic, u.stats_messages, u.stats_emails, u.stats_calls, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, deleted, u.suspended, u.suspended_until, u.suspended_reason, u.tier_expires, IFNULL(m.org_id, ''), IFNULL(m.role, ''), IFNULL(g.name, ''), u.tier_id IS NULL AND g.tier_id IS NOT NULL, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.subscriptions_limit, t.subscription_duration_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id, t.stripe_metered_messages_price_id, t.stripe_metered_attachment_price_id
 		FROM user u
 		JOIN user_token tk on u.id = tk.user_id
-		LEFT JOIN tier t on t.id = u.tier_id
-		WHERE tk.token = ? AND (tk.expires = 0 OR tk.expires >= ?)
+		LEFT JOIN org_member m on m.user_id = u.id
+		LEFT JOIN org g on g.id = m.org_id
+		LEFT JOIN tier t on t.id = IFNULL(u.tier_id, g.tier_id)
+		WHERE tk.token = ? AND (tk.expires = 0 OR tk.expires >= ?) AND (tk.hard_expires = 0 OR tk.hard_expires >= ?)
 	`
 	selectUserByStripeCustomerIDQuery = `
-		SELECT u.id, u.user, u.pass, u.role, u.prefs, u.sync_topic, u.stats_messages, u.stats_emails, u.stats_calls, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, deleted, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id
+		SELECT u.id, u.user, u.pass, u.role, u.prefs, u.sync_topic, u.stats_messages, u.stats_emails, u.stats_calls, u.stripe_customer_id, u.stripe_subscription_id, u.stripe_subscription_status, u.stripe_subscription_interval, u.stripe_subscription_paid_until, u.stripe_subscription_cancel_at, deleted, u.suspended, u.suspended_until, u.suspended_reason, u.tier_expires, IFNULL(m.org_id, ''), IFNULL(m.role, ''), IFNULL(g.name, ''), u.tier_id IS NULL AND g.tier_id IS NOT NULL, t.id, t.code, t.name, t.messages_limit, t.messages_expiry_duration, t.emails_limit, t.calls_limit, t.reservations_limit, t.attachment_file_size_limit, t.attachment_total_size_limit, t.attachment_expiry_duration, t.attachment_bandwidth_limit, t.subscriptions_limit, t.subscription_duration_limit, t.stripe_monthly_price_id, t.stripe_yearly_price_id, t.stripe_metered_messages_price_id, t.stripe_metered_attachment_price_id
 		FROM user u
-		LEFT JOIN tier t on t.id = u.tier_id
+		LEFT JOIN org_member m on m.user_id = u.id
+		LEFT JOIN org g on g.id = m.org_id
+		LEFT JOIN tier t on t.id = IFNULL(u.tier_id, g.tier_id)
 		WHERE u.stripe_customer_id = ?
 	`
 	selectTopicPermsQuery = `
-		SELECT read, write
+		SELECT u.user, a.topic, read, write, write_no_cache, attach, manage OR IFNULL(a.user_id = a.owner_user_id, 0), IFNULL(o.user, '')
 		FROM user_access a
 		JOIN user u ON u.id = a.user_id
+		LEFT JOIN user o ON o.id = a.owner_user_id
 		WHERE (u.user = ? OR u.user = ?) AND ? LIKE a.topic ESCAPE '\'
 		ORDER BY u.user DESC, LENGTH(a.topic) DESC, a.write DESC
 	`
@@ -178,35 +327,47 @@ const (
 				ELSE 2
 			END, user
 	`
-	selectUserCountQuery         = `SELECT COUNT(*) FROM user`
-	updateUserPassQuery          = `UPDATE user SET pass = ? WHERE user = ?`
-	updateUserRoleQuery          = `UPDATE user SET role = ? WHERE user = ?`
-	updateUserPrefsQuery         = `UPDATE user SET prefs = ? WHERE id = ?`
-	updateUserStatsQuery         = `UPDATE user SET stats_messages = ?, stats_emails = ?, stats_calls = ? WHERE id = ?`
-	updateUserStatsResetAllQuery = `UPDATE user SET stats_messages = 0, stats_emails = 0, stats_calls = 0`
-	updateUserDeletedQuery       = `UPDATE user SET deleted = ? WHERE id = ?`
-	deleteUsersMarkedQuery       = `DELETE FROM user WHERE deleted < ?`
-	deleteUserQuery              = `DELETE FROM user WHERE user = ?`
+	selectUserCountQuery             = `SELECT COUNT(*) FROM user`
+	selectUsernameExistsQuery        = `SELECT COUNT(*) FROM user WHERE user = ?`
+	updateUserPassQuery              = `UPDATE user SET pass = ? WHERE user = ?`
+	updateUsernameQuery              = `UPDATE user SET user = ? WHERE user = ?`
+	updateUserRoleQuery              = `UPDATE user SET role = ? WHERE user = ?`
+	updateUserPrefsQuery             = `UPDATE user SET prefs = ? WHERE id = ?`
+	updateUserStatsQuery             = `UPDATE user SET stats_messages = ?, stats_emails = ?, stats_calls = ? WHERE id = ?`
+	updateUserStatsResetAllQuery     = `UPDATE user SET stats_messages = 0, stats_emails = 0, stats_calls = 0`
+	updateUserDeletedQuery           = `UPDATE user SET deleted = ? WHERE id = ?`
+	updateUserSuspendedQuery         = `UPDATE user SET suspended = ?, suspended_until = ?, suspended_reason = ? WHERE user = ?`
+	updateUserReinstatedQuery        = `UPDATE user SET suspended = NULL, suspended_until = 0, suspended_reason = '' WHERE user = ?`
+	updateUserReinstatedExpiredQuery = `UPDATE user SET suspended = NULL, suspended_until = 0, suspended_reason = '' WHERE suspended IS NOT NULL AND suspended_until > 0 AND suspended_until < ?`
+	deleteUsersMarkedQuery           = `DELETE FROM user WHERE deleted < ?`
+	deleteUserQuery                  = `DELETE FROM user WHERE user = ?`
 
 	upsertUserAccessQuery = `
-		INSERT INTO user_access (user_id, topic, read, write, owner_user_id)
-		VALUES ((SELECT id FROM user WHERE user = ?), ?, ?, ?, (SELECT IIF(?='',NULL,(SELECT id FROM user WHERE user=?))))
+		INSERT INTO user_access (user_id, topic, read, write, write_no_cache, attach, manage, owner_user_id)
+		VALUES ((SELECT id FROM user WHERE user = ?), ?, ?, ?, ?, ?, ?, (SELECT IIF(?='',NULL,(SELECT id FROM user WHERE user=?))))
+		ON CONFLICT (user_id, topic)
+		DO UPDATE SET read=excluded.read, write=excluded.write, write_no_cache=excluded.write_no_cache, attach=excluded.attach, manage=excluded.manage, owner_user_id=excluded.owner_user_id
+	`
+	upsertReservationUserAccessQuery = `
+		INSERT INTO user_access (user_id, topic, read, write, write_no_cache, attach, manage, owner_user_id)
+		VALUES ((SELECT id FROM user WHERE user = ?), ?, ?, ?, ?, ?, ?, (SELECT id FROM user WHERE user = ?))
 		ON CONFLICT (user_id, topic)
-		DO UPDATE SET read=excluded.read, write=excluded.write, owner_user_id=excluded.owner_user_id
+		DO UPDATE SET read=excluded.read, write=excluded.write, write_no_cache=excluded.write_no_cache, attach=excluded.attach, manage=excluded.manage
+		WHERE user_access.owner_user_id = excluded.owner_user_id
 	`
 	selectUserAllAccessQuery = `
-		SELECT user_id, topic, read, write
+		SELECT user_id, topic, read, write, write_no_cache, attach, manage
 		FROM user_access
 		ORDER BY LENGTH(topic) DESC, write DESC, read DESC, topic
 	`
 	selectUserAccessQuery = `
-		SELECT topic, read, write
+		SELECT topic, read, write, write_no_cache, attach, manage
 		FROM user_access
 		WHERE user_id = (SELECT id FROM user WHERE user = ?)
 		ORDER BY LENGTH(topic) DESC, write DESC, read DESC, topic
 	`
 	selectUserReservationsQuery = `
-		SELECT a_user.topic, a_user.read, a_user.write, a_everyone.read AS everyone_read, a_everyone.write AS everyone_write
+		SELECT a_user.topic, a_user.read, a_user.write, a_everyone.read AS everyone_read, a_everyone.write AS everyone_write, IFNULL(a_user.email_alias, '')
 		FROM user_access a_user
 		LEFT JOIN  user_access a_everyone ON a_user.topic = a_everyone.topic AND a_everyone.user_id = (SELECT id FROM user WHERE user = ?)
 		WHERE a_user.user_id = a_user.owner_user_id
@@ -232,12 +393,94 @@ const (
 		  AND owner_user_id = (SELECT id FROM user WHERE user = ?)
 		  AND topic = ?
 	`
+	updateReservationSecretQuery = `
+		UPDATE user_access
+		SET publish_secret = ?
+		WHERE user_id = owner_user_id
+		  AND owner_user_id = (SELECT id FROM user WHERE user = ?)
+		  AND topic = ?
+	`
+	selectReservationSecretQuery = `
+		SELECT publish_secret
+		FROM user_access
+		WHERE user_id = owner_user_id
+		  AND topic = ?
+		  AND publish_secret IS NOT NULL
+	`
+	updateReservationEmailAliasQuery = `
+		UPDATE user_access
+		SET email_alias = ?
+		WHERE user_id = owner_user_id
+		  AND owner_user_id = (SELECT id FROM user WHERE user = ?)
+		  AND topic = ?
+	`
+	selectReservationEmailAliasQuery = `
+		SELECT email_alias
+		FROM user_access
+		WHERE user_id = owner_user_id
+		  AND topic = ?
+		  AND email_alias IS NOT NULL
+	`
+	selectEmailAliasTopicQuery = `
+		SELECT topic
+		FROM user_access
+		WHERE user_id = owner_user_id
+		  AND email_alias = ?
+	`
 	selectOtherAccessCountQuery = `
 		SELECT COUNT(*)
 		FROM user_access
 		WHERE (topic = ? OR ? LIKE topic ESCAPE '\')
 		  AND (owner_user_id IS NULL OR owner_user_id != (SELECT id FROM user WHERE user = ?))
 	`
+	selectReservationManagersQuery = `
+		SELECT u.user
+		FROM user_access a
+		JOIN user u ON u.id = a.user_id
+		WHERE a.topic = ?
+		  AND a.owner_user_id = (SELECT id FROM user WHERE user = ?)
+		  AND a.user_id != a.owner_user_id
+		  AND a.manage = 1
+		  AND u.user != ?
+		ORDER BY u.user
+	`
+	selectReservationMembersQuery = `
+		SELECT u.user, a.read, a.write
+		FROM user_access a
+		JOIN user u ON u.id = a.user_id
+		WHERE a.topic = ?
+		  AND a.owner_user_id = (SELECT id FROM user WHERE user = ?)
+		  AND a.user_id != a.owner_user_id
+		  AND a.manage = 0
+		  AND u.user != ?
+		ORDER BY u.user
+	`
+	deleteReservationUserQuery = `
+		DELETE FROM user_access
+		WHERE user_id = (SELECT id FROM user WHERE user = ?)
+		  AND topic = ?
+		  AND owner_user_id = (SELECT id FROM user WHERE user = ?)
+		  AND user_id != owner_user_id
+	`
+	deleteReservationNewOwnerQuery = `
+		DELETE FROM user_access
+		WHERE user_id = (SELECT id FROM user WHERE user = ?)
+		  AND topic = ?
+		  AND (owner_user_id = (SELECT id FROM user WHERE user = ?) OR owner_user_id IS NULL)
+	`
+	updateReservationOwnerEntryQuery = `
+		UPDATE user_access
+		SET user_id = (SELECT id FROM user WHERE user = ?), owner_user_id = (SELECT id FROM user WHERE user = ?)
+		WHERE user_id = owner_user_id
+		  AND owner_user_id = (SELECT id FROM user WHERE user = ?)
+		  AND topic = ?
+	`
+	updateReservationOwnerQuery = `
+		UPDATE user_access
+		SET owner_user_id = (SELECT id FROM user WHERE user = ?)
+		WHERE owner_user_id = (SELECT id FROM user WHERE user = ?)
+		  AND topic = ?
+	`
 	deleteAllAccessQuery  = `DELETE FROM user_access`
 	deleteUserAccessQuery = `
 		DELETE FROM user_access
@@ -250,16 +493,38 @@ const (
 	   	  AND topic = ?
   	`
 
+	selectAllAccessExportQuery = `
+		SELECT u.user, a.topic, a.read, a.write, a.write_no_cache, a.attach, a.manage
+		FROM user_access a
+		JOIN user u ON u.id = a.user_id
+		WHERE a.owner_user_id IS NULL
+		ORDER BY u.user, a.topic
+	`
+	selectAllReservationsExportQuery = `
+		SELECT u.user, a_user.topic, a_everyone.read AS everyone_read, a_everyone.write AS everyone_write
+		FROM user_access a_user
+		JOIN user u ON u.id = a_user.user_id
+		LEFT JOIN user_access a_everyone ON a_user.topic = a_everyone.topic AND a_everyone.user_id = (SELECT id FROM user WHERE user = ?)
+		WHERE a_user.user_id = a_user.owner_user_id
+		ORDER BY u.user, a_user.topic
+	`
+	deleteUnownedTopicAccessQuery = `
+		DELETE FROM user_access
+		WHERE user_id = (SELECT id FROM user WHERE user = ?)
+		  AND topic = ?
+		  AND owner_user_id IS NULL
+	`
+
 	selectTokenCountQuery      = `SELECT COUNT(*) FROM user_token WHERE user_id = ?`
-	selectTokensQuery          = `SELECT token, label, last_access, last_origin, expires FROM user_token WHERE user_id = ?`
-	selectTokenQuery           = `SELECT token, label, last_access, last_origin, expires FROM user_token WHERE user_id = ? AND token = ?`
-	insertTokenQuery           = `INSERT INTO user_token (user_id, token, label, last_access, last_origin, expires) VALUES (?, ?, ?, ?, ?, ?)`
-	updateTokenExpiryQuery     = `UPDATE user_token SET expires = ? WHERE user_id = ? AND token = ?`
+	selectTokensQuery          = `SELECT token, label, last_access, last_origin, expires, hard_expires, scope_permission, scope_topics, type, created, created_origin, created_user_agent FROM user_token WHERE user_id = ?`
+	selectTokenQuery           = `SELECT token, label, last_access, last_origin, expires, hard_expires, scope_permission, scope_topics, type, created, created_origin, created_user_agent FROM user_token WHERE user_id = ? AND token = ?`
+	insertTokenQuery           = `INSERT INTO user_token (user_id, token, label, last_access, last_origin, expires, hard_expires, scope_permission, scope_topics, type, created, created_origin, created_user_agent) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	updateTokenExpiryQuery     = `UPDATE user_token SET expires = IIF(hard_expires > 0 AND (? = 0 OR ? > hard_expires), hard_expires, ?) WHERE user_id = ? AND token = ?`
 	updateTokenLabelQuery      = `UPDATE user_token SET label = ? WHERE user_id = ? AND token = ?`
 	updateTokenLastAccessQuery = `UPDATE user_token SET last_access = ?, last_origin = ? WHERE token = ?`
 	deleteTokenQuery           = `DELETE FROM user_token WHERE user_id = ? AND token = ?`
 	deleteAllTokenQuery        = `DELETE FROM user_token WHERE user_id = ?`
-	deleteExpiredTokensQuery   = `DELETE FROM user_token WHERE expires > 0 AND expires < ?`
+	deleteExpiredTokensQuery   = `DELETE FROM user_token WHERE (expires > 0 AND expires < ?) OR (hard_expires > 0 AND hard_expires < ?)`
 	deleteExcessTokensQuery    = `
 		DELETE FROM user_token
 		WHERE user_id = ?
@@ -276,32 +541,175 @@ const (
 	insertPhoneNumberQuery  = `INSERT INTO user_phone (user_id, phone_number) VALUES (?, ?)`
 	deletePhoneNumberQuery  = `DELETE FROM user_phone WHERE user_id = ? AND phone_number = ?`
 
+	insertWebhookEventQuery        = `INSERT INTO webhook_event (provider, id, type, received) VALUES (?, ?, ?, ?) ON CONFLICT (provider, id) DO NOTHING`
+	deleteWebhookEventQuery        = `DELETE FROM webhook_event WHERE provider = ? AND id = ?`
+	deleteExpiredWebhookEventQuery = `DELETE FROM webhook_event WHERE received < ?`
+
+	insertSigningKeyQuery  = `INSERT INTO signing_key (id, purpose, secret, created, expires) VALUES (?, ?, ?, ?, 0)`
+	selectSigningKeysQuery = `
+		SELECT id, purpose, secret, created, expires
+		FROM signing_key
+		WHERE (purpose = ? OR ? = '') AND (expires = 0 OR expires > ?)
+		ORDER BY created DESC, id
+	`
+	updateSigningKeyExpiresQuery  = `UPDATE signing_key SET expires = ? WHERE id = ? AND (expires = 0 OR expires > ?)`
+	deleteSigningKeyQuery         = `DELETE FROM signing_key WHERE id = ?`
+	deleteExpiredSigningKeysQuery = `DELETE FROM signing_key WHERE expires > 0 AND expires <= ?`
+
+	selectTOTPQuery              = `SELECT secret, enabled, last_step FROM user_totp WHERE user_id = ?`
+	upsertTOTPQuery              = `INSERT INTO user_totp (user_id, secret, enabled, last_step, created) VALUES (?, ?, 0, 0, ?) ON CONFLICT (user_id) DO UPDATE SET secret = excluded.secret, enabled = 0, last_step = 0, created = excluded.created`
+	updateTOTPEnabledQuery       = `UPDATE user_totp SET enabled = 1, last_step = ? WHERE user_id = ? AND enabled = 0`
+	updateTOTPLastStepQuery      = `UPDATE user_totp SET last_step = ? WHERE user_id = ? AND last_step < ?`
+	deleteTOTPQuery              = `DELETE FROM user_totp WHERE user_id = ?`
+	selectTOTPRecoveryCountQuery = `SELECT COUNT(*) FROM user_totp_recovery WHERE user_id = ?`
+	insertTOTPRecoveryCodeQuery  = `INSERT INTO user_totp_recovery (user_id, code_hash) VALUES (?, ?)`
+	deleteTOTPRecoveryCodeQuery  = `DELETE FROM user_totp_recovery WHERE user_id = ? AND code_hash = ?`
+	deleteTOTPRecoveryCodesQuery = `DELETE FROM user_totp_recovery WHERE user_id = ?`
+
+	upsertVerificationQuery       = `INSERT INTO user_verification (user_id, email, token_hash, expires) VALUES (?, ?, ?, ?) ON CONFLICT (user_id) DO UPDATE SET email = excluded.email, token_hash = excluded.token_hash, expires = excluded.expires`
+	selectVerificationCountQuery  = `SELECT COUNT(*) FROM user_verification WHERE user_id = ?`
+	selectVerificationUserIDQuery = `SELECT user_id FROM user_verification WHERE token_hash = ? AND expires >= ?`
+	deleteVerificationQuery       = `DELETE FROM user_verification WHERE user_id = ?`
+	deleteUnverifiedUsersQuery    = `DELETE FROM user WHERE id IN (SELECT user_id FROM user_verification WHERE expires < ?)`
+
+	insertInviteQuery  = `INSERT INTO invite (code, tier_code, max_uses, uses, created, expires) VALUES (?, ?, ?, 0, ?, ?)`
+	selectInvitesQuery = `
+		SELECT code, tier_code, max_uses, uses, created, expires
+		FROM invite
+		WHERE expires = 0 OR expires > ?
+		ORDER BY created DESC, code
+	`
+	selectInviteQuery         = `SELECT code, tier_code, max_uses, uses, created, expires FROM invite WHERE code = ?`
+	updateInviteUsesQuery     = `UPDATE invite SET uses = uses + 1 WHERE code = ? AND (max_uses = 0 OR uses < max_uses) AND (expires = 0 OR expires > ?)`
+	updateInviteReturnQuery   = `UPDATE invite SET uses = uses - 1 WHERE code = ? AND uses > 0`
+	deleteInviteQuery         = `DELETE FROM invite WHERE code = ?`
+	deleteExpiredInvitesQuery = `DELETE FROM invite WHERE expires > 0 AND expires <= ?`
+
+	insertOrgQuery = `INSERT INTO org (id, name, created) VALUES (?, ?, ?)`
+	selectOrgQuery = `
+		SELECT g.id, g.name, IFNULL(t.code, ''), g.stripe_customer_id, g.stripe_subscription_id, g.stripe_subscription_status, g.stripe_subscription_interval, g.stripe_subscription_paid_until, g.stripe_subscription_cancel_at, g.created
+		FROM org g
+		LEFT JOIN tier t on t.id = g.tier_id
+		WHERE g.id = ?
+	`
+	selectOrgByStripeCustomerIDQuery = `
+		SELECT g.id, g.name, IFNULL(t.code, ''), g.stripe_customer_id, g.stripe_subscription_id, g.stripe_subscription_status, g.stripe_subscription_interval, g.stripe_subscription_paid_until, g.stripe_subscription_cancel_at, g.created
+		FROM org g
+		LEFT JOIN tier t on t.id = g.tier_id
+		WHERE g.stripe_customer_id = ?
+	`
+	updateOrgTierQuery    = `UPDATE org SET tier_id = (SELECT id FROM tier WHERE code = ?) WHERE id = ?`
+	deleteOrgTierQuery    = `UPDATE org SET tier_id = null WHERE id = ?`
+	updateOrgBillingQuery = `
+		UPDATE org
+		SET stripe_customer_id = ?, stripe_subscription_id = ?, stripe_subscription_status = ?, stripe_subscription_interval = ?, stripe_subscription_paid_until = ?, stripe_subscription_cancel_at = ?
+		WHERE id = ?
+	`
+	deleteOrgQuery       = `DELETE FROM org WHERE id = ?`
+	upsertOrgMemberQuery = `
+		INSERT INTO org_member (org_id, user_id, role)
+		VALUES (?, (SELECT id FROM user WHERE user = ?), ?)
+		ON CONFLICT (org_id, user_id) DO UPDATE SET role = excluded.role
+	`
+	selectOrgMembersQuery = `
+		SELECT u.user, m.role
+		FROM org_member m
+		JOIN user u ON u.id = m.user_id
+		WHERE m.org_id = ?
+		ORDER BY
+			CASE m.role
+				WHEN 'owner' THEN 1
+				WHEN 'admin' THEN 2
+				ELSE 3
+			END, u.user
+	`
+	deleteOrgMemberQuery = `DELETE FROM org_member WHERE org_id = ? AND user_id = (SELECT id FROM user WHERE user = ?)`
+	upsertOrgInviteQuery = `
+		INSERT INTO org_invite (org_id, user_id, role, created)
+		VALUES (?, (SELECT id FROM user WHERE user = ?), ?, ?)
+		ON CONFLICT (org_id, user_id) DO UPDATE SET role = excluded.role
+	`
+	selectOrgInvitesQuery = `
+		SELECT g.id, g.name, i.role
+		FROM org_invite i
+		JOIN org g ON g.id = i.org_id
+		WHERE i.user_id = (SELECT id FROM user WHERE user = ?)
+		ORDER BY i.created, g.name
+	`
+	selectOrgInviteRoleQuery = `SELECT role FROM org_invite WHERE org_id = ? AND user_id = (SELECT id FROM user WHERE user = ?)`
+	deleteOrgInviteQuery     = `DELETE FROM org_invite WHERE org_id = ? AND user_id = (SELECT id FROM user WHERE user = ?)`
+	upsertOrgTopicQuery      = `
+		INSERT INTO org_topic (topic, org_id, everyone_read, everyone_write)
+		VALUES (?, ?, ?, ?)
+		ON CONFLICT (topic) DO UPDATE SET everyone_read = excluded.everyone_read, everyone_write = excluded.everyone_write
+		WHERE org_topic.org_id = excluded.org_id
+	`
+	selectOrgTopicsQuery      = `SELECT topic, everyone_read, everyone_write FROM org_topic WHERE org_id = ? ORDER BY topic`
+	selectOrgTopicQuery       = `SELECT org_id, everyone_read, everyone_write FROM org_topic WHERE topic = ?`
+	selectOrgTopicsCountQuery = `SELECT COUNT(*) FROM org_topic WHERE org_id = ?`
+	selectOrgStatsQuery       = `
+		SELECT IFNULL(SUM(u.stats_messages), 0), IFNULL(SUM(u.stats_emails), 0), IFNULL(SUM(u.stats_calls), 0)
+		FROM org_member m
+		JOIN user u ON u.id = m.user_id
+		WHERE m.org_id = ? AND u.tier_id IS NULL
+	`
+	selectTopicAccessCountQuery = `
+		SELECT COUNT(*)
+		FROM user_access
+		WHERE topic = ? OR ? LIKE topic ESCAPE '\'
+	`
+	deleteOrgTopicQuery = `DELETE FROM org_topic WHERE org_id = ? AND topic = ?`
+
+	upsertUsageQuery = `
+		INSERT INTO user_usage (user_id, topic, bucket, messages, emails, attachment_bytes)
+		SELECT ?, ?, ?, ?, ?, ?
+		WHERE EXISTS (SELECT 1 FROM user WHERE id = ?)
+		ON CONFLICT (user_id, topic, bucket) DO UPDATE SET
+			messages = messages + excluded.messages,
+			emails = emails + excluded.emails,
+			attachment_bytes = attachment_bytes + excluded.attachment_bytes
+	`
+	selectUsageQuery = `
+		SELECT topic, (bucket / ?) * ? AS time, SUM(messages), SUM(emails), SUM(attachment_bytes)
+		FROM user_usage
+		WHERE user_id = ? AND bucket >= ?
+		GROUP BY time, topic
+		ORDER BY time, topic
+	`
+	selectUsageTotalQuery = `
+		SELECT COALESCE(SUM(messages), 0), COALESCE(SUM(emails), 0), COALESCE(SUM(attachment_bytes), 0)
+		FROM user_usage
+		WHERE user_id = ? AND bucket >= ? AND bucket < ?
+	`
+	deleteUsageBeforeQuery = `DELETE FROM user_usage WHERE bucket < ?`
+
 	insertTierQuery = `
-		INSERT INTO tier (id, code, name, messages_limit, messages_expiry_duration, emails_limit, calls_limit, reservations_limit, attachment_file_size_limit, attachment_total_size_limit, attachment_expiry_duration, attachment_bandwidth_limit, stripe_monthly_price_id, stripe_yearly_price_id)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		INSERT INTO tier (id, code, name, messages_limit, messages_expiry_duration, emails_limit, calls_limit, reservations_limit, attachment_file_size_limit, attachment_total_size_limit, attachment_expiry_duration, attachment_bandwidth_limit, subscriptions_limit, subscription_duration_limit, stripe_monthly_price_id, stripe_yearly_price_id, stripe_metered_messages_price_id, stripe_metered_attachment_price_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
 	updateTierQuery = `
 		UPDATE tier
-		SET name = ?, messages_limit = ?, messages_expiry_duration = ?, emails_limit = ?, calls_limit = ?, reservations_limit = ?, attachment_file_size_limit = ?, attachment_total_size_limit = ?, attachment_expiry_duration = ?, attachment_bandwidth_limit = ?, stripe_monthly_price_id = ?, stripe_yearly_price_id = ?
+		SET name = ?, messages_limit = ?, messages_expiry_duration = ?, emails_limit = ?, calls_limit = ?, reservations_limit = ?, attachment_file_size_limit = ?, attachment_total_size_limit = ?, attachment_expiry_duration = ?, attachment_bandwidth_limit = ?, subscriptions_limit = ?, subscription_duration_limit = ?, stripe_monthly_price_id = ?, stripe_yearly_price_id = ?, stripe_metered_messages_price_id = ?, stripe_metered_attachment_price_id = ?
 		WHERE code = ?
 	`
 	selectTiersQuery = `
-		SELECT id, code, name, messages_limit, messages_expiry_duration, emails_limit, calls_limit, reservations_limit, attachment_file_size_limit, attachment_total_size_limit, attachment_expiry_duration, attachment_bandwidth_limit, stripe_monthly_price_id, stripe_yearly_price_id
+		SELECT id, code, name, messages_limit, messages_expiry_duration, emails_limit, calls_limit, reservations_limit, attachment_file_size_limit, attachment_total_size_limit, attachment_expiry_duration, attachment_bandwidth_limit, subscriptions_limit, subscription_duration_limit, stripe_monthly_price_id, stripe_yearly_price_id, stripe_metered_messages_price_id, stripe_metered_attachment_price_id
 		FROM tier
 	`
 	selectTierByCodeQuery = `
-		SELECT id, code, name, messages_limit, messages_expiry_duration, emails_limit, calls_limit, reservations_limit, attachment_file_size_limit, attachment_total_size_limit, attachment_expiry_duration, attachment_bandwidth_limit, stripe_monthly_price_id, stripe_yearly_price_id
+		SELECT id, code, name, messages_limit, messages_expiry_duration, emails_limit, calls_limit, reservations_limit, attachment_file_size_limit, attachment_total_size_limit, attachment_expiry_duration, attachment_bandwidth_limit, subscriptions_limit, subscription_duration_limit, stripe_monthly_price_id, stripe_yearly_price_id, stripe_metered_messages_price_id, stripe_metered_attachment_price_id
 		FROM tier
 		WHERE code = ?
 	`
 	selectTierByPriceIDQuery = `
-		SELECT id, code, name, messages_limit, messages_expiry_duration, emails_limit, calls_limit, reservations_limit, attachment_file_size_limit, attachment_total_size_limit, attachment_expiry_duration, attachment_bandwidth_limit, stripe_monthly_price_id, stripe_yearly_price_id
+		SELECT id, code, name, messages_limit, messages_expiry_duration, emails_limit, calls_limit, reservations_limit, attachment_file_size_limit, attachment_total_size_limit, attachment_expiry_duration, attachment_bandwidth_limit, subscriptions_limit, subscription_duration_limit, stripe_monthly_price_id, stripe_yearly_price_id, stripe_metered_messages_price_id, stripe_metered_attachment_price_id
 		FROM tier
 		WHERE (stripe_monthly_price_id = ? OR stripe_yearly_price_id = ?)
 	`
-	updateUserTierQuery = `UPDATE user SET tier_id = (SELECT id FROM tier WHERE code = ?) WHERE user = ?`
-	deleteUserTierQuery = `UPDATE user SET tier_id = null WHERE user = ?`
-	deleteTierQuery     = `DELETE FROM tier WHERE code = ?`
+	updateUserTierQuery             = `UPDATE user SET tier_id = (SELECT id FROM tier WHERE code = ?), tier_expires = ? WHERE user = ?`
+	deleteUserTierQuery             = `UPDATE user SET tier_id = null, tier_expires = 0 WHERE user = ?`
+	selectUsersWithExpiredTierQuery = `SELECT user FROM user WHERE tier_id IS NOT NULL AND tier_expires > 0 AND tier_expires < ? ORDER BY user`
+	deleteTierQuery                 = `DELETE FROM tier WHERE code = ?`
 
 	updateBillingQuery = `
 		UPDATE user
@@ -312,7 +720,7 @@ const (
 
 // Schema management queries
 const (
-	currentSchemaVersion     = 5
+	currentSchemaVersion     = 21
 	insertSchemaVersion      = `INSERT INTO schemaVersion VALUES (1, ?)`
 	updateSchemaVersion      = `UPDATE schemaVersion SET version = ? WHERE id = 1`
 	selectSchemaVersionQuery = `SELECT version FROM schemaVersion WHERE id = 1`
@@ -427,14 +835,217 @@ const (
 	migrate4To5UpdateQueries = `
 		UPDATE user_access SET topic = REPLACE(topic, '_', '\_');
 	`
+
+	// 5 -> 6
+	migrate5To6UpdateQueries = `
+		ALTER TABLE user_token ADD COLUMN hard_expires INT NOT NULL DEFAULT (0);
+		ALTER TABLE user_token ADD COLUMN scope_permission INT;
+		ALTER TABLE user_token ADD COLUMN scope_topics TEXT NOT NULL DEFAULT ('');
+	`
+
+	// 6 -> 7
+	migrate6To7UpdateQueries = `
+		CREATE TABLE IF NOT EXISTS webhook_event (
+			provider TEXT NOT NULL,
+			id TEXT NOT NULL,
+			type TEXT NOT NULL,
+			received INT NOT NULL,
+			PRIMARY KEY (provider, id)
+		);
+	`
+
+	// 7 -> 8
+	migrate7To8UpdateQueries = `
+		ALTER TABLE user ADD COLUMN suspended INT;
+		ALTER TABLE user ADD COLUMN suspended_until INT NOT NULL DEFAULT (0);
+		ALTER TABLE user ADD COLUMN suspended_reason TEXT NOT NULL DEFAULT ('');
+	`
+
+	// 8 -> 9
+	migrate8To9UpdateQueries = `
+		ALTER TABLE user_token ADD COLUMN type TEXT NOT NULL DEFAULT ('');
+		ALTER TABLE user_token ADD COLUMN created INT NOT NULL DEFAULT (0);
+		ALTER TABLE user_token ADD COLUMN created_origin TEXT NOT NULL DEFAULT ('');
+		ALTER TABLE user_token ADD COLUMN created_user_agent TEXT NOT NULL DEFAULT ('');
+	`
+
+	// 9 -> 10
+	migrate9To10UpdateQueries = `
+		ALTER TABLE user_access ADD COLUMN write_no_cache INT NOT NULL DEFAULT (0);
+		ALTER TABLE user_access ADD COLUMN attach INT NOT NULL DEFAULT (0);
+		ALTER TABLE user_access ADD COLUMN manage INT NOT NULL DEFAULT (0);
+	`
+
+	// 10 -> 11
+	migrate10To11UpdateQueries = `
+		ALTER TABLE tier ADD COLUMN subscriptions_limit INT NOT NULL DEFAULT (0);
+		ALTER TABLE tier ADD COLUMN subscription_duration_limit INT NOT NULL DEFAULT (0);
+	`
+
+	// 11 -> 12
+	migrate11To12UpdateQueries = `
+		ALTER TABLE user_access ADD COLUMN publish_secret TEXT;
+	`
+
+	// 12 -> 13
+	migrate12To13UpdateQueries = `
+		ALTER TABLE user_access ADD COLUMN email_alias TEXT;
+		CREATE UNIQUE INDEX idx_user_access_email_alias ON user_access (email_alias);
+	`
+
+	// 13 -> 14
+	migrate13To14UpdateQueries = `
+		CREATE TABLE IF NOT EXISTS signing_key (
+			id TEXT NOT NULL,
+			purpose TEXT NOT NULL,
+			secret TEXT NOT NULL,
+			created INT NOT NULL,
+			expires INT NOT NULL,
+			PRIMARY KEY (id)
+		);
+		CREATE INDEX IF NOT EXISTS idx_signing_key_purpose ON signing_key (purpose);
+	`
+
+	// 14 -> 15
+	migrate14To15UpdateQueries = `
+		CREATE TABLE IF NOT EXISTS user_totp (
+			user_id TEXT NOT NULL,
+			secret TEXT NOT NULL,
+			enabled INT NOT NULL,
+			last_step INT NOT NULL,
+			created INT NOT NULL,
+			PRIMARY KEY (user_id),
+			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
+		);
+		CREATE TABLE IF NOT EXISTS user_totp_recovery (
+			user_id TEXT NOT NULL,
+			code_hash TEXT NOT NULL,
+			PRIMARY KEY (user_id, code_hash),
+			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
+		);
+	`
+
+	// 15 -> 16
+	migrate15To16UpdateQueries = `
+		CREATE TABLE IF NOT EXISTS user_verification (
+			user_id TEXT NOT NULL,
+			email TEXT NOT NULL,
+			token_hash TEXT NOT NULL,
+			expires INT NOT NULL,
+			PRIMARY KEY (user_id),
+			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
+		);
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_user_verification_token_hash ON user_verification (token_hash);
+	`
+
+	// 16 -> 17
+	migrate16To17UpdateQueries = `
+		CREATE TABLE IF NOT EXISTS invite (
+			code TEXT NOT NULL,
+			tier_code TEXT NOT NULL,
+			max_uses INT NOT NULL,
+			uses INT NOT NULL,
+			created INT NOT NULL,
+			expires INT NOT NULL,
+			PRIMARY KEY (code)
+		);
+	`
+
+	// 17 -> 18
+	migrate17To18UpdateQueries = `
+		CREATE TABLE IF NOT EXISTS user_usage (
+			user_id TEXT NOT NULL,
+			topic TEXT NOT NULL,
+			bucket INT NOT NULL,
+			messages INT NOT NULL,
+			emails INT NOT NULL,
+			attachment_bytes INT NOT NULL,
+			PRIMARY KEY (user_id, topic, bucket),
+			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
+		);
+		CREATE INDEX IF NOT EXISTS idx_user_usage_bucket ON user_usage (bucket);
+	`
+
+	// 18 -> 19
+	migrate18To19UpdateQueries = `
+		ALTER TABLE tier ADD COLUMN stripe_metered_messages_price_id TEXT;
+		ALTER TABLE tier ADD COLUMN stripe_metered_attachment_price_id TEXT;
+	`
+
+	// 19 -> 20
+	migrate19To20UpdateQueries = `
+		ALTER TABLE user ADD COLUMN tier_expires INT NOT NULL DEFAULT (0);
+	`
+
+	// 20 -> 21
+	migrate20To21CreateTablesQueries = `
+		CREATE TABLE IF NOT EXISTS org (
+			id TEXT PRIMARY KEY,
+			name TEXT NOT NULL,
+			tier_id TEXT,
+			stripe_customer_id TEXT,
+			stripe_subscription_id TEXT,
+			stripe_subscription_status TEXT,
+			stripe_subscription_interval TEXT,
+			stripe_subscription_paid_until INT,
+			stripe_subscription_cancel_at INT,
+			created INT NOT NULL,
+			FOREIGN KEY (tier_id) REFERENCES tier (id)
+		);
+		CREATE UNIQUE INDEX idx_org_stripe_customer_id ON org (stripe_customer_id);
+		CREATE TABLE IF NOT EXISTS org_member (
+			org_id TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			role TEXT NOT NULL,
+			PRIMARY KEY (org_id, user_id),
+			FOREIGN KEY (org_id) REFERENCES org (id) ON DELETE CASCADE,
+			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
+		);
+		CREATE UNIQUE INDEX idx_org_member_user_id ON org_member (user_id);
+		CREATE TABLE IF NOT EXISTS org_invite (
+			org_id TEXT NOT NULL,
+			user_id TEXT NOT NULL,
+			role TEXT NOT NULL,
+			created INT NOT NULL,
+			PRIMARY KEY (org_id, user_id),
+			FOREIGN KEY (org_id) REFERENCES org (id) ON DELETE CASCADE,
+			FOREIGN KEY (user_id) REFERENCES user (id) ON DELETE CASCADE
+		);
+		CREATE INDEX idx_org_invite_user_id ON org_invite (user_id);
+		CREATE TABLE IF NOT EXISTS org_topic (
+			topic TEXT NOT NULL,
+			org_id TEXT NOT NULL,
+			everyone_read INT NOT NULL,
+			everyone_write INT NOT NULL,
+			PRIMARY KEY (topic),
+			FOREIGN KEY (org_id) REFERENCES org (id) ON DELETE CASCADE
+		);
+		CREATE INDEX idx_org_topic_org_id ON org_topic (org_id);
+	`
 )
 
 var (
 	migrations = map[int]func(db *sql.DB) error{
-		1: migrateFrom1,
-		2: migrateFrom2,
-		3: migrateFrom3,
-		4: migrateFrom4,
+		1:  migrateFrom1,
+		2:  migrateFrom2,
+		3:  migrateFrom3,
+		4:  migrateFrom4,
+		5:  migrateFrom5,
+		6:  migrateFrom6,
+		7:  migrateFrom7,
+		8:  migrateFrom8,
+		9:  migrateFrom9,
+		10: migrateFrom10,
+		11: migrateFrom11,
+		12: migrateFrom12,
+		13: migrateFrom13,
+		14: migrateFrom14,
+		15: migrateFrom15,
+		16: migrateFrom16,
+		17: migrateFrom17,
+		18: migrateFrom18,
+		19: migrateFrom19,
+		20: migrateFrom20,
 	}
 )
 
@@ -445,6 +1056,7 @@ type Manager struct {
 	defaultAccess Permission              // Default permission if no ACL matches
 	statsQueue    map[string]*Stats       // "Queue" to asynchronously write user stats to the database (UserID -> Stats)
 	tokenQueue    map[string]*TokenUpdate // "Queue" to asynchronously write token access stats to the database (Token ID -> TokenUpdate)
+	usageQueue    map[usageKey]*Usage     // "Queue" to asynchronously write usage stats to the database, see EnqueueUsage
 	bcryptCost    int                     // Makes testing easier
 	mu            sync.Mutex
 }
@@ -468,6 +1080,7 @@ func NewManager(filename, startupQueries string, defaultAccess Permission, bcryp
 		defaultAccess: defaultAccess,
 		statsQueue:    make(map[string]*Stats),
 		tokenQueue:    make(map[string]*TokenUpdate),
+		usageQueue:    make(map[usageKey]*Usage),
 		bcryptCost:    bcryptCost,
 	}
 	go manager.asyncQueueWriter(queueWriterInterval)
@@ -508,22 +1121,58 @@ func (a *Manager) AuthenticateToken(token string) (*User, error) {
 		log.Tag(tag).Field("token", token).Err(err).Trace("Authentication of token failed")
 		return nil, ErrUnauthenticated
 	}
+	t, err := a.Token(user.ID, token)
+	if err != nil {
+		return nil, err
+	}
 	user.Token = token
+	user.TokenScope = t.Scope
 	return user, nil
 }
 
 // CreateToken generates a random token for the given user and returns it. The token expires
 // after a fixed duration unless ChangeToken is called. This function also prunes tokens for the
 // given user, if there are too many of them.
-func (a *Manager) CreateToken(userID, label string, expires time.Time, origin netip.Addr) (*Token, error) {
+func (a *Manager) CreateToken(userID, label string, tokenType TokenType, expires time.Time, origin netip.Addr) (*Token, error) {
+	return a.CreateScopedToken(userID, label, tokenType, expires, time.Unix(0, 0), origin, "", nil)
+}
+
+// CreateScopedToken is like CreateToken, but additionally restricts the token to the given scope
+// (if not nil), and sets a hard expiry date (if not zero Unix time), beyond which the token cannot
+// be extended using ChangeToken. The origin and user agent are stored as creation metadata.
+func (a *Manager) CreateScopedToken(userID, label string, tokenType TokenType, expires, hardExpires time.Time, origin netip.Addr, userAgent string, scope *TokenScope) (*Token, error) {
+	if !AllowedTokenType(tokenType) {
+		return nil, ErrInvalidArgument
+	}
 	token := util.RandomLowerStringPrefix(tokenPrefix, tokenLength) // Lowercase only to support "<topic>+<token>@<domain>" email addresses
+	if hardExpires.Unix() > 0 && (expires.Unix() == 0 || expires.After(hardExpires)) {
+		expires = hardExpires
+	}
+	var scopePermission sql.NullInt64
+	var scopeTopics string
+	if scope != nil {
+		for _, topic := range scope.Topics {
+			if !AllowedTopicPattern(topic) {
+				return nil, ErrInvalidArgument
+			}
+		}
+		scopePermission = sql.NullInt64{Int64: int64(scope.Permission), Valid: true}
+		scopeTopics = strings.Join(scope.Topics, ",")
+	}
 	tx, err := a.db.Begin()
 	if err != nil {
 		return nil, err
 	}
 	defer tx.Rollback()
+	if len(userAgent) > tokenUserAgentMaxLength {
+		n := tokenUserAgentMaxLength
+		for n > 0 && !utf8.RuneStart(userAgent[n]) {
+			n-- // Don't cut a multi-byte character in half
+		}
+		userAgent = userAgent[:n]
+	}
 	access := time.Now()
-	if _, err := tx.Exec(insertTokenQuery, userID, token, label, access.Unix(), origin.String(), expires.Unix()); err != nil {
+	if _, err := tx.Exec(insertTokenQuery, userID, token, label, access.Unix(), origin.String(), expires.Unix(), hardExpires.Unix(), scopePermission, scopeTopics, string(tokenType), access.Unix(), origin.String(), userAgent); err != nil {
 		return nil, err
 	}
 	rows, err := tx.Query(selectTokenCountQuery, userID)
@@ -549,11 +1198,17 @@ func (a *Manager) CreateToken(userID, label string, expires time.Time, origin ne
 		return nil, err
 	}
 	return &Token{
-		Value:      token,
-		Label:      label,
-		LastAccess: access,
-		LastOrigin: origin,
-		Expires:    expires,
+		Value:            token,
+		Label:            label,
+		Type:             tokenType,
+		LastAccess:       access,
+		LastOrigin:       origin,
+		Expires:          expires,
+		HardExpires:      hardExpires,
+		Scope:            scope,
+		Created:          access,
+		CreatedOrigin:    origin,
+		CreatedUserAgent: userAgent,
 	}, nil
 }
 
@@ -588,12 +1243,13 @@ func (a *Manager) Token(userID, token string) (*Token, error) {
 }
 
 func (a *Manager) readToken(rows *sql.Rows) (*Token, error) {
-	var token, label, lastOrigin string
-	var lastAccess, expires int64
+	var token, label, lastOrigin, scopeTopics, tokenType, createdOrigin, createdUserAgent string
+	var lastAccess, expires, hardExpires, created int64
+	var scopePermission sql.NullInt64
 	if !rows.Next() {
 		return nil, ErrTokenNotFound
 	}
-	if err := rows.Scan(&token, &label, &lastAccess, &lastOrigin, &expires); err != nil {
+	if err := rows.Scan(&token, &label, &lastAccess, &lastOrigin, &expires, &hardExpires, &scopePermission, &scopeTopics, &tokenType, &created, &createdOrigin, &createdUserAgent); err != nil {
 		return nil, err
 	} else if err := rows.Err(); err != nil {
 		return nil, err
@@ -602,12 +1258,29 @@ func (a *Manager) readToken(rows *sql.Rows) (*Token, error) {
 	if err != nil {
 		lastOriginIP = netip.IPv4Unspecified()
 	}
+	createdOriginIP, err := netip.ParseAddr(createdOrigin)
+	if err != nil {
+		createdOriginIP = netip.IPv4Unspecified() // Tokens created before schema version 9
+	}
+	var scope *TokenScope
+	if scopePermission.Valid {
+		scope = &TokenScope{
+			Permission: Permission(scopePermission.Int64),
+			Topics:     util.SplitNoEmpty(scopeTopics, ","),
+		}
+	}
 	return &Token{
-		Value:      token,
-		Label:      label,
-		LastAccess: time.Unix(lastAccess, 0),
-		LastOrigin: lastOriginIP,
-		Expires:    time.Unix(expires, 0),
+		Value:            token,
+		Label:            label,
+		Type:             TokenType(tokenType),
+		LastAccess:       time.Unix(lastAccess, 0),
+		LastOrigin:       lastOriginIP,
+		Expires:          time.Unix(expires, 0),
+		HardExpires:      time.Unix(hardExpires, 0),
+		Scope:            scope,
+		Created:          time.Unix(created, 0),
+		CreatedOrigin:    createdOriginIP,
+		CreatedUserAgent: createdUserAgent,
 	}, nil
 }
 
@@ -627,7 +1300,7 @@ func (a *Manager) ChangeToken(userID, token string, label *string, expires *time
 		}
 	}
 	if expires != nil {
-		if _, err := tx.Exec(updateTokenExpiryQuery, expires.Unix(), userID, token); err != nil {
+		if _, err := tx.Exec(updateTokenExpiryQuery, expires.Unix(), expires.Unix(), expires.Unix(), userID, token); err != nil {
 			return nil, err
 		}
 	}
@@ -637,6 +1310,52 @@ func (a *Manager) ChangeToken(userID, token string, label *string, expires *time
 	return a.Token(userID, token)
 }
 
+// RotateToken creates a replacement for the given token, with the same label, type and scope. The new token expires
+// after the same duration as the old one (or never, if the old one never expires). The old token stays valid for the
+// given grace period, so that integrations can switch over without downtime; if the grace period is zero, it is
+// removed right away. The new token keeps the hard expiry of the old one, so rotating cannot be used to extend a
+// token's lifetime beyond it.
+func (a *Manager) RotateToken(userID, token string, gracePeriod time.Duration, origin netip.Addr, userAgent string) (newToken *Token, oldToken *Token, err error) {
+	if token == "" {
+		return nil, nil, errNoTokenProvided
+	}
+	oldToken, err = a.Token(userID, token)
+	if err != nil {
+		return nil, nil, err
+	}
+	expires := time.Unix(0, 0)
+	if oldToken.Expires.Unix() > 0 {
+		lifetime := tokenRotationDefaultLifetime
+		if oldToken.Created.Unix() > 0 && oldToken.Expires.After(oldToken.Created) {
+			lifetime = oldToken.Expires.Sub(oldToken.Created)
+		}
+		expires = time.Now().Add(lifetime)
+	}
+	tokenType := oldToken.Type
+	if tokenType == "" {
+		tokenType = TokenTypeIntegration
+	}
+	newToken, err = a.CreateScopedToken(userID, oldToken.Label, tokenType, expires, oldToken.HardExpires, origin, userAgent, oldToken.Scope) // Expiry is capped at the hard expiry
+	if err != nil {
+		return nil, nil, err
+	}
+	if gracePeriod <= 0 {
+		if err := a.RemoveToken(userID, token); err != nil {
+			return nil, nil, err
+		}
+		oldToken.Expires = time.Now()
+		return newToken, oldToken, nil
+	}
+	graceExpires := time.Now().Add(gracePeriod)
+	if oldToken.Expires.Unix() == 0 || oldToken.Expires.After(graceExpires) {
+		oldToken, err = a.ChangeToken(userID, token, nil, &graceExpires)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return newToken, oldToken, nil
+}
+
 // RemoveToken deletes the token defined in User.Token
 func (a *Manager) RemoveToken(userID, token string) error {
 	if token == "" {
@@ -650,7 +1369,8 @@ func (a *Manager) RemoveToken(userID, token string) error {
 
 // RemoveExpiredTokens deletes all expired tokens from the database
 func (a *Manager) RemoveExpiredTokens() error {
-	if _, err := a.db.Exec(deleteExpiredTokensQuery, time.Now().Unix()); err != nil {
+	now := time.Now().Unix()
+	if _, err := a.db.Exec(deleteExpiredTokensQuery, now, now); err != nil {
 		return err
 	}
 	return nil
@@ -714,45 +1434,754 @@ func (a *Manager) RemoveDeletedUsers() error {
 	return nil
 }
 
-// ChangeSettings persists the user settings
-func (a *Manager) ChangeSettings(userID string, prefs *Prefs) error {
-	b, err := json.Marshal(prefs)
+// AddWebhookEvent records that the webhook event with the given provider and ID is being processed. It returns
+// false if the event was already recorded, i.e. if it is a duplicate or a replay and must not be processed again.
+func (a *Manager) AddWebhookEvent(provider, id, eventType string) (bool, error) {
+	result, err := a.db.Exec(insertWebhookEventQuery, provider, id, eventType, time.Now().Unix())
 	if err != nil {
-		return err
+		return false, err
 	}
-	if _, err := a.db.Exec(updateUserPrefsQuery, string(b), userID); err != nil {
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rows > 0, nil
+}
+
+// RemoveWebhookEvent removes a recorded webhook event, so that it can be processed again, e.g. if
+// processing it failed and the provider is expected to retry it
+func (a *Manager) RemoveWebhookEvent(provider, id string) error {
+	if _, err := a.db.Exec(deleteWebhookEventQuery, provider, id); err != nil {
 		return err
 	}
 	return nil
 }
 
-// ResetStats resets all user stats in the user database. This touches all users.
-func (a *Manager) ResetStats() error {
-	a.mu.Lock() // Includes database query to avoid races!
-	defer a.mu.Unlock()
-	if _, err := a.db.Exec(updateUserStatsResetAllQuery); err != nil {
+// RemoveExpiredWebhookEvents deletes recorded webhook events that are older than the retention period
+func (a *Manager) RemoveExpiredWebhookEvents() error {
+	if _, err := a.db.Exec(deleteExpiredWebhookEventQuery, time.Now().Add(-webhookEventKeepDuration).Unix()); err != nil {
 		return err
 	}
-	a.statsQueue = make(map[string]*Stats)
 	return nil
 }
 
-// EnqueueUserStats adds the user to a queue which writes out user stats (messages, emails, ..) in
-// batches at a regular interval
-func (a *Manager) EnqueueUserStats(userID string, stats *Stats) {
-	a.mu.Lock()
-	defer a.mu.Unlock()
-	a.statsQueue[userID] = stats
+// AddSigningKey adds a key to the signing keyring of the given purpose, and returns it. The key is valid until it is
+// retired via RetireSigningKey. Keys are server secrets (e.g. to verify webhook signatures), and not tied to a user.
+func (a *Manager) AddSigningKey(purpose, secret string) (*SigningKey, error) {
+	if purpose == "" || secret == "" {
+		return nil, ErrInvalidArgument
+	}
+	key := &SigningKey{
+		ID:      util.RandomStringPrefix(signingKeyIDPrefix, signingKeyIDLength),
+		Purpose: purpose,
+		Secret:  secret,
+		Created: time.Unix(time.Now().Unix(), 0),
+		Expires: time.Unix(0, 0),
+	}
+	if _, err := a.db.Exec(insertSigningKeyQuery, key.ID, key.Purpose, key.Secret, key.Created.Unix()); err != nil {
+		return nil, err
+	}
+	return key, nil
 }
 
-// EnqueueTokenUpdate adds the token update to  a queue which writes out token access times
-// in batches at a regular interval
-func (a *Manager) EnqueueTokenUpdate(tokenID string, update *TokenUpdate) {
-	a.mu.Lock()
+// SigningKeys returns all valid (i.e. not yet expired) signing keys of the given purpose, or of all purposes if
+// purpose is empty. Keys are sorted by creation date, newest first.
+func (a *Manager) SigningKeys(purpose string) ([]*SigningKey, error) {
+	rows, err := a.db.Query(selectSigningKeysQuery, purpose, purpose, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := make([]*SigningKey, 0)
+	for rows.Next() {
+		var id, keyPurpose, secret string
+		var created, expires int64
+		if err := rows.Scan(&id, &keyPurpose, &secret, &created, &expires); err != nil {
+			return nil, err
+		}
+		keys = append(keys, &SigningKey{
+			ID:      id,
+			Purpose: keyPurpose,
+			Secret:  secret,
+			Created: time.Unix(created, 0),
+			Expires: time.Unix(expires, 0),
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// RetireSigningKey retires a signing key. If grace is zero, the key is removed right away; otherwise it stays
+// valid for the grace period, so that signatures created with it are still accepted during a rotation. It returns
+// ErrSigningKeyNotFound if the key does not exist, or if it is already expired.
+func (a *Manager) RetireSigningKey(id string, grace time.Duration) error {
+	now := time.Now().Unix()
+	var result sql.Result
+	var err error
+	if grace > 0 {
+		result, err = a.db.Exec(updateSigningKeyExpiresQuery, time.Now().Add(grace).Unix(), id, now)
+	} else {
+		result, err = a.db.Exec(deleteSigningKeyQuery, id)
+	}
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return ErrSigningKeyNotFound
+	}
+	return nil
+}
+
+// RemoveExpiredSigningKeys deletes signing keys whose grace period has ended
+func (a *Manager) RemoveExpiredSigningKeys() error {
+	if _, err := a.db.Exec(deleteExpiredSigningKeysQuery, time.Now().Unix()); err != nil {
+		return err
+	}
+	return nil
+}
+
+// AddInvite creates a new invite code, and returns it. If tier is set, users who sign up with the invite are assigned
+// to that tier. If maxUses is zero, the invite can be used any number of times; if expires is the zero Unix time, it
+// does not expire.
+func (a *Manager) AddInvite(tier string, maxUses int, expires time.Time) (*Invite, error) {
+	if maxUses < 0 {
+		return nil, ErrInvalidArgument
+	} else if tier != "" {
+		if _, err := a.Tier(tier); err != nil {
+			return nil, err
+		}
+	}
+	invite := &Invite{
+		Code:    util.RandomLowerStringPrefix(inviteCodePrefix, inviteCodeLength),
+		Tier:    tier,
+		MaxUses: maxUses,
+		Created: time.Unix(time.Now().Unix(), 0),
+		Expires: time.Unix(expires.Unix(), 0),
+	}
+	if _, err := a.db.Exec(insertInviteQuery, invite.Code, invite.Tier, invite.MaxUses, invite.Created.Unix(), invite.Expires.Unix()); err != nil {
+		return nil, err
+	}
+	return invite, nil
+}
+
+// Invites returns all invites that have not expired yet, including used up invites, newest first
+func (a *Manager) Invites() ([]*Invite, error) {
+	rows, err := a.db.Query(selectInvitesQuery, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	invites := make([]*Invite, 0)
+	for rows.Next() {
+		invite, err := readInvite(rows)
+		if err != nil {
+			return nil, err
+		}
+		invites = append(invites, invite)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return invites, nil
+}
+
+// UseInvite counts a signup against the given invite code, and returns the invite. It returns ErrInviteNotFound if
+// the invite does not exist, is expired, or is used up.
+func (a *Manager) UseInvite(code string) (*Invite, error) {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	invite, err := a.useInviteTx(tx, code)
+	if err != nil {
+		return nil, err
+	}
+	return invite, tx.Commit()
+}
+
+// ReturnInvite reverts one use of the given invite code, e.g. if the signup could not be completed after all
+func (a *Manager) ReturnInvite(code string) error {
+	if _, err := a.db.Exec(updateInviteReturnQuery, code); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (a *Manager) useInviteTx(tx *sql.Tx, code string) (*Invite, error) {
+	result, err := tx.Exec(updateInviteUsesQuery, code, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	} else if rows, err := result.RowsAffected(); err != nil {
+		return nil, err
+	} else if rows == 0 {
+		return nil, ErrInviteNotFound
+	}
+	rows, err := tx.Query(selectInviteQuery, code)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, ErrInviteNotFound
+	}
+	return readInvite(rows)
+}
+
+// RemoveInvite deletes the given invite code. It returns ErrInviteNotFound if the invite does not exist.
+func (a *Manager) RemoveInvite(code string) error {
+	result, err := a.db.Exec(deleteInviteQuery, code)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return ErrInviteNotFound
+	}
+	return nil
+}
+
+// RemoveExpiredInvites deletes all invites that have expired
+func (a *Manager) RemoveExpiredInvites() error {
+	if _, err := a.db.Exec(deleteExpiredInvitesQuery, time.Now().Unix()); err != nil {
+		return err
+	}
+	return nil
+}
+
+func readInvite(rows *sql.Rows) (*Invite, error) {
+	var code, tier string
+	var maxUses, uses int
+	var created, expires int64
+	if err := rows.Scan(&code, &tier, &maxUses, &uses, &created, &expires); err != nil {
+		return nil, err
+	}
+	return &Invite{
+		Code:    code,
+		Tier:    tier,
+		MaxUses: maxUses,
+		Uses:    uses,
+		Created: time.Unix(created, 0),
+		Expires: time.Unix(expires, 0),
+	}, nil
+}
+
+// AddOrg creates a new organization with the given name, and adds the given user as its owner. A user can only be
+// a member of one organization.
+func (a *Manager) AddOrg(name, owner string) (*Org, error) {
+	if name == "" || !AllowedUsername(owner) {
+		return nil, ErrInvalidArgument
+	}
+	u, err := a.User(owner)
+	if err != nil {
+		return nil, err
+	} else if u.Org != nil {
+		return nil, ErrOrgMemberExists
+	}
+	org := &Org{
+		ID:      util.RandomStringPrefix(orgIDPrefix, orgIDLength),
+		Name:    name,
+		Billing: &Billing{},
+		Created: time.Unix(time.Now().Unix(), 0),
+	}
+	tx, err := a.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(insertOrgQuery, org.ID, org.Name, org.Created.Unix()); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(upsertOrgMemberQuery, org.ID, owner, string(OrgRoleOwner)); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return org, nil
+}
+
+// Org returns the organization with the given ID, or ErrOrgNotFound if it does not exist
+func (a *Manager) Org(id string) (*Org, error) {
+	rows, err := a.db.Query(selectOrgQuery, id)
+	if err != nil {
+		return nil, err
+	}
+	return a.readOrg(rows)
+}
+
+// OrgByStripeCustomer returns the organization with the given Stripe customer ID, or ErrOrgNotFound
+func (a *Manager) OrgByStripeCustomer(customerID string) (*Org, error) {
+	rows, err := a.db.Query(selectOrgByStripeCustomerIDQuery, customerID)
+	if err != nil {
+		return nil, err
+	}
+	return a.readOrg(rows)
+}
+
+func (a *Manager) readOrg(rows *sql.Rows) (*Org, error) {
+	defer rows.Close()
+	var id, name, tierCode string
+	var stripeCustomerID, stripeSubscriptionID, stripeSubscriptionStatus, stripeSubscriptionInterval sql.NullString
+	var stripeSubscriptionPaidUntil, stripeSubscriptionCancelAt sql.NullInt64
+	var created int64
+	if !rows.Next() {
+		return nil, ErrOrgNotFound
+	}
+	if err := rows.Scan(&id, &name, &tierCode, &stripeCustomerID, &stripeSubscriptionID, &stripeSubscriptionStatus, &stripeSubscriptionInterval, &stripeSubscriptionPaidUntil, &stripeSubscriptionCancelAt, &created); err != nil {
+		return nil, err
+	} else if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close() // Close before querying the tier
+	org := &Org{
+		ID:   id,
+		Name: name,
+		Billing: &Billing{
+			StripeCustomerID:            stripeCustomerID.String,                                          // May be empty
+			StripeSubscriptionID:        stripeSubscriptionID.String,                                      // May be empty
+			StripeSubscriptionStatus:    stripe.SubscriptionStatus(stripeSubscriptionStatus.String),       // May be empty
+			StripeSubscriptionInterval:  stripe.PriceRecurringInterval(stripeSubscriptionInterval.String), // May be empty
+			StripeSubscriptionPaidUntil: time.Unix(stripeSubscriptionPaidUntil.Int64, 0),                  // May be zero
+			StripeSubscriptionCancelAt:  time.Unix(stripeSubscriptionCancelAt.Int64, 0),                   // May be zero
+		},
+		Created: time.Unix(created, 0),
+	}
+	if tierCode != "" {
+		tier, err := a.Tier(tierCode)
+		if err != nil {
+			return nil, err
+		}
+		org.Tier = tier
+	}
+	return org, nil
+}
+
+// RemoveOrg deletes the organization, its memberships and its topics. Members keep their accounts.
+func (a *Manager) RemoveOrg(id string) error {
+	result, err := a.db.Exec(deleteOrgQuery, id)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return ErrOrgNotFound
+	}
+	return nil
+}
+
+// ChangeOrgTier changes the tier of the organization. Members without a tier of their own use the organization's
+// tier. Like ChangeTier, this does not delete any topics if the new tier has lower limits.
+func (a *Manager) ChangeOrgTier(id, tier string) error {
+	if _, err := a.Tier(tier); err != nil {
+		return err
+	}
+	if _, err := a.db.Exec(updateOrgTierQuery, tier, id); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ResetOrgTier removes the tier from the organization
+func (a *Manager) ResetOrgTier(id string) error {
+	_, err := a.db.Exec(deleteOrgTierQuery, id)
+	return err
+}
+
+// ChangeOrgBilling updates the Stripe billing fields of the organization, see ChangeBilling
+func (a *Manager) ChangeOrgBilling(id string, billing *Billing) error {
+	if _, err := a.db.Exec(updateOrgBillingQuery, nullString(billing.StripeCustomerID), nullString(billing.StripeSubscriptionID), nullString(string(billing.StripeSubscriptionStatus)), nullString(string(billing.StripeSubscriptionInterval)), nullInt64(billing.StripeSubscriptionPaidUntil.Unix()), nullInt64(billing.StripeSubscriptionCancelAt.Unix()), id); err != nil {
+		return err
+	}
+	return nil
+}
+
+// AddOrgMember adds a user to the organization with the given role, or changes the role of an existing member.
+// It returns ErrOrgMemberExists if the user is a member of another organization. To add users with their consent,
+// use AddOrgInvite and AcceptOrgInvite instead.
+func (a *Manager) AddOrgMember(id, username string, role OrgRole) error {
+	if !AllowedUsername(username) || !AllowedOrgRole(role) {
+		return ErrInvalidArgument
+	}
+	u, err := a.User(username)
+	if err != nil {
+		return err
+	} else if u.Org != nil && u.Org.ID != id {
+		return ErrOrgMemberExists
+	}
+	if _, err := a.db.Exec(upsertOrgMemberQuery, id, username, string(role)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// RemoveOrgMember removes a user from the organization, and revokes a pending invite of the user, if any
+func (a *Manager) RemoveOrgMember(id, username string) error {
+	if !AllowedUsername(username) {
+		return ErrInvalidArgument
+	}
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(deleteOrgMemberQuery, id, username); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(deleteOrgInviteQuery, id, username); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// AddOrgInvite invites a user to join the organization with the given role, or changes the role of a pending
+// invite. The user only becomes a member once they accept the invite, see AcceptOrgInvite.
+func (a *Manager) AddOrgInvite(id, username string, role OrgRole) error {
+	if !AllowedUsername(username) || !AllowedOrgRole(role) {
+		return ErrInvalidArgument
+	}
+	if _, err := a.User(username); err != nil {
+		return err
+	}
+	if _, err := a.db.Exec(upsertOrgInviteQuery, id, username, string(role), time.Now().Unix()); err != nil {
+		return err
+	}
+	return nil
+}
+
+// OrgInvites returns the pending organization invites of the user, oldest first
+func (a *Manager) OrgInvites(username string) ([]OrgInvite, error) {
+	rows, err := a.db.Query(selectOrgInvitesQuery, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	invites := make([]OrgInvite, 0)
+	for rows.Next() {
+		var id, name, role string
+		if err := rows.Scan(&id, &name, &role); err != nil {
+			return nil, err
+		}
+		invites = append(invites, OrgInvite{
+			ID:   id,
+			Name: name,
+			Role: OrgRole(role),
+		})
+	}
+	return invites, rows.Err()
+}
+
+// AcceptOrgInvite adds the user to the organization with the role of the pending invite, and removes the invite.
+// It returns ErrOrgInviteNotFound if there is no such invite, and ErrOrgMemberExists if the user is a member of
+// another organization.
+func (a *Manager) AcceptOrgInvite(id, username string) error {
+	if !AllowedUsername(username) {
+		return ErrInvalidArgument
+	}
+	u, err := a.User(username)
+	if err != nil {
+		return err
+	} else if u.Org != nil && u.Org.ID != id {
+		return ErrOrgMemberExists
+	}
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var role string
+	if err := tx.QueryRow(selectOrgInviteRoleQuery, id, username).Scan(&role); errors.Is(err, sql.ErrNoRows) {
+		return ErrOrgInviteNotFound
+	} else if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(upsertOrgMemberQuery, id, username, role); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(deleteOrgInviteQuery, id, username); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RemoveOrgInvite declines or revokes a pending invite of the user, see AddOrgInvite. It returns
+// ErrOrgInviteNotFound if there is no such invite.
+func (a *Manager) RemoveOrgInvite(id, username string) error {
+	if !AllowedUsername(username) {
+		return ErrInvalidArgument
+	}
+	result, err := a.db.Exec(deleteOrgInviteQuery, id, username)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	} else if rows == 0 {
+		return ErrOrgInviteNotFound
+	}
+	return nil
+}
+
+// OrgMembers returns the members of the organization, owners and admins first
+func (a *Manager) OrgMembers(id string) ([]OrgMember, error) {
+	rows, err := a.db.Query(selectOrgMembersQuery, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	members := make([]OrgMember, 0)
+	for rows.Next() {
+		var username, role string
+		if err := rows.Scan(&username, &role); err != nil {
+			return nil, err
+		}
+		members = append(members, OrgMember{
+			Username: username,
+			Role:     OrgRole(role),
+		})
+	}
+	return members, rows.Err()
+}
+
+// OrgStats returns the combined daily stats of the members of the organization that use the organization's tier,
+// i.e. of the members that do not have a tier of their own
+func (a *Manager) OrgStats(id string) (*Stats, error) {
+	var messages, emails, calls int64
+	if err := a.db.QueryRow(selectOrgStatsQuery, id).Scan(&messages, &emails, &calls); err != nil {
+		return nil, err
+	}
+	return &Stats{
+		Messages: messages,
+		Emails:   emails,
+		Calls:    calls,
+	}, nil
+}
+
+// AddOrgTopic reserves a topic for the organization, or updates the everyone access of an existing organization
+// topic. Like AddReservation, it fails if there are access control entries for the topic, or if the topic is
+// reserved by another organization. The caller must check the reservation limit of the organization's tier.
+func (a *Manager) AddOrgTopic(id, topic string, everyone Permission) error {
+	if !AllowedTopic(topic) {
+		return ErrInvalidArgument
+	}
+	rows, err := a.db.Query(selectTopicAccessCountQuery, escapeUnderscore(topic), escapeUnderscore(topic))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return errNoRows
+	}
+	var count int
+	if err := rows.Scan(&count); err != nil {
+		return err
+	} else if count > 0 {
+		return errTopicOwnedByOthers
+	}
+	rows.Close()
+	result, err := a.db.Exec(upsertOrgTopicQuery, topic, id, everyone.IsRead(), everyone.IsWrite())
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return errTopicOwnedByOthers
+	}
+	return nil
+}
+
+// RemoveOrgTopic removes a topic reservation of the organization
+func (a *Manager) RemoveOrgTopic(id, topic string) error {
+	result, err := a.db.Exec(deleteOrgTopicQuery, id, topic)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return ErrOrgTopicNotFound
+	}
+	return nil
+}
+
+// OrgTopics returns the topics reserved by the organization
+func (a *Manager) OrgTopics(id string) ([]OrgTopic, error) {
+	rows, err := a.db.Query(selectOrgTopicsQuery, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	topics := make([]OrgTopic, 0)
+	for rows.Next() {
+		var topic string
+		var everyoneRead, everyoneWrite bool
+		if err := rows.Scan(&topic, &everyoneRead, &everyoneWrite); err != nil {
+			return nil, err
+		}
+		topics = append(topics, OrgTopic{
+			Topic:    topic,
+			Everyone: NewPermission(everyoneRead, everyoneWrite),
+		})
+	}
+	return topics, rows.Err()
+}
+
+// OrgTopicsCount returns the number of topics reserved by the organization
+func (a *Manager) OrgTopicsCount(id string) (int64, error) {
+	rows, err := a.db.Query(selectOrgTopicsCountQuery, id)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return 0, errNoRows
+	}
+	var count int64
+	if err := rows.Scan(&count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// orgTopic returns the ID of the organization that reserved the topic, and the everyone permission of the topic,
+// or an empty ID if the topic is not reserved by an organization
+func (a *Manager) orgTopic(topic string) (string, Permission, error) {
+	rows, err := a.db.Query(selectOrgTopicQuery, topic)
+	if err != nil {
+		return "", PermissionDenyAll, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return "", PermissionDenyAll, rows.Err()
+	}
+	var orgID string
+	var everyoneRead, everyoneWrite bool
+	if err := rows.Scan(&orgID, &everyoneRead, &everyoneWrite); err != nil {
+		return "", PermissionDenyAll, err
+	}
+	return orgID, NewPermission(everyoneRead, everyoneWrite), nil
+}
+
+// ChangeSettings persists the user settings
+func (a *Manager) ChangeSettings(userID string, prefs *Prefs) error {
+	b, err := json.Marshal(prefs)
+	if err != nil {
+		return err
+	}
+	if _, err := a.db.Exec(updateUserPrefsQuery, string(b), userID); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ResetStats resets all user stats in the user database. This touches all users.
+func (a *Manager) ResetStats() error {
+	a.mu.Lock() // Includes database query to avoid races!
+	defer a.mu.Unlock()
+	if _, err := a.db.Exec(updateUserStatsResetAllQuery); err != nil {
+		return err
+	}
+	a.statsQueue = make(map[string]*Stats)
+	return nil
+}
+
+// EnqueueUserStats adds the user to a queue which writes out user stats (messages, emails, ..) in
+// batches at a regular interval
+func (a *Manager) EnqueueUserStats(userID string, stats *Stats) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.statsQueue[userID] = stats
+}
+
+// EnqueueTokenUpdate adds the token update to  a queue which writes out token access times
+// in batches at a regular interval
+func (a *Manager) EnqueueTokenUpdate(tokenID string, update *TokenUpdate) {
+	a.mu.Lock()
 	defer a.mu.Unlock()
 	a.tokenQueue[tokenID] = update
 }
 
+// EnqueueUsage adds the usage (messages, emails, attachment bytes) of a user on a topic to a queue, which is
+// written out to hourly usage stats in batches at a regular interval. Topic and counters are taken from usage;
+// the time bucket is the current hour.
+func (a *Manager) EnqueueUsage(userID string, usage *Usage) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	key := usageKey{
+		userID: userID,
+		topic:  usage.Topic,
+		bucket: time.Now().Truncate(usageBucketDuration).Unix(),
+	}
+	queued, ok := a.usageQueue[key]
+	if !ok {
+		queued = &Usage{Topic: usage.Topic, Time: time.Unix(key.bucket, 0)}
+		a.usageQueue[key] = queued
+	}
+	queued.Messages += usage.Messages
+	queued.Emails += usage.Emails
+	queued.AttachmentBytes += usage.AttachmentBytes
+}
+
+// Usage returns the usage stats of the user with the given user ID since the given time, per topic and period
+// of the given granularity (e.g. 24h for daily stats). Periods start at multiples of the granularity since the
+// Unix epoch, i.e. daily periods start at midnight UTC. Stats are sorted by time and topic.
+func (a *Manager) Usage(userID string, since time.Time, granularity time.Duration) ([]*Usage, error) {
+	if granularity < usageBucketDuration || granularity%usageBucketDuration != 0 {
+		return nil, ErrInvalidArgument
+	}
+	seconds := int64(granularity.Seconds())
+	rows, err := a.db.Query(selectUsageQuery, seconds, seconds, userID, since.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	usage := make([]*Usage, 0)
+	for rows.Next() {
+		var topic string
+		var bucket, messages, emails, attachmentBytes int64
+		if err := rows.Scan(&topic, &bucket, &messages, &emails, &attachmentBytes); err != nil {
+			return nil, err
+		}
+		usage = append(usage, &Usage{
+			Topic:           topic,
+			Time:            time.Unix(bucket, 0),
+			Messages:        messages,
+			Emails:          emails,
+			AttachmentBytes: attachmentBytes,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+// UsageTotal returns the total usage of the user with the given user ID across all topics, for all hourly buckets
+// that start within [since, until). Usage that is still queued (see EnqueueUsage) is not included.
+func (a *Manager) UsageTotal(userID string, since, until time.Time) (*Usage, error) {
+	usage := &Usage{Time: since}
+	if err := a.db.QueryRow(selectUsageTotalQuery, userID, since.Unix(), until.Unix()).Scan(&usage.Messages, &usage.Emails, &usage.AttachmentBytes); err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+// RemoveExpiredUsage deletes usage stats older than usageKeepDuration
+func (a *Manager) RemoveExpiredUsage() error {
+	if _, err := a.db.Exec(deleteUsageBeforeQuery, time.Now().Add(-usageKeepDuration).Unix()); err != nil {
+		return err
+	}
+	return nil
+}
+
 func (a *Manager) asyncQueueWriter(interval time.Duration) {
 	ticker := time.NewTicker(interval)
 	for range ticker.C {
@@ -762,6 +2191,9 @@ func (a *Manager) asyncQueueWriter(interval time.Duration) {
 		if err := a.writeTokenUpdateQueue(); err != nil {
 			log.Tag(tag).Err(err).Warn("Writing token update queue failed")
 		}
+		if err := a.writeUsageQueue(); err != nil {
+			log.Tag(tag).Err(err).Warn("Writing usage queue failed")
+		}
 	}
 }
 
@@ -798,6 +2230,30 @@ func (a *Manager) writeUserStatsQueue() error {
 	return tx.Commit()
 }
 
+func (a *Manager) writeUsageQueue() error {
+	a.mu.Lock()
+	if len(a.usageQueue) == 0 {
+		a.mu.Unlock()
+		log.Tag(tag).Trace("No usage updates to commit")
+		return nil
+	}
+	usageQueue := a.usageQueue
+	a.usageQueue = make(map[usageKey]*Usage)
+	a.mu.Unlock()
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	log.Tag(tag).Debug("Writing usage queue with %d update(s)", len(usageQueue))
+	for key, usage := range usageQueue {
+		if _, err := tx.Exec(upsertUsageQuery, key.userID, key.topic, key.bucket, usage.Messages, usage.Emails, usage.AttachmentBytes, key.userID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
 func (a *Manager) writeTokenUpdateQueue() error {
 	a.mu.Lock()
 	if len(a.tokenQueue) == 0 {
@@ -826,38 +2282,117 @@ func (a *Manager) writeTokenUpdateQueue() error {
 // Authorize returns nil if the given user has access to the given topic using the desired
 // permission. The user param may be nil to signal an anonymous user.
 func (a *Manager) Authorize(user *User, topic string, perm Permission) error {
+	decision, err := a.Explain(user, topic, perm)
+	if err != nil {
+		return err
+	} else if !decision.Allowed {
+		return ErrUnauthorized
+	}
+	return nil
+}
+
+// Explain evaluates the access of the given user to the given topic using the desired permission, just like
+// Authorize, but returns which rule produced the decision. The user param may be nil to signal an anonymous user.
+func (a *Manager) Explain(user *User, topic string, perm Permission) (*Decision, error) {
+	if user != nil && !user.TokenScope.Allows(topic, perm) {
+		return &Decision{Allowed: false, Reason: DecisionTokenScope}, nil // Scoped tokens restrict even admins
+	}
+	if user != nil && user.Role == RoleAdmin {
+		return &Decision{Allowed: true, Reason: DecisionAdmin}, nil // Admin can do everything
+	}
+	orgID, everyone, err := a.orgTopic(topic)
+	if err != nil {
+		return nil, err
+	} else if orgID != "" {
+		allowed := everyone
+		if user != nil && user.Org != nil && user.Org.ID == orgID {
+			allowed = PermissionReadWrite
+			if user.Org.Role.IsOrgAdmin() {
+				allowed |= PermissionManage
+			}
+		}
+		return &Decision{
+			Allowed: a.resolvePerms(allowed, perm) == nil,
+			Reason:  DecisionOrg,
+		}, nil
+	}
+	entry, err := a.topicAccessEntry(user, topic)
+	if err != nil {
+		return nil, err
+	} else if entry == nil {
+		return &Decision{
+			Allowed: a.resolvePerms(a.defaultAccess, perm) == nil,
+			Reason:  DecisionDefaultAccess,
+		}, nil
+	}
+	reason := DecisionAccessEntry
+	if entry.Owner != "" {
+		reason = DecisionReservation
+	}
+	return &Decision{
+		Allowed: a.resolvePerms(entry.Permission, perm) == nil,
+		Reason:  reason,
+		Entry:   entry,
+	}, nil
+}
+
+// AuthorizeTopicPattern returns nil if the given user has access to all topics matching the given topic
+// pattern (e.g. "host-*") using the desired permission. Unlike Authorize, the default access does not apply:
+// Users other than admins need an access control entry (for the user or for everyone) that covers the
+// entire pattern, e.g. "host-*" or "*".
+func (a *Manager) AuthorizeTopicPattern(user *User, pattern string, perm Permission) error {
+	if user != nil && !user.TokenScope.Allows(pattern, perm) {
+		return ErrUnauthorized
+	}
 	if user != nil && user.Role == RoleAdmin {
-		return nil // Admin can do everything
+		return nil
+	}
+	// The pattern is matched against the access control entries like a topic, so "*" in the pattern
+	// only matches a wildcard in the entry
+	entry, err := a.topicAccessEntry(user, pattern)
+	if err != nil {
+		return err
+	} else if entry == nil {
+		return ErrUnauthorized
 	}
+	return a.resolvePerms(entry.Permission, perm)
+}
+
+// topicAccessEntry selects the access control entry that applies to this user/topic combo, and returns nil
+// if there is no matching access control entry.
+//   - The query may return two rows (one for everyone, and one for the user), but prioritizes the user.
+//   - Furthermore, the query prioritizes more specific permissions (longer!) over more generic ones, e.g. "test*" > "*"
+//   - It also prioritizes write permissions over read permissions
+func (a *Manager) topicAccessEntry(user *User, topic string) (*MatchedEntry, error) {
 	username := Everyone
 	if user != nil {
 		username = user.Name
 	}
-	// Select the read/write permissions for this user/topic combo.
-	// - The query may return two rows (one for everyone, and one for the user), but prioritizes the user.
-	// - Furthermore, the query prioritizes more specific permissions (longer!) over more generic ones, e.g. "test*" > "*"
-	// - It also prioritizes write permissions over read permissions
 	rows, err := a.db.Query(selectTopicPermsQuery, Everyone, username, topic)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer rows.Close()
 	if !rows.Next() {
-		return a.resolvePerms(a.defaultAccess, perm)
+		return nil, nil
 	}
-	var read, write bool
-	if err := rows.Scan(&read, &write); err != nil {
-		return err
+	var entryUser, topicPattern, owner string
+	var read, write, writeNoCache, attach, manage bool
+	if err := rows.Scan(&entryUser, &topicPattern, &read, &write, &writeNoCache, &attach, &manage, &owner); err != nil {
+		return nil, err
 	} else if err := rows.Err(); err != nil {
-		return err
+		return nil, err
 	}
-	return a.resolvePerms(NewPermission(read, write), perm)
+	return &MatchedEntry{
+		Username:     entryUser,
+		TopicPattern: fromSQLWildcard(topicPattern),
+		Permission:   newPermissionFromColumns(read, write, writeNoCache, attach, manage),
+		Owner:        owner,
+	}, nil
 }
 
 func (a *Manager) resolvePerms(base, perm Permission) error {
-	if perm == PermissionRead && base.IsRead() {
-		return nil
-	} else if perm == PermissionWrite && base.IsWrite() {
+	if perm != PermissionDenyAll && base.Allows(perm) {
 		return nil
 	}
 	return ErrUnauthorized
@@ -865,6 +2400,42 @@ func (a *Manager) resolvePerms(base, perm Permission) error {
 
 // AddUser adds a user with the given username, password and role
 func (a *Manager) AddUser(username, password string, role Role) error {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := a.addUserTx(tx, username, password, role); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// AddUserWithInvite adds a user like AddUser, and counts the signup against the given invite code in the same
+// transaction. If the invite has a tier, the user is assigned to it. It returns ErrInviteNotFound if the invite
+// does not exist, is expired, or is used up; in that case, the user is not created.
+func (a *Manager) AddUserWithInvite(username, password string, role Role, code string) (*Invite, error) {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	invite, err := a.useInviteTx(tx, code)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.addUserTx(tx, username, password, role); err != nil {
+		return nil, err
+	}
+	if invite.Tier != "" {
+		if _, err := tx.Exec(updateUserTierQuery, invite.Tier, 0, username); err != nil {
+			return nil, err
+		}
+	}
+	return invite, tx.Commit()
+}
+
+func (a *Manager) addUserTx(tx *sql.Tx, username, password string, role Role) error {
 	if !AllowedUsername(username) || !AllowedRole(role) {
 		return ErrInvalidArgument
 	}
@@ -874,7 +2445,7 @@ func (a *Manager) AddUser(username, password string, role Role) error {
 	}
 	userID := util.RandomStringPrefix(userIDPrefix, userIDLength)
 	syncTopic, now := util.RandomStringPrefix(syncTopicPrefix, syncTopicLength), time.Now().Unix()
-	if _, err = a.db.Exec(insertUserQuery, userID, username, hash, role, syncTopic, now); err != nil {
+	if _, err = tx.Exec(insertUserQuery, userID, username, hash, role, syncTopic, now); err != nil {
 		if sqliteErr, ok := err.(sqlite3.Error); ok && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
 			return ErrUserExists
 		}
@@ -883,6 +2454,229 @@ func (a *Manager) AddUser(username, password string, role Role) error {
 	return nil
 }
 
+// TOTPEnabled returns true if the user with the given user ID has two-factor authentication enabled,
+// i.e. if a TOTP code (or recovery code) is required in addition to the password, see VerifyTOTP
+func (a *Manager) TOTPEnabled(userID string) (bool, error) {
+	_, enabled, _, err := a.readTOTP(userID)
+	if errors.Is(err, ErrTOTPNotEnabled) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return enabled, nil
+}
+
+// BeginTOTPEnrollment creates a new TOTP secret for the user with the given user ID, and returns it. The
+// secret is pending until it is confirmed with a valid code via EnableTOTP. Calling this again replaces a
+// pending secret. It returns ErrTOTPAlreadyEnabled if two-factor authentication is already enabled.
+func (a *Manager) BeginTOTPEnrollment(userID string) (string, error) {
+	if enabled, err := a.TOTPEnabled(userID); err != nil {
+		return "", err
+	} else if enabled {
+		return "", ErrTOTPAlreadyEnabled
+	}
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return "", err
+	}
+	if _, err := a.db.Exec(upsertTOTPQuery, userID, secret, time.Now().Unix()); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// EnableTOTP confirms the pending TOTP secret (see BeginTOTPEnrollment) with a code from the authenticator,
+// enables two-factor authentication, and returns new recovery codes. The recovery codes are only stored as
+// hashes, so they cannot be retrieved later.
+func (a *Manager) EnableTOTP(userID, code string) ([]string, error) {
+	secret, enabled, _, err := a.readTOTP(userID)
+	if err != nil {
+		return nil, err
+	} else if enabled {
+		return nil, ErrTOTPAlreadyEnabled
+	}
+	step, ok := matchTOTPCode(secret, strings.TrimSpace(code), 0, time.Now())
+	if !ok {
+		return nil, ErrTOTPInvalidCode
+	}
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	tx, err := a.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if result, err := tx.Exec(updateTOTPEnabledQuery, step, userID); err != nil {
+		return nil, err
+	} else if rows, err := result.RowsAffected(); err != nil {
+		return nil, err
+	} else if rows == 0 {
+		return nil, ErrTOTPAlreadyEnabled
+	}
+	if _, err := tx.Exec(deleteTOTPRecoveryCodesQuery, userID); err != nil {
+		return nil, err
+	}
+	for _, c := range codes {
+		if _, err := tx.Exec(insertTOTPRecoveryCodeQuery, userID, hashRecoveryCode(c)); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// VerifyTOTP checks a TOTP code (or a recovery code) of the user with the given user ID. TOTP codes can only be
+// used once, and recovery codes are deleted once they were used. It returns ErrTOTPInvalidCode if the code is
+// invalid, or ErrTOTPNotEnabled if the user does not have two-factor authentication enabled.
+func (a *Manager) VerifyTOTP(userID, code string) error {
+	secret, enabled, lastStep, err := a.readTOTP(userID)
+	if err != nil {
+		return err
+	} else if !enabled {
+		return ErrTOTPNotEnabled
+	}
+	code = strings.TrimSpace(code)
+	if step, ok := matchTOTPCode(secret, code, lastStep, time.Now()); ok {
+		result, err := a.db.Exec(updateTOTPLastStepQuery, step, userID, step)
+		if err != nil {
+			return err
+		} else if rows, err := result.RowsAffected(); err != nil {
+			return err
+		} else if rows == 0 {
+			return ErrTOTPInvalidCode // Code was used concurrently
+		}
+		return nil
+	}
+	result, err := a.db.Exec(deleteTOTPRecoveryCodeQuery, userID, hashRecoveryCode(code))
+	if err != nil {
+		return err
+	} else if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return ErrTOTPInvalidCode
+	}
+	return nil
+}
+
+// AuthenticateTOTP checks a TOTP code (or a recovery code) like VerifyTOTP, but allows TOTP codes to be used again
+// while they are valid, so that repeated password (Basic auth) requests can send the same code. The code can not be
+// used with VerifyTOTP anymore afterwards. Recovery codes are deleted once they were used.
+func (a *Manager) AuthenticateTOTP(userID, code string) error {
+	secret, enabled, lastStep, err := a.readTOTP(userID)
+	if err != nil {
+		return err
+	} else if !enabled {
+		return ErrTOTPNotEnabled
+	}
+	code = strings.TrimSpace(code)
+	if step, ok := matchTOTPCode(secret, code, 0, time.Now()); ok {
+		if step > lastStep {
+			if _, err := a.db.Exec(updateTOTPLastStepQuery, step, userID, step); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	result, err := a.db.Exec(deleteTOTPRecoveryCodeQuery, userID, hashRecoveryCode(code))
+	if err != nil {
+		return err
+	} else if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return ErrTOTPInvalidCode
+	}
+	return nil
+}
+
+// TOTPRecoveryCodesLeft returns the number of unused recovery codes of the user with the given user ID
+func (a *Manager) TOTPRecoveryCodesLeft(userID string) (int, error) {
+	var count int
+	if err := a.db.QueryRow(selectTOTPRecoveryCountQuery, userID).Scan(&count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// DisableTOTP disables two-factor authentication for the user with the given user ID, and removes the
+// secret and the recovery codes. It returns nil if two-factor authentication was not enabled.
+func (a *Manager) DisableTOTP(userID string) error {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(deleteTOTPQuery, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(deleteTOTPRecoveryCodesQuery, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// AddEmailVerification marks the user with the given user ID as unverified until VerifyEmail is called with the
+// returned token, or until the user is removed by RemoveUnverifiedUsers after the given expiry time. Calling it
+// again replaces the token.
+func (a *Manager) AddEmailVerification(userID, email string, expires time.Time) (string, error) {
+	token := util.RandomLowerStringPrefix(verificationTokenPrefix, verificationTokenLength)
+	if _, err := a.db.Exec(upsertVerificationQuery, userID, email, hashVerificationToken(token), expires.Unix()); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// EmailVerificationPending returns true if the user with the given user ID has not verified their email address yet
+func (a *Manager) EmailVerificationPending(userID string) (bool, error) {
+	var count int
+	if err := a.db.QueryRow(selectVerificationCountQuery, userID).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// VerifyEmail completes the email verification with the given token, and returns the ID of the verified user.
+// It returns ErrVerificationNotFound if the token does not exist or has expired.
+func (a *Manager) VerifyEmail(token string) (string, error) {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	var userID string
+	err = tx.QueryRow(selectVerificationUserIDQuery, hashVerificationToken(token), time.Now().Unix()).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrVerificationNotFound
+	} else if err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec(deleteVerificationQuery, userID); err != nil {
+		return "", err
+	}
+	return userID, tx.Commit()
+}
+
+// RemoveUnverifiedUsers deletes all users whose email verification has expired
+func (a *Manager) RemoveUnverifiedUsers() error {
+	if _, err := a.db.Exec(deleteUnverifiedUsersQuery, time.Now().Unix()); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (a *Manager) readTOTP(userID string) (secret string, enabled bool, lastStep int64, err error) {
+	err = a.db.QueryRow(selectTOTPQuery, userID).Scan(&secret, &enabled, &lastStep)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, 0, ErrTOTPNotEnabled
+	} else if err != nil {
+		return "", false, 0, err
+	}
+	return secret, enabled, lastStep, nil
+}
+
 // RemoveUser deletes the user with the given username. The function returns nil on success, even
 // if the user did not exist in the first place.
 func (a *Manager) RemoveUser(username string) error {
@@ -994,7 +2788,8 @@ func (a *Manager) UserByStripeCustomer(stripeCustomerID string) (*User, error) {
 }
 
 func (a *Manager) userByToken(token string) (*User, error) {
-	rows, err := a.db.Query(selectUserByTokenQuery, token, time.Now().Unix())
+	now := time.Now().Unix()
+	rows, err := a.db.Query(selectUserByTokenQuery, token, now, now)
 	if err != nil {
 		return nil, err
 	}
@@ -1004,13 +2799,16 @@ func (a *Manager) userByToken(token string) (*User, error) {
 func (a *Manager) readUser(rows *sql.Rows) (*User, error) {
 	defer rows.Close()
 	var id, username, hash, role, prefs, syncTopic string
-	var stripeCustomerID, stripeSubscriptionID, stripeSubscriptionStatus, stripeSubscriptionInterval, stripeMonthlyPriceID, stripeYearlyPriceID, tierID, tierCode, tierName sql.NullString
+	var stripeCustomerID, stripeSubscriptionID, stripeSubscriptionStatus, stripeSubscriptionInterval, stripeMonthlyPriceID, stripeYearlyPriceID, stripeMeteredMessagesPriceID, stripeMeteredAttachmentPriceID, tierID, tierCode, tierName sql.NullString
 	var messages, emails, calls int64
-	var messagesLimit, messagesExpiryDuration, emailsLimit, callsLimit, reservationsLimit, attachmentFileSizeLimit, attachmentTotalSizeLimit, attachmentExpiryDuration, attachmentBandwidthLimit, stripeSubscriptionPaidUntil, stripeSubscriptionCancelAt, deleted sql.NullInt64
+	var messagesLimit, messagesExpiryDuration, emailsLimit, callsLimit, reservationsLimit, attachmentFileSizeLimit, attachmentTotalSizeLimit, attachmentExpiryDuration, attachmentBandwidthLimit, subscriptionsLimit, subscriptionDurationLimit, stripeSubscriptionPaidUntil, stripeSubscriptionCancelAt, deleted, suspended sql.NullInt64
+	var suspendedUntil, tierExpires int64
+	var suspendedReason, orgID, orgRole, orgName string
+	var orgTier bool
 	if !rows.Next() {
 		return nil, ErrUserNotFound
 	}
-	if err := rows.Scan(&id, &username, &hash, &role, &prefs, &syncTopic, &messages, &emails, &calls, &stripeCustomerID, &stripeSubscriptionID, &stripeSubscriptionStatus, &stripeSubscriptionInterval, &stripeSubscriptionPaidUntil, &stripeSubscriptionCancelAt, &deleted, &tierID, &tierCode, &tierName, &messagesLimit, &messagesExpiryDuration, &emailsLimit, &callsLimit, &reservationsLimit, &attachmentFileSizeLimit, &attachmentTotalSizeLimit, &attachmentExpiryDuration, &attachmentBandwidthLimit, &stripeMonthlyPriceID, &stripeYearlyPriceID); err != nil {
+	if err := rows.Scan(&id, &username, &hash, &role, &prefs, &syncTopic, &messages, &emails, &calls, &stripeCustomerID, &stripeSubscriptionID, &stripeSubscriptionStatus, &stripeSubscriptionInterval, &stripeSubscriptionPaidUntil, &stripeSubscriptionCancelAt, &deleted, &suspended, &suspendedUntil, &suspendedReason, &tierExpires, &orgID, &orgRole, &orgName, &orgTier, &tierID, &tierCode, &tierName, &messagesLimit, &messagesExpiryDuration, &emailsLimit, &callsLimit, &reservationsLimit, &attachmentFileSizeLimit, &attachmentTotalSizeLimit, &attachmentExpiryDuration, &attachmentBandwidthLimit, &subscriptionsLimit, &subscriptionDurationLimit, &stripeMonthlyPriceID, &stripeYearlyPriceID, &stripeMeteredMessagesPriceID, &stripeMeteredAttachmentPriceID); err != nil {
 		return nil, err
 	} else if err := rows.Err(); err != nil {
 		return nil, err
@@ -1035,28 +2833,48 @@ func (a *Manager) readUser(rows *sql.Rows) (*User, error) {
 			StripeSubscriptionPaidUntil: time.Unix(stripeSubscriptionPaidUntil.Int64, 0),                  // May be zero
 			StripeSubscriptionCancelAt:  time.Unix(stripeSubscriptionCancelAt.Int64, 0),                   // May be zero
 		},
-		Deleted: deleted.Valid,
+		TierExpires: time.Unix(tierExpires, 0), // May be zero
+		Deleted:     deleted.Valid,
 	}
 	if err := json.Unmarshal([]byte(prefs), user.Prefs); err != nil {
 		return nil, err
 	}
+	if orgID != "" {
+		user.Org = &OrgMembership{
+			ID:       orgID,
+			Name:     orgName,
+			Role:     OrgRole(orgRole),
+			UsesTier: orgTier,
+		}
+	}
+	if suspended.Valid {
+		user.Suspension = &Suspension{
+			Since:  time.Unix(suspended.Int64, 0),
+			Until:  time.Unix(suspendedUntil, 0), // May be zero
+			Reason: suspendedReason,
+		}
+	}
 	if tierCode.Valid {
 		// See readTier() when this is changed!
 		user.Tier = &Tier{
-			ID:                       tierID.String,
-			Code:                     tierCode.String,
-			Name:                     tierName.String,
-			MessageLimit:             messagesLimit.Int64,
-			MessageExpiryDuration:    time.Duration(messagesExpiryDuration.Int64) * time.Second,
-			EmailLimit:               emailsLimit.Int64,
-			CallLimit:                callsLimit.Int64,
-			ReservationLimit:         reservationsLimit.Int64,
-			AttachmentFileSizeLimit:  attachmentFileSizeLimit.Int64,
-			AttachmentTotalSizeLimit: attachmentTotalSizeLimit.Int64,
-			AttachmentExpiryDuration: time.Duration(attachmentExpiryDuration.Int64) * time.Second,
-			AttachmentBandwidthLimit: attachmentBandwidthLimit.Int64,
-			StripeMonthlyPriceID:     stripeMonthlyPriceID.String, // May be empty
-			StripeYearlyPriceID:      stripeYearlyPriceID.String,  // May be empty
+			ID:                             tierID.String,
+			Code:                           tierCode.String,
+			Name:                           tierName.String,
+			MessageLimit:                   messagesLimit.Int64,
+			MessageExpiryDuration:          time.Duration(messagesExpiryDuration.Int64) * time.Second,
+			EmailLimit:                     emailsLimit.Int64,
+			CallLimit:                      callsLimit.Int64,
+			ReservationLimit:               reservationsLimit.Int64,
+			AttachmentFileSizeLimit:        attachmentFileSizeLimit.Int64,
+			AttachmentTotalSizeLimit:       attachmentTotalSizeLimit.Int64,
+			AttachmentExpiryDuration:       time.Duration(attachmentExpiryDuration.Int64) * time.Second,
+			AttachmentBandwidthLimit:       attachmentBandwidthLimit.Int64,
+			SubscriptionLimit:              subscriptionsLimit.Int64,
+			SubscriptionDurationLimit:      time.Duration(subscriptionDurationLimit.Int64) * time.Second,
+			StripeMonthlyPriceID:           stripeMonthlyPriceID.String,           // May be empty
+			StripeYearlyPriceID:            stripeYearlyPriceID.String,            // May be empty
+			StripeMeteredMessagesPriceID:   stripeMeteredMessagesPriceID.String,   // May be empty
+			StripeMeteredAttachmentPriceID: stripeMeteredAttachmentPriceID.String, // May be empty
 		}
 	}
 	return user, nil
@@ -1072,8 +2890,8 @@ func (a *Manager) AllGrants() (map[string][]Grant, error) {
 	grants := make(map[string][]Grant, 0)
 	for rows.Next() {
 		var userID, topic string
-		var read, write bool
-		if err := rows.Scan(&userID, &topic, &read, &write); err != nil {
+		var read, write, writeNoCache, attach, manage bool
+		if err := rows.Scan(&userID, &topic, &read, &write, &writeNoCache, &attach, &manage); err != nil {
 			return nil, err
 		} else if err := rows.Err(); err != nil {
 			return nil, err
@@ -1083,7 +2901,7 @@ func (a *Manager) AllGrants() (map[string][]Grant, error) {
 		}
 		grants[userID] = append(grants[userID], Grant{
 			TopicPattern: fromSQLWildcard(topic),
-			Allow:        NewPermission(read, write),
+			Allow:        newPermissionFromColumns(read, write, writeNoCache, attach, manage),
 		})
 	}
 	return grants, nil
@@ -1099,15 +2917,15 @@ func (a *Manager) Grants(username string) ([]Grant, error) {
 	grants := make([]Grant, 0)
 	for rows.Next() {
 		var topic string
-		var read, write bool
-		if err := rows.Scan(&topic, &read, &write); err != nil {
+		var read, write, writeNoCache, attach, manage bool
+		if err := rows.Scan(&topic, &read, &write, &writeNoCache, &attach, &manage); err != nil {
 			return nil, err
 		} else if err := rows.Err(); err != nil {
 			return nil, err
 		}
 		grants = append(grants, Grant{
 			TopicPattern: fromSQLWildcard(topic),
-			Allow:        NewPermission(read, write),
+			Allow:        newPermissionFromColumns(read, write, writeNoCache, attach, manage),
 		})
 	}
 	return grants, nil
@@ -1122,18 +2940,19 @@ func (a *Manager) Reservations(username string) ([]Reservation, error) {
 	defer rows.Close()
 	reservations := make([]Reservation, 0)
 	for rows.Next() {
-		var topic string
+		var topic, emailAlias string
 		var ownerRead, ownerWrite bool
 		var everyoneRead, everyoneWrite sql.NullBool
-		if err := rows.Scan(&topic, &ownerRead, &ownerWrite, &everyoneRead, &everyoneWrite); err != nil {
+		if err := rows.Scan(&topic, &ownerRead, &ownerWrite, &everyoneRead, &everyoneWrite, &emailAlias); err != nil {
 			return nil, err
 		} else if err := rows.Err(); err != nil {
 			return nil, err
 		}
 		reservations = append(reservations, Reservation{
-			Topic:    unescapeUnderscore(topic),
-			Owner:    NewPermission(ownerRead, ownerWrite),
-			Everyone: NewPermission(everyoneRead.Bool, everyoneWrite.Bool), // false if null
+			Topic:      unescapeUnderscore(topic),
+			Owner:      NewPermission(ownerRead, ownerWrite),
+			Everyone:   NewPermission(everyoneRead.Bool, everyoneWrite.Bool), // false if null
+			EmailAlias: emailAlias,
 		})
 	}
 	return reservations, nil
@@ -1203,19 +3022,93 @@ func (a *Manager) ChangePassword(username, password string) error {
 	return nil
 }
 
-// ChangeRole changes a user's role. When a role is changed from RoleUser to RoleAdmin,
-// all existing access control entries (Grant) are removed, since they are no longer needed.
-func (a *Manager) ChangeRole(username string, role Role) error {
-	if !AllowedUsername(username) || !AllowedRole(role) {
+// ChangeUsername renames a user. Access control entries, reservations, tokens, phone numbers and messages all
+// reference the user ID rather than the username, so they are carried over automatically. The rename is done in a
+// transaction, and fails with ErrUserExists if the new username is already taken.
+func (a *Manager) ChangeUsername(username, newUsername string) error {
+	if !AllowedUsername(username) || !AllowedUsername(newUsername) {
+		return ErrInvalidArgument
+	}
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var count int
+	if err := tx.QueryRow(selectUsernameExistsQuery, newUsername).Scan(&count); err != nil {
+		return err
+	} else if count > 0 {
+		return ErrUserExists
+	}
+	result, err := tx.Exec(updateUsernameQuery, newUsername, username)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return ErrUserNotFound
+	}
+	return tx.Commit()
+}
+
+// ChangeRole changes a user's role. When a role is changed from RoleUser to RoleAdmin,
+// all existing access control entries (Grant) are removed, since they are no longer needed.
+func (a *Manager) ChangeRole(username string, role Role) error {
+	if !AllowedUsername(username) || !AllowedRole(role) {
+		return ErrInvalidArgument
+	}
+	if _, err := a.db.Exec(updateUserRoleQuery, string(role), username); err != nil {
+		return err
+	}
+	if role == RoleAdmin {
+		if _, err := a.db.Exec(deleteUserAccessQuery, username, username); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SuspendUser suspends the account of the given user. Suspended users can still log in, but cannot publish or
+// subscribe. Their data is preserved. If until is not zero, the suspension is lifted automatically at that time
+// (see ReinstateExpiredSuspensions).
+func (a *Manager) SuspendUser(username, reason string, until time.Time) error {
+	if !AllowedUsername(username) {
+		return ErrInvalidArgument
+	}
+	result, err := a.db.Exec(updateUserSuspendedQuery, time.Now().Unix(), until.Unix(), reason, username)
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// ReinstateUser lifts the suspension of the given user
+func (a *Manager) ReinstateUser(username string) error {
+	if !AllowedUsername(username) {
 		return ErrInvalidArgument
 	}
-	if _, err := a.db.Exec(updateUserRoleQuery, string(role), username); err != nil {
+	result, err := a.db.Exec(updateUserReinstatedQuery, username)
+	if err != nil {
 		return err
 	}
-	if role == RoleAdmin {
-		if _, err := a.db.Exec(deleteUserAccessQuery, username, username); err != nil {
-			return err
-		}
+	if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// ReinstateExpiredSuspensions lifts all suspensions whose end date has passed
+func (a *Manager) ReinstateExpiredSuspensions() error {
+	if _, err := a.db.Exec(updateUserReinstatedExpiredQuery, time.Now().Unix()); err != nil {
+		return err
 	}
 	return nil
 }
@@ -1232,12 +3125,49 @@ func (a *Manager) ChangeTier(username, tier string) error {
 	} else if err := a.checkReservationsLimit(username, t.ReservationLimit); err != nil {
 		return err
 	}
-	if _, err := a.db.Exec(updateUserTierQuery, tier, username); err != nil {
+	if _, err := a.db.Exec(updateUserTierQuery, tier, 0, username); err != nil {
+		return err
+	}
+	return nil
+}
+
+// GrantTier assigns a tier to a user until the given time, independent of any Stripe subscription, e.g. for trials
+// or sponsorships. Once the grant has expired, the tier is removed by the server (see UsersWithExpiredTier). Like
+// ChangeTier, this function does not delete reservations, messages, or attachments.
+func (a *Manager) GrantTier(username, tier string, expires time.Time) error {
+	if !AllowedUsername(username) {
+		return ErrInvalidArgument
+	}
+	t, err := a.Tier(tier)
+	if err != nil {
+		return err
+	} else if err := a.checkReservationsLimit(username, t.ReservationLimit); err != nil {
+		return err
+	}
+	if _, err := a.db.Exec(updateUserTierQuery, tier, expires.Unix(), username); err != nil {
 		return err
 	}
 	return nil
 }
 
+// UsersWithExpiredTier returns the names of all users whose granted tier has expired (see GrantTier)
+func (a *Manager) UsersWithExpiredTier() ([]string, error) {
+	rows, err := a.db.Query(selectUsersWithExpiredTierQuery, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	usernames := make([]string, 0)
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			return nil, err
+		}
+		usernames = append(usernames, username)
+	}
+	return usernames, rows.Err()
+}
+
 // ResetTier removes the tier from the given user
 func (a *Manager) ResetTier(username string) error {
 	if !AllowedUsername(username) && username != Everyone && username != "" {
@@ -1286,6 +3216,12 @@ func (a *Manager) AllowReservation(username string, topic string) error {
 	if otherCount > 0 {
 		return errTopicOwnedByOthers
 	}
+	rows.Close()
+	if orgID, _, err := a.orgTopic(topic); err != nil {
+		return err
+	} else if orgID != "" {
+		return errTopicOwnedByOthers
+	}
 	return nil
 }
 
@@ -1299,7 +3235,7 @@ func (a *Manager) AllowAccess(username string, topicPattern string, permission P
 		return ErrInvalidArgument
 	}
 	owner := ""
-	if _, err := a.db.Exec(upsertUserAccessQuery, username, toSQLWildcard(topicPattern), permission.IsRead(), permission.IsWrite(), owner, owner); err != nil {
+	if _, err := a.db.Exec(upsertUserAccessQuery, username, toSQLWildcard(topicPattern), permission.IsRead(), permission.IsWrite(), permission.IsWriteNoCache(), permission.IsAttach(), permission.IsManage(), owner, owner); err != nil {
 		return err
 	}
 	return nil
@@ -1333,43 +3269,487 @@ func (a *Manager) AddReservation(username string, topic string, everyone Permiss
 	}
 	tx, err := a.db.Begin()
 	if err != nil {
-		return err
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(upsertUserAccessQuery, username, escapeUnderscore(topic), true, true, false, false, false, username, username); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(upsertUserAccessQuery, Everyone, escapeUnderscore(topic), everyone.IsRead(), everyone.IsWrite(), everyone.IsWriteNoCache(), everyone.IsAttach(), everyone.IsManage(), username, username); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RemoveReservations deletes the access control entries associated with the given username/topic, as
+// well as all entries with Everyone/topic. This is the counterpart for AddReservation.
+func (a *Manager) RemoveReservations(username string, topics ...string) error {
+	if !AllowedUsername(username) || username == Everyone || len(topics) == 0 {
+		return ErrInvalidArgument
+	}
+	for _, topic := range topics {
+		if !AllowedTopic(topic) {
+			return ErrInvalidArgument
+		}
+	}
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, topic := range topics {
+		if _, err := tx.Exec(deleteTopicAccessQuery, username, username, escapeUnderscore(topic)); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(deleteTopicAccessQuery, Everyone, Everyone, escapeUnderscore(topic)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// AddReservationManager grants another user the manage permission (in addition to read-write access) for a topic
+// reserved by the owner, see PermissionManage. The entry is owned by the reservation owner, so it is removed along
+// with the reservation. The caller must ensure that the owner has a reservation for the topic.
+func (a *Manager) AddReservationManager(owner, topic, manager string) error {
+	if !AllowedUsername(owner) || !AllowedUsername(manager) || owner == manager || !AllowedTopic(topic) {
+		return ErrInvalidArgument
+	}
+	if _, err := a.User(manager); err != nil {
+		return err
+	}
+	return a.upsertReservationUserAccess(owner, topic, manager, true, true, true)
+}
+
+// RemoveReservationManager revokes the manage permission granted with AddReservationManager
+func (a *Manager) RemoveReservationManager(owner, topic, manager string) error {
+	if !AllowedUsername(owner) || !AllowedUsername(manager) || !AllowedTopic(topic) {
+		return ErrInvalidArgument
+	}
+	if _, err := a.db.Exec(deleteReservationUserQuery, manager, escapeUnderscore(topic), owner); err != nil {
+		return err
+	}
+	return nil
+}
+
+// AddReservationMember grants another user access to a topic reserved by the owner, e.g. to share a protected topic
+// within a team. Like managers (see AddReservationManager), members are owned by the reservation owner, so they are
+// removed along with the reservation. The caller must ensure that the owner has a reservation for the topic.
+func (a *Manager) AddReservationMember(owner, topic, member string, permission Permission) error {
+	if !AllowedUsername(owner) || !AllowedUsername(member) || owner == member || !AllowedTopic(topic) {
+		return ErrInvalidArgument
+	} else if permission == PermissionDenyAll || permission.IsManage() {
+		return ErrInvalidArgument
+	}
+	if _, err := a.User(member); err != nil {
+		return err
+	}
+	return a.upsertReservationUserAccess(owner, topic, member, permission.IsRead(), permission.IsWrite(), false)
+}
+
+// upsertReservationUserAccess adds or updates an access entry owned by the reservation owner. Entries that were not
+// created by the owner (e.g. granted by an admin) are left alone, since they would otherwise be deleted along with
+// the reservation. In that case, ErrUserAccessExists is returned.
+func (a *Manager) upsertReservationUserAccess(owner, topic, username string, read, write, manage bool) error {
+	result, err := a.db.Exec(upsertReservationUserAccessQuery, username, escapeUnderscore(topic), read, write, false, false, manage, owner)
+	if err != nil {
+		return err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	} else if rows == 0 {
+		return ErrUserAccessExists
+	}
+	return nil
+}
+
+// RemoveReservationMember revokes the access granted with AddReservationMember
+func (a *Manager) RemoveReservationMember(owner, topic, member string) error {
+	if !AllowedUsername(owner) || !AllowedUsername(member) || !AllowedTopic(topic) {
+		return ErrInvalidArgument
+	}
+	if _, err := a.db.Exec(deleteReservationUserQuery, member, escapeUnderscore(topic), owner); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ReservationMembers returns the users the owner granted access to the reserved topic, see AddReservationMember
+func (a *Manager) ReservationMembers(owner, topic string) ([]ReservationMember, error) {
+	rows, err := a.db.Query(selectReservationMembersQuery, escapeUnderscore(topic), owner, Everyone)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	members := make([]ReservationMember, 0)
+	for rows.Next() {
+		var username string
+		var read, write bool
+		if err := rows.Scan(&username, &read, &write); err != nil {
+			return nil, err
+		}
+		members = append(members, ReservationMember{
+			Username:   username,
+			Permission: NewPermission(read, write),
+		})
+	}
+	return members, rows.Err()
+}
+
+// TransferReservation hands over the ownership of a topic reserved by the owner to another user. Managers, members,
+// the everyone access, the publish secret and the email alias are kept. The previous owner stays a read-write member,
+// and can be removed by the new owner. Any existing access entry of the new owner for the topic (as a member, or
+// granted by an admin) is replaced. It returns ErrReservationNotFound if the owner does not own a reservation for the
+// topic. The caller must ensure that the new owner is allowed to own another reservation.
+func (a *Manager) TransferReservation(owner, topic, newOwner string) error {
+	if !AllowedUsername(owner) || !AllowedUsername(newOwner) || owner == newOwner || !AllowedTopic(topic) {
+		return ErrInvalidArgument
+	}
+	if _, err := a.User(newOwner); err != nil {
+		return err
+	}
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(deleteReservationNewOwnerQuery, newOwner, escapeUnderscore(topic), owner); err != nil {
+		return err
+	}
+	result, err := tx.Exec(updateReservationOwnerEntryQuery, newOwner, newOwner, owner, escapeUnderscore(topic))
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return ErrReservationNotFound
+	}
+	if _, err := tx.Exec(updateReservationOwnerQuery, newOwner, owner, escapeUnderscore(topic)); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(upsertUserAccessQuery, owner, escapeUnderscore(topic), true, true, false, false, false, newOwner, newOwner); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// SetReservationSecret sets the shared secret used to verify signed (HMAC) publish requests to a topic reserved by
+// the given user, or removes it if secret is empty. It returns ErrReservationNotFound
+// if the user does not own a reservation for the topic.
+func (a *Manager) SetReservationSecret(username, topic, secret string) error {
+	if !AllowedUsername(username) || username == Everyone || !AllowedTopic(topic) {
+		return ErrInvalidArgument
+	}
+	result, err := a.db.Exec(updateReservationSecretQuery, nullString(secret), username, escapeUnderscore(topic))
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return ErrReservationNotFound
+	}
+	return nil
+}
+
+// ReservationSecret returns the shared secret of a reserved topic, see SetReservationSecret, or an empty
+// string if the topic is not reserved or has no secret
+func (a *Manager) ReservationSecret(topic string) (string, error) {
+	rows, err := a.db.Query(selectReservationSecretQuery, escapeUnderscore(topic))
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return "", rows.Err()
+	}
+	var secret string
+	if err := rows.Scan(&secret); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// SetReservationEmailAlias sets the secret email alias of a topic reserved by the given user (the local part
+// of the address emails can be sent to, see EmailAliasTopic), or removes it if alias is empty. It returns
+// ErrReservationNotFound if the user does not own a reservation for the topic.
+func (a *Manager) SetReservationEmailAlias(username, topic, alias string) error {
+	if !AllowedUsername(username) || username == Everyone || !AllowedTopic(topic) {
+		return ErrInvalidArgument
+	}
+	result, err := a.db.Exec(updateReservationEmailAliasQuery, nullString(strings.ToLower(alias)), username, escapeUnderscore(topic))
+	if err != nil {
+		return err
+	}
+	if rows, err := result.RowsAffected(); err != nil {
+		return err
+	} else if rows == 0 {
+		return ErrReservationNotFound
+	}
+	return nil
+}
+
+// ReservationEmailAlias returns the secret email alias of a reserved topic, see SetReservationEmailAlias,
+// or an empty string if the topic is not reserved or has no alias
+func (a *Manager) ReservationEmailAlias(topic string) (string, error) {
+	rows, err := a.db.Query(selectReservationEmailAliasQuery, escapeUnderscore(topic))
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return "", rows.Err()
+	}
+	var alias string
+	if err := rows.Scan(&alias); err != nil {
+		return "", err
+	}
+	return alias, nil
+}
+
+// EmailAliasTopic returns the reserved topic with the given secret email alias (case-insensitive), or an
+// empty string if there is no such topic
+func (a *Manager) EmailAliasTopic(alias string) (string, error) {
+	rows, err := a.db.Query(selectEmailAliasTopicQuery, strings.ToLower(alias))
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return "", rows.Err()
+	}
+	var topic string
+	if err := rows.Scan(&topic); err != nil {
+		return "", err
+	}
+	return unescapeUnderscore(topic), nil
+}
+
+// ReservationManagers returns the usernames of the users the owner granted the manage permission for the
+// reserved topic, see AddReservationManager
+func (a *Manager) ReservationManagers(owner, topic string) ([]string, error) {
+	rows, err := a.db.Query(selectReservationManagersQuery, escapeUnderscore(topic), owner, Everyone)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	managers := make([]string, 0)
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			return nil, err
+		}
+		managers = append(managers, username)
+	}
+	return managers, rows.Err()
+}
+
+// ExportAccess returns all user-specific access control entries and reservations as an AccessList.
+// The result can be passed to ImportAccess to restore the exact same state.
+func (a *Manager) ExportAccess() (*AccessList, error) {
+	list := &AccessList{
+		Access:       make([]AccessEntry, 0),
+		Reservations: make([]ReservationEntry, 0),
+	}
+	rows, err := a.db.Query(selectAllAccessExportQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var username, topic string
+		var read, write, writeNoCache, attach, manage bool
+		if err := rows.Scan(&username, &topic, &read, &write, &writeNoCache, &attach, &manage); err != nil {
+			return nil, err
+		} else if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		list.Access = append(list.Access, AccessEntry{
+			User:       username,
+			Topic:      fromSQLWildcard(topic),
+			Permission: newPermissionFromColumns(read, write, writeNoCache, attach, manage).String(),
+		})
+	}
+	rows, err = a.db.Query(selectAllReservationsExportQuery, Everyone)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var username, topic string
+		var everyoneRead, everyoneWrite sql.NullBool
+		if err := rows.Scan(&username, &topic, &everyoneRead, &everyoneWrite); err != nil {
+			return nil, err
+		} else if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		list.Reservations = append(list.Reservations, ReservationEntry{
+			User:     username,
+			Topic:    unescapeUnderscore(topic),
+			Everyone: NewPermission(everyoneRead.Bool, everyoneWrite.Bool).String(), // false if null
+		})
+	}
+	return list, nil
+}
+
+// ImportAccess replaces all user-specific access control entries and reservations with the ones in the given
+// AccessList. Only the differences to the current state are applied (in a single transaction), so importing the
+// same list twice is a no-op. Entries not contained in the list are removed. If dryRun is true, the changes
+// are computed and returned, but not applied. Tier-based reservation limits are not enforced.
+func (a *Manager) ImportAccess(list *AccessList, dryRun bool) (*AccessListChanges, error) {
+	if err := a.validateAccessList(list); err != nil {
+		return nil, err
+	}
+	current, err := a.ExportAccess()
+	if err != nil {
+		return nil, err
+	}
+	changes := diffAccessList(current, list)
+	if dryRun || changes.Count() == 0 {
+		return changes, nil
+	}
+	tx, err := a.db.Begin()
+	if err != nil {
+		return nil, err
 	}
 	defer tx.Rollback()
-	if _, err := tx.Exec(upsertUserAccessQuery, username, escapeUnderscore(topic), true, true, username, username); err != nil {
-		return err
+	for _, entry := range changes.AccessRemoved {
+		if _, err := tx.Exec(deleteUnownedTopicAccessQuery, entry.User, toSQLWildcard(entry.Topic)); err != nil {
+			return nil, err
+		}
 	}
-	if _, err := tx.Exec(upsertUserAccessQuery, Everyone, escapeUnderscore(topic), everyone.IsRead(), everyone.IsWrite(), username, username); err != nil {
-		return err
+	for _, entry := range changes.ReservationsRemoved {
+		if _, err := tx.Exec(deleteTopicAccessQuery, entry.User, entry.User, escapeUnderscore(entry.Topic)); err != nil {
+			return nil, err
+		} else if _, err := tx.Exec(deleteTopicAccessQuery, Everyone, Everyone, escapeUnderscore(entry.Topic)); err != nil {
+			return nil, err
+		}
 	}
-	return tx.Commit()
-}
-
-// RemoveReservations deletes the access control entries associated with the given username/topic, as
-// well as all entries with Everyone/topic. This is the counterpart for AddReservation.
-func (a *Manager) RemoveReservations(username string, topics ...string) error {
-	if !AllowedUsername(username) || username == Everyone || len(topics) == 0 {
-		return ErrInvalidArgument
+	for _, entry := range append(changes.AccessAdded, changes.AccessChanged...) {
+		permission, _ := ParsePermission(entry.Permission) // Validated above
+		if _, err := tx.Exec(upsertUserAccessQuery, entry.User, toSQLWildcard(entry.Topic), permission.IsRead(), permission.IsWrite(), permission.IsWriteNoCache(), permission.IsAttach(), permission.IsManage(), "", ""); err != nil {
+			return nil, err
+		}
 	}
-	for _, topic := range topics {
-		if !AllowedTopic(topic) {
-			return ErrInvalidArgument
+	for _, entry := range append(changes.ReservationsAdded, changes.ReservationsChanged...) {
+		everyone, _ := ParsePermission(entry.Everyone) // Validated above
+		if _, err := tx.Exec(upsertUserAccessQuery, entry.User, escapeUnderscore(entry.Topic), true, true, false, false, false, entry.User, entry.User); err != nil {
+			return nil, err
+		} else if _, err := tx.Exec(upsertUserAccessQuery, Everyone, escapeUnderscore(entry.Topic), everyone.IsRead(), everyone.IsWrite(), everyone.IsWriteNoCache(), everyone.IsAttach(), everyone.IsManage(), entry.User, entry.User); err != nil {
+			return nil, err
 		}
 	}
-	tx, err := a.db.Begin()
-	if err != nil {
-		return err
+	if err := tx.Commit(); err != nil {
+		return nil, err
 	}
-	defer tx.Rollback()
-	for _, topic := range topics {
-		if _, err := tx.Exec(deleteTopicAccessQuery, username, username, escapeUnderscore(topic)); err != nil {
+	return changes, nil
+}
+
+// validateAccessList checks that all users exist, and that all topics and permissions are valid. Since a reservation
+// implies an entry for the owner and for Everyone, these entries must not be defined again in the access section.
+func (a *Manager) validateAccessList(list *AccessList) error {
+	users := make(map[string]bool)
+	userExists := func(username string) error {
+		if _, ok := users[username]; ok {
+			return nil
+		}
+		if _, err := a.User(username); errors.Is(err, ErrUserNotFound) {
+			return fmt.Errorf("%w: %s", ErrUserNotFound, username)
+		} else if err != nil {
 			return err
 		}
-		if _, err := tx.Exec(deleteTopicAccessQuery, Everyone, Everyone, escapeUnderscore(topic)); err != nil {
+		users[username] = true
+		return nil
+	}
+	entries := make(map[string]bool)
+	for _, entry := range list.Reservations {
+		if !AllowedUsername(entry.User) || !AllowedTopic(entry.Topic) {
+			return fmt.Errorf("%w: invalid reservation %s/%s", ErrInvalidArgument, entry.User, entry.Topic)
+		} else if _, err := ParsePermission(entry.Everyone); err != nil {
+			return fmt.Errorf("%w: invalid permission %s for reservation %s/%s", ErrInvalidArgument, entry.Everyone, entry.User, entry.Topic)
+		} else if entries[accessKey(entry.User, entry.Topic)] || entries[accessKey(Everyone, entry.Topic)] {
+			return fmt.Errorf("%w: duplicate reservation for topic %s", ErrInvalidArgument, entry.Topic)
+		} else if err := userExists(entry.User); err != nil {
+			return err
+		}
+		entries[accessKey(entry.User, entry.Topic)] = true
+		entries[accessKey(Everyone, entry.Topic)] = true
+	}
+	for _, entry := range list.Access {
+		if (!AllowedUsername(entry.User) && entry.User != Everyone) || !AllowedTopicPattern(entry.Topic) {
+			return fmt.Errorf("%w: invalid access entry %s/%s", ErrInvalidArgument, entry.User, entry.Topic)
+		} else if _, err := ParsePermission(entry.Permission); err != nil {
+			return fmt.Errorf("%w: invalid permission %s for access entry %s/%s", ErrInvalidArgument, entry.Permission, entry.User, entry.Topic)
+		} else if entries[accessKey(entry.User, entry.Topic)] {
+			return fmt.Errorf("%w: duplicate access entry %s/%s, or conflicting reservation", ErrInvalidArgument, entry.User, entry.Topic)
+		} else if err := userExists(entry.User); err != nil {
 			return err
 		}
+		entries[accessKey(entry.User, entry.Topic)] = true
 	}
-	return tx.Commit()
+	return nil
+}
+
+// diffAccessList compares the current and the desired AccessList. Permissions are compared in their
+// normalized form, so that e.g. "rw" and "read-write" are considered equal.
+func diffAccessList(current, desired *AccessList) *AccessListChanges {
+	changes := &AccessListChanges{
+		AccessAdded:         make([]AccessEntry, 0),
+		AccessChanged:       make([]AccessEntry, 0),
+		AccessRemoved:       make([]AccessEntry, 0),
+		ReservationsAdded:   make([]ReservationEntry, 0),
+		ReservationsChanged: make([]ReservationEntry, 0),
+		ReservationsRemoved: make([]ReservationEntry, 0),
+	}
+	currentAccess := make(map[string]AccessEntry)
+	for _, entry := range current.Access {
+		currentAccess[accessKey(entry.User, entry.Topic)] = entry
+	}
+	for _, entry := range desired.Access {
+		permission, _ := ParsePermission(entry.Permission)
+		entry.Permission = permission.String()
+		key := accessKey(entry.User, entry.Topic)
+		if existing, ok := currentAccess[key]; !ok {
+			changes.AccessAdded = append(changes.AccessAdded, entry)
+		} else if existing.Permission != entry.Permission {
+			changes.AccessChanged = append(changes.AccessChanged, entry)
+		}
+		delete(currentAccess, key)
+	}
+	for _, entry := range current.Access {
+		if _, ok := currentAccess[accessKey(entry.User, entry.Topic)]; ok {
+			changes.AccessRemoved = append(changes.AccessRemoved, entry)
+		}
+	}
+	currentReservations := make(map[string]ReservationEntry)
+	for _, entry := range current.Reservations {
+		currentReservations[entry.Topic] = entry
+	}
+	for _, entry := range desired.Reservations {
+		everyone, _ := ParsePermission(entry.Everyone)
+		entry.Everyone = everyone.String()
+		if existing, ok := currentReservations[entry.Topic]; !ok {
+			changes.ReservationsAdded = append(changes.ReservationsAdded, entry)
+		} else if existing.User != entry.User {
+			changes.ReservationsRemoved = append(changes.ReservationsRemoved, existing)
+			changes.ReservationsAdded = append(changes.ReservationsAdded, entry)
+		} else if existing.Everyone != entry.Everyone {
+			changes.ReservationsChanged = append(changes.ReservationsChanged, entry)
+		}
+		delete(currentReservations, entry.Topic)
+	}
+	for _, entry := range current.Reservations {
+		if _, ok := currentReservations[entry.Topic]; ok {
+			changes.ReservationsRemoved = append(changes.ReservationsRemoved, entry)
+		}
+	}
+	return changes
+}
+
+func accessKey(username, topic string) string {
+	return username + "/" + topic
 }
 
 // DefaultAccess returns the default read/write access if no access control entry matches
@@ -1382,7 +3762,7 @@ func (a *Manager) AddTier(tier *Tier) error {
 	if tier.ID == "" {
 		tier.ID = util.RandomStringPrefix(tierIDPrefix, tierIDLength)
 	}
-	if _, err := a.db.Exec(insertTierQuery, tier.ID, tier.Code, tier.Name, tier.MessageLimit, int64(tier.MessageExpiryDuration.Seconds()), tier.EmailLimit, tier.CallLimit, tier.ReservationLimit, tier.AttachmentFileSizeLimit, tier.AttachmentTotalSizeLimit, int64(tier.AttachmentExpiryDuration.Seconds()), tier.AttachmentBandwidthLimit, nullString(tier.StripeMonthlyPriceID), nullString(tier.StripeYearlyPriceID)); err != nil {
+	if _, err := a.db.Exec(insertTierQuery, tier.ID, tier.Code, tier.Name, tier.MessageLimit, int64(tier.MessageExpiryDuration.Seconds()), tier.EmailLimit, tier.CallLimit, tier.ReservationLimit, tier.AttachmentFileSizeLimit, tier.AttachmentTotalSizeLimit, int64(tier.AttachmentExpiryDuration.Seconds()), tier.AttachmentBandwidthLimit, tier.SubscriptionLimit, int64(tier.SubscriptionDurationLimit.Seconds()), nullString(tier.StripeMonthlyPriceID), nullString(tier.StripeYearlyPriceID), nullString(tier.StripeMeteredMessagesPriceID), nullString(tier.StripeMeteredAttachmentPriceID)); err != nil {
 		return err
 	}
 	return nil
@@ -1390,7 +3770,7 @@ func (a *Manager) AddTier(tier *Tier) error {
 
 // UpdateTier updates a tier's properties in the database
 func (a *Manager) UpdateTier(tier *Tier) error {
-	if _, err := a.db.Exec(updateTierQuery, tier.Name, tier.MessageLimit, int64(tier.MessageExpiryDuration.Seconds()), tier.EmailLimit, tier.CallLimit, tier.ReservationLimit, tier.AttachmentFileSizeLimit, tier.AttachmentTotalSizeLimit, int64(tier.AttachmentExpiryDuration.Seconds()), tier.AttachmentBandwidthLimit, nullString(tier.StripeMonthlyPriceID), nullString(tier.StripeYearlyPriceID), tier.Code); err != nil {
+	if _, err := a.db.Exec(updateTierQuery, tier.Name, tier.MessageLimit, int64(tier.MessageExpiryDuration.Seconds()), tier.EmailLimit, tier.CallLimit, tier.ReservationLimit, tier.AttachmentFileSizeLimit, tier.AttachmentTotalSizeLimit, int64(tier.AttachmentExpiryDuration.Seconds()), tier.AttachmentBandwidthLimit, tier.SubscriptionLimit, int64(tier.SubscriptionDurationLimit.Seconds()), nullString(tier.StripeMonthlyPriceID), nullString(tier.StripeYearlyPriceID), nullString(tier.StripeMeteredMessagesPriceID), nullString(tier.StripeMeteredAttachmentPriceID), tier.Code); err != nil {
 		return err
 	}
 	return nil
@@ -1458,35 +3838,45 @@ func (a *Manager) TierByStripePrice(priceID string) (*Tier, error) {
 
 func (a *Manager) readTier(rows *sql.Rows) (*Tier, error) {
 	var id, code, name string
-	var stripeMonthlyPriceID, stripeYearlyPriceID sql.NullString
-	var messagesLimit, messagesExpiryDuration, emailsLimit, callsLimit, reservationsLimit, attachmentFileSizeLimit, attachmentTotalSizeLimit, attachmentExpiryDuration, attachmentBandwidthLimit sql.NullInt64
+	var stripeMonthlyPriceID, stripeYearlyPriceID, stripeMeteredMessagesPriceID, stripeMeteredAttachmentPriceID sql.NullString
+	var messagesLimit, messagesExpiryDuration, emailsLimit, callsLimit, reservationsLimit, attachmentFileSizeLimit, attachmentTotalSizeLimit, attachmentExpiryDuration, attachmentBandwidthLimit, subscriptionsLimit, subscriptionDurationLimit sql.NullInt64
 	if !rows.Next() {
 		return nil, ErrTierNotFound
 	}
-	if err := rows.Scan(&id, &code, &name, &messagesLimit, &messagesExpiryDuration, &emailsLimit, &callsLimit, &reservationsLimit, &attachmentFileSizeLimit, &attachmentTotalSizeLimit, &attachmentExpiryDuration, &attachmentBandwidthLimit, &stripeMonthlyPriceID, &stripeYearlyPriceID); err != nil {
+	if err := rows.Scan(&id, &code, &name, &messagesLimit, &messagesExpiryDuration, &emailsLimit, &callsLimit, &reservationsLimit, &attachmentFileSizeLimit, &attachmentTotalSizeLimit, &attachmentExpiryDuration, &attachmentBandwidthLimit, &subscriptionsLimit, &subscriptionDurationLimit, &stripeMonthlyPriceID, &stripeYearlyPriceID, &stripeMeteredMessagesPriceID, &stripeMeteredAttachmentPriceID); err != nil {
 		return nil, err
 	} else if err := rows.Err(); err != nil {
 		return nil, err
 	}
 	// When changed, note readUser() as well
 	return &Tier{
-		ID:                       id,
-		Code:                     code,
-		Name:                     name,
-		MessageLimit:             messagesLimit.Int64,
-		MessageExpiryDuration:    time.Duration(messagesExpiryDuration.Int64) * time.Second,
-		EmailLimit:               emailsLimit.Int64,
-		CallLimit:                callsLimit.Int64,
-		ReservationLimit:         reservationsLimit.Int64,
-		AttachmentFileSizeLimit:  attachmentFileSizeLimit.Int64,
-		AttachmentTotalSizeLimit: attachmentTotalSizeLimit.Int64,
-		AttachmentExpiryDuration: time.Duration(attachmentExpiryDuration.Int64) * time.Second,
-		AttachmentBandwidthLimit: attachmentBandwidthLimit.Int64,
-		StripeMonthlyPriceID:     stripeMonthlyPriceID.String, // May be empty
-		StripeYearlyPriceID:      stripeYearlyPriceID.String,  // May be empty
+		ID:                             id,
+		Code:                           code,
+		Name:                           name,
+		MessageLimit:                   messagesLimit.Int64,
+		MessageExpiryDuration:          time.Duration(messagesExpiryDuration.Int64) * time.Second,
+		EmailLimit:                     emailsLimit.Int64,
+		CallLimit:                      callsLimit.Int64,
+		ReservationLimit:               reservationsLimit.Int64,
+		AttachmentFileSizeLimit:        attachmentFileSizeLimit.Int64,
+		AttachmentTotalSizeLimit:       attachmentTotalSizeLimit.Int64,
+		AttachmentExpiryDuration:       time.Duration(attachmentExpiryDuration.Int64) * time.Second,
+		AttachmentBandwidthLimit:       attachmentBandwidthLimit.Int64,
+		SubscriptionLimit:              subscriptionsLimit.Int64,
+		SubscriptionDurationLimit:      time.Duration(subscriptionDurationLimit.Int64) * time.Second,
+		StripeMonthlyPriceID:           stripeMonthlyPriceID.String,           // May be empty
+		StripeYearlyPriceID:            stripeYearlyPriceID.String,            // May be empty
+		StripeMeteredMessagesPriceID:   stripeMeteredMessagesPriceID.String,   // May be empty
+		StripeMeteredAttachmentPriceID: stripeMeteredAttachmentPriceID.String, // May be empty
 	}, nil
 }
 
+// Ping checks if the database responds, by reading the schema version within the context's deadline
+func (a *Manager) Ping(ctx context.Context) error {
+	var schemaVersion int
+	return a.db.QueryRowContext(ctx, selectSchemaVersionQuery).Scan(&schemaVersion)
+}
+
 // Close closes the underlying database
 func (a *Manager) Close() error {
 	return a.db.Close()
@@ -1663,6 +4053,283 @@ func migrateFrom4(db *sql.DB) error {
 	return tx.Commit()
 }
 
+func migrateFrom5(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 5 to 6")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate5To6UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 6); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom6(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 6 to 7")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate6To7UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 7); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom7(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 7 to 8")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate7To8UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 8); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom8(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 8 to 9")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate8To9UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 9); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom9(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 9 to 10")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate9To10UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 10); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom10(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 10 to 11")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate10To11UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 11); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom11(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 11 to 12")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate11To12UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 12); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom12(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 12 to 13")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate12To13UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 13); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom13(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 13 to 14")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate13To14UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 14); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom14(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 14 to 15")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate14To15UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 15); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom15(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 15 to 16")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate15To16UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 16); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom16(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 16 to 17")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate16To17UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 17); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom17(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 17 to 18")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate17To18UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 18); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom18(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 18 to 19")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate18To19UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 19); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom19(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 19 to 20")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate19To20UpdateQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 20); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func migrateFrom20(db *sql.DB) error {
+	log.Tag(tag).Info("Migrating user database schema: from 20 to 21")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(migrate20To21CreateTablesQueries); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(updateSchemaVersion, 21); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// newPermissionFromColumns creates a Permission from the permission columns of the user_access table
+func newPermissionFromColumns(read, write, writeNoCache, attach, manage bool) Permission {
+	p := NewPermission(read, write)
+	if writeNoCache {
+		p |= PermissionWriteNoCache
+	}
+	if attach {
+		p |= PermissionAttach
+	}
+	if manage {
+		p |= PermissionManage
+	}
+	return p
+}
+
+// hashVerificationToken returns the hash of an email verification token, as stored in the database
+func hashVerificationToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
 func nullString(s string) sql.NullString {
 	if s == "" {
 		return sql.NullString{}
@@ -12,6 +12,7 @@ import (
 	"strings"
 	"testing"
 	"time"
+	"unicode/utf8"
 )
 
 const minBcryptTimingMillis = int64(50) // Ideally should be >100ms, but this should also run on a Raspberry Pi without massive resources
@@ -145,6 +146,368 @@ func TestManager_Access_Order_LengthWriteRead(t *testing.T) {
 	require.Nil(t, a.Authorize(ben, "test123", PermissionWrite))
 }
 
+func TestManager_Access_FineGrained(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+	require.Nil(t, a.AllowAccess("ben", "alerts", PermissionRead|PermissionWriteNoCache))
+	require.Nil(t, a.AllowAccess("ben", "files", PermissionWriteNoCache|PermissionAttach))
+	require.Nil(t, a.AllowAccess("ben", "moderated", PermissionReadWrite|PermissionManage))
+
+	ben, err := a.Authenticate("ben", "ben")
+	require.Nil(t, err)
+	require.Nil(t, a.Authorize(ben, "alerts", PermissionRead))
+	require.Nil(t, a.Authorize(ben, "alerts", PermissionWriteNoCache))
+	require.Equal(t, ErrUnauthorized, a.Authorize(ben, "alerts", PermissionWrite))
+	require.Equal(t, ErrUnauthorized, a.Authorize(ben, "alerts", PermissionAttach))
+	require.Equal(t, ErrUnauthorized, a.Authorize(ben, "alerts", PermissionManage))
+	require.Nil(t, a.Authorize(ben, "files", PermissionAttach))
+	require.Equal(t, ErrUnauthorized, a.Authorize(ben, "files", PermissionRead))
+	require.Nil(t, a.Authorize(ben, "moderated", PermissionAttach)) // Implied by write
+	require.Nil(t, a.Authorize(ben, "moderated", PermissionManage))
+
+	grants, err := a.Grants("ben")
+	require.Nil(t, err)
+	require.Equal(t, 3, len(grants))
+	require.Equal(t, "moderated", grants[0].TopicPattern)
+	require.Equal(t, PermissionReadWrite|PermissionManage, grants[0].Allow)
+
+	list, err := a.ExportAccess()
+	require.Nil(t, err)
+	permissions := make(map[string]string)
+	for _, entry := range list.Access {
+		permissions[entry.Topic] = entry.Permission
+	}
+	require.Equal(t, "read-only+write-no-cache", permissions["alerts"])
+	require.Equal(t, "write-no-cache+attach", permissions["files"])
+	require.Equal(t, "read-write+manage", permissions["moderated"])
+}
+
+func TestManager_ReservationManagers(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	require.Nil(t, a.AddUser("phil", "phil", RoleUser))
+	require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+	require.Nil(t, a.AddReservation("phil", "mytopic", PermissionRead))
+	require.Equal(t, ErrUserNotFound, a.AddReservationManager("phil", "mytopic", "nobody"))
+	require.Equal(t, ErrInvalidArgument, a.AddReservationManager("phil", "mytopic", "phil"))
+	require.Nil(t, a.AddReservationManager("phil", "mytopic", "ben"))
+
+	phil, err := a.Authenticate("phil", "phil")
+	require.Nil(t, err)
+	ben, err := a.Authenticate("ben", "ben")
+	require.Nil(t, err)
+	require.Nil(t, a.Authorize(phil, "mytopic", PermissionManage)) // Owners manage their topics implicitly
+	require.Nil(t, a.Authorize(ben, "mytopic", PermissionManage))
+	require.Nil(t, a.Authorize(ben, "mytopic", PermissionWrite))
+	require.Equal(t, ErrUnauthorized, a.Authorize(nil, "mytopic", PermissionManage))
+
+	managers, err := a.ReservationManagers("phil", "mytopic")
+	require.Nil(t, err)
+	require.Equal(t, []string{"ben"}, managers)
+	reservations, err := a.Reservations("ben")
+	require.Nil(t, err)
+	require.Equal(t, 0, len(reservations))
+
+	// Revoking and re-granting, then removing the reservation removes the manager as well
+	require.Nil(t, a.RemoveReservationManager("phil", "mytopic", "ben"))
+	require.Equal(t, ErrUnauthorized, a.Authorize(ben, "mytopic", PermissionManage))
+	require.Nil(t, a.AddReservationManager("phil", "mytopic", "ben"))
+	require.Nil(t, a.RemoveReservations("phil", "mytopic"))
+	require.Equal(t, ErrUnauthorized, a.Authorize(ben, "mytopic", PermissionManage))
+	managers, err = a.ReservationManagers("phil", "mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 0, len(managers))
+}
+
+func TestManager_ReservationManagers_AdminGrantedAccess(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	require.Nil(t, a.AddUser("phil", "phil", RoleUser))
+	require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+	require.Nil(t, a.AddReservation("phil", "mytopic", PermissionDenyAll))
+	require.Nil(t, a.AllowAccess("ben", "mytopic", PermissionRead)) // Granted by an admin, not the owner
+
+	// The admin-granted entry is not taken over by the reservation owner
+	require.Equal(t, ErrUserAccessExists, a.AddReservationManager("phil", "mytopic", "ben"))
+	require.Equal(t, ErrUserAccessExists, a.AddReservationMember("phil", "mytopic", "ben", PermissionReadWrite))
+	managers, err := a.ReservationManagers("phil", "mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 0, len(managers))
+
+	// Removing the manager or the reservation keeps the admin-granted access
+	require.Nil(t, a.RemoveReservationManager("phil", "mytopic", "ben"))
+	require.Nil(t, a.RemoveReservationMember("phil", "mytopic", "ben"))
+	require.Nil(t, a.RemoveReservations("phil", "mytopic"))
+	ben, err := a.Authenticate("ben", "ben")
+	require.Nil(t, err)
+	require.Nil(t, a.Authorize(ben, "mytopic", PermissionRead))
+	require.Equal(t, ErrUnauthorized, a.Authorize(ben, "mytopic", PermissionWrite))
+	require.Equal(t, ErrUnauthorized, a.Authorize(ben, "mytopic", PermissionManage))
+}
+
+func TestManager_ReservationMembers_Transfer(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	require.Nil(t, a.AddUser("phil", "phil", RoleUser))
+	require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+	require.Nil(t, a.AddUser("emma", "emma", RoleUser))
+	require.Nil(t, a.AddReservation("phil", "mytopic", PermissionDenyAll))
+	require.Nil(t, a.SetReservationSecret("phil", "mytopic", "s3cr3t"))
+	require.Equal(t, ErrUserNotFound, a.AddReservationMember("phil", "mytopic", "nobody", PermissionRead))
+	require.Equal(t, ErrInvalidArgument, a.AddReservationMember("phil", "mytopic", "ben", PermissionDenyAll))
+	require.Nil(t, a.AddReservationMember("phil", "mytopic", "ben", PermissionRead))
+	require.Nil(t, a.AddReservationManager("phil", "mytopic", "emma"))
+
+	ben, err := a.Authenticate("ben", "ben")
+	require.Nil(t, err)
+	require.Nil(t, a.Authorize(ben, "mytopic", PermissionRead))
+	require.Equal(t, ErrUnauthorized, a.Authorize(ben, "mytopic", PermissionWrite))
+
+	// Members and managers are listed separately
+	members, err := a.ReservationMembers("phil", "mytopic")
+	require.Nil(t, err)
+	require.Equal(t, []ReservationMember{{Username: "ben", Permission: PermissionRead}}, members)
+	managers, err := a.ReservationManagers("phil", "mytopic")
+	require.Nil(t, err)
+	require.Equal(t, []string{"emma"}, managers)
+
+	// Transfer to ben: his member entry is replaced, phil stays a read-write member
+	require.Equal(t, ErrReservationNotFound, a.TransferReservation("emma", "mytopic", "ben"))
+	require.Nil(t, a.TransferReservation("phil", "mytopic", "ben"))
+	hasReservation, err := a.HasReservation("ben", "mytopic")
+	require.Nil(t, err)
+	require.True(t, hasReservation)
+	hasReservation, err = a.HasReservation("phil", "mytopic")
+	require.Nil(t, err)
+	require.False(t, hasReservation)
+	require.Nil(t, a.Authorize(ben, "mytopic", PermissionWrite))
+	secret, err := a.ReservationSecret("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, "s3cr3t", secret)
+	members, err = a.ReservationMembers("ben", "mytopic")
+	require.Nil(t, err)
+	require.Equal(t, []ReservationMember{{Username: "phil", Permission: PermissionReadWrite}}, members)
+	managers, err = a.ReservationManagers("ben", "mytopic")
+	require.Nil(t, err)
+	require.Equal(t, []string{"emma"}, managers)
+
+	// Removing the member revokes access
+	require.Nil(t, a.RemoveReservationMember("ben", "mytopic", "phil"))
+	phil, err := a.Authenticate("phil", "phil")
+	require.Nil(t, err)
+	require.Equal(t, ErrUnauthorized, a.Authorize(phil, "mytopic", PermissionRead))
+}
+
+func TestManager_ReservationMembers_Transfer_AdminGrantedAccess(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	require.Nil(t, a.AddUser("phil", "phil", RoleUser))
+	require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+	require.Nil(t, a.AddReservation("phil", "mytopic", PermissionDenyAll))
+	require.Nil(t, a.AllowAccess("ben", "mytopic", PermissionRead)) // Granted by an admin, not a reservation member
+
+	// Transfer to ben: the admin-granted entry is replaced by the owner entry
+	require.Nil(t, a.TransferReservation("phil", "mytopic", "ben"))
+	hasReservation, err := a.HasReservation("ben", "mytopic")
+	require.Nil(t, err)
+	require.True(t, hasReservation)
+	ben, err := a.Authenticate("ben", "ben")
+	require.Nil(t, err)
+	require.Nil(t, a.Authorize(ben, "mytopic", PermissionWrite))
+	members, err := a.ReservationMembers("ben", "mytopic")
+	require.Nil(t, err)
+	require.Equal(t, []ReservationMember{{Username: "phil", Permission: PermissionReadWrite}}, members)
+}
+
+func TestManager_Orgs(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	require.Nil(t, a.AddTier(&Tier{
+		Code:             "team",
+		Name:             "Team",
+		ReservationLimit: 5,
+	}))
+	require.Nil(t, a.AddUser("phil", "phil", RoleUser))
+	require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+	require.Nil(t, a.AddUser("emma", "emma", RoleUser))
+	require.Nil(t, a.AddUser("lena", "lena", RoleUser))
+
+	// Create org with phil as owner, add ben as admin and emma as member
+	org, err := a.AddOrg("ACME", "phil")
+	require.Nil(t, err)
+	require.True(t, strings.HasPrefix(org.ID, "org_"))
+	require.Nil(t, a.AddOrgMember(org.ID, "ben", OrgRoleAdmin))
+	require.Nil(t, a.AddOrgMember(org.ID, "emma", OrgRoleMember))
+	require.Equal(t, ErrInvalidArgument, a.AddOrgMember(org.ID, "lena", OrgRole("boss")))
+	_, err = a.AddOrg("Other", "ben")
+	require.Equal(t, ErrOrgMemberExists, err)
+
+	members, err := a.OrgMembers(org.ID)
+	require.Nil(t, err)
+	require.Equal(t, []OrgMember{
+		{Username: "phil", Role: OrgRoleOwner},
+		{Username: "ben", Role: OrgRoleAdmin},
+		{Username: "emma", Role: OrgRoleMember},
+	}, members)
+
+	// Members without their own tier use the org tier
+	require.Nil(t, a.ChangeOrgTier(org.ID, "team"))
+	emma, err := a.User("emma")
+	require.Nil(t, err)
+	require.Equal(t, org.ID, emma.Org.ID)
+	require.Equal(t, "ACME", emma.Org.Name)
+	require.Equal(t, OrgRoleMember, emma.Org.Role)
+	require.Equal(t, "team", emma.Tier.Code)
+	lena, err := a.User("lena")
+	require.Nil(t, err)
+	require.Nil(t, lena.Org)
+	require.Nil(t, lena.Tier)
+
+	// Org topics: members have read-write access, admins can manage, everyone else has the everyone access
+	require.Nil(t, a.AddOrgTopic(org.ID, "acme_alerts", PermissionRead))
+	ben, err := a.User("ben")
+	require.Nil(t, err)
+	require.Nil(t, a.Authorize(emma, "acme_alerts", PermissionReadWrite))
+	require.Equal(t, ErrUnauthorized, a.Authorize(emma, "acme_alerts", PermissionManage))
+	require.Nil(t, a.Authorize(ben, "acme_alerts", PermissionManage))
+	require.Nil(t, a.Authorize(lena, "acme_alerts", PermissionRead))
+	require.Equal(t, ErrUnauthorized, a.Authorize(lena, "acme_alerts", PermissionWrite))
+	require.Equal(t, ErrUnauthorized, a.Authorize(nil, "acme_alerts", PermissionWrite))
+	decision, err := a.Explain(emma, "acme_alerts", PermissionWrite)
+	require.Nil(t, err)
+	require.Equal(t, DecisionOrg, decision.Reason)
+
+	// Org topics cannot be reserved by users, and reserved topics cannot be added to orgs
+	require.Equal(t, errTopicOwnedByOthers, a.AllowReservation("lena", "acme_alerts"))
+	require.Nil(t, a.AddReservation("lena", "lenas_topic", PermissionDenyAll))
+	require.Equal(t, errTopicOwnedByOthers, a.AddOrgTopic(org.ID, "lenas_topic", PermissionDenyAll))
+	other, err := a.AddOrg("Other", "lena")
+	require.Nil(t, err)
+	require.Equal(t, errTopicOwnedByOthers, a.AddOrgTopic(other.ID, "acme_alerts", PermissionReadWrite))
+
+	topics, err := a.OrgTopics(org.ID)
+	require.Nil(t, err)
+	require.Equal(t, []OrgTopic{{Topic: "acme_alerts", Everyone: PermissionRead}}, topics)
+	count, err := a.OrgTopicsCount(org.ID)
+	require.Nil(t, err)
+	require.Equal(t, int64(1), count)
+
+	// Billing
+	require.Nil(t, a.ChangeOrgBilling(org.ID, &Billing{
+		StripeCustomerID:     "acct_123",
+		StripeSubscriptionID: "sub_123",
+	}))
+	org, err = a.OrgByStripeCustomer("acct_123")
+	require.Nil(t, err)
+	require.Equal(t, "sub_123", org.Billing.StripeSubscriptionID)
+	require.Equal(t, "team", org.Tier.Code)
+
+	// Removing members and the org
+	require.Nil(t, a.RemoveOrgMember(org.ID, "emma"))
+	emma, err = a.User("emma")
+	require.Nil(t, err)
+	require.Nil(t, emma.Org)
+	require.Nil(t, emma.Tier)
+	require.Equal(t, ErrUnauthorized, a.Authorize(emma, "acme_alerts", PermissionWrite))
+	require.Nil(t, a.RemoveOrg(org.ID))
+	_, err = a.Org(org.ID)
+	require.Equal(t, ErrOrgNotFound, err)
+	require.Nil(t, a.AllowReservation("lena", "acme_alerts"))
+}
+
+func TestManager_OrgInvites(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	require.Nil(t, a.AddUser("phil", "phil", RoleUser))
+	require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+	require.Nil(t, a.AddUser("lena", "lena", RoleUser))
+	org, err := a.AddOrg("ACME", "phil")
+	require.Nil(t, err)
+	other, err := a.AddOrg("Other", "lena")
+	require.Nil(t, err)
+
+	// Invites do not make the user a member
+	require.Equal(t, ErrUserNotFound, a.AddOrgInvite(org.ID, "nobody", OrgRoleMember))
+	require.Equal(t, ErrInvalidArgument, a.AddOrgInvite(org.ID, "ben", OrgRole("boss")))
+	require.Nil(t, a.AddOrgInvite(org.ID, "ben", OrgRoleMember))
+	require.Nil(t, a.AddOrgInvite(org.ID, "ben", OrgRoleAdmin)) // Updates the role
+	require.Nil(t, a.AddOrgInvite(org.ID, "lena", OrgRoleMember))
+	ben, err := a.User("ben")
+	require.Nil(t, err)
+	require.Nil(t, ben.Org)
+	invites, err := a.OrgInvites("ben")
+	require.Nil(t, err)
+	require.Equal(t, []OrgInvite{{ID: org.ID, Name: "ACME", Role: OrgRoleAdmin}}, invites)
+
+	// Accepting adds the member and removes the invite, members of other orgs cannot accept
+	require.Equal(t, ErrOrgInviteNotFound, a.AcceptOrgInvite(other.ID, "ben"))
+	require.Nil(t, a.AcceptOrgInvite(org.ID, "ben"))
+	require.Equal(t, ErrOrgInviteNotFound, a.AcceptOrgInvite(org.ID, "ben"))
+	ben, err = a.User("ben")
+	require.Nil(t, err)
+	require.Equal(t, org.ID, ben.Org.ID)
+	require.Equal(t, OrgRoleAdmin, ben.Org.Role)
+	invites, err = a.OrgInvites("ben")
+	require.Nil(t, err)
+	require.Equal(t, 0, len(invites))
+	require.Equal(t, ErrOrgMemberExists, a.AcceptOrgInvite(org.ID, "lena"))
+
+	// Declining, and revoking via RemoveOrgMember
+	require.Nil(t, a.RemoveOrgInvite(org.ID, "lena"))
+	require.Equal(t, ErrOrgInviteNotFound, a.RemoveOrgInvite(org.ID, "lena"))
+	require.Nil(t, a.AddOrgInvite(org.ID, "lena", OrgRoleMember))
+	require.Nil(t, a.RemoveOrgMember(org.ID, "lena"))
+	invites, err = a.OrgInvites("lena")
+	require.Nil(t, err)
+	require.Equal(t, 0, len(invites))
+}
+
+func TestManager_ReservationSecret(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	require.Nil(t, a.AddUser("phil", "phil", RoleUser))
+	require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+	require.Nil(t, a.AddReservation("phil", "mytopic", PermissionDenyAll))
+	require.Nil(t, a.AddReservationManager("phil", "mytopic", "ben"))
+
+	secret, err := a.ReservationSecret("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, "", secret)
+	require.Nil(t, a.SetReservationSecret("phil", "mytopic", "s3cr3t"))
+	secret, err = a.ReservationSecret("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, "s3cr3t", secret)
+
+	// Only the owner can set the secret
+	require.Equal(t, ErrReservationNotFound, a.SetReservationSecret("ben", "mytopic", "other"))
+	require.Equal(t, ErrReservationNotFound, a.SetReservationSecret("phil", "othertopic", "other"))
+
+	require.Nil(t, a.SetReservationSecret("phil", "mytopic", ""))
+	secret, err = a.ReservationSecret("mytopic")
+	require.Nil(t, err)
+	require.Equal(t, "", secret)
+}
+
+func TestManager_AuthorizeTopicPattern(t *testing.T) {
+	a := newTestManager(t, PermissionReadWrite)
+	require.Nil(t, a.AddUser("phil", "phil", RoleAdmin))
+	require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+	require.Nil(t, a.AllowAccess("ben", "host-*", PermissionRead))
+	require.Nil(t, a.AllowAccess("ben", "host-secret", PermissionDenyAll))
+	require.Nil(t, a.AllowAccess(Everyone, "public_*", PermissionRead))
+	phil, err := a.User("phil")
+	require.Nil(t, err)
+	ben, err := a.User("ben")
+	require.Nil(t, err)
+
+	require.Nil(t, a.AuthorizeTopicPattern(phil, "*", PermissionRead))
+	require.Nil(t, a.AuthorizeTopicPattern(ben, "host-*", PermissionRead))
+	require.Nil(t, a.AuthorizeTopicPattern(ben, "host-web-*", PermissionRead))
+	require.Nil(t, a.AuthorizeTopicPattern(ben, "public_*", PermissionRead))
+	require.Nil(t, a.AuthorizeTopicPattern(nil, "public_*", PermissionRead))
+	require.Equal(t, ErrUnauthorized, a.AuthorizeTopicPattern(ben, "host-*", PermissionWrite))
+	require.Equal(t, ErrUnauthorized, a.AuthorizeTopicPattern(ben, "h*", PermissionRead))
+	require.Equal(t, ErrUnauthorized, a.AuthorizeTopicPattern(ben, "*", PermissionRead))        // Default access does not apply
+	require.Equal(t, ErrUnauthorized, a.AuthorizeTopicPattern(nil, "publicX*", PermissionRead)) // Underscore is not a wildcard
+	require.Nil(t, a.Authorize(ben, "other", PermissionRead))
+
+	// Topics excluded by more specific entries must be checked separately
+	require.Equal(t, ErrUnauthorized, a.Authorize(ben, "host-secret", PermissionRead))
+}
+
 func TestManager_AddUser_Invalid(t *testing.T) {
 	a := newTestManager(t, PermissionDenyAll)
 	require.Equal(t, ErrInvalidArgument, a.AddUser("  invalid  ", "pass", RoleAdmin))
@@ -194,7 +557,7 @@ func TestManager_MarkUserRemoved_RemoveDeletedUsers(t *testing.T) {
 	require.Nil(t, err)
 	require.False(t, u.Deleted)
 
-	token, err := a.CreateToken(u.ID, "", time.Now().Add(time.Hour), netip.IPv4Unspecified())
+	token, err := a.CreateToken(u.ID, "", TokenTypeCLI, time.Now().Add(time.Hour), netip.IPv4Unspecified())
 	require.Nil(t, err)
 
 	u, err = a.Authenticate("user", "pass")
@@ -241,7 +604,7 @@ func TestManager_CreateToken_Only_Lower(t *testing.T) {
 	u, err := a.User("user")
 	require.Nil(t, err)
 
-	token, err := a.CreateToken(u.ID, "", time.Now().Add(time.Hour), netip.IPv4Unspecified())
+	token, err := a.CreateToken(u.ID, "", TokenTypeCLI, time.Now().Add(time.Hour), netip.IPv4Unspecified())
 	require.Nil(t, err)
 	require.Equal(t, token.Value, strings.ToLower(token.Value))
 }
@@ -376,6 +739,143 @@ func TestManager_ChangeRole(t *testing.T) {
 	require.Equal(t, 0, len(benGrants))
 }
 
+func TestManager_ExportImportAccess(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	require.Nil(t, a.AddUser("phil", "phil", RoleUser))
+	require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+	require.Nil(t, a.AllowAccess("phil", "alerts_*", PermissionRead))
+	require.Nil(t, a.AllowAccess(Everyone, "announcements", PermissionRead))
+	require.Nil(t, a.AddReservation("ben", "ben_topic", PermissionDenyAll))
+
+	list, err := a.ExportAccess()
+	require.Nil(t, err)
+	require.Equal(t, []AccessEntry{
+		{User: "*", Topic: "announcements", Permission: "read-only"},
+		{User: "phil", Topic: "alerts_*", Permission: "read-only"},
+	}, list.Access)
+	require.Equal(t, []ReservationEntry{
+		{User: "ben", Topic: "ben_topic", Everyone: "deny-all"},
+	}, list.Reservations)
+
+	// Re-importing the exported list is a no-op
+	changes, err := a.ImportAccess(list, false)
+	require.Nil(t, err)
+	require.Equal(t, 0, changes.Count())
+
+	// Apply changes: add, change and remove access entries and reservations
+	changes, err = a.ImportAccess(&AccessList{
+		Access: []AccessEntry{
+			{User: "phil", Topic: "alerts_*", Permission: "rw"},
+			{User: "phil", Topic: "mytopic", Permission: "ro"},
+			{User: "ben", Topic: "ben_topic", Permission: "ro"}, // Was a reservation
+		},
+		Reservations: []ReservationEntry{
+			{User: "phil", Topic: "phil_topic", Everyone: "read"},
+		},
+	}, true) // Dry run
+	require.Nil(t, err)
+	require.Equal(t, []AccessEntry{{User: "phil", Topic: "mytopic", Permission: "read-only"}, {User: "ben", Topic: "ben_topic", Permission: "read-only"}}, changes.AccessAdded)
+	require.Equal(t, []AccessEntry{{User: "phil", Topic: "alerts_*", Permission: "read-write"}}, changes.AccessChanged)
+	require.Equal(t, []AccessEntry{{User: "*", Topic: "announcements", Permission: "read-only"}}, changes.AccessRemoved)
+	require.Equal(t, []ReservationEntry{{User: "phil", Topic: "phil_topic", Everyone: "read-only"}}, changes.ReservationsAdded)
+	require.Equal(t, []ReservationEntry{{User: "ben", Topic: "ben_topic", Everyone: "deny-all"}}, changes.ReservationsRemoved)
+	require.Equal(t, 6, changes.Count())
+
+	list2, err := a.ExportAccess()
+	require.Nil(t, err)
+	require.Equal(t, list, list2) // Dry run did not change anything
+
+	changes, err = a.ImportAccess(&AccessList{
+		Access: []AccessEntry{
+			{User: "phil", Topic: "alerts_*", Permission: "rw"},
+			{User: "phil", Topic: "mytopic", Permission: "ro"},
+			{User: "ben", Topic: "ben_topic", Permission: "ro"},
+		},
+		Reservations: []ReservationEntry{
+			{User: "phil", Topic: "phil_topic", Everyone: "read"},
+		},
+	}, false)
+	require.Nil(t, err)
+	require.Equal(t, 6, changes.Count())
+
+	list, err = a.ExportAccess()
+	require.Nil(t, err)
+	require.Equal(t, []AccessEntry{
+		{User: "ben", Topic: "ben_topic", Permission: "read-only"},
+		{User: "phil", Topic: "alerts_*", Permission: "read-write"},
+		{User: "phil", Topic: "mytopic", Permission: "read-only"},
+	}, list.Access)
+	require.Equal(t, []ReservationEntry{
+		{User: "phil", Topic: "phil_topic", Everyone: "read-only"},
+	}, list.Reservations)
+	require.Nil(t, a.Authorize(nil, "phil_topic", PermissionRead))
+	require.Equal(t, ErrUnauthorized, a.Authorize(nil, "announcements", PermissionRead))
+
+	// Invalid lists are rejected
+	_, err = a.ImportAccess(&AccessList{Access: []AccessEntry{{User: "nobody", Topic: "mytopic", Permission: "rw"}}}, false)
+	require.ErrorIs(t, err, ErrUserNotFound)
+	_, err = a.ImportAccess(&AccessList{Access: []AccessEntry{{User: "phil", Topic: "mytopic", Permission: "invalid"}}}, false)
+	require.ErrorIs(t, err, ErrInvalidArgument)
+	_, err = a.ImportAccess(&AccessList{
+		Access:       []AccessEntry{{User: "*", Topic: "phil_topic", Permission: "rw"}},
+		Reservations: []ReservationEntry{{User: "phil", Topic: "phil_topic", Everyone: "deny"}},
+	}, false)
+	require.ErrorIs(t, err, ErrInvalidArgument)
+}
+
+func TestManager_Explain(t *testing.T) {
+	a := newTestManager(t, PermissionRead)
+	require.Nil(t, a.AddUser("phil", "phil", RoleAdmin))
+	require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+	require.Nil(t, a.AddUser("john", "john", RoleUser))
+	require.Nil(t, a.AllowAccess("ben", "prod-*", PermissionRead))
+	require.Nil(t, a.AllowAccess(Everyone, "public", PermissionReadWrite))
+	require.Nil(t, a.AddReservation("john", "johns-topic", PermissionRead))
+	phil, err := a.User("phil")
+	require.Nil(t, err)
+	ben, err := a.User("ben")
+	require.Nil(t, err)
+	john, err := a.User("john")
+	require.Nil(t, err)
+
+	decision, err := a.Explain(phil, "prod-alerts", PermissionWrite)
+	require.Nil(t, err)
+	require.Equal(t, &Decision{Allowed: true, Reason: DecisionAdmin}, decision)
+
+	decision, err = a.Explain(ben, "prod-alerts", PermissionWrite)
+	require.Nil(t, err)
+	require.False(t, decision.Allowed)
+	require.Equal(t, DecisionAccessEntry, decision.Reason)
+	require.Equal(t, &MatchedEntry{Username: "ben", TopicPattern: "prod-*", Permission: PermissionRead}, decision.Entry)
+
+	decision, err = a.Explain(nil, "public", PermissionWrite)
+	require.Nil(t, err)
+	require.True(t, decision.Allowed)
+	require.Equal(t, Everyone, decision.Entry.Username)
+
+	decision, err = a.Explain(john, "johns-topic", PermissionWrite)
+	require.Nil(t, err)
+	require.True(t, decision.Allowed)
+	require.Equal(t, DecisionReservation, decision.Reason)
+	require.Equal(t, &MatchedEntry{Username: "john", TopicPattern: "johns-topic", Permission: PermissionReadWrite | PermissionManage, Owner: "john"}, decision.Entry)
+
+	decision, err = a.Explain(ben, "johns-topic", PermissionWrite)
+	require.Nil(t, err)
+	require.False(t, decision.Allowed)
+	require.Equal(t, DecisionReservation, decision.Reason)
+	require.Equal(t, Everyone, decision.Entry.Username)
+	require.Equal(t, "john", decision.Entry.Owner)
+
+	decision, err = a.Explain(ben, "other", PermissionRead)
+	require.Nil(t, err)
+	require.Equal(t, &Decision{Allowed: true, Reason: DecisionDefaultAccess}, decision)
+
+	ben.TokenScope = &TokenScope{Permission: PermissionWrite}
+	decision, err = a.Explain(ben, "other", PermissionRead)
+	require.Nil(t, err)
+	require.Equal(t, &Decision{Allowed: false, Reason: DecisionTokenScope}, decision)
+}
+
 func TestManager_Reservations(t *testing.T) {
 	a := newTestManager(t, PermissionDenyAll)
 	require.Nil(t, a.AddUser("phil", "phil", RoleUser))
@@ -513,7 +1013,7 @@ func TestManager_Token_Valid(t *testing.T) {
 	require.Nil(t, err)
 
 	// Create token for user
-	token, err := a.CreateToken(u.ID, "some label", time.Now().Add(72*time.Hour), netip.IPv4Unspecified())
+	token, err := a.CreateToken(u.ID, "some label", TokenTypeCLI, time.Now().Add(72*time.Hour), netip.IPv4Unspecified())
 	require.Nil(t, err)
 	require.NotEmpty(t, token.Value)
 	require.Equal(t, "some label", token.Label)
@@ -528,11 +1028,14 @@ func TestManager_Token_Valid(t *testing.T) {
 	require.Nil(t, err)
 	require.Equal(t, token.Value, token2.Value)
 	require.Equal(t, "some label", token2.Label)
+	require.Equal(t, TokenTypeCLI, token2.Type)
+	require.True(t, token2.Created.Unix() > 0)
 
 	tokens, err := a.Tokens(u.ID)
 	require.Nil(t, err)
 	require.Equal(t, 1, len(tokens))
 	require.Equal(t, "some label", tokens[0].Label)
+	require.Equal(t, TokenTypeCLI, tokens[0].Type)
 
 	tokens, err = a.Tokens("u_notauser")
 	require.Nil(t, err)
@@ -576,12 +1079,12 @@ func TestManager_Token_Expire(t *testing.T) {
 	require.Nil(t, err)
 
 	// Create tokens for user
-	token1, err := a.CreateToken(u.ID, "", time.Now().Add(72*time.Hour), netip.IPv4Unspecified())
+	token1, err := a.CreateToken(u.ID, "", TokenTypeCLI, time.Now().Add(72*time.Hour), netip.IPv4Unspecified())
 	require.Nil(t, err)
 	require.NotEmpty(t, token1.Value)
 	require.True(t, time.Now().Add(71*time.Hour).Unix() < token1.Expires.Unix())
 
-	token2, err := a.CreateToken(u.ID, "", time.Now().Add(72*time.Hour), netip.IPv4Unspecified())
+	token2, err := a.CreateToken(u.ID, "", TokenTypeCLI, time.Now().Add(72*time.Hour), netip.IPv4Unspecified())
 	require.Nil(t, err)
 	require.NotEmpty(t, token2.Value)
 	require.NotEqual(t, token1.Value, token2.Value)
@@ -628,7 +1131,7 @@ func TestManager_Token_Extend(t *testing.T) {
 	require.Equal(t, errNoTokenProvided, err)
 
 	// Create token for user
-	token, err := a.CreateToken(u.ID, "", time.Now().Add(72*time.Hour), netip.IPv4Unspecified())
+	token, err := a.CreateToken(u.ID, "", TokenTypeCLI, time.Now().Add(72*time.Hour), netip.IPv4Unspecified())
 	require.Nil(t, err)
 	require.NotEmpty(t, token.Value)
 
@@ -643,6 +1146,597 @@ func TestManager_Token_Extend(t *testing.T) {
 	require.True(t, time.Now().Add(99*time.Hour).Unix() < extendedToken.Expires.Unix())
 }
 
+func TestManager_Token_Rotate(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+	u, err := a.User("ben")
+	require.Nil(t, err)
+
+	// Rotate with grace period: old token stays valid, new token inherits label, type, scope and lifetime
+	token, err := a.CreateScopedToken(u.ID, "backups", TokenTypeIntegration, time.Now().Add(30*24*time.Hour), time.Unix(0, 0), netip.IPv4Unspecified(), "", &TokenScope{
+		Permission: PermissionWrite,
+		Topics:     []string{"backups"},
+	})
+	require.Nil(t, err)
+	newToken, oldToken, err := a.RotateToken(u.ID, token.Value, time.Hour, netip.MustParseAddr("1.2.3.4"), "curl/8.0")
+	require.Nil(t, err)
+	require.NotEqual(t, token.Value, newToken.Value)
+	require.Equal(t, "backups", newToken.Label)
+	require.Equal(t, TokenTypeIntegration, newToken.Type)
+	require.Equal(t, PermissionWrite, newToken.Scope.Permission)
+	require.Equal(t, "curl/8.0", newToken.CreatedUserAgent)
+	require.True(t, newToken.Expires.After(time.Now().Add(29*24*time.Hour)))
+	require.Equal(t, token.Value, oldToken.Value)
+	require.True(t, oldToken.Expires.Before(time.Now().Add(time.Hour+time.Minute)))
+
+	_, err = a.AuthenticateToken(token.Value)
+	require.Nil(t, err)
+	_, err = a.AuthenticateToken(newToken.Value)
+	require.Nil(t, err)
+
+	// Rotate without grace period: old token is removed
+	newToken2, _, err := a.RotateToken(u.ID, newToken.Value, 0, netip.IPv4Unspecified(), "")
+	require.Nil(t, err)
+	_, err = a.AuthenticateToken(newToken.Value)
+	require.Equal(t, ErrUnauthenticated, err)
+	_, err = a.AuthenticateToken(newToken2.Value)
+	require.Nil(t, err)
+
+	// Tokens that never expire stay that way
+	token, err = a.CreateToken(u.ID, "", TokenTypeCLI, time.Unix(0, 0), netip.IPv4Unspecified())
+	require.Nil(t, err)
+	newToken, _, err = a.RotateToken(u.ID, token.Value, time.Hour, netip.IPv4Unspecified(), "")
+	require.Nil(t, err)
+	require.Equal(t, int64(0), newToken.Expires.Unix())
+
+	_, _, err = a.RotateToken(u.ID, "tk_doesnotexist", time.Hour, netip.IPv4Unspecified(), "")
+	require.Equal(t, ErrTokenNotFound, err)
+}
+
+func TestManager_Token_UserAgentTruncated(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+	u, err := a.User("ben")
+	require.Nil(t, err)
+
+	// 255 ASCII bytes, followed by a 3-byte character that would be cut in half at 256 bytes
+	userAgent := strings.Repeat("a", tokenUserAgentMaxLength-1) + "€€"
+	token, err := a.CreateScopedToken(u.ID, "", TokenTypeIntegration, time.Unix(0, 0), time.Unix(0, 0), netip.IPv4Unspecified(), userAgent, nil)
+	require.Nil(t, err)
+	require.Equal(t, strings.Repeat("a", tokenUserAgentMaxLength-1), token.CreatedUserAgent)
+	require.True(t, utf8.ValidString(token.CreatedUserAgent))
+
+	token, err = a.Token(u.ID, token.Value)
+	require.Nil(t, err)
+	require.Equal(t, strings.Repeat("a", tokenUserAgentMaxLength-1), token.CreatedUserAgent)
+}
+
+func TestManager_Token_Rotate_HardExpires(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+	u, err := a.User("ben")
+	require.Nil(t, err)
+
+	// Rotating a token does not extend it beyond its hard expiry
+	hardExpires := time.Now().Add(2 * time.Hour)
+	token, err := a.CreateScopedToken(u.ID, "", TokenTypeIntegration, time.Now().Add(time.Hour), hardExpires, netip.IPv4Unspecified(), "", nil)
+	require.Nil(t, err)
+	newToken, _, err := a.RotateToken(u.ID, token.Value, 0, netip.IPv4Unspecified(), "")
+	require.Nil(t, err)
+	require.Equal(t, hardExpires.Unix(), newToken.HardExpires.Unix())
+	require.False(t, newToken.Expires.After(hardExpires))
+
+	// Tokens that never expire, but have a hard expiry, are also capped
+	token, err = a.CreateScopedToken(u.ID, "", TokenTypeIntegration, time.Unix(0, 0), hardExpires, netip.IPv4Unspecified(), "", nil)
+	require.Nil(t, err)
+	newToken, _, err = a.RotateToken(u.ID, token.Value, 0, netip.IPv4Unspecified(), "")
+	require.Nil(t, err)
+	require.Equal(t, hardExpires.Unix(), newToken.Expires.Unix())
+
+	// The hard expiry survives a further rotation and cannot be extended
+	newToken, _, err = a.RotateToken(u.ID, newToken.Value, 0, netip.IPv4Unspecified(), "")
+	require.Nil(t, err)
+	require.Equal(t, hardExpires.Unix(), newToken.HardExpires.Unix())
+	newToken, err = a.ChangeToken(u.ID, newToken.Value, nil, util.Time(time.Now().Add(100*time.Hour)))
+	require.Nil(t, err)
+	require.Equal(t, hardExpires.Unix(), newToken.Expires.Unix())
+}
+
+func TestManager_Token_Scope(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	require.Nil(t, a.AddUser("phil", "phil", RoleAdmin))
+	require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+	require.Nil(t, a.AllowAccess("ben", "mytopic", PermissionReadWrite))
+	require.Nil(t, a.AllowAccess("ben", "alerts_*", PermissionReadWrite))
+
+	// Publish-only token, limited to alerts_* topics
+	ben, err := a.User("ben")
+	require.Nil(t, err)
+	token, err := a.CreateScopedToken(ben.ID, "ci", TokenTypeIntegration, time.Now().Add(time.Hour), time.Unix(0, 0), netip.IPv4Unspecified(), "", &TokenScope{
+		Permission: PermissionWrite,
+		Topics:     []string{"alerts_*"},
+	})
+	require.Nil(t, err)
+	require.Equal(t, PermissionWrite, token.Scope.Permission)
+
+	u, err := a.AuthenticateToken(token.Value)
+	require.Nil(t, err)
+	require.NotNil(t, u.TokenScope)
+	require.Equal(t, []string{"alerts_*"}, u.TokenScope.Topics)
+	require.Nil(t, a.Authorize(u, "alerts_disk", PermissionWrite))
+	require.Equal(t, ErrUnauthorized, a.Authorize(u, "alerts_disk", PermissionRead))
+	require.Equal(t, ErrUnauthorized, a.Authorize(u, "mytopic", PermissionWrite))
+
+	// Subscribe-only token for an admin still restricts the admin
+	phil, err := a.User("phil")
+	require.Nil(t, err)
+	token, err = a.CreateScopedToken(phil.ID, "", TokenTypeIntegration, time.Now().Add(time.Hour), time.Unix(0, 0), netip.IPv4Unspecified(), "", &TokenScope{
+		Permission: PermissionRead,
+	})
+	require.Nil(t, err)
+	u, err = a.AuthenticateToken(token.Value)
+	require.Nil(t, err)
+	require.Nil(t, a.Authorize(u, "anything", PermissionRead))
+	require.Equal(t, ErrUnauthorized, a.Authorize(u, "anything", PermissionWrite))
+
+	// Unscoped tokens are not restricted
+	token, err = a.CreateToken(ben.ID, "", TokenTypeCLI, time.Now().Add(time.Hour), netip.IPv4Unspecified())
+	require.Nil(t, err)
+	u, err = a.AuthenticateToken(token.Value)
+	require.Nil(t, err)
+	require.Nil(t, u.TokenScope)
+	require.Nil(t, a.Authorize(u, "mytopic", PermissionWrite))
+
+	// Invalid topic patterns are rejected
+	_, err = a.CreateScopedToken(ben.ID, "", TokenTypeIntegration, time.Now().Add(time.Hour), time.Unix(0, 0), netip.IPv4Unspecified(), "", &TokenScope{
+		Permission: PermissionRead,
+		Topics:     []string{"not/valid"},
+	})
+	require.Equal(t, ErrInvalidArgument, err)
+}
+
+func TestManager_Token_HardExpires(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+	u, err := a.User("ben")
+	require.Nil(t, err)
+
+	// Expiry is capped to the hard expiry
+	hardExpires := time.Now().Add(2 * time.Hour)
+	token, err := a.CreateScopedToken(u.ID, "", TokenTypeIntegration, time.Unix(0, 0), hardExpires, netip.IPv4Unspecified(), "", nil)
+	require.Nil(t, err)
+	require.Equal(t, hardExpires.Unix(), token.Expires.Unix())
+
+	// Token cannot be extended beyond the hard expiry
+	token, err = a.ChangeToken(u.ID, token.Value, nil, util.Time(time.Now().Add(100*time.Hour)))
+	require.Nil(t, err)
+	require.Equal(t, hardExpires.Unix(), token.Expires.Unix())
+	require.Equal(t, hardExpires.Unix(), token.HardExpires.Unix())
+
+	// But it can be shortened
+	shorter := time.Now().Add(time.Hour)
+	token, err = a.ChangeToken(u.ID, token.Value, nil, util.Time(shorter))
+	require.Nil(t, err)
+	require.Equal(t, shorter.Unix(), token.Expires.Unix())
+
+	// Hard-expired tokens are rejected and removed
+	_, err = a.db.Exec("UPDATE user_token SET expires = 0, hard_expires = ? WHERE token = ?", time.Now().Add(-time.Minute).Unix(), token.Value)
+	require.Nil(t, err)
+	_, err = a.AuthenticateToken(token.Value)
+	require.Equal(t, ErrUnauthenticated, err)
+	require.Nil(t, a.RemoveExpiredTokens())
+	_, err = a.Token(u.ID, token.Value)
+	require.Equal(t, ErrTokenNotFound, err)
+}
+
+func TestManager_ChangeUsername(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+	require.Nil(t, a.AddUser("phil", "phil", RoleUser))
+	require.Nil(t, a.AllowAccess("ben", "mytopic", PermissionRead))
+	require.Nil(t, a.AddReservation("ben", "mytopic2", PermissionDenyAll))
+	u, err := a.User("ben")
+	require.Nil(t, err)
+	token, err := a.CreateToken(u.ID, "", TokenTypeCLI, time.Unix(0, 0), netip.IPv4Unspecified())
+	require.Nil(t, err)
+
+	// Rename, everything carries over
+	require.Nil(t, a.ChangeUsername("ben", "benjamin"))
+	_, err = a.User("ben")
+	require.Equal(t, ErrUserNotFound, err)
+	renamed, err := a.Authenticate("benjamin", "ben")
+	require.Nil(t, err)
+	require.Equal(t, u.ID, renamed.ID)
+	require.Nil(t, a.Authorize(renamed, "mytopic", PermissionRead))
+	require.Nil(t, a.Authorize(renamed, "mytopic2", PermissionWrite))
+	reservations, err := a.Reservations("benjamin")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(reservations))
+	require.Equal(t, "mytopic2", reservations[0].Topic)
+	u, err = a.AuthenticateToken(token.Value)
+	require.Nil(t, err)
+	require.Equal(t, "benjamin", u.Name)
+
+	// Failures
+	require.Equal(t, ErrUserExists, a.ChangeUsername("benjamin", "phil"))
+	require.Equal(t, ErrUserNotFound, a.ChangeUsername("ben", "ben2"))
+	require.Equal(t, ErrInvalidArgument, a.ChangeUsername("benjamin", "not valid"))
+	require.Equal(t, ErrInvalidArgument, a.ChangeUsername("benjamin", Everyone))
+}
+
+func TestManager_SuspendUser(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+	require.Nil(t, a.AddUser("phil", "phil", RoleUser))
+
+	// Suspend indefinitely, user can still authenticate
+	require.Nil(t, a.SuspendUser("ben", "spam", time.Unix(0, 0)))
+	u, err := a.Authenticate("ben", "ben")
+	require.Nil(t, err)
+	require.True(t, u.IsSuspended())
+	require.Equal(t, "spam", u.Suspension.Reason)
+	require.Equal(t, int64(0), u.Suspension.Until.Unix())
+	require.InDelta(t, time.Now().Unix(), u.Suspension.Since.Unix(), 2)
+
+	// Temporary suspension, lifted automatically when expired
+	require.Nil(t, a.SuspendUser("phil", "abuse", time.Now().Add(time.Hour)))
+	u, err = a.User("phil")
+	require.Nil(t, err)
+	require.True(t, u.IsSuspended())
+	_, err = a.db.Exec("UPDATE user SET suspended_until = ? WHERE user = 'phil'", time.Now().Add(-time.Minute).Unix())
+	require.Nil(t, err)
+	u, err = a.User("phil")
+	require.Nil(t, err)
+	require.False(t, u.IsSuspended()) // Expired, even before the reinstatement ran
+	require.Nil(t, a.ReinstateExpiredSuspensions())
+	u, err = a.User("phil")
+	require.Nil(t, err)
+	require.Nil(t, u.Suspension)
+
+	// Indefinite suspensions are not lifted automatically, only manually
+	u, err = a.User("ben")
+	require.Nil(t, err)
+	require.True(t, u.IsSuspended())
+	require.Nil(t, a.ReinstateUser("ben"))
+	u, err = a.User("ben")
+	require.Nil(t, err)
+	require.False(t, u.IsSuspended())
+	require.Nil(t, u.Suspension)
+
+	// Unknown users
+	require.Equal(t, ErrUserNotFound, a.SuspendUser("unknown", "", time.Unix(0, 0)))
+	require.Equal(t, ErrUserNotFound, a.ReinstateUser("unknown"))
+}
+
+func TestManager_WebhookEvents(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+
+	// First delivery is new, second one is a duplicate
+	added, err := a.AddWebhookEvent("stripe", "evt_1234", "customer.subscription.updated")
+	require.Nil(t, err)
+	require.True(t, added)
+	added, err = a.AddWebhookEvent("stripe", "evt_1234", "customer.subscription.updated")
+	require.Nil(t, err)
+	require.False(t, added)
+
+	// Same ID from another provider is a different event
+	added, err = a.AddWebhookEvent("other", "evt_1234", "something")
+	require.Nil(t, err)
+	require.True(t, added)
+
+	// Removed events can be processed again
+	require.Nil(t, a.RemoveWebhookEvent("stripe", "evt_1234"))
+	added, err = a.AddWebhookEvent("stripe", "evt_1234", "customer.subscription.updated")
+	require.Nil(t, err)
+	require.True(t, added)
+
+	// Old events are pruned
+	_, err = a.db.Exec("UPDATE webhook_event SET received = ?", time.Now().Add(-webhookEventKeepDuration-time.Hour).Unix())
+	require.Nil(t, err)
+	require.Nil(t, a.RemoveExpiredWebhookEvents())
+	added, err = a.AddWebhookEvent("other", "evt_1234", "something")
+	require.Nil(t, err)
+	require.True(t, added)
+}
+
+func TestManager_EmailVerification(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	require.Nil(t, a.AddUser("phil", "phil", RoleUser))
+	require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+	phil, err := a.User("phil")
+	require.Nil(t, err)
+	ben, err := a.User("ben")
+	require.Nil(t, err)
+
+	pending, err := a.EmailVerificationPending(phil.ID)
+	require.Nil(t, err)
+	require.False(t, pending)
+
+	token, err := a.AddEmailVerification(phil.ID, "phil@example.com", time.Now().Add(time.Hour))
+	require.Nil(t, err)
+	require.True(t, strings.HasPrefix(token, "vt_"))
+	_, err = a.AddEmailVerification(ben.ID, "ben@example.com", time.Now().Add(-time.Minute))
+	require.Nil(t, err)
+	pending, err = a.EmailVerificationPending(phil.ID)
+	require.Nil(t, err)
+	require.True(t, pending)
+
+	// Verify, token can only be used once
+	_, err = a.VerifyEmail("vt_invalid")
+	require.Equal(t, ErrVerificationNotFound, err)
+	userID, err := a.VerifyEmail(token)
+	require.Nil(t, err)
+	require.Equal(t, phil.ID, userID)
+	_, err = a.VerifyEmail(token)
+	require.Equal(t, ErrVerificationNotFound, err)
+	pending, err = a.EmailVerificationPending(phil.ID)
+	require.Nil(t, err)
+	require.False(t, pending)
+
+	// Unverified users are removed after the verification expired
+	require.Nil(t, a.RemoveUnverifiedUsers())
+	_, err = a.User("ben")
+	require.Equal(t, ErrUserNotFound, err)
+	_, err = a.User("phil")
+	require.Nil(t, err)
+}
+
+func TestManager_Invites(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	require.Nil(t, a.AddTier(&Tier{ID: "ti_123", Code: "pro"}))
+
+	_, err := a.AddInvite("does-not-exist", 0, time.Unix(0, 0))
+	require.Equal(t, ErrTierNotFound, err)
+	_, err = a.AddInvite("", -1, time.Unix(0, 0))
+	require.Equal(t, ErrInvalidArgument, err)
+
+	limited, err := a.AddInvite("pro", 2, time.Unix(0, 0))
+	require.Nil(t, err)
+	require.True(t, strings.HasPrefix(limited.Code, "iv_"))
+	unlimited, err := a.AddInvite("", 0, time.Now().Add(time.Hour))
+	require.Nil(t, err)
+	expired, err := a.AddInvite("", 0, time.Now().Add(-time.Minute))
+	require.Nil(t, err)
+
+	invites, err := a.Invites()
+	require.Nil(t, err)
+	require.Len(t, invites, 2)
+
+	// Limited invite can be used twice
+	for i := 1; i <= 2; i++ {
+		invite, err := a.UseInvite(limited.Code)
+		require.Nil(t, err)
+		require.Equal(t, "pro", invite.Tier)
+		require.Equal(t, i, invite.Uses)
+	}
+	_, err = a.UseInvite(limited.Code)
+	require.Equal(t, ErrInviteNotFound, err)
+	_, err = a.UseInvite(expired.Code)
+	require.Equal(t, ErrInviteNotFound, err)
+	_, err = a.UseInvite("iv_doesnotexist")
+	require.Equal(t, ErrInviteNotFound, err)
+	for i := 0; i < 3; i++ {
+		_, err := a.UseInvite(unlimited.Code)
+		require.Nil(t, err)
+	}
+
+	// Remove
+	require.Nil(t, a.RemoveInvite(unlimited.Code))
+	require.Equal(t, ErrInviteNotFound, a.RemoveInvite(unlimited.Code))
+	require.Nil(t, a.RemoveExpiredInvites())
+	require.Equal(t, ErrInviteNotFound, a.RemoveInvite(expired.Code))
+	invites, err = a.Invites()
+	require.Nil(t, err)
+	require.Len(t, invites, 1)
+	require.Equal(t, limited.Code, invites[0].Code)
+	require.Equal(t, 2, invites[0].Uses)
+}
+
+func TestManager_AddUserWithInvite(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	require.Nil(t, a.AddTier(&Tier{ID: "ti_123", Code: "pro"}))
+	invite, err := a.AddInvite("pro", 1, time.Unix(0, 0))
+	require.Nil(t, err)
+
+	// Invalid invite: user is not created
+	_, err = a.AddUserWithInvite("phil", "phil", RoleUser, "iv_doesnotexist")
+	require.Equal(t, ErrInviteNotFound, err)
+	_, err = a.User("phil")
+	require.Equal(t, ErrUserNotFound, err)
+
+	// Invalid username: invite is not used
+	_, err = a.AddUserWithInvite("not valid!", "phil", RoleUser, invite.Code)
+	require.Equal(t, ErrInvalidArgument, err)
+	invites, err := a.Invites()
+	require.Nil(t, err)
+	require.Equal(t, 0, invites[0].Uses)
+
+	// Valid invite: user is created and assigned to the invite's tier
+	used, err := a.AddUserWithInvite("phil", "phil", RoleUser, invite.Code)
+	require.Nil(t, err)
+	require.Equal(t, 1, used.Uses)
+	phil, err := a.User("phil")
+	require.Nil(t, err)
+	require.Equal(t, "pro", phil.Tier.Code)
+	_, err = a.AddUserWithInvite("ben", "ben", RoleUser, invite.Code)
+	require.Equal(t, ErrInviteNotFound, err)
+
+	// Returned invites can be used again
+	require.Nil(t, a.ReturnInvite(invite.Code))
+	_, err = a.AddUserWithInvite("ben", "ben", RoleUser, invite.Code)
+	require.Nil(t, err)
+}
+
+func TestManager_Usage(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	require.Nil(t, a.AddUser("phil", "phil", RoleUser))
+	phil, err := a.User("phil")
+	require.Nil(t, err)
+
+	a.EnqueueUsage(phil.ID, &Usage{Topic: "mytopic", Messages: 1})
+	a.EnqueueUsage(phil.ID, &Usage{Topic: "mytopic", Messages: 1, AttachmentBytes: 1000})
+	a.EnqueueUsage(phil.ID, &Usage{Topic: "mytopic", Emails: 1})
+	a.EnqueueUsage(phil.ID, &Usage{Topic: "another", Messages: 1})
+	a.EnqueueUsage("u_doesnotexist", &Usage{Topic: "mytopic", Messages: 1}) // Ignored
+	require.Nil(t, a.writeUsageQueue())
+	a.EnqueueUsage(phil.ID, &Usage{Topic: "mytopic", Messages: 1})
+	require.Nil(t, a.writeUsageQueue())
+
+	_, err = a.Usage(phil.ID, time.Now().Add(-time.Hour), time.Minute)
+	require.Equal(t, ErrInvalidArgument, err)
+
+	usage, err := a.Usage(phil.ID, time.Now().Add(-24*time.Hour), 24*time.Hour)
+	require.Nil(t, err)
+	require.Len(t, usage, 2)
+	require.Equal(t, "another", usage[0].Topic)
+	require.Equal(t, int64(1), usage[0].Messages)
+	require.Equal(t, "mytopic", usage[1].Topic)
+	require.Equal(t, int64(3), usage[1].Messages)
+	require.Equal(t, int64(1), usage[1].Emails)
+	require.Equal(t, int64(1000), usage[1].AttachmentBytes)
+	require.Equal(t, time.Now().Truncate(24*time.Hour).Unix(), usage[1].Time.Unix())
+
+	usage, err = a.Usage(phil.ID, time.Now().Add(time.Hour), 24*time.Hour)
+	require.Nil(t, err)
+	require.Empty(t, usage)
+
+	total, err := a.UsageTotal(phil.ID, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))
+	require.Nil(t, err)
+	require.Equal(t, int64(4), total.Messages)
+	require.Equal(t, int64(1), total.Emails)
+	require.Equal(t, int64(1000), total.AttachmentBytes)
+
+	total, err = a.UsageTotal(phil.ID, time.Now().Add(time.Hour), time.Now().Add(2*time.Hour))
+	require.Nil(t, err)
+	require.Equal(t, int64(0), total.Messages)
+
+	// Usage is removed with the user
+	require.Nil(t, a.RemoveUser("phil"))
+	usage, err = a.Usage(phil.ID, time.Unix(0, 0), time.Hour)
+	require.Nil(t, err)
+	require.Empty(t, usage)
+}
+
+func TestManager_TOTP(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	require.Nil(t, a.AddUser("phil", "phil", RoleUser))
+	u, err := a.User("phil")
+	require.Nil(t, err)
+
+	// Not enabled
+	enabled, err := a.TOTPEnabled(u.ID)
+	require.Nil(t, err)
+	require.False(t, enabled)
+	require.Equal(t, ErrTOTPNotEnabled, a.VerifyTOTP(u.ID, "123456"))
+
+	// Pending enrollment does not enable two-factor authentication
+	secret, err := a.BeginTOTPEnrollment(u.ID)
+	require.Nil(t, err)
+	enabled, err = a.TOTPEnabled(u.ID)
+	require.Nil(t, err)
+	require.False(t, enabled)
+	_, err = a.EnableTOTP(u.ID, "000000")
+	require.Equal(t, ErrTOTPInvalidCode, err)
+
+	// Enable with a valid code, and get recovery codes
+	code, err := totpCode(secret, totpStep(time.Now().Add(-totpPeriod)))
+	require.Nil(t, err)
+	recoveryCodes, err := a.EnableTOTP(u.ID, code)
+	require.Nil(t, err)
+	require.Equal(t, totpRecoveryCodeCount, len(recoveryCodes))
+	enabled, err = a.TOTPEnabled(u.ID)
+	require.Nil(t, err)
+	require.True(t, enabled)
+	_, err = a.BeginTOTPEnrollment(u.ID)
+	require.Equal(t, ErrTOTPAlreadyEnabled, err)
+
+	// The enrollment code cannot be reused, the next one works once
+	require.Equal(t, ErrTOTPInvalidCode, a.VerifyTOTP(u.ID, code))
+	code, err = totpCode(secret, totpStep(time.Now()))
+	require.Nil(t, err)
+	require.Nil(t, a.VerifyTOTP(u.ID, code))
+	require.Equal(t, ErrTOTPInvalidCode, a.VerifyTOTP(u.ID, code))
+
+	// Recovery codes work once
+	require.Nil(t, a.VerifyTOTP(u.ID, recoveryCodes[0]))
+	require.Equal(t, ErrTOTPInvalidCode, a.VerifyTOTP(u.ID, recoveryCodes[0]))
+	left, err := a.TOTPRecoveryCodesLeft(u.ID)
+	require.Nil(t, err)
+	require.Equal(t, totpRecoveryCodeCount-1, left)
+
+	// For Basic auth, codes can be reused while they are valid, but not verified again afterwards
+	code, err = totpCode(secret, totpStep(time.Now().Add(totpPeriod)))
+	require.Nil(t, err)
+	require.Nil(t, a.AuthenticateTOTP(u.ID, code))
+	require.Nil(t, a.AuthenticateTOTP(u.ID, code))
+	require.Equal(t, ErrTOTPInvalidCode, a.VerifyTOTP(u.ID, code))
+	require.Equal(t, ErrTOTPInvalidCode, a.AuthenticateTOTP(u.ID, "000000"))
+	require.Nil(t, a.AuthenticateTOTP(u.ID, recoveryCodes[1]))
+	require.Equal(t, ErrTOTPInvalidCode, a.AuthenticateTOTP(u.ID, recoveryCodes[1]))
+
+	// Disable
+	require.Nil(t, a.DisableTOTP(u.ID))
+	enabled, err = a.TOTPEnabled(u.ID)
+	require.Nil(t, err)
+	require.False(t, enabled)
+	left, err = a.TOTPRecoveryCodesLeft(u.ID)
+	require.Nil(t, err)
+	require.Equal(t, 0, left)
+}
+
+func TestManager_SigningKeys(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+	_, err := a.AddSigningKey("", "secret")
+	require.Equal(t, ErrInvalidArgument, err)
+
+	// Keys are listed newest first
+	key1, err := a.AddSigningKey("stripe-webhook", "secret1")
+	require.Nil(t, err)
+	require.True(t, strings.HasPrefix(key1.ID, "sk_"))
+	_, err = a.db.Exec("UPDATE signing_key SET created = created - 10 WHERE id = ?", key1.ID)
+	require.Nil(t, err)
+	key2, err := a.AddSigningKey("stripe-webhook", "secret2")
+	require.Nil(t, err)
+	_, err = a.AddSigningKey("other", "secret3")
+	require.Nil(t, err)
+	keys, err := a.SigningKeys("stripe-webhook")
+	require.Nil(t, err)
+	require.Equal(t, 2, len(keys))
+	require.Equal(t, key2.ID, keys[0].ID)
+	require.Equal(t, "secret2", keys[0].Secret)
+	require.Equal(t, int64(0), keys[0].Expires.Unix())
+	require.Equal(t, key1.ID, keys[1].ID)
+	keys, err = a.SigningKeys("")
+	require.Nil(t, err)
+	require.Equal(t, 3, len(keys))
+
+	// Retired keys stay valid during the grace period
+	require.Nil(t, a.RetireSigningKey(key1.ID, time.Hour))
+	keys, err = a.SigningKeys("stripe-webhook")
+	require.Nil(t, err)
+	require.Equal(t, 2, len(keys))
+	require.True(t, keys[1].Expires.After(time.Now()))
+
+	// Expired keys are no longer valid, and are pruned
+	_, err = a.db.Exec("UPDATE signing_key SET expires = ? WHERE id = ?", time.Now().Add(-time.Minute).Unix(), key1.ID)
+	require.Nil(t, err)
+	keys, err = a.SigningKeys("stripe-webhook")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(keys))
+	require.Equal(t, ErrSigningKeyNotFound, a.RetireSigningKey(key1.ID, time.Hour))
+	require.Nil(t, a.RemoveExpiredSigningKeys())
+	var count int
+	require.Nil(t, a.db.QueryRow("SELECT COUNT(*) FROM signing_key").Scan(&count))
+	require.Equal(t, 2, count)
+
+	// Retiring without grace period removes the key
+	require.Nil(t, a.RetireSigningKey(key2.ID, 0))
+	require.Equal(t, ErrSigningKeyNotFound, a.RetireSigningKey(key2.ID, 0))
+	keys, err = a.SigningKeys("stripe-webhook")
+	require.Nil(t, err)
+	require.Equal(t, 0, len(keys))
+}
+
 func TestManager_Token_MaxCount_AutoDelete(t *testing.T) {
 	// Tests that tokens are automatically deleted when the maximum number of tokens is reached
 
@@ -658,12 +1752,12 @@ func TestManager_Token_MaxCount_AutoDelete(t *testing.T) {
 
 	// Create 2 tokens for phil
 	philTokens := make([]string, 0)
-	token, err := a.CreateToken(phil.ID, "", time.Now().Add(72*time.Hour), netip.IPv4Unspecified())
+	token, err := a.CreateToken(phil.ID, "", TokenTypeCLI, time.Now().Add(72*time.Hour), netip.IPv4Unspecified())
 	require.Nil(t, err)
 	require.NotEmpty(t, token.Value)
 	philTokens = append(philTokens, token.Value)
 
-	token, err = a.CreateToken(phil.ID, "", time.Unix(0, 0), netip.IPv4Unspecified())
+	token, err = a.CreateToken(phil.ID, "", TokenTypeCLI, time.Unix(0, 0), netip.IPv4Unspecified())
 	require.Nil(t, err)
 	require.NotEmpty(t, token.Value)
 	philTokens = append(philTokens, token.Value)
@@ -672,7 +1766,7 @@ func TestManager_Token_MaxCount_AutoDelete(t *testing.T) {
 	baseTime := time.Now().Add(24 * time.Hour)
 	benTokens := make([]string, 0)
 	for i := 0; i < 22; i++ { //
-		token, err := a.CreateToken(ben.ID, "", time.Now().Add(72*time.Hour), netip.IPv4Unspecified())
+		token, err := a.CreateToken(ben.ID, "", TokenTypeCLI, time.Now().Add(72*time.Hour), netip.IPv4Unspecified())
 		require.Nil(t, err)
 		require.NotEmpty(t, token.Value)
 		benTokens = append(benTokens, token.Value)
@@ -771,7 +1865,7 @@ func TestManager_EnqueueTokenUpdate(t *testing.T) {
 	u, err := a.User("ben")
 	require.Nil(t, err)
 
-	token, err := a.CreateToken(u.ID, "", time.Now().Add(time.Hour), netip.IPv4Unspecified())
+	token, err := a.CreateToken(u.ID, "", TokenTypeCLI, time.Now().Add(time.Hour), netip.IPv4Unspecified())
 	require.Nil(t, err)
 
 	// Queue token update
@@ -854,17 +1948,20 @@ func TestManager_Tier_Create_Update_List_Delete(t *testing.T) {
 		StripeMonthlyPriceID:     "price_1",
 	}))
 	require.Nil(t, a.AddTier(&Tier{
-		Code:                     "pro",
-		Name:                     "Pro",
-		MessageLimit:             123,
-		MessageExpiryDuration:    86400 * time.Second,
-		EmailLimit:               32,
-		ReservationLimit:         2,
-		AttachmentFileSizeLimit:  1231231,
-		AttachmentTotalSizeLimit: 123123,
-		AttachmentExpiryDuration: 10800 * time.Second,
-		AttachmentBandwidthLimit: 21474836480,
-		StripeMonthlyPriceID:     "price_2",
+		Code:                         "pro",
+		Name:                         "Pro",
+		MessageLimit:                 123,
+		MessageExpiryDuration:        86400 * time.Second,
+		EmailLimit:                   32,
+		ReservationLimit:             2,
+		AttachmentFileSizeLimit:      1231231,
+		AttachmentTotalSizeLimit:     123123,
+		AttachmentExpiryDuration:     10800 * time.Second,
+		AttachmentBandwidthLimit:     21474836480,
+		SubscriptionLimit:            50,
+		SubscriptionDurationLimit:    6 * time.Hour,
+		StripeMonthlyPriceID:         "price_2",
+		StripeMeteredMessagesPriceID: "price_messages",
 	}))
 	require.Nil(t, a.AddUser("phil", "phil", RoleUser))
 	require.Nil(t, a.ChangeTier("phil", "pro"))
@@ -890,10 +1987,16 @@ func TestManager_Tier_Create_Update_List_Delete(t *testing.T) {
 	require.Equal(t, int64(123123), ti.AttachmentTotalSizeLimit)
 	require.Equal(t, 10800*time.Second, ti.AttachmentExpiryDuration)
 	require.Equal(t, int64(21474836480), ti.AttachmentBandwidthLimit)
+	require.Equal(t, int64(50), ti.SubscriptionLimit)
+	require.Equal(t, 6*time.Hour, ti.SubscriptionDurationLimit)
 	require.Equal(t, "price_2", ti.StripeMonthlyPriceID)
+	require.Equal(t, "price_messages", ti.StripeMeteredMessagesPriceID)
+	require.Equal(t, "", ti.StripeMeteredAttachmentPriceID)
 
 	// Update tier
 	ti.EmailLimit = 999999
+	ti.SubscriptionLimit = 100
+	ti.StripeMeteredAttachmentPriceID = "price_attachment"
 	require.Nil(t, a.UpdateTier(ti))
 
 	// List tiers
@@ -925,7 +2028,11 @@ func TestManager_Tier_Create_Update_List_Delete(t *testing.T) {
 	require.Equal(t, int64(123123), ti.AttachmentTotalSizeLimit)
 	require.Equal(t, 10800*time.Second, ti.AttachmentExpiryDuration)
 	require.Equal(t, int64(21474836480), ti.AttachmentBandwidthLimit)
+	require.Equal(t, int64(100), ti.SubscriptionLimit) // Updated!
+	require.Equal(t, 6*time.Hour, ti.SubscriptionDurationLimit)
 	require.Equal(t, "price_2", ti.StripeMonthlyPriceID)
+	require.Equal(t, "price_messages", ti.StripeMeteredMessagesPriceID)
+	require.Equal(t, "price_attachment", ti.StripeMeteredAttachmentPriceID) // Updated!
 
 	ti, err = a.TierByStripePrice("price_1")
 	require.Nil(t, err)
@@ -1004,6 +2111,47 @@ func TestManager_Tier_Change_And_Reset(t *testing.T) {
 	require.Nil(t, a.ResetTier("phil"))
 }
 
+func TestManager_Tier_Grant_And_Expire(t *testing.T) {
+	a := newTestManager(t, PermissionDenyAll)
+
+	require.Nil(t, a.AddTier(&Tier{
+		Code: "pro",
+		Name: "Pro",
+	}))
+	require.Nil(t, a.AddUser("phil", "phil", RoleUser))
+	require.Nil(t, a.AddUser("ben", "ben", RoleUser))
+	require.Nil(t, a.AddUser("lena", "lena", RoleUser))
+	require.Equal(t, ErrTierNotFound, a.GrantTier("phil", "does-not-exist", time.Now().Add(time.Hour)))
+
+	// Grant tier to phil (expired) and ben (not expired); lena has a regular tier
+	require.Nil(t, a.GrantTier("phil", "pro", time.Now().Add(-time.Minute)))
+	require.Nil(t, a.GrantTier("ben", "pro", time.Now().Add(time.Hour)))
+	require.Nil(t, a.ChangeTier("lena", "pro"))
+
+	phil, err := a.User("phil")
+	require.Nil(t, err)
+	require.Equal(t, "pro", phil.Tier.Code)
+	require.True(t, phil.TierExpires.Unix() > 0)
+	lena, err := a.User("lena")
+	require.Nil(t, err)
+	require.Equal(t, int64(0), lena.TierExpires.Unix())
+
+	usernames, err := a.UsersWithExpiredTier()
+	require.Nil(t, err)
+	require.Equal(t, []string{"phil"}, usernames)
+
+	// Changing or resetting the tier removes the expiry
+	require.Nil(t, a.ChangeTier("phil", "pro"))
+	usernames, err = a.UsersWithExpiredTier()
+	require.Nil(t, err)
+	require.Empty(t, usernames)
+	require.Nil(t, a.ResetTier("ben"))
+	ben, err := a.User("ben")
+	require.Nil(t, err)
+	require.Nil(t, ben.Tier)
+	require.Equal(t, int64(0), ben.TierExpires.Unix())
+}
+
 func TestUser_PhoneNumberAddListRemove(t *testing.T) {
 	a := newTestManager(t, PermissionDenyAll)
 
@@ -0,0 +1,116 @@
+package user
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Two-factor authentication uses time-based one-time passwords (TOTP, RFC 6238) with the parameters that all
+// common authenticator apps support: HMAC-SHA1, 6 digits and a period of 30 seconds. Codes of the previous and
+// the next period are accepted as well, to allow for clock drift. Each code can only be used once.
+//
+// Recovery codes can be used instead of a TOTP code if the authenticator is lost. They are random, so they are
+// stored as plain SHA-256 hashes, and are deleted once they were used.
+
+const (
+	totpSecretLength       = 20 // Bytes, i.e. 160 bits, as recommended by RFC 4226
+	totpDigits             = 6
+	totpPeriod             = 30 * time.Second
+	totpSkew               = 1 // Number of periods before/after the current one that are accepted
+	totpRecoveryCodeCount  = 10
+	totpRecoveryCodeLength = 10 // Characters, formatted as xxxxx-xxxxx
+	totpRecoveryCodeChars  = "abcdefghijkmnpqrstuvwxyz23456789"
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTPURI returns the otpauth:// URI for the given secret, which authenticator apps can import (usually
+// as a QR code)
+func TOTPURI(issuer, username, secret string) string {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprintf("%d", totpDigits))
+	params.Set("period", fmt.Sprintf("%d", int(totpPeriod.Seconds())))
+	label := url.PathEscape(issuer + ":" + username)
+	return fmt.Sprintf("otpauth://totp/%s?%s", label, params.Encode())
+}
+
+// generateTOTPSecret returns a new random TOTP secret, base32-encoded without padding
+func generateTOTPSecret() (string, error) {
+	b := make([]byte, totpSecretLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// totpCode returns the TOTP code of the given secret for the given period (time step)
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000), nil
+}
+
+// totpStep returns the TOTP period (time step) of the given time
+func totpStep(t time.Time) int64 {
+	return t.Unix() / int64(totpPeriod.Seconds())
+}
+
+// matchTOTPCode checks the code against the codes of the current, previous and next period, and returns the
+// matching period, or false if the code does not match, or if its period is not after lastStep (i.e. it was used)
+func matchTOTPCode(secret, code string, lastStep int64, now time.Time) (int64, bool) {
+	current := totpStep(now)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		expected, err := totpCode(secret, step)
+		if err != nil {
+			return 0, false
+		} else if step > lastStep && subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// generateRecoveryCodes returns new random recovery codes, formatted as xxxxx-xxxxx
+func generateRecoveryCodes() ([]string, error) {
+	codes := make([]string, totpRecoveryCodeCount)
+	b := make([]byte, totpRecoveryCodeLength)
+	for i := range codes {
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		for j := range b {
+			b[j] = totpRecoveryCodeChars[int(b[j])%len(totpRecoveryCodeChars)]
+		}
+		codes[i] = fmt.Sprintf("%s-%s", b[:totpRecoveryCodeLength/2], b[totpRecoveryCodeLength/2:])
+	}
+	return codes, nil
+}
+
+// hashRecoveryCode returns the hash of a recovery code, as stored in the database. Dashes and case are ignored.
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
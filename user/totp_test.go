@@ -0,0 +1,64 @@
+package user
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTOTPCode_RFC6238(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890")) // SHA-1 test vectors, last 6 digits
+	for unix, expected := range map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1111111111: "050471",
+		1234567890: "005924",
+		2000000000: "279037",
+	} {
+		code, err := totpCode(secret, totpStep(time.Unix(unix, 0)))
+		require.Nil(t, err)
+		require.Equal(t, expected, code, "time %d", unix)
+	}
+}
+
+func TestMatchTOTPCode(t *testing.T) {
+	secret, err := generateTOTPSecret()
+	require.Nil(t, err)
+	now := time.Now()
+	current := totpStep(now)
+	previous, _ := totpCode(secret, current-1)
+	old, _ := totpCode(secret, current-2)
+
+	step, ok := matchTOTPCode(secret, previous, 0, now)
+	require.True(t, ok)
+	require.Equal(t, current-1, step)
+	_, ok = matchTOTPCode(secret, previous, current-1, now) // Already used
+	require.False(t, ok)
+	_, ok = matchTOTPCode(secret, old, 0, now) // Outside the skew
+	require.False(t, ok)
+	_, ok = matchTOTPCode(secret, "12345", 0, now)
+	require.False(t, ok)
+}
+
+func TestTOTPURI(t *testing.T) {
+	uri := TOTPURI("ntfy.example.com", "phil", "JBSWY3DPEHPK3PXP")
+	u, err := url.Parse(uri)
+	require.Nil(t, err)
+	require.Equal(t, "otpauth", u.Scheme)
+	require.Equal(t, "totp", u.Host)
+	require.Equal(t, "/ntfy.example.com:phil", u.Path)
+	require.Equal(t, "JBSWY3DPEHPK3PXP", u.Query().Get("secret"))
+	require.Equal(t, "ntfy.example.com", u.Query().Get("issuer"))
+}
+
+func TestGenerateRecoveryCodes(t *testing.T) {
+	codes, err := generateRecoveryCodes()
+	require.Nil(t, err)
+	require.Equal(t, totpRecoveryCodeCount, len(codes))
+	require.Regexp(t, `^[a-z2-9]{5}-[a-z2-9]{5}$`, codes[0])
+	require.NotEqual(t, codes[0], codes[1])
+	require.Equal(t, hashRecoveryCode(codes[0]), hashRecoveryCode(" "+strings.ToUpper(strings.ReplaceAll(codes[0], "-", ""))))
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/stripe/stripe-go/v74"
 	"heckel.io/ntfy/v2/log"
 	"net/netip"
+	"path"
 	"regexp"
 	"strings"
 	"time"
@@ -12,17 +13,21 @@ import (
 
 // User is a struct that represents a user
 type User struct {
-	ID        string
-	Name      string
-	Hash      string // password hash (bcrypt)
-	Token     string // Only set if token was used to log in
-	Role      Role
-	Prefs     *Prefs
-	Tier      *Tier
-	Stats     *Stats
-	Billing   *Billing
-	SyncTopic string
-	Deleted   bool
+	ID          string
+	Name        string
+	Hash        string      // password hash (bcrypt)
+	Token       string      // Only set if token was used to log in
+	TokenScope  *TokenScope // Only set if a scoped token was used to log in
+	Role        Role
+	Prefs       *Prefs
+	Tier        *Tier
+	TierExpires time.Time // Tier is removed automatically at this time, see Manager.GrantTier; zero Unix time means never
+	Stats       *Stats
+	Billing     *Billing
+	SyncTopic   string
+	Deleted     bool
+	Suspension  *Suspension    // Only set if the account is suspended
+	Org         *OrgMembership // Only set if the user is a member of an organization
 }
 
 // TierID returns the ID of the User.Tier, or an empty string if the user has no tier,
@@ -34,6 +39,11 @@ func (u *User) TierID() string {
 	return u.Tier.ID
 }
 
+// IsSuspended returns true if the user's account is currently suspended
+func (u *User) IsSuspended() bool {
+	return u != nil && u.Suspension != nil && (u.Suspension.Until.Unix() == 0 || u.Suspension.Until.After(time.Now()))
+}
+
 // IsAdmin returns true if the user is an admin
 func (u *User) IsAdmin() bool {
 	return u != nil && u.Role == RoleAdmin
@@ -44,6 +54,71 @@ func (u *User) IsUser() bool {
 	return u != nil && u.Role == RoleUser
 }
 
+// Suspension describes the suspension of a user account, e.g. due to a terms of service violation
+type Suspension struct {
+	Since  time.Time
+	Until  time.Time // Suspension is lifted automatically at this time; zero Unix time means indefinitely
+	Reason string
+}
+
+// Org is an organization (team), which shares a tier and a Stripe subscription among its members, as well as a
+// set of centrally managed topics, see Manager.AddOrg
+type Org struct {
+	ID      string
+	Name    string
+	Tier    *Tier // May be nil
+	Billing *Billing
+	Created time.Time
+}
+
+// OrgRole is the role of a user within an organization
+type OrgRole string
+
+// Organization roles: owners and admins manage members, topics and billing; only owners can delete the organization
+const (
+	OrgRoleOwner  = OrgRole("owner")
+	OrgRoleAdmin  = OrgRole("admin")
+	OrgRoleMember = OrgRole("member")
+)
+
+// AllowedOrgRole returns true if the given role is a valid organization role
+func AllowedOrgRole(role OrgRole) bool {
+	return role == OrgRoleOwner || role == OrgRoleAdmin || role == OrgRoleMember
+}
+
+// IsOrgAdmin returns true if the role may manage the organization, i.e. if it is an owner or admin
+func (r OrgRole) IsOrgAdmin() bool {
+	return r == OrgRoleOwner || r == OrgRoleAdmin
+}
+
+// OrgMembership describes the organization a user belongs to, see User.Org
+type OrgMembership struct {
+	ID       string
+	Name     string
+	Role     OrgRole
+	UsesTier bool // True if the user has no tier of their own, and uses the organization's tier
+}
+
+// OrgMember is a member of an organization, see Manager.OrgMembers
+type OrgMember struct {
+	Username string
+	Role     OrgRole
+}
+
+// OrgInvite is a pending invite of a user to join an organization, see Manager.OrgInvites
+type OrgInvite struct {
+	ID   string
+	Name string
+	Role OrgRole
+}
+
+// OrgTopic is a topic reserved by an organization. Members have read-write access (owners and admins can also
+// manage it), everyone else has the Everyone permission.
+type OrgTopic struct {
+	Topic    string
+	Everyone Permission
+}
+
 // Auther is an interface for authentication and authorization
 type Auther interface {
 	// Authenticate checks username and password and returns a user if correct. The method
@@ -56,13 +131,97 @@ type Auther interface {
 	Authorize(user *User, topic string, perm Permission) error
 }
 
+// SigningKey is a server secret used to sign or verify requests (e.g. webhook signatures). Multiple keys of
+// the same purpose may be valid at the same time, so that keys can be rotated without downtime.
+type SigningKey struct {
+	ID      string // Key ID, e.g. sk_...
+	Purpose string // What the key is used for, e.g. stripe-webhook
+	Secret  string
+	Created time.Time
+	Expires time.Time // Set when the key is retired; zero Unix time means the key does not expire
+}
+
+// Usage is the usage of a user on a topic within a period, see Manager.EnqueueUsage and Manager.Usage
+type Usage struct {
+	Topic           string
+	Time            time.Time // Start of the period
+	Messages        int64     // Messages published
+	Emails          int64     // Emails sent
+	AttachmentBytes int64     // Size of uploaded attachments
+}
+
+type usageKey struct {
+	userID string
+	topic  string
+	bucket int64 // Unix time of the start of the hour
+}
+
+// Invite is an invite code that allows signing up if signup is restricted to invites. Users who sign up with
+// an invite are assigned to the invite's tier, if any.
+type Invite struct {
+	Code    string // Invite code, e.g. iv_...
+	Tier    string // Tier code, empty if users are not assigned to a tier
+	MaxUses int    // Max number of signups; zero means unlimited
+	Uses    int
+	Created time.Time
+	Expires time.Time // Zero Unix time means the invite does not expire
+}
+
 // Token represents a user token, including expiry date
 type Token struct {
-	Value      string
-	Label      string
-	LastAccess time.Time
-	LastOrigin netip.Addr
-	Expires    time.Time
+	Value            string
+	Label            string
+	Type             TokenType // What the token is used for; empty for tokens created before types were introduced
+	LastAccess       time.Time
+	LastOrigin       netip.Addr
+	Expires          time.Time
+	HardExpires      time.Time   // Expiry date that cannot be extended; zero Unix time means none
+	Scope            *TokenScope // Restricts what the token can be used for; nil means unrestricted
+	Created          time.Time   // Zero Unix time for tokens created before creation metadata was recorded
+	CreatedOrigin    netip.Addr
+	CreatedUserAgent string
+}
+
+// TokenType describes what a token is used for, so that users can tell their tokens apart
+type TokenType string
+
+// Token types
+const (
+	TokenTypeWeb         = TokenType("web")         // Web app session, created when logging in
+	TokenTypeCLI         = TokenType("cli")         // Created via the 'ntfy token' command
+	TokenTypeIntegration = TokenType("integration") // Created for scripts and other integrations, e.g. via the web app
+)
+
+// AllowedTokenType returns true if the given token type can be used for new tokens
+func AllowedTokenType(tokenType TokenType) bool {
+	return tokenType == TokenTypeWeb || tokenType == TokenTypeCLI || tokenType == TokenTypeIntegration
+}
+
+// TokenScope restricts a token to a maximum permission (e.g. publish-only), and optionally
+// to a list of topics. Scoped tokens cannot be used to manage the user's account.
+type TokenScope struct {
+	Permission Permission // Maximum permission the token grants, e.g. PermissionWrite for publish-only
+	Topics     []string   // Topic patterns (may include wildcards) the token is limited to; empty means all topics
+}
+
+// Allows returns true if the scope permits the given permission on the given topic. The
+// user's regular ACL entries are still checked separately.
+func (s *TokenScope) Allows(topic string, perm Permission) bool {
+	if s == nil {
+		return true
+	}
+	if !s.Permission.Allows(perm) {
+		return false
+	}
+	if len(s.Topics) == 0 {
+		return true
+	}
+	for _, pattern := range s.Topics {
+		if matched, _ := path.Match(pattern, topic); matched {
+			return true
+		}
+	}
+	return false
 }
 
 // TokenUpdate holds information about the last access time and origin IP address of a token
@@ -80,20 +239,24 @@ type Prefs struct {
 
 // Tier represents a user's account type, including its account limits
 type Tier struct {
-	ID                       string        // Tier identifier (ti_...)
-	Code                     string        // Code of the tier
-	Name                     string        // Name of the tier
-	MessageLimit             int64         // Daily message limit
-	MessageExpiryDuration    time.Duration // Cache duration for messages
-	EmailLimit               int64         // Daily email limit
-	CallLimit                int64         // Daily phone call limit
-	ReservationLimit         int64         // Number of topic reservations allowed by user
-	AttachmentFileSizeLimit  int64         // Max file size per file (bytes)
-	AttachmentTotalSizeLimit int64         // Total file size for all files of this user (bytes)
-	AttachmentExpiryDuration time.Duration // Duration after which attachments will be deleted
-	AttachmentBandwidthLimit int64         // Daily bandwidth limit for the user
-	StripeMonthlyPriceID     string        // Monthly price ID for paid tiers (price_...)
-	StripeYearlyPriceID      string        // Yearly price ID for paid tiers (price_...)
+	ID                             string        // Tier identifier (ti_...)
+	Code                           string        // Code of the tier
+	Name                           string        // Name of the tier
+	MessageLimit                   int64         // Daily message limit
+	MessageExpiryDuration          time.Duration // Cache duration for messages
+	EmailLimit                     int64         // Daily email limit
+	CallLimit                      int64         // Daily phone call limit
+	ReservationLimit               int64         // Number of topic reservations allowed by user
+	AttachmentFileSizeLimit        int64         // Max file size per file (bytes)
+	AttachmentTotalSizeLimit       int64         // Total file size for all files of this user (bytes)
+	AttachmentExpiryDuration       time.Duration // Duration after which attachments will be deleted
+	AttachmentBandwidthLimit       int64         // Daily bandwidth limit for the user
+	SubscriptionLimit              int64         // Number of simultaneous streaming connections (SSE/WS/...), 0 means server default
+	SubscriptionDurationLimit      time.Duration // Max. duration of a single streaming connection, 0 means server default
+	StripeMonthlyPriceID           string        // Monthly price ID for paid tiers (price_...)
+	StripeYearlyPriceID            string        // Yearly price ID for paid tiers (price_...)
+	StripeMeteredMessagesPriceID   string        // Metered (monthly) price ID for published messages, for pay-as-you-go tiers (price_...)
+	StripeMeteredAttachmentPriceID string        // Metered (monthly) price ID for uploaded attachment bytes, for pay-as-you-go tiers (price_...)
 }
 
 // Context returns fields for the log
@@ -108,9 +271,30 @@ func (t *Tier) Context() log.Context {
 
 // Subscription represents a user's topic subscription
 type Subscription struct {
-	BaseURL     string  `json:"base_url"`
-	Topic       string  `json:"topic"`
-	DisplayName *string `json:"display_name"`
+	BaseURL      string             `json:"base_url"`
+	Topic        string             `json:"topic"`
+	DisplayName  *string            `json:"display_name"`
+	Icon         *string            `json:"icon,omitempty"`        // Custom icon URL
+	MutedUntil   *int64             `json:"muted_until,omitempty"` // Unix timestamp; 0 = not muted, 1 = muted forever
+	SortOrder    *int               `json:"sort_order,omitempty"`
+	QuietHours   *QuietHours        `json:"quiet_hours,omitempty"`
+	Routing      *Routing           `json:"routing,omitempty"`      // Delivery channels that fire for the subscription
+	Notification *NotificationPrefs `json:"notification,omitempty"` // Overrides the account-wide notification settings
+	LastRead     *ReadMarker        `json:"last_read,omitempty"`    // Last message that was read on any device
+}
+
+// ReadMarker identifies the last message of a subscription that was read (or seen) on one of the user's devices.
+// Other devices mark all messages up to this message as read.
+type ReadMarker struct {
+	ID   string `json:"id"`   // Message ID
+	Time int64  `json:"time"` // Message time (Unix timestamp)
+}
+
+// After returns true if the marker points to a later message than the other marker (which may be nil). Read markers
+// only ever move forward, so that a device with an outdated state cannot mark messages as unread on other devices.
+// Since message IDs are random, markers with the same time are considered later, i.e. the last update wins.
+func (m *ReadMarker) After(other *ReadMarker) bool {
+	return other == nil || m.Time >= other.Time
 }
 
 // Context returns fields for the log
@@ -121,6 +305,117 @@ func (s *Subscription) Context() log.Context {
 	}
 }
 
+// QuietHours is a daily time window, in which Firebase and email deliveries of low-priority messages
+// for a subscription are held back, and summarized once the window ends
+type QuietHours struct {
+	Start    string `json:"start"`              // Local time, e.g. "22:00"
+	End      string `json:"end"`                // Local time, e.g. "07:00"; may be before Start to span midnight
+	Timezone string `json:"timezone,omitempty"` // IANA time zone, e.g. "Europe/Berlin"; defaults to UTC
+	Priority int    `json:"priority,omitempty"` // Messages up to this priority are held back; defaults to 3
+}
+
+// Valid returns true if start and end are valid times of the day (HH:MM), the time zone
+// exists, and the priority is between 0 (default) and 5
+func (q *QuietHours) Valid() bool {
+	start, errStart := parseTimeOfDay(q.Start)
+	end, errEnd := parseTimeOfDay(q.End)
+	if errStart != nil || errEnd != nil || start == end {
+		return false
+	} else if _, err := time.LoadLocation(q.Timezone); err != nil {
+		return false
+	}
+	return q.Priority >= 0 && q.Priority <= 5
+}
+
+// MaxPriority returns the highest priority that is held back during quiet hours
+func (q *QuietHours) MaxPriority() int {
+	if q.Priority == 0 {
+		return 3
+	}
+	return q.Priority
+}
+
+// Active returns true if the given time is within the quiet hours
+func (q *QuietHours) Active(now time.Time) bool {
+	start, end, local, err := q.parse(now)
+	if err != nil {
+		return false
+	}
+	minute := local.Hour()*60 + local.Minute()
+	if start < end {
+		return minute >= start && minute < end
+	}
+	return minute >= start || minute < end // Spans midnight
+}
+
+// NextEnd returns the next time the quiet hours end after the given time
+func (q *QuietHours) NextEnd(now time.Time) time.Time {
+	_, end, local, err := q.parse(now)
+	if err != nil {
+		return now
+	}
+	next := time.Date(local.Year(), local.Month(), local.Day(), end/60, end%60, 0, 0, local.Location())
+	if !next.After(local) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+func (q *QuietHours) parse(now time.Time) (start int, end int, local time.Time, err error) {
+	if start, err = parseTimeOfDay(q.Start); err != nil {
+		return 0, 0, now, err
+	} else if end, err = parseTimeOfDay(q.End); err != nil {
+		return 0, 0, now, err
+	}
+	location, err := time.LoadLocation(q.Timezone) // Empty string is UTC
+	if err != nil {
+		return 0, 0, now, err
+	}
+	return start, end, now.In(location), nil
+}
+
+// parseTimeOfDay parses a time of the day (HH:MM) and returns the minutes since midnight
+func parseTimeOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Delivery channels that can be enabled per subscription, see Routing
+const (
+	RoutingChannelPush  = "push"  // Firebase and web push notifications
+	RoutingChannelEmail = "email" // E-mails requested by the publisher
+)
+
+// Routing controls which delivery channels fire for a subscription, and for which messages. A subscription
+// without routing uses all channels the publisher asked for.
+type Routing struct {
+	Channels []string `json:"channels"`           // Enabled channels (RoutingChannelPush, ...); empty means none
+	Priority int      `json:"priority,omitempty"` // Channels only fire for messages of at least this priority; defaults to 1
+}
+
+// Valid returns true if all channels are known, and the priority is between 0 (default) and 5
+func (r *Routing) Valid() bool {
+	for _, channel := range r.Channels {
+		if channel != RoutingChannelPush && channel != RoutingChannelEmail {
+			return false
+		}
+	}
+	return r.Priority >= 0 && r.Priority <= 5
+}
+
+// Allows returns true if the given channel fires for a message with the given priority (1-5)
+func (r *Routing) Allows(channel string, priority int) bool {
+	for _, c := range r.Channels {
+		if c == channel {
+			return priority >= r.Priority
+		}
+	}
+	return false
+}
+
 // NotificationPrefs represents the user's notification settings
 type NotificationPrefs struct {
 	Sound       *string `json:"sound,omitempty"`
@@ -151,22 +446,99 @@ type Grant struct {
 	Allow        Permission
 }
 
+// MatchedEntry is the access control entry that applies to a topic, see Manager.Explain
+type MatchedEntry struct {
+	Username     string // User the entry belongs to, may be Everyone
+	TopicPattern string // May include wildcard (*)
+	Permission   Permission
+	Owner        string // Username of the owner of the topic, if the entry is part of a reservation
+}
+
+// DecisionReason describes which rule produced an authorization decision
+type DecisionReason string
+
+// Reasons for an authorization decision
+const (
+	DecisionTokenScope    = DecisionReason("token-scope")    // The scoped token does not allow the access
+	DecisionAdmin         = DecisionReason("admin")          // Admins can do everything
+	DecisionAccessEntry   = DecisionReason("access-entry")   // An access control entry (for the user or for everyone) matched
+	DecisionReservation   = DecisionReason("reservation")    // An access control entry of a reserved topic matched
+	DecisionDefaultAccess = DecisionReason("default-access") // No entry matched, the default access applies
+	DecisionOrg           = DecisionReason("org")            // The topic is reserved by an organization
+)
+
+// Decision is the result of evaluating a user's access to a topic, see Manager.Explain
+type Decision struct {
+	Allowed bool
+	Reason  DecisionReason
+	Entry   *MatchedEntry // Only set if the reason is DecisionAccessEntry or DecisionReservation
+}
+
 // Reservation is a struct that represents the ownership over a topic by a user
 type Reservation struct {
-	Topic    string
-	Owner    Permission
-	Everyone Permission
+	Topic      string
+	Owner      Permission
+	Everyone   Permission
+	EmailAlias string // Secret email alias, see Manager.SetReservationEmailAlias
+}
+
+// ReservationMember is a user that was granted access to a reserved topic by its owner, see Manager.AddReservationMember
+type ReservationMember struct {
+	Username   string
+	Permission Permission
+}
+
+// AccessList is a portable representation of the entire access control list (excluding entries
+// created by the server itself), see Manager.ExportAccess and Manager.ImportAccess. It is meant to
+// be stored as YAML or JSON, e.g. to manage permissions in version control.
+type AccessList struct {
+	Access       []AccessEntry      `json:"access" yaml:"access"`
+	Reservations []ReservationEntry `json:"reservations" yaml:"reservations"`
+}
+
+// AccessEntry is a single user-specific access control entry in an AccessList
+type AccessEntry struct {
+	User       string `json:"user" yaml:"user"`             // Username, or Everyone (*)
+	Topic      string `json:"topic" yaml:"topic"`           // May include wildcard (*)
+	Permission string `json:"permission" yaml:"permission"` // See ParsePermission
+}
+
+// ReservationEntry is a single reserved topic in an AccessList
+type ReservationEntry struct {
+	User     string `json:"user" yaml:"user"`         // Owner of the topic
+	Topic    string `json:"topic" yaml:"topic"`       // Topic name, no wildcards
+	Everyone string `json:"everyone" yaml:"everyone"` // Permission for everyone else, see ParsePermission
+}
+
+// AccessListChanges describes the differences between the current access control list and an
+// imported AccessList, see Manager.ImportAccess
+type AccessListChanges struct {
+	AccessAdded         []AccessEntry      `json:"access_added"`
+	AccessChanged       []AccessEntry      `json:"access_changed"`
+	AccessRemoved       []AccessEntry      `json:"access_removed"`
+	ReservationsAdded   []ReservationEntry `json:"reservations_added"`
+	ReservationsChanged []ReservationEntry `json:"reservations_changed"`
+	ReservationsRemoved []ReservationEntry `json:"reservations_removed"`
+}
+
+// Count returns the total number of changes
+func (c *AccessListChanges) Count() int {
+	return len(c.AccessAdded) + len(c.AccessChanged) + len(c.AccessRemoved) +
+		len(c.ReservationsAdded) + len(c.ReservationsChanged) + len(c.ReservationsRemoved)
 }
 
-// Permission represents a read or write permission to a topic
+// Permission represents a set of permissions to a topic, e.g. read, write, or manage
 type Permission uint8
 
-// Permissions to a topic
+// Permissions to a topic. Permissions are bit flags, and may be combined (see ParsePermission).
 const (
-	PermissionDenyAll Permission = iota
-	PermissionRead
-	PermissionWrite
-	PermissionReadWrite // 3!
+	PermissionDenyAll      Permission = 0
+	PermissionRead         Permission = 1 << 0                           // Subscribe to the topic
+	PermissionWrite        Permission = 1 << 1                           // Publish messages, including attachments
+	PermissionReadWrite               = PermissionRead | PermissionWrite // 3!
+	PermissionWriteNoCache Permission = 1 << 2                           // Publish messages, but only with "Cache: no"
+	PermissionAttach       Permission = 1 << 3                           // Upload attachments (implied by PermissionWrite)
+	PermissionManage       Permission = 1 << 4                           // Delete messages and mute senders
 )
 
 // NewPermission is a helper to create a Permission based on read/write bool values
@@ -181,20 +553,34 @@ func NewPermission(read, write bool) Permission {
 	return Permission(p)
 }
 
-// ParsePermission parses the string representation and returns a Permission
+// ParsePermission parses the string representation and returns a Permission. Permissions may be
+// combined with "+", e.g. "read-write+manage" or "read+write-no-cache+attach".
 func ParsePermission(s string) (Permission, error) {
-	switch strings.ToLower(s) {
-	case "read-write", "rw":
-		return NewPermission(true, true), nil
-	case "read-only", "read", "ro":
-		return NewPermission(true, false), nil
-	case "write-only", "write", "wo":
-		return NewPermission(false, true), nil
-	case "deny-all", "deny", "none":
-		return NewPermission(false, false), nil
-	default:
-		return NewPermission(false, false), errors.New("invalid permission")
+	parts := strings.Split(strings.ToLower(s), "+")
+	p := PermissionDenyAll
+	for _, part := range parts {
+		switch strings.TrimSpace(part) {
+		case "read-write", "rw":
+			p |= PermissionReadWrite
+		case "read-only", "read", "ro":
+			p |= PermissionRead
+		case "write-only", "write", "wo":
+			p |= PermissionWrite
+		case "write-no-cache", "publish-no-cache":
+			p |= PermissionWriteNoCache
+		case "attach":
+			p |= PermissionAttach
+		case "manage":
+			p |= PermissionManage
+		case "deny-all", "deny", "none":
+			if len(parts) > 1 {
+				return PermissionDenyAll, errors.New("invalid permission")
+			}
+		default:
+			return PermissionDenyAll, errors.New("invalid permission")
+		}
 	}
+	return p, nil
 }
 
 // IsRead returns true if readable
@@ -212,16 +598,58 @@ func (p Permission) IsReadWrite() bool {
 	return p.IsRead() && p.IsWrite()
 }
 
-// String returns a string representation of the permission
+// IsWriteNoCache returns true if messages may be published without caching them
+func (p Permission) IsWriteNoCache() bool {
+	return p&PermissionWriteNoCache != 0
+}
+
+// IsAttach returns true if attachments may be uploaded
+func (p Permission) IsAttach() bool {
+	return p&PermissionAttach != 0
+}
+
+// IsManage returns true if messages may be deleted, and senders may be muted
+func (p Permission) IsManage() bool {
+	return p&PermissionManage != 0
+}
+
+// Allows returns true if p includes all the given permissions, taking into account that the write
+// permission implies the weaker publish-only-no-cache and attach permissions
+func (p Permission) Allows(perm Permission) bool {
+	if p.IsWrite() {
+		p |= PermissionWriteNoCache | PermissionAttach
+	}
+	return p&perm == perm
+}
+
+// String returns a string representation of the permission. Read/write permissions are represented
+// using their legacy names (e.g. "read-write"), and any other permissions are appended with a "+".
 func (p Permission) String() string {
+	var base string
 	if p.IsReadWrite() {
-		return "read-write"
+		base = "read-write"
 	} else if p.IsRead() {
-		return "read-only"
+		base = "read-only"
 	} else if p.IsWrite() {
-		return "write-only"
+		base = "write-only"
+	}
+	parts := make([]string, 0)
+	if base != "" {
+		parts = append(parts, base)
+	}
+	if p.IsWriteNoCache() {
+		parts = append(parts, "write-no-cache")
+	}
+	if p.IsAttach() {
+		parts = append(parts, "attach")
+	}
+	if p.IsManage() {
+		parts = append(parts, "manage")
+	}
+	if len(parts) == 0 {
+		return "deny-all"
 	}
-	return "deny-all"
+	return strings.Join(parts, "+")
 }
 
 // Role represents a user's role, either admin or regular user
@@ -274,14 +702,26 @@ func AllowedTier(tier string) bool {
 
 // Error constants used by the package
 var (
-	ErrUnauthenticated     = errors.New("unauthenticated")
-	ErrUnauthorized        = errors.New("unauthorized")
-	ErrInvalidArgument     = errors.New("invalid argument")
-	ErrUserNotFound        = errors.New("user not found")
-	ErrUserExists          = errors.New("user already exists")
-	ErrTierNotFound        = errors.New("tier not found")
-	ErrTokenNotFound       = errors.New("token not found")
-	ErrPhoneNumberNotFound = errors.New("phone number not found")
-	ErrTooManyReservations = errors.New("new tier has lower reservation limit")
-	ErrPhoneNumberExists   = errors.New("phone number already exists")
+	ErrUnauthenticated      = errors.New("unauthenticated")
+	ErrUnauthorized         = errors.New("unauthorized")
+	ErrInvalidArgument      = errors.New("invalid argument")
+	ErrUserNotFound         = errors.New("user not found")
+	ErrUserExists           = errors.New("user already exists")
+	ErrTierNotFound         = errors.New("tier not found")
+	ErrTokenNotFound        = errors.New("token not found")
+	ErrPhoneNumberNotFound  = errors.New("phone number not found")
+	ErrTooManyReservations  = errors.New("new tier has lower reservation limit")
+	ErrPhoneNumberExists    = errors.New("phone number already exists")
+	ErrReservationNotFound  = errors.New("reservation not found")
+	ErrUserAccessExists     = errors.New("user already has access to topic")
+	ErrSigningKeyNotFound   = errors.New("signing key not found")
+	ErrTOTPNotEnabled       = errors.New("two-factor authentication not enabled")
+	ErrTOTPAlreadyEnabled   = errors.New("two-factor authentication already enabled")
+	ErrTOTPInvalidCode      = errors.New("invalid two-factor code")
+	ErrVerificationNotFound = errors.New("email verification not found or expired")
+	ErrInviteNotFound       = errors.New("invite not found, expired, or used up")
+	ErrOrgNotFound          = errors.New("organization not found")
+	ErrOrgMemberExists      = errors.New("user is already a member of another organization")
+	ErrOrgInviteNotFound    = errors.New("organization invite not found")
+	ErrOrgTopicNotFound     = errors.New("organization topic not found")
 )
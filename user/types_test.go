@@ -3,6 +3,7 @@ package user
 import (
 	"github.com/stretchr/testify/require"
 	"testing"
+	"time"
 )
 
 func TestPermission(t *testing.T) {
@@ -40,6 +41,75 @@ func TestParsePermission(t *testing.T) {
 	p, err = ParsePermission("deny-all")
 	require.Nil(t, err)
 	require.Equal(t, PermissionDenyAll, p)
+
+	p, err = ParsePermission("read-write+manage")
+	require.Nil(t, err)
+	require.Equal(t, PermissionReadWrite|PermissionManage, p)
+	require.Equal(t, "read-write+manage", p.String())
+
+	p, err = ParsePermission("read+write-no-cache+attach")
+	require.Nil(t, err)
+	require.Equal(t, PermissionRead|PermissionWriteNoCache|PermissionAttach, p)
+	require.Equal(t, "read-only+write-no-cache+attach", p.String())
+
+	p, err = ParsePermission("write-no-cache")
+	require.Nil(t, err)
+	require.Equal(t, "write-no-cache", p.String())
+
+	_, err = ParsePermission("rw+deny")
+	require.NotNil(t, err)
+	_, err = ParsePermission("rw+")
+	require.NotNil(t, err)
+}
+
+func TestPermission_Allows(t *testing.T) {
+	require.True(t, PermissionWrite.Allows(PermissionWriteNoCache))
+	require.True(t, PermissionWrite.Allows(PermissionAttach))
+	require.False(t, PermissionWrite.Allows(PermissionManage))
+	require.False(t, PermissionWriteNoCache.Allows(PermissionWrite))
+	require.False(t, PermissionWriteNoCache.Allows(PermissionAttach))
+	require.True(t, (PermissionWriteNoCache | PermissionAttach).Allows(PermissionAttach))
+	require.True(t, (PermissionRead | PermissionManage).Allows(PermissionManage))
+	require.False(t, PermissionRead.Allows(PermissionWriteNoCache))
+}
+
+func TestQuietHours(t *testing.T) {
+	q := &QuietHours{Start: "22:00", End: "07:00", Timezone: "UTC"}
+	require.True(t, q.Valid())
+	require.Equal(t, 3, q.MaxPriority())
+	require.True(t, q.Active(time.Date(2024, 1, 1, 23, 0, 0, 0, time.UTC)))
+	require.True(t, q.Active(time.Date(2024, 1, 1, 6, 59, 0, 0, time.UTC)))
+	require.False(t, q.Active(time.Date(2024, 1, 1, 7, 0, 0, 0, time.UTC)))
+	require.False(t, q.Active(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)))
+	require.Equal(t, time.Date(2024, 1, 2, 7, 0, 0, 0, time.UTC).Unix(), q.NextEnd(time.Date(2024, 1, 1, 23, 0, 0, 0, time.UTC)).Unix())
+	require.Equal(t, time.Date(2024, 1, 1, 7, 0, 0, 0, time.UTC).Unix(), q.NextEnd(time.Date(2024, 1, 1, 3, 0, 0, 0, time.UTC)).Unix())
+
+	q = &QuietHours{Start: "12:00", End: "13:30", Priority: 2}
+	require.True(t, q.Valid())
+	require.Equal(t, 2, q.MaxPriority())
+	require.True(t, q.Active(time.Date(2024, 1, 1, 13, 29, 0, 0, time.UTC)))
+	require.False(t, q.Active(time.Date(2024, 1, 1, 11, 59, 0, 0, time.UTC)))
+
+	require.False(t, (&QuietHours{Start: "22:00", End: "22:00"}).Valid())
+	require.False(t, (&QuietHours{Start: "22:00", End: "7"}).Valid())
+	require.False(t, (&QuietHours{Start: "22:00", End: "07:00", Timezone: "Mars/Olympus"}).Valid())
+	require.False(t, (&QuietHours{Start: "22:00", End: "07:00", Priority: 6}).Valid())
+}
+
+func TestRouting(t *testing.T) {
+	r := &Routing{Channels: []string{RoutingChannelPush}, Priority: 4}
+	require.True(t, r.Valid())
+	require.True(t, r.Allows(RoutingChannelPush, 4))
+	require.False(t, r.Allows(RoutingChannelPush, 3))
+	require.False(t, r.Allows(RoutingChannelEmail, 5))
+
+	r = &Routing{Channels: []string{}}
+	require.True(t, r.Valid())
+	require.False(t, r.Allows(RoutingChannelPush, 5))
+
+	require.True(t, (&Routing{Channels: []string{RoutingChannelPush, RoutingChannelEmail}}).Allows(RoutingChannelEmail, 1))
+	require.False(t, (&Routing{Channels: []string{"webhook"}}).Valid())
+	require.False(t, (&Routing{Priority: 6}).Valid())
 }
 
 func TestAllowedTier(t *testing.T) {
@@ -26,12 +26,8 @@ func (w *ContentTypeWriter) Write(p []byte) (n int, err error) {
 		return w.w.Write(p)
 	}
 	// Detect and set Content-Type header
-	// Fix content types that we don't want to inline-render in the browser. In particular,
-	// we don't want to render HTML in the browser for security reasons.
-	contentType, _ := DetectContentType(p, w.filename)
-	if strings.HasPrefix(contentType, "text/html") {
-		contentType = strings.ReplaceAll(contentType, "text/html", "text/plain")
-	} else if contentType == "application/octet-stream" {
+	contentType := SafeContentType(p, w.filename)
+	if contentType == "application/octet-stream" {
 		contentType = "" // Reset to let downstream http.ResponseWriter take care of it
 	}
 	if contentType != "" {
@@ -40,3 +36,14 @@ func (w *ContentTypeWriter) Write(p []byte) (n int, err error) {
 	w.sniffed = true
 	return w.w.Write(p)
 }
+
+// SafeContentType detects the content type of the given file content, like DetectContentType, but fixes content
+// types that we don't want to inline-render in the browser. In particular, we don't want to render HTML in the
+// browser for security reasons.
+func SafeContentType(b []byte, filename string) string {
+	contentType, _ := DetectContentType(b, filename)
+	if strings.HasPrefix(contentType, "text/html") {
+		contentType = strings.ReplaceAll(contentType, "text/html", "text/plain")
+	}
+	return contentType
+}
@@ -49,3 +49,61 @@ func (w *gzipResponseWriter) WriteHeader(status int) {
 func (w *gzipResponseWriter) Write(b []byte) (int, error) {
 	return w.Writer.Write(b)
 }
+
+// GzipStreamWriter is a http.ResponseWriter that compresses long-lived streams (e.g. JSON or SSE subscriptions)
+// using gzip. Unlike Gzip, it passes through flushes, so that every message reaches the client right away.
+// The Content-Encoding header is only set with the first write, so that errors before that are not compressed.
+type GzipStreamWriter struct {
+	w  http.ResponseWriter
+	gz *gzip.Writer
+}
+
+// NewGzipStreamWriter creates a new GzipStreamWriter. The caller must call Close after the last write.
+func NewGzipStreamWriter(w http.ResponseWriter) *GzipStreamWriter {
+	return &GzipStreamWriter{w: w}
+}
+
+// Header returns the header map of the underlying http.ResponseWriter
+func (w *GzipStreamWriter) Header() http.Header {
+	return w.w.Header()
+}
+
+// WriteHeader sends the HTTP response header with the given status code, see Write
+func (w *GzipStreamWriter) WriteHeader(status int) {
+	w.init()
+	w.w.WriteHeader(status)
+}
+
+// Write compresses and writes the given bytes. Compressed data may be buffered until the next Flush.
+func (w *GzipStreamWriter) Write(b []byte) (int, error) {
+	w.init()
+	return w.gz.Write(b)
+}
+
+// Flush writes all buffered data to the underlying http.ResponseWriter, and flushes it
+func (w *GzipStreamWriter) Flush() {
+	if w.gz != nil {
+		_ = w.gz.Flush()
+	}
+	if fl, ok := w.w.(http.Flusher); ok {
+		fl.Flush()
+	}
+}
+
+// Close writes the gzip footer, if anything was written
+func (w *GzipStreamWriter) Close() error {
+	if w.gz == nil {
+		return nil
+	}
+	return w.gz.Close()
+}
+
+func (w *GzipStreamWriter) init() {
+	if w.gz != nil {
+		return
+	}
+	w.w.Header().Set("Content-Encoding", "gzip")
+	w.w.Header().Add("Vary", "Accept-Encoding")
+	w.w.Header().Del("Content-Length")
+	w.gz, _ = gzip.NewWriterLevel(w.w, gzip.BestSpeed) // Only fails for invalid levels
+}
@@ -1,6 +1,7 @@
 package util
 
 import (
+	"bytes"
 	"compress/gzip"
 	"github.com/stretchr/testify/require"
 	"io"
@@ -38,3 +39,31 @@ func TestGzipHandler_NoGzip(t *testing.T) {
 	b, _ := io.ReadAll(rr.Body)
 	require.Equal(t, "This is a test file for embedfs_test.go\n", string(b))
 }
+
+func TestGzipStreamWriter(t *testing.T) {
+	rr := httptest.NewRecorder()
+	w := NewGzipStreamWriter(rr)
+	require.Equal(t, "", rr.Header().Get("Content-Encoding"))
+
+	// Every flush makes the written data readable by the client
+	_, err := w.Write([]byte("first line\n"))
+	require.Nil(t, err)
+	w.Flush()
+	require.Equal(t, "gzip", rr.Header().Get("Content-Encoding"))
+	require.True(t, rr.Flushed)
+	gz, err := gzip.NewReader(bytes.NewReader(rr.Body.Bytes()))
+	require.Nil(t, err)
+	line := make([]byte, 11)
+	_, err = io.ReadFull(gz, line)
+	require.Nil(t, err)
+	require.Equal(t, "first line\n", string(line))
+
+	_, err = w.Write([]byte("second line\n"))
+	require.Nil(t, err)
+	require.Nil(t, w.Close())
+	gz, err = gzip.NewReader(rr.Body)
+	require.Nil(t, err)
+	b, err := io.ReadAll(gz)
+	require.Nil(t, err)
+	require.Equal(t, "first line\nsecond line\n", string(b))
+}
@@ -0,0 +1,42 @@
+package util
+
+import (
+	"regexp"
+	"strconv"
+)
+
+var (
+	jsonFieldPathRegex     = regexp.MustCompile(`^(\$|\$?\.|\$?(\.[A-Za-z_][A-Za-z0-9_]*|\[\d+])+)$`)
+	jsonFieldPathPartRegex = regexp.MustCompile(`\.([A-Za-z_][A-Za-z0-9_]*)|\[(\d+)]`)
+)
+
+// ValidJSONFieldPath returns true if the given path is a valid JSON field path, as used by JSONField,
+// e.g. .temperature, $.sensors.humidity or .actions[0].url
+func ValidJSONFieldPath(path string) bool {
+	return jsonFieldPathRegex.MatchString(path)
+}
+
+// JSONField extracts a value from a decoded JSON document (as returned by json.Unmarshal into an "any") using
+// a simple jq-like or JSONPath-like field path, e.g. .temperature, $.sensors.humidity or .actions[0].url. The
+// paths "." and "$" return the entire document. It returns false if the field does not exist.
+func JSONField(value any, path string) (any, bool) {
+	for _, part := range jsonFieldPathPartRegex.FindAllStringSubmatch(path, -1) {
+		if part[1] != "" {
+			obj, ok := value.(map[string]any)
+			if !ok {
+				return nil, false
+			}
+			if value, ok = obj[part[1]]; !ok {
+				return nil, false
+			}
+		} else {
+			arr, ok := value.([]any)
+			index, err := strconv.Atoi(part[2])
+			if !ok || err != nil || index >= len(arr) {
+				return nil, false
+			}
+			value = arr[index]
+		}
+	}
+	return value, true
+}
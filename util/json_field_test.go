@@ -0,0 +1,45 @@
+package util
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSONField(t *testing.T) {
+	var doc any
+	require.Nil(t, json.Unmarshal([]byte(`{"temperature":21.5,"sensors":{"humidity":40},"actions":[{"url":"https://example.com"}],"empty":null}`), &doc))
+
+	value, ok := JSONField(doc, ".temperature")
+	require.True(t, ok)
+	require.Equal(t, 21.5, value)
+	value, ok = JSONField(doc, "$.sensors.humidity")
+	require.True(t, ok)
+	require.Equal(t, float64(40), value)
+	value, ok = JSONField(doc, ".actions[0].url")
+	require.True(t, ok)
+	require.Equal(t, "https://example.com", value)
+	value, ok = JSONField(doc, ".empty")
+	require.True(t, ok)
+	require.Nil(t, value)
+	value, ok = JSONField(doc, "$")
+	require.True(t, ok)
+	require.Equal(t, doc, value)
+
+	_, ok = JSONField(doc, ".actions[1].url")
+	require.False(t, ok)
+	_, ok = JSONField(doc, ".sensors.pressure")
+	require.False(t, ok)
+	_, ok = JSONField(doc, ".temperature.value")
+	require.False(t, ok)
+}
+
+func TestValidJSONFieldPath(t *testing.T) {
+	for _, path := range []string{".", "$", "$.temperature", ".a.b_c[0]", "$[1].x"} {
+		require.True(t, ValidJSONFieldPath(path), path)
+	}
+	for _, path := range []string{"", "temperature", "$temperature", ".a-b", ".a[x]", "..a", "$.a.", ".a b"} {
+		require.False(t, ValidJSONFieldPath(path), path)
+	}
+}
@@ -0,0 +1,324 @@
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"os"
+)
+
+// MaxMindDB is a minimal reader for MaxMind DB files (e.g. GeoLite2-Country.mmdb), as used to look up the country
+// of an IP address. The whole file is read into memory.
+//
+// The implementation follows https://maxmind.github.io/MaxMind-DB/
+type MaxMindDB struct {
+	data       []byte // Whole file
+	nodeCount  uint
+	recordSize uint // Bits per record: 24, 28 or 32
+	ipVersion  uint // 4 or 6
+	dataStart  uint // Offset of the data section
+	ipv4Start  uint // Node at which IPv4 lookups start in an IPv6 database
+}
+
+const (
+	maxMindDataSectionSeparator = 16
+	maxMindMaxDepth             = 32 // Max. nesting of maps/arrays/pointers, to guard against corrupt files
+)
+
+var (
+	// ErrMaxMindInvalidDatabase is returned if the file is not a valid MaxMind DB file
+	ErrMaxMindInvalidDatabase = errors.New("invalid MaxMind DB file")
+
+	maxMindMetadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+)
+
+// MaxMind DB data types, see https://maxmind.github.io/MaxMind-DB/#output-data-section
+const (
+	maxMindTypeExtended = iota
+	maxMindTypePointer
+	maxMindTypeString
+	maxMindTypeDouble
+	maxMindTypeBytes
+	maxMindTypeUint16
+	maxMindTypeUint32
+	maxMindTypeMap
+	maxMindTypeInt32
+	maxMindTypeUint64
+	maxMindTypeUint128
+	maxMindTypeArray
+	maxMindTypeContainer
+	maxMindTypeEndMarker
+	maxMindTypeBool
+	maxMindTypeFloat
+)
+
+// OpenMaxMindDB reads the given MaxMind DB file
+func OpenMaxMindDB(filename string) (*MaxMindDB, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return NewMaxMindDB(b)
+}
+
+// NewMaxMindDB parses the given MaxMind DB file contents
+func NewMaxMindDB(data []byte) (*MaxMindDB, error) {
+	markerIndex := bytes.LastIndex(data, maxMindMetadataMarker)
+	if markerIndex == -1 {
+		return nil, ErrMaxMindInvalidDatabase
+	}
+	metadataStart := uint(markerIndex + len(maxMindMetadataMarker))
+	d := &maxMindDecoder{data: data, base: metadataStart}
+	metadata, _, err := d.decode(metadataStart, 0)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := metadata.(map[string]any)
+	if !ok {
+		return nil, ErrMaxMindInvalidDatabase
+	}
+	nodeCount, ok1 := m["node_count"].(uint64)
+	recordSize, ok2 := m["record_size"].(uint64)
+	ipVersion, ok3 := m["ip_version"].(uint64)
+	if !ok1 || !ok2 || !ok3 || (recordSize != 24 && recordSize != 28 && recordSize != 32) || (ipVersion != 4 && ipVersion != 6) {
+		return nil, ErrMaxMindInvalidDatabase
+	}
+	db := &MaxMindDB{
+		data:       data,
+		nodeCount:  uint(nodeCount),
+		recordSize: uint(recordSize),
+		ipVersion:  uint(ipVersion),
+	}
+	searchTreeSize := db.nodeCount * db.recordSize * 2 / 8
+	db.dataStart = searchTreeSize + maxMindDataSectionSeparator
+	if db.dataStart > uint(markerIndex) {
+		return nil, ErrMaxMindInvalidDatabase
+	}
+	if db.ipVersion == 6 {
+		// IPv4 addresses are stored as ::a.b.c.d, i.e. after 96 zero bits
+		node := uint(0)
+		for i := 0; i < 96 && node < db.nodeCount; i++ {
+			node = db.record(node, 0)
+		}
+		db.ipv4Start = node
+	}
+	return db, nil
+}
+
+// Lookup returns the data for the given IP address (typically a map[string]any), or nil if there is none
+func (db *MaxMindDB) Lookup(ip netip.Addr) (any, error) {
+	ip = ip.Unmap()
+	var bits []byte
+	node := uint(0)
+	if ip.Is4() {
+		b := ip.As4()
+		bits = b[:]
+		if db.ipVersion == 6 {
+			node = db.ipv4Start
+		}
+	} else if db.ipVersion == 4 {
+		return nil, nil // IPv6 addresses cannot be looked up in an IPv4 database
+	} else {
+		b := ip.As16()
+		bits = b[:]
+	}
+	for i := 0; i < len(bits)*8 && node < db.nodeCount; i++ {
+		bit := (bits[i/8] >> (7 - i%8)) & 1
+		node = db.record(node, uint(bit))
+	}
+	if node == db.nodeCount {
+		return nil, nil // Not found
+	} else if node < db.nodeCount {
+		return nil, ErrMaxMindInvalidDatabase
+	}
+	offset := node - db.nodeCount - maxMindDataSectionSeparator + db.dataStart
+	d := &maxMindDecoder{data: db.data, base: db.dataStart}
+	value, _, err := d.decode(offset, 0)
+	return value, err
+}
+
+// Country returns the ISO code of the country of the given IP address (e.g. "DE"), or an empty string if unknown.
+// If the country is unknown, the registered country (e.g. of anycast addresses) is used.
+func (db *MaxMindDB) Country(ip netip.Addr) (string, error) {
+	value, err := db.Lookup(ip)
+	if err != nil {
+		return "", err
+	}
+	m, ok := value.(map[string]any)
+	if !ok {
+		return "", nil
+	}
+	for _, key := range []string{"country", "registered_country"} {
+		if country, ok := m[key].(map[string]any); ok {
+			if isoCode, ok := country["iso_code"].(string); ok && isoCode != "" {
+				return isoCode, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of the given node in the search tree
+func (db *MaxMindDB) record(node, bit uint) uint {
+	switch db.recordSize {
+	case 24:
+		offset := node*6 + bit*3
+		if offset+3 > uint(len(db.data)) {
+			return db.nodeCount
+		}
+		b := db.data[offset:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		offset := node * 7
+		if offset+7 > uint(len(db.data)) {
+			return db.nodeCount
+		}
+		b := db.data[offset:]
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default: // 32
+		offset := node*8 + bit*4
+		if offset+4 > uint(len(db.data)) {
+			return db.nodeCount
+		}
+		return uint(binary.BigEndian.Uint32(db.data[offset:]))
+	}
+}
+
+// maxMindDecoder decodes values in the data section (or the metadata section), whose pointers are relative to base
+type maxMindDecoder struct {
+	data []byte
+	base uint
+}
+
+// decode decodes the value at the given offset, and returns it along with the offset after the value
+func (d *maxMindDecoder) decode(offset uint, depth int) (any, uint, error) {
+	if depth > maxMindMaxDepth {
+		return nil, 0, ErrMaxMindInvalidDatabase
+	}
+	ctrl, offset, err := d.bytes(offset, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	typ := uint(ctrl[0] >> 5)
+	if typ == maxMindTypePointer {
+		return d.decodePointer(ctrl[0], offset, depth)
+	} else if typ == maxMindTypeExtended {
+		var ext []byte
+		if ext, offset, err = d.bytes(offset, 1); err != nil {
+			return nil, 0, err
+		}
+		typ = 7 + uint(ext[0])
+	}
+	size := uint(ctrl[0] & 0x1f)
+	if size >= 29 {
+		n := size - 28 // 1, 2 or 3 bytes
+		var b []byte
+		if b, offset, err = d.bytes(offset, n); err != nil {
+			return nil, 0, err
+		}
+		size = uint(0)
+		for _, c := range b {
+			size = size<<8 | uint(c)
+		}
+		size += [...]uint{29, 285, 65821}[n-1]
+	}
+	switch typ {
+	case maxMindTypeMap:
+		m := make(map[string]any, size)
+		for i := uint(0); i < size; i++ {
+			var key, value any
+			if key, offset, err = d.decode(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			k, ok := key.(string)
+			if !ok {
+				return nil, 0, ErrMaxMindInvalidDatabase
+			}
+			if value, offset, err = d.decode(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			m[k] = value
+		}
+		return m, offset, nil
+	case maxMindTypeArray:
+		a := make([]any, 0, min(size, 1024))
+		for i := uint(0); i < size; i++ {
+			var value any
+			if value, offset, err = d.decode(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			a = append(a, value)
+		}
+		return a, offset, nil
+	case maxMindTypeBool:
+		return size != 0, offset, nil
+	}
+	b, offset, err := d.bytes(offset, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch typ {
+	case maxMindTypeString:
+		return string(b), offset, nil
+	case maxMindTypeBytes:
+		return b, offset, nil
+	case maxMindTypeDouble:
+		if size != 8 {
+			return nil, 0, ErrMaxMindInvalidDatabase
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case maxMindTypeFloat:
+		if size != 4 {
+			return nil, 0, ErrMaxMindInvalidDatabase
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), offset, nil
+	case maxMindTypeUint16, maxMindTypeUint32, maxMindTypeUint64, maxMindTypeInt32:
+		if size > 8 {
+			return nil, 0, ErrMaxMindInvalidDatabase
+		}
+		var v uint64
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		if typ == maxMindTypeInt32 {
+			return int64(int32(v)), offset, nil
+		}
+		return v, offset, nil
+	case maxMindTypeUint128:
+		return b, offset, nil // Not needed, returned as raw bytes
+	default:
+		return nil, 0, fmt.Errorf("%w: unsupported data type %d", ErrMaxMindInvalidDatabase, typ)
+	}
+}
+
+// decodePointer follows a pointer, and returns the value it points to, along with the offset after the pointer
+func (d *maxMindDecoder) decodePointer(ctrl byte, offset uint, depth int) (any, uint, error) {
+	size := uint(ctrl>>3)&0x3 + 1
+	b, next, err := d.bytes(offset, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	var pointer uint
+	if size < 4 {
+		pointer = uint(ctrl & 0x7)
+	}
+	for _, c := range b {
+		pointer = pointer<<8 | uint(c)
+	}
+	pointer += [...]uint{0, 2048, 526336, 0}[size-1]
+	value, _, err := d.decode(d.base+pointer, depth+1)
+	return value, next, err
+}
+
+func (d *maxMindDecoder) bytes(offset, n uint) ([]byte, uint, error) {
+	if offset+n > uint(len(d.data)) || offset+n < offset {
+		return nil, 0, ErrMaxMindInvalidDatabase
+	}
+	return d.data[offset : offset+n], offset + n, nil
+}
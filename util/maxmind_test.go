@@ -0,0 +1,170 @@
+package util
+
+import (
+	"encoding/binary"
+	"github.com/stretchr/testify/require"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMaxMindDB_Country(t *testing.T) {
+	for _, ipVersion := range []int{4, 6} {
+		for _, recordSize := range []int{24, 28, 32} {
+			db, err := NewMaxMindDB(newTestMaxMindDB(ipVersion, recordSize, map[string]string{
+				"1.2.3.0/24":      "DE",
+				"5.6.0.0/16":      "US",
+				"9.9.9.9/32":      "registered:CH",
+				"2001:db8::/32":   "FR",
+				"2001:db9::1/128": "JP",
+			}))
+			require.Nil(t, err)
+			for ip, expected := range map[string]string{
+				"1.2.3.4":        "DE",
+				"1.2.3.255":      "DE",
+				"1.2.4.1":        "",
+				"5.6.7.8":        "US",
+				"::ffff:5.6.7.8": "US",
+				"9.9.9.9":        "CH",
+				"9.9.9.8":        "",
+				"2001:db8::1":    "FR",
+				"2001:db9::1":    "JP",
+				"2001:db9::2":    "",
+			} {
+				if ipVersion == 4 && netip.MustParseAddr(ip).Unmap().Is6() {
+					expected = "" // IPv6 networks are not in IPv4 databases
+				}
+				country, err := db.Country(netip.MustParseAddr(ip))
+				require.Nil(t, err)
+				require.Equal(t, expected, country, "ip %s, version %d, record size %d", ip, ipVersion, recordSize)
+			}
+		}
+	}
+}
+
+func TestMaxMindDB_Open(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "GeoLite2-Country.mmdb")
+	require.Nil(t, os.WriteFile(filename, newTestMaxMindDB(6, 24, map[string]string{"1.2.3.0/24": "DE"}), 0600))
+	db, err := OpenMaxMindDB(filename)
+	require.Nil(t, err)
+	country, err := db.Country(netip.MustParseAddr("1.2.3.4"))
+	require.Nil(t, err)
+	require.Equal(t, "DE", country)
+
+	_, err = OpenMaxMindDB(filepath.Join(t.TempDir(), "does-not-exist.mmdb"))
+	require.Error(t, err)
+}
+
+func TestMaxMindDB_Invalid(t *testing.T) {
+	_, err := NewMaxMindDB([]byte("not a database"))
+	require.Equal(t, ErrMaxMindInvalidDatabase, err)
+
+	// Truncated search tree
+	b := newTestMaxMindDB(6, 24, map[string]string{"1.2.3.0/24": "DE"})
+	_, err = NewMaxMindDB(b[100:])
+	require.Error(t, err)
+}
+
+// newTestMaxMindDB creates a MaxMind DB file with the given networks and countries. Countries prefixed with
+// "registered:" are stored as registered country instead of country.
+func newTestMaxMindDB(ipVersion, recordSize int, networks map[string]string) []byte {
+	type node struct {
+		children [2]int // 0 = empty, > 0 = node index, < 0 = -(data offset + 1)
+	}
+	nodes := []node{{}}
+	data := make([]byte, 0)
+	data = append(data, testMaxMindString("country")...) // Referenced via pointer below, at offset 0
+	for network, country := range networks {
+		key := []byte{0x20, 0} // Pointer to offset 0 ("country")
+		if registered, ok := strings.CutPrefix(country, "registered:"); ok {
+			key = testMaxMindString("registered_country")
+			country = registered
+		}
+		offset := len(data)
+		data = append(data, 0xe1) // Map with 1 entry
+		data = append(data, key...)
+		data = append(data, 0xe1)
+		data = append(data, testMaxMindString("iso_code")...)
+		data = append(data, testMaxMindString(country)...)
+
+		prefix := netip.MustParsePrefix(network)
+		addr, bits := prefix.Addr(), prefix.Bits()
+		var ip []byte
+		if ipVersion == 4 {
+			if !addr.Is4() {
+				continue
+			}
+			b := addr.As4()
+			ip = b[:]
+		} else {
+			if addr.Is4() {
+				bits += 96
+			}
+			b := addr.As16()
+			if addr.Is4() {
+				b = [16]byte{}
+				copy(b[12:], addr.AsSlice())
+			}
+			ip = b[:]
+		}
+		n := 0
+		for i := 0; i < bits; i++ {
+			bit := (ip[i/8] >> (7 - i%8)) & 1
+			if i == bits-1 {
+				nodes[n].children[bit] = -(offset + 1)
+				break
+			}
+			if nodes[n].children[bit] <= 0 {
+				nodes = append(nodes, node{})
+				nodes[n].children[bit] = len(nodes) - 1
+			}
+			n = nodes[n].children[bit]
+		}
+	}
+	nodeCount := len(nodes)
+	tree := make([]byte, 0)
+	for _, n := range nodes {
+		var records [2]uint32
+		for i, child := range n.children {
+			if child == 0 {
+				records[i] = uint32(nodeCount)
+			} else if child > 0 {
+				records[i] = uint32(child)
+			} else {
+				records[i] = uint32(nodeCount + 16 + (-child - 1))
+			}
+		}
+		switch recordSize {
+		case 24:
+			tree = append(tree, byte(records[0]>>16), byte(records[0]>>8), byte(records[0]))
+			tree = append(tree, byte(records[1]>>16), byte(records[1]>>8), byte(records[1]))
+		case 28:
+			tree = append(tree, byte(records[0]>>16), byte(records[0]>>8), byte(records[0]))
+			tree = append(tree, byte((records[0]>>20)&0xf0|(records[1]>>24)&0x0f))
+			tree = append(tree, byte(records[1]>>16), byte(records[1]>>8), byte(records[1]))
+		case 32:
+			tree = binary.BigEndian.AppendUint32(tree, records[0])
+			tree = binary.BigEndian.AppendUint32(tree, records[1])
+		}
+	}
+	b := append(tree, make([]byte, 16)...)
+	b = append(b, data...)
+	b = append(b, maxMindMetadataMarker...)
+	b = append(b, 0xe4) // Map with 4 entries
+	b = append(b, testMaxMindString("node_count")...)
+	b = append(b, 0xc4) // uint32, 4 bytes
+	b = binary.BigEndian.AppendUint32(b, uint32(nodeCount))
+	b = append(b, testMaxMindString("record_size")...)
+	b = append(b, 0xa2, 0, byte(recordSize)) // uint16, 2 bytes
+	b = append(b, testMaxMindString("ip_version")...)
+	b = append(b, 0xa1, byte(ipVersion)) // uint16, 1 byte
+	b = append(b, testMaxMindString("database_type")...)
+	b = append(b, testMaxMindString("Test-Country")...)
+	return b
+}
+
+func testMaxMindString(s string) []byte {
+	return append([]byte{0x40 | byte(len(s))}, s...) // Strings < 29 bytes only
+}
@@ -0,0 +1,118 @@
+package util
+
+import (
+	"sync"
+)
+
+// PriorityQueue is a bounded, blocking queue with a fixed number of priority levels. Elements with a higher priority
+// are dequeued first, and elements with the same priority are dequeued in the order they were enqueued.
+//
+// If the queue is full, enqueuing an element evicts the most recently enqueued element with the lowest priority,
+// but only if its priority is lower than the priority of the new element. Otherwise, the new element is dropped.
+// PriorityQueue may be used by multiple goroutines.
+type PriorityQueue[T any] struct {
+	levels   [][]T // Priority -> elements, oldest first
+	size     int
+	capacity int
+	closed   bool
+	done     chan struct{} // Closed when the queue is closed, see Done
+	cond     *sync.Cond
+	mu       sync.Mutex
+}
+
+// NewPriorityQueue creates a new PriorityQueue with priorities 0 to levels-1, holding at most capacity elements
+func NewPriorityQueue[T any](levels, capacity int) *PriorityQueue[T] {
+	q := &PriorityQueue[T]{
+		levels:   make([][]T, levels),
+		capacity: capacity,
+		done:     make(chan struct{}),
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// Enqueue adds an element with the given priority to the queue. Priorities outside of the queue's levels are
+// clamped. If an element had to be dropped because the queue is full (or closed), it returns the dropped element
+// (either an evicted element, or the given element itself) and true.
+func (q *PriorityQueue[T]) Enqueue(element T, priority int) (T, bool) {
+	priority = max(0, min(priority, len(q.levels)-1))
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return element, true
+	}
+	var dropped T
+	var isDropped bool
+	if q.size >= q.capacity {
+		lowest := q.lowest()
+		if lowest < 0 || lowest >= priority {
+			return element, true
+		}
+		last := len(q.levels[lowest]) - 1
+		dropped, isDropped = q.levels[lowest][last], true
+		q.levels[lowest] = q.levels[lowest][:last]
+		q.size--
+	}
+	q.levels[priority] = append(q.levels[priority], element)
+	q.size++
+	q.cond.Signal()
+	return dropped, isDropped
+}
+
+// Dequeue removes and returns the element with the highest priority, blocking until there is one. It returns
+// false if the queue was closed.
+func (q *PriorityQueue[T]) Dequeue() (T, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.size == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	var element T
+	if q.closed {
+		return element, false
+	}
+	for priority := len(q.levels) - 1; priority >= 0; priority-- {
+		if len(q.levels[priority]) > 0 {
+			element = q.levels[priority][0]
+			q.levels[priority] = q.levels[priority][1:]
+			q.size--
+			break
+		}
+	}
+	return element, true
+}
+
+// Len returns the number of elements in the queue
+func (q *PriorityQueue[T]) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.size
+}
+
+// Close closes the queue, and wakes up all goroutines waiting in Dequeue. Elements still in the queue are discarded.
+func (q *PriorityQueue[T]) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		close(q.done)
+	}
+	q.closed = true
+	q.levels = make([][]T, len(q.levels))
+	q.size = 0
+	q.cond.Broadcast()
+}
+
+// Done returns a channel that is closed when the queue is closed, e.g. to stop waiting before re-enqueuing an element
+func (q *PriorityQueue[T]) Done() <-chan struct{} {
+	return q.done
+}
+
+// lowest returns the lowest priority that has elements, or -1 if the queue is empty; must be called with the lock held
+func (q *PriorityQueue[T]) lowest() int {
+	for priority := range q.levels {
+		if len(q.levels[priority]) > 0 {
+			return priority
+		}
+	}
+	return -1
+}
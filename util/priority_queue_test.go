@@ -0,0 +1,84 @@
+package util
+
+import (
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPriorityQueue_Order(t *testing.T) {
+	q := NewPriorityQueue[string](6, 10)
+	q.Enqueue("low1", 1)
+	q.Enqueue("default1", 3)
+	q.Enqueue("urgent", 5)
+	q.Enqueue("default2", 3)
+	q.Enqueue("low2", 1)
+	q.Enqueue("clamped", 100) // Same as 5
+	require.Equal(t, 6, q.Len())
+
+	expected := []string{"urgent", "clamped", "default1", "default2", "low1", "low2"}
+	for _, e := range expected {
+		element, ok := q.Dequeue()
+		require.True(t, ok)
+		require.Equal(t, e, element)
+	}
+	require.Equal(t, 0, q.Len())
+}
+
+func TestPriorityQueue_Full(t *testing.T) {
+	q := NewPriorityQueue[string](6, 3)
+	_, dropped := q.Enqueue("low1", 1)
+	require.False(t, dropped)
+	q.Enqueue("low2", 1)
+	q.Enqueue("default", 3)
+
+	// Same or lower priority than the lowest element: the new element is dropped
+	element, dropped := q.Enqueue("low3", 1)
+	require.True(t, dropped)
+	require.Equal(t, "low3", element)
+
+	// Higher priority: the newest element with the lowest priority is evicted
+	element, dropped = q.Enqueue("urgent", 5)
+	require.True(t, dropped)
+	require.Equal(t, "low2", element)
+	require.Equal(t, 3, q.Len())
+
+	element, _ = q.Dequeue()
+	require.Equal(t, "urgent", element)
+	element, _ = q.Dequeue()
+	require.Equal(t, "default", element)
+	element, _ = q.Dequeue()
+	require.Equal(t, "low1", element)
+}
+
+func TestPriorityQueue_DequeueBlocksUntilEnqueueOrClose(t *testing.T) {
+	q := NewPriorityQueue[int](6, 10)
+	var wg sync.WaitGroup
+	results := make(chan bool, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, ok := q.Dequeue()
+			results <- ok
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	q.Enqueue(1, 3)
+	require.True(t, <-results)
+
+	select {
+	case <-q.Done():
+		t.Fatal("queue should not be done yet")
+	default:
+	}
+	q.Close()
+	wg.Wait()
+	require.False(t, <-results)
+	<-q.Done()
+	q.Close() // Closing twice is fine
+
+	_, dropped := q.Enqueue(2, 3)
+	require.True(t, dropped)
+}
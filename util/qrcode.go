@@ -0,0 +1,476 @@
+package util
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+)
+
+// QRCode is a QR code, encoded in byte mode with error correction level M. Only versions 1-10 are supported,
+// which is enough for up to 213 bytes (e.g. a URL with an access token).
+//
+// The implementation follows ISO/IEC 18004, see https://www.thonky.com/qr-code-tutorial/ for a readable introduction.
+type QRCode struct {
+	version  int
+	size     int
+	modules  [][]bool // [y][x], true is dark
+	function [][]bool // [y][x], true if the module is part of a function pattern (not data)
+}
+
+const (
+	qrVersionMax       = 10
+	qrQuietZoneModules = 4 // Light border around the code, required by the spec
+	qrFormatBitsM      = 0 // Error correction level M, see qrFormatBits
+)
+
+var (
+	// ErrQRCodeTooLong is returned if the text does not fit into a QR code of the supported versions
+	ErrQRCodeTooLong = errors.New("text too long for QR code")
+
+	// qrBlocks is the error correction block structure for level M, per version:
+	// EC codewords per block, number of blocks in group 1, data codewords per block in group 1, and group 2 blocks
+	// (which have one more data codeword than group 1)
+	qrBlocks = [qrVersionMax + 1]struct{ ec, blocks1, data1, blocks2 int }{
+		1:  {10, 1, 16, 0},
+		2:  {16, 1, 28, 0},
+		3:  {26, 1, 44, 0},
+		4:  {18, 2, 32, 0},
+		5:  {24, 2, 43, 0},
+		6:  {16, 4, 27, 0},
+		7:  {18, 4, 31, 0},
+		8:  {22, 2, 38, 2},
+		9:  {22, 3, 36, 2},
+		10: {26, 4, 43, 1},
+	}
+
+	// qrAlignmentPositions are the center coordinates of the alignment patterns, per version
+	qrAlignmentPositions = [qrVersionMax + 1][]int{
+		2:  {6, 18},
+		3:  {6, 22},
+		4:  {6, 26},
+		5:  {6, 30},
+		6:  {6, 34},
+		7:  {6, 22, 38},
+		8:  {6, 24, 42},
+		9:  {6, 26, 46},
+		10: {6, 28, 50},
+	}
+)
+
+// NewQRCode encodes the given text as a QR code, picking the smallest version that fits
+func NewQRCode(text string) (*QRCode, error) {
+	data := []byte(text)
+	for version := 1; version <= qrVersionMax; version++ {
+		if len(data) > qrCapacity(version) {
+			continue
+		}
+		q := &QRCode{
+			version: version,
+			size:    17 + 4*version,
+		}
+		q.modules = make([][]bool, q.size)
+		q.function = make([][]bool, q.size)
+		for y := range q.modules {
+			q.modules[y] = make([]bool, q.size)
+			q.function[y] = make([]bool, q.size)
+		}
+		q.drawFunctionPatterns()
+		q.drawCodewords(qrCodewords(version, data))
+		q.applyBestMask()
+		return q, nil
+	}
+	return nil, ErrQRCodeTooLong
+}
+
+// Size returns the number of modules per side, excluding the quiet zone
+func (q *QRCode) Size() int {
+	return q.size
+}
+
+// Dark returns true if the module at the given coordinates is dark
+func (q *QRCode) Dark(x, y int) bool {
+	return q.modules[y][x]
+}
+
+// PNG renders the QR code as a PNG image, with scale pixels per module, including the quiet zone
+func (q *QRCode) PNG(scale int) ([]byte, error) {
+	width := (q.size + 2*qrQuietZoneModules) * scale
+	img := image.NewPaletted(image.Rect(0, 0, width, width), color.Palette{color.White, color.Black})
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if !q.modules[y][x] {
+				continue
+			}
+			for dy := 0; dy < scale; dy++ {
+				for dx := 0; dx < scale; dx++ {
+					img.SetColorIndex((x+qrQuietZoneModules)*scale+dx, (y+qrQuietZoneModules)*scale+dy, 1)
+				}
+			}
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (q *QRCode) set(x, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.function[y][x] = true
+}
+
+func (q *QRCode) drawFunctionPatterns() {
+	for i := 0; i < q.size; i++ {
+		q.set(6, i, i%2 == 0) // Timing patterns
+		q.set(i, 6, i%2 == 0)
+	}
+	q.drawFinderPattern(3, 3)
+	q.drawFinderPattern(q.size-4, 3)
+	q.drawFinderPattern(3, q.size-4)
+	positions := qrAlignmentPositions[q.version]
+	last := len(positions) - 1
+	for i, x := range positions {
+		for j, y := range positions {
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue // Overlaps with finder patterns
+			}
+			q.drawAlignmentPattern(x, y)
+		}
+	}
+	q.drawFormatBits(0) // Reserve area, actual bits are drawn in applyBestMask
+	q.drawVersionBits()
+}
+
+func (q *QRCode) drawFinderPattern(cx, cy int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			x, y := cx+dx, cy+dy
+			if x < 0 || x >= q.size || y < 0 || y >= q.size {
+				continue
+			}
+			dist := max(abs(dx), abs(dy))
+			q.set(x, y, dist != 2 && dist != 4) // Includes the light separator
+		}
+	}
+}
+
+func (q *QRCode) drawAlignmentPattern(cx, cy int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			q.set(cx+dx, cy+dy, max(abs(dx), abs(dy)) != 1)
+		}
+	}
+}
+
+func (q *QRCode) drawFormatBits(mask int) {
+	bits := qrFormatBits(mask)
+	for i := 0; i <= 5; i++ {
+		q.set(8, i, qrBit(bits, i))
+	}
+	q.set(8, 7, qrBit(bits, 6))
+	q.set(8, 8, qrBit(bits, 7))
+	q.set(7, 8, qrBit(bits, 8))
+	for i := 9; i < 15; i++ {
+		q.set(14-i, 8, qrBit(bits, i))
+	}
+	for i := 0; i < 8; i++ {
+		q.set(q.size-1-i, 8, qrBit(bits, i))
+	}
+	for i := 8; i < 15; i++ {
+		q.set(8, q.size-15+i, qrBit(bits, i))
+	}
+	q.set(8, q.size-8, true) // Dark module
+}
+
+func (q *QRCode) drawVersionBits() {
+	if q.version < 7 {
+		return
+	}
+	bits := qrVersionBits(q.version)
+	for i := 0; i < 18; i++ {
+		a, b := q.size-11+i%3, i/3
+		q.set(a, b, qrBit(bits, i))
+		q.set(b, a, qrBit(bits, i))
+	}
+}
+
+// drawCodewords places the data in a zigzag pattern, in two-module wide columns from the bottom right
+func (q *QRCode) drawCodewords(data []byte) {
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5 // Skip vertical timing pattern
+		}
+		for vert := 0; vert < q.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = q.size - 1 - vert // Upwards
+				}
+				if !q.function[y][x] && i < len(data)*8 {
+					q.modules[y][x] = (data[i>>3]>>(7-(i&7)))&1 == 1
+					i++
+				}
+			}
+		}
+	}
+}
+
+func (q *QRCode) applyMask(mask int) {
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if !q.function[y][x] && qrMaskBit(mask, x, y) {
+				q.modules[y][x] = !q.modules[y][x]
+			}
+		}
+	}
+}
+
+// applyBestMask tries all eight masks, and applies the one with the lowest penalty
+func (q *QRCode) applyBestMask() {
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.drawFormatBits(mask)
+		if penalty := q.penalty(); bestPenalty < 0 || penalty < bestPenalty {
+			best, bestPenalty = mask, penalty
+		}
+		q.applyMask(mask) // Undo, masks are XOR
+	}
+	q.applyMask(best)
+	q.drawFormatBits(best)
+}
+
+// penalty scores the readability of the code, see ISO/IEC 18004, section 7.8.3
+func (q *QRCode) penalty() int {
+	penalty := 0
+	for i := 0; i < q.size; i++ {
+		penalty += q.linePenalty(func(j int) bool { return q.modules[i][j] }) // Rows
+		penalty += q.linePenalty(func(j int) bool { return q.modules[j][i] }) // Columns
+	}
+	dark := 0
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if q.modules[y][x] {
+				dark++
+			}
+			if x < q.size-1 && y < q.size-1 {
+				c := q.modules[y][x]
+				if c == q.modules[y][x+1] && c == q.modules[y+1][x] && c == q.modules[y+1][x+1] {
+					penalty += 3 // 2x2 blocks of the same color
+				}
+			}
+		}
+	}
+	total := q.size * q.size
+	k := (abs(dark*20-total*10)+total-1)/total - 1 // Deviation from 50% dark modules, in steps of 5%
+	return penalty + max(k, 0)*10
+}
+
+// linePenalty scores runs of five or more modules of the same color, and finder-like patterns in a row or column
+func (q *QRCode) linePenalty(module func(i int) bool) int {
+	penalty, run := 0, 0
+	for i := 0; i < q.size; i++ {
+		if i > 0 && module(i) == module(i-1) {
+			run++
+		} else {
+			run = 1
+		}
+		if run == 5 {
+			penalty += 3
+		} else if run > 5 {
+			penalty++
+		}
+	}
+	finder := []bool{true, false, true, true, true, false, true}
+	for i := 0; i+len(finder) <= q.size; i++ {
+		matches := true
+		for j, dark := range finder {
+			if module(i+j) != dark {
+				matches = false
+				break
+			}
+		}
+		if !matches {
+			continue
+		}
+		lightBefore, lightAfter := true, true
+		for j := 1; j <= 4; j++ {
+			lightBefore = lightBefore && (i-j < 0 || !module(i-j))
+			lightAfter = lightAfter && (i+6+j >= q.size || !module(i+6+j))
+		}
+		if lightBefore || lightAfter {
+			penalty += 40
+		}
+	}
+	return penalty
+}
+
+// qrCapacity returns the max. number of bytes that fit into a QR code of the given version
+func qrCapacity(version int) int {
+	b := qrBlocks[version]
+	dataBits := (b.blocks1*b.data1 + b.blocks2*(b.data1+1)) * 8
+	return (dataBits - 4 - qrCountBits(version)) / 8
+}
+
+func qrCountBits(version int) int {
+	if version < 10 {
+		return 8
+	}
+	return 16
+}
+
+// qrCodewords encodes the data in byte mode, splits it into blocks, adds the error correction codewords,
+// and interleaves the blocks
+func qrCodewords(version int, data []byte) []byte {
+	b := qrBlocks[version]
+	capacity := b.blocks1*b.data1 + b.blocks2*(b.data1+1)
+	var bits []bool
+	appendBits := func(value, n int) {
+		for i := n - 1; i >= 0; i-- {
+			bits = append(bits, (value>>i)&1 == 1)
+		}
+	}
+	appendBits(0b0100, 4) // Byte mode
+	appendBits(len(data), qrCountBits(version))
+	for _, c := range data {
+		appendBits(int(c), 8)
+	}
+	appendBits(0, min(4, capacity*8-len(bits))) // Terminator
+	appendBits(0, (8-len(bits)%8)%8)
+	codewords := make([]byte, 0, capacity)
+	for i := 0; i < len(bits); i += 8 {
+		var c byte
+		for j := 0; j < 8; j++ {
+			if bits[i+j] {
+				c |= 1 << (7 - j)
+			}
+		}
+		codewords = append(codewords, c)
+	}
+	for pad := byte(0xEC); len(codewords) < capacity; pad ^= 0xEC ^ 0x11 {
+		codewords = append(codewords, pad)
+	}
+	divisor := qrReedSolomonDivisor(b.ec)
+	dataBlocks, ecBlocks := make([][]byte, 0), make([][]byte, 0)
+	for i, offset := 0, 0; i < b.blocks1+b.blocks2; i++ {
+		n := b.data1
+		if i >= b.blocks1 {
+			n++
+		}
+		block := codewords[offset : offset+n]
+		dataBlocks = append(dataBlocks, block)
+		ecBlocks = append(ecBlocks, qrReedSolomonRemainder(block, divisor))
+		offset += n
+	}
+	result := make([]byte, 0)
+	for i := 0; i <= b.data1; i++ {
+		for _, block := range dataBlocks {
+			if i < len(block) {
+				result = append(result, block[i])
+			}
+		}
+	}
+	for i := 0; i < b.ec; i++ {
+		for _, block := range ecBlocks {
+			result = append(result, block[i])
+		}
+	}
+	return result
+}
+
+// qrReedSolomonDivisor returns the generator polynomial of the given degree, without the leading coefficient
+func qrReedSolomonDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := 0; j < degree; j++ {
+			result[j] = qrMultiply(result[j], root)
+			if j+1 < degree {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = qrMultiply(root, 0x02)
+	}
+	return result
+}
+
+// qrReedSolomonRemainder returns the error correction codewords for the given data
+func qrReedSolomonRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i := range result {
+			result[i] ^= qrMultiply(divisor[i], factor)
+		}
+	}
+	return result
+}
+
+// qrMultiply multiplies two elements of GF(2^8), modulo the QR code polynomial x^8 + x^4 + x^3 + x^2 + 1
+func qrMultiply(x, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>i)&1) * int(x)
+	}
+	return byte(z)
+}
+
+// qrFormatBits returns the 15-bit format information (error correction level and mask, with BCH code)
+func qrFormatBits(mask int) int {
+	data := qrFormatBitsM<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	return (data<<10 | rem) ^ 0x5412
+}
+
+// qrVersionBits returns the 18-bit version information (version, with BCH code), only used for versions >= 7
+func qrVersionBits(version int) int {
+	rem := version
+	for i := 0; i < 12; i++ {
+		rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+	}
+	return version<<12 | rem
+}
+
+func qrMaskBit(mask, x, y int) bool {
+	switch mask {
+	case 0:
+		return (x+y)%2 == 0
+	case 1:
+		return y%2 == 0
+	case 2:
+		return x%3 == 0
+	case 3:
+		return (x+y)%3 == 0
+	case 4:
+		return (x/3+y/2)%2 == 0
+	case 5:
+		return x*y%2+x*y%3 == 0
+	case 6:
+		return (x*y%2+x*y%3)%2 == 0
+	default:
+		return ((x+y)%2+x*y%3)%2 == 0
+	}
+}
+
+func qrBit(bits, i int) bool {
+	return (bits>>i)&1 == 1
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,103 @@
+package util
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/require"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func TestQRCode_ReedSolomon(t *testing.T) {
+	// "HELLO WORLD" as version 1-M, see https://www.thonky.com/qr-code-tutorial/error-correction-coding
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	ec := qrReedSolomonRemainder(data, qrReedSolomonDivisor(10))
+	require.Equal(t, []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}, ec)
+}
+
+func TestQRCode_FormatAndVersionBits(t *testing.T) {
+	// See https://www.thonky.com/qr-code-tutorial/format-version-tables
+	require.Equal(t, 0b101010000010010, qrFormatBits(0))
+	require.Equal(t, 0b100000011001110, qrFormatBits(5))
+	require.Equal(t, 0b000111110010010100, qrVersionBits(7))
+	require.Equal(t, 0b001010010011010011, qrVersionBits(10))
+}
+
+func TestQRCode_Versions(t *testing.T) {
+	remainderBits := map[int]int{1: 0, 2: 7, 3: 7, 4: 7, 5: 7, 6: 7, 7: 0, 8: 0, 9: 0, 10: 0}
+	for _, length := range []int{1, 14, 15, 26, 42, 62, 84, 106, 122, 152, 180, 213} {
+		q, err := NewQRCode(strings.Repeat("a", length))
+		require.Nil(t, err)
+
+		// All modules that are not function patterns are used for the data, except for the remainder bits
+		b := qrBlocks[q.version]
+		codewords := b.blocks1*b.data1 + b.blocks2*(b.data1+1) + (b.blocks1+b.blocks2)*b.ec
+		var dataModules int
+		for y := 0; y < q.size; y++ {
+			for x := 0; x < q.size; x++ {
+				if !q.function[y][x] {
+					dataModules++
+				}
+			}
+		}
+		require.Equal(t, codewords*8+remainderBits[q.version], dataModules, "version %d", q.version)
+		require.Equal(t, 17+4*q.version, q.Size())
+
+		// Finder patterns, timing patterns and the dark module
+		for _, corner := range [][2]int{{0, 0}, {q.size - 7, 0}, {0, q.size - 7}} {
+			require.True(t, q.Dark(corner[0], corner[1]))
+			require.False(t, q.Dark(corner[0]+1, corner[1]+1))
+			require.True(t, q.Dark(corner[0]+3, corner[1]+3))
+		}
+		for i := 8; i < q.size-8; i++ {
+			require.Equal(t, i%2 == 0, q.Dark(i, 6))
+			require.Equal(t, i%2 == 0, q.Dark(6, i))
+		}
+		require.True(t, q.Dark(8, q.size-8))
+	}
+	_, err := NewQRCode(strings.Repeat("a", 214))
+	require.Equal(t, ErrQRCodeTooLong, err)
+}
+
+func TestQRCode_FormatBitsMatchMask(t *testing.T) {
+	q, err := NewQRCode("ntfy://ntfy.sh/mytopic")
+	require.Nil(t, err)
+	require.Equal(t, 2, q.version)
+
+	// Read both copies of the format bits, and make sure they are the same, and describe level M
+	var bits1, bits2 int
+	positions1 := [][2]int{{8, 0}, {8, 1}, {8, 2}, {8, 3}, {8, 4}, {8, 5}, {8, 7}, {8, 8}, {7, 8}, {5, 8}, {4, 8}, {3, 8}, {2, 8}, {1, 8}, {0, 8}}
+	for i, p := range positions1 {
+		if q.Dark(p[0], p[1]) {
+			bits1 |= 1 << i
+		}
+	}
+	for i := 0; i < 8; i++ {
+		if q.Dark(q.size-1-i, 8) {
+			bits2 |= 1 << i
+		}
+	}
+	for i := 8; i < 15; i++ {
+		if q.Dark(8, q.size-15+i) {
+			bits2 |= 1 << i
+		}
+	}
+	require.Equal(t, bits1, bits2)
+	mask := ((bits1 ^ 0x5412) >> 10) & 0b111
+	require.Equal(t, qrFormatBits(mask), bits1)
+	require.Equal(t, qrFormatBitsM, (bits1^0x5412)>>13)
+}
+
+func TestQRCode_PNG(t *testing.T) {
+	q, err := NewQRCode("ntfy://ntfy.sh/mytopic")
+	require.Nil(t, err)
+	b, err := q.PNG(4)
+	require.Nil(t, err)
+	img, err := png.Decode(bytes.NewReader(b))
+	require.Nil(t, err)
+	require.Equal(t, (25+8)*4, img.Bounds().Dx())
+	r, _, _, _ := img.At(0, 0).RGBA()
+	require.Equal(t, uint32(0xffff), r) // Quiet zone
+	r, _, _, _ = img.At(16, 16).RGBA()
+	require.Equal(t, uint32(0), r) // Top left finder pattern
+}
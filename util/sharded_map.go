@@ -0,0 +1,130 @@
+package util
+
+import (
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+)
+
+// ShardedMap is a map with string keys that is split into a fixed number of shards, each guarded by its own lock.
+// Compared to a single map with a single lock, this reduces lock contention if the map is accessed by many
+// goroutines at once, e.g. on every publish and subscribe. ShardedMap may be used by multiple goroutines.
+//
+// Operations on a single key are atomic. Operations on the whole map (Len, Values, DeleteFunc) lock one shard
+// at a time, so they see a consistent view of each shard, but not necessarily of the whole map.
+type ShardedMap[V any] struct {
+	shards []*mapShard[V]
+	size   atomic.Int64
+}
+
+type mapShard[V any] struct {
+	entries map[string]V
+	mu      sync.RWMutex
+}
+
+// NewShardedMap creates a new ShardedMap with the given number of shards
+func NewShardedMap[V any](shards int) *ShardedMap[V] {
+	if shards < 1 {
+		shards = 1
+	}
+	m := &ShardedMap[V]{
+		shards: make([]*mapShard[V], shards),
+	}
+	for i := range m.shards {
+		m.shards[i] = &mapShard[V]{
+			entries: make(map[string]V),
+		}
+	}
+	return m
+}
+
+// Get returns the value for the given key, and whether it exists
+func (m *ShardedMap[V]) Get(key string) (V, bool) {
+	shard := m.shard(key)
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+	value, ok := shard.entries[key]
+	return value, ok
+}
+
+// GetOrCreate returns the value for the given key. If it does not exist, it is created using the create function,
+// which is called while holding the lock of the key's shard. If create returns an error, nothing is stored.
+func (m *ShardedMap[V]) GetOrCreate(key string, create func() (V, error)) (V, error) {
+	shard := m.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if value, ok := shard.entries[key]; ok {
+		return value, nil
+	}
+	value, err := create()
+	if err != nil {
+		return value, err
+	}
+	shard.entries[key] = value
+	m.size.Add(1)
+	return value, nil
+}
+
+// Set sets the value for the given key, replacing any existing value
+func (m *ShardedMap[V]) Set(key string, value V) {
+	shard := m.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if _, ok := shard.entries[key]; !ok {
+		m.size.Add(1)
+	}
+	shard.entries[key] = value
+}
+
+// Delete removes the given key from the map, if it exists
+func (m *ShardedMap[V]) Delete(key string) {
+	shard := m.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if _, ok := shard.entries[key]; ok {
+		delete(shard.entries, key)
+		m.size.Add(-1)
+	}
+}
+
+// DeleteFunc removes all entries for which the given function returns true, and returns the number of
+// removed entries. The function is called while holding the lock of the entry's shard.
+func (m *ShardedMap[V]) DeleteFunc(fn func(key string, value V) bool) int {
+	var deleted int
+	for _, shard := range m.shards {
+		shard.mu.Lock()
+		for key, value := range shard.entries {
+			if fn(key, value) {
+				delete(shard.entries, key)
+				m.size.Add(-1)
+				deleted++
+			}
+		}
+		shard.mu.Unlock()
+	}
+	return deleted
+}
+
+// Values returns a snapshot of all values in the map, in no particular order
+func (m *ShardedMap[V]) Values() []V {
+	values := make([]V, 0, m.Len())
+	for _, shard := range m.shards {
+		shard.mu.RLock()
+		for _, value := range shard.entries {
+			values = append(values, value)
+		}
+		shard.mu.RUnlock()
+	}
+	return values
+}
+
+// Len returns the number of entries in the map
+func (m *ShardedMap[V]) Len() int {
+	return int(m.size.Load())
+}
+
+func (m *ShardedMap[V]) shard(key string) *mapShard[V] {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return m.shards[h.Sum32()%uint32(len(m.shards))]
+}
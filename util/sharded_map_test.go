@@ -0,0 +1,117 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func TestShardedMap_GetSetDelete(t *testing.T) {
+	m := NewShardedMap[int](4)
+	_, ok := m.Get("a")
+	require.False(t, ok)
+
+	m.Set("a", 1)
+	m.Set("b", 2)
+	m.Set("a", 3) // Replace
+	value, ok := m.Get("a")
+	require.True(t, ok)
+	require.Equal(t, 3, value)
+	require.Equal(t, 2, m.Len())
+
+	m.Delete("a")
+	m.Delete("doesnotexist")
+	_, ok = m.Get("a")
+	require.False(t, ok)
+	require.Equal(t, 1, m.Len())
+}
+
+func TestShardedMap_GetOrCreate(t *testing.T) {
+	m := NewShardedMap[string](4)
+	value, err := m.GetOrCreate("a", func() (string, error) {
+		return "created", nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, "created", value)
+
+	value, err = m.GetOrCreate("a", func() (string, error) {
+		t.Fatal("must not be called for existing key")
+		return "", nil
+	})
+	require.Nil(t, err)
+	require.Equal(t, "created", value)
+
+	_, err = m.GetOrCreate("b", func() (string, error) {
+		return "", errors.New("failed")
+	})
+	require.Equal(t, "failed", err.Error())
+	_, ok := m.Get("b")
+	require.False(t, ok)
+	require.Equal(t, 1, m.Len())
+}
+
+func TestShardedMap_DeleteFuncValues(t *testing.T) {
+	m := NewShardedMap[int](8)
+	for i := 0; i < 100; i++ {
+		m.Set(fmt.Sprintf("key%d", i), i)
+	}
+	deleted := m.DeleteFunc(func(_ string, value int) bool {
+		return value%2 == 0
+	})
+	require.Equal(t, 50, deleted)
+	require.Equal(t, 50, m.Len())
+
+	values := m.Values()
+	sort.Ints(values)
+	require.Equal(t, 50, len(values))
+	require.Equal(t, 1, values[0])
+	require.Equal(t, 99, values[49])
+}
+
+func TestShardedMap_Concurrent(t *testing.T) {
+	m := NewShardedMap[int](16)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				key := fmt.Sprintf("key%d", j)
+				_, _ = m.GetOrCreate(key, func() (int, error) {
+					return j, nil
+				})
+				m.Get(key)
+				if i%5 == 0 {
+					m.Delete(key)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	require.Equal(t, len(m.Values()), m.Len())
+}
+
+func BenchmarkShardedMap_GetOrCreate(b *testing.B) {
+	for _, shards := range []int{1, 64} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			m := NewShardedMap[int](shards)
+			keys := make([]string, 10000)
+			for i := range keys {
+				keys[i] = fmt.Sprintf("topic%d", i)
+			}
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				var i int
+				for pb.Next() {
+					_, _ = m.GetOrCreate(keys[i%len(keys)], func() (int, error) {
+						return i, nil
+					})
+					i++
+				}
+			})
+		})
+	}
+}
@@ -10,6 +10,7 @@ var config = {
   app_root: "/",
   enable_login: true,
   enable_signup: true,
+  signup_mode: "open",
   enable_payments: false,
   enable_reservations: true,
   enable_emails: true,
@@ -18,4 +19,5 @@ var config = {
   billing_contact: "",
   web_push_public_key: "",
   disallowed_topics: ["docs", "static", "file", "app", "account", "settings", "signup", "login", "v1"],
+  banner: "",
 };
@@ -63,11 +63,12 @@ class AccountApi {
     });
   }
 
-  async create(username, password) {
+  async create(username, password, invite) {
     const url = accountUrl(config.base_url);
     const body = JSON.stringify({
       username,
       password,
+      invite,
     });
     console.log(`[AccountApi] Creating user account ${url}`);
     await fetchOrThrow(url, {
@@ -119,6 +120,7 @@ class AccountApi {
     const url = accountTokenUrl(config.base_url);
     const body = {
       label,
+      type: "integration",
       expires: expires > 0 ? Math.floor(Date.now() / 1000) + expires : 0,
     };
     console.log(`[AccountApi] Creating user access token ${url}`);
@@ -259,17 +261,17 @@ class AccountApi {
     return this.tiers;
   }
 
-  async createBillingSubscription(tier, interval) {
+  async createBillingSubscription(tier, interval, promotionCode) {
     console.log(`[AccountApi] Creating billing subscription with ${tier} and interval ${interval}`);
-    return this.upsertBillingSubscription("POST", tier, interval);
+    return this.upsertBillingSubscription("POST", tier, interval, promotionCode);
   }
 
-  async updateBillingSubscription(tier, interval) {
+  async updateBillingSubscription(tier, interval, promotionCode) {
     console.log(`[AccountApi] Updating billing subscription with ${tier} and interval ${interval}`);
-    return this.upsertBillingSubscription("PUT", tier, interval);
+    return this.upsertBillingSubscription("PUT", tier, interval, promotionCode);
   }
 
-  async upsertBillingSubscription(method, tier, interval) {
+  async upsertBillingSubscription(method, tier, interval, promotionCode) {
     const url = accountBillingSubscriptionUrl(config.base_url);
     const response = await fetchOrThrow(url, {
       method,
@@ -277,6 +279,7 @@ class AccountApi {
       body: JSON.stringify({
         tier,
         interval,
+        promotion_code: promotionCode || undefined,
       }),
     });
     return response.json(); // May throw SyntaxError
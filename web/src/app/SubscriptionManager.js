@@ -103,6 +103,14 @@ class SubscriptionManager {
           reservation, // May be null!
         });
 
+        if (remote.muted_until !== undefined && remote.muted_until !== local.mutedUntil) {
+          await this.setMutedUntil(local.id, remote.muted_until);
+        }
+
+        if (remote.last_read) {
+          await this.markNotificationsReadUntil(local.id, remote.last_read.time);
+        }
+
         return local.id;
       })
     );
@@ -232,6 +240,14 @@ class SubscriptionManager {
     await this.db.notifications.where({ subscriptionId, new: 1 }).modify({ new: 0 });
   }
 
+  /** Marks all notifications up to the given time as read, e.g. because they were read on another device */
+  async markNotificationsReadUntil(subscriptionId, time) {
+    await this.db.notifications
+      .where({ subscriptionId, new: 1 })
+      .and((n) => n.time <= time)
+      .modify({ new: 0 });
+  }
+
   async setMutedUntil(subscriptionId, mutedUntil) {
     await this.db.subscriptions.update(subscriptionId, {
       mutedUntil,
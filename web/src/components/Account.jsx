@@ -869,6 +869,12 @@ const TokensTable = (props) => {
             <TableCell aria-label={t("account_tokens_table_label_header")}>
               {token.token === session.token() && <em>{t("account_tokens_table_current_session")}</em>}
               {token.token !== session.token() && (token.label || "-")}
+              {token.type && (
+                <Typography variant="caption" color="text.secondary" component="div">
+                  {t(`account_tokens_table_type_${token.type}`)}
+                  {token.created > 0 && ` · ${t("account_tokens_table_created", { date: formatShortDateTime(token.created, i18n.language) })}`}
+                </Typography>
+              )}
             </TableCell>
             <TableCell sx={{ whiteSpace: "nowrap" }} aria-label={t("account_tokens_table_expires_header")}>
               {token.expires ? formatShortDateTime(token.expires, i18n.language) : <em>{t("account_tokens_table_never_expires")}</em>}
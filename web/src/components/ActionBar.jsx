@@ -103,6 +103,16 @@ const SettingsIcons = (props) => {
   const handleToggleMute = async () => {
     const mutedUntil = subscription.mutedUntil ? 0 : 1; // Make this a timestamp in the future
     await subscriptionManager.setMutedUntil(subscription.id, mutedUntil);
+    if (session.exists() && !subscription.internal) {
+      try {
+        await accountApi.updateSubscription(subscription.baseUrl, subscription.topic, {
+          display_name: subscription.displayName,
+          muted_until: mutedUntil,
+        });
+      } catch (e) {
+        console.log(`[ActionBar] Error updating subscription`, e);
+      }
+    }
   };
 
   return (
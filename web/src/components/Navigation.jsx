@@ -118,7 +118,10 @@ const NavList = (props) => {
   const showNotificationBrowserNotSupportedBox = !showNotificationIOSInstallRequired && !notifier.browserSupported();
   const showNotificationContextNotSupportedBox = notifier.browserSupported() && !notifier.contextSupported(); // Only show if notifications are generally supported in the browser
 
+  const showBanner = !!props.banner;
+
   const alertVisible =
+    showBanner ||
     showNotificationPermissionRequired ||
     showNotificationPermissionDenied ||
     showNotificationIOSInstallRequired ||
@@ -129,6 +132,7 @@ const NavList = (props) => {
     <>
       <Toolbar sx={{ display: { xs: "none", sm: "block" } }} />
       <List component="nav" sx={{ paddingTop: { xs: 0, sm: alertVisible ? 0 : "" } }}>
+        {showBanner && <BannerAlert message={props.banner} />}
         {showNotificationPermissionRequired && <NotificationPermissionRequired />}
         {showNotificationPermissionDenied && <NotificationPermissionDeniedAlert />}
         {showNotificationBrowserNotSupportedBox && <NotificationBrowserNotSupportedAlert />}
@@ -299,6 +303,19 @@ const SubscriptionItem = (props) => {
   const handleClick = async () => {
     navigate(routes.forSubscription(subscription));
     await subscriptionManager.markNotificationsRead(subscription.id);
+    if (session.exists() && !subscription.internal && subscription.new > 0) {
+      try {
+        const [last] = await subscriptionManager.getNotifications(subscription.id); // Newest first
+        if (last) {
+          await accountApi.updateSubscription(subscription.baseUrl, subscription.topic, {
+            display_name: subscription.displayName,
+            last_read: { id: last.id, time: last.time },
+          });
+        }
+      } catch (e) {
+        console.log(`[Navigation] Error updating subscription`, e);
+      }
+    }
   };
 
   return (
@@ -362,6 +379,16 @@ const SubscriptionItem = (props) => {
   );
 };
 
+const BannerAlert = (props) => {
+  const { t } = useTranslation();
+  return (
+    <Alert severity="info" sx={{ paddingTop: 2 }}>
+      <AlertTitle>{t("alert_banner_title")}</AlertTitle>
+      <Typography gutterBottom>{props.message}</Typography>
+    </Alert>
+  );
+};
+
 const NotificationPermissionRequired = () => {
   const { t } = useTranslation();
   const requestPermission = async () => {
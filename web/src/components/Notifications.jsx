@@ -248,7 +248,7 @@ const NotificationItem = (props) => {
   const showActions = hasAttachmentActions || hasClickAction || hasUserActions;
 
   return (
-    <Card sx={{ padding: 1 }} role="listitem" aria-label={t("notifications_list_item")}>
+    <Card sx={{ padding: 1 }} role="listitem" aria-label={notification.summary || t("notifications_list_item")}>
       <CardContent>
         <Tooltip title={t("notifications_delete")} enterDelay={500}>
           <IconButton onClick={handleDelete} sx={{ float: "right", marginRight: -1, marginTop: -1 }} aria-label={t("notifications_delete")}>
@@ -298,11 +298,23 @@ const NotificationItem = (props) => {
           {maybeActionErrors(notification)}
         </Typography>
         {attachment && <Attachment attachment={attachment} />}
+        {notification.embeds?.map((embed, index) => (
+          <Embed key={index} embed={embed} />
+        ))}
         {tags && (
           <Typography sx={{ fontSize: 14 }} color="text.secondary">
             {t("notifications_tags")}: {tags}
           </Typography>
         )}
+        {notification.publisher && (
+          <Typography sx={{ fontSize: 14 }} color="text.secondary">
+            {t("notifications_publisher", {
+              publisher: notification.publisher.token
+                ? `${notification.publisher.user} (${notification.publisher.token})`
+                : notification.publisher.user,
+            })}
+          </Typography>
+        )}
       </CardContent>
       {showActions && (
         <CardActions sx={{ paddingTop: 0 }}>
@@ -438,7 +450,7 @@ const Image = (props) => {
         component="img"
         src={props.attachment.url}
         loading="lazy"
-        alt={t("notifications_attachment_image")}
+        alt={props.attachment.alt || t("notifications_attachment_image")}
         onClick={() => setOpen(true)}
         sx={{
           marginTop: 2,
@@ -455,7 +467,7 @@ const Image = (props) => {
           <Box
             component="img"
             src={props.attachment.url}
-            alt={t("notifications_attachment_image")}
+            alt={props.attachment.alt || t("notifications_attachment_image")}
             loading="lazy"
             sx={{
               maxWidth: 1,
@@ -473,6 +485,53 @@ const Image = (props) => {
   );
 };
 
+const Embed = (props) => {
+  const { embed } = props;
+  return (
+    <Box
+      sx={{
+        marginTop: 2,
+        padding: 1.5,
+        borderRadius: "4px",
+        borderLeft: 4,
+        borderLeftColor: embed.color || "divider",
+        backgroundColor: "action.hover",
+      }}
+    >
+      {embed.title && (
+        <Typography variant="subtitle1" sx={{ fontWeight: 500 }}>
+          {embed.url ? (
+            <Link href={embed.url} target="_blank" rel="noopener" underline="hover">
+              {embed.title}
+            </Link>
+          ) : (
+            embed.title
+          )}
+        </Typography>
+      )}
+      {embed.description && (
+        <Typography variant="body2" sx={{ whiteSpace: "pre-line" }}>
+          {embed.description}
+        </Typography>
+      )}
+      {embed.fields?.length > 0 && (
+        <Box sx={{ display: "flex", flexWrap: "wrap", columnGap: 3, rowGap: 1, marginTop: 1 }}>
+          {embed.fields.map((field, index) => (
+            <Box key={index} sx={{ flexBasis: field.inline ? "auto" : "100%" }}>
+              <Typography variant="body2" sx={{ fontWeight: 500 }}>
+                {field.name}
+              </Typography>
+              <Typography variant="body2" sx={{ whiteSpace: "pre-line" }}>
+                {field.value}
+              </Typography>
+            </Box>
+          ))}
+        </Box>
+      )}
+    </Box>
+  );
+};
+
 const UserActions = (props) => (
   <>
     {props.notification.actions.map((action) => (
@@ -1,7 +1,7 @@
 import * as React from "react";
 import { useState } from "react";
 import { TextField, Button, Box, Typography, InputAdornment, IconButton } from "@mui/material";
-import { NavLink } from "react-router-dom";
+import { NavLink, useSearchParams } from "react-router-dom";
 import { useTranslation } from "react-i18next";
 import WarningAmberIcon from "@mui/icons-material/WarningAmber";
 import { Visibility, VisibilityOff } from "@mui/icons-material";
@@ -19,12 +19,15 @@ const Signup = () => {
   const [confirm, setConfirm] = useState("");
   const [showPassword, setShowPassword] = useState(false);
   const [showConfirm, setShowConfirm] = useState(false);
+  const [searchParams] = useSearchParams();
+  const [invite, setInvite] = useState(searchParams.get("invite") ?? "");
+  const inviteRequired = config.signup_mode === "invite";
 
   const handleSubmit = async (event) => {
     event.preventDefault();
     const user = { username, password };
     try {
-      await accountApi.create(user.username, user.password);
+      await accountApi.create(user.username, user.password, inviteRequired ? invite : undefined);
       const token = await accountApi.login(user);
       console.log(`[Signup] User signup for user ${user.username} successful, token is ${token}`);
       await session.store(user.username, token);
@@ -116,11 +119,23 @@ const Signup = () => {
             ),
           }}
         />
+        {inviteRequired && (
+          <TextField
+            margin="dense"
+            required
+            fullWidth
+            id="invite"
+            label={t("signup_form_invite")}
+            name="invite"
+            value={invite}
+            onChange={(ev) => setInvite(ev.target.value.trim())}
+          />
+        )}
         <Button
           type="submit"
           fullWidth
           variant="contained"
-          disabled={username === "" || password === "" || password !== confirm}
+          disabled={username === "" || password === "" || password !== confirm || (inviteRequired && invite === "")}
           sx={{ mt: 2, mb: 2 }}
         >
           {t("signup_form_button_submit")}
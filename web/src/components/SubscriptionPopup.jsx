@@ -150,6 +150,16 @@ export const SubscriptionPopup = (props) => {
 
   const handleSetMutedUntil = async (mutedUntil) => {
     await subscriptionManager.setMutedUntil(subscription.id, mutedUntil);
+    if (session.exists() && !subscription.internal) {
+      try {
+        await accountApi.updateSubscription(subscription.baseUrl, subscription.topic, {
+          display_name: subscription.displayName,
+          muted_until: mutedUntil,
+        });
+      } catch (e) {
+        console.log(`[SubscriptionPopup] Error updating subscription`, e);
+      }
+    }
   };
 
   const handleUnsubscribe = async () => {
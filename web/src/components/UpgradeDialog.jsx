@@ -21,6 +21,7 @@ import {
   Box,
   DialogContentText,
   DialogActions,
+  TextField,
   useTheme,
 } from "@mui/material";
 import { Trans, useTranslation } from "react-i18next";
@@ -68,6 +69,7 @@ const UpgradeDialog = (props) => {
   const [tiers, setTiers] = useState(null);
   const [interval, setInterval] = useState(account?.billing?.interval || SubscriptionInterval.YEAR);
   const [newTierCode, setNewTierCode] = useState(account?.tier?.code); // May be undefined
+  const [promotionCode, setPromotionCode] = useState("");
   const [loading, setLoading] = useState(false);
   const fullScreen = useMediaQuery(theme.breakpoints.down("sm"));
 
@@ -130,10 +132,10 @@ const UpgradeDialog = (props) => {
     try {
       setLoading(true);
       if (submitAction === Action.CREATE_SUBSCRIPTION) {
-        const response = await accountApi.createBillingSubscription(newTierCode, interval);
+        const response = await accountApi.createBillingSubscription(newTierCode, interval, promotionCode);
         window.location.href = response.redirect_url;
       } else if (submitAction === Action.UPDATE_SUBSCRIPTION) {
-        await accountApi.updateBillingSubscription(newTierCode, interval);
+        await accountApi.updateBillingSubscription(newTierCode, interval, promotionCode);
       } else if (submitAction === Action.CANCEL_SUBSCRIPTION) {
         await accountApi.deleteBillingSubscription();
       }
@@ -225,9 +227,23 @@ const UpgradeDialog = (props) => {
               selected={newTierCode === tier.code} // tier.code may be undefined!
               interval={interval}
               onClick={() => setNewTierCode(tier.code)} // tier.code may be undefined!
+              onDiscountClick={(code) => {
+                setNewTierCode(tier.code);
+                setPromotionCode(code);
+              }}
             />
           ))}
         </div>
+        {(submitAction === Action.CREATE_SUBSCRIPTION || submitAction === Action.UPDATE_SUBSCRIPTION) && (
+          <TextField
+            margin="dense"
+            label={t("account_upgrade_dialog_promotion_code_label")}
+            value={promotionCode}
+            onChange={(ev) => setPromotionCode(ev.target.value.trim())}
+            variant="standard"
+            sx={{ marginBottom: "8px" }}
+          />
+        )}
         {banner === Banner.CANCEL_WARNING && (
           <Alert severity="warning" sx={{ fontSize: "1rem" }}>
             <Trans
@@ -426,6 +442,24 @@ const TierCard = (props) => {
                 })}
               </Typography>
             )}
+            {tier.discounts?.map((discount) => (
+              <Chip
+                key={discount.code}
+                label={
+                  discount.percent_off
+                    ? t("account_upgrade_dialog_tier_discount_percent", { percent: discount.percent_off, code: discount.code })
+                    : t("account_upgrade_dialog_tier_discount_amount", { amount: formatPrice(discount.amount_off), code: discount.code })
+                }
+                color="primary"
+                size="small"
+                variant="outlined"
+                onClick={(ev) => {
+                  ev.stopPropagation();
+                  props.onDiscountClick(discount.code);
+                }}
+                sx={{ marginTop: "5px", marginRight: "5px" }}
+              />
+            ))}
           </CardContent>
         </CardActionArea>
       </Card>
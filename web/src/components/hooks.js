@@ -22,7 +22,7 @@ import prefs from "../app/Prefs";
  * will be delivered via Web Push. However, we still need to connect to other servers via WebSocket, or for internal
  * topics, such as sync topics (st_...).
  */
-export const useConnectionListeners = (account, subscriptions, users, webPushTopics) => {
+export const useConnectionListeners = (account, subscriptions, users, webPushTopics, onBannerChange) => {
   const wsSubscriptions = useMemo(
     () => (subscriptions && webPushTopics ? subscriptions.filter((s) => !webPushTopics.includes(s.topic)) : []),
     // wsSubscriptions should stay stable unless the list of subscription IDs changes. Without the memo, the connection
@@ -41,6 +41,9 @@ export const useConnectionListeners = (account, subscriptions, users, webPushTop
           if (data.event === "sync") {
             console.log(`[ConnectionListener] Triggering account sync`);
             await accountApi.sync();
+          } else if (data.event === "banner") {
+            console.log(`[ConnectionListener] Updating banner`);
+            onBannerChange(data.banner || "");
           } else {
             console.log(`[ConnectionListener] Unknown message type. Doing nothing.`);
           }